@@ -0,0 +1,269 @@
+// Copyright 2023 Hedgehog
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+
+	"go.githedgehog.com/dasboot/pkg/cliflags"
+	"go.githedgehog.com/dasboot/pkg/devid"
+	"go.githedgehog.com/dasboot/pkg/log"
+	"go.githedgehog.com/dasboot/pkg/net"
+	"go.githedgehog.com/dasboot/pkg/seeder/ipam"
+	"go.githedgehog.com/dasboot/pkg/stage"
+	"go.githedgehog.com/dasboot/pkg/version"
+
+	"github.com/urfave/cli/v2"
+	"go.uber.org/zap"
+)
+
+var description = `
+ipam-client sends an IPAM request to a seeder exactly like stage 0 does it,
+and prints the request and the response as JSON to stdout. It is meant for
+network engineers to debug the reachability of a seeder and its IPAM
+responses without running a full installation.
+
+All values of the request default to what stage 0 would send from the device
+where it is running on, and every one of them can be overridden. If the IPAM
+URL is on a link-local IPv6 address, the same interface selection as in
+stage 0 applies: the interface of the ONIE exec URL is reused if it is on a
+link-local address as well, otherwise the request is tried on all interfaces.
+
+Log messages are written to stderr, so the output can be piped to tools
+like jq:
+
+ipam-client --url https://[fe80::1]/stage0/ipam --server-ca ca.pem | jq .
+`
+
+const (
+	flagURL                   = "url"
+	flagServerCA              = "server-ca"
+	flagSignatureCA           = "signature-ca"
+	flagInsecureSkipVerify    = "insecure-skip-verify"
+	flagDevID                 = "devid"
+	flagArch                  = "arch"
+	flagLocationUUID          = "location-uuid"
+	flagLocationUUIDSignature = "location-uuid-signature"
+	flagInterface             = "interface"
+	flagExecURL               = "exec-url"
+	flagNonce                 = "nonce"
+)
+
+// output is what gets printed to stdout
+type output struct {
+	Request *ipam.Request  `json:"request"`
+	Netdev  string         `json:"netdev,omitempty"`
+	Netdevs []string       `json:"netdevs"`
+	Elapsed string         `json:"elapsed"`
+	Resp    *ipam.Response `json:"response"`
+}
+
+func main() {
+	app := &cli.App{
+		Name:        "ipam-client",
+		Usage:       "IPAM request debugging tool",
+		UsageText:   "ipam-client --url <ipam-url> [--server-ca <path> | --insecure-skip-verify] [options]",
+		Description: description[1 : len(description)-1],
+		Version:     version.Version,
+		Flags: append(cliflags.LogFlags(),
+			&cli.StringFlag{
+				Name:     flagURL,
+				Usage:    "IPAM URL of the seeder as it is embedded in stage 0",
+				Required: true,
+			},
+			&cli.PathFlag{
+				Name:  flagServerCA,
+				Usage: "path to the PEM or DER encoded server CA of the seeder",
+			},
+			&cli.PathFlag{
+				Name:  flagSignatureCA,
+				Usage: "path to the PEM or DER encoded config signature CA to verify the response signature with",
+			},
+			&cli.BoolFlag{
+				Name:  flagInsecureSkipVerify,
+				Usage: "skips the verification of the server certificate if no server CA is available",
+			},
+			&cli.StringFlag{
+				Name:  flagDevID,
+				Usage: "device ID to send (default: the device ID of this device)",
+			},
+			&cli.StringFlag{
+				Name:  flagArch,
+				Usage: "architecture to send (default: the architecture of this device)",
+			},
+			&cli.StringFlag{
+				Name:  flagLocationUUID,
+				Usage: "location UUID to send",
+			},
+			&cli.StringFlag{
+				Name:  flagLocationUUIDSignature,
+				Usage: "base64 encoded signature of the location UUID",
+			},
+			&cli.StringSliceFlag{
+				Name:  flagInterface,
+				Usage: "network interfaces to send, can be passed multiple times (default: all capable interfaces of this device)",
+			},
+			&cli.StringFlag{
+				Name:    flagExecURL,
+				Usage:   "ONIE exec URL from which stage 0 was downloaded",
+				EnvVars: []string{"onie_exec_url"},
+			},
+			&cli.StringFlag{
+				Name:  flagNonce,
+				Usage: "nonce of a previous response to request the same addresses again",
+			},
+		),
+		Action: run,
+	}
+
+	if err := app.Run(os.Args); err != nil {
+		fmt.Fprintf(os.Stderr, "FATAL: ipam-client failed: %s\n", err)
+		os.Exit(1)
+	}
+}
+
+func run(c *cli.Context) error {
+	if err := stage.InitializeGlobalLogger(c.Context, cliflags.LogSettings(c)); err != nil {
+		return err
+	}
+	l := log.L()
+
+	req, err := buildRequest(c)
+	if err != nil {
+		return err
+	}
+
+	hc, err := buildHTTPClient(c)
+	if err != nil {
+		return err
+	}
+
+	// the ONIE environment is only used to determine the interface for link-local IPAM URLs
+	onieEnv := stage.GetOnieEnv()
+	onieEnv.ExecURL = c.String(flagExecURL)
+
+	l.Info("Sending IPAM request", zap.String("url", c.String(flagURL)), zap.Reflect("ipamRequest", req))
+	start := time.Now()
+	resp, netdev, err := ipam.DoLinkLocalRequest(c.Context, l, hc, c.String(flagURL), req, onieEnv)
+	elapsed := time.Since(start)
+	if err != nil {
+		return fmt.Errorf("IPAM request: %w", err)
+	}
+
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(&output{
+		Request: req,
+		Netdev:  netdev,
+		Netdevs: resp.Netdevs(),
+		Elapsed: elapsed.String(),
+		Resp:    resp,
+	})
+}
+
+func buildRequest(c *cli.Context) (*ipam.Request, error) {
+	req := &ipam.Request{
+		Arch:         c.String(flagArch),
+		DevID:        c.String(flagDevID),
+		LocationUUID: c.String(flagLocationUUID),
+		Interfaces:   c.StringSlice(flagInterface),
+		Nonce:        c.String(flagNonce),
+	}
+	if req.Arch == "" {
+		req.Arch = stage.Arch()
+	}
+	if req.DevID == "" {
+		req.DevID = devid.ID()
+	}
+	if sig := c.String(flagLocationUUIDSignature); sig != "" {
+		var err error
+		req.LocationUUIDSignature, err = base64.StdEncoding.DecodeString(sig)
+		if err != nil {
+			return nil, fmt.Errorf("decoding location UUID signature: %w", err)
+		}
+	}
+	if len(req.Interfaces) == 0 {
+		var err error
+		req.Interfaces, err = net.GetInterfaces()
+		if err != nil {
+			return nil, fmt.Errorf("retrieving network interface list: %w", err)
+		}
+	}
+
+	// fail early and with the same error as the seeder would
+	if err := req.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid IPAM request: %w", err)
+	}
+	return req, nil
+}
+
+func buildHTTPClient(c *cli.Context) (*http.Client, error) {
+	var hc *http.Client
+	switch {
+	case c.Path(flagServerCA) != "":
+		serverCA, err := readCertificate(c.Path(flagServerCA))
+		if err != nil {
+			return nil, fmt.Errorf("server CA: %w", err)
+		}
+		hc, err = stage.SeederHTTPClient(serverCA, nil, stage.HTTPClientOptionServerCertificateIgnoreExpiryTime)
+		if err != nil {
+			return nil, fmt.Errorf("building HTTP client: %w", err)
+		}
+	case c.Bool(flagInsecureSkipVerify):
+		hc = &http.Client{
+			Transport: &http.Transport{
+				Proxy:           http.ProxyFromEnvironment,
+				TLSClientConfig: &tls.Config{InsecureSkipVerify: true}, //nolint:gosec
+			},
+		}
+	default:
+		return nil, fmt.Errorf("either --%s or --%s is required", flagServerCA, flagInsecureSkipVerify)
+	}
+
+	if path := c.Path(flagSignatureCA); path != "" {
+		der, err := readCertificate(path)
+		if err != nil {
+			return nil, fmt.Errorf("config signature CA: %w", err)
+		}
+		signatureCACert, err := x509.ParseCertificate(der)
+		if err != nil {
+			return nil, fmt.Errorf("parsing config signature CA: %w", err)
+		}
+		signatureCAPool := x509.NewCertPool()
+		signatureCAPool.AddCert(signatureCACert)
+		stage.WithResponseSignatureVerification(hc, signatureCAPool)
+	}
+	return hc, nil
+}
+
+// readCertificate reads a DER encoded certificate from a PEM or DER encoded file
+func readCertificate(path string) ([]byte, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if block, _ := pem.Decode(b); block != nil {
+		return block.Bytes, nil
+	}
+	return b, nil
+}
@@ -55,10 +55,12 @@ func main() {
 	var probeAddr string
 	var keyPath string
 	var certPath string
+	var requireApproval bool
 	flag.StringVar(&metricsAddr, "metrics-bind-address", ":8080", "The address the metric endpoint binds to.")
 	flag.StringVar(&probeAddr, "health-probe-bind-address", ":8081", "The address the probe endpoint binds to.")
 	flag.StringVar(&keyPath, "key-path", "/etc/registration-controller/ca/key.pem", "The path to the PEM encodeded signing key (CA) for requests.")
 	flag.StringVar(&certPath, "cert-path", "/etc/registration-controller/ca/cert.pem", "The path to the PEM encoded certificate (CA) which signs requests.")
+	flag.BoolVar(&requireApproval, "require-approval", false, "Only issue certificates for device registrations which have been approved.")
 	flag.BoolVar(&enableLeaderElection, "leader-elect", false,
 		"Enable leader election for controller manager. "+
 			"Enabling this will ensure there is only one active controller manager.")
@@ -109,6 +111,8 @@ func main() {
 		Scheme: mgr.GetScheme(),
 		Key:    key,
 		Cert:   cert,
+
+		RequireApproval: requireApproval,
 	}).SetupWithManager(mgr); err != nil {
 		setupLog.Error(err, "unable to create controller", "controller", "Frigate")
 		os.Exit(1)
@@ -19,11 +19,19 @@ import (
 	"fmt"
 	"os"
 
+	"go.githedgehog.com/dasboot/pkg/banner"
+	"go.githedgehog.com/dasboot/pkg/partitions"
+	config0 "go.githedgehog.com/dasboot/pkg/stage0/config"
+	"go.uber.org/zap"
 	"gopkg.in/yaml.v3"
 )
 
 // Config is passed to a seeder instance. It will initialize the seeder based on this configuration.
 type Config struct {
+	// Version is the version of the configuration format. Configuration files of older versions
+	// can be upgraded with `seeder migrate`.
+	Version int `json:"version" yaml:"version"`
+
 	// Servers holds all HTTP server settings
 	Servers *Servers `json:"servers,omitempty" yaml:"servers,omitempty"`
 
@@ -39,6 +47,29 @@ type Config struct {
 	RegistrySettings *RegistrySettings `json:"registry_settings,omitempty" yaml:"registry_settings,omitempty"`
 
 	ArtifactProviders *ArtifactProviders `json:"artifact_providers,omitempty" yaml:"artifact_providers,omitempty"`
+
+	// Limits are the request body and artifact size limits, and the download concurrency limits of the seeder.
+	Limits *Limits `json:"limits,omitempty" yaml:"limits,omitempty"`
+
+	// LogShipping enables devices to upload their logs to the seeder for post-mortem analysis.
+	LogShipping *LogShipping `json:"log_shipping,omitempty" yaml:"log_shipping,omitempty"`
+
+	// DiagnosticsUploads enables devices to upload large diagnostic files like core dumps to the seeder.
+	DiagnosticsUploads *DiagnosticsUploads `json:"diagnostics_uploads,omitempty" yaml:"diagnostics_uploads,omitempty"`
+
+	// IPAMLeases are the settings for the addresses which are being reserved for devices during their installations.
+	IPAMLeases *IPAMLeases `json:"ipam_leases,omitempty" yaml:"ipam_leases,omitempty"`
+
+	// Revocation are the settings for checking client certificates on the secure server for revocation.
+	Revocation *Revocation `json:"revocation,omitempty" yaml:"revocation,omitempty"`
+
+	// LabMode is an INSECURE mode for throwaway lab environments: the secure server may run without TLS, and an
+	// ephemeral CA replaces all keys and certificates which are not configured. Never use this anywhere else.
+	LabMode bool `json:"lab_mode,omitempty" yaml:"lab_mode,omitempty"`
+
+	// DrainTimeout is the time that the seeder waits on shutdown for in-flight artifact downloads to finish
+	// before it cuts them off, e.g. "5m".
+	DrainTimeout string `json:"drain_timeout,omitempty" yaml:"drain_timeout,omitempty"`
 }
 
 type Servers struct {
@@ -49,11 +80,25 @@ type Servers struct {
 	// ServerSecure will instantiate a secure server if it is not nil. The secure server serves all artifacts
 	// which must be served over a secure connection.
 	ServerSecure *BindInfo `json:"secure,omitempty" yaml:"secure,omitempty"`
+
+	// ServerAdmin will instantiate an admin server if it is not nil. The admin server serves administrative
+	// routes like per-device artifact overrides. It must only be reachable from trusted networks.
+	ServerAdmin *BindInfo `json:"admin,omitempty" yaml:"admin,omitempty"`
+
+	// ServerMetrics will instantiate a metrics server if it is not nil. The metrics server serves Prometheus
+	// metrics at /metrics.
+	ServerMetrics *BindInfo `json:"metrics,omitempty" yaml:"metrics,omitempty"`
 }
 
 type InsecureServer struct {
 	DynLL   *DynLL    `json:"dynll,omitempty" yaml:"dynll,omitempty"`
 	Generic *BindInfo `json:"generic,omitempty" yaml:"generic,omitempty"`
+
+	// ONIEDiscovery enables the ONIE discovery responder which serves stage 0 on all the ONIE default installer
+	// file names (e.g. "onie-installer-x86_64-accton_as7726_32x-r0.bin"). This allows to use existing DHCP/ZTP
+	// environments which point ONIE at this server without having to reconfigure them. A platform specific stage 0
+	// build like "stage0-x86_64-accton_as7726_32x-r0" takes precedence over the architecture specific one.
+	ONIEDiscovery bool `json:"onie_discovery,omitempty" yaml:"onie_discovery,omitempty"`
 }
 
 // DynLL holds configuration for the dynamic linklocal insecure server listeners configuration. This mode allows
@@ -123,6 +168,15 @@ type InstallerSettings struct {
 	// alternative way.
 	ServerCAPath string `json:"server_ca,omitempty" yaml:"server_ca,omitempty"`
 
+	// ServerCABundlePath points to a file containing all CA certificates which clients should trust for the seeder.
+	// This is for rotations of the server CA: during the transition window it holds the old and the new CA, and
+	// afterwards only the new one. It must include the CA from `ServerCAPath`.
+	ServerCABundlePath string `json:"server_ca_bundle,omitempty" yaml:"server_ca_bundle,omitempty"`
+
+	// ServerCABundleVersion is the version of the server CA bundle. It must be increased whenever the bundle changes,
+	// as clients never go back to an older version than the one which they pinned.
+	ServerCABundleVersion uint64 `json:"server_ca_bundle_version,omitempty" yaml:"server_ca_bundle_version,omitempty"`
+
 	// ConfigSignatureCAPath points to a file containing the CA certificate which signed the signature certificate
 	// which is used to sign the embedded configuration which is served with every staged installer.
 	ConfigSignatureCAPath string `json:"config_signature_ca,omitempty" yaml:"config_signature_ca,omitempty"`
@@ -132,14 +186,163 @@ type InstallerSettings struct {
 	// different port it needs to be included here (e.g. dasboot.example.com:8080).
 	SecureServerName string `json:"secure_server_name,omitempty" yaml:"secure_server_name,omitempty"`
 
+	// MirrorServerNames are additional host names of seeders which serve the same artifacts, e.g. the other
+	// control nodes. Devices get artifact URLs for all of them, rank them by latency, and fall back to the
+	// next one if a download fails. They must match the TLS SAN for the server certificates as well.
+	MirrorServerNames []string `json:"mirror_server_names,omitempty" yaml:"mirror_server_names,omitempty"`
+
 	// ControlVIP is the virtual IP of where to reach the control network services
 	ControlVIP string `json:"control_vip,omitempty" yaml:"control_vip,omitempty"`
 
+	// ControlVIPv6 is the IPv6 virtual IP of where to reach the control network services. Management links with IPv6
+	// addresses use it if ControlVIP is an IPv4 address, which is what IPv6-only provisioning requires.
+	ControlVIPv6 string `json:"control_vip_v6,omitempty" yaml:"control_vip_v6,omitempty"`
+
+	// FabricName is the name of the fabric which is part of the metadata that devices get about themselves
+	FabricName string `json:"fabric_name,omitempty" yaml:"fabric_name,omitempty"`
+
 	// NTPServers are the NTP servers which will be configured on clients at installation time
 	NTPServers []string `json:"ntp_servers,omitempty" yaml:"ntp_servers,omitempty"`
 
+	// NTPMaxOffset is the maximum clock offset as a duration like "24h" which clients accept from a single NTP
+	// query round. Larger offsets must be confirmed by a second round before the clock gets set.
+	NTPMaxOffset string `json:"ntp_max_offset,omitempty" yaml:"ntp_max_offset,omitempty"`
+
+	// LLDPWait is the time as a duration like "35s" which clients listen for LLDP neighbours before they request their
+	// IP addresses. The seeder finds devices without location information by their LLDP neighbours.
+	LLDPWait string `json:"lldp_wait,omitempty" yaml:"lldp_wait,omitempty"`
+
 	// SyslogServers are the syslog servers which will be configured on clients at installation time
 	SyslogServers []string `json:"syslog_servers,omitempty" yaml:"syslog_servers,omitempty"`
+
+	// SyslogFraming is the framing which the syslog servers expect: "non-transparent" (default) or "octet-counting"
+	SyslogFraming string `json:"syslog_framing,omitempty" yaml:"syslog_framing,omitempty"`
+
+	// SyslogTransport is the transport to the syslog servers: "udp" (default), "tcp" or "tcp+tls"
+	SyslogTransport string `json:"syslog_transport,omitempty" yaml:"syslog_transport,omitempty"`
+
+	// SyslogCAPath is the path to a PEM encoded CA bundle with which devices validate the syslog servers over TLS.
+	// If it is empty, devices use their system CAs.
+	SyslogCAPath string `json:"syslog_ca_path,omitempty" yaml:"syslog_ca_path,omitempty"`
+
+	// DNSServers are the DNS servers which will be configured on clients at installation time
+	DNSServers []string `json:"dns_servers,omitempty" yaml:"dns_servers,omitempty"`
+
+	// DNSSearchDomains are the DNS search domains which will be configured on clients at installation time
+	DNSSearchDomains []string `json:"dns_search_domains,omitempty" yaml:"dns_search_domains,omitempty"`
+
+	// DiagBootBeforeInstall instructs stage 2 to boot into the vendor diagnostics OS once before installing the NOS.
+	// The installation resumes automatically when the device falls back into ONIE after the diagnostics run.
+	DiagBootBeforeInstall bool `json:"diag_boot_before_install,omitempty" yaml:"diag_boot_before_install,omitempty"`
+
+	// EncryptIdentityPartition instructs stage 1 to create the identity partition of new devices as a LUKS container.
+	// The keys are derived from the TPM and from the location partition, so the private keys are protected at rest.
+	EncryptIdentityPartition bool `json:"encrypt_identity_partition,omitempty" yaml:"encrypt_identity_partition,omitempty"`
+
+	// IdentityBackups instructs stage 1 to upload an encrypted backup of the device identity to the control plane,
+	// and to restore it from there when the identity partition of a registered device was lost (e.g. a replaced SSD).
+	IdentityBackups bool `json:"identity_backups,omitempty" yaml:"identity_backups,omitempty"`
+
+	// Banner is operator information (operator name, environment, support contact, change ticket, message) which
+	// is being handed out to devices, and which stage 0 prints on the console and to syslog
+	Banner *banner.Banner `json:"banner,omitempty" yaml:"banner,omitempty"`
+
+	// MTU is the MTU which will be configured on the control network interface of clients at installation time.
+	// If this is 0, the default MTU of the interface is being used.
+	MTU int `json:"mtu,omitempty" yaml:"mtu,omitempty"`
+
+	// RequireProvenance instructs clients to only run stage artifacts which come with a signed artifact
+	// provenance which matches the downloaded artifact. This requires the config signature CA to be set.
+	RequireProvenance bool `json:"require_provenance,omitempty" yaml:"require_provenance,omitempty"`
+
+	// RequireManifest instructs clients to only run stage artifacts which the seeder verified against the
+	// signed artifact manifest. This requires RequireProvenance and the artifact manifest to be set.
+	RequireManifest bool `json:"require_manifest,omitempty" yaml:"require_manifest,omitempty"`
+
+	// MACAllowlists are the MAC addresses which the port security of the fabric allows during provisioning.
+	// They are keyed by the ONIE management MAC address of a device, and map VLAN IDs to the allowlisted MAC address
+	// for that VLAN. The VLAN ID 0 stands for the untagged network interface.
+	MACAllowlists map[string]map[uint16]string `json:"mac_allowlists,omitempty" yaml:"mac_allowlists,omitempty"`
+
+	// RecoveryMaxConsecutiveFailures is the number of consecutive failed installations after which a device stops
+	// retrying and enters recovery mode. Zero disables recovery mode.
+	RecoveryMaxConsecutiveFailures uint `json:"recovery_max_consecutive_failures,omitempty" yaml:"recovery_max_consecutive_failures,omitempty"`
+
+	// RecoveryAction is the action a device takes when it enters recovery mode: "stop" (the default) stops the
+	// ONIE discovery, and "rescue" additionally boots ONIE into rescue mode.
+	RecoveryAction string `json:"recovery_action,omitempty" yaml:"recovery_action,omitempty"`
+
+	// GPTAttributes are GPT partition attributes which stage 2 sets after the NOS installation. They are keyed by
+	// the ONIE platform (or "*" for all platforms) and then by the GPT partition name. The attributes are either
+	// "required", "no_block_io", "legacy_bios_bootable" or a bit number.
+	GPTAttributes map[string]map[string][]string `json:"gpt_attributes,omitempty" yaml:"gpt_attributes,omitempty"`
+
+	// PreserveNOSConfig is the policy for reinstallations of already provisioned devices: it lists the files of the
+	// existing NOS configuration which stage 2 backs up before the reinstallation, and restores for the new NOS to
+	// migrate on its first boot. It is keyed by device ID (or "*" for all devices), and the paths are relative to
+	// /etc/sonic, e.g. "config_db.json" or "frr". An empty list for a device disables it for that device.
+	PreserveNOSConfig map[string][]string `json:"preserve_nos_config,omitempty" yaml:"preserve_nos_config,omitempty"`
+
+	// DisableDiscardPlatforms lists the ONIE platforms (or "*" for all platforms) on which stage 2 must not discard the
+	// blocks which it skips when it writes artifacts to flash media. This is for platforms with broken discard support.
+	DisableDiscardPlatforms []string `json:"disable_discard_platforms,omitempty" yaml:"disable_discard_platforms,omitempty"`
+
+	// Staging holds the settings for the staging area which stage 0 creates on the devices. The defaults are
+	// unsuitable for platforms with a tiny /tmp or little memory.
+	Staging *config0.Staging `json:"staging,omitempty" yaml:"staging,omitempty"`
+
+	// MultipathPolicy decides how the stages treat dm-multipath devices when they discover disks: "prefer" (the
+	// default) works with the multipath maps and ignores the paths underneath them, "exclude" ignores both, and
+	// "ignore" disables the multipath awareness.
+	MultipathPolicy string `json:"multipath_policy,omitempty" yaml:"multipath_policy,omitempty"`
+
+	// DiskSelection selects the disk for the NOS and the identity partition on devices with more than one disk.
+	// By default, this is the disk which holds the ONIE partition.
+	DiskSelection *partitions.DiskSelectionPolicy `json:"disk_selection,omitempty" yaml:"disk_selection,omitempty"`
+
+	// DHCPFallback lets stage 0 fall back to DHCP on its network interfaces if it does not get anywhere with IPAM.
+	// This only helps in management networks with a DHCP server which hands out addresses from which the seeder is reachable.
+	DHCPFallback bool `json:"dhcp_fallback,omitempty" yaml:"dhcp_fallback,omitempty"`
+
+	// Proxy holds the HTTP proxy settings which are handed out to devices. All stages use them for their HTTP clients,
+	// and they are part of the first-boot payload of the Hedgehog agent.
+	Proxy *config0.Proxy `json:"proxy,omitempty" yaml:"proxy,omitempty"`
+
+	// MaintenanceWindows restrict when devices may start an installation. They are keyed by device ID (or "*" for all
+	// devices). Outside of its windows a device gets told to retry later. An empty list for a device lifts the restriction.
+	MaintenanceWindows map[string][]MaintenanceWindow `json:"maintenance_windows,omitempty" yaml:"maintenance_windows,omitempty"`
+
+	// CompatibilityMatrix lists which versions of the DAS BOOT stages, the Hedgehog agent and the NOS work together.
+	// The seeder refuses to serve combinations of versions which match none of its entries.
+	CompatibilityMatrix []Compatibility `json:"compatibility_matrix,omitempty" yaml:"compatibility_matrix,omitempty"`
+}
+
+// Compatibility is an entry of the compatibility matrix. All versions are glob patterns like "v0.12.*",
+// and an empty list matches any version.
+type Compatibility struct {
+	// DASBoot are the versions of the DAS BOOT stages
+	DASBoot []string `json:"dasboot,omitempty" yaml:"dasboot,omitempty"`
+
+	// Agent are the versions of the Hedgehog agent
+	Agent []string `json:"agent,omitempty" yaml:"agent,omitempty"`
+
+	// NOS are the versions of the NOS
+	NOS []string `json:"nos,omitempty" yaml:"nos,omitempty"`
+}
+
+// MaintenanceWindow is a recurring time window during which devices may start installations.
+type MaintenanceWindow struct {
+	// Days are the weekdays on which the window opens as "mon", "tue", etc. If it is empty, the window opens every day.
+	Days []string `json:"days,omitempty" yaml:"days,omitempty"`
+
+	// Start is the time of day in "HH:MM" format at which the window opens
+	Start string `json:"start,omitempty" yaml:"start,omitempty"`
+
+	// End is the time of day in "HH:MM" format at which the window closes. It spans midnight if it is before the start.
+	End string `json:"end,omitempty" yaml:"end,omitempty"`
+
+	// TimeZone is the IANA time zone of the start and end times. If it is empty, UTC is being used.
+	TimeZone string `json:"time_zone,omitempty" yaml:"time_zone,omitempty"`
 }
 
 // RegistrySettings are all the settings that instruct the seeder on what to do for registration requests
@@ -156,12 +359,177 @@ type RegistrySettings struct {
 	// handled by the registration controller instead. If this is set, it means that we will automatically
 	// accept and approve all registration requests.
 	KeyPath string `json:"key_path,omitempty" yaml:"key_path,omitempty"`
+
+	// RequireApproval holds back the client certificates of all devices which do not match any of the auto-approve
+	// rules until an operator approves their registration on the admin server. If the registration controller
+	// issues the certificates, it must run with approval required as well.
+	RequireApproval bool `json:"require_approval,omitempty" yaml:"require_approval,omitempty"`
+
+	// AutoApprove are the rules for registrations which get approved even though approval is required
+	AutoApprove []AutoApproveRule `json:"auto_approve,omitempty" yaml:"auto_approve,omitempty"`
+
+	// PendingDir is the directory in which pending registrations are being persisted when the seeder issues
+	// client certificates itself. If it is empty, pending registrations are lost on restarts.
+	PendingDir string `json:"pending_dir,omitempty" yaml:"pending_dir,omitempty"`
+
+	// Attestation is the policy for the attestation evidence which devices send with their registration requests.
+	// Registration requests which do not satisfy it are being rejected.
+	Attestation *AttestationPolicy `json:"attestation,omitempty" yaml:"attestation,omitempty"`
+}
+
+// AttestationPolicy defines the attestation evidence which registration requests must come with
+type AttestationPolicy struct {
+	// RequireQuote requires a TPM quote which is signed by the client key of the device
+	RequireQuote bool `json:"require_quote,omitempty" yaml:"require_quote,omitempty"`
+
+	// RequireSecureBoot requires devices to boot with UEFI secure boot enabled
+	RequireSecureBoot bool `json:"require_secure_boot,omitempty" yaml:"require_secure_boot,omitempty"`
+
+	// PCRs are the hex encoded SHA-256 values which the quoted PCRs must have, keyed by their index
+	PCRs map[int]string `json:"pcrs,omitempty" yaml:"pcrs,omitempty"`
+
+	// ONIEVersions are shell patterns like "2022.*" of which the ONIE version must match at least one
+	ONIEVersions []string `json:"onie_versions,omitempty" yaml:"onie_versions,omitempty"`
+}
+
+// AutoApproveRule matches registrations by their location and by the serial number of the device.
+// All fields which are set must match.
+type AutoApproveRule struct {
+	// LocationUUID is the location UUID which registrations must have
+	LocationUUID string `json:"location_uuid,omitempty" yaml:"location_uuid,omitempty"`
+
+	// SerialNumber is a shell pattern like "FX*" which the serial number of the device must match
+	SerialNumber string `json:"serial_number,omitempty" yaml:"serial_number,omitempty"`
+}
+
+// Limits protect the seeder from runaway artifacts in registries or from malicious clients. For all settings
+// a value of 0 means that the default is being used.
+type Limits struct {
+	// MaxIPAMRequestSize is the maximum size in bytes of IPAM request bodies
+	MaxIPAMRequestSize int64 `json:"max_ipam_request_size,omitempty" yaml:"max_ipam_request_size,omitempty"`
+
+	// MaxRegisterRequestSize is the maximum size in bytes of registration request bodies
+	MaxRegisterRequestSize int64 `json:"max_register_request_size,omitempty" yaml:"max_register_request_size,omitempty"`
+
+	// MaxAdminRequestSize is the maximum size in bytes of request bodies on the admin server
+	MaxAdminRequestSize int64 `json:"max_admin_request_size,omitempty" yaml:"max_admin_request_size,omitempty"`
+
+	// MaxArtifactSize is the maximum size in bytes of an artifact that the seeder serves from its artifact providers
+	MaxArtifactSize int64 `json:"max_artifact_size,omitempty" yaml:"max_artifact_size,omitempty"`
+
+	// MaxConcurrentDownloads is the maximum number of concurrent downloads of large artifacts (NOS, ONIE updaters,
+	// agents). Requests which exceed this limit are being rejected with a 503.
+	MaxConcurrentDownloads int `json:"max_concurrent_downloads,omitempty" yaml:"max_concurrent_downloads,omitempty"`
+}
+
+// LogShipping are the settings for the logs which devices upload during their installations. For all size
+// and age settings a value of 0 or an empty value means that the default is being used.
+type LogShipping struct {
+	// Dir is the directory where the uploaded logs are being stored per device and install session
+	Dir string `json:"dir,omitempty" yaml:"dir,omitempty"`
+
+	// MaxBytesPerDevice is the maximum amount of compressed logs in bytes which are being retained per device
+	MaxBytesPerDevice int64 `json:"max_bytes_per_device,omitempty" yaml:"max_bytes_per_device,omitempty"`
+
+	// MaxAge is the duration after which uploaded logs are being removed, e.g. "168h"
+	MaxAge string `json:"max_age,omitempty" yaml:"max_age,omitempty"`
+
+	// MaxChunkSize is the maximum size in bytes of a single compressed chunk that a device uploads
+	MaxChunkSize int64 `json:"max_chunk_size,omitempty" yaml:"max_chunk_size,omitempty"`
+}
+
+// IPAMLeases are the settings for the addresses which are being reserved for devices during their installations
+type IPAMLeases struct {
+	// StatePath is the file in which the leases are being persisted across restarts of the seeder
+	StatePath string `json:"state_path,omitempty" yaml:"state_path,omitempty"`
+
+	// TTL is the time for which the addresses are being reserved after the last IPAM request of a device, e.g. "30m"
+	TTL string `json:"ttl,omitempty" yaml:"ttl,omitempty"`
+}
+
+// Revocation are the settings for checking client certificates on the secure server for revocation
+type Revocation struct {
+	// CRLPath is a file with one or more CRLs of the client CA in PEM or DER format. It is being reloaded when it changes.
+	CRLPath string `json:"crl_path,omitempty" yaml:"crl_path,omitempty"`
+
+	// StatePath is the file in which the revocations through the admin API are being persisted across restarts of the seeder
+	StatePath string `json:"state_path,omitempty" yaml:"state_path,omitempty"`
+}
+
+// DiagnosticsUploads are the settings for the diagnostic files which devices upload in chunks. For all size,
+// age and rate settings a value of 0 or an empty value means that the default is being used.
+type DiagnosticsUploads struct {
+	// Dir is the directory where the uploaded files are being stored per device
+	Dir string `json:"dir,omitempty" yaml:"dir,omitempty"`
+
+	// MaxFileSize is the maximum size in bytes of a single diagnostic file
+	MaxFileSize int64 `json:"max_file_size,omitempty" yaml:"max_file_size,omitempty"`
+
+	// MaxBytesPerDevice is the maximum amount of diagnostic files in bytes which are being retained per device
+	MaxBytesPerDevice int64 `json:"max_bytes_per_device,omitempty" yaml:"max_bytes_per_device,omitempty"`
+
+	// MaxChunkSize is the maximum size in bytes of a single chunk that a device uploads
+	MaxChunkSize int64 `json:"max_chunk_size,omitempty" yaml:"max_chunk_size,omitempty"`
+
+	// MaxAge is the duration after which uploads are being removed, e.g. "336h"
+	MaxAge string `json:"max_age,omitempty" yaml:"max_age,omitempty"`
+
+	// MaxBytesPerSecond throttles the uploads of every device to this rate
+	MaxBytesPerSecond int64 `json:"max_bytes_per_second,omitempty" yaml:"max_bytes_per_second,omitempty"`
 }
 
 type ArtifactProviders struct {
 	Directories   []string       `json:"directories,omitempty" yaml:"directories,omitempty"`
 	OCITempDir    string         `json:"oci_temp_dir,omitempty" yaml:"oci_temp_dir,omitempty"`
 	OCIRegistries []*OCIRegistry `json:"oci_registries,omitempty" yaml:"oci_registries,omitempty"`
+
+	// Manifest verifies the artifacts of all providers but the embedded one against a signed manifest of
+	// their digests. If this is nil, artifacts are not being verified.
+	Manifest *ArtifactManifest `json:"manifest,omitempty" yaml:"manifest,omitempty"`
+
+	// OCICache caches the artifacts of the OCI registries on local disk, so that not every download hits the
+	// registries. If this is nil, artifacts are not being cached.
+	OCICache *ArtifactCache `json:"oci_cache,omitempty" yaml:"oci_cache,omitempty"`
+
+	// HTTPCacheDir is the directory in which the artifacts of the HTTP servers are being cached
+	HTTPCacheDir string        `json:"http_cache_dir,omitempty" yaml:"http_cache_dir,omitempty"`
+	HTTPServers  []*HTTPServer `json:"http_servers,omitempty" yaml:"http_servers,omitempty"`
+}
+
+// ArtifactManifest is a signed manifest of artifact digests
+type ArtifactManifest struct {
+	Path string `json:"path,omitempty" yaml:"path,omitempty"`
+
+	// SignaturePath is the base64 encoded detached ECDSA signature of the manifest
+	SignaturePath string `json:"signature_path,omitempty" yaml:"signature_path,omitempty"`
+
+	// CertPath is the certificate which signed the manifest
+	CertPath string `json:"cert_path,omitempty" yaml:"cert_path,omitempty"`
+
+	// SpoolDir is where artifacts are being stored while they are being verified, it defaults to the temp dir
+	SpoolDir string `json:"spool_dir,omitempty" yaml:"spool_dir,omitempty"`
+}
+
+// ArtifactCache is a size-bounded LRU cache of artifacts on local disk
+type ArtifactCache struct {
+	Dir string `json:"dir,omitempty" yaml:"dir,omitempty"`
+
+	// MaxSize is the size limit of all cached artifacts together in bytes
+	MaxSize int64 `json:"max_size,omitempty" yaml:"max_size,omitempty"`
+
+	// TTL is the time after which a cached artifact is being fetched again, e.g. "1h"
+	TTL string `json:"ttl,omitempty" yaml:"ttl,omitempty"`
+}
+
+// HTTPServer is a plain HTTP(S) artifact server like an air-gapped mirror which is not an OCI registry.
+// Artifacts are being fetched from the path of their names relative to the URL.
+type HTTPServer struct {
+	URL      string `json:"url,omitempty" yaml:"url,omitempty"`
+	Username string `json:"username,omitempty" yaml:"username,omitempty"`
+	Password string `json:"password,omitempty" yaml:"password,omitempty"`
+
+	// ServerCAPath pins the server certificate to this CA instead of the system CAs
+	ServerCAPath string `json:"server_ca_path,omitempty" yaml:"server_ca_path,omitempty"`
 }
 
 type OCIRegistry struct {
@@ -173,10 +541,28 @@ type OCIRegistry struct {
 	ServerCAPath   string `json:"server_ca_path,omitempty" yaml:"server_ca_path,omitempty"`
 	ClientCertPath string `json:"client_cert_path,omitempty" yaml:"cert_path,omitempty"`
 	ClientKeyPath  string `json:"client_key_path,omitempty" yaml:"key_path,omitempty"`
+
+	// Environment is the value of the "{environment}" placeholder in the prefixes of the namespaces
+	Environment string `json:"environment,omitempty" yaml:"environment,omitempty"`
+
+	// Namespaces restrict the registry to the artifacts which match one of them, and prefix their repositories.
+	// This allows one registry to host the artifacts of several fabrics or environments.
+	Namespaces []OCINamespace `json:"namespaces,omitempty" yaml:"namespaces,omitempty"`
+}
+
+// OCINamespace maps a class of artifacts to a repository prefix within an OCI registry
+type OCINamespace struct {
+	// Artifacts is a glob pattern of the artifact names in this namespace, e.g. "sonic/*"
+	Artifacts string `json:"artifacts,omitempty" yaml:"artifacts,omitempty"`
+
+	// Prefix is the repository prefix relative to the registry URL which can contain the placeholders
+	// "{environment}" and "{class}", e.g. "fabrics/{environment}/{class}"
+	Prefix string `json:"prefix,omitempty" yaml:"prefix,omitempty"`
 }
 
 // ReferenceConfig will be displayed when requested through the CLI
 var ReferenceConfig = Config{
+	Version: configVersion,
 	Servers: &Servers{
 		ServerInsecure: &InsecureServer{
 			DynLL: &DynLL{
@@ -193,6 +579,14 @@ var ReferenceConfig = Config{
 			ServerKeyPath:  "/etc/hedgehog/seeder/server-key.pem",
 			ServerCertPath: "/etc/hedgehog/seeder/server-cert.pem",
 		},
+		ServerAdmin: &BindInfo{
+			Addresses: []string{
+				"127.0.0.1:8443",
+			},
+			ClientCAPath:   "/etc/hedgehog/seeder/admin-client-ca-cert.pem",
+			ServerKeyPath:  "/etc/hedgehog/seeder/server-key.pem",
+			ServerCertPath: "/etc/hedgehog/seeder/server-cert.pem",
+		},
 	},
 	EmbeddedConfigGenerator: &EmbeddedConfigGeneratorConfig{
 		KeyPath:  "/etc/hedgehog/seeder/embedded-config-generator-key.pem",
@@ -205,6 +599,13 @@ var ReferenceConfig = Config{
 		ControlVIP:            "192.168.42.1",
 		NTPServers:            []string{"192.168.42.1", "192.168.42.2"},
 		SyslogServers:         []string{"192.168.42.1"},
+		DNSServers:            []string{"192.168.42.1"},
+		DNSSearchDomains:      []string{"hedgehog.svc.cluster.local"},
+		Banner: &banner.Banner{
+			Operator:       "Hedgehog",
+			Environment:    "lab",
+			SupportContact: "support@githedgehog.com",
+		},
 	},
 }
 
@@ -222,13 +623,32 @@ func marshalReferenceConfig() ([]byte, error) {
 }
 
 func loadConfig(path string) (*Config, error) {
-	f, err := os.Open(path)
+	b, err := os.ReadFile(path)
 	if err != nil {
 		return nil, fmt.Errorf("open '%s': %w", path, err)
 	}
-	defer f.Close()
+	return decodeConfig(b)
+}
+
+// decodeConfig decodes the configuration `b`. Configurations of older versions are being migrated in memory,
+// and configurations which are newer than this seeder are being refused.
+func decodeConfig(b []byte) (*Config, error) {
+	var doc yaml.Node
+	if err := yaml.Unmarshal(b, &doc); err != nil {
+		return nil, fmt.Errorf("config yaml decode: %w", err)
+	}
+	if doc.Kind == 0 {
+		return nil, fmt.Errorf("config yaml decode: empty configuration")
+	}
+	from, applied, err := migrateConfigDoc(&doc)
+	if err != nil {
+		return nil, err
+	}
+	if len(applied) > 0 {
+		l.Warn("Configuration is of an older version and was migrated in memory, run 'seeder migrate' to upgrade it permanently", zap.Int("version", from), zap.Int("currentVersion", configVersion))
+	}
 	var cfg Config
-	if err := yaml.NewDecoder(f).Decode(&cfg); err != nil {
+	if err := doc.Decode(&cfg); err != nil {
 		return nil, fmt.Errorf("config yaml decode: %w", err)
 	}
 	return &cfg, nil
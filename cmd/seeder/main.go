@@ -23,12 +23,14 @@ import (
 	"syscall"
 	"time"
 
+	"go.githedgehog.com/dasboot/pkg/cliflags"
 	"go.githedgehog.com/dasboot/pkg/log"
 	"go.githedgehog.com/dasboot/pkg/seeder"
 	"go.githedgehog.com/dasboot/pkg/seeder/artifacts"
 	"go.githedgehog.com/dasboot/pkg/seeder/artifacts/embedded"
 	"go.githedgehog.com/dasboot/pkg/seeder/artifacts/file"
 	"go.githedgehog.com/dasboot/pkg/seeder/artifacts/oras"
+	"go.githedgehog.com/dasboot/pkg/seeder/artifacts/web"
 	seederconfig "go.githedgehog.com/dasboot/pkg/seeder/config"
 	"go.githedgehog.com/dasboot/pkg/version"
 
@@ -37,10 +39,6 @@ import (
 	"go.uber.org/zap/zapcore"
 )
 
-var (
-	defaultLogLevel = zapcore.InfoLevel
-)
-
 var l = log.NewZapWrappedLogger(zap.Must(log.NewSerialConsole(zapcore.DebugLevel, "console", true)))
 
 var description = `
@@ -52,6 +50,8 @@ installer.
 There are several components that need to be configured:
 - bind info / listeners for the insecure server (serving stage0 and IPAM only)
 - bind info / listeners for the secure server
+- bind info / listeners for the optional admin server
+- bind info / listeners for the optional Prometheus metrics server
 - the artifacts provider which can make installers available from different
   sources
 - the embedded config generator
@@ -60,6 +60,11 @@ There are several components that need to be configured:
 More than one instance of the seeder should be running. And a seeder which
 serves at least an insecure server should be running on all switch interconnect
 ports.
+
+Sending SIGHUP reloads the configuration file. Listener addresses, certificates,
+the artifacts provider, the embedded config generator and the installer settings
+are applied without dropping in-flight downloads. All other changes require a
+restart, and the current configuration is kept if a reload fails.
 `
 
 func main() {
@@ -69,31 +74,106 @@ func main() {
 		UsageText:   "seeder",
 		Description: description[1 : len(description)-1],
 		Version:     version.Version,
-		Flags: []cli.Flag{
-			&cli.GenericFlag{
-				Name:  "log-level",
-				Usage: "minimum log level to log at",
-				Value: &defaultLogLevel,
-			},
-			&cli.StringFlag{
-				Name:  "log-format",
-				Usage: "log format to use: json or console",
-				Value: "json",
-			},
-			&cli.BoolFlag{
-				Name:  "log-development",
-				Usage: "enables development log settings",
-				Value: false,
-			},
+		Flags: append(cliflags.LogFlags(),
 			&cli.BoolFlag{
 				Name:  "reference-config",
 				Usage: "prints a reference config to stdout and exits",
 			},
-			&cli.PathFlag{
-				Name:    "config",
-				Aliases: []string{"c"},
-				Usage:   "load configuration from `FILE`",
-				Value:   "/etc/hedgehog/seeder/config.yaml",
+			cliflags.ConfigFlag("load configuration from `FILE`", "/etc/hedgehog/seeder/config.yaml", "c"),
+		),
+		Commands: []*cli.Command{
+			{
+				Name:  "migrate",
+				Usage: "upgrades the configuration file to the format of this seeder",
+				Description: `Detects the version of the configuration file and converts it to the version
+which is supported by this seeder. The original file is kept as a backup
+next to it with the suffix ".v<VERSION>.bak". The seeder refuses to start with a
+configuration file which is newer than itself.`,
+				Flags: []cli.Flag{
+					&cli.BoolFlag{
+						Name:  "dry-run",
+						Usage: "prints the migrated configuration to stdout instead of writing it",
+					},
+				},
+				Action: func(ctx *cli.Context) error {
+					initLogger(ctx)
+					migrated, err := migrateConfigFile(ctx.Path(cliflags.Config), ctx.Bool("dry-run"))
+					if err != nil {
+						return err
+					}
+					if ctx.Bool("dry-run") {
+						_, err = os.Stdout.Write(migrated)
+						return err
+					}
+					return nil
+				},
+			},
+			{
+				Name:  "self-test",
+				Usage: "validates the full install path against the configured seeder on ephemeral ports",
+				Description: `Spins up the configured insecure and secure servers on ephemeral loopback ports and
+walks through the stage 0 to stage 2 HTTP contract: stage 0 download, IPAM,
+stage 1 download, registration of a throwaway device, and stage 2 and agent
+provisioner downloads. Artifacts are checked against their digest and embedded
+configurations are verified. Nothing is persisted in the control plane.`,
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:  "arch",
+						Usage: "architecture of the artifacts to test",
+						Value: "x86_64",
+					},
+				},
+				Action: func(ctx *cli.Context) error {
+					initLogger(ctx)
+					cfg, err := loadConfig(ctx.Path(cliflags.Config))
+					if err != nil {
+						return err
+					}
+					c, err := translateConfig(ctx.Context, cfg)
+					if err != nil {
+						return err
+					}
+					report, err := seeder.SelfTest(ctx.Context, c, ctx.String("arch"))
+					if err != nil {
+						return err
+					}
+					report.Print(os.Stdout)
+					if !report.Passed() {
+						return seeder.ErrSelfTestFailed
+					}
+					return nil
+				},
+			},
+			{
+				Name:  "openapi",
+				Usage: "prints the OpenAPI document of a seeder API to stdout",
+				Description: `Prints the OpenAPI v3 document of the insecure, secure or admin API as it is being
+served by the configured seeder. The running seeder serves the same document
+at "/openapi.json" on every server.`,
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:  "api",
+						Usage: "API to document: insecure, secure or admin",
+						Value: string(seeder.APISecure),
+					},
+				},
+				Action: func(ctx *cli.Context) error {
+					initLogger(ctx)
+					cfg, err := loadConfig(ctx.Path(cliflags.Config))
+					if err != nil {
+						return err
+					}
+					c, err := translateConfig(ctx.Context, cfg)
+					if err != nil {
+						return err
+					}
+					b, err := seeder.OpenAPIDocument(c, seeder.API(ctx.String("api")))
+					if err != nil {
+						return err
+					}
+					_, err = os.Stdout.Write(append(b, []byte("\n")...))
+					return err
+				},
 			},
 		},
 		Action: func(ctx *cli.Context) error {
@@ -108,125 +188,29 @@ func main() {
 			}
 
 			// initialize logger
-			l = log.NewZapWrappedLogger(zap.Must(log.NewSerialConsole(
-				*ctx.Generic("log-level").(*zapcore.Level),
-				ctx.String("log-format"),
-				ctx.Bool("log-development"),
-			)))
+			initLogger(ctx)
 			defer func() {
 				if err := l.Sync(); err != nil {
 					l.Debug("Flushing logger failed", zap.Error(err))
 				}
 			}()
-			log.ReplaceGlobals(l)
 
 			// print version information
 			l.Info("Seeder starting", zap.String("version", version.Version))
 
 			// load config
-			cfg, err := loadConfig(ctx.Path("config"))
+			cfg, err := loadConfig(ctx.Path(cliflags.Config))
 			if err != nil {
 				return err
 			}
 			l.Info("Successfully loaded configuration", zap.String("path", ctx.Path("config")), zap.Reflect("config", cfg))
 
 			// create seeder
-
-			// this is a bit stupid, and maybe we should just share the config structs
-			// however, something told me that it is good to decouple those
-			// so translate the configs
-			c := &seederconfig.SeederConfig{}
-			if cfg.Servers != nil {
-				if cfg.Servers.ServerInsecure != nil {
-					c.InsecureServer = &seederconfig.InsecureServer{}
-					if cfg.Servers.ServerInsecure.DynLL != nil {
-						c.InsecureServer.DynLL = &seederconfig.DynLL{
-							DeviceType:    seederconfig.DeviceType(cfg.Servers.ServerInsecure.DynLL.DeviceType),
-							DeviceName:    cfg.Servers.ServerInsecure.DynLL.DeviceName,
-							ListeningPort: cfg.Servers.ServerInsecure.DynLL.ListeningPort,
-						}
-					}
-					if cfg.Servers.ServerInsecure.Generic != nil {
-						c.InsecureServer.Generic = &seederconfig.BindInfo{
-							Address:        cfg.Servers.ServerInsecure.Generic.Addresses,
-							ClientCAPath:   cfg.Servers.ServerInsecure.Generic.ClientCAPath,
-							ServerKeyPath:  cfg.Servers.ServerInsecure.Generic.ServerKeyPath,
-							ServerCertPath: cfg.Servers.ServerInsecure.Generic.ServerCertPath,
-						}
-					}
-				}
-				if cfg.Servers.ServerSecure != nil {
-					c.SecureServer = &seederconfig.BindInfo{
-						Address:        cfg.Servers.ServerSecure.Addresses,
-						ClientCAPath:   cfg.Servers.ServerSecure.ClientCAPath,
-						ServerKeyPath:  cfg.Servers.ServerSecure.ServerKeyPath,
-						ServerCertPath: cfg.Servers.ServerSecure.ServerCertPath,
-					}
-				}
-			}
-			if cfg.EmbeddedConfigGenerator != nil {
-				c.EmbeddedConfigGenerator = &seederconfig.EmbeddedConfigGeneratorConfig{
-					KeyPath:  cfg.EmbeddedConfigGenerator.KeyPath,
-					CertPath: cfg.EmbeddedConfigGenerator.CertPath,
-				}
-			}
-			if cfg.InstallerSettings != nil {
-				c.InstallerSettings = &seederconfig.InstallerSettings{
-					ServerCAPath:          cfg.InstallerSettings.ServerCAPath,
-					ConfigSignatureCAPath: cfg.InstallerSettings.ConfigSignatureCAPath,
-					SecureServerName:      cfg.InstallerSettings.SecureServerName,
-					ControlVIP:            cfg.InstallerSettings.ControlVIP,
-					NTPServers:            cfg.InstallerSettings.NTPServers,
-					SyslogServers:         cfg.InstallerSettings.SyslogServers,
-				}
-			}
-			if cfg.RegistrySettings != nil {
-				c.RegistrySettings = &seederconfig.RegistrySettings{
-					CertPath: cfg.RegistrySettings.CertPath,
-					KeyPath:  cfg.RegistrySettings.KeyPath,
-				}
-			}
-
-			// we always add the embedded provider
-			artifactProviders := []artifacts.Provider{embedded.Provider()}
-			if cfg.ArtifactProviders != nil {
-				if len(cfg.ArtifactProviders.Directories) > 0 {
-					for _, dir := range cfg.ArtifactProviders.Directories {
-						artifactProviders = append(artifactProviders, file.Provider(dir))
-					}
-				}
-				if len(cfg.ArtifactProviders.OCIRegistries) > 0 {
-					for _, ociReg := range cfg.ArtifactProviders.OCIRegistries {
-						var opts []oras.ProviderOption
-						if ociReg.AccessToken != "" {
-							opts = append(opts, oras.ProviderOptionAccessToken(ociReg.AccessToken))
-						}
-						if ociReg.RefreshToken != "" {
-							opts = append(opts, oras.ProviderOptionRefreshToken(ociReg.RefreshToken))
-						}
-						if ociReg.Username != "" && ociReg.Password != "" {
-							opts = append(opts, oras.ProviderOptionBasicAuth(ociReg.Username, ociReg.Password))
-						}
-						if ociReg.ClientCertPath != "" && ociReg.ClientKeyPath != "" {
-							opts = append(opts, oras.ProviderOptionTLSClientAuth(ociReg.ClientCertPath, ociReg.ClientKeyPath))
-						}
-						if ociReg.ServerCAPath != "" {
-							opts = append(opts, oras.ProviderOptionServerCA(ociReg.ServerCAPath))
-						}
-						prov, err := oras.Provider(ctx.Context, ociReg.URL, cfg.ArtifactProviders.OCITempDir, opts...)
-						if err != nil {
-							return fmt.Errorf("oras provider: %w", err)
-						}
-						artifactProviders = append(artifactProviders, prov)
-					}
-				}
+			c, err := translateConfig(ctx.Context, cfg)
+			if err != nil {
+				return err
 			}
 
-			// the artifacts provider
-			c.ArtifactsProvider = artifacts.New(
-				artifactProviders...,
-			)
-
 			// now create the seeder
 			l.Debug("Translated seeder config", zap.Reflect("seederConfig", c))
 			s, err := seeder.New(ctx.Context, c)
@@ -238,6 +222,10 @@ func main() {
 			signals := make(chan os.Signal, 1)
 			signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
 
+			// HUP reloads the configuration
+			reloads := make(chan os.Signal, 1)
+			signal.Notify(reloads, syscall.SIGHUP)
+
 			// now start the seeder - and wait for things to happen
 			l.Info("Seeder starting...")
 			s.Start()
@@ -254,13 +242,27 @@ func main() {
 					l.Info("received signal, stopping seeder...", zap.String("signal", sig.String()))
 					signalReceived = true
 					wg.Add(1)
-					ctx, cancel := context.WithTimeout(ctx.Context, time.Minute)
+					// in-flight downloads are being drained first before the servers are being shut down
+					drainTimeout := c.DrainTimeout
+					if drainTimeout <= 0 {
+						drainTimeout = seeder.DefaultDrainTimeout
+					}
+					ctx, cancel := context.WithTimeout(ctx.Context, drainTimeout+time.Minute)
 					go func(ctx context.Context, cancel context.CancelFunc) {
 						defer cancel()
 						s.Stop(ctx)
 						l.Info("seeder shutdown complete")
 						wg.Done()
 					}(ctx, cancel)
+				case sig := <-reloads:
+					if signalReceived {
+						l.Info("received reload signal while stopping, ignoring...", zap.String("signal", sig.String()))
+						break
+					}
+					l.Info("received signal, reloading configuration...", zap.String("signal", sig.String()))
+					if err := reloadConfig(ctx.Context, ctx.Path(cliflags.Config), s); err != nil {
+						l.Error("reloading configuration failed, keeping the current configuration", zap.Error(err))
+					}
 				case err, ok := <-s.Err():
 					if ok {
 						l.Error("error from seeder", zap.Error(err))
@@ -281,3 +283,339 @@ func main() {
 		l.Fatal("seeder failed", zap.Error(err))
 	}
 }
+
+// reloadConfig loads the configuration file at `path` and applies it to the running seeder `s`
+func reloadConfig(ctx context.Context, path string, s seeder.Interface) error {
+	cfg, err := loadConfig(path)
+	if err != nil {
+		return err
+	}
+	c, err := translateConfig(ctx, cfg)
+	if err != nil {
+		return err
+	}
+	l.Debug("Translated seeder config", zap.Reflect("seederConfig", c))
+	return s.Reload(ctx, c)
+}
+
+// translateConfig translates the loaded configuration file into the seeder configuration
+func translateConfig(ctx context.Context, cfg *Config) (*seederconfig.SeederConfig, error) {
+	// this is a bit stupid, and maybe we should just share the config structs
+	// however, something told me that it is good to decouple those
+	// so translate the configs
+	c := &seederconfig.SeederConfig{}
+	if cfg.Servers != nil {
+		if cfg.Servers.ServerInsecure != nil {
+			c.InsecureServer = &seederconfig.InsecureServer{
+				ONIEDiscovery: cfg.Servers.ServerInsecure.ONIEDiscovery,
+			}
+			if cfg.Servers.ServerInsecure.DynLL != nil {
+				c.InsecureServer.DynLL = &seederconfig.DynLL{
+					DeviceType:    seederconfig.DeviceType(cfg.Servers.ServerInsecure.DynLL.DeviceType),
+					DeviceName:    cfg.Servers.ServerInsecure.DynLL.DeviceName,
+					ListeningPort: cfg.Servers.ServerInsecure.DynLL.ListeningPort,
+				}
+			}
+			if cfg.Servers.ServerInsecure.Generic != nil {
+				c.InsecureServer.Generic = &seederconfig.BindInfo{
+					Address:        cfg.Servers.ServerInsecure.Generic.Addresses,
+					ClientCAPath:   cfg.Servers.ServerInsecure.Generic.ClientCAPath,
+					ServerKeyPath:  cfg.Servers.ServerInsecure.Generic.ServerKeyPath,
+					ServerCertPath: cfg.Servers.ServerInsecure.Generic.ServerCertPath,
+				}
+			}
+		}
+		if cfg.Servers.ServerSecure != nil {
+			c.SecureServer = &seederconfig.BindInfo{
+				Address:        cfg.Servers.ServerSecure.Addresses,
+				ClientCAPath:   cfg.Servers.ServerSecure.ClientCAPath,
+				ServerKeyPath:  cfg.Servers.ServerSecure.ServerKeyPath,
+				ServerCertPath: cfg.Servers.ServerSecure.ServerCertPath,
+			}
+		}
+		if cfg.Servers.ServerAdmin != nil {
+			c.AdminServer = &seederconfig.BindInfo{
+				Address:        cfg.Servers.ServerAdmin.Addresses,
+				ClientCAPath:   cfg.Servers.ServerAdmin.ClientCAPath,
+				ServerKeyPath:  cfg.Servers.ServerAdmin.ServerKeyPath,
+				ServerCertPath: cfg.Servers.ServerAdmin.ServerCertPath,
+			}
+		}
+		if cfg.Servers.ServerMetrics != nil {
+			c.MetricsServer = &seederconfig.BindInfo{
+				Address:        cfg.Servers.ServerMetrics.Addresses,
+				ClientCAPath:   cfg.Servers.ServerMetrics.ClientCAPath,
+				ServerKeyPath:  cfg.Servers.ServerMetrics.ServerKeyPath,
+				ServerCertPath: cfg.Servers.ServerMetrics.ServerCertPath,
+			}
+		}
+	}
+	if cfg.EmbeddedConfigGenerator != nil {
+		c.EmbeddedConfigGenerator = &seederconfig.EmbeddedConfigGeneratorConfig{
+			KeyPath:  cfg.EmbeddedConfigGenerator.KeyPath,
+			CertPath: cfg.EmbeddedConfigGenerator.CertPath,
+		}
+	}
+	if cfg.InstallerSettings != nil {
+		c.InstallerSettings = &seederconfig.InstallerSettings{
+			ServerCAPath:             cfg.InstallerSettings.ServerCAPath,
+			ServerCABundlePath:       cfg.InstallerSettings.ServerCABundlePath,
+			ServerCABundleVersion:    cfg.InstallerSettings.ServerCABundleVersion,
+			ConfigSignatureCAPath:    cfg.InstallerSettings.ConfigSignatureCAPath,
+			SecureServerName:         cfg.InstallerSettings.SecureServerName,
+			MirrorServerNames:        cfg.InstallerSettings.MirrorServerNames,
+			ControlVIP:               cfg.InstallerSettings.ControlVIP,
+			ControlVIPv6:             cfg.InstallerSettings.ControlVIPv6,
+			FabricName:               cfg.InstallerSettings.FabricName,
+			NTPServers:               cfg.InstallerSettings.NTPServers,
+			NTPMaxOffset:             cfg.InstallerSettings.NTPMaxOffset,
+			LLDPWait:                 cfg.InstallerSettings.LLDPWait,
+			SyslogServers:            cfg.InstallerSettings.SyslogServers,
+			SyslogFraming:            cfg.InstallerSettings.SyslogFraming,
+			SyslogTransport:          cfg.InstallerSettings.SyslogTransport,
+			SyslogCAPath:             cfg.InstallerSettings.SyslogCAPath,
+			DNSServers:               cfg.InstallerSettings.DNSServers,
+			DNSSearchDomains:         cfg.InstallerSettings.DNSSearchDomains,
+			DiagBootBeforeInstall:    cfg.InstallerSettings.DiagBootBeforeInstall,
+			EncryptIdentityPartition: cfg.InstallerSettings.EncryptIdentityPartition,
+			IdentityBackups:          cfg.InstallerSettings.IdentityBackups,
+			Banner:                   cfg.InstallerSettings.Banner,
+			MTU:                      cfg.InstallerSettings.MTU,
+			RequireProvenance:        cfg.InstallerSettings.RequireProvenance,
+			RequireManifest:          cfg.InstallerSettings.RequireManifest,
+			MACAllowlists:            cfg.InstallerSettings.MACAllowlists,
+
+			RecoveryMaxConsecutiveFailures: cfg.InstallerSettings.RecoveryMaxConsecutiveFailures,
+			RecoveryAction:                 cfg.InstallerSettings.RecoveryAction,
+			GPTAttributes:                  cfg.InstallerSettings.GPTAttributes,
+			PreserveNOSConfig:              cfg.InstallerSettings.PreserveNOSConfig,
+			DisableDiscardPlatforms:        cfg.InstallerSettings.DisableDiscardPlatforms,
+			Staging:                        cfg.InstallerSettings.Staging,
+			MultipathPolicy:                cfg.InstallerSettings.MultipathPolicy,
+			DiskSelection:                  cfg.InstallerSettings.DiskSelection,
+			DHCPFallback:                   cfg.InstallerSettings.DHCPFallback,
+			Proxy:                          cfg.InstallerSettings.Proxy,
+		}
+		if len(cfg.InstallerSettings.MaintenanceWindows) > 0 {
+			c.InstallerSettings.MaintenanceWindows = make(map[string][]seederconfig.MaintenanceWindow, len(cfg.InstallerSettings.MaintenanceWindows))
+			for devid, windows := range cfg.InstallerSettings.MaintenanceWindows {
+				ws := make([]seederconfig.MaintenanceWindow, 0, len(windows))
+				for _, w := range windows {
+					ws = append(ws, seederconfig.MaintenanceWindow{
+						Days:     w.Days,
+						Start:    w.Start,
+						End:      w.End,
+						TimeZone: w.TimeZone,
+					})
+				}
+				c.InstallerSettings.MaintenanceWindows[devid] = ws
+			}
+		}
+		for _, e := range cfg.InstallerSettings.CompatibilityMatrix {
+			c.InstallerSettings.CompatibilityMatrix = append(c.InstallerSettings.CompatibilityMatrix, seederconfig.Compatibility{
+				DASBoot: e.DASBoot,
+				Agent:   e.Agent,
+				NOS:     e.NOS,
+			})
+		}
+	}
+	if cfg.RegistrySettings != nil {
+		c.RegistrySettings = &seederconfig.RegistrySettings{
+			CertPath:        cfg.RegistrySettings.CertPath,
+			KeyPath:         cfg.RegistrySettings.KeyPath,
+			RequireApproval: cfg.RegistrySettings.RequireApproval,
+			PendingDir:      cfg.RegistrySettings.PendingDir,
+		}
+		for _, rule := range cfg.RegistrySettings.AutoApprove {
+			c.RegistrySettings.AutoApprove = append(c.RegistrySettings.AutoApprove, seederconfig.AutoApproveRule{
+				LocationUUID: rule.LocationUUID,
+				SerialNumber: rule.SerialNumber,
+			})
+		}
+		if cfg.RegistrySettings.Attestation != nil {
+			c.RegistrySettings.Attestation = &seederconfig.AttestationPolicy{
+				RequireQuote:      cfg.RegistrySettings.Attestation.RequireQuote,
+				RequireSecureBoot: cfg.RegistrySettings.Attestation.RequireSecureBoot,
+				PCRs:              cfg.RegistrySettings.Attestation.PCRs,
+				ONIEVersions:      cfg.RegistrySettings.Attestation.ONIEVersions,
+			}
+		}
+	}
+
+	if cfg.Limits != nil {
+		c.Limits = &seederconfig.Limits{
+			MaxIPAMRequestSize:     cfg.Limits.MaxIPAMRequestSize,
+			MaxRegisterRequestSize: cfg.Limits.MaxRegisterRequestSize,
+			MaxAdminRequestSize:    cfg.Limits.MaxAdminRequestSize,
+			MaxArtifactSize:        cfg.Limits.MaxArtifactSize,
+			MaxConcurrentDownloads: cfg.Limits.MaxConcurrentDownloads,
+		}
+	}
+
+	if cfg.LogShipping != nil {
+		c.LogShipping = &seederconfig.LogShipping{
+			Dir:               cfg.LogShipping.Dir,
+			MaxBytesPerDevice: cfg.LogShipping.MaxBytesPerDevice,
+			MaxChunkSize:      cfg.LogShipping.MaxChunkSize,
+		}
+		if cfg.LogShipping.MaxAge != "" {
+			maxAge, err := time.ParseDuration(cfg.LogShipping.MaxAge)
+			if err != nil {
+				return nil, fmt.Errorf("log shipping: max_age: %w", err)
+			}
+			c.LogShipping.MaxAge = maxAge
+		}
+	}
+
+	if cfg.DiagnosticsUploads != nil {
+		c.DiagnosticsUploads = &seederconfig.DiagnosticsUploads{
+			Dir:               cfg.DiagnosticsUploads.Dir,
+			MaxFileSize:       cfg.DiagnosticsUploads.MaxFileSize,
+			MaxBytesPerDevice: cfg.DiagnosticsUploads.MaxBytesPerDevice,
+			MaxChunkSize:      cfg.DiagnosticsUploads.MaxChunkSize,
+			MaxBytesPerSecond: cfg.DiagnosticsUploads.MaxBytesPerSecond,
+		}
+		if cfg.DiagnosticsUploads.MaxAge != "" {
+			maxAge, err := time.ParseDuration(cfg.DiagnosticsUploads.MaxAge)
+			if err != nil {
+				return nil, fmt.Errorf("diagnostics uploads: max_age: %w", err)
+			}
+			c.DiagnosticsUploads.MaxAge = maxAge
+		}
+	}
+
+	if cfg.IPAMLeases != nil {
+		c.IPAMLeases = &seederconfig.IPAMLeases{
+			StatePath: cfg.IPAMLeases.StatePath,
+		}
+		if cfg.IPAMLeases.TTL != "" {
+			ttl, err := time.ParseDuration(cfg.IPAMLeases.TTL)
+			if err != nil {
+				return nil, fmt.Errorf("ipam leases: ttl: %w", err)
+			}
+			c.IPAMLeases.TTL = ttl
+		}
+	}
+
+	if cfg.Revocation != nil {
+		c.Revocation = &seederconfig.Revocation{
+			CRLPath:   cfg.Revocation.CRLPath,
+			StatePath: cfg.Revocation.StatePath,
+		}
+	}
+
+	if cfg.DrainTimeout != "" {
+		drainTimeout, err := time.ParseDuration(cfg.DrainTimeout)
+		if err != nil {
+			return nil, fmt.Errorf("drain_timeout: %w", err)
+		}
+		c.DrainTimeout = drainTimeout
+	}
+	c.LabMode = cfg.LabMode
+
+	// we always add the embedded provider
+	artifactProviders := []artifacts.Provider{embedded.Provider()}
+	if cfg.ArtifactProviders != nil {
+		if len(cfg.ArtifactProviders.Directories) > 0 {
+			for _, dir := range cfg.ArtifactProviders.Directories {
+				artifactProviders = append(artifactProviders, file.Provider(dir))
+			}
+		}
+		if len(cfg.ArtifactProviders.OCIRegistries) > 0 {
+			ociProviders := make([]artifacts.Provider, 0, len(cfg.ArtifactProviders.OCIRegistries))
+			for _, ociReg := range cfg.ArtifactProviders.OCIRegistries {
+				var opts []oras.ProviderOption
+				if ociReg.AccessToken != "" {
+					opts = append(opts, oras.ProviderOptionAccessToken(ociReg.AccessToken))
+				}
+				if ociReg.RefreshToken != "" {
+					opts = append(opts, oras.ProviderOptionRefreshToken(ociReg.RefreshToken))
+				}
+				if ociReg.Username != "" && ociReg.Password != "" {
+					opts = append(opts, oras.ProviderOptionBasicAuth(ociReg.Username, ociReg.Password))
+				}
+				if ociReg.ClientCertPath != "" && ociReg.ClientKeyPath != "" {
+					opts = append(opts, oras.ProviderOptionTLSClientAuth(ociReg.ClientCertPath, ociReg.ClientKeyPath))
+				}
+				if ociReg.ServerCAPath != "" {
+					opts = append(opts, oras.ProviderOptionServerCA(ociReg.ServerCAPath))
+				}
+				if len(ociReg.Namespaces) > 0 {
+					namespaces := make([]oras.Namespace, 0, len(ociReg.Namespaces))
+					for _, ns := range ociReg.Namespaces {
+						namespaces = append(namespaces, oras.Namespace{Artifacts: ns.Artifacts, Prefix: ns.Prefix})
+					}
+					opts = append(opts, oras.ProviderOptionNamespaces(ociReg.Environment, namespaces))
+				}
+				prov, err := oras.Provider(ctx, ociReg.URL, cfg.ArtifactProviders.OCITempDir, opts...)
+				if err != nil {
+					return nil, fmt.Errorf("oras provider '%s': %w", ociReg.URL, err)
+				}
+				ociProviders = append(ociProviders, prov)
+			}
+			if ociCache := cfg.ArtifactProviders.OCICache; ociCache != nil {
+				var opts []artifacts.CacheOption
+				if ociCache.MaxSize > 0 {
+					opts = append(opts, artifacts.CacheOptionMaxSize(ociCache.MaxSize))
+				}
+				if ociCache.TTL != "" {
+					ttl, err := time.ParseDuration(ociCache.TTL)
+					if err != nil {
+						return nil, fmt.Errorf("oci cache: ttl: %w", err)
+					}
+					opts = append(opts, artifacts.CacheOptionTTL(ttl))
+				}
+				prov, err := artifacts.Cached(artifacts.New(ociProviders...), ociCache.Dir, opts...)
+				if err != nil {
+					return nil, fmt.Errorf("oci cache: %w", err)
+				}
+				ociProviders = []artifacts.Provider{prov}
+			}
+			artifactProviders = append(artifactProviders, ociProviders...)
+		}
+		for _, httpSrv := range cfg.ArtifactProviders.HTTPServers {
+			var opts []web.ProviderOption
+			if httpSrv.Username != "" && httpSrv.Password != "" {
+				opts = append(opts, web.ProviderOptionBasicAuth(httpSrv.Username, httpSrv.Password))
+			}
+			if httpSrv.ServerCAPath != "" {
+				opts = append(opts, web.ProviderOptionServerCA(httpSrv.ServerCAPath))
+			}
+			prov, err := web.Provider(ctx, httpSrv.URL, cfg.ArtifactProviders.HTTPCacheDir, opts...)
+			if err != nil {
+				return nil, fmt.Errorf("http provider '%s': %w", httpSrv.URL, err)
+			}
+			artifactProviders = append(artifactProviders, prov)
+		}
+
+		// the embedded artifacts are part of the seeder binary, so they are the only ones which are not verified
+		if m := cfg.ArtifactProviders.Manifest; m != nil && len(artifactProviders) > 1 {
+			manifest, err := artifacts.LoadManifest(m.Path, m.SignaturePath, m.CertPath)
+			if err != nil {
+				return nil, fmt.Errorf("artifact manifest: %w", err)
+			}
+			verified, err := artifacts.Verified(artifacts.New(artifactProviders[1:]...), manifest, m.SpoolDir)
+			if err != nil {
+				return nil, fmt.Errorf("artifact manifest: %w", err)
+			}
+			artifactProviders = []artifacts.Provider{artifactProviders[0], verified}
+			c.ArtifactManifest = manifest
+		}
+	}
+
+	// the artifacts provider
+	c.ArtifactsProvider = artifacts.New(
+		artifactProviders...,
+	)
+
+	return c, nil
+}
+
+func initLogger(ctx *cli.Context) {
+	l = log.NewZapWrappedLogger(zap.Must(log.NewSerialConsole(
+		cliflags.GetLogLevel(ctx),
+		ctx.String(cliflags.LogFormat),
+		ctx.Bool(cliflags.LogDevelopment),
+	)))
+	log.ReplaceGlobals(l)
+}
@@ -0,0 +1,205 @@
+// Copyright 2023 Hedgehog
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"go.uber.org/zap"
+	"gopkg.in/yaml.v3"
+)
+
+// configVersion is the version of the configuration file format which this seeder understands.
+// Every change to the format which requires existing configuration files to be converted must
+// increase it, and must add a migration to `configMigrations`.
+const configVersion = 1
+
+var (
+	ErrConfigTooNew         = errors.New("seeder: configuration is newer than this seeder")
+	ErrConfigInvalidVersion = errors.New("seeder: invalid configuration version")
+)
+
+// configMigration converts a configuration document from version `from` to version `from+1`
+type configMigration struct {
+	from        int
+	description string
+	migrate     func(doc *yaml.Node) error
+}
+
+// configMigrations must be ordered by their `from` version, and there must be one for every version
+// below `configVersion`. Migrations work on the YAML document so that comments are preserved.
+var configMigrations = []configMigration{
+	{
+		from:        0,
+		description: "configuration files without a version become version 1, no settings change",
+		migrate:     func(*yaml.Node) error { return nil },
+	},
+}
+
+// docVersion returns the configuration version of the YAML document `doc`. A missing version is version 0.
+func docVersion(doc *yaml.Node) (int, error) {
+	v := mappingValue(doc, "version")
+	if v == nil {
+		return 0, nil
+	}
+	ret, err := strconv.Atoi(v.Value)
+	if err != nil || ret < 0 {
+		return 0, fmt.Errorf("%w: '%s'", ErrConfigInvalidVersion, v.Value)
+	}
+	return ret, nil
+}
+
+// mappingValue returns the value node for `key` of the top-level mapping of the YAML document `doc`
+func mappingValue(doc *yaml.Node, key string) *yaml.Node {
+	m := docMapping(doc)
+	if m == nil {
+		return nil
+	}
+	for i := 0; i+1 < len(m.Content); i += 2 {
+		if m.Content[i].Value == key {
+			return m.Content[i+1]
+		}
+	}
+	return nil
+}
+
+// setDocVersion sets the version of the YAML document `doc`. It gets added as the first key if it is missing.
+func setDocVersion(doc *yaml.Node, version int) {
+	if v := mappingValue(doc, "version"); v != nil {
+		v.Value = strconv.Itoa(version)
+		v.Tag = "!!int"
+		return
+	}
+	m := docMapping(doc)
+	if m == nil {
+		return
+	}
+	m.Content = append([]*yaml.Node{
+		{Kind: yaml.ScalarNode, Tag: "!!str", Value: "version"},
+		{Kind: yaml.ScalarNode, Tag: "!!int", Value: strconv.Itoa(version)},
+	}, m.Content...)
+}
+
+func docMapping(doc *yaml.Node) *yaml.Node {
+	if doc.Kind == yaml.DocumentNode && len(doc.Content) > 0 {
+		doc = doc.Content[0]
+	}
+	if doc.Kind != yaml.MappingNode {
+		return nil
+	}
+	return doc
+}
+
+// migrateConfigDoc migrates the YAML document `doc` to the current configuration version. It returns
+// the version of the document before the migration, and the descriptions of all applied migrations.
+func migrateConfigDoc(doc *yaml.Node) (int, []string, error) {
+	from, err := docVersion(doc)
+	if err != nil {
+		return 0, nil, err
+	}
+	if from > configVersion {
+		return from, nil, fmt.Errorf("%w: configuration version is %d, but this seeder only supports up to version %d", ErrConfigTooNew, from, configVersion)
+	}
+	var applied []string
+	for _, m := range configMigrations {
+		if m.from < from {
+			continue
+		}
+		if err := m.migrate(doc); err != nil {
+			return from, applied, fmt.Errorf("migrating configuration from version %d to %d: %w", m.from, m.from+1, err)
+		}
+		setDocVersion(doc, m.from+1)
+		applied = append(applied, fmt.Sprintf("%d -> %d: %s", m.from, m.from+1, m.description))
+	}
+	return from, applied, nil
+}
+
+// migrateConfigFile migrates the configuration file at `path` to the current version. The original file is
+// kept as a backup next to it before it is being replaced. Nothing is written if `dryRun` is set, and the
+// migrated configuration is returned in any case.
+func migrateConfigFile(path string, dryRun bool) ([]byte, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading '%s': %w", path, err)
+	}
+	var doc yaml.Node
+	if err := yaml.Unmarshal(b, &doc); err != nil {
+		return nil, fmt.Errorf("config yaml decode: %w", err)
+	}
+	from, applied, err := migrateConfigDoc(&doc)
+	if err != nil {
+		return nil, err
+	}
+	if len(applied) == 0 {
+		l.Info("Configuration is already at the current version", zap.String("path", path), zap.Int("version", from))
+		return b, nil
+	}
+	for _, desc := range applied {
+		l.Info("Applying configuration migration", zap.String("path", path), zap.String("migration", desc))
+	}
+
+	buf := &bytes.Buffer{}
+	enc := yaml.NewEncoder(buf)
+	enc.SetIndent(2)
+	if err := enc.Encode(&doc); err != nil {
+		return nil, fmt.Errorf("config yaml encode: %w", err)
+	}
+	if err := enc.Close(); err != nil {
+		return nil, fmt.Errorf("config yaml encode: %w", err)
+	}
+	migrated := buf.Bytes()
+
+	// the migrated configuration must be loadable by this seeder
+	if _, err := decodeConfig(migrated); err != nil {
+		return nil, fmt.Errorf("validating migrated configuration: %w", err)
+	}
+	if dryRun {
+		return migrated, nil
+	}
+
+	fi, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	backupPath := fmt.Sprintf("%s.v%d.bak", path, from)
+	if err := os.WriteFile(backupPath, b, fi.Mode().Perm()); err != nil {
+		return nil, fmt.Errorf("writing backup '%s': %w", backupPath, err)
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".migrate-*")
+	if err != nil {
+		return nil, fmt.Errorf("creating temporary file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(migrated); err != nil {
+		tmp.Close()
+		return nil, fmt.Errorf("writing '%s': %w", tmp.Name(), err)
+	}
+	if err := tmp.Close(); err != nil {
+		return nil, fmt.Errorf("writing '%s': %w", tmp.Name(), err)
+	}
+	if err := os.Chmod(tmp.Name(), fi.Mode().Perm()); err != nil {
+		return nil, err
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return nil, fmt.Errorf("replacing '%s': %w", path, err)
+	}
+	l.Info("Configuration migrated", zap.String("path", path), zap.String("backup", backupPath), zap.Int("from", from), zap.Int("to", configVersion))
+	return migrated, nil
+}
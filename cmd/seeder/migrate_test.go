@@ -0,0 +1,121 @@
+// Copyright 2023 Hedgehog
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestMigrateConfigFile(t *testing.T) {
+	unversioned := `# the seeder configuration
+servers:
+  secure:
+    addresses:
+      - 0.0.0.0:443
+`
+	tests := []struct {
+		name       string
+		config     string
+		dryRun     bool
+		wantErr    error
+		wantBackup bool
+		wantConfig string
+	}{
+		{
+			name:       "unversioned",
+			config:     unversioned,
+			wantBackup: true,
+			wantConfig: "version: 1\n" + unversioned,
+		},
+		{
+			name:       "dry run",
+			config:     unversioned,
+			dryRun:     true,
+			wantConfig: unversioned,
+		},
+		{
+			name:       "current version",
+			config:     "version: 1\n" + unversioned,
+			wantConfig: "version: 1\n" + unversioned,
+		},
+		{
+			name:       "newer version",
+			config:     "version: 2\n" + unversioned,
+			wantErr:    ErrConfigTooNew,
+			wantConfig: "version: 2\n" + unversioned,
+		},
+		{
+			name:       "invalid version",
+			config:     "version: latest\n" + unversioned,
+			wantErr:    ErrConfigInvalidVersion,
+			wantConfig: "version: latest\n" + unversioned,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "config.yaml")
+			if err := os.WriteFile(path, []byte(tt.config), 0640); err != nil {
+				t.Fatal(err)
+			}
+			_, err := migrateConfigFile(path, tt.dryRun)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("migrateConfigFile() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			got, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != tt.wantConfig {
+				t.Errorf("migrated config = %q, want %q", got, tt.wantConfig)
+			}
+			backup, err := os.ReadFile(path + ".v0.bak")
+			if tt.wantBackup != (err == nil) {
+				t.Fatalf("backup exists = %v, want %v", err == nil, tt.wantBackup)
+			}
+			if tt.wantBackup && string(backup) != tt.config {
+				t.Errorf("backup = %q, want %q", backup, tt.config)
+			}
+		})
+	}
+}
+
+func TestDecodeConfig(t *testing.T) {
+	cfg, err := decodeConfig([]byte("servers:\n  secure:\n    addresses: [\"0.0.0.0:443\"]\n"))
+	if err != nil {
+		t.Fatalf("decodeConfig() error = %v", err)
+	}
+	if cfg.Version != configVersion {
+		t.Errorf("decodeConfig() version = %d, want %d", cfg.Version, configVersion)
+	}
+
+	if _, err := decodeConfig([]byte("version: 2\n")); !errors.Is(err, ErrConfigTooNew) {
+		t.Errorf("decodeConfig() error = %v, want %v", err, ErrConfigTooNew)
+	}
+
+	b, err := marshalReferenceConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(string(b), "version: 1\n") {
+		t.Errorf("reference config does not start with the current version")
+	}
+	if _, err := decodeConfig(b); err != nil {
+		t.Errorf("decodeConfig() of reference config error = %v", err)
+	}
+}
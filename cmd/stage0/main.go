@@ -19,8 +19,8 @@ import (
 	"fmt"
 	"os"
 
+	"go.githedgehog.com/dasboot/pkg/cliflags"
 	"go.githedgehog.com/dasboot/pkg/log"
-	"go.githedgehog.com/dasboot/pkg/log/syslog"
 	"go.githedgehog.com/dasboot/pkg/stage"
 	"go.githedgehog.com/dasboot/pkg/stage0"
 	"go.githedgehog.com/dasboot/pkg/stage0/config"
@@ -28,15 +28,11 @@ import (
 
 	"github.com/urfave/cli/v2"
 	"go.uber.org/zap"
-	"go.uber.org/zap/zapcore"
-)
-
-var (
-	defaultLogLevel = zapcore.InfoLevel
-	defaultFacility = syslog.LOG_LOCAL0
 )
 
 func main() {
+	defer stage.HandlePanic("stage0")
+
 	app := &cli.App{
 		Name:                 "stage0",
 		Usage:                "configures system network and basic operating system functionalities",
@@ -44,37 +40,15 @@ func main() {
 		Description:          "Should be running in ONIE, and is the first of a series of installer stages within DAS BOOT",
 		Version:              version.Version,
 		EnableBashCompletion: true,
-		Flags: []cli.Flag{
-			&cli.GenericFlag{
-				Name:  "log-level",
-				Usage: "minimum log level to log at",
-				Value: &defaultLogLevel,
-			},
-			&cli.StringFlag{
-				Name:  "log-format",
-				Usage: "log format to use: json or console (only affects serial console)",
-				Value: "console",
-			},
-			&cli.BoolFlag{
-				Name:  "log-development",
-				Usage: "enables development log settings",
-				Value: false,
-			},
-			&cli.StringFlag{
-				Name:  "syslog-server",
-				Usage: "syslog server IP addresses or hostnames or FQDNs",
-			},
-			&cli.GenericFlag{
-				Name:  "syslog-facility",
-				Usage: "syslog facility to use within syslog messages",
-				Value: &defaultFacility,
-			},
-			&cli.PathFlag{
-				Name:  "config",
-				Usage: "optional configuration file to load which can override settings of the embedded configuration",
-			},
-		},
+		Flags: append(append(cliflags.StageFlags(), cliflags.StagingFlags()...), &cli.BoolFlag{
+			Name:    cliflags.ForceBreakLock,
+			Usage:   "breaks the install lock of another running installation, which will abort at its next lock verification",
+			EnvVars: cliflags.EnvVars(cliflags.ForceBreakLock),
+		}),
 		Action: func(ctx *cli.Context) error {
+			if ctx.Bool(cliflags.PrintCapabilities) {
+				return cliflags.WriteCapabilities(os.Stdout, "stage0")
+			}
 			os.Stdout.WriteString(`
 
  _   _          _            _
@@ -99,6 +73,10 @@ ______  ___   _____  ______  _____  _____ _____
 	}
 
 	if err := app.Run(os.Args); err != nil {
+		if errors.Is(err, stage.ErrInstallCancelled) {
+			log.L().Error("installation cancelled", zap.Error(err))
+			os.Exit(stage.ExitCodeCancelled)
+		}
 		if errors.Is(err, stage0.ErrExecution) {
 			log.L().Fatal("runtime error", zap.Error(err))
 		}
@@ -109,7 +87,7 @@ ______  ___   _____  ______  _____  _____ _____
 
 func runStage0(ctx *cli.Context) error {
 	// read optional configuration file first
-	configPath := ctx.Path("config")
+	configPath := ctx.Path(cliflags.Config)
 	var cfg *config.Stage0
 	if configPath != "" {
 		var err error
@@ -119,18 +97,29 @@ func runStage0(ctx *cli.Context) error {
 		}
 	}
 
-	// CLI flags for log settings
-	var syslogServers []string
-	syslogServer := ctx.String("syslog-server")
-	if syslogServer != "" {
-		syslogServers = append(syslogServers, syslogServer)
+	// CLI flags for the staging area take precedence over the configuration file
+	if stagingDir, tmpfsSize := ctx.Path(cliflags.StagingDir), ctx.String(cliflags.StagingTmpfsSize); stagingDir != "" || tmpfsSize != "" {
+		if cfg == nil {
+			cfg = &config.Stage0{}
+		}
+		staging := config.Staging{}
+		if cfg.Staging != nil {
+			staging = *cfg.Staging
+		}
+		if stagingDir != "" {
+			staging.BaseDir = stagingDir
+		}
+		if tmpfsSize != "" {
+			staging.TmpfsSize = tmpfsSize
+		}
+		cfg.Staging = &staging
 	}
-	logSettings := &stage.LogSettings{
-		Development:    ctx.Bool("log-development"),
-		Level:          *ctx.Generic("log-level").(*zapcore.Level),
-		Format:         ctx.String("log-format"),
-		SyslogServers:  syslogServers,
-		SyslogFacility: *ctx.Generic("syslog-facility").(*syslog.Priority),
+
+	// CLI flags for log settings
+	logSettings := cliflags.LogSettings(ctx)
+	var opts []stage.RunOption
+	if ctx.Bool(cliflags.ForceBreakLock) {
+		opts = append(opts, stage.RunOptionForceBreakInstallLock())
 	}
-	return stage0.Run(ctx.Context, cfg, logSettings)
+	return stage0.Run(ctx.Context, cfg, logSettings, opts...)
 }
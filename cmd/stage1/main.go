@@ -19,8 +19,8 @@ import (
 	"fmt"
 	"os"
 
+	"go.githedgehog.com/dasboot/pkg/cliflags"
 	"go.githedgehog.com/dasboot/pkg/log"
-	"go.githedgehog.com/dasboot/pkg/log/syslog"
 	"go.githedgehog.com/dasboot/pkg/stage"
 	"go.githedgehog.com/dasboot/pkg/stage1"
 	"go.githedgehog.com/dasboot/pkg/stage1/config"
@@ -28,15 +28,11 @@ import (
 
 	"github.com/urfave/cli/v2"
 	"go.uber.org/zap"
-	"go.uber.org/zap/zapcore"
-)
-
-var (
-	defaultLogLevel = zapcore.InfoLevel
-	defaultFacility = syslog.LOG_LOCAL0
 )
 
 func main() {
+	defer stage.HandlePanic("stage1")
+
 	app := &cli.App{
 		Name:                 "stage1",
 		Usage:                "device remote attestation and registration with the cluster",
@@ -44,42 +40,20 @@ func main() {
 		Description:          "Should be running in ONIE, and is the second of a series of installer stages within DAS BOOT",
 		Version:              version.Version,
 		EnableBashCompletion: true,
-		Flags: []cli.Flag{
-			&cli.GenericFlag{
-				Name:  "log-level",
-				Usage: "minimum log level to log at",
-				Value: &defaultLogLevel,
-			},
-			&cli.StringFlag{
-				Name:  "log-format",
-				Usage: "log format to use: json or console (only affects serial console)",
-				Value: "console",
-			},
-			&cli.BoolFlag{
-				Name:  "log-development",
-				Usage: "enables development log settings",
-				Value: false,
-			},
-			&cli.StringFlag{
-				Name:  "syslog-server",
-				Usage: "syslog server IP addresses or hostnames or FQDNs",
-			},
-			&cli.GenericFlag{
-				Name:  "syslog-facility",
-				Usage: "syslog facility to use within syslog messages",
-				Value: &defaultFacility,
-			},
-			&cli.PathFlag{
-				Name:  "config",
-				Usage: "optional configuration file to load which can override settings of the embedded configuration",
-			},
-		},
+		Flags:                cliflags.StageFlags(),
 		Action: func(ctx *cli.Context) error {
+			if ctx.Bool(cliflags.PrintCapabilities) {
+				return cliflags.WriteCapabilities(os.Stdout, "stage1")
+			}
 			return runStage1(ctx)
 		},
 	}
 
 	if err := app.Run(os.Args); err != nil {
+		if errors.Is(err, stage.ErrInstallCancelled) {
+			log.L().Error("installation cancelled", zap.Error(err))
+			os.Exit(stage.ExitCodeCancelled)
+		}
 		if errors.Is(err, stage1.ErrExecution) {
 			log.L().Fatal("runtime error", zap.Error(err))
 		}
@@ -90,7 +64,7 @@ func main() {
 
 func runStage1(ctx *cli.Context) error {
 	// read optional configuration file first
-	configPath := ctx.Path("config")
+	configPath := ctx.Path(cliflags.Config)
 	var cfg *config.Stage1
 	if configPath != "" {
 		var err error
@@ -101,17 +75,6 @@ func runStage1(ctx *cli.Context) error {
 	}
 
 	// CLI flags for log settings
-	var syslogServers []string
-	syslogServer := ctx.String("syslog-server")
-	if syslogServer != "" {
-		syslogServers = append(syslogServers, syslogServer)
-	}
-	logSettings := &stage.LogSettings{
-		Development:    ctx.Bool("log-development"),
-		Level:          *ctx.Generic("log-level").(*zapcore.Level),
-		Format:         ctx.String("log-format"),
-		SyslogServers:  syslogServers,
-		SyslogFacility: *ctx.Generic("syslog-facility").(*syslog.Priority),
-	}
+	logSettings := cliflags.LogSettings(ctx)
 	return stage1.Run(ctx.Context, cfg, logSettings)
 }
@@ -19,8 +19,8 @@ import (
 	"fmt"
 	"os"
 
+	"go.githedgehog.com/dasboot/pkg/cliflags"
 	"go.githedgehog.com/dasboot/pkg/log"
-	"go.githedgehog.com/dasboot/pkg/log/syslog"
 	"go.githedgehog.com/dasboot/pkg/stage"
 	"go.githedgehog.com/dasboot/pkg/stage2"
 	"go.githedgehog.com/dasboot/pkg/stage2/config"
@@ -28,15 +28,16 @@ import (
 
 	"github.com/urfave/cli/v2"
 	"go.uber.org/zap"
-	"go.uber.org/zap/zapcore"
 )
 
-var (
-	defaultLogLevel = zapcore.InfoLevel
-	defaultFacility = syslog.LOG_LOCAL0
+const (
+	flagPrestage    = "prestage"
+	flagPrestageDir = "prestage-dir"
 )
 
 func main() {
+	defer stage.HandlePanic("stage2")
+
 	app := &cli.App{
 		Name:                 "stage2",
 		Usage:                "NOS provisioning or ONIE updates",
@@ -44,42 +45,31 @@ func main() {
 		Description:          "Should be running in ONIE, and is the third of a series of installer stages within DAS BOOT",
 		Version:              version.Version,
 		EnableBashCompletion: true,
-		Flags: []cli.Flag{
-			&cli.GenericFlag{
-				Name:  "log-level",
-				Usage: "minimum log level to log at",
-				Value: &defaultLogLevel,
-			},
-			&cli.StringFlag{
-				Name:  "log-format",
-				Usage: "log format to use: json or console (only affects serial console)",
-				Value: "console",
-			},
+		Flags: append(cliflags.StageFlags(),
 			&cli.BoolFlag{
-				Name:  "log-development",
-				Usage: "enables development log settings",
-				Value: false,
-			},
-			&cli.StringFlag{
-				Name:  "syslog-server",
-				Usage: "syslog server IP addresses or hostnames or FQDNs",
-			},
-			&cli.GenericFlag{
-				Name:  "syslog-facility",
-				Usage: "syslog facility to use within syslog messages",
-				Value: &defaultFacility,
+				Name:    flagPrestage,
+				Usage:   "only download and verify the NOS installer and provisioners for a later installation",
+				EnvVars: cliflags.EnvVars(flagPrestage),
 			},
 			&cli.PathFlag{
-				Name:  "config",
-				Usage: "optional configuration file to load which can override settings of the embedded configuration",
+				Name:    flagPrestageDir,
+				Usage:   "directory on persistent storage for pre-staged artifacts (default: on the identity partition)",
+				EnvVars: cliflags.EnvVars(flagPrestageDir),
 			},
-		},
+		),
 		Action: func(ctx *cli.Context) error {
+			if ctx.Bool(cliflags.PrintCapabilities) {
+				return cliflags.WriteCapabilities(os.Stdout, "stage2")
+			}
 			return runStage2(ctx)
 		},
 	}
 
 	if err := app.Run(os.Args); err != nil {
+		if errors.Is(err, stage.ErrInstallCancelled) {
+			log.L().Error("installation cancelled", zap.Error(err))
+			os.Exit(stage.ExitCodeCancelled)
+		}
 		if errors.Is(err, stage2.ErrExecution) {
 			log.L().Fatal("runtime error", zap.Error(err))
 		}
@@ -90,7 +80,7 @@ func main() {
 
 func runStage2(ctx *cli.Context) error {
 	// read optional configuration file first
-	configPath := ctx.Path("config")
+	configPath := ctx.Path(cliflags.Config)
 	var cfg *config.Stage2
 	if configPath != "" {
 		var err error
@@ -100,18 +90,18 @@ func runStage2(ctx *cli.Context) error {
 		}
 	}
 
-	// CLI flags for log settings
-	var syslogServers []string
-	syslogServer := ctx.String("syslog-server")
-	if syslogServer != "" {
-		syslogServers = append(syslogServers, syslogServer)
-	}
-	logSettings := &stage.LogSettings{
-		Development:    ctx.Bool("log-development"),
-		Level:          *ctx.Generic("log-level").(*zapcore.Level),
-		Format:         ctx.String("log-format"),
-		SyslogServers:  syslogServers,
-		SyslogFacility: *ctx.Generic("syslog-facility").(*syslog.Priority),
+	// CLI flags for pre-staging override the configuration file
+	if ctx.Bool(flagPrestage) || ctx.Path(flagPrestageDir) != "" {
+		if cfg == nil {
+			cfg = &config.Stage2{}
+		}
+		cfg.Prestage = cfg.Prestage || ctx.Bool(flagPrestage)
+		if prestageDir := ctx.Path(flagPrestageDir); prestageDir != "" {
+			cfg.PrestageDir = prestageDir
+		}
 	}
+
+	// CLI flags for log settings
+	logSettings := cliflags.LogSettings(ctx)
 	return stage2.Run(ctx.Context, cfg, logSettings)
 }
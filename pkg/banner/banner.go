@@ -0,0 +1,93 @@
+// Copyright 2023 Hedgehog
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package banner holds the "first contact" banner data which the seeder hands out to devices,
+// so that an engineer on the console immediately knows which fabric and seeder has claimed the box.
+package banner
+
+import (
+	"fmt"
+	"io"
+	"strings"
+
+	"go.uber.org/zap/zapcore"
+)
+
+// Banner is the operator information that the seeder returns to devices, and that stage 0
+// prints on the console and to syslog
+type Banner struct {
+	// Operator is the name of the operator (team, company, etc.) which runs the fabric
+	Operator string `json:"operator,omitempty" yaml:"operator,omitempty"`
+
+	// Environment is the name of the environment (fabric, lab, site, etc.) that the seeder belongs to
+	Environment string `json:"environment,omitempty" yaml:"environment,omitempty"`
+
+	// SupportContact is the contact information for the operator (email, phone, chat channel, etc.)
+	SupportContact string `json:"support_contact,omitempty" yaml:"support_contact,omitempty"`
+
+	// ChangeTicket is the change or work order ticket under which this installation is happening
+	ChangeTicket string `json:"change_ticket,omitempty" yaml:"change_ticket,omitempty"`
+
+	// Message is a free form message of the day
+	Message string `json:"message,omitempty" yaml:"message,omitempty"`
+}
+
+// IsEmpty returns true if there is no information in the banner
+func (b *Banner) IsEmpty() bool {
+	return b == nil || (b.Operator == "" && b.Environment == "" && b.SupportContact == "" && b.ChangeTicket == "" && b.Message == "")
+}
+
+const border = "================================================================================"
+
+// Print writes the banner in a human readable form to `w`. It is a no-op for an empty banner.
+func (b *Banner) Print(w io.Writer) error {
+	if b.IsEmpty() {
+		return nil
+	}
+	var sb strings.Builder
+	sb.WriteString(border + "\n")
+	sb.WriteString("This device has been claimed by a Hedgehog seeder\n")
+	for _, line := range [][2]string{
+		{"Operator", b.Operator},
+		{"Environment", b.Environment},
+		{"Support Contact", b.SupportContact},
+		{"Change Ticket", b.ChangeTicket},
+	} {
+		if line[1] != "" {
+			fmt.Fprintf(&sb, "  %-16s %s\n", line[0]+":", line[1])
+		}
+	}
+	if b.Message != "" {
+		sb.WriteString("\n")
+		for _, line := range strings.Split(strings.TrimRight(b.Message, "\n"), "\n") {
+			sb.WriteString("  " + line + "\n")
+		}
+	}
+	sb.WriteString(border + "\n")
+	_, err := io.WriteString(w, sb.String())
+	return err
+}
+
+// MarshalLogObject implements zapcore.ObjectMarshaler
+func (b *Banner) MarshalLogObject(enc zapcore.ObjectEncoder) error {
+	if b == nil {
+		return nil
+	}
+	enc.AddString("operator", b.Operator)
+	enc.AddString("environment", b.Environment)
+	enc.AddString("supportContact", b.SupportContact)
+	enc.AddString("changeTicket", b.ChangeTicket)
+	enc.AddString("message", b.Message)
+	return nil
+}
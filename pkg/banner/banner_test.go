@@ -0,0 +1,75 @@
+// Copyright 2023 Hedgehog
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package banner
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestBanner_Print(t *testing.T) {
+	tests := []struct {
+		name   string
+		banner *Banner
+		want   string
+	}{
+		{
+			name: "nil banner",
+		},
+		{
+			name:   "empty banner",
+			banner: &Banner{},
+		},
+		{
+			name: "full banner",
+			banner: &Banner{
+				Operator:       "Hedgehog",
+				Environment:    "lab-rack-4",
+				SupportContact: "support@example.com",
+				ChangeTicket:   "CHG-1234",
+				Message:        "Do not unplug.\nCall before rebooting.\n",
+			},
+			want: border + "\n" +
+				"This device has been claimed by a Hedgehog seeder\n" +
+				"  Operator:        Hedgehog\n" +
+				"  Environment:     lab-rack-4\n" +
+				"  Support Contact: support@example.com\n" +
+				"  Change Ticket:   CHG-1234\n" +
+				"\n" +
+				"  Do not unplug.\n" +
+				"  Call before rebooting.\n" +
+				border + "\n",
+		},
+		{
+			name:   "partial banner",
+			banner: &Banner{Environment: "prod"},
+			want: border + "\n" +
+				"This device has been claimed by a Hedgehog seeder\n" +
+				"  Environment:     prod\n" +
+				border + "\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			if err := tt.banner.Print(&buf); err != nil {
+				t.Fatalf("Print() error = %v", err)
+			}
+			if got := buf.String(); got != tt.want {
+				t.Errorf("Print() = \n%s\nwant\n%s", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,308 @@
+// Copyright 2023 Hedgehog
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package cliflags provides the command-line flags which are shared between all DAS BOOT
+// stage and tool commands. Every flag can also be set through an environment variable
+// which is the flag name prefixed with `dasboot_` and with dashes replaced by underscores
+// (e.g. `dasboot_log_level`). This allows ONIE wrappers to pass settings without argv.
+package cliflags
+
+import (
+	"encoding/json"
+	"io"
+	"strings"
+
+	"go.githedgehog.com/dasboot/pkg/log/syslog"
+	"go.githedgehog.com/dasboot/pkg/stage"
+	"go.githedgehog.com/dasboot/pkg/version"
+
+	"github.com/urfave/cli/v2"
+	"go.uber.org/zap/zapcore"
+)
+
+const (
+	// EnvPrefix is the prefix of all environment variables which can be used to override flags
+	EnvPrefix = "dasboot_"
+
+	LogLevel       = "log-level"
+	LogFormat      = "log-format"
+	LogDevelopment = "log-development"
+	LogConsole     = "log-console"
+	SyslogServer   = "syslog-server"
+	SyslogFacility = "syslog-facility"
+	SyslogFraming  = "syslog-framing"
+
+	SyslogTransport     = "syslog-transport"
+	SyslogTLSCA         = "syslog-tls-ca"
+	SyslogTLSCert       = "syslog-tls-cert"
+	SyslogTLSKey        = "syslog-tls-key"
+	SyslogTLSServerName = "syslog-tls-server-name"
+
+	Config = "config"
+
+	StagingDir       = "staging-dir"
+	StagingTmpfsSize = "staging-tmpfs-size"
+
+	ForceBreakLock = "force-break-lock"
+
+	PrintCapabilities = "print-capabilities"
+)
+
+const (
+	defaultLogLevel        = zapcore.InfoLevel
+	defaultLogFormat       = "console"
+	defaultSyslogFacility  = syslog.LOG_LOCAL0
+	defaultSyslogFraming   = syslog.DefaultFraming
+	defaultSyslogTransport = syslog.DefaultTransport
+)
+
+// EnvVars returns the environment variables which can be used to set the flag `name`
+func EnvVars(name string) []string {
+	return []string{EnvPrefix + strings.ReplaceAll(name, "-", "_")}
+}
+
+// LogFlags returns the flags for serial console logging
+func LogFlags() []cli.Flag {
+	level := defaultLogLevel
+	return []cli.Flag{
+		&cli.GenericFlag{
+			Name:    LogLevel,
+			Usage:   "minimum log level to log at",
+			EnvVars: EnvVars(LogLevel),
+			Value:   &level,
+		},
+		&cli.StringFlag{
+			Name:    LogFormat,
+			Usage:   "log format to use: json or console (only affects serial console)",
+			EnvVars: EnvVars(LogFormat),
+			Value:   defaultLogFormat,
+		},
+		&cli.BoolFlag{
+			Name:    LogDevelopment,
+			Usage:   "enables development log settings",
+			EnvVars: EnvVars(LogDevelopment),
+			Value:   false,
+		},
+		&cli.StringSliceFlag{
+			Name:    LogConsole,
+			Usage:   "consoles to log to at the same time: 'auto' for autodetection, device names like 'ttyS0', or 'stderr' (default: stderr)",
+			EnvVars: EnvVars(LogConsole),
+		},
+	}
+}
+
+// SyslogFlags returns the flags for syslog logging. The syslog server flag can be passed multiple
+// times, or as a comma-separated list when set through its environment variable.
+func SyslogFlags(defaultServers ...string) []cli.Flag {
+	facility := defaultSyslogFacility
+	framing := defaultSyslogFraming
+	transport := defaultSyslogTransport
+	var servers *cli.StringSlice
+	if len(defaultServers) > 0 {
+		servers = cli.NewStringSlice(defaultServers...)
+	}
+	return []cli.Flag{
+		&cli.StringSliceFlag{
+			Name:    SyslogServer,
+			Usage:   "syslog server IP addresses or hostnames or FQDNs",
+			EnvVars: EnvVars(SyslogServer),
+			Value:   servers,
+		},
+		&cli.GenericFlag{
+			Name:    SyslogFacility,
+			Usage:   "syslog facility to use within syslog messages",
+			EnvVars: EnvVars(SyslogFacility),
+			Value:   &facility,
+		},
+		&cli.GenericFlag{
+			Name:    SyslogFraming,
+			Usage:   "syslog message framing: 'non-transparent' (LF delimited) or 'octet-counting' (RFC 6587)",
+			EnvVars: EnvVars(SyslogFraming),
+			Value:   &framing,
+		},
+		&cli.GenericFlag{
+			Name:    SyslogTransport,
+			Usage:   "syslog transport: 'udp', 'tcp' or 'tcp+tls' (which always uses octet-counting framing)",
+			EnvVars: EnvVars(SyslogTransport),
+			Value:   &transport,
+		},
+		&cli.PathFlag{
+			Name:    SyslogTLSCA,
+			Usage:   "PEM encoded CA bundle to validate syslog servers with over TLS (default: system CAs)",
+			EnvVars: EnvVars(SyslogTLSCA),
+		},
+		&cli.PathFlag{
+			Name:    SyslogTLSCert,
+			Usage:   "PEM encoded client certificate for syslog servers which require mutual TLS",
+			EnvVars: EnvVars(SyslogTLSCert),
+		},
+		&cli.PathFlag{
+			Name:    SyslogTLSKey,
+			Usage:   "PEM encoded key of the client certificate for syslog servers which require mutual TLS",
+			EnvVars: EnvVars(SyslogTLSKey),
+		},
+		&cli.StringFlag{
+			Name:    SyslogTLSServerName,
+			Usage:   "name to validate the syslog server certificates against (default: the host name of the syslog server)",
+			EnvVars: EnvVars(SyslogTLSServerName),
+		},
+	}
+}
+
+// ConfigFlag returns the flag for loading a configuration file. `defaultPath` can be empty if
+// the configuration file is optional.
+func ConfigFlag(usage string, defaultPath string, aliases ...string) cli.Flag {
+	return &cli.PathFlag{
+		Name:    Config,
+		Aliases: aliases,
+		Usage:   usage,
+		EnvVars: EnvVars(Config),
+		Value:   defaultPath,
+	}
+}
+
+// StagingFlags returns the flags for the staging area which stage 0 creates. They override the
+// staging area settings of the embedded configuration.
+func StagingFlags() []cli.Flag {
+	return []cli.Flag{
+		&cli.PathFlag{
+			Name:    StagingDir,
+			Usage:   "base directory in which the staging area gets created (default: system temporary directory)",
+			EnvVars: EnvVars(StagingDir),
+		},
+		&cli.StringFlag{
+			Name:    StagingTmpfsSize,
+			Usage:   "size of the tmpfs for the staging area in bytes with an optional k/m/g suffix, as percentage of the memory like '75%', or '0' to disable it",
+			EnvVars: EnvVars(StagingTmpfsSize),
+		},
+	}
+}
+
+// StageFlags returns the full set of flags which all installer stages and provisioners share
+func StageFlags() []cli.Flag {
+	ret := LogFlags()
+	ret = append(ret, SyslogFlags()...)
+	ret = append(ret, ConfigFlag("optional configuration file to load which can override settings of the embedded configuration", ""))
+	ret = append(ret, &cli.BoolFlag{
+		Name:    PrintCapabilities,
+		Usage:   "prints the build provenance and capabilities as JSON and exits",
+		EnvVars: EnvVars(PrintCapabilities),
+	})
+	return ret
+}
+
+// stageFeatures are the features which all stages support
+var stageFeatures = []string{
+	"signed-responses",
+	"artifact-provenance",
+	"proxy",
+	"install-report",
+	"install-lock",
+}
+
+// Capabilities is what a stage prints when it was called with the `PrintCapabilities` flag
+type Capabilities struct {
+	Name       string              `json:"name"`
+	Version    string              `json:"version"`
+	Provenance *version.Provenance `json:"provenance"`
+	Features   []string            `json:"features"`
+}
+
+// WriteCapabilities writes the capabilities of the stage `name` as JSON to `w`
+func WriteCapabilities(w io.Writer, name string) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(&Capabilities{
+		Name:       name,
+		Version:    version.Version,
+		Provenance: version.GetProvenance(),
+		Features:   stageFeatures,
+	})
+}
+
+// GetLogLevel returns the log level as set by the flags from `LogFlags`
+func GetLogLevel(ctx *cli.Context) zapcore.Level {
+	if level, ok := ctx.Generic(LogLevel).(*zapcore.Level); ok && level != nil {
+		return *level
+	}
+	return defaultLogLevel
+}
+
+// GetSyslogFacility returns the syslog facility as set by the flags from `SyslogFlags`
+func GetSyslogFacility(ctx *cli.Context) syslog.Priority {
+	if facility, ok := ctx.Generic(SyslogFacility).(*syslog.Priority); ok && facility != nil {
+		return *facility
+	}
+	return defaultSyslogFacility
+}
+
+// GetSyslogFraming returns the syslog framing as set by the flags from `SyslogFlags`
+func GetSyslogFraming(ctx *cli.Context) syslog.Framing {
+	if framing, ok := ctx.Generic(SyslogFraming).(*syslog.Framing); ok && framing != nil {
+		return *framing
+	}
+	return defaultSyslogFraming
+}
+
+// GetSyslogTransport returns the syslog transport as set by the flags from `SyslogFlags`
+func GetSyslogTransport(ctx *cli.Context) syslog.Transport {
+	if transport, ok := ctx.Generic(SyslogTransport).(*syslog.Transport); ok && transport != nil {
+		return *transport
+	}
+	return defaultSyslogTransport
+}
+
+// GetSyslogTLS returns the syslog TLS settings as set by the flags from `SyslogFlags`, or nil if none are set
+func GetSyslogTLS(ctx *cli.Context) *syslog.TLSSettings {
+	ret := &syslog.TLSSettings{
+		CAPath:     ctx.Path(SyslogTLSCA),
+		CertPath:   ctx.Path(SyslogTLSCert),
+		KeyPath:    ctx.Path(SyslogTLSKey),
+		ServerName: ctx.String(SyslogTLSServerName),
+	}
+	if ret.CAPath == "" && ret.CertPath == "" && ret.KeyPath == "" && ret.ServerName == "" {
+		return nil
+	}
+	return ret
+}
+
+// LogSettings builds the log settings from the flags from `LogFlags` and `SyslogFlags`
+func LogSettings(ctx *cli.Context) *stage.LogSettings {
+	var syslogServers []string
+	for _, syslogServer := range ctx.StringSlice(SyslogServer) {
+		syslogServer = strings.TrimSpace(syslogServer)
+		if syslogServer != "" {
+			syslogServers = append(syslogServers, syslogServer)
+		}
+	}
+	var consoles []string
+	for _, console := range ctx.StringSlice(LogConsole) {
+		console = strings.TrimSpace(console)
+		if console != "" {
+			consoles = append(consoles, console)
+		}
+	}
+	return &stage.LogSettings{
+		Development:    ctx.Bool(LogDevelopment),
+		Level:          GetLogLevel(ctx),
+		Format:         ctx.String(LogFormat),
+		SyslogServers:  syslogServers,
+		SyslogFacility: GetSyslogFacility(ctx),
+		SyslogFraming:  GetSyslogFraming(ctx),
+		Consoles:       consoles,
+
+		SyslogTransport: GetSyslogTransport(ctx),
+		SyslogTLS:       GetSyslogTLS(ctx),
+	}
+}
@@ -0,0 +1,169 @@
+// Copyright 2023 Hedgehog
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cliflags
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"go.githedgehog.com/dasboot/pkg/log/syslog"
+	"go.githedgehog.com/dasboot/pkg/stage"
+	"go.githedgehog.com/dasboot/pkg/version"
+
+	"github.com/urfave/cli/v2"
+	"go.uber.org/zap/zapcore"
+)
+
+func TestEnvVars(t *testing.T) {
+	if got := EnvVars(LogLevel); !reflect.DeepEqual(got, []string{"dasboot_log_level"}) {
+		t.Errorf("EnvVars() = %v", got)
+	}
+}
+
+func TestLogSettings(t *testing.T) {
+	tests := []struct {
+		name string
+		args []string
+		env  map[string]string
+		want *stage.LogSettings
+	}{
+		{
+			name: "defaults",
+			args: []string{"test"},
+			want: &stage.LogSettings{
+				Level:           zapcore.InfoLevel,
+				Format:          "console",
+				SyslogFacility:  syslog.LOG_LOCAL0,
+				SyslogTransport: syslog.TransportUDP,
+			},
+		},
+		{
+			name: "flags",
+			args: []string{"test", "--log-level", "debug", "--log-format", "json", "--log-development", "--syslog-server", "192.168.42.1", "--syslog-server", "192.168.42.2", "--syslog-facility", "local7"},
+			want: &stage.LogSettings{
+				Level:           zapcore.DebugLevel,
+				Development:     true,
+				Format:          "json",
+				SyslogServers:   []string{"192.168.42.1", "192.168.42.2"},
+				SyslogFacility:  syslog.LOG_LOCAL7,
+				SyslogTransport: syslog.TransportUDP,
+			},
+		},
+		{
+			name: "consoles",
+			args: []string{"test", "--log-console", "ttyS0", "--log-console", "stderr"},
+			env: map[string]string{
+				"dasboot_log_console": "auto",
+			},
+			want: &stage.LogSettings{
+				Level:           zapcore.InfoLevel,
+				Format:          "console",
+				SyslogFacility:  syslog.LOG_LOCAL0,
+				SyslogTransport: syslog.TransportUDP,
+				Consoles:        []string{"ttyS0", "stderr"},
+			},
+		},
+		{
+			name: "environment variables",
+			args: []string{"test"},
+			env: map[string]string{
+				"dasboot_log_level":       "warn",
+				"dasboot_log_development": "true",
+				"dasboot_syslog_server":   "192.168.42.1,192.168.42.2",
+				"dasboot_syslog_facility": "local1",
+			},
+			want: &stage.LogSettings{
+				Level:           zapcore.WarnLevel,
+				Development:     true,
+				Format:          "console",
+				SyslogServers:   []string{"192.168.42.1", "192.168.42.2"},
+				SyslogFacility:  syslog.LOG_LOCAL1,
+				SyslogTransport: syslog.TransportUDP,
+			},
+		},
+		{
+			name: "syslog over TLS",
+			args: []string{"test", "--syslog-server", "syslog.example.com", "--syslog-transport", "tcp+tls", "--syslog-tls-ca", "/etc/ssl/syslog-ca.pem"},
+			env: map[string]string{
+				"dasboot_syslog_tls_server_name": "collector.example.com",
+			},
+			want: &stage.LogSettings{
+				Level:           zapcore.InfoLevel,
+				Format:          "console",
+				SyslogServers:   []string{"syslog.example.com"},
+				SyslogFacility:  syslog.LOG_LOCAL0,
+				SyslogTransport: syslog.TransportTLS,
+				SyslogTLS: &syslog.TLSSettings{
+					CAPath:     "/etc/ssl/syslog-ca.pem",
+					ServerName: "collector.example.com",
+				},
+			},
+		},
+		{
+			name: "flags take precedence over environment variables",
+			args: []string{"test", "--log-level", "error"},
+			env: map[string]string{
+				"dasboot_log_level": "warn",
+			},
+			want: &stage.LogSettings{
+				Level:           zapcore.ErrorLevel,
+				Format:          "console",
+				SyslogFacility:  syslog.LOG_LOCAL0,
+				SyslogTransport: syslog.TransportUDP,
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for k, v := range tt.env {
+				t.Setenv(k, v)
+			}
+			var got *stage.LogSettings
+			app := &cli.App{
+				Name:  "test",
+				Flags: StageFlags(),
+				Action: func(ctx *cli.Context) error {
+					got = LogSettings(ctx)
+					return nil
+				},
+			}
+			if err := app.Run(tt.args); err != nil {
+				t.Fatalf("app.Run() error = %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("LogSettings() = %#v, want %#v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestWriteCapabilities(t *testing.T) {
+	var buf bytes.Buffer
+	if err := WriteCapabilities(&buf, "stage1"); err != nil {
+		t.Fatalf("WriteCapabilities() error = %v", err)
+	}
+	var got Capabilities
+	if err := json.Unmarshal(buf.Bytes(), &got); err != nil {
+		t.Fatalf("WriteCapabilities() wrote invalid JSON: %v", err)
+	}
+	if got.Name != "stage1" || got.Version != version.Version || got.Provenance == nil || got.Provenance.GoVersion == "" {
+		t.Errorf("WriteCapabilities() = %#v", got)
+	}
+	if !reflect.DeepEqual(got.Features, stageFeatures) {
+		t.Errorf("WriteCapabilities() features = %v, want %v", got.Features, stageFeatures)
+	}
+}
@@ -0,0 +1,46 @@
+// Copyright 2023 Hedgehog
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+)
+
+// ErrInsecureURL is returned if a configuration references the seeder over plain HTTP outside of lab mode
+var ErrInsecureURL = errors.New("config: plain HTTP URL requires lab mode")
+
+// ValidateSecureURLs ensures that none of the `urls` uses plain HTTP unless `labMode` is set. Lab mode is an
+// insecure mode for throwaway lab environments which only the seeder can enable in the signed embedded
+// configuration, so that a device never falls back to plain HTTP on its own. Empty URLs are ignored.
+func ValidateSecureURLs(labMode bool, urls ...string) error {
+	if labMode {
+		return nil
+	}
+	for _, s := range urls {
+		if s == "" {
+			continue
+		}
+		u, err := url.Parse(s)
+		if err != nil {
+			return fmt.Errorf("config: invalid URL '%s': %w", s, err)
+		}
+		if u.Scheme == "http" {
+			return fmt.Errorf("%w: %s", ErrInsecureURL, u.Redacted())
+		}
+	}
+	return nil
+}
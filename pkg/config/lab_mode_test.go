@@ -0,0 +1,52 @@
+// Copyright 2023 Hedgehog
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestValidateSecureURLs(t *testing.T) {
+	tests := []struct {
+		name    string
+		labMode bool
+		urls    []string
+		wantErr error
+	}{
+		{
+			name: "HTTPS",
+			urls: []string{"https://seeder.example.com/stage1/x86_64", ""},
+		},
+		{
+			name:    "plain HTTP",
+			urls:    []string{"https://seeder.example.com/stage1/x86_64", "http://seeder.example.com/stage1/x86_64"},
+			wantErr: ErrInsecureURL,
+		},
+		{
+			name:    "plain HTTP in lab mode",
+			labMode: true,
+			urls:    []string{"http://seeder.example.com/stage1/x86_64"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := ValidateSecureURLs(tt.labMode, tt.urls...)
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("ValidateSecureURLs() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
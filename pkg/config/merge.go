@@ -0,0 +1,279 @@
+// Copyright 2023 Hedgehog
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+// MergeTag is the struct tag which tells `Merge` how a field of a configuration can be overridden. Its value is a
+// strategy, optionally followed by options which are separated by commas. The strategies are:
+//
+//   - "set": the field is overridden if it is set in the override. Pointers are overridden with a copy of the value.
+//   - "replace": for slices and maps, the field is overridden with a copy if it is not empty in the override
+//   - "append": for slices, the elements of the override get appended to the ones of the embedded configuration
+//   - "key=<field>": for slices of structs, elements of the override replace the elements with the same value in
+//     `<field>`, and all other elements get appended
+//   - "deep": for structs or pointers to structs, every field is being merged according to its own tag
+//   - "-": the field can never be overridden
+//
+// The only option is "reset=<field>" which resets `<field>` to its value in the override whenever the field gets
+// overridden. It is for fields which are only valid together with the field, like the pin of a download URL.
+const MergeTag = "merge"
+
+const (
+	mergeSet     = "set"
+	mergeReplace = "replace"
+	mergeAppend  = "append"
+	mergeDeep    = "deep"
+	mergeNever   = "-"
+
+	mergeKeyPrefix   = "key="
+	mergeResetPrefix = "reset="
+)
+
+var ErrInvalidMergeTag = errors.New("config: invalid merge tag")
+
+// mergeRule is the parsed merge tag of a field
+type mergeRule struct {
+	strategy string
+	key      string
+	resets   []string
+}
+
+// Merge merges `override` into a copy of `embedded` according to the merge tags of `T`, which must be a struct.
+// It never modifies its arguments. It returns nil if `embedded` is nil, and panics if the merge tags of `T`
+// are invalid, which `ValidateMergeTags` detects in tests.
+func Merge[T any](embedded *T, override *T) *T {
+	if embedded == nil {
+		return nil
+	}
+	ret := *embedded
+	if override == nil {
+		return &ret
+	}
+	if err := mergeStruct(reflect.ValueOf(&ret).Elem(), reflect.ValueOf(override).Elem()); err != nil {
+		panic(err)
+	}
+	return &ret
+}
+
+// ValidateMergeTags ensures that every exported field of `T` and of all structs which are merged deeply carries
+// a valid merge tag. Every configuration which uses `Merge` should call it in its tests, so that new fields
+// cannot be added without deciding how they are being merged.
+func ValidateMergeTags[T any]() error {
+	return validateMergeTags(reflect.TypeOf((*T)(nil)).Elem())
+}
+
+func validateMergeTags(t reflect.Type) error {
+	if t.Kind() != reflect.Struct {
+		return fmt.Errorf("%w: %s is not a struct", ErrInvalidMergeTag, t)
+	}
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if !f.IsExported() {
+			continue
+		}
+		rule, err := parseMergeRule(t, f)
+		if err != nil {
+			return err
+		}
+		if rule.strategy == mergeDeep {
+			ft := f.Type
+			if ft.Kind() == reflect.Pointer {
+				ft = ft.Elem()
+			}
+			if err := validateMergeTags(ft); err != nil {
+				return fmt.Errorf("%s.%s: %w", t.Name(), f.Name, err)
+			}
+		}
+	}
+	return nil
+}
+
+func parseMergeRule(t reflect.Type, f reflect.StructField) (*mergeRule, error) {
+	tag, ok := f.Tag.Lookup(MergeTag)
+	if !ok {
+		return nil, fmt.Errorf("%w: %s.%s has no merge tag", ErrInvalidMergeTag, t.Name(), f.Name)
+	}
+	invalid := func(reason string) error {
+		return fmt.Errorf("%w: %s.%s: '%s' %s", ErrInvalidMergeTag, t.Name(), f.Name, tag, reason)
+	}
+
+	parts := strings.Split(tag, ",")
+	rule := &mergeRule{strategy: parts[0]}
+	for _, opt := range parts[1:] {
+		name, found := strings.CutPrefix(opt, mergeResetPrefix)
+		if !found {
+			return nil, invalid("has an unknown option")
+		}
+		if _, ok := t.FieldByName(name); !ok {
+			return nil, invalid("resets a field which does not exist")
+		}
+		rule.resets = append(rule.resets, name)
+	}
+
+	kind := f.Type.Kind()
+	switch {
+	case rule.strategy == mergeSet:
+		if kind == reflect.Slice || kind == reflect.Map {
+			return nil, invalid("must decide between replacing or appending")
+		}
+	case rule.strategy == mergeReplace:
+		if kind != reflect.Slice && kind != reflect.Map {
+			return nil, invalid("is only for slices and maps")
+		}
+	case rule.strategy == mergeAppend:
+		if kind != reflect.Slice {
+			return nil, invalid("is only for slices")
+		}
+	case strings.HasPrefix(rule.strategy, mergeKeyPrefix):
+		rule.key = strings.TrimPrefix(rule.strategy, mergeKeyPrefix)
+		if kind != reflect.Slice || f.Type.Elem().Kind() != reflect.Struct {
+			return nil, invalid("is only for slices of structs")
+		}
+		kf, ok := f.Type.Elem().FieldByName(rule.key)
+		if !ok || !kf.Type.Comparable() {
+			return nil, invalid("has no comparable key field")
+		}
+	case rule.strategy == mergeDeep:
+		if kind != reflect.Struct && (kind != reflect.Pointer || f.Type.Elem().Kind() != reflect.Struct) {
+			return nil, invalid("is only for structs and pointers to structs")
+		}
+	case rule.strategy == mergeNever:
+		if len(rule.resets) > 0 {
+			return nil, invalid("resets fields of a field which is never overridden")
+		}
+	default:
+		return nil, invalid("has an unknown strategy")
+	}
+	return rule, nil
+}
+
+// mergeStruct merges the struct `override` into the struct `ret` which must be addressable
+func mergeStruct(ret reflect.Value, override reflect.Value) error {
+	t := ret.Type()
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if !f.IsExported() {
+			continue
+		}
+		rule, err := parseMergeRule(t, f)
+		if err != nil {
+			return err
+		}
+		ov := override.Field(i)
+		if rule.strategy == mergeNever || isUnset(ov) {
+			continue
+		}
+		for _, name := range rule.resets {
+			ret.FieldByName(name).Set(clone(override.FieldByName(name)))
+		}
+		if err := mergeField(rule, ret.Field(i), ov); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func mergeField(rule *mergeRule, ret reflect.Value, override reflect.Value) error {
+	switch {
+	case rule.strategy == mergeAppend:
+		merged := reflect.MakeSlice(ret.Type(), 0, ret.Len()+override.Len())
+		ret.Set(reflect.AppendSlice(reflect.AppendSlice(merged, ret), override))
+	case rule.key != "":
+		merged := reflect.MakeSlice(ret.Type(), ret.Len(), ret.Len())
+		reflect.Copy(merged, ret)
+		for i := 0; i < override.Len(); i++ {
+			elem := override.Index(i)
+			j := indexByKey(merged, rule.key, elem.FieldByName(rule.key))
+			if j >= 0 {
+				merged.Index(j).Set(elem)
+			} else {
+				merged = reflect.Append(merged, elem)
+			}
+		}
+		ret.Set(merged)
+	case rule.strategy == mergeDeep && ret.Kind() == reflect.Pointer:
+		// the embedded value must never be modified, so we merge into a copy
+		merged := reflect.New(ret.Type().Elem())
+		if !ret.IsNil() {
+			merged.Elem().Set(ret.Elem())
+		}
+		if err := mergeStruct(merged.Elem(), override.Elem()); err != nil {
+			return err
+		}
+		ret.Set(merged)
+	case rule.strategy == mergeDeep:
+		return mergeStruct(ret, override)
+	default:
+		ret.Set(clone(override))
+	}
+	return nil
+}
+
+// isUnset returns true if `v` is not set in an override. Empty slices and maps are not set either.
+func isUnset(v reflect.Value) bool {
+	switch v.Kind() { //nolint:exhaustive
+	case reflect.Slice, reflect.Map:
+		return v.Len() == 0
+	default:
+		return v.IsZero()
+	}
+}
+
+func indexByKey(s reflect.Value, key string, want reflect.Value) int {
+	for i := 0; i < s.Len(); i++ {
+		if s.Index(i).FieldByName(key).Equal(want) {
+			return i
+		}
+	}
+	return -1
+}
+
+// clone returns a copy of `v` which does not share its top level slice, map or pointer with it
+func clone(v reflect.Value) reflect.Value {
+	switch v.Kind() { //nolint:exhaustive
+	case reflect.Slice:
+		if v.IsNil() {
+			return v
+		}
+		ret := reflect.MakeSlice(v.Type(), v.Len(), v.Len())
+		reflect.Copy(ret, v)
+		return ret
+	case reflect.Map:
+		if v.IsNil() {
+			return v
+		}
+		ret := reflect.MakeMapWithSize(v.Type(), v.Len())
+		iter := v.MapRange()
+		for iter.Next() {
+			ret.SetMapIndex(iter.Key(), iter.Value())
+		}
+		return ret
+	case reflect.Pointer:
+		if v.IsNil() {
+			return v
+		}
+		ret := reflect.New(v.Type().Elem())
+		ret.Elem().Set(v.Elem())
+		return ret
+	default:
+		return v
+	}
+}
@@ -0,0 +1,179 @@
+// Copyright 2023 Hedgehog
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"errors"
+	"maps"
+	"reflect"
+	"slices"
+	"testing"
+)
+
+type mergeTestNested struct {
+	A string `merge:"set"`
+	B int    `merge:"set"`
+}
+
+type mergeTestItem struct {
+	Name  string
+	Value string
+}
+
+type mergeTestConfig struct {
+	URL       string            `merge:"set,reset=Pin,reset=Mirrors"`
+	Pin       *string           `merge:"set"`
+	Mirrors   []string          `merge:"replace"`
+	Servers   []string          `merge:"append"`
+	Labels    map[string]string `merge:"replace"`
+	Items     []mergeTestItem   `merge:"key=Name"`
+	Nested    mergeTestNested   `merge:"deep"`
+	NestedPtr *mergeTestNested  `merge:"deep"`
+	Strict    bool              `merge:"set"`
+	Immutable bool              `merge:"-"`
+
+	unexported string
+}
+
+func TestMerge(t *testing.T) {
+	pin := "sha256:abc"
+	otherPin := "sha256:def"
+	tests := []struct {
+		name     string
+		embedded *mergeTestConfig
+		override *mergeTestConfig
+		want     *mergeTestConfig
+	}{
+		{
+			name: "no embedded config",
+		},
+		{
+			name:     "no override",
+			embedded: &mergeTestConfig{URL: "https://a", unexported: "kept"},
+			want:     &mergeTestConfig{URL: "https://a", unexported: "kept"},
+		},
+		{
+			name:     "unset fields are not overridden",
+			embedded: &mergeTestConfig{URL: "https://a", Pin: &pin, Mirrors: []string{"https://m"}, Strict: true, Nested: mergeTestNested{A: "a", B: 1}},
+			override: &mergeTestConfig{Mirrors: []string{}},
+			want:     &mergeTestConfig{URL: "https://a", Pin: &pin, Mirrors: []string{"https://m"}, Strict: true, Nested: mergeTestNested{A: "a", B: 1}},
+		},
+		{
+			name:     "overriding a field resets the fields which depend on it",
+			embedded: &mergeTestConfig{URL: "https://a", Pin: &pin, Mirrors: []string{"https://m"}},
+			override: &mergeTestConfig{URL: "https://b"},
+			want:     &mergeTestConfig{URL: "https://b"},
+		},
+		{
+			name:     "dependent fields can be overridden together",
+			embedded: &mergeTestConfig{URL: "https://a", Pin: &pin},
+			override: &mergeTestConfig{URL: "https://b", Pin: &otherPin},
+			want:     &mergeTestConfig{URL: "https://b", Pin: &otherPin},
+		},
+		{
+			name:     "slices and maps",
+			embedded: &mergeTestConfig{Servers: []string{"a"}, Labels: map[string]string{"a": "1", "b": "2"}},
+			override: &mergeTestConfig{Servers: []string{"b"}, Labels: map[string]string{"c": "3"}},
+			want:     &mergeTestConfig{Servers: []string{"a", "b"}, Labels: map[string]string{"c": "3"}},
+		},
+		{
+			name:     "keyed slices",
+			embedded: &mergeTestConfig{Items: []mergeTestItem{{Name: "a", Value: "1"}, {Name: "b", Value: "2"}}},
+			override: &mergeTestConfig{Items: []mergeTestItem{{Name: "b", Value: "3"}, {Name: "c", Value: "4"}}},
+			want:     &mergeTestConfig{Items: []mergeTestItem{{Name: "a", Value: "1"}, {Name: "b", Value: "3"}, {Name: "c", Value: "4"}}},
+		},
+		{
+			name:     "deep merges",
+			embedded: &mergeTestConfig{Nested: mergeTestNested{A: "a", B: 1}, NestedPtr: &mergeTestNested{A: "a", B: 1}},
+			override: &mergeTestConfig{Nested: mergeTestNested{B: 2}, NestedPtr: &mergeTestNested{A: "b"}},
+			want:     &mergeTestConfig{Nested: mergeTestNested{A: "a", B: 2}, NestedPtr: &mergeTestNested{A: "b", B: 1}},
+		},
+		{
+			name:     "deep merge without embedded value",
+			embedded: &mergeTestConfig{},
+			override: &mergeTestConfig{NestedPtr: &mergeTestNested{A: "b"}},
+			want:     &mergeTestConfig{NestedPtr: &mergeTestNested{A: "b"}},
+		},
+		{
+			name:     "fields which can never be overridden",
+			embedded: &mergeTestConfig{},
+			override: &mergeTestConfig{Immutable: true, unexported: "ignored"},
+			want:     &mergeTestConfig{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var before *mergeTestConfig
+			if tt.embedded != nil {
+				before = deepCopyMergeTestConfig(tt.embedded)
+			}
+			got := Merge(tt.embedded, tt.override)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Merge() = %#v, want %#v", got, tt.want)
+			}
+			if !reflect.DeepEqual(tt.embedded, before) {
+				t.Errorf("Merge() modified the embedded config: %#v, was %#v", tt.embedded, before)
+			}
+		})
+	}
+}
+
+func deepCopyMergeTestConfig(c *mergeTestConfig) *mergeTestConfig {
+	ret := *c
+	ret.Mirrors = slices.Clone(c.Mirrors)
+	ret.Servers = slices.Clone(c.Servers)
+	ret.Labels = maps.Clone(c.Labels)
+	ret.Items = slices.Clone(c.Items)
+	if c.NestedPtr != nil {
+		n := *c.NestedPtr
+		ret.NestedPtr = &n
+	}
+	return &ret
+}
+
+func TestValidateMergeTags(t *testing.T) {
+	if err := ValidateMergeTags[mergeTestConfig](); err != nil {
+		t.Errorf("ValidateMergeTags() = %v, want nil", err)
+	}
+
+	type missing struct {
+		A string `merge:"set"`
+		B string
+	}
+	type nestedMissing struct {
+		N *missing `merge:"deep"`
+	}
+	type setSlice struct {
+		S []string `merge:"set"`
+	}
+	type unknownReset struct {
+		A string `merge:"set,reset=B"`
+	}
+	type unknownKey struct {
+		Items []mergeTestItem `merge:"key=ID"`
+	}
+	for name, f := range map[string]func() error{
+		"missing tag":         ValidateMergeTags[missing],
+		"missing nested tag":  ValidateMergeTags[nestedMissing],
+		"set on a slice":      ValidateMergeTags[setSlice],
+		"unknown reset field": ValidateMergeTags[unknownReset],
+		"unknown key field":   ValidateMergeTags[unknownKey],
+		"not a struct":        ValidateMergeTags[string],
+	} {
+		if err := f(); !errors.Is(err, ErrInvalidMergeTag) {
+			t.Errorf("%s: ValidateMergeTags() = %v, want %v", name, err, ErrInvalidMergeTag)
+		}
+	}
+}
@@ -19,8 +19,14 @@ import "fmt"
 // Tlv represents an ONIE TLV
 type Tlv uint8
 
+// ONIE TLV codes as they are defined in the ONIE TlvInfo EEPROM format
 const (
-	TlvSerial Tlv = 0x23
+	TlvProductName  Tlv = 0x21
+	TlvPartNumber   Tlv = 0x22
+	TlvSerial       Tlv = 0x23
+	TlvManufacturer Tlv = 0x2B
+	TlvVendor       Tlv = 0x2D
+	TlvServiceTag   Tlv = 0x2F
 )
 
 func (t Tlv) String() string {
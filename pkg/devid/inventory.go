@@ -0,0 +1,108 @@
+// Copyright 2023 Hedgehog
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package devid
+
+import (
+	"bufio"
+	"bytes"
+	"strconv"
+	"strings"
+
+	"go.githedgehog.com/dasboot/pkg/exec"
+)
+
+// Inventory is the hardware inventory of a device as it is stored in its ONIE EEPROM. Contrary to the device ID,
+// these values are human readable and allow operators to find a device by the label on its chassis.
+type Inventory struct {
+	// VendorID is the IANA private enterprise number of the vendor as reported by onie-sysinfo
+	VendorID string `json:"vendor_id,omitempty"`
+
+	// Vendor is the name of the vendor of the device
+	Vendor string `json:"vendor,omitempty"`
+
+	// Manufacturer is the name of the manufacturer of the device, which can differ from the vendor
+	Manufacturer string `json:"manufacturer,omitempty"`
+
+	// ProductName is the product name of the device
+	ProductName string `json:"product_name,omitempty"`
+
+	// PartNumber is the vendor part number of the device
+	PartNumber string `json:"part_number,omitempty"`
+
+	// Serial is the serial number of the device
+	Serial string `json:"serial,omitempty"`
+
+	// AssetTag is the asset tag of the device, which ONIE calls the service tag
+	AssetTag string `json:"asset_tag,omitempty"`
+}
+
+// IsEmpty returns true if no inventory information was found
+func (i *Inventory) IsEmpty() bool {
+	return i == nil || *i == Inventory{}
+}
+
+// CollectInventory reads the hardware inventory from the ONIE EEPROM. Missing values are left empty, and
+// it returns an error only if the EEPROM could not be read at all.
+func CollectInventory() (*Inventory, error) {
+	out, err := exec.Command(onieSyseeprom).Output()
+	if err != nil {
+		return nil, err
+	}
+	tlvs := parseSyseeprom(out)
+	ret := &Inventory{
+		Vendor:       tlvs[TlvVendor],
+		Manufacturer: tlvs[TlvManufacturer],
+		ProductName:  tlvs[TlvProductName],
+		PartNumber:   tlvs[TlvPartNumber],
+		Serial:       tlvs[TlvSerial],
+		AssetTag:     tlvs[TlvServiceTag],
+	}
+
+	// the vendor ID is not necessarily in the EEPROM, but ONIE always knows it
+	if out, err := exec.Command(onieSysinfo, "-i").Output(); err == nil {
+		ret.VendorID = strings.TrimSpace(string(out))
+	}
+	return ret, nil
+}
+
+// parseSyseeprom parses the TLV table as it is printed by onie-syseeprom:
+//
+//	TLV Name             Code Len Value
+//	-------------------- ---- --- -----
+//	Product Name         0x21   8 S5248F-ON
+//	Serial Number        0x23  20 TH0X1234567890ABCDEF
+func parseSyseeprom(out []byte) map[Tlv]string {
+	ret := map[Tlv]string{}
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		// the name can contain spaces, so we look for the code column which is followed by the length
+		for i := 0; i+2 < len(fields); i++ {
+			if !strings.HasPrefix(fields[i], "0x") {
+				continue
+			}
+			code, err := strconv.ParseUint(fields[i][2:], 16, 8)
+			if err != nil {
+				continue
+			}
+			if _, err := strconv.ParseUint(fields[i+1], 10, 16); err != nil {
+				continue
+			}
+			ret[Tlv(code)] = strings.Join(fields[i+2:], " ")
+			break
+		}
+	}
+	return ret
+}
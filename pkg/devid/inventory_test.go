@@ -0,0 +1,70 @@
+// Copyright 2023 Hedgehog
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package devid
+
+import (
+	"reflect"
+	"testing"
+)
+
+func Test_parseSyseeprom(t *testing.T) {
+	tests := []struct {
+		name string
+		out  string
+		want map[Tlv]string
+	}{
+		{
+			name: "full table",
+			out: `TlvInfo Header:
+   Id String:    TlvInfo
+   Version:      1
+   Total Length: 178
+TLV Name             Code Len Value
+-------------------- ---- --- -----
+Product Name         0x21   9 S5248F-ON
+Part Number          0x22   6 0D2X8R
+Serial Number        0x23  20 CN0D2X8RCES0099B0036
+Base MAC Address     0x24   6 0C:29:EF:CF:63:01
+Manufacturer         0x2B   5 CES00
+Vendor Name          0x2D   4 DELL
+Service Tag          0x2F   7 ABC 123
+CRC-32               0xFE   4 0x2E2A8A11
+Checksum is valid.
+`,
+			want: map[Tlv]string{
+				TlvProductName:  "S5248F-ON",
+				TlvPartNumber:   "0D2X8R",
+				TlvSerial:       "CN0D2X8RCES0099B0036",
+				0x24:            "0C:29:EF:CF:63:01",
+				TlvManufacturer: "CES00",
+				TlvVendor:       "DELL",
+				TlvServiceTag:   "ABC 123",
+				0xFE:            "0x2E2A8A11",
+			},
+		},
+		{
+			name: "no TLVs",
+			out:  "onie-syseeprom: EEPROM is not initialized\n",
+			want: map[Tlv]string{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := parseSyseeprom([]byte(tt.out)); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseSyseeprom() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,126 @@
+// Copyright 2023 Hedgehog
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package efivar
+
+import (
+	"context"
+
+	"github.com/0x5a17ed/itkit"
+	"github.com/0x5a17ed/itkit/iters/sliceit"
+	"github.com/0x5a17ed/uefi/efi/efiguid"
+	"github.com/0x5a17ed/uefi/efi/efivario"
+)
+
+// storeContext adapts a Store to an efivario.Context so that the typed
+// variables of the efivars package can be used with it
+type storeContext struct {
+	ctx context.Context
+	s   Store
+
+	// efivario always asks for a size hint before it reads a variable, so the
+	// variable is only read once for the hint and kept for the following read
+	hinted *hintedVariable
+}
+
+type hintedVariable struct {
+	name  string
+	guid  efiguid.GUID
+	attrs efivario.Attributes
+	value []byte
+	err   error
+}
+
+var _ efivario.Context = &storeContext{}
+
+// NewContext returns an efivario.Context for the Store `s`. All operations are being executed with `ctx`.
+// The returned context must not be used concurrently.
+func NewContext(ctx context.Context, s Store) efivario.Context {
+	return &storeContext{ctx: ctx, s: s}
+}
+
+// Close implements efivario.Context
+func (c *storeContext) Close() error {
+	return nil
+}
+
+// GetSizeHint implements efivario.Context
+func (c *storeContext) GetSizeHint(name string, guid efiguid.GUID) (int64, error) {
+	attrs, value, err := c.s.Get(c.ctx, name, guid)
+	c.hinted = &hintedVariable{name: name, guid: guid, attrs: attrs, value: value, err: err}
+	if err != nil {
+		return -1, err
+	}
+	return int64(len(value)), nil
+}
+
+// Get implements efivario.Context
+func (c *storeContext) Get(name string, guid efiguid.GUID, out []byte) (efivario.Attributes, int, error) {
+	var attrs efivario.Attributes
+	var value []byte
+	var err error
+	if h := c.hinted; h != nil && h.name == name && h.guid == guid {
+		attrs, value, err = h.attrs, h.value, h.err
+	} else {
+		attrs, value, err = c.s.Get(c.ctx, name, guid)
+	}
+	c.hinted = nil
+	if err != nil {
+		return 0, 0, err
+	}
+	if len(value) > len(out) {
+		return 0, 0, efivario.ErrInsufficientSpace
+	}
+	return attrs, copy(out, value), nil
+}
+
+// Set implements efivario.Context
+func (c *storeContext) Set(name string, guid efiguid.GUID, attrs efivario.Attributes, value []byte) error {
+	c.hinted = nil
+	return c.s.Set(c.ctx, name, guid, attrs, value)
+}
+
+// Delete implements efivario.Context
+func (c *storeContext) Delete(name string, guid efiguid.GUID) error {
+	c.hinted = nil
+	return c.s.Delete(c.ctx, name, guid)
+}
+
+// VariableNames implements efivario.Context
+func (c *storeContext) VariableNames() (efivario.VariableNameIterator, error) {
+	names, err := c.s.Names(c.ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &nameIterator{Iterator: sliceit.In(names)}, nil
+}
+
+// nameIterator implements efivario.VariableNameIterator for a slice of names
+type nameIterator struct {
+	itkit.Iterator[efivario.VariableNameItem]
+}
+
+var _ efivario.VariableNameIterator = &nameIterator{}
+
+func (it *nameIterator) Close() error {
+	return nil
+}
+
+func (it *nameIterator) Iter() itkit.Iterator[efivario.VariableNameItem] {
+	return it
+}
+
+func (it *nameIterator) Err() error {
+	return nil
+}
@@ -0,0 +1,221 @@
+// Copyright 2023 Hedgehog
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package efivar provides access to EFI variables on top of efivario. Some firmware
+// implementations occasionally fail EFI variable reads and writes with transient errors
+// like EINTR or ENOSPC, so all operations of a `Store` are being retried with a backoff.
+// The `Fake` is an in-memory implementation of an efivario.Context for unit tests.
+package efivar
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"syscall"
+	"time"
+
+	"github.com/0x5a17ed/uefi/efi/efiguid"
+	"github.com/0x5a17ed/uefi/efi/efivario"
+)
+
+const (
+	// DefaultRetries is the number of times an operation is being retried after a transient error
+	DefaultRetries = 3
+
+	// DefaultBackoff is the backoff after the first transient error. It doubles with every retry.
+	DefaultBackoff = 50 * time.Millisecond
+
+	// DefaultMaxSize is the largest EFI variable which a Store reads or writes
+	DefaultMaxSize = 64 * 1024
+
+	// initialSize is the buffer size which is used for reading variables if there is no size hint
+	initialSize = 8
+)
+
+var (
+	ErrVariableTooLarge = errors.New("efivar: variable too large")
+)
+
+// Store provides access to EFI variables
+type Store interface {
+	// Get returns the attributes and the value of the EFI variable `name`
+	Get(ctx context.Context, name string, guid efiguid.GUID) (efivario.Attributes, []byte, error)
+
+	// Set writes the EFI variable `name`
+	Set(ctx context.Context, name string, guid efiguid.GUID, attrs efivario.Attributes, value []byte) error
+
+	// Delete removes the EFI variable `name`
+	Delete(ctx context.Context, name string, guid efiguid.GUID) error
+
+	// Names returns the names of all EFI variables which are currently set
+	Names(ctx context.Context) ([]efivario.VariableNameItem, error)
+}
+
+// Option is an option which can be passed to `New`
+type Option func(*store)
+
+// WithRetries sets the number of times an operation is being retried after a transient error
+func WithRetries(retries int) Option {
+	return func(s *store) {
+		s.retries = retries
+	}
+}
+
+// WithBackoff sets the backoff after the first transient error. It doubles with every retry.
+func WithBackoff(backoff time.Duration) Option {
+	return func(s *store) {
+		s.backoff = backoff
+	}
+}
+
+// WithMaxSize sets the largest EFI variable which is being read or written
+func WithMaxSize(maxSize int) Option {
+	return func(s *store) {
+		s.maxSize = maxSize
+	}
+}
+
+type store struct {
+	c       efivario.Context
+	retries int
+	backoff time.Duration
+	maxSize int
+}
+
+var _ Store = &store{}
+
+// New returns a Store which accesses EFI variables through `c`, and which retries transient errors
+func New(c efivario.Context, opts ...Option) Store {
+	s := &store{
+		c:       c,
+		retries: DefaultRetries,
+		backoff: DefaultBackoff,
+		maxSize: DefaultMaxSize,
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	return s
+}
+
+// NewDefault returns a Store for the EFI variables of the running system
+func NewDefault(opts ...Option) Store {
+	return New(efivario.NewDefaultContext(), opts...)
+}
+
+// IsTransient returns true for errors which some firmware returns for EFI variable operations
+// which will succeed when they are being retried
+func IsTransient(err error) bool {
+	return errors.Is(err, syscall.EINTR) ||
+		errors.Is(err, syscall.EAGAIN) ||
+		errors.Is(err, syscall.EBUSY) ||
+		errors.Is(err, syscall.ENOSPC)
+}
+
+func (s *store) retry(ctx context.Context, f func() error) error {
+	backoff := s.backoff
+	for i := 0; ; i++ {
+		err := f()
+		if err == nil || !IsTransient(err) || i >= s.retries {
+			return err
+		}
+		t := time.NewTimer(backoff)
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return fmt.Errorf("%w (last error: %w)", ctx.Err(), err)
+		case <-t.C:
+		}
+		backoff *= 2
+	}
+}
+
+// Get implements Store
+func (s *store) Get(ctx context.Context, name string, guid efiguid.GUID) (efivario.Attributes, []byte, error) {
+	var hint int64
+	if err := s.retry(ctx, func() (err error) {
+		hint, err = s.c.GetSizeHint(name, guid)
+		return
+	}); err != nil || hint <= 0 {
+		hint = initialSize
+	}
+	size := int(hint)
+	if size > s.maxSize {
+		return 0, nil, fmt.Errorf("%w: %s is %d bytes, maximum is %d bytes", ErrVariableTooLarge, name, size, s.maxSize)
+	}
+
+	for {
+		out := make([]byte, size)
+		var attrs efivario.Attributes
+		var n int
+		err := s.retry(ctx, func() (err error) {
+			attrs, n, err = s.c.Get(name, guid, out)
+			return
+		})
+		if err == nil {
+			return attrs, out[:n], nil
+		}
+		if !errors.Is(err, efivario.ErrInsufficientSpace) {
+			return 0, nil, err
+		}
+		if size >= s.maxSize {
+			return 0, nil, fmt.Errorf("%w: %s is larger than the maximum of %d bytes", ErrVariableTooLarge, name, s.maxSize)
+		}
+		size *= 2
+		if size > s.maxSize {
+			size = s.maxSize
+		}
+	}
+}
+
+// Set implements Store
+func (s *store) Set(ctx context.Context, name string, guid efiguid.GUID, attrs efivario.Attributes, value []byte) error {
+	if len(value) > s.maxSize {
+		return fmt.Errorf("%w: %s is %d bytes, maximum is %d bytes", ErrVariableTooLarge, name, len(value), s.maxSize)
+	}
+	return s.retry(ctx, func() error {
+		return s.c.Set(name, guid, attrs, value)
+	})
+}
+
+// Delete implements Store
+func (s *store) Delete(ctx context.Context, name string, guid efiguid.GUID) error {
+	return s.retry(ctx, func() error {
+		return s.c.Delete(name, guid)
+	})
+}
+
+// Names implements Store
+func (s *store) Names(ctx context.Context) ([]efivario.VariableNameItem, error) {
+	var ret []efivario.VariableNameItem
+	if err := s.retry(ctx, func() error {
+		it, err := s.c.VariableNames()
+		if err != nil {
+			return err
+		}
+		defer it.Close()
+		ret = ret[:0]
+		for it.Next() {
+			ret = append(ret, it.Value())
+		}
+		return it.Err()
+	}); err != nil {
+		return nil, err
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		return ret[i].Name < ret[j].Name
+	})
+	return ret, nil
+}
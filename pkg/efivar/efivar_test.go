@@ -0,0 +1,189 @@
+// Copyright 2023 Hedgehog
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package efivar
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/0x5a17ed/uefi/efi/efivario"
+	"github.com/0x5a17ed/uefi/efi/efivars"
+)
+
+func TestStore(t *testing.T) {
+	errPermanent := errors.New("permanent error")
+	attrs := efivario.BootServiceAccess | efivario.RuntimeAccess | efivario.NonVolatile
+	large := bytes.Repeat([]byte{0xaa}, 100)
+
+	tests := []struct {
+		name    string
+		pre     func(f *Fake)
+		run     func(ctx context.Context, s Store) error
+		wantErr error
+	}{
+		{
+			name: "get retries transient errors",
+			pre: func(f *Fake) {
+				f.Set("Test", efivars.GlobalVariable, attrs, []byte{1, 2, 3}) //nolint:errcheck
+				f.Fail(OpGet, "Test", syscall.EINTR, 2)
+			},
+			run: func(ctx context.Context, s Store) error {
+				gotAttrs, got, err := s.Get(ctx, "Test", efivars.GlobalVariable)
+				if err != nil {
+					return err
+				}
+				if gotAttrs != attrs || !bytes.Equal(got, []byte{1, 2, 3}) {
+					t.Errorf("Get() = %v, %v", gotAttrs, got)
+				}
+				return nil
+			},
+		},
+		{
+			name: "get gives up after retries",
+			pre: func(f *Fake) {
+				f.Set("Test", efivars.GlobalVariable, attrs, []byte{1}) //nolint:errcheck
+				f.Fail(OpGet, "Test", syscall.EINTR, 4)
+			},
+			run: func(ctx context.Context, s Store) error {
+				_, _, err := s.Get(ctx, "Test", efivars.GlobalVariable)
+				return err
+			},
+			wantErr: syscall.EINTR,
+		},
+		{
+			name: "get does not retry permanent errors",
+			pre: func(f *Fake) {
+				f.Set("Test", efivars.GlobalVariable, attrs, []byte{1}) //nolint:errcheck
+				f.Fail(OpGet, "Test", errPermanent, 1)
+			},
+			run: func(ctx context.Context, s Store) error {
+				_, _, err := s.Get(ctx, "Test", efivars.GlobalVariable)
+				return err
+			},
+			wantErr: errPermanent,
+		},
+		{
+			name: "get variable too large",
+			pre: func(f *Fake) {
+				f.Set("Test", efivars.GlobalVariable, attrs, large) //nolint:errcheck
+			},
+			run: func(ctx context.Context, s Store) error {
+				_, _, err := s.Get(ctx, "Test", efivars.GlobalVariable)
+				return err
+			},
+			wantErr: ErrVariableTooLarge,
+		},
+		{
+			name: "get variable not found",
+			run: func(ctx context.Context, s Store) error {
+				_, _, err := s.Get(ctx, "Test", efivars.GlobalVariable)
+				return err
+			},
+			wantErr: efivario.ErrNotFound,
+		},
+		{
+			name: "set retries ENOSPC",
+			pre: func(f *Fake) {
+				f.Fail(OpSet, "Test", syscall.ENOSPC, 1)
+			},
+			run: func(ctx context.Context, s Store) error {
+				return s.Set(ctx, "Test", efivars.GlobalVariable, attrs, []byte{1})
+			},
+		},
+		{
+			name: "set variable too large",
+			run: func(ctx context.Context, s Store) error {
+				return s.Set(ctx, "Test", efivars.GlobalVariable, attrs, large)
+			},
+			wantErr: ErrVariableTooLarge,
+		},
+		{
+			name: "delete retries transient errors",
+			pre: func(f *Fake) {
+				f.Set("Test", efivars.GlobalVariable, attrs, []byte{1}) //nolint:errcheck
+				f.Fail(OpDelete, "Test", syscall.EBUSY, 3)
+			},
+			run: func(ctx context.Context, s Store) error {
+				return s.Delete(ctx, "Test", efivars.GlobalVariable)
+			},
+		},
+		{
+			name: "names",
+			pre: func(f *Fake) {
+				f.Set("Boot0001", efivars.GlobalVariable, attrs, []byte{1}) //nolint:errcheck
+				f.Set("Boot0000", efivars.GlobalVariable, attrs, []byte{1}) //nolint:errcheck
+				f.Fail(OpNames, "", syscall.EAGAIN, 1)
+			},
+			run: func(ctx context.Context, s Store) error {
+				names, err := s.Names(ctx)
+				if err != nil {
+					return err
+				}
+				if len(names) != 2 || names[0].Name != "Boot0000" || names[1].Name != "Boot0001" {
+					t.Errorf("Names() = %v", names)
+				}
+				return nil
+			},
+		},
+		{
+			name: "canceled context stops retries",
+			pre: func(f *Fake) {
+				f.Fail(OpSet, "Test", syscall.EINTR, 1)
+			},
+			run: func(_ context.Context, s Store) error {
+				ctx, cancel := context.WithCancel(context.Background())
+				cancel()
+				return s.Set(ctx, "Test", efivars.GlobalVariable, attrs, []byte{1})
+			},
+			wantErr: context.Canceled,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := NewFake()
+			if tt.pre != nil {
+				tt.pre(f)
+			}
+			s := New(f, WithBackoff(time.Millisecond), WithMaxSize(64))
+			err := tt.run(context.Background(), s)
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestNewContext(t *testing.T) {
+	f := NewFake()
+	c := NewContext(context.Background(), New(f, WithBackoff(time.Millisecond)))
+	if err := efivars.BootOrder.Set(c, []uint16{7, 1}); err != nil {
+		t.Fatalf("BootOrder.Set() error = %v", err)
+	}
+	f.Fail(OpGet, "BootOrder", syscall.EINTR, 1)
+	_, bootOrder, err := efivars.BootOrder.Get(c)
+	if err != nil {
+		t.Fatalf("BootOrder.Get() error = %v", err)
+	}
+	if len(bootOrder) != 2 || bootOrder[0] != 7 || bootOrder[1] != 1 {
+		t.Errorf("BootOrder.Get() = %v", bootOrder)
+	}
+	if got, ok := f.Value("BootOrder", efivars.GlobalVariable); !ok || !bytes.Equal(got, []byte{7, 0, 1, 0}) {
+		t.Errorf("BootOrder value = %v", got)
+	}
+}
@@ -0,0 +1,173 @@
+// Copyright 2023 Hedgehog
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package efivar
+
+import (
+	"sort"
+	"sync"
+
+	"github.com/0x5a17ed/itkit/iters/sliceit"
+	"github.com/0x5a17ed/uefi/efi/efiguid"
+	"github.com/0x5a17ed/uefi/efi/efivario"
+)
+
+// Op is an operation on an EFI variable for which a failure can be injected into a Fake
+type Op string
+
+const (
+	OpGet    Op = "get"
+	OpSet    Op = "set"
+	OpDelete Op = "delete"
+	OpNames  Op = "names"
+)
+
+type fakeKey struct {
+	name string
+	guid efiguid.GUID
+}
+
+type fakeVariable struct {
+	attrs efivario.Attributes
+	value []byte
+}
+
+type fakeFailure struct {
+	op    Op
+	name  string
+	err   error
+	times int
+}
+
+// Fake is an in-memory efivario.Context for unit tests. It can be wrapped with `New`
+// like any other efivario.Context. Failures can be injected with `Fail`.
+type Fake struct {
+	lock     sync.Mutex
+	vars     map[fakeKey]*fakeVariable
+	failures []*fakeFailure
+}
+
+var _ efivario.Context = &Fake{}
+
+// NewFake returns an empty Fake
+func NewFake() *Fake {
+	return &Fake{vars: make(map[fakeKey]*fakeVariable)}
+}
+
+// Fail makes the next `times` operations `op` on the variable `name` fail with `err`.
+// An empty `name` matches all variables.
+func (f *Fake) Fail(op Op, name string, err error, times int) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.failures = append(f.failures, &fakeFailure{op: op, name: name, err: err, times: times})
+}
+
+// Value returns the value of the variable `name` and if it exists
+func (f *Fake) Value(name string, guid efiguid.GUID) ([]byte, bool) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	v, ok := f.vars[fakeKey{name: name, guid: guid}]
+	if !ok {
+		return nil, false
+	}
+	return append([]byte{}, v.value...), true
+}
+
+// failure must be called with the lock held
+func (f *Fake) failure(op Op, name string) error {
+	for _, fail := range f.failures {
+		if fail.op != op || fail.times <= 0 || (fail.name != "" && fail.name != name) {
+			continue
+		}
+		fail.times--
+		return fail.err
+	}
+	return nil
+}
+
+// Close implements efivario.Context
+func (f *Fake) Close() error {
+	return nil
+}
+
+// GetSizeHint implements efivario.Context
+func (f *Fake) GetSizeHint(name string, guid efiguid.GUID) (int64, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	v, ok := f.vars[fakeKey{name: name, guid: guid}]
+	if !ok {
+		return -1, efivario.ErrNotFound
+	}
+	return int64(len(v.value)), nil
+}
+
+// Get implements efivario.Context
+func (f *Fake) Get(name string, guid efiguid.GUID, out []byte) (efivario.Attributes, int, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if err := f.failure(OpGet, name); err != nil {
+		return 0, 0, err
+	}
+	v, ok := f.vars[fakeKey{name: name, guid: guid}]
+	if !ok {
+		return 0, 0, efivario.ErrNotFound
+	}
+	if len(v.value) > len(out) {
+		return 0, 0, efivario.ErrInsufficientSpace
+	}
+	return v.attrs, copy(out, v.value), nil
+}
+
+// Set implements efivario.Context
+func (f *Fake) Set(name string, guid efiguid.GUID, attrs efivario.Attributes, value []byte) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if err := f.failure(OpSet, name); err != nil {
+		return err
+	}
+	f.vars[fakeKey{name: name, guid: guid}] = &fakeVariable{attrs: attrs, value: append([]byte{}, value...)}
+	return nil
+}
+
+// Delete implements efivario.Context
+func (f *Fake) Delete(name string, guid efiguid.GUID) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if err := f.failure(OpDelete, name); err != nil {
+		return err
+	}
+	key := fakeKey{name: name, guid: guid}
+	if _, ok := f.vars[key]; !ok {
+		return efivario.ErrNotFound
+	}
+	delete(f.vars, key)
+	return nil
+}
+
+// VariableNames implements efivario.Context
+func (f *Fake) VariableNames() (efivario.VariableNameIterator, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if err := f.failure(OpNames, ""); err != nil {
+		return nil, err
+	}
+	names := make([]efivario.VariableNameItem, 0, len(f.vars))
+	for key := range f.vars {
+		names = append(names, efivario.VariableNameItem{Name: key.name, GUID: key.guid})
+	}
+	sort.Slice(names, func(i, j int) bool {
+		return names[i].Name < names[j].Name
+	})
+	return &nameIterator{Iterator: sliceit.In(names)}, nil
+}
@@ -14,26 +14,58 @@
 
 package config
 
-import "go.githedgehog.com/dasboot/pkg/config"
+import (
+	"fmt"
+
+	"go.githedgehog.com/dasboot/pkg/config"
+	"go.githedgehog.com/dasboot/pkg/version"
+)
 
 var _ config.EmbeddedConfig = &HedgehogAgentProvisioner{}
 
 type HedgehogAgentProvisioner struct {
 	// AgentURL is the download URL for the agent binary
-	AgentURL string `json:"agent_url,omitempty" yaml:"agent_url,omitempty"`
+	AgentURL string `json:"agent_url,omitempty" yaml:"agent_url,omitempty" merge:"set,reset=AgentPin"`
+
+	// AgentPin pins the digest of the agent binary. If it is set, the provisioner will refuse to
+	// install an agent binary which does not match it.
+	AgentPin *version.ArtifactPin `json:"agent_pin,omitempty" yaml:"agent_pin,omitempty" merge:"set"`
 
 	// AgentConfigURL is the download URL for the agent config yaml file
-	AgentConfigURL string `json:"agent_config_url,omitempty" yaml:"agent_config_url,omitempty"`
+	AgentConfigURL string `json:"agent_config_url,omitempty" yaml:"agent_config_url,omitempty" merge:"set"`
 
 	// AgentKubeconfigURL is the download URL for the kubeconfig for the agent
-	AgentKubeconfigURL string `json:"agent_kubeconfig_url,omitempty" yaml:"agent_kubeconfig_url,omitempty"`
+	AgentKubeconfigURL string `json:"agent_kubeconfig_url,omitempty" yaml:"agent_kubeconfig_url,omitempty" merge:"set"`
+
+	// AgentFirstBootURL is the download URL for the sealed first-boot payload for the agent
+	AgentFirstBootURL string `json:"agent_firstboot_url,omitempty" yaml:"agent_firstboot_url,omitempty" merge:"set"`
+
+	// CABundleURL is the URL of the server CA bundle on the seeder. The provisioner pins it for the agent, so
+	// that the agent trusts the seeder across rotations of the server CA.
+	CABundleURL string `json:"ca_bundle_url,omitempty" yaml:"ca_bundle_url,omitempty" merge:"set"`
+
+	// DeviceMetadataURL is the base URL for the metadata which the control plane plans for this device.
+	// The provisioner writes it into the initial configuration of SONiC.
+	DeviceMetadataURL string `json:"device_metadata_url,omitempty" yaml:"device_metadata_url,omitempty" merge:"set"`
+
+	// DiagnosticsUploadsURL is the URL where the provisioner uploads core dumps to if the agent crashes
+	// during provisioning. If it is empty, diagnostic files are not being uploaded.
+	DiagnosticsUploadsURL string `json:"diagnostics_uploads_url,omitempty" yaml:"diagnostics_uploads_url,omitempty" merge:"set"`
+
+	// LogShippingURL is the URL where the provisioner uploads its logs to for post-mortem analysis. If it is empty,
+	// logs are not being shipped.
+	LogShippingURL string `json:"log_shipping_url,omitempty" yaml:"log_shipping_url,omitempty" merge:"set"`
+
+	// LabMode is set by a seeder which runs in its insecure lab mode. Only then plain HTTP URLs are accepted.
+	// It can only be set in the embedded configuration and never by an override.
+	LabMode bool `json:"lab_mode,omitempty" yaml:"lab_mode,omitempty" merge:"-"`
 
 	// SignatureCert holds the DER encoded X509 certificate with which the signature of the embedded config
 	// can be validated
-	SignatureCert []byte `json:"signature_cert,omitempty" yaml:"signature_cert,omitempty"`
+	SignatureCert []byte `json:"signature_cert,omitempty" yaml:"signature_cert,omitempty" merge:"-"`
 
 	// Version is tracking the format of this structure itself
-	Version config.ConfigVersion `json:"version,omitempty" yaml:"version,omitempty"`
+	Version config.ConfigVersion `json:"version,omitempty" yaml:"version,omitempty" merge:"-"`
 }
 
 // Cert implements config.EmbeddedConfig
@@ -43,7 +75,10 @@ func (c *HedgehogAgentProvisioner) Cert() []byte {
 
 // Validate implements config.EmbeddedConfig
 func (c *HedgehogAgentProvisioner) Validate() error {
-	// TODO: implement
+	// TODO: implement the rest
+	if err := config.ValidateSecureURLs(c.LabMode, c.AgentURL, c.AgentConfigURL, c.AgentKubeconfigURL, c.AgentFirstBootURL, c.CABundleURL, c.DeviceMetadataURL, c.DiagnosticsUploadsURL, c.LogShippingURL); err != nil {
+		return fmt.Errorf("hedgehog agent provisioner config: %w", err)
+	}
 	return nil
 }
 
@@ -21,6 +21,7 @@ import (
 	"os"
 	"strings"
 
+	"go.githedgehog.com/dasboot/pkg/config"
 	"gopkg.in/yaml.v3"
 )
 
@@ -71,29 +72,8 @@ func ReadFrom(r io.Reader, typ FileType) (*HedgehogAgentProvisioner, error) {
 	return &cfg, nil
 }
 
+// MergeConfigs merges the `override` into a copy of the `embedded` configuration. How every field gets merged is
+// decided by its merge tag, see `config.Merge`.
 func MergeConfigs(embedded *HedgehogAgentProvisioner, override *HedgehogAgentProvisioner) *HedgehogAgentProvisioner {
-	// clone the values from the embedded config
-	// so that we don't override the arguments for the caller
-	// also short-circuit things to avoid pointer shenanigans
-	if embedded == nil {
-		return nil
-	}
-	ret := *embedded
-	if override == nil {
-		return &ret
-	}
-
-	if override.AgentURL != "" {
-		ret.AgentURL = override.AgentURL
-	}
-
-	if override.AgentConfigURL != "" {
-		ret.AgentConfigURL = override.AgentConfigURL
-	}
-
-	if override.AgentKubeconfigURL != "" {
-		ret.AgentKubeconfigURL = override.AgentKubeconfigURL
-	}
-
-	return &ret
+	return config.Merge(embedded, override)
 }
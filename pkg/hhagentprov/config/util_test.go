@@ -14,4 +14,14 @@
 
 package config
 
-// keep this as a placeholder until there need to be tests for this package
+import (
+	"testing"
+
+	"go.githedgehog.com/dasboot/pkg/config"
+)
+
+func TestMergeTags(t *testing.T) {
+	if err := config.ValidateMergeTags[HedgehogAgentProvisioner](); err != nil {
+		t.Errorf("every field of the configuration must have a merge tag: %v", err)
+	}
+}
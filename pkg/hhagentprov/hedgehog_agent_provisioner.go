@@ -17,6 +17,7 @@ package hhagentprov
 import (
 	"context"
 	"crypto/x509"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
@@ -32,6 +33,9 @@ import (
 	configstage "go.githedgehog.com/dasboot/pkg/hhagentprov/config"
 	"go.githedgehog.com/dasboot/pkg/log"
 	"go.githedgehog.com/dasboot/pkg/partitions"
+	"go.githedgehog.com/dasboot/pkg/partitions/identity"
+	"go.githedgehog.com/dasboot/pkg/seeder/firstboot"
+	"go.githedgehog.com/dasboot/pkg/seeder/logship"
 	"go.githedgehog.com/dasboot/pkg/stage"
 	"go.githedgehog.com/dasboot/pkg/version"
 	"go.uber.org/zap"
@@ -40,6 +44,14 @@ import (
 
 var l = log.L()
 
+// correlation holds the fields which are bound to every log message of this stage
+var correlation log.Correlation
+
+// setLogger makes `newL` the logger of this stage with all correlation fields bound to it
+func setLogger(newL log.Interface) {
+	l = log.WithCorrelation(newL, correlation)
+}
+
 var ErrExecution = errors.New("unrecoverable execution error encountered")
 
 func executionError(err error) error {
@@ -75,21 +87,38 @@ func ReadConfig(caPool *x509.CertPool) (*configstage.HedgehogAgentProvisioner, e
 	return &cfg, nil
 }
 
-func Run(ctx context.Context, override *configstage.HedgehogAgentProvisioner, logSettings *stage.LogSettings) (runErr error) {
+// Run runs the Hedgehog Agent Provisioner with `logSettings` which initialize the global logger. This is what the the Hedgehog Agent Provisioner binary executes.
+func Run(ctx context.Context, override *configstage.HedgehogAgentProvisioner, logSettings *stage.LogSettings) error {
+	_, err := Execute(ctx, override, stage.RunOptionLogSettings(logSettings))
+	return err
+}
+
+// Execute runs the Hedgehog Agent Provisioner in-process. It can be used to embed the Hedgehog Agent Provisioner into other installers. The returned result is
+// never nil, and holds as much information as was gathered until the execution finished or failed.
+func Execute(ctx context.Context, override *configstage.HedgehogAgentProvisioner, opts ...stage.RunOption) (result *stage.Result, runErr error) {
+	o := stage.NewRunOptions(opts...)
+	logSettings := o.LogSettings
+	result = &stage.Result{}
+	correlation = log.Correlation{Stage: "hedgehog-agent-provisioner"}
+
 	// setup some console logging first
 	// NOTE: we'll throw this away immediately after we've read the staging info
 	// so this is really just for until then
 	// TODO: this essentially should never fail, so should be implemented differently I guess
-	if err := stage.InitializeGlobalLogger(ctx, logSettings); err != nil {
-		return fmt.Errorf("hedgehog-agent-provisioner: failed to initialize logger: %w", err)
+	newL, err := o.InitializeLogger(ctx, logSettings)
+	if err != nil {
+		return result, fmt.Errorf("hedgehog-agent-provisioner: failed to initialize logger: %w", err)
 	}
-	l = log.L()
+	setLogger(newL)
 	defer func() {
 		if err := l.Sync(); err != nil {
 			l.Debug("Flushing logger failed", zap.Error(err))
 		}
 	}()
 	l.Info("Hedgehog Agent Provisioner execution starting", zap.String("version", version.Version))
+
+	// record execution timings of all major steps
+	stage.StartTimings("hedgehog-agent-provisioner")
 	l.Info("System environment", zap.Strings("env", os.Environ()))
 
 	// read ONIE env information
@@ -100,17 +129,36 @@ func Run(ctx context.Context, override *configstage.HedgehogAgentProvisioner, lo
 	si, err := stage.ReadStagingInfo()
 	if err != nil {
 		l.Error("Reading staging info", zap.Error(err))
-		return executionError(fmt.Errorf("reading staging info: %w", err))
+		stage.FinishTimings(l, "", err)
+		return result, executionError(fmt.Errorf("reading staging info: %w", err))
 	}
+
+	// from now on every message carries the device ID and install session
+	correlation = si.Correlation("hedgehog-agent-provisioner")
+	setLogger(l)
+	partitions.SetMultipathPolicy(si.MultipathPolicy)
+	partitions.SetDiskSelectionPolicy(si.DiskSelection)
+	result.StagingInfo = si
+	defer func() {
+		if summary := stage.FinishTimings(l, si.StagingDir, runErr); summary != nil {
+			result.Timings = summary
+		}
+	}()
 	l.Info("Staging information", zap.Reflect("si", si))
 
+	// stage 0 holds the install lock for our install session, if it is not ours anymore, we must stop right here
+	if err := stage.VerifyInstallLock(si.InstallSessionID); err != nil {
+		l.Error("Install lock verification failed", zap.Error(err))
+		return result, executionError(err)
+	}
+
 	// reinitialize global logger
 	// TODO: merge log settings I guess? will figure out what constitutes a change from the program flags
 	l.Debug("Reinitializing global logger again", zap.Reflect("logSettings", &si.LogSettings))
-	if err := stage.InitializeGlobalLogger(ctx, &si.LogSettings); err != nil {
+	if newL, err := o.InitializeLogger(ctx, &si.LogSettings); err != nil {
 		l.Warn("Reinitializing global logger failed", zap.Error(err))
 	} else {
-		l = log.L()
+		setLogger(newL)
 		l.Info("Reinitialized global logger from staging info", zap.Reflect("logSettings", &si.LogSettings))
 	}
 
@@ -118,14 +166,14 @@ func Run(ctx context.Context, override *configstage.HedgehogAgentProvisioner, lo
 	configCAPool, err := si.ConfigSignatureCAPool()
 	if err != nil {
 		l.Error("Initializing Config Signature CA Pool failed", zap.Error(err))
-		return executionError(fmt.Errorf("initializing config signature CA pool: %w", err))
+		return result, executionError(fmt.Errorf("initializing config signature CA pool: %w", err))
 	}
 
 	// read embedded config now
 	embedded, err := ReadConfig(configCAPool)
 	if err != nil {
 		l.Error("Reading embedded config failed", zap.Error(err))
-		return executionError(err)
+		return result, executionError(err)
 	}
 	l.Info("Read embedded configuration", zap.Reflect("config", embedded))
 
@@ -133,39 +181,69 @@ func Run(ctx context.Context, override *configstage.HedgehogAgentProvisioner, lo
 	cfg := configstage.MergeConfigs(embedded, override)
 	if err := cfg.Validate(); err != nil {
 		l.Error("Merged config validation error", zap.Error(err))
-		return executionError(fmt.Errorf("merged config validation: %w", err))
+		return result, executionError(fmt.Errorf("merged config validation: %w", err))
 	}
 	if override != nil {
 		l.Info("Merged override configuration", zap.Reflect("config", cfg))
 	}
 
+	stage.ReportToolCapabilities(l)
+
 	// discover partitions
+	endDiscovery := stage.Span("discovery")
 	devices := partitions.Discover()
+	endDiscovery()
 
 	// now mount the identity partition
 	// this step fully initializes and prepares the partition for our usage
-	identityPartition, err := stage.MountIdentityPartition(l, devices, onieEnv.Platform)
+	identityPartition, err := stage.MountIdentityPartition(l, devices, onieEnv.Platform, &stage.IdentityEncryption{Keys: stage.IdentityUnlockKeys(l, devices)})
 	if err != nil {
 		l.Error("Identity Partition could not be opened/mounted/created", zap.Error(err))
-		return executionError(fmt.Errorf("opening identity partition: %w", err))
+		return result, executionError(fmt.Errorf("opening identity partition: %w", err))
 	}
 	l.Info("Opened Hedgehog Identity Partition successfully")
 
-	hc, err := stage.SeederHTTPClient(si.ServerCA, identityPartition)
+	hc, err := si.SeederHTTPClient(identityPartition, configCAPool, stage.LabModeOptions(cfg.LabMode)...)
 	if err != nil {
 		l.Error("Building HTTP client for downloading agent and agent config failed", zap.Error(err))
-		return executionError(err)
+		return result, executionError(err)
+	}
+
+	// ship all further logs to the seeder as well, so that they are available for post-mortem analysis
+	if cfg.LogShippingURL != "" {
+		if shipL, err := logship.StageLogger(hc, cfg.LogShippingURL, identityPartition, si, "hedgehog-agent-provisioner"); err != nil {
+			l.Warn("Log shipping disabled", zap.String("url", cfg.LogShippingURL), zap.Error(err))
+		} else {
+			setLogger(log.Tee(l, shipL))
+			l.Info("Shipping logs to seeder", zap.String("url", cfg.LogShippingURL))
+		}
+	}
+
+	// the agent binary is executed during provisioning, so it can leave a core dump behind if it crashes.
+	// Stage 2 uploads the same files as well, but the seeder only keeps one copy of them.
+	if cfg.DiagnosticsUploadsURL != "" {
+		if err := stage.EnableCoreDumps(); err != nil {
+			l.Warn("Enabling core dumps failed", zap.Error(err))
+		}
+		defer func() {
+			if runErr == nil {
+				return
+			}
+			if wd, err := os.Getwd(); err == nil {
+				stage.UploadAllDiagnostics(ctx, hc, cfg.DiagnosticsUploadsURL, correlation, stage.DiagnosticFiles(wd))
+			}
+		}()
 	}
 
 	// now mount the SONiC partition
 	sonicPart := devices.GetSONiCPartition()
 	if sonicPart == nil {
 		l.Error("SONiC Partition not found")
-		return executionError(fmt.Errorf("SONiC partition not found"))
+		return result, executionError(fmt.Errorf("SONiC partition not found"))
 	}
 	if err := sonicPart.Mount(); err != nil && !errors.Is(err, partitions.ErrAlreadyMounted) {
 		l.Error("SONiC Partition could not be mounted", zap.String("device", sonicPart.Path), zap.String("mountPath", sonicPart.MountPath))
-		return executionError(fmt.Errorf("SONiC partition mount: %w", err))
+		return result, executionError(fmt.Errorf("SONiC partition mount: %w", err))
 	}
 	defer func() {
 		l.Info("Unmounting SONiC Partition", zap.String("device", sonicPart.Path), zap.String("mountPath", sonicPart.MountPath))
@@ -179,7 +257,7 @@ func Run(ctx context.Context, override *configstage.HedgehogAgentProvisioner, lo
 	sonicRootPath, err := determineSonicRootPath(sonicPart.MountPath)
 	if err != nil {
 		l.Error("Determining SONiC image directory failed", zap.String("mountPath", sonicPart.MountPath), zap.Error(err))
-		return executionError(fmt.Errorf("determining SONiC image dir: %w", err))
+		return result, executionError(fmt.Errorf("determining SONiC image dir: %w", err))
 	}
 	l.Info("Found SONiC installation on SONiC partition", zap.String("sonicRootPath", sonicRootPath))
 
@@ -187,18 +265,18 @@ func Run(ctx context.Context, override *configstage.HedgehogAgentProvisioner, lo
 	agentConfigTargetDir := filepath.Join(sonicRootPath, "/rw/etc/sonic/hedgehog/")
 	if err := os.MkdirAll(agentConfigTargetDir, 0755); err != nil {
 		l.Error("Preparing Hedgehog Agent config target directory failed", zap.String("agentConfigTargetDir", agentConfigTargetDir), zap.Error(err))
-		return executionError(fmt.Errorf("creating agent config target dir '%s': %w", agentConfigTargetDir, err))
+		return result, executionError(fmt.Errorf("creating agent config target dir '%s': %w", agentConfigTargetDir, err))
 	}
 	sonicAgentBinDir := "/opt/hedgehog/bin"
 	agentBinTargetDir := filepath.Join(sonicRootPath, "rw", sonicAgentBinDir)
 	if err := os.MkdirAll(agentBinTargetDir, 0755); err != nil {
 		l.Error("Preparing Hedgehog Agent bin target directory failed", zap.String("agentBinTargetDir", agentBinTargetDir), zap.Error(err))
-		return executionError(fmt.Errorf("creating agent bin target dir '%s': %w", agentBinTargetDir, err))
+		return result, executionError(fmt.Errorf("creating agent bin target dir '%s': %w", agentBinTargetDir, err))
 	}
 	systemdMultiUserTargetDir := filepath.Join(sonicRootPath, "/rw/etc/systemd/system/multi-user.target.wants")
 	if err := os.MkdirAll(systemdMultiUserTargetDir, 0755); err != nil {
 		l.Error("Preparing systemd multi-user.target.wants dir failed", zap.String("systemdMultiUserTargetDir", systemdMultiUserTargetDir), zap.Error(err))
-		return executionError(fmt.Errorf("creating systemd multi-user.target.wants dir '%s': %w", systemdMultiUserTargetDir, err))
+		return result, executionError(fmt.Errorf("creating systemd multi-user.target.wants dir '%s': %w", systemdMultiUserTargetDir, err))
 	}
 	l.Info("Created basic directory layout for Hedgehog agent installation",
 		zap.String("agentConfigTargetDir", agentConfigTargetDir),
@@ -209,7 +287,7 @@ func Run(ctx context.Context, override *configstage.HedgehogAgentProvisioner, lo
 	// populate it with
 	// - agent
 	// - agent config
-	// - agent kubeconfig
+	// - sealed agent first-boot payload, or the agent kubeconfig if the seeder does not provide one
 	// by downloading it from the seeder
 	agentBinPath := filepath.Join(agentBinTargetDir, "agent")
 	agentConfigPath := filepath.Join(agentConfigTargetDir, "agent-config.yaml")
@@ -218,38 +296,122 @@ func Run(ctx context.Context, override *configstage.HedgehogAgentProvisioner, lo
 	cfg.AgentURL, err = url.JoinPath(cfg.AgentURL, si.DeviceID)
 	if err != nil {
 		l.Error("Joining agent URL with device ID failed", zap.String("url", cfg.AgentURL), zap.String("deviceID", si.DeviceID), zap.Error(err))
-		return executionError(fmt.Errorf("joining agent URL with device ID '%s': %w", si.DeviceID, err))
+		return result, executionError(fmt.Errorf("joining agent URL with device ID '%s': %w", si.DeviceID, err))
 	}
 
-	if err := stage.DownloadExecutable(ctx, hc, cfg.AgentURL, agentBinPath, time.Second*60); err != nil {
+	if err := stage.Timed("download-agent", func() error {
+		return stage.DownloadExecutable(ctx, hc, cfg.AgentURL, agentBinPath, time.Second*60)
+	}); err != nil {
 		l.Error("Downloading agent binary failed", zap.String("url", cfg.AgentURL), zap.String("dest", agentBinPath), zap.Error(err))
-		return executionError(fmt.Errorf("downloading agent binary: %w", err))
+		return result, executionError(fmt.Errorf("downloading agent binary: %w", err))
 	}
 	l.Info("Downloaded agent binary", zap.String("url", cfg.AgentURL), zap.String("dest", agentBinPath))
 
+	// the seeder pinned the digest of the agent in our configuration, and a
+	// mismatching agent must not be left behind in the NOS
+	if err := stage.VerifyArtifactPin(agentBinPath, cfg.AgentPin); err != nil {
+		l.Error("Agent binary does not match its pinned digest", zap.String("dest", agentBinPath), zap.Reflect("pin", cfg.AgentPin), zap.Error(err))
+		if err := os.Remove(agentBinPath); err != nil {
+			l.Warn("Removing agent binary failed", zap.String("dest", agentBinPath), zap.Error(err))
+		}
+		return result, executionError(fmt.Errorf("agent binary digest verification: %w", err))
+	}
+
 	agentConfigURL, err := url.Parse(cfg.AgentConfigURL)
 	if err != nil {
 		l.Error("Parsing agent config URL failed", zap.String("url", cfg.AgentConfigURL), zap.Error(err))
-		return executionError(fmt.Errorf("parsing agent config URL '%s': %w", cfg.AgentConfigURL, err))
+		return result, executionError(fmt.Errorf("parsing agent config URL '%s': %w", cfg.AgentConfigURL, err))
 	}
 	agentConfigURL.Path = path.Join(agentConfigURL.Path, si.DeviceID)
-	if err := stage.Download(ctx, hc, agentConfigURL.String(), agentConfigPath, 0640, time.Second*60); err != nil {
+	if err := stage.Timed("download-agent-config", func() error {
+		return stage.Download(ctx, hc, agentConfigURL.String(), agentConfigPath, 0640, time.Second*60)
+	}); err != nil {
 		l.Error("Downloading agent config failed", zap.String("url", agentConfigURL.String()), zap.String("dest", agentConfigPath), zap.Error(err))
-		return executionError(fmt.Errorf("downloading agent config: %w", err))
+		return result, executionError(fmt.Errorf("downloading agent config: %w", err))
 	}
 	l.Info("Downloaded agent config for this device", zap.String("url", agentConfigURL.String()), zap.String("dest", agentConfigPath))
 
-	agentKubeconfigURL, err := url.Parse(cfg.AgentKubeconfigURL)
-	if err != nil {
-		l.Error("Parsing agent kubeconfig URL failed", zap.String("url", cfg.AgentKubeconfigURL), zap.Error(err))
-		return executionError(fmt.Errorf("parsing agent kubeconfig URL '%s': %w", cfg.AgentKubeconfigURL, err))
+	// the first-boot payload is sealed to our identity, so it stays sealed within the SONiC image. It carries the agent
+	// kubeconfig as well, so the plaintext kubeconfig must not end up next to it. Devices whose key cannot open the
+	// payload (like keys which are held by a TPM) could never bootstrap their agent, so this fails the provisioning.
+	if cfg.AgentFirstBootURL != "" {
+		agentFirstBootPath := filepath.Join(agentConfigTargetDir, "agent-firstboot.json")
+		agentFirstBootURL, err := url.JoinPath(cfg.AgentFirstBootURL, si.DeviceID)
+		if err != nil {
+			l.Error("Joining agent first-boot payload URL with device ID failed", zap.String("url", cfg.AgentFirstBootURL), zap.String("deviceID", si.DeviceID), zap.Error(err))
+			return result, executionError(fmt.Errorf("joining agent first-boot payload URL with device ID '%s': %w", si.DeviceID, err))
+		}
+		if err := stage.Timed("download-agent-firstboot", func() error {
+			return stage.Download(ctx, hc, agentFirstBootURL, agentFirstBootPath, 0600, time.Second*60)
+		}); err != nil {
+			l.Error("Downloading agent first-boot payload failed", zap.String("url", agentFirstBootURL), zap.String("dest", agentFirstBootPath), zap.Error(err))
+			return result, executionError(fmt.Errorf("downloading agent first-boot payload: %w", err))
+		}
+		if err := verifyFirstBootPayload(agentFirstBootPath, identityPartition, si.DeviceID); err != nil {
+			l.Error("Verifying agent first-boot payload failed", zap.String("path", agentFirstBootPath), zap.Error(err))
+			if err := os.Remove(agentFirstBootPath); err != nil {
+				l.Warn("Removing agent first-boot payload failed", zap.String("path", agentFirstBootPath), zap.Error(err))
+			}
+			return result, executionError(fmt.Errorf("verifying agent first-boot payload: %w", err))
+		}
+		l.Info("Downloaded agent first-boot payload for this device", zap.String("url", agentFirstBootURL), zap.String("dest", agentFirstBootPath))
+
+		// a previous installation might have left the plaintext kubeconfig behind
+		if err := os.Remove(agentKubeconfigPath); err != nil && !errors.Is(err, os.ErrNotExist) {
+			l.Error("Removing plaintext agent kubeconfig failed", zap.String("path", agentKubeconfigPath), zap.Error(err))
+			return result, executionError(fmt.Errorf("removing plaintext agent kubeconfig: %w", err))
+		}
+	} else {
+		agentKubeconfigURL, err := url.Parse(cfg.AgentKubeconfigURL)
+		if err != nil {
+			l.Error("Parsing agent kubeconfig URL failed", zap.String("url", cfg.AgentKubeconfigURL), zap.Error(err))
+			return result, executionError(fmt.Errorf("parsing agent kubeconfig URL '%s': %w", cfg.AgentKubeconfigURL, err))
+		}
+		agentKubeconfigURL.Path = path.Join(agentKubeconfigURL.Path, si.DeviceID)
+		if err := stage.Timed("download-agent-kubeconfig", func() error {
+			return stage.Download(ctx, hc, agentKubeconfigURL.String(), agentKubeconfigPath, 0600, time.Second*60)
+		}); err != nil {
+			l.Error("Downloading agent kubeconfig failed", zap.String("url", agentKubeconfigURL.String()), zap.String("dest", agentKubeconfigPath), zap.Error(err))
+			return result, executionError(fmt.Errorf("downloading agent kubeconfig: %w", err))
+		}
+		l.Info("Downloaded agent kubeconfig for this device", zap.String("url", agentKubeconfigURL.String()), zap.String("dest", agentKubeconfigPath))
+	}
+
+	// the agent keeps following rotations of the server CA by refreshing this bundle, and it refuses
+	// to go back to an older version, so a bundle which is already there from a previous installation wins
+	if cfg.CABundleURL != "" {
+		caBundlePath := filepath.Join(agentConfigTargetDir, "ca-bundle.json")
+		bundle, updated, err := stage.RefreshCABundle(ctx, hc, cfg.CABundleURL, caBundlePath)
+		if err != nil {
+			l.Warn("Refreshing server CA bundle for the agent failed", zap.String("url", cfg.CABundleURL), zap.String("dest", caBundlePath), zap.Error(err))
+		} else if updated {
+			l.Info("Pinned server CA bundle for the agent", zap.String("url", cfg.CABundleURL), zap.String("dest", caBundlePath), zap.Uint64("version", bundle.Version))
+		}
 	}
-	agentKubeconfigURL.Path = path.Join(agentKubeconfigURL.Path, si.DeviceID)
-	if err := stage.Download(ctx, hc, agentKubeconfigURL.String(), agentKubeconfigPath, 0600, time.Second*60); err != nil {
-		l.Error("Downloading agent kubeconfig failed", zap.String("url", agentKubeconfigURL.String()), zap.String("dest", agentKubeconfigPath), zap.Error(err))
-		return executionError(fmt.Errorf("downloading agent kubeconfig: %w", err))
+
+	// the device metadata becomes part of the initial SONiC configuration, so that the NOS knows
+	// its planned host name and role before the agent ever talked to the control plane
+	if cfg.DeviceMetadataURL != "" {
+		deviceMetadataPath := filepath.Join(agentConfigTargetDir, "device-metadata.json")
+		md, err := stage.FetchDeviceMetadata(ctx, hc, cfg.DeviceMetadataURL, si.DeviceID)
+		if err != nil {
+			l.Warn("Fetching device metadata failed", zap.String("url", cfg.DeviceMetadataURL), zap.Error(err))
+		} else if err := md.WriteFile(deviceMetadataPath); err != nil {
+			l.Warn("Writing device metadata failed", zap.String("dest", deviceMetadataPath), zap.Error(err))
+		} else {
+			correlation.Hostname = md.Hostname
+			setLogger(l)
+			l.Info("Wrote device metadata into SONiC configuration", zap.String("dest", deviceMetadataPath), zap.String("hostname", md.Hostname), zap.String("role", md.Role))
+		}
+	}
+
+	// the public identity document is for the agent to publish to the control plane, it holds no secrets
+	identityDocPath := filepath.Join(agentConfigTargetDir, "identity.json")
+	if err := writePublicIdentityDocument(identityPartition, identityDocPath); err != nil {
+		l.Warn("Writing public identity document failed", zap.String("dest", identityDocPath), zap.Error(err))
+	} else {
+		l.Info("Wrote public identity document for the agent", zap.String("dest", identityDocPath))
 	}
-	l.Info("Downloaded agent kubeconfig for this device", zap.String("url", agentKubeconfigURL.String()), zap.String("dest", agentKubeconfigPath))
 
 	// now write systemd unit
 	// we'll do this by calling the agent with the "generate systemd-unit" commands which will just do that
@@ -259,7 +421,7 @@ func Run(ctx context.Context, override *configstage.HedgehogAgentProvisioner, lo
 	systemdUnitTargetFile, err := os.OpenFile(systemdUnitTargetPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
 	if err != nil {
 		l.Error("Opening hedgehog-agent.service file failed", zap.String("systemdUnitTargetPath", systemdUnitTargetPath), zap.Error(err))
-		return executionError(fmt.Errorf("opening hedgehog agent service file '%s': %w", systemdUnitTargetPath, err))
+		return result, executionError(fmt.Errorf("opening hedgehog agent service file '%s': %w", systemdUnitTargetPath, err))
 	}
 	subctx, cancel := context.WithCancel(ctx)
 	cmdStrings := []string{agentBinPath, "generate", "systemd-unit", "--agent-path", filepath.Join(sonicAgentBinDir, "agent"), "--user", "root"}
@@ -270,7 +432,7 @@ func Run(ctx context.Context, override *configstage.HedgehogAgentProvisioner, lo
 		systemdUnitTargetFile.Close()
 		cancel()
 		l.Error("Generating hedgehog-agent.service systemd unit with agent binary failed", zap.Strings("cmd", cmdStrings), zap.Error(err))
-		return executionError(fmt.Errorf("generating systemd unit with agent binary: %w", err))
+		return result, executionError(fmt.Errorf("generating systemd unit with agent binary: %w", err))
 	}
 	cancel()
 	systemdUnitTargetFile.Close()
@@ -281,13 +443,13 @@ func Run(ctx context.Context, override *configstage.HedgehogAgentProvisioner, lo
 	symlinkPath := filepath.Join(sonicRootPath, "/rw/etc/systemd/system/multi-user.target.wants/hedgehog-agent.service")
 	if err := os.Symlink(systemdUnitPath, symlinkPath); err != nil {
 		l.Error("Creating symlink for systemd service failed", zap.String("symlinkPath", symlinkPath), zap.String("targetPath", systemdUnitPath), zap.Error(err))
-		return executionError(fmt.Errorf("symlinking agent systemd unit '%s' -> '%s': %w", symlinkPath, systemdUnitPath, err))
+		return result, executionError(fmt.Errorf("symlinking agent systemd unit '%s' -> '%s': %w", symlinkPath, systemdUnitPath, err))
 	}
 	l.Info("Created symlink for Hedgehog agent to enable hedgehog-agent.service unit on startup", zap.String("symlinkPath", symlinkPath), zap.String("targetPath", systemdUnitPath))
 
 	// we are done here
 	l.Info("Hedgehog Agent Provisioner completed successfully")
-	return nil
+	return result, nil
 }
 
 func determineSonicRootPath(path string) (string, error) {
@@ -311,3 +473,42 @@ func determineSonicRootPath(path string) (string, error) {
 	// no SONiC installation found - truly irrecoverable at this point
 	return "", fmt.Errorf("no SONiC image installation found")
 }
+
+// verifyFirstBootPayload ensures that the sealed first-boot payload at `path` can be opened with the key of this device,
+// and that it was generated for this device. It fails with `firstboot.ErrUnsupportedKey` if the key of this device
+// cannot open it at all.
+func verifyFirstBootPayload(path string, ip identity.IdentityPartition, devid string) error {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var envelope firstboot.Envelope
+	if err := json.Unmarshal(b, &envelope); err != nil {
+		return fmt.Errorf("decoding envelope: %w", err)
+	}
+	cert, err := ip.LoadX509KeyPair()
+	if err != nil {
+		return fmt.Errorf("loading device key: %w", err)
+	}
+	payload, err := firstboot.Open(cert.PrivateKey, &envelope)
+	if err != nil {
+		return err
+	}
+	if payload.DevID != devid {
+		return fmt.Errorf("payload is for device '%s'", payload.DevID)
+	}
+	return nil
+}
+
+// writePublicIdentityDocument writes the signed public identity document of this device to `path`
+func writePublicIdentityDocument(ip identity.IdentityPartition, path string) error {
+	doc, err := ip.PublicDocument()
+	if err != nil {
+		return err
+	}
+	b, err := json.Marshal(doc)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, b, 0644)
+}
@@ -27,11 +27,75 @@ import (
 type DeviceRegistrationSpec struct {
 	LocationUUID string `json:"locationUUID,omitempty"`
 	CSR          []byte `json:"csr,omitempty"`
+
+	// SerialNumber is the serial number of the device as it is stored in its ONIE EEPROM
+	// +optional
+	SerialNumber string `json:"serialNumber,omitempty"`
+
+	// Vendor is the vendor name of the device as it is stored in its ONIE EEPROM
+	// +optional
+	Vendor string `json:"vendor,omitempty"`
+
+	// ProductName is the product name of the device as it is stored in its ONIE EEPROM
+	// +optional
+	ProductName string `json:"productName,omitempty"`
+
+	// AssetTag is the asset tag (ONIE service tag) of the device as it is stored in its ONIE EEPROM
+	// +optional
+	AssetTag string `json:"assetTag,omitempty"`
+
+	// Approval is the decision of an operator or of an auto-approval rule of the seeder about this registration.
+	// If the registration controller requires approval, it only issues a certificate once this is "Approved".
+	// Registrations which are "Denied" never get a certificate. If it is empty, the registration is pending.
+	// +kubebuilder:validation:Enum="";Approved;Denied
+	// +optional
+	Approval RegistrationApproval `json:"approval,omitempty"`
+
+	// Attestation is the attestation evidence of the device as the seeder verified it on registration
+	// +optional
+	Attestation *DeviceAttestation `json:"attestation,omitempty"`
+}
+
+// DeviceAttestation is the attestation evidence which a device sent with its registration request
+type DeviceAttestation struct {
+	// QuoteVerified is true if the PCR values were quoted by the TPM which holds the client key of the device
+	// +optional
+	QuoteVerified bool `json:"quoteVerified,omitempty"`
+
+	// PCRs are the hex encoded SHA-256 PCR values of the device keyed by their index
+	// +optional
+	PCRs map[string]string `json:"pcrs,omitempty"`
+
+	// SecureBoot is true if the device reported that it booted with UEFI secure boot enabled
+	// +optional
+	SecureBoot bool `json:"secureBoot,omitempty"`
+
+	// ONIEVersion is the ONIE version which the device reported
+	// +optional
+	ONIEVersion string `json:"onieVersion,omitempty"`
 }
 
+// RegistrationApproval is the decision about a device registration
+type RegistrationApproval string
+
+const (
+	RegistrationApprovalPending  RegistrationApproval = ""
+	RegistrationApprovalApproved RegistrationApproval = "Approved"
+	RegistrationApprovalDenied   RegistrationApproval = "Denied"
+)
+
+// SerialNumberLabelKey is the label which holds the serial number of a device on its device registration,
+// so that operators can find devices by their serial number with a label selector
+const SerialNumberLabelKey = "dasboot.githedgehog.com/serial-number"
+
 // DeviceRegistrationStatus defines the observed state of the device registration process
 type DeviceRegistrationStatus struct {
 	Certificate []byte `json:"certificate,omitempty"`
+
+	// Conditions reflect the provisioning lifecycle of the device as observed by the seeder.
+	// Known condition types are "Registered", "Approved", "Installing" and "Failed".
+	// +optional
+	Conditions []metav1.Condition `json:"conditions,omitempty"`
 }
 
 type RequestConditionType string
@@ -69,6 +133,10 @@ type CertificateSigningRequestCondition struct {
 // +kubebuilder:subresource:status
 // +kubebuilder:resource:categories=hedgehog;fabric,shortName=devreg;dr
 // +kubebuilder:printcolumn:name="Location",type=string,JSONPath=`.spec.locationUUID`,priority=0
+// +kubebuilder:printcolumn:name="Serial",type=string,JSONPath=`.spec.serialNumber`,priority=0
+// +kubebuilder:printcolumn:name="Approval",type=string,JSONPath=`.spec.approval`,priority=0
+// +kubebuilder:printcolumn:name="Vendor",type=string,JSONPath=`.spec.vendor`,priority=1
+// +kubebuilder:printcolumn:name="Asset Tag",type=string,JSONPath=`.spec.assetTag`,priority=1
 // +kubebuilder:printcolumn:name="Age",type=date,JSONPath=`.metadata.creationTimestamp`,priority=0
 // DeviceRegistration is the Schema for the device registration within DAS BOOT
 type DeviceRegistration struct {
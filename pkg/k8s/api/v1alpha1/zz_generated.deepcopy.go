@@ -21,6 +21,7 @@
 package v1alpha1
 
 import (
+	"k8s.io/apimachinery/pkg/apis/meta/v1"
 	runtime "k8s.io/apimachinery/pkg/runtime"
 )
 
@@ -41,6 +42,28 @@ func (in *CertificateSigningRequestCondition) DeepCopy() *CertificateSigningRequ
 	return out
 }
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *DeviceAttestation) DeepCopyInto(out *DeviceAttestation) {
+	*out = *in
+	if in.PCRs != nil {
+		in, out := &in.PCRs, &out.PCRs
+		*out = make(map[string]string, len(*in))
+		for key, val := range *in {
+			(*out)[key] = val
+		}
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new DeviceAttestation.
+func (in *DeviceAttestation) DeepCopy() *DeviceAttestation {
+	if in == nil {
+		return nil
+	}
+	out := new(DeviceAttestation)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *DeviceRegistration) DeepCopyInto(out *DeviceRegistration) {
 	*out = *in
@@ -108,6 +131,11 @@ func (in *DeviceRegistrationSpec) DeepCopyInto(out *DeviceRegistrationSpec) {
 		*out = make([]byte, len(*in))
 		copy(*out, *in)
 	}
+	if in.Attestation != nil {
+		in, out := &in.Attestation, &out.Attestation
+		*out = new(DeviceAttestation)
+		(*in).DeepCopyInto(*out)
+	}
 }
 
 // DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new DeviceRegistrationSpec.
@@ -128,6 +156,13 @@ func (in *DeviceRegistrationStatus) DeepCopyInto(out *DeviceRegistrationStatus)
 		*out = make([]byte, len(*in))
 		copy(*out, *in)
 	}
+	if in.Conditions != nil {
+		in, out := &in.Conditions, &out.Conditions
+		*out = make([]v1.Condition, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
 }
 
 // DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new DeviceRegistrationStatus.
@@ -36,6 +36,9 @@ import (
 
 var certificateValidity = time.Hour * 24 * 360
 
+// certificateRenewBefore is the time before the expiry of a certificate from which on a new one gets generated
+var certificateRenewBefore = time.Hour * 24 * 60
+
 //go:generate mockgen -destination ../../../test/mock/controller-runtime/mockclient/client.go -package mockclient sigs.k8s.io/controller-runtime/pkg/client Client
 //go:generate mockgen -destination ../../../test/mock/controller-runtime/mockclient/subresource_writer.go -package mockclient sigs.k8s.io/controller-runtime/pkg/client SubResourceWriter
 
@@ -49,6 +52,10 @@ type DeviceRegistrationReconciler struct {
 
 	// Public Cert (CA used to sign requests with
 	Cert *x509.Certificate
+
+	// RequireApproval only issues certificates for registrations which were approved by an operator
+	// or by an auto-approval rule of the seeder
+	RequireApproval bool
 }
 
 //+kubebuilder:rbac:groups=dasboot.githedgehog.com,resources=deviceregistrations,verbs=get;list;watch;create;update;patch;delete
@@ -111,6 +118,18 @@ func (r *DeviceRegistrationReconciler) Reconcile(ctx context.Context, req ctrl.R
 	// TODO: check requested location of the device first, and if there is already a registration for this device
 	// then we need to reject this
 
+	// denied registrations never get a certificate, and pending ones only if no approval is required
+	switch dr.Spec.Approval {
+	case dasbootv1alpha1.RegistrationApprovalDenied:
+		l.Info("Registration was denied, not issuing a certificate", "req", req.NamespacedName)
+		return ctrl.Result{}, nil
+	case dasbootv1alpha1.RegistrationApprovalPending:
+		if r.RequireApproval {
+			l.Info("Registration is pending approval, not issuing a certificate yet", "req", req.NamespacedName)
+			return ctrl.Result{}, nil
+		}
+	}
+
 	// check if we need to create a certificate
 	if !needToGenerateCertificate(l, &dr, csrPub) {
 		l.Info("No need to generate a new certificate", "req", req.NamespacedName)
@@ -165,7 +184,17 @@ func needToGenerateCertificate(l logr.Logger, dr *dasbootv1alpha1.DeviceRegistra
 
 	// if the public keys match, then we do NOT have to generate a new certificate
 	// otherwise it is a new CSR, so we need to generate a new certificate
-	return !csrPub.Equal(certPub)
+	if !csrPub.Equal(certPub) {
+		return true
+	}
+
+	// the same key gets a new certificate when the existing one is about to expire
+	// so that devices can pick it up through a renewal request
+	if time.Until(cert.NotAfter) < certificateRenewBefore {
+		l.Info("needToGenerateCertificate: existing certificate is about to expire, generating a new one...", "notAfter", cert.NotAfter)
+		return true
+	}
+	return false
 }
 
 // SetupWithManager sets up the controller with the Manager.
@@ -129,11 +129,12 @@ func TestDeviceRegistrationReconciler_Reconcile(t *testing.T) {
 	}
 
 	tests := []struct {
-		name    string
-		args    args
-		pre     func(t *testing.T, ctrl *gomock.Controller, r *DeviceRegistrationReconciler, c *mockclient.MockClient)
-		want    ctrl.Result
-		wantErr bool
+		name            string
+		args            args
+		requireApproval bool
+		pre             func(t *testing.T, ctrl *gomock.Controller, r *DeviceRegistrationReconciler, c *mockclient.MockClient)
+		want            ctrl.Result
+		wantErr         bool
 	}{
 		{
 			name: "new device registration object created",
@@ -255,6 +256,161 @@ func TestDeviceRegistrationReconciler_Reconcile(t *testing.T) {
 			want:    ctrl.Result{},
 			wantErr: false,
 		},
+		{
+			name: "certificate about to expire gets renewed for the same key",
+			args: args{
+				req: ctrl.Request{
+					NamespacedName: types.NamespacedName{
+						Name:      "test-device",
+						Namespace: "default",
+					},
+				},
+			},
+			pre: func(t *testing.T, ctrl *gomock.Controller, r *DeviceRegistrationReconciler, c *mockclient.MockClient) {
+				origValidity := certificateValidity
+				certificateValidity = time.Hour * 24
+				csr, pub, certPrev := newCSRPubKeyAndCert("test-device", r.Key, r.Cert)
+				certificateValidity = origValidity
+				c.EXPECT().Get(gomock.Any(), gomock.Any(), gomock.Any()).Times(1).DoAndReturn(func(ctx context.Context, key types.NamespacedName, obj client.Object, opts ...client.GetOption) error {
+					o := obj.(*dasbootv1alpha1.DeviceRegistration)
+					*o = dasbootv1alpha1.DeviceRegistration{
+						ObjectMeta: metav1.ObjectMeta{
+							Name:      "test-device",
+							Namespace: "default",
+						},
+						Spec: dasbootv1alpha1.DeviceRegistrationSpec{
+							CSR: csr,
+						},
+						Status: dasbootv1alpha1.DeviceRegistrationStatus{
+							Certificate: certPrev,
+						},
+					}
+					return nil
+				})
+				w := mockclient.NewMockSubResourceWriter(ctrl)
+				w.EXPECT().Update(gomock.Any(), gomock.Any(), gomock.Any()).Times(1).DoAndReturn(func(ctx context.Context, obj client.Object, opts ...client.SubResourceUpdateOption) error {
+					o := obj.(*dasbootv1alpha1.DeviceRegistration)
+					cert, err := x509.ParseCertificate(o.Status.Certificate)
+					if err != nil {
+						return err
+					}
+					if !cert.PublicKey.(*ecdsa.PublicKey).Equal(pub) {
+						return fmt.Errorf("expected certificate public key to be the existing one")
+					}
+					if time.Until(cert.NotAfter) < certificateRenewBefore {
+						return fmt.Errorf("expected renewed certificate to be valid for longer than the renewal period")
+					}
+					return nil
+				})
+				c.EXPECT().Status().DoAndReturn(func() client.SubResourceWriter {
+					return w
+				})
+			},
+			want:    ctrl.Result{},
+			wantErr: false,
+		},
+		{
+			name: "approval required and registration pending, no certificate issued",
+			args: args{
+				req: ctrl.Request{
+					NamespacedName: types.NamespacedName{
+						Name:      "test-device",
+						Namespace: "default",
+					},
+				},
+			},
+			requireApproval: true,
+			pre: func(t *testing.T, ctrl *gomock.Controller, r *DeviceRegistrationReconciler, c *mockclient.MockClient) {
+				csr, _, _ := newCSRPubKeyAndCert("test-device", r.Key, r.Cert)
+				c.EXPECT().Get(gomock.Any(), gomock.Any(), gomock.Any()).Times(1).DoAndReturn(func(ctx context.Context, key types.NamespacedName, obj client.Object, opts ...client.GetOption) error {
+					o := obj.(*dasbootv1alpha1.DeviceRegistration)
+					*o = dasbootv1alpha1.DeviceRegistration{
+						ObjectMeta: metav1.ObjectMeta{
+							Name:      "test-device",
+							Namespace: "default",
+						},
+						Spec: dasbootv1alpha1.DeviceRegistrationSpec{
+							CSR: csr,
+						},
+					}
+					return nil
+				})
+			},
+			want:    ctrl.Result{},
+			wantErr: false,
+		},
+		{
+			name: "approval required and registration approved",
+			args: args{
+				req: ctrl.Request{
+					NamespacedName: types.NamespacedName{
+						Name:      "test-device",
+						Namespace: "default",
+					},
+				},
+			},
+			requireApproval: true,
+			pre: func(t *testing.T, ctrl *gomock.Controller, r *DeviceRegistrationReconciler, c *mockclient.MockClient) {
+				csr, _, _ := newCSRPubKeyAndCert("test-device", r.Key, r.Cert)
+				c.EXPECT().Get(gomock.Any(), gomock.Any(), gomock.Any()).Times(1).DoAndReturn(func(ctx context.Context, key types.NamespacedName, obj client.Object, opts ...client.GetOption) error {
+					o := obj.(*dasbootv1alpha1.DeviceRegistration)
+					*o = dasbootv1alpha1.DeviceRegistration{
+						ObjectMeta: metav1.ObjectMeta{
+							Name:      "test-device",
+							Namespace: "default",
+						},
+						Spec: dasbootv1alpha1.DeviceRegistrationSpec{
+							CSR:      csr,
+							Approval: dasbootv1alpha1.RegistrationApprovalApproved,
+						},
+					}
+					return nil
+				})
+				w := mockclient.NewMockSubResourceWriter(ctrl)
+				w.EXPECT().Update(gomock.Any(), gomock.Any(), gomock.Any()).Times(1).DoAndReturn(func(ctx context.Context, obj client.Object, opts ...client.SubResourceUpdateOption) error {
+					o := obj.(*dasbootv1alpha1.DeviceRegistration)
+					if o.Status.Certificate == nil {
+						return fmt.Errorf("expected certificate to be set")
+					}
+					return nil
+				})
+				c.EXPECT().Status().DoAndReturn(func() client.SubResourceWriter {
+					return w
+				})
+			},
+			want:    ctrl.Result{},
+			wantErr: false,
+		},
+		{
+			name: "denied registration never gets a certificate",
+			args: args{
+				req: ctrl.Request{
+					NamespacedName: types.NamespacedName{
+						Name:      "test-device",
+						Namespace: "default",
+					},
+				},
+			},
+			pre: func(t *testing.T, ctrl *gomock.Controller, r *DeviceRegistrationReconciler, c *mockclient.MockClient) {
+				csr, _, _ := newCSRPubKeyAndCert("test-device", r.Key, r.Cert)
+				c.EXPECT().Get(gomock.Any(), gomock.Any(), gomock.Any()).Times(1).DoAndReturn(func(ctx context.Context, key types.NamespacedName, obj client.Object, opts ...client.GetOption) error {
+					o := obj.(*dasbootv1alpha1.DeviceRegistration)
+					*o = dasbootv1alpha1.DeviceRegistration{
+						ObjectMeta: metav1.ObjectMeta{
+							Name:      "test-device",
+							Namespace: "default",
+						},
+						Spec: dasbootv1alpha1.DeviceRegistrationSpec{
+							CSR:      csr,
+							Approval: dasbootv1alpha1.RegistrationApprovalDenied,
+						},
+					}
+					return nil
+				})
+			},
+			want:    ctrl.Result{},
+			wantErr: false,
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -264,6 +420,7 @@ func TestDeviceRegistrationReconciler_Reconcile(t *testing.T) {
 			defer ctrl.Finish()
 			mockclient := mockclient.NewMockClient(ctrl)
 			r := newDeviceRegistrationReconciler(mockclient)
+			r.RequireApproval = tt.requireApproval
 			if tt.pre != nil {
 				tt.pre(t, ctrl, r, mockclient)
 			}
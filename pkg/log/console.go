@@ -0,0 +1,143 @@
+// Copyright 2023 Hedgehog
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package log
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+const (
+	// ConsoleAuto can be passed as a console to `NewSerialConsole` to autodetect the consoles
+	ConsoleAuto = "auto"
+
+	// ConsoleStderr is the default console which is being used if no consoles are set or detected
+	ConsoleStderr = "stderr"
+)
+
+// these are variables so that they can be swapped out in tests
+var (
+	procCmdlinePath      = "/proc/cmdline"
+	sysConsoleActivePath = "/sys/class/tty/console/active"
+	devPath              = "/dev"
+
+	// probeConsoles are the console devices which are being probed in order if the
+	// consoles could not be detected from the kernel command-line or sysfs
+	probeConsoles = []string{"ttyS0", "ttyS1", "ttyAMA0", "ttyMV0", "hvc0"}
+)
+
+// DetectConsoles detects the consoles of the system. It parses the `console=` entries of the kernel command-line
+// first. If there are none, it uses the active consoles as reported by the kernel in sysfs. If that fails as well,
+// it falls back to probing well-known serial console devices, and returns the first one which can be opened. It
+// returns the device paths of all detected consoles, or nil if none could be detected.
+func DetectConsoles() []string {
+	if consoles := cmdlineConsoles(); len(consoles) > 0 {
+		return consoles
+	}
+	if consoles := activeConsoles(); len(consoles) > 0 {
+		return consoles
+	}
+	for _, name := range probeConsoles {
+		p := filepath.Join(devPath, name)
+		// unused legacy serial ports fail to open with EIO, which is what makes this probing work
+		f, err := os.OpenFile(p, os.O_WRONLY|syscall.O_NOCTTY|syscall.O_NONBLOCK, 0)
+		if err != nil {
+			continue
+		}
+		f.Close()
+		return []string{p}
+	}
+	return nil
+}
+
+// cmdlineConsoles parses all `console=` entries from the kernel command-line, e.g. `console=ttyS0,115200n8`
+func cmdlineConsoles() []string {
+	b, err := os.ReadFile(procCmdlinePath)
+	if err != nil {
+		return nil
+	}
+	var ret []string
+	for _, arg := range strings.Fields(string(b)) {
+		val, ok := strings.CutPrefix(arg, "console=")
+		if !ok {
+			continue
+		}
+		name, _, _ := strings.Cut(val, ",")
+		ret = appendConsole(ret, name)
+	}
+	return ret
+}
+
+// activeConsoles reads the active consoles from sysfs, e.g. `tty0 ttyS0`
+func activeConsoles() []string {
+	b, err := os.ReadFile(sysConsoleActivePath)
+	if err != nil {
+		return nil
+	}
+	var ret []string
+	for _, name := range strings.Fields(string(b)) {
+		ret = appendConsole(ret, name)
+	}
+	return ret
+}
+
+func appendConsole(consoles []string, name string) []string {
+	if name == "" {
+		return consoles
+	}
+	p := filepath.Join(devPath, name)
+	for _, c := range consoles {
+		if c == p {
+			return consoles
+		}
+	}
+	return append(consoles, p)
+}
+
+// ResolveConsoles resolves the consoles as they can be passed to `NewSerialConsole` to output paths. `ConsoleAuto`
+// gets replaced by the detected consoles, plain device names (e.g. `ttyS0`) are being expanded to their device path,
+// and `stderr` and `stdout` are being passed through. If the result is empty, it returns `ConsoleStderr`.
+func ResolveConsoles(consoles []string) []string {
+	var ret []string
+	add := func(p string) {
+		for _, c := range ret {
+			if c == p {
+				return
+			}
+		}
+		ret = append(ret, p)
+	}
+	for _, console := range consoles {
+		console = strings.TrimSpace(console)
+		switch {
+		case console == "":
+			continue
+		case console == ConsoleAuto:
+			for _, p := range DetectConsoles() {
+				add(p)
+			}
+		case console == "stderr" || console == "stdout" || filepath.IsAbs(console):
+			add(console)
+		default:
+			add(filepath.Join(devPath, console))
+		}
+	}
+	if len(ret) == 0 {
+		return []string{ConsoleStderr}
+	}
+	return ret
+}
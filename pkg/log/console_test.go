@@ -0,0 +1,133 @@
+// Copyright 2023 Hedgehog
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package log
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestDetectConsoles(t *testing.T) {
+	tests := []struct {
+		name    string
+		cmdline string
+		active  string
+		devs    []string
+		want    []string
+	}{
+		{
+			name:    "kernel command-line",
+			cmdline: "BOOT_IMAGE=/vmlinuz console=tty0 console=ttyS1,115200n8 quiet console=ttyS1",
+			active:  "ttyS0",
+			want:    []string{"tty0", "ttyS1"},
+		},
+		{
+			name:    "active consoles from sysfs",
+			cmdline: "BOOT_IMAGE=/vmlinuz quiet",
+			active:  "tty0 ttyAMA0\n",
+			want:    []string{"tty0", "ttyAMA0"},
+		},
+		{
+			name:    "probing",
+			cmdline: "BOOT_IMAGE=/vmlinuz quiet",
+			devs:    []string{"ttyAMA0", "hvc0"},
+			want:    []string{"ttyAMA0"},
+		},
+		{
+			name: "nothing detected",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			oldCmdline, oldActive, oldDev := procCmdlinePath, sysConsoleActivePath, devPath
+			defer func() {
+				procCmdlinePath, sysConsoleActivePath, devPath = oldCmdline, oldActive, oldDev
+			}()
+			procCmdlinePath = filepath.Join(dir, "cmdline")
+			sysConsoleActivePath = filepath.Join(dir, "active")
+			devPath = filepath.Join(dir, "dev")
+			if err := os.MkdirAll(devPath, 0755); err != nil {
+				t.Fatal(err)
+			}
+			if tt.cmdline != "" {
+				if err := os.WriteFile(procCmdlinePath, []byte(tt.cmdline), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if tt.active != "" {
+				if err := os.WriteFile(sysConsoleActivePath, []byte(tt.active), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			for _, dev := range tt.devs {
+				if err := os.WriteFile(filepath.Join(devPath, dev), nil, 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			var want []string
+			for _, w := range tt.want {
+				want = append(want, filepath.Join(devPath, w))
+			}
+			if got := DetectConsoles(); !reflect.DeepEqual(got, want) {
+				t.Errorf("DetectConsoles() = %v, want %v", got, want)
+			}
+		})
+	}
+}
+
+func TestResolveConsoles(t *testing.T) {
+	oldCmdline, oldDev := procCmdlinePath, devPath
+	defer func() {
+		procCmdlinePath, devPath = oldCmdline, oldDev
+	}()
+	dir := t.TempDir()
+	procCmdlinePath = filepath.Join(dir, "cmdline")
+	devPath = "/dev"
+	if err := os.WriteFile(procCmdlinePath, []byte("console=ttyS0,115200"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		consoles []string
+		want     []string
+	}{
+		{
+			name: "default",
+			want: []string{"stderr"},
+		},
+		{
+			name:     "names and paths",
+			consoles: []string{"ttyS1", " /dev/ttyAMA0 ", "stderr", ""},
+			want:     []string{"/dev/ttyS1", "/dev/ttyAMA0", "stderr"},
+		},
+		{
+			name:     "auto without duplicates",
+			consoles: []string{"auto", "ttyS0", "stdout"},
+			want:     []string{"/dev/ttyS0", "stdout"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := ResolveConsoles(tt.consoles); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ResolveConsoles() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
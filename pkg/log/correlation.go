@@ -0,0 +1,201 @@
+// Copyright 2023 Hedgehog
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package log
+
+import (
+	"fmt"
+	"sync"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// These are the keys of the standard fields with which log messages of all stages can be correlated
+const (
+	FieldDeviceID       = "device_id"
+	FieldStage          = "stage"
+	FieldStep           = "step"
+	FieldInstallSession = "install_session"
+	FieldHostname       = "hostname"
+)
+
+// Correlation holds the standard fields which correlate the log messages of a single installation across all stages
+type Correlation struct {
+	DeviceID       string
+	Stage          string
+	InstallSession string
+
+	// Hostname is the planned host name of the device, which is only known once the seeder told us
+	Hostname string
+}
+
+// Fields returns the fields of all values of `c` which are set
+func (c Correlation) Fields() []zapcore.Field {
+	ret := make([]zapcore.Field, 0, 4)
+	if c.DeviceID != "" {
+		ret = append(ret, zap.String(FieldDeviceID, c.DeviceID))
+	}
+	if c.Stage != "" {
+		ret = append(ret, zap.String(FieldStage, c.Stage))
+	}
+	if c.InstallSession != "" {
+		ret = append(ret, zap.String(FieldInstallSession, c.InstallSession))
+	}
+	if c.Hostname != "" {
+		ret = append(ret, zap.String(FieldHostname, c.Hostname))
+	}
+	return ret
+}
+
+var currentStep string
+var currentStepLock sync.RWMutex
+
+// SetStep sets the step which all correlated loggers add to their messages from now on. It returns a function
+// which restores the previous step.
+func SetStep(step string) func() {
+	currentStepLock.Lock()
+	prev := currentStep
+	currentStep = step
+	currentStepLock.Unlock()
+	return func() {
+		currentStepLock.Lock()
+		currentStep = prev
+		currentStepLock.Unlock()
+	}
+}
+
+// Step returns the step which was set with `SetStep`
+func Step() string {
+	currentStepLock.RLock()
+	defer currentStepLock.RUnlock()
+	return currentStep
+}
+
+// WithCorrelation returns a logger which adds the correlation fields of `c` and the current step to every message
+// of `l`. If `l` is a correlated logger already, its correlation fields are being replaced. Fields which are passed
+// explicitly to a log call take precedence over the correlation fields with the same key.
+func WithCorrelation(l Interface, c Correlation) Interface {
+	if cl, ok := l.(*correlatedLogger); ok {
+		l = cl.next
+	}
+	return &correlatedLogger{
+		next:   l,
+		fields: c.Fields(),
+	}
+}
+
+type correlatedLogger struct {
+	next   Interface
+	fields []zapcore.Field
+}
+
+var _ Interface = &correlatedLogger{}
+
+func (l *correlatedLogger) with(fields []zapcore.Field) []zapcore.Field {
+	ret := make([]zapcore.Field, 0, len(fields)+len(l.fields)+1)
+	ret = append(ret, fields...)
+	has := func(key string) bool {
+		for _, f := range fields {
+			if f.Key == key {
+				return true
+			}
+		}
+		return false
+	}
+	for _, f := range l.fields {
+		if !has(f.Key) {
+			ret = append(ret, f)
+		}
+	}
+	if step := Step(); step != "" && !has(FieldStep) {
+		ret = append(ret, zap.String(FieldStep, step))
+	}
+	return ret
+}
+
+// Debug implements Interface
+func (l *correlatedLogger) Debug(msg string, fields ...zapcore.Field) {
+	l.next.Debug(msg, l.with(fields)...)
+}
+
+// Debugf implements Interface
+func (l *correlatedLogger) Debugf(template string, args ...interface{}) {
+	l.next.Debug(fmt.Sprintf(template, args...), l.with(nil)...)
+}
+
+// Info implements Interface
+func (l *correlatedLogger) Info(msg string, fields ...zapcore.Field) {
+	l.next.Info(msg, l.with(fields)...)
+}
+
+// Infof implements Interface
+func (l *correlatedLogger) Infof(template string, args ...interface{}) {
+	l.next.Info(fmt.Sprintf(template, args...), l.with(nil)...)
+}
+
+// Warn implements Interface
+func (l *correlatedLogger) Warn(msg string, fields ...zapcore.Field) {
+	l.next.Warn(msg, l.with(fields)...)
+}
+
+// Warnf implements Interface
+func (l *correlatedLogger) Warnf(template string, args ...interface{}) {
+	l.next.Warn(fmt.Sprintf(template, args...), l.with(nil)...)
+}
+
+// Error implements Interface
+func (l *correlatedLogger) Error(msg string, fields ...zapcore.Field) {
+	l.next.Error(msg, l.with(fields)...)
+}
+
+// Errorf implements Interface
+func (l *correlatedLogger) Errorf(template string, args ...interface{}) {
+	l.next.Error(fmt.Sprintf(template, args...), l.with(nil)...)
+}
+
+// DPanic implements Interface
+func (l *correlatedLogger) DPanic(msg string, fields ...zapcore.Field) {
+	l.next.DPanic(msg, l.with(fields)...)
+}
+
+// DPanicf implements Interface
+func (l *correlatedLogger) DPanicf(template string, args ...interface{}) {
+	l.next.DPanic(fmt.Sprintf(template, args...), l.with(nil)...)
+}
+
+// Panic implements Interface
+func (l *correlatedLogger) Panic(msg string, fields ...zapcore.Field) {
+	l.next.Panic(msg, l.with(fields)...)
+}
+
+// Panicf implements Interface
+func (l *correlatedLogger) Panicf(template string, args ...interface{}) {
+	l.next.Panic(fmt.Sprintf(template, args...), l.with(nil)...)
+}
+
+// Fatal implements Interface
+func (l *correlatedLogger) Fatal(msg string, fields ...zapcore.Field) {
+	l.next.Fatal(msg, l.with(fields)...)
+}
+
+// Fatalf implements Interface
+func (l *correlatedLogger) Fatalf(template string, args ...interface{}) {
+	l.next.Fatal(fmt.Sprintf(template, args...), l.with(nil)...)
+}
+
+// Sync implements Interface
+func (l *correlatedLogger) Sync() error {
+	return l.next.Sync()
+}
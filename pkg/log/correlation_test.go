@@ -0,0 +1,97 @@
+// Copyright 2023 Hedgehog
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package log
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"go.githedgehog.com/dasboot/pkg/log/syslog"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+func TestWithCorrelation(t *testing.T) {
+	c := Correlation{DeviceID: "0a1b2c", Stage: "stage2", InstallSession: "f00d"}
+	encoderConfig := zapcore.EncoderConfig{MessageKey: "m", LevelKey: "l", EncodeLevel: zapcore.LowercaseLevelEncoder}
+	tests := []struct {
+		name string
+		enc  zapcore.Encoder
+	}{
+		{
+			name: "console",
+			enc:  zapcore.NewConsoleEncoder(encoderConfig),
+		},
+		{
+			name: "json",
+			enc:  zapcore.NewJSONEncoder(encoderConfig),
+		},
+		{
+			name: "syslog",
+			enc: syslog.NewSyslogEncoder(syslog.SyslogEncoderConfig{
+				EncoderConfig: encoderConfig,
+				Facility:      syslog.LOG_LOCAL0,
+				Hostname:      "switch",
+				App:           "stage2",
+			}),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			l := WithCorrelation(NewZapWrappedLogger(zap.New(zapcore.NewCore(tt.enc, zapcore.AddSync(&buf), zapcore.DebugLevel))), c)
+
+			// messages without a step
+			l.Info("Without step")
+			l.Infof("Formatted %s", "message")
+			for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+				for _, want := range []string{"0a1b2c", "stage2", "f00d"} {
+					if !strings.Contains(line, want) {
+						t.Errorf("log line %q does not contain %q", line, want)
+					}
+				}
+				if strings.Contains(line, `"`+FieldStep+`"`) {
+					t.Errorf("log line %q contains a step", line)
+				}
+			}
+
+			// the step gets added and restored
+			buf.Reset()
+			restore := SetStep("download-artifacts")
+			l.Warn("With step")
+			restore()
+			l.Warn("Without step again")
+			lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+			if len(lines) != 2 || !strings.Contains(lines[0], "download-artifacts") || strings.Contains(lines[1], "download-artifacts") {
+				t.Errorf("unexpected step in log lines %q", lines)
+			}
+
+			// explicit fields take precedence and are not duplicated
+			buf.Reset()
+			l.Error("Explicit stage", zap.String(FieldStage, "other"))
+			if got := buf.String(); !strings.Contains(got, "other") || strings.Count(got, `"`+FieldStage+`"`) != 1 {
+				t.Errorf("log line %q does not contain the explicit stage exactly once", got)
+			}
+
+			// rebinding replaces the fields instead of adding them
+			buf.Reset()
+			WithCorrelation(l, Correlation{Stage: "stage1"}).Debug("Rebound")
+			if got := buf.String(); strings.Contains(got, "0a1b2c") || strings.Count(got, `"`+FieldStage+`"`) != 1 {
+				t.Errorf("log line %q still contains the previous correlation fields", got)
+			}
+		})
+	}
+}
@@ -77,7 +77,9 @@ func ReplaceGlobals(newLogger Interface) func() {
 	return func() { ReplaceGlobals(prevLogger) }
 }
 
-func NewSerialConsole(level zapcore.Level, format string, development bool) (*zap.Logger, error) {
+// NewSerialConsole creates a logger for the serial console. If no `consoles` are passed, it logs to stderr.
+// Otherwise it logs to all consoles at the same time, see `ResolveConsoles` for the supported values.
+func NewSerialConsole(level zapcore.Level, format string, development bool, consoles ...string) (*zap.Logger, error) {
 	// we enable callers, stacktraces and functions in development mode only
 	disableCaller := true
 	disableStacktrace := true
@@ -118,13 +120,22 @@ func NewSerialConsole(level zapcore.Level, format string, development bool) (*za
 			EncodeDuration: zapcore.StringDurationEncoder,
 			EncodeCaller:   zapcore.ShortCallerEncoder,
 		},
-		OutputPaths:      []string{"stderr"},
+		OutputPaths:      ResolveConsoles(consoles),
 		ErrorOutputPaths: []string{"stderr"},
 	}
 	return cfg.Build()
 }
 
-func NewSyslog(ctx context.Context, level zapcore.Level, development bool, facility syslog.Priority, server string, writerOptions ...syslog.WriterOption) (*zap.Logger, error) {
+func NewSyslog(ctx context.Context, level zapcore.Level, development bool, facility syslog.Priority, framing syslog.Framing, server string, writerOptions ...syslog.WriterOption) (*zap.Logger, error) {
+	logger, _, err := NewSyslogWithWriter(ctx, level, development, facility, framing, server, writerOptions...)
+	return logger, err
+}
+
+// NewSyslogWithWriter is like `NewSyslog`, but it additionally returns the underlying syslog writer which allows
+// to check on the health of the syslog destination. The `framing` must match what the syslog server expects
+// on stream transports: rsyslog and syslog-ng both detect octet-counting automatically, but many relays only
+// support non-transparent (LF delimited) framing.
+func NewSyslogWithWriter(ctx context.Context, level zapcore.Level, development bool, facility syslog.Priority, framing syslog.Framing, server string, writerOptions ...syslog.WriterOption) (*zap.Logger, *syslog.Writer, error) {
 	// we enable callers, stacktraces and functions in development mode only
 	callerKey := zapcore.OmitKey
 	stacktraceKey := zapcore.OmitKey
@@ -168,7 +179,7 @@ func NewSyslog(ctx context.Context, level zapcore.Level, development bool, facil
 			EncodeDuration: zapcore.StringDurationEncoder,
 			EncodeCaller:   zapcore.ShortCallerEncoder,
 		},
-		Framing:  syslog.DefaultFraming,
+		Framing:  framing,
 		Facility: facility,
 		Hostname: hostname,
 		PID:      pid,
@@ -189,5 +200,5 @@ func NewSyslog(ctx context.Context, level zapcore.Level, development bool, facil
 		zap.AddStacktrace(stackLevel),
 	)
 
-	return logger, nil
+	return logger, sink, nil
 }
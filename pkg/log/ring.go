@@ -0,0 +1,101 @@
+// Copyright 2023 Hedgehog
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package log
+
+import (
+	"bytes"
+	"strings"
+	"sync"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// RingBuffer is a zapcore.WriteSyncer which keeps the last lines that were written to it in memory.
+// It is used to retain recent log messages, so that they can be included in crash reports.
+type RingBuffer struct {
+	lock  sync.Mutex
+	lines []string
+	next  int
+	full  bool
+}
+
+var _ zapcore.WriteSyncer = &RingBuffer{}
+
+// NewRingBuffer creates a new ring buffer which retains the last `size` lines.
+func NewRingBuffer(size int) *RingBuffer {
+	if size <= 0 {
+		size = 1
+	}
+	return &RingBuffer{
+		lines: make([]string, size),
+	}
+}
+
+// Write implements zapcore.WriteSyncer. Every write can contain one or more lines.
+func (rb *RingBuffer) Write(p []byte) (int, error) {
+	rb.lock.Lock()
+	defer rb.lock.Unlock()
+	for _, line := range bytes.Split(bytes.TrimRight(p, "\n"), []byte("\n")) {
+		rb.lines[rb.next] = string(line)
+		rb.next++
+		if rb.next == len(rb.lines) {
+			rb.next = 0
+			rb.full = true
+		}
+	}
+	return len(p), nil
+}
+
+// Sync implements zapcore.WriteSyncer
+func (rb *RingBuffer) Sync() error {
+	return nil
+}
+
+// Lines returns a copy of the retained lines in the order in which they were written.
+func (rb *RingBuffer) Lines() []string {
+	rb.lock.Lock()
+	defer rb.lock.Unlock()
+	if !rb.full {
+		ret := make([]string, rb.next)
+		copy(ret, rb.lines[:rb.next])
+		return ret
+	}
+	ret := make([]string, 0, len(rb.lines))
+	ret = append(ret, rb.lines[rb.next:]...)
+	ret = append(ret, rb.lines[:rb.next]...)
+	return ret
+}
+
+// String returns all retained lines joined by newlines.
+func (rb *RingBuffer) String() string {
+	return strings.Join(rb.Lines(), "\n")
+}
+
+// NewRingBufferLogger creates a JSON logger which writes to the ring buffer `rb`.
+func NewRingBufferLogger(level zapcore.Level, rb *RingBuffer) *zap.Logger {
+	enc := zapcore.NewJSONEncoder(zapcore.EncoderConfig{
+		TimeKey:        "t",
+		LevelKey:       "l",
+		NameKey:        "n",
+		MessageKey:     "m",
+		StacktraceKey:  zapcore.OmitKey,
+		LineEnding:     zapcore.DefaultLineEnding,
+		EncodeLevel:    zapcore.LowercaseLevelEncoder,
+		EncodeTime:     zapcore.RFC3339TimeEncoder,
+		EncodeDuration: zapcore.StringDurationEncoder,
+	})
+	return zap.New(zapcore.NewCore(enc, rb, zap.NewAtomicLevelAt(level)))
+}
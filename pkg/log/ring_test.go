@@ -0,0 +1,93 @@
+// Copyright 2023 Hedgehog
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package log
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"go.uber.org/zap/zapcore"
+)
+
+func TestRingBuffer(t *testing.T) {
+	tests := []struct {
+		name   string
+		size   int
+		writes []string
+		want   []string
+	}{
+		{
+			name: "empty",
+			size: 3,
+			want: []string{},
+		},
+		{
+			name:   "not full",
+			size:   3,
+			writes: []string{"one\n", "two\n"},
+			want:   []string{"one", "two"},
+		},
+		{
+			name:   "wraps around",
+			size:   3,
+			writes: []string{"one\n", "two\n", "three\n", "four\n", "five\n"},
+			want:   []string{"three", "four", "five"},
+		},
+		{
+			name:   "multiple lines in one write",
+			size:   3,
+			writes: []string{"one\ntwo\n", "three\nfour\n"},
+			want:   []string{"two", "three", "four"},
+		},
+		{
+			name:   "invalid size",
+			size:   0,
+			writes: []string{"one\n", "two\n"},
+			want:   []string{"two"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rb := NewRingBuffer(tt.size)
+			for _, w := range tt.writes {
+				n, err := rb.Write([]byte(w))
+				if err != nil {
+					t.Fatalf("Write() error = %v", err)
+				}
+				if n != len(w) {
+					t.Fatalf("Write() n = %d, want %d", n, len(w))
+				}
+			}
+			if got := rb.Lines(); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Lines() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNewRingBufferLogger(t *testing.T) {
+	rb := NewRingBuffer(10)
+	l := NewRingBufferLogger(zapcore.InfoLevel, rb)
+	l.Debug("filtered")
+	l.Info("retained")
+	lines := rb.Lines()
+	if len(lines) != 1 {
+		t.Fatalf("expected exactly one line, got %v", lines)
+	}
+	if !strings.HasSuffix(lines[0], `"m":"retained"}`) {
+		t.Errorf("unexpected line: %s", lines[0])
+	}
+}
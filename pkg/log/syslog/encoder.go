@@ -72,6 +72,9 @@ type SyslogEncoderConfig struct {
 	Hostname string   `json:"hostname" yaml:"hostname"`
 	PID      int      `json:"pid" yaml:"pid"`
 	App      string   `json:"app" yaml:"app"`
+
+	// StructuredData optionally maps fields of log entries into an SD-ELEMENT of every message
+	StructuredData *StructuredDataConfig `json:"structured_data,omitempty" yaml:"structured_data,omitempty"`
 }
 
 type syslogEncoder struct {
@@ -264,8 +267,9 @@ func (enc *syslogEncoder) EncodeEntry(ent zapcore.Entry, fields []zapcore.Field)
 	msg.AppendByte(' ')
 	msg.AppendInt(int64(enc.PID))
 
-	// SP MSGID SP STRUCTURED-DATA (just ignore)
-	msg.AppendString(" - -")
+	// SP MSGID SP STRUCTURED-DATA
+	msg.AppendString(" - ")
+	appendStructuredData(msg, enc.structuredData(fields))
 
 	// SP UTF8 MSG
 	json, err := enc.je.EncodeEntry(ent, fields)
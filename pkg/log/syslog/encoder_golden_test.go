@@ -0,0 +1,175 @@
+// Copyright 2023 Hedgehog
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package syslog
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// run `go test ./pkg/log/syslog -run TestSyslogEncoderGolden -update` after an intended change of the encoder output
+var updateGolden = flag.Bool("update", false, "update the golden files of the syslog encoder")
+
+type goldenObject struct {
+	name  string
+	count int
+}
+
+func (o goldenObject) MarshalLogObject(enc zapcore.ObjectEncoder) error {
+	enc.AddString("name", o.name)
+	enc.AddInt("count", o.count)
+	return nil
+}
+
+func TestSyslogEncoderGolden(t *testing.T) {
+	ts := time.Date(2023, 6, 1, 12, 34, 56, 789012345, time.UTC)
+
+	// a deterministic long message which exceeds the typical UDP syslog size limits
+	var long strings.Builder
+	for i := 0; long.Len() < 4096; i++ {
+		long.WriteString("segment-")
+		long.WriteByte(byte('a' + i%26))
+		long.WriteByte(' ')
+	}
+
+	tests := []struct {
+		name   string
+		entry  zapcore.Entry
+		fields []zapcore.Field
+	}{
+		{name: "level-debug", entry: zapcore.Entry{Level: zapcore.DebugLevel, Time: ts, Message: "debug message"}},
+		{name: "level-info", entry: zapcore.Entry{Level: zapcore.InfoLevel, Time: ts, Message: "info message"}},
+		{name: "level-warn", entry: zapcore.Entry{Level: zapcore.WarnLevel, Time: ts, Message: "warn message"}},
+		{name: "level-error", entry: zapcore.Entry{Level: zapcore.ErrorLevel, Time: ts, Message: "error message"}},
+		{name: "level-dpanic", entry: zapcore.Entry{Level: zapcore.DPanicLevel, Time: ts, Message: "dpanic message"}},
+		{name: "level-panic", entry: zapcore.Entry{Level: zapcore.PanicLevel, Time: ts, Message: "panic message"}},
+		{name: "level-fatal", entry: zapcore.Entry{Level: zapcore.FatalLevel, Time: ts, Message: "fatal message"}},
+		{name: "zero-time", entry: zapcore.Entry{Level: zapcore.InfoLevel, Message: "no timestamp"}},
+		{
+			name:  "logger-name-and-caller",
+			entry: zapcore.Entry{Level: zapcore.InfoLevel, Time: ts, Message: "with caller", LoggerName: "stage0", Caller: zapcore.NewEntryCaller(0, "/src/pkg/stage0/stage0.go", 42, true)},
+		},
+		{
+			name:  "fields",
+			entry: zapcore.Entry{Level: zapcore.InfoLevel, Time: ts, Message: "Downloading artifact"},
+			fields: []zapcore.Field{
+				zap.String("url", "https://[fd00::1]:8443/stage1/x86_64"),
+				zap.Int("attempt", 3),
+				zap.Bool("resumed", true),
+				zap.Float64("ratio", 0.25),
+				zap.Duration("elapsed", 1500*time.Millisecond),
+				zap.Time("started", ts.Add(-time.Minute)),
+				zap.Strings("mirrors", []string{"seeder-a", "seeder-b"}),
+				zap.Object("artifact", goldenObject{name: "stage1", count: 2}),
+				zap.Error(errors.New("connection reset by peer")),
+				zap.Namespace("retry"),
+				zap.Int("max", 5),
+			},
+		},
+		{
+			name:  "escaping",
+			entry: zapcore.Entry{Level: zapcore.WarnLevel, Time: ts, Message: "quote \" backslash \\ tab \t newline \n control \x01"},
+			fields: []zapcore.Field{
+				zap.String("path", `C:\dir "quoted"`),
+				zap.ByteString("raw", []byte{'a', 0x00, 'b'}),
+			},
+		},
+		{
+			name:  "unicode",
+			entry: zapcore.Entry{Level: zapcore.InfoLevel, Time: ts, Message: "Gerät übernommen ✓ 设备已认领 🦔"},
+			fields: []zapcore.Field{
+				zap.String("location", "Zürich – Rack 7"),
+				zap.String("invalid_utf8", "a\xffb"),
+			},
+		},
+		{
+			name:  "structured-data",
+			entry: zapcore.Entry{Level: zapcore.InfoLevel, Time: ts, Message: "Registered device"},
+			fields: []zapcore.Field{
+				zap.String("device_id", "0a1b2c3d"),
+				StructuredData("dasboot@32473", SDParam{Name: "device_id", Value: "0a1b2c3d"}, SDParam{Name: "escaped", Value: `a "b" \ c]`}),
+				StructuredData("origin", SDParam{Name: "software", Value: "das-boot"}),
+			},
+		},
+		{name: "long-message", entry: zapcore.Entry{Level: zapcore.InfoLevel, Time: ts, Message: long.String()}},
+	}
+
+	framings := []struct {
+		name    string
+		framing Framing
+	}{
+		{name: "udp", framing: NonTransparentFraming},
+		{name: "octet-counted", framing: OctetCountingFraming},
+	}
+
+	for _, f := range framings {
+		enc := NewSyslogEncoder(SyslogEncoderConfig{
+			EncoderConfig: zapcore.EncoderConfig{
+				TimeKey:        "t",
+				LevelKey:       "l",
+				NameKey:        "n",
+				CallerKey:      "c",
+				MessageKey:     "m",
+				StacktraceKey:  "s",
+				LineEnding:     zapcore.DefaultLineEnding,
+				EncodeLevel:    zapcore.LowercaseLevelEncoder,
+				EncodeTime:     zapcore.RFC3339TimeEncoder,
+				EncodeDuration: zapcore.StringDurationEncoder,
+				EncodeCaller:   zapcore.ShortCallerEncoder,
+			},
+			Framing:  f.framing,
+			Facility: LOG_LOCAL0,
+			Hostname: "switch-01",
+			PID:      4242,
+			App:      "stage0",
+		})
+		for _, tt := range tests {
+			t.Run(tt.name+"/"+f.name, func(t *testing.T) {
+				buf, err := enc.Clone().EncodeEntry(tt.entry, tt.fields)
+				if err != nil {
+					t.Fatalf("EncodeEntry() error = %v", err)
+				}
+				defer buf.Free()
+				got := buf.Bytes()
+
+				path := filepath.Join("testdata", "golden", tt.name+"."+f.name+".golden")
+				if *updateGolden {
+					if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+						t.Fatal(err)
+					}
+					if err := os.WriteFile(path, got, 0644); err != nil {
+						t.Fatal(err)
+					}
+				}
+				want, err := os.ReadFile(path)
+				if err != nil {
+					t.Fatalf("reading golden file (run with -update to create it): %v", err)
+				}
+				if !bytes.Equal(got, want) {
+					t.Errorf("EncodeEntry() output does not match golden file %s\n got: %q\nwant: %q", path, got, want)
+				}
+			})
+		}
+	}
+}
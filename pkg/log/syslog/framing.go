@@ -0,0 +1,78 @@
+// Copyright 2023 Hedgehog
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package syslog
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+var ErrInvalidFraming = errors.New("syslog: invalid framing")
+
+var framingNames = map[Framing]string{
+	NonTransparentFraming: "non-transparent",
+	OctetCountingFraming:  "octet-counting",
+}
+
+// ParseFraming parses the name of a framing as it is being returned by `Framing.String()`. An empty string
+// returns the `DefaultFraming`.
+func ParseFraming(s string) (Framing, error) {
+	if s == "" {
+		return DefaultFraming, nil
+	}
+	for f, name := range framingNames {
+		if strings.EqualFold(s, name) {
+			return f, nil
+		}
+	}
+	return DefaultFraming, fmt.Errorf("%w: '%s': must be one of 'non-transparent' or 'octet-counting'", ErrInvalidFraming, s)
+}
+
+// String implements fmt.Stringer
+func (f Framing) String() string {
+	if name, ok := framingNames[f]; ok {
+		return name
+	}
+	return fmt.Sprintf("unknown(%d)", int(f))
+}
+
+// Set sets the framing for the flag.Value interface.
+func (f *Framing) Set(s string) error {
+	v, err := ParseFraming(s)
+	if err != nil {
+		return err
+	}
+	*f = v
+	return nil
+}
+
+// Get gets the framing for the flag.Getter interface.
+func (f *Framing) Get() interface{} {
+	return *f
+}
+
+// MarshalText implements encoding.TextMarshaler
+func (f Framing) MarshalText() ([]byte, error) {
+	if _, ok := framingNames[f]; !ok {
+		return nil, fmt.Errorf("%w: %d", ErrInvalidFraming, int(f))
+	}
+	return []byte(f.String()), nil
+}
+
+// UnmarshalText implements encoding.TextUnmarshaler
+func (f *Framing) UnmarshalText(text []byte) error {
+	return f.Set(string(text))
+}
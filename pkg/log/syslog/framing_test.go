@@ -0,0 +1,216 @@
+// Copyright 2023 Hedgehog
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package syslog
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+
+	"go.uber.org/zap/zapcore"
+)
+
+func TestParseFraming(t *testing.T) {
+	tests := []struct {
+		s       string
+		want    Framing
+		wantErr bool
+	}{
+		{s: "", want: DefaultFraming},
+		{s: "non-transparent", want: NonTransparentFraming},
+		{s: "octet-counting", want: OctetCountingFraming},
+		{s: "Octet-Counting", want: OctetCountingFraming},
+		{s: "lf", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.s, func(t *testing.T) {
+			got, err := ParseFraming(tt.s)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseFraming() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				if !errors.Is(err, ErrInvalidFraming) {
+					t.Errorf("ParseFraming() error = %v, want ErrInvalidFraming", err)
+				}
+				return
+			}
+			if got != tt.want {
+				t.Errorf("ParseFraming() = %v, want %v", got, tt.want)
+			}
+			if tt.s != "" && got.String() != tt.want.String() {
+				t.Errorf("String() = %v, want %v", got.String(), tt.want.String())
+			}
+		})
+	}
+
+	// the JSON form is the name of the framing
+	b, err := json.Marshal(struct {
+		F Framing `json:"f"`
+	}{F: OctetCountingFraming})
+	if err != nil || string(b) != `{"f":"octet-counting"}` {
+		t.Errorf("json.Marshal() = %s, %v", b, err)
+	}
+}
+
+// splitOctetCounted splits a stream with octet-counting framing (RFC 6587 section 3.4.1) the way
+// syslog-ng does for its syslog() source over TCP
+func splitOctetCounted(stream []byte) ([]string, error) {
+	var ret []string
+	for len(stream) > 0 {
+		sp := bytes.IndexByte(stream, ' ')
+		if sp <= 0 {
+			return nil, fmt.Errorf("missing MSG-LEN in %q", stream)
+		}
+		n, err := strconv.Atoi(string(stream[:sp]))
+		if err != nil || n <= 0 || stream[0] == '0' {
+			return nil, fmt.Errorf("invalid MSG-LEN %q", stream[:sp])
+		}
+		stream = stream[sp+1:]
+		if len(stream) < n {
+			return nil, fmt.Errorf("MSG-LEN %d exceeds remaining stream of %d bytes", n, len(stream))
+		}
+		ret = append(ret, string(stream[:n]))
+		stream = stream[n:]
+	}
+	return ret, nil
+}
+
+// splitNonTransparent splits a stream with non-transparent framing (RFC 6587 section 3.4.2) on LF
+// the way syslog-ng does for its network() source
+func splitNonTransparent(stream []byte) ([]string, error) {
+	var ret []string
+	for len(stream) > 0 {
+		lf := bytes.IndexByte(stream, '\n')
+		if lf < 0 {
+			return nil, fmt.Errorf("unterminated frame %q", stream)
+		}
+		ret = append(ret, string(stream[:lf]))
+		stream = stream[lf+1:]
+	}
+	return ret, nil
+}
+
+// splitAutodetect splits a stream like rsyslog's imtcp does: every frame which starts with a digit is
+// octet-counted, and everything else is delimited by LF
+func splitAutodetect(stream []byte) ([]string, error) {
+	var ret []string
+	for len(stream) > 0 {
+		if stream[0] >= '0' && stream[0] <= '9' {
+			sp := bytes.IndexByte(stream, ' ')
+			if sp < 0 {
+				return nil, fmt.Errorf("missing MSG-LEN in %q", stream)
+			}
+			n, err := strconv.Atoi(string(stream[:sp]))
+			if err != nil || len(stream[sp+1:]) < n {
+				return nil, fmt.Errorf("invalid MSG-LEN %q", stream[:sp])
+			}
+			ret = append(ret, string(stream[sp+1:sp+1+n]))
+			stream = stream[sp+1+n:]
+			continue
+		}
+		lf := bytes.IndexByte(stream, '\n')
+		if lf < 0 {
+			return nil, fmt.Errorf("unterminated frame %q", stream)
+		}
+		ret = append(ret, string(stream[:lf]))
+		stream = stream[lf+1:]
+	}
+	return ret, nil
+}
+
+func TestFramingRelayExpectations(t *testing.T) {
+	ts := time.Date(2023, 6, 1, 12, 0, 0, 0, time.UTC)
+	entries := []zapcore.Entry{
+		{Level: zapcore.InfoLevel, Time: ts, Message: "first"},
+		{Level: zapcore.ErrorLevel, Time: ts, Message: "multi\nline\r\nmessage"},
+		{Level: zapcore.WarnLevel, Time: ts, Message: "42 starts with digits"},
+		{Level: zapcore.InfoLevel, Time: ts, Message: "unicode 设备 ✓"},
+		{Level: zapcore.DebugLevel, Time: ts, Message: ""},
+	}
+
+	tests := []struct {
+		name    string
+		framing Framing
+		split   []func([]byte) ([]string, error)
+	}{
+		{
+			name:    "non-transparent",
+			framing: NonTransparentFraming,
+			split:   []func([]byte) ([]string, error){splitNonTransparent, splitAutodetect},
+		},
+		{
+			name:    "octet-counting",
+			framing: OctetCountingFraming,
+			split:   []func([]byte) ([]string, error){splitOctetCounted, splitAutodetect},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			enc := NewSyslogEncoder(SyslogEncoderConfig{
+				EncoderConfig: zapcore.EncoderConfig{
+					MessageKey:  "m",
+					LevelKey:    "l",
+					EncodeLevel: zapcore.LowercaseLevelEncoder,
+				},
+				Framing:  tt.framing,
+				Facility: LOG_LOCAL0,
+				Hostname: "switch-01",
+				PID:      1,
+				App:      "stage0",
+			})
+
+			// this is what a stream transport sends, and what a relay must split up again
+			var stream []byte
+			var want []string
+			for _, ent := range entries {
+				buf, err := enc.EncodeEntry(ent, nil)
+				if err != nil {
+					t.Fatalf("EncodeEntry() error = %v", err)
+				}
+				frame := buf.String()
+				buf.Free()
+				stream = append(stream, frame...)
+
+				// the syslog message itself never starts with a digit, so that relays can autodetect the framing,
+				// and it never contains a LF, so that it survives non-transparent framing
+				var msg string
+				if tt.framing == OctetCountingFraming {
+					msg = frame[bytes.IndexByte([]byte(frame), ' ')+1:]
+				} else {
+					msg = frame[:len(frame)-1]
+				}
+				if msg[0] != '<' || bytes.ContainsAny([]byte(msg), "\n") {
+					t.Errorf("syslog message %q must start with '<' and must not contain LF", msg)
+				}
+				want = append(want, msg)
+			}
+
+			for i, split := range tt.split {
+				got, err := split(stream)
+				if err != nil {
+					t.Fatalf("split %d: error = %v", i, err)
+				}
+				if !reflect.DeepEqual(got, want) {
+					t.Errorf("split %d: got = %q, want %q", i, got, want)
+				}
+			}
+		})
+	}
+}
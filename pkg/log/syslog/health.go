@@ -0,0 +1,134 @@
+// Copyright 2023 Hedgehog
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package syslog
+
+import (
+	"time"
+)
+
+const (
+	DefaultFailureThreshold = 3
+	DefaultNegativeCacheTTL = time.Second * 30
+)
+
+// HealthState is the state of the connection of a `*Writer` to its syslog server
+type HealthState string
+
+const (
+	// HealthStateConnecting means that the writer has not established a connection yet. Messages are being queued.
+	HealthStateConnecting HealthState = "connecting"
+
+	// HealthStateHealthy means that the writer is connected and messages are being delivered.
+	HealthStateHealthy HealthState = "healthy"
+
+	// HealthStateDisabled means that the destination failed too often and is temporarily disabled (negatively
+	// cached). Messages are being dropped (or spilled, see `Spill`) without blocking until the next connection attempt.
+	HealthStateDisabled HealthState = "disabled"
+)
+
+// Health is a snapshot of the health of a `*Writer`
+type Health struct {
+	Addr                string      `json:"addr"`
+	State               HealthState `json:"state"`
+	ConsecutiveFailures int         `json:"consecutive_failures,omitempty"`
+	LastError           string      `json:"last_error,omitempty"`
+	LastFailure         time.Time   `json:"last_failure,omitempty"`
+	DisabledUntil       time.Time   `json:"disabled_until,omitempty"`
+	Dropped             uint64      `json:"dropped,omitempty"`
+	Spilled             uint64      `json:"spilled,omitempty"`
+}
+
+// Degraded returns true if the destination is not healthy
+func (h Health) Degraded() bool {
+	return h.State != HealthStateHealthy
+}
+
+// FailureThreshold sets the number of consecutive connection or write failures after which the destination is being
+// disabled for the negative cache TTL.
+func FailureThreshold(n int) WriterOption {
+	return func(w *Writer) {
+		w.failureThreshold = n
+	}
+}
+
+// NegativeCacheTTL sets the duration for which a failing destination is disabled before the writer tries to
+// connect to it again.
+func NegativeCacheTTL(d time.Duration) WriterOption {
+	return func(w *Writer) {
+		w.negativeCacheTTL = d
+	}
+}
+
+// Health returns a snapshot of the current health of the writer
+func (w *Writer) Health() Health {
+	w.healthLock.Lock()
+	defer w.healthLock.Unlock()
+	ret := w.health
+	ret.Addr = w.addr
+	return ret
+}
+
+func (w *Writer) state() HealthState {
+	w.healthLock.Lock()
+	defer w.healthLock.Unlock()
+	return w.health.State
+}
+
+func (w *Writer) recordSuccess() {
+	w.healthLock.Lock()
+	defer w.healthLock.Unlock()
+	w.health.State = HealthStateHealthy
+	w.health.ConsecutiveFailures = 0
+	w.health.DisabledUntil = time.Time{}
+}
+
+// recordFailure records a connection or write failure, and returns the time until which the destination is disabled
+// if the failure threshold was reached
+func (w *Writer) recordFailure(reason string) time.Time {
+	w.healthLock.Lock()
+	defer w.healthLock.Unlock()
+	now := time.Now()
+	w.health.ConsecutiveFailures++
+	w.health.LastError = reason
+	w.health.LastFailure = now
+	if w.failureThreshold > 0 && w.health.ConsecutiveFailures >= w.failureThreshold {
+		w.health.State = HealthStateDisabled
+		w.health.DisabledUntil = now.Add(w.negativeCacheTTL)
+		return w.health.DisabledUntil
+	}
+	w.health.State = HealthStateConnecting
+	return time.Time{}
+}
+
+// recordRetry moves the writer from the disabled state back to connecting once the negative cache TTL expired
+func (w *Writer) recordRetry() {
+	w.healthLock.Lock()
+	defer w.healthLock.Unlock()
+	w.health.State = HealthStateConnecting
+	w.health.ConsecutiveFailures = 0
+	w.health.DisabledUntil = time.Time{}
+}
+
+func (w *Writer) recordDropped(n int) {
+	w.healthLock.Lock()
+	defer w.healthLock.Unlock()
+	w.health.Dropped += uint64(n)
+}
+
+func (w *Writer) recordSpilled(n int) {
+	w.healthLock.Lock()
+	defer w.healthLock.Unlock()
+	w.health.Spilled += uint64(n)
+}
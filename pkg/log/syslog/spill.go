@@ -0,0 +1,184 @@
+// Copyright 2023 Hedgehog
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package syslog
+
+import (
+	"encoding/binary"
+	"os"
+	"sync"
+)
+
+const (
+	// DefaultSpillMaxBytes is a sensible maximum size for a spill file: it holds thousands of typical messages
+	DefaultSpillMaxBytes = 4 * 1024 * 1024
+
+	spillHeaderLen = 4
+)
+
+// Spill enables spilling of messages to the file at `path` instead of dropping them whenever they cannot be delivered
+// right away: while the writer is still connecting and the buffer is full, while the destination is disabled, or
+// when writing a message to the destination failed. Once the writer is (re)connected, spilled messages are being
+// replayed in order before the writer proceeds with newly queued messages. The spill file grows up to `maxBytes`,
+// messages which do not fit anymore are being dropped. A spill file which was left behind by a previous writer with
+// the same `path` is being replayed as well, which is why every writer must use its own path.
+func Spill(path string, maxBytes int64) WriterOption {
+	return func(w *Writer) {
+		w.spill = &spillFile{
+			path:     path,
+			maxBytes: maxBytes,
+		}
+	}
+}
+
+// spillFile is an append-only file of length-prefixed messages. All methods are safe to be called on a nil
+// `*spillFile` which simply means that spilling is not enabled.
+type spillFile struct {
+	path     string
+	maxBytes int64
+	lock     sync.Mutex
+	f        *os.File
+	// size is the size of the file, and offset the position of the next message to replay
+	size   int64
+	offset int64
+}
+
+func (s *spillFile) open() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	f, err := os.OpenFile(s.path, os.O_RDWR|os.O_CREATE, 0o600)
+	if err != nil {
+		return err
+	}
+	st, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	s.f = f
+	s.size = st.Size()
+	s.offset = 0
+	return nil
+}
+
+// close closes the spill file. It is being removed if there is nothing left to replay.
+func (s *spillFile) close() {
+	if s == nil {
+		return
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.f == nil {
+		return
+	}
+	s.f.Close()
+	s.f = nil
+	if s.offset >= s.size {
+		os.Remove(s.path) //nolint: errcheck
+	}
+}
+
+// append spills `msg` and returns true on success
+func (s *spillFile) append(msg []byte) bool {
+	if s == nil {
+		return false
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.f == nil {
+		return false
+	}
+	rec := make([]byte, spillHeaderLen+len(msg))
+	if s.size+int64(len(rec)) > s.maxBytes {
+		return false
+	}
+	binary.BigEndian.PutUint32(rec, uint32(len(msg)))
+	copy(rec[spillHeaderLen:], msg)
+	if _, err := s.f.WriteAt(rec, s.size); err != nil {
+		return false
+	}
+	s.size += int64(len(rec))
+	return true
+}
+
+// pending returns true if there are spilled messages which were not replayed yet
+func (s *spillFile) pending() bool {
+	if s == nil {
+		return false
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.f != nil && s.offset < s.size
+}
+
+// next returns the next message to replay without consuming it, call `commit` once it was delivered. It returns nil
+// if there is nothing left to replay.
+func (s *spillFile) next() []byte {
+	if s == nil {
+		return nil
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.f == nil {
+		return nil
+	}
+	if s.offset >= s.size {
+		s.reset()
+		return nil
+	}
+	hdr := make([]byte, spillHeaderLen)
+	if _, err := s.f.ReadAt(hdr, s.offset); err != nil {
+		s.reset()
+		return nil
+	}
+	n := int64(binary.BigEndian.Uint32(hdr))
+	if s.offset+spillHeaderLen+n > s.size {
+		// a truncated message, probably from a writer which got killed in between
+		s.reset()
+		return nil
+	}
+	msg := make([]byte, n)
+	if _, err := s.f.ReadAt(msg, s.offset+spillHeaderLen); err != nil {
+		s.reset()
+		return nil
+	}
+	return msg
+}
+
+// commit consumes `msg` which must be the message which was returned by the last call to `next`
+func (s *spillFile) commit(msg []byte) {
+	if s == nil {
+		return
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.f == nil {
+		return
+	}
+	s.offset += spillHeaderLen + int64(len(msg))
+	if s.offset >= s.size {
+		s.reset()
+	}
+}
+
+// reset truncates the spill file once everything was replayed, the lock must be held
+func (s *spillFile) reset() {
+	if err := s.f.Truncate(0); err != nil {
+		// keep appending to the end rather than overwriting messages which we could not get rid of
+		s.offset = s.size
+		return
+	}
+	s.size = 0
+	s.offset = 0
+}
@@ -0,0 +1,206 @@
+// Copyright 2023 Hedgehog
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package syslog
+
+import (
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+func Test_spillFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.spill")
+	s := &spillFile{path: path, maxBytes: 2 * (spillHeaderLen + 3)}
+	if err := s.open(); err != nil {
+		t.Fatalf("open() error = %v", err)
+	}
+	for _, msg := range []string{"one", "two"} {
+		if !s.append([]byte(msg)) {
+			t.Fatalf("append(%q) = false, want true", msg)
+		}
+	}
+	if s.append([]byte("three")) {
+		t.Errorf("append() beyond maxBytes = true, want false")
+	}
+
+	// a new spill file with the same path picks up what was left behind
+	if got := string(s.next()); got != "one" {
+		t.Fatalf("next() = %q, want %q", got, "one")
+	}
+	s.commit([]byte("one"))
+	s.close()
+	s = &spillFile{path: path, maxBytes: DefaultSpillMaxBytes}
+	if err := s.open(); err != nil {
+		t.Fatalf("open() error = %v", err)
+	}
+	var got []string
+	for msg := s.next(); msg != nil; msg = s.next() {
+		got = append(got, string(msg))
+		s.commit(msg)
+	}
+	if want := []string{"one", "two"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("replayed = %v, want %v", got, want)
+	}
+	if s.pending() {
+		t.Errorf("pending() = true after replay, want false")
+	}
+	s.close()
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("spill file must be removed when everything was replayed, stat error = %v", err)
+	}
+
+	// a nil spill file means spilling is disabled
+	var disabled *spillFile
+	if disabled.append([]byte("msg")) || disabled.pending() || disabled.next() != nil {
+		t.Errorf("nil spill file must not accept messages")
+	}
+}
+
+func Test_spillFileTruncated(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.spill")
+	if err := os.WriteFile(path, []byte{0, 0, 0, 10, 'a', 'b'}, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	s := &spillFile{path: path, maxBytes: DefaultSpillMaxBytes}
+	if err := s.open(); err != nil {
+		t.Fatalf("open() error = %v", err)
+	}
+	defer s.close()
+	if msg := s.next(); msg != nil {
+		t.Errorf("next() = %q, want nil", msg)
+	}
+	if !s.append([]byte("msg")) {
+		t.Fatalf("append() = false, want true")
+	}
+	if got := string(s.next()); got != "msg" {
+		t.Errorf("next() = %q, want %q", got, "msg")
+	}
+}
+
+// pipeConnect returns a connect function which fails until `allow` is being closed, and which delivers all
+// messages which are being written to the returned connections to `ch`
+func pipeConnect(allow <-chan struct{}, ch chan<- string) ConnectFunc {
+	return func(ctx context.Context, connTimeout time.Duration, addr string, internalLogger *zap.Logger) net.Conn {
+		select {
+		case <-allow:
+		default:
+			return nil
+		}
+		client, server := net.Pipe()
+		go func() {
+			defer server.Close()
+			buf := make([]byte, 4096)
+			for {
+				n, err := server.Read(buf)
+				if err != nil {
+					return
+				}
+				ch <- string(buf[:n])
+			}
+		}()
+		return client
+	}
+}
+
+func receive(t *testing.T, ch <-chan string, n int) []string {
+	t.Helper()
+	var ret []string
+	for len(ret) < n {
+		select {
+		case msg := <-ch:
+			ret = append(ret, msg)
+		case <-time.After(time.Second * 5):
+			t.Fatalf("received %v, but expected %d messages", ret, n)
+		}
+	}
+	return ret
+}
+
+func TestWriter_Spill(t *testing.T) {
+	msgs := []string{"one", "two", "three", "four", "five"}
+	tests := []struct {
+		name        string
+		opts        []WriterOption
+		waitState   HealthState
+		wantSpilled uint64
+	}{
+		{
+			name:        "while connecting with a full buffer",
+			opts:        []WriterOption{BufferMsgs(1), FailureThreshold(0)},
+			waitState:   HealthStateConnecting,
+			wantSpilled: 4,
+		},
+		{
+			name:        "while disabled",
+			opts:        []WriterOption{BufferMsgs(10), FailureThreshold(1), NegativeCacheTTL(time.Millisecond * 100)},
+			waitState:   HealthStateDisabled,
+			wantSpilled: 5,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			allow := make(chan struct{})
+			var allowOnce sync.Once
+			defer allowOnce.Do(func() { close(allow) })
+			ch := make(chan string, 10)
+			path := filepath.Join(t.TempDir(), "test.spill")
+
+			opts := append([]WriterOption{
+				ConnectionTimeout(time.Millisecond),
+				ConnectFunction(pipeConnect(allow, ch)),
+				Spill(path, DefaultSpillMaxBytes),
+			}, tt.opts...)
+			w := NewWriter(ctx, "pipe", opts...)
+
+			deadline := time.Now().Add(time.Second)
+			for h := w.Health(); h.State != tt.waitState || h.LastError == ""; h = w.Health() {
+				if time.Now().After(deadline) {
+					t.Fatalf("writer did not reach state %s: %#v", tt.waitState, h)
+				}
+				time.Sleep(time.Millisecond)
+			}
+
+			for _, msg := range msgs {
+				if _, err := w.Write([]byte(msg)); err != nil {
+					t.Fatalf("Writer.Write() error = %v", err)
+				}
+			}
+			if h := w.Health(); h.Spilled != tt.wantSpilled || h.Dropped != 0 {
+				t.Errorf("Health() spilled = %d, dropped = %d, want spilled = %d, dropped = 0", h.Spilled, h.Dropped, tt.wantSpilled)
+			}
+
+			// once connected, everything gets delivered in order
+			allowOnce.Do(func() { close(allow) })
+			if got := receive(t, ch, len(msgs)); !reflect.DeepEqual(got, msgs) {
+				t.Errorf("received = %v, want %v", got, msgs)
+			}
+			if err := w.Sync(); err != nil {
+				t.Errorf("Writer.Sync() error = %v", err)
+			}
+			if w.spill.pending() {
+				t.Errorf("spill file must not have pending messages after replay")
+			}
+		})
+	}
+}
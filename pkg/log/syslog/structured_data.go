@@ -0,0 +1,150 @@
+// Copyright 2023 Hedgehog
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package syslog
+
+import (
+	"fmt"
+	"strings"
+
+	"go.uber.org/zap/buffer"
+	"go.uber.org/zap/zapcore"
+)
+
+// maxSDNameLen is the maximum length of an SD-ID or a PARAM-NAME as of RFC 5424
+const maxSDNameLen = 32
+
+// StructuredDataConfig maps the fields of log entries into an RFC 5424 SD-ELEMENT, so that syslog collectors can
+// parse them without parsing the message. The mapped fields remain part of the message as well.
+type StructuredDataConfig struct {
+	// ID is the SD-ID of the element. Custom SD-IDs must have the form "name@<private enterprise number>".
+	ID string `json:"id" yaml:"id"`
+
+	// Fields are the keys of the fields which are mapped into SD-PARAMs of the element. Only the fields which are
+	// passed to a log call are mapped, and not the ones which were added to a logger with `With`.
+	Fields []string `json:"fields" yaml:"fields"`
+}
+
+// SDParam is an SD-PARAM of an SD-ELEMENT
+type SDParam struct {
+	Name  string
+	Value string
+}
+
+// sdElement is an SD-ELEMENT which is attached to a log entry with `StructuredData`
+type sdElement struct {
+	id     string
+	params []SDParam
+}
+
+// StructuredData returns a field which attaches the SD-ELEMENT `id` with `params` to the syslog message of a log
+// entry. Other encoders ignore the field. Elements with the same SD-ID are merged, as an SD-ID must not appear
+// twice in a message.
+func StructuredData(id string, params ...SDParam) zapcore.Field {
+	return zapcore.Field{
+		Key:       id,
+		Type:      zapcore.SkipType,
+		Interface: &sdElement{id: id, params: params},
+	}
+}
+
+// toSDName maps `s` to a valid SD-NAME which excludes '=', SP, ']' and '"' from the printable ASCII characters
+func toSDName(s string) string {
+	s = strings.Map(func(r rune) rune {
+		switch r {
+		case '=', ' ', ']', '"':
+			return '_'
+		default:
+			return rfc5424CompliantASCIIMapper(r)
+		}
+	}, s)
+	if len(s) > maxSDNameLen {
+		s = s[:maxSDNameLen]
+	}
+	return s
+}
+
+// sdParamValueEscaper escapes the characters which must be escaped in a PARAM-VALUE
+var sdParamValueEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, `]`, `\]`)
+
+// sdFieldValue returns the value of a zap field as it goes into a PARAM-VALUE
+func sdFieldValue(f zapcore.Field) string {
+	enc := zapcore.NewMapObjectEncoder()
+	f.AddTo(enc)
+	v, ok := enc.Fields[f.Key]
+	if !ok {
+		return ""
+	}
+	if s, ok := v.(string); ok {
+		return s
+	}
+	return fmt.Sprint(v)
+}
+
+// structuredData collects the SD-ELEMENTs for a log entry from its fields
+func (enc *syslogEncoder) structuredData(fields []zapcore.Field) []*sdElement {
+	var elements []*sdElement
+	add := func(id string, params ...SDParam) {
+		id = toSDName(id)
+		for _, el := range elements {
+			if el.id == id {
+				el.params = append(el.params, params...)
+				return
+			}
+		}
+		elements = append(elements, &sdElement{id: id, params: params})
+	}
+
+	if cfg := enc.StructuredData; cfg != nil && cfg.ID != "" {
+		var params []SDParam
+		for _, key := range cfg.Fields {
+			for _, f := range fields {
+				if f.Key == key && f.Type != zapcore.SkipType {
+					params = append(params, SDParam{Name: key, Value: sdFieldValue(f)})
+					break
+				}
+			}
+		}
+		if len(params) > 0 {
+			add(cfg.ID, params...)
+		}
+	}
+
+	for _, f := range fields {
+		if el, ok := f.Interface.(*sdElement); ok && f.Type == zapcore.SkipType {
+			add(el.id, el.params...)
+		}
+	}
+	return elements
+}
+
+// appendStructuredData appends the STRUCTURED-DATA of a syslog message, which is the NILVALUE without elements
+func appendStructuredData(buf *buffer.Buffer, elements []*sdElement) {
+	if len(elements) == 0 {
+		buf.AppendString(nilValue)
+		return
+	}
+	for _, el := range elements {
+		buf.AppendByte('[')
+		buf.AppendString(el.id)
+		for _, p := range el.params {
+			buf.AppendByte(' ')
+			buf.AppendString(toSDName(p.Name))
+			buf.AppendString(`="`)
+			buf.AppendString(sdParamValueEscaper.Replace(p.Value))
+			buf.AppendByte('"')
+		}
+		buf.AppendByte(']')
+	}
+}
@@ -0,0 +1,84 @@
+// Copyright 2023 Hedgehog
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package syslog
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+func TestSyslogEncoder_StructuredData(t *testing.T) {
+	tests := []struct {
+		name   string
+		cfg    *StructuredDataConfig
+		fields []zapcore.Field
+		want   string
+	}{
+		{
+			name:   "no structured data",
+			fields: []zapcore.Field{zap.String("device_id", "dev1")},
+			want:   " - - ",
+		},
+		{
+			name:   "mapped fields",
+			cfg:    &StructuredDataConfig{ID: "dasboot@32473", Fields: []string{"device_id", "attempt", "elapsed", "missing"}},
+			fields: []zapcore.Field{zap.String("device_id", "dev1"), zap.Int("attempt", 3), zap.Duration("elapsed", 1500*time.Millisecond)},
+			want:   ` - [dasboot@32473 device_id="dev1" attempt="3" elapsed="1.5s"] `,
+		},
+		{
+			name:   "no mapped fields present",
+			cfg:    &StructuredDataConfig{ID: "dasboot@32473", Fields: []string{"device_id"}},
+			fields: []zapcore.Field{zap.String("stage", "stage0")},
+			want:   " - - ",
+		},
+		{
+			name: "attached elements with the same SD-ID are merged",
+			cfg:  &StructuredDataConfig{ID: "dasboot@32473", Fields: []string{"device_id"}},
+			fields: []zapcore.Field{
+				zap.String("device_id", "dev1"),
+				StructuredData("dasboot@32473", SDParam{Name: "stage", Value: "stage0"}),
+				StructuredData("bad id=x", SDParam{Name: "a]b", Value: "c"}),
+			},
+			want: ` - [dasboot@32473 device_id="dev1" stage="stage0"][bad_id_x a_b="c"] `,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			enc := NewSyslogEncoder(SyslogEncoderConfig{
+				EncoderConfig:  zap.NewProductionEncoderConfig(),
+				Hostname:       "switch-01",
+				PID:            4242,
+				App:            "stage0",
+				StructuredData: tt.cfg,
+			})
+			buf, err := enc.EncodeEntry(testEntry, tt.fields)
+			if err != nil {
+				t.Fatalf("EncodeEntry() error = %v", err)
+			}
+			defer buf.Free()
+			got := buf.String()
+			if !strings.Contains(got, " 4242"+tt.want+"\xef\xbb\xbf") {
+				t.Errorf("EncodeEntry() = %q, want MSGID and STRUCTURED-DATA %q", got, tt.want)
+			}
+			if strings.Contains(got, "bad id=x") {
+				t.Errorf("EncodeEntry() = %q, structured data must not end up in the message", got)
+			}
+		})
+	}
+}
@@ -0,0 +1,212 @@
+// Copyright 2023 Hedgehog
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package syslog
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// Transport is the transport over which syslog messages are being sent to a syslog server
+type Transport string
+
+const (
+	// TransportUDP sends every message in its own UDP datagram as of RFC 5426
+	TransportUDP Transport = "udp"
+
+	// TransportTCP streams messages over TCP as of RFC 6587
+	TransportTCP Transport = "tcp"
+
+	// TransportTLS streams messages over TLS as of RFC 5425, which mandates octet-counting framing
+	TransportTLS Transport = "tcp+tls"
+
+	DefaultTransport = TransportUDP
+)
+
+var (
+	ErrInvalidTransport = errors.New("syslog: invalid transport")
+	ErrInvalidTLS       = errors.New("syslog: invalid TLS settings")
+)
+
+// ParseTransport parses a transport. An empty string returns the `DefaultTransport`.
+func ParseTransport(s string) (Transport, error) {
+	if s == "" {
+		return DefaultTransport, nil
+	}
+	switch t := Transport(strings.ToLower(s)); t {
+	case TransportUDP, TransportTCP, TransportTLS:
+		return t, nil
+	default:
+		return DefaultTransport, fmt.Errorf("%w: '%s': must be one of 'udp', 'tcp' or 'tcp+tls'", ErrInvalidTransport, s)
+	}
+}
+
+// String implements fmt.Stringer
+func (t Transport) String() string {
+	return string(t)
+}
+
+// Set sets the transport for the flag.Value interface.
+func (t *Transport) Set(s string) error {
+	v, err := ParseTransport(s)
+	if err != nil {
+		return err
+	}
+	*t = v
+	return nil
+}
+
+// Get gets the transport for the flag.Getter interface.
+func (t *Transport) Get() interface{} {
+	return *t
+}
+
+// Framing returns the framing which must be used on the transport. TLS requires octet-counting framing,
+// and all other transports use `f`.
+func (t Transport) Framing(f Framing) Framing {
+	if t == TransportTLS {
+		return OctetCountingFraming
+	}
+	return f
+}
+
+// defaultPort returns the well-known port of syslog servers for the transport
+func (t Transport) defaultPort() string {
+	if t == TransportTLS {
+		return "6514"
+	}
+	return "514"
+}
+
+// TLSSettings are the settings for the TLS transport
+type TLSSettings struct {
+	// CA is a PEM encoded bundle of CAs which the syslog server certificate is validated against. It takes
+	// precedence over `CAPath`. If neither is set, the system CAs are being used.
+	CA []byte `json:"ca,omitempty"`
+
+	// CAPath is the path to a PEM encoded bundle of CAs which the syslog server certificate is validated against
+	CAPath string `json:"ca_path,omitempty"`
+
+	// CertPath and KeyPath are the paths to the PEM encoded client certificate and key for syslog servers
+	// which require mutual TLS. They are optional.
+	CertPath string `json:"cert_path,omitempty"`
+	KeyPath  string `json:"key_path,omitempty"`
+
+	// ServerName overrides the name which the syslog server certificate is validated against. It defaults to the
+	// host name of the syslog server address.
+	ServerName string `json:"server_name,omitempty"`
+}
+
+// Config builds the TLS client configuration
+func (s *TLSSettings) Config() (*tls.Config, error) {
+	ret := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+	}
+	if s == nil {
+		return ret, nil
+	}
+	ret.ServerName = s.ServerName
+
+	ca := s.CA
+	if len(ca) == 0 && s.CAPath != "" {
+		var err error
+		ca, err = os.ReadFile(s.CAPath)
+		if err != nil {
+			return nil, fmt.Errorf("%w: reading CA: %w", ErrInvalidTLS, err)
+		}
+	}
+	if len(ca) > 0 {
+		ret.RootCAs = x509.NewCertPool()
+		if !ret.RootCAs.AppendCertsFromPEM(ca) {
+			return nil, fmt.Errorf("%w: no PEM encoded CA certificates found", ErrInvalidTLS)
+		}
+	}
+
+	if (s.CertPath == "") != (s.KeyPath == "") {
+		return nil, fmt.Errorf("%w: client certificate and key must be set together", ErrInvalidTLS)
+	}
+	if s.CertPath != "" {
+		cert, err := tls.LoadX509KeyPair(s.CertPath, s.KeyPath)
+		if err != nil {
+			return nil, fmt.Errorf("%w: loading client certificate: %w", ErrInvalidTLS, err)
+		}
+		ret.Certificates = []tls.Certificate{cert}
+	}
+	return ret, nil
+}
+
+// TransportConnect returns the connect function for the transport `t`. `tlsSettings` are only used for TLS,
+// and the files which they reference are being read right away, so that invalid settings fail early.
+func TransportConnect(t Transport, tlsSettings *TLSSettings) (ConnectFunc, error) {
+	switch t {
+	case "", TransportUDP:
+		return defaultUDPConnect, nil
+	case TransportTCP:
+		return dialConnect(TransportTCP, nil), nil
+	case TransportTLS:
+		cfg, err := tlsSettings.Config()
+		if err != nil {
+			return nil, err
+		}
+		return dialConnect(TransportTLS, cfg), nil
+	default:
+		return nil, fmt.Errorf("%w: '%s'", ErrInvalidTransport, t)
+	}
+}
+
+// dialAddress appends the default port of the transport to `addr` if it does not have a port
+func dialAddress(t Transport, addr string) string {
+	if _, _, err := net.SplitHostPort(addr); err == nil {
+		return addr
+	}
+	return net.JoinHostPort(strings.Trim(addr, "[]"), t.defaultPort())
+}
+
+// dialConnect returns a connect function for the stream transports
+func dialConnect(t Transport, tlsCfg *tls.Config) ConnectFunc {
+	return func(ctx context.Context, connTimeout time.Duration, addr string, internalLogger *zap.Logger) net.Conn {
+		if addr == "" {
+			return nil
+		}
+		subctx, cancel := context.WithTimeout(ctx, connTimeout)
+		defer cancel()
+
+		var conn net.Conn
+		var err error
+		if tlsCfg != nil {
+			d := &tls.Dialer{Config: tlsCfg}
+			conn, err = d.DialContext(subctx, "tcp", dialAddress(t, addr))
+		} else {
+			d := &net.Dialer{}
+			conn, err = d.DialContext(subctx, "tcp", dialAddress(t, addr))
+		}
+		if err != nil {
+			if internalLogger != nil {
+				internalLogger.Error("connecting to syslog server", zap.String("transport", t.String()), zap.Error(err))
+			}
+			return nil
+		}
+		return conn
+	}
+}
@@ -0,0 +1,201 @@
+// Copyright 2023 Hedgehog
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package syslog
+
+import (
+	"bufio"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+func TestParseTransport(t *testing.T) {
+	tests := []struct {
+		s       string
+		want    Transport
+		wantErr bool
+	}{
+		{s: "", want: TransportUDP},
+		{s: "udp", want: TransportUDP},
+		{s: "TCP", want: TransportTCP},
+		{s: "tcp+tls", want: TransportTLS},
+		{s: "tls", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.s, func(t *testing.T) {
+			got, err := ParseTransport(tt.s)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseTransport() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				if !errors.Is(err, ErrInvalidTransport) {
+					t.Errorf("ParseTransport() error = %v, want %v", err, ErrInvalidTransport)
+				}
+				return
+			}
+			if got != tt.want {
+				t.Errorf("ParseTransport() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_dialAddress(t *testing.T) {
+	tests := []struct {
+		transport Transport
+		addr      string
+		want      string
+	}{
+		{transport: TransportUDP, addr: "192.168.42.1", want: "192.168.42.1:514"},
+		{transport: TransportTCP, addr: "192.168.42.1:1514", want: "192.168.42.1:1514"},
+		{transport: TransportTLS, addr: "syslog.example.com", want: "syslog.example.com:6514"},
+		{transport: TransportTLS, addr: "fd00::1", want: "[fd00::1]:6514"},
+		{transport: TransportTCP, addr: "[fd00::1]", want: "[fd00::1]:514"},
+		{transport: TransportTCP, addr: "[fd00::1]:1514", want: "[fd00::1]:1514"},
+	}
+	for _, tt := range tests {
+		t.Run(string(tt.transport)+"/"+tt.addr, func(t *testing.T) {
+			if got := dialAddress(tt.transport, tt.addr); got != tt.want {
+				t.Errorf("dialAddress() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// newTestCertificate creates a self-signed certificate for localhost, and writes it as a PEM encoded file
+func newTestCertificate(t *testing.T) (tls.Certificate, string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "localhost"},
+		DNSNames:              []string{"localhost"},
+		IPAddresses:           []net.IP{net.IPv6loopback, net.IPv4(127, 0, 0, 1)},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "ca.pem")
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, path
+}
+
+func TestTransportConnect(t *testing.T) {
+	cert, caPath := newTestCertificate(t)
+	tests := []struct {
+		name        string
+		transport   Transport
+		tlsSettings *TLSSettings
+		wantErr     bool
+	}{
+		{
+			name:      "tcp",
+			transport: TransportTCP,
+		},
+		{
+			name:        "tls",
+			transport:   TransportTLS,
+			tlsSettings: &TLSSettings{CAPath: caPath},
+		},
+		{
+			name:        "tls with missing client key",
+			transport:   TransportTLS,
+			tlsSettings: &TLSSettings{CAPath: caPath, CertPath: caPath},
+			wantErr:     true,
+		},
+		{
+			name:        "tls with invalid CA",
+			transport:   TransportTLS,
+			tlsSettings: &TLSSettings{CA: []byte("not a certificate")},
+			wantErr:     true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			connect, err := TransportConnect(tt.transport, tt.tlsSettings)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("TransportConnect() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				if !errors.Is(err, ErrInvalidTLS) {
+					t.Errorf("TransportConnect() error = %v, want %v", err, ErrInvalidTLS)
+				}
+				return
+			}
+
+			var l net.Listener
+			if tt.transport == TransportTLS {
+				l, err = tls.Listen("tcp", "localhost:0", &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12})
+			} else {
+				l, err = net.Listen("tcp", "localhost:0")
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer l.Close()
+			received := make(chan string, 1)
+			go func() {
+				conn, err := l.Accept()
+				if err != nil {
+					return
+				}
+				defer conn.Close()
+				line, _ := bufio.NewReader(conn).ReadString('\n')
+				received <- line
+			}()
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			w := NewWriter(ctx, l.Addr().String(), ConnectFunction(connect), InternalLogger(zap.NewNop()))
+			if _, err := w.Write([]byte("<134>1 - - - - - - hello\n")); err != nil {
+				t.Fatalf("Write() error = %v", err)
+			}
+			select {
+			case got := <-received:
+				if got != "<134>1 - - - - - - hello\n" {
+					t.Errorf("received %q", got)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatalf("message not received over %s", tt.transport)
+			}
+		})
+	}
+}
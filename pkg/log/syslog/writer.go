@@ -19,7 +19,6 @@ import (
 	"errors"
 	"fmt"
 	"net"
-	"strings"
 	"sync"
 	"time"
 
@@ -108,14 +107,24 @@ var _ zapcore.WriteSyncer = &Writer{}
 // speed. Note that write failures or partially written messages are *NOT* being retried, and will simply be discarded.
 // Similarly to an overflowing buffer which will fail to the zap API with an error, but it will not recover log messages
 // that have failed to being queued.
+// If the destination fails repeatedly (see `FailureThreshold`), it is being disabled for the `NegativeCacheTTL`. While
+// it is disabled, all messages are being dropped immediately so that logging never blocks or slows down the caller.
+// All of this changes with the `Spill` option: messages which would be dropped are being spilled to a file instead,
+// and they are being replayed once the writer is (re)connected.
+// Use `Health()` to check on the state of the destination.
 type Writer struct {
-	addr           string
-	connect        ConnectFunc
-	connTimeout    time.Duration
-	writeTimeout   time.Duration
-	syncTimeout    time.Duration
-	recvCh         chan []byte
-	internalLogger *zap.Logger
+	addr             string
+	connect          ConnectFunc
+	connTimeout      time.Duration
+	writeTimeout     time.Duration
+	syncTimeout      time.Duration
+	recvCh           chan []byte
+	internalLogger   *zap.Logger
+	failureThreshold int
+	negativeCacheTTL time.Duration
+	healthLock       sync.Mutex
+	health           Health
+	spill            *spillFile
 	// we're making use of a RWLock here even though this has nothing to do with ReadWrite
 	// however, the use-case fits exactly what we need a RWLock for:
 	// - multiple `Write()` calls are read locked
@@ -125,8 +134,8 @@ type Writer struct {
 
 // NewWriter returns a new network-based zap WriteSyncer for syslog messages. If a `ConnectionFunction` is missing in
 // the `options`, then this is trying to attempt to write UDP-based syslog messages to `dialAddr` which can be an IP
-// address or a hostname. If `dialAddr` is not specifying a port by separating it with a colon, then the default
-// implementation of the connect function will append `:514` to `dialAddr`.
+// address or a hostname. If `dialAddr` is not specifying a port, then the default implementation of the connect
+// function will use port 514. Use `TransportConnect` for a connect function for TCP or TLS.
 // This function cannot fail, and all retry mechanisms are internally to the writer. For example, temporary write
 // failures will try to reestablish a new connection to the same `dialAddr`. See the documentation for `Writer` on
 // message delivery guarantees (which are essentially not in place on purpose).
@@ -138,6 +147,11 @@ func NewWriter(ctx context.Context, dialAddr string, options ...WriterOption) *W
 		connTimeout:  DefaultConnectionTimeout,
 		writeTimeout: DefaultWriteTimeout,
 		syncTimeout:  DefaultSyncTimeout,
+		health: Health{
+			State: HealthStateConnecting,
+		},
+		failureThreshold: DefaultFailureThreshold,
+		negativeCacheTTL: DefaultNegativeCacheTTL,
 	}
 
 	// apply options
@@ -145,6 +159,16 @@ func NewWriter(ctx context.Context, dialAddr string, options ...WriterOption) *W
 		opt(ret)
 	}
 
+	// not being able to spill is no reason to fail, we simply drop messages as usual then
+	if ret.spill != nil {
+		if err := ret.spill.open(); err != nil {
+			if ret.internalLogger != nil {
+				ret.internalLogger.Warn("Opening syslog spill file failed, messages are going to be dropped instead", zap.String("path", ret.spill.path), zap.Error(err))
+			}
+			ret.spill = nil
+		}
+	}
+
 	// start the processor
 	go ret.loop(ctx)
 
@@ -161,6 +185,12 @@ func (w *Writer) Write(p []byte) (n int, err error) {
 		}
 	}()
 
+	// fail fast if the destination is disabled
+	if w.state() == HealthStateDisabled {
+		w.spillOrDrop(p)
+		return len(p), nil
+	}
+
 	// we need to copy out the message
 	// as the same pointer is being reused by zap
 	// this is the only way to really preserve the message
@@ -168,14 +198,33 @@ func (w *Writer) Write(p []byte) (n int, err error) {
 	send := make([]byte, len(p))
 	copy(send, p)
 
+	// as long as there are spilled messages, new messages must queue up behind them
+	if w.spill.pending() && w.spill.append(send) {
+		w.recordSpilled(1)
+		return len(send), nil
+	}
+
 	select {
 	case w.recvCh <- send:
 		return len(send), nil
 	default:
+		if w.spill.append(send) {
+			w.recordSpilled(1)
+			return len(send), nil
+		}
 		return 0, ErrBufferFull
 	}
 }
 
+// spillOrDrop spills `msg` if spilling is enabled, and drops it otherwise
+func (w *Writer) spillOrDrop(msg []byte) {
+	if w.spill.append(msg) {
+		w.recordSpilled(1)
+		return
+	}
+	w.recordDropped(1)
+}
+
 const syncPollTimeout = time.Millisecond * 10
 
 // Sync implements zapcore.WriteSyncer
@@ -184,7 +233,13 @@ func (w *Writer) Sync() error {
 	defer w.syncLock.Unlock()
 
 	// short circuit if really nothing needs to happen
-	if len(w.recvCh) == 0 {
+	if len(w.recvCh) == 0 && !w.spill.pending() {
+		return nil
+	}
+
+	// we are not going to wait for a destination which is disabled
+	// as all queued messages are being dropped or spilled anyways
+	if w.state() == HealthStateDisabled {
 		return nil
 	}
 
@@ -201,7 +256,7 @@ func (w *Writer) Sync() error {
 		case <-ch:
 			return ErrSyncTimeout
 		case <-time.After(syncPollTimeout):
-			if len(w.recvCh) == 0 {
+			if len(w.recvCh) == 0 && !w.spill.pending() {
 				return nil
 			}
 		}
@@ -212,6 +267,7 @@ func (w *Writer) loop(ctx context.Context) {
 	defer func() {
 		w.syncLock.Lock()
 		close(w.recvCh)
+		w.spill.close()
 		w.syncLock.Unlock()
 	}()
 
@@ -235,8 +291,13 @@ func (w *Writer) loop(ctx context.Context) {
 				beforeConnect := time.Now()
 				conn = w.connect(ctx, w.connTimeout, w.addr, w.internalLogger)
 				if conn != nil {
+					w.recordSuccess()
 					break connectLoop
 				}
+				if until := w.recordFailure("connecting to syslog server failed"); !until.IsZero() {
+					w.disable(ctx, until)
+					continue
+				}
 
 				// if the connect call returned faster (probably unrelated to a timeout)
 				// then we wait for the rest of the time before we try again
@@ -249,48 +310,100 @@ func (w *Writer) loop(ctx context.Context) {
 		// once connected, enter the write loop
 	writeLoop:
 		for {
+			// queued messages go first: new messages are being spilled for as long as
+			// there are spilled messages, so all queued messages are older than those
+			var msg []byte
+			var replay bool
 			select {
 			case <-ctx.Done():
 				return
-			case msg := <-w.recvCh:
-				if err := conn.SetWriteDeadline(time.Now().Add(w.writeTimeout)); err != nil && w.internalLogger != nil {
-					w.internalLogger.Debug("failed to set write deadline for write to syslog server", zap.Error(err))
+			case msg = <-w.recvCh:
+			default:
+				if msg = w.spill.next(); msg != nil {
+					replay = true
+					break
 				}
-				n, err := conn.Write(msg)
-				if err != nil {
-					if w.internalLogger != nil {
-						w.internalLogger.Error("writing to syslog server", zap.Error(err))
-					}
-					// we're treating any write errors
-					// as reconnection events
-					conn.Close()
-					conn = nil
-					break writeLoop
+				select {
+				case <-ctx.Done():
+					return
+				case msg = <-w.recvCh:
 				}
-				if n != len(msg) && w.internalLogger != nil {
-					w.internalLogger.Warn("len(written) != len(msg)", zap.Int("msgLen", len(msg)), zap.Int("written", n))
+			}
+
+			if err := w.write(conn, msg); err != nil {
+				// we're treating any write errors
+				// as reconnection events
+				conn.Close()
+				conn = nil
+				// a replayed message simply remains in the spill file
+				if !replay {
+					w.spillOrDrop(msg)
+				}
+				if until := w.recordFailure(err.Error()); !until.IsZero() {
+					w.disable(ctx, until)
 				}
+				break writeLoop
+			}
+			if replay {
+				w.spill.commit(msg)
 			}
 		}
 	}
 }
 
+func (w *Writer) write(conn net.Conn, msg []byte) error {
+	if err := conn.SetWriteDeadline(time.Now().Add(w.writeTimeout)); err != nil && w.internalLogger != nil {
+		w.internalLogger.Debug("failed to set write deadline for write to syslog server", zap.Error(err))
+	}
+	n, err := conn.Write(msg)
+	if err != nil {
+		if w.internalLogger != nil {
+			w.internalLogger.Error("writing to syslog server", zap.Error(err))
+		}
+		return err
+	}
+	if n != len(msg) && w.internalLogger != nil {
+		w.internalLogger.Warn("len(written) != len(msg)", zap.Int("msgLen", len(msg)), zap.Int("written", n))
+	}
+	return nil
+}
+
+// disable drops (or spills) all queued messages until the negative cache TTL expired at `until`
+func (w *Writer) disable(ctx context.Context, until time.Time) {
+	h := w.Health()
+	if w.internalLogger != nil {
+		w.internalLogger.Warn("Syslog server is failing, disabling it temporarily", zap.String("addr", w.addr), zap.Int("failures", h.ConsecutiveFailures), zap.String("lastError", h.LastError), zap.Time("until", until))
+	}
+	t := time.NewTimer(time.Until(until))
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case msg := <-w.recvCh:
+			w.spillOrDrop(msg)
+		case <-t.C:
+			w.recordRetry()
+			return
+		}
+	}
+}
+
 func defaultUDPConnect(ctx context.Context, connTimeout time.Duration, addr string, internalLogger *zap.Logger) net.Conn {
 	// check the address
 	// if it doesn't has a port, we'll add the default UDP port
 	if addr == "" {
 		return nil
 	}
-	dialAddr := addr
-	if !strings.Contains(addr, ":") {
-		dialAddr = addr + ":514"
-	}
 	d := &net.Dialer{}
 	subctx, cancel := context.WithTimeout(ctx, connTimeout)
 	defer cancel()
-	conn, err := d.DialContext(subctx, "udp", dialAddr)
-	if err != nil && internalLogger != nil {
-		internalLogger.Error("connecting to syslog server", zap.Error(err))
+	conn, err := d.DialContext(subctx, "udp", dialAddress(TransportUDP, addr))
+	if err != nil {
+		if internalLogger != nil {
+			internalLogger.Error("connecting to syslog server", zap.Error(err))
+		}
+		return nil
 	}
 	return conn
 }
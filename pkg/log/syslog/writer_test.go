@@ -353,3 +353,59 @@ func TestWriter_Sync(t *testing.T) {
 		})
 	}
 }
+
+func TestWriter_NegativeCache(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var connects int
+	var connectsLock sync.Mutex
+	w := NewWriter(ctx, "unreachable",
+		BufferMsgs(2),
+		ConnectionTimeout(time.Millisecond),
+		FailureThreshold(2),
+		NegativeCacheTTL(time.Hour),
+		ConnectFunction(func(ctx context.Context, connTimeout time.Duration, addr string, internalLogger *zap.Logger) net.Conn {
+			connectsLock.Lock()
+			defer connectsLock.Unlock()
+			connects++
+			// never connect
+			return nil
+		}),
+	)
+
+	// wait for the destination to become disabled
+	deadline := time.Now().Add(time.Second)
+	for w.Health().State != HealthStateDisabled {
+		if time.Now().After(deadline) {
+			t.Fatalf("writer did not get disabled: %#v", w.Health())
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	// writes must neither fail nor block, even though they overflow the buffer
+	for i := 0; i < 5; i++ {
+		if _, err := w.Write([]byte("msg")); err != nil {
+			t.Fatalf("Writer.Write() error = %v", err)
+		}
+	}
+	if err := w.Sync(); err != nil {
+		t.Fatalf("Writer.Sync() error = %v", err)
+	}
+
+	h := w.Health()
+	if !h.Degraded() {
+		t.Errorf("Health().Degraded() = false, want true")
+	}
+	if h.Dropped != 5 {
+		t.Errorf("Health().Dropped = %d, want 5", h.Dropped)
+	}
+	if h.Addr != "unreachable" || h.ConsecutiveFailures != 2 || h.DisabledUntil.IsZero() {
+		t.Errorf("unexpected health: %#v", h)
+	}
+	connectsLock.Lock()
+	defer connectsLock.Unlock()
+	if connects != 2 {
+		t.Errorf("connects = %d, want 2", connects)
+	}
+}
@@ -0,0 +1,159 @@
+// Copyright 2023 Hedgehog
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package log
+
+import (
+	"errors"
+
+	"go.uber.org/zap/zapcore"
+)
+
+type teeLogger []Interface
+
+var _ Interface = teeLogger{}
+
+// Tee returns a logger which writes every message to all `loggers`.
+func Tee(loggers ...Interface) Interface {
+	return teeLogger(loggers)
+}
+
+// DPanic implements Interface
+func (t teeLogger) DPanic(msg string, fields ...zapcore.Field) {
+	for _, l := range t {
+		l.DPanic(msg, fields...)
+	}
+}
+
+// DPanicf implements Interface
+func (t teeLogger) DPanicf(template string, args ...interface{}) {
+	for _, l := range t {
+		l.DPanicf(template, args...)
+	}
+}
+
+// Debug implements Interface
+func (t teeLogger) Debug(msg string, fields ...zapcore.Field) {
+	for _, l := range t {
+		l.Debug(msg, fields...)
+	}
+}
+
+// Debugf implements Interface
+func (t teeLogger) Debugf(template string, args ...interface{}) {
+	for _, l := range t {
+		l.Debugf(template, args...)
+	}
+}
+
+// Error implements Interface
+func (t teeLogger) Error(msg string, fields ...zapcore.Field) {
+	for _, l := range t {
+		l.Error(msg, fields...)
+	}
+}
+
+// Errorf implements Interface
+func (t teeLogger) Errorf(template string, args ...interface{}) {
+	for _, l := range t {
+		l.Errorf(template, args...)
+	}
+}
+
+// Fatal implements Interface
+func (t teeLogger) Fatal(msg string, fields ...zapcore.Field) {
+	// all but the last logger must not exit the process
+	for i, l := range t {
+		if i == len(t)-1 {
+			l.Fatal(msg, fields...)
+		} else {
+			l.Error(msg, fields...)
+			_ = l.Sync()
+		}
+	}
+}
+
+// Fatalf implements Interface
+func (t teeLogger) Fatalf(template string, args ...interface{}) {
+	for i, l := range t {
+		if i == len(t)-1 {
+			l.Fatalf(template, args...)
+		} else {
+			l.Errorf(template, args...)
+			_ = l.Sync()
+		}
+	}
+}
+
+// Info implements Interface
+func (t teeLogger) Info(msg string, fields ...zapcore.Field) {
+	for _, l := range t {
+		l.Info(msg, fields...)
+	}
+}
+
+// Infof implements Interface
+func (t teeLogger) Infof(template string, args ...interface{}) {
+	for _, l := range t {
+		l.Infof(template, args...)
+	}
+}
+
+// Panic implements Interface
+func (t teeLogger) Panic(msg string, fields ...zapcore.Field) {
+	// all but the last logger must not panic
+	for i, l := range t {
+		if i == len(t)-1 {
+			l.Panic(msg, fields...)
+		} else {
+			l.Error(msg, fields...)
+		}
+	}
+}
+
+// Panicf implements Interface
+func (t teeLogger) Panicf(template string, args ...interface{}) {
+	for i, l := range t {
+		if i == len(t)-1 {
+			l.Panicf(template, args...)
+		} else {
+			l.Errorf(template, args...)
+		}
+	}
+}
+
+// Warn implements Interface
+func (t teeLogger) Warn(msg string, fields ...zapcore.Field) {
+	for _, l := range t {
+		l.Warn(msg, fields...)
+	}
+}
+
+// Warnf implements Interface
+func (t teeLogger) Warnf(template string, args ...interface{}) {
+	for _, l := range t {
+		l.Warnf(template, args...)
+	}
+}
+
+// Sync implements Interface
+func (t teeLogger) Sync() error {
+	var errs []error
+	for _, l := range t {
+		if err := l.Sync(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,354 @@
+// Copyright 2023 Hedgehog
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package net
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+var (
+	ErrDHCPNoLease   = errors.New("net: dhcp: no lease")
+	ErrDHCPMalformed = errors.New("net: dhcp: malformed message")
+)
+
+// dhcpRetransmit is the time after which a DHCP message is being sent again if there was no answer.
+// It can be swapped out for testing.
+var dhcpRetransmit = 4 * time.Second
+
+// dhcpMaxNAKs is the number of times we start over after a server declined our request
+const dhcpMaxNAKs = 3
+
+const (
+	dhcpServerPort = 67
+	dhcpClientPort = 68
+
+	dhcpOpRequest = 1
+	dhcpOpReply   = 2
+
+	dhcpHeaderLen = 236
+	// dhcpFlagBroadcast asks the server to broadcast its replies, as we cannot receive unicasts
+	// to an address which is not configured yet
+	dhcpFlagBroadcast = 0x8000
+)
+
+var dhcpMagicCookie = []byte{99, 130, 83, 99}
+
+// DHCP message types
+const (
+	dhcpDiscover = 1
+	dhcpOffer    = 2
+	dhcpRequest  = 3
+	dhcpAck      = 5
+	dhcpNak      = 6
+)
+
+// DHCP options
+const (
+	dhcpOptPad           = 0
+	dhcpOptSubnetMask    = 1
+	dhcpOptRouter        = 3
+	dhcpOptDNSServers    = 6
+	dhcpOptLogServers    = 7
+	dhcpOptDomainName    = 15
+	dhcpOptMTU           = 26
+	dhcpOptNTPServers    = 42
+	dhcpOptRequestedIP   = 50
+	dhcpOptLeaseTime     = 51
+	dhcpOptMessageType   = 53
+	dhcpOptServerID      = 54
+	dhcpOptParamRequest  = 55
+	dhcpOptMaxMessageLen = 57
+	dhcpOptClientID      = 61
+	dhcpOptEnd           = 255
+)
+
+// DHCPv4Lease is the network configuration which a DHCPv4 server acknowledged
+type DHCPv4Lease struct {
+	// Address is the IP address with its netmask
+	Address *net.IPNet
+
+	// Router is the default gateway, it is nil if the server did not send one
+	Router net.IP
+
+	// ServerID is the address of the DHCP server which acknowledged the lease
+	ServerID net.IP
+
+	// LeaseTime is the time for which the address is leased to us
+	LeaseTime time.Duration
+
+	// MTU is the MTU of the interface, or 0 if the server did not send one
+	MTU int
+
+	// DNSServers, NTPServers and LogServers are the respective servers as the server sent them
+	DNSServers []net.IP
+	NTPServers []net.IP
+	LogServers []net.IP
+
+	// DomainName is the domain name of the network, it is empty if the server did not send one
+	DomainName string
+}
+
+// RequestDHCPv4Lease requests a lease from a DHCPv4 server over the network interface `device`. The interface is
+// being set up first, but the lease is not being configured on it. Messages are being sent again until `ctx` expires.
+func RequestDHCPv4Lease(ctx context.Context, device string) (*DHCPv4Lease, error) {
+	link, err := netlink.LinkByName(device)
+	if err != nil {
+		return nil, fmt.Errorf("netlink: link by name: %w", err)
+	}
+	if err := netlink.LinkSetUp(link); err != nil {
+		return nil, fmt.Errorf("netlink: link set up: %w", err)
+	}
+
+	// the socket is bound to the device, so that broadcasts go out on it and not on the interface of the default route
+	lc := net.ListenConfig{
+		Control: func(network, address string, c syscall.RawConn) error {
+			var serr error
+			if err := c.Control(func(fd uintptr) {
+				if serr = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_REUSEADDR, 1); serr != nil {
+					return
+				}
+				if serr = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_BROADCAST, 1); serr != nil {
+					return
+				}
+				serr = unix.BindToDevice(int(fd), device)
+			}); err != nil {
+				return err
+			}
+			return serr
+		},
+	}
+	conn, err := lc.ListenPacket(ctx, "udp4", fmt.Sprintf(":%d", dhcpClientPort))
+	if err != nil {
+		return nil, fmt.Errorf("net: dhcp: listen: %w", err)
+	}
+	defer conn.Close()
+
+	return requestDHCPv4Lease(ctx, conn, &net.UDPAddr{IP: net.IPv4bcast, Port: dhcpServerPort}, link.Attrs().HardwareAddr)
+}
+
+// requestDHCPv4Lease runs a DHCP exchange (DISCOVER, OFFER, REQUEST, ACK) with the server at `server` over `conn`
+func requestDHCPv4Lease(ctx context.Context, conn net.PacketConn, server net.Addr, hw net.HardwareAddr) (*DHCPv4Lease, error) {
+	for naks := 0; ; naks++ {
+		xid, err := dhcpXID()
+		if err != nil {
+			return nil, err
+		}
+		offer, err := dhcpExchange(ctx, conn, server, newDHCPMessage(dhcpDiscover, xid, hw, nil, nil), xid, hw)
+		if err != nil {
+			return nil, fmt.Errorf("%w: discover: %w", ErrDHCPNoLease, err)
+		}
+		if offer.messageType() != dhcpOffer {
+			continue
+		}
+		serverID := offer.ipOption(dhcpOptServerID)
+		ack, err := dhcpExchange(ctx, conn, server, newDHCPMessage(dhcpRequest, xid, hw, offer.yiaddr, serverID), xid, hw)
+		if err != nil {
+			return nil, fmt.Errorf("%w: request: %w", ErrDHCPNoLease, err)
+		}
+		if ack.messageType() == dhcpAck {
+			return ack.lease()
+		}
+		// the server declined our request, most likely because the offered address was taken in the meantime
+		if naks+1 >= dhcpMaxNAKs {
+			return nil, fmt.Errorf("%w: server declined request %d times", ErrDHCPNoLease, naks+1)
+		}
+	}
+}
+
+// dhcpExchange sends `req` until it gets a reply for transaction `xid`, or until `ctx` expires
+func dhcpExchange(ctx context.Context, conn net.PacketConn, server net.Addr, req []byte, xid uint32, hw net.HardwareAddr) (*dhcpMessage, error) {
+	buf := make([]byte, 1500)
+	for {
+		if _, err := conn.WriteTo(req, server); err != nil {
+			return nil, err
+		}
+		deadline := time.Now().Add(dhcpRetransmit)
+		if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+			deadline = d
+		}
+		if err := conn.SetReadDeadline(deadline); err != nil {
+			return nil, err
+		}
+		for {
+			n, _, err := conn.ReadFrom(buf)
+			if err != nil {
+				var nerr net.Error
+				if errors.As(err, &nerr) && nerr.Timeout() {
+					break
+				}
+				return nil, err
+			}
+			m, err := parseDHCPMessage(buf[:n])
+			if err != nil {
+				continue
+			}
+			// other clients on the same network get their replies broadcasted as well
+			if m.op != dhcpOpReply || m.xid != xid || !bytes.Equal(m.chaddr, hw) {
+				continue
+			}
+			switch m.messageType() {
+			case dhcpOffer, dhcpAck, dhcpNak:
+				return m, nil
+			}
+		}
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+	}
+}
+
+func dhcpXID() (uint32, error) {
+	var b [4]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return 0, fmt.Errorf("net: dhcp: transaction ID: %w", err)
+	}
+	return binary.BigEndian.Uint32(b[:]), nil
+}
+
+// newDHCPMessage builds a DISCOVER or REQUEST message. `requested` and `serverID` are only set for requests.
+func newDHCPMessage(typ byte, xid uint32, hw net.HardwareAddr, requested net.IP, serverID net.IP) []byte {
+	b := make([]byte, dhcpHeaderLen, 300)
+	b[0] = dhcpOpRequest
+	b[1] = 1 // ethernet
+	b[2] = byte(len(hw))
+	binary.BigEndian.PutUint32(b[4:8], xid)
+	binary.BigEndian.PutUint16(b[10:12], dhcpFlagBroadcast)
+	copy(b[28:44], hw)
+	b = append(b, dhcpMagicCookie...)
+	b = append(b, dhcpOptMessageType, 1, typ)
+	b = append(b, dhcpOptClientID, byte(len(hw)+1), 1)
+	b = append(b, hw...)
+	if ip := requested.To4(); ip != nil {
+		b = append(b, dhcpOptRequestedIP, 4)
+		b = append(b, ip...)
+	}
+	if ip := serverID.To4(); ip != nil {
+		b = append(b, dhcpOptServerID, 4)
+		b = append(b, ip...)
+	}
+	params := []byte{dhcpOptSubnetMask, dhcpOptRouter, dhcpOptDNSServers, dhcpOptLogServers, dhcpOptDomainName, dhcpOptMTU, dhcpOptNTPServers, dhcpOptLeaseTime, dhcpOptServerID}
+	b = append(b, dhcpOptParamRequest, byte(len(params)))
+	b = append(b, params...)
+	b = append(b, dhcpOptMaxMessageLen, 2, 0x05, 0xdc)
+	b = append(b, dhcpOptEnd)
+	return b
+}
+
+// dhcpMessage is a parsed DHCP message with the fields that we care about
+type dhcpMessage struct {
+	op      byte
+	xid     uint32
+	yiaddr  net.IP
+	chaddr  net.HardwareAddr
+	options map[byte][]byte
+}
+
+func parseDHCPMessage(b []byte) (*dhcpMessage, error) {
+	if len(b) < dhcpHeaderLen+len(dhcpMagicCookie) || !bytes.Equal(b[dhcpHeaderLen:dhcpHeaderLen+len(dhcpMagicCookie)], dhcpMagicCookie) {
+		return nil, fmt.Errorf("%w: too short or no magic cookie", ErrDHCPMalformed)
+	}
+	hlen := int(b[2])
+	if hlen > 16 {
+		return nil, fmt.Errorf("%w: hardware address length %d", ErrDHCPMalformed, hlen)
+	}
+	m := &dhcpMessage{
+		op:      b[0],
+		xid:     binary.BigEndian.Uint32(b[4:8]),
+		yiaddr:  net.IP(append([]byte(nil), b[16:20]...)),
+		chaddr:  net.HardwareAddr(append([]byte(nil), b[28:28+hlen]...)),
+		options: make(map[byte][]byte),
+	}
+	opts := b[dhcpHeaderLen+len(dhcpMagicCookie):]
+	for len(opts) > 0 {
+		code := opts[0]
+		if code == dhcpOptEnd {
+			break
+		}
+		if code == dhcpOptPad {
+			opts = opts[1:]
+			continue
+		}
+		if len(opts) < 2 || len(opts) < 2+int(opts[1]) {
+			return nil, fmt.Errorf("%w: option %d is truncated", ErrDHCPMalformed, code)
+		}
+		// options which are split up are being concatenated (RFC 3396)
+		m.options[code] = append(m.options[code], opts[2:2+int(opts[1])]...)
+		opts = opts[2+int(opts[1]):]
+	}
+	return m, nil
+}
+
+func (m *dhcpMessage) messageType() byte {
+	if v := m.options[dhcpOptMessageType]; len(v) == 1 {
+		return v[0]
+	}
+	return 0
+}
+
+func (m *dhcpMessage) ipOption(code byte) net.IP {
+	if ips := m.ipsOption(code); len(ips) > 0 {
+		return ips[0]
+	}
+	return nil
+}
+
+func (m *dhcpMessage) ipsOption(code byte) []net.IP {
+	v := m.options[code]
+	var ret []net.IP
+	for len(v) >= 4 {
+		ret = append(ret, net.IPv4(v[0], v[1], v[2], v[3]).To4())
+		v = v[4:]
+	}
+	return ret
+}
+
+// lease returns the lease of an ACK message
+func (m *dhcpMessage) lease() (*DHCPv4Lease, error) {
+	if m.yiaddr.Equal(net.IPv4zero) {
+		return nil, fmt.Errorf("%w: acknowledgement without address", ErrDHCPMalformed)
+	}
+	mask := m.yiaddr.DefaultMask()
+	if v := m.options[dhcpOptSubnetMask]; len(v) == 4 {
+		mask = net.IPMask(v)
+	}
+	ret := &DHCPv4Lease{
+		Address:    &net.IPNet{IP: m.yiaddr, Mask: mask},
+		Router:     m.ipOption(dhcpOptRouter),
+		ServerID:   m.ipOption(dhcpOptServerID),
+		DNSServers: m.ipsOption(dhcpOptDNSServers),
+		NTPServers: m.ipsOption(dhcpOptNTPServers),
+		LogServers: m.ipsOption(dhcpOptLogServers),
+		DomainName: strings.TrimRight(string(m.options[dhcpOptDomainName]), "\x00"),
+	}
+	if v := m.options[dhcpOptLeaseTime]; len(v) == 4 {
+		ret.LeaseTime = time.Duration(binary.BigEndian.Uint32(v)) * time.Second
+	}
+	if v := m.options[dhcpOptMTU]; len(v) == 2 {
+		ret.MTU = int(binary.BigEndian.Uint16(v))
+	}
+	return ret, nil
+}
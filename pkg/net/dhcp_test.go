@@ -0,0 +1,202 @@
+// Copyright 2023 Hedgehog
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package net
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+// dhcpTestServer answers DHCP messages on a loopback socket. It declines the first `naks` requests, and ignores
+// the first `drop` messages altogether.
+type dhcpTestServer struct {
+	conn net.PacketConn
+	naks int
+	drop int
+}
+
+func (s *dhcpTestServer) reply(req *dhcpMessage, typ byte) []byte {
+	b := make([]byte, dhcpHeaderLen)
+	b[0] = dhcpOpReply
+	b[1] = 1
+	b[2] = byte(len(req.chaddr))
+	binary.BigEndian.PutUint32(b[4:8], req.xid)
+	copy(b[16:20], net.IPv4(192, 168, 1, 100).To4())
+	copy(b[28:44], req.chaddr)
+	b = append(b, dhcpMagicCookie...)
+	b = append(b, dhcpOptMessageType, 1, typ)
+	b = append(b, dhcpOptServerID, 4, 192, 168, 1, 1)
+	b = append(b, dhcpOptSubnetMask, 4, 255, 255, 255, 0)
+	b = append(b, dhcpOptRouter, 4, 192, 168, 1, 1)
+	b = append(b, dhcpOptDNSServers, 8, 192, 168, 1, 2, 192, 168, 1, 3)
+	b = append(b, dhcpOptNTPServers, 4, 192, 168, 1, 4)
+	b = append(b, dhcpOptLeaseTime, 4, 0, 0, 0x0e, 0x10)
+	b = append(b, dhcpOptMTU, 2, 0x05, 0xdc)
+	// split up options are concatenated
+	b = append(b, dhcpOptDomainName, 3, 'l', 'a', 'b')
+	b = append(b, dhcpOptDomainName, 4, '.', 'c', 'o', 'm')
+	return append(b, dhcpOptEnd)
+}
+
+func (s *dhcpTestServer) serve() {
+	buf := make([]byte, 1500)
+	for {
+		n, addr, err := s.conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		if s.drop > 0 {
+			s.drop--
+			continue
+		}
+		req, err := parseDHCPMessage(buf[:n])
+		if err != nil {
+			continue
+		}
+		var resp []byte
+		switch req.messageType() {
+		case dhcpDiscover:
+			resp = s.reply(req, dhcpOffer)
+		case dhcpRequest:
+			if s.naks > 0 {
+				s.naks--
+				resp = s.reply(req, dhcpNak)
+			} else {
+				resp = s.reply(req, dhcpAck)
+			}
+		}
+		// a reply of another transaction comes first which must be ignored
+		other := append([]byte(nil), resp...)
+		other[4]++
+		s.conn.WriteTo(other, addr) //nolint: errcheck
+		s.conn.WriteTo(resp, addr)  //nolint: errcheck
+	}
+}
+
+func TestRequestDHCPv4Lease(t *testing.T) {
+	old := dhcpRetransmit
+	dhcpRetransmit = 50 * time.Millisecond
+	t.Cleanup(func() { dhcpRetransmit = old })
+	hw := net.HardwareAddr{0x0c, 0x20, 0x12, 0xfe, 0x01, 0x00}
+
+	tests := []struct {
+		name    string
+		naks    int
+		drop    int
+		wantErr error
+	}{
+		{
+			name: "lease",
+		},
+		{
+			name: "retransmits lost messages",
+			drop: 2,
+		},
+		{
+			name: "starts over after a declined request",
+			naks: 1,
+		},
+		{
+			name:    "gives up after declined requests",
+			naks:    dhcpMaxNAKs,
+			wantErr: ErrDHCPNoLease,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srvConn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer srvConn.Close()
+			go (&dhcpTestServer{conn: srvConn, naks: tt.naks, drop: tt.drop}).serve()
+			conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			lease, err := requestDHCPv4Lease(ctx, conn, srvConn.LocalAddr(), hw)
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) {
+					t.Fatalf("requestDHCPv4Lease() error = %v, want %v", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("requestDHCPv4Lease() error = %v", err)
+			}
+			if got := lease.Address.String(); got != "192.168.1.100/24" {
+				t.Errorf("address = %s, want 192.168.1.100/24", got)
+			}
+			if !lease.Router.Equal(net.IPv4(192, 168, 1, 1)) || !lease.ServerID.Equal(net.IPv4(192, 168, 1, 1)) {
+				t.Errorf("router = %s, server ID = %s, want 192.168.1.1", lease.Router, lease.ServerID)
+			}
+			if len(lease.DNSServers) != 2 || len(lease.NTPServers) != 1 || len(lease.LogServers) != 0 {
+				t.Errorf("DNS servers = %v, NTP servers = %v, log servers = %v", lease.DNSServers, lease.NTPServers, lease.LogServers)
+			}
+			if lease.LeaseTime != time.Hour || lease.MTU != 1500 || lease.DomainName != "lab.com" {
+				t.Errorf("lease time = %s, MTU = %d, domain name = %q", lease.LeaseTime, lease.MTU, lease.DomainName)
+			}
+		})
+	}
+}
+
+func TestRequestDHCPv4Lease_timeout(t *testing.T) {
+	old := dhcpRetransmit
+	dhcpRetransmit = 20 * time.Millisecond
+	t.Cleanup(func() { dhcpRetransmit = old })
+
+	// nobody answers on this socket
+	srvConn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srvConn.Close()
+	conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if _, err := requestDHCPv4Lease(ctx, conn, srvConn.LocalAddr(), net.HardwareAddr{0x0c, 0x20, 0x12, 0xfe, 0x01, 0x00}); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("requestDHCPv4Lease() error = %v, want %v", err, context.DeadlineExceeded)
+	}
+}
+
+func TestParseDHCPMessage(t *testing.T) {
+	if _, err := parseDHCPMessage(make([]byte, 100)); !errors.Is(err, ErrDHCPMalformed) {
+		t.Errorf("parseDHCPMessage() error = %v, want %v", err, ErrDHCPMalformed)
+	}
+	b := newDHCPMessage(dhcpDiscover, 42, net.HardwareAddr{1, 2, 3, 4, 5, 6}, nil, nil)
+	m, err := parseDHCPMessage(b)
+	if err != nil {
+		t.Fatalf("parseDHCPMessage() error = %v", err)
+	}
+	if m.messageType() != dhcpDiscover || m.xid != 42 || m.chaddr.String() != "01:02:03:04:05:06" {
+		t.Errorf("parseDHCPMessage() = %+v", m)
+	}
+	if _, err := parseDHCPMessage(b[:len(b)-3]); !errors.Is(err, ErrDHCPMalformed) {
+		t.Errorf("parseDHCPMessage() of truncated message error = %v, want %v", err, ErrDHCPMalformed)
+	}
+}
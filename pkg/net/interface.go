@@ -22,14 +22,51 @@ import (
 	"net/netip"
 
 	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
 )
 
-var ErrNotAVlanDevice = errors.New("net: not a vlan device")
+var (
+	ErrNotAVlanDevice     = errors.New("net: not a vlan device")
+	ErrRouteAddressFamily = errors.New("net: route gateway and destination are of different address families")
+)
 
 func notAVlanDeviceError(str string) error {
 	return fmt.Errorf("%w: %s", ErrNotAVlanDevice, str)
 }
 
+// these are being replaced in tests
+var (
+	netlinkLinkByName   = netlink.LinkByName
+	netlinkLinkByIndex  = netlink.LinkByIndex
+	netlinkLinkList     = netlink.LinkList
+	netlinkLinkAdd      = netlink.LinkAdd
+	netlinkLinkDel      = netlink.LinkDel
+	netlinkLinkSetMTU   = netlink.LinkSetMTU
+	netlinkLinkSetAlias = netlink.LinkSetAlias
+	netlinkLinkSetUp    = netlink.LinkSetUp
+	netlinkAddrList     = netlink.AddrList
+	netlinkAddrAdd      = netlink.AddrAdd
+	netlinkAddrDel      = netlink.AddrDel
+	netlinkRouteAdd     = netlink.RouteAdd
+	netlinkRouteDel     = netlink.RouteDel
+)
+
+// restoreParentMTU sets the MTU of the parent interface with index `parentIndex` back to `mtu`, which is the
+// MTU that it had before `AddVLANDeviceWithIP` raised it
+func restoreParentMTU(parentIndex int, mtu int) error {
+	pl, err := netlinkLinkByIndex(parentIndex)
+	if err != nil {
+		return fmt.Errorf("netlink: link by index %d: %w", parentIndex, err)
+	}
+	if pl.Attrs().MTU == mtu {
+		return nil
+	}
+	if err := netlinkLinkSetMTU(pl, mtu); err != nil {
+		return fmt.Errorf("netlink: link set mtu %d on parent: %w", mtu, err)
+	}
+	return nil
+}
+
 // StringsToIPNets is a convenience function to convert between the two formats
 func StringsToIPNets(ipaddrs []string) ([]*net.IPNet, error) {
 	var ipnets []*net.IPNet
@@ -50,24 +87,110 @@ type Route struct {
 	Flags int
 }
 
+// netlinkAddr returns the netlink address for `ipaddrnet`. IPv6 addresses skip duplicate address detection,
+// as they would not be usable until it finished, and the seeder assigns them to this device alone.
+func netlinkAddr(ipaddrnet *net.IPNet) *netlink.Addr {
+	addr := &netlink.Addr{
+		IPNet: ipaddrnet,
+	}
+	if ipaddrnet.IP.To4() == nil {
+		addr.Flags = unix.IFA_F_NODAD
+	}
+	return addr
+}
+
+// netlinkRoutes returns the netlink routes for all destinations of `routes` over the link with index `linkIndex`.
+// The gateway of a route must be of the same address family as its destinations. It can be an IPv6 link-local
+// address, as the routes are always bound to the link.
+func netlinkRoutes(routes []*Route, linkIndex int) ([]*netlink.Route, error) {
+	var ret []*netlink.Route
+	for _, route := range routes {
+		for _, dest := range route.Dests {
+			if route.Gw != nil && (route.Gw.To4() == nil) != (dest.IP.To4() == nil) {
+				return nil, fmt.Errorf("%w: gateway %s, destination %s", ErrRouteAddressFamily, route.Gw, dest)
+			}
+			ret = append(ret, &netlink.Route{
+				Dst:       dest,
+				Gw:        route.Gw,
+				LinkIndex: linkIndex,
+				Flags:     route.Flags,
+			})
+		}
+	}
+	return ret, nil
+}
+
+type deviceOptions struct {
+	hardwareAddr net.HardwareAddr
+}
+
+// DeviceOption are additional options when creating network interfaces
+type DeviceOption func(*deviceOptions)
+
+// DeviceOptionHardwareAddr creates the network interface with the MAC address `hw`
+func DeviceOptionHardwareAddr(hw net.HardwareAddr) DeviceOption {
+	return func(o *deviceOptions) {
+		o.hardwareAddr = hw
+	}
+}
+
 // AddVLANDeviceWithIP will create a new VLAN network interface called `vlanName` with VLAN ID `vid` and add it to
 // the parent network interface `device`. It will also add all IP addresses as given with `ipaddrnets`, add the additional
-// routes in `routes`, and, last but not least, it will set the interface UP.
-func AddVLANDeviceWithIP(device string, vid uint16, vlanName string, ipaddrnets []*net.IPNet, routes []*Route) error {
-	// This is kind of desperate, but the easiest way to ensure that it's really not configured before we configure it
-	// It has the advantage though that it will also work in cases when our installer crashed before it could reset the network
-	DeleteVLANDevice(device, ipaddrnets, routes) //nolint: errcheck
+// routes in `routes`, and, last but not least, it will set the interface UP. If `mtu` is not 0, the MTU of the VLAN
+// interface will be set to `mtu`. The parent interface MTU will be raised if it is lower than `mtu`, and it is being
+// restored right away if the VLAN interface cannot be set up. Otherwise its original MTU is recorded in the alias of
+// the VLAN interface, so that `DeleteVLANDevice` or `ReconcileNetworkState` can restore it from any process.
+// Stale network state of a previous run gets cleaned up first with `ReconcileNetworkState`, and the new interface
+// is marked with `LinkAlias`.
+func AddVLANDeviceWithIP(device string, vid uint16, vlanName string, mtu int, ipaddrnets []*net.IPNet, routes []*Route, opts ...DeviceOption) (funcErr error) {
+	o := &deviceOptions{}
+	for _, opt := range opts {
+		opt(o)
+	}
+
+	if mtu != 0 {
+		if err := ValidateMTU(mtu); err != nil {
+			return err
+		}
+	}
+
+	// ensure that it's really not configured before we configure it
+	// this also covers the cases when our installer crashed before it could reset the network
+	if _, err := ReconcileNetworkState(device, vid, vlanName, ipaddrnets); err != nil {
+		return fmt.Errorf("reconciling stale network state: %w", err)
+	}
 
 	// get the parent device
-	pl, err := netlink.LinkByName(device)
+	pl, err := netlinkLinkByName(device)
 	if err != nil {
 		return fmt.Errorf("netlink: link by name: %w", err)
 	}
 
+	// a VLAN device cannot have a larger MTU than its parent
+	// we are going to restore its original MTU if anything below fails, or when the VLAN device gets deleted
+	var parentMTU int
+	if origMTU := pl.Attrs().MTU; mtu > origMTU {
+		if err := netlinkLinkSetMTU(pl, mtu); err != nil {
+			return fmt.Errorf("netlink: link set mtu %d on parent: %w", mtu, err)
+		}
+		parentMTU = origMTU
+		defer func() {
+			if funcErr != nil {
+				if err := restoreParentMTU(pl.Attrs().Index, origMTU); err != nil {
+					funcErr = fmt.Errorf("%w, %w", funcErr, err)
+				}
+			}
+		}()
+	}
+
 	// create a vlan link
 	la := netlink.NewLinkAttrs()
 	la.Name = vlanName
 	la.ParentIndex = pl.Attrs().Index
+	la.MTU = mtu
+	if len(o.hardwareAddr) > 0 {
+		la.HardwareAddr = o.hardwareAddr
+	}
 	vlan := &netlink.Vlan{
 		LinkAttrs:    la,
 		VlanId:       int(vid),
@@ -75,40 +198,37 @@ func AddVLANDeviceWithIP(device string, vid uint16, vlanName string, ipaddrnets
 	}
 
 	// add the vlan link
-	if err := netlink.LinkAdd(vlan); err != nil {
+	if err := netlinkLinkAdd(vlan); err != nil {
 		return fmt.Errorf("netlink: link add: %w", err)
 	}
 
+	// mark the link as ours, so that we can detect it as stale later, and restore the MTU of the parent
+	if err := netlinkLinkSetAlias(vlan, linkAlias(parentMTU)); err != nil {
+		return fmt.Errorf("netlink: link set alias: %w", err)
+	}
+
 	// now add the IP address
 	for _, ipaddrnet := range ipaddrnets {
-		addr := &netlink.Addr{
-			IPNet: ipaddrnet,
-		}
-		if err := netlink.AddrAdd(vlan, addr); err != nil {
+		addr := netlinkAddr(ipaddrnet)
+		if err := netlinkAddrAdd(vlan, addr); err != nil {
 			return fmt.Errorf("netlink: addr add '%s': %w", addr, err)
 		}
 	}
 
 	// set the interface up
-	if err := netlink.LinkSetUp(vlan); err != nil {
+	if err := netlinkLinkSetUp(vlan); err != nil {
 		return fmt.Errorf("netlink: link set up: %w", err)
 	}
 
 	// add subnets to be routed over same interface
 	// network needs to be up for this, so must come after we bring up the link
-	if len(routes) > 0 {
-		for _, route := range routes {
-			for _, dest := range route.Dests {
-				r := &netlink.Route{
-					Dst:       dest,
-					Gw:        route.Gw,
-					LinkIndex: vlan.Index,
-					Flags:     route.Flags,
-				}
-				if err := netlink.RouteAdd(r); err != nil {
-					return fmt.Errorf("netlink: route add '%s': %w", r, err)
-				}
-			}
+	nlroutes, err := netlinkRoutes(routes, vlan.Index)
+	if err != nil {
+		return err
+	}
+	for _, r := range nlroutes {
+		if err := netlinkRouteAdd(r); err != nil {
+			return fmt.Errorf("netlink: route add '%s': %w", r, err)
 		}
 	}
 
@@ -117,48 +237,59 @@ func AddVLANDeviceWithIP(device string, vid uint16, vlanName string, ipaddrnets
 }
 
 // ConfigureDeviceWithIP will add all IP addresses as given with `ipaddrnets`, add the additional
-// routes in `routes`, and, last but not least, it will ensure the interface is UP.
-func ConfigureDeviceWithIP(device string, ipaddrnets []*net.IPNet, routes []*Route) error {
+// routes in `routes`, and, last but not least, it will ensure the interface is UP. If `mtu` is not 0,
+// the MTU of the interface will be set to `mtu`.
+func ConfigureDeviceWithIP(device string, mtu int, ipaddrnets []*net.IPNet, routes []*Route) error {
+	if mtu != 0 {
+		if err := ValidateMTU(mtu); err != nil {
+			return err
+		}
+	}
+
 	// This is kind of desperate, but the easiest way to ensure that it's really not configured before we configure it
 	// It has the advantage though that it will also work in cases when our installer crashed before it could reset the network
 	UnconfigureDeviceWithIP(device, ipaddrnets, routes) //nolint: errcheck
 
+	// a VLAN interface which is left over from a previous run could still hold our addresses
+	if _, err := ReconcileNetworkState(device, 0, "", ipaddrnets); err != nil {
+		return fmt.Errorf("reconciling stale network state: %w", err)
+	}
+
 	// get the device
-	link, err := netlink.LinkByName(device)
+	link, err := netlinkLinkByName(device)
 	if err != nil {
 		return fmt.Errorf("netlink: link by name: %w", err)
 	}
 
+	// set the MTU if requested
+	if mtu != 0 && link.Attrs().MTU != mtu {
+		if err := netlinkLinkSetMTU(link, mtu); err != nil {
+			return fmt.Errorf("netlink: link set mtu %d: %w", mtu, err)
+		}
+	}
+
 	// now add the IP address
 	for _, ipaddrnet := range ipaddrnets {
-		addr := &netlink.Addr{
-			IPNet: ipaddrnet,
-		}
-		if err := netlink.AddrAdd(link, addr); err != nil {
+		addr := netlinkAddr(ipaddrnet)
+		if err := netlinkAddrAdd(link, addr); err != nil {
 			return fmt.Errorf("netlink: addr add '%s': %w", addr, err)
 		}
 	}
 
 	// ensure the interface is up
-	if err := netlink.LinkSetUp(link); err != nil {
+	if err := netlinkLinkSetUp(link); err != nil {
 		return fmt.Errorf("netlink: link set up: %w", err)
 	}
 
 	// add subnets to be routed over same interface
 	// network needs to be up for this, so must come after we bring up the link
-	if len(routes) > 0 {
-		for _, route := range routes {
-			for _, dest := range route.Dests {
-				r := &netlink.Route{
-					Dst:       dest,
-					Gw:        route.Gw,
-					LinkIndex: link.Attrs().Index,
-					Flags:     route.Flags,
-				}
-				if err := netlink.RouteAdd(r); err != nil {
-					return fmt.Errorf("netlink: route add '%s': %w", r, err)
-				}
-			}
+	nlroutes, err := netlinkRoutes(routes, link.Attrs().Index)
+	if err != nil {
+		return err
+	}
+	for _, r := range nlroutes {
+		if err := netlinkRouteAdd(r); err != nil {
+			return fmt.Errorf("netlink: route add '%s': %w", r, err)
 		}
 	}
 
@@ -172,7 +303,7 @@ func UnconfigureDeviceWithIP(device string, ipaddrnets []*net.IPNet, routes []*R
 	var errs []error
 
 	// get the device
-	link, err := netlink.LinkByName(device)
+	link, err := netlinkLinkByName(device)
 	if err != nil {
 		return fmt.Errorf("netlink: link by name: %w", err)
 	}
@@ -187,7 +318,7 @@ func UnconfigureDeviceWithIP(device string, ipaddrnets []*net.IPNet, routes []*R
 					LinkIndex: link.Attrs().Index,
 					Flags:     route.Flags,
 				}
-				if err := netlink.RouteDel(r); err != nil {
+				if err := netlinkRouteDel(r); err != nil {
 					errs = append(errs, fmt.Errorf("netlink: route del '%s': %w", r, err))
 				}
 			}
@@ -199,7 +330,7 @@ func UnconfigureDeviceWithIP(device string, ipaddrnets []*net.IPNet, routes []*R
 		addr := &netlink.Addr{
 			IPNet: ipaddrnet,
 		}
-		if err := netlink.AddrDel(link, addr); err != nil {
+		if err := netlinkAddrDel(link, addr); err != nil {
 			errs = append(errs, fmt.Errorf("netlink: addr del '%s': %w", addr, err))
 		}
 	}
@@ -222,10 +353,11 @@ func UnconfigureDeviceWithIP(device string, ipaddrnets []*net.IPNet, routes []*R
 // DeleteVLANDevice will delete the network interface with name `device`. The interface must exist,
 // or otherwise the function will error with a netlink error. The network interface must also be a
 // VLAN interface or otherwise the function will return an error of type `ErrNotAVlanDevice`.
-// Before it does that it will delete all associated routes though as well as IP addresses.
+// Before it does that it will delete all associated routes though as well as IP addresses. Afterwards the MTU of the
+// parent interface is being restored if `AddVLANDeviceWithIP` recorded that it had to raise it.
 func DeleteVLANDevice(device string, ipaddrnets []*net.IPNet, routes []*Route) error {
 	// get the device
-	l, err := netlink.LinkByName(device)
+	l, err := netlinkLinkByName(device)
 	if err != nil {
 		return fmt.Errorf("netlink: link by name: %w", err)
 	}
@@ -244,7 +376,7 @@ func DeleteVLANDevice(device string, ipaddrnets []*net.IPNet, routes []*Route) e
 					LinkIndex: l.Attrs().Index,
 					Flags:     route.Flags,
 				}
-				if err := netlink.RouteDel(r); err != nil {
+				if err := netlinkRouteDel(r); err != nil {
 					errs = append(errs, fmt.Errorf("netlink: route del '%s': %w", r, err))
 				}
 			}
@@ -256,14 +388,18 @@ func DeleteVLANDevice(device string, ipaddrnets []*net.IPNet, routes []*Route) e
 		addr := &netlink.Addr{
 			IPNet: ipaddrnet,
 		}
-		if err := netlink.AddrDel(l, addr); err != nil {
+		if err := netlinkAddrDel(l, addr); err != nil {
 			errs = append(errs, fmt.Errorf("netlink: addr del '%s': %w", addr, err))
 		}
 	}
 
 	// last but not least, delete the device
-	if err := netlink.LinkDel(l); err != nil {
+	if err := netlinkLinkDel(l); err != nil {
 		errs = append(errs, fmt.Errorf("netlink: link del: %w", err))
+	} else if _, parentMTU := parseLinkAlias(l.Attrs().Alias); parentMTU > 0 {
+		if err := restoreParentMTU(l.Attrs().ParentIndex, parentMTU); err != nil {
+			errs = append(errs, err)
+		}
 	}
 
 	if len(errs) > 0 {
@@ -283,7 +419,7 @@ func DeleteVLANDevice(device string, ipaddrnets []*net.IPNet, routes []*Route) e
 // GetInterfaces will return a list of interface names for all network interfaces which are "real devices".
 // Being a "real device" means that its netlink type is a "device" and its encapsulation type is "ether".
 func GetInterfaces() ([]string, error) {
-	ll, err := netlink.LinkList()
+	ll, err := netlinkLinkList()
 	if err != nil {
 		return nil, fmt.Errorf("netlink: link list: %w", err)
 	}
@@ -300,12 +436,12 @@ func GetInterfaces() ([]string, error) {
 
 // GetInterfaceAddresses returns all IP addresses for an interface.
 func GetInterfaceAddresses(device string) ([]netip.Addr, error) {
-	link, err := netlink.LinkByName(device)
+	link, err := netlinkLinkByName(device)
 	if err != nil {
 		return nil, fmt.Errorf("netlink: link by name: %w", err)
 	}
 
-	addrs, err := netlink.AddrList(link, 0)
+	addrs, err := netlinkAddrList(link, 0)
 	if err != nil {
 		return nil, fmt.Errorf("netlink: addr list for '%s': %w", device, err)
 	}
@@ -325,7 +461,7 @@ func GetInterface(name, macStr string) (string, error) {
 		return "", fmt.Errorf("net: parse mac: %w", err)
 	}
 
-	ll, err := netlink.LinkList()
+	ll, err := netlinkLinkList()
 	if err != nil {
 		return "", fmt.Errorf("netlink: link list: %w", err)
 	}
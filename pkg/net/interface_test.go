@@ -0,0 +1,284 @@
+// Copyright 2023 Hedgehog
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package net
+
+import (
+	"errors"
+	"net"
+	"slices"
+	"testing"
+
+	"github.com/vishvananda/netlink"
+)
+
+// fakeNetlink is a parent interface "eth0" which can have VLAN interfaces on top of it
+type fakeNetlink struct {
+	parent  *netlink.Device
+	links   map[string]netlink.Link
+	addrs   []netlink.Addr
+	setMTUs []int
+
+	linkAddErr  error
+	routeAddErr error
+	setMTUErr   error
+}
+
+func newFakeNetlink(t *testing.T, mtu int) *fakeNetlink {
+	la := netlink.NewLinkAttrs()
+	la.Name = "eth0"
+	la.Index = 2
+	la.MTU = mtu
+	f := &fakeNetlink{
+		parent: &netlink.Device{LinkAttrs: la},
+		links:  map[string]netlink.Link{},
+	}
+	f.links["eth0"] = f.parent
+
+	origLinkByName, origLinkByIndex, origLinkList := netlinkLinkByName, netlinkLinkByIndex, netlinkLinkList
+	origLinkAdd, origLinkDel, origLinkSetMTU, origLinkSetAlias, origLinkSetUp := netlinkLinkAdd, netlinkLinkDel, netlinkLinkSetMTU, netlinkLinkSetAlias, netlinkLinkSetUp
+	origAddrList, origAddrAdd, origAddrDel, origRouteAdd, origRouteDel := netlinkAddrList, netlinkAddrAdd, netlinkAddrDel, netlinkRouteAdd, netlinkRouteDel
+	t.Cleanup(func() {
+		netlinkLinkByName, netlinkLinkByIndex, netlinkLinkList = origLinkByName, origLinkByIndex, origLinkList
+		netlinkLinkAdd, netlinkLinkDel, netlinkLinkSetMTU, netlinkLinkSetAlias, netlinkLinkSetUp = origLinkAdd, origLinkDel, origLinkSetMTU, origLinkSetAlias, origLinkSetUp
+		netlinkAddrList, netlinkAddrAdd, netlinkAddrDel, netlinkRouteAdd, netlinkRouteDel = origAddrList, origAddrAdd, origAddrDel, origRouteAdd, origRouteDel
+	})
+
+	netlinkLinkByName = func(name string) (netlink.Link, error) {
+		link, ok := f.links[name]
+		if !ok {
+			return nil, errors.New("link not found")
+		}
+		return link, nil
+	}
+	netlinkLinkByIndex = func(index int) (netlink.Link, error) {
+		for _, link := range f.links {
+			if link.Attrs().Index == index {
+				return link, nil
+			}
+		}
+		return nil, errors.New("link not found")
+	}
+	netlinkLinkList = func() ([]netlink.Link, error) {
+		var ret []netlink.Link
+		for _, link := range f.links {
+			ret = append(ret, link)
+		}
+		slices.SortFunc(ret, func(a, b netlink.Link) int { return a.Attrs().Index - b.Attrs().Index })
+		return ret, nil
+	}
+	netlinkLinkAdd = func(link netlink.Link) error {
+		if f.linkAddErr != nil {
+			return f.linkAddErr
+		}
+		link.Attrs().Index = len(f.links) + 2
+		f.links[link.Attrs().Name] = link
+		return nil
+	}
+	netlinkLinkDel = func(link netlink.Link) error {
+		delete(f.links, link.Attrs().Name)
+		return nil
+	}
+	netlinkLinkSetMTU = func(link netlink.Link, mtu int) error {
+		if f.setMTUErr != nil {
+			return f.setMTUErr
+		}
+		if link == f.parent {
+			f.setMTUs = append(f.setMTUs, mtu)
+		}
+		link.Attrs().MTU = mtu
+		return nil
+	}
+	netlinkLinkSetAlias = func(link netlink.Link, alias string) error {
+		link.Attrs().Alias = alias
+		return nil
+	}
+	netlinkLinkSetUp = func(netlink.Link) error { return nil }
+	// only the addresses of the parent interface are tracked
+	netlinkAddrList = func(link netlink.Link, _ int) ([]netlink.Addr, error) {
+		if link != f.parent {
+			return nil, nil
+		}
+		return slices.Clone(f.addrs), nil
+	}
+	netlinkAddrAdd = func(netlink.Link, *netlink.Addr) error { return nil }
+	netlinkAddrDel = func(link netlink.Link, addr *netlink.Addr) error {
+		if link == f.parent {
+			f.addrs = slices.DeleteFunc(f.addrs, func(a netlink.Addr) bool { return a.Equal(*addr) })
+		}
+		return nil
+	}
+	netlinkRouteAdd = func(*netlink.Route) error { return f.routeAddErr }
+	netlinkRouteDel = func(*netlink.Route) error { return nil }
+	return f
+}
+
+// addVLAN adds the VLAN interface `name` with VLAN ID `vid` and alias `alias` on top of the parent interface
+func (f *fakeNetlink) addVLAN(name string, vid int, alias string) *netlink.Vlan {
+	la := netlink.NewLinkAttrs()
+	la.Name = name
+	la.Index = len(f.links) + 2
+	la.ParentIndex = f.parent.Index
+	la.Alias = alias
+	vlan := &netlink.Vlan{LinkAttrs: la, VlanId: vid}
+	f.links[name] = vlan
+	return vlan
+}
+
+func TestVLANDevice_ParentMTU(t *testing.T) {
+	ipnets := mustIPNets(t, "192.168.42.101/24")
+	routes := []*Route{
+		{
+			Dests: mustIPNets(t, "10.142.0.0/16"),
+			Gw:    net.ParseIP("192.168.42.1"),
+		},
+	}
+	tests := []struct {
+		name          string
+		parentMTU     int
+		mtu           int
+		linkAddErr    error
+		routeAddErr   error
+		wantAddErr    bool
+		wantRaisedMTU int
+		wantSetMTUs   []int
+	}{
+		{
+			name:          "jumbo VLAN raises and restores the parent MTU",
+			parentMTU:     1500,
+			mtu:           9000,
+			wantRaisedMTU: 9000,
+			wantSetMTUs:   []int{9000, 1500},
+		},
+		{
+			name:          "smaller VLAN MTU leaves the parent MTU alone",
+			parentMTU:     1500,
+			mtu:           1400,
+			wantRaisedMTU: 1500,
+		},
+		{
+			name:          "no VLAN MTU leaves the parent MTU alone",
+			parentMTU:     1500,
+			wantRaisedMTU: 1500,
+		},
+		{
+			name:        "failing to add the VLAN interface restores the parent MTU",
+			parentMTU:   1500,
+			mtu:         9000,
+			linkAddErr:  errors.New("link add failed"),
+			wantAddErr:  true,
+			wantSetMTUs: []int{9000, 1500},
+		},
+		{
+			name:        "failing to add the routes restores the parent MTU",
+			parentMTU:   1500,
+			mtu:         9000,
+			routeAddErr: errors.New("route add failed"),
+			wantAddErr:  true,
+			wantSetMTUs: []int{9000, 1500},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := newFakeNetlink(t, tt.parentMTU)
+			f.linkAddErr = tt.linkAddErr
+			f.routeAddErr = tt.routeAddErr
+
+			err := AddVLANDeviceWithIP("eth0", 42, "mgmt", tt.mtu, ipnets, routes)
+			if (err != nil) != tt.wantAddErr {
+				t.Fatalf("AddVLANDeviceWithIP() error = %v, wantErr %v", err, tt.wantAddErr)
+			}
+			if err != nil {
+				if f.parent.MTU != tt.parentMTU {
+					t.Errorf("parent MTU = %d after failed AddVLANDeviceWithIP(), want %d", f.parent.MTU, tt.parentMTU)
+				}
+			} else {
+				if f.parent.MTU != tt.wantRaisedMTU {
+					t.Errorf("parent MTU = %d after AddVLANDeviceWithIP(), want %d", f.parent.MTU, tt.wantRaisedMTU)
+				}
+				if err := DeleteVLANDevice("mgmt", ipnets, routes); err != nil {
+					t.Fatalf("DeleteVLANDevice() error = %v", err)
+				}
+				if f.parent.MTU != tt.parentMTU {
+					t.Errorf("parent MTU = %d after DeleteVLANDevice(), want %d", f.parent.MTU, tt.parentMTU)
+				}
+			}
+			if !slices.Equal(f.setMTUs, tt.wantSetMTUs) {
+				t.Errorf("parent MTU changes = %v, want %v", f.setMTUs, tt.wantSetMTUs)
+			}
+		})
+	}
+}
+
+func TestDeleteVLANDevice_ParentMTU(t *testing.T) {
+	setMTUErr := errors.New("link set mtu failed")
+	tests := []struct {
+		name        string
+		alias       string
+		setMTUErr   error
+		wantErr     error
+		wantMTU     int
+		wantSetMTUs []int
+	}{
+		{
+			name:        "recorded parent MTU gets restored by another process",
+			alias:       "dasboot parent-mtu=1500",
+			wantMTU:     1500,
+			wantSetMTUs: []int{1500},
+		},
+		{
+			name:    "no recorded parent MTU",
+			alias:   "dasboot",
+			wantMTU: 9000,
+		},
+		{
+			name:    "invalid recorded parent MTU",
+			alias:   "dasboot parent-mtu=jumbo",
+			wantMTU: 9000,
+		},
+		{
+			name:    "interface of somebody else",
+			alias:   "parent-mtu=1500",
+			wantMTU: 9000,
+		},
+		{
+			name:      "restoring the parent MTU fails",
+			alias:     "dasboot parent-mtu=1500",
+			setMTUErr: setMTUErr,
+			wantErr:   setMTUErr,
+			wantMTU:   9000,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := newFakeNetlink(t, 9000)
+			f.addVLAN("mgmt", 42, tt.alias)
+			f.setMTUErr = tt.setMTUErr
+
+			err := DeleteVLANDevice("mgmt", nil, nil)
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("DeleteVLANDevice() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if _, ok := f.links["mgmt"]; ok {
+				t.Errorf("VLAN interface 'mgmt' still exists after deletion")
+			}
+			if f.parent.MTU != tt.wantMTU {
+				t.Errorf("parent MTU = %d after DeleteVLANDevice(), want %d", f.parent.MTU, tt.wantMTU)
+			}
+			if !slices.Equal(f.setMTUs, tt.wantSetMTUs) {
+				t.Errorf("parent MTU changes = %v, want %v", f.setMTUs, tt.wantSetMTUs)
+			}
+		})
+	}
+}
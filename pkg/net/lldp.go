@@ -0,0 +1,267 @@
+// Copyright 2023 Hedgehog
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package net
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+var ErrLLDPMalformed = errors.New("net: lldp: malformed LLDPDU")
+
+const lldpEtherType = 0x88cc
+
+// lldpMulticastAddr is the "nearest bridge" group address to which LLDP agents send their LLDPDUs
+var lldpMulticastAddr = [8]byte{0x01, 0x80, 0xc2, 0x00, 0x00, 0x0e}
+
+// LLDP TLV types
+const (
+	lldpTLVEnd               = 0
+	lldpTLVChassisID         = 1
+	lldpTLVPortID            = 2
+	lldpTLVTTL               = 3
+	lldpTLVPortDescription   = 4
+	lldpTLVSystemName        = 5
+	lldpTLVSystemDescription = 6
+	lldpTLVManagementAddress = 8
+)
+
+// LLDP chassis ID and port ID subtypes which are not plain strings
+const (
+	lldpChassisIDMAC     = 4
+	lldpChassisIDNetAddr = 5
+	lldpPortIDMAC        = 3
+	lldpPortIDNetAddr    = 4
+)
+
+// LLDPNeighbor is what an LLDP agent of a neighbour told us about itself and the port we are connected to
+type LLDPNeighbor struct {
+	// Interface is the network interface on which we received the LLDPDU
+	Interface string `json:"interface"`
+
+	// ChassisID identifies the neighbour, it is usually its MAC address
+	ChassisID string `json:"chassis_id"`
+
+	// PortID identifies the port of the neighbour, it is usually its MAC address or interface name
+	PortID string `json:"port_id"`
+
+	// PortDescription is usually the interface name of the port of the neighbour
+	PortDescription string `json:"port_description,omitempty"`
+
+	// SystemName is usually the host name of the neighbour
+	SystemName string `json:"system_name,omitempty"`
+
+	// SystemDescription is usually the operating system of the neighbour
+	SystemDescription string `json:"system_description,omitempty"`
+
+	// ManagementAddresses are the IP addresses under which the neighbour can be managed
+	ManagementAddresses []string `json:"management_addresses,omitempty"`
+
+	// TTL is the number of seconds for which this information is valid
+	TTL uint16 `json:"ttl"`
+}
+
+// MatchesSystem returns true if the neighbour is the host with the name `hostname`. LLDP agents often send the
+// fully qualified domain name, so only the host part of it needs to match.
+func (n *LLDPNeighbor) MatchesSystem(hostname string) bool {
+	if n == nil || n.SystemName == "" || hostname == "" {
+		return false
+	}
+	if strings.EqualFold(n.SystemName, hostname) {
+		return true
+	}
+	host, _, _ := strings.Cut(n.SystemName, ".")
+	return strings.EqualFold(host, hostname)
+}
+
+// MatchesPort returns true if the port of the neighbour is the network interface with the name `name` or
+// the MAC address `mac`. Either of them can be empty.
+func (n *LLDPNeighbor) MatchesPort(name string, mac string) bool {
+	if n == nil {
+		return false
+	}
+	if name != "" && (n.PortID == name || n.PortDescription == name) {
+		return true
+	}
+	if mac == "" {
+		return false
+	}
+	hw, err := net.ParseMAC(mac)
+	if err != nil {
+		return false
+	}
+	portHW, err := net.ParseMAC(n.PortID)
+	return err == nil && portHW.String() == hw.String()
+}
+
+// DiscoverLLDPNeighbor waits for an LLDPDU on the network interface `device` until `ctx` expires. The interface
+// is being set up first. LLDP agents typically send their LLDPDUs every 30 seconds.
+func DiscoverLLDPNeighbor(ctx context.Context, device string) (*LLDPNeighbor, error) {
+	link, err := netlink.LinkByName(device)
+	if err != nil {
+		return nil, fmt.Errorf("netlink: link by name: %w", err)
+	}
+	if err := netlink.LinkSetUp(link); err != nil {
+		return nil, fmt.Errorf("netlink: link set up: %w", err)
+	}
+
+	// a datagram packet socket hands us the LLDPDUs without the ethernet header
+	proto := htons(lldpEtherType)
+	fd, err := unix.Socket(unix.AF_PACKET, unix.SOCK_DGRAM|unix.SOCK_NONBLOCK|unix.SOCK_CLOEXEC, int(proto))
+	if err != nil {
+		return nil, fmt.Errorf("lldp: socket: %w", err)
+	}
+	f := os.NewFile(uintptr(fd), "lldp-"+device)
+	defer f.Close()
+	if err := unix.Bind(fd, &unix.SockaddrLinklayer{Protocol: proto, Ifindex: link.Attrs().Index}); err != nil {
+		return nil, fmt.Errorf("lldp: bind: %w", err)
+	}
+	if err := unix.SetsockoptPacketMreq(fd, unix.SOL_PACKET, unix.PACKET_ADD_MEMBERSHIP, &unix.PacketMreq{
+		Ifindex: int32(link.Attrs().Index),
+		Type:    unix.PACKET_MR_MULTICAST,
+		Alen:    6,
+		Address: lldpMulticastAddr,
+	}); err != nil {
+		return nil, fmt.Errorf("lldp: add multicast membership: %w", err)
+	}
+
+	// the read deadline takes care of the context
+	stop := context.AfterFunc(ctx, func() {
+		f.SetReadDeadline(time.Now()) //nolint: errcheck
+	})
+	defer stop()
+
+	buf := make([]byte, 1500)
+	for {
+		n, err := f.Read(buf)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			return nil, fmt.Errorf("lldp: read: %w", err)
+		}
+		neighbor, err := parseLLDPDU(buf[:n])
+		if err != nil {
+			// ignore garbage, there might still be a proper LLDPDU coming
+			continue
+		}
+		neighbor.Interface = device
+		return neighbor, nil
+	}
+}
+
+func htons(v uint16) uint16 {
+	return v<<8 | v>>8
+}
+
+// parseLLDPDU parses the TLVs of an LLDPDU. It must start with the mandatory chassis ID, port ID and TTL TLVs.
+func parseLLDPDU(b []byte) (*LLDPNeighbor, error) {
+	ret := &LLDPNeighbor{}
+	for i := 0; len(b) > 0; i++ {
+		if len(b) < 2 {
+			return nil, fmt.Errorf("%w: truncated TLV header", ErrLLDPMalformed)
+		}
+		hdr := binary.BigEndian.Uint16(b[:2])
+		typ, l := byte(hdr>>9), int(hdr&0x1ff)
+		if len(b) < 2+l {
+			return nil, fmt.Errorf("%w: TLV %d of length %d is truncated", ErrLLDPMalformed, typ, l)
+		}
+		val := b[2 : 2+l]
+		b = b[2+l:]
+
+		// the first three TLVs are mandatory and in this order
+		if (i == 0 && typ != lldpTLVChassisID) || (i == 1 && typ != lldpTLVPortID) || (i == 2 && typ != lldpTLVTTL) {
+			return nil, fmt.Errorf("%w: unexpected TLV %d at position %d", ErrLLDPMalformed, typ, i)
+		}
+
+		switch typ {
+		case lldpTLVEnd:
+			return ret, nil
+		case lldpTLVChassisID:
+			if l < 2 {
+				return nil, fmt.Errorf("%w: chassis ID too short", ErrLLDPMalformed)
+			}
+			ret.ChassisID = lldpID(val[0], val[1:], lldpChassisIDMAC, lldpChassisIDNetAddr)
+		case lldpTLVPortID:
+			if l < 2 {
+				return nil, fmt.Errorf("%w: port ID too short", ErrLLDPMalformed)
+			}
+			ret.PortID = lldpID(val[0], val[1:], lldpPortIDMAC, lldpPortIDNetAddr)
+		case lldpTLVTTL:
+			if l < 2 {
+				return nil, fmt.Errorf("%w: TTL too short", ErrLLDPMalformed)
+			}
+			ret.TTL = binary.BigEndian.Uint16(val)
+		case lldpTLVPortDescription:
+			ret.PortDescription = string(val)
+		case lldpTLVSystemName:
+			ret.SystemName = string(val)
+		case lldpTLVSystemDescription:
+			ret.SystemDescription = string(val)
+		case lldpTLVManagementAddress:
+			// the address string length includes the address family byte
+			if l < 2 || int(val[0]) < 1 || l < 1+int(val[0]) {
+				return nil, fmt.Errorf("%w: management address too short", ErrLLDPMalformed)
+			}
+			if addr := lldpNetAddr(val[1 : 1+int(val[0])]); addr != "" {
+				ret.ManagementAddresses = append(ret.ManagementAddresses, addr)
+			}
+		}
+	}
+	// the end TLV is mandatory, but some agents skip it
+	if ret.ChassisID == "" || ret.PortID == "" {
+		return nil, fmt.Errorf("%w: missing mandatory TLVs", ErrLLDPMalformed)
+	}
+	return ret, nil
+}
+
+// lldpID formats a chassis or port ID depending on its subtype: MAC and network addresses are binary,
+// and all others are strings
+func lldpID(subtype byte, val []byte, macSubtype byte, netAddrSubtype byte) string {
+	switch subtype {
+	case macSubtype:
+		if len(val) == 6 {
+			return net.HardwareAddr(val).String()
+		}
+	case netAddrSubtype:
+		if addr := lldpNetAddr(val); addr != "" {
+			return addr
+		}
+	}
+	return string(val)
+}
+
+// lldpNetAddr formats an address family byte (IANA address family numbers) followed by an address
+func lldpNetAddr(val []byte) string {
+	if len(val) == 0 {
+		return ""
+	}
+	switch {
+	case val[0] == 1 && len(val) == 1+net.IPv4len:
+		return net.IP(val[1:]).String()
+	case val[0] == 2 && len(val) == 1+net.IPv6len:
+		return net.IP(val[1:]).String()
+	}
+	return ""
+}
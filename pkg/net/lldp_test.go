@@ -0,0 +1,140 @@
+// Copyright 2023 Hedgehog
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package net
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+// lldpTLV encodes a single TLV
+func lldpTLV(typ byte, val ...byte) []byte {
+	l := len(val)
+	return append([]byte{typ<<1 | byte(l>>8), byte(l)}, val...)
+}
+
+func lldpDU(tlvs ...[]byte) []byte {
+	var ret []byte
+	for _, tlv := range tlvs {
+		ret = append(ret, tlv...)
+	}
+	return ret
+}
+
+func TestParseLLDPDU(t *testing.T) {
+	chassisMAC := lldpTLV(lldpTLVChassisID, lldpChassisIDMAC, 0x0c, 0x20, 0x12, 0xfe, 0x01, 0x00)
+	portName := lldpTLV(lldpTLVPortID, append([]byte{5}, "enp2s1"...)...)
+	ttl := lldpTLV(lldpTLVTTL, 0, 120)
+	end := lldpTLV(lldpTLVEnd)
+	tests := []struct {
+		name    string
+		b       []byte
+		want    *LLDPNeighbor
+		wantErr error
+	}{
+		{
+			name: "mandatory TLVs",
+			b:    lldpDU(chassisMAC, portName, ttl, end),
+			want: &LLDPNeighbor{
+				ChassisID: "0c:20:12:fe:01:00",
+				PortID:    "enp2s1",
+				TTL:       120,
+			},
+		},
+		{
+			name: "optional TLVs",
+			b: lldpDU(
+				chassisMAC,
+				lldpTLV(lldpTLVPortID, lldpPortIDMAC, 0x0c, 0x20, 0x12, 0xfe, 0x01, 0x01),
+				ttl,
+				lldpTLV(lldpTLVPortDescription, []byte("enp2s1")...),
+				lldpTLV(lldpTLVSystemName, []byte("control-1.example.com")...),
+				lldpTLV(lldpTLVSystemDescription, []byte("Flatcar Container Linux")...),
+				lldpTLV(lldpTLVManagementAddress, 5, 1, 172, 30, 1, 1, 2, 0, 0, 0, 1, 0),
+				lldpTLV(lldpTLVManagementAddress, 17, 2, 0xfe, 0x80, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1, 2, 0, 0, 0, 1, 0),
+				// unknown and organizationally specific TLVs are ignored
+				lldpTLV(127, 0x00, 0x12, 0x0f, 0x01, 0x03, 0x6c, 0x03, 0x00, 0x10),
+				end,
+			),
+			want: &LLDPNeighbor{
+				ChassisID:           "0c:20:12:fe:01:00",
+				PortID:              "0c:20:12:fe:01:01",
+				PortDescription:     "enp2s1",
+				SystemName:          "control-1.example.com",
+				SystemDescription:   "Flatcar Container Linux",
+				ManagementAddresses: []string{"172.30.1.1", "fe80::1"},
+				TTL:                 120,
+			},
+		},
+		{
+			name: "network address chassis ID and missing end TLV",
+			b:    lldpDU(lldpTLV(lldpTLVChassisID, lldpChassisIDNetAddr, 1, 172, 30, 1, 1), portName, ttl),
+			want: &LLDPNeighbor{
+				ChassisID: "172.30.1.1",
+				PortID:    "enp2s1",
+				TTL:       120,
+			},
+		},
+		{
+			name:    "mandatory TLVs out of order",
+			b:       lldpDU(portName, chassisMAC, ttl, end),
+			wantErr: ErrLLDPMalformed,
+		},
+		{
+			name:    "missing TTL",
+			b:       lldpDU(chassisMAC, portName, end),
+			wantErr: ErrLLDPMalformed,
+		},
+		{
+			name:    "truncated TLV",
+			b:       lldpDU(chassisMAC, portName, ttl)[:15],
+			wantErr: ErrLLDPMalformed,
+		},
+		{
+			name:    "empty",
+			wantErr: ErrLLDPMalformed,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseLLDPDU(tt.b)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("parseLLDPDU() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseLLDPDU() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLLDPNeighbor_Matches(t *testing.T) {
+	n := &LLDPNeighbor{
+		PortID:          "0C:20:12:FE:01:01",
+		PortDescription: "enp2s1",
+		SystemName:      "control-1.example.com",
+	}
+	if !n.MatchesSystem("control-1") || !n.MatchesSystem("control-1.example.com") || n.MatchesSystem("control-2") || n.MatchesSystem("") {
+		t.Errorf("MatchesSystem() does not match the host part of the system name")
+	}
+	if !n.MatchesPort("enp2s1", "") || !n.MatchesPort("", "0c:20:12:fe:01:01") || n.MatchesPort("enp2s2", "0c:20:12:fe:01:02") || n.MatchesPort("", "") {
+		t.Errorf("MatchesPort() does not match the port by name or MAC address")
+	}
+	var none *LLDPNeighbor
+	if none.MatchesSystem("control-1") || none.MatchesPort("enp2s1", "") {
+		t.Errorf("nil neighbour must not match")
+	}
+}
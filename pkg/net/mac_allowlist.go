@@ -0,0 +1,224 @@
+// Copyright 2023 Hedgehog
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package net
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/vishvananda/netlink"
+)
+
+// MACAllowlistBackupFile is the file name of the backup of the original MAC addresses in the state directory
+const MACAllowlistBackupFile = "mac-allowlist-backup.json"
+
+var ErrInvalidMACAllowlist = errors.New("net: invalid MAC allowlist")
+
+func invalidMACAllowlistError(format string, a ...any) error {
+	return fmt.Errorf("%w: %s", ErrInvalidMACAllowlist, fmt.Sprintf(format, a...))
+}
+
+// MACAllowlist maps VLAN IDs to the MAC address which the port security of the fabric allows on that VLAN
+// during provisioning. The VLAN ID 0 stands for the untagged network interface.
+type MACAllowlist map[uint16]string
+
+// Validate ensures that all VLAN IDs are valid and that all MAC addresses are unicast Ethernet addresses
+func (a MACAllowlist) Validate() error {
+	for vid, mac := range a {
+		if vid > 4094 {
+			return invalidMACAllowlistError("VLAN ID %d out of range", vid)
+		}
+		hw, err := net.ParseMAC(mac)
+		if err != nil {
+			return invalidMACAllowlistError("VLAN %d: %s", vid, err)
+		}
+		if len(hw) != 6 || hw[0]&0x01 != 0 {
+			return invalidMACAllowlistError("VLAN %d: '%s' is not a unicast Ethernet MAC address", vid, mac)
+		}
+	}
+	return nil
+}
+
+// HardwareAddr returns the allowlisted MAC address for VLAN `vid` if there is one
+func (a MACAllowlist) HardwareAddr(vid uint16) (net.HardwareAddr, bool) {
+	mac, ok := a[vid]
+	if !ok {
+		return nil, false
+	}
+	hw, err := net.ParseMAC(mac)
+	if err != nil {
+		return nil, false
+	}
+	return hw, true
+}
+
+// MACAllowlistBackup is an original MAC address of a network interface before an allowlisted MAC address was applied
+type MACAllowlistBackup struct {
+	Device      string `json:"device"`
+	OriginalMAC string `json:"original_mac"`
+}
+
+// these are being replaced in tests
+var (
+	linkHardwareAddr    = GetHardwareAddr
+	linkSetHardwareAddr = setHardwareAddr
+)
+
+// GetHardwareAddr returns the MAC address of `device`
+func GetHardwareAddr(device string) (net.HardwareAddr, error) {
+	link, err := netlink.LinkByName(device)
+	if err != nil {
+		return nil, fmt.Errorf("netlink: link by name: %w", err)
+	}
+	return link.Attrs().HardwareAddr, nil
+}
+
+// setHardwareAddr sets the MAC address of `device`. Not all drivers support changing the MAC address
+// while the interface is up, so it takes the interface down and up again if necessary.
+func setHardwareAddr(device string, hw net.HardwareAddr) error {
+	link, err := netlink.LinkByName(device)
+	if err != nil {
+		return fmt.Errorf("netlink: link by name: %w", err)
+	}
+	if err := netlink.LinkSetHardwareAddr(link, hw); err == nil {
+		return nil
+	}
+	if err := netlink.LinkSetDown(link); err != nil {
+		return fmt.Errorf("netlink: link set down: %w", err)
+	}
+	if err := netlink.LinkSetHardwareAddr(link, hw); err != nil {
+		return fmt.Errorf("netlink: link set hardware address '%s': %w", hw, err)
+	}
+	if link.Attrs().Flags&net.FlagUp != 0 {
+		if err := netlink.LinkSetUp(link); err != nil {
+			return fmt.Errorf("netlink: link set up: %w", err)
+		}
+	}
+	return nil
+}
+
+// MACAllowlistManager applies allowlisted MAC addresses to network interfaces, and keeps a backup of their
+// original MAC addresses in a state directory. This allows a later stage to roll them back.
+type MACAllowlistManager struct {
+	lock sync.Mutex
+	path string
+}
+
+// NewMACAllowlistManager creates a manager which keeps its backup in `stateDir`
+func NewMACAllowlistManager(stateDir string) *MACAllowlistManager {
+	return &MACAllowlistManager{
+		path: filepath.Join(stateDir, MACAllowlistBackupFile),
+	}
+}
+
+// Record backs up `original` as the original MAC address of `device` unless a backup for it exists already.
+// This must be called before the device is being created with or set to an allowlisted MAC address.
+func (m *MACAllowlistManager) Record(device string, original net.HardwareAddr) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	backups, err := m.read()
+	if err != nil {
+		return err
+	}
+	for _, b := range backups {
+		if b.Device == device {
+			return nil
+		}
+	}
+	return m.write(append(backups, MACAllowlistBackup{Device: device, OriginalMAC: original.String()}))
+}
+
+// Apply sets the MAC address of the existing network interface `device` to `hw` after backing up its
+// original MAC address
+func (m *MACAllowlistManager) Apply(device string, hw net.HardwareAddr) error {
+	original, err := linkHardwareAddr(device)
+	if err != nil {
+		return err
+	}
+	if err := m.Record(device, original); err != nil {
+		return err
+	}
+	return linkSetHardwareAddr(device, hw)
+}
+
+// Rollback restores the original MAC addresses of all network interfaces which still exist, and removes the backup.
+// It does nothing if there is no backup.
+func (m *MACAllowlistManager) Rollback() error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	backups, err := m.read()
+	if err != nil {
+		return err
+	}
+	if len(backups) == 0 {
+		return nil
+	}
+	var errs []error
+	for _, b := range backups {
+		hw, err := net.ParseMAC(b.OriginalMAC)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("net: device '%s': invalid original MAC address: %w", b.Device, err))
+			continue
+		}
+		// VLAN interfaces are usually gone by now, so there is nothing to roll back for them
+		if _, err := linkHardwareAddr(b.Device); err != nil {
+			continue
+		}
+		if err := linkSetHardwareAddr(b.Device, hw); err != nil {
+			errs = append(errs, fmt.Errorf("net: device '%s': %w", b.Device, err))
+		}
+	}
+	if len(errs) > 0 {
+		return errors.Join(errs...)
+	}
+	if err := os.Remove(m.path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("net: removing backup '%s': %w", m.path, err)
+	}
+	return nil
+}
+
+func (m *MACAllowlistManager) read() ([]MACAllowlistBackup, error) {
+	b, err := os.ReadFile(m.path)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("net: reading backup '%s': %w", m.path, err)
+	}
+	var ret []MACAllowlistBackup
+	if err := json.Unmarshal(b, &ret); err != nil {
+		return nil, fmt.Errorf("net: decoding backup '%s': %w", m.path, err)
+	}
+	return ret, nil
+}
+
+func (m *MACAllowlistManager) write(backups []MACAllowlistBackup) error {
+	b, err := json.Marshal(backups)
+	if err != nil {
+		return fmt.Errorf("net: encoding backup: %w", err)
+	}
+	if err := os.WriteFile(m.path, b, 0644); err != nil {
+		return fmt.Errorf("net: writing backup '%s': %w", m.path, err)
+	}
+	return nil
+}
@@ -0,0 +1,124 @@
+// Copyright 2023 Hedgehog
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package net
+
+import (
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestMACAllowlist_Validate(t *testing.T) {
+	tests := []struct {
+		name      string
+		allowlist MACAllowlist
+		wantErr   bool
+	}{
+		{
+			name:      "valid",
+			allowlist: MACAllowlist{0: "02:00:00:00:00:01", 42: "02:00:00:00:00:02"},
+		},
+		{
+			name:      "invalid VLAN ID",
+			allowlist: MACAllowlist{4095: "02:00:00:00:00:01"},
+			wantErr:   true,
+		},
+		{
+			name:      "invalid MAC address",
+			allowlist: MACAllowlist{42: "not a MAC"},
+			wantErr:   true,
+		},
+		{
+			name:      "multicast MAC address",
+			allowlist: MACAllowlist{42: "01:00:5e:00:00:01"},
+			wantErr:   true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.allowlist.Validate()
+			if (err != nil) != tt.wantErr {
+				t.Errorf("MACAllowlist.Validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil && !errors.Is(err, ErrInvalidMACAllowlist) {
+				t.Errorf("MACAllowlist.Validate() error = %v, want %v", err, ErrInvalidMACAllowlist)
+			}
+		})
+	}
+}
+
+func TestMACAllowlistManager(t *testing.T) {
+	links := map[string]net.HardwareAddr{
+		"eth0": {0x0c, 0x00, 0x00, 0x00, 0x00, 0x01},
+	}
+	origLinkHardwareAddr, origLinkSetHardwareAddr := linkHardwareAddr, linkSetHardwareAddr
+	defer func() {
+		linkHardwareAddr, linkSetHardwareAddr = origLinkHardwareAddr, origLinkSetHardwareAddr
+	}()
+	linkHardwareAddr = func(device string) (net.HardwareAddr, error) {
+		hw, ok := links[device]
+		if !ok {
+			return nil, errors.New("link not found")
+		}
+		return hw, nil
+	}
+	linkSetHardwareAddr = func(device string, hw net.HardwareAddr) error {
+		links[device] = hw
+		return nil
+	}
+
+	dir := t.TempDir()
+	m := NewMACAllowlistManager(dir)
+	allowlist := MACAllowlist{0: "02:00:00:00:00:01", 42: "02:00:00:00:00:02"}
+
+	// untagged interface
+	hw, _ := allowlist.HardwareAddr(0)
+	if err := m.Apply("eth0", hw); err != nil {
+		t.Fatalf("Apply() error = %v", err)
+	}
+	// applying again must not overwrite the original MAC address in the backup
+	if err := m.Apply("eth0", hw); err != nil {
+		t.Fatalf("Apply() error = %v", err)
+	}
+	if links["eth0"].String() != "02:00:00:00:00:01" {
+		t.Errorf("eth0 MAC = %s, want allowlisted MAC", links["eth0"])
+	}
+
+	// a VLAN interface which is gone by the time of the rollback
+	if err := m.Record("control", links["eth0"]); err != nil {
+		t.Fatalf("Record() error = %v", err)
+	}
+
+	// a new manager must be able to roll it back from the backup
+	if err := NewMACAllowlistManager(dir).Rollback(); err != nil {
+		t.Fatalf("Rollback() error = %v", err)
+	}
+	if links["eth0"].String() != "0c:00:00:00:00:01" {
+		t.Errorf("eth0 MAC = %s, want original MAC", links["eth0"])
+	}
+	if _, ok := links["control"]; ok {
+		t.Errorf("rollback must not create missing devices")
+	}
+	if _, err := os.Stat(filepath.Join(dir, MACAllowlistBackupFile)); !os.IsNotExist(err) {
+		t.Errorf("backup must be removed after rollback, stat error = %v", err)
+	}
+
+	// nothing to roll back
+	if err := m.Rollback(); err != nil {
+		t.Errorf("Rollback() without backup error = %v", err)
+	}
+}
@@ -0,0 +1,209 @@
+// Copyright 2023 Hedgehog
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package net
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"syscall"
+	"time"
+
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// MinMTU is the smallest MTU that we allow to be configured. This is the minimum MTU which
+	// is required for IPv6 to function.
+	MinMTU = 1280
+
+	// MaxMTU is the largest MTU that we allow to be configured (jumbo frames).
+	MaxMTU = 9216
+
+	pathMTUProbes    = 3
+	pathMTUProbeWait = 200 * time.Millisecond
+	ipv4HeaderLen    = 20
+	ipv6HeaderLen    = 40
+	udpHeaderLen     = 8
+)
+
+var ErrInvalidMTU = errors.New("net: invalid MTU")
+
+func invalidMTUError(mtu int) error {
+	return fmt.Errorf("%w: %d not within [%d, %d]", ErrInvalidMTU, mtu, MinMTU, MaxMTU)
+}
+
+// ValidateMTU ensures that `mtu` is within the bounds that we allow to be configured.
+func ValidateMTU(mtu int) error {
+	if mtu < MinMTU || mtu > MaxMTU {
+		return invalidMTUError(mtu)
+	}
+	return nil
+}
+
+// SetMTU sets the MTU of the network interface `device` to `mtu`.
+func SetMTU(device string, mtu int) error {
+	if err := ValidateMTU(mtu); err != nil {
+		return err
+	}
+	link, err := netlink.LinkByName(device)
+	if err != nil {
+		return fmt.Errorf("netlink: link by name: %w", err)
+	}
+	if link.Attrs().MTU == mtu {
+		return nil
+	}
+	if err := netlink.LinkSetMTU(link, mtu); err != nil {
+		return fmt.Errorf("netlink: link set mtu %d: %w", mtu, err)
+	}
+	return nil
+}
+
+// GetMTU returns the MTU of the network interface `device`.
+func GetMTU(device string) (int, error) {
+	link, err := netlink.LinkByName(device)
+	if err != nil {
+		return 0, fmt.Errorf("netlink: link by name: %w", err)
+	}
+	return link.Attrs().MTU, nil
+}
+
+// PathMTUInfo is the result of a path MTU probe.
+type PathMTUInfo struct {
+	// Interface is the network interface which is being used to reach the destination
+	Interface string
+
+	// InterfaceMTU is the MTU of `Interface`, or the MTU of the route if it is lower
+	InterfaceMTU int
+
+	// PathMTU is the effective MTU towards the destination as discovered by the kernel
+	PathMTU int
+}
+
+// ProbePathMTU probes the effective path MTU towards `addr` which must be in "host:port" notation.
+// It sends UDP datagrams of the size of the MTU of the outgoing interface with the "Don't Fragment"
+// bit set, and returns the path MTU that the kernel discovered from the ICMP responses along the path.
+// NOTE: this relies on routers along the path to send ICMP "fragmentation needed" or "packet too big"
+// messages. If they are filtered, the path MTU will be reported as the interface MTU.
+func ProbePathMTU(ctx context.Context, addr string) (*PathMTUInfo, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, fmt.Errorf("net: split host port '%s': %w", addr, err)
+	}
+	ip, err := netip.ParseAddr(host)
+	if err != nil {
+		ips, err := net.DefaultResolver.LookupNetIP(ctx, "ip", host)
+		if err != nil {
+			return nil, fmt.Errorf("net: resolving '%s': %w", host, err)
+		}
+		if len(ips) == 0 {
+			return nil, fmt.Errorf("net: resolving '%s': no addresses", host)
+		}
+		ip = ips[0]
+	}
+	ip = ip.Unmap()
+
+	// find the outgoing interface and its MTU
+	ret := &PathMTUInfo{}
+	if ip.Zone() != "" {
+		link, err := netlink.LinkByName(ip.Zone())
+		if err != nil {
+			return nil, fmt.Errorf("netlink: link by name: %w", err)
+		}
+		ret.Interface = link.Attrs().Name
+		ret.InterfaceMTU = link.Attrs().MTU
+	} else {
+		routes, err := netlink.RouteGet(ip.AsSlice())
+		if err != nil {
+			return nil, fmt.Errorf("netlink: route get '%s': %w", ip, err)
+		}
+		if len(routes) == 0 {
+			return nil, fmt.Errorf("netlink: no route to '%s'", ip)
+		}
+		link, err := netlink.LinkByIndex(routes[0].LinkIndex)
+		if err != nil {
+			return nil, fmt.Errorf("netlink: link by index: %w", err)
+		}
+		ret.Interface = link.Attrs().Name
+		ret.InterfaceMTU = link.Attrs().MTU
+		if routes[0].MTU > 0 && routes[0].MTU < ret.InterfaceMTU {
+			ret.InterfaceMTU = routes[0].MTU
+		}
+	}
+
+	// now probe the path by sending datagrams with the DF bit set
+	network, level, discoverOpt, mtuOpt, headerLen := "udp4", unix.IPPROTO_IP, unix.IP_MTU_DISCOVER, unix.IP_MTU, ipv4HeaderLen
+	if ip.Is6() {
+		network, level, discoverOpt, mtuOpt, headerLen = "udp6", unix.IPPROTO_IPV6, unix.IPV6_MTU_DISCOVER, unix.IPV6_MTU, ipv6HeaderLen
+	}
+	d := &net.Dialer{
+		Control: func(_, _ string, c syscall.RawConn) error {
+			var sockErr error
+			if err := c.Control(func(fd uintptr) {
+				sockErr = unix.SetsockoptInt(int(fd), level, discoverOpt, unix.IP_PMTUDISC_PROBE)
+			}); err != nil {
+				return err
+			}
+			return sockErr
+		},
+	}
+	conn, err := d.DialContext(ctx, network, net.JoinHostPort(ip.String(), port))
+	if err != nil {
+		return nil, fmt.Errorf("net: dial '%s': %w", addr, err)
+	}
+	defer conn.Close()
+	rc, err := conn.(*net.UDPConn).SyscallConn()
+	if err != nil {
+		return nil, fmt.Errorf("net: raw connection: %w", err)
+	}
+	getMTU := func() (int, error) {
+		var mtu int
+		var sockErr error
+		if err := rc.Control(func(fd uintptr) {
+			mtu, sockErr = unix.GetsockoptInt(int(fd), level, mtuOpt)
+		}); err != nil {
+			return 0, err
+		}
+		return mtu, sockErr
+	}
+
+	mtu := ret.InterfaceMTU
+	for i := 0; i < pathMTUProbes; i++ {
+		// we are ignoring all write errors on purpose: they are either because of the kernel
+		// telling us that the datagram is too big, or because the destination port is unreachable
+		// which are both expected
+		if size := mtu - headerLen - udpHeaderLen; size > 0 {
+			conn.Write(make([]byte, size)) //nolint: errcheck
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(pathMTUProbeWait):
+		}
+		newMTU, err := getMTU()
+		if err != nil {
+			return nil, fmt.Errorf("net: getsockopt path mtu: %w", err)
+		}
+		if newMTU >= mtu {
+			break
+		}
+		mtu = newMTU
+	}
+	ret.PathMTU = mtu
+	return ret, nil
+}
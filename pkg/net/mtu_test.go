@@ -0,0 +1,72 @@
+// Copyright 2023 Hedgehog
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package net
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestValidateMTU(t *testing.T) {
+	tests := []struct {
+		name    string
+		mtu     int
+		wantErr bool
+	}{
+		{
+			name: "default",
+			mtu:  1500,
+		},
+		{
+			name: "minimum",
+			mtu:  MinMTU,
+		},
+		{
+			name: "maximum",
+			mtu:  MaxMTU,
+		},
+		{
+			name:    "below minimum",
+			mtu:     MinMTU - 1,
+			wantErr: true,
+		},
+		{
+			name:    "above maximum",
+			mtu:     MaxMTU + 1,
+			wantErr: true,
+		},
+		{
+			name:    "zero",
+			mtu:     0,
+			wantErr: true,
+		},
+		{
+			name:    "negative",
+			mtu:     -1,
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := ValidateMTU(tt.mtu)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("ValidateMTU() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil && !errors.Is(err, ErrInvalidMTU) {
+				t.Errorf("ValidateMTU() error = %v, want %v", err, ErrInvalidMTU)
+			}
+		})
+	}
+}
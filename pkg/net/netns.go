@@ -0,0 +1,192 @@
+// Copyright 2023 Hedgehog
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package net
+
+import (
+	"errors"
+	"fmt"
+	"runtime"
+
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netns"
+)
+
+var ErrNamespace = errors.New("net: network namespace")
+
+func namespaceError(format string, a ...any) error {
+	return fmt.Errorf("%w: %s", ErrNamespace, fmt.Sprintf(format, a...))
+}
+
+// Namespace is a network namespace which holds one end of a veth pair as a stand-in for a real network
+// device. All functions of this package can be run inside of it with `Do`, which makes it possible to
+// exercise the VLAN, address and route handling without touching any of the interfaces of the host.
+type Namespace struct {
+	// Name is the name of the namespace if it is a named namespace (see `ip netns`), otherwise empty
+	Name string
+
+	// Device is the veth device inside of the namespace which stands in for the network device
+	Device string
+
+	// Peer is the other end of the veth pair which is also inside of the namespace
+	Peer string
+
+	handle netns.NsHandle
+}
+
+// vethPeerName derives the name of the veth peer from `device` while staying within the
+// maximum length of interface names.
+func vethPeerName(device string) string {
+	const maxLen = 15
+	peer := device + "-peer"
+	if len(peer) > maxLen {
+		peer = peer[len(peer)-maxLen:]
+	}
+	return peer
+}
+
+// NewNamespace creates a new network namespace with a veth pair inside of it. `device` is the name of the veth
+// device which stands in for a real network device. If `name` is not empty, the namespace is created as a
+// named namespace which outlives this process until it gets deleted with `Delete`, otherwise it is gone
+// once it gets closed.
+func NewNamespace(name string, device string) (*Namespace, error) {
+	if device == "" {
+		return nil, namespaceError("device name missing")
+	}
+	ret := &Namespace{
+		Name:   name,
+		Device: device,
+		Peer:   vethPeerName(device),
+	}
+
+	// namespaces are per thread, and creating one switches the current thread into it
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	orig, err := netns.Get()
+	if err != nil {
+		return nil, fmt.Errorf("netns: get current namespace: %w", err)
+	}
+	defer orig.Close()
+
+	if name != "" {
+		ret.handle, err = netns.NewNamed(name)
+	} else {
+		ret.handle, err = netns.New()
+	}
+	if err != nil {
+		// we might have been switched already, so try our best to switch back
+		_ = netns.Set(orig)
+		return nil, fmt.Errorf("netns: new namespace '%s': %w", name, err)
+	}
+
+	setupErr := ret.setup()
+	if err := netns.Set(orig); err != nil {
+		// the thread is tainted now, so we must not unlock it: it will be terminated when the goroutine exits
+		runtime.LockOSThread()
+		return nil, fmt.Errorf("netns: switching back to original namespace: %w", err)
+	}
+	if setupErr != nil {
+		ret.Delete() //nolint: errcheck
+		return nil, setupErr
+	}
+	return ret, nil
+}
+
+// setup runs inside of the new namespace
+func (n *Namespace) setup() error {
+	lo, err := netlink.LinkByName("lo")
+	if err != nil {
+		return fmt.Errorf("netlink: link by name: %w", err)
+	}
+	if err := netlink.LinkSetUp(lo); err != nil {
+		return fmt.Errorf("netlink: link set up 'lo': %w", err)
+	}
+	veth := &netlink.Veth{
+		LinkAttrs: netlink.LinkAttrs{Name: n.Device},
+		PeerName:  n.Peer,
+	}
+	if err := netlink.LinkAdd(veth); err != nil {
+		return fmt.Errorf("netlink: link add veth '%s' <-> '%s': %w", n.Device, n.Peer, err)
+	}
+	for _, name := range []string{n.Device, n.Peer} {
+		link, err := netlink.LinkByName(name)
+		if err != nil {
+			return fmt.Errorf("netlink: link by name: %w", err)
+		}
+		if err := netlink.LinkSetUp(link); err != nil {
+			return fmt.Errorf("netlink: link set up '%s': %w", name, err)
+		}
+	}
+	return nil
+}
+
+// OpenNamespace opens an existing named namespace which was created with `NewNamespace` before.
+func OpenNamespace(name string, device string) (*Namespace, error) {
+	h, err := netns.GetFromName(name)
+	if err != nil {
+		return nil, fmt.Errorf("netns: get namespace '%s': %w", name, err)
+	}
+	return &Namespace{
+		Name:   name,
+		Device: device,
+		Peer:   vethPeerName(device),
+		handle: h,
+	}, nil
+}
+
+// Do runs `f` inside of the namespace, and switches back to the original namespace afterwards.
+// NOTE: `f` must not spawn goroutines which rely on running in the namespace, as only the
+// current thread gets switched.
+func (n *Namespace) Do(f func() error) error {
+	if !n.handle.IsOpen() {
+		return namespaceError("'%s' is closed", n.Name)
+	}
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	orig, err := netns.Get()
+	if err != nil {
+		return fmt.Errorf("netns: get current namespace: %w", err)
+	}
+	defer orig.Close()
+
+	if err := netns.Set(n.handle); err != nil {
+		return fmt.Errorf("netns: switching to namespace '%s': %w", n.Name, err)
+	}
+	fErr := f()
+	if err := netns.Set(orig); err != nil {
+		runtime.LockOSThread()
+		return fmt.Errorf("netns: switching back to original namespace: %w", err)
+	}
+	return fErr
+}
+
+// Close closes the handle to the namespace. Anonymous namespaces will be gone with this,
+// named namespaces stay around until they are deleted.
+func (n *Namespace) Close() error {
+	return n.handle.Close()
+}
+
+// Delete closes the namespace, and deletes it if it is a named namespace.
+func (n *Namespace) Delete() error {
+	if err := n.Close(); err != nil {
+		return fmt.Errorf("netns: close: %w", err)
+	}
+	if n.Name == "" {
+		return nil
+	}
+	if err := netns.DeleteNamed(n.Name); err != nil {
+		return fmt.Errorf("netns: delete namespace '%s': %w", n.Name, err)
+	}
+	return nil
+}
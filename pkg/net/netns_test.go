@@ -0,0 +1,257 @@
+// Copyright 2023 Hedgehog
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package net
+
+import (
+	"errors"
+	"net"
+	"net/netip"
+	"os"
+	"slices"
+	"testing"
+
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+// newTestNamespace creates an anonymous namespace with a veth pair, or skips the test
+// if we are not allowed to create namespaces
+func newTestNamespace(t *testing.T) *Namespace {
+	t.Helper()
+	if os.Geteuid() != 0 {
+		t.Skip("network namespace tests need to run as root")
+	}
+	ns, err := NewNamespace("", "eth0")
+	if err != nil {
+		t.Skipf("cannot create network namespace: %v", err)
+	}
+	t.Cleanup(func() {
+		if err := ns.Delete(); err != nil {
+			t.Errorf("deleting namespace: %v", err)
+		}
+	})
+	return ns
+}
+
+// skipWithoutVLANSupport skips the test if the kernel cannot create VLAN interfaces (no 8021q module)
+func skipWithoutVLANSupport(t *testing.T, ns *Namespace) {
+	t.Helper()
+	if err := ns.Do(func() error {
+		parent, err := netlink.LinkByName(ns.Device)
+		if err != nil {
+			return err
+		}
+		vlan := &netlink.Vlan{
+			LinkAttrs: netlink.LinkAttrs{Name: "probe", ParentIndex: parent.Attrs().Index},
+			VlanId:    4000,
+		}
+		if err := netlink.LinkAdd(vlan); err != nil {
+			return err
+		}
+		return netlink.LinkDel(vlan)
+	}); err != nil {
+		t.Skipf("kernel does not support VLAN interfaces: %v", err)
+	}
+}
+
+func mustIPNets(t *testing.T, s ...string) []*net.IPNet {
+	t.Helper()
+	ret, err := StringsToIPNets(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ret
+}
+
+func TestNamespace_VLANDevice(t *testing.T) {
+	ns := newTestNamespace(t)
+	skipWithoutVLANSupport(t, ns)
+	ipnets := mustIPNets(t, "192.168.42.101/24")
+	routes := []*Route{
+		{
+			Dests: mustIPNets(t, "10.142.0.0/16", "10.143.0.0/16"),
+			Gw:    net.ParseIP("192.168.42.1"),
+		},
+	}
+
+	// the veth device must not be visible outside of the namespace
+	if link, err := netlink.LinkByName(ns.Peer); err == nil {
+		t.Fatalf("veth peer '%s' is visible in the host namespace: %v", ns.Peer, link.Attrs())
+	}
+
+	if err := ns.Do(func() error {
+		if err := AddVLANDeviceWithIP(ns.Device, 42, "mgmt", 1400, ipnets, routes); err != nil {
+			t.Fatalf("AddVLANDeviceWithIP() error = %v", err)
+		}
+		addrs, err := GetInterfaceAddresses("mgmt")
+		if err != nil {
+			t.Fatalf("GetInterfaceAddresses() error = %v", err)
+		}
+		if !slices.Contains(addrs, netip.MustParseAddr("192.168.42.101")) {
+			t.Errorf("GetInterfaceAddresses() = %v, want it to contain 192.168.42.101", addrs)
+		}
+		mtu, err := GetMTU("mgmt")
+		if err != nil {
+			t.Fatalf("GetMTU() error = %v", err)
+		}
+		if mtu != 1400 {
+			t.Errorf("GetMTU() = %d, want 1400", mtu)
+		}
+		for _, dest := range routes[0].Dests {
+			rs, err := netlink.RouteGet(dest.IP)
+			if err != nil {
+				t.Fatalf("RouteGet(%s) error = %v", dest.IP, err)
+			}
+			if len(rs) == 0 || !rs[0].Gw.Equal(routes[0].Gw) {
+				t.Errorf("RouteGet(%s) = %v, want gateway %s", dest.IP, rs, routes[0].Gw)
+			}
+		}
+
+		if err := DeleteVLANDevice("mgmt", ipnets, routes); err != nil {
+			t.Fatalf("DeleteVLANDevice() error = %v", err)
+		}
+		if _, err := netlink.LinkByName("mgmt"); err == nil {
+			t.Errorf("VLAN interface 'mgmt' still exists after deletion")
+		}
+		return nil
+	}); err != nil {
+		t.Fatalf("Namespace.Do() error = %v", err)
+	}
+}
+
+func TestNamespace_ConfigureDevice(t *testing.T) {
+	ns := newTestNamespace(t)
+	ipnets := mustIPNets(t, "192.168.42.101/24")
+
+	if err := ns.Do(func() error {
+		if err := ConfigureDeviceWithIP(ns.Device, 0, ipnets, nil); err != nil {
+			t.Fatalf("ConfigureDeviceWithIP() error = %v", err)
+		}
+		addrs, err := GetInterfaceAddresses(ns.Device)
+		if err != nil {
+			t.Fatalf("GetInterfaceAddresses() error = %v", err)
+		}
+		if !slices.Contains(addrs, netip.MustParseAddr("192.168.42.101")) {
+			t.Errorf("GetInterfaceAddresses() = %v, want it to contain 192.168.42.101", addrs)
+		}
+		if err := UnconfigureDeviceWithIP(ns.Device, ipnets, nil); err != nil {
+			t.Fatalf("UnconfigureDeviceWithIP() error = %v", err)
+		}
+		addrs, err = GetInterfaceAddresses(ns.Device)
+		if err != nil {
+			t.Fatalf("GetInterfaceAddresses() error = %v", err)
+		}
+		if slices.Contains(addrs, netip.MustParseAddr("192.168.42.101")) {
+			t.Errorf("GetInterfaceAddresses() = %v, want it to not contain 192.168.42.101", addrs)
+		}
+		return nil
+	}); err != nil {
+		t.Fatalf("Namespace.Do() error = %v", err)
+	}
+}
+
+func TestNamespace_ConfigureDeviceIPv6(t *testing.T) {
+	ns := newTestNamespace(t)
+	ipnets := mustIPNets(t, "fd00:42::101/64")
+	routes := []*Route{
+		{
+			Dests: mustIPNets(t, "::/0"),
+			Gw:    net.ParseIP("fd00:42::1"),
+		},
+	}
+
+	if err := ns.Do(func() error {
+		if err := ConfigureDeviceWithIP(ns.Device, 0, ipnets, routes); err != nil {
+			t.Fatalf("ConfigureDeviceWithIP() error = %v", err)
+		}
+		link, err := netlink.LinkByName(ns.Device)
+		if err != nil {
+			t.Fatalf("LinkByName() error = %v", err)
+		}
+		addrs, err := netlink.AddrList(link, netlink.FAMILY_V6)
+		if err != nil {
+			t.Fatalf("AddrList() error = %v", err)
+		}
+		found := false
+		for _, addr := range addrs {
+			if addr.IP.Equal(ipnets[0].IP) {
+				found = true
+				// the address must be usable right away
+				if addr.Flags&unix.IFA_F_TENTATIVE != 0 {
+					t.Errorf("address %s is tentative", addr)
+				}
+			}
+		}
+		if !found {
+			t.Errorf("AddrList() = %v, want it to contain %s", addrs, ipnets[0].IP)
+		}
+		rs, err := netlink.RouteGet(net.ParseIP("2001:db8::1"))
+		if err != nil {
+			t.Fatalf("RouteGet() error = %v", err)
+		}
+		if len(rs) == 0 || !rs[0].Gw.Equal(routes[0].Gw) {
+			t.Errorf("RouteGet() = %v, want gateway %s", rs, routes[0].Gw)
+		}
+		if err := UnconfigureDeviceWithIP(ns.Device, ipnets, routes); err != nil {
+			t.Fatalf("UnconfigureDeviceWithIP() error = %v", err)
+		}
+		return nil
+	}); err != nil {
+		t.Fatalf("Namespace.Do() error = %v", err)
+	}
+}
+
+func TestNamespace_ConfigureDeviceRouteAddressFamily(t *testing.T) {
+	ns := newTestNamespace(t)
+	ipnets := mustIPNets(t, "192.168.42.101/24")
+	routes := []*Route{
+		{
+			Dests: mustIPNets(t, "fd00:1::/64"),
+			Gw:    net.ParseIP("192.168.42.1"),
+		},
+	}
+
+	if err := ns.Do(func() error {
+		if err := ConfigureDeviceWithIP(ns.Device, 0, ipnets, routes); !errors.Is(err, ErrRouteAddressFamily) {
+			t.Errorf("ConfigureDeviceWithIP() error = %v, want %v", err, ErrRouteAddressFamily)
+		}
+		return nil
+	}); err != nil {
+		t.Fatalf("Namespace.Do() error = %v", err)
+	}
+}
+
+func TestNamespace_ReconcileNetworkState(t *testing.T) {
+	ns := newTestNamespace(t)
+	skipWithoutVLANSupport(t, ns)
+	ipnets := mustIPNets(t, "192.168.42.101/24")
+
+	if err := ns.Do(func() error {
+		// what a crashed run leaves behind
+		if err := AddVLANDeviceWithIP(ns.Device, 42, "mgmt", 0, ipnets, nil); err != nil {
+			t.Fatalf("AddVLANDeviceWithIP() error = %v", err)
+		}
+		stale, err := ReconcileNetworkState(ns.Device, 42, "mgmt", ipnets)
+		if err != nil {
+			t.Fatalf("ReconcileNetworkState() error = %v", err)
+		}
+		if !slices.Equal(stale.DeletedDevices, []string{"mgmt"}) {
+			t.Errorf("ReconcileNetworkState() deleted devices = %v, want [mgmt]", stale.DeletedDevices)
+		}
+		return nil
+	}); err != nil {
+		t.Fatalf("Namespace.Do() error = %v", err)
+	}
+}
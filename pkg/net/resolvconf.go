@@ -0,0 +1,158 @@
+// Copyright 2023 Hedgehog
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package net
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"os"
+	"strings"
+	"sync"
+)
+
+// DefaultResolvConfPath is the location of the resolver configuration file
+const DefaultResolvConfPath = "/etc/resolv.conf"
+
+const resolvConfBackupSuffix = ".dasboot.bak"
+
+var ErrInvalidNameserver = errors.New("net: invalid nameserver")
+
+func invalidNameserverError(s string) error {
+	return fmt.Errorf("%w: %s", ErrInvalidNameserver, s)
+}
+
+// ResolvConf holds the DNS resolution settings which can be written to a resolv.conf file
+type ResolvConf struct {
+	Nameservers []string
+	Search      []string
+}
+
+// Validate ensures that all nameservers are IP addresses
+func (rc *ResolvConf) Validate() error {
+	for _, ns := range rc.Nameservers {
+		if net.ParseIP(ns) == nil {
+			return invalidNameserverError(ns)
+		}
+	}
+	return nil
+}
+
+// Bytes renders the settings in resolv.conf format
+func (rc *ResolvConf) Bytes() []byte {
+	var b bytes.Buffer
+	b.WriteString("# generated by DAS BOOT\n")
+	if len(rc.Search) > 0 {
+		b.WriteString("search " + strings.Join(rc.Search, " ") + "\n")
+	}
+	for _, ns := range rc.Nameservers {
+		b.WriteString("nameserver " + ns + "\n")
+	}
+	return b.Bytes()
+}
+
+// ResolvConfManager applies DNS resolution settings to a resolv.conf file,
+// and can restore its previous contents from a backup.
+type ResolvConfManager struct {
+	lock       sync.Mutex
+	path       string
+	backupPath string
+	applied    bool
+	existed    bool
+}
+
+// NewResolvConfManager creates a manager for the resolv.conf file at `path`.
+// If `path` is empty, `DefaultResolvConfPath` is being used.
+func NewResolvConfManager(path string) *ResolvConfManager {
+	if path == "" {
+		path = DefaultResolvConfPath
+	}
+	return &ResolvConfManager{
+		path:       path,
+		backupPath: path + resolvConfBackupSuffix,
+	}
+}
+
+// Apply backs up the current resolv.conf file if this is the first time it is being called,
+// and writes the settings from `rc` to it. If there are no nameservers in `rc`, the file
+// is left untouched.
+func (m *ResolvConfManager) Apply(rc *ResolvConf) error {
+	if rc == nil || len(rc.Nameservers) == 0 {
+		return nil
+	}
+	if err := rc.Validate(); err != nil {
+		return err
+	}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	// only backup the original file once, so that consecutive calls to apply
+	// will still be able to restore the original
+	if !m.applied {
+		orig, err := os.ReadFile(m.path)
+		switch {
+		case err == nil:
+			if err := os.WriteFile(m.backupPath, orig, 0644); err != nil {
+				return fmt.Errorf("net: backing up '%s' to '%s': %w", m.path, m.backupPath, err)
+			}
+			m.existed = true
+		case errors.Is(err, fs.ErrNotExist):
+			m.existed = false
+		default:
+			return fmt.Errorf("net: reading '%s': %w", m.path, err)
+		}
+	}
+
+	// NOTE: we are not writing to a temporary file and renaming it on purpose
+	// as resolv.conf is a symlink on many systems which we want to keep intact
+	if err := os.WriteFile(m.path, rc.Bytes(), 0644); err != nil {
+		return fmt.Errorf("net: writing '%s': %w", m.path, err)
+	}
+	m.applied = true
+	return nil
+}
+
+// Restore restores the resolv.conf file from the backup which was taken at the first call to `Apply`.
+// It does nothing if `Apply` was never called successfully.
+func (m *ResolvConfManager) Restore() error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if !m.applied {
+		return nil
+	}
+	if !m.existed {
+		if err := os.Remove(m.path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return fmt.Errorf("net: removing '%s': %w", m.path, err)
+		}
+		m.applied = false
+		return nil
+	}
+	orig, err := os.ReadFile(m.backupPath)
+	if err != nil {
+		return fmt.Errorf("net: reading backup '%s': %w", m.backupPath, err)
+	}
+	if err := os.WriteFile(m.path, orig, 0644); err != nil {
+		return fmt.Errorf("net: restoring '%s': %w", m.path, err)
+	}
+	if err := os.Remove(m.backupPath); err != nil {
+		return fmt.Errorf("net: removing backup '%s': %w", m.backupPath, err)
+	}
+	m.applied = false
+	return nil
+}
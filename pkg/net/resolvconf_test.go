@@ -0,0 +1,107 @@
+// Copyright 2023 Hedgehog
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package net
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestResolvConfManager(t *testing.T) {
+	tests := []struct {
+		name      string
+		orig      *string
+		rc        *ResolvConf
+		want      string
+		wantErr   error
+		untouched bool
+	}{
+		{
+			name: "apply and restore existing file",
+			orig: ptr("nameserver 127.0.0.1\n"),
+			rc:   &ResolvConf{Nameservers: []string{"192.168.42.1", "fe80::1"}, Search: []string{"hedgehog.svc.cluster.local", "cluster.local"}},
+			want: "# generated by DAS BOOT\nsearch hedgehog.svc.cluster.local cluster.local\nnameserver 192.168.42.1\nnameserver fe80::1\n",
+		},
+		{
+			name: "apply and restore missing file",
+			rc:   &ResolvConf{Nameservers: []string{"192.168.42.1"}},
+			want: "# generated by DAS BOOT\nnameserver 192.168.42.1\n",
+		},
+		{
+			name:      "no nameservers leaves file untouched",
+			orig:      ptr("nameserver 127.0.0.1\n"),
+			rc:        &ResolvConf{Search: []string{"cluster.local"}},
+			untouched: true,
+		},
+		{
+			name:    "invalid nameserver",
+			orig:    ptr("nameserver 127.0.0.1\n"),
+			rc:      &ResolvConf{Nameservers: []string{"ns.example.com"}},
+			wantErr: ErrInvalidNameserver,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "resolv.conf")
+			if tt.orig != nil {
+				if err := os.WriteFile(path, []byte(*tt.orig), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			m := NewResolvConfManager(path)
+			err := m.Apply(tt.rc)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("Apply() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			got, _ := os.ReadFile(path)
+			if tt.untouched {
+				if string(got) != *tt.orig {
+					t.Errorf("file was modified: %q", string(got))
+				}
+			} else if string(got) != tt.want {
+				t.Errorf("Apply() wrote %q, want %q", string(got), tt.want)
+			}
+
+			// applying a second time must not overwrite the backup
+			if err := m.Apply(tt.rc); err != nil {
+				t.Fatalf("second Apply() error = %v", err)
+			}
+
+			if err := m.Restore(); err != nil {
+				t.Fatalf("Restore() error = %v", err)
+			}
+			got, err = os.ReadFile(path)
+			if tt.orig == nil {
+				if !errors.Is(err, os.ErrNotExist) {
+					t.Errorf("Restore() did not remove the file: %v", err)
+				}
+			} else if string(got) != *tt.orig {
+				t.Errorf("Restore() restored %q, want %q", string(got), *tt.orig)
+			}
+			if _, err := os.Stat(path + resolvConfBackupSuffix); !errors.Is(err, os.ErrNotExist) {
+				t.Errorf("backup file was not removed: %v", err)
+			}
+		})
+	}
+}
+
+func ptr(s string) *string {
+	return &s
+}
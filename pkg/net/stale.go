@@ -0,0 +1,183 @@
+// Copyright 2023 Hedgehog
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package net
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/vishvananda/netlink"
+)
+
+// LinkAlias is the interface alias (ifalias) which is set on all network interfaces which were created by DAS BOOT.
+// It acts as a cookie so that a later run can tell apart its own leftovers from interfaces which belong to somebody else.
+const LinkAlias = "dasboot"
+
+// linkAliasParentMTU follows `LinkAlias` in the alias of VLAN interfaces for which the MTU of their parent interface
+// had to be raised. It is followed by the original MTU of the parent interface.
+const linkAliasParentMTU = " parent-mtu="
+
+// linkAlias returns the alias of a VLAN interface which we create. If `parentMTU` is not 0, it is recorded in the alias
+// as the original MTU of the parent interface. The alias lives as long as the interface, so it is available for the
+// process which deletes the interface, which often is not the one which created it (like a later stage).
+func linkAlias(parentMTU int) string {
+	if parentMTU == 0 {
+		return LinkAlias
+	}
+	return LinkAlias + linkAliasParentMTU + strconv.Itoa(parentMTU)
+}
+
+// parseLinkAlias returns if `alias` marks an interface as created by us, and the original MTU of its parent interface
+// if it was recorded in the alias
+func parseLinkAlias(alias string) (bool, int) {
+	if alias == LinkAlias {
+		return true, 0
+	}
+	mtuStr, ok := strings.CutPrefix(alias, LinkAlias+linkAliasParentMTU)
+	if !ok {
+		return false, 0
+	}
+	mtu, err := strconv.Atoi(mtuStr)
+	if err != nil || mtu <= 0 {
+		// it is still ours, but we do not know what to restore
+		return true, 0
+	}
+	return true, mtu
+}
+
+var ErrConflictingVLANDevice = errors.New("net: conflicting VLAN device")
+
+func conflictingVLANDeviceError(name string, reason string) error {
+	return fmt.Errorf("%w: %s: %s", ErrConflictingVLANDevice, name, reason)
+}
+
+// StaleNetworkState describes what was cleaned up by `ReconcileNetworkState`
+type StaleNetworkState struct {
+	// DeletedDevices are the names of the VLAN interfaces which were deleted
+	DeletedDevices []string `json:"deleted_devices,omitempty"`
+
+	// RemovedAddresses are the addresses which were removed from interfaces in the form of "address@interface"
+	RemovedAddresses []string `json:"removed_addresses,omitempty"`
+}
+
+// IsEmpty returns true if nothing had to be cleaned up
+func (s *StaleNetworkState) IsEmpty() bool {
+	return s == nil || (len(s.DeletedDevices) == 0 && len(s.RemovedAddresses) == 0)
+}
+
+// ReconcileNetworkState detects network configuration which was left behind by a previous DAS BOOT run - for example
+// if the installer crashed before it could reset the network - and cleans it up so that `device` can be configured
+// again. The following gets deleted:
+//   - all VLAN interfaces which carry the DAS BOOT `LinkAlias` cookie, restoring the MTU of their parent interface
+//   - a VLAN interface called `vlanName` with VLAN ID `vid` on top of `device` (created by a DAS BOOT version without the cookie)
+//   - the addresses in `ipaddrnets` on `device` itself
+//
+// If `vid` is not 0 and there is a VLAN interface which is in the way but which was not created by us (a different
+// VLAN interface called `vlanName`, or a VLAN interface with VLAN ID `vid` on top of `device`), it is left alone and
+// an error of type `ErrConflictingVLANDevice` is returned.
+func ReconcileNetworkState(device string, vid uint16, vlanName string, ipaddrnets []*net.IPNet) (*StaleNetworkState, error) {
+	ret := &StaleNetworkState{}
+
+	pl, err := netlinkLinkByName(device)
+	if err != nil {
+		return ret, fmt.Errorf("netlink: link by name: %w", err)
+	}
+	parentIndex := pl.Attrs().Index
+
+	links, err := netlinkLinkList()
+	if err != nil {
+		return ret, fmt.Errorf("netlink: link list: %w", err)
+	}
+	for _, link := range links {
+		attrs := link.Attrs()
+		vlan, isVLAN := link.(*netlink.Vlan)
+		if !isVLAN {
+			if vid > 0 && attrs.Name == vlanName {
+				return ret, conflictingVLANDeviceError(attrs.Name, fmt.Sprintf("interface exists and is of type '%s'", link.Type()))
+			}
+			continue
+		}
+
+		ours, parentMTU := parseLinkAlias(attrs.Alias)
+		if !ours && vid > 0 {
+			sameName := attrs.Name == vlanName
+			sameVLAN := attrs.ParentIndex == parentIndex && vlan.VlanId == int(vid)
+			switch {
+			case sameName && sameVLAN:
+				// this is what a previous run without the cookie would have left behind
+				ours = true
+			case sameName:
+				return ret, conflictingVLANDeviceError(attrs.Name, fmt.Sprintf("interface exists with VLAN ID %d on parent index %d", vlan.VlanId, attrs.ParentIndex))
+			case sameVLAN:
+				return ret, conflictingVLANDeviceError(attrs.Name, fmt.Sprintf("interface with VLAN ID %d on '%s' exists", vid, device))
+			}
+		}
+		if !ours {
+			continue
+		}
+
+		// deleting the link will also remove all its addresses and routes
+		if err := netlinkLinkDel(link); err != nil {
+			return ret, fmt.Errorf("netlink: link del '%s': %w", attrs.Name, err)
+		}
+		if parentMTU > 0 {
+			if err := restoreParentMTU(attrs.ParentIndex, parentMTU); err != nil {
+				return ret, fmt.Errorf("restoring parent MTU of '%s': %w", attrs.Name, err)
+			}
+		}
+		ret.DeletedDevices = append(ret.DeletedDevices, attrs.Name)
+	}
+
+	// addresses which are still on the parent device would either make adding them fail,
+	// or if we are configuring a VLAN interface, would make traffic leave on the wrong interface
+	if len(ipaddrnets) > 0 {
+		addrs, err := netlinkAddrList(pl, netlink.FAMILY_ALL)
+		if err != nil {
+			return ret, fmt.Errorf("netlink: addr list for '%s': %w", device, err)
+		}
+		for _, addr := range addrs {
+			if !containsIPNet(ipaddrnets, addr.IPNet) {
+				continue
+			}
+			addr := addr
+			if err := netlinkAddrDel(pl, &addr); err != nil {
+				return ret, fmt.Errorf("netlink: addr del '%s': %w", addr, err)
+			}
+			ret.RemovedAddresses = append(ret.RemovedAddresses, addr.IPNet.String()+"@"+device)
+		}
+	}
+
+	return ret, nil
+}
+
+func containsIPNet(ipnets []*net.IPNet, ipnet *net.IPNet) bool {
+	if ipnet == nil {
+		return false
+	}
+	for _, n := range ipnets {
+		if n == nil {
+			continue
+		}
+		nOnes, _ := n.Mask.Size()
+		ones, _ := ipnet.Mask.Size()
+		if n.IP.Equal(ipnet.IP) && nOnes == ones {
+			return true
+		}
+	}
+	return false
+}
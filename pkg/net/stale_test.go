@@ -0,0 +1,220 @@
+// Copyright 2023 Hedgehog
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package net
+
+import (
+	"errors"
+	"reflect"
+	"slices"
+	"testing"
+
+	"github.com/vishvananda/netlink"
+)
+
+func TestParseLinkAlias(t *testing.T) {
+	tests := []struct {
+		name          string
+		alias         string
+		wantOurs      bool
+		wantParentMTU int
+	}{
+		{name: "cookie", alias: "dasboot", wantOurs: true},
+		{name: "cookie with parent MTU", alias: linkAlias(1500), wantOurs: true, wantParentMTU: 1500},
+		{name: "cookie with invalid parent MTU", alias: "dasboot parent-mtu=large", wantOurs: true},
+		{name: "cookie with negative parent MTU", alias: "dasboot parent-mtu=-1", wantOurs: true},
+		{name: "no alias"},
+		{name: "alias of somebody else", alias: "uplink"},
+		{name: "alias starting with the cookie", alias: "dasboot2"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ours, parentMTU := parseLinkAlias(tt.alias)
+			if ours != tt.wantOurs {
+				t.Errorf("parseLinkAlias() ours = %v, want %v", ours, tt.wantOurs)
+			}
+			if parentMTU != tt.wantParentMTU {
+				t.Errorf("parseLinkAlias() parentMTU = %d, want %d", parentMTU, tt.wantParentMTU)
+			}
+		})
+	}
+}
+
+func TestReconcileNetworkState(t *testing.T) {
+	errDummy := errors.New("dummy error")
+	ipnets := mustIPNets(t, "192.168.42.101/24")
+	tests := []struct {
+		name        string
+		vid         uint16
+		parentMTU   int
+		pre         func(f *fakeNetlink)
+		addrs       []string
+		setMTUErr   error
+		want        *StaleNetworkState
+		wantLinks   []string
+		wantAddrs   []string
+		wantSetMTUs []int
+		wantErrToBe error
+	}{
+		{
+			name:      "nothing stale",
+			vid:       2,
+			pre:       func(f *fakeNetlink) { f.addVLAN("eth0.100", 100, "") },
+			addrs:     []string{"10.0.0.1/8"},
+			want:      &StaleNetworkState{},
+			wantLinks: []string{"eth0", "eth0.100"},
+			wantAddrs: []string{"10.0.0.1/8"},
+		},
+		{
+			name: "VLAN interfaces with the cookie",
+			vid:  2,
+			pre: func(f *fakeNetlink) {
+				f.addVLAN("eth0.5", 5, LinkAlias)
+				f.addVLAN("eth0.100", 100, "")
+			},
+			want:      &StaleNetworkState{DeletedDevices: []string{"eth0.5"}},
+			wantLinks: []string{"eth0", "eth0.100"},
+		},
+		{
+			name:      "VLAN interfaces with the cookie without a VLAN",
+			pre:       func(f *fakeNetlink) { f.addVLAN("eth0.5", 5, LinkAlias) },
+			want:      &StaleNetworkState{DeletedDevices: []string{"eth0.5"}},
+			wantLinks: []string{"eth0"},
+		},
+		{
+			name:        "VLAN interface with the cookie restores the parent MTU",
+			vid:         2,
+			parentMTU:   9000,
+			pre:         func(f *fakeNetlink) { f.addVLAN("eth0.2", 2, linkAlias(1500)) },
+			want:        &StaleNetworkState{DeletedDevices: []string{"eth0.2"}},
+			wantLinks:   []string{"eth0"},
+			wantSetMTUs: []int{1500},
+		},
+		{
+			name:        "restoring the parent MTU fails",
+			vid:         2,
+			parentMTU:   9000,
+			pre:         func(f *fakeNetlink) { f.addVLAN("eth0.2", 2, linkAlias(1500)) },
+			setMTUErr:   errDummy,
+			want:        &StaleNetworkState{},
+			wantLinks:   []string{"eth0"},
+			wantErrToBe: errDummy,
+		},
+		{
+			name:      "VLAN interface of a run without the cookie",
+			vid:       2,
+			pre:       func(f *fakeNetlink) { f.addVLAN("eth0.2", 2, "") },
+			want:      &StaleNetworkState{DeletedDevices: []string{"eth0.2"}},
+			wantLinks: []string{"eth0"},
+		},
+		{
+			name:      "VLAN interface without the cookie is left alone without a VLAN",
+			pre:       func(f *fakeNetlink) { f.addVLAN("eth0.2", 2, "") },
+			want:      &StaleNetworkState{},
+			wantLinks: []string{"eth0", "eth0.2"},
+		},
+		{
+			name:        "conflicting VLAN interface with the same name",
+			vid:         2,
+			pre:         func(f *fakeNetlink) { f.addVLAN("eth0.2", 3, "") },
+			want:        &StaleNetworkState{},
+			wantLinks:   []string{"eth0", "eth0.2"},
+			wantErrToBe: ErrConflictingVLANDevice,
+		},
+		{
+			name:        "conflicting VLAN interface with the same VLAN ID",
+			vid:         2,
+			pre:         func(f *fakeNetlink) { f.addVLAN("vlan2", 2, "") },
+			want:        &StaleNetworkState{},
+			wantLinks:   []string{"eth0", "vlan2"},
+			wantErrToBe: ErrConflictingVLANDevice,
+		},
+		{
+			name: "conflicting interface which is not a VLAN interface",
+			vid:  2,
+			pre: func(f *fakeNetlink) {
+				la := netlink.NewLinkAttrs()
+				la.Name = "eth0.2"
+				la.Index = 3
+				la.Alias = LinkAlias
+				f.links[la.Name] = &netlink.Dummy{LinkAttrs: la}
+			},
+			want:        &StaleNetworkState{},
+			wantLinks:   []string{"eth0", "eth0.2"},
+			wantErrToBe: ErrConflictingVLANDevice,
+		},
+		{
+			name: "interface which is not a VLAN interface is left alone without a VLAN",
+			pre: func(f *fakeNetlink) {
+				la := netlink.NewLinkAttrs()
+				la.Name = "eth0.2"
+				la.Index = 3
+				la.Alias = LinkAlias
+				f.links[la.Name] = &netlink.Dummy{LinkAttrs: la}
+			},
+			want:      &StaleNetworkState{},
+			wantLinks: []string{"eth0", "eth0.2"},
+		},
+		{
+			name:      "stale addresses on the parent interface",
+			addrs:     []string{"10.0.0.1/8", "192.168.42.101/24", "192.168.42.101/32", "192.168.42.102/24"},
+			want:      &StaleNetworkState{RemovedAddresses: []string{"192.168.42.101/24@eth0"}},
+			wantLinks: []string{"eth0"},
+			wantAddrs: []string{"10.0.0.1/8", "192.168.42.101/32", "192.168.42.102/24"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			parentMTU := tt.parentMTU
+			if parentMTU == 0 {
+				parentMTU = 1500
+			}
+			f := newFakeNetlink(t, parentMTU)
+			if tt.pre != nil {
+				tt.pre(f)
+			}
+			for _, ipnet := range mustIPNets(t, tt.addrs...) {
+				f.addrs = append(f.addrs, netlink.Addr{IPNet: ipnet})
+			}
+			f.setMTUErr = tt.setMTUErr
+
+			got, err := ReconcileNetworkState("eth0", tt.vid, "eth0.2", ipnets)
+			if !errors.Is(err, tt.wantErrToBe) {
+				t.Errorf("ReconcileNetworkState() error = %v, wantErrToBe %v", err, tt.wantErrToBe)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ReconcileNetworkState() = %#v, want %#v", got, tt.want)
+			}
+
+			var links []string
+			for name := range f.links {
+				links = append(links, name)
+			}
+			slices.Sort(links)
+			if !reflect.DeepEqual(links, tt.wantLinks) {
+				t.Errorf("links = %v, want %v", links, tt.wantLinks)
+			}
+			var addrs []string
+			for _, addr := range f.addrs {
+				addrs = append(addrs, addr.IPNet.String())
+			}
+			if !reflect.DeepEqual(addrs, tt.wantAddrs) {
+				t.Errorf("addresses = %v, want %v", addrs, tt.wantAddrs)
+			}
+			if !reflect.DeepEqual(f.setMTUs, tt.wantSetMTUs) {
+				t.Errorf("parent MTU set to %v, want %v", f.setMTUs, tt.wantSetMTUs)
+			}
+		})
+	}
+}
@@ -0,0 +1,122 @@
+// Copyright 2023 Hedgehog
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package url
+
+import (
+	"strings"
+)
+
+// This file contains the Hedgehog additions to this package. ONIE firmware passes on URLs
+// (e.g. in `onie_exec_url`) which are not valid according to RFC 3986 and RFC 6874 when the
+// installer was downloaded from an IPv6 link-local address. Variants which are seen in the wild:
+//
+//	http://[fe80::1%25eth0]/onie-installer       (valid)
+//	http://[fe80::1%eth0]/onie-installer         (zone not percent-encoded)
+//	http://fe80::1%eth0/onie-installer           (no brackets, zone not percent-encoded)
+//	http://fe80::1%25eth0:8080/onie-installer    (no brackets, with port)
+//
+// The helpers in this file parse all of these variants, and allow to rebuild standards compliant
+// URLs from them which can be used with the standard library.
+
+// ParseONIE parses a URL which was provided by ONIE. It handles all known broken variants of
+// IPv6 link-local hosts with zones as they are sent by ONIE firmware. The host of the returned
+// URL always uses brackets, and its zone can be retrieved with `Zone`.
+func ParseONIE(rawURL string) (*URL, error) {
+	return Parse(escapeONIEZone(strings.TrimSpace(rawURL)))
+}
+
+// NormalizeONIE parses a URL which was provided by ONIE with `ParseONIE`, and returns its
+// standards compliant string representation which can be parsed by the standard library.
+func NormalizeONIE(rawURL string) (string, error) {
+	u, err := ParseONIE(rawURL)
+	if err != nil {
+		return "", err
+	}
+	return u.String(), nil
+}
+
+// escapeONIEZone percent-encodes the zone delimiter in the authority of `rawURL` if it is not
+// encoded yet. Only the authority is touched, percent-encodings in the path or query are left alone.
+func escapeONIEZone(rawURL string) string {
+	schemeEnd := strings.Index(rawURL, "://")
+	if schemeEnd < 0 {
+		return rawURL
+	}
+	authorityStart := schemeEnd + 3
+	authorityEnd := len(rawURL)
+	if i := strings.IndexAny(rawURL[authorityStart:], "/?#"); i >= 0 {
+		authorityEnd = authorityStart + i
+	}
+	authority := rawURL[authorityStart:authorityEnd]
+	i := strings.Index(authority, "%")
+	if i < 0 || strings.HasPrefix(authority[i:], "%25") {
+		return rawURL
+	}
+	return rawURL[:authorityStart] + authority[:i] + "%25" + authority[i+1:] + rawURL[authorityEnd:]
+}
+
+// Zone returns the IPv6 zone of the host of `u`, which is the network interface for link-local
+// addresses. It returns an empty string if the host has no zone.
+func (u *URL) Zone() string {
+	return HostZone(u.Host)
+}
+
+// HostZone returns the IPv6 zone of `host` which can be in any of the forms `[addr%zone]:port`,
+// `[addr%25zone]`, or `addr%zone`. It returns an empty string if the host has no zone.
+func HostZone(host string) string {
+	if strings.HasPrefix(host, "[") {
+		if i := strings.LastIndex(host, "]"); i >= 0 {
+			host = host[1:i]
+		}
+	}
+	i := strings.Index(host, "%")
+	if i < 0 {
+		return ""
+	}
+	zone := host[i+1:]
+	if strings.HasPrefix(host[i:], "%25") {
+		zone = host[i+3:]
+	}
+	// hosts without brackets could still carry a port
+	if j := strings.LastIndex(zone, ":"); j >= 0 && validOptionalPort(zone[j:]) {
+		zone = zone[:j]
+	}
+	return zone
+}
+
+// HostWithZone returns `host` with its IPv6 zone set to `zone`. Any existing zone is replaced,
+// and the port is retained. The returned host is in the `[addr%zone]:port` form which is what the
+// `Host` field of a standard library URL expects. Hosts which are not IPv6 addresses are returned
+// unchanged.
+func HostWithZone(host, zone string) string {
+	addr, port := host, ""
+	if strings.HasPrefix(host, "[") {
+		i := strings.LastIndex(host, "]")
+		if i < 0 {
+			return host
+		}
+		addr, port = host[1:i], host[i+1:]
+	} else if strings.Count(host, ":") < 2 {
+		// hostnames and IPv4 addresses have no zones
+		return host
+	}
+	if i := strings.Index(addr, "%"); i >= 0 {
+		addr = addr[:i]
+	}
+	if zone == "" {
+		return "[" + addr + "]" + port
+	}
+	return "[" + addr + "%" + zone + "]" + port
+}
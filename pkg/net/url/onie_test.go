@@ -0,0 +1,199 @@
+// Copyright 2023 Hedgehog
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package url
+
+import (
+	nurl "net/url"
+	"testing"
+)
+
+func TestParseONIE(t *testing.T) {
+	tests := []struct {
+		name     string
+		rawURL   string
+		wantHost string
+		wantZone string
+		wantPort string
+		wantPath string
+		wantStr  string
+		wantErr  bool
+	}{
+		{
+			name:     "valid link-local URL",
+			rawURL:   "http://[fe80::4638:39ff:fe00:1%25eth0]/onie-installer-x86_64",
+			wantHost: "[fe80::4638:39ff:fe00:1%eth0]",
+			wantZone: "eth0",
+			wantPath: "/onie-installer-x86_64",
+			wantStr:  "http://[fe80::4638:39ff:fe00:1%25eth0]/onie-installer-x86_64",
+		},
+		{
+			name:     "zone not percent-encoded",
+			rawURL:   "http://[fe80::4638:39ff:fe00:1%eth0]/onie-installer-x86_64",
+			wantHost: "[fe80::4638:39ff:fe00:1%eth0]",
+			wantZone: "eth0",
+			wantPath: "/onie-installer-x86_64",
+			wantStr:  "http://[fe80::4638:39ff:fe00:1%25eth0]/onie-installer-x86_64",
+		},
+		{
+			name:     "no brackets and zone not percent-encoded",
+			rawURL:   "http://fe80::4638:39ff:fe00:1%eth0/onie-installer",
+			wantHost: "[fe80::4638:39ff:fe00:1%eth0]",
+			wantZone: "eth0",
+			wantPath: "/onie-installer",
+			wantStr:  "http://[fe80::4638:39ff:fe00:1%25eth0]/onie-installer",
+		},
+		{
+			name:     "no brackets with port",
+			rawURL:   "http://fe80::1%25eth0:8080/onie-installer",
+			wantHost: "[fe80::1%eth0]:8080",
+			wantZone: "eth0",
+			wantPort: "8080",
+			wantPath: "/onie-installer",
+			wantStr:  "http://[fe80::1%25eth0]:8080/onie-installer",
+		},
+		{
+			name:     "zone not percent-encoded with port and trailing whitespace",
+			rawURL:   "http://[fe80::1%eth1]:80/onie-updater-x86_64-dell_s5248f_c3538-r0 \n",
+			wantHost: "[fe80::1%eth1]:80",
+			wantZone: "eth1",
+			wantPort: "80",
+			wantPath: "/onie-updater-x86_64-dell_s5248f_c3538-r0",
+			wantStr:  "http://[fe80::1%25eth1]:80/onie-updater-x86_64-dell_s5248f_c3538-r0",
+		},
+		{
+			name:     "percent-encoding in the path is left alone",
+			rawURL:   "http://[fe80::1%eth0]/path%20with%20spaces",
+			wantHost: "[fe80::1%eth0]",
+			wantZone: "eth0",
+			wantPath: "/path with spaces",
+			wantStr:  "http://[fe80::1%25eth0]/path%20with%20spaces",
+		},
+		{
+			name:     "IPv4 host",
+			rawURL:   "http://192.168.1.1:8080/onie-installer",
+			wantHost: "192.168.1.1:8080",
+			wantPort: "8080",
+			wantPath: "/onie-installer",
+			wantStr:  "http://192.168.1.1:8080/onie-installer",
+		},
+		{
+			name:     "hostname",
+			rawURL:   "https://das-boot.hedgehog.svc/onie-installer",
+			wantHost: "das-boot.hedgehog.svc",
+			wantPath: "/onie-installer",
+			wantStr:  "https://das-boot.hedgehog.svc/onie-installer",
+		},
+		{
+			name:    "link-local without zone and without brackets",
+			rawURL:  "http://fe80::1/onie-installer",
+			wantErr: true,
+		},
+		{
+			name:    "invalid port",
+			rawURL:  "http://[fe80::1%eth0]:port/onie-installer",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			u, err := ParseONIE(tt.rawURL)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseONIE() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if u.Host != tt.wantHost {
+				t.Errorf("ParseONIE() host = %q, want %q", u.Host, tt.wantHost)
+			}
+			if got := u.Zone(); got != tt.wantZone {
+				t.Errorf("Zone() = %q, want %q", got, tt.wantZone)
+			}
+			if got := u.Port(); got != tt.wantPort {
+				t.Errorf("Port() = %q, want %q", got, tt.wantPort)
+			}
+			if u.Path != tt.wantPath {
+				t.Errorf("ParseONIE() path = %q, want %q", u.Path, tt.wantPath)
+			}
+
+			// the normalized URL must be parseable by the standard library, and result in the same host
+			str, err := NormalizeONIE(tt.rawURL)
+			if err != nil {
+				t.Fatalf("NormalizeONIE() error = %v", err)
+			}
+			if str != tt.wantStr {
+				t.Errorf("NormalizeONIE() = %q, want %q", str, tt.wantStr)
+			}
+			su, err := nurl.Parse(str)
+			if err != nil {
+				t.Fatalf("standard library failed to parse normalized URL: %v", err)
+			}
+			if su.Host != u.Host {
+				t.Errorf("standard library host = %q, want %q", su.Host, u.Host)
+			}
+		})
+	}
+}
+
+func TestHostZone(t *testing.T) {
+	tests := []struct {
+		host string
+		want string
+	}{
+		{host: "[fe80::1%eth0]", want: "eth0"},
+		{host: "[fe80::1%25eth0]:8080", want: "eth0"},
+		{host: "fe80::1%eth0", want: "eth0"},
+		{host: "fe80::1%eth0:8080", want: "eth0"},
+		{host: "[fe80::1]:8080", want: ""},
+		{host: "192.168.1.1:80", want: ""},
+		{host: "das-boot.hedgehog.svc", want: ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.host, func(t *testing.T) {
+			if got := HostZone(tt.host); got != tt.want {
+				t.Errorf("HostZone(%q) = %q, want %q", tt.host, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestHostWithZone(t *testing.T) {
+	tests := []struct {
+		host string
+		zone string
+		want string
+	}{
+		{host: "[fe80::1]", zone: "eth0", want: "[fe80::1%eth0]"},
+		{host: "[fe80::1]:8080", zone: "eth0", want: "[fe80::1%eth0]:8080"},
+		{host: "[fe80::1%eth1]:8080", zone: "eth0", want: "[fe80::1%eth0]:8080"},
+		{host: "fe80::1", zone: "Ethernet0", want: "[fe80::1%Ethernet0]"},
+		{host: "[fe80::1%eth1]", zone: "", want: "[fe80::1]"},
+		{host: "192.168.1.1:80", zone: "eth0", want: "192.168.1.1:80"},
+		{host: "das-boot.hedgehog.svc", zone: "eth0", want: "das-boot.hedgehog.svc"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.host+"/"+tt.zone, func(t *testing.T) {
+			got := HostWithZone(tt.host, tt.zone)
+			if got != tt.want {
+				t.Errorf("HostWithZone(%q, %q) = %q, want %q", tt.host, tt.zone, got, tt.want)
+			}
+			// the result must be usable with a standard library URL
+			u := &nurl.URL{Scheme: "http", Host: got, Path: "/stage0/ipam"}
+			if _, err := nurl.Parse(u.String()); err != nil {
+				t.Errorf("standard library failed to parse URL with host %q: %v", got, err)
+			}
+		})
+	}
+}
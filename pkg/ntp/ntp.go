@@ -32,41 +32,124 @@ var (
 	ErrNTPQueriesUnsuccessful = errors.New("ntp: all query attempts unsuccessful")
 	ErrUpdateSystemClock      = errors.New("ntp: updating system clock")
 	ErrHWClockSync            = errors.New("ntp: syncing system clock with hardware clock")
+	ErrSuspiciousOffset       = errors.New("ntp: suspicious clock offset")
 )
 
 func updateSystemClockError(err error) error {
 	return fmt.Errorf("%w: %w", ErrUpdateSystemClock, err)
 }
 
+// these can be swapped out for testing
 var (
 	syscallSettimeofday func(tv *syscall.Timeval) error = syscall.Settimeofday
+	ntpQueryWithOptions                                 = ntp.QueryWithOptions
 )
 
-func SyncClock(ctx context.Context, servers []string) error {
+// confirmationTolerance is the maximum difference between the clock offsets of the first and the confirmation
+// round for a suspicious offset to be accepted. The system clock is not touched between the rounds, so the
+// offsets must be almost identical if the servers agree.
+const confirmationTolerance = time.Second
+
+// SyncResult holds the measurements of the NTP query which was used to set the system clock
+type SyncResult struct {
+	// Server is the NTP server whose response was used
+	Server string
+
+	// Offset is the measured offset of the system clock to the time of the NTP server
+	Offset time.Duration
+
+	// Delay is the round-trip delay of the NTP query
+	Delay time.Duration
+
+	// Stratum is the stratum of the NTP server
+	Stratum uint8
+
+	// RootDistance is the estimated maximum error of the time of the NTP server
+	RootDistance time.Duration
+
+	// Confirmed is set if the offset exceeded the maximum acceptable offset, and a second round confirmed it
+	Confirmed bool
+
+	// ConfirmationServer is the NTP server which answered the confirmation round
+	ConfirmationServer string
+
+	// ConfirmationOffset is the offset measured in the confirmation round
+	ConfirmationOffset time.Duration
+}
+
+type syncOptions struct {
+	maxOffset time.Duration
+}
+
+// SyncOption is an option to SyncClock
+type SyncOption func(*syncOptions)
+
+// SyncOptionMaxOffset sets the maximum acceptable clock offset. An offset which is larger than that is treated as
+// suspicious, and the system clock only gets updated if a second query round confirms the offset. A value of 0
+// disables the check.
+func SyncOptionMaxOffset(d time.Duration) SyncOption {
+	return func(o *syncOptions) {
+		o.maxOffset = d
+	}
+}
+
+type measurement struct {
+	server string
+	resp   *ntp.Response
+}
+
+// SyncClock queries the NTP `servers` and sets the system clock from the first response. It additionally syncs
+// the hardware clock if it deviates too much from the new system time. The returned result holds the
+// measurements of the query even if setting the clock failed.
+func SyncClock(ctx context.Context, servers []string, opts ...SyncOption) (*SyncResult, error) {
+	var o syncOptions
+	for _, opt := range opts {
+		opt(&o)
+	}
+
 	// validate servers
 	if len(servers) == 0 {
-		return ErrNoServers
+		return nil, ErrNoServers
 	}
 
 	// fire away an NTP query
-	ch := make(chan *time.Time)
+	ch := make(chan *measurement)
 	defer close(ch)
-	var t *time.Time
-	for i := 0; i < 3; i++ {
-		t = queryAttempt(ctx, servers, ch)
-		if t != nil {
-			break
-		}
+	m := queryRounds(ctx, servers, ch)
+	if m == nil {
+		return nil, ErrNTPQueriesUnsuccessful
 	}
-	if t == nil {
-		return ErrNTPQueriesUnsuccessful
+	ret := &SyncResult{
+		Server:       m.server,
+		Offset:       m.resp.ClockOffset,
+		Delay:        m.resp.RTT,
+		Stratum:      m.resp.Stratum,
+		RootDistance: m.resp.RootDistance,
+	}
+
+	// an offset beyond the maximum acceptable offset must be confirmed by a second round
+	// before we trust it enough to set the clock
+	if o.maxOffset > 0 && abs(m.resp.ClockOffset) > o.maxOffset {
+		log.L().Warn("Clock offset exceeds maximum acceptable offset, running confirmation round", zap.String("server", m.server), zap.Duration("offset", m.resp.ClockOffset), zap.Duration("maxOffset", o.maxOffset))
+		c := queryRounds(ctx, servers, ch)
+		if c == nil {
+			return ret, fmt.Errorf("%w: offset %s exceeds %s: confirmation round unsuccessful", ErrSuspiciousOffset, m.resp.ClockOffset, o.maxOffset)
+		}
+		ret.ConfirmationServer = c.server
+		ret.ConfirmationOffset = c.resp.ClockOffset
+		if diff := abs(c.resp.ClockOffset - m.resp.ClockOffset); diff > confirmationTolerance {
+			return ret, fmt.Errorf("%w: offset %s from %s exceeds %s, and confirmation offset %s from %s deviates by %s", ErrSuspiciousOffset, m.resp.ClockOffset, m.server, o.maxOffset, c.resp.ClockOffset, c.server, diff)
+		}
+		ret.Confirmed = true
+		m = c
 	}
 
 	// now set the system clock
-	tv := TimevalFromTime(t)
-	log.L().Info("Updating system time with time from NTP server", zap.Timep("ntp", t), zap.Time("systemTime", time.Now()))
+	t := time.Now().Add(m.resp.ClockOffset)
+	tv := TimevalFromTime(&t)
+	log.L().Info("Updating system time with time from NTP server", zap.String("server", m.server), zap.Time("ntp", t), zap.Time("systemTime", time.Now()), zap.Duration("offset", m.resp.ClockOffset), zap.Duration("delay", m.resp.RTT), zap.Uint8("stratum", m.resp.Stratum))
 	if err := syscallSettimeofday(tv); err != nil {
-		return updateSystemClockError(err)
+		return ret, updateSystemClockError(err)
 	}
 
 	// check if we need to set the hardware clock
@@ -76,24 +159,24 @@ func SyncClock(ctx context.Context, servers []string) error {
 	if err != nil {
 		log.L().Warn("failed to open RTC", zap.Error(err))
 	}
-	defer rtc.Close()
 	if rtc != nil {
+		defer rtc.Close()
 		hardwareTime, err := rtc.Read()
 		if err != nil {
 			log.L().Warn("failed to read time from RTC", zap.Error(err))
 		}
 		if hardwareTime != nil {
-			deviation := abs(hardwareTime.Sub(*t))
+			deviation := abs(hardwareTime.Sub(t))
 			if deviation > (30 * time.Second) {
 				log.L().Info("Trying to sync hardware clock with new system time because the clock deviation is too large", zap.Duration("deviation", deviation))
-				if err := rtc.Set(t); err != nil {
+				if err := rtc.Set(&t); err != nil {
 					log.L().Error("failed to set hardware clock to new time", zap.Error(err))
 				}
 			}
 		}
 	}
 
-	return nil
+	return ret, nil
 }
 
 func abs(d time.Duration) time.Duration {
@@ -103,25 +186,34 @@ func abs(d time.Duration) time.Duration {
 	return -d
 }
 
-func queryAttempt(ctx context.Context, servers []string, ch chan *time.Time) *time.Time {
+func queryRounds(ctx context.Context, servers []string, ch chan *measurement) *measurement {
+	for i := 0; i < 3; i++ {
+		if m := queryAttempt(ctx, servers, ch); m != nil {
+			return m
+		}
+	}
+	return nil
+}
+
+func queryAttempt(ctx context.Context, servers []string, ch chan *measurement) *measurement {
 	attemptCtx, cancel := context.WithTimeout(ctx, time.Second*5)
 	defer cancel()
 	go queryTimeFromServers(attemptCtx, servers, ch)
 	select {
-	case t := <-ch:
-		return t
+	case m := <-ch:
+		return m
 	case <-attemptCtx.Done():
 		return nil
 	}
 }
 
-func queryTimeFromServers(ctx context.Context, servers []string, ch chan<- *time.Time) {
+func queryTimeFromServers(ctx context.Context, servers []string, ch chan<- *measurement) {
 	for _, server := range servers {
 		go queryTimeFromServer(ctx, server, ch)
 	}
 }
 
-func queryTimeFromServer(ctx context.Context, server string, ch chan<- *time.Time) {
+func queryTimeFromServer(ctx context.Context, server string, ch chan<- *measurement) {
 	defer func() {
 		// this recovers from the problem that the channel might be closed
 		// which is expected if this is not the first responding server
@@ -138,7 +230,7 @@ func queryTimeFromServer(ctx context.Context, server string, ch chan<- *time.Tim
 	}
 
 	// execute NTP query
-	r, err := ntp.QueryWithOptions(server, ntp.QueryOptions{
+	r, err := ntpQueryWithOptions(server, ntp.QueryOptions{
 		Timeout: timeout,
 		Version: 4,
 	})
@@ -148,6 +240,9 @@ func queryTimeFromServer(ctx context.Context, server string, ch chan<- *time.Tim
 	}
 
 	// write to channel
-	t := time.Now().Add(r.ClockOffset)
-	ch <- &t
+	// if the attempt was already given up on, there is nobody listening anymore
+	select {
+	case ch <- &measurement{server: server, resp: r}:
+	case <-ctx.Done():
+	}
 }
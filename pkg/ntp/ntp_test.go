@@ -19,10 +19,12 @@ import (
 	"errors"
 	"fmt"
 	"os"
+	"reflect"
 	"syscall"
 	"testing"
 	"time"
 
+	"github.com/beevik/ntp"
 	"golang.org/x/sys/unix"
 )
 
@@ -184,7 +186,7 @@ func TestSyncClock(t *testing.T) {
 				}()
 				osOpen = tt.osOpen
 			}
-			err := SyncClock(ctx, tt.args.servers)
+			_, err := SyncClock(ctx, tt.args.servers)
 			if (err != nil) != tt.wantErr {
 				t.Errorf("SyncClock() error = %v, wantErr %v", err, tt.wantErr)
 				return
@@ -198,3 +200,118 @@ func TestSyncClock(t *testing.T) {
 		})
 	}
 }
+
+func TestSyncClockMaxOffset(t *testing.T) {
+	// queries return the offsets in order, and the last one for all further queries
+	queries := func(offsets ...time.Duration) func(string, ntp.QueryOptions) (*ntp.Response, error) {
+		var i int
+		return func(string, ntp.QueryOptions) (*ntp.Response, error) {
+			offset := offsets[i]
+			if i < len(offsets)-1 {
+				i++
+			}
+			return &ntp.Response{ClockOffset: offset, RTT: 10 * time.Millisecond, Stratum: 2}, nil
+		}
+	}
+	tests := []struct {
+		name        string
+		maxOffset   time.Duration
+		query       func(string, ntp.QueryOptions) (*ntp.Response, error)
+		want        *SyncResult
+		wantErr     bool
+		wantErrToBe error
+		wantSet     bool
+	}{
+		{
+			name:      "offset within limit",
+			maxOffset: time.Minute,
+			query:     queries(5 * time.Second),
+			want: &SyncResult{
+				Server:  "ntp.example.com",
+				Offset:  5 * time.Second,
+				Delay:   10 * time.Millisecond,
+				Stratum: 2,
+			},
+			wantSet: true,
+		},
+		{
+			name:      "no limit",
+			maxOffset: 0,
+			query:     queries(-24 * time.Hour),
+			want: &SyncResult{
+				Server:  "ntp.example.com",
+				Offset:  -24 * time.Hour,
+				Delay:   10 * time.Millisecond,
+				Stratum: 2,
+			},
+			wantSet: true,
+		},
+		{
+			name:      "offset beyond limit confirmed",
+			maxOffset: time.Minute,
+			query:     queries(24*time.Hour, 24*time.Hour+200*time.Millisecond),
+			want: &SyncResult{
+				Server:             "ntp.example.com",
+				Offset:             24 * time.Hour,
+				Delay:              10 * time.Millisecond,
+				Stratum:            2,
+				Confirmed:          true,
+				ConfirmationServer: "ntp.example.com",
+				ConfirmationOffset: 24*time.Hour + 200*time.Millisecond,
+			},
+			wantSet: true,
+		},
+		{
+			name:      "offset beyond limit not confirmed",
+			maxOffset: time.Minute,
+			query:     queries(24*time.Hour, 3*time.Second),
+			want: &SyncResult{
+				Server:             "ntp.example.com",
+				Offset:             24 * time.Hour,
+				Delay:              10 * time.Millisecond,
+				Stratum:            2,
+				ConfirmationServer: "ntp.example.com",
+				ConfirmationOffset: 3 * time.Second,
+			},
+			wantErr:     true,
+			wantErrToBe: ErrSuspiciousOffset,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			oldNtpQueryWithOptions := ntpQueryWithOptions
+			oldSyscallSettimeofday := syscallSettimeofday
+			oldOsOpen := osOpen
+			defer func() {
+				ntpQueryWithOptions = oldNtpQueryWithOptions
+				syscallSettimeofday = oldSyscallSettimeofday
+				osOpen = oldOsOpen
+			}()
+			ntpQueryWithOptions = tt.query
+			var set bool
+			syscallSettimeofday = func(tv *syscall.Timeval) error {
+				set = true
+				return nil
+			}
+			osOpen = func(name string) (*os.File, error) {
+				return nil, os.ErrNotExist
+			}
+
+			got, err := SyncClock(context.Background(), []string{"ntp.example.com"}, SyncOptionMaxOffset(tt.maxOffset))
+			if (err != nil) != tt.wantErr {
+				t.Errorf("SyncClock() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if err != nil && tt.wantErrToBe != nil && !errors.Is(err, tt.wantErrToBe) {
+				t.Errorf("SyncClock() error = %v, wantErrToBe %v", err, tt.wantErrToBe)
+				return
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("SyncClock() = %#v, want %#v", got, tt.want)
+			}
+			if set != tt.wantSet {
+				t.Errorf("SyncClock() set system clock = %v, want %v", set, tt.wantSet)
+			}
+		})
+	}
+}
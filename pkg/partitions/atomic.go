@@ -0,0 +1,109 @@
+// Copyright 2023 Hedgehog
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package partitions
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path"
+	"slices"
+	"strings"
+)
+
+// TempSuffix is appended to the name of a file while it is being written by
+// WriteFileAtomic. Files with this suffix are leftovers of interrupted writes.
+const TempSuffix = ".tmp"
+
+// IsTempFile returns true if `name` is a temporary file of an atomic write
+func IsTempFile(name string) bool {
+	return strings.HasSuffix(name, TempSuffix)
+}
+
+// File is the content of a single file which is being written by WriteFilesAtomic
+type File struct {
+	Name string
+	Data []byte
+}
+
+// syncer is implemented by files which can be flushed to stable storage, like *os.File
+type syncer interface {
+	Sync() error
+}
+
+// WriteFileAtomic writes `data` to the file `name` on `fsys` in a crash-consistent way. See
+// WriteFilesAtomic for details.
+func WriteFileAtomic(fsys FS, name string, data []byte, perm fs.FileMode) error {
+	return WriteFilesAtomic(fsys, perm, File{Name: name, Data: data})
+}
+
+// WriteFilesAtomic writes all `files` on `fsys` in a crash-consistent way: every file is first written
+// to a temporary file next to it and synced to disk. Only once all temporary files were written
+// successfully, they are renamed over their destinations, and the directories are synced.
+// Power loss at any point leaves every destination file either with its old or its new content,
+// but never truncated or partially written. Temporary files are removed on errors.
+func WriteFilesAtomic(fsys FS, perm fs.FileMode, files ...File) error {
+	written := make([]string, 0, len(files))
+	removeTemps := func(names []string) {
+		for _, name := range names {
+			fsys.Remove(name + TempSuffix) //nolint: errcheck
+		}
+	}
+	for _, file := range files {
+		if err := writeTempFile(fsys, file.Name+TempSuffix, file.Data, perm); err != nil {
+			removeTemps(append(written, file.Name))
+			return err
+		}
+		written = append(written, file.Name)
+	}
+
+	var dirs []string
+	for i, name := range written {
+		if err := fsys.Rename(name+TempSuffix, name); err != nil {
+			removeTemps(written[i:])
+			return err
+		}
+		dir := path.Dir(name)
+		if !slices.Contains(dirs, dir) {
+			dirs = append(dirs, dir)
+		}
+	}
+
+	var errs []error
+	for _, dir := range dirs {
+		if err := fsys.SyncDir(dir); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func writeTempFile(fsys FS, name string, data []byte, perm fs.FileMode) error {
+	f, err := fsys.OpenFile(name, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, perm)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if s, ok := f.(syncer); ok {
+		if err := s.Sync(); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	return f.Close()
+}
@@ -0,0 +1,181 @@
+// Copyright 2023 Hedgehog
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package partitions
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/golang/mock/gomock"
+
+	"go.githedgehog.com/dasboot/test/mock/mockio"
+	"go.githedgehog.com/dasboot/test/mock/mockpartitions"
+)
+
+func TestWriteFilesAtomic(t *testing.T) {
+	errFailure := errors.New("failure")
+	const flags = os.O_CREATE | os.O_TRUNC | os.O_WRONLY
+	files := []File{
+		{Name: "/location/uuid", Data: []byte("uuid")},
+		{Name: "/location/uuid.sig", Data: []byte("sig")},
+	}
+	expectWrite := func(ctrl *gomock.Controller, mfs *mockpartitions.MockFS, name string, data []byte, writeErr error) {
+		f := mockio.NewMockReadWriteCloser(ctrl)
+		mfs.EXPECT().OpenFile(gomock.Eq(name+TempSuffix), gomock.Eq(flags), gomock.Eq(fs.FileMode(0644))).Times(1).Return(f, nil)
+		if writeErr != nil {
+			f.EXPECT().Write(gomock.Eq(data)).Times(1).Return(0, writeErr)
+		} else {
+			f.EXPECT().Write(gomock.Eq(data)).Times(1).Return(len(data), nil)
+		}
+		f.EXPECT().Close().Times(1).Return(nil)
+	}
+
+	// Every step of an atomic write can be interrupted. The mock FS fails the test on any unexpected call,
+	// so these cases also ensure that the destination files are never opened or truncated directly.
+	tests := []struct {
+		name    string
+		wantErr error
+		pre     func(ctrl *gomock.Controller, mfs *mockpartitions.MockFS)
+	}{
+		{
+			name: "success",
+			pre: func(ctrl *gomock.Controller, mfs *mockpartitions.MockFS) {
+				expectWrite(ctrl, mfs, files[0].Name, files[0].Data, nil)
+				expectWrite(ctrl, mfs, files[1].Name, files[1].Data, nil)
+				gomock.InOrder(
+					mfs.EXPECT().Rename(gomock.Eq(files[0].Name+TempSuffix), gomock.Eq(files[0].Name)).Times(1).Return(nil),
+					mfs.EXPECT().Rename(gomock.Eq(files[1].Name+TempSuffix), gomock.Eq(files[1].Name)).Times(1).Return(nil),
+					mfs.EXPECT().SyncDir(gomock.Eq("/location")).Times(1).Return(nil),
+				)
+			},
+		},
+		{
+			name:    "opening first temporary file fails",
+			wantErr: errFailure,
+			pre: func(ctrl *gomock.Controller, mfs *mockpartitions.MockFS) {
+				mfs.EXPECT().OpenFile(gomock.Eq(files[0].Name+TempSuffix), gomock.Eq(flags), gomock.Eq(fs.FileMode(0644))).Times(1).Return(nil, errFailure)
+				mfs.EXPECT().Remove(gomock.Eq(files[0].Name + TempSuffix)).Times(1).Return(os.ErrNotExist)
+			},
+		},
+		{
+			name:    "writing second temporary file fails",
+			wantErr: errFailure,
+			pre: func(ctrl *gomock.Controller, mfs *mockpartitions.MockFS) {
+				expectWrite(ctrl, mfs, files[0].Name, files[0].Data, nil)
+				expectWrite(ctrl, mfs, files[1].Name, files[1].Data, errFailure)
+				mfs.EXPECT().Remove(gomock.Eq(files[0].Name + TempSuffix)).Times(1).Return(nil)
+				mfs.EXPECT().Remove(gomock.Eq(files[1].Name + TempSuffix)).Times(1).Return(nil)
+			},
+		},
+		{
+			name:    "closing temporary file fails",
+			wantErr: errFailure,
+			pre: func(ctrl *gomock.Controller, mfs *mockpartitions.MockFS) {
+				f := mockio.NewMockReadWriteCloser(ctrl)
+				mfs.EXPECT().OpenFile(gomock.Eq(files[0].Name+TempSuffix), gomock.Eq(flags), gomock.Eq(fs.FileMode(0644))).Times(1).Return(f, nil)
+				f.EXPECT().Write(gomock.Eq(files[0].Data)).Times(1).Return(len(files[0].Data), nil)
+				f.EXPECT().Close().Times(1).Return(errFailure)
+				mfs.EXPECT().Remove(gomock.Eq(files[0].Name + TempSuffix)).Times(1).Return(nil)
+			},
+		},
+		{
+			name:    "renaming second file fails",
+			wantErr: errFailure,
+			pre: func(ctrl *gomock.Controller, mfs *mockpartitions.MockFS) {
+				expectWrite(ctrl, mfs, files[0].Name, files[0].Data, nil)
+				expectWrite(ctrl, mfs, files[1].Name, files[1].Data, nil)
+				mfs.EXPECT().Rename(gomock.Eq(files[0].Name+TempSuffix), gomock.Eq(files[0].Name)).Times(1).Return(nil)
+				mfs.EXPECT().Rename(gomock.Eq(files[1].Name+TempSuffix), gomock.Eq(files[1].Name)).Times(1).Return(errFailure)
+				// only the file which was not moved into place is removed
+				mfs.EXPECT().Remove(gomock.Eq(files[1].Name + TempSuffix)).Times(1).Return(nil)
+			},
+		},
+		{
+			name:    "syncing directory fails",
+			wantErr: errFailure,
+			pre: func(ctrl *gomock.Controller, mfs *mockpartitions.MockFS) {
+				expectWrite(ctrl, mfs, files[0].Name, files[0].Data, nil)
+				expectWrite(ctrl, mfs, files[1].Name, files[1].Data, nil)
+				mfs.EXPECT().Rename(gomock.Eq(files[0].Name+TempSuffix), gomock.Eq(files[0].Name)).Times(1).Return(nil)
+				mfs.EXPECT().Rename(gomock.Eq(files[1].Name+TempSuffix), gomock.Eq(files[1].Name)).Times(1).Return(nil)
+				mfs.EXPECT().SyncDir(gomock.Eq("/location")).Times(1).Return(errFailure)
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			defer ctrl.Finish()
+			mfs := mockpartitions.NewMockFS(ctrl)
+			tt.pre(ctrl, mfs)
+			err := WriteFilesAtomic(mfs, 0644, files...)
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("WriteFilesAtomic() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestWriteFileAtomicOS(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.Mkdir(filepath.Join(dir, "identity"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	fsys := NewFS(dir)
+	for _, content := range []string{"first", "second"} {
+		if err := WriteFileAtomic(fsys, "/identity/client.crt", []byte(content), 0644); err != nil {
+			t.Fatalf("WriteFileAtomic() error = %v", err)
+		}
+		b, err := os.ReadFile(filepath.Join(dir, "identity", "client.crt"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(b) != content {
+			t.Errorf("content = %q, want %q", string(b), content)
+		}
+	}
+	entries, err := os.ReadDir(filepath.Join(dir, "identity"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Errorf("directory contains %d entries, want only the destination file", len(entries))
+	}
+
+	// a failed write must leave the previous content intact
+	if err := WriteFilesAtomic(fsys, 0644,
+		File{Name: "/identity/client.crt", Data: []byte("third")},
+		File{Name: "/missing/client.key", Data: []byte("key")},
+	); err == nil {
+		t.Fatalf("WriteFilesAtomic() into missing directory succeeded")
+	}
+	b, err := os.ReadFile(filepath.Join(dir, "identity", "client.crt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != "second" {
+		t.Errorf("content after failed write = %q, want %q", string(b), "second")
+	}
+	if _, err := os.Stat(filepath.Join(dir, "identity", "client.crt"+TempSuffix)); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("temporary file was not removed after failed write: %v", err)
+	}
+
+	if err := WriteFileAtomic(NewFS(""), "/identity/client.crt", nil, 0644); !errors.Is(err, ErrNotMounted) {
+		t.Errorf("WriteFileAtomic() on unmounted FS error = %v, want %v", err, ErrNotMounted)
+	}
+}
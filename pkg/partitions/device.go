@@ -19,12 +19,15 @@ import (
 	"errors"
 	"fmt"
 	"os"
+	osexec "os/exec"
 	"path/filepath"
 	"strconv"
 	"strings"
 
 	"go.githedgehog.com/dasboot/pkg/exec"
+	"go.githedgehog.com/dasboot/pkg/log"
 
+	"go.uber.org/zap"
 	"golang.org/x/sys/unix"
 )
 
@@ -34,15 +37,28 @@ type Device struct {
 	Path        string
 	MountPath   string
 	Filesystem  string
-	GPTPartType string
+	GPTPartType PartType
 	FSLabel     string
+	FSUUID      string
 	Disk        *Device
 	Partitions  []*Device
 	FS          FS
+
+	// MapperPath is the device mapper device of the unlocked LUKS container of this device (see `OpenLUKS`).
+	// If it is set, the filesystem lives on it instead of on `Path`.
+	MapperPath string
+
+	// topology is cached as it requires quite a few reads from sysfs
+	topology *Topology
 }
 
 const (
-	FSExt4 = "ext4"
+	FSExt2     = "ext2"
+	FSExt3     = "ext3"
+	FSExt4     = "ext4"
+	FSXFS      = "xfs"
+	FSVFAT     = "vfat"
+	FSSquashfs = "squashfs"
 
 	FSLabelONIE             = "ONIE-BOOT"
 	FSLabelSONiC            = "SONiC-OS"
@@ -54,18 +70,13 @@ const (
 	GPTPartNameHedgehogIdentity = "HEDGEHOG_IDENTITY"
 	GPTPartNameHedgehogLocation = "HEDGEHOG_LOCATION"
 
-	GPTPartTypeONIE             = "7412f7d5-a156-4b13-81dc-867174929325"
-	GPTPartTypeEFI              = "c12a7328-f81f-11d2-ba4b-00a0c93ec93b"
-	GPTPartTypeHedgehogIdentity = "e982e2bd-867c-4d7a-89a2-9c5a9bc5dfdd"
-	GPTPartTypeHedgehogLocation = "e23c5ebc-5f53-488c-959d-a4ab90befefe"
-
 	MountPathHedgehogIdentity = "/mnt/hedgehog-identity"
 	MountPathHedgehogLocation = "/mnt/hedgehog-location"
 	MountPathSonic            = "/mnt/sonic"
 
 	DefaultPartSizeHedgehogIdentityInMB int = 100
 
-	blkrrpart = 0x125f //nolint: unused
+	blkrrpart = 0x125f
 )
 
 var (
@@ -123,22 +134,64 @@ func (d *Device) ensureDevicePath() error {
 	return nil
 }
 
+// GetDeviceName returns the kernel name of the device like "sda3", "nvme0n1p3" or "mmcblk0p3". It falls back
+// to the name of its sysfs directory if the uevent has no DEVNAME entry.
+func (d *Device) GetDeviceName() string {
+	if name := d.Uevent.GetDeviceName(); name != "" {
+		return name
+	}
+	if d.SysfsPath != "" {
+		return filepath.Base(d.SysfsPath)
+	}
+	return ""
+}
+
+// PartitionDeviceName returns the kernel name of partition `partNum` of this disk
+func (d *Device) PartitionDeviceName(partNum int) string {
+	return PartitionDeviceName(d.GetDeviceName(), partNum)
+}
+
+// isRemovable returns true if the kernel flags the disk as removable, like USB sticks and SD cards
+func (d *Device) isRemovable() bool {
+	if d.SysfsPath == "" {
+		return false
+	}
+	return readSysfsAttr(filepath.Join(d.SysfsPath, "removable")) == "1"
+}
+
 func (d *Device) discoverPartitionType() error {
 	if d.Path == "" {
 		return ErrNoDeviceNode
 	}
 	out, err := exec.Command("grub-probe", "-d", d.Path, "-t", "gpt_parttype").Output()
 	if err != nil {
-		return fmt.Errorf("device: grub-probe gpt_parttype: %w", err)
+		return fmt.Errorf("device: grub-probe gpt_parttype: %w", toolError(ToolGrubProbe, err))
 	}
-	d.GPTPartType = strings.TrimSpace(strings.ToLower(string(out)))
+	d.GPTPartType = normalizePartType(string(out))
 	return nil
 }
 
+// fsPath returns the device node which holds the filesystem of the device
+func (d *Device) fsPath() string {
+	if d.MapperPath != "" {
+		return d.MapperPath
+	}
+	return d.Path
+}
+
 func (d *Device) discoverFilesystem() error {
 	if d.Path == "" {
 		return ErrNoDeviceNode
 	}
+	if probeFilesystemNatively {
+		info, err := d.probeFilesystem()
+		if err == nil {
+			d.Filesystem = info.Type
+			d.FSUUID = info.UUID
+			return nil
+		}
+		log.L().Debug("native filesystem probing failed, falling back to grub-probe", zap.String("device", d.fsPath()), zap.Error(err))
+	}
 	// NOTE: grub-probe actually does not distinguish between ext2/ext3/ext4.
 	// Technically they all have the same superblock magic which is why they
 	// are being picked up as the same filesystem.
@@ -146,9 +199,9 @@ func (d *Device) discoverFilesystem() error {
 	// ext2 kernel driver.
 	// The filesystems only distinguish themselves by the set of features.
 	// This is not really a problem for us right now
-	out, err := exec.Command("grub-probe", "-d", d.Path, "-t", "fs").Output()
+	out, err := exec.Command("grub-probe", "-d", d.fsPath(), "-t", "fs").Output()
 	if err != nil {
-		return fmt.Errorf("device: grub-probe fs: %w", err)
+		return fmt.Errorf("device: grub-probe fs: %w", toolError(ToolGrubProbe, err))
 	}
 	d.Filesystem = strings.TrimSpace(string(out))
 	return nil
@@ -158,9 +211,17 @@ func (d *Device) discoverFilesystemLabel() error {
 	if d.Path == "" {
 		return ErrNoDeviceNode
 	}
-	out, err := exec.Command("grub-probe", "-d", d.Path, "-t", "fs_label").Output()
+	if probeFilesystemNatively {
+		info, err := d.probeFilesystem()
+		if err == nil {
+			d.FSLabel = info.Label
+			return nil
+		}
+		log.L().Debug("native filesystem probing failed, falling back to grub-probe", zap.String("device", d.fsPath()), zap.Error(err))
+	}
+	out, err := exec.Command("grub-probe", "-d", d.fsPath(), "-t", "fs_label").Output()
 	if err != nil {
-		return fmt.Errorf("device: grub-probe fs_label: %w", err)
+		return fmt.Errorf("device: grub-probe fs_label: %w", toolError(ToolGrubProbe, err))
 	}
 	d.FSLabel = strings.TrimSpace(string(out))
 	return nil
@@ -169,42 +230,42 @@ func (d *Device) discoverFilesystemLabel() error {
 func (d *Device) IsEFIPartition() bool {
 	if d.IsPartition() {
 		// the labels for the EFI system partition or filesystem vary from OS to OS, the only reliable indicator is the partition type
-		return d.GPTPartType == GPTPartTypeEFI
+		return d.GPTPartType.IsEFI()
 	}
 	return false
 }
 
 func (d *Device) IsONIEPartition() bool {
 	if d.IsPartition() {
-		return d.GPTPartType == GPTPartTypeONIE || d.GetPartitionName() == GPTPartNameONIE || d.FSLabel == FSLabelONIE
+		return d.GPTPartType.IsONIE() || d.GetPartitionName() == GPTPartNameONIE || d.FSLabel == FSLabelONIE
 	}
 	return false
 }
 
 func (d *Device) IsSonicPartition() bool {
 	if d.IsPartition() {
-		return d.FSLabel == FSLabelSONiC || d.GetPartitionName() == GPTPartNameSONiC
+		return d.GPTPartType.IsNOS() || d.FSLabel == FSLabelSONiC || d.GetPartitionName() == GPTPartNameSONiC
 	}
 	return false
 }
 
 func (d *Device) IsDiagPartition() bool {
 	if d.IsPartition() {
-		return strings.HasSuffix(d.GetPartitionName(), "-DIAG") || strings.HasSuffix(d.GetPartitionName(), "-diag") || strings.HasSuffix(d.FSLabel, "-DIAG") || strings.HasSuffix(d.FSLabel, "-diag")
+		return d.GPTPartType.IsDiag() || strings.HasSuffix(d.GetPartitionName(), "-DIAG") || strings.HasSuffix(d.GetPartitionName(), "-diag") || strings.HasSuffix(d.FSLabel, "-DIAG") || strings.HasSuffix(d.FSLabel, "-diag")
 	}
 	return false
 }
 
 func (d *Device) IsHedgehogIdentityPartition() bool {
 	if d.IsPartition() {
-		return d.GPTPartType == GPTPartTypeHedgehogIdentity || d.GetPartitionName() == GPTPartNameHedgehogIdentity || d.FSLabel == FSLabelHedgehogIdentity
+		return d.GPTPartType.IsHedgehogIdentity() || d.GetPartitionName() == GPTPartNameHedgehogIdentity || d.FSLabel == FSLabelHedgehogIdentity
 	}
 	return false
 }
 
 func (d *Device) IsHedgehogLocationPartition() bool {
 	if d.IsPartition() {
-		return d.GPTPartType == GPTPartTypeHedgehogLocation || d.GetPartitionName() == GPTPartNameHedgehogLocation || d.FSLabel == FSLabelHedgehogLocation
+		return d.GPTPartType.IsHedgehogLocation() || d.GetPartitionName() == GPTPartNameHedgehogLocation || d.FSLabel == FSLabelHedgehogLocation
 	}
 	return false
 }
@@ -214,11 +275,10 @@ func (d *Device) Delete() error {
 		return ErrDeviceNotPartition
 	}
 
-	// build a command to call sgdisk
 	// get the partition number
-	partNum := d.GetPartitionNumber()
-	if partNum <= 0 {
-		return ErrInvalidUevent
+	partNum, err := d.GetPartitionNumber()
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrInvalidUevent, err)
 	}
 
 	// and the device path of the disk (NOT the partition)
@@ -230,8 +290,14 @@ func (d *Device) Delete() error {
 		return ErrNoDeviceNode
 	}
 
+	if err := disk.updateNativeGPT(func(g *GPT) error { return g.Delete(partNum) }); !fallBackFromNativeGPT(disk, "delete", err) {
+		if err != nil {
+			return fmt.Errorf("device: deleting partition %d: %w", partNum, err)
+		}
+		return nil
+	}
 	if err := exec.Command("sgdisk", "-d", strconv.Itoa(partNum), disk.Path).Run(); err != nil {
-		return fmt.Errorf("device: sgdisk -d failed: %w", err)
+		return fmt.Errorf("device: sgdisk -d failed: %w", toolError(ToolSgdisk, err))
 	}
 	return nil
 }
@@ -243,21 +309,27 @@ func (d *Device) ReReadPartitionTable() error {
 	if d.Path == "" {
 		return ErrNoDeviceNode
 	}
-	// TODO: this does not seem to be enough nowadays
+	// TODO: BLKRRPART alone does not seem to be enough nowadays, and it fails if any partition of the disk is in use.
 	// We should find out what exactly `partprobe` does and replicate the calls directly.
 	// It's probably another set of ioctls apart from blkrrpart
-	// NOTE: don't delete! keep for now until we solve the TODO
-	//
-	// f, err := os.Open(d.Path)
-	// if err != nil {
-	// 	return err
-	// }
-	// if _, err = unixIoctlGetInt(int(f.Fd()), blkrrpart); err != nil {
-	// 	return fmt.Errorf("device: unable to re-read partition table: %ww", err)
-	// }
-	if err := exec.Command("partprobe", d.Path).Run(); err != nil {
+	err := exec.Command("partprobe", d.Path).Run()
+	if err == nil {
+		return nil
+	}
+	if !errors.Is(err, osexec.ErrNotFound) {
 		return fmt.Errorf("device: unable to re-read partition table: partprobe: %w", err)
 	}
+
+	// some ONIE images lack partprobe, so we fall back to the ioctl which is better than nothing
+	log.L().Warn("partprobe is not installed, falling back to BLKRRPART ioctl to reread the partition table", zap.String("device", d.Path))
+	f, err := os.Open(d.Path)
+	if err != nil {
+		return fmt.Errorf("device: unable to re-read partition table: %w", err)
+	}
+	defer f.Close()
+	if _, err = unixIoctlGetInt(int(f.Fd()), blkrrpart); err != nil {
+		return fmt.Errorf("device: unable to re-read partition table: BLKRRPART: %w", toolError(ToolPartprobe, err))
+	}
 	return nil
 }
 
@@ -296,7 +368,7 @@ func (d *Device) IsMounted() bool {
 		if len(split) != 3 {
 			continue
 		}
-		if split[0] == d.Path {
+		if split[0] == d.fsPath() {
 			d.MountPath = unescapeMountPath(split[1])
 			if d.FS != nil {
 				d.FS.SetBase(d.MountPath)
@@ -357,7 +429,9 @@ func unescapeMountPath(path string) string {
 	return string(buf[:bufLen])
 }
 
-func (d *Device) Mount() error {
+// Mount mounts the device according to its mount policy (see `MountPolicy`). The options
+// allow callers to override the default mount policy for the partition type.
+func (d *Device) Mount(opts ...MountOption) error {
 	if d.Path == "" {
 		return ErrNoDeviceNode
 	}
@@ -365,61 +439,36 @@ func (d *Device) Mount() error {
 		return ErrAlreadyMounted
 	}
 
-	if d.IsHedgehogIdentityPartition() {
-		// ensure mount path exists and is a directory
-		mountPath := filepath.Join(rootPath, MountPathHedgehogIdentity)
-		if err := ensureMountPath(mountPath); err != nil {
-			return err
-		}
-
-		// now mount it
-		if err := unixMount(d.Path, mountPath, FSExt4, unix.MS_NODEV|unix.MS_NOEXEC, ""); err != nil {
-			return fmt.Errorf("device: mount: %w", err)
-		}
-		d.MountPath = mountPath
-		if d.FS != nil {
-			d.FS.SetBase(d.MountPath)
-		}
-		return nil
+	policy, err := d.MountPolicy(opts...)
+	if err != nil {
+		return err
 	}
 
-	if d.IsHedgehogLocationPartition() {
-		// ensure mount path exists and is a directory
-		mountPath := filepath.Join(rootPath, MountPathHedgehogLocation)
-		if err := ensureMountPath(mountPath); err != nil {
-			return err
-		}
-
-		// now mount it
-		if err := unixMount(d.Path, mountPath, FSExt4, unix.MS_NODEV|unix.MS_NOEXEC, ""); err != nil {
-			return fmt.Errorf("device: mount: %w", err)
-		}
-		d.MountPath = mountPath
-		if d.FS != nil {
-			d.FS.SetBase(d.MountPath)
-		}
-		return nil
+	// ensure mount path exists and is a directory
+	mountPath := filepath.Join(rootPath, policy.MountPath)
+	if err := ensureMountPath(mountPath); err != nil {
+		return err
 	}
 
-	if d.IsSonicPartition() {
-		// ensure mount path exists and is a director
-		mountPath := filepath.Join(rootPath, MountPathSonic)
-		if err := ensureMountPath(mountPath); err != nil {
-			return err
+	// now mount it: we try all filesystem types in order, but only fall back to the next
+	// if the mount failed because of the filesystem type
+	for _, fsType := range policy.fsTypeCandidates(d.Filesystem) {
+		err = unixMount(d.fsPath(), mountPath, fsType, policy.Flags, policy.Data[fsType])
+		if err == nil {
+			break
 		}
-
-		// now mount it
-		if err := unixMount(d.Path, mountPath, FSExt4, unix.MS_NODEV, ""); err != nil {
-			return fmt.Errorf("device: mount: %w", err)
+		if !isWrongFSTypeError(err) {
+			break
 		}
-		d.MountPath = mountPath
-		if d.FS != nil {
-			d.FS.SetBase(d.MountPath)
-		}
-		return nil
 	}
-
-	return ErrUnsupportedMountForDevice
+	if err != nil {
+		return fmt.Errorf("device: mount: %w", err)
+	}
+	d.MountPath = mountPath
+	if d.FS != nil {
+		d.FS.SetBase(d.MountPath)
+	}
+	return nil
 }
 
 func (d *Device) Unmount() error {
@@ -495,11 +544,12 @@ func (d *Device) makeFilesystem(fsType, fsLabel string, force bool) error {
 	if len(fsOpts) > 0 {
 		args = append(args, fsOpts...)
 	}
-	args = append(args, d.Path)
+	args = append(args, d.fsPath())
 	if err := exec.Command("mkfs."+fsType, args...).Run(); err != nil {
-		return fmt.Errorf("device: mkfs.%s: %w", fsType, err)
+		return fmt.Errorf("device: mkfs.%s: %w", fsType, toolError(Tool("mkfs."+fsType), err))
 	}
 	d.Filesystem = fsType
+	d.FSUUID = ""
 	d.FSLabel = fsLabel
 	return nil
 }
@@ -1551,7 +1551,7 @@ func TestDevice_discoverPartitionType(t *testing.T) {
 		device          *Device
 		wantErr         bool
 		wantErrToBe     error
-		wantGPTPartType string
+		wantGPTPartType PartType
 		cmds            func(t *testing.T, ctrl *gomock.Controller) []exec.CommandFunc
 	}{
 		{
@@ -1562,6 +1562,26 @@ func TestDevice_discoverPartitionType(t *testing.T) {
 			wantErr:     true,
 			wantErrToBe: ErrNoDeviceNode,
 		},
+		{
+			name: "normalizes output",
+			device: &Device{
+				Path: "/path/to/device",
+			},
+			cmds: func(t *testing.T, ctrl *gomock.Controller) []exec.CommandFunc {
+				return []exec.CommandFunc{
+					mockexec.MockCommand(t, ctrl, []string{"grub-probe", "-d", "/path/to/device", "-t", "gpt_parttype"}, func(tc *mockexec.TestCmd) {
+						tc.EXPECT().Output().Times(1).DoAndReturn(func() ([]byte, error) {
+							if err := tc.IsExpectedCommand(); err != nil {
+								return nil, err
+							}
+							return []byte("{C12A7328-F81F-11D2-BA4B-00A0C93EC93B}\n"), nil
+						})
+					}),
+				}
+			},
+			wantErr:         false,
+			wantGPTPartType: GPTPartTypeEFI,
+		},
 		{
 			name: "command fails",
 			device: &Device{
@@ -18,7 +18,6 @@ import (
 	"errors"
 	"fmt"
 	"sort"
-	"strings"
 
 	"go.githedgehog.com/dasboot/pkg/exec"
 	"go.githedgehog.com/dasboot/pkg/log"
@@ -37,7 +36,16 @@ func (d ByPartNumber) Len() int {
 
 // Less implements sort.Interface
 func (d ByPartNumber) Less(i int, j int) bool {
-	return d[i].GetPartitionNumber() < d[j].GetPartitionNumber()
+	return partitionNumberOrInvalid(d[i]) < partitionNumberOrInvalid(d[j])
+}
+
+// partitionNumberOrInvalid returns -1 for devices without a valid partition number which sorts them first
+func partitionNumberOrInvalid(d *Device) int {
+	n, err := d.GetPartitionNumber()
+	if err != nil {
+		return -1
+	}
+	return n
 }
 
 // Swap implements sort.Interface
@@ -70,6 +78,49 @@ func (d Devices) GetONIEPartition() *Device {
 	return nil
 }
 
+// GetONIEDisk returns the disk which holds the ONIE partition, which is the disk for the NOS and Hedgehog partitions.
+// If there is more than one ONIE partition (e.g. on a USB stick with a rescue image), it prefers the ones on
+// disks which are not removable, and then the one on the disk which sorts first by its device name.
+func (d Devices) GetONIEDisk() (*Device, error) {
+	var candidates Devices
+	for _, dev := range d {
+		if dev.IsONIEPartition() {
+			candidates = append(candidates, dev)
+		}
+	}
+	if len(candidates) == 0 {
+		return nil, ErrONIEPartitionNotFound
+	}
+	for _, part := range candidates {
+		if part.Disk == nil {
+			return nil, ErrBrokenDiscovery
+		}
+	}
+	sort.SliceStable(candidates, func(i, j int) bool {
+		ri, rj := candidates[i].Disk.isRemovable(), candidates[j].Disk.isRemovable()
+		if ri != rj {
+			return !ri
+		}
+		return candidates[i].Disk.GetDeviceName() < candidates[j].Disk.GetDeviceName()
+	})
+	if len(candidates) > 1 {
+		log.L().Warn("Found more than one ONIE partition, using the first one", zap.String("disk", candidates[0].Disk.GetDeviceName()), zap.Int("count", len(candidates)))
+	}
+	return candidates[0].Disk, nil
+}
+
+// nextPartitionNumber returns the number for a new partition on the disk, which follows its last partition.
+// Counting the partitions is not good enough, as there can be gaps after partitions were deleted.
+func (d *Device) nextPartitionNumber() int {
+	ret := len(d.Partitions) + 1
+	for _, part := range d.Partitions {
+		if n := partitionNumberOrInvalid(part); n >= ret {
+			ret = n + 1
+		}
+	}
+	return ret
+}
+
 func (d Devices) GetDiagPartition() *Device {
 	for _, dev := range d {
 		if dev.IsDiagPartition() {
@@ -88,6 +139,21 @@ func (d Devices) GetHedgehogIdentityPartition() *Device {
 	return nil
 }
 
+// GetHedgehogIdentityPartitions returns all Hedgehog Identity Partitions sorted by their device path.
+// Devices with more than one disk can end up with more than one identity partition after hardware swaps.
+func (d Devices) GetHedgehogIdentityPartitions() Devices {
+	var ret Devices
+	for _, dev := range d {
+		if dev.IsHedgehogIdentityPartition() {
+			ret = append(ret, dev)
+		}
+	}
+	sort.SliceStable(ret, func(i, j int) bool {
+		return ret[i].Path < ret[j].Path
+	})
+	return ret
+}
+
 func (d Devices) GetHedgehogLocationPartition() *Device {
 	for _, dev := range d {
 		if dev.IsHedgehogLocationPartition() {
@@ -122,6 +188,10 @@ func (d Devices) GetSONiCPartition() *Device {
 // DeletePartitions will call `ReReadPartitionTable()` on the disk that
 // it operated on.
 //
+// If a disk selection policy was set with `SetDiskSelectionPolicy()`,
+// the disk which it selects is used instead of the one holding the
+// ONIE partition.
+//
 // DeletePartitions will also ensure that the BoorOrder has ONIE as
 // the first boot entry because after a call to this function, there
 // is not going to be any NOS available anymore, and a subsequent
@@ -144,17 +214,16 @@ func (d Devices) DeletePartitions(platform string) error {
 }
 
 func (d Devices) deletePartitionsByONIELocation() error {
-	oniePart := d.GetONIEPartition()
-	if oniePart == nil {
-		return ErrONIEPartitionNotFound
-	}
-
-	disk := oniePart.Disk
-	if disk == nil {
-		return ErrBrokenDiscovery
+	disk, err := d.SelectDisk(diskSelectionPolicy)
+	if err != nil {
+		return err
 	}
 	parts := disk.Partitions
 	if len(parts) == 0 {
+		// a disk which was selected by policy can be empty, the disk holding the ONIE partition cannot
+		if diskSelectionPolicy != nil {
+			return nil
+		}
 		return ErrBrokenDiscovery
 	}
 	var partsToDelete Devices
@@ -205,7 +274,7 @@ func (d Devices) deletePartitionsByONIELocation() error {
 // for more details.
 //
 // CreateHedgehogIdentityPartition will call ReReadPartitionTable on the disk that
-// it operated on.
+// it operated on. Like `DeletePartitions()`, it applies the disk selection policy.
 //
 // NOTE: it is advisable to call `Discover()` again after a call
 // to this to make sure the partition is in the list.
@@ -222,25 +291,33 @@ func (d Devices) createHedgehogIdentityPartitionByONIELocation() error {
 	if d.GetHedgehogIdentityPartition() != nil {
 		return ErrPartitionExists
 	}
-	oniePart := d.GetONIEPartition()
-	if oniePart == nil {
-		return ErrONIEPartitionNotFound
-	}
-
-	disk := oniePart.Disk
-	if disk == nil {
-		return ErrBrokenDiscovery
+	disk, err := d.SelectDisk(diskSelectionPolicy)
+	if err != nil {
+		return err
 	}
 	if disk.Path == "" {
 		return ErrNoDeviceNode
 	}
-	parts := disk.Partitions
-	if len(parts) == 0 {
+	// a disk which was selected by policy can be empty, sgdisk creates a partition table on it
+	if len(disk.Partitions) == 0 && diskSelectionPolicy == nil {
 		return ErrBrokenDiscovery
 	}
 
-	// new partition number is simply len + 1
-	partNum := len(parts) + 1
+	partNum := disk.nextPartitionNumber()
+
+	if err := disk.updateNativeGPT(func(g *GPT) error {
+		_, err := g.Add(partNum, GPTPartTypeHedgehogIdentity, GPTPartNameHedgehogIdentity, uint64(DefaultPartSizeHedgehogIdentityInMB)*1024*1024)
+		return err
+	}); !fallBackFromNativeGPT(disk, "create", err) {
+		if err != nil {
+			return fmt.Errorf("devices: creating Hedgehog Identity Partition: %w", err)
+		}
+		log.L().Info("Created Hedgehog Identity Partition", zap.String("disk", disk.Path), zap.Int("partNum", partNum), zap.String("devname", disk.PartitionDeviceName(partNum)))
+		if err := disk.ReReadPartitionTable(); err != nil {
+			log.L().Warn("rereading partition table failed", zap.Error(err))
+		}
+		return nil
+	}
 
 	// sgdisk --new=${created_part}::+${created_part_size}MB \
 	//     --attributes=${created_part}:=:$attr_bitmask \
@@ -251,11 +328,12 @@ func (d Devices) createHedgehogIdentityPartitionByONIELocation() error {
 		"sgdisk",
 		fmt.Sprintf("--new=%d::+%dMB", partNum, DefaultPartSizeHedgehogIdentityInMB),
 		fmt.Sprintf("--change-name=%d:%s", partNum, GPTPartNameHedgehogIdentity),
-		fmt.Sprintf("--typecode=%d:%s", partNum, strings.ToUpper(GPTPartTypeHedgehogIdentity)),
+		fmt.Sprintf("--typecode=%d:%s", partNum, GPTPartTypeHedgehogIdentity.Upper()),
 		disk.Path,
 	).Run(); err != nil {
-		return fmt.Errorf("devices: sgdisk create failed: %w", err)
+		return fmt.Errorf("devices: sgdisk create failed: %w", toolError(ToolSgdisk, err))
 	}
+	log.L().Info("Created Hedgehog Identity Partition", zap.String("disk", disk.Path), zap.Int("partNum", partNum), zap.String("devname", disk.PartitionDeviceName(partNum)))
 
 	// reread partition table
 	if err := disk.ReReadPartitionTable(); err != nil {
@@ -17,15 +17,15 @@ package partitions
 import (
 	"errors"
 	"fmt"
+	"os"
+	"path/filepath"
 	"reflect"
 	"testing"
 
+	"go.githedgehog.com/dasboot/pkg/efivar"
 	"go.githedgehog.com/dasboot/pkg/exec"
 	"go.githedgehog.com/dasboot/test/mock/mockexec"
-	"go.githedgehog.com/dasboot/test/mock/mockuefi"
 
-	efiguid "github.com/0x5a17ed/uefi/efi/efiguid"
-	"github.com/0x5a17ed/uefi/efi/efivario"
 	"github.com/0x5a17ed/uefi/efi/efivars"
 	gomock "github.com/golang/mock/gomock"
 )
@@ -144,6 +144,132 @@ func TestDevices_GetONIEPartition(t *testing.T) {
 	}
 }
 
+func TestDevices_GetONIEDisk(t *testing.T) {
+	sysfs := t.TempDir()
+	disk := func(name string, removable bool) *Device {
+		p := filepath.Join(sysfs, name)
+		if err := os.MkdirAll(p, 0755); err != nil {
+			t.Fatal(err)
+		}
+		val := "0\n"
+		if removable {
+			val = "1\n"
+		}
+		if err := os.WriteFile(filepath.Join(p, "removable"), []byte(val), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return &Device{
+			Uevent: Uevent{
+				UeventDevtype: UeventDevtypeDisk,
+				UeventDevname: name,
+			},
+			SysfsPath: p,
+		}
+	}
+	oniePart := func(disk *Device) *Device {
+		part := &Device{
+			Uevent: Uevent{
+				UeventDevtype: UeventDevtypePartition,
+				UeventDevname: disk.PartitionDeviceName(2),
+				UeventPartn:   "2",
+			},
+			GPTPartType: GPTPartTypeONIE,
+			Disk:        disk,
+		}
+		disk.Partitions = append(disk.Partitions, part)
+		return part
+	}
+	nvme := disk("nvme0n1", false)
+	emmc := disk("mmcblk0", false)
+	usb := disk("sda", true)
+	partNVMe := oniePart(nvme)
+	partEMMC := oniePart(emmc)
+	partUSB := oniePart(usb)
+
+	tests := []struct {
+		name        string
+		d           Devices
+		want        *Device
+		wantErrToBe error
+	}{
+		{
+			name: "single ONIE partition",
+			d:    Devices{nvme, partNVMe},
+			want: nvme,
+		},
+		{
+			name: "prefers non-removable disks",
+			d:    Devices{usb, partUSB, nvme, partNVMe},
+			want: nvme,
+		},
+		{
+			name: "sorted by device name",
+			d:    Devices{partNVMe, partEMMC},
+			want: emmc,
+		},
+		{
+			name:        "no ONIE partition",
+			d:           Devices{nvme, emmc},
+			wantErrToBe: ErrONIEPartitionNotFound,
+		},
+		{
+			name: "ONIE partition without disk",
+			d: Devices{
+				{
+					Uevent:      Uevent{UeventDevtype: UeventDevtypePartition},
+					GPTPartType: GPTPartTypeONIE,
+				},
+			},
+			wantErrToBe: ErrBrokenDiscovery,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.d.GetONIEDisk()
+			if !errors.Is(err, tt.wantErrToBe) {
+				t.Fatalf("Devices.GetONIEDisk() error = %v, wantErrToBe %v", err, tt.wantErrToBe)
+			}
+			if got != tt.want {
+				t.Errorf("Devices.GetONIEDisk() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDevice_nextPartitionNumber(t *testing.T) {
+	part := func(partn string) *Device {
+		return &Device{Uevent: Uevent{UeventDevtype: UeventDevtypePartition, UeventPartn: partn}}
+	}
+	tests := []struct {
+		name  string
+		parts []*Device
+		want  int
+	}{
+		{
+			name: "no partitions",
+			want: 1,
+		},
+		{
+			name:  "consecutive partitions",
+			parts: []*Device{part("1"), part("2"), part("3")},
+			want:  4,
+		},
+		{
+			name:  "gap after deleted partition",
+			parts: []*Device{part("1"), part("2"), part("5")},
+			want:  6,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := &Device{Partitions: tt.parts}
+			if got := d.nextPartitionNumber(); got != tt.want {
+				t.Errorf("Device.nextPartitionNumber() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
 func TestDevices_GetDiagPartition(t *testing.T) {
 	tests := []struct {
 		name string
@@ -258,6 +384,58 @@ func TestDevices_GetHedgehogIdentityPartition(t *testing.T) {
 	}
 }
 
+func TestDevices_GetHedgehogIdentityPartitions(t *testing.T) {
+	idPart := func(path string) *Device {
+		return &Device{
+			Path: path,
+			Uevent: Uevent{
+				UeventDevtype: UeventDevtypePartition,
+			},
+			GPTPartType: GPTPartTypeHedgehogIdentity,
+		}
+	}
+	tests := []struct {
+		name string
+		d    Devices
+		want Devices
+	}{
+		{
+			name: "multiple sorted by path",
+			d: Devices{
+				idPart("/dev/sdb1"),
+				{
+					Path: "/dev/sda1",
+					Uevent: Uevent{
+						UeventDevtype: UeventDevtypePartition,
+					},
+					GPTPartType: GPTPartTypeEFI,
+				},
+				idPart("/dev/sda5"),
+			},
+			want: Devices{idPart("/dev/sda5"), idPart("/dev/sdb1")},
+		},
+		{
+			name: "none",
+			d: Devices{
+				{
+					Uevent: Uevent{
+						UeventDevtype: UeventDevtypePartition,
+					},
+					GPTPartType: GPTPartTypeONIE,
+				},
+			},
+			want: nil,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.d.GetHedgehogIdentityPartitions(); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Devices.GetHedgehogIdentityPartitions() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
 func TestDevices_GetHedgehogLocationPartition(t *testing.T) {
 	tests := []struct {
 		name string
@@ -319,6 +497,10 @@ func TestDevices_DeletePartitions(t *testing.T) {
 	// some error fixtures
 	errDeleteFailed := errors.New("sgdisk -d failed")
 	errMakeONIEDefaultFailed := errors.New("MakeONIEDefaultAndCleanup() failed")
+	wd, err := os.Getwd()
+	if err != nil {
+		panic(err)
+	}
 
 	// create a set of realistic GOOD test data
 	disk := &Device{
@@ -634,47 +816,20 @@ func TestDevices_DeletePartitions(t *testing.T) {
 			ctrl := gomock.NewController(t)
 			defer ctrl.Finish()
 
-			//// START - mock for MakeONIEDefaultBootEntryAndCleanup() call
-			c := mockuefi.NewMockContext(ctrl)
-			oldEfiCtx := efiCtx
+			//// START - fake for MakeONIEDefaultBootEntryAndCleanup() call
+			oldOsReleasePath := osReleasePath
 			defer func() {
-				efiCtx = oldEfiCtx
+				osReleasePath = oldOsReleasePath
 			}()
-			efiCtx = c
-			if tt.callsMakeONIEDefaultBootEntryAndCleanup {
-				t.Skipf("Skipping %s until mockgen properyly supports generics for VariableNameIterator...", tt.name)
-				if tt.callsMakeONIEDefaultBootEntryAndCleanupFails {
-					c.EXPECT().GetSizeHint(gomock.Eq("BootCurrent"), gomock.Eq(efivars.GlobalVariable)).Times(1).
-						Return(int64(0), nil)
-					c.EXPECT().Get(gomock.Eq("BootCurrent"), gomock.Eq(efivars.GlobalVariable), gomock.Eq([]byte{})).Times(1).
-						Return(efivario.Attributes(0), 0, errMakeONIEDefaultFailed)
-				} else {
-					c.EXPECT().GetSizeHint(gomock.Eq("BootCurrent"), gomock.Eq(efivars.GlobalVariable)).Times(1).
-						Return(int64(2), nil)
-					c.EXPECT().Get(gomock.Eq("BootCurrent"), gomock.Eq(efivars.GlobalVariable), gomock.Eq([]byte{0, 0})).Times(1).
-						DoAndReturn(func(name string, guid efiguid.GUID, out []byte) (efivario.Attributes, int, error) {
-							copy(out, []byte{0x07, 0x00})
-							return efivario.BootServiceAccess | efivario.RuntimeAccess, 2, nil
-						})
-					c.EXPECT().GetSizeHint(gomock.Eq("Boot0007"), gomock.Eq(efivars.GlobalVariable)).Times(1).
-						Return(int64(len(onieBootContents)-4), nil)
-					c.EXPECT().Get(gomock.Eq("Boot0007"), gomock.Eq(efivars.GlobalVariable), gomock.Eq(make([]byte, len(onieBootContents)-4))).Times(1).
-						DoAndReturn(func(name string, guid efiguid.GUID, out []byte) (efivario.Attributes, int, error) {
-							copy(out, onieBootContents[4:])
-							return efivario.BootServiceAccess | efivario.RuntimeAccess | efivario.NonVolatile, len(onieBootContents) - 4, nil
-						})
-					bootOrderContents := []byte{
-						0x07, 0x00, 0x00, 0x00, 0x07, 0x00, 0x0b, 0x00, 0x00, 0x00, 0x01, 0x00, 0x06, 0x00, 0x02, 0x00,
-						0x03, 0x00, 0x04, 0x00, 0x05, 0x00, 0x08, 0x00, 0x09, 0x00, 0x0a, 0x00,
-					}
-					c.EXPECT().GetSizeHint(gomock.Eq("BootOrder"), gomock.Eq(efivars.GlobalVariable)).Times(1).
-						Return(int64(len(bootOrderContents)-4), nil)
-					c.EXPECT().Get(gomock.Eq("BootOrder"), gomock.Eq(efivars.GlobalVariable), gomock.Eq(make([]byte, len(bootOrderContents)-4))).Times(1).
-						DoAndReturn(func(name string, guid efiguid.GUID, out []byte) (efivario.Attributes, int, error) {
-							copy(out, bootOrderContents[4:])
-							return efivario.BootServiceAccess | efivario.RuntimeAccess | efivario.NonVolatile, len(bootOrderContents) - 4, nil
-						})
-				}
+			osReleasePath = filepath.Join(wd, "testdata", "IsBootedIntoONIE", "success")
+			f := newFakeEFIVars(t, []uint16{0x0b, 0x07, 0x01})
+			oldEFIVars := efiVars
+			defer func() {
+				efiVars = oldEFIVars
+			}()
+			efiVars = efivar.New(f)
+			if tt.callsMakeONIEDefaultBootEntryAndCleanupFails {
+				f.Fail(efivar.OpGet, "BootOrder", errMakeONIEDefaultFailed, 1)
 			}
 			///// END - for MakeONIEDefaultBootEntryAndCleanup() call
 
@@ -698,6 +853,15 @@ func TestDevices_DeletePartitions(t *testing.T) {
 					return
 				}
 			}
+			if err == nil {
+				_, bootOrder, err := efivars.BootOrder.Get(f)
+				if err != nil {
+					t.Fatalf("BootOrder.Get() error = %v", err)
+				}
+				if madeONIEDefault := bootOrder[0] == 0x07; madeONIEDefault != tt.callsMakeONIEDefaultBootEntryAndCleanup {
+					t.Errorf("Devices.DeletePartitions() made ONIE the default boot entry = %v, want %v", madeONIEDefault, tt.callsMakeONIEDefaultBootEntryAndCleanup)
+				}
+			}
 		})
 	}
 }
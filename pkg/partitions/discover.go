@@ -36,6 +36,10 @@ func Discover() Devices {
 				log.L().Warn("ReadUevent failed", zap.Error(err))
 				return nil
 			}
+			if isAuxiliaryDevname(entry.GetDeviceName()) {
+				log.L().Debug("skipping auxiliary block device", zap.String("devname", entry.GetDeviceName()))
+				return nil
+			}
 			dev := &Device{
 				Uevent:    entry,
 				SysfsPath: filepath.Dir(path),
@@ -53,7 +57,7 @@ func Discover() Devices {
 	for _, dev := range ret {
 		if dev.IsDisk() {
 			for _, dev2 := range ret {
-				if dev2.IsPartition() && strings.HasPrefix(dev2.SysfsPath, dev.SysfsPath) {
+				if dev2.IsPartition() && isPartitionOf(dev2, dev) {
 					dev2.Disk = dev
 					dev.Partitions = append(dev.Partitions, dev2)
 				}
@@ -61,6 +65,9 @@ func Discover() Devices {
 		}
 	}
 
+	// multipath maps shadow the disks underneath them, so we must decide which of them we want to work with
+	ret = Devices(ret).ApplyMultipathPolicy(multipathPolicy)
+
 	// we are only interested in partitions for the next discovery phase
 	// because we *know* that all we care about is located on partitions
 	// However, we should ensure for all devices that a block device node
@@ -70,8 +77,13 @@ func Discover() Devices {
 			log.L().Warn("ensuring device path failed", zap.String("devname", dev.GetDeviceName()), zap.Error(err))
 			// technically that might be faster, but let's just try everything anyways
 			// they will most likely abort because of the missing device node anyways
-			// continue
 		}
+	}
+
+	// the partition types come from the partition tables of the disks which we read ourselves if we can,
+	// that saves us a grub-probe call per partition
+	tables := make(map[*Device]*GPT)
+	for _, dev := range ret {
 		if err := dev.discoverFilesystem(); err != nil {
 			log.L().Debug("discover filesystem failed", zap.String("devname", dev.GetDeviceName()), zap.Error(err))
 		}
@@ -79,6 +91,9 @@ func Discover() Devices {
 			log.L().Debug("discover filesystem label failed", zap.String("devname", dev.GetDeviceName()), zap.Error(err))
 		}
 		if dev.IsPartition() {
+			if err := dev.discoverPartitionTypeNative(tables); !fallBackFromNativeGPT(dev, "discover partition type", err) {
+				continue
+			}
 			if err := dev.discoverPartitionType(); err != nil {
 				log.L().Debug("discover partition type failed", zap.String("devname", dev.GetDeviceName()), zap.Error(err))
 			}
@@ -86,3 +101,9 @@ func Discover() Devices {
 	}
 	return ret
 }
+
+// isPartitionOf returns true if `part` is a partition of `disk`. Partitions live in the sysfs directory of
+// their disk, and the path separator matters: nvme0n10p1 is not a partition of nvme0n1, and neither is sdaa1 of sda.
+func isPartitionOf(part *Device, disk *Device) bool {
+	return disk.SysfsPath != "" && strings.HasPrefix(part.SysfsPath, disk.SysfsPath+string(filepath.Separator))
+}
@@ -82,3 +82,59 @@ func TestDiscover(t *testing.T) {
 		})
 	}
 }
+
+func TestIsPartitionOf(t *testing.T) {
+	dev := func(sysfsPath string) *Device {
+		return &Device{SysfsPath: sysfsPath}
+	}
+	tests := []struct {
+		name string
+		part *Device
+		disk *Device
+		want bool
+	}{
+		{
+			name: "sata",
+			part: dev("/sys/block/sda/sda3"),
+			disk: dev("/sys/block/sda"),
+			want: true,
+		},
+		{
+			name: "sata disk with a longer name",
+			part: dev("/sys/block/sdaa/sdaa3"),
+			disk: dev("/sys/block/sda"),
+			want: false,
+		},
+		{
+			name: "nvme",
+			part: dev("/sys/block/nvme0n1/nvme0n1p3"),
+			disk: dev("/sys/block/nvme0n1"),
+			want: true,
+		},
+		{
+			name: "nvme namespace with a longer name",
+			part: dev("/sys/block/nvme0n10/nvme0n10p3"),
+			disk: dev("/sys/block/nvme0n1"),
+			want: false,
+		},
+		{
+			name: "emmc",
+			part: dev("/sys/block/mmcblk0/mmcblk0p3"),
+			disk: dev("/sys/block/mmcblk0"),
+			want: true,
+		},
+		{
+			name: "disk without sysfs path",
+			part: dev("/sys/block/sda/sda3"),
+			disk: dev(""),
+			want: false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := isPartitionOf(tt.part, tt.disk); got != tt.want {
+				t.Errorf("isPartitionOf() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,255 @@
+// Copyright 2023 Hedgehog
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package partitions
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"go.githedgehog.com/dasboot/pkg/log"
+
+	"go.uber.org/zap"
+)
+
+// DiskPreference orders the disks which a `DiskSelectionPolicy` considers
+type DiskPreference string
+
+const (
+	// DiskPreferONIE prefers the disk which holds the ONIE partition, this is the default
+	DiskPreferONIE DiskPreference = "onie"
+
+	// DiskPreferLargest prefers the largest disk
+	DiskPreferLargest DiskPreference = "largest"
+
+	// DiskPreferSmallest prefers the smallest disk
+	DiskPreferSmallest DiskPreference = "smallest"
+)
+
+// DiskBus is the bus through which a disk is attached
+type DiskBus string
+
+const (
+	DiskBusNVMe      DiskBus = "nvme"
+	DiskBusSATA      DiskBus = "sata"
+	DiskBusSCSI      DiskBus = "scsi"
+	DiskBusMMC       DiskBus = "mmc"
+	DiskBusUSB       DiskBus = "usb"
+	DiskBusVirtio    DiskBus = "virtio"
+	DiskBusMultipath DiskBus = "multipath"
+)
+
+var (
+	ErrInvalidDiskSelectionPolicy = errors.New("partitions: invalid disk selection policy")
+	ErrNoDiskMatchesPolicy        = errors.New("partitions: no disk matches the disk selection policy")
+)
+
+// DiskSelectionPolicy selects the disk on which the NOS and the Hedgehog Identity Partition are being created on
+// systems with more than one disk. Without a policy, this is always the disk which holds the ONIE partition.
+// All of the filters must match for a disk to be considered, and removable disks are only considered if their
+// bus is listed explicitly.
+type DiskSelectionPolicy struct {
+	// Prefer orders the disks which pass the filters: "onie" (the default) prefers the disk which holds the ONIE
+	// partition, "largest" and "smallest" order them by their size. Ties are broken by the device name.
+	Prefer DiskPreference `json:"prefer,omitempty" yaml:"prefer,omitempty"`
+
+	// Buses restricts the disks to the ones which are attached through one of these buses: "nvme", "sata",
+	// "scsi", "mmc", "usb", "virtio" or "multipath"
+	Buses []DiskBus `json:"buses,omitempty" yaml:"buses,omitempty"`
+
+	// Allowlist restricts the disks to the ones which have one of these WWNs or serial numbers. WWNs can be
+	// given as they are reported by the disk (e.g. "naa.5000c500a1b2c3d4") or as their udev by-id name
+	// (e.g. "wwn-0x5000c500a1b2c3d4").
+	Allowlist []string `json:"allowlist,omitempty" yaml:"allowlist,omitempty"`
+
+	// MinSizeGB excludes disks which are smaller than this amount of GB
+	MinSizeGB uint64 `json:"min_size_gb,omitempty" yaml:"min_size_gb,omitempty"`
+}
+
+// diskSelectionPolicy is the policy which `DeletePartitions` and `CreateHedgehogIdentityPartition` apply
+var diskSelectionPolicy *DiskSelectionPolicy
+
+// SetDiskSelectionPolicy sets the disk selection policy which all subsequent partition operations apply.
+// A nil policy selects the disk which holds the ONIE partition.
+func SetDiskSelectionPolicy(p *DiskSelectionPolicy) {
+	diskSelectionPolicy = p
+}
+
+// Validate checks the preference and the buses of the policy
+func (p *DiskSelectionPolicy) Validate() error {
+	if p == nil {
+		return nil
+	}
+	switch p.Prefer {
+	case "", DiskPreferONIE, DiskPreferLargest, DiskPreferSmallest:
+	default:
+		return fmt.Errorf("%w: unknown preference '%s'", ErrInvalidDiskSelectionPolicy, p.Prefer)
+	}
+	for _, bus := range p.Buses {
+		switch bus {
+		case DiskBusNVMe, DiskBusSATA, DiskBusSCSI, DiskBusMMC, DiskBusUSB, DiskBusVirtio, DiskBusMultipath:
+		default:
+			return fmt.Errorf("%w: unknown bus '%s'", ErrInvalidDiskSelectionPolicy, bus)
+		}
+	}
+	return nil
+}
+
+// SelectDisk returns the disk which the policy selects out of all the disks in `d`. A nil policy returns the
+// disk which holds the ONIE partition.
+func (d Devices) SelectDisk(p *DiskSelectionPolicy) (*Device, error) {
+	if p == nil {
+		return d.GetONIEDisk()
+	}
+
+	// the ONIE disk is optional here, it only matters for the ordering
+	onieDisk, _ := d.GetONIEDisk()
+
+	var candidates Devices
+	for _, dev := range d {
+		if !dev.IsDisk() {
+			continue
+		}
+		if reason := p.excludes(dev); reason != "" {
+			log.L().Debug("Disk selection policy excludes disk", zap.String("devname", dev.GetDeviceName()), zap.String("reason", reason))
+			continue
+		}
+		candidates = append(candidates, dev)
+	}
+	if len(candidates) == 0 {
+		return nil, ErrNoDiskMatchesPolicy
+	}
+
+	sort.SliceStable(candidates, func(i, j int) bool {
+		a, b := candidates[i], candidates[j]
+		switch p.Prefer {
+		case DiskPreferLargest:
+			if sa, sb := diskSize(a), diskSize(b); sa != sb {
+				return sa > sb
+			}
+		case DiskPreferSmallest:
+			if sa, sb := diskSize(a), diskSize(b); sa != sb {
+				return sa < sb
+			}
+		default:
+			if (a == onieDisk) != (b == onieDisk) {
+				return a == onieDisk
+			}
+		}
+		return a.GetDeviceName() < b.GetDeviceName()
+	})
+	log.L().Info("Disk selection policy selected disk", zap.String("devname", candidates[0].GetDeviceName()), zap.String("prefer", string(p.Prefer)), zap.Int("candidates", len(candidates)))
+	return candidates[0], nil
+}
+
+// excludes returns the reason why the policy excludes the disk, or an empty string if it does not
+func (p *DiskSelectionPolicy) excludes(dev *Device) string {
+	bus := diskBus(dev)
+	if bus == "" {
+		return "not a physical disk"
+	}
+	if len(p.Buses) > 0 && !containsBus(p.Buses, bus) {
+		return "bus " + string(bus) + " is not allowed"
+	}
+	if dev.isRemovable() && !containsBus(p.Buses, bus) {
+		return "removable"
+	}
+	if p.MinSizeGB > 0 && diskSize(dev) < p.MinSizeGB*1000*1000*1000 {
+		return "too small"
+	}
+	if len(p.Allowlist) > 0 && !p.allows(dev) {
+		return "not in allowlist"
+	}
+	return ""
+}
+
+func (p *DiskSelectionPolicy) allows(dev *Device) bool {
+	t := dev.Topology()
+	for _, entry := range p.Allowlist {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if strings.EqualFold(entry, t.WWID) || entry == t.Serial {
+			return true
+		}
+		for _, id := range t.ByID {
+			if id == entry {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func containsBus(buses []DiskBus, bus DiskBus) bool {
+	for _, b := range buses {
+		if b == bus {
+			return true
+		}
+	}
+	return false
+}
+
+// diskSize returns the size of the disk in bytes. The kernel reports it in 512 byte sectors, independent of
+// the logical block size of the disk.
+func diskSize(dev *Device) uint64 {
+	if dev.SysfsPath == "" {
+		return 0
+	}
+	sectors, err := strconv.ParseUint(readSysfsAttr(filepath.Join(dev.SysfsPath, "size")), 10, 64)
+	if err != nil {
+		return 0
+	}
+	return sectors * 512
+}
+
+// diskBus returns the bus through which the disk is attached. It returns an empty string for virtual block
+// devices like loop devices, RAM disks and device mapper devices other than multipath maps.
+func diskBus(dev *Device) DiskBus {
+	name := dev.GetDeviceName()
+	switch {
+	case strings.HasPrefix(name, "nvme"):
+		return DiskBusNVMe
+	case strings.HasPrefix(name, "mmcblk"):
+		return DiskBusMMC
+	case strings.HasPrefix(name, "vd"):
+		return DiskBusVirtio
+	case strings.HasPrefix(name, "dm-"):
+		if isMultipathUUID(dmUUID(dev)) {
+			return DiskBusMultipath
+		}
+		return ""
+	case strings.HasPrefix(name, "sd"):
+		// the sysfs directory of the disk is a link into the device hierarchy which has the bus in its path
+		devicePath := dev.SysfsPath
+		if p, err := filepath.EvalSymlinks(dev.SysfsPath); err == nil {
+			devicePath = p
+		}
+		switch {
+		case strings.Contains(devicePath, "/usb"):
+			return DiskBusUSB
+		case strings.Contains(devicePath, "/ata"):
+			return DiskBusSATA
+		default:
+			return DiskBusSCSI
+		}
+	default:
+		return ""
+	}
+}
@@ -0,0 +1,174 @@
+// Copyright 2023 Hedgehog
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package partitions
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+func TestDevices_SelectDisk(t *testing.T) {
+	root := t.TempDir()
+	oldRootPath := rootPath
+	defer func() { rootPath = oldRootPath }()
+	rootPath = root
+
+	write := func(path string, content string) {
+		t.Helper()
+		p := filepath.Join(root, path)
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, []byte(content+"\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// disk creates a disk whose sysfs directory is a link into the device hierarchy below `bus`
+	disk := func(name string, bus string, sizeGB uint64, removable bool) *Device {
+		t.Helper()
+		devicePath := filepath.Join("sys", "devices", bus, name)
+		write(filepath.Join(devicePath, "size"), strconv.FormatUint(sizeGB*1000*1000*1000/512, 10))
+		rem := "0"
+		if removable {
+			rem = "1"
+		}
+		write(filepath.Join(devicePath, "removable"), rem)
+		link := filepath.Join(root, "sys", "block", name)
+		if err := os.MkdirAll(filepath.Dir(link), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Symlink(filepath.Join(root, devicePath), link); err != nil {
+			t.Fatal(err)
+		}
+		return &Device{
+			Uevent:    Uevent{UeventDevtype: UeventDevtypeDisk, UeventDevname: name},
+			SysfsPath: link,
+		}
+	}
+	onie := func(d *Device) *Device {
+		part := &Device{
+			Uevent:      Uevent{UeventDevtype: UeventDevtypePartition, UeventDevname: d.PartitionDeviceName(2), UeventPartn: "2"},
+			GPTPartType: GPTPartTypeONIE,
+			Disk:        d,
+		}
+		d.Partitions = append(d.Partitions, part)
+		return part
+	}
+
+	sda := disk("sda", "pci0000:00/0000:00:17.0/ata1/host0/target0:0:0/0:0:0:0/block", 64, false)
+	nvme := disk("nvme0n1", "pci0000:00/0000:00:1d.0/nvme/nvme0", 960, false)
+	emmc := disk("mmcblk0", "platform/mmc_host/mmc0/mmc0:0001/block", 8, false)
+	usb := disk("sdb", "pci0000:00/0000:00:14.0/usb1/1-1/1-1:1.0/host1/target1:0:0/1:0:0:0/block", 32, true)
+	loop := &Device{Uevent: Uevent{UeventDevtype: UeventDevtypeDisk, UeventDevname: "loop0"}}
+	write("sys/block/nvme0n1/wwid", "eui.0025388b71b0a1c2")
+	write("sys/block/sda/device/serial", "S1SERIAL")
+	devs := Devices{sda, onie(sda), nvme, emmc, usb, loop}
+
+	tests := []struct {
+		name        string
+		policy      *DiskSelectionPolicy
+		want        *Device
+		wantErrToBe error
+	}{
+		{
+			name: "no policy selects the ONIE disk",
+			want: sda,
+		},
+		{
+			name:   "prefers the ONIE disk",
+			policy: &DiskSelectionPolicy{},
+			want:   sda,
+		},
+		{
+			name:   "largest",
+			policy: &DiskSelectionPolicy{Prefer: DiskPreferLargest},
+			want:   nvme,
+		},
+		{
+			name:   "smallest ignores removable disks",
+			policy: &DiskSelectionPolicy{Prefer: DiskPreferSmallest},
+			want:   emmc,
+		},
+		{
+			name:   "smallest of the allowed buses",
+			policy: &DiskSelectionPolicy{Prefer: DiskPreferSmallest, Buses: []DiskBus{DiskBusNVMe, DiskBusSATA}},
+			want:   sda,
+		},
+		{
+			name:   "removable disks on an allowed bus",
+			policy: &DiskSelectionPolicy{Buses: []DiskBus{DiskBusUSB}},
+			want:   usb,
+		},
+		{
+			name:   "minimum size",
+			policy: &DiskSelectionPolicy{MinSizeGB: 100},
+			want:   nvme,
+		},
+		{
+			name:   "allowlisted WWN",
+			policy: &DiskSelectionPolicy{Allowlist: []string{"EUI.0025388B71B0A1C2"}},
+			want:   nvme,
+		},
+		{
+			name:   "allowlisted serial",
+			policy: &DiskSelectionPolicy{Prefer: DiskPreferLargest, Allowlist: []string{"S1SERIAL"}},
+			want:   sda,
+		},
+		{
+			name:        "nothing matches",
+			policy:      &DiskSelectionPolicy{Buses: []DiskBus{DiskBusVirtio}},
+			wantErrToBe: ErrNoDiskMatchesPolicy,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := devs.SelectDisk(tt.policy)
+			if !errors.Is(err, tt.wantErrToBe) {
+				t.Fatalf("Devices.SelectDisk() error = %v, wantErrToBe %v", err, tt.wantErrToBe)
+			}
+			if got != tt.want {
+				t.Errorf("Devices.SelectDisk() = %v, want %v", got.GetDeviceName(), tt.want.GetDeviceName())
+			}
+		})
+	}
+}
+
+func TestDiskSelectionPolicy_Validate(t *testing.T) {
+	tests := []struct {
+		name    string
+		policy  *DiskSelectionPolicy
+		wantErr bool
+	}{
+		{name: "nil"},
+		{name: "empty", policy: &DiskSelectionPolicy{}},
+		{name: "valid", policy: &DiskSelectionPolicy{Prefer: DiskPreferLargest, Buses: []DiskBus{DiskBusNVMe, DiskBusMMC}}},
+		{name: "unknown preference", policy: &DiskSelectionPolicy{Prefer: "fastest"}, wantErr: true},
+		{name: "unknown bus", policy: &DiskSelectionPolicy{Buses: []DiskBus{"firewire"}}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.policy.Validate()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("DiskSelectionPolicy.Validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil && !errors.Is(err, ErrInvalidDiskSelectionPolicy) {
+				t.Errorf("DiskSelectionPolicy.Validate() error = %v, want %v", err, ErrInvalidDiskSelectionPolicy)
+			}
+		})
+	}
+}
@@ -33,4 +33,6 @@ type FS interface {
 	Remove(path string) error
 	RemoveAll(path string) error
 	Mkdir(name string, perm fs.FileMode) error
+	Rename(oldpath, newpath string) error
+	SyncDir(name string) error
 }
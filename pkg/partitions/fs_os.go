@@ -27,6 +27,12 @@ type fsOs struct {
 
 var _ FS = &fsOs{}
 
+// NewFS returns an FS which operates on the OS filesystem below `basePath`. An empty
+// `basePath` means that the filesystem is not mounted.
+func NewFS(basePath string) FS {
+	return &fsOs{base: basePath}
+}
+
 // SetBase implements FS
 func (fs *fsOs) SetBase(basePath string) {
 	fs.base = basePath
@@ -87,6 +93,28 @@ func (fs *fsOs) RemoveAll(path string) error {
 	return os.RemoveAll(filepath.Join(fs.base, path))
 }
 
+// Rename implements FS
+func (fs *fsOs) Rename(oldpath, newpath string) error {
+	if fs.base == "" {
+		return ErrNotMounted
+	}
+	return os.Rename(filepath.Join(fs.base, oldpath), filepath.Join(fs.base, newpath))
+}
+
+// SyncDir implements FS. It flushes the directory entries of `name` to stable storage,
+// which is what makes a preceding rename durable.
+func (fs *fsOs) SyncDir(name string) error {
+	if fs.base == "" {
+		return ErrNotMounted
+	}
+	d, err := os.Open(filepath.Join(fs.base, name))
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
 // Stat implements FS
 func (fs *fsOs) Stat(name string) (fs.FileInfo, error) {
 	if fs.base == "" {
@@ -0,0 +1,100 @@
+// Copyright 2023 Hedgehog
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package partitions
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	osexec "os/exec"
+
+	"go.githedgehog.com/dasboot/pkg/exec"
+	"go.githedgehog.com/dasboot/pkg/log"
+
+	"go.uber.org/zap"
+)
+
+var (
+	ErrFilesystemCorrupt        = errors.New("device: filesystem corrupt")
+	ErrUnsupportedFsckForDevice = errors.New("device: filesystem check unsupported for device")
+)
+
+const (
+	// e2fsck exit codes are a bitmask
+	e2fsckExitCorrected       = 1
+	e2fsckExitCorrectedReboot = 2
+	e2fsckExitUncorrected     = 4
+
+	extStateErrors = 0x2
+)
+
+// CheckFilesystem checks the ext filesystem of the device with `e2fsck -p` before it gets mounted. It repairs
+// everything which can be repaired safely without user interaction, and it returns `ErrFilesystemCorrupt` if
+// errors remain which would need a manual repair. If e2fsck is not installed, it only checks if the kernel
+// marked the filesystem as having errors in its superblock.
+func (d *Device) CheckFilesystem() error {
+	if d.Path == "" {
+		return ErrNoDeviceNode
+	}
+	if d.IsMounted() {
+		return ErrAlreadyMounted
+	}
+	if !isExtFilesystem(d.Filesystem) {
+		return fmt.Errorf("%w: filesystem '%s'", ErrUnsupportedFsckForDevice, d.Filesystem)
+	}
+
+	err := exec.Command("e2fsck", "-p", d.fsPath()).Run()
+	if err == nil {
+		return nil
+	}
+	var exitErr *osexec.ExitError
+	if errors.As(err, &exitErr) {
+		code := exitErr.ExitCode()
+		switch {
+		case code&e2fsckExitUncorrected != 0:
+			return fmt.Errorf("%w: e2fsck could not repair %s (exit code %d)", ErrFilesystemCorrupt, d.fsPath(), code)
+		case code&^(e2fsckExitCorrected|e2fsckExitCorrectedReboot) == 0:
+			log.L().Warn("e2fsck repaired filesystem errors", zap.String("device", d.fsPath()), zap.Int("exitCode", code))
+			return nil
+		}
+	}
+	if !errors.Is(err, osexec.ErrNotFound) {
+		return fmt.Errorf("device: e2fsck: %w", err)
+	}
+
+	log.L().Warn("e2fsck is not installed, only checking the filesystem state in the superblock", zap.String("device", d.fsPath()))
+	return d.checkExtFilesystemState()
+}
+
+// checkExtFilesystemState returns `ErrFilesystemCorrupt` if the superblock says that the filesystem has errors
+func (d *Device) checkExtFilesystemState() error {
+	f, err := osOpenFile(d.fsPath(), os.O_RDONLY, 0)
+	if err != nil {
+		return fmt.Errorf("device: %w", err)
+	}
+	defer f.Close()
+	sb, err := readBlock(f, extSuperblockOffset, 1024)
+	if err != nil {
+		return err
+	}
+	if sb == nil || binary.LittleEndian.Uint16(sb[0x38:0x3a]) != extMagic {
+		return fmt.Errorf("%w: no ext superblock on %s", ErrFilesystemCorrupt, d.fsPath())
+	}
+	if state := binary.LittleEndian.Uint16(sb[0x3a:0x3c]); state&extStateErrors != 0 {
+		return fmt.Errorf("%w: superblock of %s has errors", ErrFilesystemCorrupt, d.fsPath())
+	}
+	return nil
+}
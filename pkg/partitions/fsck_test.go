@@ -0,0 +1,170 @@
+// Copyright 2023 Hedgehog
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package partitions
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	osexec "os/exec"
+	"path/filepath"
+	"testing"
+
+	"go.githedgehog.com/dasboot/pkg/exec"
+	"go.githedgehog.com/dasboot/test/mock/mockexec"
+
+	gomock "github.com/golang/mock/gomock"
+)
+
+// exitError returns a real exit error of a process which exited with `code`
+func exitError(t *testing.T, code int) error {
+	t.Helper()
+	err := osexec.Command("sh", "-c", fmt.Sprintf("exit %d", code)).Run()
+	var exitErr *osexec.ExitError
+	if !errors.As(err, &exitErr) {
+		t.Fatalf("expected exit error, got %v", err)
+	}
+	return err
+}
+
+func TestDevice_CheckFilesystem(t *testing.T) {
+	errCmdFailed := errors.New("command failed")
+	notFound := &osexec.Error{Name: "e2fsck", Err: osexec.ErrNotFound}
+
+	// images of ext4 filesystems for the superblock check without e2fsck
+	dir := t.TempDir()
+	image := func(name string, state uint16) string {
+		b := extImage(extFeatureCompatHasJournal, 0x40, 0, FSLabelHedgehogIdentity)
+		binary.LittleEndian.PutUint16(b[extSuperblockOffset+0x3a:], state)
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, b, 0o644); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	cleanImage := image("clean.img", 0x1)
+	errorsImage := image("errors.img", 0x1|extStateErrors)
+
+	tests := []struct {
+		name        string
+		device      *Device
+		cmds        func(t *testing.T, ctrl *gomock.Controller) []exec.CommandFunc
+		wantErrToBe error
+	}{
+		{
+			name:   "clean",
+			device: &Device{Path: "/dev/sda4", Filesystem: FSExt4},
+			cmds: func(t *testing.T, ctrl *gomock.Controller) []exec.CommandFunc {
+				return []exec.CommandFunc{mockRun(t, ctrl, []string{"e2fsck", "-p", "/dev/sda4"}, nil)}
+			},
+		},
+		{
+			name:   "grub-probe names all ext filesystems ext2",
+			device: &Device{Path: "/dev/sda4", Filesystem: FSExt2},
+			cmds: func(t *testing.T, ctrl *gomock.Controller) []exec.CommandFunc {
+				return []exec.CommandFunc{mockRun(t, ctrl, []string{"e2fsck", "-p", "/dev/sda4"}, nil)}
+			},
+		},
+		{
+			name:   "encrypted",
+			device: &Device{Path: "/dev/sda4", MapperPath: "/dev/mapper/hh-identity", Filesystem: FSExt4},
+			cmds: func(t *testing.T, ctrl *gomock.Controller) []exec.CommandFunc {
+				return []exec.CommandFunc{mockRun(t, ctrl, []string{"e2fsck", "-p", "/dev/mapper/hh-identity"}, nil)}
+			},
+		},
+		{
+			name:   "errors corrected",
+			device: &Device{Path: "/dev/sda4", Filesystem: FSExt4},
+			cmds: func(t *testing.T, ctrl *gomock.Controller) []exec.CommandFunc {
+				return []exec.CommandFunc{mockRun(t, ctrl, []string{"e2fsck", "-p", "/dev/sda4"}, exitError(t, 1))}
+			},
+		},
+		{
+			name:   "errors left uncorrected",
+			device: &Device{Path: "/dev/sda4", Filesystem: FSExt4},
+			cmds: func(t *testing.T, ctrl *gomock.Controller) []exec.CommandFunc {
+				return []exec.CommandFunc{mockRun(t, ctrl, []string{"e2fsck", "-p", "/dev/sda4"}, exitError(t, 4))}
+			},
+			wantErrToBe: ErrFilesystemCorrupt,
+		},
+		{
+			name:   "operational error",
+			device: &Device{Path: "/dev/sda4", Filesystem: FSExt4},
+			cmds: func(t *testing.T, ctrl *gomock.Controller) []exec.CommandFunc {
+				return []exec.CommandFunc{mockRun(t, ctrl, []string{"e2fsck", "-p", "/dev/sda4"}, exitError(t, 8))}
+			},
+			wantErrToBe: &osexec.ExitError{},
+		},
+		{
+			name:   "other error",
+			device: &Device{Path: "/dev/sda4", Filesystem: FSExt4},
+			cmds: func(t *testing.T, ctrl *gomock.Controller) []exec.CommandFunc {
+				return []exec.CommandFunc{mockRun(t, ctrl, []string{"e2fsck", "-p", "/dev/sda4"}, errCmdFailed)}
+			},
+			wantErrToBe: errCmdFailed,
+		},
+		{
+			name:   "e2fsck missing and superblock clean",
+			device: &Device{Path: cleanImage, Filesystem: FSExt4},
+			cmds: func(t *testing.T, ctrl *gomock.Controller) []exec.CommandFunc {
+				return []exec.CommandFunc{mockRun(t, ctrl, []string{"e2fsck", "-p", cleanImage}, notFound)}
+			},
+		},
+		{
+			name:   "e2fsck missing and superblock has errors",
+			device: &Device{Path: errorsImage, Filesystem: FSExt4},
+			cmds: func(t *testing.T, ctrl *gomock.Controller) []exec.CommandFunc {
+				return []exec.CommandFunc{mockRun(t, ctrl, []string{"e2fsck", "-p", errorsImage}, notFound)}
+			},
+			wantErrToBe: ErrFilesystemCorrupt,
+		},
+		{
+			name:        "unsupported filesystem",
+			device:      &Device{Path: "/dev/sda1", Filesystem: FSVFAT},
+			wantErrToBe: ErrUnsupportedFsckForDevice,
+		},
+		{
+			name:        "no device node",
+			device:      &Device{Filesystem: FSExt4},
+			wantErrToBe: ErrNoDeviceNode,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			defer ctrl.Finish()
+			if tt.cmds != nil {
+				oldCommand := exec.Command
+				defer func() {
+					exec.Command = oldCommand
+				}()
+				cmds := mockexec.NewMockCommands(tt.cmds(t, ctrl))
+				defer cmds.Finish()
+				exec.Command = cmds.Command()
+			}
+			err := tt.device.CheckFilesystem()
+			if exitErr, ok := tt.wantErrToBe.(*osexec.ExitError); ok {
+				if !errors.As(err, &exitErr) {
+					t.Errorf("Device.CheckFilesystem() error = %v, want an exit error", err)
+				}
+				return
+			}
+			if !errors.Is(err, tt.wantErrToBe) {
+				t.Errorf("Device.CheckFilesystem() error = %v, wantErrToBe %v", err, tt.wantErrToBe)
+			}
+		})
+	}
+}
@@ -0,0 +1,194 @@
+// Copyright 2023 Hedgehog
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package partitions
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/google/uuid"
+)
+
+const (
+	extSuperblockOffset = 1024
+	extMagic            = 0xef53
+
+	extFeatureCompatHasJournal = 0x4
+
+	// incompatible and read-only compatible features which ext3 does not know
+	extFeatureIncompatExt4   = 0x40 | 0x80 | 0x100 | 0x200 | 0x400 | 0x1000 | 0x2000 | 0x8000 | 0x10000
+	extFeatureRoCompatExt4   = 0x8 | 0x10 | 0x20 | 0x40 | 0x400
+	extFeatureIncompatJnlDev = 0x8
+
+	squashfsMagic = "hsqs"
+
+	fatNoName = "NO NAME"
+)
+
+// ErrUnknownFilesystem is returned if none of the filesystems which we can probe natively was found on the device
+var ErrUnknownFilesystem = errors.New("fsprobe: unknown filesystem")
+
+// probeFilesystemNatively enables native filesystem probing, with grub-probe as fallback for filesystems which
+// we cannot detect ourselves
+var probeFilesystemNatively = true
+
+// FSInfo is the result of probing a filesystem
+type FSInfo struct {
+	// Type is the filesystem type as the kernel names it, and as it is used for mounting
+	Type  string
+	Label string
+	UUID  string
+}
+
+// ProbeFilesystem detects ext2, ext3, ext4, FAT and squashfs filesystems by their superblocks, and reads their labels
+// and UUIDs. It returns `ErrUnknownFilesystem` if it does not find any of them.
+func ProbeFilesystem(r io.ReaderAt) (*FSInfo, error) {
+	for _, probe := range []func(io.ReaderAt) (*FSInfo, error){probeExt, probeSquashfs, probeFAT} {
+		info, err := probe(r)
+		if err != nil {
+			return nil, err
+		}
+		if info != nil {
+			return info, nil
+		}
+	}
+	return nil, ErrUnknownFilesystem
+}
+
+// readBlock reads `n` bytes at `off`. A device which is too small for the block is not an error, it simply
+// cannot hold the filesystem in question, and it returns nil in this case.
+func readBlock(r io.ReaderAt, off int64, n int) ([]byte, error) {
+	b := make([]byte, n)
+	if _, err := r.ReadAt(b, off); err != nil {
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("fsprobe: reading %d bytes at %d: %w", n, off, err)
+	}
+	return b, nil
+}
+
+func probeExt(r io.ReaderAt) (*FSInfo, error) {
+	sb, err := readBlock(r, extSuperblockOffset, 1024)
+	if sb == nil || err != nil {
+		return nil, err
+	}
+	if binary.LittleEndian.Uint16(sb[0x38:0x3a]) != extMagic {
+		return nil, nil
+	}
+	compat := binary.LittleEndian.Uint32(sb[0x5c:0x60])
+	incompat := binary.LittleEndian.Uint32(sb[0x60:0x64])
+	roCompat := binary.LittleEndian.Uint32(sb[0x64:0x68])
+	if incompat&extFeatureIncompatJnlDev != 0 {
+		// an external journal is not a filesystem which can be mounted
+		return nil, nil
+	}
+	ret := &FSInfo{
+		Type:  FSExt2,
+		Label: cString(sb[0x78:0x88]),
+	}
+	switch {
+	case incompat&extFeatureIncompatExt4 != 0 || roCompat&extFeatureRoCompatExt4 != 0:
+		ret.Type = FSExt4
+	case compat&extFeatureCompatHasJournal != 0:
+		ret.Type = FSExt3
+	}
+	if id, err := uuid.FromBytes(sb[0x68:0x78]); err == nil && id != uuid.Nil {
+		ret.UUID = id.String()
+	}
+	return ret, nil
+}
+
+func probeSquashfs(r io.ReaderAt) (*FSInfo, error) {
+	sb, err := readBlock(r, 0, 4)
+	if sb == nil || err != nil {
+		return nil, err
+	}
+	if string(sb) != squashfsMagic {
+		return nil, nil
+	}
+	// squashfs has neither a label nor a UUID
+	return &FSInfo{Type: FSSquashfs}, nil
+}
+
+func probeFAT(r io.ReaderAt) (*FSInfo, error) {
+	bs, err := readBlock(r, 0, 512)
+	if bs == nil || err != nil {
+		return nil, err
+	}
+	if bs[510] != 0x55 || bs[511] != 0xaa {
+		return nil, nil
+	}
+	// a FAT boot sector starts with a jump instruction, and has a sane number of bytes per sector and FATs
+	if bs[0] != 0xeb && bs[0] != 0xe9 {
+		return nil, nil
+	}
+	bytesPerSector := binary.LittleEndian.Uint16(bs[11:13])
+	if bytesPerSector < 512 || bytesPerSector > 4096 || bytesPerSector&(bytesPerSector-1) != 0 || bs[16] == 0 {
+		return nil, nil
+	}
+
+	// the extended BIOS parameter block is at a different place for FAT32
+	var ebpb []byte
+	switch {
+	case bytes.HasPrefix(bs[82:90], []byte("FAT32")):
+		ebpb = bs[64:90]
+	case bytes.HasPrefix(bs[54:62], []byte("FAT")):
+		ebpb = bs[36:62]
+	default:
+		return nil, nil
+	}
+	ret := &FSInfo{Type: FSVFAT}
+	if ebpb[2] == 0x28 || ebpb[2] == 0x29 {
+		id := binary.LittleEndian.Uint32(ebpb[3:7])
+		ret.UUID = fmt.Sprintf("%04X-%04X", id>>16, id&0xffff)
+	}
+	if ebpb[2] == 0x29 {
+		if label := strings.TrimRight(string(ebpb[7:18]), " \x00"); label != fatNoName {
+			ret.Label = label
+		}
+	}
+	return ret, nil
+}
+
+func cString(b []byte) string {
+	if n := bytes.IndexByte(b, 0); n >= 0 {
+		b = b[:n]
+	}
+	return string(b)
+}
+
+// probeFilesystem probes the filesystem of the device natively
+func (d *Device) probeFilesystem() (*FSInfo, error) {
+	if d.Path == "" {
+		return nil, ErrNoDeviceNode
+	}
+	f, err := osOpenFile(d.fsPath(), os.O_RDONLY, 0)
+	if err != nil {
+		return nil, fmt.Errorf("fsprobe: %w", err)
+	}
+	defer f.Close()
+	return ProbeFilesystem(f)
+}
+
+// isExtFilesystem returns true for all filesystems of the ext family. grub-probe reports all of them as ext2.
+func isExtFilesystem(fs string) bool {
+	return fs == FSExt2 || fs == FSExt3 || fs == FSExt4
+}
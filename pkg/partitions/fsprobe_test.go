@@ -0,0 +1,165 @@
+// Copyright 2023 Hedgehog
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package partitions
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func extImage(compat, incompat, roCompat uint32, label string) []byte {
+	b := make([]byte, 4096)
+	sb := b[extSuperblockOffset:]
+	binary.LittleEndian.PutUint16(sb[0x38:], extMagic)
+	binary.LittleEndian.PutUint32(sb[0x5c:], compat)
+	binary.LittleEndian.PutUint32(sb[0x60:], incompat)
+	binary.LittleEndian.PutUint32(sb[0x64:], roCompat)
+	copy(sb[0x68:], []byte{0x5c, 0x0b, 0x8d, 0x1a, 0x7e, 0x4f, 0x4c, 0x32, 0x9a, 0x55, 0x3e, 0x8f, 0x0d, 0x2b, 0x6a, 0x71})
+	copy(sb[0x78:], label)
+	return b
+}
+
+func fatImage(fat32 bool, label string) []byte {
+	b := make([]byte, 4096)
+	b[0] = 0xeb
+	binary.LittleEndian.PutUint16(b[11:], 512)
+	b[16] = 2
+	ebpb := b[36:62]
+	typ := b[54:62]
+	if fat32 {
+		ebpb = b[64:90]
+		typ = b[82:90]
+	}
+	ebpb[2] = 0x29
+	binary.LittleEndian.PutUint32(ebpb[3:], 0x1234abcd)
+	copy(ebpb[7:18], label)
+	copy(typ, "FAT     ")
+	if fat32 {
+		copy(typ, "FAT32   ")
+	}
+	b[510] = 0x55
+	b[511] = 0xaa
+	return b
+}
+
+func TestProbeFilesystem(t *testing.T) {
+	const extUUID = "5c0b8d1a-7e4f-4c32-9a55-3e8f0d2b6a71"
+	tests := []struct {
+		name        string
+		image       []byte
+		want        *FSInfo
+		wantErrToBe error
+	}{
+		{
+			name:  "ext4",
+			image: extImage(extFeatureCompatHasJournal, 0x40|0x200, 0, FSLabelHedgehogIdentity),
+			want:  &FSInfo{Type: FSExt4, Label: FSLabelHedgehogIdentity, UUID: extUUID},
+		},
+		{
+			name:  "ext4 by read-only features",
+			image: extImage(extFeatureCompatHasJournal, 0, 0x400, ""),
+			want:  &FSInfo{Type: FSExt4, UUID: extUUID},
+		},
+		{
+			name:  "ext3",
+			image: extImage(extFeatureCompatHasJournal, 0, 0, "ext3"),
+			want:  &FSInfo{Type: FSExt3, Label: "ext3", UUID: extUUID},
+		},
+		{
+			name:  "ext2 with a label of full length",
+			image: extImage(0, 0, 0, "0123456789abcdef"),
+			want:  &FSInfo{Type: FSExt2, Label: "0123456789abcdef", UUID: extUUID},
+		},
+		{
+			name:        "external ext journal",
+			image:       extImage(0, extFeatureIncompatJnlDev, 0, ""),
+			wantErrToBe: ErrUnknownFilesystem,
+		},
+		{
+			name:  "FAT16",
+			image: fatImage(false, "EFI        "),
+			want:  &FSInfo{Type: FSVFAT, Label: "EFI", UUID: "1234-ABCD"},
+		},
+		{
+			name:  "FAT32 without a label",
+			image: fatImage(true, "NO NAME    "),
+			want:  &FSInfo{Type: FSVFAT, UUID: "1234-ABCD"},
+		},
+		{
+			name:  "squashfs",
+			image: append([]byte(squashfsMagic), make([]byte, 4092)...),
+			want:  &FSInfo{Type: FSSquashfs},
+		},
+		{
+			name: "MBR is not FAT",
+			image: func() []byte {
+				b := make([]byte, 4096)
+				b[510] = 0x55
+				b[511] = 0xaa
+				return b
+			}(),
+			wantErrToBe: ErrUnknownFilesystem,
+		},
+		{
+			name:        "empty",
+			image:       make([]byte, 4096),
+			wantErrToBe: ErrUnknownFilesystem,
+		},
+		{
+			name:        "too small",
+			image:       []byte("hs"),
+			wantErrToBe: ErrUnknownFilesystem,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ProbeFilesystem(bytes.NewReader(tt.image))
+			if !errors.Is(err, tt.wantErrToBe) {
+				t.Fatalf("ProbeFilesystem() error = %v, wantErrToBe %v", err, tt.wantErrToBe)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ProbeFilesystem() = %#v, want %#v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDevice_discoverFilesystemNatively(t *testing.T) {
+	probeFilesystemNatively = true
+	t.Cleanup(func() { probeFilesystemNatively = false })
+
+	path := filepath.Join(t.TempDir(), "part.img")
+	if err := os.WriteFile(path, extImage(extFeatureCompatHasJournal, 0x40, 0, FSLabelHedgehogIdentity), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	d := &Device{
+		Uevent: Uevent{UeventDevtype: UeventDevtypePartition, UeventPartn: "1"},
+		Path:   path,
+	}
+	if err := d.discoverFilesystem(); err != nil {
+		t.Fatalf("Device.discoverFilesystem() error = %v", err)
+	}
+	if err := d.discoverFilesystemLabel(); err != nil {
+		t.Fatalf("Device.discoverFilesystemLabel() error = %v", err)
+	}
+	if d.Filesystem != FSExt4 || d.FSLabel != FSLabelHedgehogIdentity || d.FSUUID == "" {
+		t.Errorf("Device.discoverFilesystem() = %q, %q, %q", d.Filesystem, d.FSLabel, d.FSUUID)
+	}
+}
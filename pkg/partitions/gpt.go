@@ -0,0 +1,407 @@
+// Copyright 2023 Hedgehog
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package partitions
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"unicode/utf16"
+
+	"github.com/google/uuid"
+)
+
+const (
+	gptSignature       = "EFI PART"
+	gptRevision        = 0x00010000
+	gptHeaderSize      = 92
+	gptEntrySize       = 128
+	gptEntryNameLen    = 36
+	mbrSignatureOffset = 510
+	mbrPartitionOffset = 446
+	mbrTypeProtective  = 0xee
+
+	// gptAlignmentBytes is the alignment of new partitions, it is the same as the sgdisk default
+	gptAlignmentBytes = 1024 * 1024
+)
+
+var (
+	ErrNoGPT                 = errors.New("gpt: no GUID partition table")
+	ErrInvalidGPT            = errors.New("gpt: invalid GUID partition table")
+	ErrGPTEntryNotFound      = errors.New("gpt: partition entry not found")
+	ErrGPTEntryExists        = errors.New("gpt: partition entry exists")
+	ErrGPTNoSpace            = errors.New("gpt: not enough free space")
+	ErrGPTInvalidPartitionNo = errors.New("gpt: invalid partition number")
+)
+
+// GPT is a GUID partition table as it is read from a disk. It holds all partition entries of the table, including
+// the unused ones, so that it can be written back with the same layout. Changes only affect the disk with `Write`.
+type GPT struct {
+	SectorSize int
+	DiskGUID   uuid.UUID
+
+	// FirstUsableLBA and LastUsableLBA delimit the space which partitions can occupy
+	FirstUsableLBA uint64
+	LastUsableLBA  uint64
+
+	// Entries are all partition entries of the table, partition number N is at index N-1
+	Entries []GPTEntry
+
+	// these are needed to write the table back to its place
+	primaryEntriesLBA uint64
+	backupLBA         uint64
+}
+
+// GPTEntry is a partition entry of a GUID partition table. An entry with an empty type is unused.
+type GPTEntry struct {
+	Type       PartType
+	UniqueGUID uuid.UUID
+	FirstLBA   uint64
+	LastLBA    uint64
+	Attributes GPTAttributes
+	Name       string
+}
+
+// IsUsed returns true if the entry describes a partition
+func (e *GPTEntry) IsUsed() bool {
+	return e.Type != "" && e.Type != "00000000-0000-0000-0000-000000000000"
+}
+
+// Sectors returns the size of the partition in sectors
+func (e *GPTEntry) Sectors() uint64 {
+	if !e.IsUsed() || e.LastLBA < e.FirstLBA {
+		return 0
+	}
+	return e.LastLBA - e.FirstLBA + 1
+}
+
+// ReadGPT reads the GUID partition table from a disk of `size` bytes with `sectorSize` bytes per logical sector.
+// It checks the protective MBR, and falls back to the backup table at the end of the disk if the primary one
+// is corrupt.
+func ReadGPT(r io.ReaderAt, size int64, sectorSize int) (*GPT, error) {
+	if sectorSize < 512 {
+		return nil, fmt.Errorf("%w: sector size %d", ErrInvalidGPT, sectorSize)
+	}
+	sectors := uint64(size) / uint64(sectorSize)
+	if sectors < 3 {
+		return nil, fmt.Errorf("%w: disk too small", ErrNoGPT)
+	}
+
+	mbr := make([]byte, 512)
+	if _, err := r.ReadAt(mbr, 0); err != nil {
+		return nil, fmt.Errorf("gpt: reading MBR: %w", err)
+	}
+	if mbr[mbrSignatureOffset] != 0x55 || mbr[mbrSignatureOffset+1] != 0xaa {
+		return nil, fmt.Errorf("%w: no MBR signature", ErrNoGPT)
+	}
+	var protective bool
+	for i := 0; i < 4; i++ {
+		if mbr[mbrPartitionOffset+i*16+4] == mbrTypeProtective {
+			protective = true
+		}
+	}
+	if !protective {
+		return nil, fmt.Errorf("%w: no protective MBR", ErrNoGPT)
+	}
+
+	g, primaryErr := readGPTAt(r, 1, sectorSize)
+	if primaryErr == nil {
+		return g, nil
+	}
+	g, err := readGPTAt(r, sectors-1, sectorSize)
+	if err != nil {
+		return nil, fmt.Errorf("primary table: %w, backup table: %w", primaryErr, err)
+	}
+	return g, nil
+}
+
+// readGPTAt reads and verifies the GPT header at `lba` together with its partition entries
+func readGPTAt(r io.ReaderAt, lba uint64, sectorSize int) (*GPT, error) {
+	hdr := make([]byte, sectorSize)
+	if _, err := r.ReadAt(hdr, int64(lba)*int64(sectorSize)); err != nil {
+		return nil, fmt.Errorf("gpt: reading header at LBA %d: %w", lba, err)
+	}
+	if string(hdr[0:8]) != gptSignature {
+		return nil, fmt.Errorf("%w: no signature at LBA %d", ErrNoGPT, lba)
+	}
+	hdrSize := binary.LittleEndian.Uint32(hdr[12:16])
+	if hdrSize < gptHeaderSize || int(hdrSize) > sectorSize {
+		return nil, fmt.Errorf("%w: header size %d", ErrInvalidGPT, hdrSize)
+	}
+	wantCRC := binary.LittleEndian.Uint32(hdr[16:20])
+	check := make([]byte, hdrSize)
+	copy(check, hdr[:hdrSize])
+	binary.LittleEndian.PutUint32(check[16:20], 0)
+	if crc32.ChecksumIEEE(check) != wantCRC {
+		return nil, fmt.Errorf("%w: header checksum mismatch at LBA %d", ErrInvalidGPT, lba)
+	}
+	if myLBA := binary.LittleEndian.Uint64(hdr[24:32]); myLBA != lba {
+		return nil, fmt.Errorf("%w: header at LBA %d claims to be at LBA %d", ErrInvalidGPT, lba, myLBA)
+	}
+
+	g := &GPT{
+		SectorSize:     sectorSize,
+		FirstUsableLBA: binary.LittleEndian.Uint64(hdr[40:48]),
+		LastUsableLBA:  binary.LittleEndian.Uint64(hdr[48:56]),
+	}
+	g.DiskGUID = decodeGUID(hdr[56:72])
+	entriesLBA := binary.LittleEndian.Uint64(hdr[72:80])
+	numEntries := binary.LittleEndian.Uint32(hdr[80:84])
+	entrySize := binary.LittleEndian.Uint32(hdr[84:88])
+	entriesCRC := binary.LittleEndian.Uint32(hdr[88:92])
+	if entrySize != gptEntrySize || numEntries == 0 || numEntries > 1024 {
+		return nil, fmt.Errorf("%w: %d entries of %d bytes", ErrInvalidGPT, numEntries, entrySize)
+	}
+	if lba == 1 {
+		g.primaryEntriesLBA = entriesLBA
+		g.backupLBA = binary.LittleEndian.Uint64(hdr[32:40])
+	} else {
+		// the backup header points back to the primary one, and the primary entries follow it
+		g.primaryEntriesLBA = 2
+		g.backupLBA = lba
+	}
+
+	entries := make([]byte, int(numEntries)*gptEntrySize)
+	if _, err := r.ReadAt(entries, int64(entriesLBA)*int64(sectorSize)); err != nil {
+		return nil, fmt.Errorf("gpt: reading partition entries: %w", err)
+	}
+	if crc32.ChecksumIEEE(entries) != entriesCRC {
+		return nil, fmt.Errorf("%w: partition entries checksum mismatch", ErrInvalidGPT)
+	}
+	g.Entries = make([]GPTEntry, numEntries)
+	for i := range g.Entries {
+		g.Entries[i] = decodeGPTEntry(entries[i*gptEntrySize : (i+1)*gptEntrySize])
+	}
+	return g, nil
+}
+
+// Write writes the primary and the backup table to the disk. It does not touch the protective MBR.
+func (g *GPT) Write(w io.WriterAt) error {
+	entries := make([]byte, len(g.Entries)*gptEntrySize)
+	for i := range g.Entries {
+		encodeGPTEntry(entries[i*gptEntrySize:(i+1)*gptEntrySize], &g.Entries[i])
+	}
+	entriesCRC := crc32.ChecksumIEEE(entries)
+	entriesSectors := (uint64(len(entries)) + uint64(g.SectorSize) - 1) / uint64(g.SectorSize)
+	backupEntriesLBA := g.backupLBA - entriesSectors
+
+	// the backup goes first: if writing fails halfway, the primary table is still intact
+	for _, t := range []struct {
+		lba, alternateLBA, entriesLBA uint64
+	}{
+		{lba: g.backupLBA, alternateLBA: 1, entriesLBA: backupEntriesLBA},
+		{lba: 1, alternateLBA: g.backupLBA, entriesLBA: g.primaryEntriesLBA},
+	} {
+		if _, err := w.WriteAt(entries, int64(t.entriesLBA)*int64(g.SectorSize)); err != nil {
+			return fmt.Errorf("gpt: writing partition entries at LBA %d: %w", t.entriesLBA, err)
+		}
+		hdr := g.encodeHeader(t.lba, t.alternateLBA, t.entriesLBA, entriesCRC)
+		if _, err := w.WriteAt(hdr, int64(t.lba)*int64(g.SectorSize)); err != nil {
+			return fmt.Errorf("gpt: writing header at LBA %d: %w", t.lba, err)
+		}
+	}
+	return nil
+}
+
+func (g *GPT) encodeHeader(lba, alternateLBA, entriesLBA uint64, entriesCRC uint32) []byte {
+	hdr := make([]byte, g.SectorSize)
+	copy(hdr[0:8], gptSignature)
+	binary.LittleEndian.PutUint32(hdr[8:12], gptRevision)
+	binary.LittleEndian.PutUint32(hdr[12:16], gptHeaderSize)
+	binary.LittleEndian.PutUint64(hdr[24:32], lba)
+	binary.LittleEndian.PutUint64(hdr[32:40], alternateLBA)
+	binary.LittleEndian.PutUint64(hdr[40:48], g.FirstUsableLBA)
+	binary.LittleEndian.PutUint64(hdr[48:56], g.LastUsableLBA)
+	encodeGUID(hdr[56:72], g.DiskGUID)
+	binary.LittleEndian.PutUint64(hdr[72:80], entriesLBA)
+	binary.LittleEndian.PutUint32(hdr[80:84], uint32(len(g.Entries)))
+	binary.LittleEndian.PutUint32(hdr[84:88], gptEntrySize)
+	binary.LittleEndian.PutUint32(hdr[88:92], entriesCRC)
+	binary.LittleEndian.PutUint32(hdr[16:20], crc32.ChecksumIEEE(hdr[:gptHeaderSize]))
+	return hdr
+}
+
+// Entry returns the entry of partition number `partNum`
+func (g *GPT) Entry(partNum int) (*GPTEntry, error) {
+	if partNum < 1 || partNum > len(g.Entries) {
+		return nil, fmt.Errorf("%w: %d", ErrGPTInvalidPartitionNo, partNum)
+	}
+	e := &g.Entries[partNum-1]
+	if !e.IsUsed() {
+		return nil, fmt.Errorf("%w: %d", ErrGPTEntryNotFound, partNum)
+	}
+	return e, nil
+}
+
+// Delete removes the entry of partition number `partNum`
+func (g *GPT) Delete(partNum int) error {
+	if _, err := g.Entry(partNum); err != nil {
+		return err
+	}
+	g.Entries[partNum-1] = GPTEntry{}
+	return nil
+}
+
+// Add creates partition number `partNum` with a size of `size` bytes in the first aligned free space which is
+// large enough for it. It gets a new random unique GUID.
+func (g *GPT) Add(partNum int, partType PartType, name string, size uint64) (*GPTEntry, error) {
+	if partNum < 1 || partNum > len(g.Entries) {
+		return nil, fmt.Errorf("%w: %d", ErrGPTInvalidPartitionNo, partNum)
+	}
+	if g.Entries[partNum-1].IsUsed() {
+		return nil, fmt.Errorf("%w: %d", ErrGPTEntryExists, partNum)
+	}
+	sectors := g.sectors(size)
+	align := g.alignment()
+	start := alignUp(g.FirstUsableLBA, align)
+	for {
+		if start+sectors-1 > g.LastUsableLBA {
+			return nil, fmt.Errorf("%w: for %d bytes", ErrGPTNoSpace, size)
+		}
+		overlap := g.overlapping(start, start+sectors-1, -1)
+		if overlap == nil {
+			break
+		}
+		start = alignUp(overlap.LastLBA+1, align)
+	}
+	g.Entries[partNum-1] = GPTEntry{
+		Type:       partType,
+		UniqueGUID: uuid.New(),
+		FirstLBA:   start,
+		LastLBA:    start + sectors - 1,
+		Name:       name,
+	}
+	return &g.Entries[partNum-1], nil
+}
+
+// Resize changes the size of partition number `partNum` to `size` bytes. It keeps the start of the partition, and
+// fails if the space after it is not free.
+func (g *GPT) Resize(partNum int, size uint64) error {
+	e, err := g.Entry(partNum)
+	if err != nil {
+		return err
+	}
+	last := e.FirstLBA + g.sectors(size) - 1
+	if last > g.LastUsableLBA {
+		return fmt.Errorf("%w: partition %d would end after the last usable sector", ErrGPTNoSpace, partNum)
+	}
+	if overlap := g.overlapping(e.FirstLBA, last, partNum-1); overlap != nil {
+		return fmt.Errorf("%w: partition %d would overlap with the partition at LBA %d", ErrGPTNoSpace, partNum, overlap.FirstLBA)
+	}
+	e.LastLBA = last
+	return nil
+}
+
+// overlapping returns the first used entry other than the one at index `skip` which overlaps with the given range
+func (g *GPT) overlapping(first, last uint64, skip int) *GPTEntry {
+	var ret *GPTEntry
+	for i := range g.Entries {
+		e := &g.Entries[i]
+		if i == skip || !e.IsUsed() {
+			continue
+		}
+		if e.FirstLBA <= last && e.LastLBA >= first && (ret == nil || e.FirstLBA < ret.FirstLBA) {
+			ret = e
+		}
+	}
+	return ret
+}
+
+func (g *GPT) sectors(size uint64) uint64 {
+	return (size + uint64(g.SectorSize) - 1) / uint64(g.SectorSize)
+}
+
+func (g *GPT) alignment() uint64 {
+	return gptAlignmentBytes / uint64(g.SectorSize)
+}
+
+func alignUp(lba, align uint64) uint64 {
+	if align == 0 {
+		return lba
+	}
+	return (lba + align - 1) / align * align
+}
+
+func decodeGPTEntry(b []byte) GPTEntry {
+	var ret GPTEntry
+	typ := decodeGUID(b[0:16])
+	if typ != uuid.Nil {
+		ret.Type = PartType(typ.String())
+	}
+	ret.UniqueGUID = decodeGUID(b[16:32])
+	ret.FirstLBA = binary.LittleEndian.Uint64(b[32:40])
+	ret.LastLBA = binary.LittleEndian.Uint64(b[40:48])
+	ret.Attributes = GPTAttributes(binary.LittleEndian.Uint64(b[48:56]))
+	name := make([]uint16, gptEntryNameLen)
+	for i := range name {
+		name[i] = binary.LittleEndian.Uint16(b[56+i*2:])
+	}
+	if n := indexUint16(name, 0); n >= 0 {
+		name = name[:n]
+	}
+	ret.Name = string(utf16.Decode(name))
+	return ret
+}
+
+func encodeGPTEntry(b []byte, e *GPTEntry) {
+	clear(b)
+	if !e.IsUsed() {
+		return
+	}
+	typ, _ := uuid.Parse(string(e.Type))
+	encodeGUID(b[0:16], typ)
+	encodeGUID(b[16:32], e.UniqueGUID)
+	binary.LittleEndian.PutUint64(b[32:40], e.FirstLBA)
+	binary.LittleEndian.PutUint64(b[40:48], e.LastLBA)
+	binary.LittleEndian.PutUint64(b[48:56], uint64(e.Attributes))
+	name := utf16.Encode([]rune(e.Name))
+	for i := 0; i < len(name) && i < gptEntryNameLen; i++ {
+		binary.LittleEndian.PutUint16(b[56+i*2:], name[i])
+	}
+}
+
+// GUIDs are stored in mixed endian: the first three fields are little endian, the rest is big endian
+func decodeGUID(b []byte) uuid.UUID {
+	var ret uuid.UUID
+	copy(ret[:], b[:16])
+	reverse(ret[0:4])
+	reverse(ret[4:6])
+	reverse(ret[6:8])
+	return ret
+}
+
+func encodeGUID(b []byte, u uuid.UUID) {
+	copy(b[:16], u[:])
+	reverse(b[0:4])
+	reverse(b[4:6])
+	reverse(b[6:8])
+}
+
+func reverse(b []byte) {
+	for i, j := 0, len(b)-1; i < j; i, j = i+1, j-1 {
+		b[i], b[j] = b[j], b[i]
+	}
+}
+
+func indexUint16(s []uint16, v uint16) int {
+	for i, x := range s {
+		if x == v {
+			return i
+		}
+	}
+	return -1
+}
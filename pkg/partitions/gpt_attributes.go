@@ -0,0 +1,210 @@
+// Copyright 2023 Hedgehog
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package partitions
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"go.githedgehog.com/dasboot/pkg/exec"
+)
+
+// GPTAttributes are the attribute flags of a GPT partition entry
+type GPTAttributes uint64
+
+const (
+	// GPTAttributeRequired marks a partition which is required for the platform to function
+	GPTAttributeRequired GPTAttributes = 1 << 0
+
+	// GPTAttributeNoBlockIO instructs EFI firmware to not provide the EFI_BLOCK_IO_PROTOCOL for the partition
+	GPTAttributeNoBlockIO GPTAttributes = 1 << 1
+
+	// GPTAttributeLegacyBIOSBootable marks a partition as bootable for legacy BIOS firmware
+	GPTAttributeLegacyBIOSBootable GPTAttributes = 1 << 2
+)
+
+var (
+	ErrInvalidGPTAttribute   = errors.New("device: invalid GPT attribute")
+	ErrGPTAttributesNotFound = errors.New("device: GPT attributes not found in sgdisk output")
+	ErrPartitionNameNotFound = errors.New("devices: no partition with GPT partition name found")
+	gptAttributeNames        = map[string]GPTAttributes{
+		"required":             GPTAttributeRequired,
+		"no_block_io":          GPTAttributeNoBlockIO,
+		"legacy_bios_bootable": GPTAttributeLegacyBIOSBootable,
+	}
+)
+
+// ParseGPTAttributes parses a list of GPT attribute names. Next to the well-known attribute names
+// ("required", "no_block_io" and "legacy_bios_bootable") it accepts bit numbers (0-63), which is
+// necessary for the partition type specific attributes in bits 48-63.
+func ParseGPTAttributes(names []string) (GPTAttributes, error) {
+	var ret GPTAttributes
+	for _, name := range names {
+		if a, ok := gptAttributeNames[name]; ok {
+			ret |= a
+			continue
+		}
+		bit, err := strconv.ParseUint(name, 10, 8)
+		if err != nil || bit > 63 {
+			return 0, fmt.Errorf("%w: '%s'", ErrInvalidGPTAttribute, name)
+		}
+		ret |= 1 << bit
+	}
+	return ret, nil
+}
+
+// Has returns true if all attributes of `a` are set
+func (attrs GPTAttributes) Has(a GPTAttributes) bool {
+	return attrs&a == a
+}
+
+// String returns the attribute names, or bit numbers for the attributes without a name
+func (attrs GPTAttributes) String() string {
+	names := make([]string, 0, len(gptAttributeNames))
+	for name, a := range gptAttributeNames {
+		if attrs.Has(a) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	for bit := 3; bit < 64; bit++ {
+		if attrs.Has(1 << bit) {
+			names = append(names, strconv.Itoa(bit))
+		}
+	}
+	return strings.Join(names, ",")
+}
+
+// partitionNumberAndDisk returns the partition number and the disk of a partition
+func (d *Device) partitionNumberAndDisk() (int, *Device, error) {
+	if !d.IsPartition() {
+		return 0, nil, ErrDeviceNotPartition
+	}
+	partNum, err := d.GetPartitionNumber()
+	if err != nil {
+		return 0, nil, fmt.Errorf("%w: %w", ErrInvalidUevent, err)
+	}
+	disk := d.Disk
+	if disk == nil {
+		return 0, nil, ErrBrokenDiscovery
+	}
+	if disk.Path == "" {
+		return 0, nil, ErrNoDeviceNode
+	}
+	return partNum, disk, nil
+}
+
+// GetGPTAttributes reads the GPT attribute flags of the partition
+func (d *Device) GetGPTAttributes() (GPTAttributes, error) {
+	partNum, disk, err := d.partitionNumberAndDisk()
+	if err != nil {
+		return 0, err
+	}
+	g, err := disk.readNativeGPT()
+	if err == nil {
+		e, err := g.Entry(partNum)
+		if err != nil {
+			return 0, fmt.Errorf("device: %w", err)
+		}
+		return e.Attributes, nil
+	}
+	fallBackFromNativeGPT(disk, "get attributes", err)
+	out, err := exec.Command("sgdisk", "-i", strconv.Itoa(partNum), disk.Path).Output()
+	if err != nil {
+		return 0, fmt.Errorf("device: sgdisk -i failed: %w", toolError(ToolSgdisk, err))
+	}
+	return parseSgdiskAttributeFlags(out)
+}
+
+// parseSgdiskAttributeFlags parses the "Attribute flags: 0000000000000004" line of `sgdisk -i`
+func parseSgdiskAttributeFlags(out []byte) (GPTAttributes, error) {
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		value, ok := strings.CutPrefix(strings.TrimSpace(scanner.Text()), "Attribute flags:")
+		if !ok {
+			continue
+		}
+		attrs, err := strconv.ParseUint(strings.TrimSpace(value), 16, 64)
+		if err != nil {
+			return 0, fmt.Errorf("%w: %w", ErrGPTAttributesNotFound, err)
+		}
+		return GPTAttributes(attrs), nil
+	}
+	return 0, ErrGPTAttributesNotFound
+}
+
+// SetGPTAttributes sets the GPT attribute flags of the partition to exactly `attrs`
+func (d *Device) SetGPTAttributes(attrs GPTAttributes) error {
+	partNum, disk, err := d.partitionNumberAndDisk()
+	if err != nil {
+		return err
+	}
+	if err := disk.updateNativeGPT(func(g *GPT) error {
+		e, err := g.Entry(partNum)
+		if err != nil {
+			return err
+		}
+		e.Attributes = attrs
+		return nil
+	}); !fallBackFromNativeGPT(disk, "set attributes", err) {
+		if err != nil {
+			return fmt.Errorf("device: setting GPT attributes: %w", err)
+		}
+		return nil
+	}
+	if err := exec.Command("sgdisk", fmt.Sprintf("--attributes=%d:=:%016x", partNum, uint64(attrs)), disk.Path).Run(); err != nil {
+		return fmt.Errorf("device: sgdisk --attributes failed: %w", toolError(ToolSgdisk, err))
+	}
+	return nil
+}
+
+// AddGPTAttributes sets the GPT attribute flags `attrs` on the partition in addition to the ones which are already set
+func (d *Device) AddGPTAttributes(attrs GPTAttributes) error {
+	current, err := d.GetGPTAttributes()
+	if err != nil {
+		return err
+	}
+	if current.Has(attrs) {
+		return nil
+	}
+	return d.SetGPTAttributes(current | attrs)
+}
+
+// ApplyGPTAttributes adds the GPT attributes to the partitions which are keyed by their GPT partition name.
+// It tries all partitions, and returns the errors of all partitions which failed.
+func (d Devices) ApplyGPTAttributes(attrs map[string]GPTAttributes) error {
+	var errs []error
+	for name, a := range attrs {
+		var found bool
+		for _, dev := range d {
+			if !dev.IsPartition() || dev.GetPartitionName() != name {
+				continue
+			}
+			found = true
+			if err := dev.AddGPTAttributes(a); err != nil {
+				errs = append(errs, fmt.Errorf("partition '%s': %w", name, err))
+			}
+		}
+		if !found {
+			errs = append(errs, fmt.Errorf("%w: '%s'", ErrPartitionNameNotFound, name))
+		}
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,213 @@
+// Copyright 2023 Hedgehog
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package partitions
+
+import (
+	"errors"
+	"testing"
+
+	"go.githedgehog.com/dasboot/pkg/exec"
+	"go.githedgehog.com/dasboot/test/mock/mockexec"
+
+	gomock "github.com/golang/mock/gomock"
+)
+
+func TestParseGPTAttributes(t *testing.T) {
+	tests := []struct {
+		name    string
+		names   []string
+		want    GPTAttributes
+		wantStr string
+		wantErr bool
+	}{
+		{
+			name:    "empty",
+			want:    0,
+			wantStr: "",
+		},
+		{
+			name:    "well-known names",
+			names:   []string{"legacy_bios_bootable", "required"},
+			want:    GPTAttributeRequired | GPTAttributeLegacyBIOSBootable,
+			wantStr: "legacy_bios_bootable,required",
+		},
+		{
+			name:    "bit numbers",
+			names:   []string{"no_block_io", "48", "63"},
+			want:    GPTAttributeNoBlockIO | 1<<48 | 1<<63,
+			wantStr: "no_block_io,48,63",
+		},
+		{
+			name:    "bit number out of range",
+			names:   []string{"64"},
+			wantErr: true,
+		},
+		{
+			name:    "unknown name",
+			names:   []string{"bootable"},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseGPTAttributes(tt.names)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseGPTAttributes() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				if !errors.Is(err, ErrInvalidGPTAttribute) {
+					t.Errorf("ParseGPTAttributes() error = %v, wantErrToBe %v", err, ErrInvalidGPTAttribute)
+				}
+				return
+			}
+			if got != tt.want {
+				t.Errorf("ParseGPTAttributes() = %x, want %x", uint64(got), uint64(tt.want))
+			}
+			if got.String() != tt.wantStr {
+				t.Errorf("GPTAttributes.String() = %q, want %q", got.String(), tt.wantStr)
+			}
+		})
+	}
+}
+
+const sgdiskInfoOutput = `Partition GUID code: 0FC63DAF-8483-4772-8E79-3D69D8477DE4 (Linux filesystem)
+Partition unique GUID: 4B4D9E5A-1C5E-4D4B-A1D0-2B5F6E0C9A11
+First sector: 2048 (at 1024.0 KiB)
+Last sector: 206847 (at 101.0 MiB)
+Partition size: 204800 sectors (100.0 MiB)
+Attribute flags: 0000000000000001
+Partition name: 'SONiC-OS'
+`
+
+func TestDevice_AddGPTAttributes(t *testing.T) {
+	errCmdFailed := errors.New("command failed")
+	partition := func() *Device {
+		return &Device{
+			Uevent: Uevent{
+				UeventDevtype: UeventDevtypePartition,
+				UeventPartn:   "3",
+			},
+			Path: "/dev/sda3",
+			Disk: &Device{
+				Uevent: Uevent{
+					UeventDevtype: UeventDevtypeDisk,
+				},
+				Path: "/dev/sda",
+			},
+		}
+	}
+	sgdiskInfo := func(t *testing.T, ctrl *gomock.Controller, out string, err error) exec.CommandFunc {
+		return mockexec.MockCommand(t, ctrl, []string{"sgdisk", "-i", "3", "/dev/sda"}, func(tc *mockexec.TestCmd) {
+			tc.EXPECT().Output().Times(1).DoAndReturn(func() ([]byte, error) {
+				if err := tc.IsExpectedCommand(); err != nil {
+					return nil, err
+				}
+				return []byte(out), err
+			})
+		})
+	}
+	tests := []struct {
+		name        string
+		device      *Device
+		attrs       GPTAttributes
+		cmds        func(t *testing.T, ctrl *gomock.Controller) []exec.CommandFunc
+		wantErr     bool
+		wantErrToBe error
+	}{
+		{
+			name:   "success",
+			device: partition(),
+			attrs:  GPTAttributeLegacyBIOSBootable,
+			cmds: func(t *testing.T, ctrl *gomock.Controller) []exec.CommandFunc {
+				return []exec.CommandFunc{
+					sgdiskInfo(t, ctrl, sgdiskInfoOutput, nil),
+					mockexec.MockCommand(t, ctrl, []string{"sgdisk", "--attributes=3:=:0000000000000005", "/dev/sda"}, func(tc *mockexec.TestCmd) {
+						tc.EXPECT().Run().Times(1).DoAndReturn(func() error {
+							return tc.IsExpectedCommand()
+						})
+					}),
+				}
+			},
+		},
+		{
+			name:   "already set",
+			device: partition(),
+			attrs:  GPTAttributeRequired,
+			cmds: func(t *testing.T, ctrl *gomock.Controller) []exec.CommandFunc {
+				return []exec.CommandFunc{
+					sgdiskInfo(t, ctrl, sgdiskInfoOutput, nil),
+				}
+			},
+		},
+		{
+			name:   "sgdisk info fails",
+			device: partition(),
+			attrs:  GPTAttributeRequired,
+			cmds: func(t *testing.T, ctrl *gomock.Controller) []exec.CommandFunc {
+				return []exec.CommandFunc{
+					sgdiskInfo(t, ctrl, "", errCmdFailed),
+				}
+			},
+			wantErr:     true,
+			wantErrToBe: errCmdFailed,
+		},
+		{
+			name:   "no attribute flags in output",
+			device: partition(),
+			attrs:  GPTAttributeRequired,
+			cmds: func(t *testing.T, ctrl *gomock.Controller) []exec.CommandFunc {
+				return []exec.CommandFunc{
+					sgdiskInfo(t, ctrl, "Partition #3 does not exist.\n", nil),
+				}
+			},
+			wantErr:     true,
+			wantErrToBe: ErrGPTAttributesNotFound,
+		},
+		{
+			name: "not a partition",
+			device: &Device{
+				Uevent: Uevent{
+					UeventDevtype: UeventDevtypeDisk,
+				},
+				Path: "/dev/sda",
+			},
+			wantErr:     true,
+			wantErrToBe: ErrDeviceNotPartition,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			defer ctrl.Finish()
+			if tt.cmds != nil {
+				oldCommand := exec.Command
+				defer func() {
+					exec.Command = oldCommand
+				}()
+				cmds := mockexec.NewMockCommands(tt.cmds(t, ctrl))
+				defer cmds.Finish()
+				exec.Command = cmds.Command()
+			}
+			err := tt.device.AddGPTAttributes(tt.attrs)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Device.AddGPTAttributes() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if err != nil && tt.wantErrToBe != nil && !errors.Is(err, tt.wantErrToBe) {
+				t.Errorf("Device.AddGPTAttributes() error = %v, wantErrToBe %v", err, tt.wantErrToBe)
+			}
+		})
+	}
+}
@@ -0,0 +1,156 @@
+// Copyright 2023 Hedgehog
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package partitions
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"go.githedgehog.com/dasboot/pkg/log"
+
+	"go.uber.org/zap"
+	"golang.org/x/sys/unix"
+)
+
+// GPTBackend selects how partition tables are being read and changed
+type GPTBackend string
+
+const (
+	// GPTBackendNative reads and writes partition tables directly. It falls back to sgdisk and grub-probe for
+	// disks whose partition table it cannot read, e.g. disks without a partition table at all.
+	GPTBackendNative GPTBackend = "native"
+
+	// GPTBackendSgdisk uses sgdisk to change partition tables and grub-probe to discover partition types
+	GPTBackendSgdisk GPTBackend = "sgdisk"
+
+	DefaultGPTBackend = GPTBackendNative
+)
+
+// errNativeGPTUnavailable is returned if the partition table of a disk cannot be read natively. It is the
+// signal for falling back to the external tools.
+var errNativeGPTUnavailable = errors.New("partitions: native GPT backend unavailable")
+
+// gptBackend is the backend which all partition table operations use
+var gptBackend = DefaultGPTBackend
+
+// SetGPTBackend sets the backend for all subsequent partition table operations
+func SetGPTBackend(b GPTBackend) {
+	if b == "" {
+		b = DefaultGPTBackend
+	}
+	gptBackend = b
+}
+
+// readNativeGPT reads the partition table of the disk. All errors wrap `errNativeGPTUnavailable`.
+func (d *Device) readNativeGPT() (*GPT, error) {
+	if gptBackend != GPTBackendNative {
+		return nil, fmt.Errorf("%w: backend is %s", errNativeGPTUnavailable, gptBackend)
+	}
+	f, err := osOpenFile(d.Path, os.O_RDONLY, 0)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", errNativeGPTUnavailable, err)
+	}
+	defer f.Close()
+	g, err := readGPTFile(f)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", errNativeGPTUnavailable, err)
+	}
+	return g, nil
+}
+
+// updateNativeGPT reads the partition table of the disk, applies `fn` to it, and writes it back. It returns an
+// error which wraps `errNativeGPTUnavailable` if the table could not be read, and nothing was changed.
+func (d *Device) updateNativeGPT(fn func(g *GPT) error) error {
+	if gptBackend != GPTBackendNative {
+		return fmt.Errorf("%w: backend is %s", errNativeGPTUnavailable, gptBackend)
+	}
+	f, err := osOpenFile(d.Path, os.O_RDWR, 0)
+	if err != nil {
+		return fmt.Errorf("%w: %w", errNativeGPTUnavailable, err)
+	}
+	defer f.Close()
+	g, err := readGPTFile(f)
+	if err != nil {
+		return fmt.Errorf("%w: %w", errNativeGPTUnavailable, err)
+	}
+	if err := fn(g); err != nil {
+		return err
+	}
+	if err := g.Write(f); err != nil {
+		return err
+	}
+	return f.Sync()
+}
+
+// fallBackFromNativeGPT logs why the native backend could not be used for `op`, and returns true if the
+// operation should be done with the external tools instead
+func fallBackFromNativeGPT(d *Device, op string, err error) bool {
+	if !errors.Is(err, errNativeGPTUnavailable) {
+		return false
+	}
+	if gptBackend == GPTBackendNative {
+		log.L().Debug("Falling back to external tools for partition table operation", zap.String("device", d.Path), zap.String("op", op), zap.Error(err))
+	}
+	return true
+}
+
+// readGPTFile reads the partition table from a disk device or a disk image
+func readGPTFile(f *os.File) (*GPT, error) {
+	size, err := f.Seek(0, io.SeekEnd)
+	if err != nil {
+		return nil, fmt.Errorf("gpt: determining disk size: %w", err)
+	}
+	sectorSize := 512
+	if info, err := f.Stat(); err == nil && info.Mode()&os.ModeDevice != 0 {
+		if ss, err := unixIoctlGetInt(int(f.Fd()), unix.BLKSSZGET); err == nil && ss > 0 {
+			sectorSize = ss
+		}
+	}
+	return ReadGPT(f, size, sectorSize)
+}
+
+// discoverPartitionTypeNative sets the partition type from the partition table of the disk of the partition. As
+// all partitions of a disk share the same table, every table is read only once and cached in `tables`. All errors
+// wrap `errNativeGPTUnavailable`.
+func (d *Device) discoverPartitionTypeNative(tables map[*Device]*GPT) error {
+	if d.Disk == nil || d.Disk.Path == "" {
+		return fmt.Errorf("%w: %w", errNativeGPTUnavailable, ErrNoDeviceNode)
+	}
+	partNum, err := d.GetPartitionNumber()
+	if err != nil {
+		return fmt.Errorf("%w: %w", errNativeGPTUnavailable, err)
+	}
+	g, ok := tables[d.Disk]
+	if !ok {
+		g, err = d.Disk.readNativeGPT()
+		if err != nil {
+			// remember the failure, so that we don't try again for every partition
+			tables[d.Disk] = nil
+			return err
+		}
+		tables[d.Disk] = g
+	}
+	if g == nil {
+		return fmt.Errorf("%w: partition table of %s unreadable", errNativeGPTUnavailable, d.Disk.Path)
+	}
+	e, err := g.Entry(partNum)
+	if err != nil {
+		return fmt.Errorf("%w: %w", errNativeGPTUnavailable, err)
+	}
+	d.GPTPartType = e.Type
+	return nil
+}
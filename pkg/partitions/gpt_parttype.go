@@ -0,0 +1,177 @@
+// Copyright 2023 Hedgehog
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package partitions
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// PartType is a GPT partition type GUID. It is always in its normalized form (lower case, no braces), so it can
+// be compared directly. Use ParsePartType to create one from external input.
+type PartType string
+
+// PartTypeRole describes what a partition type is being used for
+type PartTypeRole string
+
+const (
+	PartTypeRoleUnknown          PartTypeRole = ""
+	PartTypeRoleData             PartTypeRole = "data"
+	PartTypeRoleBIOSBoot         PartTypeRole = "bios-boot"
+	PartTypeRoleEFI              PartTypeRole = "efi"
+	PartTypeRoleONIE             PartTypeRole = "onie"
+	PartTypeRoleDiag             PartTypeRole = "diag"
+	PartTypeRoleNOS              PartTypeRole = "nos"
+	PartTypeRoleHedgehogIdentity PartTypeRole = "hedgehog-identity"
+	PartTypeRoleHedgehogLocation PartTypeRole = "hedgehog-location"
+)
+
+// PartTypeInfo describes a known partition type
+type PartTypeInfo struct {
+	Type        PartType
+	Role        PartTypeRole
+	Description string
+}
+
+const (
+	GPTPartTypeONIE             PartType = "7412f7d5-a156-4b13-81dc-867174929325"
+	GPTPartTypeEFI              PartType = "c12a7328-f81f-11d2-ba4b-00a0c93ec93b"
+	GPTPartTypeBIOSBoot         PartType = "21686148-6449-6e6f-744e-656564454649"
+	GPTPartTypeLinuxData        PartType = "0fc63daf-8483-4772-8e79-3d69d8477de4"
+	GPTPartTypeBasicData        PartType = "ebd0a0a2-b9e5-4433-87c0-68b6b72699c7"
+	GPTPartTypeHedgehogIdentity PartType = "e982e2bd-867c-4d7a-89a2-9c5a9bc5dfdd"
+	GPTPartTypeHedgehogLocation PartType = "e23c5ebc-5f53-488c-959d-a4ab90befefe"
+)
+
+var (
+	ErrInvalidPartType  = errors.New("partitions: invalid GPT partition type")
+	ErrPartTypeConflict = errors.New("partitions: GPT partition type already registered with a different role")
+)
+
+var partTypeRegex = regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{12}$`)
+
+// partTypes is the registry of all known partition types.
+//
+// NOTE: vendors usually put their diagnostics OS on generic data partitions (e.g. "DELL-DIAG" or "ACCTON-DIAG"),
+// and SONiC installs itself on a generic Linux data partition. These are being detected by partition name or
+// filesystem label. Platforms which use dedicated partition types can register them with RegisterPartType.
+var (
+	partTypes = map[PartType]PartTypeInfo{
+		GPTPartTypeONIE:             {Type: GPTPartTypeONIE, Role: PartTypeRoleONIE, Description: "ONIE boot"},
+		GPTPartTypeEFI:              {Type: GPTPartTypeEFI, Role: PartTypeRoleEFI, Description: "EFI system"},
+		GPTPartTypeBIOSBoot:         {Type: GPTPartTypeBIOSBoot, Role: PartTypeRoleBIOSBoot, Description: "BIOS boot"},
+		GPTPartTypeLinuxData:        {Type: GPTPartTypeLinuxData, Role: PartTypeRoleData, Description: "Linux filesystem data"},
+		GPTPartTypeBasicData:        {Type: GPTPartTypeBasicData, Role: PartTypeRoleData, Description: "Microsoft basic data"},
+		GPTPartTypeHedgehogIdentity: {Type: GPTPartTypeHedgehogIdentity, Role: PartTypeRoleHedgehogIdentity, Description: "Hedgehog identity"},
+		GPTPartTypeHedgehogLocation: {Type: GPTPartTypeHedgehogLocation, Role: PartTypeRoleHedgehogLocation, Description: "Hedgehog location"},
+	}
+	partTypesLock sync.RWMutex
+)
+
+// ParsePartType normalizes `s` (case, surrounding whitespace and braces) and validates it as a partition type GUID
+func ParsePartType(s string) (PartType, error) {
+	t := normalizePartType(s)
+	if !partTypeRegex.MatchString(string(t)) {
+		return "", fmt.Errorf("%w: '%s'", ErrInvalidPartType, s)
+	}
+	return t, nil
+}
+
+// normalizePartType normalizes `s` without validating it
+func normalizePartType(s string) PartType {
+	norm := strings.ToLower(strings.TrimSpace(s))
+	return PartType(strings.TrimSuffix(strings.TrimPrefix(norm, "{"), "}"))
+}
+
+// RegisterPartType adds a partition type to the registry of known types. Registering a known type again
+// with the same role is a no-op, registering it with a different role fails.
+func RegisterPartType(info PartTypeInfo) error {
+	t, err := ParsePartType(string(info.Type))
+	if err != nil {
+		return err
+	}
+	info.Type = t
+	partTypesLock.Lock()
+	defer partTypesLock.Unlock()
+	if existing, ok := partTypes[t]; ok && existing.Role != info.Role {
+		return fmt.Errorf("%w: %s is registered as '%s'", ErrPartTypeConflict, t, existing.Role)
+	}
+	partTypes[t] = info
+	return nil
+}
+
+// LookupPartType returns the registry entry of a partition type
+func LookupPartType(t PartType) (PartTypeInfo, bool) {
+	partTypesLock.RLock()
+	defer partTypesLock.RUnlock()
+	info, ok := partTypes[t]
+	return info, ok
+}
+
+// KnownPartTypes returns all registered partition types ordered by their GUID
+func KnownPartTypes() []PartTypeInfo {
+	partTypesLock.RLock()
+	defer partTypesLock.RUnlock()
+	ret := make([]PartTypeInfo, 0, len(partTypes))
+	for _, info := range partTypes {
+		ret = append(ret, info)
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i].Type < ret[j].Type })
+	return ret
+}
+
+// String implements fmt.Stringer
+func (t PartType) String() string {
+	return string(t)
+}
+
+// Upper returns the GUID in upper case as tools like sgdisk print it
+func (t PartType) Upper() string {
+	return strings.ToUpper(string(t))
+}
+
+// Role returns the role of a registered partition type, or PartTypeRoleUnknown
+func (t PartType) Role() PartTypeRole {
+	info, _ := LookupPartType(t)
+	return info.Role
+}
+
+func (t PartType) IsEFI() bool {
+	return t.Role() == PartTypeRoleEFI
+}
+
+func (t PartType) IsONIE() bool {
+	return t.Role() == PartTypeRoleONIE
+}
+
+func (t PartType) IsDiag() bool {
+	return t.Role() == PartTypeRoleDiag
+}
+
+func (t PartType) IsNOS() bool {
+	return t.Role() == PartTypeRoleNOS
+}
+
+func (t PartType) IsHedgehogIdentity() bool {
+	return t.Role() == PartTypeRoleHedgehogIdentity
+}
+
+func (t PartType) IsHedgehogLocation() bool {
+	return t.Role() == PartTypeRoleHedgehogLocation
+}
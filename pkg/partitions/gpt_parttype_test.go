@@ -0,0 +1,126 @@
+// Copyright 2023 Hedgehog
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package partitions
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestParsePartType(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   string
+		want    PartType
+		wantErr error
+	}{
+		{
+			name:  "normalized",
+			input: "c12a7328-f81f-11d2-ba4b-00a0c93ec93b",
+			want:  GPTPartTypeEFI,
+		},
+		{
+			name:  "upper case",
+			input: "7412F7D5-A156-4B13-81DC-867174929325",
+			want:  GPTPartTypeONIE,
+		},
+		{
+			name:  "braces and whitespace",
+			input: " {E982E2BD-867C-4D7A-89A2-9C5A9BC5DFDD}\n",
+			want:  GPTPartTypeHedgehogIdentity,
+		},
+		{
+			name:    "not a GUID",
+			input:   "8300",
+			wantErr: ErrInvalidPartType,
+		},
+		{
+			name:    "empty",
+			input:   "",
+			wantErr: ErrInvalidPartType,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParsePartType(tt.input)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("ParsePartType() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("ParsePartType() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPartTypeRoles(t *testing.T) {
+	tests := []struct {
+		partType PartType
+		want     PartTypeRole
+	}{
+		{partType: GPTPartTypeEFI, want: PartTypeRoleEFI},
+		{partType: GPTPartTypeONIE, want: PartTypeRoleONIE},
+		{partType: GPTPartTypeBIOSBoot, want: PartTypeRoleBIOSBoot},
+		{partType: GPTPartTypeLinuxData, want: PartTypeRoleData},
+		{partType: GPTPartTypeHedgehogIdentity, want: PartTypeRoleHedgehogIdentity},
+		{partType: GPTPartTypeHedgehogLocation, want: PartTypeRoleHedgehogLocation},
+		{partType: "00000000-0000-0000-0000-000000000000", want: PartTypeRoleUnknown},
+	}
+	for _, tt := range tests {
+		t.Run(tt.partType.String(), func(t *testing.T) {
+			if got := tt.partType.Role(); got != tt.want {
+				t.Errorf("PartType.Role() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRegisterPartType(t *testing.T) {
+	const vendorDiag PartType = "3b5e8f0a-1d2c-4e6f-9a8b-7c6d5e4f3a2b"
+	defer func() {
+		partTypesLock.Lock()
+		delete(partTypes, vendorDiag)
+		partTypesLock.Unlock()
+	}()
+
+	dev := &Device{
+		Uevent:      Uevent{UeventDevtype: UeventDevtypePartition, UeventPartname: "VENDOR"},
+		GPTPartType: vendorDiag,
+	}
+	if dev.IsDiagPartition() {
+		t.Fatal("unregistered partition type must not be detected as diag partition")
+	}
+
+	if err := RegisterPartType(PartTypeInfo{Type: PartType("{3B5E8F0A-1D2C-4E6F-9A8B-7C6D5E4F3A2B}"), Role: PartTypeRoleDiag, Description: "vendor diagnostics"}); err != nil {
+		t.Fatalf("RegisterPartType() error = %v", err)
+	}
+	if !dev.IsDiagPartition() {
+		t.Error("registered diag partition type must be detected as diag partition")
+	}
+	if info, ok := LookupPartType(vendorDiag); !ok || info.Description != "vendor diagnostics" {
+		t.Errorf("LookupPartType() = %v, %v", info, ok)
+	}
+
+	// registering again with the same role is fine, but not with a different one
+	if err := RegisterPartType(PartTypeInfo{Type: vendorDiag, Role: PartTypeRoleDiag}); err != nil {
+		t.Errorf("RegisterPartType() with same role error = %v", err)
+	}
+	if err := RegisterPartType(PartTypeInfo{Type: GPTPartTypeEFI, Role: PartTypeRoleDiag}); !errors.Is(err, ErrPartTypeConflict) {
+		t.Errorf("RegisterPartType() with different role error = %v, want %v", err, ErrPartTypeConflict)
+	}
+	if err := RegisterPartType(PartTypeInfo{Type: "not-a-guid", Role: PartTypeRoleDiag}); !errors.Is(err, ErrInvalidPartType) {
+		t.Errorf("RegisterPartType() with invalid type error = %v, want %v", err, ErrInvalidPartType)
+	}
+}
@@ -0,0 +1,484 @@
+// Copyright 2023 Hedgehog
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package partitions
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+func TestMain(m *testing.M) {
+	// the tests run with the native backend and native filesystem probing like the real thing, but the device
+	// paths which they use must never be opened for real. They do not exist for the native code, which falls
+	// back to the mocked sgdisk and grub-probe, and disk images in temporary directories can be used instead.
+	tmp := os.TempDir()
+	osOpenFile = func(name string, flag int, perm fs.FileMode) (*os.File, error) {
+		if rel, err := filepath.Rel(tmp, name); err != nil || !filepath.IsLocal(rel) {
+			return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+		}
+		return os.OpenFile(name, flag, perm)
+	}
+	os.Exit(m.Run())
+}
+
+// useNativeGPTBackend enables the native backend for the duration of the test
+func useNativeGPTBackend(t *testing.T) {
+	old := gptBackend
+	t.Cleanup(func() { gptBackend = old })
+	SetGPTBackend(GPTBackendNative)
+}
+
+// newGPTImage creates a disk image of `sizeInMB` with a protective MBR and an empty GUID partition table
+// of 128 entries, the same layout which sgdisk creates
+func newGPTImage(t *testing.T, sizeInMB int) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "disk.img")
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	size := int64(sizeInMB) * 1024 * 1024
+	if err := f.Truncate(size); err != nil {
+		t.Fatal(err)
+	}
+	sectors := uint64(size / 512)
+
+	mbr := make([]byte, 512)
+	mbr[mbrPartitionOffset+4] = mbrTypeProtective
+	binary.LittleEndian.PutUint32(mbr[mbrPartitionOffset+8:], 1)
+	binary.LittleEndian.PutUint32(mbr[mbrPartitionOffset+12:], uint32(sectors-1))
+	mbr[mbrSignatureOffset] = 0x55
+	mbr[mbrSignatureOffset+1] = 0xaa
+	if _, err := f.WriteAt(mbr, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	g := &GPT{
+		SectorSize:        512,
+		DiskGUID:          uuid.New(),
+		FirstUsableLBA:    34,
+		LastUsableLBA:     sectors - 34,
+		Entries:           make([]GPTEntry, 128),
+		primaryEntriesLBA: 2,
+		backupLBA:         sectors - 1,
+	}
+	if err := g.Write(f); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// goldenGPTImage returns a copy of the disk image in testdata which was created by systemd-repart from the
+// definitions next to it. It has an EFI system partition and an identity partition, and a table which is
+// aligned like the ones of sgdisk and fdisk, which are the tables the native backend has to deal with.
+func goldenGPTImage(t *testing.T) string {
+	t.Helper()
+	in, err := os.Open(filepath.Join("testdata", "ReadGPT", "disk.img.gz"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer in.Close()
+	zr, err := gzip.NewReader(in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := io.ReadAll(zr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "golden.img")
+	if err := os.WriteFile(path, b, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func readGPTImage(t *testing.T, path string) *GPT {
+	t.Helper()
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	g, err := readGPTFile(f)
+	if err != nil {
+		t.Fatalf("readGPTFile() error = %v", err)
+	}
+	return g
+}
+
+func writeGPTImage(t *testing.T, path string, g *GPT) {
+	t.Helper()
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if err := g.Write(f); err != nil {
+		t.Fatalf("GPT.Write() error = %v", err)
+	}
+}
+
+func TestReadGPT(t *testing.T) {
+	corrupt := func(t *testing.T, path string, off int64) {
+		t.Helper()
+		f, err := os.OpenFile(path, os.O_RDWR, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		if _, err := f.WriteAt([]byte("XXXX"), off); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tests := []struct {
+		name        string
+		prepare     func(t *testing.T, path string)
+		wantErrToBe error
+	}{
+		{
+			name: "success",
+		},
+		{
+			name: "primary header corrupt",
+			prepare: func(t *testing.T, path string) {
+				corrupt(t, path, 512+40)
+			},
+		},
+		{
+			name: "primary entries corrupt",
+			prepare: func(t *testing.T, path string) {
+				corrupt(t, path, 1024)
+			},
+		},
+		{
+			name: "primary and backup header corrupt",
+			prepare: func(t *testing.T, path string) {
+				corrupt(t, path, 512+40)
+				corrupt(t, path, 16*1024*1024-512+40)
+			},
+			wantErrToBe: ErrInvalidGPT,
+		},
+		{
+			name: "no MBR signature",
+			prepare: func(t *testing.T, path string) {
+				corrupt(t, path, mbrSignatureOffset)
+			},
+			wantErrToBe: ErrNoGPT,
+		},
+		{
+			name: "no protective MBR",
+			prepare: func(t *testing.T, path string) {
+				corrupt(t, path, mbrPartitionOffset+4)
+			},
+			wantErrToBe: ErrNoGPT,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := newGPTImage(t, 16)
+			g := readGPTImage(t, path)
+			if _, err := g.Add(1, GPTPartTypeONIE, GPTPartNameONIE, 1024*1024); err != nil {
+				t.Fatal(err)
+			}
+			writeGPTImage(t, path, g)
+			if tt.prepare != nil {
+				tt.prepare(t, path)
+			}
+
+			f, err := os.Open(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer f.Close()
+			got, err := ReadGPT(f, 16*1024*1024, 512)
+			if !errors.Is(err, tt.wantErrToBe) {
+				t.Fatalf("ReadGPT() error = %v, wantErrToBe %v", err, tt.wantErrToBe)
+			}
+			if err != nil {
+				return
+			}
+			if got.DiskGUID != g.DiskGUID {
+				t.Errorf("ReadGPT() disk GUID = %s, want %s", got.DiskGUID, g.DiskGUID)
+			}
+			e, err := got.Entry(1)
+			if err != nil {
+				t.Fatalf("GPT.Entry() error = %v", err)
+			}
+			if *e != g.Entries[0] {
+				t.Errorf("GPT.Entry() = %#v, want %#v", *e, g.Entries[0])
+			}
+		})
+	}
+}
+
+func TestReadGPT_golden(t *testing.T) {
+	wantEntries := []GPTEntry{
+		{
+			Type:       GPTPartTypeEFI,
+			UniqueGUID: uuid.MustParse("3b2f0a4e-8d1c-4f5e-9a7b-1c2d3e4f5a6b"),
+			FirstLBA:   2048,
+			LastLBA:    6143,
+			Name:       "EFI System",
+		},
+		{
+			Type:       GPTPartTypeHedgehogIdentity,
+			UniqueGUID: uuid.MustParse("5c0b8d1a-7e4f-4c32-9a55-3e8f0d2b6a71"),
+			FirstLBA:   6144,
+			LastLBA:    8191,
+			Name:       GPTPartNameHedgehogIdentity,
+		},
+	}
+	check := func(t *testing.T, g *GPT) {
+		t.Helper()
+		if want := uuid.MustParse("3f200c87-6598-4b5b-8d76-e3fdee615e0b"); g.DiskGUID != want {
+			t.Errorf("ReadGPT() disk GUID = %s, want %s", g.DiskGUID, want)
+		}
+		if g.FirstUsableLBA != 2048 || g.LastUsableLBA != 16350 {
+			t.Errorf("ReadGPT() usable LBAs = %d-%d, want 2048-16350", g.FirstUsableLBA, g.LastUsableLBA)
+		}
+		if g.primaryEntriesLBA != 2 || g.backupLBA != 16383 {
+			t.Errorf("ReadGPT() entries at LBA %d, backup at LBA %d, want 2 and 16383", g.primaryEntriesLBA, g.backupLBA)
+		}
+		if len(g.Entries) != 128 {
+			t.Fatalf("ReadGPT() = %d entries, want 128", len(g.Entries))
+		}
+		for i, want := range wantEntries {
+			if g.Entries[i] != want {
+				t.Errorf("ReadGPT() entry %d = %#v, want %#v", i+1, g.Entries[i], want)
+			}
+		}
+		for i, e := range g.Entries[len(wantEntries):] {
+			if e.IsUsed() {
+				t.Errorf("ReadGPT() entry %d = %#v, want unused", len(wantEntries)+i+1, e)
+			}
+		}
+	}
+
+	path := goldenGPTImage(t)
+	golden, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	g := readGPTImage(t, path)
+	check(t, g)
+
+	// writing the table back unchanged must reproduce the table of systemd-repart byte for byte
+	writeGPTImage(t, path, g)
+	written, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(written, golden) {
+		t.Errorf("GPT.Write() changed the unchanged table")
+	}
+
+	// the backup table is the same as the primary one
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if _, err := f.WriteAt(make([]byte, 512), 512); err != nil {
+		t.Fatal(err)
+	}
+	backup, err := ReadGPT(f, int64(len(golden)), 512)
+	if err != nil {
+		t.Fatalf("ReadGPT() from backup error = %v", err)
+	}
+	check(t, backup)
+}
+
+func TestGPT_Write(t *testing.T) {
+	// writing a table which was read from the backup must restore the primary table
+	path := newGPTImage(t, 16)
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if _, err := f.WriteAt(make([]byte, 512), 512); err != nil {
+		t.Fatal(err)
+	}
+	g, err := readGPTFile(f)
+	if err != nil {
+		t.Fatalf("readGPTFile() error = %v", err)
+	}
+	if err := g.Write(f); err != nil {
+		t.Fatalf("GPT.Write() error = %v", err)
+	}
+	if _, err := readGPTAt(f, 1, 512); err != nil {
+		t.Errorf("primary table not restored: %v", err)
+	}
+	if _, err := readGPTAt(f, g.backupLBA, 512); err != nil {
+		t.Errorf("backup table broken: %v", err)
+	}
+}
+
+func TestGPT_AddDeleteResize(t *testing.T) {
+	g := readGPTImage(t, newGPTImage(t, 16))
+	mb := uint64(1024 * 1024)
+
+	e1, err := g.Add(1, GPTPartTypeEFI, "EFI System", 2*mb)
+	if err != nil {
+		t.Fatalf("GPT.Add() error = %v", err)
+	}
+	if e1.FirstLBA != 2048 || e1.Sectors() != 4096 {
+		t.Errorf("GPT.Add() = %d+%d, want 2048+4096", e1.FirstLBA, e1.Sectors())
+	}
+	e2, err := g.Add(2, GPTPartTypeONIE, GPTPartNameONIE, mb)
+	if err != nil {
+		t.Fatalf("GPT.Add() error = %v", err)
+	}
+	if e2.FirstLBA != 6144 {
+		t.Errorf("GPT.Add() first LBA = %d, want 6144", e2.FirstLBA)
+	}
+	if _, err := g.Add(2, GPTPartTypeONIE, GPTPartNameONIE, mb); !errors.Is(err, ErrGPTEntryExists) {
+		t.Errorf("GPT.Add() error = %v, wantErrToBe %v", err, ErrGPTEntryExists)
+	}
+	if _, err := g.Add(3, GPTPartTypeHedgehogIdentity, GPTPartNameHedgehogIdentity, 16*mb); !errors.Is(err, ErrGPTNoSpace) {
+		t.Errorf("GPT.Add() error = %v, wantErrToBe %v", err, ErrGPTNoSpace)
+	}
+	if _, err := g.Add(129, GPTPartTypeHedgehogIdentity, GPTPartNameHedgehogIdentity, mb); !errors.Is(err, ErrGPTInvalidPartitionNo) {
+		t.Errorf("GPT.Add() error = %v, wantErrToBe %v", err, ErrGPTInvalidPartitionNo)
+	}
+
+	// the first partition cannot grow into the second one
+	if err := g.Resize(1, 4*mb); !errors.Is(err, ErrGPTNoSpace) {
+		t.Errorf("GPT.Resize() error = %v, wantErrToBe %v", err, ErrGPTNoSpace)
+	}
+	if err := g.Resize(2, 8*mb); err != nil {
+		t.Errorf("GPT.Resize() error = %v", err)
+	}
+	if e2.Sectors() != 16384 {
+		t.Errorf("GPT.Resize() sectors = %d, want 16384", e2.Sectors())
+	}
+
+	if err := g.Delete(1); err != nil {
+		t.Errorf("GPT.Delete() error = %v", err)
+	}
+	if err := g.Delete(1); !errors.Is(err, ErrGPTEntryNotFound) {
+		t.Errorf("GPT.Delete() error = %v, wantErrToBe %v", err, ErrGPTEntryNotFound)
+	}
+	// the freed space gets reused
+	e3, err := g.Add(3, GPTPartTypeHedgehogIdentity, GPTPartNameHedgehogIdentity, mb)
+	if err != nil {
+		t.Fatalf("GPT.Add() error = %v", err)
+	}
+	if e3.FirstLBA != 2048 {
+		t.Errorf("GPT.Add() first LBA = %d, want 2048", e3.FirstLBA)
+	}
+}
+
+func TestDevice_nativeGPT(t *testing.T) {
+	useNativeGPTBackend(t)
+	path := newGPTImage(t, 16)
+	g := readGPTImage(t, path)
+	if _, err := g.Add(1, GPTPartTypeONIE, GPTPartNameONIE, 1024*1024); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := g.Add(2, GPTPartTypeHedgehogIdentity, GPTPartNameHedgehogIdentity, 1024*1024); err != nil {
+		t.Fatal(err)
+	}
+	writeGPTImage(t, path, g)
+
+	disk := &Device{
+		Uevent: Uevent{UeventDevtype: UeventDevtypeDisk},
+		Path:   path,
+	}
+	partition := func(n string) *Device {
+		return &Device{
+			Uevent: Uevent{UeventDevtype: UeventDevtypePartition, UeventPartn: n},
+			Disk:   disk,
+		}
+	}
+
+	// discovery reads the partition types from the table
+	tables := make(map[*Device]*GPT)
+	p2 := partition("2")
+	if err := p2.discoverPartitionTypeNative(tables); err != nil {
+		t.Fatalf("Device.discoverPartitionTypeNative() error = %v", err)
+	}
+	if p2.GPTPartType != GPTPartTypeHedgehogIdentity {
+		t.Errorf("Device.discoverPartitionTypeNative() type = %s, want %s", p2.GPTPartType, GPTPartTypeHedgehogIdentity)
+	}
+	if len(tables) != 1 {
+		t.Errorf("Device.discoverPartitionTypeNative() cached %d tables, want 1", len(tables))
+	}
+	if err := partition("3").discoverPartitionTypeNative(tables); !errors.Is(err, errNativeGPTUnavailable) {
+		t.Errorf("Device.discoverPartitionTypeNative() error = %v, wantErrToBe %v", err, errNativeGPTUnavailable)
+	}
+
+	// attributes
+	if err := p2.SetGPTAttributes(GPTAttributeRequired | GPTAttributeNoBlockIO); err != nil {
+		t.Fatalf("Device.SetGPTAttributes() error = %v", err)
+	}
+	attrs, err := p2.GetGPTAttributes()
+	if err != nil {
+		t.Fatalf("Device.GetGPTAttributes() error = %v", err)
+	}
+	if attrs != GPTAttributeRequired|GPTAttributeNoBlockIO {
+		t.Errorf("Device.GetGPTAttributes() = %s, want %s", attrs, GPTAttributeRequired|GPTAttributeNoBlockIO)
+	}
+
+	// deletion
+	if err := p2.Delete(); err != nil {
+		t.Fatalf("Device.Delete() error = %v", err)
+	}
+	if err := p2.Delete(); !errors.Is(err, ErrGPTEntryNotFound) {
+		t.Errorf("Device.Delete() error = %v, wantErrToBe %v", err, ErrGPTEntryNotFound)
+	}
+	got := readGPTImage(t, path)
+	if got.Entries[1].IsUsed() || !got.Entries[0].IsUsed() {
+		t.Errorf("Device.Delete() removed the wrong partition: %#v", got.Entries[:2])
+	}
+}
+
+func TestDevice_nativeGPTUnavailable(t *testing.T) {
+	useNativeGPTBackend(t)
+	path := filepath.Join(t.TempDir(), "empty.img")
+	if err := os.WriteFile(path, make([]byte, 1024*1024), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	disk := &Device{
+		Uevent: Uevent{UeventDevtype: UeventDevtypeDisk},
+		Path:   path,
+	}
+	_, err := disk.readNativeGPT()
+	if !errors.Is(err, errNativeGPTUnavailable) || !errors.Is(err, ErrNoGPT) {
+		t.Errorf("Device.readNativeGPT() error = %v, wantErrToBe %v", err, ErrNoGPT)
+	}
+	if !fallBackFromNativeGPT(disk, "test", err) {
+		t.Errorf("fallBackFromNativeGPT() = false, want true")
+	}
+	if fallBackFromNativeGPT(disk, "test", ErrGPTEntryNotFound) {
+		t.Errorf("fallBackFromNativeGPT() = true, want false")
+	}
+
+	SetGPTBackend(GPTBackendSgdisk)
+	if err := disk.updateNativeGPT(func(*GPT) error { return nil }); !errors.Is(err, errNativeGPTUnavailable) {
+		t.Errorf("Device.updateNativeGPT() error = %v, wantErrToBe %v", err, errNativeGPTUnavailable)
+	}
+}
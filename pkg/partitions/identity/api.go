@@ -20,14 +20,20 @@ import (
 	"errors"
 
 	"go.githedgehog.com/dasboot/pkg/partitions/location"
+	"go.githedgehog.com/dasboot/pkg/tpm"
 )
 
 const (
 	version1 int = 1
 
+	// version2 adds a checksum file next to every file which is written together with it
+	version2 int = 2
+
 	versionFilePath         = "/version"
 	identityDirPath         = "/identity"
 	locationDirPath         = "/location"
+	checkpointsDirPath      = "/checkpoints"
+	checksumSuffix          = ".sha256"
 	clientKeyPath           = identityDirPath + "/client.key"
 	clientCSRPath           = identityDirPath + "/client.csr"
 	clientCertPath          = identityDirPath + "/client.crt"
@@ -91,6 +97,12 @@ type IdentityPartition interface {
 	// StoreClientCert stores a certificate to disk which is passed in the argument in DER encoding.
 	StoreClientCert([]byte) error
 
+	// RenewClientCert renews the client certificate for the existing client key. It generates a new CSR with the key
+	// without touching the current certificate, and passes it to `issue` which typically sends it to the seeder while
+	// authenticating with the current certificate. The returned DER encoded certificate replaces the current one if it
+	// belongs to the client key, otherwise `ErrRenewedCertMismatch` is returned.
+	RenewClientCert(issue func(csr []byte) ([]byte, error)) error
+
 	// LoadX509KeyPair loads the key from the partition (or TPM) and the certificate from the partition and returns a
 	// TLS certificate which is ready to be used in a TLS config as a client certificate.
 	LoadX509KeyPair() (tls.Certificate, error)
@@ -107,6 +119,35 @@ type IdentityPartition interface {
 	// It is going to overwrite existing location information on disk if it already exists. The implementation may call
 	// internally `StoreLocation` to persist the information onto the disk.
 	CopyLocation(location.LocationPartition) error
+
+	// StoreCheckpoint persists the installation checkpoint `name` with its `data` on the partition. Checkpoints survive
+	// reboots and allow installers to resume multi-boot installation flows. Existing checkpoints are overwritten.
+	StoreCheckpoint(name string, data []byte) error
+
+	// GetCheckpoint reads the installation checkpoint `name` from the partition. It returns `ErrNoCheckpoint` if the
+	// checkpoint does not exist.
+	GetCheckpoint(name string) ([]byte, error)
+
+	// DeleteCheckpoint deletes the installation checkpoint `name` from the partition. It must not return an error if
+	// the checkpoint does not exist.
+	DeleteCheckpoint(name string) error
+
+	// PublicDocument returns the public identity document of the device signed with the client key. It holds no
+	// secrets and can be published to the control plane or verified offline by auditors. It fails if there is no
+	// client certificate yet.
+	PublicDocument() (*PublicDocument, error)
+
+	// Quote returns a TPM quote of the default PCRs for `qualifyingData` which is signed by the client key. It returns
+	// `ErrNoTPMKey` if the client key is not held by a TPM.
+	Quote(qualifyingData []byte) (*tpm.Quote, error)
+
+	// ExportBackup returns a signed backup of the client key pair and the location which is encrypted for every key
+	// of `keys` (see `UnlockKeys`). It fails if there is no client certificate yet.
+	ExportBackup(keys [][]byte) (*Backup, error)
+
+	// RestoreBackup restores the client key pair and the location from backup `b` with one of the `keys`. It refuses
+	// to overwrite an existing client certificate, and fails if the restored key pair cannot be loaded.
+	RestoreBackup(b *Backup, keys [][]byte) error
 }
 
 var (
@@ -117,4 +158,7 @@ var (
 	ErrAlreadyInitialized     = errors.New("identity: partition already initialized")
 	ErrNoPEMData              = errors.New("identity: no PEM data")
 	ErrNoDevID                = errors.New("identity: no device ID")
+	ErrNoCheckpoint           = errors.New("identity: no such checkpoint")
+	ErrInvalidCheckpointName  = errors.New("identity: invalid checkpoint name")
+	ErrChecksumMismatch       = errors.New("identity: checksum mismatch")
 )
@@ -15,6 +15,7 @@
 package identity
 
 import (
+	"crypto"
 	"crypto/ecdsa"
 	"crypto/elliptic"
 	"crypto/rand"
@@ -25,26 +26,27 @@ import (
 	"encoding/pem"
 	"errors"
 	"fmt"
-	"io"
 	"os"
+	"syscall"
 	"time"
 
 	"go.githedgehog.com/dasboot/pkg/partitions"
 	"go.githedgehog.com/dasboot/pkg/partitions/location"
-	"go.githedgehog.com/dasboot/pkg/tpm"
 
 	"github.com/google/uuid"
 )
 
 type api struct {
-	dev *partitions.Device
+	dev     *partitions.Device
+	version int
 }
 
 var _ IdentityPartition = &api{}
 
 // Open an existing identity partition. If the partition was not previously initialized
 // this function returns `ErrUninitializedPartition` in which case the caller should
-// call `Init()` instead.
+// call `Init()` instead. Version 1 partitions are being migrated to version 2, unless
+// they are mounted read-only in which case they keep being used with the version 1 layout.
 func Open(d *partitions.Device) (IdentityPartition, error) {
 	// initial checks
 	if !d.IsHedgehogIdentityPartition() {
@@ -66,14 +68,23 @@ func Open(d *partitions.Device) (IdentityPartition, error) {
 		return nil, err
 	}
 
-	// only version one is supported right now
-	if version.Version != version1 {
+	switch version.Version {
+	case version2:
+	case version1:
+		if err := migrateToVersion2(d); err != nil {
+			if errors.Is(err, syscall.EROFS) {
+				return &api{dev: d, version: version1}, nil
+			}
+			return nil, fmt.Errorf("identity: migrating partition to version %d: %w", version2, err)
+		}
+	default:
 		return nil, ErrUnsupportedVersion
 	}
 
 	// all validations complete, return the API object
 	return &api{
-		dev: d,
+		dev:     d,
+		version: version2,
 	}, nil
 }
 
@@ -111,18 +122,7 @@ func Init(d *partitions.Device) (IdentityPartition, error) {
 
 	// write the version file, and create identity and location directories
 	// which is the minimum to initialize it
-	f, err := d.FS.OpenFile(versionFilePath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
-	if err != nil {
-		return nil, err
-	}
-	defer f.Close()
-	version := Version{
-		Version: version1,
-	}
-	// cannot fail, we can be certain
-	b, _ := json.Marshal(version) //nolint: errchkjson
-	b = append(b, byte('\n'))
-	if _, err := f.Write(b); err != nil {
+	if err := writeVersionFile(d, version2); err != nil {
 		return nil, err
 	}
 
@@ -135,15 +135,23 @@ func Init(d *partitions.Device) (IdentityPartition, error) {
 
 	// initialized, return the API object
 	return &api{
-		dev: d,
+		dev:     d,
+		version: version2,
 	}, nil
 }
 
+func writeVersionFile(d *partitions.Device, v int) error {
+	// cannot fail, we can be certain
+	b, _ := json.Marshal(Version{Version: v}) //nolint: errchkjson
+	b = append(b, byte('\n'))
+	return partitions.WriteFileAtomic(d.FS, versionFilePath, b, 0644)
+}
+
 // GenerateClientCSR implements IdentityPartition
 func (a *api) GenerateClientCSR() ([]byte, error) {
 	var b []byte
 	var err error
-	if tpm.HasTPM() {
+	if a.usesTPM() {
 		b, err = a.generateClientCSRWithTPM()
 	} else {
 		b, err = a.generateClientCSRWithoutTPM()
@@ -153,8 +161,7 @@ func (a *api) GenerateClientCSR() ([]byte, error) {
 	}
 
 	// and delete an existing certificate if it is there
-	err = a.dev.FS.Remove(clientCertPath)
-	if err != nil && !errors.Is(err, os.ErrNotExist) {
+	if err := a.removeFile(clientCertPath); err != nil {
 		return nil, fmt.Errorf("deleting already existing certificate: %w", err)
 	}
 
@@ -162,18 +169,25 @@ func (a *api) GenerateClientCSR() ([]byte, error) {
 }
 
 func (a *api) generateClientCSRWithTPM() ([]byte, error) {
-	// TODO: implement
-	return nil, nil
+	key, err := a.loadClientKeyFromTPM()
+	if err != nil {
+		return nil, err
+	}
+	return a.writeCSR(key, clientCSRPath)
 }
 
 func (a *api) generateClientCSRWithoutTPM() ([]byte, error) {
 	// read client key from disk
-	f, err := a.dev.FS.Open(clientKeyPath)
+	key, err := a.readKey(clientKeyPath)
 	if err != nil {
 		return nil, err
 	}
-	defer f.Close()
-	b, err := io.ReadAll(f)
+	return a.writeCSR(key, clientCSRPath)
+}
+
+// readKey reads the PEM encoded EC private key file `name`
+func (a *api) readKey(name string) (*ecdsa.PrivateKey, error) {
+	b, err := a.readFile(name)
 	if err != nil {
 		return nil, err
 	}
@@ -181,11 +195,11 @@ func (a *api) generateClientCSRWithoutTPM() ([]byte, error) {
 	if p == nil {
 		return nil, ErrNoPEMData
 	}
-	key, err := x509.ParseECPrivateKey(p.Bytes)
-	if err != nil {
-		return nil, err
-	}
+	return x509.ParseECPrivateKey(p.Bytes)
+}
 
+// writeCSR generates a new CSR with `key` and stores it on the partition as `name`
+func (a *api) writeCSR(key crypto.Signer, name string) ([]byte, error) {
 	// now generate CSR
 	id := devidID()
 	if id == "" {
@@ -193,7 +207,7 @@ func (a *api) generateClientCSRWithoutTPM() ([]byte, error) {
 	}
 	// TODO: the Subject needs review
 	csr := &x509.CertificateRequest{
-		PublicKey: key.PublicKey,
+		PublicKey: key.Public(),
 		Subject: pkix.Name{
 			CommonName: id,
 		},
@@ -204,17 +218,11 @@ func (a *api) generateClientCSRWithoutTPM() ([]byte, error) {
 	}
 
 	// save it to disk
-	f2, err := a.dev.FS.OpenFile(clientCSRPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
-	if err != nil {
-		return nil, err
-	}
-	defer f2.Close()
-
 	p2 := pem.Block{
 		Type:  "CERTIFICATE REQUEST",
 		Bytes: csrBytes,
 	}
-	if _, err := f2.Write(pem.EncodeToMemory(&p2)); err != nil {
+	if err := a.writeFiles(partitions.File{Name: name, Data: pem.EncodeToMemory(&p2)}); err != nil {
 		return nil, err
 	}
 
@@ -225,7 +233,7 @@ func (a *api) generateClientCSRWithoutTPM() ([]byte, error) {
 // GenerateClientKeyPair implements IdentityPartition
 func (a *api) GenerateClientKeyPair() error {
 	var err error
-	if tpm.HasTPM() {
+	if tpmHasTPM() {
 		err = a.generateClientKeyPairWithTPM()
 	} else {
 		err = a.generateClientKeyPairWithoutTPM()
@@ -235,14 +243,12 @@ func (a *api) GenerateClientKeyPair() error {
 	}
 
 	// now ensure to delete an existing CSR if it is there
-	err = a.dev.FS.Remove(clientCSRPath)
-	if err != nil && !errors.Is(err, os.ErrNotExist) {
+	if err := a.removeFile(clientCSRPath); err != nil {
 		return fmt.Errorf("deleting already existing CSR: %w", err)
 	}
 
 	// and delete an existing certificate if it is there
-	err = a.dev.FS.Remove(clientCertPath)
-	if err != nil && !errors.Is(err, os.ErrNotExist) {
+	if err := a.removeFile(clientCertPath); err != nil {
 		return fmt.Errorf("deleting already existing certificate: %w", err)
 	}
 
@@ -250,11 +256,31 @@ func (a *api) GenerateClientKeyPair() error {
 }
 
 func (a *api) generateClientKeyPairWithTPM() error {
-	// TODO: implement
+	blob, err := tpmCreateKey()
+	if err != nil {
+		return err
+	}
+	// the public blob marks that the TPM holds the key, so it must be written last
+	if err := a.writeFiles(partitions.File{Name: tpmClientPrivPath, Data: blob.Private}); err != nil {
+		return err
+	}
+	if err := a.writeFiles(partitions.File{Name: tpmClientPubPath, Data: blob.Public}); err != nil {
+		return err
+	}
+
+	// a key file from before the device had a TPM is not in use anymore
+	if err := a.removeFile(clientKeyPath); err != nil {
+		return fmt.Errorf("deleting client key file: %w", err)
+	}
 	return nil
 }
 
 func (a *api) generateClientKeyPairWithoutTPM() error {
+	return a.writeNewKey(clientKeyPath)
+}
+
+// writeNewKey generates a new EC private key, and stores it PEM encoded on the partition as `name`
+func (a *api) writeNewKey(name string) error {
 	key, err := ecdsaGenerateKey(elliptic.P256(), rand.Reader)
 	if err != nil {
 		return err
@@ -268,26 +294,13 @@ func (a *api) generateClientKeyPairWithoutTPM() error {
 		Bytes: keyBytes,
 	}
 	keyPEMBytes := pem.EncodeToMemory(p)
-	f, err := a.dev.FS.OpenFile(clientKeyPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
-	if err != nil {
-		return err
-	}
-	defer f.Close()
-	if _, err := f.Write(keyPEMBytes); err != nil {
-		return err
-	}
-	return nil
+	return a.writeFiles(partitions.File{Name: name, Data: keyPEMBytes})
 }
 
 // GetLocation implements IdentityPartition
 func (a *api) GetLocation() (*location.Info, error) {
 	// uuid
-	f1, err := a.dev.FS.Open(locationUUIDPath)
-	if err != nil {
-		return nil, err
-	}
-	defer f1.Close()
-	uuidBytes, err := io.ReadAll(f1)
+	uuidBytes, err := a.readFile(locationUUIDPath)
 	if err != nil {
 		return nil, err
 	}
@@ -297,23 +310,13 @@ func (a *api) GetLocation() (*location.Info, error) {
 	}
 
 	// uuid.sig
-	f2, err := a.dev.FS.Open(locationUUIDSigPath)
-	if err != nil {
-		return nil, err
-	}
-	defer f2.Close()
-	uuidSigBytes, err := io.ReadAll(f2)
+	uuidSigBytes, err := a.readFile(locationUUIDSigPath)
 	if err != nil {
 		return nil, err
 	}
 
 	// metadata
-	f3, err := a.dev.FS.Open(locationMetadataPath)
-	if err != nil {
-		return nil, err
-	}
-	defer f3.Close()
-	metadataBytes, err := io.ReadAll(f3)
+	metadataBytes, err := a.readFile(locationMetadataPath)
 	if err != nil {
 		return nil, err
 	}
@@ -323,12 +326,7 @@ func (a *api) GetLocation() (*location.Info, error) {
 	}
 
 	// metadata.sig
-	f4, err := a.dev.FS.Open(locationMetadataSigPath)
-	if err != nil {
-		return nil, err
-	}
-	defer f4.Close()
-	metadataSigBytes, err := io.ReadAll(f4)
+	metadataSigBytes, err := a.readFile(locationMetadataSigPath)
 	if err != nil {
 		return nil, err
 	}
@@ -345,47 +343,14 @@ func (a *api) GetLocation() (*location.Info, error) {
 
 // StoreLocation implements IdentityPartition
 func (a *api) StoreLocation(info *location.Info) error {
-	// uuid
-	f1, err := a.dev.FS.OpenFile(locationUUIDPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
-	if err != nil {
-		return err
-	}
-	defer f1.Close()
-	if _, err := f1.Write([]byte(info.UUID)); err != nil {
-		return err
-	}
-
-	// uuid.sig
-	f2, err := a.dev.FS.OpenFile(locationUUIDSigPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
-	if err != nil {
-		return err
-	}
-	defer f2.Close()
-	if _, err := f2.Write(info.UUIDSig); err != nil {
-		return err
-	}
-
-	// metadata
-	f3, err := a.dev.FS.OpenFile(locationMetadataPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
-	if err != nil {
-		return err
-	}
-	defer f3.Close()
-	if _, err := f3.Write([]byte(info.Metadata)); err != nil {
-		return err
-	}
-
-	// metadata.sig
-	f4, err := a.dev.FS.OpenFile(locationMetadataSigPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
-	if err != nil {
-		return err
-	}
-	defer f4.Close()
-	if _, err := f4.Write(info.MetadataSig); err != nil {
-		return err
-	}
-
-	return nil
+	// all files are written at once, so that a failed write never leaves
+	// a UUID or metadata behind together with the signature of its predecessor
+	return a.writeFiles(
+		partitions.File{Name: locationUUIDPath, Data: []byte(info.UUID)},
+		partitions.File{Name: locationUUIDSigPath, Data: info.UUIDSig},
+		partitions.File{Name: locationMetadataPath, Data: []byte(info.Metadata)},
+		partitions.File{Name: locationMetadataSigPath, Data: info.MetadataSig},
+	)
 }
 
 // CopyLocation implements IdentityPartition
@@ -399,12 +364,7 @@ func (a *api) CopyLocation(lp location.LocationPartition) error {
 
 // HasClientCSR im plements IdentityPartition
 func (a *api) HasClientCSR() bool {
-	f, err := a.dev.FS.Open(clientCSRPath)
-	if err != nil {
-		return false
-	}
-	defer f.Close()
-	csrPEMBytes, err := io.ReadAll(f)
+	csrPEMBytes, err := a.readFile(clientCSRPath)
 	if err != nil {
 		return false
 	}
@@ -421,12 +381,7 @@ func (a *api) HasClientCSR() bool {
 
 // HasClientCert implements IdentityPartition
 func (a *api) HasClientCert() bool {
-	f, err := a.dev.FS.Open(clientCertPath)
-	if err != nil {
-		return false
-	}
-	defer f.Close()
-	certPEMBytes, err := io.ReadAll(f)
+	certPEMBytes, err := a.readFile(clientCertPath)
 	if err != nil {
 		return false
 	}
@@ -443,12 +398,7 @@ func (a *api) HasClientCert() bool {
 
 // HasValidClientCert implements IdentityPartition
 func (a *api) HasValidClientCert() bool {
-	f, err := a.dev.FS.Open(clientCertPath)
-	if err != nil {
-		return false
-	}
-	defer f.Close()
-	certPEMBytes, err := io.ReadAll(f)
+	certPEMBytes, err := a.readFile(clientCertPath)
 	if err != nil {
 		return false
 	}
@@ -480,12 +430,7 @@ func (a *api) HasValidClientCert() bool {
 
 // MatchesClientCertificate implements IdentityPartition.
 func (a *api) MatchesClientCertificate(cert *x509.Certificate) bool {
-	f, err := a.dev.FS.Open(clientCertPath)
-	if err != nil {
-		return false
-	}
-	defer f.Close()
-	certPEMBytes, err := io.ReadAll(f)
+	certPEMBytes, err := a.readFile(clientCertPath)
 	if err != nil {
 		return false
 	}
@@ -505,24 +450,20 @@ func (a *api) MatchesClientCertificate(cert *x509.Certificate) bool {
 
 // HasClientKey implements IdentityPartition
 func (a *api) HasClientKey() bool {
-	if tpm.HasTPM() {
+	if a.usesTPM() {
 		return a.hasClientKeyFromTPM()
 	}
 	return a.hasClientKeyFromFiles()
 }
 
 func (a *api) hasClientKeyFromTPM() bool {
-	// TODO: implement
-	return false
+	// loading the key proves that it belongs to this TPM
+	_, err := a.loadClientKeyFromTPM()
+	return err == nil
 }
 
 func (a *api) hasClientKeyFromFiles() bool {
-	f, err := a.dev.FS.Open(clientKeyPath)
-	if err != nil {
-		return false
-	}
-	defer f.Close()
-	keyPEMBytes, err := io.ReadAll(f)
+	keyPEMBytes, err := a.readFile(clientKeyPath)
 	if err != nil {
 		return false
 	}
@@ -539,29 +480,68 @@ func (a *api) hasClientKeyFromFiles() bool {
 
 // LoadX509KeyPair implements IdentityPartition
 func (a *api) LoadX509KeyPair() (tls.Certificate, error) {
-	if tpm.HasTPM() {
+	if a.usesTPM() {
 		return a.loadX509KeyPairFromTPM()
 	}
 	return a.loadX509KeyPairFromFiles()
 }
 
 func (a *api) loadX509KeyPairFromFiles() (tls.Certificate, error) {
-	return tls.LoadX509KeyPair(a.dev.FS.Path(clientCertPath), a.dev.FS.Path(clientKeyPath))
+	if a.version < version2 {
+		return tls.LoadX509KeyPair(a.dev.FS.Path(clientCertPath), a.dev.FS.Path(clientKeyPath))
+	}
+	return a.loadX509KeyPair(clientCertPath, clientKeyPath)
+}
+
+// loadX509KeyPair loads a key pair from the files `certPath` and `keyPath` after verifying their checksums
+func (a *api) loadX509KeyPair(certPath, keyPath string) (tls.Certificate, error) {
+	certPEMBytes, err := a.readFile(certPath)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	keyPEMBytes, err := a.readFile(keyPath)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	return tls.X509KeyPair(certPEMBytes, keyPEMBytes)
 }
 
 func (a *api) loadX509KeyPairFromTPM() (tls.Certificate, error) {
-	// TODO: implement
-	return tls.Certificate{}, nil
+	certPEMBytes, err := a.readFile(clientCertPath)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	p, _ := pem.Decode(certPEMBytes)
+	if p == nil {
+		return tls.Certificate{}, ErrNoPEMData
+	}
+	cert, err := x509.ParseCertificate(p.Bytes)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	key, err := a.loadClientKeyFromTPM()
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	pub, ok := key.Public().(interface{ Equal(crypto.PublicKey) bool })
+	if !ok || !pub.Equal(cert.PublicKey) {
+		return tls.Certificate{}, ErrTPMKeyMismatch
+	}
+	return tls.Certificate{
+		Certificate: [][]byte{cert.Raw},
+		PrivateKey:  key,
+		Leaf:        cert,
+	}, nil
 }
 
 // ReadClientCSR implements IdentityPartition
 func (a *api) ReadClientCSR() ([]byte, error) {
-	f, err := a.dev.FS.Open(clientCSRPath)
-	if err != nil {
-		return nil, err
-	}
-	defer f.Close()
-	csrPEMBytes, err := io.ReadAll(f)
+	return a.readCSR(clientCSRPath)
+}
+
+// readCSR reads the PEM encoded CSR file `name`, and returns the CSR in DER encoding
+func (a *api) readCSR(name string) ([]byte, error) {
+	csrPEMBytes, err := a.readFile(name)
 	if err != nil {
 		return nil, err
 	}
@@ -577,6 +557,11 @@ func (a *api) ReadClientCSR() ([]byte, error) {
 
 // StoreClientCert implements IdentityPartition
 func (a *api) StoreClientCert(certBytes []byte) error {
+	return a.storeCert(certBytes, clientCSRPath, clientCertPath)
+}
+
+// storeCert stores the DER encoded certificate as `certPath` if it matches the CSR in `csrPath`
+func (a *api) storeCert(certBytes []byte, csrPath, certPath string) error {
 	// validate input first
 	cert, err := x509.ParseCertificate(certBytes)
 	if err != nil {
@@ -589,7 +574,7 @@ func (a *api) StoreClientCert(certBytes []byte) error {
 
 	// we need to check the certificate against the CSR first
 	// before we allow it to be stored
-	csrBytes, err := a.ReadClientCSR()
+	csrBytes, err := a.readCSR(csrPath)
 	if err != nil {
 		return fmt.Errorf("identity: failed to read CSR while trying to store cert: %w", err)
 	}
@@ -619,11 +604,5 @@ func (a *api) StoreClientCert(certBytes []byte) error {
 	// anymore anyways if Go runs out of memory here.
 	certPEMBytes := pem.EncodeToMemory(p)
 
-	f, err := a.dev.FS.OpenFile(clientCertPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
-	if err != nil {
-		return err
-	}
-	defer f.Close()
-	_, err = f.Write(certPEMBytes)
-	return err
+	return a.writeFiles(partitions.File{Name: certPath, Data: certPEMBytes})
 }
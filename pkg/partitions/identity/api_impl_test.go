@@ -57,12 +57,12 @@ func TestOpen(t *testing.T) {
 		{
 			name:    "success",
 			args:    args{d: d},
-			want:    &api{dev: d},
+			want:    &api{dev: d, version: version2},
 			wantErr: false,
 			pre: func(t *testing.T, ctrl *gomock.Controller, fs *mockpartitions.MockFS) {
 				versionFile := mockio.NewMockReadWriteCloser(ctrl)
 				versionFile.EXPECT().Read(gomock.Any()).Times(1).DoAndReturn(func(b []byte) (int, error) {
-					versionBytes := `{"version":1}`
+					versionBytes := `{"version":2}`
 					copy(b, []byte(versionBytes))
 					return len(versionBytes), io.EOF
 				})
@@ -122,7 +122,7 @@ func TestOpen(t *testing.T) {
 			pre: func(t *testing.T, ctrl *gomock.Controller, fs *mockpartitions.MockFS) {
 				versionFile := mockio.NewMockReadWriteCloser(ctrl)
 				versionFile.EXPECT().Read(gomock.Any()).Times(1).DoAndReturn(func(b []byte) (int, error) {
-					versionBytes := `{"version":2}`
+					versionBytes := `{"version":3}`
 					copy(b, []byte(versionBytes))
 					return len(versionBytes), io.EOF
 				})
@@ -187,7 +187,7 @@ func TestInit(t *testing.T) {
 		{
 			name: "success",
 			args: args{d: d},
-			want: &api{dev: d},
+			want: &api{dev: d, version: version2},
 			pre: func(t *testing.T, ctrl *gomock.Controller, mfs *mockpartitions.MockFS) {
 				// version file check
 				mfs.EXPECT().Stat(gomock.Eq(versionFilePath)).Times(1).Return(nil, os.ErrNotExist)
@@ -202,14 +202,18 @@ func TestInit(t *testing.T) {
 
 				// writing version file
 				f := mockio.NewMockReadWriteCloser(ctrl)
-				mfs.EXPECT().OpenFile(gomock.Eq(versionFilePath), gomock.Eq(os.O_CREATE|os.O_TRUNC|os.O_WRONLY), gomock.Eq(fs.FileMode(0644))).Times(1).Return(f, nil)
+				mfs.EXPECT().OpenFile(gomock.Eq(versionFilePath+partitions.TempSuffix), gomock.Eq(os.O_CREATE|os.O_TRUNC|os.O_WRONLY), gomock.Eq(fs.FileMode(0644))).Times(1).Return(f, nil)
 				f.EXPECT().Close().Times(1)
-				versString := `{"version":1}` + "\n"
+				versString := `{"version":2}` + "\n"
 				f.EXPECT().Write(gomock.Eq([]byte(versString))).Times(1).Return(len(versString), nil)
 
 				// creating directories
 				mfs.EXPECT().Mkdir(gomock.Eq(identityDirPath), gomock.Eq(fs.FileMode(0755))).Times(1).Return(nil)
 				mfs.EXPECT().Mkdir(gomock.Eq(locationDirPath), gomock.Eq(fs.FileMode(0755))).Times(1).Return(nil)
+
+				// the temporary file is moved into place and the directory is synced
+				mfs.EXPECT().Rename(gomock.Eq(versionFilePath+partitions.TempSuffix), gomock.Eq(versionFilePath)).Times(1).Return(nil)
+				mfs.EXPECT().SyncDir(gomock.Eq("/")).Times(1).Return(nil)
 			},
 		},
 		{
@@ -292,7 +296,10 @@ func TestInit(t *testing.T) {
 				mfs.EXPECT().RemoveAll(gomock.Eq("removeme")).Times(1).Return(nil)
 
 				// writing version file
-				mfs.EXPECT().OpenFile(gomock.Eq(versionFilePath), gomock.Eq(os.O_CREATE|os.O_TRUNC|os.O_WRONLY), gomock.Eq(fs.FileMode(0644))).Times(1).Return(nil, errOpenVersionFileForWriting)
+				mfs.EXPECT().OpenFile(gomock.Eq(versionFilePath+partitions.TempSuffix), gomock.Eq(os.O_CREATE|os.O_TRUNC|os.O_WRONLY), gomock.Eq(fs.FileMode(0644))).Times(1).Return(nil, errOpenVersionFileForWriting)
+
+				// the temporary file is removed again
+				mfs.EXPECT().Remove(gomock.Eq(versionFilePath + partitions.TempSuffix)).Times(1).Return(nil)
 			},
 		},
 		{
@@ -314,10 +321,13 @@ func TestInit(t *testing.T) {
 
 				// writing version file
 				f := mockio.NewMockReadWriteCloser(ctrl)
-				mfs.EXPECT().OpenFile(gomock.Eq(versionFilePath), gomock.Eq(os.O_CREATE|os.O_TRUNC|os.O_WRONLY), gomock.Eq(fs.FileMode(0644))).Times(1).Return(f, nil)
+				mfs.EXPECT().OpenFile(gomock.Eq(versionFilePath+partitions.TempSuffix), gomock.Eq(os.O_CREATE|os.O_TRUNC|os.O_WRONLY), gomock.Eq(fs.FileMode(0644))).Times(1).Return(f, nil)
 				f.EXPECT().Close().Times(1)
-				versString := `{"version":1}` + "\n"
+				versString := `{"version":2}` + "\n"
 				f.EXPECT().Write(gomock.Eq([]byte(versString))).Times(1).Return(0, errWritingJSONToVersionFileFailed)
+
+				// the temporary file is removed again
+				mfs.EXPECT().Remove(gomock.Eq(versionFilePath + partitions.TempSuffix)).Times(1).Return(nil)
 			},
 		},
 		{
@@ -339,13 +349,17 @@ func TestInit(t *testing.T) {
 
 				// writing version file
 				f := mockio.NewMockReadWriteCloser(ctrl)
-				mfs.EXPECT().OpenFile(gomock.Eq(versionFilePath), gomock.Eq(os.O_CREATE|os.O_TRUNC|os.O_WRONLY), gomock.Eq(fs.FileMode(0644))).Times(1).Return(f, nil)
+				mfs.EXPECT().OpenFile(gomock.Eq(versionFilePath+partitions.TempSuffix), gomock.Eq(os.O_CREATE|os.O_TRUNC|os.O_WRONLY), gomock.Eq(fs.FileMode(0644))).Times(1).Return(f, nil)
 				f.EXPECT().Close().Times(1)
-				versString := `{"version":1}` + "\n"
+				versString := `{"version":2}` + "\n"
 				f.EXPECT().Write(gomock.Eq([]byte(versString))).Times(1).Return(len(versString), nil)
 
 				// creating directories
 				mfs.EXPECT().Mkdir(gomock.Eq(identityDirPath), gomock.Eq(fs.FileMode(0755))).Times(1).Return(errMkdirIdentityDir)
+
+				// the temporary file is moved into place and the directory is synced
+				mfs.EXPECT().Rename(gomock.Eq(versionFilePath+partitions.TempSuffix), gomock.Eq(versionFilePath)).Times(1).Return(nil)
+				mfs.EXPECT().SyncDir(gomock.Eq("/")).Times(1).Return(nil)
 			},
 		},
 		{
@@ -367,14 +381,18 @@ func TestInit(t *testing.T) {
 
 				// writing version file
 				f := mockio.NewMockReadWriteCloser(ctrl)
-				mfs.EXPECT().OpenFile(gomock.Eq(versionFilePath), gomock.Eq(os.O_CREATE|os.O_TRUNC|os.O_WRONLY), gomock.Eq(fs.FileMode(0644))).Times(1).Return(f, nil)
+				mfs.EXPECT().OpenFile(gomock.Eq(versionFilePath+partitions.TempSuffix), gomock.Eq(os.O_CREATE|os.O_TRUNC|os.O_WRONLY), gomock.Eq(fs.FileMode(0644))).Times(1).Return(f, nil)
 				f.EXPECT().Close().Times(1)
-				versString := `{"version":1}` + "\n"
+				versString := `{"version":2}` + "\n"
 				f.EXPECT().Write(gomock.Eq([]byte(versString))).Times(1).Return(len(versString), nil)
 
 				// creating directories
 				mfs.EXPECT().Mkdir(gomock.Eq(identityDirPath), gomock.Eq(fs.FileMode(0755))).Times(1).Return(nil)
 				mfs.EXPECT().Mkdir(gomock.Eq(locationDirPath), gomock.Eq(fs.FileMode(0755))).Times(1).Return(errMkdirLocationDir)
+
+				// the temporary file is moved into place and the directory is synced
+				mfs.EXPECT().Rename(gomock.Eq(versionFilePath+partitions.TempSuffix), gomock.Eq(versionFilePath)).Times(1).Return(nil)
+				mfs.EXPECT().SyncDir(gomock.Eq("/")).Times(1).Return(nil)
 			},
 		},
 	}
@@ -424,13 +442,17 @@ func Test_api_GenerateClientKeyPair(t *testing.T) {
 			wantErr: false,
 			pre: func(t *testing.T, ctrl *gomock.Controller, mfs *mockpartitions.MockFS) {
 				f := mockio.NewMockReadWriteCloser(ctrl)
-				mfs.EXPECT().OpenFile(gomock.Eq(clientKeyPath), gomock.Eq(os.O_CREATE|os.O_TRUNC|os.O_WRONLY), gomock.Eq(fs.FileMode(0644))).Times(1).Return(f, nil)
+				mfs.EXPECT().OpenFile(gomock.Eq(clientKeyPath+partitions.TempSuffix), gomock.Eq(os.O_CREATE|os.O_TRUNC|os.O_WRONLY), gomock.Eq(fs.FileMode(0644))).Times(1).Return(f, nil)
 				f.EXPECT().Close().Times(1).Return(nil)
 				f.EXPECT().Write(gomock.Any()).Times(1).DoAndReturn(func(b []byte) (int, error) {
 					return len(b), nil
 				})
 				mfs.EXPECT().Remove(gomock.Eq(clientCSRPath)).Times(1).Return(nil)
 				mfs.EXPECT().Remove(gomock.Eq(clientCertPath)).Times(1).Return(os.ErrNotExist)
+
+				// the temporary file is moved into place and the directory is synced
+				mfs.EXPECT().Rename(gomock.Eq(clientKeyPath+partitions.TempSuffix), gomock.Eq(clientKeyPath)).Times(1).Return(nil)
+				mfs.EXPECT().SyncDir(gomock.Eq(identityDirPath)).Times(1).Return(nil)
 			},
 		},
 		{
@@ -438,12 +460,16 @@ func Test_api_GenerateClientKeyPair(t *testing.T) {
 			wantErr: true,
 			pre: func(t *testing.T, ctrl *gomock.Controller, mfs *mockpartitions.MockFS) {
 				f := mockio.NewMockReadWriteCloser(ctrl)
-				mfs.EXPECT().OpenFile(gomock.Eq(clientKeyPath), gomock.Eq(os.O_CREATE|os.O_TRUNC|os.O_WRONLY), gomock.Eq(fs.FileMode(0644))).Times(1).Return(f, nil)
+				mfs.EXPECT().OpenFile(gomock.Eq(clientKeyPath+partitions.TempSuffix), gomock.Eq(os.O_CREATE|os.O_TRUNC|os.O_WRONLY), gomock.Eq(fs.FileMode(0644))).Times(1).Return(f, nil)
 				f.EXPECT().Close().Times(1).Return(nil)
 				f.EXPECT().Write(gomock.Any()).Times(1).DoAndReturn(func(b []byte) (int, error) {
 					return len(b), nil
 				})
 				mfs.EXPECT().Remove(gomock.Eq(clientCSRPath)).Times(1).Return(os.ErrPermission)
+
+				// the temporary file is moved into place and the directory is synced
+				mfs.EXPECT().Rename(gomock.Eq(clientKeyPath+partitions.TempSuffix), gomock.Eq(clientKeyPath)).Times(1).Return(nil)
+				mfs.EXPECT().SyncDir(gomock.Eq(identityDirPath)).Times(1).Return(nil)
 			},
 		},
 		{
@@ -451,13 +477,17 @@ func Test_api_GenerateClientKeyPair(t *testing.T) {
 			wantErr: true,
 			pre: func(t *testing.T, ctrl *gomock.Controller, mfs *mockpartitions.MockFS) {
 				f := mockio.NewMockReadWriteCloser(ctrl)
-				mfs.EXPECT().OpenFile(gomock.Eq(clientKeyPath), gomock.Eq(os.O_CREATE|os.O_TRUNC|os.O_WRONLY), gomock.Eq(fs.FileMode(0644))).Times(1).Return(f, nil)
+				mfs.EXPECT().OpenFile(gomock.Eq(clientKeyPath+partitions.TempSuffix), gomock.Eq(os.O_CREATE|os.O_TRUNC|os.O_WRONLY), gomock.Eq(fs.FileMode(0644))).Times(1).Return(f, nil)
 				f.EXPECT().Close().Times(1).Return(nil)
 				f.EXPECT().Write(gomock.Any()).Times(1).DoAndReturn(func(b []byte) (int, error) {
 					return len(b), nil
 				})
 				mfs.EXPECT().Remove(gomock.Eq(clientCSRPath)).Times(1).Return(os.ErrNotExist)
 				mfs.EXPECT().Remove(gomock.Eq(clientCertPath)).Times(1).Return(os.ErrPermission)
+
+				// the temporary file is moved into place and the directory is synced
+				mfs.EXPECT().Rename(gomock.Eq(clientKeyPath+partitions.TempSuffix), gomock.Eq(clientKeyPath)).Times(1).Return(nil)
+				mfs.EXPECT().SyncDir(gomock.Eq(identityDirPath)).Times(1).Return(nil)
 			},
 		},
 		{
@@ -481,7 +511,10 @@ func Test_api_GenerateClientKeyPair(t *testing.T) {
 			wantErr:     true,
 			wantErrToBe: os.ErrPermission,
 			pre: func(t *testing.T, ctrl *gomock.Controller, mfs *mockpartitions.MockFS) {
-				mfs.EXPECT().OpenFile(gomock.Eq(clientKeyPath), gomock.Eq(os.O_CREATE|os.O_TRUNC|os.O_WRONLY), gomock.Eq(fs.FileMode(0644))).Times(1).Return(nil, os.ErrPermission)
+				mfs.EXPECT().OpenFile(gomock.Eq(clientKeyPath+partitions.TempSuffix), gomock.Eq(os.O_CREATE|os.O_TRUNC|os.O_WRONLY), gomock.Eq(fs.FileMode(0644))).Times(1).Return(nil, os.ErrPermission)
+
+				// the temporary file is removed again
+				mfs.EXPECT().Remove(gomock.Eq(clientKeyPath + partitions.TempSuffix)).Times(1).Return(nil)
 			},
 		},
 		{
@@ -490,11 +523,14 @@ func Test_api_GenerateClientKeyPair(t *testing.T) {
 			wantErrToBe: io.ErrUnexpectedEOF,
 			pre: func(t *testing.T, ctrl *gomock.Controller, mfs *mockpartitions.MockFS) {
 				f := mockio.NewMockReadWriteCloser(ctrl)
-				mfs.EXPECT().OpenFile(gomock.Eq(clientKeyPath), gomock.Eq(os.O_CREATE|os.O_TRUNC|os.O_WRONLY), gomock.Eq(fs.FileMode(0644))).Times(1).Return(f, nil)
+				mfs.EXPECT().OpenFile(gomock.Eq(clientKeyPath+partitions.TempSuffix), gomock.Eq(os.O_CREATE|os.O_TRUNC|os.O_WRONLY), gomock.Eq(fs.FileMode(0644))).Times(1).Return(f, nil)
 				f.EXPECT().Close().Times(1).Return(nil)
 				f.EXPECT().Write(gomock.Any()).Times(1).DoAndReturn(func(b []byte) (int, error) {
 					return 0, io.ErrUnexpectedEOF
 				})
+
+				// the temporary file is removed again
+				mfs.EXPECT().Remove(gomock.Eq(clientKeyPath + partitions.TempSuffix)).Times(1).Return(nil)
 			},
 		},
 	}
@@ -880,7 +916,7 @@ func Test_api_StoreLocation(t *testing.T) {
 			pre: func(t *testing.T, ctrl *gomock.Controller, mfs *mockpartitions.MockFS) {
 				// uuid
 				f1 := mockio.NewMockReadWriteCloser(ctrl)
-				mfs.EXPECT().OpenFile(gomock.Eq(locationUUIDPath), gomock.Eq(os.O_CREATE|os.O_TRUNC|os.O_WRONLY), gomock.Eq(fs.FileMode(0644))).Times(1).Return(f1, nil)
+				mfs.EXPECT().OpenFile(gomock.Eq(locationUUIDPath+partitions.TempSuffix), gomock.Eq(os.O_CREATE|os.O_TRUNC|os.O_WRONLY), gomock.Eq(fs.FileMode(0644))).Times(1).Return(f1, nil)
 				f1.EXPECT().Write(gomock.Eq([]byte("2a59c9f4-9966-4270-b6a2-2313f41d5ce1"))).Times(1).DoAndReturn(func(b []byte) (int, error) {
 					return len(b), nil
 				})
@@ -888,7 +924,7 @@ func Test_api_StoreLocation(t *testing.T) {
 
 				// uuid.sig
 				f2 := mockio.NewMockReadWriteCloser(ctrl)
-				mfs.EXPECT().OpenFile(gomock.Eq(locationUUIDSigPath), gomock.Eq(os.O_CREATE|os.O_TRUNC|os.O_WRONLY), gomock.Eq(fs.FileMode(0644))).Times(1).Return(f2, nil)
+				mfs.EXPECT().OpenFile(gomock.Eq(locationUUIDSigPath+partitions.TempSuffix), gomock.Eq(os.O_CREATE|os.O_TRUNC|os.O_WRONLY), gomock.Eq(fs.FileMode(0644))).Times(1).Return(f2, nil)
 				f2.EXPECT().Write(gomock.Eq([]byte("uuid-sig"))).Times(1).DoAndReturn(func(b []byte) (int, error) {
 					return len(b), nil
 				})
@@ -896,7 +932,7 @@ func Test_api_StoreLocation(t *testing.T) {
 
 				// metadata
 				f3 := mockio.NewMockReadWriteCloser(ctrl)
-				mfs.EXPECT().OpenFile(gomock.Eq(locationMetadataPath), gomock.Eq(os.O_CREATE|os.O_TRUNC|os.O_WRONLY), gomock.Eq(fs.FileMode(0644))).Times(1).Return(f3, nil)
+				mfs.EXPECT().OpenFile(gomock.Eq(locationMetadataPath+partitions.TempSuffix), gomock.Eq(os.O_CREATE|os.O_TRUNC|os.O_WRONLY), gomock.Eq(fs.FileMode(0644))).Times(1).Return(f3, nil)
 				f3.EXPECT().Write(gomock.Eq([]byte(`{"a":"aa","b":"bb"}`))).Times(1).DoAndReturn(func(b []byte) (int, error) {
 					return len(b), nil
 				})
@@ -904,11 +940,18 @@ func Test_api_StoreLocation(t *testing.T) {
 
 				// metadata.sig
 				f4 := mockio.NewMockReadWriteCloser(ctrl)
-				mfs.EXPECT().OpenFile(gomock.Eq(locationMetadataSigPath), gomock.Eq(os.O_CREATE|os.O_TRUNC|os.O_WRONLY), gomock.Eq(fs.FileMode(0644))).Times(1).Return(f4, nil)
+				mfs.EXPECT().OpenFile(gomock.Eq(locationMetadataSigPath+partitions.TempSuffix), gomock.Eq(os.O_CREATE|os.O_TRUNC|os.O_WRONLY), gomock.Eq(fs.FileMode(0644))).Times(1).Return(f4, nil)
 				f4.EXPECT().Write(gomock.Eq([]byte("metadata-sig"))).Times(1).DoAndReturn(func(b []byte) (int, error) {
 					return len(b), nil
 				})
 				f4.EXPECT().Close().Times(1).Return(nil)
+
+				// the temporary files are moved into place and the directory is synced
+				mfs.EXPECT().Rename(gomock.Eq(locationUUIDPath+partitions.TempSuffix), gomock.Eq(locationUUIDPath)).Times(1).Return(nil)
+				mfs.EXPECT().Rename(gomock.Eq(locationUUIDSigPath+partitions.TempSuffix), gomock.Eq(locationUUIDSigPath)).Times(1).Return(nil)
+				mfs.EXPECT().Rename(gomock.Eq(locationMetadataPath+partitions.TempSuffix), gomock.Eq(locationMetadataPath)).Times(1).Return(nil)
+				mfs.EXPECT().Rename(gomock.Eq(locationMetadataSigPath+partitions.TempSuffix), gomock.Eq(locationMetadataSigPath)).Times(1).Return(nil)
+				mfs.EXPECT().SyncDir(gomock.Eq(locationDirPath)).Times(1).Return(nil)
 			},
 		},
 		{
@@ -919,7 +962,7 @@ func Test_api_StoreLocation(t *testing.T) {
 			pre: func(t *testing.T, ctrl *gomock.Controller, mfs *mockpartitions.MockFS) {
 				// uuid
 				f1 := mockio.NewMockReadWriteCloser(ctrl)
-				mfs.EXPECT().OpenFile(gomock.Eq(locationUUIDPath), gomock.Eq(os.O_CREATE|os.O_TRUNC|os.O_WRONLY), gomock.Eq(fs.FileMode(0644))).Times(1).Return(f1, nil)
+				mfs.EXPECT().OpenFile(gomock.Eq(locationUUIDPath+partitions.TempSuffix), gomock.Eq(os.O_CREATE|os.O_TRUNC|os.O_WRONLY), gomock.Eq(fs.FileMode(0644))).Times(1).Return(f1, nil)
 				f1.EXPECT().Write(gomock.Eq([]byte("2a59c9f4-9966-4270-b6a2-2313f41d5ce1"))).Times(1).DoAndReturn(func(b []byte) (int, error) {
 					return len(b), nil
 				})
@@ -927,7 +970,7 @@ func Test_api_StoreLocation(t *testing.T) {
 
 				// uuid.sig
 				f2 := mockio.NewMockReadWriteCloser(ctrl)
-				mfs.EXPECT().OpenFile(gomock.Eq(locationUUIDSigPath), gomock.Eq(os.O_CREATE|os.O_TRUNC|os.O_WRONLY), gomock.Eq(fs.FileMode(0644))).Times(1).Return(f2, nil)
+				mfs.EXPECT().OpenFile(gomock.Eq(locationUUIDSigPath+partitions.TempSuffix), gomock.Eq(os.O_CREATE|os.O_TRUNC|os.O_WRONLY), gomock.Eq(fs.FileMode(0644))).Times(1).Return(f2, nil)
 				f2.EXPECT().Write(gomock.Eq([]byte("uuid-sig"))).Times(1).DoAndReturn(func(b []byte) (int, error) {
 					return len(b), nil
 				})
@@ -935,7 +978,7 @@ func Test_api_StoreLocation(t *testing.T) {
 
 				// metadata
 				f3 := mockio.NewMockReadWriteCloser(ctrl)
-				mfs.EXPECT().OpenFile(gomock.Eq(locationMetadataPath), gomock.Eq(os.O_CREATE|os.O_TRUNC|os.O_WRONLY), gomock.Eq(fs.FileMode(0644))).Times(1).Return(f3, nil)
+				mfs.EXPECT().OpenFile(gomock.Eq(locationMetadataPath+partitions.TempSuffix), gomock.Eq(os.O_CREATE|os.O_TRUNC|os.O_WRONLY), gomock.Eq(fs.FileMode(0644))).Times(1).Return(f3, nil)
 				f3.EXPECT().Write(gomock.Eq([]byte(`{"a":"aa","b":"bb"}`))).Times(1).DoAndReturn(func(b []byte) (int, error) {
 					return len(b), nil
 				})
@@ -943,9 +986,15 @@ func Test_api_StoreLocation(t *testing.T) {
 
 				// metadata.sig
 				f4 := mockio.NewMockReadWriteCloser(ctrl)
-				mfs.EXPECT().OpenFile(gomock.Eq(locationMetadataSigPath), gomock.Eq(os.O_CREATE|os.O_TRUNC|os.O_WRONLY), gomock.Eq(fs.FileMode(0644))).Times(1).Return(f4, nil)
+				mfs.EXPECT().OpenFile(gomock.Eq(locationMetadataSigPath+partitions.TempSuffix), gomock.Eq(os.O_CREATE|os.O_TRUNC|os.O_WRONLY), gomock.Eq(fs.FileMode(0644))).Times(1).Return(f4, nil)
 				f4.EXPECT().Write(gomock.Eq([]byte("metadata-sig"))).Times(1).Return(0, errF4Write)
 				f4.EXPECT().Close().Times(1).Return(nil)
+
+				// the temporary files are removed again
+				mfs.EXPECT().Remove(gomock.Eq(locationUUIDPath + partitions.TempSuffix)).Times(1).Return(nil)
+				mfs.EXPECT().Remove(gomock.Eq(locationUUIDSigPath + partitions.TempSuffix)).Times(1).Return(nil)
+				mfs.EXPECT().Remove(gomock.Eq(locationMetadataPath + partitions.TempSuffix)).Times(1).Return(nil)
+				mfs.EXPECT().Remove(gomock.Eq(locationMetadataSigPath + partitions.TempSuffix)).Times(1).Return(nil)
 			},
 		},
 		{
@@ -956,7 +1005,7 @@ func Test_api_StoreLocation(t *testing.T) {
 			pre: func(t *testing.T, ctrl *gomock.Controller, mfs *mockpartitions.MockFS) {
 				// uuid
 				f1 := mockio.NewMockReadWriteCloser(ctrl)
-				mfs.EXPECT().OpenFile(gomock.Eq(locationUUIDPath), gomock.Eq(os.O_CREATE|os.O_TRUNC|os.O_WRONLY), gomock.Eq(fs.FileMode(0644))).Times(1).Return(f1, nil)
+				mfs.EXPECT().OpenFile(gomock.Eq(locationUUIDPath+partitions.TempSuffix), gomock.Eq(os.O_CREATE|os.O_TRUNC|os.O_WRONLY), gomock.Eq(fs.FileMode(0644))).Times(1).Return(f1, nil)
 				f1.EXPECT().Write(gomock.Eq([]byte("2a59c9f4-9966-4270-b6a2-2313f41d5ce1"))).Times(1).DoAndReturn(func(b []byte) (int, error) {
 					return len(b), nil
 				})
@@ -964,7 +1013,7 @@ func Test_api_StoreLocation(t *testing.T) {
 
 				// uuid.sig
 				f2 := mockio.NewMockReadWriteCloser(ctrl)
-				mfs.EXPECT().OpenFile(gomock.Eq(locationUUIDSigPath), gomock.Eq(os.O_CREATE|os.O_TRUNC|os.O_WRONLY), gomock.Eq(fs.FileMode(0644))).Times(1).Return(f2, nil)
+				mfs.EXPECT().OpenFile(gomock.Eq(locationUUIDSigPath+partitions.TempSuffix), gomock.Eq(os.O_CREATE|os.O_TRUNC|os.O_WRONLY), gomock.Eq(fs.FileMode(0644))).Times(1).Return(f2, nil)
 				f2.EXPECT().Write(gomock.Eq([]byte("uuid-sig"))).Times(1).DoAndReturn(func(b []byte) (int, error) {
 					return len(b), nil
 				})
@@ -972,14 +1021,20 @@ func Test_api_StoreLocation(t *testing.T) {
 
 				// metadata
 				f3 := mockio.NewMockReadWriteCloser(ctrl)
-				mfs.EXPECT().OpenFile(gomock.Eq(locationMetadataPath), gomock.Eq(os.O_CREATE|os.O_TRUNC|os.O_WRONLY), gomock.Eq(fs.FileMode(0644))).Times(1).Return(f3, nil)
+				mfs.EXPECT().OpenFile(gomock.Eq(locationMetadataPath+partitions.TempSuffix), gomock.Eq(os.O_CREATE|os.O_TRUNC|os.O_WRONLY), gomock.Eq(fs.FileMode(0644))).Times(1).Return(f3, nil)
 				f3.EXPECT().Write(gomock.Eq([]byte(`{"a":"aa","b":"bb"}`))).Times(1).DoAndReturn(func(b []byte) (int, error) {
 					return len(b), nil
 				})
 				f3.EXPECT().Close().Times(1).Return(nil)
 
 				// metadata.sig
-				mfs.EXPECT().OpenFile(gomock.Eq(locationMetadataSigPath), gomock.Eq(os.O_CREATE|os.O_TRUNC|os.O_WRONLY), gomock.Eq(fs.FileMode(0644))).Times(1).Return(nil, errF4Open)
+				mfs.EXPECT().OpenFile(gomock.Eq(locationMetadataSigPath+partitions.TempSuffix), gomock.Eq(os.O_CREATE|os.O_TRUNC|os.O_WRONLY), gomock.Eq(fs.FileMode(0644))).Times(1).Return(nil, errF4Open)
+
+				// the temporary files are removed again
+				mfs.EXPECT().Remove(gomock.Eq(locationUUIDPath + partitions.TempSuffix)).Times(1).Return(nil)
+				mfs.EXPECT().Remove(gomock.Eq(locationUUIDSigPath + partitions.TempSuffix)).Times(1).Return(nil)
+				mfs.EXPECT().Remove(gomock.Eq(locationMetadataPath + partitions.TempSuffix)).Times(1).Return(nil)
+				mfs.EXPECT().Remove(gomock.Eq(locationMetadataSigPath + partitions.TempSuffix)).Times(1).Return(nil)
 			},
 		},
 		{
@@ -990,7 +1045,7 @@ func Test_api_StoreLocation(t *testing.T) {
 			pre: func(t *testing.T, ctrl *gomock.Controller, mfs *mockpartitions.MockFS) {
 				// uuid
 				f1 := mockio.NewMockReadWriteCloser(ctrl)
-				mfs.EXPECT().OpenFile(gomock.Eq(locationUUIDPath), gomock.Eq(os.O_CREATE|os.O_TRUNC|os.O_WRONLY), gomock.Eq(fs.FileMode(0644))).Times(1).Return(f1, nil)
+				mfs.EXPECT().OpenFile(gomock.Eq(locationUUIDPath+partitions.TempSuffix), gomock.Eq(os.O_CREATE|os.O_TRUNC|os.O_WRONLY), gomock.Eq(fs.FileMode(0644))).Times(1).Return(f1, nil)
 				f1.EXPECT().Write(gomock.Eq([]byte("2a59c9f4-9966-4270-b6a2-2313f41d5ce1"))).Times(1).DoAndReturn(func(b []byte) (int, error) {
 					return len(b), nil
 				})
@@ -998,7 +1053,7 @@ func Test_api_StoreLocation(t *testing.T) {
 
 				// uuid.sig
 				f2 := mockio.NewMockReadWriteCloser(ctrl)
-				mfs.EXPECT().OpenFile(gomock.Eq(locationUUIDSigPath), gomock.Eq(os.O_CREATE|os.O_TRUNC|os.O_WRONLY), gomock.Eq(fs.FileMode(0644))).Times(1).Return(f2, nil)
+				mfs.EXPECT().OpenFile(gomock.Eq(locationUUIDSigPath+partitions.TempSuffix), gomock.Eq(os.O_CREATE|os.O_TRUNC|os.O_WRONLY), gomock.Eq(fs.FileMode(0644))).Times(1).Return(f2, nil)
 				f2.EXPECT().Write(gomock.Eq([]byte("uuid-sig"))).Times(1).DoAndReturn(func(b []byte) (int, error) {
 					return len(b), nil
 				})
@@ -1006,9 +1061,14 @@ func Test_api_StoreLocation(t *testing.T) {
 
 				// metadata
 				f3 := mockio.NewMockReadWriteCloser(ctrl)
-				mfs.EXPECT().OpenFile(gomock.Eq(locationMetadataPath), gomock.Eq(os.O_CREATE|os.O_TRUNC|os.O_WRONLY), gomock.Eq(fs.FileMode(0644))).Times(1).Return(f3, nil)
+				mfs.EXPECT().OpenFile(gomock.Eq(locationMetadataPath+partitions.TempSuffix), gomock.Eq(os.O_CREATE|os.O_TRUNC|os.O_WRONLY), gomock.Eq(fs.FileMode(0644))).Times(1).Return(f3, nil)
 				f3.EXPECT().Write(gomock.Eq([]byte(`{"a":"aa","b":"bb"}`))).Times(1).Return(0, errF3Write)
 				f3.EXPECT().Close().Times(1).Return(nil)
+
+				// the temporary files are removed again
+				mfs.EXPECT().Remove(gomock.Eq(locationUUIDPath + partitions.TempSuffix)).Times(1).Return(nil)
+				mfs.EXPECT().Remove(gomock.Eq(locationUUIDSigPath + partitions.TempSuffix)).Times(1).Return(nil)
+				mfs.EXPECT().Remove(gomock.Eq(locationMetadataPath + partitions.TempSuffix)).Times(1).Return(nil)
 			},
 		},
 		{
@@ -1019,7 +1079,7 @@ func Test_api_StoreLocation(t *testing.T) {
 			pre: func(t *testing.T, ctrl *gomock.Controller, mfs *mockpartitions.MockFS) {
 				// uuid
 				f1 := mockio.NewMockReadWriteCloser(ctrl)
-				mfs.EXPECT().OpenFile(gomock.Eq(locationUUIDPath), gomock.Eq(os.O_CREATE|os.O_TRUNC|os.O_WRONLY), gomock.Eq(fs.FileMode(0644))).Times(1).Return(f1, nil)
+				mfs.EXPECT().OpenFile(gomock.Eq(locationUUIDPath+partitions.TempSuffix), gomock.Eq(os.O_CREATE|os.O_TRUNC|os.O_WRONLY), gomock.Eq(fs.FileMode(0644))).Times(1).Return(f1, nil)
 				f1.EXPECT().Write(gomock.Eq([]byte("2a59c9f4-9966-4270-b6a2-2313f41d5ce1"))).Times(1).DoAndReturn(func(b []byte) (int, error) {
 					return len(b), nil
 				})
@@ -1027,14 +1087,19 @@ func Test_api_StoreLocation(t *testing.T) {
 
 				// uuid.sig
 				f2 := mockio.NewMockReadWriteCloser(ctrl)
-				mfs.EXPECT().OpenFile(gomock.Eq(locationUUIDSigPath), gomock.Eq(os.O_CREATE|os.O_TRUNC|os.O_WRONLY), gomock.Eq(fs.FileMode(0644))).Times(1).Return(f2, nil)
+				mfs.EXPECT().OpenFile(gomock.Eq(locationUUIDSigPath+partitions.TempSuffix), gomock.Eq(os.O_CREATE|os.O_TRUNC|os.O_WRONLY), gomock.Eq(fs.FileMode(0644))).Times(1).Return(f2, nil)
 				f2.EXPECT().Write(gomock.Eq([]byte("uuid-sig"))).Times(1).DoAndReturn(func(b []byte) (int, error) {
 					return len(b), nil
 				})
 				f2.EXPECT().Close().Times(1).Return(nil)
 
 				// metadata
-				mfs.EXPECT().OpenFile(gomock.Eq(locationMetadataPath), gomock.Eq(os.O_CREATE|os.O_TRUNC|os.O_WRONLY), gomock.Eq(fs.FileMode(0644))).Times(1).Return(nil, errF3Open)
+				mfs.EXPECT().OpenFile(gomock.Eq(locationMetadataPath+partitions.TempSuffix), gomock.Eq(os.O_CREATE|os.O_TRUNC|os.O_WRONLY), gomock.Eq(fs.FileMode(0644))).Times(1).Return(nil, errF3Open)
+
+				// the temporary files are removed again
+				mfs.EXPECT().Remove(gomock.Eq(locationUUIDPath + partitions.TempSuffix)).Times(1).Return(nil)
+				mfs.EXPECT().Remove(gomock.Eq(locationUUIDSigPath + partitions.TempSuffix)).Times(1).Return(nil)
+				mfs.EXPECT().Remove(gomock.Eq(locationMetadataPath + partitions.TempSuffix)).Times(1).Return(nil)
 			},
 		},
 		{
@@ -1045,7 +1110,7 @@ func Test_api_StoreLocation(t *testing.T) {
 			pre: func(t *testing.T, ctrl *gomock.Controller, mfs *mockpartitions.MockFS) {
 				// uuid
 				f1 := mockio.NewMockReadWriteCloser(ctrl)
-				mfs.EXPECT().OpenFile(gomock.Eq(locationUUIDPath), gomock.Eq(os.O_CREATE|os.O_TRUNC|os.O_WRONLY), gomock.Eq(fs.FileMode(0644))).Times(1).Return(f1, nil)
+				mfs.EXPECT().OpenFile(gomock.Eq(locationUUIDPath+partitions.TempSuffix), gomock.Eq(os.O_CREATE|os.O_TRUNC|os.O_WRONLY), gomock.Eq(fs.FileMode(0644))).Times(1).Return(f1, nil)
 				f1.EXPECT().Write(gomock.Eq([]byte("2a59c9f4-9966-4270-b6a2-2313f41d5ce1"))).Times(1).DoAndReturn(func(b []byte) (int, error) {
 					return len(b), nil
 				})
@@ -1053,9 +1118,13 @@ func Test_api_StoreLocation(t *testing.T) {
 
 				// uuid.sig
 				f2 := mockio.NewMockReadWriteCloser(ctrl)
-				mfs.EXPECT().OpenFile(gomock.Eq(locationUUIDSigPath), gomock.Eq(os.O_CREATE|os.O_TRUNC|os.O_WRONLY), gomock.Eq(fs.FileMode(0644))).Times(1).Return(f2, nil)
+				mfs.EXPECT().OpenFile(gomock.Eq(locationUUIDSigPath+partitions.TempSuffix), gomock.Eq(os.O_CREATE|os.O_TRUNC|os.O_WRONLY), gomock.Eq(fs.FileMode(0644))).Times(1).Return(f2, nil)
 				f2.EXPECT().Write(gomock.Eq([]byte("uuid-sig"))).Times(1).Return(0, errF2Write)
 				f2.EXPECT().Close().Times(1).Return(nil)
+
+				// the temporary files are removed again
+				mfs.EXPECT().Remove(gomock.Eq(locationUUIDPath + partitions.TempSuffix)).Times(1).Return(nil)
+				mfs.EXPECT().Remove(gomock.Eq(locationUUIDSigPath + partitions.TempSuffix)).Times(1).Return(nil)
 			},
 		},
 		{
@@ -1066,14 +1135,18 @@ func Test_api_StoreLocation(t *testing.T) {
 			pre: func(t *testing.T, ctrl *gomock.Controller, mfs *mockpartitions.MockFS) {
 				// uuid
 				f1 := mockio.NewMockReadWriteCloser(ctrl)
-				mfs.EXPECT().OpenFile(gomock.Eq(locationUUIDPath), gomock.Eq(os.O_CREATE|os.O_TRUNC|os.O_WRONLY), gomock.Eq(fs.FileMode(0644))).Times(1).Return(f1, nil)
+				mfs.EXPECT().OpenFile(gomock.Eq(locationUUIDPath+partitions.TempSuffix), gomock.Eq(os.O_CREATE|os.O_TRUNC|os.O_WRONLY), gomock.Eq(fs.FileMode(0644))).Times(1).Return(f1, nil)
 				f1.EXPECT().Write(gomock.Eq([]byte("2a59c9f4-9966-4270-b6a2-2313f41d5ce1"))).Times(1).DoAndReturn(func(b []byte) (int, error) {
 					return len(b), nil
 				})
 				f1.EXPECT().Close().Times(1).Return(nil)
 
 				// uuid.sig
-				mfs.EXPECT().OpenFile(gomock.Eq(locationUUIDSigPath), gomock.Eq(os.O_CREATE|os.O_TRUNC|os.O_WRONLY), gomock.Eq(fs.FileMode(0644))).Times(1).Return(nil, errF2Open)
+				mfs.EXPECT().OpenFile(gomock.Eq(locationUUIDSigPath+partitions.TempSuffix), gomock.Eq(os.O_CREATE|os.O_TRUNC|os.O_WRONLY), gomock.Eq(fs.FileMode(0644))).Times(1).Return(nil, errF2Open)
+
+				// the temporary files are removed again
+				mfs.EXPECT().Remove(gomock.Eq(locationUUIDPath + partitions.TempSuffix)).Times(1).Return(nil)
+				mfs.EXPECT().Remove(gomock.Eq(locationUUIDSigPath + partitions.TempSuffix)).Times(1).Return(nil)
 			},
 		},
 		{
@@ -1084,9 +1157,12 @@ func Test_api_StoreLocation(t *testing.T) {
 			pre: func(t *testing.T, ctrl *gomock.Controller, mfs *mockpartitions.MockFS) {
 				// uuid
 				f1 := mockio.NewMockReadWriteCloser(ctrl)
-				mfs.EXPECT().OpenFile(gomock.Eq(locationUUIDPath), gomock.Eq(os.O_CREATE|os.O_TRUNC|os.O_WRONLY), gomock.Eq(fs.FileMode(0644))).Times(1).Return(f1, nil)
+				mfs.EXPECT().OpenFile(gomock.Eq(locationUUIDPath+partitions.TempSuffix), gomock.Eq(os.O_CREATE|os.O_TRUNC|os.O_WRONLY), gomock.Eq(fs.FileMode(0644))).Times(1).Return(f1, nil)
 				f1.EXPECT().Write(gomock.Eq([]byte("2a59c9f4-9966-4270-b6a2-2313f41d5ce1"))).Times(1).Return(0, errF1Write)
 				f1.EXPECT().Close().Times(1).Return(nil)
+
+				// the temporary file is removed again
+				mfs.EXPECT().Remove(gomock.Eq(locationUUIDPath + partitions.TempSuffix)).Times(1).Return(nil)
 			},
 		},
 		{
@@ -1096,7 +1172,10 @@ func Test_api_StoreLocation(t *testing.T) {
 			wantErrToBe: errF1Open,
 			pre: func(t *testing.T, ctrl *gomock.Controller, mfs *mockpartitions.MockFS) {
 				// uuid
-				mfs.EXPECT().OpenFile(gomock.Eq(locationUUIDPath), gomock.Eq(os.O_CREATE|os.O_TRUNC|os.O_WRONLY), gomock.Eq(fs.FileMode(0644))).Times(1).Return(nil, errF1Open)
+				mfs.EXPECT().OpenFile(gomock.Eq(locationUUIDPath+partitions.TempSuffix), gomock.Eq(os.O_CREATE|os.O_TRUNC|os.O_WRONLY), gomock.Eq(fs.FileMode(0644))).Times(1).Return(nil, errF1Open)
+
+				// the temporary file is removed again
+				mfs.EXPECT().Remove(gomock.Eq(locationUUIDPath + partitions.TempSuffix)).Times(1).Return(nil)
 			},
 		},
 	}
@@ -1152,7 +1231,7 @@ func Test_api_CopyLocation(t *testing.T) {
 				}, nil)
 				// uuid
 				f1 := mockio.NewMockReadWriteCloser(ctrl)
-				mfs.EXPECT().OpenFile(gomock.Eq(locationUUIDPath), gomock.Eq(os.O_CREATE|os.O_TRUNC|os.O_WRONLY), gomock.Eq(fs.FileMode(0644))).Times(1).Return(f1, nil)
+				mfs.EXPECT().OpenFile(gomock.Eq(locationUUIDPath+partitions.TempSuffix), gomock.Eq(os.O_CREATE|os.O_TRUNC|os.O_WRONLY), gomock.Eq(fs.FileMode(0644))).Times(1).Return(f1, nil)
 				f1.EXPECT().Write(gomock.Eq([]byte("2a59c9f4-9966-4270-b6a2-2313f41d5ce1"))).Times(1).DoAndReturn(func(b []byte) (int, error) {
 					return len(b), nil
 				})
@@ -1160,7 +1239,7 @@ func Test_api_CopyLocation(t *testing.T) {
 
 				// uuid.sig
 				f2 := mockio.NewMockReadWriteCloser(ctrl)
-				mfs.EXPECT().OpenFile(gomock.Eq(locationUUIDSigPath), gomock.Eq(os.O_CREATE|os.O_TRUNC|os.O_WRONLY), gomock.Eq(fs.FileMode(0644))).Times(1).Return(f2, nil)
+				mfs.EXPECT().OpenFile(gomock.Eq(locationUUIDSigPath+partitions.TempSuffix), gomock.Eq(os.O_CREATE|os.O_TRUNC|os.O_WRONLY), gomock.Eq(fs.FileMode(0644))).Times(1).Return(f2, nil)
 				f2.EXPECT().Write(gomock.Eq([]byte("uuid-sig"))).Times(1).DoAndReturn(func(b []byte) (int, error) {
 					return len(b), nil
 				})
@@ -1168,7 +1247,7 @@ func Test_api_CopyLocation(t *testing.T) {
 
 				// metadata
 				f3 := mockio.NewMockReadWriteCloser(ctrl)
-				mfs.EXPECT().OpenFile(gomock.Eq(locationMetadataPath), gomock.Eq(os.O_CREATE|os.O_TRUNC|os.O_WRONLY), gomock.Eq(fs.FileMode(0644))).Times(1).Return(f3, nil)
+				mfs.EXPECT().OpenFile(gomock.Eq(locationMetadataPath+partitions.TempSuffix), gomock.Eq(os.O_CREATE|os.O_TRUNC|os.O_WRONLY), gomock.Eq(fs.FileMode(0644))).Times(1).Return(f3, nil)
 				f3.EXPECT().Write(gomock.Eq([]byte(`{"a":"aa","b":"bb"}`))).Times(1).DoAndReturn(func(b []byte) (int, error) {
 					return len(b), nil
 				})
@@ -1176,11 +1255,18 @@ func Test_api_CopyLocation(t *testing.T) {
 
 				// metadata.sig
 				f4 := mockio.NewMockReadWriteCloser(ctrl)
-				mfs.EXPECT().OpenFile(gomock.Eq(locationMetadataSigPath), gomock.Eq(os.O_CREATE|os.O_TRUNC|os.O_WRONLY), gomock.Eq(fs.FileMode(0644))).Times(1).Return(f4, nil)
+				mfs.EXPECT().OpenFile(gomock.Eq(locationMetadataSigPath+partitions.TempSuffix), gomock.Eq(os.O_CREATE|os.O_TRUNC|os.O_WRONLY), gomock.Eq(fs.FileMode(0644))).Times(1).Return(f4, nil)
 				f4.EXPECT().Write(gomock.Eq([]byte("metadata-sig"))).Times(1).DoAndReturn(func(b []byte) (int, error) {
 					return len(b), nil
 				})
 				f4.EXPECT().Close().Times(1).Return(nil)
+
+				// the temporary files are moved into place and the directory is synced
+				mfs.EXPECT().Rename(gomock.Eq(locationUUIDPath+partitions.TempSuffix), gomock.Eq(locationUUIDPath)).Times(1).Return(nil)
+				mfs.EXPECT().Rename(gomock.Eq(locationUUIDSigPath+partitions.TempSuffix), gomock.Eq(locationUUIDSigPath)).Times(1).Return(nil)
+				mfs.EXPECT().Rename(gomock.Eq(locationMetadataPath+partitions.TempSuffix), gomock.Eq(locationMetadataPath)).Times(1).Return(nil)
+				mfs.EXPECT().Rename(gomock.Eq(locationMetadataSigPath+partitions.TempSuffix), gomock.Eq(locationMetadataSigPath)).Times(1).Return(nil)
+				mfs.EXPECT().SyncDir(gomock.Eq(locationDirPath)).Times(1).Return(nil)
 			},
 		},
 		{
@@ -1940,9 +2026,13 @@ func Test_api_StoreClientCert(t *testing.T) {
 				mockio.ReadAllBytesMock(f, csrValid, 2)
 
 				// Cert
-				mfs.EXPECT().OpenFile(gomock.Eq(clientCertPath), gomock.Eq(os.O_CREATE|os.O_TRUNC|os.O_WRONLY), gomock.Eq(fs.FileMode(0644))).Times(1).Return(f, nil)
+				mfs.EXPECT().OpenFile(gomock.Eq(clientCertPath+partitions.TempSuffix), gomock.Eq(os.O_CREATE|os.O_TRUNC|os.O_WRONLY), gomock.Eq(fs.FileMode(0644))).Times(1).Return(f, nil)
 				f.EXPECT().Close().Times(1).Return(nil)
 				f.EXPECT().Write(gomock.Eq(certValidPEM)).Times(1).Return(len(certValidPEM), nil)
+
+				// the temporary file is moved into place and the directory is synced
+				mfs.EXPECT().Rename(gomock.Eq(clientCertPath+partitions.TempSuffix), gomock.Eq(clientCertPath)).Times(1).Return(nil)
+				mfs.EXPECT().SyncDir(gomock.Eq(identityDirPath)).Times(1).Return(nil)
 			},
 		},
 		{
@@ -1958,9 +2048,12 @@ func Test_api_StoreClientCert(t *testing.T) {
 				mockio.ReadAllBytesMock(f, csrValid, 2)
 
 				// Cert
-				mfs.EXPECT().OpenFile(gomock.Eq(clientCertPath), gomock.Eq(os.O_CREATE|os.O_TRUNC|os.O_WRONLY), gomock.Eq(fs.FileMode(0644))).Times(1).Return(f, nil)
+				mfs.EXPECT().OpenFile(gomock.Eq(clientCertPath+partitions.TempSuffix), gomock.Eq(os.O_CREATE|os.O_TRUNC|os.O_WRONLY), gomock.Eq(fs.FileMode(0644))).Times(1).Return(f, nil)
 				f.EXPECT().Close().Times(1).Return(nil)
 				f.EXPECT().Write(gomock.Eq(certValidPEM)).Times(1).Return(0, errWriteFailed)
+
+				// the temporary file is removed again
+				mfs.EXPECT().Remove(gomock.Eq(clientCertPath + partitions.TempSuffix)).Times(1).Return(nil)
 			},
 		},
 		{
@@ -1976,7 +2069,10 @@ func Test_api_StoreClientCert(t *testing.T) {
 				mockio.ReadAllBytesMock(f, csrValid, 2)
 
 				// Cert
-				mfs.EXPECT().OpenFile(gomock.Eq(clientCertPath), gomock.Eq(os.O_CREATE|os.O_TRUNC|os.O_WRONLY), gomock.Eq(fs.FileMode(0644))).Times(1).Return(nil, errOpenFailed)
+				mfs.EXPECT().OpenFile(gomock.Eq(clientCertPath+partitions.TempSuffix), gomock.Eq(os.O_CREATE|os.O_TRUNC|os.O_WRONLY), gomock.Eq(fs.FileMode(0644))).Times(1).Return(nil, errOpenFailed)
+
+				// the temporary file is removed again
+				mfs.EXPECT().Remove(gomock.Eq(clientCertPath + partitions.TempSuffix)).Times(1).Return(nil)
 			},
 		},
 		{
@@ -2042,12 +2138,16 @@ func Test_api_GenerateClientCSR(t *testing.T) {
 				f.EXPECT().Close().Times(1).Return(nil)
 				mockio.ReadAllBytesMock(f, keyValid, 1)
 				f2 := mockio.NewMockReadWriteCloser(ctrl)
-				mfs.EXPECT().OpenFile(gomock.Eq(clientCSRPath), gomock.Eq(os.O_CREATE|os.O_TRUNC|os.O_WRONLY), gomock.Eq(fs.FileMode(0644))).Times(1).Return(f2, nil)
+				mfs.EXPECT().OpenFile(gomock.Eq(clientCSRPath+partitions.TempSuffix), gomock.Eq(os.O_CREATE|os.O_TRUNC|os.O_WRONLY), gomock.Eq(fs.FileMode(0644))).Times(1).Return(f2, nil)
 				f2.EXPECT().Close().Times(1).Return(nil)
 				f2.EXPECT().Write(gomock.Any()).Times(1).DoAndReturn(func(b []byte) (int, error) {
 					return len(b), nil
 				})
 				mfs.EXPECT().Remove(gomock.Eq(clientCertPath)).Times(1).Return(os.ErrNotExist)
+
+				// the temporary file is moved into place and the directory is synced
+				mfs.EXPECT().Rename(gomock.Eq(clientCSRPath+partitions.TempSuffix), gomock.Eq(clientCSRPath)).Times(1).Return(nil)
+				mfs.EXPECT().SyncDir(gomock.Eq(identityDirPath)).Times(1).Return(nil)
 			},
 		},
 		{
@@ -2059,12 +2159,16 @@ func Test_api_GenerateClientCSR(t *testing.T) {
 				f.EXPECT().Close().Times(1).Return(nil)
 				mockio.ReadAllBytesMock(f, keyValid, 1)
 				f2 := mockio.NewMockReadWriteCloser(ctrl)
-				mfs.EXPECT().OpenFile(gomock.Eq(clientCSRPath), gomock.Eq(os.O_CREATE|os.O_TRUNC|os.O_WRONLY), gomock.Eq(fs.FileMode(0644))).Times(1).Return(f2, nil)
+				mfs.EXPECT().OpenFile(gomock.Eq(clientCSRPath+partitions.TempSuffix), gomock.Eq(os.O_CREATE|os.O_TRUNC|os.O_WRONLY), gomock.Eq(fs.FileMode(0644))).Times(1).Return(f2, nil)
 				f2.EXPECT().Close().Times(1).Return(nil)
 				f2.EXPECT().Write(gomock.Any()).Times(1).DoAndReturn(func(b []byte) (int, error) {
 					return len(b), nil
 				})
 				mfs.EXPECT().Remove(gomock.Eq(clientCertPath)).Times(1).Return(os.ErrPermission)
+
+				// the temporary file is moved into place and the directory is synced
+				mfs.EXPECT().Rename(gomock.Eq(clientCSRPath+partitions.TempSuffix), gomock.Eq(clientCSRPath)).Times(1).Return(nil)
+				mfs.EXPECT().SyncDir(gomock.Eq(identityDirPath)).Times(1).Return(nil)
 			},
 		},
 		{
@@ -2077,9 +2181,12 @@ func Test_api_GenerateClientCSR(t *testing.T) {
 				f.EXPECT().Close().Times(1).Return(nil)
 				mockio.ReadAllBytesMock(f, keyValid, 1)
 				f2 := mockio.NewMockReadWriteCloser(ctrl)
-				mfs.EXPECT().OpenFile(gomock.Eq(clientCSRPath), gomock.Eq(os.O_CREATE|os.O_TRUNC|os.O_WRONLY), gomock.Eq(fs.FileMode(0644))).Times(1).Return(f2, nil)
+				mfs.EXPECT().OpenFile(gomock.Eq(clientCSRPath+partitions.TempSuffix), gomock.Eq(os.O_CREATE|os.O_TRUNC|os.O_WRONLY), gomock.Eq(fs.FileMode(0644))).Times(1).Return(f2, nil)
 				f2.EXPECT().Close().Times(1).Return(nil)
 				f2.EXPECT().Write(gomock.Any()).Times(1).Return(0, errWriteFailed)
+
+				// the temporary file is removed again
+				mfs.EXPECT().Remove(gomock.Eq(clientCSRPath + partitions.TempSuffix)).Times(1).Return(nil)
 			},
 		},
 		{
@@ -2091,7 +2198,10 @@ func Test_api_GenerateClientCSR(t *testing.T) {
 				mfs.EXPECT().Open(gomock.Eq(clientKeyPath)).Times(1).Return(f, nil)
 				f.EXPECT().Close().Times(1).Return(nil)
 				mockio.ReadAllBytesMock(f, keyValid, 1)
-				mfs.EXPECT().OpenFile(gomock.Eq(clientCSRPath), gomock.Eq(os.O_CREATE|os.O_TRUNC|os.O_WRONLY), gomock.Eq(fs.FileMode(0644))).Times(1).Return(nil, errOpenFailed)
+				mfs.EXPECT().OpenFile(gomock.Eq(clientCSRPath+partitions.TempSuffix), gomock.Eq(os.O_CREATE|os.O_TRUNC|os.O_WRONLY), gomock.Eq(fs.FileMode(0644))).Times(1).Return(nil, errOpenFailed)
+
+				// the temporary file is removed again
+				mfs.EXPECT().Remove(gomock.Eq(clientCSRPath + partitions.TempSuffix)).Times(1).Return(nil)
 			},
 		},
 		{
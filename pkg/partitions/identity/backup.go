@@ -0,0 +1,314 @@
+// Copyright 2023 Hedgehog
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package identity
+
+import (
+	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"time"
+
+	"go.githedgehog.com/dasboot/pkg/partitions"
+)
+
+// BackupVersion is the current version of the format of identity backups
+const BackupVersion = 1
+
+var (
+	ErrInvalidBackup        = errors.New("identity: invalid backup")
+	ErrBackupSignature      = errors.New("identity: backup signature verification failed")
+	ErrBackupLocked         = errors.New("identity: backup cannot be decrypted with any of the keys")
+	ErrBackupDeviceMismatch = errors.New("identity: backup is for a different device")
+	ErrIdentityExists       = errors.New("identity: partition holds a client certificate already")
+)
+
+// backupKeyLabel separates the keys which encrypt backups from the unlock keys they are derived from
+var backupKeyLabel = []byte("hedgehog identity backup v1")
+
+// backupFiles are the files of the identity partition which make up the identity of a device. Devices with a TPM
+// have the wrapped TPM key instead of the key file, and it can only be restored onto the same TPM.
+var backupFiles = []string{
+	clientKeyPath,
+	tpmClientPubPath,
+	tpmClientPrivPath,
+	clientCSRPath,
+	clientCertPath,
+	locationUUIDPath,
+	locationUUIDSigPath,
+	locationMetadataPath,
+	locationMetadataSigPath,
+}
+
+// Backup is a backup of the identity of a device: its client key, CSR and certificate, and its location. The files
+// are encrypted with a random data key, which is encrypted with every unlock key of the device (see `UnlockKeys`)
+// into a key slot of its own. It is signed with the client key, so that the seeder can check which device uploaded
+// it, and the device can check it before restoring it.
+type Backup struct {
+	// Version is the version of the backup format
+	Version int `json:"version"`
+
+	// DeviceID is the device ID, which is also the common name of the client certificate
+	DeviceID string `json:"device_id"`
+
+	// Cert is the DER encoded client certificate
+	Cert []byte `json:"cert"`
+
+	// KeySlots hold the data key encrypted with AES-256-GCM under every unlock key
+	KeySlots [][]byte `json:"key_slots"`
+
+	// Payload holds the files encrypted with AES-256-GCM under the data key
+	Payload []byte `json:"payload"`
+
+	// Created is the time when the backup was created
+	Created time.Time `json:"created"`
+
+	// Signature is the signature over the SHA256 digest of the JSON encoding of the backup without the signature
+	Signature []byte `json:"signature,omitempty"`
+}
+
+// ExportBackup implements IdentityPartition
+func (a *api) ExportBackup(keys [][]byte) (*Backup, error) {
+	if len(keys) == 0 {
+		return nil, ErrNoUnlockKeys
+	}
+	kp, err := a.LoadX509KeyPair()
+	if err != nil {
+		return nil, fmt.Errorf("identity: loading client key pair: %w", err)
+	}
+	signer, ok := kp.PrivateKey.(crypto.Signer)
+	if !ok {
+		return nil, ErrUnsupportedDocumentSigner
+	}
+	cert, err := x509.ParseCertificate(kp.Certificate[0])
+	if err != nil {
+		return nil, fmt.Errorf("identity: client certificate: %w", err)
+	}
+	if cert.Subject.CommonName == "" {
+		return nil, ErrNoDevID
+	}
+
+	files := map[string][]byte{}
+	for _, name := range backupFiles {
+		b, err := a.readFile(name)
+		if err != nil {
+			if errors.Is(err, os.ErrNotExist) {
+				continue
+			}
+			return nil, fmt.Errorf("identity: reading %s: %w", name, err)
+		}
+		files[name] = b
+	}
+	plain, err := json.Marshal(files)
+	if err != nil {
+		return nil, err
+	}
+
+	b := &Backup{
+		Version:  BackupVersion,
+		DeviceID: cert.Subject.CommonName,
+		Cert:     cert.Raw,
+		Created:  time.Now().UTC(),
+	}
+	dataKey := make([]byte, 32)
+	if _, err := io.ReadFull(rand.Reader, dataKey); err != nil {
+		return nil, err
+	}
+	for _, key := range keys {
+		slot, err := seal(backupKey(key), dataKey, []byte(b.DeviceID))
+		if err != nil {
+			return nil, err
+		}
+		b.KeySlots = append(b.KeySlots, slot)
+	}
+	if b.Payload, err = seal(dataKey, plain, []byte(b.DeviceID)); err != nil {
+		return nil, err
+	}
+
+	digest, err := b.signingDigest()
+	if err != nil {
+		return nil, err
+	}
+	if b.Signature, err = signDigest(signer, digest); err != nil {
+		return nil, fmt.Errorf("identity: signing backup: %w", err)
+	}
+	return b, nil
+}
+
+// RestoreBackup implements IdentityPartition
+func (a *api) RestoreBackup(b *Backup, keys [][]byte) error {
+	if a.HasClientCert() {
+		return ErrIdentityExists
+	}
+	if _, err := b.Verify(); err != nil {
+		return err
+	}
+	if id := devidID(); id != "" && id != b.DeviceID {
+		return fmt.Errorf("%w: backup is for '%s', but this is '%s'", ErrBackupDeviceMismatch, b.DeviceID, id)
+	}
+	files, err := b.decrypt(keys)
+	if err != nil {
+		return err
+	}
+
+	// whatever is left of a previous identity must not be mixed with the restored one
+	write := make([]partitions.File, 0, len(files))
+	for _, name := range backupFiles {
+		data, ok := files[name]
+		if !ok {
+			if err := a.removeFile(name); err != nil {
+				return fmt.Errorf("identity: removing %s: %w", name, err)
+			}
+			continue
+		}
+		write = append(write, partitions.File{Name: name, Data: data})
+	}
+	if err := a.writeFiles(write...); err != nil {
+		return fmt.Errorf("identity: writing backup: %w", err)
+	}
+
+	// the client key must be usable, which is not the case for a TPM key of a different TPM
+	if _, err := a.LoadX509KeyPair(); err != nil {
+		for _, f := range write {
+			a.removeFile(f.Name) //nolint: errcheck
+		}
+		return fmt.Errorf("identity: loading restored client key pair: %w", err)
+	}
+	return nil
+}
+
+// Verify checks that the backup was signed with the key of its client certificate, and that the certificate
+// belongs to its device ID. It does not verify the certificate chain. It returns the client certificate.
+func (b *Backup) Verify() (*x509.Certificate, error) {
+	if b.Version != BackupVersion {
+		return nil, fmt.Errorf("%w: unsupported version %d", ErrInvalidBackup, b.Version)
+	}
+	cert, err := x509.ParseCertificate(b.Cert)
+	if err != nil {
+		return nil, fmt.Errorf("%w: client certificate: %w", ErrInvalidBackup, err)
+	}
+	if cert.Subject.CommonName == "" || cert.Subject.CommonName != b.DeviceID {
+		return nil, fmt.Errorf("%w: device ID '%s' does not match client certificate for '%s'", ErrInvalidBackup, b.DeviceID, cert.Subject.CommonName)
+	}
+	if len(b.Signature) == 0 {
+		return nil, fmt.Errorf("%w: not signed", ErrBackupSignature)
+	}
+	digest, err := b.signingDigest()
+	if err != nil {
+		return nil, err
+	}
+	ok, err := verifyDigest(cert.PublicKey, digest, b.Signature)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, ErrBackupSignature
+	}
+	return cert, nil
+}
+
+// signingDigest returns the SHA256 digest of the JSON encoding of the backup without its signature
+func (b *Backup) signingDigest() ([]byte, error) {
+	unsigned := *b
+	unsigned.Signature = nil
+	raw, err := json.Marshal(&unsigned)
+	if err != nil {
+		return nil, err
+	}
+	digest := sha256.Sum256(raw)
+	return digest[:], nil
+}
+
+// decrypt returns the files of the backup with the first key of `keys` which opens one of its key slots
+func (b *Backup) decrypt(keys [][]byte) (map[string][]byte, error) {
+	var dataKey []byte
+	for _, key := range keys {
+		for _, slot := range b.KeySlots {
+			if k, err := open(backupKey(key), slot, []byte(b.DeviceID)); err == nil {
+				dataKey = k
+				break
+			}
+		}
+		if dataKey != nil {
+			break
+		}
+	}
+	if dataKey == nil {
+		return nil, ErrBackupLocked
+	}
+	plain, err := open(dataKey, b.Payload, []byte(b.DeviceID))
+	if err != nil {
+		return nil, fmt.Errorf("%w: payload: %w", ErrInvalidBackup, err)
+	}
+	var files map[string][]byte
+	if err := json.Unmarshal(plain, &files); err != nil {
+		return nil, fmt.Errorf("%w: payload: %w", ErrInvalidBackup, err)
+	}
+	for name := range files {
+		if !slices.Contains(backupFiles, name) {
+			return nil, fmt.Errorf("%w: unexpected file %s", ErrInvalidBackup, name)
+		}
+	}
+	return files, nil
+}
+
+// backupKey derives the key which encrypts a key slot from the unlock key `key`
+func backupKey(key []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(backupKeyLabel)
+	return mac.Sum(nil)
+}
+
+// seal encrypts `plain` with AES-256-GCM, the random nonce is prepended to the ciphertext
+func seal(key, plain, additionalData []byte) ([]byte, error) {
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(plain)+aead.Overhead())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, plain, additionalData), nil
+}
+
+// open decrypts what `seal` encrypted
+func open(key, sealed, additionalData []byte) ([]byte, error) {
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) < aead.NonceSize() {
+		return nil, errors.New("sealed data too short")
+	}
+	return aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], additionalData)
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
@@ -0,0 +1,173 @@
+// Copyright 2023 Hedgehog
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package identity
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"go.githedgehog.com/dasboot/pkg/partitions/location"
+)
+
+// testRegisteredPartition initializes a partition with a client key pair, certificate and location
+func testRegisteredPartition(t *testing.T) *api {
+	t.Helper()
+	ip, err := Init(testIdentityDevice(t, "/dev/sda5"))
+	if err != nil {
+		t.Fatalf("Init() error = %v", err)
+	}
+	a := ip.(*api)
+	if err := a.StoreLocation(&location.Info{UUID: "cf2c3c2a-0f4c-4bd4-8b15-6e7c0f8e2b49", UUIDSig: []byte("sig"), Metadata: `{"rack":"r1"}`, MetadataSig: []byte("sig")}); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.GenerateClientKeyPair(); err != nil {
+		t.Fatal(err)
+	}
+	csr, err := a.GenerateClientCSR()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := a.StoreClientCert(selfSignedCert(t, csr)); err != nil {
+		t.Fatal(err)
+	}
+	return a
+}
+
+func Test_api_Backup(t *testing.T) {
+	oldDevidID := devidID
+	defer func() { devidID = oldDevidID }()
+	devidID = func() string { return "test-device" }
+
+	tpmKey, locationKey := []byte("tpm key"), []byte("location key")
+	src := testRegisteredPartition(t)
+	if _, err := src.ExportBackup(nil); !errors.Is(err, ErrNoUnlockKeys) {
+		t.Errorf("api.ExportBackup() without keys error = %v, want %v", err, ErrNoUnlockKeys)
+	}
+	b, err := src.ExportBackup([][]byte{tpmKey, locationKey})
+	if err != nil {
+		t.Fatalf("api.ExportBackup() error = %v", err)
+	}
+	if b.DeviceID != "test-device" || len(b.KeySlots) != 2 {
+		t.Errorf("api.ExportBackup() = device %q with %d key slots", b.DeviceID, len(b.KeySlots))
+	}
+	if _, err := b.Verify(); err != nil {
+		t.Errorf("Backup.Verify() error = %v", err)
+	}
+	raw, err := json.Marshal(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(raw, []byte("cf2c3c2a")) {
+		t.Errorf("backup contains the location in plain text")
+	}
+	wantKP, err := src.LoadX509KeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("restore with second key", func(t *testing.T) {
+		ip, err := Init(testIdentityDevice(t, "/dev/sdb5"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		dst := ip.(*api)
+		if err := dst.RestoreBackup(b, [][]byte{[]byte("wrong key"), locationKey}); err != nil {
+			t.Fatalf("api.RestoreBackup() error = %v", err)
+		}
+		kp, err := dst.LoadX509KeyPair()
+		if err != nil {
+			t.Fatalf("api.LoadX509KeyPair() after restore error = %v", err)
+		}
+		if !bytes.Equal(kp.Certificate[0], wantKP.Certificate[0]) {
+			t.Errorf("restored client certificate does not match")
+		}
+		if info, err := dst.GetLocation(); err != nil || info.UUID != "cf2c3c2a-0f4c-4bd4-8b15-6e7c0f8e2b49" {
+			t.Errorf("api.GetLocation() after restore = %v, %v", info, err)
+		}
+		if err := dst.RestoreBackup(b, [][]byte{tpmKey}); !errors.Is(err, ErrIdentityExists) {
+			t.Errorf("api.RestoreBackup() over existing identity error = %v, want %v", err, ErrIdentityExists)
+		}
+	})
+
+	tamper := func(f func(b *Backup)) *Backup {
+		var c Backup
+		if err := json.Unmarshal(raw, &c); err != nil {
+			t.Fatal(err)
+		}
+		f(&c)
+		return &c
+	}
+	tests := []struct {
+		name        string
+		backup      *Backup
+		keys        [][]byte
+		devid       string
+		wantErrToBe error
+	}{
+		{
+			name:        "wrong keys",
+			backup:      b,
+			keys:        [][]byte{[]byte("wrong key")},
+			devid:       "test-device",
+			wantErrToBe: ErrBackupLocked,
+		},
+		{
+			name:        "other device",
+			backup:      b,
+			keys:        [][]byte{tpmKey},
+			devid:       "other-device",
+			wantErrToBe: ErrBackupDeviceMismatch,
+		},
+		{
+			name:        "tampered payload",
+			backup:      tamper(func(b *Backup) { b.Payload[len(b.Payload)-1] ^= 1 }),
+			keys:        [][]byte{tpmKey},
+			devid:       "test-device",
+			wantErrToBe: ErrBackupSignature,
+		},
+		{
+			name:        "unsigned",
+			backup:      tamper(func(b *Backup) { b.Signature = nil }),
+			keys:        [][]byte{tpmKey},
+			devid:       "test-device",
+			wantErrToBe: ErrBackupSignature,
+		},
+		{
+			name:        "unsupported version",
+			backup:      tamper(func(b *Backup) { b.Version = 2 }),
+			keys:        [][]byte{tpmKey},
+			devid:       "test-device",
+			wantErrToBe: ErrInvalidBackup,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			devidID = func() string { return tt.devid }
+			ip, err := Init(testIdentityDevice(t, "/dev/sdb5"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			dst := ip.(*api)
+			if err := dst.RestoreBackup(tt.backup, tt.keys); !errors.Is(err, tt.wantErrToBe) {
+				t.Errorf("api.RestoreBackup() error = %v, wantErrToBe %v", err, tt.wantErrToBe)
+			}
+			if dst.HasClientKey() || dst.HasClientCert() {
+				t.Errorf("api.RestoreBackup() left a client key pair behind after failing")
+			}
+		})
+	}
+}
@@ -0,0 +1,79 @@
+// Copyright 2023 Hedgehog
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package identity
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"regexp"
+
+	"go.githedgehog.com/dasboot/pkg/partitions"
+)
+
+var checkpointNameRegexp = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9._-]*$`)
+
+func checkpointPath(name string) (string, error) {
+	if !checkpointNameRegexp.MatchString(name) {
+		return "", fmt.Errorf("%w: '%s'", ErrInvalidCheckpointName, name)
+	}
+	return path.Join(checkpointsDirPath, name), nil
+}
+
+// StoreCheckpoint implements IdentityPartition
+func (a *api) StoreCheckpoint(name string, data []byte) error {
+	p, err := checkpointPath(name)
+	if err != nil {
+		return err
+	}
+
+	// partitions which were initialized by previous versions do not have the checkpoints directory yet
+	if _, err := a.dev.FS.Stat(checkpointsDirPath); err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		if err := a.dev.FS.Mkdir(checkpointsDirPath, 0755); err != nil {
+			return err
+		}
+	}
+
+	return a.writeFiles(partitions.File{Name: p, Data: data})
+}
+
+// GetCheckpoint implements IdentityPartition
+func (a *api) GetCheckpoint(name string) ([]byte, error) {
+	p, err := checkpointPath(name)
+	if err != nil {
+		return nil, err
+	}
+	b, err := a.readFile(p)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, fmt.Errorf("%w: '%s'", ErrNoCheckpoint, name)
+		}
+		return nil, err
+	}
+	return b, nil
+}
+
+// DeleteCheckpoint implements IdentityPartition
+func (a *api) DeleteCheckpoint(name string) error {
+	p, err := checkpointPath(name)
+	if err != nil {
+		return err
+	}
+	return a.removeFile(p)
+}
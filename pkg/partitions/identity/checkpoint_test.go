@@ -0,0 +1,151 @@
+// Copyright 2023 Hedgehog
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package identity
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"reflect"
+	"testing"
+
+	"github.com/golang/mock/gomock"
+	"go.githedgehog.com/dasboot/pkg/partitions"
+	"go.githedgehog.com/dasboot/test/mock/mockio"
+	"go.githedgehog.com/dasboot/test/mock/mockpartitions"
+)
+
+func testCheckpointAPI(mfs partitions.FS) *api {
+	return &api{
+		dev: &partitions.Device{
+			Uevent: partitions.Uevent{
+				partitions.UeventDevtype: partitions.UeventDevtypePartition,
+			},
+			GPTPartType: partitions.GPTPartTypeHedgehogIdentity,
+			FS:          mfs,
+		},
+	}
+}
+
+func Test_api_StoreCheckpoint(t *testing.T) {
+	errStat := errors.New("Stat() failed tragically")
+	tests := []struct {
+		name        string
+		cpName      string
+		wantErrToBe error
+		pre         func(t *testing.T, ctrl *gomock.Controller, mfs *mockpartitions.MockFS)
+	}{
+		{
+			name:   "success creates checkpoints directory",
+			cpName: "diag-boot",
+			pre: func(t *testing.T, ctrl *gomock.Controller, mfs *mockpartitions.MockFS) {
+				mfs.EXPECT().Stat(gomock.Eq(checkpointsDirPath)).Times(1).Return(nil, os.ErrNotExist)
+				mfs.EXPECT().Mkdir(gomock.Eq(checkpointsDirPath), gomock.Eq(fs.FileMode(0755))).Times(1).Return(nil)
+				f := mockio.NewMockReadWriteCloser(ctrl)
+				mfs.EXPECT().OpenFile(gomock.Eq(checkpointsDirPath+"/diag-boot"+partitions.TempSuffix), gomock.Eq(os.O_CREATE|os.O_TRUNC|os.O_WRONLY), gomock.Eq(fs.FileMode(0644))).Times(1).Return(f, nil)
+				f.EXPECT().Write(gomock.Eq([]byte("pending"))).Times(1).Return(7, nil)
+				f.EXPECT().Close().Times(1)
+
+				// the temporary file is moved into place and the directory is synced
+				mfs.EXPECT().Rename(gomock.Eq(checkpointsDirPath+"/diag-boot"+partitions.TempSuffix), gomock.Eq(checkpointsDirPath+"/diag-boot")).Times(1).Return(nil)
+				mfs.EXPECT().SyncDir(gomock.Eq(checkpointsDirPath)).Times(1).Return(nil)
+			},
+		},
+		{
+			name:        "invalid name",
+			cpName:      "../version",
+			wantErrToBe: ErrInvalidCheckpointName,
+		},
+		{
+			name:        "stat fails",
+			cpName:      "diag-boot",
+			wantErrToBe: errStat,
+			pre: func(t *testing.T, ctrl *gomock.Controller, mfs *mockpartitions.MockFS) {
+				mfs.EXPECT().Stat(gomock.Eq(checkpointsDirPath)).Times(1).Return(nil, errStat)
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			defer ctrl.Finish()
+			mockfs := mockpartitions.NewMockFS(ctrl)
+			if tt.pre != nil {
+				tt.pre(t, ctrl, mockfs)
+			}
+			err := testCheckpointAPI(mockfs).StoreCheckpoint(tt.cpName, []byte("pending"))
+			if !errors.Is(err, tt.wantErrToBe) {
+				t.Errorf("api.StoreCheckpoint() error = %v, wantErrToBe %v", err, tt.wantErrToBe)
+			}
+		})
+	}
+}
+
+func Test_api_GetCheckpoint(t *testing.T) {
+	tests := []struct {
+		name        string
+		want        []byte
+		wantErrToBe error
+		pre         func(t *testing.T, ctrl *gomock.Controller, mfs *mockpartitions.MockFS)
+	}{
+		{
+			name: "success",
+			want: []byte("pending"),
+			pre: func(t *testing.T, ctrl *gomock.Controller, mfs *mockpartitions.MockFS) {
+				f := mockio.NewMockReadWriteCloser(ctrl)
+				mfs.EXPECT().Open(gomock.Eq(checkpointsDirPath+"/diag-boot")).Times(1).Return(f, nil)
+				f.EXPECT().Read(gomock.Any()).DoAndReturn(func(b []byte) (int, error) {
+					return copy(b, "pending"), io.EOF
+				})
+				f.EXPECT().Close().Times(1)
+			},
+		},
+		{
+			name:        "does not exist",
+			wantErrToBe: ErrNoCheckpoint,
+			pre: func(t *testing.T, ctrl *gomock.Controller, mfs *mockpartitions.MockFS) {
+				mfs.EXPECT().Open(gomock.Eq(checkpointsDirPath+"/diag-boot")).Times(1).Return(nil, os.ErrNotExist)
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			defer ctrl.Finish()
+			mockfs := mockpartitions.NewMockFS(ctrl)
+			if tt.pre != nil {
+				tt.pre(t, ctrl, mockfs)
+			}
+			got, err := testCheckpointAPI(mockfs).GetCheckpoint("diag-boot")
+			if !errors.Is(err, tt.wantErrToBe) {
+				t.Errorf("api.GetCheckpoint() error = %v, wantErrToBe %v", err, tt.wantErrToBe)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("api.GetCheckpoint() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_api_DeleteCheckpoint(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	mockfs := mockpartitions.NewMockFS(ctrl)
+	mockfs.EXPECT().Remove(gomock.Eq(checkpointsDirPath + "/diag-boot")).Times(1).Return(os.ErrNotExist)
+	if err := testCheckpointAPI(mockfs).DeleteCheckpoint("diag-boot"); err != nil {
+		t.Errorf("api.DeleteCheckpoint() error = %v", err)
+	}
+}
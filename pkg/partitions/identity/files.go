@@ -0,0 +1,109 @@
+// Copyright 2023 Hedgehog
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package identity
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"go.githedgehog.com/dasboot/pkg/partitions"
+)
+
+// All file access of the API goes through these functions. On version 2 partitions every file has a checksum file
+// next to it which holds the hex encoded SHA-256 digest of its content. Files and their checksums are written in
+// one atomic batch where the checksums are moved into place last. If a write is interrupted in between, the new
+// checksum is still in its temporary file, and the write is completed when the file is read the next time.
+
+func checksum(data []byte) []byte {
+	sum := sha256.Sum256(data)
+	return []byte(hex.EncodeToString(sum[:]) + "\n")
+}
+
+// readFile reads `name`, and verifies its checksum on version 2 partitions
+func (a *api) readFile(name string) ([]byte, error) {
+	f, err := a.dev.FS.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	b, err := io.ReadAll(f)
+	if err != nil {
+		return nil, err
+	}
+	if a.version >= version2 {
+		if err := a.verifyChecksum(name, b); err != nil {
+			return nil, err
+		}
+	}
+	return b, nil
+}
+
+func (a *api) verifyChecksum(name string, data []byte) error {
+	want := checksum(data)
+	sum, err := readAll(a.dev.FS, name+checksumSuffix)
+	if err == nil && bytes.Equal(sum, want) {
+		return nil
+	}
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	// complete a write which was interrupted after the file was moved into place
+	tmp := name + checksumSuffix + partitions.TempSuffix
+	if sum, err := readAll(a.dev.FS, tmp); err == nil && bytes.Equal(sum, want) {
+		return a.dev.FS.Rename(tmp, name+checksumSuffix)
+	}
+	return fmt.Errorf("%w: '%s'", ErrChecksumMismatch, name)
+}
+
+// writeFiles writes all `files` atomically, together with their checksums on version 2 partitions
+func (a *api) writeFiles(files ...partitions.File) error {
+	if a.version >= version2 {
+		all := make([]partitions.File, 0, 2*len(files))
+		all = append(all, files...)
+		for _, f := range files {
+			all = append(all, partitions.File{Name: f.Name + checksumSuffix, Data: checksum(f.Data)})
+		}
+		files = all
+	}
+	return partitions.WriteFilesAtomic(a.dev.FS, 0644, files...)
+}
+
+// removeFile removes `name` and its checksum. It does not fail if they do not exist.
+func (a *api) removeFile(name string) error {
+	if err := a.dev.FS.Remove(name); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	if a.version >= version2 {
+		if err := a.dev.FS.Remove(name + checksumSuffix); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	return nil
+}
+
+func readAll(fsys partitions.FS, name string) ([]byte, error) {
+	f, err := fsys.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return io.ReadAll(f)
+}
@@ -0,0 +1,66 @@
+// Copyright 2023 Hedgehog
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package identity
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	"go.githedgehog.com/dasboot/pkg/partitions/location"
+)
+
+var ErrNoUnlockKeys = errors.New("identity: no keys to unlock the encrypted partition, the device has neither a TPM nor location information")
+
+// luksKeyLabel is the label for which the TPM and the location information derive the LUKS keys. It must
+// never change, or existing partitions can no longer be unlocked.
+var luksKeyLabel = []byte("hedgehog identity partition luks key v1")
+
+// UnlockKeys returns the keys which unlock an encrypted identity partition, one for every key slot of its LUKS
+// container. If the device has a TPM, the first key is a secret which is derived from the TPM, so it is bound
+// to this device. If there is location information, the next key is derived from it, which keeps the partition
+// accessible if the TPM is being replaced or cleared. The keys are the same on every call for the same device.
+func UnlockKeys(info *location.Info) ([][]byte, error) {
+	var keys [][]byte
+	if tpmHasTPM() {
+		key, err := tpmDeriveSecret(luksKeyLabel)
+		if err != nil {
+			return nil, fmt.Errorf("identity: deriving LUKS key from TPM: %w", err)
+		}
+		keys = append(keys, key)
+	}
+	if key := locationKey(info); key != nil {
+		keys = append(keys, key)
+	}
+	if len(keys) == 0 {
+		return nil, ErrNoUnlockKeys
+	}
+	return keys, nil
+}
+
+// locationKey derives a key from the location information. Only the signed parts are used, as they cannot be
+// changed by anybody who does not have the signing key of the location.
+func locationKey(info *location.Info) []byte {
+	if info == nil || info.UUID == "" || len(info.UUIDSig) == 0 {
+		return nil
+	}
+	h := sha256.New()
+	for _, v := range [][]byte{luksKeyLabel, []byte(info.UUID), info.UUIDSig, []byte(info.Metadata), info.MetadataSig} {
+		h.Write(binary.BigEndian.AppendUint32(nil, uint32(len(v))))
+		h.Write(v)
+	}
+	return h.Sum(nil)
+}
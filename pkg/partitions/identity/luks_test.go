@@ -0,0 +1,123 @@
+// Copyright 2023 Hedgehog
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package identity
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"go.githedgehog.com/dasboot/pkg/partitions/location"
+)
+
+func TestUnlockKeys(t *testing.T) {
+	info := &location.Info{
+		UUID:        "cf2c3c2a-0f4c-4bd4-8b15-6e7c0f8e2b49",
+		UUIDSig:     []byte("uuid signature"),
+		Metadata:    `{"rack":"r1"}`,
+		MetadataSig: []byte("metadata signature"),
+	}
+	tpmSecret := []byte("tpm secret")
+	errTPM := errors.New("tpm failure")
+
+	tests := []struct {
+		name        string
+		hasTPM      bool
+		tpmErr      error
+		info        *location.Info
+		wantKeys    int
+		wantTPMKey  bool
+		wantErrToBe error
+	}{
+		{
+			name:        "neither TPM nor location",
+			wantErrToBe: ErrNoUnlockKeys,
+		},
+		{
+			name:        "unsigned location",
+			info:        &location.Info{UUID: info.UUID},
+			wantErrToBe: ErrNoUnlockKeys,
+		},
+		{
+			name:     "location only",
+			info:     info,
+			wantKeys: 1,
+		},
+		{
+			name:       "TPM only",
+			hasTPM:     true,
+			wantKeys:   1,
+			wantTPMKey: true,
+		},
+		{
+			name:       "TPM and location",
+			hasTPM:     true,
+			info:       info,
+			wantKeys:   2,
+			wantTPMKey: true,
+		},
+		{
+			name:        "TPM fails",
+			hasTPM:      true,
+			tpmErr:      errTPM,
+			info:        info,
+			wantErrToBe: errTPM,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			oldHasTPM, oldDeriveSecret := tpmHasTPM, tpmDeriveSecret
+			defer func() {
+				tpmHasTPM, tpmDeriveSecret = oldHasTPM, oldDeriveSecret
+			}()
+			tpmHasTPM = func() bool { return tt.hasTPM }
+			tpmDeriveSecret = func(label []byte) ([]byte, error) {
+				if !bytes.Equal(label, luksKeyLabel) {
+					t.Errorf("tpm.DeriveSecret() label = %q, want %q", label, luksKeyLabel)
+				}
+				return tpmSecret, tt.tpmErr
+			}
+
+			keys, err := UnlockKeys(tt.info)
+			if !errors.Is(err, tt.wantErrToBe) {
+				t.Fatalf("UnlockKeys() error = %v, wantErrToBe %v", err, tt.wantErrToBe)
+			}
+			if len(keys) != tt.wantKeys {
+				t.Fatalf("UnlockKeys() returned %d keys, want %d", len(keys), tt.wantKeys)
+			}
+			if tt.wantTPMKey && !bytes.Equal(keys[0], tpmSecret) {
+				t.Errorf("UnlockKeys() first key = %x, want the TPM secret", keys[0])
+			}
+			if tt.info != nil && tt.wantKeys > 0 {
+				again, err := UnlockKeys(tt.info)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !bytes.Equal(keys[len(keys)-1], again[len(again)-1]) {
+					t.Errorf("UnlockKeys() location key is not deterministic")
+				}
+				other := *tt.info
+				other.UUIDSig = []byte("other signature")
+				otherKeys, err := UnlockKeys(&other)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if bytes.Equal(keys[len(keys)-1], otherKeys[len(otherKeys)-1]) {
+					t.Errorf("UnlockKeys() location key does not depend on the signature")
+				}
+			}
+		})
+	}
+}
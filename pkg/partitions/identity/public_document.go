@@ -0,0 +1,250 @@
+// Copyright 2023 Hedgehog
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package identity
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// PublicDocumentVersion is the current version of the format of the public identity document
+const PublicDocumentVersion = 1
+
+var (
+	ErrInvalidPublicDocument     = errors.New("identity: invalid public identity document")
+	ErrPublicDocumentNotSigned   = errors.New("identity: public identity document not signed")
+	ErrPublicDocumentSignature   = errors.New("identity: public identity document signature verification failed")
+	ErrPublicDocumentMismatch    = errors.New("identity: public identity document does not match")
+	ErrUnsupportedDocumentSigner = errors.New("identity: unsupported key type for signing the public identity document")
+)
+
+// PublicDocument describes the identity of a device without any secrets. It is signed with the client key of the
+// device, so that the control plane and auditors can verify it offline against the CA which issued the client
+// certificate.
+type PublicDocument struct {
+	// Version is the version of the document format
+	Version int `json:"version"`
+
+	// DeviceID is the device ID, which is also the common name of the client certificate
+	DeviceID string `json:"device_id"`
+
+	// PublicKey is the DER encoded PKIX public key of the client key
+	PublicKey []byte `json:"public_key"`
+
+	// CertChain holds the DER encoded certificate chain starting with the client certificate
+	CertChain [][]byte `json:"cert_chain"`
+
+	// LocationUUID is the UUID of the location of the device if it is known
+	LocationUUID string `json:"location_uuid,omitempty"`
+
+	// Created is the time when the document was created
+	Created time.Time `json:"created"`
+
+	// Signature is the signature over the SHA256 digest of the JSON encoding of the document without the signature
+	Signature []byte `json:"signature,omitempty"`
+}
+
+// NewPublicDocument builds an unsigned public identity document for the DER encoded certificate `chain`, which
+// must start with the client certificate. The device ID is taken from the common name of the client certificate.
+func NewPublicDocument(chain [][]byte, locationUUID string) (*PublicDocument, error) {
+	if len(chain) == 0 {
+		return nil, fmt.Errorf("%w: empty certificate chain", ErrInvalidPublicDocument)
+	}
+	cert, err := x509.ParseCertificate(chain[0])
+	if err != nil {
+		return nil, fmt.Errorf("%w: client certificate: %w", ErrInvalidPublicDocument, err)
+	}
+	if cert.Subject.CommonName == "" {
+		return nil, ErrNoDevID
+	}
+	pub, err := x509.MarshalPKIXPublicKey(cert.PublicKey)
+	if err != nil {
+		return nil, fmt.Errorf("%w: public key: %w", ErrInvalidPublicDocument, err)
+	}
+	certChain := make([][]byte, 0, len(chain))
+	for _, der := range chain {
+		certChain = append(certChain, bytes.Clone(der))
+	}
+	return &PublicDocument{
+		Version:      PublicDocumentVersion,
+		DeviceID:     cert.Subject.CommonName,
+		PublicKey:    pub,
+		CertChain:    certChain,
+		LocationUUID: locationUUID,
+		Created:      time.Now().UTC(),
+	}, nil
+}
+
+// PublicDocument implements IdentityPartition
+func (a *api) PublicDocument() (*PublicDocument, error) {
+	kp, err := a.LoadX509KeyPair()
+	if err != nil {
+		return nil, fmt.Errorf("identity: loading client key pair: %w", err)
+	}
+	signer, ok := kp.PrivateKey.(crypto.Signer)
+	if !ok {
+		return nil, ErrUnsupportedDocumentSigner
+	}
+
+	// the location is optional, as a device might not know it yet
+	var locationUUID string
+	if info, err := a.GetLocation(); err == nil {
+		locationUUID = info.UUID
+	}
+
+	doc, err := NewPublicDocument(kp.Certificate, locationUUID)
+	if err != nil {
+		return nil, err
+	}
+	if id := devidID(); id != "" && id != doc.DeviceID {
+		return nil, fmt.Errorf("%w: device ID '%s' of this device does not match client certificate for '%s'", ErrInvalidPublicDocument, id, doc.DeviceID)
+	}
+	if err := doc.Sign(signer); err != nil {
+		return nil, err
+	}
+	return doc, nil
+}
+
+// signingDigest returns the SHA256 digest of the JSON encoding of the document without its signature
+func (d *PublicDocument) signingDigest() ([]byte, error) {
+	unsigned := *d
+	unsigned.Signature = nil
+	b, err := json.Marshal(&unsigned)
+	if err != nil {
+		return nil, err
+	}
+	digest := sha256.Sum256(b)
+	return digest[:], nil
+}
+
+// Sign signs the document with `signer` which must be the client key
+func (d *PublicDocument) Sign(signer crypto.Signer) error {
+	digest, err := d.signingDigest()
+	if err != nil {
+		return err
+	}
+	sig, err := signDigest(signer, digest)
+	if err != nil {
+		return fmt.Errorf("identity: signing public identity document: %w", err)
+	}
+	d.Signature = sig
+	return nil
+}
+
+// signDigest signs the SHA256 `digest` with `signer`, which can be any of the key types of client keys
+func signDigest(signer crypto.Signer, digest []byte) ([]byte, error) {
+	switch signer.Public().(type) {
+	case *ecdsa.PublicKey, *rsa.PublicKey:
+		return signer.Sign(rand.Reader, digest, crypto.SHA256)
+	case ed25519.PublicKey:
+		return signer.Sign(rand.Reader, digest, crypto.Hash(0))
+	default:
+		return nil, ErrUnsupportedDocumentSigner
+	}
+}
+
+// verifyDigest verifies the signature `sig` of the SHA256 `digest` which was made by `signDigest`
+func verifyDigest(pub crypto.PublicKey, digest []byte, sig []byte) (bool, error) {
+	switch key := pub.(type) {
+	case *ecdsa.PublicKey:
+		return ecdsa.VerifyASN1(key, digest, sig), nil
+	case *rsa.PublicKey:
+		return rsa.VerifyPKCS1v15(key, crypto.SHA256, digest, sig) == nil, nil
+	case ed25519.PublicKey:
+		return ed25519.Verify(key, digest, sig), nil
+	default:
+		return false, ErrUnsupportedDocumentSigner
+	}
+}
+
+// Verify verifies the document: the certificate chain must verify against `roots`, the public key and device ID
+// must match the client certificate, and the signature must have been made with the client key.
+func (d *PublicDocument) Verify(roots *x509.CertPool) error {
+	if d.Version != PublicDocumentVersion {
+		return fmt.Errorf("%w: unsupported version %d", ErrInvalidPublicDocument, d.Version)
+	}
+	if len(d.Signature) == 0 {
+		return ErrPublicDocumentNotSigned
+	}
+	if len(d.CertChain) == 0 {
+		return fmt.Errorf("%w: empty certificate chain", ErrInvalidPublicDocument)
+	}
+	cert, err := x509.ParseCertificate(d.CertChain[0])
+	if err != nil {
+		return fmt.Errorf("%w: client certificate: %w", ErrInvalidPublicDocument, err)
+	}
+	intermediates := x509.NewCertPool()
+	for _, der := range d.CertChain[1:] {
+		c, err := x509.ParseCertificate(der)
+		if err != nil {
+			return fmt.Errorf("%w: certificate chain: %w", ErrInvalidPublicDocument, err)
+		}
+		intermediates.AddCert(c)
+	}
+	if _, err := cert.Verify(x509.VerifyOptions{
+		Roots:         roots,
+		Intermediates: intermediates,
+		CurrentTime:   d.Created,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}); err != nil {
+		return fmt.Errorf("%w: client certificate: %w", ErrPublicDocumentSignature, err)
+	}
+	if cert.Subject.CommonName != d.DeviceID {
+		return fmt.Errorf("%w: device ID '%s' does not match client certificate for '%s'", ErrInvalidPublicDocument, d.DeviceID, cert.Subject.CommonName)
+	}
+	pub, err := x509.MarshalPKIXPublicKey(cert.PublicKey)
+	if err != nil || !bytes.Equal(pub, d.PublicKey) {
+		return fmt.Errorf("%w: public key does not match client certificate", ErrInvalidPublicDocument)
+	}
+
+	digest, err := d.signingDigest()
+	if err != nil {
+		return err
+	}
+	ok, err := verifyDigest(cert.PublicKey, digest, d.Signature)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return ErrPublicDocumentSignature
+	}
+	return nil
+}
+
+// Matches compares the document with the `expected` document of the seeder. The device ID, public key, client
+// certificate and location must be the same. Creation time, the rest of the chain and signatures are ignored.
+func (d *PublicDocument) Matches(expected *PublicDocument) error {
+	switch {
+	case d.DeviceID != expected.DeviceID:
+		return fmt.Errorf("%w: device ID '%s', expected '%s'", ErrPublicDocumentMismatch, d.DeviceID, expected.DeviceID)
+	case !bytes.Equal(d.PublicKey, expected.PublicKey):
+		return fmt.Errorf("%w: public key", ErrPublicDocumentMismatch)
+	case len(d.CertChain) == 0 || len(expected.CertChain) == 0 || !bytes.Equal(d.CertChain[0], expected.CertChain[0]):
+		return fmt.Errorf("%w: client certificate", ErrPublicDocumentMismatch)
+	case d.LocationUUID != expected.LocationUUID:
+		return fmt.Errorf("%w: location UUID '%s', expected '%s'", ErrPublicDocumentMismatch, d.LocationUUID, expected.LocationUUID)
+	}
+	return nil
+}
@@ -0,0 +1,191 @@
+// Copyright 2023 Hedgehog
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package identity
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"math/big"
+	"testing"
+	"time"
+)
+
+const testDocDevID = "8a1c3a3e-8c4a-4c1e-9b43-52d8a0b0f6a1"
+
+func testDocCerts(t *testing.T) (*x509.CertPool, []byte, *ecdsa.PrivateKey) {
+	t.Helper()
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca, err := x509.ParseCertificate(caDER)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: testDocDevID},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}, ca, &key.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(ca)
+	return roots, der, key
+}
+
+func TestPublicDocument_Verify(t *testing.T) {
+	roots, der, key := testDocCerts(t)
+	otherRoots, _, otherKey := testDocCerts(t)
+	tests := []struct {
+		name    string
+		signer  *ecdsa.PrivateKey
+		roots   *x509.CertPool
+		modify  func(d *PublicDocument)
+		wantErr error
+	}{
+		{
+			name:   "valid",
+			signer: key,
+			roots:  roots,
+		},
+		{
+			name:    "not signed",
+			roots:   roots,
+			wantErr: ErrPublicDocumentNotSigned,
+		},
+		{
+			name:    "signed with another key",
+			signer:  otherKey,
+			roots:   roots,
+			wantErr: ErrPublicDocumentSignature,
+		},
+		{
+			name:    "issued by another CA",
+			signer:  key,
+			roots:   otherRoots,
+			wantErr: ErrPublicDocumentSignature,
+		},
+		{
+			name:    "tampered location",
+			signer:  key,
+			roots:   roots,
+			modify:  func(d *PublicDocument) { d.LocationUUID = "tampered" },
+			wantErr: ErrPublicDocumentSignature,
+		},
+		{
+			name:    "device ID does not match certificate",
+			signer:  key,
+			roots:   roots,
+			modify:  func(d *PublicDocument) { d.DeviceID = "other" },
+			wantErr: ErrInvalidPublicDocument,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			doc, err := NewPublicDocument([][]byte{der}, "location")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.signer != nil {
+				if err := doc.Sign(tt.signer); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if tt.modify != nil {
+				tt.modify(doc)
+			}
+			err = doc.Verify(tt.roots)
+			if tt.wantErr == nil && err != nil {
+				t.Errorf("Verify() error = %v", err)
+			}
+			if tt.wantErr != nil && !errors.Is(err, tt.wantErr) {
+				t.Errorf("Verify() error = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestPublicDocument_Matches(t *testing.T) {
+	_, der, key := testDocCerts(t)
+	_, otherDER, _ := testDocCerts(t)
+	doc, err := NewPublicDocument([][]byte{der}, "location")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := doc.Sign(key); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name     string
+		chain    [][]byte
+		location string
+		wantErr  bool
+	}{
+		{
+			name:     "matches",
+			chain:    [][]byte{der},
+			location: "location",
+		},
+		{
+			name:     "other location",
+			chain:    [][]byte{der},
+			location: "other",
+			wantErr:  true,
+		},
+		{
+			name:     "other certificate",
+			chain:    [][]byte{otherDER},
+			location: "location",
+			wantErr:  true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			expected, err := NewPublicDocument(tt.chain, tt.location)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := doc.Matches(expected); (err != nil) != tt.wantErr {
+				t.Errorf("Matches() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,79 @@
+// Copyright 2023 Hedgehog
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package identity
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+
+	"go.githedgehog.com/dasboot/pkg/partitions"
+)
+
+var (
+	ErrNoClientCert        = errors.New("identity: no client certificate")
+	ErrRenewedCertMismatch = errors.New("identity: renewed certificate does not match the client key")
+)
+
+// RenewClientCert implements IdentityPartition
+func (a *api) RenewClientCert(issue func(csr []byte) ([]byte, error)) error {
+	kp, err := a.LoadX509KeyPair()
+	if err != nil {
+		return fmt.Errorf("identity: loading client key pair: %w", err)
+	}
+	if len(kp.Certificate) == 0 {
+		return ErrNoClientCert
+	}
+	current, err := x509.ParseCertificate(kp.Certificate[0])
+	if err != nil {
+		return fmt.Errorf("identity: parsing client certificate: %w", err)
+	}
+	signer, ok := kp.PrivateKey.(crypto.Signer)
+	if !ok {
+		return fmt.Errorf("identity: client key cannot sign a CSR")
+	}
+
+	// the CSR on disk stays as it is, as it holds the same key
+	csr, err := x509CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject: pkix.Name{
+			CommonName: current.Subject.CommonName,
+		},
+	}, signer)
+	if err != nil {
+		return fmt.Errorf("identity: failed to create renewal CSR: %w", err)
+	}
+
+	certBytes, err := issue(csr)
+	if err != nil {
+		return fmt.Errorf("identity: renewing client certificate: %w", err)
+	}
+	renewed, err := x509.ParseCertificate(certBytes)
+	if err != nil {
+		return fmt.Errorf("identity: not a valid certificate: %w", err)
+	}
+	pub, ok := signer.Public().(interface{ Equal(crypto.PublicKey) bool })
+	if !ok || !pub.Equal(renewed.PublicKey) {
+		return ErrRenewedCertMismatch
+	}
+
+	return a.writeFiles(partitions.File{Name: clientCertPath, Data: pem.EncodeToMemory(&pem.Block{
+		Type:  "CERTIFICATE",
+		Bytes: certBytes,
+	})})
+}
@@ -0,0 +1,120 @@
+// Copyright 2023 Hedgehog
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package identity
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"go.githedgehog.com/dasboot/pkg/partitions"
+)
+
+func Test_api_RenewClientCert(t *testing.T) {
+	_, der, key := testDocCerts(t)
+	_, _, otherKey := testDocCerts(t)
+	errIssue := errors.New("seeder unreachable")
+
+	// renewed issues a certificate which outlives the current one for the key of the CSR,
+	// or for `forKey` if it is set
+	renewed := func(forKey *ecdsa.PrivateKey) func(csrBytes []byte) ([]byte, error) {
+		return func(csrBytes []byte) ([]byte, error) {
+			csr, err := x509.ParseCertificateRequest(csrBytes)
+			if err != nil {
+				return nil, err
+			}
+			if err := csr.CheckSignature(); err != nil {
+				return nil, err
+			}
+			pub := csr.PublicKey
+			if forKey != nil {
+				pub = &forKey.PublicKey
+			}
+			caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+			if err != nil {
+				return nil, err
+			}
+			tmpl := &x509.Certificate{
+				SerialNumber: big.NewInt(3),
+				Subject:      csr.Subject,
+				NotBefore:    time.Now().Add(-time.Hour),
+				NotAfter:     time.Now().Add(48 * time.Hour),
+			}
+			return x509.CreateCertificate(rand.Reader, tmpl, tmpl, pub, caKey)
+		}
+	}
+
+	tests := []struct {
+		name        string
+		issue       func([]byte) ([]byte, error)
+		wantErrToBe error
+		wantRenewed bool
+	}{
+		{
+			name:        "renewed",
+			issue:       renewed(nil),
+			wantRenewed: true,
+		},
+		{
+			name:        "issuing fails",
+			issue:       func([]byte) ([]byte, error) { return nil, errIssue },
+			wantErrToBe: errIssue,
+		},
+		{
+			name:        "certificate for another key",
+			issue:       renewed(otherKey),
+			wantErrToBe: ErrRenewedCertMismatch,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			if err := os.Mkdir(filepath.Join(dir, identityDirPath), 0755); err != nil {
+				t.Fatal(err)
+			}
+			keyBytes, err := x509.MarshalECPrivateKey(key)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(filepath.Join(dir, clientKeyPath), pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyBytes}), 0600); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(filepath.Join(dir, clientCertPath), pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644); err != nil {
+				t.Fatal(err)
+			}
+			a := &api{dev: &partitions.Device{FS: partitions.NewFS(dir)}}
+
+			err = a.RenewClientCert(tt.issue)
+			if !errors.Is(err, tt.wantErrToBe) {
+				t.Fatalf("api.RenewClientCert() error = %v, wantErrToBe %v", err, tt.wantErrToBe)
+			}
+			kp, err := a.LoadX509KeyPair()
+			if err != nil {
+				t.Fatalf("api.LoadX509KeyPair() after renewal error = %v", err)
+			}
+			if got := string(kp.Certificate[0]) != string(der); got != tt.wantRenewed {
+				t.Errorf("certificate renewed = %v, want %v", got, tt.wantRenewed)
+			}
+		})
+	}
+}
@@ -0,0 +1,234 @@
+// Copyright 2023 Hedgehog
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package identity
+
+import (
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"go.githedgehog.com/dasboot/pkg/partitions"
+)
+
+var (
+	ErrNoValidPartition = errors.New("identity: no valid identity partition")
+	ErrSamePartition    = errors.New("identity: source and destination partition are the same")
+)
+
+// Candidate describes an identity partition which is a candidate for being selected
+// when there is more than one identity partition on the system.
+type Candidate struct {
+	// Device is the identity partition
+	Device *partitions.Device
+
+	// Version is the version of the partition format as read from the version file
+	Version int
+
+	// ModTime is the modification time of the version file
+	ModTime time.Time
+
+	// DeviceID is the device ID from the client certificate on the partition if there is one
+	DeviceID string
+
+	// Err is set if the partition is not a valid identity partition
+	Err error
+}
+
+// Valid returns true if the candidate is a valid identity partition which can be used
+func (c *Candidate) Valid() bool {
+	return c.Err == nil
+}
+
+// Inspect reads the version file and the client certificate of the identity partition `d` which must be mounted.
+// Any failure is recorded in the `Err` field of the returned candidate.
+func Inspect(d *partitions.Device) *Candidate {
+	ret := &Candidate{Device: d}
+	if !d.IsHedgehogIdentityPartition() {
+		ret.Err = ErrWrongDevice
+		return ret
+	}
+
+	st, err := d.FS.Stat(versionFilePath)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			err = ErrUninitializedPartition
+		}
+		ret.Err = err
+		return ret
+	}
+	ret.ModTime = st.ModTime()
+
+	f, err := d.FS.Open(versionFilePath)
+	if err != nil {
+		ret.Err = err
+		return ret
+	}
+	defer f.Close()
+	var version Version
+	if err := json.NewDecoder(f).Decode(&version); err != nil {
+		ret.Err = fmt.Errorf("identity: decoding version file: %w", err)
+		return ret
+	}
+	ret.Version = version.Version
+	if version.Version != version1 && version.Version != version2 {
+		ret.Err = ErrUnsupportedVersion
+		return ret
+	}
+
+	// the device ID is optional: partitions of devices which did not register yet do not have a certificate
+	ret.DeviceID = readCertDeviceID(d)
+	return ret
+}
+
+func readCertDeviceID(d *partitions.Device) string {
+	f, err := d.FS.Open(clientCertPath)
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+	b, err := io.ReadAll(f)
+	if err != nil {
+		return ""
+	}
+	p, _ := pem.Decode(b)
+	if p == nil || p.Type != "CERTIFICATE" {
+		return ""
+	}
+	cert, err := x509.ParseCertificate(p.Bytes)
+	if err != nil {
+		return ""
+	}
+	return cert.Subject.CommonName
+}
+
+// Select deterministically selects the identity partition to use from `candidates`. Only valid candidates are
+// considered. If `devID` is set, candidates with a client certificate for that device ID are preferred. Out of
+// the remaining candidates the one with the most recent version file wins. Ties are broken by the order
+// of `candidates`, which should be sorted by device path.
+func Select(candidates []*Candidate, devID string) (*Candidate, error) {
+	var valid []*Candidate
+	for _, c := range candidates {
+		if c.Valid() {
+			valid = append(valid, c)
+		}
+	}
+	if len(valid) == 0 {
+		return nil, ErrNoValidPartition
+	}
+
+	if devID != "" {
+		var matching []*Candidate
+		for _, c := range valid {
+			if c.DeviceID == devID {
+				matching = append(matching, c)
+			}
+		}
+		if len(matching) > 0 {
+			valid = matching
+		}
+	}
+
+	ret := valid[0]
+	for _, c := range valid[1:] {
+		if c.ModTime.After(ret.ModTime) {
+			ret = c
+		}
+	}
+	return ret, nil
+}
+
+// migrateDirs are the directories which are being migrated by `Migrate`
+var migrateDirs = []string{identityDirPath, locationDirPath, checkpointsDirPath}
+
+// Migrate consolidates the identity data from the identity partition `src` onto the identity partition `dst`.
+// Both partitions must be mounted. `dst` gets initialized if it was not initialized before. Existing identity,
+// location and checkpoint data on `dst` is replaced by the data from `src`.
+func Migrate(src, dst *partitions.Device) error {
+	if src == dst || (src.Path != "" && src.Path == dst.Path) {
+		return ErrSamePartition
+	}
+	srcAPI, err := Open(src)
+	if err != nil {
+		return fmt.Errorf("identity: opening source partition: %w", err)
+	}
+	dstAPI, err := Open(dst)
+	if err != nil {
+		if !errors.Is(err, ErrUninitializedPartition) {
+			return fmt.Errorf("identity: opening destination partition: %w", err)
+		}
+		dstAPI, err = Init(dst)
+		if err != nil {
+			return fmt.Errorf("identity: initializing destination partition: %w", err)
+		}
+	}
+
+	for _, dir := range migrateDirs {
+		if err := dst.FS.RemoveAll(dir); err != nil {
+			return fmt.Errorf("identity: removing '%s' on destination partition: %w", dir, err)
+		}
+		if err := copyDir(srcAPI.(*api), dstAPI.(*api), dir); err != nil {
+			return fmt.Errorf("identity: copying '%s': %w", dir, err)
+		}
+	}
+	return nil
+}
+
+// copyDir copies `dir` with the checksums of the destination partition, so that it does not matter if the
+// source partition is still a read-only version 1 partition
+func copyDir(src, dst *api, dir string) error {
+	entries, err := src.dev.FS.ReadDir(dir)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+	if err := dst.dev.FS.Mkdir(dir, 0755); err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		p := path.Join(dir, entry.Name())
+		if partitions.IsTempFile(entry.Name()) || strings.HasSuffix(entry.Name(), checksumSuffix) {
+			// leftovers of interrupted writes where the file they were meant for is intact, and checksums
+			// which the destination writes itself
+			continue
+		}
+		if entry.IsDir() {
+			if err := copyDir(src, dst, p); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := copyFile(src, dst, p); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func copyFile(src, dst *api, name string) error {
+	b, err := src.readFile(name)
+	if err != nil {
+		return err
+	}
+	return dst.writeFiles(partitions.File{Name: name, Data: b})
+}
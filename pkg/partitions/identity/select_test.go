@@ -0,0 +1,284 @@
+// Copyright 2023 Hedgehog
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package identity
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"go.githedgehog.com/dasboot/pkg/partitions"
+)
+
+func testIdentityDevice(t *testing.T, devPath string) *partitions.Device {
+	t.Helper()
+	return &partitions.Device{
+		Path: devPath,
+		Uevent: partitions.Uevent{
+			partitions.UeventDevtype: partitions.UeventDevtypePartition,
+		},
+		GPTPartType: partitions.GPTPartTypeHedgehogIdentity,
+		FS:          partitions.NewFS(t.TempDir()),
+	}
+}
+
+func writeTestFile(t *testing.T, d *partitions.Device, name string, data []byte, modTime time.Time) {
+	t.Helper()
+	p := d.FS.Path(name)
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(p, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if !modTime.IsZero() {
+		if err := os.Chtimes(p, modTime, modTime); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func testClientCertPEM(t *testing.T, devID string) []byte {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: devID},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+}
+
+func TestInspect(t *testing.T) {
+	modTime := time.Date(2023, 5, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name         string
+		pre          func(t *testing.T, d *partitions.Device)
+		wrongDevice  bool
+		wantErrToBe  error
+		wantVersion  int
+		wantDeviceID string
+	}{
+		{
+			name: "valid with certificate",
+			pre: func(t *testing.T, d *partitions.Device) {
+				writeTestFile(t, d, versionFilePath, []byte(`{"version":1}`), modTime)
+				writeTestFile(t, d, clientCertPath, testClientCertPEM(t, "7a0a1e7e-2c3c-4b2a-9f0e-2f2b8c0d6a11"), time.Time{})
+			},
+			wantVersion:  1,
+			wantDeviceID: "7a0a1e7e-2c3c-4b2a-9f0e-2f2b8c0d6a11",
+		},
+		{
+			name: "valid without certificate",
+			pre: func(t *testing.T, d *partitions.Device) {
+				writeTestFile(t, d, versionFilePath, []byte(`{"version":1}`), modTime)
+			},
+			wantVersion: 1,
+		},
+		{
+			name:        "uninitialized",
+			wantErrToBe: ErrUninitializedPartition,
+		},
+		{
+			name: "unsupported version",
+			pre: func(t *testing.T, d *partitions.Device) {
+				writeTestFile(t, d, versionFilePath, []byte(`{"version":42}`), modTime)
+			},
+			wantErrToBe: ErrUnsupportedVersion,
+			wantVersion: 42,
+		},
+		{
+			name:        "wrong device",
+			wrongDevice: true,
+			wantErrToBe: ErrWrongDevice,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := testIdentityDevice(t, "/dev/sda5")
+			if tt.wrongDevice {
+				d.GPTPartType = ""
+			}
+			if tt.pre != nil {
+				tt.pre(t, d)
+			}
+			c := Inspect(d)
+			if !errors.Is(c.Err, tt.wantErrToBe) {
+				t.Fatalf("Inspect() error = %v, wantErrToBe %v", c.Err, tt.wantErrToBe)
+			}
+			if c.Version != tt.wantVersion {
+				t.Errorf("Inspect() version = %d, want %d", c.Version, tt.wantVersion)
+			}
+			if c.DeviceID != tt.wantDeviceID {
+				t.Errorf("Inspect() device ID = %s, want %s", c.DeviceID, tt.wantDeviceID)
+			}
+			if tt.wantErrToBe == nil && !c.ModTime.Equal(modTime) {
+				t.Errorf("Inspect() mod time = %s, want %s", c.ModTime, modTime)
+			}
+		})
+	}
+}
+
+func TestSelect(t *testing.T) {
+	older := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	newer := time.Date(2023, 6, 1, 0, 0, 0, 0, time.UTC)
+	sda := &partitions.Device{Path: "/dev/sda5"}
+	sdb := &partitions.Device{Path: "/dev/sdb1"}
+	tests := []struct {
+		name        string
+		candidates  []*Candidate
+		devID       string
+		want        *partitions.Device
+		wantErrToBe error
+	}{
+		{
+			name: "most recent wins",
+			candidates: []*Candidate{
+				{Device: sda, ModTime: older},
+				{Device: sdb, ModTime: newer},
+			},
+			want: sdb,
+		},
+		{
+			name: "matching device ID wins over more recent",
+			candidates: []*Candidate{
+				{Device: sda, ModTime: older, DeviceID: "dev1"},
+				{Device: sdb, ModTime: newer, DeviceID: "dev2"},
+			},
+			devID: "dev1",
+			want:  sda,
+		},
+		{
+			name: "no matching device ID falls back to most recent",
+			candidates: []*Candidate{
+				{Device: sda, ModTime: newer, DeviceID: "dev1"},
+				{Device: sdb, ModTime: older, DeviceID: "dev2"},
+			},
+			devID: "dev3",
+			want:  sda,
+		},
+		{
+			name: "invalid candidates are skipped",
+			candidates: []*Candidate{
+				{Device: sda, ModTime: newer, Err: ErrUnsupportedVersion},
+				{Device: sdb, ModTime: older},
+			},
+			want: sdb,
+		},
+		{
+			name: "ties are broken by order",
+			candidates: []*Candidate{
+				{Device: sda, ModTime: newer},
+				{Device: sdb, ModTime: newer},
+			},
+			want: sda,
+		},
+		{
+			name: "no valid candidates",
+			candidates: []*Candidate{
+				{Device: sda, Err: ErrUninitializedPartition},
+			},
+			wantErrToBe: ErrNoValidPartition,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Select(tt.candidates, tt.devID)
+			if !errors.Is(err, tt.wantErrToBe) {
+				t.Fatalf("Select() error = %v, wantErrToBe %v", err, tt.wantErrToBe)
+			}
+			if err != nil {
+				return
+			}
+			if got.Device != tt.want {
+				t.Errorf("Select() = %s, want %s", got.Device.Path, tt.want.Path)
+			}
+		})
+	}
+}
+
+func TestMigrate(t *testing.T) {
+	src := testIdentityDevice(t, "/dev/sda5")
+	writeTestFile(t, src, versionFilePath, []byte(`{"version":1}`+"\n"), time.Time{})
+	writeTestFile(t, src, clientKeyPath, []byte("key"), time.Time{})
+	writeTestFile(t, src, clientCertPath, []byte("cert"), time.Time{})
+	writeTestFile(t, src, locationUUIDPath, []byte("uuid"), time.Time{})
+	writeTestFile(t, src, checkpointsDirPath+"/diag-boot", []byte("pending"), time.Time{})
+
+	t.Run("uninitialized destination", func(t *testing.T) {
+		dst := testIdentityDevice(t, "/dev/sdb1")
+		if err := Migrate(src, dst); err != nil {
+			t.Fatalf("Migrate() error = %v", err)
+		}
+		for name, want := range map[string]string{
+			clientKeyPath:                     "key",
+			clientCertPath:                    "cert",
+			locationUUIDPath:                  "uuid",
+			checkpointsDirPath + "/diag-boot": "pending",
+		} {
+			b, err := os.ReadFile(dst.FS.Path(name))
+			if err != nil {
+				t.Fatalf("reading %s: %v", name, err)
+			}
+			if string(b) != want {
+				t.Errorf("%s = %q, want %q", name, string(b), want)
+			}
+		}
+		if _, err := Open(dst); err != nil {
+			t.Errorf("Open() on destination failed: %v", err)
+		}
+	})
+
+	t.Run("stale data on destination is replaced", func(t *testing.T) {
+		dst := testIdentityDevice(t, "/dev/sdb1")
+		writeTestFile(t, dst, versionFilePath, []byte(`{"version":1}`+"\n"), time.Time{})
+		writeTestFile(t, dst, clientCSRPath, []byte("stale csr"), time.Time{})
+		if err := Migrate(src, dst); err != nil {
+			t.Fatalf("Migrate() error = %v", err)
+		}
+		if _, err := os.Stat(dst.FS.Path(clientCSRPath)); !errors.Is(err, os.ErrNotExist) {
+			t.Errorf("expected stale CSR to be removed, got %v", err)
+		}
+	})
+
+	t.Run("same partition", func(t *testing.T) {
+		if err := Migrate(src, src); !errors.Is(err, ErrSamePartition) {
+			t.Errorf("Migrate() error = %v, wantErrToBe %v", err, ErrSamePartition)
+		}
+	})
+
+	t.Run("uninitialized source", func(t *testing.T) {
+		if err := Migrate(testIdentityDevice(t, "/dev/sdc1"), testIdentityDevice(t, "/dev/sdb1")); !errors.Is(err, ErrUninitializedPartition) {
+			t.Errorf("Migrate() error = %v, wantErrToBe %v", err, ErrUninitializedPartition)
+		}
+	})
+}
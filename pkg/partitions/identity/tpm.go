@@ -0,0 +1,77 @@
+// Copyright 2023 Hedgehog
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package identity
+
+import (
+	"crypto"
+	"errors"
+
+	"go.githedgehog.com/dasboot/pkg/tpm"
+)
+
+var (
+	ErrTPMKeyMismatch = errors.New("identity: client certificate does not match the TPM key")
+	ErrNoTPMKey       = errors.New("identity: client key is not held by a TPM")
+)
+
+type quoter interface {
+	Quote(qualifyingData []byte, pcrs []int) (*tpm.Quote, error)
+}
+
+// usesTPM answers if the client key is held by the TPM. Devices with a TPM keep using a key file from before they
+// had TPM support until a new key pair is being generated, so that their registration stays valid.
+func (a *api) usesTPM() bool {
+	if !tpmHasTPM() {
+		return false
+	}
+	_, err := a.dev.FS.Stat(tpmClientPubPath)
+	return err == nil
+}
+
+// loadClientKeyFromTPM loads the wrapped client key from the partition into the TPM
+func (a *api) loadClientKeyFromTPM() (crypto.Signer, error) {
+	pub, err := a.readFile(tpmClientPubPath)
+	if err != nil {
+		return nil, err
+	}
+	priv, err := a.readFile(tpmClientPrivPath)
+	if err != nil {
+		return nil, err
+	}
+	return tpmLoadKey(&tpm.KeyBlob{
+		Public:  pub,
+		Private: priv,
+	})
+}
+
+// Quote implements IdentityPartition
+func (a *api) Quote(qualifyingData []byte) (*tpm.Quote, error) {
+	if !a.usesTPM() {
+		return nil, ErrNoTPMKey
+	}
+	key, err := a.loadClientKeyFromTPM()
+	if err != nil {
+		return nil, err
+	}
+	q, ok := key.(quoter)
+	if !ok {
+		return nil, ErrNoTPMKey
+	}
+	return q.Quote(qualifyingData, tpm.DefaultPCRs)
+}
+
+func loadTPMKey(blob *tpm.KeyBlob) (crypto.Signer, error) {
+	return tpm.LoadKey(blob)
+}
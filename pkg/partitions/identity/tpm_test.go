@@ -0,0 +1,168 @@
+// Copyright 2023 Hedgehog
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package identity
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"go.githedgehog.com/dasboot/pkg/partitions"
+	"go.githedgehog.com/dasboot/pkg/tpm"
+)
+
+func TestMain(m *testing.M) {
+	// the tests must not depend on the TPM of the machine which runs them
+	tpmHasTPM = func() bool { return false }
+	os.Exit(m.Run())
+}
+
+// fakeTPMKeys replaces the TPM with software keys which are being looked up by their public blob
+func fakeTPMKeys(t *testing.T) {
+	keys := map[string]*ecdsa.PrivateKey{}
+	oldHasTPM, oldCreateKey, oldLoadKey := tpmHasTPM, tpmCreateKey, tpmLoadKey
+	t.Cleanup(func() {
+		tpmHasTPM, tpmCreateKey, tpmLoadKey = oldHasTPM, oldCreateKey, oldLoadKey
+	})
+	tpmHasTPM = func() bool { return true }
+	tpmCreateKey = func() (*tpm.KeyBlob, error) {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		pub := key.X.Text(16)
+		keys[pub] = key
+		return &tpm.KeyBlob{Public: []byte(pub), Private: []byte("wrapped")}, nil
+	}
+	tpmLoadKey = func(blob *tpm.KeyBlob) (crypto.Signer, error) {
+		key, ok := keys[string(blob.Public)]
+		if !ok || string(blob.Private) != "wrapped" {
+			return nil, errors.New("tpm: load: key does not belong to this TPM")
+		}
+		return key, nil
+	}
+}
+
+func selfSignedCert(t *testing.T, csrBytes []byte) []byte {
+	t.Helper()
+	csr, err := x509.ParseCertificateRequest(csrBytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := csr.CheckSignature(); err != nil {
+		t.Fatal(err)
+	}
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: csr.Subject.CommonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, csr.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return der
+}
+
+func Test_api_TPM(t *testing.T) {
+	oldDevidID := devidID
+	defer func() { devidID = oldDevidID }()
+	devidID = func() string { return "test-device" }
+
+	dir := t.TempDir()
+	if err := os.Mkdir(filepath.Join(dir, identityDirPath), 0755); err != nil {
+		t.Fatal(err)
+	}
+	a := &api{dev: &partitions.Device{FS: partitions.NewFS(dir)}}
+
+	// a key file from before the device had TPM support stays in use
+	if err := a.GenerateClientKeyPair(); err != nil {
+		t.Fatalf("api.GenerateClientKeyPair() without TPM error = %v", err)
+	}
+	if _, err := a.Quote([]byte("nonce")); !errors.Is(err, ErrNoTPMKey) {
+		t.Errorf("api.Quote() without TPM error = %v, want %v", err, ErrNoTPMKey)
+	}
+	fakeTPMKeys(t)
+	if a.usesTPM() || !a.HasClientKey() {
+		t.Fatalf("key file is not in use anymore after the TPM appeared")
+	}
+
+	// a new key pair is being generated in the TPM, and replaces the key file
+	if err := a.GenerateClientKeyPair(); err != nil {
+		t.Fatalf("api.GenerateClientKeyPair() error = %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, clientKeyPath)); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("key file still exists after generating a key in the TPM: %v", err)
+	}
+	if !a.usesTPM() || !a.HasClientKey() {
+		t.Fatalf("api.HasClientKey() = false for TPM key")
+	}
+	key, err := a.loadClientKeyFromTPM()
+	if err != nil {
+		t.Fatalf("api.loadClientKeyFromTPM() error = %v", err)
+	}
+
+	csrBytes, err := a.GenerateClientCSR()
+	if err != nil {
+		t.Fatalf("api.GenerateClientCSR() error = %v", err)
+	}
+	csr, err := x509.ParseCertificateRequest(csrBytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !key.Public().(*ecdsa.PublicKey).Equal(csr.PublicKey) {
+		t.Fatalf("CSR is not for the TPM key")
+	}
+	if err := a.StoreClientCert(selfSignedCert(t, csrBytes)); err != nil {
+		t.Fatalf("api.StoreClientCert() error = %v", err)
+	}
+	kp, err := a.LoadX509KeyPair()
+	if err != nil {
+		t.Fatalf("api.LoadX509KeyPair() error = %v", err)
+	}
+	if kp.PrivateKey != key || kp.Leaf == nil || kp.Leaf.Subject.CommonName != "test-device" {
+		t.Errorf("api.LoadX509KeyPair() = %#v, want TPM key with client certificate", kp)
+	}
+
+	// a certificate for another key is not usable with the TPM key
+	if err := partitions.WriteFileAtomic(a.dev.FS, clientCertPath, testClientCertPEM(t, "test-device"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := a.LoadX509KeyPair(); !errors.Is(err, ErrTPMKeyMismatch) {
+		t.Errorf("api.LoadX509KeyPair() error = %v, want %v", err, ErrTPMKeyMismatch)
+	}
+
+	// a blob which does not load into this TPM is not a valid key
+	if err := os.WriteFile(filepath.Join(dir, tpmClientPrivPath), []byte("other TPM"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if a.HasClientKey() {
+		t.Errorf("api.HasClientKey() = true for key blob of another TPM")
+	}
+}
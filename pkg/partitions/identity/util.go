@@ -15,12 +15,14 @@
 package identity
 
 import (
+	"crypto"
 	"crypto/ecdsa"
 	"crypto/elliptic"
 	"crypto/x509"
 	"io"
 
 	"go.githedgehog.com/dasboot/pkg/devid"
+	"go.githedgehog.com/dasboot/pkg/tpm"
 )
 
 var (
@@ -28,4 +30,8 @@ var (
 	x509MarshalECPrivateKey      func(key *ecdsa.PrivateKey) ([]byte, error)                                               = x509.MarshalECPrivateKey
 	x509CreateCertificateRequest func(rand io.Reader, template *x509.CertificateRequest, priv any) (csr []byte, err error) = x509.CreateCertificateRequest
 	devidID                      func() string                                                                             = devid.ID
+	tpmHasTPM                    func() bool                                                                               = tpm.HasTPM
+	tpmCreateKey                 func() (*tpm.KeyBlob, error)                                                              = tpm.CreateKey
+	tpmLoadKey                   func(blob *tpm.KeyBlob) (crypto.Signer, error)                                            = loadTPMKey
+	tpmDeriveSecret              func(label []byte) ([]byte, error)                                                        = tpm.DeriveSecret
 )
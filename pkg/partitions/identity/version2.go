@@ -0,0 +1,69 @@
+// Copyright 2023 Hedgehog
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package identity
+
+import (
+	"errors"
+	"os"
+	"path"
+	"strings"
+
+	"go.githedgehog.com/dasboot/pkg/partitions"
+)
+
+// migrateToVersion2 writes the checksums of all files of a version 1 partition, and marks it as version 2 once all
+// of them were written. An interrupted migration leaves a version 1 partition behind, and is simply being repeated.
+func migrateToVersion2(d *partitions.Device) error {
+	var checksums []partitions.File
+	for _, dir := range migrateDirs {
+		if err := collectChecksums(d.FS, dir, &checksums); err != nil {
+			return err
+		}
+	}
+	if len(checksums) > 0 {
+		if err := partitions.WriteFilesAtomic(d.FS, 0644, checksums...); err != nil {
+			return err
+		}
+	}
+	return writeVersionFile(d, version2)
+}
+
+func collectChecksums(fsys partitions.FS, dir string, checksums *[]partitions.File) error {
+	entries, err := fsys.ReadDir(dir)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+	for _, entry := range entries {
+		p := path.Join(dir, entry.Name())
+		if partitions.IsTempFile(entry.Name()) || strings.HasSuffix(entry.Name(), checksumSuffix) {
+			continue
+		}
+		if entry.IsDir() {
+			if err := collectChecksums(fsys, p, checksums); err != nil {
+				return err
+			}
+			continue
+		}
+		b, err := readAll(fsys, p)
+		if err != nil {
+			return err
+		}
+		*checksums = append(*checksums, partitions.File{Name: p + checksumSuffix, Data: checksum(b)})
+	}
+	return nil
+}
@@ -0,0 +1,99 @@
+// Copyright 2023 Hedgehog
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package identity
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"testing"
+	"time"
+
+	"go.githedgehog.com/dasboot/pkg/partitions"
+)
+
+func TestOpen_migratesVersion1(t *testing.T) {
+	d := testIdentityDevice(t, "/dev/sda5")
+	writeTestFile(t, d, versionFilePath, []byte(`{"version":1}`+"\n"), time.Time{})
+	writeTestFile(t, d, locationUUIDPath, []byte("uuid"), time.Time{})
+	writeTestFile(t, d, checkpointsDirPath+"/diag-boot", []byte("pending"), time.Time{})
+	writeTestFile(t, d, checkpointsDirPath+"/install"+partitions.TempSuffix, []byte("interrupted"), time.Time{})
+
+	ip, err := Open(d)
+	if err != nil {
+		t.Fatalf("Open() error = %v", err)
+	}
+	a := ip.(*api)
+	if a.version != version2 {
+		t.Errorf("Open() version = %d, want %d", a.version, version2)
+	}
+	c := Inspect(d)
+	if c.Err != nil || c.Version != version2 {
+		t.Errorf("Inspect() = version %d with error %v, want version %d", c.Version, c.Err, version2)
+	}
+
+	// all files have their checksum now, but leftovers of interrupted writes do not
+	if b, err := a.GetCheckpoint("diag-boot"); err != nil || string(b) != "pending" {
+		t.Errorf("api.GetCheckpoint() = %q, %v", b, err)
+	}
+	b, err := os.ReadFile(d.FS.Path(locationUUIDPath + checksumSuffix))
+	if err != nil || !bytes.Equal(b, checksum([]byte("uuid"))) {
+		t.Errorf("checksum of %s = %q, %v", locationUUIDPath, b, err)
+	}
+	if _, err := os.Stat(d.FS.Path(checkpointsDirPath + "/install" + partitions.TempSuffix + checksumSuffix)); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("temporary file got a checksum: %v", err)
+	}
+
+	// opening it again does not migrate it again
+	if _, err := Open(d); err != nil {
+		t.Errorf("Open() on version 2 partition error = %v", err)
+	}
+}
+
+func Test_api_checksums(t *testing.T) {
+	d := testIdentityDevice(t, "/dev/sda5")
+	ip, err := Init(d)
+	if err != nil {
+		t.Fatalf("Init() error = %v", err)
+	}
+	a := ip.(*api)
+	if err := a.StoreCheckpoint("diag-boot", []byte("pending")); err != nil {
+		t.Fatalf("api.StoreCheckpoint() error = %v", err)
+	}
+
+	// a corrupted file is detected
+	p := checkpointsDirPath + "/diag-boot"
+	writeTestFile(t, d, p, []byte("pendinG"), time.Time{})
+	if _, err := a.GetCheckpoint("diag-boot"); !errors.Is(err, ErrChecksumMismatch) {
+		t.Errorf("api.GetCheckpoint() of corrupted file error = %v, want %v", err, ErrChecksumMismatch)
+	}
+
+	// a write which was interrupted before its checksum was moved into place is completed
+	writeTestFile(t, d, p+checksumSuffix+partitions.TempSuffix, checksum([]byte("pendinG")), time.Time{})
+	if b, err := a.GetCheckpoint("diag-boot"); err != nil || string(b) != "pendinG" {
+		t.Errorf("api.GetCheckpoint() after interrupted write = %q, %v", b, err)
+	}
+	if _, err := os.Stat(d.FS.Path(p + checksumSuffix + partitions.TempSuffix)); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("temporary checksum file was not moved into place: %v", err)
+	}
+
+	// checksums are removed together with their files
+	if err := a.DeleteCheckpoint("diag-boot"); err != nil {
+		t.Fatalf("api.DeleteCheckpoint() error = %v", err)
+	}
+	if _, err := os.Stat(d.FS.Path(p + checksumSuffix)); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("checksum file was not removed: %v", err)
+	}
+}
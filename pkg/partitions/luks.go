@@ -0,0 +1,203 @@
+// Copyright 2023 Hedgehog
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package partitions
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	osexec "os/exec"
+	"path/filepath"
+
+	"go.githedgehog.com/dasboot/pkg/exec"
+	"go.githedgehog.com/dasboot/pkg/log"
+	"go.uber.org/zap"
+)
+
+// LUKSNameHedgehogIdentity is the device mapper name of the unlocked Hedgehog Identity Partition
+const LUKSNameHedgehogIdentity = "hh-identity"
+
+var (
+	ErrNoLUKSKeys   = errors.New("device: no LUKS keys")
+	ErrLUKSLocked   = errors.New("device: LUKS container could not be unlocked with any of the keys")
+	ErrNotLUKSOpen  = errors.New("device: LUKS container is not open")
+	ErrLUKSMounted  = errors.New("device: LUKS container is still mounted")
+	ErrEmptyLUKSKey = errors.New("device: empty LUKS key")
+)
+
+// these can be swapped out for testing
+var luksKeyFile = writeLUKSKeyFile
+
+// writeLUKSKeyFile writes `key` to a temporary file which only we can read, so that the key never shows up on
+// a command line. ONIE runs from a RAM disk, so the key does not end up on a disk either. The returned function
+// removes the file again.
+func writeLUKSKeyFile(key []byte) (string, func(), error) {
+	if len(key) == 0 {
+		return "", nil, ErrEmptyLUKSKey
+	}
+	f, err := os.CreateTemp("", "luks-key-*")
+	if err != nil {
+		return "", nil, err
+	}
+	name := f.Name()
+	remove := func() { os.Remove(name) } //nolint: errcheck
+	if _, err := f.Write(key); err != nil {
+		f.Close()
+		remove()
+		return "", nil, err
+	}
+	if err := f.Close(); err != nil {
+		remove()
+		return "", nil, err
+	}
+	return name, remove, nil
+}
+
+// IsLUKS answers if the device is a LUKS container
+func (d *Device) IsLUKS() (bool, error) {
+	if d.Path == "" {
+		return false, ErrNoDeviceNode
+	}
+	err := exec.Command("cryptsetup", "isLuks", d.Path).Run()
+	if err == nil {
+		return true, nil
+	}
+	var exitErr *osexec.ExitError
+	if errors.As(err, &exitErr) {
+		return false, nil
+	}
+	return false, fmt.Errorf("device: cryptsetup isLuks: %w", toolError(ToolCryptsetup, err))
+}
+
+// FormatLUKS creates a new LUKS2 container on the device which can be unlocked with every key of `keys`, every
+// key gets its own key slot. All data on the device is lost. The filesystem needs to be created after the
+// container was unlocked with `OpenLUKS`.
+func (d *Device) FormatLUKS(keys [][]byte) error {
+	if d.Path == "" {
+		return ErrNoDeviceNode
+	}
+	if len(keys) == 0 {
+		return ErrNoLUKSKeys
+	}
+	if d.MapperPath != "" || d.IsMounted() {
+		return ErrAlreadyMounted
+	}
+	keyFile, remove, err := luksKeyFile(keys[0])
+	if err != nil {
+		return fmt.Errorf("device: LUKS key file: %w", err)
+	}
+	defer remove()
+	if err := exec.Command("cryptsetup", "luksFormat", "--type", "luks2", "--batch-mode", "--key-file", keyFile, d.Path).Run(); err != nil {
+		return fmt.Errorf("device: cryptsetup luksFormat: %w", toolError(ToolCryptsetup, err))
+	}
+	d.Filesystem = ""
+	d.FSLabel = ""
+	d.FSUUID = ""
+	for _, key := range keys[1:] {
+		if err := d.addLUKSKey(keyFile, key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// AddLUKSKey adds `newKey` to a new key slot of the LUKS container of the device. `key` must be one of its
+// existing keys.
+func (d *Device) AddLUKSKey(key, newKey []byte) error {
+	if d.Path == "" {
+		return ErrNoDeviceNode
+	}
+	keyFile, remove, err := luksKeyFile(key)
+	if err != nil {
+		return fmt.Errorf("device: LUKS key file: %w", err)
+	}
+	defer remove()
+	return d.addLUKSKey(keyFile, newKey)
+}
+
+func (d *Device) addLUKSKey(keyFile string, newKey []byte) error {
+	newKeyFile, remove, err := luksKeyFile(newKey)
+	if err != nil {
+		return fmt.Errorf("device: LUKS key file: %w", err)
+	}
+	defer remove()
+	if err := exec.Command("cryptsetup", "luksAddKey", "--batch-mode", "--key-file", keyFile, d.Path, newKeyFile).Run(); err != nil {
+		return fmt.Errorf("device: cryptsetup luksAddKey: %w", toolError(ToolCryptsetup, err))
+	}
+	return nil
+}
+
+// OpenLUKS unlocks the LUKS container of the device with the first key of `keys` which works, and maps it to
+// `/dev/mapper/<name>`. If it is mapped already, for example by an earlier stage, it is used as it is. The
+// filesystem is rediscovered on the unlocked container, and all filesystem operations like `Mount` use it
+// from now on.
+func (d *Device) OpenLUKS(name string, keys [][]byte) error {
+	if d.Path == "" {
+		return ErrNoDeviceNode
+	}
+	mapperPath := filepath.Join("/dev/mapper", name)
+	if _, err := osStat(filepath.Join(rootPath, mapperPath)); err != nil {
+		if len(keys) == 0 {
+			return ErrNoLUKSKeys
+		}
+		var openErr error
+		for i, key := range keys {
+			keyFile, remove, err := luksKeyFile(key)
+			if err != nil {
+				return fmt.Errorf("device: LUKS key file: %w", err)
+			}
+			openErr = exec.Command("cryptsetup", "open", "--type", "luks", "--key-file", keyFile, d.Path, name).Run()
+			remove()
+			if openErr == nil {
+				break
+			}
+			if errors.Is(openErr, osexec.ErrNotFound) {
+				return fmt.Errorf("device: cryptsetup open: %w", toolError(ToolCryptsetup, openErr))
+			}
+			log.L().Debug("LUKS key did not unlock the device", zap.String("device", d.Path), zap.Int("key", i), zap.Error(openErr))
+		}
+		if openErr != nil {
+			return fmt.Errorf("%w: %w", ErrLUKSLocked, openErr)
+		}
+	}
+	d.MapperPath = mapperPath
+
+	// a new container does not have a filesystem yet, so errors are expected here
+	d.Filesystem = ""
+	d.FSLabel = ""
+	d.FSUUID = ""
+	if err := d.discoverFilesystem(); err != nil {
+		log.L().Debug("discover filesystem of LUKS container failed", zap.String("device", d.MapperPath), zap.Error(err))
+	}
+	if err := d.discoverFilesystemLabel(); err != nil {
+		log.L().Debug("discover filesystem label of LUKS container failed", zap.String("device", d.MapperPath), zap.Error(err))
+	}
+	return nil
+}
+
+// CloseLUKS locks the LUKS container of the device again. It must be unmounted first.
+func (d *Device) CloseLUKS() error {
+	if d.MapperPath == "" {
+		return ErrNotLUKSOpen
+	}
+	if d.IsMounted() {
+		return ErrLUKSMounted
+	}
+	if err := exec.Command("cryptsetup", "close", filepath.Base(d.MapperPath)).Run(); err != nil {
+		return fmt.Errorf("device: cryptsetup close: %w", toolError(ToolCryptsetup, err))
+	}
+	d.MapperPath = ""
+	return nil
+}
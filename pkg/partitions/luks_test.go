@@ -0,0 +1,397 @@
+// Copyright 2023 Hedgehog
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package partitions
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	osexec "os/exec"
+	"testing"
+
+	"go.githedgehog.com/dasboot/pkg/exec"
+	"go.githedgehog.com/dasboot/test/mock/mockexec"
+
+	gomock "github.com/golang/mock/gomock"
+)
+
+// fakeLUKSKeyFiles replaces the key files with paths which are named after the keys, and makes sure that all
+// of them are being removed again
+func fakeLUKSKeyFiles(t *testing.T) {
+	open := map[string]bool{}
+	old := luksKeyFile
+	luksKeyFile = func(key []byte) (string, func(), error) {
+		if len(key) == 0 {
+			return "", nil, ErrEmptyLUKSKey
+		}
+		name := "/run/" + string(key)
+		open[name] = true
+		return name, func() { delete(open, name) }, nil
+	}
+	t.Cleanup(func() {
+		luksKeyFile = old
+		if len(open) > 0 {
+			t.Errorf("key files were not removed: %v", open)
+		}
+	})
+}
+
+func mockRun(t *testing.T, ctrl *gomock.Controller, nameArgs []string, err error) exec.CommandFunc {
+	return mockexec.MockCommand(t, ctrl, nameArgs, func(tc *mockexec.TestCmd) {
+		tc.EXPECT().Run().Times(1).DoAndReturn(func() error {
+			if err := tc.IsExpectedCommand(); err != nil {
+				return err
+			}
+			return err
+		})
+	})
+}
+
+func mockOutput(t *testing.T, ctrl *gomock.Controller, nameArgs []string, out string, err error) exec.CommandFunc {
+	return mockexec.MockCommand(t, ctrl, nameArgs, func(tc *mockexec.TestCmd) {
+		tc.EXPECT().Output().Times(1).DoAndReturn(func() ([]byte, error) {
+			if err := tc.IsExpectedCommand(); err != nil {
+				return nil, err
+			}
+			return []byte(out), err
+		})
+	})
+}
+
+func TestDevice_IsLUKS(t *testing.T) {
+	errNotFound := &osexec.Error{Name: "cryptsetup", Err: osexec.ErrNotFound}
+	tests := []struct {
+		name        string
+		device      *Device
+		cmds        func(t *testing.T, ctrl *gomock.Controller) []exec.CommandFunc
+		want        bool
+		wantErrToBe error
+	}{
+		{
+			name:        "no device node",
+			device:      &Device{},
+			wantErrToBe: ErrNoDeviceNode,
+		},
+		{
+			name:   "is LUKS",
+			device: &Device{Path: "/dev/sda5"},
+			cmds: func(t *testing.T, ctrl *gomock.Controller) []exec.CommandFunc {
+				return []exec.CommandFunc{mockRun(t, ctrl, []string{"cryptsetup", "isLuks", "/dev/sda5"}, nil)}
+			},
+			want: true,
+		},
+		{
+			name:   "is not LUKS",
+			device: &Device{Path: "/dev/sda5"},
+			cmds: func(t *testing.T, ctrl *gomock.Controller) []exec.CommandFunc {
+				return []exec.CommandFunc{mockRun(t, ctrl, []string{"cryptsetup", "isLuks", "/dev/sda5"}, &osexec.ExitError{})}
+			},
+			want: false,
+		},
+		{
+			name:   "cryptsetup missing",
+			device: &Device{Path: "/dev/sda5"},
+			cmds: func(t *testing.T, ctrl *gomock.Controller) []exec.CommandFunc {
+				return []exec.CommandFunc{mockRun(t, ctrl, []string{"cryptsetup", "isLuks", "/dev/sda5"}, errNotFound)}
+			},
+			wantErrToBe: ErrToolMissing,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			defer ctrl.Finish()
+			if tt.cmds != nil {
+				oldCommand := exec.Command
+				defer func() {
+					exec.Command = oldCommand
+				}()
+				cmds := mockexec.NewMockCommands(tt.cmds(t, ctrl))
+				defer cmds.Finish()
+				exec.Command = cmds.Command()
+			}
+			got, err := tt.device.IsLUKS()
+			if !errors.Is(err, tt.wantErrToBe) {
+				t.Errorf("Device.IsLUKS() error = %v, wantErrToBe %v", err, tt.wantErrToBe)
+			}
+			if got != tt.want {
+				t.Errorf("Device.IsLUKS() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDevice_FormatLUKS(t *testing.T) {
+	errCmdFailed := errors.New("command failed")
+	tests := []struct {
+		name        string
+		device      *Device
+		keys        [][]byte
+		cmds        func(t *testing.T, ctrl *gomock.Controller) []exec.CommandFunc
+		wantErrToBe error
+	}{
+		{
+			name:        "no device node",
+			device:      &Device{},
+			keys:        [][]byte{[]byte("key0")},
+			wantErrToBe: ErrNoDeviceNode,
+		},
+		{
+			name:        "no keys",
+			device:      &Device{Path: "/dev/sda5"},
+			wantErrToBe: ErrNoLUKSKeys,
+		},
+		{
+			name:        "already open",
+			device:      &Device{Path: "/dev/sda5", MapperPath: "/dev/mapper/hh-identity"},
+			keys:        [][]byte{[]byte("key0")},
+			wantErrToBe: ErrAlreadyMounted,
+		},
+		{
+			name:        "empty key",
+			device:      &Device{Path: "/dev/sda5"},
+			keys:        [][]byte{nil},
+			wantErrToBe: ErrEmptyLUKSKey,
+		},
+		{
+			name:   "success with one key slot per key",
+			device: &Device{Path: "/dev/sda5", Filesystem: FSExt4, FSLabel: FSLabelHedgehogIdentity},
+			keys:   [][]byte{[]byte("key0"), []byte("key1")},
+			cmds: func(t *testing.T, ctrl *gomock.Controller) []exec.CommandFunc {
+				return []exec.CommandFunc{
+					mockRun(t, ctrl, []string{"cryptsetup", "luksFormat", "--type", "luks2", "--batch-mode", "--key-file", "/run/key0", "/dev/sda5"}, nil),
+					mockRun(t, ctrl, []string{"cryptsetup", "luksAddKey", "--batch-mode", "--key-file", "/run/key0", "/dev/sda5", "/run/key1"}, nil),
+				}
+			},
+		},
+		{
+			name:   "format fails",
+			device: &Device{Path: "/dev/sda5"},
+			keys:   [][]byte{[]byte("key0"), []byte("key1")},
+			cmds: func(t *testing.T, ctrl *gomock.Controller) []exec.CommandFunc {
+				return []exec.CommandFunc{
+					mockRun(t, ctrl, []string{"cryptsetup", "luksFormat", "--type", "luks2", "--batch-mode", "--key-file", "/run/key0", "/dev/sda5"}, errCmdFailed),
+				}
+			},
+			wantErrToBe: errCmdFailed,
+		},
+		{
+			name:   "adding key fails",
+			device: &Device{Path: "/dev/sda5"},
+			keys:   [][]byte{[]byte("key0"), []byte("key1")},
+			cmds: func(t *testing.T, ctrl *gomock.Controller) []exec.CommandFunc {
+				return []exec.CommandFunc{
+					mockRun(t, ctrl, []string{"cryptsetup", "luksFormat", "--type", "luks2", "--batch-mode", "--key-file", "/run/key0", "/dev/sda5"}, nil),
+					mockRun(t, ctrl, []string{"cryptsetup", "luksAddKey", "--batch-mode", "--key-file", "/run/key0", "/dev/sda5", "/run/key1"}, errCmdFailed),
+				}
+			},
+			wantErrToBe: errCmdFailed,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fakeLUKSKeyFiles(t)
+			ctrl := gomock.NewController(t)
+			defer ctrl.Finish()
+			if tt.cmds != nil {
+				oldCommand := exec.Command
+				defer func() {
+					exec.Command = oldCommand
+				}()
+				cmds := mockexec.NewMockCommands(tt.cmds(t, ctrl))
+				defer cmds.Finish()
+				exec.Command = cmds.Command()
+			}
+			err := tt.device.FormatLUKS(tt.keys)
+			if !errors.Is(err, tt.wantErrToBe) {
+				t.Errorf("Device.FormatLUKS() error = %v, wantErrToBe %v", err, tt.wantErrToBe)
+			}
+			if err == nil && (tt.device.Filesystem != "" || tt.device.FSLabel != "") {
+				t.Errorf("Device.FormatLUKS() kept filesystem %q with label %q", tt.device.Filesystem, tt.device.FSLabel)
+			}
+		})
+	}
+}
+
+func TestDevice_OpenLUKS(t *testing.T) {
+	errWrongKey := errors.New("no key available with this passphrase")
+	errNotFound := &osexec.Error{Name: "cryptsetup", Err: osexec.ErrNotFound}
+	statMissing := func(string) (fs.FileInfo, error) { return nil, os.ErrNotExist }
+	statExists := func(string) (fs.FileInfo, error) { return nil, nil }
+	discovery := func(t *testing.T, ctrl *gomock.Controller) []exec.CommandFunc {
+		return []exec.CommandFunc{
+			mockOutput(t, ctrl, []string{"grub-probe", "-d", "/dev/mapper/hh-identity", "-t", "fs"}, "ext2\n", nil),
+			mockOutput(t, ctrl, []string{"grub-probe", "-d", "/dev/mapper/hh-identity", "-t", "fs_label"}, FSLabelHedgehogIdentity+"\n", nil),
+		}
+	}
+	tests := []struct {
+		name           string
+		device         *Device
+		keys           [][]byte
+		osStat         func(string) (fs.FileInfo, error)
+		cmds           func(t *testing.T, ctrl *gomock.Controller) []exec.CommandFunc
+		wantErrToBe    error
+		wantMapperPath string
+		wantFilesystem string
+	}{
+		{
+			name:        "no device node",
+			device:      &Device{},
+			wantErrToBe: ErrNoDeviceNode,
+		},
+		{
+			name:        "no keys",
+			device:      &Device{Path: "/dev/sda5"},
+			osStat:      statMissing,
+			wantErrToBe: ErrNoLUKSKeys,
+		},
+		{
+			name:   "second key unlocks",
+			device: &Device{Path: "/dev/sda5"},
+			keys:   [][]byte{[]byte("key0"), []byte("key1")},
+			osStat: statMissing,
+			cmds: func(t *testing.T, ctrl *gomock.Controller) []exec.CommandFunc {
+				return append([]exec.CommandFunc{
+					mockRun(t, ctrl, []string{"cryptsetup", "open", "--type", "luks", "--key-file", "/run/key0", "/dev/sda5", LUKSNameHedgehogIdentity}, errWrongKey),
+					mockRun(t, ctrl, []string{"cryptsetup", "open", "--type", "luks", "--key-file", "/run/key1", "/dev/sda5", LUKSNameHedgehogIdentity}, nil),
+				}, discovery(t, ctrl)...)
+			},
+			wantMapperPath: "/dev/mapper/hh-identity",
+			wantFilesystem: "ext2",
+		},
+		{
+			name:   "already unlocked",
+			device: &Device{Path: "/dev/sda5"},
+			osStat: statExists,
+			cmds:   discovery,
+
+			wantMapperPath: "/dev/mapper/hh-identity",
+			wantFilesystem: "ext2",
+		},
+		{
+			name:   "no key unlocks",
+			device: &Device{Path: "/dev/sda5"},
+			keys:   [][]byte{[]byte("key0"), []byte("key1")},
+			osStat: statMissing,
+			cmds: func(t *testing.T, ctrl *gomock.Controller) []exec.CommandFunc {
+				return []exec.CommandFunc{
+					mockRun(t, ctrl, []string{"cryptsetup", "open", "--type", "luks", "--key-file", "/run/key0", "/dev/sda5", LUKSNameHedgehogIdentity}, errWrongKey),
+					mockRun(t, ctrl, []string{"cryptsetup", "open", "--type", "luks", "--key-file", "/run/key1", "/dev/sda5", LUKSNameHedgehogIdentity}, errWrongKey),
+				}
+			},
+			wantErrToBe: ErrLUKSLocked,
+		},
+		{
+			name:   "cryptsetup missing",
+			device: &Device{Path: "/dev/sda5"},
+			keys:   [][]byte{[]byte("key0"), []byte("key1")},
+			osStat: statMissing,
+			cmds: func(t *testing.T, ctrl *gomock.Controller) []exec.CommandFunc {
+				return []exec.CommandFunc{
+					mockRun(t, ctrl, []string{"cryptsetup", "open", "--type", "luks", "--key-file", "/run/key0", "/dev/sda5", LUKSNameHedgehogIdentity}, errNotFound),
+				}
+			},
+			wantErrToBe: ErrToolMissing,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fakeLUKSKeyFiles(t)
+			ctrl := gomock.NewController(t)
+			defer ctrl.Finish()
+			if tt.cmds != nil {
+				oldCommand := exec.Command
+				defer func() {
+					exec.Command = oldCommand
+				}()
+				cmds := mockexec.NewMockCommands(tt.cmds(t, ctrl))
+				defer cmds.Finish()
+				exec.Command = cmds.Command()
+			}
+			if tt.osStat != nil {
+				oldOsStat := osStat
+				defer func() {
+					osStat = oldOsStat
+				}()
+				osStat = tt.osStat
+			}
+			err := tt.device.OpenLUKS(LUKSNameHedgehogIdentity, tt.keys)
+			if !errors.Is(err, tt.wantErrToBe) {
+				t.Errorf("Device.OpenLUKS() error = %v, wantErrToBe %v", err, tt.wantErrToBe)
+			}
+			if tt.device.MapperPath != tt.wantMapperPath {
+				t.Errorf("Device.OpenLUKS() MapperPath = %q, want %q", tt.device.MapperPath, tt.wantMapperPath)
+			}
+			if tt.device.Filesystem != tt.wantFilesystem {
+				t.Errorf("Device.OpenLUKS() Filesystem = %q, want %q", tt.device.Filesystem, tt.wantFilesystem)
+			}
+		})
+	}
+}
+
+func TestDevice_CloseLUKS(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	oldCommand := exec.Command
+	defer func() {
+		exec.Command = oldCommand
+	}()
+	cmds := mockexec.NewMockCommands([]exec.CommandFunc{
+		mockRun(t, ctrl, []string{"cryptsetup", "close", LUKSNameHedgehogIdentity}, nil),
+	})
+	defer cmds.Finish()
+	exec.Command = cmds.Command()
+
+	d := &Device{Path: "/dev/sda5"}
+	if err := d.CloseLUKS(); !errors.Is(err, ErrNotLUKSOpen) {
+		t.Errorf("Device.CloseLUKS() error = %v, want %v", err, ErrNotLUKSOpen)
+	}
+	d.MapperPath = "/dev/mapper/" + LUKSNameHedgehogIdentity
+	if err := d.CloseLUKS(); err != nil {
+		t.Errorf("Device.CloseLUKS() error = %v", err)
+	}
+	if d.MapperPath != "" {
+		t.Errorf("Device.CloseLUKS() MapperPath = %q, want it to be cleared", d.MapperPath)
+	}
+}
+
+func Test_writeLUKSKeyFile(t *testing.T) {
+	t.Setenv("TMPDIR", t.TempDir())
+	name, remove, err := writeLUKSKeyFile([]byte("secret"))
+	if err != nil {
+		t.Fatalf("writeLUKSKeyFile() error = %v", err)
+	}
+	st, err := os.Stat(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.Mode().Perm() != 0o600 {
+		t.Errorf("writeLUKSKeyFile() mode = %v, want 0600", st.Mode().Perm())
+	}
+	b, err := os.ReadFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != "secret" {
+		t.Errorf("writeLUKSKeyFile() content = %q, want %q", b, "secret")
+	}
+	remove()
+	if _, err := os.Stat(name); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("writeLUKSKeyFile() file was not removed: %v", err)
+	}
+	if _, _, err := writeLUKSKeyFile(nil); !errors.Is(err, ErrEmptyLUKSKey) {
+		t.Errorf("writeLUKSKeyFile() error = %v, want %v", err, ErrEmptyLUKSKey)
+	}
+}
@@ -0,0 +1,164 @@
+// Copyright 2023 Hedgehog
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package partitions
+
+import (
+	"errors"
+	"fmt"
+
+	"golang.org/x/sys/unix"
+)
+
+// MountPolicy describes how a partition is being mounted
+type MountPolicy struct {
+	// MountPath is the path (relative to the root path) where the partition will be mounted
+	MountPath string
+
+	// FSTypes are the filesystem types which will be tried in order. If the filesystem of the
+	// device was discovered and is one of them, it will be tried first.
+	FSTypes []string
+
+	// Flags are the mount flags
+	Flags uintptr
+
+	// Data holds the filesystem specific mount options per filesystem type
+	Data map[string]string
+}
+
+// MountOption allows to override the default mount policy of a partition when calling `Mount`
+type MountOption func(*MountPolicy)
+
+// MountOptionMountPath overrides the mount path
+func MountOptionMountPath(path string) MountOption {
+	return func(p *MountPolicy) {
+		p.MountPath = path
+	}
+}
+
+// MountOptionFSTypes overrides the filesystem types which will be tried
+func MountOptionFSTypes(fsTypes ...string) MountOption {
+	return func(p *MountPolicy) {
+		p.FSTypes = fsTypes
+	}
+}
+
+// MountOptionFlags overrides the mount flags
+func MountOptionFlags(flags uintptr) MountOption {
+	return func(p *MountPolicy) {
+		p.Flags = flags
+	}
+}
+
+// MountOptionData sets the filesystem specific mount options for the filesystem type `fsType`
+func MountOptionData(fsType string, data string) MountOption {
+	return func(p *MountPolicy) {
+		if p.Data == nil {
+			p.Data = make(map[string]string)
+		}
+		p.Data[fsType] = data
+	}
+}
+
+type mountPolicyEntry struct {
+	matches func(*Device) bool
+	policy  MountPolicy
+}
+
+// mountPolicies is the table of default mount policies per partition type
+var mountPolicies = []mountPolicyEntry{
+	{
+		matches: (*Device).IsHedgehogIdentityPartition,
+		policy: MountPolicy{
+			MountPath: MountPathHedgehogIdentity,
+			FSTypes:   []string{FSExt4, FSXFS, FSVFAT},
+			Flags:     unix.MS_NODEV | unix.MS_NOEXEC,
+			Data: map[string]string{
+				FSVFAT: "umask=0077",
+			},
+		},
+	},
+	{
+		matches: (*Device).IsHedgehogLocationPartition,
+		policy: MountPolicy{
+			MountPath: MountPathHedgehogLocation,
+			FSTypes:   []string{FSExt4, FSXFS, FSVFAT},
+			Flags:     unix.MS_NODEV | unix.MS_NOEXEC,
+			Data: map[string]string{
+				FSVFAT: "umask=0077",
+			},
+		},
+	},
+	{
+		matches: (*Device).IsSonicPartition,
+		policy: MountPolicy{
+			MountPath: MountPathSonic,
+			FSTypes:   []string{FSExt4},
+			Flags:     unix.MS_NODEV,
+		},
+	},
+}
+
+// MountPolicy returns the mount policy for the device after applying all `opts`.
+// It returns `ErrUnsupportedMountForDevice` if there is no mount policy for this device.
+func (d *Device) MountPolicy(opts ...MountOption) (*MountPolicy, error) {
+	for _, entry := range mountPolicies {
+		if !entry.matches(d) {
+			continue
+		}
+
+		// copy the policy so that options cannot alter the table
+		ret := entry.policy
+		ret.FSTypes = append([]string(nil), entry.policy.FSTypes...)
+		ret.Data = make(map[string]string, len(entry.policy.Data))
+		for k, v := range entry.policy.Data {
+			ret.Data[k] = v
+		}
+		for _, opt := range opts {
+			opt(&ret)
+		}
+		if len(ret.FSTypes) == 0 {
+			return nil, fmt.Errorf("%w: no filesystem types", ErrUnsupportedMountForDevice)
+		}
+		return &ret, nil
+	}
+	return nil, ErrUnsupportedMountForDevice
+}
+
+// fsTypeCandidates returns the filesystem types to try in order. A discovered filesystem
+// goes first if it is allowed by the policy.
+func (p *MountPolicy) fsTypeCandidates(discovered string) []string {
+	if discovered == "" {
+		return p.FSTypes
+	}
+	ret := make([]string, 0, len(p.FSTypes))
+	for _, fsType := range p.FSTypes {
+		if fsType == discovered {
+			ret = append(ret, fsType)
+			break
+		}
+	}
+	for _, fsType := range p.FSTypes {
+		if fsType != discovered {
+			ret = append(ret, fsType)
+		}
+	}
+	return ret
+}
+
+// isWrongFSTypeError returns true if mount failed because of a wrong or unsupported
+// filesystem type, in which case it is worth trying the next candidate
+func isWrongFSTypeError(err error) bool {
+	return errors.Is(err, unix.EINVAL) || errors.Is(err, unix.ENODEV)
+}
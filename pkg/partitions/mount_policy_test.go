@@ -0,0 +1,172 @@
+// Copyright 2023 Hedgehog
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package partitions
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestDevice_MountPolicy(t *testing.T) {
+	identityDev := &Device{
+		Uevent:      Uevent{UeventDevtype: UeventDevtypePartition},
+		GPTPartType: GPTPartTypeHedgehogIdentity,
+	}
+	tests := []struct {
+		name        string
+		device      *Device
+		opts        []MountOption
+		want        *MountPolicy
+		wantErrToBe error
+	}{
+		{
+			name:   "identity partition defaults",
+			device: identityDev,
+			want: &MountPolicy{
+				MountPath: MountPathHedgehogIdentity,
+				FSTypes:   []string{FSExt4, FSXFS, FSVFAT},
+				Flags:     unix.MS_NODEV | unix.MS_NOEXEC,
+				Data:      map[string]string{FSVFAT: "umask=0077"},
+			},
+		},
+		{
+			name:   "identity partition with overrides",
+			device: identityDev,
+			opts: []MountOption{
+				MountOptionMountPath("/mnt/other"),
+				MountOptionFSTypes(FSXFS),
+				MountOptionFlags(unix.MS_RDONLY),
+				MountOptionData(FSXFS, "nouuid"),
+			},
+			want: &MountPolicy{
+				MountPath: "/mnt/other",
+				FSTypes:   []string{FSXFS},
+				Flags:     unix.MS_RDONLY,
+				Data:      map[string]string{FSVFAT: "umask=0077", FSXFS: "nouuid"},
+			},
+		},
+		{
+			name:        "no filesystem types",
+			device:      identityDev,
+			opts:        []MountOption{MountOptionFSTypes()},
+			wantErrToBe: ErrUnsupportedMountForDevice,
+		},
+		{
+			name:        "unsupported device",
+			device:      &Device{Uevent: Uevent{UeventDevtype: UeventDevtypePartition}},
+			wantErrToBe: ErrUnsupportedMountForDevice,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.device.MountPolicy(tt.opts...)
+			if !errors.Is(err, tt.wantErrToBe) {
+				t.Fatalf("Device.MountPolicy() error = %v, wantErrToBe %v", err, tt.wantErrToBe)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Device.MountPolicy() = %#v, want %#v", got, tt.want)
+			}
+		})
+	}
+
+	// options must never alter the policy table
+	if _, err := identityDev.MountPolicy(MountOptionData(FSExt4, "errors=remount-ro")); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := mountPolicies[0].policy.Data[FSExt4]; ok {
+		t.Errorf("mount option altered the mount policy table")
+	}
+}
+
+func TestDevice_MountFSTypeDetection(t *testing.T) {
+	pwd, err := os.Getwd()
+	if err != nil {
+		panic(err)
+	}
+	goodPath := filepath.Join(pwd, "testdata", "Mount")
+	errBusy := unix.EBUSY
+	tests := []struct {
+		name        string
+		filesystem  string
+		mountErrs   map[string]error
+		wantTried   []string
+		wantErrToBe error
+	}{
+		{
+			name:       "discovered filesystem is tried first",
+			filesystem: FSVFAT,
+			wantTried:  []string{FSVFAT},
+		},
+		{
+			name:       "discovered filesystem which is not allowed is ignored",
+			filesystem: "btrfs",
+			wantTried:  []string{FSExt4},
+		},
+		{
+			name:      "falls back to next filesystem type on wrong filesystem",
+			mountErrs: map[string]error{FSExt4: unix.EINVAL},
+			wantTried: []string{FSExt4, FSXFS},
+		},
+		{
+			name:        "does not fall back on other errors",
+			mountErrs:   map[string]error{FSExt4: errBusy},
+			wantTried:   []string{FSExt4},
+			wantErrToBe: errBusy,
+		},
+		{
+			name:        "all filesystem types fail",
+			mountErrs:   map[string]error{FSExt4: unix.EINVAL, FSXFS: unix.EINVAL, FSVFAT: unix.ENODEV},
+			wantTried:   []string{FSExt4, FSXFS, FSVFAT},
+			wantErrToBe: unix.ENODEV,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			oldRootPath := rootPath
+			oldUnixMount := unixMount
+			defer func() {
+				rootPath = oldRootPath
+				unixMount = oldUnixMount
+			}()
+			rootPath = goodPath
+			var tried []string
+			unixMount = func(source, target, fstype string, flags uintptr, data string) error {
+				tried = append(tried, fstype)
+				if fstype == FSVFAT && data != "umask=0077" {
+					t.Errorf("unexpected data for vfat: %s", data)
+				}
+				return tt.mountErrs[fstype]
+			}
+			d := &Device{
+				Uevent:      Uevent{UeventDevtype: UeventDevtypePartition},
+				GPTPartType: GPTPartTypeHedgehogIdentity,
+				Path:        "/path/to/device",
+				Filesystem:  tt.filesystem,
+			}
+			err := d.Mount()
+			if !errors.Is(err, tt.wantErrToBe) {
+				t.Errorf("Device.Mount() error = %v, wantErrToBe %v", err, tt.wantErrToBe)
+			}
+			if !reflect.DeepEqual(tried, tt.wantTried) {
+				t.Errorf("Device.Mount() tried %v, want %v", tried, tt.wantTried)
+			}
+		})
+	}
+}
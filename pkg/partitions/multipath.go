@@ -0,0 +1,172 @@
+// Copyright 2023 Hedgehog
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package partitions
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"go.githedgehog.com/dasboot/pkg/log"
+
+	"go.uber.org/zap"
+)
+
+// MultipathPolicy decides which devices discovery returns if dm-multipath is active on a system. A multipath map
+// (a device mapper device like "dm-0") shadows all the disks which are the paths to the same storage. Working on
+// one of the paths directly bypasses the map, and partition operations would end up on the wrong device node.
+type MultipathPolicy string
+
+const (
+	// MultipathPolicyPrefer keeps the multipath maps and their partition maps, and excludes the disks which
+	// are the paths underneath them together with their partitions
+	MultipathPolicyPrefer MultipathPolicy = "prefer"
+
+	// MultipathPolicyExclude excludes the multipath maps, their partition maps, and the disks which are the paths
+	// underneath them together with their partitions. Nothing which is part of a multipath setup gets touched.
+	MultipathPolicyExclude MultipathPolicy = "exclude"
+
+	// MultipathPolicyIgnore disables multipath awareness, and all devices are returned
+	MultipathPolicyIgnore MultipathPolicy = "ignore"
+
+	DefaultMultipathPolicy = MultipathPolicyPrefer
+)
+
+var ErrInvalidMultipathPolicy = errors.New("partitions: invalid multipath policy")
+
+// multipathPolicy is the policy which `Discover` applies
+var multipathPolicy = DefaultMultipathPolicy
+
+// ParseMultipathPolicy parses the name of a multipath policy. An empty string
+// returns the `DefaultMultipathPolicy`.
+func ParseMultipathPolicy(s string) (MultipathPolicy, error) {
+	switch p := MultipathPolicy(s); p {
+	case "":
+		return DefaultMultipathPolicy, nil
+	case MultipathPolicyPrefer, MultipathPolicyExclude, MultipathPolicyIgnore:
+		return p, nil
+	default:
+		return "", fmt.Errorf("%w: '%s'", ErrInvalidMultipathPolicy, s)
+	}
+}
+
+// SetMultipathPolicy sets the multipath policy which all subsequent calls to `Discover` apply
+func SetMultipathPolicy(p MultipathPolicy) {
+	if p == "" {
+		p = DefaultMultipathPolicy
+	}
+	multipathPolicy = p
+}
+
+// IsDeviceMapper returns true if the device is a device mapper device
+func (t *Topology) IsDeviceMapper() bool {
+	return t.DMName != "" || t.DMUUID != ""
+}
+
+// IsMultipath returns true if the device is a multipath map. Multipath maps are the
+// device mapper devices which multipathd creates with a UUID like "mpath-<wwid>".
+func (t *Topology) IsMultipath() bool {
+	return isMultipathUUID(t.DMUUID)
+}
+
+// IsMultipathPartition returns true if the device is a partition map on top of a multipath map.
+// kpartx creates them with a UUID like "part1-mpath-<wwid>".
+func (t *Topology) IsMultipathPartition() bool {
+	return isMultipathPartitionUUID(t.DMUUID)
+}
+
+func isMultipathUUID(uuid string) bool {
+	return strings.HasPrefix(uuid, "mpath-")
+}
+
+func isMultipathPartitionUUID(uuid string) bool {
+	return strings.HasPrefix(uuid, "part") && strings.Contains(uuid, "-mpath-")
+}
+
+// dmUUID reads the device mapper UUID of a device directly from sysfs. Discovery cannot use `Topology`
+// for this as it must not populate the cached topology before all relationships are known.
+func dmUUID(d *Device) string {
+	if d.SysfsPath == "" {
+		return ""
+	}
+	return readSysfsAttr(filepath.Join(d.SysfsPath, "dm", "uuid"))
+}
+
+func holders(d *Device) []string {
+	if d.SysfsPath == "" {
+		return nil
+	}
+	return readSysfsDirNames(filepath.Join(d.SysfsPath, "holders"))
+}
+
+// ApplyMultipathPolicy returns all devices which `p` does not exclude. The relationships between
+// disks and partitions must have been established already.
+func (d Devices) ApplyMultipathPolicy(p MultipathPolicy) Devices {
+	if p == MultipathPolicyIgnore {
+		return d
+	}
+
+	// find all multipath maps and partition maps
+	maps := make(map[string]bool)
+	partMaps := make(map[*Device]bool)
+	for _, dev := range d {
+		uuid := dmUUID(dev)
+		switch {
+		case isMultipathUUID(uuid):
+			maps[dev.GetDeviceName()] = true
+		case isMultipathPartitionUUID(uuid):
+			partMaps[dev] = true
+		}
+	}
+	if len(maps) == 0 {
+		return d
+	}
+
+	// the paths are the disks which are held by a multipath map
+	paths := make(map[*Device]bool)
+	for _, dev := range d {
+		if !dev.IsDisk() || maps[dev.GetDeviceName()] {
+			continue
+		}
+		for _, holder := range holders(dev) {
+			if maps[holder] {
+				paths[dev] = true
+				break
+			}
+		}
+	}
+
+	ret := make(Devices, 0, len(d))
+	for _, dev := range d {
+		var reason string
+		switch {
+		case paths[dev]:
+			reason = "path of a multipath map"
+		case dev.IsPartition() && dev.Disk != nil && paths[dev.Disk]:
+			reason = "partition on a path of a multipath map"
+		case p == MultipathPolicyExclude && maps[dev.GetDeviceName()]:
+			reason = "multipath map"
+		case p == MultipathPolicyExclude && partMaps[dev]:
+			reason = "partition map of a multipath map"
+		}
+		if reason != "" {
+			log.L().Info("Excluding device from discovery", zap.String("devname", dev.GetDeviceName()), zap.String("reason", reason), zap.String("multipathPolicy", string(p)))
+			continue
+		}
+		ret = append(ret, dev)
+	}
+	return ret
+}
@@ -0,0 +1,148 @@
+// Copyright 2023 Hedgehog
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package partitions
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestParseMultipathPolicy(t *testing.T) {
+	tests := []struct {
+		name    string
+		s       string
+		want    MultipathPolicy
+		wantErr error
+	}{
+		{name: "default", s: "", want: DefaultMultipathPolicy},
+		{name: "prefer", s: "prefer", want: MultipathPolicyPrefer},
+		{name: "exclude", s: "exclude", want: MultipathPolicyExclude},
+		{name: "ignore", s: "ignore", want: MultipathPolicyIgnore},
+		{name: "invalid", s: "both", wantErr: ErrInvalidMultipathPolicy},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseMultipathPolicy(tt.s)
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("ParseMultipathPolicy() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if got != tt.want {
+				t.Errorf("ParseMultipathPolicy() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDevices_ApplyMultipathPolicy(t *testing.T) {
+	root := t.TempDir()
+	write := func(path string, content string) {
+		t.Helper()
+		p := filepath.Join(root, path)
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, []byte(content+"\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	mkdir := func(path string) {
+		t.Helper()
+		if err := os.MkdirAll(filepath.Join(root, path), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	newDevice := func(name string, devtype string) *Device {
+		return &Device{
+			Uevent:    Uevent{UeventDevname: name, UeventDevtype: devtype},
+			SysfsPath: filepath.Join(root, "sys", "block", name),
+		}
+	}
+
+	// sda and sdb are the two paths of the multipath map dm-0, and dm-1 is a partition map on top of it.
+	// sdc is a disk which has nothing to do with multipath, and dm-2 is an LVM volume on it.
+	mkdir("sys/block/sda/holders/dm-0")
+	mkdir("sys/block/sdb/holders/dm-0")
+	write("sys/block/dm-0/dm/uuid", "mpath-3600508b400105e210000900000490000")
+	write("sys/block/dm-1/dm/uuid", "part1-mpath-3600508b400105e210000900000490000")
+	mkdir("sys/block/sdc/sdc1/holders/dm-2")
+	write("sys/block/dm-2/dm/uuid", "LVM-abcdef")
+
+	sda := newDevice("sda", UeventDevtypeDisk)
+	sda1 := newDevice("sda1", UeventDevtypePartition)
+	sda1.SysfsPath = filepath.Join(sda.SysfsPath, "sda1")
+	sda1.Disk = sda
+	sda.Partitions = []*Device{sda1}
+	sdb := newDevice("sdb", UeventDevtypeDisk)
+	sdc := newDevice("sdc", UeventDevtypeDisk)
+	sdc1 := newDevice("sdc1", UeventDevtypePartition)
+	sdc1.SysfsPath = filepath.Join(sdc.SysfsPath, "sdc1")
+	sdc1.Disk = sdc
+	sdc.Partitions = []*Device{sdc1}
+	dm0 := newDevice("dm-0", UeventDevtypeDisk)
+	dm1 := newDevice("dm-1", UeventDevtypeDisk)
+	dm2 := newDevice("dm-2", UeventDevtypeDisk)
+	all := Devices{sda, sda1, sdb, sdc, sdc1, dm0, dm1, dm2}
+
+	tests := []struct {
+		name   string
+		devs   Devices
+		policy MultipathPolicy
+		want   Devices
+	}{
+		{
+			name:   "prefer excludes the paths",
+			devs:   all,
+			policy: MultipathPolicyPrefer,
+			want:   Devices{sdc, sdc1, dm0, dm1, dm2},
+		},
+		{
+			name:   "exclude excludes maps and paths",
+			devs:   all,
+			policy: MultipathPolicyExclude,
+			want:   Devices{sdc, sdc1, dm2},
+		},
+		{
+			name:   "ignore keeps everything",
+			devs:   all,
+			policy: MultipathPolicyIgnore,
+			want:   all,
+		},
+		{
+			name:   "without multipath maps nothing gets excluded",
+			devs:   Devices{sdc, sdc1, dm2},
+			policy: MultipathPolicyExclude,
+			want:   Devices{sdc, sdc1, dm2},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := tt.devs.ApplyMultipathPolicy(tt.policy)
+			var gotNames, wantNames []string
+			for _, dev := range got {
+				gotNames = append(gotNames, dev.GetDeviceName())
+			}
+			for _, dev := range tt.want {
+				wantNames = append(wantNames, dev.GetDeviceName())
+			}
+			if !reflect.DeepEqual(gotNames, wantNames) {
+				t.Errorf("Devices.ApplyMultipathPolicy() = %v, want %v", gotNames, wantNames)
+			}
+		})
+	}
+}
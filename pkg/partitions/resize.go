@@ -0,0 +1,279 @@
+// Copyright 2023 Hedgehog
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package partitions
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	osexec "os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"go.githedgehog.com/dasboot/pkg/exec"
+	"go.githedgehog.com/dasboot/pkg/log"
+
+	"go.uber.org/zap"
+)
+
+var (
+	ErrHedgehogIdentityPartitionNotFound = errors.New("devices: Hedgehog Identity Partition not found")
+	ErrNotEnoughSpace                    = errors.New("device: not enough free space after partition")
+	ErrUnsupportedResizeForDevice        = errors.New("device: unsupported device for filesystem resize")
+	ErrPartitionInfoNotFound             = errors.New("device: partition information not found in sgdisk output")
+)
+
+// ResizeHedgehogIdentityPartition grows the Hedgehog Identity Partition to `sizeInMB`. This requires free space
+// right after the partition, which is typically the case after a call to `DeletePartitions()` removed the NOS
+// partitions. The partition keeps its number, type, name, unique GUID and attributes. The partition must not be
+// mounted, and an encrypted partition must be unlocked with `OpenLUKS()` so that its filesystem can be resized.
+// It does nothing if the partition has at least the requested size already, partitions are never shrunk.
+//
+// NOTE: it is advisable to call `Discover()` again after a call to this.
+func (d Devices) ResizeHedgehogIdentityPartition(sizeInMB int) error {
+	part := d.GetHedgehogIdentityPartition()
+	if part == nil {
+		return ErrHedgehogIdentityPartitionNotFound
+	}
+	return part.growPartition(sizeInMB)
+}
+
+// sgdiskPartitionInfo is what we need from the output of `sgdisk -i` to recreate a partition with a larger size
+type sgdiskPartitionInfo struct {
+	name        string
+	uniqueGUID  string
+	firstSector uint64
+	sectors     uint64
+	attributes  GPTAttributes
+}
+
+func (d *Device) growPartition(sizeInMB int) error {
+	partNum, disk, err := d.partitionNumberAndDisk()
+	if err != nil {
+		return err
+	}
+	if d.IsMounted() {
+		return ErrAlreadyMounted
+	}
+	// the filesystem of an encrypted partition can only be seen once the LUKS container is open
+	if !isExtFilesystem(d.Filesystem) {
+		return fmt.Errorf("%w: filesystem '%s'", ErrUnsupportedResizeForDevice, d.Filesystem)
+	}
+
+	size := uint64(sizeInMB) * 1024 * 1024
+	var fromSize uint64
+	if err := disk.updateNativeGPT(func(g *GPT) error {
+		e, err := g.Entry(partNum)
+		if err != nil {
+			return err
+		}
+		fromSize = e.Sectors() * uint64(g.SectorSize)
+		if fromSize >= size {
+			return nil
+		}
+		if err := g.Resize(partNum, size); err != nil {
+			if errors.Is(err, ErrGPTNoSpace) {
+				return fmt.Errorf("%w: %w", ErrNotEnoughSpace, err)
+			}
+			return err
+		}
+		return nil
+	}); !fallBackFromNativeGPT(disk, "resize", err) {
+		if err != nil {
+			return fmt.Errorf("device: resizing partition %d: %w", partNum, err)
+		}
+		if fromSize >= size {
+			log.L().Info("Partition has the requested size already", zap.String("devname", d.GetDeviceName()), zap.Uint64("sizeInBytes", fromSize), zap.Int("requestedSizeInMB", sizeInMB))
+			return nil
+		}
+		if err := disk.ReReadPartitionTable(); err != nil {
+			return fmt.Errorf("device: rereading partition table after resize: %w", err)
+		}
+		log.L().Info("Grew partition", zap.String("devname", d.GetDeviceName()), zap.Uint64("fromSizeInBytes", fromSize), zap.Int("toSizeInMB", sizeInMB))
+		return d.growFilesystem()
+	}
+
+	out, err := exec.Command("sgdisk", "-i", strconv.Itoa(partNum), disk.Path).Output()
+	if err != nil {
+		return fmt.Errorf("device: sgdisk -i failed: %w", toolError(ToolSgdisk, err))
+	}
+	info, err := parseSgdiskPartitionInfo(out)
+	if err != nil {
+		return err
+	}
+	fromSize = info.sectors * logicalSectorSize(disk)
+	if fromSize >= size {
+		log.L().Info("Partition has the requested size already", zap.String("devname", d.GetDeviceName()), zap.Uint64("sizeInBytes", fromSize), zap.Int("requestedSizeInMB", sizeInMB))
+		return nil
+	}
+	if err := d.checkSpaceAfterPartition(size); err != nil {
+		return err
+	}
+
+	// sgdisk cannot resize a partition, so we recreate it at the same place with all of its properties,
+	// all operations of a single sgdisk call are only written to disk if all of them succeed
+	if err := exec.Command(
+		"sgdisk",
+		fmt.Sprintf("--delete=%d", partNum),
+		fmt.Sprintf("--new=%d:%d:+%dMB", partNum, info.firstSector, sizeInMB),
+		fmt.Sprintf("--change-name=%d:%s", partNum, info.name),
+		fmt.Sprintf("--typecode=%d:%s", partNum, d.GPTPartType.Upper()),
+		fmt.Sprintf("--partition-guid=%d:%s", partNum, info.uniqueGUID),
+		fmt.Sprintf("--attributes=%d:=:%016x", partNum, uint64(info.attributes)),
+		disk.Path,
+	).Run(); err != nil {
+		return fmt.Errorf("device: sgdisk resize failed: %w", toolError(ToolSgdisk, err))
+	}
+
+	// unlike after creating or deleting partitions, the kernel must know the new size before we can continue
+	if err := disk.ReReadPartitionTable(); err != nil {
+		return fmt.Errorf("device: rereading partition table after resize: %w", err)
+	}
+	log.L().Info("Grew partition", zap.String("devname", d.GetDeviceName()), zap.Uint64("fromSizeInBytes", fromSize), zap.Int("toSizeInMB", sizeInMB))
+
+	return d.growFilesystem()
+}
+
+// checkSpaceAfterPartition checks in sysfs that no other partition of the disk starts within `size` bytes from the
+// start of the partition. sgdisk would refuse to create an overlapping partition anyways, but without telling why.
+func (d *Device) checkSpaceAfterPartition(size uint64) error {
+	start, ok := sysfsSectors(d, "start")
+	if !ok {
+		return nil
+	}
+	end := start*512 + size
+	for _, part := range d.Disk.Partitions {
+		if part == d {
+			continue
+		}
+		partStart, ok := sysfsSectors(part, "start")
+		if !ok {
+			continue
+		}
+		if partStart > start && partStart*512 < end {
+			return fmt.Errorf("%w: partition %s follows at %d bytes", ErrNotEnoughSpace, part.GetDeviceName(), partStart*512)
+		}
+	}
+	return nil
+}
+
+// sysfsSectors reads a sysfs attribute of a block device which is in 512 byte sectors
+func sysfsSectors(d *Device, attr string) (uint64, bool) {
+	if d.SysfsPath == "" {
+		return 0, false
+	}
+	ret, err := strconv.ParseUint(readSysfsAttr(filepath.Join(d.SysfsPath, attr)), 10, 64)
+	if err != nil {
+		return 0, false
+	}
+	return ret, true
+}
+
+// logicalSectorSize returns the logical sector size of the disk from sysfs, in which sgdisk counts sectors. It
+// defaults to 512 bytes if sysfs does not tell.
+func logicalSectorSize(disk *Device) uint64 {
+	if disk.SysfsPath != "" {
+		ret, err := strconv.ParseUint(readSysfsAttr(filepath.Join(disk.SysfsPath, "queue", "logical_block_size")), 10, 64)
+		if err == nil && ret > 0 {
+			return ret
+		}
+	}
+	return 512
+}
+
+// growFilesystem grows the LUKS container (if the device has an open one) and the ext4 filesystem to the size of
+// the partition. resize2fs refuses to work on an unmounted filesystem which was not checked right before.
+func (d *Device) growFilesystem() error {
+	if d.MapperPath != "" {
+		if err := exec.Command("cryptsetup", "resize", filepath.Base(d.MapperPath)).Run(); err != nil {
+			return fmt.Errorf("device: cryptsetup resize: %w", toolError(ToolCryptsetup, err))
+		}
+	}
+	// e2fsck exits with 1 if it corrected errors, which is fine
+	if err := exec.Command("e2fsck", "-f", "-p", d.fsPath()).Run(); err != nil {
+		var exitErr *osexec.ExitError
+		if !errors.As(err, &exitErr) || exitErr.ExitCode() != 1 {
+			return fmt.Errorf("device: e2fsck: %w", toolError(ToolE2fsck, err))
+		}
+	}
+	if err := exec.Command("resize2fs", d.fsPath()).Run(); err != nil {
+		return fmt.Errorf("device: resize2fs: %w", toolError(ToolResize2fs, err))
+	}
+	return nil
+}
+
+// parseSgdiskPartitionInfo parses the unique GUID, first sector, size and attribute flags from the output of `sgdisk -i`:
+//
+//	Partition unique GUID: 5C0B8D1A-7E4F-4C32-9A55-3E8F0D2B6A71
+//	First sector: 1050624 (at 513.0 MiB)
+//	Partition size: 204800 sectors (100.0 MiB)
+//	Attribute flags: 0000000000000000
+//	Partition name: 'HEDGEHOG_IDENTITY'
+func parseSgdiskPartitionInfo(out []byte) (*sgdiskPartitionInfo, error) {
+	ret := &sgdiskPartitionInfo{}
+	var hasGUID, hasFirst, hasSize, hasAttrs bool
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if value, ok := strings.CutPrefix(line, "Partition unique GUID:"); ok {
+			ret.uniqueGUID = strings.TrimSpace(value)
+			hasGUID = ret.uniqueGUID != ""
+			continue
+		}
+		if value, ok := strings.CutPrefix(line, "Partition name:"); ok {
+			ret.name = strings.Trim(strings.TrimSpace(value), "'")
+			continue
+		}
+		if value, ok := strings.CutPrefix(line, "First sector:"); ok {
+			fields := strings.Fields(value)
+			if len(fields) > 0 {
+				n, err := strconv.ParseUint(fields[0], 10, 64)
+				if err != nil {
+					return nil, fmt.Errorf("%w: first sector: %w", ErrPartitionInfoNotFound, err)
+				}
+				ret.firstSector = n
+				hasFirst = true
+			}
+			continue
+		}
+		if value, ok := strings.CutPrefix(line, "Partition size:"); ok {
+			// the size in parentheses is rounded and its unit depends on the size, so we only use the sectors
+			fields := strings.Fields(value)
+			if len(fields) > 1 && fields[1] == "sectors" {
+				n, err := strconv.ParseUint(fields[0], 10, 64)
+				if err != nil {
+					return nil, fmt.Errorf("%w: partition size: %w", ErrPartitionInfoNotFound, err)
+				}
+				ret.sectors = n
+				hasSize = true
+			}
+			continue
+		}
+		if strings.HasPrefix(line, "Attribute flags:") {
+			attrs, err := parseSgdiskAttributeFlags([]byte(line))
+			if err != nil {
+				return nil, err
+			}
+			ret.attributes = attrs
+			hasAttrs = true
+		}
+	}
+	if !hasGUID || !hasFirst || !hasSize || !hasAttrs {
+		return nil, ErrPartitionInfoNotFound
+	}
+	return ret, nil
+}
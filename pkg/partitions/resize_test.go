@@ -0,0 +1,439 @@
+// Copyright 2023 Hedgehog
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package partitions
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/golang/mock/gomock"
+	"go.githedgehog.com/dasboot/pkg/exec"
+	"go.githedgehog.com/dasboot/test/mock/mockexec"
+)
+
+const sgdiskIdentityInfoOutput = `Partition GUID code: E982E2BD-867C-4D7A-89A2-9C5A9BC5DFDD (Unknown)
+Partition unique GUID: 5C0B8D1A-7E4F-4C32-9A55-3E8F0D2B6A71
+First sector: 1050624 (at 513.0 MiB)
+Last sector: 1255423 (at 613.0 MiB)
+Partition size: 204800 sectors (100.0 MiB)
+Attribute flags: 0000000000000001
+Partition name: 'HEDGEHOG_IDENTITY'
+`
+
+func TestParseSgdiskPartitionInfo(t *testing.T) {
+	tests := []struct {
+		name        string
+		out         string
+		want        *sgdiskPartitionInfo
+		wantErrToBe error
+	}{
+		{
+			name: "success",
+			out:  sgdiskIdentityInfoOutput,
+			want: &sgdiskPartitionInfo{
+				name:        GPTPartNameHedgehogIdentity,
+				uniqueGUID:  "5C0B8D1A-7E4F-4C32-9A55-3E8F0D2B6A71",
+				firstSector: 1050624,
+				sectors:     204800,
+				attributes:  GPTAttributeRequired,
+			},
+		},
+		{
+			name:        "partition does not exist",
+			out:         "Partition #4 does not exist.\n",
+			wantErrToBe: ErrPartitionInfoNotFound,
+		},
+		{
+			name: "size in GiB",
+			out:  "Partition unique GUID: 5C0B8D1A-7E4F-4C32-9A55-3E8F0D2B6A71\nFirst sector: 2048 (at 1024.0 KiB)\nPartition size: 4194304 sectors (2.0 GiB)\nAttribute flags: 0000000000000000\n",
+			want: &sgdiskPartitionInfo{
+				uniqueGUID:  "5C0B8D1A-7E4F-4C32-9A55-3E8F0D2B6A71",
+				firstSector: 2048,
+				sectors:     4194304,
+			},
+		},
+		{
+			name:        "size without sectors",
+			out:         "Partition unique GUID: 5C0B8D1A-7E4F-4C32-9A55-3E8F0D2B6A71\nFirst sector: 2048 (at 1024.0 KiB)\nPartition size: (2.0 GiB)\nAttribute flags: 0000000000000000\n",
+			wantErrToBe: ErrPartitionInfoNotFound,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseSgdiskPartitionInfo([]byte(tt.out))
+			if !errors.Is(err, tt.wantErrToBe) {
+				t.Fatalf("parseSgdiskPartitionInfo() error = %v, wantErrToBe %v", err, tt.wantErrToBe)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseSgdiskPartitionInfo() = %#v, want %#v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLogicalSectorSize(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(dir, "4k", "queue"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "4k", "queue", "logical_block_size"), []byte("4096\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name string
+		disk *Device
+		want uint64
+	}{
+		{
+			name: "from sysfs",
+			disk: &Device{SysfsPath: filepath.Join(dir, "4k")},
+			want: 4096,
+		},
+		{
+			name: "missing in sysfs",
+			disk: &Device{SysfsPath: filepath.Join(dir, "missing")},
+			want: 512,
+		},
+		{
+			name: "no sysfs path",
+			disk: &Device{},
+			want: 512,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := logicalSectorSize(tt.disk); got != tt.want {
+				t.Errorf("logicalSectorSize() = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDevices_ResizeHedgehogIdentityPartition(t *testing.T) {
+	errCmdFailed := errors.New("command failed")
+	root := t.TempDir()
+	oldRootPath := rootPath
+	defer func() { rootPath = oldRootPath }()
+	rootPath = root
+
+	// the identity partition starts at 513 MiB, the partition which follows it at 1 GiB
+	for path, content := range map[string]string{
+		"sys/block/sda/sda4/start": "1050624",
+		"sys/block/sda/sda5/start": "2097152",
+	} {
+		p := filepath.Join(root, path)
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, []byte(content+"\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	devices := func(withFollowingPartition bool, fs string, mapperPath string) Devices {
+		disk := &Device{
+			Uevent:    Uevent{UeventDevtype: UeventDevtypeDisk, UeventDevname: "sda"},
+			SysfsPath: filepath.Join(root, "sys", "block", "sda"),
+			Path:      "/dev/sda",
+		}
+		part := &Device{
+			Uevent:      Uevent{UeventDevtype: UeventDevtypePartition, UeventDevname: "sda4", UeventPartn: "4"},
+			SysfsPath:   filepath.Join(root, "sys", "block", "sda", "sda4"),
+			Path:        "/dev/sda4",
+			GPTPartType: GPTPartTypeHedgehogIdentity,
+			Filesystem:  fs,
+			MapperPath:  mapperPath,
+			Disk:        disk,
+		}
+		disk.Partitions = []*Device{part}
+		ret := Devices{disk, part}
+		if withFollowingPartition {
+			next := &Device{
+				Uevent:    Uevent{UeventDevtype: UeventDevtypePartition, UeventDevname: "sda5", UeventPartn: "5"},
+				SysfsPath: filepath.Join(root, "sys", "block", "sda", "sda5"),
+				Path:      "/dev/sda5",
+				Disk:      disk,
+			}
+			disk.Partitions = append(disk.Partitions, next)
+			ret = append(ret, next)
+		}
+		return ret
+	}
+	sgdiskInfo := func(t *testing.T, ctrl *gomock.Controller, out string, err error) exec.CommandFunc {
+		return mockexec.MockCommand(t, ctrl, []string{"sgdisk", "-i", "4", "/dev/sda"}, func(tc *mockexec.TestCmd) {
+			tc.EXPECT().Output().Times(1).DoAndReturn(func() ([]byte, error) {
+				if err := tc.IsExpectedCommand(); err != nil {
+					return nil, err
+				}
+				return []byte(out), err
+			})
+		})
+	}
+	run := func(t *testing.T, ctrl *gomock.Controller, cmd []string, err error) exec.CommandFunc {
+		return mockexec.MockCommand(t, ctrl, cmd, func(tc *mockexec.TestCmd) {
+			tc.EXPECT().Run().Times(1).DoAndReturn(func() error {
+				if cmdErr := tc.IsExpectedCommand(); cmdErr != nil {
+					return cmdErr
+				}
+				return err
+			})
+		})
+	}
+	sgdiskResize := []string{
+		"sgdisk",
+		"--delete=4",
+		"--new=4:1050624:+500MB",
+		"--change-name=4:HEDGEHOG_IDENTITY",
+		"--typecode=4:E982E2BD-867C-4D7A-89A2-9C5A9BC5DFDD",
+		"--partition-guid=4:5C0B8D1A-7E4F-4C32-9A55-3E8F0D2B6A71",
+		"--attributes=4:=:0000000000000001",
+		"/dev/sda",
+	}
+
+	tests := []struct {
+		name        string
+		d           Devices
+		sizeInMB    int
+		cmds        func(t *testing.T, ctrl *gomock.Controller) []exec.CommandFunc
+		wantErrToBe error
+	}{
+		{
+			name:     "success",
+			d:        devices(false, FSExt4, ""),
+			sizeInMB: 500,
+			cmds: func(t *testing.T, ctrl *gomock.Controller) []exec.CommandFunc {
+				return []exec.CommandFunc{
+					sgdiskInfo(t, ctrl, sgdiskIdentityInfoOutput, nil),
+					run(t, ctrl, sgdiskResize, nil),
+					run(t, ctrl, []string{"partprobe", "/dev/sda"}, nil),
+					run(t, ctrl, []string{"e2fsck", "-f", "-p", "/dev/sda4"}, nil),
+					run(t, ctrl, []string{"resize2fs", "/dev/sda4"}, nil),
+				}
+			},
+		},
+		{
+			name:     "success with LUKS container",
+			d:        devices(false, FSExt4, "/dev/mapper/hh-identity"),
+			sizeInMB: 500,
+			cmds: func(t *testing.T, ctrl *gomock.Controller) []exec.CommandFunc {
+				return []exec.CommandFunc{
+					sgdiskInfo(t, ctrl, sgdiskIdentityInfoOutput, nil),
+					run(t, ctrl, sgdiskResize, nil),
+					run(t, ctrl, []string{"partprobe", "/dev/sda"}, nil),
+					run(t, ctrl, []string{"cryptsetup", "resize", "hh-identity"}, nil),
+					run(t, ctrl, []string{"e2fsck", "-f", "-p", "/dev/mapper/hh-identity"}, nil),
+					run(t, ctrl, []string{"resize2fs", "/dev/mapper/hh-identity"}, nil),
+				}
+			},
+		},
+		{
+			name:     "large enough already",
+			d:        devices(false, FSExt4, ""),
+			sizeInMB: 100,
+			cmds: func(t *testing.T, ctrl *gomock.Controller) []exec.CommandFunc {
+				return []exec.CommandFunc{
+					sgdiskInfo(t, ctrl, sgdiskIdentityInfoOutput, nil),
+				}
+			},
+		},
+		{
+			name:     "large enough already after a previous resize to GiB",
+			d:        devices(false, FSExt4, ""),
+			sizeInMB: 2048,
+			cmds: func(t *testing.T, ctrl *gomock.Controller) []exec.CommandFunc {
+				return []exec.CommandFunc{
+					sgdiskInfo(t, ctrl, strings.Replace(sgdiskIdentityInfoOutput, "204800 sectors (100.0 MiB)", "4194304 sectors (2.0 GiB)", 1), nil),
+				}
+			},
+		},
+		{
+			name:     "partition follows",
+			d:        devices(true, FSExt4, ""),
+			sizeInMB: 1024,
+			cmds: func(t *testing.T, ctrl *gomock.Controller) []exec.CommandFunc {
+				return []exec.CommandFunc{
+					sgdiskInfo(t, ctrl, sgdiskIdentityInfoOutput, nil),
+				}
+			},
+			wantErrToBe: ErrNotEnoughSpace,
+		},
+		{
+			name:     "partition follows after the new size",
+			d:        devices(true, FSExt4, ""),
+			sizeInMB: 500,
+			cmds: func(t *testing.T, ctrl *gomock.Controller) []exec.CommandFunc {
+				return []exec.CommandFunc{
+					sgdiskInfo(t, ctrl, sgdiskIdentityInfoOutput, nil),
+					run(t, ctrl, sgdiskResize, nil),
+					run(t, ctrl, []string{"partprobe", "/dev/sda"}, nil),
+					run(t, ctrl, []string{"e2fsck", "-f", "-p", "/dev/sda4"}, nil),
+					run(t, ctrl, []string{"resize2fs", "/dev/sda4"}, nil),
+				}
+			},
+		},
+		{
+			name:        "locked LUKS container",
+			d:           devices(false, "", ""),
+			sizeInMB:    500,
+			wantErrToBe: ErrUnsupportedResizeForDevice,
+		},
+		{
+			name:     "sgdisk fails",
+			d:        devices(false, FSExt4, ""),
+			sizeInMB: 500,
+			cmds: func(t *testing.T, ctrl *gomock.Controller) []exec.CommandFunc {
+				return []exec.CommandFunc{
+					sgdiskInfo(t, ctrl, sgdiskIdentityInfoOutput, nil),
+					run(t, ctrl, sgdiskResize, errCmdFailed),
+				}
+			},
+			wantErrToBe: errCmdFailed,
+		},
+		{
+			name:     "resize2fs fails",
+			d:        devices(false, FSExt4, ""),
+			sizeInMB: 500,
+			cmds: func(t *testing.T, ctrl *gomock.Controller) []exec.CommandFunc {
+				return []exec.CommandFunc{
+					sgdiskInfo(t, ctrl, sgdiskIdentityInfoOutput, nil),
+					run(t, ctrl, sgdiskResize, nil),
+					run(t, ctrl, []string{"partprobe", "/dev/sda"}, nil),
+					run(t, ctrl, []string{"e2fsck", "-f", "-p", "/dev/sda4"}, nil),
+					run(t, ctrl, []string{"resize2fs", "/dev/sda4"}, errCmdFailed),
+				}
+			},
+			wantErrToBe: errCmdFailed,
+		},
+		{
+			name:        "no identity partition",
+			d:           Devices{},
+			sizeInMB:    500,
+			wantErrToBe: ErrHedgehogIdentityPartitionNotFound,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			defer ctrl.Finish()
+			if tt.cmds != nil {
+				oldCommand := exec.Command
+				defer func() {
+					exec.Command = oldCommand
+				}()
+				cmds := mockexec.NewMockCommands(tt.cmds(t, ctrl))
+				defer cmds.Finish()
+				exec.Command = cmds.Command()
+			}
+			err := tt.d.ResizeHedgehogIdentityPartition(tt.sizeInMB)
+			if !errors.Is(err, tt.wantErrToBe) {
+				t.Errorf("Devices.ResizeHedgehogIdentityPartition() error = %v, wantErrToBe %v", err, tt.wantErrToBe)
+			}
+		})
+	}
+}
+
+func TestDevices_ResizeHedgehogIdentityPartition_native(t *testing.T) {
+	useNativeGPTBackend(t)
+	oldRootPath := rootPath
+	defer func() { rootPath = oldRootPath }()
+	rootPath = t.TempDir()
+
+	run := func(t *testing.T, ctrl *gomock.Controller, cmd []string) exec.CommandFunc {
+		return mockexec.MockCommand(t, ctrl, cmd, func(tc *mockexec.TestCmd) {
+			tc.EXPECT().Run().Times(1).DoAndReturn(tc.IsExpectedCommand)
+		})
+	}
+	tests := []struct {
+		name        string
+		sizeInMB    int
+		cmds        func(t *testing.T, ctrl *gomock.Controller, disk string) []exec.CommandFunc
+		wantSectors uint64
+		wantErrToBe error
+	}{
+		{
+			name:     "success",
+			sizeInMB: 4,
+			cmds: func(t *testing.T, ctrl *gomock.Controller, disk string) []exec.CommandFunc {
+				return []exec.CommandFunc{
+					run(t, ctrl, []string{"partprobe", disk}),
+					run(t, ctrl, []string{"e2fsck", "-f", "-p", "/dev/sda2"}),
+					run(t, ctrl, []string{"resize2fs", "/dev/sda2"}),
+				}
+			},
+			wantSectors: 8192,
+		},
+		{
+			name:        "large enough already",
+			sizeInMB:    1,
+			wantSectors: 2048,
+		},
+		{
+			name:        "not enough space",
+			sizeInMB:    8,
+			wantSectors: 2048,
+			wantErrToBe: ErrNotEnoughSpace,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := goldenGPTImage(t)
+			disk := &Device{
+				Uevent: Uevent{UeventDevtype: UeventDevtypeDisk, UeventDevname: "sda"},
+				Path:   path,
+			}
+			part := &Device{
+				Uevent:      Uevent{UeventDevtype: UeventDevtypePartition, UeventDevname: "sda2", UeventPartn: "2"},
+				Path:        "/dev/sda2",
+				GPTPartType: GPTPartTypeHedgehogIdentity,
+				Filesystem:  FSExt4,
+				Disk:        disk,
+			}
+			disk.Partitions = []*Device{part}
+
+			ctrl := gomock.NewController(t)
+			defer ctrl.Finish()
+			if tt.cmds != nil {
+				oldCommand := exec.Command
+				defer func() {
+					exec.Command = oldCommand
+				}()
+				cmds := mockexec.NewMockCommands(tt.cmds(t, ctrl, path))
+				defer cmds.Finish()
+				exec.Command = cmds.Command()
+			}
+			err := Devices{disk, part}.ResizeHedgehogIdentityPartition(tt.sizeInMB)
+			if !errors.Is(err, tt.wantErrToBe) {
+				t.Fatalf("Devices.ResizeHedgehogIdentityPartition() error = %v, wantErrToBe %v", err, tt.wantErrToBe)
+			}
+
+			// the partition keeps its place and all of its properties, and only its size changes
+			g := readGPTImage(t, path)
+			e, err := g.Entry(2)
+			if err != nil {
+				t.Fatalf("GPT.Entry() error = %v", err)
+			}
+			if e.FirstLBA != 6144 || e.Sectors() != tt.wantSectors {
+				t.Errorf("identity partition = %d+%d, want 6144+%d", e.FirstLBA, e.Sectors(), tt.wantSectors)
+			}
+			if e.UniqueGUID.String() != "5c0b8d1a-7e4f-4c32-9a55-3e8f0d2b6a71" || e.Name != GPTPartNameHedgehogIdentity || e.Type != GPTPartTypeHedgehogIdentity {
+				t.Errorf("identity partition changed: %#v", e)
+			}
+		})
+	}
+}
@@ -0,0 +1,240 @@
+// Copyright 2023 Hedgehog
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package partitions
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"unsafe"
+
+	"go.githedgehog.com/dasboot/pkg/log"
+	"go.uber.org/zap"
+	"golang.org/x/sys/unix"
+)
+
+// SparseBlockSize is the granularity in which the SparseWriter detects blocks which contain only zeros
+const SparseBlockSize = 64 * 1024
+
+var ErrSparseWriterFlushed = errors.New("sparse writer: already flushed")
+
+// these can be swapped out for testing
+var unixIoctlBlkDiscard = blkDiscard
+
+func blkDiscard(fd int, start uint64, length uint64) error {
+	rng := [2]uint64{start, length}
+	if _, _, errno := unix.Syscall(unix.SYS_IOCTL, uintptr(fd), unix.BLKDISCARD, uintptr(unsafe.Pointer(&rng))); errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// SparseStats are the number of bytes which a SparseWriter wrote, skipped and discarded
+type SparseStats struct {
+	Written   int64 `json:"written"`
+	Skipped   int64 `json:"skipped"`
+	Discarded int64 `json:"discarded"`
+}
+
+// SparseWriter writes an image to a regular file or a block device while it skips all blocks which contain only
+// zeros. This reduces the wear on flash media like eMMC or SSDs and speeds up the installation.
+//
+// Regular files get truncated first, and the skipped blocks become holes. On block devices blocks are only being
+// skipped if discards are enabled, as the skipped ranges are being discarded (BLKDISCARD). This relies on the
+// device returning zeros for discarded blocks, which is why discards must be disabled on platforms where this is
+// broken. If the device does not support discards at all, the writer falls back to writing the zeros.
+type SparseWriter struct {
+	f         *os.File
+	blockDev  bool
+	discard   bool
+	buf       []byte
+	off       int64
+	holeStart int64
+	holeLen   int64
+	stats     SparseStats
+	flushed   bool
+}
+
+var _ io.Writer = &SparseWriter{}
+
+// NewSparseWriter returns a SparseWriter which writes to `f` from its beginning. `discard` enables discards
+// on block devices.
+func NewSparseWriter(f *os.File, discard bool) (*SparseWriter, error) {
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, fmt.Errorf("sparse writer: stat '%s': %w", f.Name(), err)
+	}
+	blockDev := fi.Mode()&os.ModeDevice != 0 && fi.Mode()&os.ModeCharDevice == 0
+	if !blockDev {
+		if err := f.Truncate(0); err != nil {
+			return nil, fmt.Errorf("sparse writer: truncate '%s': %w", f.Name(), err)
+		}
+	}
+	return &SparseWriter{
+		f:        f,
+		blockDev: blockDev,
+		discard:  discard,
+		buf:      make([]byte, 0, SparseBlockSize),
+	}, nil
+}
+
+// Write implements io.Writer
+func (w *SparseWriter) Write(p []byte) (int, error) {
+	if w.flushed {
+		return 0, ErrSparseWriterFlushed
+	}
+	var n int
+	for len(p) > 0 {
+		c := copy(w.buf[len(w.buf):cap(w.buf)], p)
+		w.buf = w.buf[:len(w.buf)+c]
+		p = p[c:]
+		n += c
+		if len(w.buf) == cap(w.buf) {
+			if err := w.writeBlock(w.buf, true); err != nil {
+				return n, err
+			}
+			w.buf = w.buf[:0]
+		}
+	}
+	return n, nil
+}
+
+// Flush writes the last partial block and settles all skipped ranges. The writer cannot be used anymore afterwards.
+// It does not close the underlying file.
+func (w *SparseWriter) Flush() error {
+	if w.flushed {
+		return nil
+	}
+	w.flushed = true
+
+	// discards must be aligned to the sector size, so the last block always gets written on block devices
+	if len(w.buf) > 0 {
+		if err := w.writeBlock(w.buf, !w.blockDev); err != nil {
+			return err
+		}
+		w.buf = w.buf[:0]
+	}
+	if err := w.settleHole(); err != nil {
+		return err
+	}
+
+	// a trailing hole in a regular file must still count towards its size
+	if !w.blockDev {
+		if err := w.f.Truncate(w.off); err != nil {
+			return fmt.Errorf("sparse writer: truncate '%s': %w", w.f.Name(), err)
+		}
+	}
+	return nil
+}
+
+// Stats returns the number of bytes which were written, skipped and discarded so far
+func (w *SparseWriter) Stats() SparseStats {
+	return w.stats
+}
+
+func (w *SparseWriter) writeBlock(b []byte, skippable bool) error {
+	if skippable && isZero(b) && (!w.blockDev || w.discard) {
+		if w.holeLen == 0 {
+			w.holeStart = w.off
+		}
+		w.holeLen += int64(len(b))
+		w.off += int64(len(b))
+		w.stats.Skipped += int64(len(b))
+		return nil
+	}
+	if err := w.settleHole(); err != nil {
+		return err
+	}
+	if _, err := w.f.WriteAt(b, w.off); err != nil {
+		return fmt.Errorf("sparse writer: write '%s': %w", w.f.Name(), err)
+	}
+	w.off += int64(len(b))
+	w.stats.Written += int64(len(b))
+	return nil
+}
+
+// settleHole discards the pending skipped range on block devices
+func (w *SparseWriter) settleHole() error {
+	if w.holeLen == 0 {
+		return nil
+	}
+	start, length := w.holeStart, w.holeLen
+	w.holeStart, w.holeLen = 0, 0
+	if !w.blockDev {
+		return nil
+	}
+	if w.discard {
+		err := unixIoctlBlkDiscard(int(w.f.Fd()), uint64(start), uint64(length))
+		if err == nil {
+			w.stats.Discarded += length
+			return nil
+		}
+		log.L().Warn("Discarding blocks failed, disabling discards and writing zeros instead", zap.String("device", w.f.Name()), zap.Int64("offset", start), zap.Int64("length", length), zap.Error(err))
+		w.discard = false
+	}
+	return w.writeZeros(start, length)
+}
+
+func (w *SparseWriter) writeZeros(start int64, length int64) error {
+	zeros := make([]byte, SparseBlockSize)
+	for length > 0 {
+		n := int64(len(zeros))
+		if length < n {
+			n = length
+		}
+		if _, err := w.f.WriteAt(zeros[:n], start); err != nil {
+			return fmt.Errorf("sparse writer: write '%s': %w", w.f.Name(), err)
+		}
+		start += n
+		length -= n
+		w.stats.Skipped -= n
+		w.stats.Written += n
+	}
+	return nil
+}
+
+func isZero(b []byte) bool {
+	for _, c := range b {
+		if c != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// WriteImage writes the image from `r` to the regular file or block device at `path` with a SparseWriter,
+// and syncs it to disk. `discard` enables discards on block devices.
+func WriteImage(path string, r io.Reader, discard bool) (SparseStats, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return SparseStats{}, fmt.Errorf("write image: open '%s': %w", path, err)
+	}
+	defer f.Close()
+	w, err := NewSparseWriter(f, discard)
+	if err != nil {
+		return SparseStats{}, err
+	}
+	if _, err := io.Copy(w, r); err != nil {
+		return w.Stats(), fmt.Errorf("write image: '%s': %w", path, err)
+	}
+	if err := w.Flush(); err != nil {
+		return w.Stats(), err
+	}
+	if err := f.Sync(); err != nil {
+		return w.Stats(), fmt.Errorf("write image: sync '%s': %w", path, err)
+	}
+	return w.Stats(), nil
+}
@@ -0,0 +1,143 @@
+// Copyright 2023 Hedgehog
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package partitions
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func sparseTestImage(blocks ...byte) []byte {
+	ret := make([]byte, 0, len(blocks)*SparseBlockSize)
+	for _, b := range blocks {
+		ret = append(ret, bytes.Repeat([]byte{b}, SparseBlockSize)...)
+	}
+	return ret
+}
+
+func TestWriteImage(t *testing.T) {
+	tests := []struct {
+		name  string
+		image []byte
+		want  SparseStats
+	}{
+		{
+			name:  "no zero blocks",
+			image: sparseTestImage(1, 2),
+			want:  SparseStats{Written: 2 * SparseBlockSize},
+		},
+		{
+			name:  "zero blocks in between and at the end",
+			image: sparseTestImage(1, 0, 0, 2, 0),
+			want:  SparseStats{Written: 2 * SparseBlockSize, Skipped: 3 * SparseBlockSize},
+		},
+		{
+			name:  "partial last block",
+			image: append(sparseTestImage(0), 3, 0, 0),
+			want:  SparseStats{Written: 3, Skipped: SparseBlockSize},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "image")
+			// existing content must not shine through the holes
+			if err := os.WriteFile(path, sparseTestImage(0xff, 0xff, 0xff, 0xff, 0xff, 0xff), 0644); err != nil {
+				t.Fatal(err)
+			}
+			got, err := WriteImage(path, bytes.NewReader(tt.image), true)
+			if err != nil {
+				t.Fatalf("WriteImage() error = %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("WriteImage() = %#v, want %#v", got, tt.want)
+			}
+			written, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(written, tt.image) {
+				t.Errorf("WriteImage() wrote %d bytes which differ from the %d bytes of the image", len(written), len(tt.image))
+			}
+		})
+	}
+}
+
+func TestSparseWriter_blockDevice(t *testing.T) {
+	tests := []struct {
+		name       string
+		discard    bool
+		discardErr error
+		want       SparseStats
+		wantRanges [][2]uint64
+	}{
+		{
+			name:       "discards skipped ranges",
+			discard:    true,
+			want:       SparseStats{Written: 2 * SparseBlockSize, Skipped: 2 * SparseBlockSize, Discarded: 2 * SparseBlockSize},
+			wantRanges: [][2]uint64{{SparseBlockSize, 2 * SparseBlockSize}},
+		},
+		{
+			name:    "writes zeros if discards are disabled",
+			discard: false,
+			want:    SparseStats{Written: 4 * SparseBlockSize},
+		},
+		{
+			name:       "falls back to writing zeros if discards fail",
+			discard:    true,
+			discardErr: errors.New("operation not supported"),
+			want:       SparseStats{Written: 4 * SparseBlockSize},
+			wantRanges: [][2]uint64{{SparseBlockSize, 2 * SparseBlockSize}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var ranges [][2]uint64
+			oldDiscard := unixIoctlBlkDiscard
+			defer func() { unixIoctlBlkDiscard = oldDiscard }()
+			unixIoctlBlkDiscard = func(_ int, start uint64, length uint64) error {
+				ranges = append(ranges, [2]uint64{start, length})
+				return tt.discardErr
+			}
+
+			f, err := os.Create(filepath.Join(t.TempDir(), "device"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer f.Close()
+			w, err := NewSparseWriter(f, tt.discard)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// pretend that this is a block device
+			w.blockDev = true
+			if _, err := w.Write(sparseTestImage(1, 0, 0, 2)); err != nil {
+				t.Fatal(err)
+			}
+			if err := w.Flush(); err != nil {
+				t.Fatal(err)
+			}
+			if got := w.Stats(); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Stats() = %#v, want %#v", got, tt.want)
+			}
+			if !reflect.DeepEqual(ranges, tt.wantRanges) {
+				t.Errorf("discarded ranges = %v, want %v", ranges, tt.wantRanges)
+			}
+		})
+	}
+}
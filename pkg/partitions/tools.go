@@ -0,0 +1,98 @@
+// Copyright 2023 Hedgehog
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package partitions
+
+import (
+	"errors"
+	"fmt"
+	osexec "os/exec"
+	"strings"
+)
+
+// Tool is an external binary which the partitions package depends on. Not every ONIE image ships all of them.
+type Tool string
+
+const (
+	ToolGrubProbe  Tool = "grub-probe"
+	ToolSgdisk     Tool = "sgdisk"
+	ToolPartprobe  Tool = "partprobe"
+	ToolMkfsExt4   Tool = "mkfs.ext4"
+	ToolCryptsetup Tool = "cryptsetup"
+	ToolE2fsck     Tool = "e2fsck"
+	ToolResize2fs  Tool = "resize2fs"
+)
+
+var ErrToolMissing = errors.New("partitions: required tool missing")
+
+// these can be swapped out for testing
+var execLookPath = osexec.LookPath
+
+type toolInfo struct {
+	feature  string
+	fallback bool
+}
+
+var tools = map[Tool]toolInfo{
+	ToolGrubProbe:  {feature: "partition type and filesystem discovery", fallback: true},
+	ToolSgdisk:     {feature: "partition creation, deletion and GPT attributes on disks without a readable partition table", fallback: true},
+	ToolPartprobe:  {feature: "rereading partition tables", fallback: true},
+	ToolMkfsExt4:   {feature: "creating the filesystem of the Hedgehog Identity Partition"},
+	ToolCryptsetup: {feature: "encrypting the Hedgehog Identity Partition"},
+	ToolE2fsck:     {feature: "checking the filesystem of the Hedgehog Identity Partition before mounting and resizing it"},
+	ToolResize2fs:  {feature: "resizing the filesystem of the Hedgehog Identity Partition"},
+}
+
+// ToolCapability reports if a tool is available, and which feature is affected if it is not
+type ToolCapability struct {
+	Tool      Tool   `json:"tool"`
+	Path      string `json:"path,omitempty"`
+	Available bool   `json:"available"`
+	Feature   string `json:"feature"`
+
+	// Fallback is true if there is a native implementation which is used if the tool is missing
+	Fallback bool `json:"fallback"`
+}
+
+// ToolCapabilities checks the presence of all tools which the partitions package depends on. They are sorted by name.
+func ToolCapabilities() []ToolCapability {
+	ret := make([]ToolCapability, 0, len(tools))
+	for _, tool := range []Tool{ToolCryptsetup, ToolE2fsck, ToolGrubProbe, ToolMkfsExt4, ToolPartprobe, ToolResize2fs, ToolSgdisk} {
+		info := tools[tool]
+		c := ToolCapability{
+			Tool:     tool,
+			Feature:  info.feature,
+			Fallback: info.fallback,
+		}
+		if p, err := execLookPath(string(tool)); err == nil {
+			c.Path = p
+			c.Available = true
+		}
+		ret = append(ret, c)
+	}
+	return ret
+}
+
+// toolError turns the error of a failed execution of `tool` into an error which names the missing tool and
+// the affected feature if the tool is not installed. All other errors are returned as they are.
+func toolError(tool Tool, err error) error {
+	if err == nil || !errors.Is(err, osexec.ErrNotFound) {
+		return err
+	}
+	feature := tools[tool].feature
+	if feature == "" && strings.HasPrefix(string(tool), "mkfs.") {
+		feature = "creating " + strings.TrimPrefix(string(tool), "mkfs.") + " filesystems"
+	}
+	return fmt.Errorf("%w: '%s' is not installed, but it is required for %s: %w", ErrToolMissing, tool, feature, err)
+}
@@ -0,0 +1,95 @@
+// Copyright 2023 Hedgehog
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package partitions
+
+import (
+	"errors"
+	"fmt"
+	osexec "os/exec"
+	"testing"
+)
+
+func TestToolCapabilities(t *testing.T) {
+	oldLookPath := execLookPath
+	defer func() { execLookPath = oldLookPath }()
+	execLookPath = func(file string) (string, error) {
+		if file == string(ToolPartprobe) {
+			return "", &osexec.Error{Name: file, Err: osexec.ErrNotFound}
+		}
+		return "/usr/sbin/" + file, nil
+	}
+
+	caps := ToolCapabilities()
+	if len(caps) != len(tools) {
+		t.Fatalf("ToolCapabilities() returned %d tools, want %d", len(caps), len(tools))
+	}
+	for _, c := range caps {
+		wantAvailable := c.Tool != ToolPartprobe
+		if c.Available != wantAvailable {
+			t.Errorf("ToolCapabilities() %s available = %v, want %v", c.Tool, c.Available, wantAvailable)
+		}
+		if c.Feature == "" {
+			t.Errorf("ToolCapabilities() %s has no feature", c.Tool)
+		}
+	}
+}
+
+func Test_toolError(t *testing.T) {
+	errOther := errors.New("exit status 1")
+	tests := []struct {
+		name        string
+		tool        Tool
+		err         error
+		wantMissing bool
+		wantErrMsg  string
+	}{
+		{
+			name: "no error",
+			tool: ToolSgdisk,
+		},
+		{
+			name: "other error",
+			tool: ToolSgdisk,
+			err:  errOther,
+		},
+		{
+			name:        "missing tool",
+			tool:        ToolGrubProbe,
+			err:         &osexec.Error{Name: "grub-probe", Err: osexec.ErrNotFound},
+			wantMissing: true,
+			wantErrMsg:  "partitions: required tool missing: 'grub-probe' is not installed, but it is required for partition type and filesystem discovery: exec: \"grub-probe\": executable file not found in $PATH",
+		},
+		{
+			name:        "missing mkfs tool",
+			tool:        Tool("mkfs.vfat"),
+			err:         fmt.Errorf("wrapped: %w", &osexec.Error{Name: "mkfs.vfat", Err: osexec.ErrNotFound}),
+			wantMissing: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := toolError(tt.tool, tt.err)
+			if errors.Is(err, ErrToolMissing) != tt.wantMissing {
+				t.Errorf("toolError() = %v, wantMissing %v", err, tt.wantMissing)
+			}
+			if !tt.wantMissing && err != tt.err {
+				t.Errorf("toolError() = %v, want %v", err, tt.err)
+			}
+			if tt.wantErrMsg != "" && err.Error() != tt.wantErrMsg {
+				t.Errorf("toolError() = %q, want %q", err.Error(), tt.wantErrMsg)
+			}
+		})
+	}
+}
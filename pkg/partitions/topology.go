@@ -0,0 +1,229 @@
+// Copyright 2023 Hedgehog
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package partitions
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Topology is the position of a block device within the block device stack, and the stable identifiers under
+// which it can be referenced. Kernel names like "sda" can change across boots, the identifiers don't.
+type Topology struct {
+	// Name is the kernel name of the device like "sda1"
+	Name string `json:"name"`
+
+	// MajorMinor is the device number in its "major:minor" form
+	MajorMinor string `json:"major_minor,omitempty"`
+
+	// Parent is the kernel name of the disk of a partition
+	Parent string `json:"parent,omitempty"`
+
+	// Children are the kernel names of the partitions of a disk
+	Children []string `json:"children,omitempty"`
+
+	// Holders are the kernel names of devices which are stacked on top of this device like device mapper devices
+	Holders []string `json:"holders,omitempty"`
+
+	// Slaves are the kernel names of the devices which back a stacked device like a device mapper device
+	Slaves []string `json:"slaves,omitempty"`
+
+	// BackingFile is the file which backs a loop device
+	BackingFile string `json:"backing_file,omitempty"`
+
+	// DMName and DMUUID are the name and UUID of a device mapper device
+	DMName string `json:"dm_name,omitempty"`
+	DMUUID string `json:"dm_uuid,omitempty"`
+
+	// WWID, Serial and Model are reported by the disk itself. They are empty for partitions.
+	WWID   string `json:"wwid,omitempty"`
+	Serial string `json:"serial,omitempty"`
+	Model  string `json:"model,omitempty"`
+
+	// ByID and ByPath are the names of the /dev/disk/by-id and /dev/disk/by-path symlinks which point to the device.
+	// They are only available if udev created them.
+	ByID   []string `json:"by_id,omitempty"`
+	ByPath []string `json:"by_path,omitempty"`
+}
+
+// Topology returns the topology of the device. It is read from sysfs and /dev/disk on first use, and cached
+// for all further calls. Use `RefreshTopology` after the block device stack changed.
+func (d *Device) Topology() *Topology {
+	if d.topology == nil {
+		d.topology = d.readTopology()
+	}
+	return d.topology
+}
+
+// RefreshTopology drops the cached topology of the device, and reads it again
+func (d *Device) RefreshTopology() *Topology {
+	d.topology = nil
+	return d.Topology()
+}
+
+func (d *Device) readTopology() *Topology {
+	name := d.GetDeviceName()
+	ret := &Topology{
+		Name: name,
+	}
+	if major, minor, err := d.GetMajorMinor(); err == nil {
+		ret.MajorMinor = fmt.Sprintf("%d:%d", major, minor)
+	}
+	if d.Disk != nil {
+		ret.Parent = d.Disk.GetDeviceName()
+	}
+	for _, part := range d.Partitions {
+		ret.Children = append(ret.Children, part.GetDeviceName())
+	}
+	sort.Strings(ret.Children)
+
+	if d.SysfsPath != "" {
+		ret.Holders = readSysfsDirNames(filepath.Join(d.SysfsPath, "holders"))
+		ret.Slaves = readSysfsDirNames(filepath.Join(d.SysfsPath, "slaves"))
+		ret.BackingFile = readSysfsAttr(filepath.Join(d.SysfsPath, "loop", "backing_file"))
+		ret.DMName = readSysfsAttr(filepath.Join(d.SysfsPath, "dm", "name"))
+		ret.DMUUID = readSysfsAttr(filepath.Join(d.SysfsPath, "dm", "uuid"))
+		if d.IsDisk() {
+			// SCSI disks have their WWID on the SCSI device, NVMe namespaces have their own
+			ret.WWID = readSysfsAttr(filepath.Join(d.SysfsPath, "device", "wwid"))
+			if ret.WWID == "" {
+				ret.WWID = readSysfsAttr(filepath.Join(d.SysfsPath, "wwid"))
+			}
+			ret.Serial = readSysfsAttr(filepath.Join(d.SysfsPath, "device", "serial"))
+			ret.Model = readSysfsAttr(filepath.Join(d.SysfsPath, "device", "model"))
+		}
+	}
+
+	if name != "" {
+		ret.ByID = diskSymlinksTo(filepath.Join(rootPath, "dev", "disk", "by-id"), name)
+		ret.ByPath = diskSymlinksTo(filepath.Join(rootPath, "dev", "disk", "by-path"), name)
+	}
+	return ret
+}
+
+// StableID returns an identifier for the device which does not change across reboots. It prefers the udev
+// by-id names (with WWN based names first), then the udev by-path names. Without udev, it derives the identifier
+// from the WWID or serial of the disk like "wwid-naa.5000c500a1b2c3d4-part1". As a last resort, it returns the
+// kernel name.
+func (d *Device) StableID() string {
+	t := d.Topology()
+	for _, id := range t.ByID {
+		if strings.HasPrefix(id, "wwn-") {
+			return id
+		}
+	}
+	if len(t.ByID) > 0 {
+		return t.ByID[0]
+	}
+	if len(t.ByPath) > 0 {
+		return t.ByPath[0]
+	}
+
+	disk := d
+	var suffix string
+	if d.IsPartition() && d.Disk != nil {
+		disk = d.Disk
+		if n, err := d.GetPartitionNumber(); err == nil {
+			suffix = fmt.Sprintf("-part%d", n)
+		}
+	}
+	dt := disk.Topology()
+	switch {
+	case dt.WWID != "":
+		return "wwid-" + sanitizeStableID(dt.WWID) + suffix
+	case dt.Serial != "":
+		return "serial-" + sanitizeStableID(dt.Serial) + suffix
+	default:
+		return t.Name
+	}
+}
+
+// GetByStableID returns the device which has `id` as its stable ID, or as one of its by-id or by-path names.
+// It returns nil if there is no such device.
+func (d Devices) GetByStableID(id string) *Device {
+	for _, dev := range d {
+		if dev.StableID() == id {
+			return dev
+		}
+		t := dev.Topology()
+		for _, name := range append(append([]string(nil), t.ByID...), t.ByPath...) {
+			if name == id {
+				return dev
+			}
+		}
+	}
+	return nil
+}
+
+// sanitizeStableID replaces all characters which udev would not use in a symlink name
+func sanitizeStableID(s string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+			return r
+		case r == '.' || r == '-' || r == ':':
+			return r
+		default:
+			return '_'
+		}
+	}, strings.TrimSpace(s))
+}
+
+func readSysfsAttr(path string) string {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(b))
+}
+
+func readSysfsDirNames(path string) []string {
+	entries, err := os.ReadDir(path)
+	if err != nil {
+		return nil
+	}
+	var ret []string
+	for _, entry := range entries {
+		ret = append(ret, entry.Name())
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+// diskSymlinksTo returns the names of all symlinks in `dir` which resolve to the device node of `devname`
+func diskSymlinksTo(dir string, devname string) []string {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil
+	}
+	var ret []string
+	for _, entry := range entries {
+		if entry.Type()&os.ModeSymlink == 0 {
+			continue
+		}
+		target, err := os.Readlink(filepath.Join(dir, entry.Name()))
+		if err != nil {
+			continue
+		}
+		if filepath.Base(target) == devname {
+			ret = append(ret, entry.Name())
+		}
+	}
+	sort.Strings(ret)
+	return ret
+}
@@ -0,0 +1,197 @@
+// Copyright 2023 Hedgehog
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package partitions
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestDeviceTopology(t *testing.T) {
+	root := t.TempDir()
+	oldRootPath := rootPath
+	defer func() { rootPath = oldRootPath }()
+	rootPath = root
+
+	write := func(path string, content string) {
+		t.Helper()
+		p := filepath.Join(root, path)
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, []byte(content+"\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	mkdir := func(path string) {
+		t.Helper()
+		if err := os.MkdirAll(filepath.Join(root, path), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	symlink := func(target, path string) {
+		t.Helper()
+		p := filepath.Join(root, path)
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Symlink(target, p); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// sda is a disk with udev symlinks, sda1 is a partition which backs dm-0
+	write("sys/block/sda/device/wwid", "naa.5000c500a1b2c3d4")
+	write("sys/block/sda/device/model", "SSD 64GB")
+	mkdir("sys/block/sda/sda1/holders/dm-0")
+	mkdir("sys/block/dm-0/slaves/sda1")
+	write("sys/block/dm-0/dm/name", "identity")
+	write("sys/block/dm-0/dm/uuid", "CRYPT-LUKS2-abc-identity")
+	write("sys/block/loop0/loop/backing_file", "/tmp/disk.img")
+	symlink("../../sda", "dev/disk/by-id/ata-SSD_64GB_S1")
+	symlink("../../sda", "dev/disk/by-id/wwn-0x5000c500a1b2c3d4")
+	symlink("../../sda1", "dev/disk/by-id/wwn-0x5000c500a1b2c3d4-part1")
+	symlink("../../sda", "dev/disk/by-path/pci-0000:00:17.0-ata-1")
+	// nvme0n1 has no udev symlinks at all
+	write("sys/block/nvme0n1/wwid", "eui.0025388b71b0a1c2")
+	write("sys/block/nvme0n1/device/serial", "S4EVNF0M  ")
+
+	sda := &Device{
+		Uevent:    Uevent{UeventDevtype: UeventDevtypeDisk, UeventDevname: "sda", UeventMajor: "8", UeventMinor: "0"},
+		SysfsPath: filepath.Join(root, "sys", "block", "sda"),
+	}
+	sda1 := &Device{
+		Uevent:    Uevent{UeventDevtype: UeventDevtypePartition, UeventDevname: "sda1", UeventPartn: "1", UeventMajor: "8", UeventMinor: "1"},
+		SysfsPath: filepath.Join(root, "sys", "block", "sda", "sda1"),
+		Disk:      sda,
+	}
+	sda.Partitions = []*Device{sda1}
+	dm0 := &Device{
+		Uevent:    Uevent{UeventDevtype: UeventDevtypeDisk, UeventDevname: "dm-0", UeventMajor: "253", UeventMinor: "0"},
+		SysfsPath: filepath.Join(root, "sys", "block", "dm-0"),
+	}
+	loop0 := &Device{
+		Uevent:    Uevent{UeventDevtype: UeventDevtypeDisk, UeventDevname: "loop0", UeventMajor: "7", UeventMinor: "0"},
+		SysfsPath: filepath.Join(root, "sys", "block", "loop0"),
+	}
+	nvme := &Device{
+		Uevent:    Uevent{UeventDevtype: UeventDevtypeDisk, UeventDevname: "nvme0n1", UeventMajor: "259", UeventMinor: "0"},
+		SysfsPath: filepath.Join(root, "sys", "block", "nvme0n1"),
+	}
+	nvmep2 := &Device{
+		Uevent:    Uevent{UeventDevtype: UeventDevtypePartition, UeventDevname: "nvme0n1p2", UeventPartn: "2", UeventMajor: "259", UeventMinor: "2"},
+		SysfsPath: filepath.Join(root, "sys", "block", "nvme0n1", "nvme0n1p2"),
+		Disk:      nvme,
+	}
+	nvme.Partitions = []*Device{nvmep2}
+
+	tests := []struct {
+		name         string
+		dev          *Device
+		want         *Topology
+		wantStableID string
+	}{
+		{
+			name: "disk with udev symlinks",
+			dev:  sda,
+			want: &Topology{
+				Name:       "sda",
+				MajorMinor: "8:0",
+				Children:   []string{"sda1"},
+				WWID:       "naa.5000c500a1b2c3d4",
+				Model:      "SSD 64GB",
+				ByID:       []string{"ata-SSD_64GB_S1", "wwn-0x5000c500a1b2c3d4"},
+				ByPath:     []string{"pci-0000:00:17.0-ata-1"},
+			},
+			wantStableID: "wwn-0x5000c500a1b2c3d4",
+		},
+		{
+			name: "partition backing a device mapper device",
+			dev:  sda1,
+			want: &Topology{
+				Name:       "sda1",
+				MajorMinor: "8:1",
+				Parent:     "sda",
+				Holders:    []string{"dm-0"},
+				ByID:       []string{"wwn-0x5000c500a1b2c3d4-part1"},
+			},
+			wantStableID: "wwn-0x5000c500a1b2c3d4-part1",
+		},
+		{
+			name: "device mapper device",
+			dev:  dm0,
+			want: &Topology{
+				Name:       "dm-0",
+				MajorMinor: "253:0",
+				Slaves:     []string{"sda1"},
+				DMName:     "identity",
+				DMUUID:     "CRYPT-LUKS2-abc-identity",
+			},
+			wantStableID: "dm-0",
+		},
+		{
+			name: "loop device",
+			dev:  loop0,
+			want: &Topology{
+				Name:        "loop0",
+				MajorMinor:  "7:0",
+				BackingFile: "/tmp/disk.img",
+			},
+			wantStableID: "loop0",
+		},
+		{
+			name: "partition without udev derives from WWID of the disk",
+			dev:  nvmep2,
+			want: &Topology{
+				Name:       "nvme0n1p2",
+				MajorMinor: "259:2",
+				Parent:     "nvme0n1",
+			},
+			wantStableID: "wwid-eui.0025388b71b0a1c2-part2",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.dev.Topology(); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Device.Topology() = %+v, want %+v", got, tt.want)
+			}
+			if got := tt.dev.StableID(); got != tt.wantStableID {
+				t.Errorf("Device.StableID() = %v, want %v", got, tt.wantStableID)
+			}
+		})
+	}
+
+	// the topology is cached until it is refreshed
+	symlink("../../dm-0", "dev/disk/by-id/dm-name-identity")
+	if got := dm0.Topology().ByID; got != nil {
+		t.Errorf("Device.Topology() cached ByID = %v, want nil", got)
+	}
+	if got := dm0.RefreshTopology().ByID; !reflect.DeepEqual(got, []string{"dm-name-identity"}) {
+		t.Errorf("Device.RefreshTopology() ByID = %v", got)
+	}
+
+	devices := Devices{sda, sda1, dm0, loop0, nvme, nvmep2}
+	if got := devices.GetByStableID("wwid-eui.0025388b71b0a1c2-part2"); got != nvmep2 {
+		t.Errorf("Devices.GetByStableID() = %v, want nvme0n1p2", got)
+	}
+	if got := devices.GetByStableID("pci-0000:00:17.0-ata-1"); got != sda {
+		t.Errorf("Devices.GetByStableID() = %v, want sda", got)
+	}
+	if got := devices.GetByStableID("unknown"); got != nil {
+		t.Errorf("Devices.GetByStableID() = %v, want nil", got)
+	}
+}
@@ -16,6 +16,7 @@ package partitions
 
 import (
 	"bufio"
+	"context"
 	"errors"
 	"fmt"
 	"os"
@@ -24,21 +25,25 @@ import (
 	"github.com/0x5a17ed/uefi/efi/efireader"
 	"github.com/0x5a17ed/uefi/efi/efivario"
 	"github.com/0x5a17ed/uefi/efi/efivars"
+	"go.githedgehog.com/dasboot/pkg/efivar"
 	"go.githedgehog.com/dasboot/pkg/log"
 	"go.uber.org/zap"
 )
 
-// One of the prerequisites is a test EFI Context.
-// As this is an interface, we are going to build a mock for this
-// by simply using go mock for this which we can easily replace
-// then for the `efiCtx` variable in a test.
-//
-//go:generate mockgen -destination ../../test/mock/mockuefi/uefi_mock_efictx.go -package mockuefi github.com/0x5a17ed/uefi/efi/efivario Context
-var efiCtx = efivario.NewDefaultContext()
+// efiVars is the EFI variable store which is used by all functions in this file.
+// It retries transient firmware errors. Unit tests replace it with a store which
+// is backed by an `efivar.Fake`.
+var efiVars = efivar.NewDefault()
+
+// efiCtx returns an EFI context for `efiVars` for the typed variables of the efivars package
+func efiCtx() efivario.Context {
+	return efivar.NewContext(context.Background(), efiVars)
+}
 
 var (
 	ErrNotBootedIntoONIE = errors.New("uefi: not booted into ONIE")
 	ErrEmptyBootOrder    = errors.New("uefi: boot order is empty")
+	ErrBootEntryNotFound = errors.New("uefi: boot entry not found")
 )
 
 // MakeONIEDefaultBootEntryAndCleanup will ensure that ONIE is the first boot
@@ -77,7 +82,8 @@ func MakeONIEDefaultBootEntryAndCleanup() error {
 	}
 
 	// get the boot order variable now
-	_, bootOrder, err := efivars.BootOrder.Get(efiCtx)
+	c := efiCtx()
+	_, bootOrder, err := efivars.BootOrder.Get(c)
 	if err != nil {
 		return err
 	}
@@ -113,14 +119,10 @@ func MakeONIEDefaultBootEntryAndCleanup() error {
 	}
 
 	// prepare a string that we use for logging and errors
-	newBootOrderStrings := make([]string, 0, len(newBootOrder))
-	for _, num := range newBootOrder {
-		newBootOrderStrings = append(newBootOrderStrings, fmt.Sprintf("%04X", num))
-	}
-	newBootOrderStr := strings.Join(newBootOrderStrings, ",")
+	newBootOrderStr := bootOrderString(newBootOrder)
 
 	// write the boot order to the EFI variable
-	if err := efivars.BootOrder.Set(efiCtx, newBootOrder); err != nil {
+	if err := efivars.BootOrder.Set(c, newBootOrder); err != nil {
 		return fmt.Errorf("uefi: setting BootOrder to '%s': %w", newBootOrderStr, err)
 	}
 	log.L().Info("uefi: successfully set EFI BootOrder variable", zap.String("BootOrder", newBootOrderStr))
@@ -128,8 +130,9 @@ func MakeONIEDefaultBootEntryAndCleanup() error {
 	// and now delete all entries which we need to delete
 	for _, num := range bootEntriesToDelete {
 		name := fmt.Sprintf("Boot%04X", num)
-		if err := efiCtx.Delete(name, efivars.GlobalVariable); err != nil {
+		if err := c.Delete(name, efivars.GlobalVariable); err != nil {
 			log.L().Warn("uefi: deleting stale EFI variable failed", zap.String("efivar", name), zap.Error(err))
+			continue
 		}
 		log.L().Info("uefi: successfully deleted stale EFI variable", zap.String("efivar", name))
 	}
@@ -166,7 +169,23 @@ func IsBootedIntoONIE() (bool, error) {
 
 // FindONIEBootEntry will find the UEFI ONIE boot entry
 func FindONIEBootEntry() (uint16, error) {
-	bootIterator, err := efivars.BootIterator(efiCtx)
+	return FindBootEntry(func(desc string) bool {
+		return strings.Contains(desc, "ONIE")
+	})
+}
+
+// FindDiagBootEntry will find the UEFI boot entry of the vendor diagnostics OS
+// which is usually installed to the *-DIAG partition
+func FindDiagBootEntry() (uint16, error) {
+	return FindBootEntry(func(desc string) bool {
+		return strings.Contains(strings.ToUpper(desc), "DIAG")
+	})
+}
+
+// FindBootEntry will find the first UEFI boot entry for which `matches` returns true for its description
+func FindBootEntry(matches func(desc string) bool) (uint16, error) {
+	c := efiCtx()
+	bootIterator, err := efivars.BootIterator(c)
 	if err != nil {
 		return 0, fmt.Errorf("failed to get BootIterator: %w", err)
 	}
@@ -174,17 +193,41 @@ func FindONIEBootEntry() (uint16, error) {
 
 	for bootIterator.Next() {
 		bootEntry := bootIterator.Value()
-		_, bootEntryLoadOptions, err := bootEntry.Variable.Get(efiCtx)
+		_, bootEntryLoadOptions, err := bootEntry.Variable.Get(c)
 		if err != nil {
 			continue
 		}
 		desc := efireader.UTF16ZBytesToString(bootEntryLoadOptions.Description)
-		if strings.Contains(desc, "ONIE") {
+		if matches(desc) {
 			return bootEntry.Index, nil
 		}
 	}
 	if err := bootIterator.Err(); err != nil {
 		return 0, fmt.Errorf("BootIterator aborted: %w", err)
 	}
-	return 0, fmt.Errorf("not found")
+	return 0, ErrBootEntryNotFound
+}
+
+// SetBootNext sets the EFI BootNext variable to the boot entry `num`. The firmware
+// will boot this entry exactly once on the next boot, and will then continue
+// with the regular BootOrder again.
+func SetBootNext(num uint16) error {
+	if err := efivars.BootNext.Set(efiCtx(), num); err != nil {
+		return fmt.Errorf("uefi: setting BootNext to '%04X': %w", num, err)
+	}
+	log.L().Info("uefi: successfully set EFI BootNext variable", zap.String("BootNext", fmt.Sprintf("%04X", num)))
+	return nil
+}
+
+// MakeDiagOneShotBootEntry sets the diagnostics OS as the boot target for the next boot only.
+// It returns the boot entry number of the diagnostics OS.
+func MakeDiagOneShotBootEntry() (uint16, error) {
+	num, err := FindDiagBootEntry()
+	if err != nil {
+		return 0, fmt.Errorf("uefi: finding DIAG boot entry: %w", err)
+	}
+	if err := SetBootNext(num); err != nil {
+		return 0, err
+	}
+	return num, nil
 }
@@ -0,0 +1,349 @@
+// Copyright 2023 Hedgehog
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package partitions
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"unicode/utf16"
+
+	"github.com/0x5a17ed/uefi/efi/efireader"
+	"github.com/0x5a17ed/uefi/efi/efitypes"
+	"github.com/0x5a17ed/uefi/efi/efitypes/efidevicepath"
+	"github.com/0x5a17ed/uefi/efi/efivario"
+	"github.com/0x5a17ed/uefi/efi/efivars"
+	"go.githedgehog.com/dasboot/pkg/log"
+	"go.uber.org/zap"
+)
+
+var (
+	ErrBootEntryInvalidLoader = errors.New("uefi: invalid EFI loader path")
+	ErrNoFreeBootEntry        = errors.New("uefi: no free boot entry number")
+)
+
+const (
+	// bootEntryAttrs are the EFI variable attributes of boot entries as the firmware creates them
+	bootEntryAttrs = efivario.NonVolatile | efivario.BootServiceAccess | efivario.RuntimeAccess
+
+	devicePathTypeMedia        = 0x04
+	devicePathSubTypeHardDrive = 0x01
+	devicePathSubTypeFilePath  = 0x04
+	devicePathHardDriveLength  = 42
+	devicePathPartitionFormat  = 0x02 // GPT
+	devicePathSignatureType    = 0x02 // GUID
+)
+
+// devicePathEnd terminates a device path
+var devicePathEnd = []byte{0x7f, 0xff, 0x04, 0x00}
+
+// BootEntry is a UEFI boot entry (a Boot#### variable)
+type BootEntry struct {
+	Number      uint16
+	Description string
+	Active      bool
+
+	// InBootOrder is true if the entry is part of the BootOrder. `ListBootEntries` returns those first.
+	InBootOrder bool
+
+	// PartitionGUID is the unique GUID of the GPT partition which holds the EFI loader at `Loader`. Both are
+	// empty for entries which do not boot a file from a GPT partition, like network boot entries.
+	PartitionGUID string
+	Loader        string
+
+	// DevicePath is the textual representation of the full device path of the entry
+	DevicePath string
+}
+
+// ListBootEntries returns all UEFI boot entries. The entries of the BootOrder come first in their boot order,
+// followed by all other entries ordered by their number.
+func ListBootEntries() ([]BootEntry, error) {
+	c := efiCtx()
+	var bootOrder []uint16
+	if _, order, err := efivars.BootOrder.Get(c); err == nil {
+		bootOrder = order
+	} else if !errors.Is(err, efivario.ErrNotFound) {
+		return nil, fmt.Errorf("uefi: reading BootOrder: %w", err)
+	}
+	position := make(map[uint16]int, len(bootOrder))
+	for i, num := range bootOrder {
+		if _, ok := position[num]; !ok {
+			position[num] = i
+		}
+	}
+
+	bootIterator, err := efivars.BootIterator(c)
+	if err != nil {
+		return nil, fmt.Errorf("uefi: failed to get BootIterator: %w", err)
+	}
+	defer bootIterator.Close()
+	var ret []BootEntry
+	for bootIterator.Next() {
+		be := bootIterator.Value()
+		_, lo, err := be.Variable.Get(c)
+		if err != nil {
+			log.L().Warn("uefi: skipping unreadable boot entry", zap.String("efivar", fmt.Sprintf("Boot%04X", be.Index)), zap.Error(err))
+			continue
+		}
+		entry := newBootEntry(be.Index, lo)
+		_, entry.InBootOrder = position[be.Index]
+		ret = append(ret, entry)
+	}
+	if err := bootIterator.Err(); err != nil {
+		return nil, fmt.Errorf("uefi: BootIterator aborted: %w", err)
+	}
+
+	sort.Slice(ret, func(i, j int) bool {
+		pi, oki := position[ret[i].Number]
+		pj, okj := position[ret[j].Number]
+		switch {
+		case oki && okj:
+			return pi < pj
+		case oki != okj:
+			return oki
+		default:
+			return ret[i].Number < ret[j].Number
+		}
+	})
+	return ret, nil
+}
+
+func newBootEntry(num uint16, lo *efitypes.LoadOption) BootEntry {
+	ret := BootEntry{
+		Number:      num,
+		Description: lo.DescriptionString(),
+		Active:      lo.Attributes&efitypes.ActiveAttribute != 0,
+		DevicePath:  strings.Join(lo.FilePathList.AllText(), ""),
+	}
+	for _, dp := range lo.FilePathList {
+		switch p := dp.(type) {
+		case *efidevicepath.HardDriveMediaDevicePath:
+			if p.PartitionFormat == devicePathPartitionFormat && p.SignatureType == devicePathSignatureType {
+				ret.PartitionGUID = decodeGUID(p.PartitionSignature[:]).String()
+			}
+		case *efidevicepath.FilePathDevicePath:
+			ret.Loader = efireader.UTF16ZBytesToString(p.PathName)
+		}
+	}
+	return ret
+}
+
+// CreateBootEntry creates an active boot entry with `description` for the EFI loader at `loader` on the EFI
+// partition `part`, for example `\EFI\sonic\shimx64.efi`. Forward slashes are accepted as well. It does not add
+// the entry to the BootOrder (see `SetBootOrder` and `SetBootNext`). If an entry for the same loader exists already,
+// it is updated instead, and its number is returned.
+func CreateBootEntry(part *Device, loader, description string) (uint16, error) {
+	loader = strings.ReplaceAll(loader, "/", `\`)
+	if !strings.HasPrefix(loader, `\`) || strings.HasSuffix(loader, `\`) {
+		return 0, fmt.Errorf("%w: '%s'", ErrBootEntryInvalidLoader, loader)
+	}
+	partNum, disk, err := part.partitionNumberAndDisk()
+	if err != nil {
+		return 0, err
+	}
+	g, err := disk.readNativeGPT()
+	if err != nil {
+		return 0, fmt.Errorf("uefi: reading partition table: %w", err)
+	}
+	e, err := g.Entry(partNum)
+	if err != nil {
+		return 0, fmt.Errorf("uefi: %w", err)
+	}
+	value := encodeLoadOption(description, partNum, e, loader)
+
+	entries, err := ListBootEntries()
+	if err != nil {
+		return 0, err
+	}
+	num, err := freeBootEntryNumber(entries)
+	if err != nil {
+		return 0, err
+	}
+	for _, entry := range entries {
+		if strings.EqualFold(entry.PartitionGUID, e.UniqueGUID.String()) && strings.EqualFold(entry.Loader, loader) {
+			num = entry.Number
+			break
+		}
+	}
+
+	name := fmt.Sprintf("Boot%04X", num)
+	if err := efiCtx().Set(name, efivars.GlobalVariable, bootEntryAttrs, value); err != nil {
+		return 0, fmt.Errorf("uefi: writing %s: %w", name, err)
+	}
+	log.L().Info("uefi: successfully wrote boot entry", zap.String("efivar", name), zap.String("description", description), zap.String("loader", loader), zap.String("partition", part.Path))
+	return num, nil
+}
+
+func freeBootEntryNumber(entries []BootEntry) (uint16, error) {
+	used := make(map[uint16]bool, len(entries))
+	for _, entry := range entries {
+		used[entry.Number] = true
+	}
+	for num := 0; num <= 0xffff; num++ {
+		if !used[uint16(num)] {
+			return uint16(num), nil
+		}
+	}
+	return 0, ErrNoFreeBootEntry
+}
+
+// encodeLoadOption encodes an EFI_LOAD_OPTION for a loader on a GPT partition. Its device path consists of a
+// hard drive media node for the partition and a file path node for the loader.
+func encodeLoadOption(description string, partNum int, e *GPTEntry, loader string) []byte {
+	desc := utf16Z(description)
+	path := utf16Z(loader)
+
+	hd := make([]byte, devicePathHardDriveLength)
+	hd[0] = devicePathTypeMedia
+	hd[1] = devicePathSubTypeHardDrive
+	binary.LittleEndian.PutUint16(hd[2:4], devicePathHardDriveLength)
+	binary.LittleEndian.PutUint32(hd[4:8], uint32(partNum))
+	binary.LittleEndian.PutUint64(hd[8:16], e.FirstLBA)
+	binary.LittleEndian.PutUint64(hd[16:24], e.Sectors())
+	encodeGUID(hd[24:40], e.UniqueGUID)
+	hd[40] = devicePathPartitionFormat
+	hd[41] = devicePathSignatureType
+
+	fp := make([]byte, 4, 4+len(path))
+	fp[0] = devicePathTypeMedia
+	fp[1] = devicePathSubTypeFilePath
+	binary.LittleEndian.PutUint16(fp[2:4], uint16(4+len(path)))
+	fp = append(fp, path...)
+
+	filePathList := append(append(hd, fp...), devicePathEnd...)
+
+	ret := make([]byte, 6, 6+len(desc)+len(filePathList))
+	binary.LittleEndian.PutUint32(ret[0:4], uint32(efitypes.ActiveAttribute))
+	binary.LittleEndian.PutUint16(ret[4:6], uint16(len(filePathList)))
+	ret = append(ret, desc...)
+	return append(ret, filePathList...)
+}
+
+// utf16Z encodes `s` as a NUL terminated UTF-16LE string
+func utf16Z(s string) []byte {
+	u := utf16.Encode([]rune(s))
+	ret := make([]byte, 0, 2*len(u)+2)
+	for _, c := range u {
+		ret = binary.LittleEndian.AppendUint16(ret, c)
+	}
+	return append(ret, 0, 0)
+}
+
+// SetBootOrder replaces the BootOrder with `order`. All entries in it must exist.
+func SetBootOrder(order []uint16) error {
+	c := efiCtx()
+	for _, num := range order {
+		if _, _, err := efivars.Boot(num).Get(c); err != nil {
+			return fmt.Errorf("%w: Boot%04X: %w", ErrBootEntryNotFound, num, err)
+		}
+	}
+	if err := efivars.BootOrder.Set(c, order); err != nil {
+		return fmt.Errorf("uefi: setting BootOrder to '%s': %w", bootOrderString(order), err)
+	}
+	log.L().Info("uefi: successfully set EFI BootOrder variable", zap.String("BootOrder", bootOrderString(order)))
+	return nil
+}
+
+// MakeBootEntryDefault moves the boot entry `num` to the front of the BootOrder, and adds it if it is missing
+func MakeBootEntryDefault(num uint16) error {
+	_, bootOrder, err := efivars.BootOrder.Get(efiCtx())
+	if err != nil && !errors.Is(err, efivario.ErrNotFound) {
+		return fmt.Errorf("uefi: reading BootOrder: %w", err)
+	}
+	newBootOrder := []uint16{num}
+	for _, n := range bootOrder {
+		if n != num {
+			newBootOrder = append(newBootOrder, n)
+		}
+	}
+	return SetBootOrder(newBootOrder)
+}
+
+// DeleteBootEntry removes the boot entry `num` from the BootOrder, and deletes its variable
+func DeleteBootEntry(num uint16) error {
+	c := efiCtx()
+	_, bootOrder, err := efivars.BootOrder.Get(c)
+	if err != nil && !errors.Is(err, efivario.ErrNotFound) {
+		return fmt.Errorf("uefi: reading BootOrder: %w", err)
+	}
+	newBootOrder := make([]uint16, 0, len(bootOrder))
+	for _, n := range bootOrder {
+		if n != num {
+			newBootOrder = append(newBootOrder, n)
+		}
+	}
+	if len(newBootOrder) != len(bootOrder) {
+		if err := efivars.BootOrder.Set(c, newBootOrder); err != nil {
+			return fmt.Errorf("uefi: setting BootOrder to '%s': %w", bootOrderString(newBootOrder), err)
+		}
+	}
+	name := fmt.Sprintf("Boot%04X", num)
+	if err := c.Delete(name, efivars.GlobalVariable); err != nil {
+		if errors.Is(err, efivario.ErrNotFound) {
+			return fmt.Errorf("%w: %s", ErrBootEntryNotFound, name)
+		}
+		return fmt.Errorf("uefi: deleting %s: %w", name, err)
+	}
+	log.L().Info("uefi: successfully deleted boot entry", zap.String("efivar", name))
+	return nil
+}
+
+// DeleteStaleBootEntries deletes all boot entries which boot a loader from a GPT partition which does not exist
+// on any of the disks anymore. Entries which do not point to a GPT partition are kept. It fails without deleting
+// anything if the partition table of any disk cannot be read, as it cannot tell stale entries apart then.
+// It returns the numbers of the deleted entries.
+func (d Devices) DeleteStaleBootEntries() ([]uint16, error) {
+	partGUIDs := map[string]bool{}
+	for _, dev := range d {
+		if !dev.IsDisk() {
+			continue
+		}
+		g, err := dev.readNativeGPT()
+		if err != nil {
+			return nil, fmt.Errorf("uefi: reading partition table of %s: %w", dev.Path, err)
+		}
+		for i := range g.Entries {
+			if g.Entries[i].IsUsed() {
+				partGUIDs[g.Entries[i].UniqueGUID.String()] = true
+			}
+		}
+	}
+
+	entries, err := ListBootEntries()
+	if err != nil {
+		return nil, err
+	}
+	var ret []uint16
+	for _, entry := range entries {
+		if entry.PartitionGUID == "" || partGUIDs[strings.ToLower(entry.PartitionGUID)] {
+			continue
+		}
+		if err := DeleteBootEntry(entry.Number); err != nil {
+			return ret, err
+		}
+		ret = append(ret, entry.Number)
+	}
+	return ret, nil
+}
+
+func bootOrderString(order []uint16) string {
+	s := make([]string, 0, len(order))
+	for _, num := range order {
+		s = append(s, fmt.Sprintf("%04X", num))
+	}
+	return strings.Join(s, ",")
+}
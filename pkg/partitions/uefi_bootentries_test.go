@@ -0,0 +1,210 @@
+// Copyright 2023 Hedgehog
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package partitions
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/0x5a17ed/uefi/efi/efivars"
+	"go.githedgehog.com/dasboot/pkg/efivar"
+)
+
+// useFakeEFIVars replaces the EFI variables with `f` for the duration of the test
+func useFakeEFIVars(t *testing.T, f *efivar.Fake) {
+	old := efiVars
+	t.Cleanup(func() { efiVars = old })
+	efiVars = efivar.New(f, efivar.WithBackoff(time.Millisecond))
+}
+
+// newEFIDisk returns a disk image with an EFI system partition as partition 1
+func newEFIDisk(t *testing.T) (*Device, *GPTEntry) {
+	path := newGPTImage(t, 16)
+	g := readGPTImage(t, path)
+	e, err := g.Add(1, GPTPartTypeEFI, "EFI System", 4*1024*1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeGPTImage(t, path, g)
+	disk := &Device{
+		Uevent: Uevent{UeventDevtype: UeventDevtypeDisk},
+		Path:   path,
+	}
+	part := &Device{
+		Uevent:      Uevent{UeventDevtype: UeventDevtypePartition, UeventPartn: "1"},
+		GPTPartType: GPTPartTypeEFI,
+		Disk:        disk,
+	}
+	disk.Partitions = []*Device{part}
+	return part, e
+}
+
+func bootEntryNumbers(entries []BootEntry) []uint16 {
+	ret := make([]uint16, 0, len(entries))
+	for _, entry := range entries {
+		ret = append(ret, entry.Number)
+	}
+	return ret
+}
+
+func TestListBootEntries(t *testing.T) {
+	f := newFakeEFIVars(t, []uint16{0x03, 0x07})
+	if err := f.Set("Boot0001", efivars.GlobalVariable, efiBootEntryAttrs, shimBootContents[4:]); err != nil {
+		t.Fatal(err)
+	}
+	useFakeEFIVars(t, f)
+
+	entries, err := ListBootEntries()
+	if err != nil {
+		t.Fatalf("ListBootEntries() error = %v", err)
+	}
+	if got, want := bootEntryNumbers(entries), []uint16{0x03, 0x07, 0x01}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("ListBootEntries() = %04X, want %04X", got, want)
+	}
+	onie := entries[1]
+	if onie.Description != "ONIE: Open Network Install Environment" || !onie.Active || !onie.InBootOrder {
+		t.Errorf("ListBootEntries() ONIE entry = %#v", onie)
+	}
+	if onie.PartitionGUID != "691dfb9a-4753-4388-ad51-d4a1daac386a" || onie.Loader != `\EFI\onie\shimx64.efi` {
+		t.Errorf("ListBootEntries() ONIE entry points to %s %s", onie.PartitionGUID, onie.Loader)
+	}
+	if entries[2].InBootOrder {
+		t.Errorf("ListBootEntries() Boot0001 is not in the boot order")
+	}
+}
+
+func TestCreateBootEntry(t *testing.T) {
+	useNativeGPTBackend(t)
+	f := newFakeEFIVars(t, []uint16{0x00, 0x07})
+	useFakeEFIVars(t, f)
+	part, e := newEFIDisk(t)
+
+	num, err := CreateBootEntry(part, "/EFI/sonic/shimx64.efi", "SONiC-OS")
+	if err != nil {
+		t.Fatalf("CreateBootEntry() error = %v", err)
+	}
+	if num != 0x01 {
+		t.Errorf("CreateBootEntry() = %04X, want the first free number 0001", num)
+	}
+
+	// the firmware must be able to read it back
+	entries, err := ListBootEntries()
+	if err != nil {
+		t.Fatalf("ListBootEntries() error = %v", err)
+	}
+	var created *BootEntry
+	for i := range entries {
+		if entries[i].Number == num {
+			created = &entries[i]
+		}
+	}
+	if created == nil {
+		t.Fatalf("ListBootEntries() = %v, missing %04X", entries, num)
+	}
+	want := BootEntry{
+		Number:        num,
+		Description:   "SONiC-OS",
+		Active:        true,
+		PartitionGUID: e.UniqueGUID.String(),
+		Loader:        `\EFI\sonic\shimx64.efi`,
+		DevicePath:    created.DevicePath,
+	}
+	if !reflect.DeepEqual(*created, want) {
+		t.Errorf("created boot entry = %#v, want %#v", *created, want)
+	}
+
+	// creating it again updates the existing entry
+	again, err := CreateBootEntry(part, `\EFI\sonic\shimx64.efi`, "SONiC")
+	if err != nil {
+		t.Fatalf("CreateBootEntry() error = %v", err)
+	}
+	if again != num {
+		t.Errorf("CreateBootEntry() = %04X, want existing entry %04X", again, num)
+	}
+
+	if _, err := CreateBootEntry(part, "EFI/sonic/", "SONiC"); !errors.Is(err, ErrBootEntryInvalidLoader) {
+		t.Errorf("CreateBootEntry() error = %v, wantErrToBe %v", err, ErrBootEntryInvalidLoader)
+	}
+}
+
+func TestBootOrderManagement(t *testing.T) {
+	f := newFakeEFIVars(t, []uint16{0x03, 0x07, 0x05})
+	useFakeEFIVars(t, f)
+	bootOrder := func() []uint16 {
+		_, order, err := efivars.BootOrder.Get(f)
+		if err != nil {
+			t.Fatalf("BootOrder.Get() error = %v", err)
+		}
+		return order
+	}
+
+	if err := SetBootOrder([]uint16{0x07, 0x08}); !errors.Is(err, ErrBootEntryNotFound) {
+		t.Errorf("SetBootOrder() error = %v, wantErrToBe %v", err, ErrBootEntryNotFound)
+	}
+	if err := MakeBootEntryDefault(0x05); err != nil {
+		t.Fatalf("MakeBootEntryDefault() error = %v", err)
+	}
+	if got, want := bootOrder(), []uint16{0x05, 0x03, 0x07}; !reflect.DeepEqual(got, want) {
+		t.Errorf("BootOrder = %04X, want %04X", got, want)
+	}
+
+	if err := DeleteBootEntry(0x03); err != nil {
+		t.Fatalf("DeleteBootEntry() error = %v", err)
+	}
+	if got, want := bootOrder(), []uint16{0x05, 0x07}; !reflect.DeepEqual(got, want) {
+		t.Errorf("BootOrder = %04X, want %04X", got, want)
+	}
+	if _, ok := f.Value("Boot0003", efivars.GlobalVariable); ok {
+		t.Errorf("Boot0003 was not deleted")
+	}
+	if err := DeleteBootEntry(0x03); !errors.Is(err, ErrBootEntryNotFound) {
+		t.Errorf("DeleteBootEntry() error = %v, wantErrToBe %v", err, ErrBootEntryNotFound)
+	}
+}
+
+func TestDevices_DeleteStaleBootEntries(t *testing.T) {
+	useNativeGPTBackend(t)
+	f := newFakeEFIVars(t, []uint16{0x03, 0x07})
+	useFakeEFIVars(t, f)
+	part, _ := newEFIDisk(t)
+	num, err := CreateBootEntry(part, `\EFI\sonic\shimx64.efi`, "SONiC-OS")
+	if err != nil {
+		t.Fatalf("CreateBootEntry() error = %v", err)
+	}
+
+	// the ONIE and shim entries point to partitions which are not on our disk
+	deleted, err := Devices{part.Disk, part}.DeleteStaleBootEntries()
+	if err != nil {
+		t.Fatalf("Devices.DeleteStaleBootEntries() error = %v", err)
+	}
+	if want := []uint16{0x03, 0x07}; !reflect.DeepEqual(deleted, want) {
+		t.Errorf("Devices.DeleteStaleBootEntries() = %04X, want %04X", deleted, want)
+	}
+	entries, err := ListBootEntries()
+	if err != nil {
+		t.Fatalf("ListBootEntries() error = %v", err)
+	}
+	if got := bootEntryNumbers(entries); !reflect.DeepEqual(got, []uint16{num}) {
+		t.Errorf("ListBootEntries() = %04X, want %04X", got, []uint16{num})
+	}
+
+	// without a readable partition table nothing can be considered stale
+	SetGPTBackend(GPTBackendSgdisk)
+	if _, err := (Devices{part.Disk, part}).DeleteStaleBootEntries(); !errors.Is(err, errNativeGPTUnavailable) {
+		t.Errorf("Devices.DeleteStaleBootEntries() error = %v, wantErrToBe %v", err, errNativeGPTUnavailable)
+	}
+}
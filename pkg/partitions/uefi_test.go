@@ -19,13 +19,14 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"reflect"
+	"syscall"
 	"testing"
+	"time"
 
-	efiguid "github.com/0x5a17ed/uefi/efi/efiguid"
 	"github.com/0x5a17ed/uefi/efi/efivario"
 	"github.com/0x5a17ed/uefi/efi/efivars"
-	"github.com/golang/mock/gomock"
-	"go.githedgehog.com/dasboot/test/mock/mockuefi"
+	"go.githedgehog.com/dasboot/pkg/efivar"
 )
 
 // contents of /sys/firmware/efi/efivars/Boot0007-8be4df61-93ca-11d2-aa0d-00e098032b8c
@@ -45,421 +46,193 @@ var onieBootContents = []byte{
 	0x00, 0x00, 0x7f, 0xff, 0x04, 0x00,
 }
 
-func TestMakeONIEDefaultBootEntryAndCleanup(t *testing.T) {
-	// contents of /sys/firmware/efi/efivars/Boot0003-8be4df61-93ca-11d2-aa0d-00e098032b8c
-	// which is the shim boot entry a local Arch Linux installation (definitely not ONIE)
-	shimBootContents := []byte{
-		0x07, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x5e, 0x00, 0x53, 0x00, 0x68, 0x00, 0x69, 0x00,
-		0x6d, 0x00, 0x00, 0x00, 0x04, 0x01, 0x2a, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00, 0x08, 0x00, 0x00,
-		0x00, 0x00, 0x00, 0x00, 0x00, 0x20, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x87, 0x16, 0xc4, 0x47,
-		0xfd, 0x67, 0xac, 0x4b, 0x99, 0x94, 0x81, 0x5d, 0x5c, 0x01, 0x6b, 0x65, 0x02, 0x02, 0x04, 0x04,
-		0x30, 0x00, 0x5c, 0x00, 0x45, 0x00, 0x46, 0x00, 0x49, 0x00, 0x5c, 0x00, 0x73, 0x00, 0x68, 0x00,
-		0x69, 0x00, 0x6d, 0x00, 0x5c, 0x00, 0x73, 0x00, 0x68, 0x00, 0x69, 0x00, 0x6d, 0x00, 0x78, 0x00,
-		0x36, 0x00, 0x34, 0x00, 0x2e, 0x00, 0x65, 0x00, 0x66, 0x00, 0x69, 0x00, 0x00, 0x00, 0x7f, 0xff,
-		0x04, 0x00,
-	}
+// contents of /sys/firmware/efi/efivars/Boot0003-8be4df61-93ca-11d2-aa0d-00e098032b8c
+// which is the shim boot entry a local Arch Linux installation (definitely not ONIE)
+var shimBootContents = []byte{
+	0x07, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x5e, 0x00, 0x53, 0x00, 0x68, 0x00, 0x69, 0x00,
+	0x6d, 0x00, 0x00, 0x00, 0x04, 0x01, 0x2a, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00, 0x08, 0x00, 0x00,
+	0x00, 0x00, 0x00, 0x00, 0x00, 0x20, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x87, 0x16, 0xc4, 0x47,
+	0xfd, 0x67, 0xac, 0x4b, 0x99, 0x94, 0x81, 0x5d, 0x5c, 0x01, 0x6b, 0x65, 0x02, 0x02, 0x04, 0x04,
+	0x30, 0x00, 0x5c, 0x00, 0x45, 0x00, 0x46, 0x00, 0x49, 0x00, 0x5c, 0x00, 0x73, 0x00, 0x68, 0x00,
+	0x69, 0x00, 0x6d, 0x00, 0x5c, 0x00, 0x73, 0x00, 0x68, 0x00, 0x69, 0x00, 0x6d, 0x00, 0x78, 0x00,
+	0x36, 0x00, 0x34, 0x00, 0x2e, 0x00, 0x65, 0x00, 0x66, 0x00, 0x69, 0x00, 0x00, 0x00, 0x7f, 0xff,
+	0x04, 0x00,
+}
 
+// efiBootEntryAttrs are the attributes of all boot entries and the BootOrder
+const efiBootEntryAttrs = efivario.BootServiceAccess | efivario.RuntimeAccess | efivario.NonVolatile
+
+func TestMakeONIEDefaultBootEntryAndCleanup(t *testing.T) {
 	errSetFailed := errors.New("EFI Set() failed")
 	errBootOrderGetFailed := errors.New("EFI BootOrder.Get() failed")
-	errGetBootCurrentFailed := errors.New("EFI BootCurrent.Get() failed")
 	errGetBootXXXXFailed := errors.New("EFI BootXXXX.Get() failed")
+	errDeleteFailed := errors.New("EFI Delete() failed")
+
+	wd, err := os.Getwd()
+	if err != nil {
+		panic(err)
+	}
 
 	tests := []struct {
-		name        string
-		wantErr     bool
-		wantErrToBe error
-		pre         func(t *testing.T, c *mockuefi.MockContext)
+		name          string
+		bootOrder     []uint16
+		osReleasePath string
+		pre           func(t *testing.T, f *efivar.Fake)
+		wantBootOrder []uint16
+		wantDeleted   []string
+		wantErr       bool
+		wantErrToBe   error
 	}{
 		{
-			name: "success without adjustments",
-			pre: func(t *testing.T, c *mockuefi.MockContext) {
-				c.EXPECT().GetSizeHint(gomock.Eq("BootCurrent"), gomock.Eq(efivars.GlobalVariable)).Times(1).
-					Return(int64(2), nil)
-				c.EXPECT().Get(gomock.Eq("BootCurrent"), gomock.Eq(efivars.GlobalVariable), gomock.Eq([]byte{0, 0})).Times(1).
-					DoAndReturn(func(name string, guid efiguid.GUID, out []byte) (efivario.Attributes, int, error) {
-						// contents of BootCurrent are 6 bytes:
-						// - first 4 bytes are Attributes, just return them directly
-						// - last two bytes are little endian int16
-						// the Get function sets it to the `out` variable
-						// []byte{0x06, 0x00, 0x00, 0x00, 0x07, 0x00}
-						copy(out, []byte{0x07, 0x00})
-						return efivario.BootServiceAccess | efivario.RuntimeAccess, 2, nil
-					})
-
-				// Boot0007 - returns `onieBootContents`
-				c.EXPECT().GetSizeHint(gomock.Eq("Boot0007"), gomock.Eq(efivars.GlobalVariable)).Times(1).
-					Return(int64(len(onieBootContents)-4), nil)
-				c.EXPECT().Get(gomock.Eq("Boot0007"), gomock.Eq(efivars.GlobalVariable), gomock.Eq(make([]byte, len(onieBootContents)-4))).Times(1).
-					DoAndReturn(func(name string, guid efiguid.GUID, out []byte) (efivario.Attributes, int, error) {
-						copy(out, onieBootContents[4:])
-						return efivario.BootServiceAccess | efivario.RuntimeAccess | efivario.NonVolatile, len(onieBootContents) - 4, nil
-					})
-
-				// BootOrder - returns `bootOrderContents`
-				bootOrderContents := []byte{
-					0x07, 0x00, 0x00, 0x00, 0x07, 0x00, 0x0b, 0x00, 0x00, 0x00, 0x01, 0x00, 0x06, 0x00, 0x02, 0x00,
-					0x03, 0x00, 0x04, 0x00, 0x05, 0x00, 0x08, 0x00, 0x09, 0x00, 0x0a, 0x00,
-				}
-				c.EXPECT().GetSizeHint(gomock.Eq("BootOrder"), gomock.Eq(efivars.GlobalVariable)).Times(1).
-					Return(int64(len(bootOrderContents)-4), nil)
-				c.EXPECT().Get(gomock.Eq("BootOrder"), gomock.Eq(efivars.GlobalVariable), gomock.Eq(make([]byte, len(bootOrderContents)-4))).Times(1).
-					DoAndReturn(func(name string, guid efiguid.GUID, out []byte) (efivario.Attributes, int, error) {
-						copy(out, bootOrderContents[4:])
-						return efivario.BootServiceAccess | efivario.RuntimeAccess | efivario.NonVolatile, len(bootOrderContents) - 4, nil
-					})
-			},
-			wantErr: false,
+			name:          "success without adjustments",
+			bootOrder:     []uint16{0x07, 0x0b, 0x01, 0x00},
+			wantBootOrder: []uint16{0x07, 0x0b, 0x01, 0x00},
 		},
 		{
-			name: "success needing adjustments",
-			pre: func(t *testing.T, c *mockuefi.MockContext) {
-				// BootCurrent - returns 7
-				c.EXPECT().GetSizeHint(gomock.Eq("BootCurrent"), gomock.Eq(efivars.GlobalVariable)).Times(1).
-					Return(int64(2), nil)
-				c.EXPECT().Get(gomock.Eq("BootCurrent"), gomock.Eq(efivars.GlobalVariable), gomock.Eq([]byte{0, 0})).Times(1).
-					DoAndReturn(func(name string, guid efiguid.GUID, out []byte) (efivario.Attributes, int, error) {
-						// contents of BootCurrent are 6 bytes:
-						// - first 4 bytes are Attributes, just return them directly
-						// - last two bytes are little endian int16
-						// the Get function sets it to the `out` variable
-						// []byte{0x06, 0x00, 0x00, 0x00, 0x07, 0x00}
-						copy(out, []byte{0x07, 0x00})
-						return efivario.BootServiceAccess | efivario.RuntimeAccess, 2, nil
-					})
-
-				// Boot0007 - returns `onieBootContents`
-				c.EXPECT().GetSizeHint(gomock.Eq("Boot0007"), gomock.Eq(efivars.GlobalVariable)).Times(1).
-					Return(int64(len(onieBootContents)-4), nil)
-				c.EXPECT().Get(gomock.Eq("Boot0007"), gomock.Eq(efivars.GlobalVariable), gomock.Eq(make([]byte, len(onieBootContents)-4))).Times(1).
-					DoAndReturn(func(name string, guid efiguid.GUID, out []byte) (efivario.Attributes, int, error) {
-						copy(out, onieBootContents[4:])
-						return efivario.BootServiceAccess | efivario.RuntimeAccess | efivario.NonVolatile, len(onieBootContents) - 4, nil
-					})
-
-				// BootOrder - returns `bootOrderContents`
-				bootOrderContents := []byte{
-					0x07, 0x00, 0x00, 0x00, 0x0b, 0x00, 0x01, 0x00, 0x00, 0x00, 0x06, 0x00, 0x07, 0x00, 0x02, 0x00,
-					0x03, 0x00, 0x04, 0x00, 0x05, 0x00, 0x08, 0x00, 0x09, 0x00, 0x0a, 0x00,
-				}
-				// the above boot order contents will need to remove 0b, 01, 00, 06
-				c.EXPECT().GetSizeHint(gomock.Eq("BootOrder"), gomock.Eq(efivars.GlobalVariable)).Times(1).
-					Return(int64(len(bootOrderContents)-4), nil)
-				c.EXPECT().Get(gomock.Eq("BootOrder"), gomock.Eq(efivars.GlobalVariable), gomock.Eq(make([]byte, len(bootOrderContents)-4))).Times(1).
-					DoAndReturn(func(name string, guid efiguid.GUID, out []byte) (efivario.Attributes, int, error) {
-						copy(out, bootOrderContents[4:])
-						return efivario.BootServiceAccess | efivario.RuntimeAccess | efivario.NonVolatile, len(bootOrderContents) - 4, nil
-					})
-
-				// Set new expected BootOrder
-				expectedBootOrderContents := []byte{
-					0x07, 0x00, 0x02, 0x00, 0x03, 0x00, 0x04, 0x00, 0x05, 0x00, 0x08, 0x00, 0x09, 0x00, 0x0a, 0x00,
-				}
-				c.EXPECT().Set(
-					gomock.Eq("BootOrder"),
-					gomock.Eq(efivars.GlobalVariable),
-					gomock.Eq(efivario.BootServiceAccess|efivario.RuntimeAccess|efivario.NonVolatile),
-					gomock.Eq(expectedBootOrderContents),
-				).Times(1).
-					Return(nil)
-
-				// now we expect four deletes: 0b, 01, 00, 06
-				c.EXPECT().Delete(gomock.Eq("Boot000B"), gomock.Eq(efivars.GlobalVariable)).Times(1).Return(nil)
-				c.EXPECT().Delete(gomock.Eq("Boot0001"), gomock.Eq(efivars.GlobalVariable)).Times(1).Return(nil)
-				c.EXPECT().Delete(gomock.Eq("Boot0000"), gomock.Eq(efivars.GlobalVariable)).Times(1).Return(fmt.Errorf("ignored error"))
-				c.EXPECT().Delete(gomock.Eq("Boot0006"), gomock.Eq(efivars.GlobalVariable)).Times(1).Return(nil)
-			},
-			wantErr: false,
+			name:          "success needing adjustments",
+			bootOrder:     []uint16{0x0b, 0x01, 0x07, 0x00, 0x06},
+			wantBootOrder: []uint16{0x07, 0x00, 0x06},
+			wantDeleted:   []string{"Boot000B", "Boot0001"},
 		},
 		{
-			// no need to delete entries because ONIE is not part of the boot order
-			name: "success and no need to delete entries",
-			pre: func(t *testing.T, c *mockuefi.MockContext) {
-				// BootCurrent - returns 7
-				c.EXPECT().GetSizeHint(gomock.Eq("BootCurrent"), gomock.Eq(efivars.GlobalVariable)).Times(1).
-					Return(int64(2), nil)
-				c.EXPECT().Get(gomock.Eq("BootCurrent"), gomock.Eq(efivars.GlobalVariable), gomock.Eq([]byte{0, 0})).Times(1).
-					DoAndReturn(func(name string, guid efiguid.GUID, out []byte) (efivario.Attributes, int, error) {
-						// contents of BootCurrent are 6 bytes:
-						// - first 4 bytes are Attributes, just return them directly
-						// - last two bytes are little endian int16
-						// the Get function sets it to the `out` variable
-						// []byte{0x06, 0x00, 0x00, 0x00, 0x07, 0x00}
-						copy(out, []byte{0x07, 0x00})
-						return efivario.BootServiceAccess | efivario.RuntimeAccess, 2, nil
-					})
-
-				// Boot0007 - returns `onieBootContents`
-				c.EXPECT().GetSizeHint(gomock.Eq("Boot0007"), gomock.Eq(efivars.GlobalVariable)).Times(1).
-					Return(int64(len(onieBootContents)-4), nil)
-				c.EXPECT().Get(gomock.Eq("Boot0007"), gomock.Eq(efivars.GlobalVariable), gomock.Eq(make([]byte, len(onieBootContents)-4))).Times(1).
-					DoAndReturn(func(name string, guid efiguid.GUID, out []byte) (efivario.Attributes, int, error) {
-						copy(out, onieBootContents[4:])
-						return efivario.BootServiceAccess | efivario.RuntimeAccess | efivario.NonVolatile, len(onieBootContents) - 4, nil
-					})
-
-				// BootOrder - returns `bootOrderContents`
-				// this boot order is missing ONIE
-				bootOrderContents := []byte{
-					0x07, 0x00, 0x00, 0x00, 0x0b, 0x00, 0x01, 0x00, 0x00, 0x00, 0x06, 0x00, 0x02, 0x00,
-					0x03, 0x00, 0x04, 0x00, 0x05, 0x00, 0x08, 0x00, 0x09, 0x00, 0x0a, 0x00,
-				}
-				// the above boot order contents do not conain ONIE, so there must nothing being deleted
-				c.EXPECT().GetSizeHint(gomock.Eq("BootOrder"), gomock.Eq(efivars.GlobalVariable)).Times(1).
-					Return(int64(len(bootOrderContents)-4), nil)
-				c.EXPECT().Get(gomock.Eq("BootOrder"), gomock.Eq(efivars.GlobalVariable), gomock.Eq(make([]byte, len(bootOrderContents)-4))).Times(1).
-					DoAndReturn(func(name string, guid efiguid.GUID, out []byte) (efivario.Attributes, int, error) {
-						copy(out, bootOrderContents[4:])
-						return efivario.BootServiceAccess | efivario.RuntimeAccess | efivario.NonVolatile, len(bootOrderContents) - 4, nil
-					})
-
-				// Set new expected BootOrder
-				// this order will simply have ONIE prepended
-				expectedBootOrderContents := []byte{
-					0x07, 0x00, 0x0b, 0x00, 0x01, 0x00, 0x00, 0x00, 0x06, 0x00, 0x02, 0x00,
-					0x03, 0x00, 0x04, 0x00, 0x05, 0x00, 0x08, 0x00, 0x09, 0x00, 0x0a, 0x00,
-				}
-				c.EXPECT().Set(
-					gomock.Eq("BootOrder"),
-					gomock.Eq(efivars.GlobalVariable),
-					gomock.Eq(efivario.BootServiceAccess|efivario.RuntimeAccess|efivario.NonVolatile),
-					gomock.Eq(expectedBootOrderContents),
-				).Times(1).
-					Return(nil)
-			},
-			wantErr: false,
+			name:          "success and no need to delete entries",
+			bootOrder:     []uint16{0x0b, 0x01, 0x00},
+			wantBootOrder: []uint16{0x07, 0x0b, 0x01, 0x00},
 		},
 		{
-			name: "set BootOrder fails",
-			pre: func(t *testing.T, c *mockuefi.MockContext) {
-				// BootCurrent - returns 7
-				c.EXPECT().GetSizeHint(gomock.Eq("BootCurrent"), gomock.Eq(efivars.GlobalVariable)).Times(1).
-					Return(int64(2), nil)
-				c.EXPECT().Get(gomock.Eq("BootCurrent"), gomock.Eq(efivars.GlobalVariable), gomock.Eq([]byte{0, 0})).Times(1).
-					DoAndReturn(func(name string, guid efiguid.GUID, out []byte) (efivario.Attributes, int, error) {
-						// contents of BootCurrent are 6 bytes:
-						// - first 4 bytes are Attributes, just return them directly
-						// - last two bytes are little endian int16
-						// the Get function sets it to the `out` variable
-						// []byte{0x06, 0x00, 0x00, 0x00, 0x07, 0x00}
-						copy(out, []byte{0x07, 0x00})
-						return efivario.BootServiceAccess | efivario.RuntimeAccess, 2, nil
-					})
-
-				// Boot0007 - returns `onieBootContents`
-				c.EXPECT().GetSizeHint(gomock.Eq("Boot0007"), gomock.Eq(efivars.GlobalVariable)).Times(1).
-					Return(int64(len(onieBootContents)-4), nil)
-				c.EXPECT().Get(gomock.Eq("Boot0007"), gomock.Eq(efivars.GlobalVariable), gomock.Eq(make([]byte, len(onieBootContents)-4))).Times(1).
-					DoAndReturn(func(name string, guid efiguid.GUID, out []byte) (efivario.Attributes, int, error) {
-						copy(out, onieBootContents[4:])
-						return efivario.BootServiceAccess | efivario.RuntimeAccess | efivario.NonVolatile, len(onieBootContents) - 4, nil
-					})
-
-				// BootOrder - returns `bootOrderContents`
-				// this boot order is missing ONIE
-				bootOrderContents := []byte{
-					0x07, 0x00, 0x00, 0x00, 0x0b, 0x00, 0x01, 0x00, 0x00, 0x00, 0x06, 0x00, 0x02, 0x00,
-					0x03, 0x00, 0x04, 0x00, 0x05, 0x00, 0x08, 0x00, 0x09, 0x00, 0x0a, 0x00,
-				}
-				// the above boot order contents do not conain ONIE, so there must nothing being deleted
-				c.EXPECT().GetSizeHint(gomock.Eq("BootOrder"), gomock.Eq(efivars.GlobalVariable)).Times(1).
-					Return(int64(len(bootOrderContents)-4), nil)
-				c.EXPECT().Get(gomock.Eq("BootOrder"), gomock.Eq(efivars.GlobalVariable), gomock.Eq(make([]byte, len(bootOrderContents)-4))).Times(1).
-					DoAndReturn(func(name string, guid efiguid.GUID, out []byte) (efivario.Attributes, int, error) {
-						copy(out, bootOrderContents[4:])
-						return efivario.BootServiceAccess | efivario.RuntimeAccess | efivario.NonVolatile, len(bootOrderContents) - 4, nil
-					})
-
-				// Set new expected BootOrder
-				// this order will simply have ONIE prepended
-				expectedBootOrderContents := []byte{
-					0x07, 0x00, 0x0b, 0x00, 0x01, 0x00, 0x00, 0x00, 0x06, 0x00, 0x02, 0x00,
-					0x03, 0x00, 0x04, 0x00, 0x05, 0x00, 0x08, 0x00, 0x09, 0x00, 0x0a, 0x00,
-				}
-				c.EXPECT().Set(
-					gomock.Eq("BootOrder"),
-					gomock.Eq(efivars.GlobalVariable),
-					gomock.Eq(efivario.BootServiceAccess|efivario.RuntimeAccess|efivario.NonVolatile),
-					gomock.Eq(expectedBootOrderContents),
-				).Times(1).
-					Return(errSetFailed)
+			name:      "success with transient errors",
+			bootOrder: []uint16{0x0b, 0x07, 0x00},
+			pre: func(t *testing.T, f *efivar.Fake) {
+				f.Fail(efivar.OpGet, "BootOrder", syscall.EINTR, 1)
+				f.Fail(efivar.OpSet, "BootOrder", syscall.ENOSPC, 2)
 			},
-			wantErr:     true,
-			wantErrToBe: errSetFailed,
+			wantBootOrder: []uint16{0x07, 0x00},
+			wantDeleted:   []string{"Boot000B"},
 		},
 		{
-			name: "BootOrder returns empty",
-			pre: func(t *testing.T, c *mockuefi.MockContext) {
-				// BootCurrent - returns 7
-				c.EXPECT().GetSizeHint(gomock.Eq("BootCurrent"), gomock.Eq(efivars.GlobalVariable)).Times(1).
-					Return(int64(2), nil)
-				c.EXPECT().Get(gomock.Eq("BootCurrent"), gomock.Eq(efivars.GlobalVariable), gomock.Eq([]byte{0, 0})).Times(1).
-					DoAndReturn(func(name string, guid efiguid.GUID, out []byte) (efivario.Attributes, int, error) {
-						// contents of BootCurrent are 6 bytes:
-						// - first 4 bytes are Attributes, just return them directly
-						// - last two bytes are little endian int16
-						// the Get function sets it to the `out` variable
-						// []byte{0x06, 0x00, 0x00, 0x00, 0x07, 0x00}
-						copy(out, []byte{0x07, 0x00})
-						return efivario.BootServiceAccess | efivario.RuntimeAccess, 2, nil
-					})
-
-				// Boot0007 - returns `onieBootContents`
-				c.EXPECT().GetSizeHint(gomock.Eq("Boot0007"), gomock.Eq(efivars.GlobalVariable)).Times(1).
-					Return(int64(len(onieBootContents)-4), nil)
-				c.EXPECT().Get(gomock.Eq("Boot0007"), gomock.Eq(efivars.GlobalVariable), gomock.Eq(make([]byte, len(onieBootContents)-4))).Times(1).
-					DoAndReturn(func(name string, guid efiguid.GUID, out []byte) (efivario.Attributes, int, error) {
-						copy(out, onieBootContents[4:])
-						return efivario.BootServiceAccess | efivario.RuntimeAccess | efivario.NonVolatile, len(onieBootContents) - 4, nil
-					})
-
-				// BootOrder - returns empty
-				// the above boot order contents do not conain ONIE, so there must nothing being deleted
-				c.EXPECT().GetSizeHint(gomock.Eq("BootOrder"), gomock.Eq(efivars.GlobalVariable)).Times(1).
-					Return(int64(0), nil)
-				c.EXPECT().Get(gomock.Eq("BootOrder"), gomock.Eq(efivars.GlobalVariable), gomock.Eq(make([]byte, 0))).Times(1).
-					Return(efivario.BootServiceAccess|efivario.RuntimeAccess|efivario.NonVolatile, 0, nil)
+			name:      "deleting stale entries fails",
+			bootOrder: []uint16{0x0b, 0x07, 0x00},
+			pre: func(t *testing.T, f *efivar.Fake) {
+				f.Fail(efivar.OpDelete, "Boot000B", errDeleteFailed, 1)
 			},
-			wantErr:     true,
-			wantErrToBe: ErrEmptyBootOrder,
+			wantBootOrder: []uint16{0x07, 0x00},
 		},
 		{
-			name: "get BootOrder fails",
-			pre: func(t *testing.T, c *mockuefi.MockContext) {
-				// BootCurrent - returns 7
-				c.EXPECT().GetSizeHint(gomock.Eq("BootCurrent"), gomock.Eq(efivars.GlobalVariable)).Times(1).
-					Return(int64(2), nil)
-				c.EXPECT().Get(gomock.Eq("BootCurrent"), gomock.Eq(efivars.GlobalVariable), gomock.Eq([]byte{0, 0})).Times(1).
-					DoAndReturn(func(name string, guid efiguid.GUID, out []byte) (efivario.Attributes, int, error) {
-						// contents of BootCurrent are 6 bytes:
-						// - first 4 bytes are Attributes, just return them directly
-						// - last two bytes are little endian int16
-						// the Get function sets it to the `out` variable
-						// []byte{0x06, 0x00, 0x00, 0x00, 0x07, 0x00}
-						copy(out, []byte{0x07, 0x00})
-						return efivario.BootServiceAccess | efivario.RuntimeAccess, 2, nil
-					})
-
-				// Boot0007 - returns `onieBootContents`
-				c.EXPECT().GetSizeHint(gomock.Eq("Boot0007"), gomock.Eq(efivars.GlobalVariable)).Times(1).
-					Return(int64(len(onieBootContents)-4), nil)
-				c.EXPECT().Get(gomock.Eq("Boot0007"), gomock.Eq(efivars.GlobalVariable), gomock.Eq(make([]byte, len(onieBootContents)-4))).Times(1).
-					DoAndReturn(func(name string, guid efiguid.GUID, out []byte) (efivario.Attributes, int, error) {
-						copy(out, onieBootContents[4:])
-						return efivario.BootServiceAccess | efivario.RuntimeAccess | efivario.NonVolatile, len(onieBootContents) - 4, nil
-					})
-
-				// BootOrder - returns error
-				// the above boot order contents do not conain ONIE, so there must nothing being deleted
-				c.EXPECT().GetSizeHint(gomock.Eq("BootOrder"), gomock.Eq(efivars.GlobalVariable)).Times(1).
-					Return(int64(0), nil)
-				c.EXPECT().Get(gomock.Eq("BootOrder"), gomock.Eq(efivars.GlobalVariable), gomock.Eq(make([]byte, 0))).Times(1).
-					Return(efivario.Attributes(0), 0, errBootOrderGetFailed)
+			name:      "set BootOrder fails",
+			bootOrder: []uint16{0x0b, 0x01, 0x00},
+			pre: func(t *testing.T, f *efivar.Fake) {
+				f.Fail(efivar.OpSet, "BootOrder", errSetFailed, 1)
 			},
-			wantErr:     true,
-			wantErrToBe: errBootOrderGetFailed,
+			wantBootOrder: []uint16{0x0b, 0x01, 0x00},
+			wantErr:       true,
+			wantErrToBe:   errSetFailed,
 		},
 		{
-			name: "get BootOrder fails",
-			pre: func(t *testing.T, c *mockuefi.MockContext) {
-				// BootCurrent - returns 7
-				c.EXPECT().GetSizeHint(gomock.Eq("BootCurrent"), gomock.Eq(efivars.GlobalVariable)).Times(1).
-					Return(int64(2), nil)
-				c.EXPECT().Get(gomock.Eq("BootCurrent"), gomock.Eq(efivars.GlobalVariable), gomock.Eq([]byte{0, 0})).Times(1).
-					DoAndReturn(func(name string, guid efiguid.GUID, out []byte) (efivario.Attributes, int, error) {
-						// contents of BootCurrent are 6 bytes:
-						// - first 4 bytes are Attributes, just return them directly
-						// - last two bytes are little endian int16
-						// the Get function sets it to the `out` variable
-						// []byte{0x06, 0x00, 0x00, 0x00, 0x07, 0x00}
-						copy(out, []byte{0x07, 0x00})
-						return efivario.BootServiceAccess | efivario.RuntimeAccess, 2, nil
-					})
-
-				// Boot0007 - returns `shimBootContents`
-				c.EXPECT().GetSizeHint(gomock.Eq("Boot0007"), gomock.Eq(efivars.GlobalVariable)).Times(1).
-					Return(int64(len(shimBootContents)-4), nil)
-				c.EXPECT().Get(gomock.Eq("Boot0007"), gomock.Eq(efivars.GlobalVariable), gomock.Eq(make([]byte, len(shimBootContents)-4))).Times(1).
-					DoAndReturn(func(name string, guid efiguid.GUID, out []byte) (efivario.Attributes, int, error) {
-						copy(out, shimBootContents[4:])
-						return efivario.BootServiceAccess | efivario.RuntimeAccess | efivario.NonVolatile, len(shimBootContents) - 4, nil
-					})
-			},
-			wantErr:     true,
-			wantErrToBe: ErrNotBootedIntoONIE,
+			name:          "BootOrder returns empty",
+			bootOrder:     []uint16{},
+			wantBootOrder: []uint16{},
+			wantErr:       true,
+			wantErrToBe:   ErrEmptyBootOrder,
 		},
 		{
-			name: "get BootXXXX fails",
-			pre: func(t *testing.T, c *mockuefi.MockContext) {
-				// BootCurrent - returns 7
-				c.EXPECT().GetSizeHint(gomock.Eq("BootCurrent"), gomock.Eq(efivars.GlobalVariable)).Times(1).
-					Return(int64(2), nil)
-				c.EXPECT().Get(gomock.Eq("BootCurrent"), gomock.Eq(efivars.GlobalVariable), gomock.Eq([]byte{0, 0})).Times(1).
-					DoAndReturn(func(name string, guid efiguid.GUID, out []byte) (efivario.Attributes, int, error) {
-						// contents of BootCurrent are 6 bytes:
-						// - first 4 bytes are Attributes, just return them directly
-						// - last two bytes are little endian int16
-						// the Get function sets it to the `out` variable
-						// []byte{0x06, 0x00, 0x00, 0x00, 0x07, 0x00}
-						copy(out, []byte{0x07, 0x00})
-						return efivario.BootServiceAccess | efivario.RuntimeAccess, 2, nil
-					})
-
-				// Boot0007 - returns error
-				c.EXPECT().GetSizeHint(gomock.Eq("Boot0007"), gomock.Eq(efivars.GlobalVariable)).Times(1).
-					Return(int64(len(shimBootContents)-4), nil)
-				c.EXPECT().Get(gomock.Eq("Boot0007"), gomock.Eq(efivars.GlobalVariable), gomock.Eq(make([]byte, len(shimBootContents)-4))).Times(1).
-					Return(efivario.Attributes(0), 0, errGetBootXXXXFailed)
+			name:      "get BootOrder fails",
+			bootOrder: []uint16{0x0b, 0x07},
+			pre: func(t *testing.T, f *efivar.Fake) {
+				f.Fail(efivar.OpGet, "BootOrder", errBootOrderGetFailed, 1)
 			},
-			wantErr:     true,
-			wantErrToBe: errGetBootXXXXFailed,
+			wantBootOrder: []uint16{0x0b, 0x07},
+			wantErr:       true,
+			wantErrToBe:   errBootOrderGetFailed,
 		},
 		{
-			name: "get BootCurrent fails",
-			pre: func(t *testing.T, c *mockuefi.MockContext) {
-				// BootCurrent - returns error
-				c.EXPECT().GetSizeHint(gomock.Eq("BootCurrent"), gomock.Eq(efivars.GlobalVariable)).Times(1).
-					Return(int64(2), nil)
-				c.EXPECT().Get(gomock.Eq("BootCurrent"), gomock.Eq(efivars.GlobalVariable), gomock.Eq([]byte{0, 0})).Times(1).
-					Return(efivario.Attributes(0), 0, errGetBootCurrentFailed)
+			name:      "get BootXXXX fails",
+			bootOrder: []uint16{0x0b, 0x07},
+			pre: func(t *testing.T, f *efivar.Fake) {
+				f.Fail(efivar.OpGet, "Boot0007", errGetBootXXXXFailed, 1)
 			},
-			wantErr:     true,
-			wantErrToBe: errGetBootCurrentFailed,
+			wantBootOrder: []uint16{0x0b, 0x07},
+			wantErr:       true,
+			wantErrToBe:   ErrBootEntryNotFound,
+		},
+		{
+			name:          "not booted into ONIE",
+			bootOrder:     []uint16{0x0b, 0x07},
+			osReleasePath: filepath.Join(wd, "testdata", "IsBootedIntoONIE", "sonic"),
+			wantBootOrder: []uint16{0x0b, 0x07},
+			wantErr:       true,
+			wantErrToBe:   ErrNotBootedIntoONIE,
 		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			// TODO: skipping tests now because rewriting them is currently impossible with the gomock framework
-			// gomock is now being maintained by uber at https://github.com/uber-go/mock
-			// However, even though they have added support for generics, the mockgen for VariableNameIterator still fails
-			// Rework this once this is fixed and working.
-			t.Skipf("Skipping %s until mockgen properyly supports generics for VariableNameIterator...", tt.name)
+			oldOsReleasePath := osReleasePath
+			defer func() {
+				osReleasePath = oldOsReleasePath
+			}()
+			osReleasePath = filepath.Join(wd, "testdata", "IsBootedIntoONIE", "success")
+			if tt.osReleasePath != "" {
+				osReleasePath = tt.osReleasePath
+			}
 
-			ctrl := gomock.NewController(t)
-			defer ctrl.Finish()
-			c := mockuefi.NewMockContext(ctrl)
-			oldEfiCtx := efiCtx
+			f := newFakeEFIVars(t, tt.bootOrder)
+			oldEFIVars := efiVars
 			defer func() {
-				efiCtx = oldEfiCtx
+				efiVars = oldEFIVars
 			}()
-			efiCtx = c
+			efiVars = efivar.New(f, efivar.WithBackoff(time.Millisecond))
 			if tt.pre != nil {
-				tt.pre(t, c)
+				tt.pre(t, f)
 			}
+
 			err := MakeONIEDefaultBootEntryAndCleanup()
 			if (err != nil) != tt.wantErr {
-				t.Errorf("GetONIEBootEntry() error = %v, wantErr %v", err, tt.wantErr)
+				t.Errorf("MakeONIEDefaultBootEntryAndCleanup() error = %v, wantErr %v", err, tt.wantErr)
 				return
 			}
 			if err != nil && tt.wantErr && tt.wantErrToBe != nil {
 				if !errors.Is(err, tt.wantErrToBe) {
-					t.Errorf("Device.Delete() error = %v, wantErrToBe %v", err, tt.wantErrToBe)
+					t.Errorf("MakeONIEDefaultBootEntryAndCleanup() error = %v, wantErrToBe %v", err, tt.wantErrToBe)
 					return
 				}
 			}
+
+			_, bootOrder, err := efivars.BootOrder.Get(f)
+			if err != nil {
+				t.Fatalf("BootOrder.Get() error = %v", err)
+			}
+			if len(bootOrder) != len(tt.wantBootOrder) || (len(bootOrder) > 0 && !reflect.DeepEqual([]uint16(bootOrder), tt.wantBootOrder)) {
+				t.Errorf("BootOrder = %v, want %v", bootOrder, tt.wantBootOrder)
+			}
+			for _, name := range tt.wantDeleted {
+				if _, ok := f.Value(name, efivars.GlobalVariable); ok {
+					t.Errorf("%s was not deleted", name)
+				}
+			}
 		})
 	}
 }
 
+// newFakeEFIVars returns a fake with an ONIE boot entry Boot0007, and shim boot entries
+// for all other entries in `bootOrder`
+func newFakeEFIVars(t *testing.T, bootOrder []uint16) *efivar.Fake {
+	f := efivar.NewFake()
+	if err := f.Set("Boot0007", efivars.GlobalVariable, efiBootEntryAttrs, onieBootContents[4:]); err != nil {
+		t.Fatal(err)
+	}
+	for _, num := range bootOrder {
+		if num == 0x07 {
+			continue
+		}
+		if err := f.Set(fmt.Sprintf("Boot%04X", num), efivars.GlobalVariable, efiBootEntryAttrs, shimBootContents[4:]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := efivars.BootOrder.Set(f, bootOrder); err != nil {
+		t.Fatal(err)
+	}
+	return f
+}
+
 func TestIsBootedIntoONIE(t *testing.T) {
 	wd, err := os.Getwd()
 	if err != nil {
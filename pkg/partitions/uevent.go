@@ -52,6 +52,12 @@ var (
 	ErrInvalidUevent      = errors.New("uevent: invalid block uevent object")
 	ErrNotABlockDevice    = errors.New("uevent: not a block device")
 	ErrStatNotFromSyscall = errors.New("uevent: stat not from syscall")
+
+	// ErrNotAPartition will be returned if a partition number was requested for a device which is not a partition
+	ErrNotAPartition = errors.New("uevent: not a partition")
+
+	// ErrInvalidPartitionNumber will be returned if the partition number could not be parsed or is out of range
+	ErrInvalidPartitionNumber = errors.New("uevent: invalid partition number")
 )
 
 // internal constants for accessing the uevent map
@@ -98,16 +104,90 @@ func (u Uevent) IsPartition() bool {
 	return val == UeventDevtypePartition
 }
 
-func (u Uevent) GetPartitionNumber() int {
-	val, ok := u[UeventPartn]
+// GetPartitionNumber returns the partition number of the partition. It is being read from the PARTN
+// entry. If that is absent (which is the case on some older kernels), it is being derived from the
+// DEVNAME entry (e.g. "sda3", "nvme0n1p3" or "mmcblk0p3") if the device is a partition.
+func (u Uevent) GetPartitionNumber() (int, error) {
+	devtype, hasDevtype := u[UeventDevtype]
+	if hasDevtype && devtype != UeventDevtypePartition {
+		return 0, ErrNotAPartition
+	}
+
+	if val, ok := u[UeventPartn]; ok {
+		return parsePartitionNumber(val)
+	}
+
+	// we can only derive it from the device name if we know that this is a partition
+	if !hasDevtype {
+		return 0, fmt.Errorf("%w: neither %s nor %s present", ErrInvalidUevent, UeventPartn, UeventDevtype)
+	}
+	devname, ok := u[UeventDevname]
 	if !ok {
-		return -1
+		return 0, fmt.Errorf("%w: neither %s nor %s present", ErrInvalidUevent, UeventPartn, UeventDevname)
 	}
-	ret, err := strconv.ParseUint(val, 0, 8)
+	return partitionNumberFromDevname(devname)
+}
+
+func parsePartitionNumber(val string) (int, error) {
+	ret, err := strconv.ParseUint(val, 10, 32)
 	if err != nil {
-		return -1
+		return 0, fmt.Errorf("%w: '%s': %w", ErrInvalidPartitionNumber, val, err)
+	}
+	if ret == 0 {
+		return 0, fmt.Errorf("%w: '%s'", ErrInvalidPartitionNumber, val)
+	}
+	return int(ret), nil
+}
+
+// partitionNumberFromDevname derives the partition number from a device name. Disks whose names end
+// in a digit (nvme0n1, mmcblk0, loop0) separate the partition number with a "p".
+func partitionNumberFromDevname(devname string) (int, error) {
+	name := filepath.Base(devname)
+	i := len(name)
+	for i > 0 && name[i-1] >= '0' && name[i-1] <= '9' {
+		i--
+	}
+	if i == len(name) || i == 0 {
+		return 0, fmt.Errorf("%w: cannot derive from %s '%s'", ErrInvalidPartitionNumber, UeventDevname, devname)
+	}
+	prefix := name[:i]
+	if prefix[len(prefix)-1] == 'p' && len(prefix) > 1 && prefix[len(prefix)-2] >= '0' && prefix[len(prefix)-2] <= '9' {
+		return parsePartitionNumber(name[i:])
+	}
+	last := prefix[len(prefix)-1]
+	if last < 'a' || last > 'z' {
+		return 0, fmt.Errorf("%w: cannot derive from %s '%s'", ErrInvalidPartitionNumber, UeventDevname, devname)
+	}
+	return parsePartitionNumber(name[i:])
+}
+
+// PartitionDeviceName returns the device name of partition `partNum` on the disk with the device name `disk`.
+// Disks whose names end in a digit (nvme0n1, mmcblk0, loop0) separate the partition number with a "p".
+func PartitionDeviceName(disk string, partNum int) string {
+	if disk == "" {
+		return ""
+	}
+	if last := disk[len(disk)-1]; last >= '0' && last <= '9' {
+		return fmt.Sprintf("%sp%d", disk, partNum)
+	}
+	return fmt.Sprintf("%s%d", disk, partNum)
+}
+
+// isAuxiliaryDevname returns true for block devices which are not a disk that we can partition, even though
+// the kernel reports them as one: the hardware boot, RPMB and general purpose areas of eMMC devices
+// (mmcblk0boot0, mmcblk0rpmb, mmcblk0gp0), and the per controller paths of multipath NVMe namespaces (nvme0c0n1).
+func isAuxiliaryDevname(devname string) bool {
+	name := filepath.Base(devname)
+	switch {
+	case strings.HasPrefix(name, "mmcblk"):
+		rest := strings.TrimLeft(strings.TrimPrefix(name, "mmcblk"), "0123456789")
+		return strings.HasPrefix(rest, "boot") || strings.HasPrefix(rest, "rpmb") || strings.HasPrefix(rest, "gp")
+	case strings.HasPrefix(name, "nvme"):
+		rest := strings.TrimLeft(strings.TrimPrefix(name, "nvme"), "0123456789")
+		return strings.HasPrefix(rest, "c")
+	default:
+		return false
 	}
-	return int(ret)
 }
 
 func (u Uevent) GetPartitionName() string {
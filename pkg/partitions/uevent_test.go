@@ -425,9 +425,10 @@ func TestUevent_IsPartition(t *testing.T) {
 
 func TestUevent_GetPartitionNumber(t *testing.T) {
 	tests := []struct {
-		name string
-		u    Uevent
-		want int
+		name    string
+		u       Uevent
+		want    int
+		wantErr error
 	}{
 		{
 			name: "success",
@@ -437,28 +438,95 @@ func TestUevent_GetPartitionNumber(t *testing.T) {
 			want: 6,
 		},
 		{
-			name: "invalid uevent",
-			u:    Uevent{},
-			want: -1,
+			name:    "invalid uevent",
+			u:       Uevent{},
+			wantErr: ErrInvalidUevent,
 		},
 		{
 			name: "not a partition",
 			u: Uevent{
 				UeventDevtype: UeventDevtypeDisk,
 			},
-			want: -1,
+			wantErr: ErrNotAPartition,
 		},
 		{
 			name: "invalid partition number",
 			u: Uevent{
 				UeventPartn: "not a number",
 			},
-			want: -1,
+			wantErr: ErrInvalidPartitionNumber,
+		},
+		{
+			name: "partition number zero",
+			u: Uevent{
+				UeventPartn: "0",
+			},
+			wantErr: ErrInvalidPartitionNumber,
+		},
+		{
+			name: "partition number above 255",
+			u: Uevent{
+				UeventDevtype: UeventDevtypePartition,
+				UeventPartn:   "300",
+			},
+			want: 300,
+		},
+		{
+			name: "derived from sd devname",
+			u: Uevent{
+				UeventDevtype: UeventDevtypePartition,
+				UeventDevname: "sda3",
+			},
+			want: 3,
+		},
+		{
+			name: "derived from nvme devname",
+			u: Uevent{
+				UeventDevtype: UeventDevtypePartition,
+				UeventDevname: "nvme0n1p12",
+			},
+			want: 12,
+		},
+		{
+			name: "derived from mmc devname",
+			u: Uevent{
+				UeventDevtype: UeventDevtypePartition,
+				UeventDevname: "mmcblk0p2",
+			},
+			want: 2,
+		},
+		{
+			name: "devname without partition number",
+			u: Uevent{
+				UeventDevtype: UeventDevtypePartition,
+				UeventDevname: "sda",
+			},
+			wantErr: ErrInvalidPartitionNumber,
+		},
+		{
+			name: "devname is only digits",
+			u: Uevent{
+				UeventDevtype: UeventDevtypePartition,
+				UeventDevname: "123",
+			},
+			wantErr: ErrInvalidPartitionNumber,
+		},
+		{
+			name: "partition without partn and devname",
+			u: Uevent{
+				UeventDevtype: UeventDevtypePartition,
+			},
+			wantErr: ErrInvalidUevent,
 		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			if got := tt.u.GetPartitionNumber(); got != tt.want {
+			got, err := tt.u.GetPartitionNumber()
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("Uevent.GetPartitionNumber() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if got != tt.want {
 				t.Errorf("Uevent.GetPartitionNumber() = %v, want %v", got, tt.want)
 			}
 		})
@@ -520,3 +588,61 @@ func TestUevent_GetDeviceName(t *testing.T) {
 		})
 	}
 }
+
+func TestPartitionDeviceName(t *testing.T) {
+	tests := []struct {
+		disk    string
+		partNum int
+		want    string
+	}{
+		{disk: "sda", partNum: 3, want: "sda3"},
+		{disk: "vdb", partNum: 12, want: "vdb12"},
+		{disk: "nvme0n1", partNum: 3, want: "nvme0n1p3"},
+		{disk: "mmcblk0", partNum: 3, want: "mmcblk0p3"},
+		{disk: "loop0", partNum: 1, want: "loop0p1"},
+		{disk: "", partNum: 1, want: ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.want, func(t *testing.T) {
+			got := PartitionDeviceName(tt.disk, tt.partNum)
+			if got != tt.want {
+				t.Errorf("PartitionDeviceName() = %v, want %v", got, tt.want)
+			}
+			if got == "" {
+				return
+			}
+			// it must be the inverse of deriving the partition number from the device name
+			n, err := partitionNumberFromDevname(got)
+			if err != nil || n != tt.partNum {
+				t.Errorf("partitionNumberFromDevname(%s) = %d, %v, want %d", got, n, err, tt.partNum)
+			}
+		})
+	}
+}
+
+func TestIsAuxiliaryDevname(t *testing.T) {
+	tests := []struct {
+		devname string
+		want    bool
+	}{
+		{devname: "sda", want: false},
+		{devname: "nvme0n1", want: false},
+		{devname: "nvme0n1p3", want: false},
+		{devname: "nvme0c0n1", want: true},
+		{devname: "nvme1c12n1", want: true},
+		{devname: "mmcblk0", want: false},
+		{devname: "mmcblk0p3", want: false},
+		{devname: "mmcblk0boot0", want: true},
+		{devname: "mmcblk0boot1", want: true},
+		{devname: "mmcblk1rpmb", want: true},
+		{devname: "mmcblk0gp0", want: true},
+		{devname: "", want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.devname, func(t *testing.T) {
+			if got := isAuxiliaryDevname(tt.devname); got != tt.want {
+				t.Errorf("isAuxiliaryDevname() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,230 @@
+// Copyright 2023 Hedgehog
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package seeder
+
+import (
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"time"
+
+	"go.githedgehog.com/dasboot/pkg/log"
+	"go.githedgehog.com/dasboot/pkg/seeder/config"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
+	"go.uber.org/zap"
+)
+
+const (
+	adminOverridesPath = "/overrides"
+	adminArtifactsPath = "/artifacts"
+)
+
+// ArtifactOverrideRequest is the request body to create or replace an artifact override
+// for a device on the admin server.
+type ArtifactOverrideRequest struct {
+	// Artifact is the artifact name which should be overridden
+	Artifact string `json:"artifact"`
+
+	// Override is the artifact name which should be served instead
+	Override string `json:"override"`
+
+	// TTL is a duration string (e.g. "30m" or "2h") after which the override expires.
+	// If it is empty, the override expires after one hour.
+	TTL string `json:"ttl,omitempty"`
+}
+
+func (s *seeder) adminHandler() *chi.Mux {
+	r := chi.NewRouter()
+	r.Use(middleware.RequestID)
+	r.Use(s.metrics.instrument("admin"))
+	r.Use(RequestLogger(log.L()))
+	r.Use(middleware.Recoverer)
+	r.Use(AddResponseRequestID())
+	r.Use(middleware.Heartbeat("/healthz"))
+	r.Use(s.adminAuthzMiddleware)
+	r.Use(s.limits.maxRequestBody(s.limits.maxAdminRequestSize))
+	r.Get(openAPIPath, s.getOpenAPIDocument(APIAdmin))
+	r.Get(adminOverridesPath, s.listArtifactOverridesHandler)
+	r.Get(path.Join(adminOverridesPath, "{devid}"), s.getArtifactOverridesHandler)
+	r.Put(path.Join(adminOverridesPath, "{devid}"), s.setArtifactOverrideHandler)
+	r.Delete(path.Join(adminOverridesPath, "{devid}"), s.deleteArtifactOverrideHandler)
+	r.Get(path.Join(adminArtifactsPath, "{artifact}", "provenance"), s.getArtifactProvenanceHandler)
+	r.Get(adminLimitsPath, s.getLimitsHandler)
+	r.Get(adminRecoveryPath, s.listRecoveryReportsHandler)
+	r.Get(adminCancellationsPath, s.listInstallCancellationsHandler)
+	r.Put(path.Join(adminCancellationsPath, "{devid}"), s.setInstallCancellationHandler)
+	r.Delete(path.Join(adminCancellationsPath, "{devid}"), s.deleteInstallCancellationHandler)
+	r.Delete(path.Join(adminRecoveryPath, "{devid}"), s.deleteRecoveryReportHandler)
+	r.Get(adminLeasesPath, s.listIPAMLeasesHandler)
+	r.Get(adminRegistrationsPath, s.listPendingRegistrationsHandler)
+	r.Put(path.Join(adminRegistrationsPath, "{devid}"), s.approveRegistrationHandler)
+	r.Delete(path.Join(adminRegistrationsPath, "{devid}"), s.denyRegistrationHandler)
+	r.Delete(path.Join(adminLeasesPath, "{devid}"), s.deleteIPAMLeaseHandler)
+	r.Get(adminRevocationsPath, s.listRevocationsHandler)
+	r.Put(path.Join(adminRevocationsPath, "{devid}"), s.revokeHandler)
+	r.Delete(path.Join(adminRevocationsPath, "{devid}"), s.deleteRevocationHandler)
+	r.Get(adminLogsPath, s.listLogsHandler)
+	r.Get(path.Join(adminLogsPath, "{devid}"), s.getLogsHandler)
+	r.Delete(path.Join(adminLogsPath, "{devid}"), s.deleteLogsHandler)
+	r.Get(adminDownloadsPath, s.listDownloadsHandler)
+	r.Get(adminUploadsPath, s.listUploadsHandler)
+	r.Get(path.Join(adminUploadsPath, "{devid}", "{id}"), s.getUploadFileHandler)
+	r.Delete(path.Join(adminUploadsPath, "{devid}", "{id}"), s.deleteUploadHandler)
+	r.Get(path.Join(adminIdentityPath, "{devid}"), s.getExpectedIdentityDocumentHandler)
+	r.Get(path.Join(adminDevicesPath, "{devid}", "diagnostics"), s.getDiagnosticsHandler)
+	return r
+}
+
+// loadAdminClientCAs loads the client CAs of the admin server. It returns nil if the admin server does not use TLS.
+func loadAdminClientCAs(bi *config.BindInfo) (*x509.CertPool, error) {
+	if bi == nil || bi.ServerKeyPath == "" || bi.ClientCAPath == "" {
+		return nil, nil
+	}
+	b, err := os.ReadFile(bi.ClientCAPath)
+	if err != nil {
+		return nil, fmt.Errorf("admin client CA: %w", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(b) {
+		return nil, fmt.Errorf("admin client CA: no certificates in '%s'", bi.ClientCAPath)
+	}
+	return pool, nil
+}
+
+func (s *seeder) adminAuthz(r *http.Request) error {
+	// on a TLS server we require a client certificate from the admin client CA: the TLS server only verifies
+	// client certificates if they are given, and a certificate of a device is no admin certificate
+	if r.TLS != nil {
+		if len(r.TLS.PeerCertificates) < 1 {
+			return fmt.Errorf("client certificate not presented")
+		}
+		if s.adminClientCAs == nil {
+			return fmt.Errorf("no admin client CA configured")
+		}
+		intermediates := x509.NewCertPool()
+		for _, cert := range r.TLS.PeerCertificates[1:] {
+			intermediates.AddCert(cert)
+		}
+		if _, err := r.TLS.PeerCertificates[0].Verify(x509.VerifyOptions{
+			Roots:         s.adminClientCAs,
+			Intermediates: intermediates,
+			KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		}); err != nil {
+			return fmt.Errorf("client certificate not issued by the admin client CA: %w", err)
+		}
+		return nil
+	}
+
+	// without TLS we only allow requests from the local machine
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || !ip.IsLoopback() {
+		return fmt.Errorf("plain HTTP requests are only allowed from loopback addresses")
+	}
+	return nil
+}
+
+func (s *seeder) adminAuthzMiddleware(next http.Handler) http.Handler {
+	fn := func(w http.ResponseWriter, r *http.Request) {
+		if err := s.adminAuthz(r); err != nil {
+			errorWithJSON(w, r, http.StatusForbidden, "unauthorized access to admin API: %s", err)
+			return
+		}
+		next.ServeHTTP(w, r)
+	}
+	return http.HandlerFunc(fn)
+}
+
+func writeJSON(w http.ResponseWriter, r *http.Request, statusCode int, v any) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		errorWithJSON(w, r, http.StatusInternalServerError, "JSON marshalling of response failed: %s", err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	if n, err := w.Write(b); err != nil || n != len(b) {
+		l.Debug("writeJSON failed to write response", zap.Error(err), zap.Int("written", n), zap.Int("len", len(b)))
+	}
+}
+
+func (s *seeder) listArtifactOverridesHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, r, http.StatusOK, s.overrides.list())
+}
+
+func (s *seeder) getArtifactOverridesHandler(w http.ResponseWriter, r *http.Request) {
+	devidParam := chi.URLParam(r, "devid")
+	ret := s.overrides.list()[devidParam]
+	if ret == nil {
+		ret = []ArtifactOverride{}
+	}
+	writeJSON(w, r, http.StatusOK, ret)
+}
+
+func (s *seeder) setArtifactOverrideHandler(w http.ResponseWriter, r *http.Request) {
+	devidParam := chi.URLParam(r, "devid")
+	if devidParam == "" {
+		errorWithJSON(w, r, http.StatusBadRequest, "no device ID in URL")
+		return
+	}
+
+	var req ArtifactOverrideRequest
+	if !s.limits.decodeJSONRequest(w, r, &req) {
+		return
+	}
+	if req.Artifact == "" || req.Override == "" {
+		errorWithJSON(w, r, http.StatusBadRequest, "invalid request: artifact and override must be set")
+		return
+	}
+	var ttl time.Duration
+	if req.TTL != "" {
+		var err error
+		ttl, err = time.ParseDuration(req.TTL)
+		if err != nil || ttl <= 0 {
+			errorWithJSON(w, r, http.StatusBadRequest, "invalid request: invalid TTL '%s'", req.TTL)
+			return
+		}
+	}
+
+	o := s.overrides.set(devidParam, req.Artifact, req.Override, ttl)
+	l.Info("Artifact override set",
+		zap.String("devid", devidParam),
+		zap.String("artifact", o.Artifact),
+		zap.String("override", o.Override),
+		zap.Time("expires", o.Expires),
+	)
+	writeJSON(w, r, http.StatusOK, o)
+}
+
+func (s *seeder) deleteArtifactOverrideHandler(w http.ResponseWriter, r *http.Request) {
+	devidParam := chi.URLParam(r, "devid")
+	artifact := r.URL.Query().Get("artifact")
+	n := s.overrides.delete(devidParam, artifact)
+	if n == 0 {
+		errorWithJSON(w, r, http.StatusNotFound, "no artifact override found for device '%s'", devidParam)
+		return
+	}
+	l.Info("Artifact override deleted", zap.String("devid", devidParam), zap.String("artifact", artifact), zap.Int("deleted", n))
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,183 @@
+// Copyright 2023 Hedgehog
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package seeder
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"go.githedgehog.com/dasboot/pkg/seeder/artifacts/file"
+	seederconfig "go.githedgehog.com/dasboot/pkg/seeder/config"
+)
+
+func TestAdminAuthz(t *testing.T) {
+	dir := t.TempDir()
+	caTmpl := func(cn string, serial int64) *x509.Certificate {
+		return &x509.Certificate{
+			SerialNumber:          big.NewInt(serial),
+			Subject:               pkix.Name{CommonName: cn},
+			NotBefore:             time.Now().Add(-time.Hour),
+			NotAfter:              time.Now().Add(time.Hour),
+			IsCA:                  true,
+			BasicConstraintsValid: true,
+			KeyUsage:              x509.KeyUsageCertSign,
+		}
+	}
+	clientTmpl := func(cn string, serial int64) *x509.Certificate {
+		return &x509.Certificate{
+			SerialNumber: big.NewInt(serial),
+			Subject:      pkix.Name{CommonName: cn},
+			NotBefore:    time.Now().Add(-time.Hour),
+			NotAfter:     time.Now().Add(time.Hour),
+			KeyUsage:     x509.KeyUsageDigitalSignature,
+			ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		}
+	}
+	adminCA, adminCAKey := writeSelfTestKeyPair(t, dir, "admin-ca", caTmpl("admin CA", 1), nil, nil)
+	deviceCA, deviceCAKey := writeSelfTestKeyPair(t, dir, "device-ca", caTmpl("device CA", 2), nil, nil)
+	adminCert, _ := writeSelfTestKeyPair(t, dir, "admin", clientTmpl("admin", 3), adminCA, adminCAKey)
+	deviceCert, _ := writeSelfTestKeyPair(t, dir, "device", clientTmpl("0a1b2c3d-4e5f-6789-abcd-ef0123456789", 4), deviceCA, deviceCAKey)
+
+	adminClientCAs, err := loadAdminClientCAs(&seederconfig.BindInfo{
+		ServerKeyPath: filepath.Join(dir, "admin-ca.key"),
+		ClientCAPath:  filepath.Join(dir, "admin-ca.pem"),
+	})
+	if err != nil {
+		t.Fatalf("loadAdminClientCAs() error = %v", err)
+	}
+
+	tests := []struct {
+		name       string
+		noAdminCAs bool
+		remoteAddr string
+		tls        *tls.ConnectionState
+		wantCode   int
+	}{
+		{
+			name:       "TLS with admin certificate",
+			remoteAddr: "192.0.2.1:12345",
+			tls:        &tls.ConnectionState{PeerCertificates: []*x509.Certificate{adminCert}},
+			wantCode:   http.StatusOK,
+		},
+		{
+			name:       "TLS with device certificate",
+			remoteAddr: "192.0.2.1:12345",
+			tls:        &tls.ConnectionState{PeerCertificates: []*x509.Certificate{deviceCert}},
+			wantCode:   http.StatusForbidden,
+		},
+		{
+			name:       "TLS without admin client CA",
+			noAdminCAs: true,
+			remoteAddr: "192.0.2.1:12345",
+			tls:        &tls.ConnectionState{PeerCertificates: []*x509.Certificate{adminCert}},
+			wantCode:   http.StatusForbidden,
+		},
+		{
+			name:       "TLS without certificate",
+			remoteAddr: "127.0.0.1:12345",
+			tls:        &tls.ConnectionState{},
+			wantCode:   http.StatusForbidden,
+		},
+		{
+			name:       "plain HTTP from remote address",
+			remoteAddr: "192.0.2.1:12345",
+			wantCode:   http.StatusForbidden,
+		},
+		{
+			name:       "plain HTTP from loopback",
+			remoteAddr: "127.0.0.1:12345",
+			wantCode:   http.StatusOK,
+		},
+		{
+			name:       "plain HTTP from IPv6 loopback",
+			remoteAddr: "[::1]:12345",
+			wantCode:   http.StatusOK,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &seeder{adminClientCAs: adminClientCAs}
+			if tt.noAdminCAs {
+				s.adminClientCAs = nil
+			}
+			h := s.adminAuthzMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusOK)
+			}))
+			r := httptest.NewRequest(http.MethodGet, adminOverridesPath, nil)
+			r.RemoteAddr = tt.remoteAddr
+			r.TLS = tt.tls
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, r)
+			if w.Code != tt.wantCode {
+				t.Errorf("admin authz status = %d, want %d: %s", w.Code, tt.wantCode, w.Body.String())
+			}
+		})
+	}
+}
+
+func TestValidateConfigAdminClientCA(t *testing.T) {
+	cfg := func(adminClientCA, secureClientCA string) *seederconfig.SeederConfig {
+		return &seederconfig.SeederConfig{
+			SecureServer: &seederconfig.BindInfo{
+				Address:        []string{"[::]:443"},
+				ServerKeyPath:  "/etc/hedgehog/seeder/server-key.pem",
+				ServerCertPath: "/etc/hedgehog/seeder/server-cert.pem",
+				ClientCAPath:   secureClientCA,
+			},
+			AdminServer: &seederconfig.BindInfo{
+				Address:        []string{"[::1]:8443"},
+				ServerKeyPath:  "/etc/hedgehog/seeder/server-key.pem",
+				ServerCertPath: "/etc/hedgehog/seeder/server-cert.pem",
+				ClientCAPath:   adminClientCA,
+			},
+			ArtifactsProvider: file.Provider(t.TempDir()),
+			InstallerSettings: &seederconfig.InstallerSettings{},
+		}
+	}
+	tests := []struct {
+		name    string
+		cfg     *seederconfig.SeederConfig
+		wantErr bool
+	}{
+		{
+			name: "dedicated admin client CA",
+			cfg:  cfg("/etc/hedgehog/seeder/admin-client-ca-cert.pem", "/etc/hedgehog/seeder/client-ca-cert.pem"),
+		},
+		{
+			name:    "no admin client CA",
+			cfg:     cfg("", "/etc/hedgehog/seeder/client-ca-cert.pem"),
+			wantErr: true,
+		},
+		{
+			name:    "admin client CA shared with devices",
+			cfg:     cfg("/etc/hedgehog/seeder/client-ca-cert.pem", "/etc/hedgehog/seeder/client-ca-cert.pem"),
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := validateConfig(tt.cfg); (err != nil) != tt.wantErr {
+				t.Errorf("validateConfig() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,164 @@
+// Copyright 2023 Hedgehog
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package seeder
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// artifactClass groups artifacts which share the same access requirements
+type artifactClass string
+
+const (
+	artifactClassStage0      artifactClass = "stage0"
+	artifactClassStage1      artifactClass = "stage1"
+	artifactClassStage2      artifactClass = "stage2"
+	artifactClassNOS         artifactClass = "nos"
+	artifactClassONIE        artifactClass = "onie"
+	artifactClassProvisioner artifactClass = "provisioner"
+	artifactClassAgent       artifactClass = "agent"
+
+	// artifactClassDeviceMetadata is the metadata which the control plane plans for a device
+	artifactClassDeviceMetadata artifactClass = "device-metadata"
+
+	// artifactClassInstallCancellation is the cancellation status of the installation of a device
+	artifactClassInstallCancellation artifactClass = "install-cancellation"
+
+	// artifactClassPlatformSupport are the platform support bundles which stage 0 loads before it configures the
+	// network. They are served anonymously, and stage 0 verifies them against the pin in its signed config.
+	artifactClassPlatformSupport artifactClass = "platform-support"
+)
+
+// accessLevel describes the device state which is required to get access to an artifact.
+// Every level includes the requirements of all previous levels.
+type accessLevel int
+
+const (
+	// accessAnonymous requires nothing at all
+	accessAnonymous accessLevel = iota
+
+	// accessTLS requires the request to be made over TLS
+	accessTLS
+
+	// accessRegistered requires a device certificate which was issued at registration time.
+	// If the request path contains a device ID, it must match the device certificate.
+	accessRegistered
+)
+
+func (a accessLevel) String() string {
+	switch a {
+	case accessAnonymous:
+		return "anonymous"
+	case accessTLS:
+		return "tls"
+	case accessRegistered:
+		return "registered"
+	default:
+		return fmt.Sprintf("unknown(%d)", int(a))
+	}
+}
+
+// artifactAccessPolicy maps artifact classes to their required access level.
+// Artifact classes which are not listed here are not being served at all.
+var artifactAccessPolicy = map[artifactClass]accessLevel{
+	artifactClassStage0:      accessAnonymous,
+	artifactClassStage1:      accessTLS,
+	artifactClassStage2:      accessRegistered,
+	artifactClassNOS:         accessRegistered,
+	artifactClassONIE:        accessRegistered,
+	artifactClassProvisioner: accessRegistered,
+	artifactClassAgent:       accessRegistered,
+
+	artifactClassDeviceMetadata:      accessRegistered,
+	artifactClassInstallCancellation: accessRegistered,
+
+	artifactClassPlatformSupport: accessAnonymous,
+}
+
+var (
+	ErrArtifactClassUnknown  = errors.New("unknown artifact class")
+	ErrTLSRequired           = errors.New("TLS connection required")
+	ErrDeviceCertRequired    = errors.New("device certificate required")
+	ErrDeviceCertNotVerified = errors.New("device certificate not verified")
+	ErrDeviceCertMissingCN   = errors.New("device certificate missing its CN UUID")
+	ErrDeviceIDMismatch      = errors.New("device ID mismatch")
+)
+
+// artifactAccessError wraps the reason why access to an artifact was denied so that
+// clients get a clear explanation in the 403 response
+func artifactAccessError(class artifactClass, level accessLevel, err error) error {
+	return fmt.Errorf("%s artifacts require access level '%s': %w", class, level, err)
+}
+
+// artifactAuthz returns an authorization function for all artifacts of the given artifact class
+func (s *seeder) artifactAuthz(class artifactClass) func(*http.Request) error {
+	return func(r *http.Request) error {
+		level, ok := artifactAccessPolicy[class]
+		if !ok {
+			return fmt.Errorf("%w: %s", ErrArtifactClassUnknown, class)
+		}
+		// devices can't prove anything over plain HTTP in lab mode
+		if s.labMode {
+			return nil
+		}
+		if err := checkAccessLevel(r, level); err != nil {
+			return artifactAccessError(class, level, err)
+		}
+		return nil
+	}
+}
+
+func checkAccessLevel(r *http.Request, level accessLevel) error {
+	if level == accessAnonymous {
+		return nil
+	}
+
+	// must be a TLS request
+	if r.TLS == nil {
+		return ErrTLSRequired
+	}
+	if level == accessTLS {
+		return nil
+	}
+
+	// If there were no client certificates provided, then you don't have access to this route.
+	// Only certificates which were verified against the client CA, which issues the certificates at
+	// registration time, are considered a registered device.
+	if len(r.TLS.PeerCertificates) < 1 {
+		return ErrDeviceCertRequired
+	}
+	if len(r.TLS.VerifiedChains) < 1 {
+		return ErrDeviceCertNotVerified
+	}
+
+	// get the UUID of the device from the cert
+	uuid := r.TLS.PeerCertificates[0].Subject.CommonName
+	if uuid == "" {
+		return ErrDeviceCertMissingCN
+	}
+
+	// if the request is for a specific device, then it must be the device itself
+	if devid := chi.URLParam(r, "devid"); devid != "" && devid != uuid {
+		return fmt.Errorf("%w: certificate is for '%s', but request is for '%s'", ErrDeviceIDMismatch, uuid, devid)
+	}
+
+	// TODO: check the keylime CV for the status of the client: this essentially means that only devices
+	// with good hardware attestation state are allowed to get an installation image
+	return nil
+}
@@ -0,0 +1,122 @@
+// Copyright 2023 Hedgehog
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package seeder
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/go-chi/chi/v5"
+)
+
+func TestArtifactAuthz(t *testing.T) {
+	deviceCert := &x509.Certificate{Subject: pkix.Name{CommonName: "dc0cd8b3-3f0e-4ddb-8c6b-c8e1a0c0b0c4"}}
+	verified := &tls.ConnectionState{
+		PeerCertificates: []*x509.Certificate{deviceCert},
+		VerifiedChains:   [][]*x509.Certificate{{deviceCert}},
+	}
+	tests := []struct {
+		name    string
+		class   artifactClass
+		tls     *tls.ConnectionState
+		devid   string
+		labMode bool
+		wantErr error
+	}{
+		{
+			name:  "stage0 is anonymous",
+			class: artifactClassStage0,
+		},
+		{
+			name:    "stage1 requires TLS",
+			class:   artifactClassStage1,
+			wantErr: ErrTLSRequired,
+		},
+		{
+			name:  "stage1 with TLS",
+			class: artifactClassStage1,
+			tls:   &tls.ConnectionState{},
+		},
+		{
+			name:    "stage2 requires device cert",
+			class:   artifactClassStage2,
+			tls:     &tls.ConnectionState{},
+			wantErr: ErrDeviceCertRequired,
+		},
+		{
+			name:    "stage2 requires verified device cert",
+			class:   artifactClassStage2,
+			tls:     &tls.ConnectionState{PeerCertificates: []*x509.Certificate{deviceCert}},
+			wantErr: ErrDeviceCertNotVerified,
+		},
+		{
+			name:    "device cert without CN",
+			class:   artifactClassNOS,
+			tls:     &tls.ConnectionState{PeerCertificates: []*x509.Certificate{{}}, VerifiedChains: [][]*x509.Certificate{{{}}}},
+			wantErr: ErrDeviceCertMissingCN,
+		},
+		{
+			name:  "agent with matching device ID",
+			class: artifactClassAgent,
+			tls:   verified,
+			devid: "dc0cd8b3-3f0e-4ddb-8c6b-c8e1a0c0b0c4",
+		},
+		{
+			name:    "agent with other device ID",
+			class:   artifactClassAgent,
+			tls:     verified,
+			devid:   "a7f8c1de-0b4e-4ba2-9b8e-5a0f7a8e1f11",
+			wantErr: ErrDeviceIDMismatch,
+		},
+		{
+			name:    "lab mode without TLS",
+			class:   artifactClassNOS,
+			labMode: true,
+		},
+		{
+			name:    "unknown artifact class in lab mode",
+			class:   artifactClass("unknown"),
+			labMode: true,
+			wantErr: ErrArtifactClassUnknown,
+		},
+		{
+			name:    "unknown artifact class",
+			class:   artifactClass("unknown"),
+			wantErr: ErrArtifactClassUnknown,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &seeder{labMode: tt.labMode}
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			r.TLS = tt.tls
+			rctx := chi.NewRouteContext()
+			if tt.devid != "" {
+				rctx.URLParams.Add("devid", tt.devid)
+			}
+			r = r.WithContext(context.WithValue(r.Context(), chi.RouteCtxKey, rctx))
+			err := s.artifactAuthz(tt.class)(r)
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("artifactAuthz() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
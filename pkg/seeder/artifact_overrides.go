@@ -0,0 +1,177 @@
+// Copyright 2023 Hedgehog
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package seeder
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// defaultArtifactOverrideTTL is used for artifact overrides which were created without a TTL
+const defaultArtifactOverrideTTL = time.Hour
+
+// ArtifactOverride pins an artifact for a single device to an alternate artifact. The alternate
+// artifact takes precedence over the default artifact resolution until the override expires.
+type ArtifactOverride struct {
+	// Artifact is the artifact name as it would be requested from the artifacts provider without
+	// the override (e.g. "stage2-amd64" or "sonic/x86_64-accton_as7726_32x-r0"). A version tag
+	// is not part of the match.
+	Artifact string `json:"artifact"`
+
+	// Override is the artifact name which will be served instead (e.g. "stage2-debug-amd64" or
+	// "sonic/x86_64-accton_as7726_32x-r0:candidate").
+	Override string `json:"override"`
+
+	// Expires is the point in time when this override will stop taking effect.
+	Expires time.Time `json:"expires"`
+}
+
+func (o *ArtifactOverride) expired(now time.Time) bool {
+	return !now.Before(o.Expires)
+}
+
+// artifactOverrides is a thread-safe in-memory store for per-device artifact overrides.
+// Expired overrides are being pruned lazily on access.
+type artifactOverrides struct {
+	lock      sync.RWMutex
+	overrides map[string]map[string]*ArtifactOverride
+	now       func() time.Time
+}
+
+func newArtifactOverrides() *artifactOverrides {
+	return &artifactOverrides{
+		overrides: make(map[string]map[string]*ArtifactOverride),
+		now:       time.Now,
+	}
+}
+
+// artifactName strips a potential version tag from an artifact
+func artifactName(artifact string) string {
+	// artifact names can contain slashes, so we only look for
+	// the tag separator after the last path element
+	slashIdx := strings.LastIndex(artifact, "/")
+	if idx := strings.LastIndex(artifact, ":"); idx > slashIdx {
+		return artifact[:idx]
+	}
+	return artifact
+}
+
+// set adds or replaces an override for `artifact` on device `deviceID` which expires after `ttl`
+func (ao *artifactOverrides) set(deviceID, artifact, override string, ttl time.Duration) *ArtifactOverride {
+	if ttl <= 0 {
+		ttl = defaultArtifactOverrideTTL
+	}
+	o := &ArtifactOverride{
+		Artifact: artifactName(artifact),
+		Override: override,
+		Expires:  ao.now().Add(ttl),
+	}
+
+	ao.lock.Lock()
+	defer ao.lock.Unlock()
+	devOverrides, ok := ao.overrides[deviceID]
+	if !ok {
+		devOverrides = make(map[string]*ArtifactOverride)
+		ao.overrides[deviceID] = devOverrides
+	}
+	devOverrides[o.Artifact] = o
+	return o
+}
+
+// delete removes the override for `artifact` on device `deviceID`. If `artifact` is empty, all
+// overrides for the device are being removed. It returns the number of deleted overrides.
+func (ao *artifactOverrides) delete(deviceID, artifact string) int {
+	ao.lock.Lock()
+	defer ao.lock.Unlock()
+	devOverrides, ok := ao.overrides[deviceID]
+	if !ok {
+		return 0
+	}
+	if artifact == "" {
+		delete(ao.overrides, deviceID)
+		return len(devOverrides)
+	}
+	name := artifactName(artifact)
+	if _, ok := devOverrides[name]; !ok {
+		return 0
+	}
+	delete(devOverrides, name)
+	if len(devOverrides) == 0 {
+		delete(ao.overrides, deviceID)
+	}
+	return 1
+}
+
+// get returns the override artifact for `artifact` on device `deviceID`. The boolean return value
+// indicates if an override was found.
+func (ao *artifactOverrides) get(deviceID, artifact string) (string, bool) {
+	if deviceID == "" {
+		return "", false
+	}
+	name := artifactName(artifact)
+	ao.lock.RLock()
+	o, ok := ao.overrides[deviceID][name]
+	ao.lock.RUnlock()
+	if !ok {
+		return "", false
+	}
+	if o.expired(ao.now()) {
+		ao.delete(deviceID, name)
+		return "", false
+	}
+	return o.Override, true
+}
+
+// list returns all overrides which have not expired yet for all devices. Expired overrides
+// are being pruned at the same time.
+func (ao *artifactOverrides) list() map[string][]ArtifactOverride {
+	now := ao.now()
+	ao.lock.Lock()
+	defer ao.lock.Unlock()
+	ret := make(map[string][]ArtifactOverride, len(ao.overrides))
+	for deviceID, devOverrides := range ao.overrides {
+		for name, o := range devOverrides {
+			if o.expired(now) {
+				delete(devOverrides, name)
+				continue
+			}
+			ret[deviceID] = append(ret[deviceID], *o)
+		}
+		if len(devOverrides) == 0 {
+			delete(ao.overrides, deviceID)
+			continue
+		}
+		sort.Slice(ret[deviceID], func(i, j int) bool {
+			return ret[deviceID][i].Artifact < ret[deviceID][j].Artifact
+		})
+	}
+	return ret
+}
+
+// overridden returns true if there is an override for `artifact` on any device which has not expired yet
+func (ao *artifactOverrides) overridden(artifact string) bool {
+	name := artifactName(artifact)
+	now := ao.now()
+	ao.lock.RLock()
+	defer ao.lock.RUnlock()
+	for _, devOverrides := range ao.overrides {
+		if o, ok := devOverrides[name]; ok && !o.expired(now) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,86 @@
+// Copyright 2023 Hedgehog
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package seeder
+
+import (
+	"testing"
+	"time"
+)
+
+func Test_artifactName(t *testing.T) {
+	tests := []struct {
+		name     string
+		artifact string
+		want     string
+	}{
+		{
+			name:     "no tag",
+			artifact: "stage2-amd64",
+			want:     "stage2-amd64",
+		},
+		{
+			name:     "path without tag",
+			artifact: "fabric/agent",
+			want:     "fabric/agent",
+		},
+		{
+			name:     "path with tag",
+			artifact: "sonic/x86_64-kvm_x86_64-r0:4.1.0",
+			want:     "sonic/x86_64-kvm_x86_64-r0",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := artifactName(tt.artifact); got != tt.want {
+				t.Errorf("artifactName() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_artifactOverrides(t *testing.T) {
+	now := time.Date(2023, 6, 1, 12, 0, 0, 0, time.UTC)
+	ao := newArtifactOverrides()
+	ao.now = func() time.Time { return now }
+
+	ao.set("dev1", "sonic/x86_64-kvm_x86_64-r0", "sonic/x86_64-kvm_x86_64-r0:candidate", time.Minute)
+	ao.set("dev1", "stage2-amd64", "stage2-debug-amd64", 0)
+
+	// other devices must not be affected
+	if _, ok := ao.get("dev2", "stage2-amd64"); ok {
+		t.Errorf("get() found override for unrelated device")
+	}
+
+	// version tags of the requested artifact must not matter
+	if got, ok := ao.get("dev1", "sonic/x86_64-kvm_x86_64-r0:4.1.0"); !ok || got != "sonic/x86_64-kvm_x86_64-r0:candidate" {
+		t.Errorf("get() = %v, %v, want override", got, ok)
+	}
+
+	// after two minutes the first override must have expired, but the default TTL one must still be there
+	now = now.Add(2 * time.Minute)
+	if _, ok := ao.get("dev1", "sonic/x86_64-kvm_x86_64-r0"); ok {
+		t.Errorf("get() returned expired override")
+	}
+	if got := ao.list()["dev1"]; len(got) != 1 || got[0].Override != "stage2-debug-amd64" {
+		t.Errorf("list() = %v, want exactly the stage2 override", got)
+	}
+
+	if n := ao.delete("dev1", ""); n != 1 {
+		t.Errorf("delete() = %d, want 1", n)
+	}
+	if got := ao.list(); len(got) != 0 {
+		t.Errorf("list() = %v, want empty list", got)
+	}
+}
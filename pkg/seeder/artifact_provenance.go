@@ -0,0 +1,108 @@
+// Copyright 2023 Hedgehog
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package seeder
+
+import (
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"go.githedgehog.com/dasboot/pkg/seeder/artifacts"
+	"go.githedgehog.com/dasboot/pkg/stage"
+	"go.githedgehog.com/dasboot/pkg/version"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
+	"go.uber.org/zap"
+)
+
+// artifactProvenance builds the provenance for an artifact as it is stored in the artifacts provider
+func (s *seeder) artifactProvenance(artifact string, artifactBytes []byte) *version.ArtifactProvenance {
+	ret := &version.ArtifactProvenance{
+		Artifact: artifact,
+		Digest:   stage.ProvenanceDigest(artifactBytes),
+		Size:     int64(len(artifactBytes)),
+	}
+	if pp, ok := s.artifactsProvider.(artifacts.ProvenanceProvider); ok {
+		ret.Build = pp.Provenance(artifact)
+	}
+	// this is independent of the provider which served the artifact, e.g. the embedded one which is not verified
+	if e, ok := s.manifest.Lookup(artifact); ok && e.Digest == ret.Digest && e.Size == ret.Size {
+		ret.ManifestVersion = s.manifest.Version
+	}
+	return ret
+}
+
+// setArtifactProvenanceHeaders signs the artifact provenance with a detached signature the same way
+// as `SignResponses` signs response bodies, and sets it together with the provenance in the headers.
+func setArtifactProvenanceHeaders(h http.Header, key *ecdsa.PrivateKey, certDER []byte, prov *version.ArtifactProvenance) error {
+	b, err := json.Marshal(prov)
+	if err != nil {
+		return fmt.Errorf("provenance JSON marshalling: %w", err)
+	}
+	cks := sha256.Sum256(b)
+	sig, err := ecdsa.SignASN1(rand.Reader, key, cks[:])
+	if err != nil {
+		return fmt.Errorf("provenance signing: %w", err)
+	}
+	h.Set(stage.HeaderArtifactProvenance, base64.StdEncoding.EncodeToString(b))
+	h.Set(stage.HeaderArtifactProvenanceSignature, base64.StdEncoding.EncodeToString(sig))
+	h.Set(stage.HeaderResponseSignatureCert, base64.StdEncoding.EncodeToString(certDER))
+	return nil
+}
+
+func (s *seeder) getArtifactProvenanceHandler(w http.ResponseWriter, r *http.Request) {
+	artifact := chi.URLParam(r, "artifact")
+	f := s.artifactsProvider.Get(artifact)
+	if f == nil {
+		errorWithJSON(w, r, http.StatusNotFound, "artifact '%s' not found", artifact)
+		return
+	}
+	defer f.Close()
+	artifactBytes, err := s.limits.readArtifact(f)
+	if err != nil {
+		errorWithJSON(w, r, artifactReadErrorStatus(err), "failed to read artifact: %s", err)
+		return
+	}
+	writeJSON(w, r, http.StatusOK, s.artifactProvenance(artifact, artifactBytes))
+}
+
+// artifactPin computes the pin of `artifact` as it is going to be served to the device which is making the
+// request `r` when it downloads the artifact. It returns nil if the artifact cannot be pinned. This is the
+// case if the device is still unknown, but the artifact has an override for any device, or if the artifact
+// cannot be read. Stages will simply not verify a digest then.
+func (s *seeder) artifactPin(r *http.Request, artifact string) *version.ArtifactPin {
+	if (r.TLS == nil || len(r.TLS.PeerCertificates) < 1) && s.overrides.overridden(artifact) {
+		l.Info("Not pinning artifact as it is overridden for a device", zap.String("request", middleware.GetReqID(r.Context())), zap.String("artifact", artifact))
+		return nil
+	}
+	artifact = s.resolveArtifact(r, artifact)
+	f := s.artifactsProvider.Get(artifact)
+	if f == nil {
+		l.Warn("Not pinning artifact as it was not found", zap.String("request", middleware.GetReqID(r.Context())), zap.String("artifact", artifact))
+		return nil
+	}
+	defer f.Close()
+	pin, err := stage.NewArtifactPin(s.limits.limitArtifact(f))
+	if err != nil {
+		l.Warn("Not pinning artifact as reading it failed", zap.String("request", middleware.GetReqID(r.Context())), zap.String("artifact", artifact), zap.Error(err))
+		return nil
+	}
+	return pin
+}
@@ -0,0 +1,222 @@
+// Copyright 2023 Hedgehog
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package seeder
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"go.githedgehog.com/dasboot/pkg/stage"
+	"go.githedgehog.com/dasboot/pkg/version"
+)
+
+func TestArtifactProvenance(t *testing.T) {
+	key, certDER, pool := newTestSigner(t)
+	_, _, otherPool := newTestSigner(t)
+	artifact := []byte("stage1 artifact")
+	embeddedConfig := []byte("embedded config")
+
+	tests := []struct {
+		name            string
+		served          []byte
+		noHeaders       bool
+		ca              *x509.CertPool
+		manifestVersion string
+		requireManifest bool
+		wantErr         error
+		wantServed      bool
+	}{
+		{
+			name:       "valid provenance",
+			served:     artifact,
+			ca:         pool,
+			wantServed: true,
+		},
+		{
+			name:       "valid provenance with embedded config",
+			served:     append(append([]byte{}, artifact...), embeddedConfig...),
+			ca:         pool,
+			wantServed: true,
+		},
+		{
+			name:       "provenance not required",
+			served:     []byte("tampered artifact"),
+			noHeaders:  true,
+			wantServed: true,
+		},
+		{
+			name:    "tampered artifact",
+			served:  []byte("stage1 artifacX"),
+			ca:      pool,
+			wantErr: stage.ErrProvenanceDigestMismatch,
+		},
+		{
+			name:    "truncated artifact",
+			served:  artifact[:5],
+			ca:      pool,
+			wantErr: stage.ErrProvenanceDigestMismatch,
+		},
+		{
+			name:      "missing provenance",
+			served:    artifact,
+			noHeaders: true,
+			ca:        pool,
+			wantErr:   stage.ErrProvenanceMissing,
+		},
+		{
+			name:            "verified against the manifest",
+			served:          artifact,
+			ca:              pool,
+			manifestVersion: "v1",
+			requireManifest: true,
+			wantServed:      true,
+		},
+		{
+			name:            "not verified against the manifest",
+			served:          artifact,
+			ca:              pool,
+			requireManifest: true,
+			wantErr:         stage.ErrProvenanceNotInManifest,
+		},
+		{
+			name:    "untrusted signer",
+			served:  artifact,
+			ca:      otherPool,
+			wantErr: stage.ErrProvenanceInvalid,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if !tt.noHeaders {
+					prov := &version.ArtifactProvenance{
+						Artifact: "stage1-x86_64",
+						Digest:   stage.ProvenanceDigest(artifact),
+						Size:     int64(len(artifact)),
+						Build:    version.GetProvenance(),
+
+						ManifestVersion: tt.manifestVersion,
+					}
+					if err := setArtifactProvenanceHeaders(w.Header(), key, certDER, prov); err != nil {
+						t.Errorf("setArtifactProvenanceHeaders() error = %v", err)
+					}
+				}
+				w.Header().Set("Content-Type", "application/octet-stream")
+				w.Write(tt.served) //nolint:errcheck
+			}))
+			defer srv.Close()
+
+			var opts []stage.DownloadOption
+			if tt.ca != nil {
+				opts = append(opts, stage.DownloadOptionRequireProvenance(tt.ca))
+			}
+			if tt.requireManifest {
+				opts = append(opts, stage.DownloadOptionRequireManifest())
+			}
+			dest := filepath.Join(t.TempDir(), "stage1")
+			err := stage.Download(context.Background(), srv.Client(), srv.URL, dest, 0644, time.Second*10, opts...)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("Download() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantServed {
+				got, err := os.ReadFile(dest)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if string(got) != string(tt.served) {
+					t.Errorf("Download() wrote %q, want %q", got, tt.served)
+				}
+			}
+		})
+	}
+}
+
+type mapProvider map[string][]byte
+
+func (m mapProvider) Get(artifact string) io.ReadCloser {
+	b, ok := m[artifact]
+	if !ok {
+		return nil
+	}
+	return io.NopCloser(bytes.NewReader(b))
+}
+
+func TestArtifactPin(t *testing.T) {
+	stage2 := []byte("stage2 artifact")
+	debugStage2 := []byte("stage2 debug artifact")
+	devReq := httptest.NewRequest(http.MethodGet, "/stage2/x86_64", nil)
+	devReq.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{{Subject: pkix.Name{CommonName: "dev1"}}}}
+
+	tests := []struct {
+		name     string
+		req      *http.Request
+		artifact string
+		override bool
+		want     *version.ArtifactPin
+	}{
+		{
+			name:     "pinned",
+			req:      httptest.NewRequest(http.MethodGet, "/stage1/x86_64", nil),
+			artifact: "stage2-x86_64",
+			want:     &version.ArtifactPin{Digest: stage.ProvenanceDigest(stage2), Size: int64(len(stage2))},
+		},
+		{
+			name:     "unknown device with override",
+			req:      httptest.NewRequest(http.MethodGet, "/stage1/x86_64", nil),
+			artifact: "stage2-x86_64",
+			override: true,
+		},
+		{
+			name:     "known device with override",
+			req:      devReq,
+			artifact: "stage2-x86_64",
+			override: true,
+			want:     &version.ArtifactPin{Digest: stage.ProvenanceDigest(debugStage2), Size: int64(len(debugStage2))},
+		},
+		{
+			name:     "missing artifact",
+			req:      httptest.NewRequest(http.MethodGet, "/stage1/x86_64", nil),
+			artifact: "stage2-arm64",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &seeder{
+				artifactsProvider: mapProvider{"stage2-x86_64": stage2, "stage2-debug-x86_64": debugStage2},
+				overrides:         newArtifactOverrides(),
+				limits:            newLimits(nil),
+			}
+			if tt.override {
+				s.overrides.set("dev1", "stage2-x86_64", "stage2-debug-x86_64", time.Minute)
+			}
+			got := s.artifactPin(tt.req, tt.artifact)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("artifactPin() = %#v, want %#v", got, tt.want)
+			}
+		})
+	}
+}
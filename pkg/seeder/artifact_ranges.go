@@ -0,0 +1,125 @@
+// Copyright 2023 Hedgehog
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package seeder
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"sync"
+	"time"
+
+	"go.githedgehog.com/dasboot/pkg/seeder/artifacts"
+)
+
+// rangeableArtifact is an artifact which can be served in byte ranges. Artifacts which are being streamed from
+// their provider can not, and they are always being served as a whole.
+type rangeableArtifact interface {
+	io.ReadSeeker
+	Stat() (fs.FileInfo, error)
+}
+
+// artifactETags memoizes the entity tags of artifacts which have to be hashed to get them
+type artifactETags struct {
+	mu   sync.Mutex
+	tags map[string]artifactETag
+}
+
+type artifactETag struct {
+	size    int64
+	modTime time.Time
+	etag    string
+}
+
+func newArtifactETags() *artifactETags {
+	return &artifactETags{tags: make(map[string]artifactETag)}
+}
+
+// get returns the entity tag of `artifact`. The entity tag is the digest of the artifact, so that it is the same
+// for all seeders which serve the same artifact. It is only being calculated again if the size or modification
+// time of the artifact changed. `f` is at its beginning again once this returns.
+func (t *artifactETags) get(artifact string, f rangeableArtifact, fi fs.FileInfo) (string, error) {
+	if d, ok := f.(artifacts.Digester); ok {
+		return `"` + d.Digest() + `"`, nil
+	}
+	if t != nil {
+		t.mu.Lock()
+		e, ok := t.tags[artifact]
+		t.mu.Unlock()
+		if ok && e.size == fi.Size() && e.modTime.Equal(fi.ModTime()) {
+			return e.etag, nil
+		}
+	}
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", fmt.Errorf("hashing artifact: %w", err)
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return "", fmt.Errorf("hashing artifact: %w", err)
+	}
+	etag := `"sha256:` + hex.EncodeToString(h.Sum(nil)) + `"`
+	if t != nil {
+		t.mu.Lock()
+		t.tags[artifact] = artifactETag{size: fi.Size(), modTime: fi.ModTime(), etag: etag}
+		t.mu.Unlock()
+	}
+	return etag, nil
+}
+
+// serveArtifactRanges serves `f` with support for Range and If-Range requests, so that clients can resume
+// interrupted downloads and download large artifacts in chunks. All bytes of the response body are also written
+// to `w2`. It returns the number of bytes which have been written, and it responds with an error itself if
+// the artifact cannot be served at all.
+func (s *seeder) serveArtifactRanges(w http.ResponseWriter, r *http.Request, artifact string, f rangeableArtifact, w2 io.Writer) (int64, error) {
+	fi, err := f.Stat()
+	if err != nil {
+		errorWithJSON(w, r, http.StatusInternalServerError, "artifact '%s': %s", artifact, err)
+		return 0, fmt.Errorf("stat artifact: %w", err)
+	}
+	etag, err := s.etags.get(artifact, f, fi)
+	if err != nil {
+		errorWithJSON(w, r, http.StatusInternalServerError, "artifact '%s': %s", artifact, err)
+		return 0, err
+	}
+	w.Header().Set("ETag", etag)
+
+	// artifacts with a digest from their provider might be spooled per request, so their
+	// modification time is meaningless
+	modTime := fi.ModTime()
+	if _, ok := f.(artifacts.Digester); ok {
+		modTime = time.Time{}
+	}
+	cw := &countingResponseWriter{ResponseWriter: w, w: w2}
+	http.ServeContent(cw, r, "", modTime, f)
+	return cw.n, nil
+}
+
+// countingResponseWriter counts the bytes of the response body, and also writes them to `w`
+type countingResponseWriter struct {
+	http.ResponseWriter
+	w io.Writer
+	n int64
+}
+
+func (cw *countingResponseWriter) Write(b []byte) (int, error) {
+	n, err := cw.ResponseWriter.Write(b)
+	cw.n += int64(n)
+	cw.w.Write(b[:n]) //nolint: errcheck
+	return n, err
+}
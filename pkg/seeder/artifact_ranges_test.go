@@ -0,0 +1,149 @@
+// Copyright 2023 Hedgehog
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package seeder
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"go.githedgehog.com/dasboot/pkg/seeder/artifacts"
+	"go.githedgehog.com/dasboot/pkg/seeder/artifacts/file"
+)
+
+// streamProvider serves artifacts which cannot be seeked, like the ones from a registry
+type streamProvider map[string][]byte
+
+func (p streamProvider) Get(artifact string) io.ReadCloser {
+	b, ok := p[artifact]
+	if !ok {
+		return nil
+	}
+	return io.NopCloser(bytes.NewReader(b))
+}
+
+func TestSeeder_getArtifactRanges(t *testing.T) {
+	artifact := bytes.Repeat([]byte("0123456789"), 1000)
+	sum := sha256.Sum256(artifact)
+	digest := "sha256:" + hex.EncodeToString(sum[:])
+	etag := `"` + digest + `"`
+
+	dir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(dir, "sonic"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "sonic", "x86_64-kvm_x86_64-r0"), artifact, 0644); err != nil {
+		t.Fatal(err)
+	}
+	verified, err := artifacts.Verified(file.Provider(dir), &artifacts.Manifest{
+		Version: "1",
+		Artifacts: map[string]artifacts.ManifestEntry{
+			"sonic/x86_64-kvm_x86_64-r0": {Digest: digest, Size: int64(len(artifact))},
+		},
+	}, t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name       string
+		provider   artifacts.Provider
+		header     http.Header
+		wantStatus int
+		wantBody   []byte
+		wantETag   string
+	}{
+		{
+			name:       "whole artifact",
+			provider:   file.Provider(dir),
+			wantStatus: http.StatusOK,
+			wantBody:   artifact,
+			wantETag:   etag,
+		},
+		{
+			name:       "byte range",
+			provider:   file.Provider(dir),
+			header:     http.Header{"Range": {"bytes=5-14"}},
+			wantStatus: http.StatusPartialContent,
+			wantBody:   artifact[5:15],
+			wantETag:   etag,
+		},
+		{
+			name:       "byte range with matching If-Range",
+			provider:   file.Provider(dir),
+			header:     http.Header{"Range": {"bytes=9990-"}, "If-Range": {etag}},
+			wantStatus: http.StatusPartialContent,
+			wantBody:   artifact[9990:],
+			wantETag:   etag,
+		},
+		{
+			name:       "stale If-Range gets the whole artifact",
+			provider:   file.Provider(dir),
+			header:     http.Header{"Range": {"bytes=5-14"}, "If-Range": {`"sha256:00"`}},
+			wantStatus: http.StatusOK,
+			wantBody:   artifact,
+			wantETag:   etag,
+		},
+		{
+			name:       "verified artifact uses the manifest digest",
+			provider:   verified,
+			header:     http.Header{"Range": {"bytes=5-14"}, "If-Range": {etag}},
+			wantStatus: http.StatusPartialContent,
+			wantBody:   artifact[5:15],
+			wantETag:   etag,
+		},
+		{
+			name:       "streamed artifact ignores ranges",
+			provider:   streamProvider{"sonic/x86_64-kvm_x86_64-r0": artifact},
+			header:     http.Header{"Range": {"bytes=5-14"}},
+			wantStatus: http.StatusOK,
+			wantBody:   artifact,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &seeder{
+				artifactsProvider: tt.provider,
+				overrides:         newArtifactOverrides(),
+				limits:            newLimits(nil),
+				downloads:         newDownloadSessions(),
+				metrics:           newMetrics(),
+				etags:             newArtifactETags(),
+			}
+			req := httptest.NewRequest(http.MethodGet, "/nosinstaller/x86_64-kvm_x86_64-r0", nil)
+			for k, v := range tt.header {
+				req.Header[k] = v
+			}
+			rec := httptest.NewRecorder()
+			s.getArtifact("sonic/x86_64-kvm_x86_64-r0")(rec, req)
+
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", rec.Code, tt.wantStatus, rec.Body.String())
+			}
+			if !bytes.Equal(rec.Body.Bytes(), tt.wantBody) {
+				t.Errorf("body has %d bytes which do not match the expected %d bytes", rec.Body.Len(), len(tt.wantBody))
+			}
+			if got := rec.Header().Get("ETag"); got != tt.wantETag {
+				t.Errorf("ETag = %q, want %q", got, tt.wantETag)
+			}
+		})
+	}
+}
@@ -0,0 +1,309 @@
+// Copyright 2023 Hedgehog
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package artifacts
+
+import (
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"go.githedgehog.com/dasboot/pkg/log"
+	"go.githedgehog.com/dasboot/pkg/version"
+	"go.uber.org/zap"
+)
+
+const (
+	// DefaultCacheMaxSize is the default size limit of all cached artifacts together
+	DefaultCacheMaxSize int64 = 8 * 1024 * 1024 * 1024
+
+	// DefaultCacheTTL is the default time after which a cached artifact is being fetched again
+	DefaultCacheTTL = time.Hour
+)
+
+var ErrCacheIntegrity = errors.New("artifacts: cached artifact is corrupted")
+
+// CacheOption configures a caching provider
+type CacheOption func(*cache)
+
+// CacheOptionMaxSize limits the size of all cached artifacts together to `maxSize` bytes. The least recently
+// used artifacts are being evicted first. Artifacts which are larger than that are not being cached at all.
+func CacheOptionMaxSize(maxSize int64) CacheOption {
+	return func(c *cache) {
+		c.maxSize = maxSize
+	}
+}
+
+// CacheOptionTTL sets the time after which a cached artifact expires and is being fetched again
+func CacheOptionTTL(ttl time.Duration) CacheOption {
+	return func(c *cache) {
+		c.ttl = ttl
+	}
+}
+
+type cacheEntry struct {
+	artifact string
+	path     string
+	size     int64
+	sum      []byte
+	fetched  time.Time
+}
+
+type cache struct {
+	p       Provider
+	dir     string
+	maxSize int64
+	ttl     time.Duration
+	now     func() time.Time
+
+	lock    sync.Mutex
+	size    int64
+	lru     *list.List
+	entries map[string]*list.Element
+}
+
+var (
+	_ Provider           = &cache{}
+	_ ProvenanceProvider = &cache{}
+	_ HealthChecker      = &cache{}
+)
+
+// Cached wraps the provider `p` with a cache on local disk in `dir`, so that remote providers like a registry are not
+// being hit on every request. Artifacts are being cached while they are being served for the first time, and their
+// checksum is being verified whenever they are being served from the cache. The cache starts out empty: the cache
+// files of previous instances are being removed.
+func Cached(p Provider, dir string, options ...CacheOption) (Provider, error) {
+	ret := &cache{
+		p:       p,
+		maxSize: DefaultCacheMaxSize,
+		ttl:     DefaultCacheTTL,
+		now:     time.Now,
+		lru:     list.New(),
+		entries: make(map[string]*list.Element),
+	}
+	for _, opt := range options {
+		opt(ret)
+	}
+	if dir == "" {
+		return nil, fmt.Errorf("cache directory must not be empty")
+	}
+	if ret.maxSize <= 0 {
+		return nil, fmt.Errorf("cache max size must be positive")
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("creating cache directory: %w", err)
+	}
+
+	// every instance gets its own directory, as the instance which we replace might still be serving from its own
+	old, err := filepath.Glob(filepath.Join(dir, "cache-*"))
+	if err != nil {
+		return nil, err
+	}
+	for _, path := range old {
+		if err := os.RemoveAll(path); err != nil {
+			log.L().Warn("artifacts: removing old cache failed", zap.String("path", path), zap.Error(err))
+		}
+	}
+	ret.dir, err = os.MkdirTemp(dir, "cache-*")
+	if err != nil {
+		return nil, fmt.Errorf("creating cache directory: %w", err)
+	}
+	return ret, nil
+}
+
+// Get implements Provider
+func (c *cache) Get(artifact string) io.ReadCloser {
+	if e := c.lookup(artifact); e != nil {
+		f, err := os.Open(e.path)
+		if err == nil {
+			log.L().Debug("artifacts: serving artifact from the cache", zap.String("artifact", artifact))
+			return &verifyingReadCloser{c: c, e: e, f: f, h: sha256.New()}
+		}
+		log.L().Warn("artifacts: opening cached artifact failed", zap.String("artifact", artifact), zap.Error(err))
+		c.evict(artifact, e)
+	}
+
+	rc := c.p.Get(artifact)
+	if rc == nil {
+		return nil
+	}
+	tmp, err := os.CreateTemp(c.dir, "download-*")
+	if err != nil {
+		log.L().Warn("artifacts: artifact will not be cached", zap.String("artifact", artifact), zap.Error(err))
+		return rc
+	}
+	return &cachingReadCloser{c: c, artifact: artifact, rc: rc, tmp: tmp, h: sha256.New(), fetched: c.now()}
+}
+
+// CheckHealth implements HealthChecker
+func (c *cache) CheckHealth(ctx context.Context) error {
+	return CheckHealth(ctx, c.p)
+}
+
+// Provenance implements ProvenanceProvider
+func (c *cache) Provenance(artifact string) *version.Provenance {
+	if pp, ok := c.p.(ProvenanceProvider); ok {
+		return pp.Provenance(artifact)
+	}
+	return nil
+}
+
+// lookup returns the cache entry of `artifact` if it did not expire yet, and marks it as used
+func (c *cache) lookup(artifact string) *cacheEntry {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	el, ok := c.entries[artifact]
+	if !ok {
+		return nil
+	}
+	e := el.Value.(*cacheEntry) //nolint: forcetypeassert
+	if c.ttl > 0 && c.now().Sub(e.fetched) > c.ttl {
+		c.remove(el)
+		return nil
+	}
+	c.lru.MoveToFront(el)
+	return e
+}
+
+// evict removes `e` from the cache if it is still the entry of `artifact`
+func (c *cache) evict(artifact string, e *cacheEntry) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if el, ok := c.entries[artifact]; ok && el.Value == e {
+		c.remove(el)
+	}
+}
+
+// add adds `e` to the cache, and evicts the least recently used entries until the cache fits into its size again
+func (c *cache) add(e *cacheEntry) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if el, ok := c.entries[e.artifact]; ok {
+		c.remove(el)
+	}
+	c.entries[e.artifact] = c.lru.PushFront(e)
+	c.size += e.size
+	for c.size > c.maxSize {
+		c.remove(c.lru.Back())
+	}
+}
+
+// remove removes the entry `el` and its file, the lock must be held. Readers which opened the file already can
+// still finish reading it.
+func (c *cache) remove(el *list.Element) {
+	e := c.lru.Remove(el).(*cacheEntry) //nolint: forcetypeassert
+	delete(c.entries, e.artifact)
+	c.size -= e.size
+	if err := os.Remove(e.path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		log.L().Warn("artifacts: removing cached artifact failed", zap.String("artifact", e.artifact), zap.Error(err))
+	}
+}
+
+// cachingReadCloser writes the artifact into the cache while it is being read. The artifact is only being added to the
+// cache if it was read completely.
+type cachingReadCloser struct {
+	c        *cache
+	artifact string
+	rc       io.ReadCloser
+	tmp      *os.File
+	h        hash.Hash
+	size     int64
+	fetched  time.Time
+	complete bool
+}
+
+// Read implements io.ReadCloser
+func (r *cachingReadCloser) Read(p []byte) (int, error) {
+	n, err := r.rc.Read(p)
+	if n > 0 && r.tmp != nil {
+		r.size += int64(n)
+		r.h.Write(p[:n]) //nolint: errcheck
+		if r.size > r.c.maxSize {
+			r.discard()
+		} else if _, werr := r.tmp.Write(p[:n]); werr != nil {
+			log.L().Warn("artifacts: writing artifact into the cache failed", zap.String("artifact", r.artifact), zap.Error(werr))
+			r.discard()
+		}
+	}
+	if errors.Is(err, io.EOF) {
+		r.complete = true
+	}
+	return n, err
+}
+
+// Close implements io.ReadCloser
+func (r *cachingReadCloser) Close() error {
+	err := r.rc.Close()
+	if r.tmp == nil {
+		return err
+	}
+	if !r.complete {
+		r.discard()
+		return err
+	}
+	path := r.tmp.Name()
+	if cerr := r.tmp.Close(); cerr != nil {
+		log.L().Warn("artifacts: writing artifact into the cache failed", zap.String("artifact", r.artifact), zap.Error(cerr))
+		os.Remove(path) //nolint: errcheck
+		return err
+	}
+	r.c.add(&cacheEntry{
+		artifact: r.artifact,
+		path:     path,
+		size:     r.size,
+		sum:      r.h.Sum(nil),
+		fetched:  r.fetched,
+	})
+	return err
+}
+
+func (r *cachingReadCloser) discard() {
+	r.tmp.Close()           //nolint: errcheck
+	os.Remove(r.tmp.Name()) //nolint: errcheck
+	r.tmp = nil
+}
+
+// verifyingReadCloser serves a cached artifact and verifies its checksum once it was read completely. A corrupted
+// artifact is being evicted, and the reader fails instead of returning EOF.
+type verifyingReadCloser struct {
+	c *cache
+	e *cacheEntry
+	f *os.File
+	h hash.Hash
+}
+
+// Read implements io.ReadCloser
+func (r *verifyingReadCloser) Read(p []byte) (int, error) {
+	n, err := r.f.Read(p)
+	r.h.Write(p[:n]) //nolint: errcheck
+	if errors.Is(err, io.EOF) && string(r.h.Sum(nil)) != string(r.e.sum) {
+		log.L().Error("artifacts: cached artifact is corrupted, evicting it", zap.String("artifact", r.e.artifact))
+		r.c.evict(r.e.artifact, r.e)
+		return n, ErrCacheIntegrity
+	}
+	return n, err
+}
+
+// Close implements io.ReadCloser
+func (r *verifyingReadCloser) Close() error {
+	return r.f.Close()
+}
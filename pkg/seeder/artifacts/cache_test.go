@@ -0,0 +1,181 @@
+// Copyright 2023 Hedgehog
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package artifacts
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+type countingProvider struct {
+	content map[string]string
+	gets    map[string]int
+}
+
+func (p *countingProvider) Get(artifact string) io.ReadCloser {
+	content, ok := p.content[artifact]
+	if !ok {
+		return nil
+	}
+	p.gets[artifact]++
+	return io.NopCloser(strings.NewReader(content))
+}
+
+func TestCached(t *testing.T) {
+	type step struct {
+		artifact string
+		advance  time.Duration
+		readN    int
+		corrupt  bool
+		want     string
+		wantErr  error
+		wantGets int
+	}
+	tests := []struct {
+		name    string
+		maxSize int64
+		steps   []step
+	}{
+		{
+			name:    "served from the cache",
+			maxSize: 100,
+			steps: []step{
+				{artifact: "stage0", want: "stage0", wantGets: 1},
+				{artifact: "stage0", want: "stage0", wantGets: 1},
+			},
+		},
+		{
+			name:    "expired",
+			maxSize: 100,
+			steps: []step{
+				{artifact: "stage0", want: "stage0", wantGets: 1},
+				{artifact: "stage0", advance: 2 * time.Hour, want: "stage0", wantGets: 2},
+				{artifact: "stage0", want: "stage0", wantGets: 2},
+			},
+		},
+		{
+			name:    "least recently used is evicted",
+			maxSize: 12,
+			steps: []step{
+				{artifact: "stage0", want: "stage0", wantGets: 1},
+				{artifact: "stage1", want: "stage1", wantGets: 1},
+				{artifact: "stage0", want: "stage0", wantGets: 1},
+				{artifact: "stage2", want: "stage2", wantGets: 1},
+				{artifact: "stage0", want: "stage0", wantGets: 1},
+				{artifact: "stage1", want: "stage1", wantGets: 2},
+			},
+		},
+		{
+			name:    "too large",
+			maxSize: 5,
+			steps: []step{
+				{artifact: "stage0", want: "stage0", wantGets: 1},
+				{artifact: "stage0", want: "stage0", wantGets: 2},
+			},
+		},
+		{
+			name:    "partially read",
+			maxSize: 100,
+			steps: []step{
+				{artifact: "stage0", readN: 3, want: "sta", wantGets: 1},
+				{artifact: "stage0", want: "stage0", wantGets: 2},
+				{artifact: "stage0", want: "stage0", wantGets: 2},
+			},
+		},
+		{
+			name:    "corrupted",
+			maxSize: 100,
+			steps: []step{
+				{artifact: "stage0", want: "stage0", wantGets: 1},
+				{artifact: "stage0", corrupt: true, want: "Stage0", wantErr: ErrCacheIntegrity, wantGets: 1},
+				{artifact: "stage0", want: "stage0", wantGets: 2},
+			},
+		},
+		{
+			name:    "not found",
+			maxSize: 100,
+			steps: []step{
+				{artifact: "stage3", wantGets: 0},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := &countingProvider{
+				content: map[string]string{"stage0": "stage0", "stage1": "stage1", "stage2": "stage2"},
+				gets:    map[string]int{},
+			}
+			cp, err := Cached(p, t.TempDir(), CacheOptionMaxSize(tt.maxSize), CacheOptionTTL(time.Hour))
+			if err != nil {
+				t.Fatal(err)
+			}
+			c := cp.(*cache) //nolint: forcetypeassert
+			now := time.Now()
+			c.now = func() time.Time { return now }
+			for i, s := range tt.steps {
+				now = now.Add(s.advance)
+				if s.corrupt {
+					if err := os.WriteFile(c.entries[s.artifact].Value.(*cacheEntry).path, []byte("Stage0"), 0o600); err != nil { //nolint: forcetypeassert
+						t.Fatal(err)
+					}
+				}
+				rc := cp.Get(s.artifact)
+				if rc == nil {
+					if s.want != "" {
+						t.Fatalf("step %d: Get() returned nil", i)
+					}
+					continue
+				}
+				var r io.Reader = rc
+				if s.readN > 0 {
+					r = io.LimitReader(rc, int64(s.readN))
+				}
+				got, err := io.ReadAll(r)
+				rc.Close()
+				if !errors.Is(err, s.wantErr) {
+					t.Errorf("step %d: read error = %v, want %v", i, err, s.wantErr)
+				}
+				if string(got) != s.want {
+					t.Errorf("step %d: got %q, want %q", i, got, s.want)
+				}
+				if p.gets[s.artifact] != s.wantGets {
+					t.Errorf("step %d: provider was hit %d times, want %d", i, p.gets[s.artifact], s.wantGets)
+				}
+				if c.size > tt.maxSize {
+					t.Errorf("step %d: cache size %d exceeds %d", i, c.size, tt.maxSize)
+				}
+			}
+		})
+	}
+}
+
+func TestCached_removesOldCaches(t *testing.T) {
+	dir := t.TempDir()
+	old := filepath.Join(dir, "cache-old")
+	if err := os.Mkdir(old, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Cached(&countingProvider{}, dir); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(old); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("old cache was not removed: %v", err)
+	}
+}
@@ -20,6 +20,7 @@ import (
 
 	"go.githedgehog.com/dasboot/pkg/log"
 	"go.githedgehog.com/dasboot/pkg/seeder/artifacts"
+	"go.githedgehog.com/dasboot/pkg/version"
 	"go.uber.org/zap"
 )
 
@@ -129,4 +130,18 @@ func (*embeddedProvider) Get(artifact string) io.ReadCloser {
 	}
 }
 
-var _ artifacts.Provider = &embeddedProvider{}
+// Provenance implements artifacts.ProvenanceProvider. The embedded artifacts are built
+// together with the seeder, so they share the build provenance of the seeder.
+func (p *embeddedProvider) Provenance(artifact string) *version.Provenance {
+	f := p.Get(artifact)
+	if f == nil {
+		return nil
+	}
+	f.Close()
+	return version.GetProvenance()
+}
+
+var (
+	_ artifacts.Provider           = &embeddedProvider{}
+	_ artifacts.ProvenanceProvider = &embeddedProvider{}
+)
@@ -16,7 +16,10 @@ package file
 
 import (
 	"bufio"
+	"context"
+	"fmt"
 	"io"
+	"io/fs"
 	"os"
 	"path/filepath"
 
@@ -29,7 +32,10 @@ type fileProvider struct {
 	base string
 }
 
-var _ artifacts.Provider = &fileProvider{}
+var (
+	_ artifacts.Provider      = &fileProvider{}
+	_ artifacts.HealthChecker = &fileProvider{}
+)
 
 // Provider will create a new file based artifacts provider
 // which tries to serve artifacts from directory `path`.
@@ -52,6 +58,18 @@ func (p *fileProvider) Get(artifact string) io.ReadCloser {
 	return newBufioReadCloser(f)
 }
 
+// CheckHealth implements artifacts.HealthChecker
+func (p *fileProvider) CheckHealth(context.Context) error {
+	st, err := os.Stat(p.base)
+	if err != nil {
+		return fmt.Errorf("file provider: %w", err)
+	}
+	if !st.IsDir() {
+		return fmt.Errorf("file provider: '%s' is not a directory", p.base)
+	}
+	return nil
+}
+
 type bufioReadCloser struct {
 	f *os.File
 	b *bufio.Reader
@@ -67,6 +85,22 @@ func (rc *bufioReadCloser) Close() error {
 	return rc.f.Close()
 }
 
+// Seek implements io.Seeker, which lets the seeder serve byte ranges of the artifact
+func (rc *bufioReadCloser) Seek(offset int64, whence int) (int64, error) {
+	if whence == io.SeekCurrent {
+		// the file is ahead of us by what is still buffered
+		offset -= int64(rc.b.Buffered())
+	}
+	n, err := rc.f.Seek(offset, whence)
+	rc.b.Reset(rc.f)
+	return n, err
+}
+
+// Stat returns the file info of the artifact
+func (rc *bufioReadCloser) Stat() (fs.FileInfo, error) {
+	return rc.f.Stat()
+}
+
 func newBufioReadCloser(f *os.File) io.ReadCloser {
 	return &bufioReadCloser{
 		f: f,
@@ -0,0 +1,217 @@
+// Copyright 2023 Hedgehog
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package artifacts
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"go.githedgehog.com/dasboot/pkg/log"
+	"go.githedgehog.com/dasboot/pkg/version"
+	"go.uber.org/zap"
+)
+
+const manifestDigestPrefix = "sha256:"
+
+var (
+	ErrManifestInvalid   = errors.New("artifacts: invalid manifest")
+	ErrManifestSignature = errors.New("artifacts: invalid manifest signature")
+)
+
+// Manifest lists the expected digests of artifacts. It is signed independently of the artifacts providers, so
+// a compromised registry or directory cannot serve tampered artifacts.
+type Manifest struct {
+	// Version identifies the manifest, it is being passed on to the stages in the artifact provenance
+	Version string `json:"version"`
+
+	// Artifacts are the expected digests keyed by the artifact names as they are being requested from the
+	// providers, including their tags, e.g. "sonic/x86_64-kvm_x86_64-r0:4.2.0"
+	Artifacts map[string]ManifestEntry `json:"artifacts"`
+}
+
+// ManifestEntry is the expected digest of an artifact
+type ManifestEntry struct {
+	// Digest is the digest of the artifact in the form `sha256:<hex>`
+	Digest string `json:"digest"`
+
+	// Size is the size of the artifact
+	Size int64 `json:"size"`
+}
+
+// Lookup returns the entry of `artifact`
+func (m *Manifest) Lookup(artifact string) (ManifestEntry, bool) {
+	if m == nil {
+		return ManifestEntry{}, false
+	}
+	e, ok := m.Artifacts[artifact]
+	return e, ok
+}
+
+// LoadManifest loads the manifest at `path` and verifies its detached signature at `signaturePath` with the
+// certificate at `certPath`. The signature is the base64 encoded ASN.1 ECDSA signature over the SHA-256 checksum
+// of the manifest file, just like the signatures of the seeder responses.
+func LoadManifest(path, signaturePath, certPath string) (*Manifest, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrManifestInvalid, err)
+	}
+	sigStr, err := os.ReadFile(signaturePath)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrManifestSignature, err)
+	}
+	sig, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(sigStr)))
+	if err != nil {
+		return nil, fmt.Errorf("%w: decoding signature: %w", ErrManifestSignature, err)
+	}
+	certPEM, err := os.ReadFile(certPath)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrManifestSignature, err)
+	}
+	p, _ := pem.Decode(certPEM)
+	if p == nil || p.Type != "CERTIFICATE" {
+		return nil, fmt.Errorf("%w: no certificate in '%s'", ErrManifestSignature, certPath)
+	}
+	cert, err := x509.ParseCertificate(p.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("%w: parsing certificate: %w", ErrManifestSignature, err)
+	}
+	pub, ok := cert.PublicKey.(*ecdsa.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("%w: certificate has no ECDSA public key", ErrManifestSignature)
+	}
+	cks := sha256.Sum256(b)
+	if !ecdsa.VerifyASN1(pub, cks[:], sig) {
+		return nil, fmt.Errorf("%w: signature does not match '%s'", ErrManifestSignature, path)
+	}
+
+	var ret Manifest
+	if err := json.Unmarshal(b, &ret); err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrManifestInvalid, err)
+	}
+	if ret.Version == "" {
+		return nil, fmt.Errorf("%w: version must be set", ErrManifestInvalid)
+	}
+	for artifact, e := range ret.Artifacts {
+		hexDigest, ok := strings.CutPrefix(e.Digest, manifestDigestPrefix)
+		if d, err := hex.DecodeString(hexDigest); !ok || err != nil || len(d) != sha256.Size || e.Size < 0 {
+			return nil, fmt.Errorf("%w: unsupported digest '%s' or size %d of artifact '%s'", ErrManifestInvalid, e.Digest, e.Size, artifact)
+		}
+	}
+	return &ret, nil
+}
+
+type verifiedProvider struct {
+	p        Provider
+	m        *Manifest
+	spoolDir string
+}
+
+var (
+	_ Provider           = &verifiedProvider{}
+	_ ProvenanceProvider = &verifiedProvider{}
+	_ HealthChecker      = &verifiedProvider{}
+)
+
+// Verified wraps the provider `p` so that it only serves artifacts which match their digest in the manifest `m`.
+// Artifacts are being spooled to a file in `spoolDir` and verified completely before they are being served, and
+// artifacts which are not listed in the manifest are not being served at all.
+func Verified(p Provider, m *Manifest, spoolDir string) (Provider, error) {
+	if m == nil {
+		return nil, fmt.Errorf("%w: no manifest", ErrManifestInvalid)
+	}
+	if spoolDir == "" {
+		spoolDir = os.TempDir()
+	}
+	if err := os.MkdirAll(spoolDir, 0o755); err != nil {
+		return nil, fmt.Errorf("creating spool directory: %w", err)
+	}
+	return &verifiedProvider{p: p, m: m, spoolDir: spoolDir}, nil
+}
+
+// Get implements Provider
+func (v *verifiedProvider) Get(artifact string) io.ReadCloser {
+	e, ok := v.m.Lookup(artifact)
+	if !ok {
+		log.L().Error("artifacts: refusing to serve artifact which is not in the manifest", zap.String("artifact", artifact), zap.String("manifest", v.m.Version))
+		return nil
+	}
+	rc := v.p.Get(artifact)
+	if rc == nil {
+		return nil
+	}
+	defer rc.Close()
+
+	f, err := os.CreateTemp(v.spoolDir, "verify-*")
+	if err != nil {
+		log.L().Error("artifacts: creating spool file failed", zap.String("artifact", artifact), zap.Error(err))
+		return nil
+	}
+	// the spool file is gone once it gets closed, nothing can leak
+	os.Remove(f.Name()) //nolint: errcheck
+
+	// one byte more than expected is enough to notice that the artifact is too large
+	h := sha256.New()
+	n, err := io.Copy(io.MultiWriter(f, h), io.LimitReader(rc, e.Size+1))
+	if err == nil && n != e.Size {
+		err = fmt.Errorf("size does not match: got %d bytes, expected %d bytes", n, e.Size)
+	}
+	if digest := manifestDigestPrefix + hex.EncodeToString(h.Sum(nil)); err == nil && digest != e.Digest {
+		err = fmt.Errorf("digest does not match: got %s, expected %s", digest, e.Digest)
+	}
+	if err == nil {
+		_, err = f.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		f.Close()
+		log.L().Error("artifacts: refusing to serve artifact which does not match the manifest", zap.String("artifact", artifact), zap.String("manifest", v.m.Version), zap.Error(err))
+		return nil
+	}
+	return &verifiedFile{File: f, digest: e.Digest}
+}
+
+// verifiedFile is a spooled artifact which matches its manifest entry
+type verifiedFile struct {
+	*os.File
+	digest string
+}
+
+// Digest implements Digester
+func (f *verifiedFile) Digest() string {
+	return f.digest
+}
+
+// CheckHealth implements HealthChecker
+func (v *verifiedProvider) CheckHealth(ctx context.Context) error {
+	return CheckHealth(ctx, v.p)
+}
+
+// Provenance implements ProvenanceProvider
+func (v *verifiedProvider) Provenance(artifact string) *version.Provenance {
+	if pp, ok := v.p.(ProvenanceProvider); ok {
+		return pp.Provenance(artifact)
+	}
+	return nil
+}
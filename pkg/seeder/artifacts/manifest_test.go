@@ -0,0 +1,193 @@
+// Copyright 2023 Hedgehog
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package artifacts
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"io"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func testDigest(b string) string {
+	cks := sha256.Sum256([]byte(b))
+	return manifestDigestPrefix + hex.EncodeToString(cks[:])
+}
+
+// writeTestManifest writes `m` signed by a new key, and returns the paths of the manifest, its signature and
+// the certificate
+func writeTestManifest(t *testing.T, m *Manifest) (string, string, string) {
+	t.Helper()
+	dir := t.TempDir()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "Manifest Signer"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := json.Marshal(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cks := sha256.Sum256(b)
+	sig, err := ecdsa.SignASN1(rand.Reader, key, cks[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	paths := []string{filepath.Join(dir, "manifest.json"), filepath.Join(dir, "manifest.json.sig"), filepath.Join(dir, "cert.pem")}
+	for i, content := range [][]byte{b, []byte(base64.StdEncoding.EncodeToString(sig)), pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})} {
+		if err := os.WriteFile(paths[i], content, 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return paths[0], paths[1], paths[2]
+}
+
+func TestLoadManifest(t *testing.T) {
+	valid := &Manifest{Version: "v1", Artifacts: map[string]ManifestEntry{"stage0": {Digest: testDigest("stage0"), Size: 6}}}
+	tests := []struct {
+		name     string
+		manifest *Manifest
+		tamper   bool
+		otherSig bool
+		wantErr  error
+	}{
+		{
+			name:     "valid",
+			manifest: valid,
+		},
+		{
+			name:     "tampered",
+			manifest: valid,
+			tamper:   true,
+			wantErr:  ErrManifestSignature,
+		},
+		{
+			name:     "signed by another key",
+			manifest: valid,
+			otherSig: true,
+			wantErr:  ErrManifestSignature,
+		},
+		{
+			name:     "no version",
+			manifest: &Manifest{Artifacts: valid.Artifacts},
+			wantErr:  ErrManifestInvalid,
+		},
+		{
+			name:     "invalid digest",
+			manifest: &Manifest{Version: "v1", Artifacts: map[string]ManifestEntry{"stage0": {Digest: "md5:abcd", Size: 6}}},
+			wantErr:  ErrManifestInvalid,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path, sigPath, certPath := writeTestManifest(t, tt.manifest)
+			if tt.tamper {
+				if err := os.WriteFile(path, []byte(`{"version":"v2","artifacts":{}}`), 0o600); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if tt.otherSig {
+				_, _, certPath = writeTestManifest(t, tt.manifest)
+			}
+			got, err := LoadManifest(path, sigPath, certPath)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("LoadManifest() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && got.Version != tt.manifest.Version {
+				t.Errorf("LoadManifest() version = %s, want %s", got.Version, tt.manifest.Version)
+			}
+		})
+	}
+}
+
+func TestVerified(t *testing.T) {
+	p := &countingProvider{
+		content: map[string]string{
+			"stage0":          "stage0",
+			"stage1":          "tampered",
+			"stage2":          "stage2 with more",
+			"sonic:4.2.0":     "sonic",
+			"not-in-manifest": "unlisted",
+		},
+		gets: map[string]int{},
+	}
+	m := &Manifest{Version: "v1", Artifacts: map[string]ManifestEntry{
+		"stage0":      {Digest: testDigest("stage0"), Size: 6},
+		"stage1":      {Digest: testDigest("stage1"), Size: 6},
+		"stage2":      {Digest: testDigest("stage2"), Size: 6},
+		"sonic:4.2.0": {Digest: testDigest("sonic"), Size: 5},
+		"missing":     {Digest: testDigest("missing"), Size: 7},
+	}}
+	v, err := Verified(p, m, t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		artifact string
+		want     string
+	}{
+		{artifact: "stage0", want: "stage0"},
+		{artifact: "sonic:4.2.0", want: "sonic"},
+		{artifact: "stage1"},
+		{artifact: "stage2"},
+		{artifact: "missing"},
+		{artifact: "not-in-manifest"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.artifact, func(t *testing.T) {
+			rc := v.Get(tt.artifact)
+			if rc == nil {
+				if tt.want != "" {
+					t.Fatalf("Get() returned nil")
+				}
+				return
+			}
+			defer rc.Close()
+			got, err := io.ReadAll(rc)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != tt.want {
+				t.Errorf("Get() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+	if p.gets["not-in-manifest"] != 0 {
+		t.Errorf("artifact which is not in the manifest was fetched from the provider")
+	}
+}
@@ -14,13 +14,23 @@
 
 package artifacts
 
-import "io"
+import (
+	"context"
+	"errors"
+	"io"
+
+	"go.githedgehog.com/dasboot/pkg/version"
+)
 
 type multipleProviders struct {
 	providers []Provider
 }
 
-var _ Provider = &multipleProviders{}
+var (
+	_ Provider           = &multipleProviders{}
+	_ ProvenanceProvider = &multipleProviders{}
+	_ HealthChecker      = &multipleProviders{}
+)
 
 func New(providers ...Provider) Provider {
 	return &multipleProviders{providers: providers}
@@ -34,3 +44,32 @@ func (m *multipleProviders) Get(artifact string) io.ReadCloser {
 	}
 	return nil
 }
+
+// CheckHealth implements HealthChecker. All providers must be healthy, as every one of them might be the only one
+// which serves a particular artifact.
+func (m *multipleProviders) CheckHealth(ctx context.Context) error {
+	var errs []error
+	for _, p := range m.providers {
+		if err := CheckHealth(ctx, p); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Provenance implements ProvenanceProvider. It returns the provenance from the provider which would
+// serve the artifact on `Get`.
+func (m *multipleProviders) Provenance(artifact string) *version.Provenance {
+	for _, p := range m.providers {
+		r := p.Get(artifact)
+		if r == nil {
+			continue
+		}
+		r.Close()
+		if pp, ok := p.(ProvenanceProvider); ok {
+			return pp.Provenance(artifact)
+		}
+		return nil
+	}
+	return nil
+}
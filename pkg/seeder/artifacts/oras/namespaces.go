@@ -0,0 +1,111 @@
+// Copyright 2023 Hedgehog
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package oras
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+)
+
+const (
+	// placeholderEnvironment is replaced with the environment of the provider in namespace prefixes
+	placeholderEnvironment = "{environment}"
+
+	// placeholderClass is replaced with the class of the artifact in namespace prefixes, which is the first path
+	// component of the artifact name, e.g. "sonic" for "sonic/x86_64-kvm_x86_64-r0"
+	placeholderClass = "{class}"
+)
+
+var (
+	ErrInvalidNamespace   = errors.New("oras: invalid namespace")
+	ErrOutsideNamespaces  = errors.New("oras: artifact outside of the configured namespaces")
+	placeholderRegexp     = regexp.MustCompile(`\{[^}]*\}`)
+	repositoryPathRegexp  = regexp.MustCompile(`^[a-z0-9]+((\.|_|__|-+)[a-z0-9]+)*(/[a-z0-9]+((\.|_|__|-+)[a-z0-9]+)*)*$`)
+	supportedPlaceholders = map[string]struct{}{placeholderEnvironment: {}, placeholderClass: {}}
+)
+
+// Namespace maps a class of artifacts to a repository prefix within the registry. This allows one registry to host
+// the artifacts of several fabrics or environments.
+type Namespace struct {
+	// Artifacts is a pattern as understood by `path.Match` which selects the artifact names which belong to this
+	// namespace, e.g. "sonic/*" or "stage*".
+	Artifacts string
+
+	// Prefix is the repository prefix of the artifacts relative to the path of the registry URL. It can contain the
+	// placeholders "{environment}" and "{class}", e.g. "fabrics/{environment}/{class}".
+	Prefix string
+}
+
+// validateNamespaces validates the patterns and prefixes of all `namespaces` for `environment`
+func validateNamespaces(environment string, namespaces []Namespace) error {
+	for i, ns := range namespaces {
+		if _, err := path.Match(ns.Artifacts, ""); err != nil || ns.Artifacts == "" {
+			return fmt.Errorf("%w: namespace %d: invalid artifacts pattern '%s'", ErrInvalidNamespace, i, ns.Artifacts)
+		}
+		for _, p := range placeholderRegexp.FindAllString(ns.Prefix, -1) {
+			if _, ok := supportedPlaceholders[p]; !ok {
+				return fmt.Errorf("%w: namespace %d: unsupported placeholder '%s' in prefix '%s'", ErrInvalidNamespace, i, p, ns.Prefix)
+			}
+		}
+		if strings.Contains(ns.Prefix, placeholderEnvironment) && environment == "" {
+			return fmt.Errorf("%w: namespace %d: prefix '%s' requires an environment", ErrInvalidNamespace, i, ns.Prefix)
+		}
+
+		// the class is only known per artifact, so we validate the prefix with a valid stand-in
+		prefix := expandPrefix(ns.Prefix, environment, "class")
+		if prefix != "" && !repositoryPathRegexp.MatchString(prefix) {
+			return fmt.Errorf("%w: namespace %d: prefix '%s' is not a valid repository path", ErrInvalidNamespace, i, prefix)
+		}
+	}
+	return nil
+}
+
+func expandPrefix(prefix string, environment string, class string) string {
+	ret := strings.ReplaceAll(prefix, placeholderEnvironment, environment)
+	ret = strings.ReplaceAll(ret, placeholderClass, class)
+	return strings.Trim(ret, "/")
+}
+
+// artifactClass returns the first path component of `artifact`
+func artifactClass(artifact string) string {
+	class, _, _ := strings.Cut(artifact, "/")
+	return class
+}
+
+// repositoryName returns the repository name of `artifact` within the registry at `basePath`. If there are
+// namespaces, the first namespace which matches the artifact determines the prefix of the repository, and
+// artifacts which do not match any namespace are rejected.
+func repositoryName(basePath string, environment string, namespaces []Namespace, artifact string) (string, error) {
+	prefix := ""
+	if len(namespaces) > 0 {
+		found := false
+		for _, ns := range namespaces {
+			if ok, _ := path.Match(ns.Artifacts, artifact); ok {
+				prefix = expandPrefix(ns.Prefix, environment, artifactClass(artifact))
+				found = true
+				break
+			}
+		}
+		if !found {
+			return "", fmt.Errorf("%w: '%s'", ErrOutsideNamespaces, artifact)
+		}
+	}
+
+	// we need to remove the left most '/' as it would render an invalid repository name
+	return strings.TrimLeft(path.Join(basePath, prefix, artifact), "/"), nil
+}
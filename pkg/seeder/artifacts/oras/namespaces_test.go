@@ -0,0 +1,120 @@
+// Copyright 2023 Hedgehog
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package oras
+
+import (
+	"errors"
+	"testing"
+)
+
+func Test_validateNamespaces(t *testing.T) {
+	tests := []struct {
+		name        string
+		environment string
+		namespaces  []Namespace
+		wantErr     bool
+	}{
+		{
+			name:        "valid",
+			environment: "prod",
+			namespaces: []Namespace{
+				{Artifacts: "sonic/*", Prefix: "fabrics/{environment}/{class}"},
+				{Artifacts: "*", Prefix: ""},
+			},
+		},
+		{
+			name:       "invalid pattern",
+			namespaces: []Namespace{{Artifacts: "sonic/[", Prefix: "common"}},
+			wantErr:    true,
+		},
+		{
+			name:       "environment placeholder without environment",
+			namespaces: []Namespace{{Artifacts: "*", Prefix: "{environment}"}},
+			wantErr:    true,
+		},
+		{
+			name:        "unsupported placeholder",
+			environment: "prod",
+			namespaces:  []Namespace{{Artifacts: "*", Prefix: "{fabric}/{environment}"}},
+			wantErr:     true,
+		},
+		{
+			name:        "invalid repository path",
+			environment: "Prod",
+			namespaces:  []Namespace{{Artifacts: "*", Prefix: "{environment}"}},
+			wantErr:     true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateNamespaces(tt.environment, tt.namespaces)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("validateNamespaces() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil && !errors.Is(err, ErrInvalidNamespace) {
+				t.Errorf("validateNamespaces() error = %v, want %v", err, ErrInvalidNamespace)
+			}
+		})
+	}
+}
+
+func Test_repositoryName(t *testing.T) {
+	namespaces := []Namespace{
+		{Artifacts: "sonic/*", Prefix: "fabrics/{environment}/{class}"},
+		{Artifacts: "onie/*", Prefix: "common"},
+	}
+	tests := []struct {
+		name       string
+		namespaces []Namespace
+		artifact   string
+		want       string
+		wantErr    error
+	}{
+		{
+			name:     "without namespaces",
+			artifact: "sonic/x86_64-kvm_x86_64-r0",
+			want:     "githedgehog/sonic/x86_64-kvm_x86_64-r0",
+		},
+		{
+			name:       "environment and class prefix",
+			namespaces: namespaces,
+			artifact:   "sonic/x86_64-kvm_x86_64-r0",
+			want:       "githedgehog/fabrics/staging/sonic/sonic/x86_64-kvm_x86_64-r0",
+		},
+		{
+			name:       "static prefix",
+			namespaces: namespaces,
+			artifact:   "onie/updater",
+			want:       "githedgehog/common/onie/updater",
+		},
+		{
+			name:       "outside of namespaces",
+			namespaces: namespaces,
+			artifact:   "stage2-x86_64",
+			wantErr:    ErrOutsideNamespaces,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := repositoryName("/githedgehog", "staging", tt.namespaces, tt.artifact)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("repositoryName() error = %v, want %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("repositoryName() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
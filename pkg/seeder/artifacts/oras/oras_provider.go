@@ -24,7 +24,6 @@ import (
 	"net/http"
 	"net/url"
 	"os"
-	"path"
 	"strings"
 	"time"
 
@@ -50,12 +49,17 @@ type orasProvider struct {
 	accessToken       string
 	refreshToken      string
 	fileStoreBasePath string
+	environment       string
+	namespaces        []Namespace
 
 	url      *url.URL
 	registry *remote.Registry
 }
 
-var _ artifacts.Provider = &orasProvider{}
+var (
+	_ artifacts.Provider      = &orasProvider{}
+	_ artifacts.HealthChecker = &orasProvider{}
+)
 
 func Provider(ctx context.Context, registryURL, fileStoreBasePath string, options ...ProviderOption) (artifacts.Provider, error) {
 	var err error
@@ -73,6 +77,10 @@ func Provider(ctx context.Context, registryURL, fileStoreBasePath string, option
 		return nil, fmt.Errorf("fileStoreBasePath must not be empty")
 	}
 
+	if err := validateNamespaces(ret.environment, ret.namespaces); err != nil {
+		return nil, err
+	}
+
 	// parse URL
 	ret.url, err = url.Parse(registryURL)
 	if err != nil {
@@ -166,10 +174,12 @@ func (op *orasProvider) Get(artifact string) (rc io.ReadCloser) {
 	}
 	log.L().Debug("oras: fetching artifact", zap.String("artifact", artifact), zap.String("tag", tagName))
 
-	// build repo name from artifact
-	// we need to remove the left most '/' as it would render an invalid repository name
-	repoName := path.Join(op.url.Path, artifact)
-	repoName = strings.TrimLeft(repoName, "/")
+	// build repo name from artifact within the configured namespaces
+	repoName, err := repositoryName(op.url.Path, op.environment, op.namespaces, artifact)
+	if err != nil {
+		log.L().Warn("oras: artifact requested outside of the configured namespaces of the registry", zap.String("artifact", artifact), zap.String("environment", op.environment), zap.Error(err))
+		return nil
+	}
 	src, err := op.registry.Repository(ctx, repoName)
 	if err != nil {
 		log.L().Error("oras: getting repository reference failed", zap.String("repo", repoName), zap.Error(err))
@@ -239,6 +249,14 @@ func (op *orasProvider) Get(artifact string) (rc io.ReadCloser) {
 	return nil
 }
 
+// CheckHealth implements artifacts.HealthChecker
+func (op *orasProvider) CheckHealth(ctx context.Context) error {
+	if err := op.registry.Ping(ctx); err != nil {
+		return fmt.Errorf("oras: registry '%s' unreachable: %w", op.url.Host, err)
+	}
+	return nil
+}
+
 type orasReadCloser struct {
 	fileStorePath string
 	rc            io.ReadCloser
@@ -47,3 +47,12 @@ func ProviderOptionRefreshToken(refreshToken string) func(*orasProvider) {
 		op.refreshToken = refreshToken
 	}
 }
+
+// ProviderOptionNamespaces restricts the provider to the artifacts which match one of the `namespaces`, and prefixes
+// their repositories accordingly. `environment` is the value of the "{environment}" placeholder in the prefixes.
+func ProviderOptionNamespaces(environment string, namespaces []Namespace) func(*orasProvider) {
+	return func(op *orasProvider) {
+		op.environment = environment
+		op.namespaces = namespaces
+	}
+}
@@ -14,9 +14,44 @@
 
 package artifacts
 
-import "io"
+import (
+	"context"
+	"io"
+
+	"go.githedgehog.com/dasboot/pkg/version"
+)
 
 // Provider is an interface for retrieving artifacts as they are going to be used by the seeder servers.
 type Provider interface {
 	Get(string) io.ReadCloser
 }
+
+// ProvenanceProvider can optionally be implemented by a Provider if it knows the build provenance
+// of its artifacts.
+type ProvenanceProvider interface {
+	// Provenance returns the build provenance of the artifact, or nil if it is not known
+	Provenance(string) *version.Provenance
+}
+
+// Digester can optionally be implemented by the artifacts which a Provider returns if it knows their digest
+// without reading them.
+type Digester interface {
+	// Digest returns the digest of the artifact in the form `sha256:<hex>`
+	Digest() string
+}
+
+// HealthChecker can optionally be implemented by a Provider which depends on a backend that can become
+// unavailable, like a registry or a mounted directory.
+type HealthChecker interface {
+	// CheckHealth returns an error if the backend of the provider is not available
+	CheckHealth(context.Context) error
+}
+
+// CheckHealth checks the health of `p` if it implements HealthChecker. Providers which do not implement it
+// are always considered healthy.
+func CheckHealth(ctx context.Context, p Provider) error {
+	if hc, ok := p.(HealthChecker); ok {
+		return hc.CheckHealth(ctx)
+	}
+	return nil
+}
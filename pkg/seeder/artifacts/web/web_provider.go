@@ -0,0 +1,333 @@
+// Copyright 2023 Hedgehog
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package web
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"go.githedgehog.com/dasboot/pkg/log"
+	"go.githedgehog.com/dasboot/pkg/seeder/artifacts"
+	"go.uber.org/zap"
+)
+
+var ErrArtifactNotFound = errors.New("web: artifact not found")
+
+type webProvider struct {
+	ctx context.Context
+
+	serverCAPath string
+	username     string
+	password     string
+	cacheDir     string
+
+	url    *url.URL
+	client *http.Client
+
+	locksLock sync.Mutex
+	locks     map[string]*artifactLock
+}
+
+// cacheMeta are the validators of a cached artifact which are being sent to the server for revalidation
+type cacheMeta struct {
+	ETag         string `json:"etag,omitempty"`
+	LastModified string `json:"last_modified,omitempty"`
+}
+
+// artifactLock serializes the downloads of one artifact
+type artifactLock struct {
+	sync.Mutex
+	refs int
+}
+
+var (
+	_ artifacts.Provider      = &webProvider{}
+	_ artifacts.HealthChecker = &webProvider{}
+)
+
+// Provider will create a new artifacts provider which downloads artifacts from a plain HTTP(S) artifact server
+// at `serverURL`. An artifact is being fetched from the path of its name relative to `serverURL`, and it is being
+// cached in `cacheDir`. Cached artifacts are being revalidated with the server on every request, and they are
+// being served from the cache if the server is unreachable.
+func Provider(ctx context.Context, serverURL, cacheDir string, options ...ProviderOption) (artifacts.Provider, error) {
+	var err error
+	// apply options
+	ret := &webProvider{
+		ctx:      ctx,
+		cacheDir: cacheDir,
+		locks:    make(map[string]*artifactLock),
+	}
+	for _, opt := range options {
+		opt(ret)
+	}
+
+	// create the cache
+	if cacheDir == "" {
+		return nil, fmt.Errorf("cacheDir must not be empty")
+	}
+	if err := os.MkdirAll(cacheDir, 0o755); err != nil {
+		return nil, fmt.Errorf("creating cache directory: %w", err)
+	}
+
+	// parse URL
+	ret.url, err = url.Parse(serverURL)
+	if err != nil {
+		return nil, fmt.Errorf("parsing server URL: %w", err)
+	}
+	switch ret.url.Scheme {
+	case "https":
+	case "http":
+		if ret.username != "" || ret.password != "" {
+			return nil, fmt.Errorf("basic auth credentials must not be sent over plain HTTP")
+		}
+		if ret.serverCAPath != "" {
+			return nil, fmt.Errorf("server CA requires an HTTPS URL")
+		}
+	default:
+		return nil, fmt.Errorf("server URL must have HTTP or HTTPS scheme, got '%s'", ret.url.Scheme)
+	}
+
+	// unlike the other providers we fail if the CA cannot be loaded: falling back to the system CAs would
+	// silently undo the pinning
+	var rootCAs *x509.CertPool
+	if ret.serverCAPath != "" {
+		b, err := os.ReadFile(ret.serverCAPath)
+		if err != nil {
+			return nil, fmt.Errorf("reading server CA: %w", err)
+		}
+		rootCAs = x509.NewCertPool()
+		if !rootCAs.AppendCertsFromPEM(b) {
+			return nil, fmt.Errorf("no certificates in server CA '%s'", ret.serverCAPath)
+		}
+	}
+
+	ret.client = &http.Client{
+		Transport: &http.Transport{
+			// take proxy from the environment if set
+			Proxy: http.ProxyFromEnvironment,
+			DialContext: (&net.Dialer{
+				Timeout:       30 * time.Second,
+				KeepAlive:     30 * time.Second,
+				FallbackDelay: 600 * time.Millisecond,
+			}).DialContext,
+			MaxIdleConns:          10,
+			MaxConnsPerHost:       3,
+			IdleConnTimeout:       90 * time.Second,
+			TLSHandshakeTimeout:   10 * time.Second,
+			ResponseHeaderTimeout: 60 * time.Second,
+			ExpectContinueTimeout: 1 * time.Second,
+			ForceAttemptHTTP2:     true,
+			TLSClientConfig: &tls.Config{
+				Rand:       rand.Reader,
+				Time:       time.Now,
+				RootCAs:    rootCAs,
+				MinVersion: tls.VersionTLS12,
+			},
+		},
+	}
+
+	return ret, nil
+}
+
+// Get implements artifacts.Provider
+func (wp *webProvider) Get(artifact string) io.ReadCloser {
+	// artifacts must stay within the URL of the server
+	if artifact == "" || path.Clean("/"+artifact) != "/"+artifact {
+		log.L().Warn("web: invalid artifact name", zap.String("artifact", artifact))
+		return nil
+	}
+
+	unlock := wp.lock(artifact)
+	defer unlock()
+
+	cachePath := wp.cachePath(artifact)
+	f, err := wp.fetch(artifact, cachePath)
+	if err == nil {
+		return f
+	}
+	if errors.Is(err, ErrArtifactNotFound) {
+		log.L().Debug("web: artifact not found", zap.String("artifact", artifact))
+		return nil
+	}
+
+	// air-gapped mirrors are not always reachable, serve what we have in that case
+	f, cacheErr := os.Open(cachePath)
+	if cacheErr != nil {
+		log.L().Error("web: fetching artifact failed", zap.String("artifact", artifact), zap.Error(err))
+		return nil
+	}
+	log.L().Warn("web: fetching artifact failed, serving it from the cache", zap.String("artifact", artifact), zap.Error(err))
+	return f
+}
+
+// fetch revalidates or downloads `artifact` into `cachePath`, and opens it
+func (wp *webProvider) fetch(artifact, cachePath string) (*os.File, error) {
+	req, err := http.NewRequestWithContext(wp.ctx, http.MethodGet, wp.url.JoinPath(artifact).String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	if wp.username != "" || wp.password != "" {
+		req.SetBasicAuth(wp.username, wp.password)
+	}
+	if meta, err := readCacheMeta(cachePath); err == nil {
+		if meta.ETag != "" {
+			req.Header.Set("If-None-Match", meta.ETag)
+		}
+		if meta.LastModified != "" {
+			req.Header.Set("If-Modified-Since", meta.LastModified)
+		}
+	}
+
+	resp, err := wp.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotModified:
+		log.L().Debug("web: serving artifact from the cache", zap.String("artifact", artifact))
+		return os.Open(cachePath)
+	case http.StatusNotFound:
+		// the artifact was removed from the server, so it must not be served from the cache anymore either
+		os.Remove(cachePath)           //nolint: errcheck
+		os.Remove(cachePath + ".json") //nolint: errcheck
+		return nil, ErrArtifactNotFound
+	default:
+		return nil, fmt.Errorf("unexpected HTTP status: %s", resp.Status)
+	}
+
+	// download into a temporary file first, so that a failed download does not destroy the cached artifact
+	tmp, err := os.CreateTemp(wp.cacheDir, "download-*")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(tmp.Name()) //nolint: errcheck
+	n, err := io.Copy(tmp, resp.Body)
+	if err == nil && resp.ContentLength >= 0 && n != resp.ContentLength {
+		err = fmt.Errorf("short download: %d of %d bytes", n, resp.ContentLength)
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return nil, fmt.Errorf("downloading: %w", err)
+	}
+	// the validators of the old artifact must never be used with the new one
+	os.Remove(cachePath + ".json") //nolint: errcheck
+	if err := os.Rename(tmp.Name(), cachePath); err != nil {
+		return nil, err
+	}
+	meta := cacheMeta{ETag: resp.Header.Get("ETag"), LastModified: resp.Header.Get("Last-Modified")}
+	if meta.ETag != "" || meta.LastModified != "" {
+		if err := writeCacheMeta(cachePath, meta); err != nil {
+			log.L().Warn("web: writing cache metadata failed", zap.String("artifact", artifact), zap.Error(err))
+		}
+	}
+	log.L().Debug("web: downloaded artifact", zap.String("artifact", artifact), zap.Int64("size", n))
+	return os.Open(cachePath)
+}
+
+// cachePath returns the path of `artifact` in the cache. The names of artifacts can contain slashes and
+// colons, so we hash them.
+func (wp *webProvider) cachePath(artifact string) string {
+	sum := sha256.Sum256([]byte(artifact))
+	return filepath.Join(wp.cacheDir, hex.EncodeToString(sum[:]))
+}
+
+// readCacheMeta reads the validators of the artifact at `cachePath`, it fails if the artifact is not cached
+func readCacheMeta(cachePath string) (*cacheMeta, error) {
+	if _, err := os.Stat(cachePath); err != nil {
+		return nil, err
+	}
+	b, err := os.ReadFile(cachePath + ".json")
+	if err != nil {
+		return nil, err
+	}
+	var ret cacheMeta
+	if err := json.Unmarshal(b, &ret); err != nil {
+		return nil, err
+	}
+	return &ret, nil
+}
+
+func writeCacheMeta(cachePath string, meta cacheMeta) error {
+	b, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(cachePath+".json", b, 0o644) //nolint: gosec
+}
+
+// lock locks the downloads of `artifact` and returns the function to unlock them
+func (wp *webProvider) lock(artifact string) func() {
+	wp.locksLock.Lock()
+	al, ok := wp.locks[artifact]
+	if !ok {
+		al = &artifactLock{}
+		wp.locks[artifact] = al
+	}
+	al.refs++
+	wp.locksLock.Unlock()
+
+	al.Lock()
+	return func() {
+		al.Unlock()
+		wp.locksLock.Lock()
+		al.refs--
+		if al.refs == 0 {
+			delete(wp.locks, artifact)
+		}
+		wp.locksLock.Unlock()
+	}
+}
+
+// CheckHealth implements artifacts.HealthChecker
+func (wp *webProvider) CheckHealth(ctx context.Context) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, wp.url.String(), nil)
+	if err != nil {
+		return fmt.Errorf("web: %w", err)
+	}
+	if wp.username != "" || wp.password != "" {
+		req.SetBasicAuth(wp.username, wp.password)
+	}
+	resp, err := wp.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("web: server '%s' unreachable: %w", wp.url.Host, err)
+	}
+	resp.Body.Close()
+	// artifact servers do not necessarily serve anything at their base URL, so only server errors count
+	if resp.StatusCode >= http.StatusInternalServerError {
+		return fmt.Errorf("web: server '%s': %s", wp.url.Host, resp.Status)
+	}
+	return nil
+}
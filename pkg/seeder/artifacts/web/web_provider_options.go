@@ -12,6 +12,21 @@
 // See the License for the specific language governing permissions and
 // limitations under the License.
 
-package log
+package web
 
-// keep this as a placeholder until there need to be tests for this package
+type ProviderOption func(*webProvider)
+
+// ProviderOptionServerCA pins the server certificate of the artifact server to the CA at `path`. The system
+// CAs are not being trusted in that case.
+func ProviderOptionServerCA(path string) func(*webProvider) {
+	return func(wp *webProvider) {
+		wp.serverCAPath = path
+	}
+}
+
+func ProviderOptionBasicAuth(username, password string) func(*webProvider) {
+	return func(wp *webProvider) {
+		wp.username = username
+		wp.password = password
+	}
+}
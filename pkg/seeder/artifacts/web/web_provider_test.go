@@ -0,0 +1,255 @@
+// Copyright 2023 Hedgehog
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package web
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type testArtifactServer struct {
+	content   map[string]string
+	downloads atomic.Int32
+	down      atomic.Bool
+}
+
+func (s *testArtifactServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if s.down.Load() {
+		w.WriteHeader(http.StatusBadGateway)
+		return
+	}
+	if user, pass, ok := r.BasicAuth(); !ok || user != "user" || pass != "pass" {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	content, ok := s.content[r.URL.Path]
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	etag := `"` + content + `"`
+	w.Header().Set("ETag", etag)
+	if r.Header.Get("If-None-Match") == etag {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	s.downloads.Add(1)
+	io.WriteString(w, content) //nolint: errcheck
+}
+
+func writeServerCA(t *testing.T, srv *httptest.Server) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "ca.pem")
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// writeOtherCA writes a CA which did not issue the certificates of the test servers, they all share one
+func writeOtherCA(t *testing.T) string {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Other CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "other-ca.pem")
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func Test_webProvider_Get(t *testing.T) {
+	as := &testArtifactServer{content: map[string]string{
+		"/mirror/stage0-x86_64":              "stage0",
+		"/mirror/sonic/x86_64-kvm_x86_64-r0": "sonic",
+	}}
+	srv := httptest.NewTLSServer(as)
+	defer srv.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	p, err := Provider(ctx, srv.URL+"/mirror", t.TempDir(), ProviderOptionServerCA(writeServerCA(t, srv)), ProviderOptionBasicAuth("user", "pass"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	get := func(artifact string) (string, bool) {
+		t.Helper()
+		rc := p.Get(artifact)
+		if rc == nil {
+			return "", false
+		}
+		defer rc.Close()
+		b, err := io.ReadAll(rc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(b), true
+	}
+
+	tests := []struct {
+		name          string
+		artifact      string
+		down          bool
+		want          string
+		wantFound     bool
+		wantDownloads int32
+	}{
+		{
+			name:          "download",
+			artifact:      "sonic/x86_64-kvm_x86_64-r0",
+			want:          "sonic",
+			wantFound:     true,
+			wantDownloads: 1,
+		},
+		{
+			name:          "revalidated from the cache",
+			artifact:      "sonic/x86_64-kvm_x86_64-r0",
+			want:          "sonic",
+			wantFound:     true,
+			wantDownloads: 1,
+		},
+		{
+			name:          "cached while the server is down",
+			artifact:      "sonic/x86_64-kvm_x86_64-r0",
+			down:          true,
+			want:          "sonic",
+			wantFound:     true,
+			wantDownloads: 1,
+		},
+		{
+			name:          "not cached while the server is down",
+			artifact:      "stage0-x86_64",
+			down:          true,
+			wantDownloads: 1,
+		},
+		{
+			name:          "another artifact",
+			artifact:      "stage0-x86_64",
+			want:          "stage0",
+			wantFound:     true,
+			wantDownloads: 2,
+		},
+		{
+			name:          "not found",
+			artifact:      "stage1-x86_64",
+			wantDownloads: 2,
+		},
+		{
+			name:          "outside of the server URL",
+			artifact:      "../stage0-x86_64",
+			wantDownloads: 2,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			as.down.Store(tt.down)
+			got, found := get(tt.artifact)
+			if found != tt.wantFound || got != tt.want {
+				t.Errorf("Get() = %q, %v, want %q, %v", got, found, tt.want, tt.wantFound)
+			}
+			if n := as.downloads.Load(); n != tt.wantDownloads {
+				t.Errorf("downloads = %d, want %d", n, tt.wantDownloads)
+			}
+		})
+	}
+}
+
+func TestProvider(t *testing.T) {
+	srv := httptest.NewTLSServer(http.NotFoundHandler())
+	defer srv.Close()
+	tests := []struct {
+		name            string
+		url             string
+		options         []ProviderOption
+		wantErr         bool
+		wantHealthy     bool
+		wantHealthCheck bool
+	}{
+		{
+			name:            "pinned CA",
+			url:             srv.URL,
+			options:         []ProviderOption{ProviderOptionServerCA(writeServerCA(t, srv))},
+			wantHealthCheck: true,
+			wantHealthy:     true,
+		},
+		{
+			name:            "wrong CA",
+			url:             srv.URL,
+			options:         []ProviderOption{ProviderOptionServerCA(writeOtherCA(t))},
+			wantHealthCheck: true,
+			wantHealthy:     false,
+		},
+		{
+			name:    "missing CA",
+			url:     srv.URL,
+			options: []ProviderOption{ProviderOptionServerCA(filepath.Join(t.TempDir(), "missing.pem"))},
+			wantErr: true,
+		},
+		{
+			name:    "basic auth over plain HTTP",
+			url:     "http://mirror.local/artifacts",
+			options: []ProviderOption{ProviderOptionBasicAuth("user", "pass")},
+			wantErr: true,
+		},
+		{
+			name:    "OCI URL",
+			url:     "oci://registry.local:5000/githedgehog",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, err := Provider(context.Background(), tt.url, t.TempDir(), tt.options...)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Provider() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantHealthCheck {
+				return
+			}
+			err = p.(*webProvider).CheckHealth(context.Background())
+			if (err == nil) != tt.wantHealthy {
+				t.Errorf("CheckHealth() error = %v, wantHealthy %v", err, tt.wantHealthy)
+			}
+		})
+	}
+}
@@ -0,0 +1,93 @@
+// Copyright 2023 Hedgehog
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package seeder
+
+import (
+	"bytes"
+	"encoding/pem"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+
+	"go.githedgehog.com/dasboot/pkg/stage"
+)
+
+// caBundlePath is the route for the server CA bundle which devices pin to follow rotations of the server CA
+const caBundlePath = "/ca-bundle"
+
+// readCABundleFromPath reads all PEM encoded certificates from `path` into a server CA bundle of `version`.
+// The bundle must contain the server CA in `serverCADER` which is handed out to stage 0.
+func readCABundleFromPath(path string, version uint64, serverCADER []byte) (*stage.CABundle, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading server CA bundle '%s': %w", path, err)
+	}
+	ret := &stage.CABundle{Version: version}
+	var hasServerCA bool
+	for {
+		var p *pem.Block
+		p, b = pem.Decode(b)
+		if p == nil {
+			break
+		}
+		if p.Type != "CERTIFICATE" {
+			continue
+		}
+		if bytes.Equal(p.Bytes, serverCADER) {
+			hasServerCA = true
+		}
+		ret.Certificates = append(ret.Certificates, p.Bytes)
+	}
+	if err := ret.Validate(); err != nil {
+		return nil, fmt.Errorf("server CA bundle '%s': %w", path, err)
+	}
+	if !hasServerCA {
+		return nil, fmt.Errorf("server CA bundle '%s' does not contain the server CA", path)
+	}
+	return ret, nil
+}
+
+// getCABundle serves the server CA bundle. The response gets signed like all JSON responses of the
+// secure server, so devices can verify it with the config signature CA.
+func (s *seeder) getCABundle(w http.ResponseWriter, r *http.Request) {
+	if s.installerSettings.serverCABundle == nil {
+		errorWithJSON(w, r, http.StatusNotFound, "no server CA bundle configured")
+		return
+	}
+	writeJSON(w, r, http.StatusOK, s.installerSettings.serverCABundle)
+}
+
+// caBundleURL returns the URL of the server CA bundle, or an empty string if there is no bundle
+func (lis *loadedInstallerSettings) caBundleURL() string {
+	if lis.serverCABundle == nil {
+		return ""
+	}
+	return (&url.URL{
+		Scheme: lis.secureScheme(),
+		Host:   lis.secureServerName,
+		Path:   caBundlePath,
+	}).String()
+}
+
+// stage0ServerCA returns the server CAs which stage 0 trusts for the seeder. During a rotation of the
+// server CA this must be all CAs of the bundle already, as the server certificate might have been
+// rotated before stage 0 gets to pin the bundle.
+func (lis *loadedInstallerSettings) stage0ServerCA() []byte {
+	if lis.serverCABundle == nil {
+		return lis.serverCADER
+	}
+	return lis.serverCABundle.DER()
+}
@@ -0,0 +1,131 @@
+// Copyright 2023 Hedgehog
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package seeder
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"slices"
+	"strings"
+
+	"go.githedgehog.com/dasboot/pkg/seeder/artifacts"
+	"go.githedgehog.com/dasboot/pkg/seeder/config"
+)
+
+var (
+	ErrInvalidCompatibilityMatrix = errors.New("seeder: invalid compatibility matrix")
+	ErrIncompatibleVersions       = errors.New("seeder: incompatible versions")
+)
+
+// stageArtifacts are all artifacts which are built from DAS BOOT itself
+var stageArtifacts = []string{
+	artifacts.Stage0X8664,
+	artifacts.Stage0Arm64,
+	artifacts.Stage0Arm,
+	artifacts.Stage1X8664,
+	artifacts.Stage1Arm64,
+	artifacts.Stage1Arm,
+	artifacts.Stage2X8664,
+	artifacts.Stage2Arm64,
+	artifacts.Stage2Arm,
+	artifacts.HHAgentProvX8664,
+	artifacts.HHAgentProvArm64,
+	artifacts.HHAgentProvArm,
+}
+
+// compatibilityMatrix is a validated config.CompatibilityMatrix. An empty matrix allows every combination.
+type compatibilityMatrix []config.Compatibility
+
+// componentVersions is a combination of versions which gets served to a device. Empty versions are unknown.
+type componentVersions struct {
+	dasboot []string
+	agent   string
+	nos     string
+}
+
+func (v componentVersions) String() string {
+	unknown := func(s string) string {
+		if s == "" {
+			return "unknown"
+		}
+		return s
+	}
+	dasboot := "unknown"
+	if len(v.dasboot) > 0 {
+		dasboot = strings.Join(v.dasboot, ",")
+	}
+	return fmt.Sprintf("dasboot=%s agent=%s nos=%s", dasboot, unknown(v.agent), unknown(v.nos))
+}
+
+func parseCompatibilityMatrix(cfg []config.Compatibility) (compatibilityMatrix, error) {
+	for i, e := range cfg {
+		for _, patterns := range [][]string{e.DASBoot, e.Agent, e.NOS} {
+			for _, p := range patterns {
+				if _, err := path.Match(p, ""); err != nil {
+					return nil, fmt.Errorf("%w: entry %d: pattern '%s': %w", ErrInvalidCompatibilityMatrix, i, p, err)
+				}
+			}
+		}
+	}
+	return compatibilityMatrix(cfg), nil
+}
+
+// matchVersion returns true if `version` matches any of `patterns`. The patterns were validated already.
+func matchVersion(patterns []string, version string) bool {
+	if len(patterns) == 0 || version == "" {
+		return true
+	}
+	for _, p := range patterns {
+		if ok, _ := path.Match(p, version); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// check returns ErrIncompatibleVersions if the combination `v` matches none of the entries of the matrix
+func (m compatibilityMatrix) check(v componentVersions) error {
+	if len(m) == 0 {
+		return nil
+	}
+	for _, e := range m {
+		ok := matchVersion(e.Agent, v.agent) && matchVersion(e.NOS, v.nos)
+		for _, dv := range v.dasboot {
+			ok = ok && matchVersion(e.DASBoot, dv)
+		}
+		if ok {
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: %s matches no entry of the compatibility matrix", ErrIncompatibleVersions, v)
+}
+
+// stageArtifactVersions returns the distinct versions of all stage artifacts whose build provenance
+// the artifacts provider knows
+func stageArtifactVersions(p artifacts.Provider) []string {
+	pp, ok := p.(artifacts.ProvenanceProvider)
+	if !ok {
+		return nil
+	}
+	var ret []string
+	for _, artifact := range stageArtifacts {
+		if prov := pp.Provenance(artifact); prov != nil && prov.Version != "" && !slices.Contains(ret, prov.Version) {
+			ret = append(ret, prov.Version)
+		}
+	}
+	slices.Sort(ret)
+	return ret
+}
@@ -0,0 +1,94 @@
+// Copyright 2023 Hedgehog
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package seeder
+
+import (
+	"errors"
+	"testing"
+
+	"go.githedgehog.com/dasboot/pkg/seeder/config"
+)
+
+func TestParseCompatibilityMatrix(t *testing.T) {
+	if _, err := parseCompatibilityMatrix([]config.Compatibility{{Agent: []string{"v0.[4"}}}); !errors.Is(err, ErrInvalidCompatibilityMatrix) {
+		t.Errorf("err = %v, want %v", err, ErrInvalidCompatibilityMatrix)
+	}
+	if _, err := parseCompatibilityMatrix([]config.Compatibility{{DASBoot: []string{"v0.12.*"}, NOS: []string{"4.[12].*"}}}); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestCompatibilityMatrixCheck(t *testing.T) {
+	matrix := compatibilityMatrix{
+		{DASBoot: []string{"v0.12.*"}, Agent: []string{"v0.40.*", "v0.41.*"}, NOS: []string{"4.2.*"}},
+		{DASBoot: []string{"v0.13.*"}, Agent: []string{"v0.42.*"}},
+	}
+	tests := []struct {
+		name    string
+		matrix  compatibilityMatrix
+		v       componentVersions
+		wantErr bool
+	}{
+		{
+			name:   "no matrix",
+			matrix: nil,
+			v:      componentVersions{dasboot: []string{"dev"}, agent: "v1", nos: "v2"},
+		},
+		{
+			name:   "compatible",
+			matrix: matrix,
+			v:      componentVersions{dasboot: []string{"v0.12.3"}, agent: "v0.41.0", nos: "4.2.1"},
+		},
+		{
+			name:   "second entry with any NOS",
+			matrix: matrix,
+			v:      componentVersions{dasboot: []string{"v0.13.0"}, agent: "v0.42.1", nos: "4.3.0"},
+		},
+		{
+			name:    "agent from another entry",
+			matrix:  matrix,
+			v:       componentVersions{dasboot: []string{"v0.12.3"}, agent: "v0.42.1", nos: "4.2.1"},
+			wantErr: true,
+		},
+		{
+			name:    "mixed stage versions",
+			matrix:  matrix,
+			v:       componentVersions{dasboot: []string{"v0.12.3", "v0.13.0"}},
+			wantErr: true,
+		},
+		{
+			name:   "unknown versions",
+			matrix: matrix,
+			v:      componentVersions{dasboot: []string{"v0.13.0"}},
+		},
+		{
+			name:    "incompatible NOS",
+			matrix:  matrix,
+			v:       componentVersions{agent: "v0.40.0", nos: "4.1.0"},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.matrix.check(tt.v)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("check() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil && !errors.Is(err, ErrIncompatibleVersions) {
+				t.Errorf("check() error = %v, want %v", err, ErrIncompatibleVersions)
+			}
+		})
+	}
+}
@@ -14,7 +14,14 @@
 
 package config
 
-import "go.githedgehog.com/dasboot/pkg/seeder/artifacts"
+import (
+	"time"
+
+	"go.githedgehog.com/dasboot/pkg/banner"
+	"go.githedgehog.com/dasboot/pkg/partitions"
+	"go.githedgehog.com/dasboot/pkg/seeder/artifacts"
+	config0 "go.githedgehog.com/dasboot/pkg/stage0/config"
+)
 
 // SeederConfig is passed to a seeder instance. It will initialize the seeder based on this configuration.
 type SeederConfig struct {
@@ -26,9 +33,22 @@ type SeederConfig struct {
 	// which must be served over a secure connection.
 	SecureServer *BindInfo
 
+	// AdminServer will instantiate an admin server if it is not nil. The admin server serves administrative routes
+	// like per-device artifact overrides. It must only be reachable from trusted networks, and it should be secured
+	// with client certificates.
+	AdminServer *BindInfo
+
+	// MetricsServer will instantiate a metrics server if it is not nil. The metrics server serves Prometheus metrics
+	// at /metrics.
+	MetricsServer *BindInfo
+
 	// ArtifactsProvider is used to retrieve installer images.
 	ArtifactsProvider artifacts.Provider
 
+	// ArtifactManifest is the signed manifest of artifact digests if the ArtifactsProvider verifies artifacts
+	// against one. Stages learn about the verification through the artifact provenance.
+	ArtifactManifest *artifacts.Manifest
+
 	// EmbeddedConfigGenerator contains all settings which are necessary to generate embedded configuration for the
 	// staged installer artifacts
 	EmbeddedConfigGenerator *EmbeddedConfigGeneratorConfig
@@ -39,6 +59,35 @@ type SeederConfig struct {
 
 	// RegistrySettings are all settings that deal with registration requests that are being sent by clients.
 	RegistrySettings *RegistrySettings
+
+	// Limits are the request body and artifact size limits, and the download concurrency limits of the seeder.
+	// If this is nil, the defaults are being used.
+	Limits *Limits
+
+	// LogShipping enables devices to upload their logs to the seeder for post-mortem analysis. If this is nil,
+	// devices will not ship their logs.
+	LogShipping *LogShipping
+
+	// DiagnosticsUploads enables devices to upload large diagnostic files like core dumps to the seeder.
+	// If this is nil, devices will not upload any diagnostic files.
+	DiagnosticsUploads *DiagnosticsUploads
+
+	// IPAMLeases are the settings for the addresses which are being reserved for devices during their installations.
+	// If this is nil, the leases only live in memory and expire after the default TTL.
+	IPAMLeases *IPAMLeases
+
+	// Revocation are the settings for checking client certificates on the secure server for revocation. Devices
+	// can always be revoked through the admin API, but if this is nil, the revocations only live in memory.
+	Revocation *Revocation
+
+	// LabMode is an INSECURE mode for throwaway lab environments. The secure server may run without TLS, an
+	// ephemeral CA replaces all keys and certificates which are not configured, and all registrations get
+	// approved with it. Devices only accept plain HTTP when their embedded configuration says so.
+	LabMode bool
+
+	// DrainTimeout is the time that the seeder waits on shutdown for in-flight artifact downloads to finish
+	// before it cuts them off. If this is zero, the default of 5 minutes is being used.
+	DrainTimeout time.Duration
 }
 
 // BindInfo provides all the necessary information for binding to an address and configuring TLS as necessary.
@@ -79,6 +128,15 @@ type InstallerSettings struct {
 	// alternative way.
 	ServerCAPath string
 
+	// ServerCABundlePath points to a file containing all CA certificates which clients should trust for the seeder.
+	// During a rotation of the server CA it holds the old and the new CA, and afterwards only the new one. It must
+	// include the CA from `ServerCAPath`. If this is empty, no CA bundle is being distributed.
+	ServerCABundlePath string
+
+	// ServerCABundleVersion is the version of the server CA bundle. It must be increased whenever the bundle changes,
+	// as clients never go back to an older version than the one which they pinned.
+	ServerCABundleVersion uint64
+
 	// ConfigSignatureCAPath points to a file containing the CA certificate which signed the signature certificate
 	// which is used to sign the embedded configuration which is served with every staged installer.
 	ConfigSignatureCAPath string
@@ -88,14 +146,162 @@ type InstallerSettings struct {
 	// different port it needs to be included here (e.g. dasboot.example.com:8080).
 	SecureServerName string
 
+	// MirrorServerNames are additional host names of seeders which serve the same artifacts, e.g. the other
+	// control nodes. Devices get artifact URLs for all of them, rank them by latency, and fall back to the
+	// next one if a download fails. They must match the TLS SAN for the server certificates as well.
+	MirrorServerNames []string
+
 	// ControlVIP is the virtual IP of where to reach the control network services
 	ControlVIP string
 
+	// ControlVIPv6 is the IPv6 virtual IP of where to reach the control network services. Management links with IPv6
+	// addresses use it if ControlVIP is an IPv4 address.
+	ControlVIPv6 string
+
+	// FabricName is the name of the fabric which is part of the metadata that devices get about themselves
+	FabricName string
+
 	// NTPServers are the NTP servers which will be configured on clients at installation time
 	NTPServers []string
 
+	// NTPMaxOffset is the maximum clock offset as a duration like "24h" which clients accept from a single NTP
+	// query round. Larger offsets must be confirmed by a second round before the clock gets set.
+	NTPMaxOffset string
+
+	// LLDPWait is the time as a duration like "35s" which clients listen for LLDP neighbours before they request their
+	// IP addresses. The seeder finds devices without location information by their LLDP neighbours.
+	LLDPWait string
+
 	// SyslogServers are the syslog servers which will be configured on clients at installation time
 	SyslogServers []string
+
+	// SyslogFraming is the framing which the syslog servers expect: "non-transparent" (default) or "octet-counting"
+	SyslogFraming string
+
+	// SyslogTransport is the transport to the syslog servers: "udp" (default), "tcp" or "tcp+tls"
+	SyslogTransport string
+
+	// SyslogCAPath is the path to a PEM encoded CA bundle with which devices validate the syslog servers over TLS.
+	// If it is empty, devices use their system CAs.
+	SyslogCAPath string
+
+	// DNSServers are the DNS servers which will be configured on clients at installation time
+	DNSServers []string
+
+	// DNSSearchDomains are the DNS search domains which will be configured on clients at installation time
+	DNSSearchDomains []string
+
+	// DiagBootBeforeInstall instructs stage 2 to boot into the vendor diagnostics OS once before installing the NOS.
+	DiagBootBeforeInstall bool
+
+	// EncryptIdentityPartition instructs stage 1 to create the identity partition of new devices as a LUKS container.
+	EncryptIdentityPartition bool
+
+	// IdentityBackups instructs stage 1 to back up the device identity to the control plane, and to restore it from there.
+	IdentityBackups bool
+
+	// Banner is operator information which is being handed out to devices, and which stage 0 prints on the console and to syslog
+	Banner *banner.Banner
+
+	// MTU is the MTU which will be configured on the control network interface of clients at installation time.
+	// If this is 0, the default MTU of the interface is being used.
+	MTU int
+
+	// RequireProvenance instructs clients to only run stage artifacts which come with a signed artifact
+	// provenance which matches the downloaded artifact. This requires the ConfigSignatureCAPath to be set.
+	RequireProvenance bool
+
+	// RequireManifest instructs clients to only run stage artifacts which the seeder verified against the
+	// signed artifact manifest. This requires RequireProvenance and the ArtifactManifest to be set.
+	RequireManifest bool
+
+	// MACAllowlists are the MAC addresses which the port security of the fabric allows during provisioning.
+	// They are keyed by the ONIE management MAC address of a device, and map VLAN IDs to the allowlisted MAC address
+	// for that VLAN. The VLAN ID 0 stands for the untagged network interface.
+	MACAllowlists map[string]map[uint16]string
+
+	// RecoveryMaxConsecutiveFailures is the number of consecutive failed installations after which a device stops
+	// retrying and enters recovery mode. Zero disables recovery mode.
+	RecoveryMaxConsecutiveFailures uint
+
+	// RecoveryAction is the action a device takes when it enters recovery mode: "stop" (the default) stops the
+	// ONIE discovery, and "rescue" additionally boots ONIE into rescue mode.
+	RecoveryAction string
+
+	// GPTAttributes are GPT partition attributes which stage 2 sets after the NOS installation. They are keyed by
+	// the ONIE platform (or "*" for all platforms) and then by the GPT partition name. The attributes are either
+	// "required", "no_block_io", "legacy_bios_bootable" or a bit number.
+	GPTAttributes map[string]map[string][]string
+
+	// PreserveNOSConfig is the policy for reinstallations of already provisioned devices: it lists the files of the
+	// existing NOS configuration which stage 2 backs up before the reinstallation, and restores for the new NOS to
+	// migrate on its first boot. It is keyed by device ID (or "*" for all devices), and the paths are relative to
+	// /etc/sonic, e.g. "config_db.json" or "frr". An empty list for a device disables it for that device.
+	PreserveNOSConfig map[string][]string
+
+	// DisableDiscardPlatforms lists the ONIE platforms (or "*" for all platforms) on which stage 2 must not discard the
+	// blocks which it skips when it writes artifacts to flash media. This is for platforms with broken discard support.
+	DisableDiscardPlatforms []string
+
+	// Staging holds the settings for the staging area which stage 0 creates on the devices. The defaults are
+	// unsuitable for platforms with a tiny /tmp or little memory.
+	Staging *config0.Staging
+
+	// MultipathPolicy decides how the stages treat dm-multipath devices when they discover disks: "prefer" (the
+	// default) works with the multipath maps and ignores the paths underneath them, "exclude" ignores both, and
+	// "ignore" disables the multipath awareness.
+	MultipathPolicy string
+
+	// DiskSelection selects the disk for the NOS and the identity partition on devices with more than one disk.
+	// It is the disk which holds the ONIE partition if it is not set.
+	DiskSelection *partitions.DiskSelectionPolicy
+
+	// DHCPFallback lets stage 0 fall back to DHCP on its network interfaces if it does not get anywhere with IPAM.
+	// This only helps in management networks with a DHCP server which hands out addresses from which the seeder is reachable.
+	DHCPFallback bool
+
+	// Proxy holds the HTTP proxy settings which are handed out to devices. All stages use them for their HTTP clients,
+	// and they are part of the first-boot payload of the Hedgehog agent.
+	Proxy *config0.Proxy
+
+	// MaintenanceWindows restrict when devices may start an installation. They are keyed by device ID (or "*" for all
+	// devices). Outside of its windows a device gets told to retry later, and does not make any changes. A device without
+	// any windows may start installations at any time. An empty list for a device lifts the restriction for that device.
+	MaintenanceWindows map[string][]MaintenanceWindow
+
+	// CompatibilityMatrix lists which versions of the DAS BOOT stages, the Hedgehog agent and the NOS work together.
+	// If it is set, the seeder refuses to start with stage artifacts which match none of its entries, and refuses to
+	// serve an agent or NOS to a device whose combination of versions matches none of its entries.
+	CompatibilityMatrix []Compatibility
+}
+
+// Compatibility is an entry of the compatibility matrix. All versions are glob patterns as for `path.Match`,
+// e.g. "v0.12.*". An empty list matches any version, and so does a version which is not known to the seeder.
+type Compatibility struct {
+	// DASBoot are the versions of the DAS BOOT stages (stage 1, stage 2 and the provisioners)
+	DASBoot []string
+
+	// Agent are the versions of the Hedgehog agent
+	Agent []string
+
+	// NOS are the versions of the NOS
+	NOS []string
+}
+
+// MaintenanceWindow is a recurring time window during which devices may start installations.
+type MaintenanceWindow struct {
+	// Days are the weekdays on which the window opens as "mon", "tue", etc. If it is empty, the window opens every day.
+	Days []string
+
+	// Start is the time of day in "HH:MM" format at which the window opens
+	Start string
+
+	// End is the time of day in "HH:MM" format at which the window closes. If it is before the start, the window
+	// spans midnight. If it is equal to the start, the window lasts for the whole day.
+	End string
+
+	// TimeZone is the IANA time zone of the start and end times. If it is empty, UTC is being used.
+	TimeZone string
 }
 
 // RegistrySettings are all the settings that instruct the seeder on what to do for registration requests
@@ -112,6 +318,132 @@ type RegistrySettings struct {
 	// handled by the registration controller instead. If this is set, it means that we will automatically
 	// accept and approve all registration requests.
 	KeyPath string `json:"key_path,omitempty" yaml:"key_path,omitempty"`
+
+	// RequireApproval holds back the client certificates of all devices which do not match any of the auto-approve
+	// rules until an operator approves their registration on the admin server. If the registration controller
+	// issues the certificates, it must run with approval required as well.
+	RequireApproval bool `json:"require_approval,omitempty" yaml:"require_approval,omitempty"`
+
+	// AutoApprove are the rules for registrations which get approved even though approval is required
+	AutoApprove []AutoApproveRule `json:"auto_approve,omitempty" yaml:"auto_approve,omitempty"`
+
+	// PendingDir is the directory in which pending registrations are being persisted when the seeder issues
+	// client certificates itself. If it is empty, pending registrations are lost on restarts.
+	PendingDir string `json:"pending_dir,omitempty" yaml:"pending_dir,omitempty"`
+
+	// Attestation is the policy for the attestation evidence which devices send with their registration requests.
+	// Registration requests which do not satisfy it are being rejected.
+	Attestation *AttestationPolicy `json:"attestation,omitempty" yaml:"attestation,omitempty"`
+}
+
+// AttestationPolicy defines the attestation evidence which registration requests must come with
+type AttestationPolicy struct {
+	// RequireQuote requires a TPM quote which is signed by the client key of the device
+	RequireQuote bool `json:"require_quote,omitempty" yaml:"require_quote,omitempty"`
+
+	// RequireSecureBoot requires devices to boot with UEFI secure boot enabled
+	RequireSecureBoot bool `json:"require_secure_boot,omitempty" yaml:"require_secure_boot,omitempty"`
+
+	// PCRs are the hex encoded SHA-256 values which the quoted PCRs must have, keyed by their index
+	PCRs map[int]string `json:"pcrs,omitempty" yaml:"pcrs,omitempty"`
+
+	// ONIEVersions are shell patterns like "2022.*" of which the ONIE version must match at least one
+	ONIEVersions []string `json:"onie_versions,omitempty" yaml:"onie_versions,omitempty"`
+}
+
+// AutoApproveRule matches registrations by their location and by the serial number of the device.
+// All fields which are set must match.
+type AutoApproveRule struct {
+	// LocationUUID is the location UUID which registrations must have
+	LocationUUID string `json:"location_uuid,omitempty" yaml:"location_uuid,omitempty"`
+
+	// SerialNumber is a shell pattern like "FX*" which the serial number of the device must match
+	SerialNumber string `json:"serial_number,omitempty" yaml:"serial_number,omitempty"`
+}
+
+// Limits protect the seeder from runaway artifacts in registries or from malicious clients. For all settings
+// a value of 0 means that the default is being used.
+type Limits struct {
+	// MaxIPAMRequestSize is the maximum size in bytes of IPAM request bodies
+	MaxIPAMRequestSize int64
+
+	// MaxRegisterRequestSize is the maximum size in bytes of registration request bodies
+	MaxRegisterRequestSize int64
+
+	// MaxAdminRequestSize is the maximum size in bytes of request bodies on the admin server
+	MaxAdminRequestSize int64
+
+	// MaxArtifactSize is the maximum size in bytes of an artifact that the seeder serves from its artifact providers
+	MaxArtifactSize int64
+
+	// MaxConcurrentDownloads is the maximum number of concurrent downloads of large artifacts (NOS, ONIE updaters,
+	// agents). Requests which exceed this limit are being rejected with a 503 and need to be retried by the client.
+	MaxConcurrentDownloads int
+}
+
+// LogShipping are the settings for the logs which devices upload during their installations. The logs are
+// being stored per device and install session. For all size and age settings a value of 0 means that the default
+// is being used.
+type LogShipping struct {
+	// Dir is the directory where the uploaded logs are being stored
+	Dir string
+
+	// MaxBytesPerDevice is the maximum amount of compressed logs in bytes which are being retained per device.
+	// The oldest chunks are being removed first.
+	MaxBytesPerDevice int64
+
+	// MaxAge is the duration after which uploaded logs are being removed
+	MaxAge time.Duration
+
+	// MaxChunkSize is the maximum size in bytes of a single compressed chunk that a device uploads
+	MaxChunkSize int64
+}
+
+// IPAMLeases are the settings for the addresses which are being reserved for devices during their installations
+type IPAMLeases struct {
+	// StatePath is the file in which the leases are being persisted, so that they survive restarts of the seeder.
+	// If it is empty, the leases only live in memory.
+	StatePath string
+
+	// TTL is the time for which the addresses are being reserved for a device after its last IPAM request.
+	// If it is zero, the default of 30 minutes is being used.
+	TTL time.Duration
+}
+
+// Revocation are the settings for checking client certificates on the secure server for revocation
+type Revocation struct {
+	// CRLPath points to a file with one or more CRLs in PEM format, or a single CRL in DER format. Client
+	// certificates are being checked against the CRLs of their issuer. The file is being reloaded whenever
+	// it changes. If it is empty, no CRL is being checked.
+	CRLPath string
+
+	// StatePath is the file in which the revocations through the admin API are being persisted, so that they
+	// survive restarts of the seeder. If it is empty, the revocations only live in memory.
+	StatePath string
+}
+
+// DiagnosticsUploads are the settings for the diagnostic files which devices upload in chunks. For all size, age
+// and rate settings a value of 0 means that the default is being used.
+type DiagnosticsUploads struct {
+	// Dir is the directory where the uploaded files are being stored
+	Dir string
+
+	// MaxFileSize is the maximum size in bytes of a single diagnostic file
+	MaxFileSize int64
+
+	// MaxBytesPerDevice is the maximum amount of diagnostic files in bytes which are being retained per device.
+	// Uploads which would exceed it are being rejected until older uploads expire or get deleted.
+	MaxBytesPerDevice int64
+
+	// MaxChunkSize is the maximum size in bytes of a single chunk that a device uploads
+	MaxChunkSize int64
+
+	// MaxAge is the duration after which uploads are being removed. For unfinished uploads it is the
+	// duration since their last chunk.
+	MaxAge time.Duration
+
+	// MaxBytesPerSecond throttles the uploads of every device to this rate
+	MaxBytesPerSecond int64
 }
 
 // InsecureServer are all settings on how to start the insecure server handler.
@@ -125,6 +457,12 @@ type InsecureServer struct {
 	// For example the seeder will not be able to deduce neighbours based on configuration stored in Kubernetes.
 	// You should always configure DynLL unless you have a very good reason not to.
 	Generic *BindInfo
+
+	// ONIEDiscovery enables the ONIE discovery responder which serves stage 0 on all the ONIE default installer
+	// file names (e.g. "onie-installer-x86_64-accton_as7726_32x-r0.bin"). This allows to use existing DHCP/ZTP
+	// environments which point ONIE at this server without having to reconfigure them. A platform specific stage 0
+	// build like "stage0-x86_64-accton_as7726_32x-r0" takes precedence over the architecture specific one.
+	ONIEDiscovery bool
 }
 
 // DynLL holds configuration for the dynamic linklocal insecure server listeners configuration. This mode allows
@@ -0,0 +1,89 @@
+// Copyright 2023 Hedgehog
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controlplane
+
+import (
+	"context"
+	"fmt"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+const (
+	// IdentityBackupSecretKey is the key of the identity backup in its secret
+	IdentityBackupSecretKey = "backup"
+
+	// IdentityBackupSecretPrefix is the prefix of the names of the secrets which hold the identity backups of devices
+	IdentityBackupSecretPrefix = "identity-backup-"
+
+	// DeviceIDLabelKey labels the secrets which hold data of a device with its device ID
+	DeviceIDLabelKey = "dasboot.githedgehog.com/device-id"
+)
+
+func identityBackupSecretKey(namespace string, deviceID string) client.ObjectKey {
+	return client.ObjectKey{Namespace: namespace, Name: IdentityBackupSecretPrefix + deviceID}
+}
+
+// GetIdentityBackup returns the identity backup of the device `deviceID`
+func (c *KubernetesControlPlaneClient) GetIdentityBackup(ctx context.Context, deviceID string) ([]byte, error) {
+	obj := &corev1.Secret{}
+	if err := c.client.Get(ctx, identityBackupSecretKey(c.deviceNamespace, deviceID), obj); err != nil {
+		if apierrors.IsNotFound(err) {
+			return nil, fmt.Errorf("identity backup: %w", ErrNotFound)
+		}
+		return nil, fmt.Errorf("identity backup: %w", err)
+	}
+	backup, ok := obj.Data[IdentityBackupSecretKey]
+	if !ok {
+		return nil, fmt.Errorf("identity backup secret entry: %w", ErrNotFound)
+	}
+	return backup, nil
+}
+
+// StoreIdentityBackup stores the identity backup of the device `deviceID` in a secret in the device namespace.
+// It replaces an existing backup of the device.
+func (c *KubernetesControlPlaneClient) StoreIdentityBackup(ctx context.Context, deviceID string, backup []byte) error {
+	key := identityBackupSecretKey(c.deviceNamespace, deviceID)
+	obj := &corev1.Secret{}
+	if err := c.client.Get(ctx, key, obj); err != nil {
+		if !apierrors.IsNotFound(err) {
+			return fmt.Errorf("identity backup: %w", err)
+		}
+		obj = &corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      key.Name,
+				Namespace: key.Namespace,
+				Labels:    map[string]string{DeviceIDLabelKey: deviceID},
+			},
+			Type: corev1.SecretTypeOpaque,
+			Data: map[string][]byte{IdentityBackupSecretKey: backup},
+		}
+		if err := c.client.Create(ctx, obj); err != nil {
+			return fmt.Errorf("identity backup: %w", err)
+		}
+		return nil
+	}
+	if obj.Data == nil {
+		obj.Data = map[string][]byte{}
+	}
+	obj.Data[IdentityBackupSecretKey] = backup
+	if err := c.client.Update(ctx, obj); err != nil {
+		return fmt.Errorf("identity backup: %w", err)
+	}
+	return nil
+}
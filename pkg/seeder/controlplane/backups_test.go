@@ -0,0 +1,66 @@
+// Copyright 2023 Hedgehog
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controlplane
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+func TestKubernetesControlPlaneClient_IdentityBackup(t *testing.T) {
+	scheme := runtime.NewScheme()
+	utilruntime.Must(clientgoscheme.AddToScheme(scheme))
+	ctx := context.Background()
+	k8sClient := fake.NewClientBuilder().WithScheme(scheme).Build()
+	c := &KubernetesControlPlaneClient{
+		client:          k8sClient,
+		deviceNamespace: "default",
+	}
+
+	if _, err := c.GetIdentityBackup(ctx, "device1"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("GetIdentityBackup() error = %v, want %v", err, ErrNotFound)
+	}
+	for _, backup := range []string{"first", "second"} {
+		if err := c.StoreIdentityBackup(ctx, "device1", []byte(backup)); err != nil {
+			t.Fatalf("StoreIdentityBackup() error = %v", err)
+		}
+		got, err := c.GetIdentityBackup(ctx, "device1")
+		if err != nil {
+			t.Fatalf("GetIdentityBackup() error = %v", err)
+		}
+		if string(got) != backup {
+			t.Errorf("GetIdentityBackup() = %q, want %q", got, backup)
+		}
+	}
+
+	secret := &corev1.Secret{}
+	if err := k8sClient.Get(ctx, client.ObjectKey{Namespace: "default", Name: IdentityBackupSecretPrefix + "device1"}, secret); err != nil {
+		t.Fatalf("getting secret: %v", err)
+	}
+	if secret.Labels[DeviceIDLabelKey] != "device1" {
+		t.Errorf("secret labels = %v, want device ID label", secret.Labels)
+	}
+	if _, err := c.GetIdentityBackup(ctx, "device2"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("GetIdentityBackup() of other device error = %v, want %v", err, ErrNotFound)
+	}
+}
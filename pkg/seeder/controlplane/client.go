@@ -44,12 +44,19 @@ type Client interface {
 	GetSwitchConnections(ctx context.Context, switchName string) ([]wiring1alpha2.Connection, error)
 	GetSwitchByAddr(ctx context.Context, addr string) (*wiring1alpha2.Switch, *wiring1alpha2.Connection, error)
 	GetNeighbourSwitchByAddr(ctx context.Context, addr string) (*wiring1alpha2.Switch, *wiring1alpha2.Connection, error)
+	GetNeighbourSwitchByLLDP(ctx context.Context, neighbor *seedernet.LLDPNeighbor) (*wiring1alpha2.Switch, *wiring1alpha2.Connection, error)
 	GetSwitchByLocationUUID(ctx context.Context, uuid string) (*wiring1alpha2.Switch, error)
 	GetDeviceRegistration(ctx context.Context, deviceID string) (*dasbootv1alpha1.DeviceRegistration, error)
 	CreateDeviceRegistration(ctx context.Context, reg *dasbootv1alpha1.DeviceRegistration) (*dasbootv1alpha1.DeviceRegistration, error)
+	ListDeviceRegistrations(ctx context.Context) ([]dasbootv1alpha1.DeviceRegistration, error)
+	SetDeviceRegistrationApproval(ctx context.Context, deviceID string, approval dasbootv1alpha1.RegistrationApproval) error
 	GetSwitchByDeviceID(ctx context.Context, deviceID string) (*wiring1alpha2.Switch, error)
 	GetAgentConfig(ctx context.Context, deviceID string) ([]byte, error)
 	GetAgentKubeconfig(ctx context.Context, deviceID string) ([]byte, error)
+	RecordDeviceEvent(ctx context.Context, deviceID string, event DeviceEvent, message string) error
+	GetIdentityBackup(ctx context.Context, deviceID string) ([]byte, error)
+	StoreIdentityBackup(ctx context.Context, deviceID string, backup []byte) error
+	CheckHealth(ctx context.Context) error
 }
 
 const (
@@ -347,6 +354,49 @@ func (c *KubernetesControlPlaneClient) getNeighbourSwitchByAddrForSwitch(ctx con
 	return nil, nil, fmt.Errorf("TODO")
 }
 
+// GetNeighbourSwitchByLLDP finds the switch that is connected to this device by what this device announced about itself
+// and its port over LLDP to the switch. The switch reports this as its LLDP neighbour `neighbor`.
+func (c *KubernetesControlPlaneClient) GetNeighbourSwitchByLLDP(ctx context.Context, neighbor *seedernet.LLDPNeighbor) (*wiring1alpha2.Switch, *wiring1alpha2.Connection, error) {
+	switch c.deviceType { //nolint: exhaustive
+	case config.DeviceTypeServer:
+		return c.getNeighbourSwitchByLLDPForServer(ctx, neighbor)
+	case config.DeviceTypeSwitch:
+		// TODO
+		return nil, nil, fmt.Errorf("TODO")
+	default:
+		return nil, nil, ErrUnsupportedDeviceType
+	}
+}
+
+func (c *KubernetesControlPlaneClient) getNeighbourSwitchByLLDPForServer(ctx context.Context, neighbor *seedernet.LLDPNeighbor) (*wiring1alpha2.Switch, *wiring1alpha2.Connection, error) {
+	// the switch must be talking to us in the first place
+	if !neighbor.MatchesSystem(c.deviceHostname) {
+		return nil, nil, ErrNotFound
+	}
+
+	// retrieve all of our connections that belong to us
+	connList := &wiring1alpha2.ConnectionList{}
+	if err := c.client.List(ctx, connList, wiring1alpha2.MatchingLabelsForListLabelServer(c.deviceHostname)); err != nil {
+		return nil, nil, err
+	}
+	for _, conn := range connList.Items {
+		// we are only interested in management connections at the moment
+		if conn.Spec.Management == nil {
+			continue
+		}
+		if neighbor.MatchesPort(conn.Spec.Management.Link.Server.LocalPortName(), conn.Spec.Management.Link.Server.MAC) {
+			ret1 := &wiring1alpha2.Switch{}
+			if err := c.client.Get(ctx, client.ObjectKey{Namespace: c.deviceNamespace, Name: conn.Spec.Management.Link.Switch.DeviceName()}, ret1); err != nil {
+				return nil, nil, err
+			}
+			// this is simply the connection we are on
+			ret2 := conn.DeepCopy()
+			return ret1, ret2, nil
+		}
+	}
+	return nil, nil, ErrNotFound
+}
+
 func (c *KubernetesControlPlaneClient) GetSwitchConnections(ctx context.Context, switchName string) ([]wiring1alpha2.Connection, error) {
 	connList := &wiring1alpha2.ConnectionList{}
 	if err := c.client.List(ctx, connList, wiring1alpha2.MatchingLabelsForListLabelSwitch(switchName)); err != nil {
@@ -398,6 +448,15 @@ func (c *KubernetesControlPlaneClient) GetDeviceRegistration(ctx context.Context
 	return obj, nil
 }
 
+// CheckHealth returns an error if the device registrations cannot be listed, which means that the seeder can
+// neither process registration requests nor look up any registered devices
+func (c *KubernetesControlPlaneClient) CheckHealth(ctx context.Context) error {
+	if err := c.client.List(ctx, &dasbootv1alpha1.DeviceRegistrationList{}, client.InNamespace(c.deviceNamespace), client.Limit(1)); err != nil {
+		return fmt.Errorf("listing device registrations: %w", err)
+	}
+	return nil
+}
+
 func (c *KubernetesControlPlaneClient) CreateDeviceRegistration(ctx context.Context, reg *dasbootv1alpha1.DeviceRegistration) (*dasbootv1alpha1.DeviceRegistration, error) {
 	obj := reg.DeepCopy()
 	if err := c.client.Create(ctx, reg); err != nil {
@@ -406,6 +465,27 @@ func (c *KubernetesControlPlaneClient) CreateDeviceRegistration(ctx context.Cont
 	return obj, nil
 }
 
+// ListDeviceRegistrations lists all device registrations in the device namespace
+func (c *KubernetesControlPlaneClient) ListDeviceRegistrations(ctx context.Context) ([]dasbootv1alpha1.DeviceRegistration, error) {
+	var list dasbootv1alpha1.DeviceRegistrationList
+	if err := c.client.List(ctx, &list, client.InNamespace(c.deviceNamespace)); err != nil {
+		return nil, err
+	}
+	return list.Items, nil
+}
+
+// SetDeviceRegistrationApproval records the decision about the device registration of `deviceID`
+// which the registration controller acts on
+func (c *KubernetesControlPlaneClient) SetDeviceRegistrationApproval(ctx context.Context, deviceID string, approval dasbootv1alpha1.RegistrationApproval) error {
+	devReg, err := c.GetDeviceRegistration(ctx, deviceID)
+	if err != nil {
+		return err
+	}
+	patch := client.MergeFrom(devReg.DeepCopy())
+	devReg.Spec.Approval = approval
+	return c.client.Patch(ctx, devReg, patch)
+}
+
 func (c *KubernetesControlPlaneClient) GetSwitchByDeviceID(ctx context.Context, deviceID string) (*wiring1alpha2.Switch, error) {
 	// the device registration will have the location information for this device
 	devReg, err := c.GetDeviceRegistration(ctx, deviceID)
@@ -0,0 +1,146 @@
+// Copyright 2023 Hedgehog
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controlplane
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	dasbootv1alpha1 "go.githedgehog.com/dasboot/pkg/k8s/api/v1alpha1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/apiutil"
+)
+
+// DeviceEvent is a transition in the provisioning lifecycle of a device. It is used as the reason
+// of the Kubernetes event as well as the condition type on the device registration.
+type DeviceEvent string
+
+const (
+	DeviceEventRegistered DeviceEvent = "Registered"
+	DeviceEventApproved   DeviceEvent = "Approved"
+	DeviceEventInstalling DeviceEvent = "Installing"
+	DeviceEventFailed     DeviceEvent = "Failed"
+	DeviceEventCancelled  DeviceEvent = "Cancelled"
+)
+
+// EventSourceComponent is the component name which is set as the source of all recorded events
+const EventSourceComponent = "das-boot-seeder"
+
+// conditionsCleared lists the conditions which get reset to false when a device event is recorded
+var conditionsCleared = map[DeviceEvent][]DeviceEvent{
+	DeviceEventInstalling: {DeviceEventFailed, DeviceEventCancelled},
+	DeviceEventFailed:     {DeviceEventInstalling},
+	DeviceEventCancelled:  {DeviceEventInstalling},
+}
+
+// RecordDeviceEvent records the lifecycle transition `event` of the device with `deviceID`. It emits a
+// Kubernetes event for the switch of the device, or for its device registration if the switch is unknown,
+// and sets the corresponding condition on the device registration. ErrNotFound is returned if neither exists.
+func (c *KubernetesControlPlaneClient) RecordDeviceEvent(ctx context.Context, deviceID string, event DeviceEvent, message string) error {
+	var obj client.Object
+	devReg, err := c.GetDeviceRegistration(ctx, deviceID)
+	if err != nil && !errors.Is(err, ErrNotFound) {
+		return fmt.Errorf("device registration: %w", err)
+	}
+	if devReg != nil {
+		obj = devReg
+		if devReg.Spec.LocationUUID != "" {
+			if switchObj, err := c.GetSwitchByLocationUUID(ctx, devReg.Spec.LocationUUID); err == nil {
+				obj = switchObj
+			}
+		}
+	}
+	if obj == nil {
+		return fmt.Errorf("device registration '%s': %w", deviceID, ErrNotFound)
+	}
+
+	if err := c.createEvent(ctx, obj, event, message); err != nil {
+		return fmt.Errorf("event: %w", err)
+	}
+
+	if devReg != nil {
+		if err := c.setDeviceCondition(ctx, devReg, event, message); err != nil {
+			return fmt.Errorf("device registration condition: %w", err)
+		}
+	}
+	return nil
+}
+
+func (c *KubernetesControlPlaneClient) createEvent(ctx context.Context, obj client.Object, event DeviceEvent, message string) error {
+	gvk, err := apiutil.GVKForObject(obj, c.client.Scheme())
+	if err != nil {
+		return err
+	}
+
+	eventType := corev1.EventTypeNormal
+	if event == DeviceEventFailed || event == DeviceEventCancelled {
+		eventType = corev1.EventTypeWarning
+	}
+
+	now := metav1.Now()
+	ev := &corev1.Event{
+		ObjectMeta: metav1.ObjectMeta{
+			GenerateName: obj.GetName() + ".",
+			Namespace:    obj.GetNamespace(),
+		},
+		InvolvedObject: corev1.ObjectReference{
+			APIVersion:      gvk.GroupVersion().String(),
+			Kind:            gvk.Kind,
+			Namespace:       obj.GetNamespace(),
+			Name:            obj.GetName(),
+			UID:             obj.GetUID(),
+			ResourceVersion: obj.GetResourceVersion(),
+		},
+		Reason:  string(event),
+		Message: message,
+		Type:    eventType,
+		Source: corev1.EventSource{
+			Component: EventSourceComponent,
+			Host:      c.deviceHostname,
+		},
+		FirstTimestamp:      now,
+		LastTimestamp:       now,
+		Count:               1,
+		ReportingController: EventSourceComponent,
+		ReportingInstance:   c.deviceHostname,
+	}
+	return c.client.Create(ctx, ev)
+}
+
+func (c *KubernetesControlPlaneClient) setDeviceCondition(ctx context.Context, devReg *dasbootv1alpha1.DeviceRegistration, event DeviceEvent, message string) error {
+	patch := client.MergeFrom(devReg.DeepCopy())
+	meta.SetStatusCondition(&devReg.Status.Conditions, metav1.Condition{
+		Type:    string(event),
+		Status:  metav1.ConditionTrue,
+		Reason:  string(event),
+		Message: message,
+	})
+	for _, cleared := range conditionsCleared[event] {
+		if meta.FindStatusCondition(devReg.Status.Conditions, string(cleared)) == nil {
+			continue
+		}
+		meta.SetStatusCondition(&devReg.Status.Conditions, metav1.Condition{
+			Type:    string(cleared),
+			Status:  metav1.ConditionFalse,
+			Reason:  string(event),
+			Message: message,
+		})
+	}
+	return c.client.Status().Patch(ctx, devReg, patch)
+}
@@ -0,0 +1,160 @@
+// Copyright 2023 Hedgehog
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controlplane
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	dasbootv1alpha1 "go.githedgehog.com/dasboot/pkg/k8s/api/v1alpha1"
+	wiring1alpha2 "go.githedgehog.com/fabric/api/wiring/v1alpha2"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+func TestKubernetesControlPlaneClient_RecordDeviceEvent(t *testing.T) {
+	scheme := runtime.NewScheme()
+	utilruntime.Must(clientgoscheme.AddToScheme(scheme))
+	utilruntime.Must(wiring1alpha2.AddToScheme(scheme))
+	utilruntime.Must(dasbootv1alpha1.AddToScheme(scheme))
+
+	devReg := func(locationUUID string, conds ...metav1.Condition) *dasbootv1alpha1.DeviceRegistration {
+		return &dasbootv1alpha1.DeviceRegistration{
+			ObjectMeta: metav1.ObjectMeta{Name: "device1", Namespace: "default"},
+			Spec:       dasbootv1alpha1.DeviceRegistrationSpec{LocationUUID: locationUUID},
+			Status:     dasbootv1alpha1.DeviceRegistrationStatus{Conditions: conds},
+		}
+	}
+	switchObj := &wiring1alpha2.Switch{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "switch1",
+			Namespace: "default",
+			Labels:    map[string]string{LocationLabelKey: "location1"},
+		},
+	}
+
+	tests := []struct {
+		name           string
+		objs           []client.Object
+		event          DeviceEvent
+		wantErr        error
+		wantKind       string
+		wantName       string
+		wantType       string
+		wantConditions map[string]metav1.ConditionStatus
+	}{
+		{
+			name:     "event on switch",
+			objs:     []client.Object{devReg("location1"), switchObj},
+			event:    DeviceEventInstalling,
+			wantKind: "Switch",
+			wantName: "switch1",
+			wantType: corev1.EventTypeNormal,
+			wantConditions: map[string]metav1.ConditionStatus{
+				string(DeviceEventInstalling): metav1.ConditionTrue,
+			},
+		},
+		{
+			name:     "event on device registration without switch",
+			objs:     []client.Object{devReg("location2")},
+			event:    DeviceEventRegistered,
+			wantKind: "DeviceRegistration",
+			wantName: "device1",
+			wantType: corev1.EventTypeNormal,
+			wantConditions: map[string]metav1.ConditionStatus{
+				string(DeviceEventRegistered): metav1.ConditionTrue,
+			},
+		},
+		{
+			name: "failed clears installing",
+			objs: []client.Object{devReg("location1", metav1.Condition{
+				Type:   string(DeviceEventInstalling),
+				Status: metav1.ConditionTrue,
+				Reason: string(DeviceEventInstalling),
+			}), switchObj},
+			event:    DeviceEventFailed,
+			wantKind: "Switch",
+			wantName: "switch1",
+			wantType: corev1.EventTypeWarning,
+			wantConditions: map[string]metav1.ConditionStatus{
+				string(DeviceEventInstalling): metav1.ConditionFalse,
+				string(DeviceEventFailed):     metav1.ConditionTrue,
+			},
+		},
+		{
+			name:    "unknown device",
+			event:   DeviceEventFailed,
+			wantErr: ErrNotFound,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			k8sClient := fake.NewClientBuilder().
+				WithScheme(scheme).
+				WithObjects(tt.objs...).
+				WithStatusSubresource(&dasbootv1alpha1.DeviceRegistration{}).
+				Build()
+			c := &KubernetesControlPlaneClient{
+				client:          k8sClient,
+				deviceHostname:  "control-1",
+				deviceNamespace: "default",
+			}
+
+			err := c.RecordDeviceEvent(ctx, "device1", tt.event, "test message")
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("RecordDeviceEvent() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr != nil {
+				return
+			}
+
+			events := &corev1.EventList{}
+			if err := k8sClient.List(ctx, events); err != nil {
+				t.Fatalf("listing events: %v", err)
+			}
+			if len(events.Items) != 1 {
+				t.Fatalf("expected exactly one event, got %d", len(events.Items))
+			}
+			ev := events.Items[0]
+			if ev.InvolvedObject.Kind != tt.wantKind || ev.InvolvedObject.Name != tt.wantName {
+				t.Errorf("event involved object = %s/%s, want %s/%s", ev.InvolvedObject.Kind, ev.InvolvedObject.Name, tt.wantKind, tt.wantName)
+			}
+			if ev.Reason != string(tt.event) || ev.Type != tt.wantType || ev.Message != "test message" {
+				t.Errorf("event = %s/%s/%q, want %s/%s/%q", ev.Reason, ev.Type, ev.Message, tt.event, tt.wantType, "test message")
+			}
+
+			got, err := c.GetDeviceRegistration(ctx, "device1")
+			if err != nil {
+				t.Fatalf("GetDeviceRegistration() error = %v", err)
+			}
+			if len(got.Status.Conditions) != len(tt.wantConditions) {
+				t.Errorf("conditions = %v, want %v", got.Status.Conditions, tt.wantConditions)
+			}
+			for condType, status := range tt.wantConditions {
+				if !meta.IsStatusConditionPresentAndEqual(got.Status.Conditions, condType, status) {
+					t.Errorf("condition %s not %s in %v", condType, status, got.Status.Conditions)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,43 @@
+// Copyright 2023 Hedgehog
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package seeder
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"go.githedgehog.com/dasboot/pkg/seeder/controlplane"
+	"go.uber.org/zap"
+)
+
+// deviceEventTimeout bounds how long a request waits for a device event to be recorded
+const deviceEventTimeout = 5 * time.Second
+
+// recordDeviceEvent records a lifecycle transition of a device in the control plane. This is
+// best-effort: failures are logged, but never fail the request that triggered the transition.
+func (s *seeder) recordDeviceEvent(ctx context.Context, devid string, event controlplane.DeviceEvent, message string) {
+	s.metrics.recordDeviceEvent(devid, event)
+	ctx, cancel := context.WithTimeout(ctx, deviceEventTimeout)
+	defer cancel()
+	if err := s.cpc.RecordDeviceEvent(ctx, devid, event, message); err != nil {
+		// devices which never registered with the control plane have nothing to record events for
+		if errors.Is(err, controlplane.ErrNotFound) {
+			l.Debug("Recording device event skipped", zap.String("devid", devid), zap.String("event", string(event)), zap.Error(err))
+			return
+		}
+		l.Warn("Recording device event failed", zap.String("devid", devid), zap.String("event", string(event)), zap.Error(err))
+	}
+}
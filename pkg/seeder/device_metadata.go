@@ -0,0 +1,77 @@
+// Copyright 2023 Hedgehog
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package seeder
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+	"path"
+
+	"github.com/go-chi/chi/v5"
+
+	"go.githedgehog.com/dasboot/pkg/seeder/controlplane"
+	"go.githedgehog.com/dasboot/pkg/stage"
+	wiring1alpha2 "go.githedgehog.com/fabric/api/wiring/v1alpha2"
+)
+
+const deviceMetadataPathBase = "/device-metadata/"
+
+// deviceMetadata builds the metadata of the device `devid` from its switch in the wiring
+func deviceMetadata(devid string, sw *wiring1alpha2.Switch, fabric string) *stage.DeviceMetadata {
+	return &stage.DeviceMetadata{
+		DeviceID:    devid,
+		Hostname:    sw.Name,
+		Role:        string(sw.Spec.Role),
+		Description: sw.Spec.Description,
+		Profile:     sw.Spec.Profile,
+		Groups:      sw.Spec.Groups,
+		Fabric:      fabric,
+	}
+}
+
+func (s *seeder) getDeviceMetadata(authz func(*http.Request) error) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if err := authz(r); err != nil {
+			errorWithJSON(w, r, http.StatusForbidden, "unauthorized access to device metadata: %s", err)
+			return
+		}
+
+		devidParam := chi.URLParam(r, "devid")
+		if devidParam == "" {
+			errorWithJSON(w, r, http.StatusBadRequest, "no device ID in URL")
+			return
+		}
+
+		sw, err := s.cpc.GetSwitchByDeviceID(r.Context(), devidParam)
+		if err != nil {
+			if errors.Is(err, controlplane.ErrNotFound) {
+				errorWithJSON(w, r, http.StatusNotFound, "no switch planned for device: %s", err)
+				return
+			}
+			errorWithJSON(w, r, http.StatusInternalServerError, "fetching switch of device: %s", err)
+			return
+		}
+		writeJSON(w, r, http.StatusOK, deviceMetadata(devidParam, sw, s.installerSettings.fabricName))
+	}
+}
+
+func (lis *loadedInstallerSettings) deviceMetadataURL() string {
+	return (&url.URL{
+		Scheme: lis.secureScheme(),
+		Host:   lis.secureServerName,
+		Path:   path.Join("/", deviceMetadataPathBase),
+	}).String()
+}
@@ -0,0 +1,126 @@
+// Copyright 2023 Hedgehog
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package seeder
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"reflect"
+	"testing"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/golang/mock/gomock"
+	"go.githedgehog.com/dasboot/pkg/seeder/controlplane"
+	"go.githedgehog.com/dasboot/pkg/stage"
+	"go.githedgehog.com/dasboot/test/mock/seeder/mockcontrolplane"
+	wiring1alpha2 "go.githedgehog.com/fabric/api/wiring/v1alpha2"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestGetDeviceMetadata(t *testing.T) {
+	const devid = "0a1b2c3d-4e5f-6789-abcd-ef0123456789"
+	allow := func(*http.Request) error { return nil }
+	tests := []struct {
+		name     string
+		authz    func(*http.Request) error
+		pre      func(c *mockcontrolplane.MockClient)
+		wantCode int
+		want     *stage.DeviceMetadata
+	}{
+		{
+			name:     "unauthorized",
+			authz:    func(*http.Request) error { return errors.New("not registered") },
+			pre:      func(c *mockcontrolplane.MockClient) {},
+			wantCode: http.StatusForbidden,
+		},
+		{
+			name:  "unknown device",
+			authz: allow,
+			pre: func(c *mockcontrolplane.MockClient) {
+				c.EXPECT().GetSwitchByDeviceID(gomock.Any(), devid).Return(nil, controlplane.ErrNotFound)
+			},
+			wantCode: http.StatusNotFound,
+		},
+		{
+			name:  "control plane failure",
+			authz: allow,
+			pre: func(c *mockcontrolplane.MockClient) {
+				c.EXPECT().GetSwitchByDeviceID(gomock.Any(), devid).Return(nil, errors.New("boom"))
+			},
+			wantCode: http.StatusInternalServerError,
+		},
+		{
+			name:  "planned switch",
+			authz: allow,
+			pre: func(c *mockcontrolplane.MockClient) {
+				c.EXPECT().GetSwitchByDeviceID(gomock.Any(), devid).Return(&wiring1alpha2.Switch{
+					ObjectMeta: metav1.ObjectMeta{Name: "leaf-01"},
+					Spec: wiring1alpha2.SwitchSpec{
+						Role:        wiring1alpha2.SwitchRoleServerLeaf,
+						Description: "rack 1",
+						Profile:     "dell-s5248f-on",
+						Groups:      []string{"mclag-1"},
+					},
+				}, nil)
+			},
+			wantCode: http.StatusOK,
+			want: &stage.DeviceMetadata{
+				DeviceID:    devid,
+				Hostname:    "leaf-01",
+				Role:        "server-leaf",
+				Description: "rack 1",
+				Profile:     "dell-s5248f-on",
+				Groups:      []string{"mclag-1"},
+				Fabric:      "lab",
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			defer ctrl.Finish()
+			c := mockcontrolplane.NewMockClient(ctrl)
+			tt.pre(c)
+			s := &seeder{
+				cpc:               c,
+				installerSettings: &loadedInstallerSettings{fabricName: "lab"},
+			}
+			r := chi.NewRouter()
+			r.Get(path.Join(deviceMetadataPathBase, "{devid}"), s.getDeviceMetadata(tt.authz))
+
+			rec := httptest.NewRecorder()
+			r.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path.Join(deviceMetadataPathBase, devid), nil))
+			if rec.Code != tt.wantCode {
+				t.Fatalf("status = %d, want %d: %s", rec.Code, tt.wantCode, rec.Body.String())
+			}
+			if tt.want == nil {
+				return
+			}
+			var got stage.DeviceMetadata
+			if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+				t.Fatalf("decoding response: %v", err)
+			}
+			if !reflect.DeepEqual(&got, tt.want) {
+				t.Errorf("metadata = %#v, want %#v", &got, tt.want)
+			}
+			if err := got.Validate(devid); err != nil {
+				t.Errorf("metadata does not validate: %v", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,320 @@
+// Copyright 2023 Hedgehog
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package seeder
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
+	"github.com/google/uuid"
+	"go.uber.org/zap"
+	"sigs.k8s.io/yaml"
+
+	"go.githedgehog.com/dasboot/pkg/seeder/controlplane"
+	"go.githedgehog.com/dasboot/pkg/version"
+)
+
+const adminDevicesPath = "/devices"
+
+// redactedValue replaces all sensitive values in the configs of a diagnostics bundle
+const redactedValue = "REDACTED"
+
+// sensitiveKeys are substrings of map keys (compared case-insensitively) whose values get redacted
+var sensitiveKeys = []string{
+	"token",
+	"password",
+	"passwd",
+	"secret",
+	"private",
+	"key-data",
+	"keydata",
+}
+
+// DiagnosticsManifest is the `manifest.json` of a diagnostics bundle. It lists the files in the bundle, and
+// the sources which could not be collected so that an incomplete bundle can be told apart from a device
+// for which nothing happened.
+type DiagnosticsManifest struct {
+	DevID         string            `json:"devid"`
+	Generated     time.Time         `json:"generated"`
+	SeederVersion string            `json:"seeder_version"`
+	Files         []string          `json:"files"`
+	Errors        map[string]string `json:"errors,omitempty"`
+}
+
+type diagnosticsFile struct {
+	name    string
+	data    []byte
+	path    string
+	modTime time.Time
+}
+
+// diagnosticsBundle collects everything the seeder knows about a device
+type diagnosticsBundle struct {
+	manifest DiagnosticsManifest
+	files    []*diagnosticsFile
+}
+
+func (b *diagnosticsBundle) addJSON(name string, v any) {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		b.addError(name, err)
+		return
+	}
+	b.files = append(b.files, &diagnosticsFile{name: name, data: data, modTime: b.manifest.Generated})
+}
+
+func (b *diagnosticsBundle) addRedactedYAML(name string, data []byte) {
+	redacted, err := redactDocument(data)
+	if err != nil {
+		// never ship a config which we were unable to redact
+		b.addError(name, err)
+		return
+	}
+	b.files = append(b.files, &diagnosticsFile{name: name, data: redacted, modTime: b.manifest.Generated})
+}
+
+func (b *diagnosticsBundle) addError(source string, err error) {
+	if b.manifest.Errors == nil {
+		b.manifest.Errors = make(map[string]string)
+	}
+	b.manifest.Errors[source] = err.Error()
+}
+
+// write writes the bundle as a gzip compressed tarball with all files in the directory `<devid>/`
+func (b *diagnosticsBundle) write(w io.Writer) error {
+	for _, f := range b.files {
+		b.manifest.Files = append(b.manifest.Files, f.name)
+	}
+	manifest, err := json.MarshalIndent(&b.manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	zw := gzip.NewWriter(w)
+	tw := tar.NewWriter(zw)
+	files := append([]*diagnosticsFile{{name: "manifest.json", data: manifest, modTime: b.manifest.Generated}}, b.files...)
+	for _, f := range files {
+		if err := writeDiagnosticsFile(tw, b.manifest.DevID, f); err != nil {
+			return fmt.Errorf("%s: %w", f.name, err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return zw.Close()
+}
+
+func writeDiagnosticsFile(tw *tar.Writer, dir string, f *diagnosticsFile) error {
+	hdr := &tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     path.Join(dir, f.name),
+		Mode:     0o644,
+		Size:     int64(len(f.data)),
+		ModTime:  f.modTime,
+	}
+	if f.path == "" {
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		_, err := tw.Write(f.data)
+		return err
+	}
+
+	// files on disk are being streamed into the tarball
+	file, err := os.Open(f.path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	fi, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	hdr.Size = fi.Size()
+	if err := tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	_, err = io.CopyN(tw, file, hdr.Size)
+	return err
+}
+
+// redactDocument parses the YAML or JSON document `data` and replaces the values of all sensitive keys
+func redactDocument(data []byte) ([]byte, error) {
+	var doc any
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return nil, fmt.Errorf("redacting: %w", err)
+	}
+	ret, err := yaml.Marshal(redactValue(doc))
+	if err != nil {
+		return nil, fmt.Errorf("redacting: %w", err)
+	}
+	return ret, nil
+}
+
+func redactValue(v any) any {
+	switch val := v.(type) {
+	case map[string]any:
+		for k, mv := range val {
+			if isSensitiveKey(k) {
+				val[k] = redactedValue
+				continue
+			}
+			val[k] = redactValue(mv)
+		}
+		return val
+	case []any:
+		for i := range val {
+			val[i] = redactValue(val[i])
+		}
+		return val
+	default:
+		return v
+	}
+}
+
+func isSensitiveKey(k string) bool {
+	k = strings.ToLower(k)
+	for _, sk := range sensitiveKeys {
+		if strings.Contains(k, sk) {
+			return true
+		}
+	}
+	return false
+}
+
+// collectDiagnostics assembles the diagnostics bundle of device `devid`. It returns false if the seeder
+// does not know anything about the device at all.
+func (s *seeder) collectDiagnostics(r *http.Request, devid string) (*diagnosticsBundle, bool) {
+	ctx := r.Context()
+	b := &diagnosticsBundle{
+		manifest: DiagnosticsManifest{
+			DevID:         devid,
+			Generated:     time.Now(),
+			SeederVersion: version.Version,
+		},
+	}
+	known := false
+
+	// the registration carries the progress of the device in its conditions
+	reg, err := s.cpc.GetDeviceRegistration(ctx, devid)
+	if err != nil {
+		if !errors.Is(err, controlplane.ErrNotFound) {
+			b.addError("registration.json", err)
+		}
+	} else {
+		known = true
+		b.addJSON("registration.json", reg)
+	}
+
+	// everything else in the control plane hangs off the registration
+	if reg != nil {
+		if switchObj, err := s.cpc.GetSwitchByDeviceID(ctx, devid); err != nil {
+			if !errors.Is(err, controlplane.ErrNotFound) {
+				b.addError("switch.json", err)
+			}
+		} else {
+			b.addJSON("switch.json", switchObj)
+		}
+
+		// these are the configs which were shipped to the device, which is why they must be redacted
+		if agentConfig, err := s.cpc.GetAgentConfig(ctx, devid); err != nil {
+			if !errors.Is(err, controlplane.ErrNotFound) {
+				b.addError("agent-config.yaml", err)
+			}
+		} else {
+			b.addRedactedYAML("agent-config.yaml", agentConfig)
+		}
+		if kubeconfig, err := s.cpc.GetAgentKubeconfig(ctx, devid); err != nil {
+			if !errors.Is(err, controlplane.ErrNotFound) {
+				b.addError("agent-kubeconfig.yaml", err)
+			}
+		} else {
+			b.addRedactedYAML("agent-kubeconfig.yaml", kubeconfig)
+		}
+	}
+
+	if report := s.recoveryReports.get(devid); report != nil {
+		known = true
+		b.addJSON("recovery-report.json", report)
+	}
+
+	if overrides := s.overrides.list()[devid]; len(overrides) > 0 {
+		known = true
+		b.addJSON("artifact-overrides.json", overrides)
+	}
+
+	var downloads []DownloadSession
+	for _, d := range s.downloads.list() {
+		if d.DevID == devid {
+			downloads = append(downloads, d)
+		}
+	}
+	if len(downloads) > 0 {
+		known = true
+		b.addJSON("downloads.json", downloads)
+	}
+
+	// the shipped logs are added as they were received: one compressed chunk per file
+	if s.logs != nil {
+		chunks, err := s.logs.find(devid, "")
+		if err != nil {
+			b.addError("logs", err)
+		}
+		for _, c := range chunks {
+			known = true
+			b.files = append(b.files, &diagnosticsFile{
+				name:    path.Join("logs", c.session, path.Base(c.path)),
+				path:    c.path,
+				modTime: c.modTime,
+			})
+		}
+	}
+
+	return b, known || len(b.manifest.Errors) > 0
+}
+
+func (s *seeder) getDiagnosticsHandler(w http.ResponseWriter, r *http.Request) {
+	devidParam := chi.URLParam(r, "devid")
+	if _, err := uuid.Parse(devidParam); err != nil {
+		errorWithJSON(w, r, http.StatusBadRequest, "invalid device ID '%s': %s", devidParam, err)
+		return
+	}
+
+	b, ok := s.collectDiagnostics(r, devidParam)
+	if !ok {
+		errorWithJSON(w, r, http.StatusNotFound, "nothing is known about device '%s'", devidParam)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/gzip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"diagnostics-%s.tar.gz\"", devidParam))
+	w.WriteHeader(http.StatusOK)
+	if err := b.write(w); err != nil {
+		l.Warn("Writing diagnostics bundle failed", zap.String("request", middleware.GetReqID(r.Context())), zap.String("devid", devidParam), zap.Error(err))
+		return
+	}
+	l.Info("Diagnostics bundle served", zap.String("devid", devidParam), zap.Int("files", len(b.manifest.Files)), zap.Int("errors", len(b.manifest.Errors)))
+}
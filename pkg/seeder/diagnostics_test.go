@@ -0,0 +1,210 @@
+// Copyright 2023 Hedgehog
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package seeder
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/golang/mock/gomock"
+	dasbootv1alpha1 "go.githedgehog.com/dasboot/pkg/k8s/api/v1alpha1"
+	"go.githedgehog.com/dasboot/pkg/seeder/controlplane"
+	"go.githedgehog.com/dasboot/pkg/seeder/recovery"
+	"go.githedgehog.com/dasboot/test/mock/seeder/mockcontrolplane"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const testDiagnosticsDevID = "4b5b8a5c-8e1b-4c1e-9d4e-1f3c2b6a7d8e"
+
+func TestRedactDocument(t *testing.T) {
+	tests := []struct {
+		name    string
+		doc     string
+		want    string
+		wantErr bool
+	}{
+		{
+			name: "kubeconfig",
+			doc: `apiVersion: v1
+clusters:
+- cluster:
+    certificate-authority-data: Q0EK
+    server: https://192.168.42.1:6443
+  name: default
+users:
+- name: agent
+  user:
+    client-key-data: S0VZCg==
+    token: abcdef
+`,
+			want: `apiVersion: v1
+clusters:
+- cluster:
+    certificate-authority-data: Q0EK
+    server: https://192.168.42.1:6443
+  name: default
+users:
+- name: agent
+  user:
+    client-key-data: REDACTED
+    token: REDACTED
+`,
+		},
+		{
+			name: "nested JSON",
+			doc:  `{"spec":{"users":[{"name":"admin","password":"$5$hash"}],"secretName":"x"}}`,
+			want: `spec:
+  secretName: REDACTED
+  users:
+  - name: admin
+    password: REDACTED
+`,
+		},
+		{
+			name:    "invalid document",
+			doc:     "a: [",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := redactDocument([]byte(tt.doc))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("redactDocument() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if string(got) != tt.want {
+				t.Errorf("redactDocument() = %q, want %q", string(got), tt.want)
+			}
+		})
+	}
+}
+
+func readDiagnosticsBundle(t *testing.T, b []byte) map[string][]byte {
+	zr, err := gzip.NewReader(bytes.NewReader(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ret := make(map[string][]byte)
+	tr := tar.NewReader(zr)
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := io.ReadAll(tr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ret[hdr.Name] = data
+	}
+	return ret
+}
+
+func TestGetDiagnosticsHandler(t *testing.T) {
+	tests := []struct {
+		name      string
+		pre       func(c *mockcontrolplane.MockClient, s *seeder)
+		wantCode  int
+		wantFiles []string
+		wantErrs  []string
+	}{
+		{
+			name: "unknown device",
+			pre: func(c *mockcontrolplane.MockClient, s *seeder) {
+				c.EXPECT().GetDeviceRegistration(gomock.Any(), testDiagnosticsDevID).Return(nil, controlplane.ErrNotFound)
+			},
+			wantCode: http.StatusNotFound,
+		},
+		{
+			name: "registered device",
+			pre: func(c *mockcontrolplane.MockClient, s *seeder) {
+				c.EXPECT().GetDeviceRegistration(gomock.Any(), testDiagnosticsDevID).Return(&dasbootv1alpha1.DeviceRegistration{
+					ObjectMeta: metav1.ObjectMeta{Name: testDiagnosticsDevID},
+				}, nil)
+				c.EXPECT().GetSwitchByDeviceID(gomock.Any(), testDiagnosticsDevID).Return(nil, controlplane.ErrNotFound)
+				c.EXPECT().GetAgentConfig(gomock.Any(), testDiagnosticsDevID).Return([]byte("spec:\n  token: abc\n"), nil)
+				c.EXPECT().GetAgentKubeconfig(gomock.Any(), testDiagnosticsDevID).Return(nil, errors.New("boom"))
+				s.recoveryReports.add(&ReceivedRecoveryReport{Report: recovery.Report{DevID: testDiagnosticsDevID}})
+			},
+			wantCode: http.StatusOK,
+			wantFiles: []string{
+				"registration.json",
+				"agent-config.yaml",
+				"recovery-report.json",
+			},
+			wantErrs: []string{"agent-kubeconfig.yaml"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			defer ctrl.Finish()
+			c := mockcontrolplane.NewMockClient(ctrl)
+			s := &seeder{
+				cpc:             c,
+				limits:          newLimits(nil),
+				overrides:       newArtifactOverrides(),
+				recoveryReports: newRecoveryReports(),
+				downloads:       newDownloadSessions(),
+			}
+			tt.pre(c, s)
+
+			r := httptest.NewRequest(http.MethodGet, adminDevicesPath+"/"+testDiagnosticsDevID+"/diagnostics", nil)
+			r.RemoteAddr = "127.0.0.1:12345"
+			rec := httptest.NewRecorder()
+			s.adminHandler().ServeHTTP(rec, r)
+			if rec.Code != tt.wantCode {
+				t.Fatalf("status = %d, want %d: %s", rec.Code, tt.wantCode, rec.Body.String())
+			}
+			if tt.wantCode != http.StatusOK {
+				return
+			}
+
+			files := readDiagnosticsBundle(t, rec.Body.Bytes())
+			var manifest DiagnosticsManifest
+			if err := json.Unmarshal(files[testDiagnosticsDevID+"/manifest.json"], &manifest); err != nil {
+				t.Fatalf("manifest: %v", err)
+			}
+			if !reflect.DeepEqual(manifest.Files, tt.wantFiles) {
+				t.Errorf("manifest files = %v, want %v", manifest.Files, tt.wantFiles)
+			}
+			for _, f := range tt.wantFiles {
+				if _, ok := files[testDiagnosticsDevID+"/"+f]; !ok {
+					t.Errorf("bundle is missing %s", f)
+				}
+			}
+			for _, e := range tt.wantErrs {
+				if _, ok := manifest.Errors[e]; !ok {
+					t.Errorf("manifest is missing error for %s: %v", e, manifest.Errors)
+				}
+			}
+			if agentConfig, ok := files[testDiagnosticsDevID+"/agent-config.yaml"]; ok && strings.Contains(string(agentConfig), "abc") {
+				t.Errorf("agent config was not redacted: %s", agentConfig)
+			}
+		})
+	}
+}
@@ -0,0 +1,640 @@
+// Copyright 2023 Hedgehog
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package seeder
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
+	"github.com/google/uuid"
+	"go.uber.org/zap"
+	"golang.org/x/time/rate"
+
+	"go.githedgehog.com/dasboot/pkg/seeder/config"
+	"go.githedgehog.com/dasboot/pkg/stage"
+)
+
+const (
+	DefaultUploadMaxFileSize       int64 = 2 * 1024 * 1024 * 1024
+	DefaultUploadMaxBytesPerDevice int64 = 4 * 1024 * 1024 * 1024
+	DefaultUploadMaxChunkSize      int64 = 4 * 1024 * 1024
+	DefaultUploadMaxAge                  = 14 * 24 * time.Hour
+	DefaultUploadMaxBytesPerSecond int64 = 8 * 1024 * 1024
+)
+
+const (
+	diagnosticsUploadsPath = "/diagnostics/uploads"
+	adminUploadsPath       = "/uploads"
+)
+
+const (
+	uploadMetadataSuffix = ".json"
+	uploadDataSuffix     = ".data"
+)
+
+// uploadThrottleBurst is the largest amount of bytes which is being read at once from a throttled upload
+const uploadThrottleBurst = 64 * 1024
+
+var (
+	ErrUploadNotFound       = errors.New("diagnostics upload: not found")
+	ErrUploadInvalid        = errors.New("diagnostics upload: invalid")
+	ErrUploadTooLarge       = errors.New("diagnostics upload: file exceeds maximum size")
+	ErrUploadQuotaExceeded  = errors.New("diagnostics upload: device quota exceeded")
+	ErrUploadOffsetMismatch = errors.New("diagnostics upload: offset mismatch")
+	ErrUploadBusy           = errors.New("diagnostics upload: another chunk is being uploaded")
+	ErrUploadDigestMismatch = errors.New("diagnostics upload: digest mismatch")
+)
+
+// DiagnosticsUpload is a diagnostics upload of a device as it is listed on the admin server
+type DiagnosticsUpload struct {
+	stage.DiagnosticsUpload
+	DevID   string    `json:"devid"`
+	Created time.Time `json:"created"`
+	Updated time.Time `json:"updated"`
+}
+
+// uploadStore stores the diagnostic files which devices upload in chunks on disk. Every upload consists of its
+// metadata at `<dir>/<devid>/<id>.json` and of the data which was received so far at `<dir>/<devid>/<id>.data`.
+// The size of the data file is the offset of the upload, so uploads can be continued across restarts of the seeder.
+type uploadStore struct {
+	mu                sync.Mutex
+	dir               string
+	maxFileSize       int64
+	maxBytesPerDevice int64
+	maxChunkSize      int64
+	maxAge            time.Duration
+	bytesPerSecond    int64
+	busy              map[string]bool
+	limiters          map[string]*rate.Limiter
+}
+
+func newUploadStore(cfg *config.DiagnosticsUploads) (*uploadStore, error) {
+	if cfg == nil || cfg.Dir == "" {
+		return nil, nil
+	}
+	if err := os.MkdirAll(cfg.Dir, 0o750); err != nil {
+		return nil, fmt.Errorf("diagnostics uploads: creating upload directory: %w", err)
+	}
+	orDefault := func(v, def int64) int64 {
+		if v <= 0 {
+			return def
+		}
+		return v
+	}
+	ret := &uploadStore{
+		dir:               cfg.Dir,
+		maxFileSize:       orDefault(cfg.MaxFileSize, DefaultUploadMaxFileSize),
+		maxBytesPerDevice: orDefault(cfg.MaxBytesPerDevice, DefaultUploadMaxBytesPerDevice),
+		maxChunkSize:      orDefault(cfg.MaxChunkSize, DefaultUploadMaxChunkSize),
+		maxAge:            cfg.MaxAge,
+		bytesPerSecond:    orDefault(cfg.MaxBytesPerSecond, DefaultUploadMaxBytesPerSecond),
+		busy:              make(map[string]bool),
+		limiters:          make(map[string]*rate.Limiter),
+	}
+	if ret.maxAge <= 0 {
+		ret.maxAge = DefaultUploadMaxAge
+	}
+	return ret, nil
+}
+
+func (us *uploadStore) path(devid, id, suffix string) string {
+	return filepath.Join(us.dir, devid, id+suffix)
+}
+
+// load reads the upload `id` of device `devid`. The offset is the size of its data.
+func (us *uploadStore) load(devid, id string) (*DiagnosticsUpload, error) {
+	b, err := os.ReadFile(us.path(devid, id, uploadMetadataSuffix))
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, fmt.Errorf("%w: %s", ErrUploadNotFound, id)
+		}
+		return nil, err
+	}
+	var ret DiagnosticsUpload
+	if err := json.Unmarshal(b, &ret); err != nil {
+		return nil, fmt.Errorf("decoding metadata of upload '%s': %w", id, err)
+	}
+	fi, err := os.Stat(us.path(devid, id, uploadDataSuffix))
+	if err != nil {
+		return nil, err
+	}
+	ret.Offset = fi.Size()
+	ret.ChunkSize = us.maxChunkSize
+	return &ret, nil
+}
+
+func (us *uploadStore) save(up *DiagnosticsUpload) error {
+	b, err := json.Marshal(up)
+	if err != nil {
+		return err
+	}
+	p := us.path(up.DevID, up.ID, uploadMetadataSuffix)
+	tmp := p + ".tmp"
+	if err := os.WriteFile(tmp, b, 0o640); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, p); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return nil
+}
+
+func (us *uploadStore) remove(devid, id string) error {
+	if err := os.Remove(us.path(devid, id, uploadMetadataSuffix)); err != nil {
+		return err
+	}
+	if err := os.Remove(us.path(devid, id, uploadDataSuffix)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	// removing the device directory only succeeds once it is empty
+	_ = os.Remove(filepath.Join(us.dir, devid))
+	return nil
+}
+
+// uploads returns all uploads of device `devid` ordered by their creation time
+func (us *uploadStore) uploads(devid string) ([]*DiagnosticsUpload, error) {
+	entries, err := os.ReadDir(filepath.Join(us.dir, devid))
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var ret []*DiagnosticsUpload
+	for _, entry := range entries {
+		id, ok := strings.CutSuffix(entry.Name(), uploadMetadataSuffix)
+		if !ok {
+			continue
+		}
+		up, err := us.load(devid, id)
+		if err != nil {
+			l.Warn("Loading diagnostics upload failed", zap.String("devid", devid), zap.String("id", id), zap.Error(err))
+			continue
+		}
+		ret = append(ret, up)
+	}
+	sort.SliceStable(ret, func(i, j int) bool {
+		return ret[i].Created.Before(ret[j].Created)
+	})
+	return ret, nil
+}
+
+// prune removes all uploads of device `devid` which were not updated within the maximum age. It must be called
+// with the lock held, and it skips uploads which are busy.
+func (us *uploadStore) prune(devid string, now time.Time) {
+	ups, err := us.uploads(devid)
+	if err != nil {
+		l.Warn("Listing diagnostics uploads for pruning failed", zap.String("devid", devid), zap.Error(err))
+		return
+	}
+	for _, up := range ups {
+		if now.Sub(up.Updated) <= us.maxAge || us.busy[devid+"/"+up.ID] {
+			continue
+		}
+		if err := us.remove(devid, up.ID); err != nil {
+			l.Warn("Removing expired diagnostics upload failed", zap.String("devid", devid), zap.String("id", up.ID), zap.Error(err))
+		}
+	}
+}
+
+func validateUploadRequest(req *stage.DiagnosticsUploadRequest) error {
+	if req.Name == "" || req.Name == "." || req.Name == ".." || strings.ContainsAny(req.Name, "/\\\x00") {
+		return fmt.Errorf("%w: file name '%s'", ErrUploadInvalid, req.Name)
+	}
+	if req.Size < 0 {
+		return fmt.Errorf("%w: size %d", ErrUploadInvalid, req.Size)
+	}
+	hexDigest, ok := strings.CutPrefix(req.Digest, "sha256:")
+	if b, err := hex.DecodeString(hexDigest); !ok || err != nil || len(b) != sha256.Size {
+		return fmt.Errorf("%w: digest '%s'", ErrUploadInvalid, req.Digest)
+	}
+	return nil
+}
+
+// create starts the upload `req` for device `devid`. If the device has an upload with the same name and digest
+// already, that one is being returned instead, so that it can be continued. The returned bool is true if a new
+// upload was created.
+func (us *uploadStore) create(devid string, req *stage.DiagnosticsUploadRequest) (*DiagnosticsUpload, bool, error) {
+	if err := validateUploadRequest(req); err != nil {
+		return nil, false, err
+	}
+	if req.Size > us.maxFileSize {
+		return nil, false, fmt.Errorf("%w: %d bytes exceed %d bytes", ErrUploadTooLarge, req.Size, us.maxFileSize)
+	}
+
+	us.mu.Lock()
+	defer us.mu.Unlock()
+	now := time.Now()
+	us.prune(devid, now)
+	ups, err := us.uploads(devid)
+	if err != nil {
+		return nil, false, err
+	}
+	var total int64
+	for _, up := range ups {
+		if up.Name == req.Name && up.Digest == req.Digest {
+			return up, false, nil
+		}
+		total += up.Size
+	}
+	if total+req.Size > us.maxBytesPerDevice {
+		return nil, false, fmt.Errorf("%w: %d bytes stored, %d bytes allowed", ErrUploadQuotaExceeded, total, us.maxBytesPerDevice)
+	}
+
+	if err := os.MkdirAll(filepath.Join(us.dir, devid), 0o750); err != nil {
+		return nil, false, err
+	}
+	up := &DiagnosticsUpload{
+		DiagnosticsUpload: stage.DiagnosticsUpload{
+			DiagnosticsUploadRequest: *req,
+			ID:                       uuid.NewString(),
+			ChunkSize:                us.maxChunkSize,
+		},
+		DevID:   devid,
+		Created: now,
+		Updated: now,
+	}
+	f, err := os.OpenFile(us.path(devid, up.ID, uploadDataSuffix), os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o640)
+	if err != nil {
+		return nil, false, err
+	}
+	f.Close()
+	if err := us.save(up); err != nil {
+		os.Remove(us.path(devid, up.ID, uploadDataSuffix))
+		return nil, false, err
+	}
+	// an empty file is complete right away
+	if up.Size == 0 {
+		if err := us.finish(up); err != nil {
+			return nil, false, err
+		}
+	}
+	return up, true, nil
+}
+
+// limiter returns the limiter which throttles all uploads of device `devid`
+func (us *uploadStore) limiter(devid string) *rate.Limiter {
+	us.mu.Lock()
+	defer us.mu.Unlock()
+	lim, ok := us.limiters[devid]
+	if !ok {
+		lim = rate.NewLimiter(rate.Limit(us.bytesPerSecond), int(min(us.bytesPerSecond, uploadThrottleBurst)))
+		us.limiters[devid] = lim
+	}
+	return lim
+}
+
+// appendChunk appends the chunk `body` at `offset` to the upload `id` of device `devid`. Everything which was read
+// from `body` is being kept even if reading fails, so that a device on a flaky link continues where it was cut off.
+func (us *uploadStore) appendChunk(ctx context.Context, devid, id string, offset int64, body io.Reader) (*DiagnosticsUpload, error) {
+	key := devid + "/" + id
+	us.mu.Lock()
+	if us.busy[key] {
+		us.mu.Unlock()
+		return nil, ErrUploadBusy
+	}
+	us.busy[key] = true
+	us.mu.Unlock()
+	defer func() {
+		us.mu.Lock()
+		delete(us.busy, key)
+		us.mu.Unlock()
+	}()
+
+	up, err := us.load(devid, id)
+	if err != nil {
+		return nil, err
+	}
+	if up.Complete || offset != up.Offset {
+		return nil, fmt.Errorf("%w: chunk at offset %d, upload is at offset %d", ErrUploadOffsetMismatch, offset, up.Offset)
+	}
+
+	f, err := os.OpenFile(us.path(devid, id, uploadDataSuffix), os.O_WRONLY|os.O_APPEND, 0o640)
+	if err != nil {
+		return nil, err
+	}
+	remaining := up.Size - up.Offset
+	n, copyErr := io.Copy(f, io.LimitReader(&throttledReader{ctx: ctx, r: body, lim: us.limiter(devid)}, remaining))
+	if err := f.Close(); err != nil && copyErr == nil {
+		copyErr = err
+	}
+	up.Offset += n
+	up.Updated = time.Now()
+	if err := us.save(up); err != nil {
+		return nil, err
+	}
+	if copyErr != nil {
+		return nil, fmt.Errorf("receiving chunk: %w", copyErr)
+	}
+	if n == remaining {
+		var extra [1]byte
+		if m, _ := body.Read(extra[:]); m > 0 {
+			return nil, fmt.Errorf("%w: chunk exceeds the size of the file", ErrUploadInvalid)
+		}
+	}
+	if up.Offset == up.Size {
+		if err := us.finish(up); err != nil {
+			return nil, err
+		}
+	}
+	return up, nil
+}
+
+// finish verifies the digest of a fully received upload and marks it complete. An upload with a wrong digest
+// is being removed, so that the device can start over.
+func (us *uploadStore) finish(up *DiagnosticsUpload) error {
+	digest, _, err := stage.DiagnosticsDigest(us.path(up.DevID, up.ID, uploadDataSuffix))
+	if err != nil {
+		return err
+	}
+	if digest != up.Digest {
+		if err := us.remove(up.DevID, up.ID); err != nil {
+			l.Warn("Removing diagnostics upload with digest mismatch failed", zap.String("devid", up.DevID), zap.String("id", up.ID), zap.Error(err))
+		}
+		return fmt.Errorf("%w: expected %s, received %s", ErrUploadDigestMismatch, up.Digest, digest)
+	}
+	up.Complete = true
+	return us.save(up)
+}
+
+// list applies the retention limits to all devices and returns all uploads
+func (us *uploadStore) list() ([]*DiagnosticsUpload, error) {
+	us.mu.Lock()
+	defer us.mu.Unlock()
+	entries, err := os.ReadDir(us.dir)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	ret := []*DiagnosticsUpload{}
+	for _, entry := range entries {
+		if _, err := uuid.Parse(entry.Name()); !entry.IsDir() || err != nil {
+			continue
+		}
+		us.prune(entry.Name(), now)
+		ups, err := us.uploads(entry.Name())
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, ups...)
+	}
+	return ret, nil
+}
+
+func (us *uploadStore) delete(devid, id string) error {
+	us.mu.Lock()
+	defer us.mu.Unlock()
+	if us.busy[devid+"/"+id] {
+		return ErrUploadBusy
+	}
+	if err := us.remove(devid, id); err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return fmt.Errorf("%w: %s", ErrUploadNotFound, id)
+		}
+		return err
+	}
+	return nil
+}
+
+// throttledReader limits the rate at which `r` is being read with `lim`
+type throttledReader struct {
+	ctx context.Context
+	r   io.Reader
+	lim *rate.Limiter
+}
+
+func (t *throttledReader) Read(p []byte) (int, error) {
+	if len(p) > t.lim.Burst() {
+		p = p[:t.lim.Burst()]
+	}
+	n, err := t.r.Read(p)
+	if n > 0 {
+		if werr := t.lim.WaitN(t.ctx, n); werr != nil {
+			return n, werr
+		}
+	}
+	return n, err
+}
+
+func uploadErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, ErrUploadNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, ErrUploadInvalid):
+		return http.StatusBadRequest
+	case errors.Is(err, ErrUploadTooLarge):
+		return http.StatusRequestEntityTooLarge
+	case errors.Is(err, ErrUploadQuotaExceeded):
+		return http.StatusInsufficientStorage
+	case errors.Is(err, ErrUploadOffsetMismatch), errors.Is(err, ErrUploadBusy):
+		return http.StatusConflict
+	case errors.Is(err, ErrUploadDigestMismatch):
+		return http.StatusUnprocessableEntity
+	}
+	var maxBytesErr *http.MaxBytesError
+	if errors.As(err, &maxBytesErr) {
+		return http.StatusRequestEntityTooLarge
+	}
+	return http.StatusInternalServerError
+}
+
+// diagnosticsUploadsURL returns the URL where devices upload diagnostic files to, or an empty string if it is disabled
+func (s *seeder) diagnosticsUploadsURL() string {
+	if s.uploads == nil {
+		return ""
+	}
+	return s.installerSettings.diagnosticsUploadsURL()
+}
+
+// uploadDeviceID returns the device ID of the registered device which makes the upload request `r`
+func uploadDeviceID(r *http.Request) (string, error) {
+	if err := checkAccessLevel(r, accessRegistered); err != nil {
+		return "", err
+	}
+	devid := r.TLS.PeerCertificates[0].Subject.CommonName
+	if _, err := uuid.Parse(devid); err != nil {
+		return "", fmt.Errorf("device certificate CN is not a device ID: %w", err)
+	}
+	return devid, nil
+}
+
+func (s *seeder) createUploadHandler(w http.ResponseWriter, r *http.Request) {
+	devid, err := uploadDeviceID(r)
+	if err != nil {
+		errorWithJSON(w, r, http.StatusForbidden, "diagnostics upload: %s", err)
+		return
+	}
+	var req stage.DiagnosticsUploadRequest
+	if !s.limits.decodeJSONRequest(w, r, &req) {
+		return
+	}
+	up, created, err := s.uploads.create(devid, &req)
+	if err != nil {
+		errorWithJSON(w, r, uploadErrorStatus(err), "%s", err)
+		return
+	}
+	w.Header().Set(stage.HeaderUploadOffset, strconv.FormatInt(up.Offset, 10))
+	if created {
+		l.Info("Diagnostics upload started", zap.String("request", middleware.GetReqID(r.Context())), zap.String("devid", devid), zap.String("id", up.ID), zap.String("name", up.Name), zap.Int64("size", up.Size))
+		writeJSON(w, r, http.StatusCreated, &up.DiagnosticsUpload)
+		return
+	}
+	writeJSON(w, r, http.StatusOK, &up.DiagnosticsUpload)
+}
+
+func (s *seeder) getUploadHandler(w http.ResponseWriter, r *http.Request) {
+	devid, err := uploadDeviceID(r)
+	if err != nil {
+		errorWithJSON(w, r, http.StatusForbidden, "diagnostics upload: %s", err)
+		return
+	}
+	id := chi.URLParam(r, "id")
+	if _, err := uuid.Parse(id); err != nil {
+		errorWithJSON(w, r, http.StatusBadRequest, "invalid upload ID '%s': %s", id, err)
+		return
+	}
+	up, err := s.uploads.load(devid, id)
+	if err != nil {
+		errorWithJSON(w, r, uploadErrorStatus(err), "%s", err)
+		return
+	}
+	w.Header().Set(stage.HeaderUploadOffset, strconv.FormatInt(up.Offset, 10))
+	writeJSON(w, r, http.StatusOK, &up.DiagnosticsUpload)
+}
+
+func (s *seeder) uploadChunkHandler(w http.ResponseWriter, r *http.Request) {
+	devid, err := uploadDeviceID(r)
+	if err != nil {
+		errorWithJSON(w, r, http.StatusForbidden, "diagnostics upload: %s", err)
+		return
+	}
+	id := chi.URLParam(r, "id")
+	if _, err := uuid.Parse(id); err != nil {
+		errorWithJSON(w, r, http.StatusBadRequest, "invalid upload ID '%s': %s", id, err)
+		return
+	}
+	offset, err := strconv.ParseInt(r.Header.Get(stage.HeaderUploadOffset), 10, 64)
+	if err != nil || offset < 0 {
+		errorWithJSON(w, r, http.StatusBadRequest, "invalid %s header '%s'", stage.HeaderUploadOffset, r.Header.Get(stage.HeaderUploadOffset))
+		return
+	}
+	up, err := s.uploads.appendChunk(r.Context(), devid, id, offset, r.Body)
+	if err != nil {
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			s.limits.requestsTooLarge.Add(1)
+		}
+		if uploadErrorStatus(err) == http.StatusInternalServerError {
+			l.Warn("Receiving diagnostics upload chunk failed", zap.String("request", middleware.GetReqID(r.Context())), zap.String("devid", devid), zap.String("id", id), zap.Error(err))
+		}
+		errorWithJSON(w, r, uploadErrorStatus(err), "%s", err)
+		return
+	}
+	if up.Complete {
+		l.Info("Diagnostics upload completed", zap.String("request", middleware.GetReqID(r.Context())), zap.String("devid", devid), zap.String("id", id), zap.String("name", up.Name), zap.Int64("size", up.Size))
+	}
+	w.Header().Set(stage.HeaderUploadOffset, strconv.FormatInt(up.Offset, 10))
+	writeJSON(w, r, http.StatusOK, &up.DiagnosticsUpload)
+}
+
+func (s *seeder) listUploadsHandler(w http.ResponseWriter, r *http.Request) {
+	if s.uploads == nil {
+		errorWithJSON(w, r, http.StatusNotFound, "diagnostics uploads are not enabled")
+		return
+	}
+	ret, err := s.uploads.list()
+	if err != nil {
+		errorWithJSON(w, r, http.StatusInternalServerError, "listing diagnostics uploads: %s", err)
+		return
+	}
+	writeJSON(w, r, http.StatusOK, ret)
+}
+
+// adminUploadParams returns the device ID and the upload ID of an admin request for a single upload
+func adminUploadParams(w http.ResponseWriter, r *http.Request) (string, string, bool) {
+	devid := chi.URLParam(r, "devid")
+	if _, err := uuid.Parse(devid); err != nil {
+		errorWithJSON(w, r, http.StatusBadRequest, "invalid device ID '%s': %s", devid, err)
+		return "", "", false
+	}
+	id := chi.URLParam(r, "id")
+	if _, err := uuid.Parse(id); err != nil {
+		errorWithJSON(w, r, http.StatusBadRequest, "invalid upload ID '%s': %s", id, err)
+		return "", "", false
+	}
+	return devid, id, true
+}
+
+func (s *seeder) getUploadFileHandler(w http.ResponseWriter, r *http.Request) {
+	if s.uploads == nil {
+		errorWithJSON(w, r, http.StatusNotFound, "diagnostics uploads are not enabled")
+		return
+	}
+	devid, id, ok := adminUploadParams(w, r)
+	if !ok {
+		return
+	}
+	up, err := s.uploads.load(devid, id)
+	if err != nil {
+		errorWithJSON(w, r, uploadErrorStatus(err), "%s", err)
+		return
+	}
+	if !up.Complete {
+		errorWithJSON(w, r, http.StatusConflict, "diagnostics upload '%s' is not complete: %d of %d bytes received", id, up.Offset, up.Size)
+		return
+	}
+	f, err := os.Open(s.uploads.path(devid, id, uploadDataSuffix))
+	if err != nil {
+		errorWithJSON(w, r, http.StatusInternalServerError, "opening diagnostics upload: %s", err)
+		return
+	}
+	defer f.Close()
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", up.Name))
+	http.ServeContent(w, r, "", up.Updated, f)
+}
+
+func (s *seeder) deleteUploadHandler(w http.ResponseWriter, r *http.Request) {
+	if s.uploads == nil {
+		errorWithJSON(w, r, http.StatusNotFound, "diagnostics uploads are not enabled")
+		return
+	}
+	devid, id, ok := adminUploadParams(w, r)
+	if !ok {
+		return
+	}
+	if err := s.uploads.delete(devid, id); err != nil {
+		errorWithJSON(w, r, uploadErrorStatus(err), "%s", err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,195 @@
+// Copyright 2023 Hedgehog
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package seeder
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strconv"
+	"testing"
+
+	"go.githedgehog.com/dasboot/pkg/seeder/config"
+	"go.githedgehog.com/dasboot/pkg/stage"
+)
+
+const testUploadDevID = "9d6f3a2e-5b1c-4e8a-a7f0-3c2d1e0b9a87"
+
+func testUploadRequest(name string, data []byte) *stage.DiagnosticsUploadRequest {
+	sum := sha256.Sum256(data)
+	return &stage.DiagnosticsUploadRequest{
+		Name:   name,
+		Size:   int64(len(data)),
+		Digest: "sha256:" + hex.EncodeToString(sum[:]),
+		Stage:  "stage2",
+	}
+}
+
+func TestUploadStore(t *testing.T) {
+	data := bytes.Repeat([]byte("core"), 1000)
+	us, err := newUploadStore(&config.DiagnosticsUploads{Dir: t.TempDir(), MaxChunkSize: 1024, MaxBytesPerDevice: 6000})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+
+	up, created, err := us.create(testUploadDevID, testUploadRequest("core.1234", data))
+	if err != nil || !created {
+		t.Fatalf("create() = %v, %v", created, err)
+	}
+	if _, err := us.appendChunk(ctx, testUploadDevID, up.ID, 0, bytes.NewReader(data[:1024])); err != nil {
+		t.Fatalf("first chunk: %v", err)
+	}
+	if _, err := us.appendChunk(ctx, testUploadDevID, up.ID, 0, bytes.NewReader(data[:1024])); !errors.Is(err, ErrUploadOffsetMismatch) {
+		t.Errorf("repeated chunk: err = %v, want %v", err, ErrUploadOffsetMismatch)
+	}
+
+	// the device starts over, and continues where it stopped
+	resumed, created, err := us.create(testUploadDevID, testUploadRequest("core.1234", data))
+	if err != nil || created {
+		t.Fatalf("resume: create() = %v, %v", created, err)
+	}
+	if resumed.ID != up.ID || resumed.Offset != 1024 {
+		t.Fatalf("resume: got upload %s at offset %d, want %s at offset 1024", resumed.ID, resumed.Offset, up.ID)
+	}
+	done, err := us.appendChunk(ctx, testUploadDevID, up.ID, 1024, bytes.NewReader(data[1024:]))
+	if err != nil {
+		t.Fatalf("last chunk: %v", err)
+	}
+	if !done.Complete || done.Offset != int64(len(data)) {
+		t.Errorf("upload is not complete: %+v", done)
+	}
+
+	// the quota covers the declared size of all uploads of the device
+	if _, _, err := us.create(testUploadDevID, testUploadRequest("core.5678", bytes.Repeat([]byte("x"), 3000))); !errors.Is(err, ErrUploadQuotaExceeded) {
+		t.Errorf("quota: err = %v, want %v", err, ErrUploadQuotaExceeded)
+	}
+
+	// a corrupted upload gets discarded
+	req := testUploadRequest("core.9999", []byte("good"))
+	bad, _, err := us.create(testUploadDevID, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := us.appendChunk(ctx, testUploadDevID, bad.ID, 0, bytes.NewReader([]byte("evil"))); !errors.Is(err, ErrUploadDigestMismatch) {
+		t.Errorf("digest: err = %v, want %v", err, ErrUploadDigestMismatch)
+	}
+	if _, err := us.load(testUploadDevID, bad.ID); !errors.Is(err, ErrUploadNotFound) {
+		t.Errorf("corrupted upload was not removed: %v", err)
+	}
+
+	for _, name := range []string{"", "..", "../core", "a/b"} {
+		if _, _, err := us.create(testUploadDevID, testUploadRequest(name, data)); !errors.Is(err, ErrUploadInvalid) {
+			t.Errorf("name '%s': err = %v, want %v", name, err, ErrUploadInvalid)
+		}
+	}
+
+	ups, err := us.list()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ups) != 1 || ups[0].ID != up.ID || ups[0].DevID != testUploadDevID {
+		t.Errorf("list() = %+v", ups)
+	}
+}
+
+func TestUploadHandlers(t *testing.T) {
+	data := bytes.Repeat([]byte("0123456789"), 500)
+	us, err := newUploadStore(&config.DiagnosticsUploads{Dir: t.TempDir(), MaxChunkSize: 2048})
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &seeder{
+		ecg:     &embeddedConfigGenerator{key: key},
+		limits:  newLimits(nil),
+		uploads: us,
+	}
+	h := s.secureHandler()
+	cert := &x509.Certificate{Subject: pkix.Name{CommonName: testUploadDevID}}
+	do := func(method, target string, body []byte, header http.Header) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, target, bytes.NewReader(body))
+		r.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{cert}, VerifiedChains: [][]*x509.Certificate{{cert}}}
+		for k, v := range header {
+			r.Header[k] = v
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, r)
+		return rec
+	}
+
+	b, _ := json.Marshal(testUploadRequest("core", data))
+	rec := do(http.MethodPost, diagnosticsUploadsPath, b, nil)
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("create: status = %d: %s", rec.Code, rec.Body.String())
+	}
+	var up stage.DiagnosticsUpload
+	if err := json.Unmarshal(rec.Body.Bytes(), &up); err != nil {
+		t.Fatal(err)
+	}
+	if up.ChunkSize != 2048 {
+		t.Errorf("chunk size = %d, want 2048", up.ChunkSize)
+	}
+
+	// chunks above the chunk size are rejected
+	rec = do(http.MethodPatch, path.Join(diagnosticsUploadsPath, up.ID), data[:4096], http.Header{stage.HeaderUploadOffset: {"0"}})
+	if rec.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("large chunk: status = %d, want %d", rec.Code, http.StatusRequestEntityTooLarge)
+	}
+
+	for off := 0; off < len(data); off += 2048 {
+		end := min(off+2048, len(data))
+		rec = do(http.MethodPatch, path.Join(diagnosticsUploadsPath, up.ID), data[off:end], http.Header{stage.HeaderUploadOffset: {strconv.Itoa(off)}})
+		if rec.Code != http.StatusOK {
+			t.Fatalf("chunk at %d: status = %d: %s", off, rec.Code, rec.Body.String())
+		}
+		if got := rec.Header().Get(stage.HeaderUploadOffset); got != strconv.Itoa(end) {
+			t.Errorf("chunk at %d: offset = %s, want %d", off, got, end)
+		}
+	}
+
+	rec = do(http.MethodGet, path.Join(diagnosticsUploadsPath, up.ID), nil, nil)
+	if err := json.Unmarshal(rec.Body.Bytes(), &up); err != nil || !up.Complete {
+		t.Fatalf("status: %s (%v)", rec.Body.String(), err)
+	}
+	stored, err := os.ReadFile(us.path(testUploadDevID, up.ID, uploadDataSuffix))
+	if err != nil || !bytes.Equal(stored, data) {
+		t.Errorf("stored data does not match the uploaded file (%v)", err)
+	}
+
+	r := httptest.NewRequest(http.MethodGet, path.Join(adminUploadsPath, testUploadDevID, up.ID), nil)
+	r.RemoteAddr = "127.0.0.1:12345"
+	rec = httptest.NewRecorder()
+	s.adminHandler().ServeHTTP(rec, r)
+	if rec.Code != http.StatusOK || !bytes.Equal(rec.Body.Bytes(), data) {
+		t.Errorf("admin download: status = %d, %d bytes", rec.Code, rec.Body.Len())
+	}
+}
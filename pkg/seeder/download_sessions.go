@@ -0,0 +1,195 @@
+// Copyright 2023 Hedgehog
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package seeder
+
+import (
+	"context"
+	"io"
+	"io/fs"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-chi/chi/v5/middleware"
+	"go.uber.org/zap"
+
+	"go.githedgehog.com/dasboot/pkg/seeder/controlplane"
+)
+
+const (
+	adminDownloadsPath = "/downloads"
+
+	// DefaultDrainTimeout is the time that the seeder waits for in-flight downloads on shutdown
+	DefaultDrainTimeout = 5 * time.Minute
+
+	// drainRetryAfter is the value of the Retry-After header in seconds for downloads which
+	// were rejected because the seeder is shutting down
+	drainRetryAfter = "60"
+)
+
+// DownloadSession is an in-flight download of a large artifact as it is listed on the admin server
+type DownloadSession struct {
+	RequestID  string    `json:"request_id"`
+	DevID      string    `json:"devid,omitempty"`
+	RemoteAddr string    `json:"remote_addr,omitempty"`
+	Artifact   string    `json:"artifact"`
+	Started    time.Time `json:"started"`
+	Size       int64     `json:"size"`
+	Written    int64     `json:"written"`
+}
+
+type downloadSession struct {
+	DownloadSession
+	written atomic.Int64
+}
+
+// Write counts the bytes which were written to the client. It can be used with an io.MultiWriter.
+func (ds *downloadSession) Write(p []byte) (int, error) {
+	ds.written.Add(int64(len(p)))
+	return len(p), nil
+}
+
+func (ds *downloadSession) snapshot() DownloadSession {
+	ret := ds.DownloadSession
+	ret.Written = ds.written.Load()
+	return ret
+}
+
+// downloadSessions tracks all in-flight downloads of large artifacts, so that the seeder can wait for them
+// to finish on shutdown instead of cutting off devices in the middle of an installation
+type downloadSessions struct {
+	mu       sync.Mutex
+	sessions map[*downloadSession]struct{}
+	draining bool
+	idle     chan struct{}
+}
+
+func newDownloadSessions() *downloadSessions {
+	return &downloadSessions{sessions: make(map[*downloadSession]struct{})}
+}
+
+// start registers a new download session for `artifact`. It returns false if the seeder is draining
+// and does not accept new downloads anymore.
+func (d *downloadSessions) start(r *http.Request, artifact string, size int64) (*downloadSession, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.draining {
+		return nil, false
+	}
+	sess := &downloadSession{DownloadSession: DownloadSession{
+		RequestID:  middleware.GetReqID(r.Context()),
+		RemoteAddr: r.RemoteAddr,
+		Artifact:   artifact,
+		Started:    time.Now(),
+		Size:       size,
+	}}
+	if r.TLS != nil && len(r.TLS.PeerCertificates) > 0 {
+		sess.DevID = r.TLS.PeerCertificates[0].Subject.CommonName
+	}
+	d.sessions[sess] = struct{}{}
+	return sess, true
+}
+
+func (d *downloadSessions) finish(sess *downloadSession) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	delete(d.sessions, sess)
+	if len(d.sessions) == 0 && d.idle != nil {
+		close(d.idle)
+		d.idle = nil
+	}
+}
+
+// list returns all in-flight downloads ordered by their start time
+func (d *downloadSessions) list() []DownloadSession {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	ret := make([]DownloadSession, 0, len(d.sessions))
+	for sess := range d.sessions {
+		ret = append(ret, sess.snapshot())
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i].Started.Before(ret[j].Started) })
+	return ret
+}
+
+// drain stops accepting new downloads and waits until all in-flight downloads have finished or `ctx` is done.
+// It returns the downloads which are still in flight and are going to be cut off.
+func (d *downloadSessions) drain(ctx context.Context) []DownloadSession {
+	d.mu.Lock()
+	d.draining = true
+	if len(d.sessions) == 0 {
+		d.mu.Unlock()
+		return nil
+	}
+	if d.idle == nil {
+		d.idle = make(chan struct{})
+	}
+	idle := d.idle
+	d.mu.Unlock()
+
+	select {
+	case <-idle:
+		return nil
+	case <-ctx.Done():
+		return d.list()
+	}
+}
+
+// drainDownloads waits for in-flight downloads before the servers get shut down, and reports all devices
+// which are going to be cut off
+func (s *seeder) drainDownloads(ctx context.Context) {
+	if inFlight := s.downloads.list(); len(inFlight) > 0 {
+		l.Info("Waiting for in-flight downloads to finish", zap.Int("downloads", len(inFlight)), zap.Duration("timeout", s.drainTimeout))
+	}
+	ctx, cancel := context.WithTimeout(ctx, s.drainTimeout)
+	defer cancel()
+	cutOff := s.downloads.drain(ctx)
+	for _, sess := range cutOff {
+		l.Warn("Download is being cut off by seeder shutdown",
+			zap.String("request", sess.RequestID),
+			zap.String("devid", sess.DevID),
+			zap.String("remoteAddr", sess.RemoteAddr),
+			zap.String("artifact", sess.Artifact),
+			zap.Int64("written", sess.Written),
+			zap.Int64("size", sess.Size),
+			zap.Duration("duration", time.Since(sess.Started)),
+		)
+		if sess.DevID != "" {
+			// we are shutting down, so this must not depend on the context that just expired
+			evCtx, evCancel := context.WithTimeout(context.Background(), deviceEventTimeout)
+			s.recordDeviceEvent(evCtx, sess.DevID, controlplane.DeviceEventFailed, "download of '"+sess.Artifact+"' was cut off by seeder shutdown")
+			evCancel()
+		}
+	}
+}
+
+// artifactSize returns the size of the artifact if it is known, and -1 otherwise
+func artifactSize(f io.Reader) int64 {
+	st, ok := f.(interface{ Stat() (fs.FileInfo, error) })
+	if !ok {
+		return -1
+	}
+	fi, err := st.Stat()
+	if err != nil {
+		return -1
+	}
+	return fi.Size()
+}
+
+func (s *seeder) listDownloadsHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, r, http.StatusOK, s.downloads.list())
+}
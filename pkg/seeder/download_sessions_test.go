@@ -0,0 +1,72 @@
+// Copyright 2023 Hedgehog
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package seeder
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestDownloadSessions_drain(t *testing.T) {
+	tests := []struct {
+		name       string
+		finishIn   time.Duration
+		timeout    time.Duration
+		wantCutOff int
+	}{
+		{
+			name:       "download finishes before the deadline",
+			finishIn:   10 * time.Millisecond,
+			timeout:    5 * time.Second,
+			wantCutOff: 0,
+		},
+		{
+			name:       "download is cut off at the deadline",
+			finishIn:   5 * time.Second,
+			timeout:    10 * time.Millisecond,
+			wantCutOff: 1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := newDownloadSessions()
+			sess, ok := d.start(httptest.NewRequest(http.MethodGet, "/stage2/x86_64", nil), "stage2-x86_64", 1024)
+			if !ok {
+				t.Fatal("start must succeed when not draining")
+			}
+			if _, err := sess.Write(make([]byte, 512)); err != nil {
+				t.Fatal(err)
+			}
+			timer := time.AfterFunc(tt.finishIn, func() { d.finish(sess) })
+			defer timer.Stop()
+
+			ctx, cancel := context.WithTimeout(context.Background(), tt.timeout)
+			defer cancel()
+			cutOff := d.drain(ctx)
+			if len(cutOff) != tt.wantCutOff {
+				t.Fatalf("drain() cut off %d downloads, want %d", len(cutOff), tt.wantCutOff)
+			}
+			if tt.wantCutOff > 0 && (cutOff[0].Artifact != "stage2-x86_64" || cutOff[0].Written != 512 || cutOff[0].Size != 1024) {
+				t.Errorf("drain() cut off %#v", cutOff[0])
+			}
+			if _, ok := d.start(httptest.NewRequest(http.MethodGet, "/stage2/x86_64", nil), "stage2-x86_64", 1024); ok {
+				t.Errorf("start must fail while draining")
+			}
+		})
+	}
+}
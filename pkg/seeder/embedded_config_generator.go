@@ -73,6 +73,16 @@ func (ecg *embeddedConfigGenerator) HedgehogAgentProvisioner(artifact []byte, cf
 }
 
 func (s *seeder) intializeEmbeddedConfigGenerator(c *seederconfig.EmbeddedConfigGeneratorConfig) error {
+	// lab mode signs with its ephemeral CA if there is no key configured
+	if (c == nil || c.KeyPath == "") && s.labCA != nil {
+		s.ecg = &embeddedConfigGenerator{
+			key:     s.labCA.key,
+			cert:    s.labCA.cert,
+			certDER: s.labCA.certDER,
+		}
+		return nil
+	}
+
 	// read key - expecting PEM format
 	key, err := readKeyFromPath(c.KeyPath)
 	if err != nil {
@@ -24,6 +24,7 @@ var (
 	ErrEmbeddedConfigGenerator = errors.New("seeder: embedded config generator")
 	ErrInstallerSettings       = errors.New("seeder: installer settings")
 	ErrRegistrySettings        = errors.New("seeder: registry settings")
+	ErrReloadRequiresRestart   = errors.New("seeder: configuration change requires a restart")
 )
 
 func InvalidConfigError(str string) error {
@@ -38,6 +39,10 @@ func InstallerSettingsError(err error) error {
 	return fmt.Errorf("%w: %w", ErrInstallerSettings, err)
 }
 
+func ReloadRequiresRestartError(str string) error {
+	return fmt.Errorf("%w: %s", ErrReloadRequiresRestart, str)
+}
+
 func RegistrySettingsError(err error) error {
 	return fmt.Errorf("%w: %w", ErrRegistrySettings, err)
 }
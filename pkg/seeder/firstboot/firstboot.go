@@ -0,0 +1,240 @@
+// Copyright 2023 Hedgehog
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package firstboot implements the first-boot payload of the Hedgehog agent. The seeder generates it for
+// every device, and seals it to the public key which the device registered with. This way the bootstrap
+// credentials which are installed into the NOS image can only be read with the key of the device.
+package firstboot
+
+import (
+	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	config0 "go.githedgehog.com/dasboot/pkg/stage0/config"
+)
+
+const (
+	// EnvelopeVersion is the current version of the envelope format
+	EnvelopeVersion = 1
+
+	// AlgorithmECDHP256 is ECIES with an ephemeral P-256 key, HKDF-SHA256 and AES-256-GCM
+	AlgorithmECDHP256 = "ECDH-P256+HKDF-SHA256+A256GCM"
+
+	hkdfInfo = "dasboot first-boot payload"
+)
+
+var (
+	ErrUnsupportedKey      = errors.New("firstboot: unsupported key")
+	ErrUnsupportedEnvelope = errors.New("firstboot: unsupported envelope")
+	ErrWrongRecipient      = errors.New("firstboot: envelope is sealed for a different key")
+	ErrDecryption          = errors.New("firstboot: decryption failed")
+)
+
+// randReader can be swapped out for testing
+var randReader = rand.Reader
+
+// Payload is everything the Hedgehog agent needs at first boot to join the control plane
+type Payload struct {
+	// DevID is the device ID of the device for which this payload was generated
+	DevID string `json:"devid"`
+
+	// Kubeconfig is the kubeconfig (including its token) with which the agent connects to the control plane
+	Kubeconfig string `json:"kubeconfig,omitempty"`
+
+	// Endpoints are the control plane endpoints
+	Endpoints Endpoints `json:"endpoints"`
+
+	// Proxy holds the HTTP proxy settings which the agent must use
+	Proxy *config0.Proxy `json:"proxy,omitempty"`
+
+	// IssuedAt is the time when the seeder generated the payload
+	IssuedAt time.Time `json:"issued_at"`
+}
+
+// Endpoints are the control plane endpoints which the agent needs to know about
+type Endpoints struct {
+	ControlVIP       string   `json:"control_vip,omitempty"`
+	ControlVIPv6     string   `json:"control_vip_v6,omitempty"`
+	SecureServerName string   `json:"secure_server_name,omitempty"`
+	NTPServers       []string `json:"ntp_servers,omitempty"`
+	SyslogServers    []string `json:"syslog_servers,omitempty"`
+	DNSServers       []string `json:"dns_servers,omitempty"`
+	DNSSearch        []string `json:"dns_search,omitempty"`
+}
+
+// Envelope is a sealed payload
+type Envelope struct {
+	Version   int    `json:"version"`
+	Algorithm string `json:"alg"`
+
+	// Recipient is the hex encoded SHA256 digest of the PKIX encoded public key which the payload is sealed to
+	Recipient string `json:"recipient"`
+
+	// EphemeralPublicKey is the uncompressed ephemeral public key of the sender
+	EphemeralPublicKey []byte `json:"epk"`
+	Nonce              []byte `json:"nonce"`
+	Ciphertext         []byte `json:"ciphertext"`
+}
+
+func ecdhPublicKey(pub crypto.PublicKey) (*ecdh.PublicKey, error) {
+	switch k := pub.(type) {
+	case *ecdsa.PublicKey:
+		ret, err := k.ECDH()
+		if err != nil {
+			return nil, fmt.Errorf("%w: %w", ErrUnsupportedKey, err)
+		}
+		if ret.Curve() != ecdh.P256() {
+			return nil, fmt.Errorf("%w: only P-256 keys are supported", ErrUnsupportedKey)
+		}
+		return ret, nil
+	default:
+		return nil, fmt.Errorf("%w: %T", ErrUnsupportedKey, pub)
+	}
+}
+
+// Recipient returns the recipient identifier of a public key as it is used in the envelope
+func Recipient(pub crypto.PublicKey) (string, error) {
+	der, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		return "", fmt.Errorf("%w: %w", ErrUnsupportedKey, err)
+	}
+	sum := sha256.Sum256(der)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// hkdf derives a 32 byte key according to RFC 5869 with SHA256
+func hkdf(secret, salt []byte, info string) []byte {
+	extract := hmac.New(sha256.New, salt)
+	extract.Write(secret)
+	prk := extract.Sum(nil)
+	expand := hmac.New(sha256.New, prk)
+	expand.Write([]byte(info))
+	expand.Write([]byte{1})
+	return expand.Sum(nil)
+}
+
+// additionalData binds the envelope metadata to the ciphertext
+func (e *Envelope) additionalData() []byte {
+	ret := []byte(strconv.Itoa(e.Version) + "|" + e.Algorithm + "|" + e.Recipient + "|")
+	return append(ret, e.EphemeralPublicKey...)
+}
+
+func newGCM(shared, epk []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(hkdf(shared, epk, hkdfInfo))
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// Seal encrypts the payload to the public key `pub`
+func Seal(pub crypto.PublicKey, p *Payload) (*Envelope, error) {
+	recipientKey, err := ecdhPublicKey(pub)
+	if err != nil {
+		return nil, err
+	}
+	recipient, err := Recipient(pub)
+	if err != nil {
+		return nil, err
+	}
+	plaintext, err := json.Marshal(p)
+	if err != nil {
+		return nil, fmt.Errorf("firstboot: encoding payload: %w", err)
+	}
+
+	ephemeral, err := ecdh.P256().GenerateKey(randReader)
+	if err != nil {
+		return nil, fmt.Errorf("firstboot: generating ephemeral key: %w", err)
+	}
+	shared, err := ephemeral.ECDH(recipientKey)
+	if err != nil {
+		return nil, fmt.Errorf("firstboot: key agreement: %w", err)
+	}
+	ret := &Envelope{
+		Version:            EnvelopeVersion,
+		Algorithm:          AlgorithmECDHP256,
+		Recipient:          recipient,
+		EphemeralPublicKey: ephemeral.PublicKey().Bytes(),
+	}
+	gcm, err := newGCM(shared, ret.EphemeralPublicKey)
+	if err != nil {
+		return nil, fmt.Errorf("firstboot: %w", err)
+	}
+	ret.Nonce = make([]byte, gcm.NonceSize())
+	if _, err := randReader.Read(ret.Nonce); err != nil {
+		return nil, fmt.Errorf("firstboot: generating nonce: %w", err)
+	}
+	ret.Ciphertext = gcm.Seal(nil, ret.Nonce, plaintext, ret.additionalData())
+	return ret, nil
+}
+
+// Open decrypts the envelope with the private key `priv`. The private key must be available in
+// software, keys which are backed by a TPM are not supported yet.
+func Open(priv crypto.PrivateKey, e *Envelope) (*Payload, error) {
+	if e.Version != EnvelopeVersion || e.Algorithm != AlgorithmECDHP256 {
+		return nil, fmt.Errorf("%w: version %d, algorithm '%s'", ErrUnsupportedEnvelope, e.Version, e.Algorithm)
+	}
+	k, ok := priv.(*ecdsa.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("%w: %T", ErrUnsupportedKey, priv)
+	}
+	recipient, err := Recipient(k.Public())
+	if err != nil {
+		return nil, err
+	}
+	if recipient != e.Recipient {
+		return nil, ErrWrongRecipient
+	}
+	ownKey, err := k.ECDH()
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrUnsupportedKey, err)
+	}
+	epk, err := ecdh.P256().NewPublicKey(e.EphemeralPublicKey)
+	if err != nil {
+		return nil, fmt.Errorf("%w: ephemeral public key: %w", ErrDecryption, err)
+	}
+	shared, err := ownKey.ECDH(epk)
+	if err != nil {
+		return nil, fmt.Errorf("%w: key agreement: %w", ErrDecryption, err)
+	}
+	gcm, err := newGCM(shared, e.EphemeralPublicKey)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrDecryption, err)
+	}
+	if len(e.Nonce) != gcm.NonceSize() {
+		return nil, fmt.Errorf("%w: invalid nonce size", ErrDecryption)
+	}
+	plaintext, err := gcm.Open(nil, e.Nonce, e.Ciphertext, e.additionalData())
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrDecryption, err)
+	}
+	var ret Payload
+	if err := json.Unmarshal(plaintext, &ret); err != nil {
+		return nil, fmt.Errorf("%w: decoding payload: %w", ErrDecryption, err)
+	}
+	return &ret, nil
+}
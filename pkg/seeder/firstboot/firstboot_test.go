@@ -0,0 +1,94 @@
+// Copyright 2023 Hedgehog
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package firstboot
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	config0 "go.githedgehog.com/dasboot/pkg/stage0/config"
+)
+
+func TestSealOpen(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload := &Payload{
+		DevID:      "a1b2c3d4-0000-4000-8000-000000000001",
+		Kubeconfig: "apiVersion: v1\nkind: Config\n",
+		Endpoints: Endpoints{
+			ControlVIP:    "192.168.42.1",
+			NTPServers:    []string{"192.168.42.1"},
+			SyslogServers: []string{"192.168.42.1"},
+		},
+		Proxy:    &config0.Proxy{HTTPSProxy: "http://proxy.example.com:3128"},
+		IssuedAt: time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC),
+	}
+
+	envelope, err := Seal(&key.PublicKey, payload)
+	if err != nil {
+		t.Fatalf("Seal() error = %v", err)
+	}
+
+	t.Run("success", func(t *testing.T) {
+		got, err := Open(key, envelope)
+		if err != nil {
+			t.Fatalf("Open() error = %v", err)
+		}
+		if !reflect.DeepEqual(got, payload) {
+			t.Errorf("Open() = %v, want %v", got, payload)
+		}
+	})
+	t.Run("wrong key", func(t *testing.T) {
+		if _, err := Open(otherKey, envelope); !errors.Is(err, ErrWrongRecipient) {
+			t.Errorf("Open() error = %v, want %v", err, ErrWrongRecipient)
+		}
+	})
+	t.Run("tampered ciphertext", func(t *testing.T) {
+		e := *envelope
+		e.Ciphertext = append([]byte{}, envelope.Ciphertext...)
+		e.Ciphertext[0] ^= 0xff
+		if _, err := Open(key, &e); !errors.Is(err, ErrDecryption) {
+			t.Errorf("Open() error = %v, want %v", err, ErrDecryption)
+		}
+	})
+	t.Run("unsupported version", func(t *testing.T) {
+		e := *envelope
+		e.Version = 2
+		if _, err := Open(key, &e); !errors.Is(err, ErrUnsupportedEnvelope) {
+			t.Errorf("Open() error = %v, want %v", err, ErrUnsupportedEnvelope)
+		}
+	})
+	t.Run("unsupported key", func(t *testing.T) {
+		pub, _, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := Seal(pub, payload); !errors.Is(err, ErrUnsupportedKey) {
+			t.Errorf("Seal() error = %v, want %v", err, ErrUnsupportedKey)
+		}
+	})
+}
@@ -0,0 +1,109 @@
+// Copyright 2023 Hedgehog
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package seeder
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"path"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
+	"github.com/google/uuid"
+	"go.githedgehog.com/dasboot/pkg/partitions/identity"
+	"go.githedgehog.com/dasboot/pkg/seeder/controlplane"
+	"go.uber.org/zap"
+)
+
+const identityBackupPath = "/identity-backup"
+
+// uploadIdentityBackupHandler stores the identity backup of a registered device in the control plane. The backup
+// must be signed with the key of the client certificate with which the device makes the request.
+func (s *seeder) uploadIdentityBackupHandler(w http.ResponseWriter, r *http.Request) {
+	devid, err := uploadDeviceID(r)
+	if err != nil {
+		errorWithJSON(w, r, http.StatusForbidden, "identity backup: %s", err)
+		return
+	}
+	var b identity.Backup
+	if !s.limits.decodeJSONRequest(w, r, &b) {
+		return
+	}
+	if _, err := b.Verify(); err != nil {
+		errorWithJSON(w, r, http.StatusBadRequest, "identity backup: %s", err)
+		return
+	}
+	if b.DeviceID != devid || !bytes.Equal(b.Cert, r.TLS.PeerCertificates[0].Raw) {
+		errorWithJSON(w, r, http.StatusForbidden, "identity backup: backup is not for the client certificate of the request")
+		return
+	}
+	data, err := json.Marshal(&b)
+	if err != nil {
+		errorWithJSON(w, r, http.StatusInternalServerError, "identity backup: %s", err)
+		return
+	}
+	if err := s.cpc.StoreIdentityBackup(r.Context(), devid, data); err != nil {
+		errorWithJSON(w, r, http.StatusInternalServerError, "storing identity backup: %s", err)
+		return
+	}
+	l.Info("Identity backup stored", zap.String("request", middleware.GetReqID(r.Context())), zap.String("devid", devid))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// getIdentityBackupHandler returns the identity backup of a device. The device has no client certificate when
+// it needs its backup, however, the backup is encrypted with keys which only the device itself can derive.
+func (s *seeder) getIdentityBackupHandler(w http.ResponseWriter, r *http.Request) {
+	if err := checkAccessLevel(r, accessTLS); err != nil && !s.labMode {
+		errorWithJSON(w, r, http.StatusForbidden, "identity backup: %s", err)
+		return
+	}
+	devid := chi.URLParam(r, "devid")
+	if _, err := uuid.Parse(devid); err != nil {
+		errorWithJSON(w, r, http.StatusBadRequest, "identity backup: invalid device ID: %s", err)
+		return
+	}
+	data, err := s.cpc.GetIdentityBackup(r.Context(), devid)
+	if err != nil {
+		if errors.Is(err, controlplane.ErrNotFound) {
+			errorWithJSON(w, r, http.StatusNotFound, "no identity backup for device: %s", err)
+			return
+		}
+		errorWithJSON(w, r, http.StatusInternalServerError, "fetching identity backup: %s", err)
+		return
+	}
+	var b identity.Backup
+	if err := json.Unmarshal(data, &b); err != nil {
+		errorWithJSON(w, r, http.StatusInternalServerError, "decoding identity backup: %s", err)
+		return
+	}
+	l.Info("Identity backup requested", zap.String("request", middleware.GetReqID(r.Context())), zap.String("devid", devid))
+	writeJSON(w, r, http.StatusOK, &b)
+}
+
+// identityBackupURL returns the URL at which devices back up and restore their identity. Devices upload their
+// backups with their client certificate, which is not being presented over plain HTTP.
+func (lis *loadedInstallerSettings) identityBackupURL() string {
+	if !lis.identityBackups || lis.plainHTTP {
+		return ""
+	}
+	return (&url.URL{
+		Scheme: lis.secureScheme(),
+		Host:   lis.secureServerName,
+		Path:   path.Join("/", identityBackupPath),
+	}).String()
+}
@@ -0,0 +1,138 @@
+// Copyright 2023 Hedgehog
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package seeder
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/golang/mock/gomock"
+	"go.githedgehog.com/dasboot/pkg/partitions/identity"
+	"go.githedgehog.com/dasboot/pkg/seeder/controlplane"
+	"go.githedgehog.com/dasboot/test/mock/seeder/mockcontrolplane"
+)
+
+func TestGetIdentityBackup(t *testing.T) {
+	const devid = "0a1b2c3d-4e5f-6789-abcd-ef0123456789"
+	backup := &identity.Backup{Version: identity.BackupVersion, DeviceID: devid, Payload: []byte("sealed")}
+	backupJSON, err := json.Marshal(backup)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name     string
+		devid    string
+		tls      bool
+		pre      func(c *mockcontrolplane.MockClient)
+		wantCode int
+		want     *identity.Backup
+	}{
+		{
+			name:     "no TLS",
+			devid:    devid,
+			pre:      func(c *mockcontrolplane.MockClient) {},
+			wantCode: http.StatusForbidden,
+		},
+		{
+			name:     "invalid device ID",
+			devid:    "not-a-uuid",
+			tls:      true,
+			pre:      func(c *mockcontrolplane.MockClient) {},
+			wantCode: http.StatusBadRequest,
+		},
+		{
+			name:  "no backup",
+			devid: devid,
+			tls:   true,
+			pre: func(c *mockcontrolplane.MockClient) {
+				c.EXPECT().GetIdentityBackup(gomock.Any(), devid).Return(nil, controlplane.ErrNotFound)
+			},
+			wantCode: http.StatusNotFound,
+		},
+		{
+			name:  "control plane failure",
+			devid: devid,
+			tls:   true,
+			pre: func(c *mockcontrolplane.MockClient) {
+				c.EXPECT().GetIdentityBackup(gomock.Any(), devid).Return(nil, errors.New("boom"))
+			},
+			wantCode: http.StatusInternalServerError,
+		},
+		{
+			name:  "backup",
+			devid: devid,
+			tls:   true,
+			pre: func(c *mockcontrolplane.MockClient) {
+				c.EXPECT().GetIdentityBackup(gomock.Any(), devid).Return(backupJSON, nil)
+			},
+			wantCode: http.StatusOK,
+			want:     backup,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			defer ctrl.Finish()
+			c := mockcontrolplane.NewMockClient(ctrl)
+			tt.pre(c)
+			s := &seeder{cpc: c}
+			r := chi.NewRouter()
+			r.Get(path.Join(identityBackupPath, "{devid}"), s.getIdentityBackupHandler)
+
+			req := httptest.NewRequest(http.MethodGet, path.Join(identityBackupPath, tt.devid), nil)
+			if tt.tls {
+				req.TLS = &tls.ConnectionState{}
+			} else {
+				req.TLS = nil
+			}
+			rec := httptest.NewRecorder()
+			r.ServeHTTP(rec, req)
+			if rec.Code != tt.wantCode {
+				t.Fatalf("status = %d, want %d: %s", rec.Code, tt.wantCode, rec.Body.String())
+			}
+			if tt.want == nil {
+				return
+			}
+			var got identity.Backup
+			if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+				t.Fatalf("decoding response: %v", err)
+			}
+			if !reflect.DeepEqual(&got, tt.want) {
+				t.Errorf("backup = %#v, want %#v", &got, tt.want)
+			}
+		})
+	}
+}
+
+func TestUploadIdentityBackupRequiresRegisteredDevice(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	s := &seeder{cpc: mockcontrolplane.NewMockClient(ctrl), limits: newLimits(nil)}
+	req := httptest.NewRequest(http.MethodPost, identityBackupPath, strings.NewReader("{}"))
+	req.TLS = &tls.ConnectionState{}
+	rec := httptest.NewRecorder()
+	s.uploadIdentityBackupHandler(rec, req)
+	if rec.Code != http.StatusForbidden {
+		t.Fatalf("status = %d, want %d: %s", rec.Code, http.StatusForbidden, rec.Body.String())
+	}
+}
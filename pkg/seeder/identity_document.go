@@ -0,0 +1,58 @@
+// Copyright 2023 Hedgehog
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package seeder
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/go-chi/chi/v5"
+
+	"go.githedgehog.com/dasboot/pkg/partitions/identity"
+	"go.githedgehog.com/dasboot/pkg/seeder/controlplane"
+)
+
+const adminIdentityPath = "/identity"
+
+// getExpectedIdentityDocumentHandler serves the public identity document which the seeder expects from a device
+// based on its device registration. It is unsigned, and it is meant to be compared with the signed document of the
+// device with `identity.PublicDocument.Matches`.
+func (s *seeder) getExpectedIdentityDocumentHandler(w http.ResponseWriter, r *http.Request) {
+	devidParam := chi.URLParam(r, "devid")
+	reg, err := s.cpc.GetDeviceRegistration(r.Context(), devidParam)
+	if err != nil {
+		if errors.Is(err, controlplane.ErrNotFound) {
+			errorWithJSON(w, r, http.StatusNotFound, "no device registration found for device '%s'", devidParam)
+			return
+		}
+		errorWithJSON(w, r, http.StatusInternalServerError, "fetching device registration: %s", err)
+		return
+	}
+	if len(reg.Status.Certificate) == 0 {
+		errorWithJSON(w, r, http.StatusNotFound, "no certificate has been issued for device '%s' yet", devidParam)
+		return
+	}
+
+	doc, err := identity.NewPublicDocument([][]byte{reg.Status.Certificate}, reg.Spec.LocationUUID)
+	if err != nil {
+		errorWithJSON(w, r, http.StatusInternalServerError, "building identity document: %s", err)
+		return
+	}
+	if doc.DeviceID != devidParam {
+		errorWithJSON(w, r, http.StatusConflict, "certificate of device '%s' was issued for '%s'", devidParam, doc.DeviceID)
+		return
+	}
+	writeJSON(w, r, http.StatusOK, doc)
+}
@@ -17,10 +17,12 @@ package seeder
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net"
 	"net/http"
 	"net/url"
+	"path"
 	"strconv"
 	"strings"
 	"time"
@@ -36,29 +38,48 @@ import (
 )
 
 const (
-	ipamPath = "/stage0/ipam"
+	ipamPath     = "/stage0/ipam"
+	recoveryPath = "/stage0/recovery"
 )
 
 func (s *seeder) insecureHandler() *chi.Mux {
 	r := chi.NewRouter()
 	r.Use(middleware.RequestID)
+	r.Use(s.metrics.instrument("insecure"))
 	r.Use(RequestLogger(log.L()))
 	r.Use(middleware.Recoverer)
 	r.Use(middleware.RealIP)
 	r.Use(AddResponseRequestID())
-	r.Use(middleware.Heartbeat("/healthz"))
+	r.Use(SignResponses(s.ecg.key, s.ecg.certDER))
+	r.Get(healthzPath, s.healthzHandler)
+	r.Get(readyzPath, s.readyzHandler)
+	r.Get(openAPIPath, s.getOpenAPIDocument(APIInsecure))
 	// For the installer, we do not need to be too device specific
-	r.Get("/onie-installer-{arch}", s.getStage0Artifact)
-	r.Get("/onie-installer", s.getStage0Artifact)
+	if s.onieDiscovery {
+		// the ONIE discovery responder serves all ONIE default installer file names
+		r.Get("/onie-installer-{name}", s.getONIEDiscoveryArtifact)
+		r.Get("/onie-installer", s.getONIEDiscoveryArtifact)
+		r.Get("/onie-installer.bin", s.getONIEDiscoveryArtifact)
+	} else {
+		r.Get("/onie-installer-{arch}", s.getStage0Artifact)
+		r.Get("/onie-installer", s.getStage0Artifact)
+	}
 	// For ONIE updates, we're going to be very specific:
 	// onie-updater-<arch>-<vendor>_<machine>-r<machine_revision>
 	r.Get("/onie-updater-{arch}-{vendor}_{machine}-r{machine_revision}", s.getOnieUpdaterArtifact)
 	r.Get("/onie-updater", s.getOnieUpdaterArtifact)
 	r.Get("/stage0/{arch}", s.getStage0Artifact)
+	r.Get(path.Join(platformSupportPathBase, "{platform}"), s.getPlatformSupportArtifact(s.artifactAuthz(artifactClassPlatformSupport)))
 	r.Route(ipamPath, func(r chi.Router) {
 		r.Use(middleware.AllowContentType("application/json"))
+		r.Use(s.limits.maxRequestBody(s.limits.maxIPAMRequestSize))
 		r.Post("/", s.processIPAMRequest)
 	})
+	r.Route(recoveryPath, func(r chi.Router) {
+		r.Use(middleware.AllowContentType("application/json"))
+		r.Use(s.limits.maxRequestBody(s.limits.maxIPAMRequestSize))
+		r.Post("/", s.processRecoveryReport)
+	})
 	return r
 }
 
@@ -102,7 +123,7 @@ func (s *seeder) getStage0Artifact(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// execute the "standard" getStageArtifact handler now
-	s.getStageArtifact("stage0", s.stage0Authz, s.embedStage0Config)(w, r)
+	s.getStageArtifact("stage0", s.artifactAuthz(artifactClassStage0), s.embedStage0Config)(w, r)
 }
 
 var stage0Fallback = []byte(`#!/bin/sh
@@ -113,12 +134,6 @@ echo "FATAL: If you have not seen any previous installers failing, then this mea
 exit 1
 `)
 
-func (s *seeder) stage0Authz(*http.Request) error {
-	// stage 0 is literally the *only* artifact which does *not* require any other
-	// additional authorization
-	return nil
-}
-
 func (s *seeder) embedStage0Config(r *http.Request, arch string, artifactBytes []byte) ([]byte, error) {
 	// build IPAM URL
 	// we are going to send back the same host
@@ -135,6 +150,11 @@ func (s *seeder) embedStage0Config(r *http.Request, arch string, artifactBytes [
 		Host:   r.Host,
 		Path:   ipamPath,
 	}
+	recoveryURL := url.URL{
+		Scheme: scheme,
+		Host:   r.Host,
+		Path:   recoveryPath,
+	}
 	parseUint := func(s string) uint {
 		n, err := strconv.ParseUint(s, 0, 0)
 		if err != nil {
@@ -158,17 +178,10 @@ func (s *seeder) embedStage0Config(r *http.Request, arch string, artifactBytes [
 		if err != nil {
 			log.L().Error("failed to discover neighbouring switch", zap.String("addr", host), zap.Error(err))
 		} else {
-			md, err := json.Marshal(&sw.Spec.Location)
+			loc, err = switchLocation(sw)
 			if err != nil {
 				log.L().Error("failed to marshal location information of neighbouring switch", zap.Error(err))
 			} else {
-				locationUUID, _ := sw.Spec.Location.GenerateUUID()
-				loc = &location.Info{
-					UUID:        locationUUID,
-					UUIDSig:     []byte(sw.Spec.LocationSig.UUIDSig),
-					Metadata:    string(md),
-					MetadataSig: []byte(sw.Spec.LocationSig.Sig),
-				}
 				log.L().Info("Serving location information for request", zap.Reflect("loc", loc))
 			}
 		}
@@ -188,17 +201,10 @@ func (s *seeder) embedStage0Config(r *http.Request, arch string, artifactBytes [
 				if err != nil {
 					log.L().Error("failed to discover switch", zap.String("addr", remoteHost), zap.Error(err))
 				} else {
-					md, err := json.Marshal(&sw.Spec.Location)
+					loc, err = switchLocation(sw)
 					if err != nil {
 						log.L().Error("failed to marshal location information of neighbouring switch", zap.Error(err))
 					} else {
-						locationUUID, _ := sw.Spec.Location.GenerateUUID()
-						loc = &location.Info{
-							UUID:        locationUUID,
-							UUIDSig:     []byte(sw.Spec.LocationSig.UUIDSig),
-							Metadata:    string(md),
-							MetadataSig: []byte(sw.Spec.LocationSig.Sig),
-						}
 						log.L().Info("Serving location information for request", zap.Reflect("loc", loc))
 					}
 				}
@@ -206,27 +212,59 @@ func (s *seeder) embedStage0Config(r *http.Request, arch string, artifactBytes [
 		}
 	}
 
+	onieHeaders := &config0.OnieHeaders{
+		SerialNumber: r.Header.Get("ONIE-SERIAL-NUMBER"),
+		EthAddr:      r.Header.Get("ONIE-ETH-ADDR"),
+		VendorID:     parseUint(r.Header.Get("ONIE-VENDOR-ID")),
+		Machine:      r.Header.Get("ONIE-MACHINE"),
+		MachineRev:   parseUint(r.Header.Get("ONIE-MACHINE-REV")),
+		Arch:         r.Header.Get("ONIE-ARCH"),
+		SecurityKey:  r.Header.Get("ONIE-SECURITY-KEY"),
+		Operation:    r.Header.Get("ONIE-OPERATION"),
+	}
+	// the ONIE discovery responder knows the platform from the installer file name
+	if onieHeaders.Machine == "" && chi.URLParam(r, "platform") != "" {
+		onieHeaders.Machine = chi.URLParam(r, "vendor") + "_" + chi.URLParam(r, "machine")
+		onieHeaders.MachineRev = parseUint(chi.URLParam(r, "machine_revision"))
+		if onieHeaders.Arch == "" {
+			onieHeaders.Arch = arch
+		}
+	}
+
 	return s.ecg.Stage0(artifactBytes, &config0.Stage0{
-		CA:          s.installerSettings.serverCADER,
-		SignatureCA: s.installerSettings.configSignatureCADER,
-		IPAMURL:     ipamURLString,
-		Stage1URL:   s.installerSettings.stage1URL(arch),
+		CA:            s.installerSettings.stage0ServerCA(),
+		SignatureCA:   s.installerSettings.configSignatureCADER,
+		CABundleURL:   s.installerSettings.caBundleURL(),
+		IPAMURL:       ipamURLString,
+		Stage1URL:     s.installerSettings.stage1URL(arch),
+		Stage1Pin:     s.artifactPin(r, "stage1-"+arch),
+		Stage1Mirrors: s.installerSettings.stage1Mirrors(arch),
 		Services: config0.Services{
-			ControlVIP:    s.installerSettings.controlVIP,
-			NTPServers:    s.installerSettings.ntpServers,
-			SyslogServers: s.installerSettings.syslogServers,
-		},
-		Location: loc,
-		OnieHeaders: &config0.OnieHeaders{
-			SerialNumber: r.Header.Get("ONIE-SERIAL-NUMBER"),
-			EthAddr:      r.Header.Get("ONIE-ETH-ADDR"),
-			VendorID:     parseUint(r.Header.Get("ONIE-VENDOR-ID")),
-			Machine:      r.Header.Get("ONIE-MACHINE"),
-			MachineRev:   parseUint(r.Header.Get("ONIE-MACHINE-REV")),
-			Arch:         r.Header.Get("ONIE-ARCH"),
-			SecurityKey:  r.Header.Get("ONIE-SECURITY-KEY"),
-			Operation:    r.Header.Get("ONIE-OPERATION"),
+			ControlVIP:      s.installerSettings.controlVIP,
+			NTPServers:      s.installerSettings.ntpServers,
+			NTPMaxOffset:    s.installerSettings.ntpMaxOffset,
+			LLDPWait:        s.installerSettings.lldpWait,
+			SyslogServers:   s.installerSettings.syslogServers,
+			SyslogFraming:   s.installerSettings.syslogFraming,
+			SyslogTransport: s.installerSettings.syslogTransport,
+			SyslogCA:        s.installerSettings.syslogCA,
+			DNSServers:      s.installerSettings.dnsServers,
+			DNSSearch:       s.installerSettings.dnsSearchDomains,
 		},
+		Location:          loc,
+		Banner:            s.installerSettings.banner,
+		RequireProvenance: s.installerSettings.requireProvenance,
+		RequireManifest:   s.installerSettings.requireManifest,
+		MACAllowlist:      s.installerSettings.macAllowlist(r.Header.Get("ONIE-ETH-ADDR")),
+		Recovery:          s.installerSettings.recoveryPolicy(recoveryURL.String()),
+		Proxy:             s.installerSettings.proxy,
+		Staging:           s.installerSettings.staging,
+		MultipathPolicy:   s.installerSettings.multipathPolicy,
+		DiskSelection:     s.installerSettings.diskSelection,
+		DHCPFallback:      s.installerSettings.dhcpFallback,
+		PlatformSupport:   s.platformSupport(r, scheme, onieHeaders),
+		OnieHeaders:       onieHeaders,
+		LabMode:           s.labMode,
 	})
 }
 
@@ -240,8 +278,7 @@ func (s *seeder) processIPAMRequest(w http.ResponseWriter, r *http.Request) {
 	}
 
 	var req ipam.Request
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		errorWithJSON(w, r, http.StatusBadRequest, "failed to decode JSON request: %s", err)
+	if !s.limits.decodeJSONRequest(w, r, &req) {
 		return
 	}
 	if err := req.Validate(); err != nil {
@@ -249,6 +286,19 @@ func (s *seeder) processIPAMRequest(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// the IPAM request is the beginning of every installation which is why it is
+	// where we hold back devices which are outside of their maintenance windows
+	if retryAfter, deferred := s.installerSettings.installDeferral(req.DevID, time.Now()); deferred {
+		l.Info("Deferring installation outside of maintenance window", zap.String("request", middleware.GetReqID(r.Context())), zap.String("devid", req.DevID), zap.Duration("retryAfter", retryAfter))
+		deferWithJSON(w, r, retryAfter, "outside of maintenance window, installation deferred for %s", retryAfter.Round(time.Second))
+		return
+	}
+	if s.cancellations.holds(req.DevID) {
+		l.Info("Deferring installation which was cancelled", zap.String("request", middleware.GetReqID(r.Context())), zap.String("devid", req.DevID))
+		deferWithJSON(w, r, cancellationRetryAfter, "all installations of the device are cancelled, installation deferred for %s", cancellationRetryAfter)
+		return
+	}
+
 	// try to see if we can find the adjacent switch port
 	ctx, cancel := context.WithTimeout(r.Context(), time.Second*30)
 	defer cancel()
@@ -256,19 +306,38 @@ func (s *seeder) processIPAMRequest(w http.ResponseWriter, r *http.Request) {
 	adjacentSwitch, adjacentPort, err := s.cpc.GetNeighbourSwitchByAddr(ctx, host)
 	if err != nil {
 		log.L().Error("failed to discover switch port by address", zap.String("addr", host), zap.Error(err))
+		// the LLDP neighbours of the device are the next best thing
+		adjacentSwitch, adjacentPort = s.neighbourSwitchByLLDP(ctx, req.Neighbors)
 	}
 	// TODO: the location UUID should match
 
 	set := &ipam.Settings{
 		ControlVIP:    s.installerSettings.controlVIP,
+		ControlVIPv6:  s.installerSettings.controlVIPv6,
 		NTPServers:    s.installerSettings.ntpServers,
 		SyslogServers: s.installerSettings.syslogServers,
+		DNSServers:    s.installerSettings.dnsServers,
+		DNSSearch:     s.installerSettings.dnsSearchDomains,
+		MTU:           s.installerSettings.mtu,
+		Banner:        s.installerSettings.banner,
 		// as the architecture has been validated by this point, we can rely on this value
-		Stage1URL: s.installerSettings.stage1URL(req.Arch),
+		Stage1URL:     s.installerSettings.stage1URL(req.Arch),
+		Stage1Mirrors: s.installerSettings.stage1Mirrors(req.Arch),
+	}
+	// devices get the same addresses for as long as their lease is valid
+	resp, err := s.ipamLeases.Process(&req, func() (*ipam.Response, error) {
+		return ipam.ProcessRequest(r.Context(), set, s.cpc, &req, adjacentSwitch, adjacentPort)
+	})
+	if errors.Is(err, ipam.ErrLeaseConflict) {
+		errorWithJSON(w, r, http.StatusConflict, "failed to process IPAM request: %s", err)
+		return
 	}
-	resp, err := ipam.ProcessRequest(r.Context(), set, s.cpc, &req, adjacentSwitch, adjacentPort)
 	if err != nil {
 		errorWithJSON(w, r, http.StatusInternalServerError, "failed to process IPAM request: %s", err)
+		return
+	}
+	if req.Nonce != "" && req.Nonce != resp.Nonce {
+		log.L().Info("IPAM lease of device expired, handed out a new lease", zap.String("devid", req.DevID), zap.String("nonce", resp.Nonce), zap.String("previousNonce", req.Nonce))
 	}
 
 	w.WriteHeader(http.StatusOK)
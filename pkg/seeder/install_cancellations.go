@@ -0,0 +1,248 @@
+// Copyright 2023 Hedgehog
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package seeder
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"path"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
+	"go.uber.org/zap"
+
+	"go.githedgehog.com/dasboot/pkg/seeder/controlplane"
+	"go.githedgehog.com/dasboot/pkg/stage"
+)
+
+const (
+	installCancellationPath = "/install-cancellation"
+	adminCancellationsPath  = "/cancellations"
+
+	// cancellationRetryAfter is how long devices with a cancelled installation are told to wait before they retry.
+	// It is longer than stage 0 is willing to wait, so that it exits without having made any changes.
+	cancellationRetryAfter = 30 * time.Minute
+)
+
+// InstallCancellationRequest is the request body to cancel the installation of a device on the admin server
+type InstallCancellationRequest struct {
+	// InstallSession restricts the cancellation to a single install session. If it is empty, all installations of
+	// the device are cancelled, and no new installations are started until the cancellation gets deleted.
+	InstallSession string `json:"install_session,omitempty"`
+
+	// Reason is passed on to the device, and ends up in its logs
+	Reason string `json:"reason,omitempty"`
+}
+
+// InstallCancellation is a cancelled installation of a device as it is listed on the admin server
+type InstallCancellation struct {
+	DeviceID       string    `json:"device_id"`
+	InstallSession string    `json:"install_session,omitempty"`
+	Reason         string    `json:"reason,omitempty"`
+	CancelledAt    time.Time `json:"cancelled_at"`
+
+	// Aborts are the reports of the stages which aborted a cancelled installation
+	Aborts []*InstallCancellationAbort `json:"aborts,omitempty"`
+}
+
+// InstallCancellationAbort is the report of a stage which aborted a cancelled installation
+type InstallCancellationAbort struct {
+	stage.InstallCancellationReport
+	AbortedAt time.Time `json:"aborted_at"`
+}
+
+// appliesTo returns true if the cancellation applies to the install session `session`
+func (c *InstallCancellation) appliesTo(session string) bool {
+	return c.InstallSession == "" || c.InstallSession == session
+}
+
+// installCancellations holds the cancellations which operators issued for devices. Stages learn about them
+// at their checkpoints, and abort the installation.
+type installCancellations struct {
+	mu            sync.Mutex
+	cancellations map[string]*InstallCancellation
+	now           func() time.Time
+}
+
+func newInstallCancellations() *installCancellations {
+	return &installCancellations{
+		cancellations: make(map[string]*InstallCancellation),
+		now:           time.Now,
+	}
+}
+
+// set adds or replaces the cancellation for device `devid`
+func (ic *installCancellations) set(devid string, req *InstallCancellationRequest) *InstallCancellation {
+	c := &InstallCancellation{
+		DeviceID:       devid,
+		InstallSession: req.InstallSession,
+		Reason:         req.Reason,
+		CancelledAt:    ic.now(),
+	}
+	ic.mu.Lock()
+	defer ic.mu.Unlock()
+	ic.cancellations[devid] = c
+	return c
+}
+
+func (ic *installCancellations) delete(devid string) bool {
+	ic.mu.Lock()
+	defer ic.mu.Unlock()
+	_, ok := ic.cancellations[devid]
+	delete(ic.cancellations, devid)
+	return ok
+}
+
+func (ic *installCancellations) list() []*InstallCancellation {
+	ic.mu.Lock()
+	defer ic.mu.Unlock()
+	ret := make([]*InstallCancellation, 0, len(ic.cancellations))
+	for _, c := range ic.cancellations {
+		ret = append(ret, c)
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i].DeviceID < ret[j].DeviceID })
+	return ret
+}
+
+// get returns the cancellation which applies to the install session `session` of device `devid`, or nil
+func (ic *installCancellations) get(devid string, session string) *InstallCancellation {
+	ic.mu.Lock()
+	defer ic.mu.Unlock()
+	c, ok := ic.cancellations[devid]
+	if !ok || !c.appliesTo(session) {
+		return nil
+	}
+	return c
+}
+
+// holds returns true if all installations of device `devid` are cancelled
+func (ic *installCancellations) holds(devid string) bool {
+	ic.mu.Lock()
+	defer ic.mu.Unlock()
+	c, ok := ic.cancellations[devid]
+	return ok && c.InstallSession == ""
+}
+
+// abort records the report of a stage which aborted the installation. It returns false if the
+// install session of the report was not cancelled.
+func (ic *installCancellations) abort(devid string, report *stage.InstallCancellationReport) (*InstallCancellation, bool) {
+	ic.mu.Lock()
+	defer ic.mu.Unlock()
+	c, ok := ic.cancellations[devid]
+	if !ok || !c.appliesTo(report.InstallSession) {
+		return nil, false
+	}
+	c.Aborts = append(c.Aborts, &InstallCancellationAbort{
+		InstallCancellationReport: *report,
+		AbortedAt:                 ic.now(),
+	})
+	return c, true
+}
+
+func (s *seeder) getInstallCancellation(authz func(*http.Request) error) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if err := authz(r); err != nil {
+			errorWithJSON(w, r, http.StatusForbidden, "unauthorized access to install cancellation: %s", err)
+			return
+		}
+		devidParam := chi.URLParam(r, "devid")
+		if devidParam == "" {
+			errorWithJSON(w, r, http.StatusBadRequest, "no device ID in URL")
+			return
+		}
+
+		ret := &stage.InstallCancellation{}
+		if c := s.cancellations.get(devidParam, r.URL.Query().Get(stage.QueryInstallSession)); c != nil {
+			ret.Cancelled = true
+			ret.Reason = c.Reason
+		}
+		writeJSON(w, r, http.StatusOK, ret)
+	}
+}
+
+func (s *seeder) reportInstallCancellation(authz func(*http.Request) error) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if err := authz(r); err != nil {
+			errorWithJSON(w, r, http.StatusForbidden, "unauthorized access to install cancellation: %s", err)
+			return
+		}
+		devidParam := chi.URLParam(r, "devid")
+		if devidParam == "" {
+			errorWithJSON(w, r, http.StatusBadRequest, "no device ID in URL")
+			return
+		}
+
+		var report stage.InstallCancellationReport
+		if !s.limits.decodeJSONRequest(w, r, &report) {
+			return
+		}
+		c, ok := s.cancellations.abort(devidParam, &report)
+		if !ok {
+			errorWithJSON(w, r, http.StatusNotFound, "installation of device '%s' in install session '%s' is not cancelled", devidParam, report.InstallSession)
+			return
+		}
+		l.Info("Device aborted cancelled installation",
+			zap.String("request", middleware.GetReqID(r.Context())),
+			zap.String("devid", devidParam),
+			zap.String("installSession", report.InstallSession),
+			zap.String("stage", report.Stage),
+			zap.String("checkpoint", report.Checkpoint),
+		)
+		s.recordDeviceEvent(r.Context(), devidParam, controlplane.DeviceEventCancelled, fmt.Sprintf("installation aborted by %s at checkpoint '%s': %s", report.Stage, report.Checkpoint, c.Reason))
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func (s *seeder) listInstallCancellationsHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, r, http.StatusOK, s.cancellations.list())
+}
+
+func (s *seeder) setInstallCancellationHandler(w http.ResponseWriter, r *http.Request) {
+	devidParam := chi.URLParam(r, "devid")
+	if devidParam == "" {
+		errorWithJSON(w, r, http.StatusBadRequest, "no device ID in URL")
+		return
+	}
+
+	var req InstallCancellationRequest
+	if r.ContentLength != 0 && !s.limits.decodeJSONRequest(w, r, &req) {
+		return
+	}
+	c := s.cancellations.set(devidParam, &req)
+	l.Warn("Installation cancelled", zap.String("devid", devidParam), zap.String("installSession", c.InstallSession), zap.String("reason", c.Reason))
+	writeJSON(w, r, http.StatusOK, c)
+}
+
+func (s *seeder) deleteInstallCancellationHandler(w http.ResponseWriter, r *http.Request) {
+	devidParam := chi.URLParam(r, "devid")
+	if !s.cancellations.delete(devidParam) {
+		errorWithJSON(w, r, http.StatusNotFound, "no install cancellation found for device '%s'", devidParam)
+		return
+	}
+	l.Info("Install cancellation deleted", zap.String("devid", devidParam))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (lis *loadedInstallerSettings) installCancellationURL() string {
+	return (&url.URL{
+		Scheme: lis.secureScheme(),
+		Host:   lis.secureServerName,
+		Path:   path.Join("/", installCancellationPath),
+	}).String()
+}
@@ -0,0 +1,114 @@
+// Copyright 2023 Hedgehog
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package seeder
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"go.githedgehog.com/dasboot/pkg/stage"
+)
+
+func Test_installCancellations(t *testing.T) {
+	now := time.Date(2023, 6, 1, 12, 0, 0, 0, time.UTC)
+	ic := newInstallCancellations()
+	ic.now = func() time.Time { return now }
+
+	ic.set("dev1", &InstallCancellationRequest{InstallSession: "session1", Reason: "wrong cabling"})
+	ic.set("dev2", &InstallCancellationRequest{Reason: "decommissioned"})
+
+	// a session cancellation must only apply to that session, and must not hold new installations
+	if ic.get("dev1", "session1") == nil {
+		t.Errorf("get() did not find cancellation of session")
+	}
+	if ic.get("dev1", "session2") != nil {
+		t.Errorf("get() found cancellation for another session")
+	}
+	if ic.holds("dev1") {
+		t.Errorf("holds() = true for a session cancellation")
+	}
+
+	// a device cancellation applies to all sessions
+	if ic.get("dev2", "any") == nil || !ic.holds("dev2") {
+		t.Errorf("device cancellation does not apply to all sessions")
+	}
+	if ic.get("dev3", "any") != nil {
+		t.Errorf("get() found cancellation for unrelated device")
+	}
+
+	if _, ok := ic.abort("dev1", &stage.InstallCancellationReport{InstallSession: "session2", Stage: "stage2"}); ok {
+		t.Errorf("abort() accepted report for a session which is not cancelled")
+	}
+	c, ok := ic.abort("dev1", &stage.InstallCancellationReport{InstallSession: "session1", Stage: "stage2", Checkpoint: "before-nos-install"})
+	if !ok || len(c.Aborts) != 1 || c.Aborts[0].Checkpoint != "before-nos-install" || !c.Aborts[0].AbortedAt.Equal(now) {
+		t.Errorf("abort() = %v, %v, want recorded abort", c, ok)
+	}
+
+	if got := ic.list(); len(got) != 2 || got[0].DeviceID != "dev1" || got[1].DeviceID != "dev2" {
+		t.Errorf("list() = %v, want both cancellations sorted by device", got)
+	}
+	if !ic.delete("dev2") || ic.delete("dev2") {
+		t.Errorf("delete() must only succeed once")
+	}
+	if ic.holds("dev2") {
+		t.Errorf("holds() = true after deletion")
+	}
+}
+
+func TestGetInstallCancellation(t *testing.T) {
+	const devid = "0a1b2c3d-4e5f-6789-abcd-ef0123456789"
+	s := &seeder{cancellations: newInstallCancellations()}
+	s.cancellations.set(devid, &InstallCancellationRequest{InstallSession: "session1", Reason: "wrong cabling"})
+	r := chi.NewRouter()
+	r.Get(path.Join(installCancellationPath, "{devid}"), s.getInstallCancellation(func(*http.Request) error { return nil }))
+
+	tests := []struct {
+		name    string
+		session string
+		want    stage.InstallCancellation
+	}{
+		{
+			name:    "cancelled session",
+			session: "session1",
+			want:    stage.InstallCancellation{Cancelled: true, Reason: "wrong cabling"},
+		},
+		{
+			name:    "other session",
+			session: "session2",
+			want:    stage.InstallCancellation{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			r.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path.Join(installCancellationPath, devid)+"?"+stage.QueryInstallSession+"="+tt.session, nil))
+			if rec.Code != http.StatusOK {
+				t.Fatalf("status = %d, want %d: %s", rec.Code, http.StatusOK, rec.Body.String())
+			}
+			var got stage.InstallCancellation
+			if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+				t.Fatalf("decoding response: %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("cancellation = %#v, want %#v", got, tt.want)
+			}
+		})
+	}
+}
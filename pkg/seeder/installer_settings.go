@@ -15,20 +15,65 @@
 package seeder
 
 import (
+	"bytes"
 	"fmt"
+	gonet "net"
 	"net/url"
+	"os"
 	"path"
+	"time"
 
+	"go.githedgehog.com/dasboot/pkg/banner"
+	"go.githedgehog.com/dasboot/pkg/log/syslog"
+	"go.githedgehog.com/dasboot/pkg/net"
+	"go.githedgehog.com/dasboot/pkg/partitions"
 	"go.githedgehog.com/dasboot/pkg/seeder/config"
+	"go.githedgehog.com/dasboot/pkg/seeder/firstboot"
+	"go.githedgehog.com/dasboot/pkg/stage"
+	config0 "go.githedgehog.com/dasboot/pkg/stage0/config"
+	config2 "go.githedgehog.com/dasboot/pkg/stage2/config"
 )
 
 type loadedInstallerSettings struct {
 	serverCADER          []byte
+	serverCABundle       *stage.CABundle
 	configSignatureCADER []byte
 	secureServerName     string
+	mirrorServerNames    []string
 	controlVIP           string
+	controlVIPv6         string
+	fabricName           string
 	ntpServers           []string
+	ntpMaxOffset         string
+	lldpWait             string
 	syslogServers        []string
+	syslogFraming        string
+	syslogTransport      string
+	syslogCA             []byte
+	dnsServers           []string
+	dnsSearchDomains     []string
+	diagBoot             bool
+	encryptIdentity      bool
+	identityBackups      bool
+	banner               *banner.Banner
+	mtu                  int
+	requireProvenance    bool
+	requireManifest      bool
+	macAllowlists        map[string]net.MACAllowlist
+	recovery             *config0.Recovery
+	gptAttributes        map[string]map[string][]string
+	preserveNOSConfig    map[string][]string
+	disableDiscard       []string
+	staging              *config0.Staging
+	multipathPolicy      string
+	diskSelection        *partitions.DiskSelectionPolicy
+	dhcpFallback         bool
+	proxy                *config0.Proxy
+	maintenanceWindows   map[string]maintenanceWindows
+	compatibility        compatibilityMatrix
+
+	// plainHTTP is set if the secure server runs without TLS in lab mode
+	plainHTTP bool
 }
 
 func (s *seeder) initializeInstallerSettings(cfg *config.InstallerSettings) error {
@@ -37,15 +82,177 @@ func (s *seeder) initializeInstallerSettings(cfg *config.InstallerSettings) erro
 		return fmt.Errorf("secure server name must be set")
 	}
 
-	// read server CA and store the DER bytes in the seeder
-	_, serverCADER, err := readCertFromPath(cfg.ServerCAPath)
+	// mirror server names must be plain host names with an optional port
+	for _, name := range cfg.MirrorServerNames {
+		if u, err := url.Parse("https://" + name); err != nil || name == "" || u.Host != name {
+			return fmt.Errorf("invalid mirror server name '%s'", name)
+		}
+	}
+
+	// the IPv6 control VIP is only used for IPv6 management links
+	if cfg.ControlVIPv6 != "" {
+		ip, _, err := gonet.ParseCIDR(cfg.ControlVIPv6)
+		if err != nil {
+			ip = gonet.ParseIP(cfg.ControlVIPv6)
+		}
+		if ip == nil || ip.To4() != nil {
+			return fmt.Errorf("invalid IPv6 control VIP '%s'", cfg.ControlVIPv6)
+		}
+	}
+
+	// validate the MTU if it is set
+	if cfg.MTU != 0 {
+		if err := net.ValidateMTU(cfg.MTU); err != nil {
+			return err
+		}
+	}
+
+	// clients can only verify artifact provenance with the config signature CA
+	if cfg.RequireProvenance && cfg.ConfigSignatureCAPath == "" {
+		return fmt.Errorf("requiring artifact provenance needs the config signature CA to be set")
+	}
+
+	// and the manifest verification is part of the artifact provenance
+	if cfg.RequireManifest && !cfg.RequireProvenance {
+		return fmt.Errorf("requiring the artifact manifest needs artifact provenance to be required")
+	}
+
+	// validate the DNS servers
+	if err := (&net.ResolvConf{Nameservers: cfg.DNSServers}).Validate(); err != nil {
+		return err
+	}
+
+	// validate the MAC allowlists, and normalize the ONIE MAC addresses that they are keyed by
+	macAllowlists := make(map[string]net.MACAllowlist, len(cfg.MACAllowlists))
+	for onieMAC, allowlist := range cfg.MACAllowlists {
+		hw, err := gonet.ParseMAC(onieMAC)
+		if err != nil {
+			return fmt.Errorf("MAC allowlist for '%s': %w", onieMAC, err)
+		}
+		if err := net.MACAllowlist(allowlist).Validate(); err != nil {
+			return fmt.Errorf("MAC allowlist for '%s': %w", onieMAC, err)
+		}
+		macAllowlists[hw.String()] = allowlist
+	}
+
+	// validate the recovery policy
+	var recovery *config0.Recovery
+	if cfg.RecoveryMaxConsecutiveFailures > 0 {
+		recovery = &config0.Recovery{
+			MaxConsecutiveFailures: cfg.RecoveryMaxConsecutiveFailures,
+			Action:                 config0.RecoveryAction(cfg.RecoveryAction),
+		}
+		if err := recovery.Validate(); err != nil {
+			return err
+		}
+	}
+
+	// validate the GPT attributes
+	for platform, attrs := range cfg.GPTAttributes {
+		for name, attrNames := range attrs {
+			if _, err := partitions.ParseGPTAttributes(attrNames); err != nil {
+				return fmt.Errorf("GPT attributes for partition '%s' on platform '%s': %w", name, platform, err)
+			}
+		}
+	}
+
+	// validate the multipath policy
+	if _, err := partitions.ParseMultipathPolicy(cfg.MultipathPolicy); err != nil {
+		return err
+	}
+
+	// validate the disk selection policy
+	if err := cfg.DiskSelection.Validate(); err != nil {
+		return err
+	}
+
+	// validate the NOS configuration preservation policy
+	for devid, paths := range cfg.PreserveNOSConfig {
+		for _, p := range paths {
+			if err := config2.ValidateNOSConfigPath(p); err != nil {
+				return fmt.Errorf("NOS configuration preservation for device '%s': %w", devid, err)
+			}
+		}
+	}
+
+	// validate the proxy settings
+	if cfg.Proxy != nil {
+		if err := stage.ValidateProxy(cfg.Proxy); err != nil {
+			return err
+		}
+	}
+
+	// validate the NTP maximum offset
+	if _, err := config0.ParseNTPMaxOffset(cfg.NTPMaxOffset); err != nil {
+		return err
+	}
+	if _, err := config0.ParseLLDPWait(cfg.LLDPWait); err != nil {
+		return err
+	}
+
+	// validate the syslog framing
+	if _, err := syslog.ParseFraming(cfg.SyslogFraming); err != nil {
+		return err
+	}
+
+	// validate the syslog transport, and read the CA for TLS
+	if _, err := syslog.ParseTransport(cfg.SyslogTransport); err != nil {
+		return err
+	}
+	var syslogCA []byte
+	if cfg.SyslogCAPath != "" {
+		var err error
+		syslogCA, err = os.ReadFile(cfg.SyslogCAPath)
+		if err != nil {
+			return fmt.Errorf("reading syslog CA: %w", err)
+		}
+		if _, err := (&syslog.TLSSettings{CA: syslogCA}).Config(); err != nil {
+			return err
+		}
+	}
+
+	// validate the staging area settings
+	if err := cfg.Staging.Validate(); err != nil {
+		return err
+	}
+
+	// parse the maintenance windows
+	maintenanceWindows, err := parseMaintenanceWindows(cfg.MaintenanceWindows)
+	if err != nil {
+		return err
+	}
+
+	// validate the compatibility matrix
+	compatibility, err := parseCompatibilityMatrix(cfg.CompatibilityMatrix)
 	if err != nil {
 		return err
 	}
 
+	// read server CA and store the DER bytes in the seeder
+	var serverCADER []byte
+	if cfg.ServerCAPath == "" && s.labCA != nil {
+		serverCADER = s.labCA.certDER
+	} else {
+		_, serverCADER, err = readCertFromPath(cfg.ServerCAPath)
+		if err != nil {
+			return err
+		}
+	}
+
+	// read the server CA bundle if set
+	var serverCABundle *stage.CABundle
+	if cfg.ServerCABundlePath != "" {
+		serverCABundle, err = readCABundleFromPath(cfg.ServerCABundlePath, cfg.ServerCABundleVersion, serverCADER)
+		if err != nil {
+			return err
+		}
+	}
+
 	// read config signature CA if set
 	var configSignatureCADER []byte
-	if cfg.ConfigSignatureCAPath != "" {
+	if cfg.ConfigSignatureCAPath == "" && s.labCA != nil && s.ecg != nil && bytes.Equal(s.ecg.certDER, s.labCA.certDER) {
+		configSignatureCADER = s.labCA.certDER
+	} else if cfg.ConfigSignatureCAPath != "" {
 		var err error
 		_, configSignatureCADER, err = readCertFromPath(cfg.ConfigSignatureCAPath)
 		if err != nil {
@@ -54,27 +261,112 @@ func (s *seeder) initializeInstallerSettings(cfg *config.InstallerSettings) erro
 	}
 	s.installerSettings = &loadedInstallerSettings{
 		serverCADER:          serverCADER,
+		serverCABundle:       serverCABundle,
 		configSignatureCADER: configSignatureCADER,
 		secureServerName:     cfg.SecureServerName,
+		mirrorServerNames:    cfg.MirrorServerNames,
 		controlVIP:           cfg.ControlVIP,
+		controlVIPv6:         cfg.ControlVIPv6,
+		fabricName:           cfg.FabricName,
 		ntpServers:           cfg.NTPServers,
+		ntpMaxOffset:         cfg.NTPMaxOffset,
+		lldpWait:             cfg.LLDPWait,
 		syslogServers:        cfg.SyslogServers,
+		syslogFraming:        cfg.SyslogFraming,
+		syslogTransport:      cfg.SyslogTransport,
+		syslogCA:             syslogCA,
+		dnsServers:           cfg.DNSServers,
+		dnsSearchDomains:     cfg.DNSSearchDomains,
+		diagBoot:             cfg.DiagBootBeforeInstall,
+		encryptIdentity:      cfg.EncryptIdentityPartition,
+		identityBackups:      cfg.IdentityBackups,
+		banner:               cfg.Banner,
+		mtu:                  cfg.MTU,
+		requireProvenance:    cfg.RequireProvenance,
+		requireManifest:      cfg.RequireManifest,
+		macAllowlists:        macAllowlists,
+		recovery:             recovery,
+		gptAttributes:        cfg.GPTAttributes,
+		preserveNOSConfig:    cfg.PreserveNOSConfig,
+		disableDiscard:       cfg.DisableDiscardPlatforms,
+		staging:              cfg.Staging,
+		multipathPolicy:      cfg.MultipathPolicy,
+		diskSelection:        cfg.DiskSelection,
+		dhcpFallback:         cfg.DHCPFallback,
+		proxy:                cfg.Proxy,
+		maintenanceWindows:   maintenanceWindows,
+		compatibility:        compatibility,
 	}
 
 	return nil
 }
 
+// macAllowlist returns the MAC allowlist for the device with the ONIE management MAC address `onieMAC`
+func (lis *loadedInstallerSettings) macAllowlist(onieMAC string) net.MACAllowlist {
+	hw, err := gonet.ParseMAC(onieMAC)
+	if err != nil {
+		return nil
+	}
+	return lis.macAllowlists[hw.String()]
+}
+
+// nosConfigToPreserve returns the NOS configuration paths which the device with `devid` preserves on reinstallations
+func (lis *loadedInstallerSettings) nosConfigToPreserve(devid string) []string {
+	if paths, ok := lis.preserveNOSConfig[devid]; ok {
+		return paths
+	}
+	return lis.preserveNOSConfig["*"]
+}
+
+// recoveryPolicy returns the recovery policy for stage 0 which reports to the seeder at `reportURL`
+func (lis *loadedInstallerSettings) recoveryPolicy(reportURL string) *config0.Recovery {
+	if lis.recovery == nil {
+		return nil
+	}
+	ret := *lis.recovery
+	ret.ReportURL = reportURL
+	return &ret
+}
+
 func (lis *loadedInstallerSettings) stage1URL(arch string) string {
 	return (&url.URL{
-		Scheme: "https",
+		Scheme: lis.secureScheme(),
 		Host:   lis.secureServerName,
 		Path:   path.Join("/", stage1PathBase, arch),
 	}).String()
 }
 
+// mirrorURLs returns the URLs of the artifact at `p` on all mirror servers
+func (lis *loadedInstallerSettings) mirrorURLs(p string) []string {
+	if len(lis.mirrorServerNames) == 0 {
+		return nil
+	}
+	ret := make([]string, 0, len(lis.mirrorServerNames))
+	for _, name := range lis.mirrorServerNames {
+		ret = append(ret, (&url.URL{
+			Scheme: lis.secureScheme(),
+			Host:   name,
+			Path:   p,
+		}).String())
+	}
+	return ret
+}
+
+func (lis *loadedInstallerSettings) stage1Mirrors(arch string) []string {
+	return lis.mirrorURLs(path.Join("/", stage1PathBase, arch))
+}
+
+func (lis *loadedInstallerSettings) stage2Mirrors(arch string) []string {
+	return lis.mirrorURLs(path.Join("/", stage2PathBase, arch))
+}
+
+func (lis *loadedInstallerSettings) nosInstallerMirrors() []string {
+	return lis.mirrorURLs(path.Join("/", nosInstallerPathBase))
+}
+
 func (lis *loadedInstallerSettings) stage2URL(arch string) string {
 	return (&url.URL{
-		Scheme: "https",
+		Scheme: lis.secureScheme(),
 		Host:   lis.secureServerName,
 		Path:   path.Join("/", stage2PathBase, arch),
 	}).String()
@@ -82,15 +374,27 @@ func (lis *loadedInstallerSettings) stage2URL(arch string) string {
 
 func (lis *loadedInstallerSettings) registerURL() string {
 	return (&url.URL{
-		Scheme: "https",
+		Scheme: lis.secureScheme(),
 		Host:   lis.secureServerName,
 		Path:   path.Join("/", registerPath),
 	}).String()
 }
 
+func (lis *loadedInstallerSettings) renewURL() string {
+	// devices renew with their current client certificate, which is not being presented over plain HTTP
+	if lis.plainHTTP {
+		return ""
+	}
+	return (&url.URL{
+		Scheme: lis.secureScheme(),
+		Host:   lis.secureServerName,
+		Path:   path.Join("/", renewPath),
+	}).String()
+}
+
 func (lis *loadedInstallerSettings) nosInstallerURL() string {
 	return (&url.URL{
-		Scheme: "https",
+		Scheme: lis.secureScheme(),
 		Host:   lis.secureServerName,
 		Path:   path.Join("/", nosInstallerPathBase),
 	}).String()
@@ -98,7 +402,7 @@ func (lis *loadedInstallerSettings) nosInstallerURL() string {
 
 func (lis *loadedInstallerSettings) onieUpdaterURL() string {
 	return (&url.URL{
-		Scheme: "https",
+		Scheme: lis.secureScheme(),
 		Host:   lis.secureServerName,
 		Path:   path.Join("/", onieUpdaterPathBase),
 	}).String()
@@ -106,15 +410,51 @@ func (lis *loadedInstallerSettings) onieUpdaterURL() string {
 
 func (lis *loadedInstallerSettings) hhAgentProvisionerURL(arch string) string {
 	return (&url.URL{
-		Scheme: "https",
+		Scheme: lis.secureScheme(),
 		Host:   lis.secureServerName,
 		Path:   path.Join("/", hhAgentProvisionerPathBase, arch),
 	}).String()
 }
 
+func (lis *loadedInstallerSettings) agentFirstBootURL() string {
+	// the payload gets sealed to the device certificate, which is not being presented over plain HTTP
+	if lis.plainHTTP {
+		return ""
+	}
+	return (&url.URL{
+		Scheme: lis.secureScheme(),
+		Host:   lis.secureServerName,
+		Path:   path.Join("/", hhAgentProvisionerPathBase, "agent", "firstboot"),
+	}).String()
+}
+
+func (lis *loadedInstallerSettings) logShippingURL() string {
+	// only registered devices can ship logs, and they can't prove it over plain HTTP
+	if lis.plainHTTP {
+		return ""
+	}
+	return (&url.URL{
+		Scheme: lis.secureScheme(),
+		Host:   lis.secureServerName,
+		Path:   logShippingPath,
+	}).String()
+}
+
+func (lis *loadedInstallerSettings) diagnosticsUploadsURL() string {
+	// just like log shipping, uploads are only for registered devices
+	if lis.plainHTTP {
+		return ""
+	}
+	return (&url.URL{
+		Scheme: lis.secureScheme(),
+		Host:   lis.secureServerName,
+		Path:   diagnosticsUploadsPath,
+	}).String()
+}
+
 func (lis *loadedInstallerSettings) agentURL() string {
 	return (&url.URL{
-		Scheme: "https",
+		Scheme: lis.secureScheme(),
 		Host:   lis.secureServerName,
 		Path:   path.Join("/", hhAgentProvisionerPathBase, "agent"),
 	}).String()
@@ -122,7 +462,7 @@ func (lis *loadedInstallerSettings) agentURL() string {
 
 func (lis *loadedInstallerSettings) agentConfigURL() string {
 	return (&url.URL{
-		Scheme: "https",
+		Scheme: lis.secureScheme(),
 		Host:   lis.secureServerName,
 		Path:   path.Join("/", hhAgentProvisionerPathBase, "agent", "config"),
 	}).String()
@@ -130,8 +470,27 @@ func (lis *loadedInstallerSettings) agentConfigURL() string {
 
 func (lis *loadedInstallerSettings) agentKubeconfigURL() string {
 	return (&url.URL{
-		Scheme: "https",
+		Scheme: lis.secureScheme(),
 		Host:   lis.secureServerName,
 		Path:   path.Join("/", hhAgentProvisionerPathBase, "agent", "kubeconfig"),
 	}).String()
 }
+
+// firstBootPayload builds the first-boot payload of the agent of the device `devid`
+func (lis *loadedInstallerSettings) firstBootPayload(devid string, kubeconfig []byte) *firstboot.Payload {
+	return &firstboot.Payload{
+		DevID:      devid,
+		Kubeconfig: string(kubeconfig),
+		Endpoints: firstboot.Endpoints{
+			ControlVIP:       lis.controlVIP,
+			ControlVIPv6:     lis.controlVIPv6,
+			SecureServerName: lis.secureServerName,
+			NTPServers:       lis.ntpServers,
+			SyslogServers:    lis.syslogServers,
+			DNSServers:       lis.dnsServers,
+			DNSSearch:        lis.dnsSearchDomains,
+		},
+		Proxy:    lis.proxy,
+		IssuedAt: time.Now(),
+	}
+}
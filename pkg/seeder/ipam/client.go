@@ -18,10 +18,16 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"fmt"
 	"net/http"
+	"net/url"
+	"strings"
 	"time"
 
+	"go.githedgehog.com/dasboot/pkg/log"
+	onieurl "go.githedgehog.com/dasboot/pkg/net/url"
 	"go.githedgehog.com/dasboot/pkg/stage"
+	"go.uber.org/zap"
 )
 
 func DoRequest(ctx context.Context, hc *http.Client, ipamReq *Request, ipamURL string) (*Response, error) {
@@ -69,3 +75,64 @@ func DoRequest(ctx context.Context, hc *http.Client, ipamReq *Request, ipamURL s
 	// return with response
 	return &resp, nil
 }
+
+// DoLinkLocalRequest performs the IPAM request like `DoRequest`. If the host of `ipamURLStr` is a link-local
+// IPv6 address, the request needs a network interface as the zone of the address: if stage 0 was downloaded
+// from a link-local address as well, the same interface is being reused, otherwise the request is tried on
+// all interfaces of `req`. It returns the network interface which was used for link-local requests.
+func DoLinkLocalRequest(ctx context.Context, l log.Interface, hc *http.Client, ipamURLStr string, req *Request, onieEnv *stage.OnieEnv) (*Response, string, error) {
+	ipamURL, err := url.Parse(ipamURLStr)
+	if err != nil {
+		return nil, "", fmt.Errorf("IPAM URL validation error: %w", err)
+	}
+
+	// if the IPAM URL is not a link-local address host, we can short-circuit here
+	if !strings.HasPrefix(ipamURL.Host, "[fe80:") && !strings.HasPrefix(ipamURL.Host, "fe80:") {
+		l.Debug("IPAM URL does not have a link-local host", zap.String("host", ipamURL.Host))
+		resp, err := DoRequest(ctx, hc, req, ipamURLStr)
+		return resp, "", err
+	}
+
+	// check if this is from within an ONIE installer
+	// because then we are going to assume that we want to use the same interface that
+	// was used to download the stage 0 installer
+	// that is of course only the case if this was downloaded from a link-local address URL
+	if strings.Contains(onieEnv.ExecURL, "fe80:") {
+		l.Warn("IPAM URL is on a link-local host, as was the stage 0 installer. We are trying to reuse the same interface for the request.", zap.String("ExecURL", onieEnv.ExecURL))
+
+		// ONIE doesn't get URL encoding right for the host, and some older ONIE versions are
+		// not even using brackets around the IPv6 address, which is what ParseONIE deals with
+		execURL, err := onieEnv.ParseExecURL()
+		if err != nil {
+			return nil, "", fmt.Errorf("ONIE Exec URL validation error: %w", err)
+		}
+		netdev := execURL.Zone()
+		if netdev == "" {
+			return nil, "", fmt.Errorf("ONIE Exec URL has no zone in host '%s'", execURL.Host)
+		}
+
+		// now adjust the URL, and use it
+		ipamURL.Host = onieurl.HostWithZone(ipamURL.Host, netdev)
+		resp, err := DoRequest(ctx, hc, req, ipamURL.String())
+		return resp, netdev, err
+	}
+
+	// otherwise this is probably being executed from the ONIE rescue system
+	// we will simply try the request on all interfaces
+	l.Warn("IPAM URL is on a link-local host, and failed to detect which network interface to use. We will try all of them", zap.Strings("netdevs", req.Interfaces))
+	urlHost := ipamURL.Host
+	for _, netdev := range req.Interfaces {
+		ipamURL.Host = onieurl.HostWithZone(urlHost, netdev)
+		resp, err := DoRequest(ctx, hc, req, ipamURL.String())
+		if err != nil {
+			// the seeder was reachable, and it will give the same answer on all other interfaces
+			if _, deferred := stage.IsDeferred(err); deferred {
+				return nil, netdev, err
+			}
+			l.Error("IPAM request failure", zap.String("netdev", netdev), zap.String("url", ipamURL.String()), zap.Reflect("ipamRequest", req), zap.Error(err))
+			continue
+		}
+		return resp, netdev, nil
+	}
+	return nil, "", fmt.Errorf("request failed on all network interfaces [%s]", strings.Join(req.Interfaces, ","))
+}
@@ -0,0 +1,94 @@
+// Copyright 2023 Hedgehog
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ipam
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"go.githedgehog.com/dasboot/pkg/log"
+	"go.githedgehog.com/dasboot/pkg/stage"
+)
+
+func TestDoLinkLocalRequest(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(&Response{Stage1URL: "https://seeder/stage1"}) //nolint:errcheck
+	}))
+	defer srv.Close()
+
+	req := &Request{
+		Arch:       "x86_64",
+		DevID:      "e04c9e65-6545-5877-bb91-d087cdaf2347",
+		Interfaces: []string{"nonexistent0", "nonexistent1"},
+	}
+	tests := []struct {
+		name       string
+		url        string
+		execURL    string
+		wantNetdev string
+		wantErr    string
+	}{
+		{
+			name: "no link-local URL",
+			url:  srv.URL,
+		},
+		{
+			name:    "link-local exec URL without zone",
+			url:     "https://[fe80::1]:1/stage0/ipam",
+			execURL: "http://[fe80::1]/onie-installer",
+			wantErr: "has no zone",
+		},
+		{
+			name:    "all interfaces are being tried",
+			url:     "https://[fe80::1]:1/stage0/ipam",
+			wantErr: "request failed on all network interfaces [nonexistent0,nonexistent1]",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp, netdev, err := DoLinkLocalRequest(context.Background(), log.L(), srv.Client(), tt.url, req, &stage.OnieEnv{ExecURL: tt.execURL})
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("DoLinkLocalRequest() error = %v, wantErr %s", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("DoLinkLocalRequest() error = %v", err)
+			}
+			if netdev != tt.wantNetdev || resp.Stage1URL != "https://seeder/stage1" {
+				t.Errorf("DoLinkLocalRequest() = %#v, %s", resp, netdev)
+			}
+		})
+	}
+}
+
+func TestResponse_Netdevs(t *testing.T) {
+	resp := &Response{IPAddresses: IPAddresses{
+		"eth2": {},
+		"eth1": {Preferred: true},
+		"eth0": {},
+		"eth3": {Preferred: true},
+	}}
+	if got, want := resp.Netdevs(), []string{"eth1", "eth3", "eth0", "eth2"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Response.Netdevs() = %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,238 @@
+// Copyright 2023 Hedgehog
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ipam
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"go.githedgehog.com/dasboot/pkg/log"
+	"go.uber.org/zap"
+)
+
+// DefaultLeaseTTL is the time for which the addresses of an IPAM response are being reserved for a device
+const DefaultLeaseTTL = 30 * time.Minute
+
+var ErrLeaseConflict = errors.New("ipam: address is leased to another device")
+
+// Lease is an IPAM response which was handed out to a device, and is reserved for it until it expires
+type Lease struct {
+	DevID    string    `json:"devid"`
+	Response *Response `json:"response"`
+	Expires  time.Time `json:"expires"`
+}
+
+// Leases is a thread-safe store of the IPAM responses which were handed out to devices. Within the TTL of
+// a lease, every request of the same device gets the same response with the same nonce. This avoids address
+// conflicts if installations are flapping. Expired leases are being pruned lazily on access. If the store was
+// loaded from a state file with `Load`, every change is being written back to it.
+type Leases struct {
+	lock   sync.Mutex
+	ttl    time.Duration
+	leases map[string]*Lease
+	now    func() time.Time
+	path   string
+}
+
+// NewLeases creates a new lease store. If `ttl` is 0, `DefaultLeaseTTL` is being used.
+func NewLeases(ttl time.Duration) *Leases {
+	if ttl <= 0 {
+		ttl = DefaultLeaseTTL
+	}
+	return &Leases{
+		ttl:    ttl,
+		leases: make(map[string]*Lease),
+		now:    time.Now,
+	}
+}
+
+// Load restores the leases from the state file at `path`, and persists all further changes to it. A
+// missing state file is not an error, it is being created with the first lease.
+func (ls *Leases) Load(path string) error {
+	ls.lock.Lock()
+	defer ls.lock.Unlock()
+
+	b, err := os.ReadFile(path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("ipam: reading lease state: %w", err)
+	}
+	if len(b) > 0 {
+		var leases []*Lease
+		if err := json.Unmarshal(b, &leases); err != nil {
+			return fmt.Errorf("ipam: decoding lease state '%s': %w", path, err)
+		}
+		for _, l := range leases {
+			if l != nil && l.DevID != "" && l.Response != nil {
+				ls.leases[l.DevID] = l
+			}
+		}
+	}
+	ls.path = path
+	ls.prune(ls.now())
+	return nil
+}
+
+// Process returns the response of the current lease of the device `req.DevID` if it has not expired yet.
+// Otherwise it calls `process` to build a new response, and stores it as a new lease with a new nonce.
+// Every request renews the lease of the device. A new response must not contain any address which is
+// leased to another device, or `ErrLeaseConflict` is being returned.
+func (ls *Leases) Process(req *Request, process func() (*Response, error)) (*Response, error) {
+	ls.lock.Lock()
+	defer ls.lock.Unlock()
+	now := ls.now()
+	ls.prune(now)
+
+	if l, ok := ls.leases[req.DevID]; ok {
+		l.Expires = now.Add(ls.ttl)
+		ls.save()
+		return l.Response, nil
+	}
+
+	resp, err := process()
+	if err != nil {
+		return nil, err
+	}
+	if err := ls.conflicts(req.DevID, resp); err != nil {
+		return nil, err
+	}
+	resp.Nonce = uuid.NewString()
+	resp.TTL = int64(ls.ttl / time.Second)
+	ls.leases[req.DevID] = &Lease{
+		DevID:    req.DevID,
+		Response: resp,
+		Expires:  now.Add(ls.ttl),
+	}
+	ls.save()
+	return resp, nil
+}
+
+// Release removes the lease of a device. It returns false if there was no lease.
+func (ls *Leases) Release(devID string) bool {
+	ls.lock.Lock()
+	defer ls.lock.Unlock()
+	if _, ok := ls.leases[devID]; !ok {
+		return false
+	}
+	delete(ls.leases, devID)
+	ls.save()
+	return true
+}
+
+// List returns all leases which have not expired yet sorted by device ID
+func (ls *Leases) List() []Lease {
+	ls.lock.Lock()
+	defer ls.lock.Unlock()
+	ls.prune(ls.now())
+	ret := make([]Lease, 0, len(ls.leases))
+	for _, l := range ls.leases {
+		ret = append(ret, *l)
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i].DevID < ret[j].DevID })
+	return ret
+}
+
+// conflicts checks the addresses of `resp` against the leases of all other devices. Addresses are the same
+// if they have the same IP on the same VLAN, regardless of their prefix length.
+func (ls *Leases) conflicts(devID string, resp *Response) error {
+	addrs := leaseAddresses(resp)
+	for otherDevID, l := range ls.leases {
+		if otherDevID == devID {
+			continue
+		}
+		for addr := range leaseAddresses(l.Response) {
+			if _, ok := addrs[addr]; ok {
+				return fmt.Errorf("%w: %s is leased to device '%s' until %s", ErrLeaseConflict, addr, otherDevID, l.Expires.Format(time.RFC3339))
+			}
+		}
+	}
+	return nil
+}
+
+func leaseAddresses(resp *Response) map[string]struct{} {
+	ret := make(map[string]struct{})
+	for _, ipa := range resp.IPAddresses {
+		for _, s := range ipa.IPAddresses {
+			addr := s
+			if prefix, err := netip.ParsePrefix(s); err == nil {
+				addr = prefix.Addr().String()
+			} else if ip, err := netip.ParseAddr(s); err == nil {
+				addr = ip.String()
+			}
+			if ipa.VLAN > 0 {
+				addr = fmt.Sprintf("%s (VLAN %d)", addr, ipa.VLAN)
+			}
+			ret[strings.ToLower(addr)] = struct{}{}
+		}
+	}
+	return ret
+}
+
+func (ls *Leases) prune(now time.Time) {
+	pruned := false
+	for devID, l := range ls.leases {
+		if !now.Before(l.Expires) {
+			delete(ls.leases, devID)
+			pruned = true
+		}
+	}
+	if pruned {
+		ls.save()
+	}
+}
+
+// save writes all leases to the state file if there is one. Failures are only logged, as they must never
+// fail IPAM requests: the leases are still valid in memory.
+func (ls *Leases) save() {
+	if ls.path == "" {
+		return
+	}
+	leases := make([]*Lease, 0, len(ls.leases))
+	for _, l := range ls.leases {
+		leases = append(leases, l)
+	}
+	sort.Slice(leases, func(i, j int) bool { return leases[i].DevID < leases[j].DevID })
+	b, err := json.Marshal(leases)
+	if err == nil {
+		err = writeFileAtomic(ls.path, b)
+	}
+	if err != nil {
+		log.L().Error("ipam: persisting lease state failed", zap.String("path", ls.path), zap.Error(err))
+	}
+}
+
+func writeFileAtomic(path string, b []byte) error {
+	f, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write(b); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
@@ -0,0 +1,205 @@
+// Copyright 2023 Hedgehog
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ipam
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestLeases(t *testing.T) {
+	now := time.Date(2023, 5, 1, 12, 0, 0, 0, time.UTC)
+	ls := NewLeases(time.Minute)
+	ls.now = func() time.Time { return now }
+
+	calls := 0
+	process := func() (*Response, error) {
+		calls++
+		return &Response{IPAddresses: IPAddresses{"eth0": {IPAddresses: []string{fmt.Sprintf("192.168.42.%d/24", 10+calls)}}}}, nil
+	}
+	dev1 := &Request{DevID: "dev1"}
+	dev2 := &Request{DevID: "dev2"}
+
+	// first request creates a new lease
+	resp1, err := ls.Process(dev1, process)
+	if err != nil {
+		t.Fatalf("Process() error = %v", err)
+	}
+	if calls != 1 || resp1.Nonce == "" || resp1.TTL != 60 {
+		t.Fatalf("Process() = %#v with %d calls, want new lease", resp1, calls)
+	}
+
+	// requests within the TTL get the same lease, and renew it
+	now = now.Add(50 * time.Second)
+	resp, err := ls.Process(dev1, process)
+	if err != nil || resp != resp1 || calls != 1 {
+		t.Fatalf("Process() = %#v, %v with %d calls, want same lease", resp, err, calls)
+	}
+	now = now.Add(50 * time.Second)
+	resp, err = ls.Process(dev1, process)
+	if err != nil || resp != resp1 || calls != 1 {
+		t.Fatalf("Process() = %#v, %v with %d calls, want renewed lease", resp, err, calls)
+	}
+
+	// other devices get their own lease
+	resp2, err := ls.Process(dev2, process)
+	if err != nil || resp2 == resp1 || resp2.Nonce == resp1.Nonce || calls != 2 {
+		t.Fatalf("Process() = %#v, %v with %d calls, want other lease", resp2, err, calls)
+	}
+
+	// once the lease expired, there is a new one with a new nonce
+	now = now.Add(2 * time.Minute)
+	resp, err = ls.Process(dev1, process)
+	if err != nil || resp == resp1 || resp.Nonce == resp1.Nonce || calls != 3 {
+		t.Fatalf("Process() = %#v, %v with %d calls, want new lease", resp, err, calls)
+	}
+
+	// errors are not stored as leases
+	errProcess := errors.New("process error")
+	if _, err := ls.Process(&Request{DevID: "dev3"}, func() (*Response, error) { return nil, errProcess }); !errors.Is(err, errProcess) {
+		t.Fatalf("Process() error = %v, want %v", err, errProcess)
+	}
+	if ls.Release("dev3") {
+		t.Errorf("Release() = true for failed request")
+	}
+	if !ls.Release("dev1") || ls.Release("dev1") {
+		t.Errorf("Release() did not release lease exactly once")
+	}
+}
+
+func TestLeases_Conflicts(t *testing.T) {
+	ls := NewLeases(time.Minute)
+	respond := func(vlan uint16, addrs ...string) func() (*Response, error) {
+		return func() (*Response, error) {
+			return &Response{IPAddresses: IPAddresses{"eth0": {IPAddresses: addrs, VLAN: vlan}}}, nil
+		}
+	}
+	if _, err := ls.Process(&Request{DevID: "dev1"}, respond(42, "192.168.42.11/24", "fd00::11/64")); err != nil {
+		t.Fatalf("Process() error = %v", err)
+	}
+
+	// the same address with another prefix length is still the same address
+	if _, err := ls.Process(&Request{DevID: "dev2"}, respond(42, "192.168.42.11/32")); !errors.Is(err, ErrLeaseConflict) {
+		t.Errorf("Process() error = %v, want %v", err, ErrLeaseConflict)
+	}
+	if _, err := ls.Process(&Request{DevID: "dev2"}, respond(42, "192.168.42.12/24", "FD00::11/64")); !errors.Is(err, ErrLeaseConflict) {
+		t.Errorf("Process() error = %v, want %v", err, ErrLeaseConflict)
+	}
+	// conflicting requests do not create a lease
+	if ls.Release("dev2") {
+		t.Errorf("Release() = true for conflicting request")
+	}
+
+	// other VLANs are other networks
+	if _, err := ls.Process(&Request{DevID: "dev2"}, respond(43, "192.168.42.11/24")); err != nil {
+		t.Errorf("Process() error = %v", err)
+	}
+
+	// released addresses can be handed out again
+	ls.Release("dev1")
+	if _, err := ls.Process(&Request{DevID: "dev3"}, respond(42, "192.168.42.11/24")); err != nil {
+		t.Errorf("Process() error = %v", err)
+	}
+}
+
+func TestLeases_Load(t *testing.T) {
+	now := time.Date(2023, 5, 1, 12, 0, 0, 0, time.UTC)
+	path := filepath.Join(t.TempDir(), "leases.json")
+	process := func() (*Response, error) {
+		return &Response{IPAddresses: IPAddresses{"eth0": {IPAddresses: []string{"192.168.42.11/24"}}}}, nil
+	}
+
+	ls := NewLeases(time.Minute)
+	ls.now = func() time.Time { return now }
+	if err := ls.Load(path); err != nil {
+		t.Fatalf("Load() of missing state file error = %v", err)
+	}
+	resp, err := ls.Process(&Request{DevID: "dev1"}, process)
+	if err != nil {
+		t.Fatalf("Process() error = %v", err)
+	}
+
+	// a restarted seeder hands out the same lease
+	restarted := NewLeases(time.Minute)
+	restarted.now = func() time.Time { return now.Add(30 * time.Second) }
+	if err := restarted.Load(path); err != nil {
+		t.Fatalf("Load() error = %v", err)
+	}
+	got, err := restarted.Process(&Request{DevID: "dev1"}, func() (*Response, error) {
+		t.Fatalf("Process() built a new response for a restored lease")
+		return nil, nil
+	})
+	if err != nil || !reflect.DeepEqual(got, resp) {
+		t.Errorf("Process() = %#v, %v, want %#v", got, err, resp)
+	}
+	if leases := restarted.List(); len(leases) != 1 || leases[0].DevID != "dev1" || !leases[0].Expires.Equal(now.Add(90*time.Second)) {
+		t.Errorf("List() = %#v, want renewed lease of dev1", leases)
+	}
+
+	// expired leases are not restored
+	expired := NewLeases(time.Minute)
+	expired.now = func() time.Time { return now.Add(time.Hour) }
+	if err := expired.Load(path); err != nil {
+		t.Fatalf("Load() error = %v", err)
+	}
+	if leases := expired.List(); len(leases) != 0 {
+		t.Errorf("List() = %#v, want no leases", leases)
+	}
+
+	if err := os.WriteFile(path, []byte("{"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := NewLeases(time.Minute).Load(path); err == nil {
+		t.Errorf("Load() of corrupt state file succeeded")
+	}
+}
+
+func TestResponseStale(t *testing.T) {
+	tests := []struct {
+		name     string
+		resp     *Response
+		received time.Time
+		want     bool
+	}{
+		{
+			name:     "no TTL",
+			resp:     &Response{},
+			received: time.Now().Add(-time.Hour),
+		},
+		{
+			name:     "within TTL",
+			resp:     &Response{TTL: 60},
+			received: time.Now(),
+		},
+		{
+			name:     "TTL passed",
+			resp:     &Response{TTL: 60},
+			received: time.Now().Add(-time.Minute),
+			want:     true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.resp.Stale(tt.received); got != tt.want {
+				t.Errorf("Response.Stale() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -22,6 +22,7 @@ import (
 
 	"net"
 
+	"go.githedgehog.com/dasboot/pkg/banner"
 	"go.githedgehog.com/dasboot/pkg/log"
 	"go.githedgehog.com/dasboot/pkg/seeder/controlplane"
 	wiring1alpha2 "go.githedgehog.com/fabric/api/wiring/v1alpha2"
@@ -31,9 +32,15 @@ import (
 // Settings needs to be passed in by the seeder to a ProcessRequest call
 type Settings struct {
 	ControlVIP    string
+	ControlVIPv6  string
 	SyslogServers []string
 	NTPServers    []string
 	Stage1URL     string
+	Stage1Mirrors []string
+	DNSServers    []string
+	DNSSearch     []string
+	MTU           int
+	Banner        *banner.Banner
 }
 
 var (
@@ -119,9 +126,13 @@ func ProcessRequest(ctx context.Context, settings *Settings, cpc controlplane.Cl
 			if err != nil {
 				return nil, fmt.Errorf("extracting IP from CIDR notation failed for server IP: %w", err)
 			}
-			controlVIP, err := ensureIPHasCIDR(settings.ControlVIP)
+			controlVIP, err := controlVIPFor(settings, serverIP)
 			if err != nil {
-				return nil, fmt.Errorf("ensuring control VIP has CIDR notation: %w", err)
+				return nil, err
+			}
+			if controlVIP == "" {
+				log.L().Info("ipam: skipping port for response as there is no control VIP of the address family of the server IP", zap.String("conn", conn.Name), zap.String("serverIP", serverIP))
+				continue
 			}
 			routes := []*Route{
 				{
@@ -135,6 +146,7 @@ func ProcessRequest(ctx context.Context, settings *Settings, cpc controlplane.Cl
 			netif := conn.Spec.Management.Link.Switch.ONIEPortName
 			ipa := IPAddress{
 				IPAddresses: []string{conn.Spec.Management.Link.Switch.IP},
+				MTU:         settings.MTU,
 				Routes:      routes,
 			}
 
@@ -161,10 +173,34 @@ func ProcessRequest(ctx context.Context, settings *Settings, cpc controlplane.Cl
 		IPAddresses:   ips,
 		NTPServers:    settings.NTPServers,
 		SyslogServers: settings.SyslogServers,
+		DNSServers:    settings.DNSServers,
+		DNSSearch:     settings.DNSSearch,
 		Stage1URL:     settings.Stage1URL,
+		Stage1Mirrors: settings.Stage1Mirrors,
+		Banner:        settings.Banner,
 	}, nil
 }
 
+// controlVIPFor returns the control VIP in CIDR notation of the same address family as the gateway `gw`,
+// as a route cannot cross address families. It returns an empty string if there is none.
+func controlVIPFor(settings *Settings, gw string) (string, error) {
+	gwIP := net.ParseIP(gw)
+	for _, vip := range []string{settings.ControlVIP, settings.ControlVIPv6} {
+		if vip == "" {
+			continue
+		}
+		cidr, err := ensureIPHasCIDR(vip)
+		if err != nil {
+			return "", fmt.Errorf("ensuring control VIP has CIDR notation: %w", err)
+		}
+		ip, _, _ := net.ParseCIDR(cidr)
+		if (ip.To4() == nil) == (gwIP.To4() == nil) {
+			return cidr, nil
+		}
+	}
+	return "", nil
+}
+
 func ensureIPHasCIDR(ip string) (string, error) {
 	// we assume IPv4 by default
 	cidr := "32"
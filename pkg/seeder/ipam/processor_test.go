@@ -107,3 +107,54 @@ func Test_ensureIPHasNoCIDR(t *testing.T) {
 		})
 	}
 }
+
+func Test_controlVIPFor(t *testing.T) {
+	tests := []struct {
+		name     string
+		settings *Settings
+		gw       string
+		want     string
+		wantErr  bool
+	}{
+		{
+			name:     "IPv4",
+			settings: &Settings{ControlVIP: "192.168.42.1", ControlVIPv6: "fd00:42::1"},
+			gw:       "192.168.101.0",
+			want:     "192.168.42.1/32",
+		},
+		{
+			name:     "IPv6",
+			settings: &Settings{ControlVIP: "192.168.42.1", ControlVIPv6: "fd00:42::1/64"},
+			gw:       "fd00:101::",
+			want:     "fd00:42::1/128",
+		},
+		{
+			name:     "IPv6 control VIP in the IPv4 setting",
+			settings: &Settings{ControlVIP: "fd00:42::1"},
+			gw:       "fe80::1",
+			want:     "fd00:42::1/128",
+		},
+		{
+			name:     "no control VIP of the address family",
+			settings: &Settings{ControlVIP: "192.168.42.1"},
+			gw:       "fd00:101::",
+		},
+		{
+			name:     "invalid control VIP",
+			settings: &Settings{ControlVIP: "not an IP"},
+			gw:       "192.168.101.0",
+			wantErr:  true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := controlVIPFor(tt.settings, tt.gw)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("controlVIPFor() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("controlVIPFor() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
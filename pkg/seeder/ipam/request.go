@@ -14,7 +14,10 @@
 
 package ipam
 
-import "github.com/google/uuid"
+import (
+	"github.com/google/uuid"
+	"go.githedgehog.com/dasboot/pkg/net"
+)
 
 // Request represents an IPAM request as being performed by the Stage 0 installer
 type Request struct {
@@ -23,6 +26,14 @@ type Request struct {
 	LocationUUID          string   `json:"location_uuid"`
 	LocationUUIDSignature []byte   `json:"location_uuid_signature"`
 	Interfaces            []string `json:"interfaces,omitempty"`
+
+	// Neighbors are the LLDP neighbours of the interfaces. The seeder uses them to find the switch if it cannot
+	// find it by the link-local address of the request, or by the location.
+	Neighbors []*net.LLDPNeighbor `json:"neighbors,omitempty"`
+
+	// Nonce is the nonce of a previous response if the client is requesting its addresses again
+	// because the TTL of the previous response has passed
+	Nonce string `json:"nonce,omitempty"`
 }
 
 func (r *Request) Validate() error {
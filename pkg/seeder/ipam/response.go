@@ -14,12 +14,59 @@
 
 package ipam
 
+import (
+	"sort"
+	"time"
+
+	"go.githedgehog.com/dasboot/pkg/banner"
+)
+
 // Response is the response as should be written back to stage 0 clients who made an IPAM request
 type Response struct {
-	IPAddresses   IPAddresses `json:"ip_addresses"`
-	NTPServers    []string    `json:"ntp_servers,omitempty"`
-	SyslogServers []string    `json:"syslog_servers,omitempty"`
-	Stage1URL     string      `json:"stage1_url"`
+	IPAddresses   IPAddresses    `json:"ip_addresses"`
+	NTPServers    []string       `json:"ntp_servers,omitempty"`
+	SyslogServers []string       `json:"syslog_servers,omitempty"`
+	DNSServers    []string       `json:"dns_servers,omitempty"`
+	DNSSearch     []string       `json:"dns_search,omitempty"`
+	Stage1URL     string         `json:"stage1_url"`
+	Stage1Mirrors []string       `json:"stage1_mirrors,omitempty"`
+	Banner        *banner.Banner `json:"banner,omitempty"`
+
+	// Nonce identifies the lease of this response. The seeder returns the same nonce for all
+	// requests of the same device as long as the lease has not expired.
+	Nonce string `json:"nonce,omitempty"`
+
+	// TTL is the number of seconds for which the addresses of this response are reserved for the
+	// device. Clients must request them again once the TTL has passed. 0 means that they never expire.
+	TTL int64 `json:"ttl,omitempty"`
+}
+
+// Stale returns true if the TTL of the response has passed since it was `received`
+func (r *Response) Stale(received time.Time) bool {
+	if r == nil || r.TTL <= 0 {
+		return false
+	}
+	return time.Since(received) >= time.Duration(r.TTL)*time.Second
+}
+
+// Netdevs returns the network devices of the response in the order in which stage 0 tries them:
+// preferred network devices first, and by name otherwise
+func (r *Response) Netdevs() []string {
+	if r == nil {
+		return nil
+	}
+	ret := make([]string, 0, len(r.IPAddresses))
+	for netdev := range r.IPAddresses {
+		ret = append(ret, netdev)
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		pi, pj := r.IPAddresses[ret[i]].Preferred, r.IPAddresses[ret[j]].Preferred
+		if pi != pj {
+			return pi
+		}
+		return ret[i] < ret[j]
+	})
+	return ret
 }
 
 // IPAddress hold all information to configure an interface on a target device.
@@ -31,6 +78,7 @@ type IPAddresses map[string]IPAddress
 type IPAddress struct {
 	IPAddresses []string `json:"ip_addresses,omitempty"`
 	VLAN        uint16   `json:"vlan,omitempty"`
+	MTU         int      `json:"mtu,omitempty"`
 	Routes      []*Route `json:"routes,omitempty"`
 	Preferred   bool     `json:"preferred"`
 }
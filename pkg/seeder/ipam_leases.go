@@ -0,0 +1,55 @@
+// Copyright 2023 Hedgehog
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package seeder
+
+import (
+	"net/http"
+
+	"github.com/go-chi/chi/v5"
+	"go.uber.org/zap"
+
+	"go.githedgehog.com/dasboot/pkg/seeder/config"
+	"go.githedgehog.com/dasboot/pkg/seeder/ipam"
+)
+
+const adminLeasesPath = "/ipam/leases"
+
+func newIPAMLeases(cfg *config.IPAMLeases) *ipam.Leases {
+	if cfg == nil {
+		return ipam.NewLeases(ipam.DefaultLeaseTTL)
+	}
+	return ipam.NewLeases(cfg.TTL)
+}
+
+// releaseIPAMLease reclaims the addresses of a device which do not need to be reserved for it anymore
+func (s *seeder) releaseIPAMLease(devid string) {
+	if s.ipamLeases.Release(devid) {
+		l.Info("IPAM lease released", zap.String("devid", devid))
+	}
+}
+
+func (s *seeder) listIPAMLeasesHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, r, http.StatusOK, s.ipamLeases.List())
+}
+
+func (s *seeder) deleteIPAMLeaseHandler(w http.ResponseWriter, r *http.Request) {
+	devidParam := chi.URLParam(r, "devid")
+	if !s.ipamLeases.Release(devidParam) {
+		errorWithJSON(w, r, http.StatusNotFound, "no IPAM lease found for device '%s'", devidParam)
+		return
+	}
+	l.Info("IPAM lease deleted", zap.String("devid", devidParam))
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,62 @@
+// Copyright 2023 Hedgehog
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package seeder
+
+import (
+	"crypto/ecdsa"
+	"crypto/x509"
+	"time"
+
+	"go.githedgehog.com/dasboot/pkg/seeder/config"
+	"go.uber.org/zap"
+)
+
+// labCALifetime is how long the ephemeral CA of the lab mode is valid. Lab environments are throwaway, and
+// the CA is being regenerated on every start anyways.
+const labCALifetime = 30 * 24 * time.Hour
+
+// labCA is the ephemeral CA which replaces all PKI in lab mode: it signs the embedded configurations, it is
+// the server CA which gets handed out to stage 0, and it issues the device certificates at registration.
+type labCA struct {
+	key     *ecdsa.PrivateKey
+	cert    *x509.Certificate
+	certDER []byte
+}
+
+func newLabCA() (*labCA, error) {
+	key, cert, err := newEphemeralCA("DAS BOOT Seeder INSECURE Lab Mode CA", labCALifetime)
+	if err != nil {
+		return nil, err
+	}
+	return &labCA{key: key, cert: cert, certDER: cert.Raw}, nil
+}
+
+// warnLabMode makes sure that nobody can miss that the seeder is running in lab mode
+func warnLabMode(cfg *config.SeederConfig) {
+	plainHTTP := cfg.SecureServer != nil && cfg.SecureServer.ServerKeyPath == ""
+	for i := 0; i < 3; i++ {
+		l.Warn("!!! INSECURE LAB MODE !!! The seeder approves all registrations, and devices do not authenticate it. Never use this outside of throwaway lab environments!",
+			zap.Bool("secureServerPlainHTTP", plainHTTP),
+		)
+	}
+}
+
+// secureScheme returns the URL scheme of the secure server, which is only plain HTTP in lab mode
+func (lis *loadedInstallerSettings) secureScheme() string {
+	if lis.plainHTTP {
+		return "http"
+	}
+	return "https"
+}
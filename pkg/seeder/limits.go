@@ -0,0 +1,222 @@
+// Copyright 2023 Hedgehog
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package seeder
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"sync/atomic"
+
+	"go.githedgehog.com/dasboot/pkg/seeder/config"
+)
+
+const (
+	DefaultMaxIPAMRequestSize     int64 = 64 * 1024
+	DefaultMaxRegisterRequestSize int64 = 64 * 1024
+	DefaultMaxAdminRequestSize    int64 = 64 * 1024
+	DefaultMaxArtifactSize        int64 = 4 * 1024 * 1024 * 1024
+	DefaultMaxConcurrentDownloads       = 32
+)
+
+const adminLimitsPath = "/limits"
+
+// downloadRetryAfter is the value of the Retry-After header in seconds
+// for downloads which were rejected because of too many concurrent downloads
+const downloadRetryAfter = "10"
+
+var ErrArtifactTooLarge = errors.New("seeder: artifact exceeds maximum size")
+
+// LimitsStatus are the configured limits together with the counters of how often they were hit. It is being
+// served on the admin server.
+type LimitsStatus struct {
+	MaxIPAMRequestSize     int64  `json:"max_ipam_request_size"`
+	MaxRegisterRequestSize int64  `json:"max_register_request_size"`
+	MaxAdminRequestSize    int64  `json:"max_admin_request_size"`
+	MaxArtifactSize        int64  `json:"max_artifact_size"`
+	MaxConcurrentDownloads int    `json:"max_concurrent_downloads"`
+	DownloadsInFlight      int    `json:"downloads_in_flight"`
+	RequestsTooLarge       uint64 `json:"requests_too_large"`
+	ArtifactsTooLarge      uint64 `json:"artifacts_too_large"`
+	DownloadsRejected      uint64 `json:"downloads_rejected"`
+}
+
+type limits struct {
+	maxIPAMRequestSize     int64
+	maxRegisterRequestSize int64
+	maxAdminRequestSize    int64
+	maxArtifactSize        int64
+	downloads              chan struct{}
+
+	requestsTooLarge  atomic.Uint64
+	artifactsTooLarge atomic.Uint64
+	downloadsRejected atomic.Uint64
+}
+
+func newLimits(cfg *config.Limits) *limits {
+	if cfg == nil {
+		cfg = &config.Limits{}
+	}
+	orDefault := func(v, def int64) int64 {
+		if v <= 0 {
+			return def
+		}
+		return v
+	}
+	maxDownloads := cfg.MaxConcurrentDownloads
+	if maxDownloads <= 0 {
+		maxDownloads = DefaultMaxConcurrentDownloads
+	}
+	return &limits{
+		maxIPAMRequestSize:     orDefault(cfg.MaxIPAMRequestSize, DefaultMaxIPAMRequestSize),
+		maxRegisterRequestSize: orDefault(cfg.MaxRegisterRequestSize, DefaultMaxRegisterRequestSize),
+		maxAdminRequestSize:    orDefault(cfg.MaxAdminRequestSize, DefaultMaxAdminRequestSize),
+		maxArtifactSize:        orDefault(cfg.MaxArtifactSize, DefaultMaxArtifactSize),
+		downloads:              make(chan struct{}, maxDownloads),
+	}
+}
+
+func (l *limits) status() *LimitsStatus {
+	return &LimitsStatus{
+		MaxIPAMRequestSize:     l.maxIPAMRequestSize,
+		MaxRegisterRequestSize: l.maxRegisterRequestSize,
+		MaxAdminRequestSize:    l.maxAdminRequestSize,
+		MaxArtifactSize:        l.maxArtifactSize,
+		MaxConcurrentDownloads: cap(l.downloads),
+		DownloadsInFlight:      len(l.downloads),
+		RequestsTooLarge:       l.requestsTooLarge.Load(),
+		ArtifactsTooLarge:      l.artifactsTooLarge.Load(),
+		DownloadsRejected:      l.downloadsRejected.Load(),
+	}
+}
+
+// maxRequestBody is a middleware which rejects requests with bodies which are larger than `n` bytes
+func (l *limits) maxRequestBody(n int64) func(next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		fn := func(w http.ResponseWriter, r *http.Request) {
+			// reject early if the client told us already
+			if r.ContentLength > n {
+				l.requestsTooLarge.Add(1)
+				errorWithJSON(w, r, http.StatusRequestEntityTooLarge, "request body exceeds maximum size of %d bytes", n)
+				return
+			}
+			// otherwise the handler will fail on reading the body
+			r.Body = http.MaxBytesReader(w, r.Body, n)
+			next.ServeHTTP(w, r)
+		}
+		return http.HandlerFunc(fn)
+	}
+}
+
+// decodeJSONRequest decodes the request body into `v`. On failure it writes the error response and returns false.
+func (l *limits) decodeJSONRequest(w http.ResponseWriter, r *http.Request, v any) bool {
+	if err := json.NewDecoder(r.Body).Decode(v); err != nil {
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			l.requestsTooLarge.Add(1)
+			errorWithJSON(w, r, http.StatusRequestEntityTooLarge, "request body exceeds maximum size of %d bytes", maxBytesErr.Limit)
+			return false
+		}
+		errorWithJSON(w, r, http.StatusBadRequest, "failed to decode JSON request: %s", err)
+		return false
+	}
+	return true
+}
+
+// acquireDownload tries to acquire a slot for a large download. If it succeeds, the returned function
+// must be called to release the slot again.
+func (l *limits) acquireDownload() (func(), bool) {
+	select {
+	case l.downloads <- struct{}{}:
+		return func() { <-l.downloads }, true
+	default:
+		l.downloadsRejected.Add(1)
+		return nil, false
+	}
+}
+
+// readArtifact reads the whole artifact into memory, and fails if it exceeds the maximum artifact size
+func (l *limits) readArtifact(f io.Reader) ([]byte, error) {
+	b, err := io.ReadAll(io.LimitReader(f, l.maxArtifactSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(b)) > l.maxArtifactSize {
+		l.artifactsTooLarge.Add(1)
+		return nil, fmt.Errorf("%w of %d bytes", ErrArtifactTooLarge, l.maxArtifactSize)
+	}
+	return b, nil
+}
+
+// checkArtifactSize checks the size of the artifact upfront if the artifact knows its size
+func (l *limits) checkArtifactSize(f io.Reader) error {
+	st, ok := f.(interface{ Stat() (fs.FileInfo, error) })
+	if !ok {
+		return nil
+	}
+	fi, err := st.Stat()
+	if err != nil {
+		return nil
+	}
+	if fi.Size() > l.maxArtifactSize {
+		l.artifactsTooLarge.Add(1)
+		return fmt.Errorf("%w of %d bytes", ErrArtifactTooLarge, l.maxArtifactSize)
+	}
+	return nil
+}
+
+// limitArtifact returns a reader which fails once the artifact exceeds the maximum artifact size
+func (l *limits) limitArtifact(f io.Reader) io.Reader {
+	return &maxSizeReader{r: f, remaining: l.maxArtifactSize, l: l}
+}
+
+type maxSizeReader struct {
+	r         io.Reader
+	remaining int64
+	l         *limits
+}
+
+func (m *maxSizeReader) Read(p []byte) (int, error) {
+	if m.remaining < 0 {
+		return 0, ErrArtifactTooLarge
+	}
+	// read one byte more than allowed to detect if the artifact is too large
+	if int64(len(p)) > m.remaining+1 {
+		p = p[:m.remaining+1]
+	}
+	n, err := m.r.Read(p)
+	m.remaining -= int64(n)
+	if m.remaining < 0 {
+		m.l.artifactsTooLarge.Add(1)
+		return 0, fmt.Errorf("%w of %d bytes", ErrArtifactTooLarge, m.l.maxArtifactSize)
+	}
+	return n, err
+}
+
+// artifactReadErrorStatus returns the HTTP status code for errors reading artifacts from a provider.
+// An artifact which is too large is the fault of the provider, so we treat it like a bad upstream response.
+func artifactReadErrorStatus(err error) int {
+	if errors.Is(err, ErrArtifactTooLarge) {
+		return http.StatusBadGateway
+	}
+	return http.StatusInternalServerError
+}
+
+func (s *seeder) getLimitsHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, r, http.StatusOK, s.limits.status())
+}
@@ -0,0 +1,130 @@
+// Copyright 2023 Hedgehog
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package seeder
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"go.githedgehog.com/dasboot/pkg/seeder/config"
+)
+
+func TestLimits_maxRequestBody(t *testing.T) {
+	tests := []struct {
+		name          string
+		body          string
+		contentLength int64
+		wantStatus    int
+	}{
+		{
+			name:          "within limit",
+			body:          `{"artifact":"a"}`,
+			contentLength: -1,
+			wantStatus:    http.StatusOK,
+		},
+		{
+			name:          "content length exceeds limit",
+			body:          `{"artifact":"` + strings.Repeat("a", 64) + `"}`,
+			contentLength: 80,
+			wantStatus:    http.StatusRequestEntityTooLarge,
+		},
+		{
+			name:          "body exceeds limit without content length",
+			body:          `{"artifact":"` + strings.Repeat("a", 64) + `"}`,
+			contentLength: -1,
+			wantStatus:    http.StatusRequestEntityTooLarge,
+		},
+		{
+			name:          "invalid JSON",
+			body:          `{`,
+			contentLength: -1,
+			wantStatus:    http.StatusBadRequest,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := newLimits(&config.Limits{MaxAdminRequestSize: 32})
+			h := l.maxRequestBody(l.maxAdminRequestSize)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				var req ArtifactOverrideRequest
+				if !l.decodeJSONRequest(w, r, &req) {
+					return
+				}
+				w.WriteHeader(http.StatusOK)
+			}))
+			r := httptest.NewRequest(http.MethodPut, "/", strings.NewReader(tt.body))
+			r.ContentLength = tt.contentLength
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, r)
+			if w.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d", w.Code, tt.wantStatus)
+			}
+			wantTooLarge := uint64(0)
+			if tt.wantStatus == http.StatusRequestEntityTooLarge {
+				wantTooLarge = 1
+			}
+			if got := l.status().RequestsTooLarge; got != wantTooLarge {
+				t.Errorf("RequestsTooLarge = %d, want %d", got, wantTooLarge)
+			}
+		})
+	}
+}
+
+func TestLimits_artifacts(t *testing.T) {
+	l := newLimits(&config.Limits{MaxArtifactSize: 8})
+
+	if b, err := l.readArtifact(bytes.NewReader([]byte("12345678"))); err != nil || len(b) != 8 {
+		t.Errorf("readArtifact() = %q, %v", b, err)
+	}
+	if _, err := l.readArtifact(bytes.NewReader([]byte("123456789"))); !errors.Is(err, ErrArtifactTooLarge) {
+		t.Errorf("readArtifact() error = %v, want %v", err, ErrArtifactTooLarge)
+	}
+
+	var buf bytes.Buffer
+	if _, err := io.Copy(&buf, l.limitArtifact(bytes.NewReader([]byte("12345678")))); err != nil || buf.String() != "12345678" {
+		t.Errorf("limitArtifact() = %q, %v", buf.String(), err)
+	}
+	if _, err := io.Copy(io.Discard, l.limitArtifact(bytes.NewReader([]byte("123456789")))); !errors.Is(err, ErrArtifactTooLarge) {
+		t.Errorf("limitArtifact() error = %v, want %v", err, ErrArtifactTooLarge)
+	}
+	if got := l.status().ArtifactsTooLarge; got != 2 {
+		t.Errorf("ArtifactsTooLarge = %d, want 2", got)
+	}
+}
+
+func TestLimits_acquireDownload(t *testing.T) {
+	l := newLimits(&config.Limits{MaxConcurrentDownloads: 1})
+	release, ok := l.acquireDownload()
+	if !ok {
+		t.Fatalf("first download must be allowed")
+	}
+	if _, ok := l.acquireDownload(); ok {
+		t.Errorf("second concurrent download must be rejected")
+	}
+	release()
+	release, ok = l.acquireDownload()
+	if !ok {
+		t.Fatalf("download after release must be allowed")
+	}
+	release()
+	st := l.status()
+	if st.DownloadsRejected != 1 || st.DownloadsInFlight != 0 {
+		t.Errorf("unexpected status: %#v", st)
+	}
+}
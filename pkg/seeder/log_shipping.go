@@ -0,0 +1,453 @@
+// Copyright 2023 Hedgehog
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package seeder
+
+import (
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
+	"github.com/google/uuid"
+	"go.uber.org/zap"
+
+	"go.githedgehog.com/dasboot/pkg/seeder/config"
+	"go.githedgehog.com/dasboot/pkg/seeder/logship"
+)
+
+const (
+	DefaultLogMaxBytesPerDevice int64 = 64 * 1024 * 1024
+	DefaultLogMaxAge                  = 7 * 24 * time.Hour
+	DefaultLogMaxChunkSize      int64 = 1024 * 1024
+)
+
+const (
+	logShippingPath = "/logs"
+	adminLogsPath   = "/logs"
+)
+
+// logChunkSuffix is the file name suffix of every stored log chunk
+const logChunkSuffix = ".ndjson.gz"
+
+// DeviceLogs is the summary of the logs of a device as it is listed on the admin server
+type DeviceLogs struct {
+	DevID    string        `json:"devid"`
+	Size     int64         `json:"size"`
+	Sessions []*LogSession `json:"sessions"`
+}
+
+// LogSession is the summary of the logs of a single install session of a device
+type LogSession struct {
+	InstallSession string    `json:"install_session"`
+	Stages         []string  `json:"stages"`
+	Chunks         int       `json:"chunks"`
+	Size           int64     `json:"size"`
+	FirstChunk     time.Time `json:"first_chunk"`
+	LastChunk      time.Time `json:"last_chunk"`
+}
+
+// logStore stores the log chunks which devices upload on disk at `<dir>/<devid>/<session>/<sequence>-<stage>.ndjson.gz`
+// and enforces the retention limits per device
+type logStore struct {
+	mu                sync.Mutex
+	dir               string
+	maxBytesPerDevice int64
+	maxAge            time.Duration
+	maxChunkSize      int64
+}
+
+// logChunk is a stored log chunk
+type logChunk struct {
+	path    string
+	session string
+	stage   string
+	size    int64
+	modTime time.Time
+}
+
+func newLogStore(cfg *config.LogShipping) (*logStore, error) {
+	if cfg == nil || cfg.Dir == "" {
+		return nil, nil
+	}
+	if err := os.MkdirAll(cfg.Dir, 0o750); err != nil {
+		return nil, fmt.Errorf("log shipping: creating log directory: %w", err)
+	}
+	ret := &logStore{
+		dir:               cfg.Dir,
+		maxBytesPerDevice: cfg.MaxBytesPerDevice,
+		maxAge:            cfg.MaxAge,
+		maxChunkSize:      cfg.MaxChunkSize,
+	}
+	if ret.maxBytesPerDevice <= 0 {
+		ret.maxBytesPerDevice = DefaultLogMaxBytesPerDevice
+	}
+	if ret.maxAge <= 0 {
+		ret.maxAge = DefaultLogMaxAge
+	}
+	if ret.maxChunkSize <= 0 {
+		ret.maxChunkSize = DefaultLogMaxChunkSize
+	}
+	return ret, nil
+}
+
+// store writes the compressed chunk `body` for device `devid`, and applies the retention limits of the device afterwards
+func (ls *logStore) store(devid string, ci *logship.ChunkInfo, body []byte) error {
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+
+	dir := filepath.Join(ls.dir, devid, ci.InstallSession)
+	if err := os.MkdirAll(dir, 0o750); err != nil {
+		return err
+	}
+	name := ls.chunkName(ci)
+
+	// write atomically, a chunk which gets retried simply replaces the previous one
+	f, err := os.CreateTemp(dir, ".chunk-*")
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(body); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	if err := os.Rename(f.Name(), filepath.Join(dir, name)); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+
+	ls.prune(devid, time.Now())
+	return nil
+}
+
+func (ls *logStore) chunkName(ci *logship.ChunkInfo) string {
+	return fmt.Sprintf("%010d-%s%s", ci.Sequence, ci.Stage, logChunkSuffix)
+}
+
+// chunks returns all stored chunks of device `devid` ordered by the time they were received
+func (ls *logStore) chunks(devid string) ([]*logChunk, error) {
+	var ret []*logChunk
+	err := filepath.WalkDir(filepath.Join(ls.dir, devid), func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() || !strings.HasSuffix(d.Name(), logChunkSuffix) {
+			return nil
+		}
+		fi, err := d.Info()
+		if err != nil {
+			return err
+		}
+		// the sequence number never contains a dash, so the first dash separates it from the stage name
+		_, stage, _ := strings.Cut(strings.TrimSuffix(d.Name(), logChunkSuffix), "-")
+		ret = append(ret, &logChunk{
+			path:    p,
+			session: filepath.Base(filepath.Dir(p)),
+			stage:   stage,
+			size:    fi.Size(),
+			modTime: fi.ModTime(),
+		})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.SliceStable(ret, func(i, j int) bool {
+		if ret[i].modTime.Equal(ret[j].modTime) {
+			return ret[i].path < ret[j].path
+		}
+		return ret[i].modTime.Before(ret[j].modTime)
+	})
+	return ret, nil
+}
+
+// prune removes all chunks of device `devid` which are older than the maximum age, and the oldest chunks
+// until the device is within its size limit again. It must be called with the lock held.
+func (ls *logStore) prune(devid string, now time.Time) {
+	chunks, err := ls.chunks(devid)
+	if err != nil {
+		l.Warn("Listing log chunks for pruning failed", zap.String("devid", devid), zap.Error(err))
+		return
+	}
+	var total int64
+	for _, c := range chunks {
+		total += c.size
+	}
+	for _, c := range chunks {
+		if now.Sub(c.modTime) <= ls.maxAge && total <= ls.maxBytesPerDevice {
+			break
+		}
+		if err := os.Remove(c.path); err != nil {
+			l.Warn("Removing log chunk failed", zap.String("devid", devid), zap.String("path", c.path), zap.Error(err))
+			continue
+		}
+		total -= c.size
+		// removing the session directory only succeeds once it is empty
+		_ = os.Remove(filepath.Dir(c.path))
+	}
+	_ = os.Remove(filepath.Join(ls.dir, devid))
+}
+
+func (ls *logStore) devices() ([]string, error) {
+	entries, err := os.ReadDir(ls.dir)
+	if err != nil {
+		return nil, err
+	}
+	var ret []string
+	for _, entry := range entries {
+		if _, err := uuid.Parse(entry.Name()); entry.IsDir() && err == nil {
+			ret = append(ret, entry.Name())
+		}
+	}
+	return ret, nil
+}
+
+// list applies the retention limits to all devices and returns a summary of all stored logs
+func (ls *logStore) list() ([]*DeviceLogs, error) {
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+
+	devids, err := ls.devices()
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	ret := make([]*DeviceLogs, 0, len(devids))
+	for _, devid := range devids {
+		ls.prune(devid, now)
+		chunks, err := ls.chunks(devid)
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				continue
+			}
+			return nil, err
+		}
+		if len(chunks) == 0 {
+			continue
+		}
+		dl := &DeviceLogs{DevID: devid}
+		sessions := make(map[string]*LogSession)
+		for _, c := range chunks {
+			s, ok := sessions[c.session]
+			if !ok {
+				s = &LogSession{InstallSession: c.session, FirstChunk: c.modTime}
+				sessions[c.session] = s
+				dl.Sessions = append(dl.Sessions, s)
+			}
+			if len(s.Stages) == 0 || s.Stages[len(s.Stages)-1] != c.stage {
+				s.Stages = append(s.Stages, c.stage)
+			}
+			s.Chunks++
+			s.Size += c.size
+			s.LastChunk = c.modTime
+			dl.Size += c.size
+		}
+		ret = append(ret, dl)
+	}
+	return ret, nil
+}
+
+// find returns the chunks of device `devid` in the order in which they were received. If `session` is set,
+// only the chunks of that install session are being returned.
+func (ls *logStore) find(devid, session string) ([]*logChunk, error) {
+	ls.mu.Lock()
+	chunks, err := ls.chunks(devid)
+	ls.mu.Unlock()
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+	var ret []*logChunk
+	for _, c := range chunks {
+		if session == "" || c.session == session {
+			ret = append(ret, c)
+		}
+	}
+	return ret, nil
+}
+
+func copyLogChunk(w io.Writer, p string) error {
+	f, err := os.Open(p)
+	if err != nil {
+		// the chunk could have been pruned in the meantime
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+	defer f.Close()
+	zr, err := gzip.NewReader(f)
+	if err != nil {
+		return err
+	}
+	defer zr.Close()
+	_, err = io.Copy(w, zr)
+	return err
+}
+
+func (ls *logStore) delete(devid string) (bool, error) {
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+	p := filepath.Join(ls.dir, devid)
+	if _, err := os.Stat(p); err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, os.RemoveAll(p)
+}
+
+// logShippingURL returns the URL where devices ship their logs to, or an empty string if log shipping is disabled
+func (s *seeder) logShippingURL() string {
+	if s.logs == nil {
+		return ""
+	}
+	return s.installerSettings.logShippingURL()
+}
+
+func (s *seeder) uploadLogsHandler(w http.ResponseWriter, r *http.Request) {
+	// only registered devices can ship logs, and the chunks are being stored for the device of the certificate
+	if err := checkAccessLevel(r, accessRegistered); err != nil {
+		errorWithJSON(w, r, http.StatusForbidden, "log shipping: %s", err)
+		return
+	}
+	cert := r.TLS.PeerCertificates[0]
+	devid := cert.Subject.CommonName
+	if _, err := uuid.Parse(devid); err != nil {
+		errorWithJSON(w, r, http.StatusForbidden, "log shipping: device certificate CN is not a device ID: %s", err)
+		return
+	}
+
+	if enc := r.Header.Get("Content-Encoding"); enc != logship.ContentEncoding {
+		errorWithJSON(w, r, http.StatusUnsupportedMediaType, "log shipping: unsupported content encoding '%s'", enc)
+		return
+	}
+	ci, err := logship.ChunkInfoFromHeaders(r.Header)
+	if err != nil {
+		errorWithJSON(w, r, http.StatusBadRequest, "%s", err)
+		return
+	}
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			s.limits.requestsTooLarge.Add(1)
+			errorWithJSON(w, r, http.StatusRequestEntityTooLarge, "log chunk exceeds maximum size of %d bytes", maxBytesErr.Limit)
+			return
+		}
+		errorWithJSON(w, r, http.StatusBadRequest, "reading log chunk: %s", err)
+		return
+	}
+	if err := logship.VerifyChunk(cert.PublicKey, ci, body, r.Header.Get(logship.HeaderDigest), r.Header.Get(logship.HeaderSignature)); err != nil {
+		errorWithJSON(w, r, http.StatusBadRequest, "%s", err)
+		return
+	}
+
+	if err := s.logs.store(devid, ci, body); err != nil {
+		l.Error("Storing log chunk failed", zap.String("request", middleware.GetReqID(r.Context())), zap.String("devid", devid), zap.Error(err))
+		errorWithJSON(w, r, http.StatusInternalServerError, "storing log chunk: %s", err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *seeder) listLogsHandler(w http.ResponseWriter, r *http.Request) {
+	if s.logs == nil {
+		errorWithJSON(w, r, http.StatusNotFound, "log shipping is not enabled")
+		return
+	}
+	ret, err := s.logs.list()
+	if err != nil {
+		errorWithJSON(w, r, http.StatusInternalServerError, "listing logs: %s", err)
+		return
+	}
+	writeJSON(w, r, http.StatusOK, ret)
+}
+
+func (s *seeder) getLogsHandler(w http.ResponseWriter, r *http.Request) {
+	if s.logs == nil {
+		errorWithJSON(w, r, http.StatusNotFound, "log shipping is not enabled")
+		return
+	}
+	devidParam := chi.URLParam(r, "devid")
+	if _, err := uuid.Parse(devidParam); err != nil {
+		errorWithJSON(w, r, http.StatusBadRequest, "invalid device ID '%s': %s", devidParam, err)
+		return
+	}
+	session := r.URL.Query().Get("session")
+	if session != "" {
+		if _, err := uuid.Parse(session); err != nil {
+			errorWithJSON(w, r, http.StatusBadRequest, "invalid install session '%s': %s", session, err)
+			return
+		}
+	}
+
+	chunks, err := s.logs.find(devidParam, session)
+	if err != nil {
+		errorWithJSON(w, r, http.StatusInternalServerError, "finding logs: %s", err)
+		return
+	}
+	if len(chunks) == 0 {
+		errorWithJSON(w, r, http.StatusNotFound, "no logs found for device '%s'", devidParam)
+		return
+	}
+
+	// the chunks are being served decompressed as one continuous stream of log entries
+	w.Header().Set("Content-Type", logship.ContentType)
+	w.WriteHeader(http.StatusOK)
+	for _, c := range chunks {
+		if err := copyLogChunk(w, c.path); err != nil {
+			l.Warn("Writing log chunk failed", zap.String("request", middleware.GetReqID(r.Context())), zap.String("devid", devidParam), zap.String("path", c.path), zap.Error(err))
+			return
+		}
+	}
+}
+
+func (s *seeder) deleteLogsHandler(w http.ResponseWriter, r *http.Request) {
+	if s.logs == nil {
+		errorWithJSON(w, r, http.StatusNotFound, "log shipping is not enabled")
+		return
+	}
+	devidParam := chi.URLParam(r, "devid")
+	if _, err := uuid.Parse(devidParam); err != nil {
+		errorWithJSON(w, r, http.StatusBadRequest, "invalid device ID '%s': %s", devidParam, err)
+		return
+	}
+	ok, err := s.logs.delete(devidParam)
+	if err != nil {
+		errorWithJSON(w, r, http.StatusInternalServerError, "deleting logs: %s", err)
+		return
+	}
+	if !ok {
+		errorWithJSON(w, r, http.StatusNotFound, "no logs found for device '%s'", devidParam)
+		return
+	}
+	l.Info("Device logs deleted", zap.String("devid", devidParam))
+	w.WriteHeader(http.StatusNoContent)
+}
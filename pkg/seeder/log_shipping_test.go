@@ -0,0 +1,185 @@
+// Copyright 2023 Hedgehog
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package seeder
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"go.githedgehog.com/dasboot/pkg/seeder/config"
+	"go.githedgehog.com/dasboot/pkg/seeder/logship"
+)
+
+const (
+	testLogDevID   = "dc0cd8b3-3f0e-4ddb-8c6b-c8e1a0c0b0c4"
+	testLogSession = "5f1b7c1e-3d0f-4a59-9d4e-0f2e6d1c7a11"
+)
+
+func gzipLogChunk(t *testing.T, data string) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if _, err := zw.Write([]byte(data)); err != nil {
+		t.Fatal(err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestLogStore_retention(t *testing.T) {
+	ls, err := newLogStore(&config.LogShipping{Dir: t.TempDir(), MaxBytesPerDevice: 1024, MaxAge: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// an old chunk gets removed because of its age
+	old := &logship.ChunkInfo{InstallSession: "0b0a6c3c-7f4e-4f3e-8a36-8a0c3c1a9f00", Stage: "stage2"}
+	if err := ls.store(testLogDevID, old, gzipLogChunk(t, "{\"m\":\"old\"}\n")); err != nil {
+		t.Fatal(err)
+	}
+	oldPath := filepath.Join(ls.dir, testLogDevID, old.InstallSession, "0000000000-stage2.ndjson.gz")
+	twoHoursAgo := time.Now().Add(-2 * time.Hour)
+	if err := os.Chtimes(oldPath, twoHoursAgo, twoHoursAgo); err != nil {
+		t.Fatal(err)
+	}
+
+	// chunks which exceed the size limit remove the oldest ones
+	for i := uint64(0); i < 3; i++ {
+		ci := &logship.ChunkInfo{InstallSession: testLogSession, Stage: "stage2", Sequence: i}
+		// random data does not compress, so every chunk is larger than a third of the limit
+		data := make([]byte, 400)
+		if _, err := rand.Read(data); err != nil {
+			t.Fatal(err)
+		}
+		if err := ls.store(testLogDevID, ci, gzipLogChunk(t, string(data))); err != nil {
+			t.Fatal(err)
+		}
+		ts := time.Now().Add(time.Duration(i) * time.Second)
+		if err := os.Chtimes(filepath.Join(ls.dir, testLogDevID, testLogSession, ls.chunkName(ci)), ts, ts); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	got, err := ls.list()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 1 || len(got[0].Sessions) != 1 {
+		t.Fatalf("expected one device with one session, got %+v", got)
+	}
+	if got[0].Size > 1024 {
+		t.Errorf("device exceeds size limit: %d", got[0].Size)
+	}
+	if s := got[0].Sessions[0]; s.InstallSession != testLogSession || s.Chunks != 2 || len(s.Stages) != 1 || s.Stages[0] != "stage2" {
+		t.Errorf("unexpected session %+v", s)
+	}
+	if _, err := os.Stat(filepath.Dir(oldPath)); !os.IsNotExist(err) {
+		t.Errorf("expected old session directory to be removed, got %v", err)
+	}
+
+	ok, err := ls.delete(testLogDevID)
+	if err != nil || !ok {
+		t.Fatalf("delete = %v, %v", ok, err)
+	}
+	if got, _ := ls.list(); len(got) != 0 {
+		t.Errorf("expected no logs after delete, got %+v", got)
+	}
+}
+
+func TestLogShippingHandlers(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	deviceCert := &x509.Certificate{Subject: pkix.Name{CommonName: testLogDevID}, PublicKey: &key.PublicKey}
+	verified := &tls.ConnectionState{
+		PeerCertificates: []*x509.Certificate{deviceCert},
+		VerifiedChains:   [][]*x509.Certificate{{deviceCert}},
+	}
+	ls, err := newLogStore(&config.LogShipping{Dir: t.TempDir()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &seeder{logs: ls, limits: newLimits(nil)}
+
+	upload := func(seq uint64, data string, tlsState *tls.ConnectionState, tamper bool) int {
+		ci := &logship.ChunkInfo{InstallSession: testLogSession, Stage: "stage2", Sequence: seq}
+		body := gzipLogChunk(t, data)
+		digest, sig, err := logship.SignChunk(key, ci, body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tamper {
+			body = gzipLogChunk(t, "{\"m\":\"tampered\"}\n")
+		}
+		r := httptest.NewRequest(http.MethodPost, logShippingPath, bytes.NewReader(body))
+		r.TLS = tlsState
+		ci.SetHeaders(r.Header)
+		r.Header.Set(logship.HeaderDigest, digest)
+		r.Header.Set(logship.HeaderSignature, sig)
+		r.Header.Set("Content-Encoding", logship.ContentEncoding)
+		w := httptest.NewRecorder()
+		s.uploadLogsHandler(w, r)
+		return w.Code
+	}
+
+	if code := upload(0, "{\"m\":\"first\"}\n", verified, false); code != http.StatusNoContent {
+		t.Fatalf("upload status = %d, want %d", code, http.StatusNoContent)
+	}
+	if code := upload(1, "{\"m\":\"second\"}\n", verified, false); code != http.StatusNoContent {
+		t.Fatalf("upload status = %d, want %d", code, http.StatusNoContent)
+	}
+	if code := upload(2, "{\"m\":\"third\"}\n", nil, false); code != http.StatusForbidden {
+		t.Errorf("upload without TLS status = %d, want %d", code, http.StatusForbidden)
+	}
+	if code := upload(2, "{\"m\":\"third\"}\n", verified, true); code != http.StatusBadRequest {
+		t.Errorf("tampered upload status = %d, want %d", code, http.StatusBadRequest)
+	}
+
+	h := s.adminHandler()
+	r := httptest.NewRequest(http.MethodGet, adminLogsPath+"/"+testLogDevID+"?session="+testLogSession, nil)
+	r.RemoteAddr = "127.0.0.1:12345"
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("get logs status = %d, want %d: %s", w.Code, http.StatusOK, w.Body.String())
+	}
+	if got, want := w.Body.String(), "{\"m\":\"first\"}\n{\"m\":\"second\"}\n"; got != want {
+		t.Errorf("get logs = %q, want %q", got, want)
+	}
+
+	r = httptest.NewRequest(http.MethodGet, adminLogsPath+"/"+strings.Replace(testLogDevID, "dc", "cd", 1), nil)
+	r.RemoteAddr = "127.0.0.1:12345"
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	if w.Code != http.StatusNotFound {
+		t.Errorf("get logs of unknown device status = %d, want %d", w.Code, http.StatusNotFound)
+	}
+}
@@ -0,0 +1,161 @@
+// Copyright 2023 Hedgehog
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package logship
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+
+	"github.com/google/uuid"
+)
+
+// The headers which describe a log chunk. The body of the request is the compressed chunk itself.
+const (
+	HeaderInstallSession = "X-Dasboot-Install-Session"
+	HeaderStage          = "X-Dasboot-Stage"
+	HeaderSequence       = "X-Dasboot-Log-Sequence"
+	HeaderDigest         = "X-Dasboot-Log-Digest"
+	HeaderSignature      = "X-Dasboot-Log-Signature"
+)
+
+// ContentType is the content type of a decompressed log chunk: newline delimited JSON log entries
+const ContentType = "application/x-ndjson"
+
+// ContentEncoding is the compression of all log chunks
+//
+// NOTE: we would prefer zstd here, however, we are restricted to what the standard library provides
+// as the stages must stay small
+const ContentEncoding = "gzip"
+
+var (
+	ErrInvalidChunk     = errors.New("logship: invalid log chunk")
+	ErrDigestMismatch   = errors.New("logship: log chunk digest mismatch")
+	ErrInvalidSignature = errors.New("logship: invalid log chunk signature")
+	ErrUnsupportedKey   = errors.New("logship: unsupported key type")
+)
+
+var stageNameRegex = regexp.MustCompile(`^[a-z0-9][a-z0-9-]{0,62}$`)
+
+// ChunkInfo describes a chunk of logs which a device uploads to the seeder
+type ChunkInfo struct {
+	InstallSession string `json:"install_session"`
+	Stage          string `json:"stage"`
+	Sequence       uint64 `json:"sequence"`
+}
+
+func (ci *ChunkInfo) Validate() error {
+	if _, err := uuid.Parse(ci.InstallSession); err != nil {
+		return fmt.Errorf("%w: install session: %w", ErrInvalidChunk, err)
+	}
+	if !stageNameRegex.MatchString(ci.Stage) {
+		return fmt.Errorf("%w: stage '%s' is not a valid stage name", ErrInvalidChunk, ci.Stage)
+	}
+	return nil
+}
+
+// SetHeaders sets all chunk headers on `h`
+func (ci *ChunkInfo) SetHeaders(h http.Header) {
+	h.Set(HeaderInstallSession, ci.InstallSession)
+	h.Set(HeaderStage, ci.Stage)
+	h.Set(HeaderSequence, strconv.FormatUint(ci.Sequence, 10))
+}
+
+// ChunkInfoFromHeaders parses and validates the chunk information from the headers `h`
+func ChunkInfoFromHeaders(h http.Header) (*ChunkInfo, error) {
+	seq, err := strconv.ParseUint(h.Get(HeaderSequence), 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("%w: sequence: %w", ErrInvalidChunk, err)
+	}
+	ret := &ChunkInfo{
+		InstallSession: h.Get(HeaderInstallSession),
+		Stage:          h.Get(HeaderStage),
+		Sequence:       seq,
+	}
+	if err := ret.Validate(); err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
+
+// signedDigest is what gets signed for a chunk: it binds the compressed body to the install session,
+// stage and sequence number so that chunks cannot be replayed under a different identity
+func signedDigest(ci *ChunkInfo, bodyDigest []byte) []byte {
+	h := sha256.New()
+	fmt.Fprintf(h, "%s\n%s\n%d\n", ci.InstallSession, ci.Stage, ci.Sequence)
+	h.Write(bodyDigest)
+	return h.Sum(nil)
+}
+
+// SignChunk calculates the digest of the compressed `body` and signs it together with the chunk information
+// with `signer`. It returns the hex encoded digest and the base64 encoded signature.
+func SignChunk(signer crypto.Signer, ci *ChunkInfo, body []byte) (string, string, error) {
+	bodyDigest := sha256.Sum256(body)
+	digest := signedDigest(ci, bodyDigest[:])
+
+	var sig []byte
+	var err error
+	switch signer.Public().(type) {
+	case ed25519.PublicKey:
+		sig, err = signer.Sign(rand.Reader, digest, crypto.Hash(0))
+	case *ecdsa.PublicKey, *rsa.PublicKey:
+		sig, err = signer.Sign(rand.Reader, digest, crypto.SHA256)
+	default:
+		return "", "", fmt.Errorf("%w: %T", ErrUnsupportedKey, signer.Public())
+	}
+	if err != nil {
+		return "", "", fmt.Errorf("logship: signing chunk: %w", err)
+	}
+	return hex.EncodeToString(bodyDigest[:]), base64.StdEncoding.EncodeToString(sig), nil
+}
+
+// VerifyChunk verifies the `digest` and `signature` of the compressed `body` against the public key `pub` of the device.
+func VerifyChunk(pub crypto.PublicKey, ci *ChunkInfo, body []byte, digest, signature string) error {
+	bodyDigest := sha256.Sum256(body)
+	if hex.EncodeToString(bodyDigest[:]) != digest {
+		return ErrDigestMismatch
+	}
+	sig, err := base64.StdEncoding.DecodeString(signature)
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrInvalidSignature, err)
+	}
+	d := signedDigest(ci, bodyDigest[:])
+
+	var ok bool
+	switch key := pub.(type) {
+	case *ecdsa.PublicKey:
+		ok = ecdsa.VerifyASN1(key, d, sig)
+	case *rsa.PublicKey:
+		ok = rsa.VerifyPKCS1v15(key, crypto.SHA256, d, sig) == nil
+	case ed25519.PublicKey:
+		ok = ed25519.Verify(key, d, sig)
+	default:
+		return fmt.Errorf("%w: %T", ErrUnsupportedKey, pub)
+	}
+	if !ok {
+		return ErrInvalidSignature
+	}
+	return nil
+}
@@ -0,0 +1,237 @@
+// Copyright 2023 Hedgehog
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package logship
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"go.uber.org/zap"
+)
+
+const testSession = "5f1b7c1e-3d0f-4a59-9d4e-0f2e6d1c7a11"
+
+func TestVerifyChunk(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ci := &ChunkInfo{InstallSession: testSession, Stage: "stage2", Sequence: 3}
+	body := []byte("compressed")
+	digest, sig, err := SignChunk(key, ci, body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		modify  func(ci *ChunkInfo, body []byte) (*ChunkInfo, []byte, string)
+		wantErr error
+	}{
+		{
+			name: "valid",
+			modify: func(ci *ChunkInfo, body []byte) (*ChunkInfo, []byte, string) {
+				return ci, body, digest
+			},
+		},
+		{
+			name: "tampered body",
+			modify: func(ci *ChunkInfo, body []byte) (*ChunkInfo, []byte, string) {
+				return ci, []byte("tampered"), digest
+			},
+			wantErr: ErrDigestMismatch,
+		},
+		{
+			name: "replayed with different sequence",
+			modify: func(ci *ChunkInfo, body []byte) (*ChunkInfo, []byte, string) {
+				c := *ci
+				c.Sequence = 4
+				return &c, body, digest
+			},
+			wantErr: ErrInvalidSignature,
+		},
+		{
+			name: "replayed for different stage",
+			modify: func(ci *ChunkInfo, body []byte) (*ChunkInfo, []byte, string) {
+				c := *ci
+				c.Stage = "stage1"
+				return &c, body, digest
+			},
+			wantErr: ErrInvalidSignature,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, b, d := tt.modify(ci, body)
+			err := VerifyChunk(&key.PublicKey, c, b, d, sig)
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("VerifyChunk() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+
+	t.Run("wrong key", func(t *testing.T) {
+		if err := VerifyChunk(&otherKey.PublicKey, ci, body, digest, sig); !errors.Is(err, ErrInvalidSignature) {
+			t.Errorf("VerifyChunk() error = %v, wantErr %v", err, ErrInvalidSignature)
+		}
+	})
+}
+
+func TestShipper(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var mu sync.Mutex
+	var chunks []string
+	var seqs []uint64
+	fail := false
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		if fail {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		ci, err := ChunkInfoFromHeaders(r.Header)
+		if err != nil {
+			t.Errorf("chunk info: %v", err)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		body, _ := io.ReadAll(r.Body)
+		if err := VerifyChunk(&key.PublicKey, ci, body, r.Header.Get(HeaderDigest), r.Header.Get(HeaderSignature)); err != nil {
+			t.Errorf("verify chunk: %v", err)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		zr, err := gzip.NewReader(bytes.NewReader(body))
+		if err != nil {
+			t.Errorf("gzip: %v", err)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		data, _ := io.ReadAll(zr)
+		chunks = append(chunks, string(data))
+		seqs = append(seqs, ci.Sequence)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer ts.Close()
+
+	s, err := NewShipper(ts.Client(), ts.URL, key, testSession, "stage2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.chunkSize = 64
+	logger := NewLogger(zap.DebugLevel, s)
+
+	// the first message exceeds the chunk size and gets uploaded immediately
+	logger.Info("first message which is long enough to fill a whole chunk on its own")
+	mu.Lock()
+	if len(chunks) != 1 {
+		t.Fatalf("expected 1 chunk after the first message, got %d", len(chunks))
+	}
+	mu.Unlock()
+
+	// a failed upload retains the entries for the next upload
+	mu.Lock()
+	fail = true
+	mu.Unlock()
+	logger.Debug("second")
+	if err := s.Sync(); err == nil {
+		t.Fatal("expected sync to fail")
+	}
+	mu.Lock()
+	fail = false
+	mu.Unlock()
+	logger.Warn("third")
+	if err := logger.Sync(); err != nil {
+		t.Fatalf("sync: %v", err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(chunks) != 2 {
+		t.Fatalf("expected 2 chunks, got %d", len(chunks))
+	}
+	if seqs[0] != 0 || seqs[1] != 1 {
+		t.Errorf("unexpected sequence numbers %v", seqs)
+	}
+	if !strings.Contains(chunks[1], `"m":"second"`) || !strings.Contains(chunks[1], `"m":"third"`) {
+		t.Errorf("second chunk is missing entries: %s", chunks[1])
+	}
+	if s.Dropped() != 0 {
+		t.Errorf("expected no dropped bytes, got %d", s.Dropped())
+	}
+}
+
+func TestShipperDisables(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer ts.Close()
+
+	s, err := NewShipper(ts.Client(), ts.URL, key, testSession, "stage2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < maxConsecutiveFailures; i++ {
+		if _, err := s.Write([]byte("entry\n")); err != nil {
+			t.Fatalf("write: %v", err)
+		}
+		_ = s.Sync()
+	}
+	if err := s.Sync(); !errors.Is(err, ErrShippingDisabled) {
+		t.Fatalf("expected shipping to be disabled, got %v", err)
+	}
+	if _, err := s.Write([]byte("dropped\n")); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	if want := uint64(3*len("entry\n") + len("dropped\n")); s.Dropped() != want {
+		t.Errorf("Dropped() = %d, want %d", s.Dropped(), want)
+	}
+}
+
+func TestNewShipper(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewShipper(http.DefaultClient, "https://seeder/logs", key, "not-a-uuid", "stage2"); !errors.Is(err, ErrInvalidChunk) {
+		t.Errorf("expected invalid session to fail, got %v", err)
+	}
+	if _, err := NewShipper(http.DefaultClient, "https://seeder/logs", key, testSession, "Stage 2"); !errors.Is(err, ErrInvalidChunk) {
+		t.Errorf("expected invalid stage to fail, got %v", err)
+	}
+}
@@ -0,0 +1,207 @@
+// Copyright 2023 Hedgehog
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package logship
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"go.githedgehog.com/dasboot/pkg/stage"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+const (
+	// DefaultChunkSize is the amount of uncompressed log data after which a chunk gets uploaded
+	DefaultChunkSize = 256 * 1024
+
+	// maxBufferedChunks is the number of chunks which are being retained while uploads are failing
+	maxBufferedChunks = 4
+
+	// maxConsecutiveFailures is the number of failed uploads after which log shipping gets disabled
+	maxConsecutiveFailures = 3
+
+	uploadTimeout = 30 * time.Second
+)
+
+var ErrShippingDisabled = errors.New("logship: log shipping disabled after too many failed uploads")
+
+// Shipper is a zapcore.WriteSyncer which collects log entries and uploads them as compressed and signed
+// chunks to the seeder. A chunk is uploaded once it reaches the chunk size, and on every `Sync()`.
+//
+// Uploads happen synchronously as they are rare and log messages must not get lost when a stage
+// terminates. If uploads keep failing the shipper disables itself, so that an unreachable seeder
+// never slows down an installation for long.
+type Shipper struct {
+	hc        *http.Client
+	url       string
+	signer    crypto.Signer
+	session   string
+	stage     string
+	chunkSize int
+
+	mu       sync.Mutex
+	buf      bytes.Buffer
+	seq      uint64
+	failures int
+	disabled bool
+	dropped  uint64
+}
+
+var _ zapcore.WriteSyncer = &Shipper{}
+
+// NewShipper creates a shipper which uploads chunks for install session `session` and stage `stageName` to `shipURL`
+// with the HTTP client `hc`. Every chunk gets signed with `signer` which must be the key of the client certificate.
+func NewShipper(hc *http.Client, shipURL string, signer crypto.Signer, session string, stageName string) (*Shipper, error) {
+	ci := &ChunkInfo{InstallSession: session, Stage: stageName}
+	if err := ci.Validate(); err != nil {
+		return nil, err
+	}
+	if _, _, err := SignChunk(signer, ci, nil); err != nil {
+		return nil, err
+	}
+	return &Shipper{
+		hc:        hc,
+		url:       shipURL,
+		signer:    signer,
+		session:   session,
+		stage:     stageName,
+		chunkSize: DefaultChunkSize,
+	}, nil
+}
+
+// Write implements zapcore.WriteSyncer. It never fails as failing log destinations must not fail the caller.
+func (s *Shipper) Write(p []byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.disabled {
+		s.dropped += uint64(len(p))
+		return len(p), nil
+	}
+	s.buf.Write(p)
+	if s.buf.Len() >= s.chunkSize {
+		// a failed upload gets retried together with the next chunk
+		_ = s.flush()
+	}
+	return len(p), nil
+}
+
+// Sync implements zapcore.WriteSyncer. It uploads all buffered log entries.
+func (s *Shipper) Sync() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.disabled {
+		return ErrShippingDisabled
+	}
+	return s.flush()
+}
+
+// Dropped returns the number of bytes of log data which could not be shipped
+func (s *Shipper) Dropped() uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.dropped
+}
+
+// flush uploads the buffer as the next chunk. It must be called with the lock held.
+func (s *Shipper) flush() error {
+	if s.buf.Len() == 0 {
+		return nil
+	}
+	if err := s.upload(s.buf.Bytes()); err != nil {
+		s.failures++
+		if s.failures >= maxConsecutiveFailures {
+			s.disabled = true
+			s.dropped += uint64(s.buf.Len())
+			s.buf.Reset()
+			return fmt.Errorf("%w: %w", ErrShippingDisabled, err)
+		}
+		// keep the entries around to retry them with the next chunk, unless that gets out of hand
+		if s.buf.Len() >= maxBufferedChunks*s.chunkSize {
+			s.dropped += uint64(s.buf.Len())
+			s.buf.Reset()
+		}
+		return err
+	}
+	s.failures = 0
+	s.seq++
+	s.buf.Reset()
+	return nil
+}
+
+func (s *Shipper) upload(data []byte) error {
+	var body bytes.Buffer
+	zw := gzip.NewWriter(&body)
+	if _, err := zw.Write(data); err != nil {
+		return fmt.Errorf("logship: compressing chunk: %w", err)
+	}
+	if err := zw.Close(); err != nil {
+		return fmt.Errorf("logship: compressing chunk: %w", err)
+	}
+
+	ci := &ChunkInfo{InstallSession: s.session, Stage: s.stage, Sequence: s.seq}
+	digest, sig, err := SignChunk(s.signer, ci, body.Bytes())
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), uploadTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.url, &body)
+	if err != nil {
+		return err
+	}
+	ci.SetHeaders(req.Header)
+	req.Header.Set(HeaderDigest, digest)
+	req.Header.Set(HeaderSignature, sig)
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("Content-Type", ContentType)
+	req.Header.Set("Content-Encoding", ContentEncoding)
+
+	resp, err := s.hc.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusNoContent {
+		return stage.NewHTTPErrorFromBody(resp)
+	}
+	return nil
+}
+
+// NewLogger creates a JSON logger which ships all entries with `s`.
+func NewLogger(level zapcore.Level, s *Shipper) *zap.Logger {
+	enc := zapcore.NewJSONEncoder(zapcore.EncoderConfig{
+		TimeKey:        "t",
+		LevelKey:       "l",
+		NameKey:        "n",
+		CallerKey:      "c",
+		MessageKey:     "m",
+		StacktraceKey:  "s",
+		LineEnding:     zapcore.DefaultLineEnding,
+		EncodeLevel:    zapcore.LowercaseLevelEncoder,
+		EncodeTime:     zapcore.RFC3339NanoTimeEncoder,
+		EncodeDuration: zapcore.StringDurationEncoder,
+		EncodeCaller:   zapcore.ShortCallerEncoder,
+	})
+	return zap.New(zapcore.NewCore(enc, s, zap.NewAtomicLevelAt(level)), zap.AddCaller())
+}
@@ -0,0 +1,43 @@
+// Copyright 2023 Hedgehog
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package logship
+
+import (
+	"crypto"
+	"fmt"
+	"net/http"
+
+	"go.githedgehog.com/dasboot/pkg/log"
+	"go.githedgehog.com/dasboot/pkg/partitions/identity"
+	"go.githedgehog.com/dasboot/pkg/stage"
+)
+
+// StageLogger returns a logger for stage `stageName` which ships all messages to `shipURL`. The chunks are
+// being signed with the device key from the identity partition, so this requires a registered device.
+func StageLogger(hc *http.Client, shipURL string, ip identity.IdentityPartition, si *stage.StagingInfo, stageName string) (log.Interface, error) {
+	cert, err := ip.LoadX509KeyPair()
+	if err != nil {
+		return nil, fmt.Errorf("logship: loading device key: %w", err)
+	}
+	signer, ok := cert.PrivateKey.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("%w: %T", ErrUnsupportedKey, cert.PrivateKey)
+	}
+	s, err := NewShipper(hc, shipURL, signer, si.InstallSessionID, stageName)
+	if err != nil {
+		return nil, err
+	}
+	return log.NewZapWrappedLogger(NewLogger(si.LogSettings.Level, s)), nil
+}
@@ -0,0 +1,165 @@
+// Copyright 2023 Hedgehog
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package seeder
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"go.githedgehog.com/dasboot/pkg/seeder/config"
+)
+
+var ErrInvalidMaintenanceWindow = errors.New("seeder: invalid maintenance window")
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday,
+	"mon": time.Monday,
+	"tue": time.Tuesday,
+	"wed": time.Wednesday,
+	"thu": time.Thursday,
+	"fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+// maintenanceWindow is a parsed config.MaintenanceWindow. Start and end are minutes since midnight.
+type maintenanceWindow struct {
+	days  [7]bool
+	start int
+	end   int
+	loc   *time.Location
+}
+
+// maintenanceWindows are all windows of a device. The device may start installations if any of them is open.
+type maintenanceWindows []*maintenanceWindow
+
+func parseTimeOfDay(s string) (int, error) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, err
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+func parseMaintenanceWindow(cfg config.MaintenanceWindow) (*maintenanceWindow, error) {
+	ret := &maintenanceWindow{loc: time.UTC}
+	if len(cfg.Days) == 0 {
+		for i := range ret.days {
+			ret.days[i] = true
+		}
+	}
+	for _, day := range cfg.Days {
+		wd, ok := weekdays[strings.ToLower(day)]
+		if !ok {
+			return nil, fmt.Errorf("%w: unknown day '%s'", ErrInvalidMaintenanceWindow, day)
+		}
+		ret.days[wd] = true
+	}
+	var err error
+	if ret.start, err = parseTimeOfDay(cfg.Start); err != nil {
+		return nil, fmt.Errorf("%w: start: %w", ErrInvalidMaintenanceWindow, err)
+	}
+	if ret.end, err = parseTimeOfDay(cfg.End); err != nil {
+		return nil, fmt.Errorf("%w: end: %w", ErrInvalidMaintenanceWindow, err)
+	}
+	if cfg.TimeZone != "" {
+		if ret.loc, err = time.LoadLocation(cfg.TimeZone); err != nil {
+			return nil, fmt.Errorf("%w: time zone: %w", ErrInvalidMaintenanceWindow, err)
+		}
+	}
+	return ret, nil
+}
+
+func parseMaintenanceWindows(cfg map[string][]config.MaintenanceWindow) (map[string]maintenanceWindows, error) {
+	ret := make(map[string]maintenanceWindows, len(cfg))
+	for devid, windows := range cfg {
+		ws := make(maintenanceWindows, 0, len(windows))
+		for _, w := range windows {
+			mw, err := parseMaintenanceWindow(w)
+			if err != nil {
+				return nil, fmt.Errorf("maintenance window for device '%s': %w", devid, err)
+			}
+			ws = append(ws, mw)
+		}
+		ret[devid] = ws
+	}
+	return ret, nil
+}
+
+// contains returns true if the window is open at `t`
+func (w *maintenanceWindow) contains(t time.Time) bool {
+	lt := t.In(w.loc)
+	m := lt.Hour()*60 + lt.Minute()
+	wd := lt.Weekday()
+	switch {
+	case w.start == w.end:
+		return w.days[wd]
+	case w.start < w.end:
+		return w.days[wd] && m >= w.start && m < w.end
+	default:
+		// the window spans midnight, so early in the morning it belongs to the window of the previous day
+		if m >= w.start {
+			return w.days[wd]
+		}
+		return m < w.end && w.days[(wd+6)%7]
+	}
+}
+
+// next returns the next time after `t` at which the window opens
+func (w *maintenanceWindow) next(t time.Time) time.Time {
+	lt := t.In(w.loc)
+	for i := 0; i <= 7; i++ {
+		d := lt.AddDate(0, 0, i)
+		candidate := time.Date(d.Year(), d.Month(), d.Day(), w.start/60, w.start%60, 0, 0, w.loc)
+		if w.days[candidate.Weekday()] && candidate.After(t) {
+			return candidate
+		}
+	}
+	// unreachable for valid windows as at least one day is always set
+	return t
+}
+
+// open returns true if any of the windows is open at `t`. If it is not open, it returns the time at which
+// the next window opens.
+func (ws maintenanceWindows) open(t time.Time) (bool, time.Time) {
+	var next time.Time
+	for _, w := range ws {
+		if w.contains(t) {
+			return true, time.Time{}
+		}
+		if n := w.next(t); next.IsZero() || n.Before(next) {
+			next = n
+		}
+	}
+	return false, next
+}
+
+// installDeferral returns true if the device with `devid` must not start an installation at `now`
+// because it is outside of its maintenance windows, together with the duration until the next window opens
+func (lis *loadedInstallerSettings) installDeferral(devid string, now time.Time) (time.Duration, bool) {
+	ws, ok := lis.maintenanceWindows[devid]
+	if !ok {
+		ws = lis.maintenanceWindows["*"]
+	}
+	if len(ws) == 0 {
+		return 0, false
+	}
+	open, next := ws.open(now)
+	if open {
+		return 0, false
+	}
+	return next.Sub(now), true
+}
@@ -0,0 +1,143 @@
+// Copyright 2023 Hedgehog
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package seeder
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"go.githedgehog.com/dasboot/pkg/seeder/config"
+)
+
+func TestInstallDeferral(t *testing.T) {
+	const devid = "dc0cd8b3-3f0e-4ddb-8c6b-c8e1a0c0b0c4"
+	// 2024-01-03 is a Wednesday
+	at := func(day int, hour, min int) time.Time {
+		return time.Date(2024, 1, day, hour, min, 0, 0, time.UTC)
+	}
+	tests := []struct {
+		name           string
+		windows        map[string][]config.MaintenanceWindow
+		now            time.Time
+		wantDeferred   bool
+		wantRetryAfter time.Duration
+	}{
+		{
+			name: "no windows",
+			now:  at(3, 12, 0),
+		},
+		{
+			name:    "within daily window",
+			windows: map[string][]config.MaintenanceWindow{"*": {{Start: "10:00", End: "14:00"}}},
+			now:     at(3, 12, 0),
+		},
+		{
+			name:           "before daily window",
+			windows:        map[string][]config.MaintenanceWindow{"*": {{Start: "10:00", End: "14:00"}}},
+			now:            at(3, 9, 30),
+			wantDeferred:   true,
+			wantRetryAfter: 30 * time.Minute,
+		},
+		{
+			name:           "after daily window opens again the next day",
+			windows:        map[string][]config.MaintenanceWindow{"*": {{Start: "10:00", End: "14:00"}}},
+			now:            at(3, 14, 0),
+			wantDeferred:   true,
+			wantRetryAfter: 20 * time.Hour,
+		},
+		{
+			name:    "window spanning midnight after midnight",
+			windows: map[string][]config.MaintenanceWindow{"*": {{Days: []string{"tue"}, Start: "22:00", End: "04:00"}}},
+			now:     at(3, 3, 0),
+		},
+		{
+			name:           "window spanning midnight on the wrong day",
+			windows:        map[string][]config.MaintenanceWindow{"*": {{Days: []string{"wed"}, Start: "22:00", End: "04:00"}}},
+			now:            at(3, 3, 0),
+			wantDeferred:   true,
+			wantRetryAfter: 19 * time.Hour,
+		},
+		{
+			name:           "weekly window",
+			windows:        map[string][]config.MaintenanceWindow{"*": {{Days: []string{"sat", "sun"}, Start: "00:00", End: "00:00"}}},
+			now:            at(3, 12, 0),
+			wantDeferred:   true,
+			wantRetryAfter: 2*24*time.Hour + 12*time.Hour,
+		},
+		{
+			name: "earliest of multiple windows",
+			windows: map[string][]config.MaintenanceWindow{"*": {
+				{Start: "20:00", End: "21:00"},
+				{Start: "13:00", End: "14:00"},
+			}},
+			now:            at(3, 12, 0),
+			wantDeferred:   true,
+			wantRetryAfter: time.Hour,
+		},
+		{
+			name:    "device windows override default",
+			windows: map[string][]config.MaintenanceWindow{"*": {{Start: "10:00", End: "11:00"}}, devid: {{Start: "12:00", End: "13:00"}}},
+			now:     at(3, 12, 30),
+		},
+		{
+			name:    "empty device windows lift the restriction",
+			windows: map[string][]config.MaintenanceWindow{"*": {{Start: "10:00", End: "11:00"}}, devid: {}},
+			now:     at(3, 12, 30),
+		},
+		{
+			name:           "time zone",
+			windows:        map[string][]config.MaintenanceWindow{"*": {{Start: "10:00", End: "14:00", TimeZone: "Europe/Berlin"}}},
+			now:            at(3, 8, 0),
+			wantDeferred:   true,
+			wantRetryAfter: time.Hour,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ws, err := parseMaintenanceWindows(tt.windows)
+			if err != nil {
+				t.Fatal(err)
+			}
+			lis := &loadedInstallerSettings{maintenanceWindows: ws}
+			retryAfter, deferred := lis.installDeferral(devid, tt.now)
+			if deferred != tt.wantDeferred {
+				t.Fatalf("installDeferral() deferred = %v, want %v", deferred, tt.wantDeferred)
+			}
+			if retryAfter != tt.wantRetryAfter {
+				t.Errorf("installDeferral() retryAfter = %v, want %v", retryAfter, tt.wantRetryAfter)
+			}
+		})
+	}
+}
+
+func TestParseMaintenanceWindow(t *testing.T) {
+	tests := []struct {
+		name   string
+		window config.MaintenanceWindow
+	}{
+		{name: "unknown day", window: config.MaintenanceWindow{Days: []string{"someday"}, Start: "10:00", End: "11:00"}},
+		{name: "invalid start", window: config.MaintenanceWindow{Start: "25:00", End: "11:00"}},
+		{name: "missing end", window: config.MaintenanceWindow{Start: "10:00"}},
+		{name: "unknown time zone", window: config.MaintenanceWindow{Start: "10:00", End: "11:00", TimeZone: "Nowhere/Special"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := parseMaintenanceWindow(tt.window); !errors.Is(err, ErrInvalidMaintenanceWindow) {
+				t.Errorf("parseMaintenanceWindow() error = %v, want %v", err, ErrInvalidMaintenanceWindow)
+			}
+		})
+	}
+}
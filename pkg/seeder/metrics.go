@@ -0,0 +1,199 @@
+// Copyright 2023 Hedgehog
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package seeder
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"go.uber.org/zap"
+
+	"go.githedgehog.com/dasboot/pkg/seeder/controlplane"
+	"go.githedgehog.com/dasboot/pkg/seeder/registration"
+)
+
+const (
+	metricsPath      = "/metrics"
+	metricsNamespace = "dasboot_seeder"
+
+	// activeInstallationTTL is the time after which a device which started an installation is not being counted
+	// as an active installation anymore, even though we never heard of its outcome
+	activeInstallationTTL = 2 * time.Hour
+
+	// routeUnmatched is the route label for requests which did not match any route
+	routeUnmatched = "unmatched"
+)
+
+// metrics are the Prometheus metrics of a seeder. Every seeder has its own registry, so that more than one seeder
+// can run within the same process. All methods are safe to be called on a nil `*metrics`.
+type metrics struct {
+	registry            *prometheus.Registry
+	httpRequests        *prometheus.CounterVec
+	httpRequestDuration *prometheus.HistogramVec
+	artifactBytes       *prometheus.CounterVec
+	registrations       *prometheus.CounterVec
+
+	installsLock sync.Mutex
+	installs     map[string]time.Time
+}
+
+func newMetrics() *metrics {
+	m := &metrics{
+		registry: prometheus.NewRegistry(),
+		httpRequests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "http_requests_total",
+			Help:      "Number of HTTP requests per server and route.",
+		}, []string{"server", "route", "method", "code"}),
+		httpRequestDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Name:      "http_request_duration_seconds",
+			Help:      "Latency of HTTP requests per server and route. Artifact downloads make up the long tail.",
+			Buckets:   []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30, 60, 120, 300},
+		}, []string{"server", "route", "method"}),
+		artifactBytes: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "artifact_download_bytes_total",
+			Help:      "Number of bytes of artifacts which were sent to devices.",
+		}, []string{"artifact"}),
+		registrations: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "registrations_total",
+			Help:      "Number of processed registration requests per resulting registration status.",
+		}, []string{"status"}),
+		installs: make(map[string]time.Time),
+	}
+	m.registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		m.httpRequests,
+		m.httpRequestDuration,
+		m.artifactBytes,
+		m.registrations,
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "active_installations",
+			Help:      "Number of devices which started downloading a NOS installer, and did not finish or fail yet.",
+		}, func() float64 { return float64(m.activeInstallations()) }),
+	)
+	return m
+}
+
+// instrument is a middleware which records the request count and latency of every request to `server`
+func (m *metrics) instrument(server string) func(next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		if m == nil {
+			return next
+		}
+		fn := func(w http.ResponseWriter, r *http.Request) {
+			ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+			start := time.Now()
+			defer func() {
+				// the route pattern is only complete after the router has processed the request, and using the
+				// pattern instead of the path keeps the cardinality of the labels bounded
+				route := routeUnmatched
+				if rctx := chi.RouteContext(r.Context()); rctx != nil && rctx.RoutePattern() != "" {
+					route = rctx.RoutePattern()
+				}
+				status := ww.Status()
+				if status == 0 {
+					status = http.StatusOK
+				}
+				m.httpRequests.WithLabelValues(server, route, r.Method, strconv.Itoa(status)).Inc()
+				m.httpRequestDuration.WithLabelValues(server, route, r.Method).Observe(time.Since(start).Seconds())
+			}()
+			next.ServeHTTP(ww, r)
+		}
+		return http.HandlerFunc(fn)
+	}
+}
+
+func (m *metrics) addArtifactBytes(artifact string, n int64) {
+	if m == nil || n <= 0 {
+		return
+	}
+	m.artifactBytes.WithLabelValues(artifact).Add(float64(n))
+}
+
+func (m *metrics) recordRegistration(resp *registration.Response) {
+	if m == nil || resp == nil {
+		return
+	}
+	m.registrations.WithLabelValues(string(resp.Status)).Inc()
+}
+
+// recordDeviceEvent tracks the active installations from the lifecycle transitions of devices
+func (m *metrics) recordDeviceEvent(devid string, event controlplane.DeviceEvent) {
+	if m == nil || devid == "" {
+		return
+	}
+	m.installsLock.Lock()
+	defer m.installsLock.Unlock()
+	switch event { //nolint: exhaustive
+	case controlplane.DeviceEventInstalling:
+		m.installs[devid] = time.Now()
+	case controlplane.DeviceEventFailed, controlplane.DeviceEventCancelled:
+		delete(m.installs, devid)
+	}
+}
+
+// installationFinished is called once a device finished its installation
+func (m *metrics) installationFinished(devid string) {
+	if m == nil {
+		return
+	}
+	m.installsLock.Lock()
+	defer m.installsLock.Unlock()
+	delete(m.installs, devid)
+}
+
+func (m *metrics) activeInstallations() int {
+	m.installsLock.Lock()
+	defer m.installsLock.Unlock()
+	var ret int
+	for devid, started := range m.installs {
+		if time.Since(started) > activeInstallationTTL {
+			delete(m.installs, devid)
+			continue
+		}
+		ret++
+	}
+	return ret
+}
+
+func (s *seeder) metricsHandler() *chi.Mux {
+	r := chi.NewRouter()
+	r.Use(middleware.Recoverer)
+	r.Use(middleware.Heartbeat("/healthz"))
+	r.Method(http.MethodGet, metricsPath, promhttp.HandlerFor(s.metrics.registry, promhttp.HandlerOpts{
+		ErrorLog: promErrorLogger{},
+	}))
+	return r
+}
+
+// promErrorLogger logs errors of the metrics handler with our logger
+type promErrorLogger struct{}
+
+func (promErrorLogger) Println(v ...interface{}) {
+	l.Error("Serving metrics failed", zap.String("error", fmt.Sprint(v...)))
+}
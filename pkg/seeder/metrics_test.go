@@ -0,0 +1,97 @@
+// Copyright 2023 Hedgehog
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package seeder
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"go.githedgehog.com/dasboot/pkg/seeder/controlplane"
+	"go.githedgehog.com/dasboot/pkg/seeder/registration"
+)
+
+func scrapeMetrics(t *testing.T, s *seeder) string {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	s.metricsHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, metricsPath, nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("scraping metrics: status = %d, want %d", rec.Code, http.StatusOK)
+	}
+	b, err := io.ReadAll(rec.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
+
+func Test_metrics(t *testing.T) {
+	s := &seeder{metrics: newMetrics()}
+
+	r := chi.NewRouter()
+	r.Use(s.metrics.instrument("secure"))
+	r.Get("/artifacts/{artifact}", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("artifact")) //nolint: errcheck
+	})
+	for _, p := range []string{"/artifacts/one", "/artifacts/two", "/nope"} {
+		r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, p, nil))
+	}
+
+	s.metrics.addArtifactBytes("stage1-x86_64", 1024)
+	s.metrics.addArtifactBytes("stage1-x86_64", 1024)
+	s.metrics.recordRegistration(&registration.Response{Status: registration.RegistrationStatusApproved})
+	s.metrics.recordRegistration(&registration.Response{Status: registration.RegistrationStatusError})
+
+	s.metrics.recordDeviceEvent("dev1", controlplane.DeviceEventInstalling)
+	s.metrics.recordDeviceEvent("dev2", controlplane.DeviceEventInstalling)
+	s.metrics.recordDeviceEvent("dev3", controlplane.DeviceEventInstalling)
+	s.metrics.recordDeviceEvent("dev2", controlplane.DeviceEventFailed)
+	s.metrics.installationFinished("dev3")
+	// installations which we never hear of again do not count forever
+	s.metrics.installs["dev4"] = time.Now().Add(-activeInstallationTTL - time.Minute)
+
+	got := scrapeMetrics(t, s)
+	for _, want := range []string{
+		`dasboot_seeder_http_requests_total{code="200",method="GET",route="/artifacts/{artifact}",server="secure"} 2`,
+		`dasboot_seeder_http_requests_total{code="404",method="GET",route="unmatched",server="secure"} 1`,
+		`dasboot_seeder_http_request_duration_seconds_count{method="GET",route="/artifacts/{artifact}",server="secure"} 2`,
+		`dasboot_seeder_artifact_download_bytes_total{artifact="stage1-x86_64"} 2048`,
+		`dasboot_seeder_registrations_total{status="Approved"} 1`,
+		`dasboot_seeder_registrations_total{status="Error"} 1`,
+		`dasboot_seeder_active_installations 1`,
+		`go_goroutines`,
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("metrics do not contain %q:\n%s", want, got)
+		}
+	}
+
+	// a seeder without metrics must work all the same
+	var m *metrics
+	m.addArtifactBytes("stage1-x86_64", 1)
+	m.recordRegistration(&registration.Response{Status: registration.RegistrationStatusApproved})
+	m.recordDeviceEvent("dev1", controlplane.DeviceEventInstalling)
+	m.installationFinished("dev1")
+	rec := httptest.NewRecorder()
+	m.instrument("secure")(http.NotFoundHandler()).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("uninstrumented handler status = %d, want %d", rec.Code, http.StatusNotFound)
+	}
+}
@@ -0,0 +1,60 @@
+// Copyright 2023 Hedgehog
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package seeder
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"go.githedgehog.com/dasboot/pkg/log"
+	"go.githedgehog.com/dasboot/pkg/net"
+	"go.githedgehog.com/dasboot/pkg/partitions/location"
+	wiring1alpha2 "go.githedgehog.com/fabric/api/wiring/v1alpha2"
+	"go.uber.org/zap"
+)
+
+// neighbourSwitchByLLDP finds the switch by the LLDP neighbours which the device reported. It returns nil
+// if none of them lead to a switch.
+func (s *seeder) neighbourSwitchByLLDP(ctx context.Context, neighbors []*net.LLDPNeighbor) (*wiring1alpha2.Switch, *wiring1alpha2.Connection) {
+	for _, neighbor := range neighbors {
+		if neighbor == nil {
+			continue
+		}
+		sw, conn, err := s.cpc.GetNeighbourSwitchByLLDP(ctx, neighbor)
+		if err != nil {
+			log.L().Debug("failed to discover switch by LLDP neighbor", zap.Reflect("neighbor", neighbor), zap.Error(err))
+			continue
+		}
+		log.L().Info("Discovered switch by LLDP neighbor", zap.String("switch", sw.Name), zap.Reflect("neighbor", neighbor))
+		return sw, conn
+	}
+	return nil, nil
+}
+
+// switchLocation returns the location information of the switch `sw` as we serve it to devices
+func switchLocation(sw *wiring1alpha2.Switch) (*location.Info, error) {
+	md, err := json.Marshal(&sw.Spec.Location)
+	if err != nil {
+		return nil, fmt.Errorf("marshaling location information of switch '%s': %w", sw.Name, err)
+	}
+	locationUUID, _ := sw.Spec.Location.GenerateUUID()
+	return &location.Info{
+		UUID:        locationUUID,
+		UUIDSig:     []byte(sw.Spec.LocationSig.UUIDSig),
+		Metadata:    string(md),
+		MetadataSig: []byte(sw.Spec.LocationSig.Sig),
+	}, nil
+}
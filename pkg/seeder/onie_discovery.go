@@ -0,0 +1,146 @@
+// Copyright 2023 Hedgehog
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package seeder
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// onieInstallerPrefix is the prefix of all ONIE default installer file names
+const onieInstallerPrefix = "onie-installer"
+
+// onieArchs are the CPU architectures as they are used by ONIE in its default installer file names
+var onieArchs = map[string]struct{}{
+	"x86_64": {},
+	"arm64":  {},
+	"arm":    {},
+}
+
+// onieInstallerName is an ONIE default installer file name broken up into its parts. ONIE tries the following
+// file names in order during its discovery, all of them optionally with a ".bin" suffix:
+//
+//	onie-installer-<arch>-<vendor>_<machine>-r<machine_revision>
+//	onie-installer-<arch>-<vendor>_<machine>
+//	onie-installer-<vendor>_<machine>
+//	onie-installer-<arch>
+//	onie-installer
+type onieInstallerName struct {
+	Arch       string
+	Vendor     string
+	Machine    string
+	MachineRev string
+}
+
+// parseONIEInstallerName parses an ONIE default installer file name. All parts which are not in the name are empty.
+func parseONIEInstallerName(name string) onieInstallerName {
+	var ret onieInstallerName
+	name = strings.TrimSuffix(name, ".bin")
+	rest, ok := strings.CutPrefix(name, onieInstallerPrefix+"-")
+	if !ok {
+		return ret
+	}
+	parts := strings.Split(rest, "-")
+	if _, ok := onieArchs[parts[0]]; ok {
+		ret.Arch = parts[0]
+		parts = parts[1:]
+	}
+	if len(parts) == 0 {
+		return ret
+	}
+	vendor, machine, ok := strings.Cut(parts[0], "_")
+	if !ok || vendor == "" || machine == "" {
+		return ret
+	}
+	ret.Vendor, ret.Machine = vendor, machine
+	if len(parts) == 2 {
+		if rev, ok := strings.CutPrefix(parts[1], "r"); ok && isDigits(rev) {
+			ret.MachineRev = rev
+		}
+	}
+	return ret
+}
+
+func isDigits(s string) bool {
+	if s == "" {
+		return false
+	}
+	for _, c := range s {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// fillFromHeaders fills all parts which were not in the file name from the ONIE request headers
+func (n *onieInstallerName) fillFromHeaders(h http.Header) {
+	if n.Arch == "" {
+		if arch := h.Get("ONIE-ARCH"); arch != "" {
+			if _, ok := onieArchs[arch]; ok {
+				n.Arch = arch
+			}
+		}
+	}
+	if n.Vendor == "" || n.Machine == "" {
+		if vendor, machine, ok := strings.Cut(h.Get("ONIE-MACHINE"), "_"); ok && vendor != "" && machine != "" {
+			n.Vendor, n.Machine = vendor, machine
+		}
+	}
+	if n.MachineRev == "" {
+		if rev := h.Get("ONIE-MACHINE-REV"); isDigits(rev) {
+			n.MachineRev = rev
+		}
+	}
+}
+
+// Platform returns the ONIE platform identifier of the name as ONIE uses it as `onie_platform` in its
+// machine.conf, e.g. "x86_64-accton_as7726_32x-r0". It returns an empty string if any part is missing.
+func (n onieInstallerName) Platform() string {
+	if n.Arch == "" || n.Vendor == "" || n.Machine == "" || n.MachineRev == "" {
+		return ""
+	}
+	return n.Arch + "-" + n.Vendor + "_" + n.Machine + "-r" + n.MachineRev
+}
+
+// archFromONIEInstallerName derives the CPU architecture from an ONIE default installer file name.
+// It returns an empty string if the name does not contain the architecture.
+func archFromONIEInstallerName(name string) string {
+	return parseONIEInstallerName(name).Arch
+}
+
+// getONIEDiscoveryArtifact is the ONIE discovery responder: it serves stage 0 on all the ONIE default installer
+// file names. All parts which are not in the file name are taken from the ONIE request headers which ONIE sends
+// with every request. If the platform is known, a platform specific stage 0 build (e.g. the artifact
+// "stage0-x86_64-accton_as7726_32x-r0") takes precedence over the architecture specific one, and the platform
+// is embedded into the stage 0 configuration if the request headers are missing.
+func (s *seeder) getONIEDiscoveryArtifact(w http.ResponseWriter, r *http.Request) {
+	name := parseONIEInstallerName(onieInstallerPrefix + "-" + chi.URLParam(r, "name"))
+	name.fillFromHeaders(r.Header)
+
+	// let the stage 0 handler deal with it: it serves the fallback script if there is no architecture
+	if rctx := chi.RouteContext(r.Context()); rctx != nil && name.Arch != "" {
+		rctx.URLParams.Add("arch", name.Arch)
+		if platform := name.Platform(); platform != "" {
+			rctx.URLParams.Add("platform", platform)
+			rctx.URLParams.Add("vendor", name.Vendor)
+			rctx.URLParams.Add("machine", name.Machine)
+			rctx.URLParams.Add("machine_revision", name.MachineRev)
+		}
+	}
+	s.getStage0Artifact(w, r)
+}
@@ -0,0 +1,106 @@
+// Copyright 2023 Hedgehog
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package seeder
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestArchFromONIEInstallerName(t *testing.T) {
+	tests := []struct {
+		name string
+		want string
+	}{
+		{name: "onie-installer-x86_64-accton_as7726_32x-r0.bin", want: "x86_64"},
+		{name: "onie-installer-x86_64-accton_as7726_32x-r0", want: "x86_64"},
+		{name: "onie-installer-arm64-celestica_ds4101.bin", want: "arm64"},
+		{name: "onie-installer-arm", want: "arm"},
+		{name: "onie-installer-accton_as7726_32x.bin"},
+		{name: "onie-installer.bin"},
+		{name: "onie-installer"},
+		{name: "onie-installer-powerpc"},
+		{name: "onie-updater-x86_64"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := archFromONIEInstallerName(tt.name); got != tt.want {
+				t.Errorf("archFromONIEInstallerName() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseONIEInstallerName(t *testing.T) {
+	tests := []struct {
+		name         string
+		headers      map[string]string
+		want         onieInstallerName
+		wantPlatform string
+	}{
+		{
+			name:         "onie-installer-x86_64-accton_as7726_32x-r0.bin",
+			want:         onieInstallerName{Arch: "x86_64", Vendor: "accton", Machine: "as7726_32x", MachineRev: "0"},
+			wantPlatform: "x86_64-accton_as7726_32x-r0",
+		},
+		{
+			name: "onie-installer-x86_64-accton_as7726_32x",
+			want: onieInstallerName{Arch: "x86_64", Vendor: "accton", Machine: "as7726_32x"},
+		},
+		{
+			name:         "onie-installer-x86_64-accton_as7726_32x",
+			headers:      map[string]string{"ONIE-MACHINE-REV": "1"},
+			want:         onieInstallerName{Arch: "x86_64", Vendor: "accton", Machine: "as7726_32x", MachineRev: "1"},
+			wantPlatform: "x86_64-accton_as7726_32x-r1",
+		},
+		{
+			name:         "onie-installer-celestica_ds4101.bin",
+			headers:      map[string]string{"ONIE-ARCH": "arm64", "ONIE-MACHINE": "accton_as4630_54pe", "ONIE-MACHINE-REV": "2"},
+			want:         onieInstallerName{Arch: "arm64", Vendor: "celestica", Machine: "ds4101", MachineRev: "2"},
+			wantPlatform: "arm64-celestica_ds4101-r2",
+		},
+		{
+			name:         "onie-installer",
+			headers:      map[string]string{"ONIE-ARCH": "x86_64", "ONIE-MACHINE": "dell_s5248f", "ONIE-MACHINE-REV": "0"},
+			want:         onieInstallerName{Arch: "x86_64", Vendor: "dell", Machine: "s5248f", MachineRev: "0"},
+			wantPlatform: "x86_64-dell_s5248f-r0",
+		},
+		{
+			name:    "onie-installer-x86_64-accton_as7726_32x-rx",
+			headers: map[string]string{"ONIE-MACHINE-REV": "invalid"},
+			want:    onieInstallerName{Arch: "x86_64", Vendor: "accton", Machine: "as7726_32x"},
+		},
+		{
+			name:    "onie-installer-powerpc",
+			headers: map[string]string{"ONIE-ARCH": "powerpc"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := http.Header{}
+			for k, v := range tt.headers {
+				h.Set(k, v)
+			}
+			got := parseONIEInstallerName(tt.name)
+			got.fillFromHeaders(h)
+			if got != tt.want {
+				t.Errorf("parseONIEInstallerName() = %#v, want %#v", got, tt.want)
+			}
+			if platform := got.Platform(); platform != tt.wantPlatform {
+				t.Errorf("Platform() = %v, want %v", platform, tt.wantPlatform)
+			}
+		})
+	}
+}
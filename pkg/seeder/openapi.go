@@ -0,0 +1,508 @@
+// Copyright 2023 Hedgehog
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package seeder
+
+import (
+	"encoding"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.githedgehog.com/dasboot/pkg/partitions/identity"
+	"go.githedgehog.com/dasboot/pkg/seeder/config"
+	"go.githedgehog.com/dasboot/pkg/seeder/firstboot"
+	"go.githedgehog.com/dasboot/pkg/seeder/ipam"
+	"go.githedgehog.com/dasboot/pkg/seeder/logship"
+	"go.githedgehog.com/dasboot/pkg/seeder/recovery"
+	"go.githedgehog.com/dasboot/pkg/seeder/registration"
+	"go.githedgehog.com/dasboot/pkg/seeder/revocation"
+	"go.githedgehog.com/dasboot/pkg/stage"
+	"go.githedgehog.com/dasboot/pkg/version"
+)
+
+// openAPIPath is the route on every server which serves the OpenAPI document of that server
+const openAPIPath = "/openapi.json"
+
+// API identifies one of the HTTP APIs which are served by the seeder
+type API string
+
+const (
+	APIInsecure API = "insecure"
+	APISecure   API = "secure"
+	APIAdmin    API = "admin"
+)
+
+// APIs are all the HTTP APIs which are served by the seeder
+var APIs = []API{APIInsecure, APISecure, APIAdmin}
+
+// apiFeatures are the optional features of the seeder which change the routes of its APIs
+type apiFeatures struct {
+	onieDiscovery   bool
+	logShipping     bool
+	uploads         bool
+	identityBackups bool
+}
+
+func apiFeaturesFromConfig(cfg *config.SeederConfig) apiFeatures {
+	return apiFeatures{
+		onieDiscovery:   cfg.InsecureServer != nil && cfg.InsecureServer.ONIEDiscovery,
+		logShipping:     cfg.LogShipping != nil,
+		uploads:         cfg.DiagnosticsUploads != nil && cfg.DiagnosticsUploads.Dir != "",
+		identityBackups: cfg.InstallerSettings != nil && cfg.InstallerSettings.IdentityBackups,
+	}
+}
+
+func (s *seeder) apiFeatures() apiFeatures {
+	return apiFeatures{
+		onieDiscovery:   s.onieDiscovery,
+		logShipping:     s.logs != nil,
+		uploads:         s.uploads != nil,
+		identityBackups: s.installerSettings != nil && s.installerSettings.identityBackups,
+	}
+}
+
+// apiResponse describes a single response of an API operation
+type apiResponse struct {
+	status      int
+	description string
+	// contentType is the content type of the response body, it defaults to "application/json" if `body` is set
+	contentType string
+	// body is a value of the type which is being returned as JSON
+	body any
+}
+
+// apiOperation describes a route of one of the seeder APIs. The list of operations is the
+// source for the OpenAPI documents, and tests ensure that it matches the registered routes.
+type apiOperation struct {
+	method  string
+	path    string
+	summary string
+	// query are the names of the optional query parameters
+	query []string
+	// request is a value of the type which is expected as JSON request body
+	request any
+	// requestContentType is the content type of a non-JSON request body
+	requestContentType string
+	responses          []apiResponse
+	// available returns false if the route is not registered with the given features
+	available func(apiFeatures) bool
+}
+
+func withONIEDiscovery(f apiFeatures) bool    { return f.onieDiscovery }
+func withoutONIEDiscovery(f apiFeatures) bool { return !f.onieDiscovery }
+func withLogShipping(f apiFeatures) bool      { return f.logShipping }
+func withUploads(f apiFeatures) bool          { return f.uploads }
+func withIdentityBackups(f apiFeatures) bool  { return f.identityBackups }
+
+var (
+	artifactResponse    = apiResponse{status: http.StatusOK, description: "The artifact", contentType: "application/octet-stream"}
+	noContentResponse   = apiResponse{status: http.StatusNoContent, description: "The request was processed successfully"}
+	openAPIDocOperation = apiOperation{method: http.MethodGet, path: openAPIPath, summary: "OpenAPI document of this API", responses: []apiResponse{{status: http.StatusOK, description: "The OpenAPI v3 document", body: map[string]any{}}}}
+	healthzAPIResponse  = apiResponse{status: http.StatusOK, description: "The server is up", contentType: "text/plain"}
+	healthzOperation    = apiOperation{method: http.MethodGet, path: "/healthz", summary: "Liveness check of the server", responses: []apiResponse{healthzAPIResponse}}
+	probeResponses      = []apiResponse{
+		{status: http.StatusOK, description: "All checks passed", body: ProbeStatus{}},
+		{status: http.StatusServiceUnavailable, description: "At least one check failed", body: ProbeStatus{}},
+	}
+	livenessOperation  = apiOperation{method: http.MethodGet, path: healthzPath, summary: "Liveness check of the seeder, it fails if certificates cannot be loaded or expired", responses: probeResponses}
+	readinessOperation = apiOperation{method: http.MethodGet, path: readyzPath, summary: "Readiness check of the seeder, it fails if artifacts or the control plane are unreachable", responses: probeResponses}
+)
+
+// rangedArtifactResponses are the responses for artifacts which are not being generated per request,
+// as they can be downloaded in byte ranges
+var rangedArtifactResponses = []apiResponse{
+	artifactResponse,
+	{status: http.StatusPartialContent, description: "A byte range of the artifact", contentType: "application/octet-stream"},
+}
+
+var apiOperations = map[API][]apiOperation{
+	APIInsecure: {
+		livenessOperation,
+		readinessOperation,
+		openAPIDocOperation,
+		{method: http.MethodGet, path: "/onie-installer-{name}", summary: "ONIE discovery responder for all ONIE default installer file names", responses: []apiResponse{artifactResponse}, available: withONIEDiscovery},
+		{method: http.MethodGet, path: "/onie-installer.bin", summary: "ONIE discovery responder for the ONIE default installer file name", responses: []apiResponse{artifactResponse}, available: withONIEDiscovery},
+		{method: http.MethodGet, path: "/onie-installer", summary: "Stage 0 installer, the architecture is taken from the ONIE headers", responses: []apiResponse{artifactResponse}},
+		{method: http.MethodGet, path: "/onie-installer-{arch}", summary: "Stage 0 installer for an architecture", responses: []apiResponse{artifactResponse}, available: withoutONIEDiscovery},
+		{method: http.MethodGet, path: "/onie-updater-{arch}-{vendor}_{machine}-r{machine_revision}", summary: "ONIE updater for a platform", responses: rangedArtifactResponses},
+		{method: http.MethodGet, path: "/onie-updater", summary: "ONIE updater, the platform is taken from the ONIE headers", responses: rangedArtifactResponses},
+		{method: http.MethodGet, path: "/stage0/{arch}", summary: "Stage 0 installer for an architecture", responses: []apiResponse{artifactResponse}},
+		{method: http.MethodGet, path: path.Join(platformSupportPathBase, "{platform}"), summary: "Platform support bundle for a platform", responses: rangedArtifactResponses},
+		{method: http.MethodPost, path: ipamPath, summary: "Requests IP addresses and routes for the management interfaces of a device", request: ipam.Request{}, responses: []apiResponse{
+			{status: http.StatusOK, description: "The IP addresses and routes", body: ipam.Response{}},
+			{status: http.StatusConflict, description: "The addresses are leased to another device", body: stage.HTTPError{}},
+			{status: http.StatusServiceUnavailable, description: "The installation is deferred, retry after the time in the Retry-After header", body: stage.HTTPError{}},
+		}},
+		{method: http.MethodPost, path: recoveryPath, summary: "Reports a failed installation of a device", request: recovery.Report{}, responses: []apiResponse{noContentResponse}},
+	},
+	APISecure: {
+		livenessOperation,
+		readinessOperation,
+		openAPIDocOperation,
+		{method: http.MethodGet, path: path.Join(stage1PathBase, "{arch}"), summary: "Stage 1 installer for an architecture", responses: []apiResponse{artifactResponse}},
+		{method: http.MethodGet, path: path.Join(stage2PathBase, "{arch}"), summary: "Stage 2 installer for an architecture", responses: []apiResponse{artifactResponse}},
+		{method: http.MethodPost, path: registerPath, summary: "Submits a device registration request", request: registration.Request{}, responses: []apiResponse{
+			{status: http.StatusOK, description: "The registration was approved or rejected", body: registration.Response{}},
+			{status: http.StatusAccepted, description: "The registration is pending", body: registration.Response{}},
+			{status: registration.HTTPProcessError, description: "The registration could not be processed", body: registration.Response{}},
+		}},
+		{method: http.MethodGet, path: path.Join(registerPath, "{devid}"), summary: "Polls the status of a device registration", responses: []apiResponse{
+			{status: http.StatusOK, description: "The registration was approved or rejected", body: registration.Response{}},
+			{status: http.StatusAccepted, description: "The registration is pending", body: registration.Response{}},
+			{status: registration.HTTPRegistrationRequestNotFound, description: "There is no registration request for the device", body: registration.Response{}},
+			{status: registration.HTTPProcessError, description: "The registration could not be processed", body: registration.Response{}},
+		}},
+		{method: http.MethodPost, path: renewPath, summary: "Renews the client certificate of a registered device for its existing key", request: registration.RenewalRequest{}, responses: []apiResponse{
+			{status: http.StatusOK, description: "The renewal was approved or rejected", body: registration.Response{}},
+			{status: http.StatusAccepted, description: "The renewal is pending", body: registration.Response{}},
+			{status: registration.HTTPRegistrationRequestNotFound, description: "The device is not registered anymore", body: registration.Response{}},
+			{status: registration.HTTPProcessError, description: "The renewal could not be processed", body: registration.Response{}},
+		}},
+		{method: http.MethodGet, path: caBundlePath, summary: "Versioned CA bundle of the secure server", responses: []apiResponse{{status: http.StatusOK, description: "The CA bundle", body: stage.CABundle{}}}},
+		{method: http.MethodPost, path: logShippingPath, summary: "Uploads a signed chunk of the installation logs of a device", requestContentType: logship.ContentType, responses: []apiResponse{noContentResponse}, available: withLogShipping},
+		{method: http.MethodPost, path: diagnosticsUploadsPath, summary: "Starts or continues an upload of a diagnostic file of a device", request: stage.DiagnosticsUploadRequest{}, responses: []apiResponse{
+			{status: http.StatusCreated, description: "The upload was started", body: stage.DiagnosticsUpload{}},
+			{status: http.StatusOK, description: "The upload exists already and continues at its offset", body: stage.DiagnosticsUpload{}},
+		}, available: withUploads},
+		{method: http.MethodGet, path: path.Join(diagnosticsUploadsPath, "{id}"), summary: "Status of an upload of a diagnostic file", responses: []apiResponse{{status: http.StatusOK, description: "The upload", body: stage.DiagnosticsUpload{}}}, available: withUploads},
+		{method: http.MethodPatch, path: path.Join(diagnosticsUploadsPath, "{id}"), summary: "Uploads the chunk of a diagnostic file at the offset in the Upload-Offset header", requestContentType: "application/octet-stream", responses: []apiResponse{
+			{status: http.StatusOK, description: "The upload with its new offset", body: stage.DiagnosticsUpload{}},
+			{status: http.StatusConflict, description: "The offset does not match the upload, get its status to continue", body: stage.HTTPError{}},
+		}, available: withUploads},
+		{method: http.MethodGet, path: path.Join(nosInstallerPathBase, "{platform}", "{devid}"), summary: "NOS installer for a device", responses: rangedArtifactResponses},
+		{method: http.MethodGet, path: path.Join(onieUpdaterPathBase, "{platform}"), summary: "ONIE updater for a platform", responses: rangedArtifactResponses},
+		{method: http.MethodGet, path: path.Join(hhAgentProvisionerPathBase, "{arch}"), summary: "Hedgehog agent provisioner for an architecture", responses: []apiResponse{artifactResponse}},
+		{method: http.MethodGet, path: path.Join(hhAgentProvisionerPathBase, "agent", "{devid}"), summary: "Hedgehog agent for a device", responses: rangedArtifactResponses},
+		{method: http.MethodGet, path: path.Join(hhAgentProvisionerPathBase, "agent", "config", "{devid}"), summary: "Hedgehog agent configuration for a device", responses: []apiResponse{{status: http.StatusOK, description: "The agent configuration", contentType: "application/yaml"}}},
+		{method: http.MethodGet, path: path.Join(hhAgentProvisionerPathBase, "agent", "kubeconfig", "{devid}"), summary: "Hedgehog agent kubeconfig for a device", responses: []apiResponse{{status: http.StatusOK, description: "The agent kubeconfig", contentType: "application/yaml"}}},
+		{method: http.MethodGet, path: path.Join(hhAgentProvisionerPathBase, "agent", "firstboot", "{devid}"), summary: "Signed first boot payload for a device", responses: []apiResponse{{status: http.StatusOK, description: "The signed first boot payload", body: firstboot.Envelope{}}}},
+		{method: http.MethodGet, path: path.Join(deviceMetadataPathBase, "{devid}"), summary: "Planned host name and role of a device", responses: []apiResponse{{status: http.StatusOK, description: "The device metadata", body: stage.DeviceMetadata{}}}},
+		{method: http.MethodGet, path: path.Join(installCancellationPath, "{devid}"), summary: "Whether the installation of a device in the install session in the query was cancelled", query: []string{stage.QueryInstallSession}, responses: []apiResponse{{status: http.StatusOK, description: "The cancellation status", body: stage.InstallCancellation{}}}},
+		{method: http.MethodPost, path: path.Join(installCancellationPath, "{devid}"), summary: "Reports that a device aborted a cancelled installation", request: stage.InstallCancellationReport{}, responses: []apiResponse{noContentResponse}},
+		{method: http.MethodPost, path: identityBackupPath, summary: "Stores the encrypted identity backup of a registered device", request: identity.Backup{}, responses: []apiResponse{noContentResponse}, available: withIdentityBackups},
+		{method: http.MethodGet, path: path.Join(identityBackupPath, "{devid}"), summary: "Encrypted identity backup of a device", responses: []apiResponse{{status: http.StatusOK, description: "The identity backup", body: identity.Backup{}}}, available: withIdentityBackups},
+	},
+	APIAdmin: {
+		healthzOperation,
+		openAPIDocOperation,
+		{method: http.MethodGet, path: adminOverridesPath, summary: "Lists the artifact overrides of all devices", responses: []apiResponse{{status: http.StatusOK, description: "The artifact overrides by device ID", body: map[string][]ArtifactOverride{}}}},
+		{method: http.MethodGet, path: path.Join(adminOverridesPath, "{devid}"), summary: "Lists the artifact overrides of a device", responses: []apiResponse{{status: http.StatusOK, description: "The artifact overrides", body: []ArtifactOverride{}}}},
+		{method: http.MethodPut, path: path.Join(adminOverridesPath, "{devid}"), summary: "Creates or replaces an artifact override of a device", request: ArtifactOverrideRequest{}, responses: []apiResponse{{status: http.StatusOK, description: "The artifact override", body: ArtifactOverride{}}}},
+		{method: http.MethodDelete, path: path.Join(adminOverridesPath, "{devid}"), summary: "Deletes the artifact overrides of a device, or only the one of the artifact in the query", query: []string{"artifact"}, responses: []apiResponse{noContentResponse}},
+		{method: http.MethodGet, path: path.Join(adminArtifactsPath, "{artifact}", "provenance"), summary: "Provenance of an artifact", responses: []apiResponse{{status: http.StatusOK, description: "The artifact provenance", body: version.ArtifactProvenance{}}}},
+		{method: http.MethodGet, path: adminLimitsPath, summary: "Status of the request limits", responses: []apiResponse{{status: http.StatusOK, description: "The limits status", body: LimitsStatus{}}}},
+		{method: http.MethodGet, path: adminRecoveryPath, summary: "Lists the received recovery reports", responses: []apiResponse{{status: http.StatusOK, description: "The recovery reports", body: []*ReceivedRecoveryReport{}}}},
+		{method: http.MethodDelete, path: path.Join(adminRecoveryPath, "{devid}"), summary: "Deletes the recovery reports of a device", responses: []apiResponse{noContentResponse}},
+		{method: http.MethodGet, path: adminRegistrationsPath, summary: "Lists the registrations which are pending approval", responses: []apiResponse{{status: http.StatusOK, description: "The pending registrations", body: []registration.PendingRegistration{}}}},
+		{method: http.MethodPut, path: path.Join(adminRegistrationsPath, "{devid}"), summary: "Approves the pending registration of a device", responses: []apiResponse{noContentResponse}},
+		{method: http.MethodDelete, path: path.Join(adminRegistrationsPath, "{devid}"), summary: "Denies the pending registration of a device", responses: []apiResponse{noContentResponse}},
+		{method: http.MethodGet, path: adminLeasesPath, summary: "Lists the IPAM leases of all devices", responses: []apiResponse{{status: http.StatusOK, description: "The IPAM leases", body: []ipam.Lease{}}}},
+		{method: http.MethodDelete, path: path.Join(adminLeasesPath, "{devid}"), summary: "Releases the IPAM lease of a device", responses: []apiResponse{noContentResponse}},
+		{method: http.MethodGet, path: adminRevocationsPath, summary: "Lists the revoked devices", responses: []apiResponse{{status: http.StatusOK, description: "The revocations", body: []*revocation.Revocation{}}}},
+		{method: http.MethodPut, path: path.Join(adminRevocationsPath, "{devid}"), summary: "Revokes the client certificates of a device", request: RevocationRequest{}, responses: []apiResponse{{status: http.StatusOK, description: "The revocation", body: revocation.Revocation{}}}},
+		{method: http.MethodDelete, path: path.Join(adminRevocationsPath, "{devid}"), summary: "Lifts the revocation of a device", responses: []apiResponse{noContentResponse}},
+		{method: http.MethodGet, path: adminCancellationsPath, summary: "Lists the cancelled installations", responses: []apiResponse{{status: http.StatusOK, description: "The install cancellations", body: []*InstallCancellation{}}}},
+		{method: http.MethodPut, path: path.Join(adminCancellationsPath, "{devid}"), summary: "Cancels the installation of a device", request: InstallCancellationRequest{}, responses: []apiResponse{{status: http.StatusOK, description: "The install cancellation", body: InstallCancellation{}}}},
+		{method: http.MethodDelete, path: path.Join(adminCancellationsPath, "{devid}"), summary: "Lifts the install cancellation of a device", responses: []apiResponse{noContentResponse}},
+		{method: http.MethodGet, path: adminLogsPath, summary: "Lists the shipped logs of all devices", responses: []apiResponse{{status: http.StatusOK, description: "The device logs", body: []*DeviceLogs{}}}},
+		{method: http.MethodGet, path: path.Join(adminLogsPath, "{devid}"), summary: "Shipped logs of a device, or only of the install session in the query", query: []string{"session"}, responses: []apiResponse{{status: http.StatusOK, description: "The logs as newline delimited JSON", contentType: logship.ContentType}}},
+		{method: http.MethodDelete, path: path.Join(adminLogsPath, "{devid}"), summary: "Deletes the shipped logs of a device", responses: []apiResponse{noContentResponse}},
+		{method: http.MethodGet, path: adminDownloadsPath, summary: "Lists the active artifact download sessions", responses: []apiResponse{{status: http.StatusOK, description: "The download sessions", body: []DownloadSession{}}}},
+		{method: http.MethodGet, path: adminUploadsPath, summary: "Lists the diagnostics uploads of all devices", responses: []apiResponse{{status: http.StatusOK, description: "The diagnostics uploads", body: []*DiagnosticsUpload{}}}},
+		{method: http.MethodGet, path: path.Join(adminUploadsPath, "{devid}", "{id}"), summary: "Diagnostic file of a complete upload", responses: []apiResponse{{status: http.StatusOK, description: "The diagnostic file", contentType: "application/octet-stream"}}},
+		{method: http.MethodDelete, path: path.Join(adminUploadsPath, "{devid}", "{id}"), summary: "Deletes a diagnostics upload", responses: []apiResponse{noContentResponse}},
+		{method: http.MethodGet, path: path.Join(adminIdentityPath, "{devid}"), summary: "Expected public identity document of a device", responses: []apiResponse{{status: http.StatusOK, description: "The public identity document", body: identity.PublicDocument{}}}},
+		{method: http.MethodGet, path: path.Join(adminDevicesPath, "{devid}", "diagnostics"), summary: "Diagnostics bundle of a device", responses: []apiResponse{{status: http.StatusOK, description: "The diagnostics bundle as gzipped tarball", contentType: "application/gzip"}}},
+	},
+}
+
+// openAPIDocument is the subset of an OpenAPI v3 document which is needed to describe the seeder APIs
+type openAPIDocument struct {
+	OpenAPI    string                                  `json:"openapi"`
+	Info       openAPIInfo                             `json:"info"`
+	Paths      map[string]map[string]*openAPIOperation `json:"paths"`
+	Components openAPIComponents                       `json:"components"`
+}
+
+type openAPIInfo struct {
+	Title   string `json:"title"`
+	Version string `json:"version"`
+}
+
+type openAPIComponents struct {
+	Schemas map[string]*openAPISchema `json:"schemas,omitempty"`
+}
+
+type openAPIOperation struct {
+	OperationID string                      `json:"operationId"`
+	Summary     string                      `json:"summary"`
+	Parameters  []openAPIParameter          `json:"parameters,omitempty"`
+	RequestBody *openAPIRequestBody         `json:"requestBody,omitempty"`
+	Responses   map[string]*openAPIResponse `json:"responses"`
+}
+
+type openAPIParameter struct {
+	Name     string         `json:"name"`
+	In       string         `json:"in"`
+	Required bool           `json:"required"`
+	Schema   *openAPISchema `json:"schema"`
+}
+
+type openAPIRequestBody struct {
+	Required bool                        `json:"required"`
+	Content  map[string]openAPIMediaType `json:"content"`
+}
+
+type openAPIResponse struct {
+	Description string                      `json:"description"`
+	Content     map[string]openAPIMediaType `json:"content,omitempty"`
+}
+
+type openAPIMediaType struct {
+	Schema *openAPISchema `json:"schema"`
+}
+
+type openAPISchema struct {
+	Ref                  string                    `json:"$ref,omitempty"`
+	Type                 string                    `json:"type,omitempty"`
+	Format               string                    `json:"format,omitempty"`
+	Items                *openAPISchema            `json:"items,omitempty"`
+	Properties           map[string]*openAPISchema `json:"properties,omitempty"`
+	AdditionalProperties *openAPISchema            `json:"additionalProperties,omitempty"`
+}
+
+// openAPIComponentRefPrefix is the prefix of all references to schemas in the components of the document
+const openAPIComponentRefPrefix = "#/components/schemas/"
+
+var openAPIPathParamRegexp = regexp.MustCompile(`\{([^}]+)\}`)
+
+// OpenAPIDocument returns the OpenAPI v3 document in JSON of the given API as it is being served
+// by a seeder with the configuration `cfg`
+func OpenAPIDocument(cfg *config.SeederConfig, api API) ([]byte, error) {
+	doc, err := newOpenAPIDocument(api, apiFeaturesFromConfig(cfg))
+	if err != nil {
+		return nil, err
+	}
+	return json.MarshalIndent(doc, "", "  ")
+}
+
+func newOpenAPIDocument(api API, features apiFeatures) (*openAPIDocument, error) {
+	ops, ok := apiOperations[api]
+	if !ok {
+		return nil, fmt.Errorf("unknown API '%s'", api)
+	}
+	g := &openAPISchemaGenerator{schemas: map[string]*openAPISchema{}}
+	errorSchema := g.schemaFor(reflect.TypeOf(stage.HTTPError{}))
+	doc := &openAPIDocument{
+		OpenAPI: "3.0.3",
+		Info: openAPIInfo{
+			Title:   fmt.Sprintf("Hedgehog seeder %s API", api),
+			Version: version.Version,
+		},
+		Paths: map[string]map[string]*openAPIOperation{},
+	}
+	for _, op := range ops {
+		if op.available != nil && !op.available(features) {
+			continue
+		}
+		method := strings.ToLower(op.method)
+		if _, ok := doc.Paths[op.path][method]; ok {
+			return nil, fmt.Errorf("duplicate operation '%s %s'", op.method, op.path)
+		}
+		o := &openAPIOperation{
+			OperationID: openAPIOperationID(op.method, op.path),
+			Summary:     op.summary,
+			Responses: map[string]*openAPIResponse{
+				"default": {
+					Description: "Error",
+					Content:     map[string]openAPIMediaType{"application/json": {Schema: errorSchema}},
+				},
+			},
+		}
+		for _, m := range openAPIPathParamRegexp.FindAllStringSubmatch(op.path, -1) {
+			o.Parameters = append(o.Parameters, openAPIParameter{Name: m[1], In: "path", Required: true, Schema: &openAPISchema{Type: "string"}})
+		}
+		for _, q := range op.query {
+			o.Parameters = append(o.Parameters, openAPIParameter{Name: q, In: "query", Schema: &openAPISchema{Type: "string"}})
+		}
+		switch {
+		case op.request != nil:
+			o.RequestBody = &openAPIRequestBody{
+				Required: true,
+				Content:  map[string]openAPIMediaType{"application/json": {Schema: g.schemaFor(reflect.TypeOf(op.request))}},
+			}
+		case op.requestContentType != "":
+			o.RequestBody = &openAPIRequestBody{
+				Required: true,
+				Content:  map[string]openAPIMediaType{op.requestContentType: {Schema: &openAPISchema{Type: "string", Format: "binary"}}},
+			}
+		}
+		for _, resp := range op.responses {
+			r := &openAPIResponse{Description: resp.description}
+			switch {
+			case resp.body != nil:
+				ct := resp.contentType
+				if ct == "" {
+					ct = "application/json"
+				}
+				r.Content = map[string]openAPIMediaType{ct: {Schema: g.schemaFor(reflect.TypeOf(resp.body))}}
+			case resp.contentType != "":
+				r.Content = map[string]openAPIMediaType{resp.contentType: {Schema: &openAPISchema{Type: "string", Format: "binary"}}}
+			}
+			o.Responses[strconv.Itoa(resp.status)] = r
+		}
+		if doc.Paths[op.path] == nil {
+			doc.Paths[op.path] = map[string]*openAPIOperation{}
+		}
+		doc.Paths[op.path][method] = o
+	}
+	doc.Components.Schemas = g.schemas
+	return doc, nil
+}
+
+// openAPIOperationID derives a stable operation ID from the method and the route, e.g. "get_register_devid"
+func openAPIOperationID(method, route string) string {
+	var sb strings.Builder
+	sb.WriteString(strings.ToLower(method))
+	lastUnderscore := false
+	for _, c := range route {
+		if (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9') {
+			sb.WriteRune(c)
+			lastUnderscore = false
+			continue
+		}
+		if !lastUnderscore {
+			sb.WriteRune('_')
+			lastUnderscore = true
+		}
+	}
+	return strings.TrimSuffix(sb.String(), "_")
+}
+
+var (
+	timeType          = reflect.TypeOf(time.Time{})
+	jsonMarshalerType = reflect.TypeOf((*json.Marshaler)(nil)).Elem()
+	textMarshalerType = reflect.TypeOf((*encoding.TextMarshaler)(nil)).Elem()
+)
+
+// openAPISchemaGenerator derives schemas from Go types the same way as encoding/json marshals them.
+// Named structs are added to the components of the document and referenced.
+type openAPISchemaGenerator struct {
+	schemas map[string]*openAPISchema
+}
+
+func implements(t reflect.Type, iface reflect.Type) bool {
+	return t.Implements(iface) || reflect.PointerTo(t).Implements(iface)
+}
+
+func (g *openAPISchemaGenerator) schemaFor(t reflect.Type) *openAPISchema {
+	switch {
+	case t == timeType:
+		return &openAPISchema{Type: "string", Format: "date-time"}
+	case implements(t, jsonMarshalerType):
+		// we cannot know what custom marshalers produce, so any value is allowed
+		return &openAPISchema{}
+	case implements(t, textMarshalerType):
+		return &openAPISchema{Type: "string"}
+	}
+
+	switch t.Kind() { //nolint: exhaustive
+	case reflect.Pointer:
+		return g.schemaFor(t.Elem())
+	case reflect.Bool:
+		return &openAPISchema{Type: "boolean"}
+	case reflect.Int8, reflect.Int16, reflect.Int32, reflect.Uint8, reflect.Uint16:
+		return &openAPISchema{Type: "integer", Format: "int32"}
+	case reflect.Int, reflect.Int64, reflect.Uint, reflect.Uint32, reflect.Uint64:
+		return &openAPISchema{Type: "integer", Format: "int64"}
+	case reflect.Float32:
+		return &openAPISchema{Type: "number", Format: "float"}
+	case reflect.Float64:
+		return &openAPISchema{Type: "number", Format: "double"}
+	case reflect.String:
+		return &openAPISchema{Type: "string"}
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 && t.Kind() == reflect.Slice {
+			return &openAPISchema{Type: "string", Format: "byte"}
+		}
+		return &openAPISchema{Type: "array", Items: g.schemaFor(t.Elem())}
+	case reflect.Map:
+		return &openAPISchema{Type: "object", AdditionalProperties: g.schemaFor(t.Elem())}
+	case reflect.Struct:
+		if t.Name() == "" {
+			return g.structSchema(t)
+		}
+		name := path.Base(t.PkgPath()) + "." + t.Name()
+		if _, ok := g.schemas[name]; !ok {
+			// register it first, so that recursive types terminate
+			g.schemas[name] = &openAPISchema{}
+			*g.schemas[name] = *g.structSchema(t)
+		}
+		return &openAPISchema{Ref: openAPIComponentRefPrefix + name}
+	default:
+		return &openAPISchema{}
+	}
+}
+
+func (g *openAPISchemaGenerator) structSchema(t reflect.Type) *openAPISchema {
+	ret := &openAPISchema{Type: "object", Properties: map[string]*openAPISchema{}}
+	g.addStructFields(ret, t)
+	return ret
+}
+
+func (g *openAPISchemaGenerator) addStructFields(schema *openAPISchema, t reflect.Type) {
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		tag := f.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		name, _, _ := strings.Cut(tag, ",")
+		if f.Anonymous && name == "" {
+			ft := f.Type
+			if ft.Kind() == reflect.Pointer {
+				ft = ft.Elem()
+			}
+			if ft.Kind() == reflect.Struct {
+				g.addStructFields(schema, ft)
+				continue
+			}
+		}
+		if !f.IsExported() {
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+		schema.Properties[name] = g.schemaFor(f.Type)
+	}
+}
+
+func (s *seeder) getOpenAPIDocument(api API) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		doc, err := newOpenAPIDocument(api, s.apiFeatures())
+		if err != nil {
+			errorWithJSON(w, r, http.StatusInternalServerError, "generating OpenAPI document: %s", err)
+			return
+		}
+		writeJSON(w, r, http.StatusOK, doc)
+	}
+}
@@ -0,0 +1,251 @@
+// Copyright 2023 Hedgehog
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package seeder
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/go-chi/chi/v5"
+
+	"go.githedgehog.com/dasboot/pkg/seeder/config"
+)
+
+func openAPITestSeeder(t *testing.T, features apiFeatures) *seeder {
+	s := &seeder{
+		ecg:           &embeddedConfigGenerator{},
+		limits:        newLimits(nil),
+		onieDiscovery: features.onieDiscovery,
+	}
+	if features.logShipping {
+		ls, err := newLogStore(&config.LogShipping{Dir: t.TempDir()})
+		if err != nil {
+			t.Fatal(err)
+		}
+		s.logs = ls
+	}
+	if features.identityBackups {
+		s.installerSettings = &loadedInstallerSettings{identityBackups: true}
+	}
+	if features.uploads {
+		us, err := newUploadStore(&config.DiagnosticsUploads{Dir: t.TempDir()})
+		if err != nil {
+			t.Fatal(err)
+		}
+		s.uploads = us
+	}
+	return s
+}
+
+func registeredRoutes(t *testing.T, r chi.Routes, heartbeat bool) []string {
+	var ret []string
+	if heartbeat {
+		// the heartbeat middleware serves this route, so it is not part of the router
+		ret = append(ret, http.MethodGet+" /healthz")
+	}
+	if err := chi.Walk(r, func(method string, route string, _ http.Handler, _ ...func(http.Handler) http.Handler) error {
+		if route != "/" {
+			route = strings.TrimSuffix(route, "/")
+		}
+		ret = append(ret, method+" "+route)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+func documentedRoutes(t *testing.T, api API, features apiFeatures) []string {
+	doc, err := newOpenAPIDocument(api, features)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ret []string
+	for p, ops := range doc.Paths {
+		for method := range ops {
+			ret = append(ret, strings.ToUpper(method)+" "+p)
+		}
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+func TestOpenAPIDocumentMatchesRoutes(t *testing.T) {
+	for _, features := range []apiFeatures{
+		{},
+		{onieDiscovery: true},
+		{logShipping: true},
+		{onieDiscovery: true, logShipping: true},
+		{uploads: true},
+		{identityBackups: true},
+	} {
+		s := openAPITestSeeder(t, features)
+		for _, api := range APIs {
+			var h chi.Routes
+			switch api {
+			case APIInsecure:
+				h = s.insecureHandler()
+			case APISecure:
+				h = s.secureHandler()
+			case APIAdmin:
+				h = s.adminHandler()
+			}
+			got := documentedRoutes(t, api, features)
+			want := registeredRoutes(t, h, api == APIAdmin)
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("%s API with features %+v: documented routes = %v, registered routes = %v", api, features, got, want)
+			}
+		}
+	}
+}
+
+func collectOpenAPIRefs(v any, refs map[string]struct{}) {
+	switch x := v.(type) {
+	case map[string]any:
+		for k, e := range x {
+			if ref, ok := e.(string); ok && k == "$ref" {
+				refs[ref] = struct{}{}
+				continue
+			}
+			collectOpenAPIRefs(e, refs)
+		}
+	case []any:
+		for _, e := range x {
+			collectOpenAPIRefs(e, refs)
+		}
+	}
+}
+
+func TestOpenAPIDocumentValid(t *testing.T) {
+	features := apiFeatures{logShipping: true}
+	for _, api := range APIs {
+		doc, err := newOpenAPIDocument(api, features)
+		if err != nil {
+			t.Fatalf("%s: %s", api, err)
+		}
+		operationIDs := map[string]string{}
+		for p, ops := range doc.Paths {
+			var params []string
+			for _, m := range openAPIPathParamRegexp.FindAllStringSubmatch(p, -1) {
+				params = append(params, m[1])
+			}
+			for method, op := range ops {
+				if op.Summary == "" {
+					t.Errorf("%s: %s %s: missing summary", api, method, p)
+				}
+				if other, ok := operationIDs[op.OperationID]; ok {
+					t.Errorf("%s: %s %s: operation ID '%s' already used by %s", api, method, p, op.OperationID, other)
+				}
+				operationIDs[op.OperationID] = method + " " + p
+				var declared []string
+				for _, param := range op.Parameters {
+					if param.In == "path" {
+						declared = append(declared, param.Name)
+					}
+				}
+				if !reflect.DeepEqual(declared, params) {
+					t.Errorf("%s: %s %s: declared path parameters %v, want %v", api, method, p, declared, params)
+				}
+				if len(op.Responses) < 2 {
+					t.Errorf("%s: %s %s: missing success response", api, method, p)
+				}
+			}
+		}
+
+		b, err := json.Marshal(doc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var generic map[string]any
+		if err := json.Unmarshal(b, &generic); err != nil {
+			t.Fatal(err)
+		}
+		refs := map[string]struct{}{}
+		collectOpenAPIRefs(generic, refs)
+		for ref := range refs {
+			name := strings.TrimPrefix(ref, openAPIComponentRefPrefix)
+			if _, ok := doc.Components.Schemas[name]; !ok {
+				t.Errorf("%s: unresolved schema reference '%s'", api, ref)
+			}
+		}
+	}
+}
+
+func TestOpenAPISchemaGenerator(t *testing.T) {
+	type inner struct {
+		Name string `json:"name"`
+	}
+	type Embedded struct {
+		Flattened bool `json:"flattened"`
+	}
+	type outer struct {
+		Embedded
+		Inner   *inner            `json:"inner,omitempty"`
+		Data    []byte            `json:"data"`
+		Labels  map[string]string `json:"labels"`
+		Numbers []uint16          `json:"numbers"`
+		Ignored string            `json:"-"`
+		NoTag   int64
+		private string //nolint: unused
+	}
+	g := &openAPISchemaGenerator{schemas: map[string]*openAPISchema{}}
+	got := g.schemaFor(reflect.TypeOf(outer{}))
+	if want := openAPIComponentRefPrefix + "seeder.outer"; got.Ref != want {
+		t.Fatalf("ref = %q, want %q", got.Ref, want)
+	}
+	want := &openAPISchema{Type: "object", Properties: map[string]*openAPISchema{
+		"flattened": {Type: "boolean"},
+		"inner":     {Ref: openAPIComponentRefPrefix + "seeder.inner"},
+		"data":      {Type: "string", Format: "byte"},
+		"labels":    {Type: "object", AdditionalProperties: &openAPISchema{Type: "string"}},
+		"numbers":   {Type: "array", Items: &openAPISchema{Type: "integer", Format: "int32"}},
+		"NoTag":     {Type: "integer", Format: "int64"},
+	}}
+	if !reflect.DeepEqual(g.schemas["seeder.outer"], want) {
+		gotJSON, _ := json.Marshal(g.schemas["seeder.outer"])
+		wantJSON, _ := json.Marshal(want)
+		t.Errorf("schema = %s, want %s", gotJSON, wantJSON)
+	}
+	if _, ok := g.schemas["seeder.inner"]; !ok {
+		t.Errorf("inner struct schema was not added to the components")
+	}
+}
+
+func TestServeOpenAPIDocument(t *testing.T) {
+	s := openAPITestSeeder(t, apiFeatures{})
+	r := httptest.NewRequest(http.MethodGet, openAPIPath, nil)
+	r.RemoteAddr = "127.0.0.1:12345"
+	w := httptest.NewRecorder()
+	s.adminHandler().ServeHTTP(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d: %s", w.Code, http.StatusOK, w.Body.String())
+	}
+	var doc openAPIDocument
+	if err := json.Unmarshal(w.Body.Bytes(), &doc); err != nil {
+		t.Fatal(err)
+	}
+	if doc.OpenAPI != "3.0.3" {
+		t.Errorf("openapi = %q, want %q", doc.OpenAPI, "3.0.3")
+	}
+	if _, ok := doc.Paths[adminOverridesPath]["get"]; !ok {
+		t.Errorf("document is missing the overrides route")
+	}
+}
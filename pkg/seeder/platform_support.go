@@ -0,0 +1,94 @@
+// Copyright 2023 Hedgehog
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package seeder
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"path"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
+	"go.uber.org/zap"
+
+	config0 "go.githedgehog.com/dasboot/pkg/stage0/config"
+)
+
+const platformSupportPathBase = "/stage0/platform-support"
+
+// platformSupportArtifact returns the artifact name of the platform support bundle for `platform`
+// which is an ONIE platform string like "x86_64-accton_as7726_32x-r0"
+func platformSupportArtifact(platform string) string {
+	return "platform-support-" + platform
+}
+
+// onieHeadersPlatform returns the ONIE platform string of the device which sent `onieHeaders`,
+// or an empty string if the headers are incomplete
+func onieHeadersPlatform(onieHeaders *config0.OnieHeaders) string {
+	if onieHeaders == nil || onieHeaders.Arch == "" || onieHeaders.Machine == "" {
+		return ""
+	}
+	return fmt.Sprintf("%s-%s-r%d", onieHeaders.Arch, onieHeaders.Machine, onieHeaders.MachineRev)
+}
+
+func (s *seeder) getPlatformSupportArtifact(authz func(*http.Request) error) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if err := authz(r); err != nil {
+			errorWithJSON(w, r, http.StatusForbidden, "unauthorized access to artifact: %s", err)
+			return
+		}
+		platformParam := chi.URLParam(r, "platform")
+		if platformParam == "" {
+			errorWithJSON(w, r, http.StatusBadRequest, "no platform in URL")
+			return
+		}
+		s.getArtifact(platformSupportArtifact(platformParam))(w, r)
+	}
+}
+
+// platformSupport returns the platform support bundle settings for the stage 0 config of the device which sent
+// `onieHeaders`. It returns nil if there is no platform support bundle for the platform of the device.
+func (s *seeder) platformSupport(r *http.Request, scheme string, onieHeaders *config0.OnieHeaders) *config0.PlatformSupport {
+	platform := onieHeadersPlatform(onieHeaders)
+	if platform == "" {
+		return nil
+	}
+
+	// most platforms don't need a bundle, so we check for its existence first to not warn about it
+	artifact := platformSupportArtifact(platform)
+	f := s.artifactsProvider.Get(artifact)
+	if f == nil {
+		return nil
+	}
+	f.Close()
+
+	// the bundle is served over plain HTTP, so it is only usable with a pin
+	pin := s.artifactPin(r, artifact)
+	if pin == nil {
+		l.Warn("Not serving platform support bundle as pinning it failed", zap.String("request", middleware.GetReqID(r.Context())), zap.String("platform", platform))
+		return nil
+	}
+	u := url.URL{
+		Scheme: scheme,
+		Host:   r.Host,
+		Path:   path.Join(platformSupportPathBase, platform),
+	}
+	return &config0.PlatformSupport{
+		Platform: platform,
+		URL:      u.String(),
+		Pin:      pin,
+	}
+}
@@ -0,0 +1,212 @@
+// Copyright 2023 Hedgehog
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package seeder
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+
+	"go.githedgehog.com/dasboot/pkg/seeder/artifacts"
+	"go.githedgehog.com/dasboot/pkg/seeder/config"
+)
+
+const (
+	healthzPath = "/healthz"
+	readyzPath  = "/readyz"
+
+	// probeTimeout bounds the time all checks of a probe may take, it must stay below the timeout of the kubelet
+	probeTimeout = 3 * time.Second
+
+	ProbeStatusOK     = "ok"
+	ProbeStatusFailed = "failed"
+)
+
+// ProbeStatus is the response of the health and readiness probes of the seeder servers
+type ProbeStatus struct {
+	// Status is "ok" if all checks passed, and "failed" otherwise
+	Status string `json:"status"`
+
+	// Checks are the results of all checks which were run
+	Checks []ProbeCheck `json:"checks"`
+}
+
+// ProbeCheck is the result of a single check of a probe
+type ProbeCheck struct {
+	Name  string `json:"name"`
+	OK    bool   `json:"ok"`
+	Error string `json:"error,omitempty"`
+}
+
+type probeCheck struct {
+	name  string
+	check func(context.Context) error
+}
+
+// certificateFile is a certificate, and optionally its key, which the seeder loaded from disk at startup
+type certificateFile struct {
+	name     string
+	certPath string
+	keyPath  string
+}
+
+// certificateFiles returns all certificates and keys of `cfg` which must stay loadable. Kubernetes rotates
+// them underneath the seeder, so a broken or expired rotation must be noticed.
+func certificateFiles(cfg *config.SeederConfig) []certificateFile {
+	var ret []certificateFile
+	add := func(name, certPath, keyPath string) {
+		if certPath != "" {
+			ret = append(ret, certificateFile{name: name, certPath: certPath, keyPath: keyPath})
+		}
+	}
+	var insecureServer *config.BindInfo
+	if cfg.InsecureServer != nil {
+		insecureServer = cfg.InsecureServer.Generic
+	}
+	servers := []struct {
+		name string
+		bi   *config.BindInfo
+	}{
+		{"insecure server", insecureServer},
+		{"secure server", cfg.SecureServer},
+		{"admin server", cfg.AdminServer},
+		{"metrics server", cfg.MetricsServer},
+	}
+	for _, srv := range servers {
+		// the certificates are ignored without a key, see BindInfo
+		if srv.bi == nil || srv.bi.ServerKeyPath == "" {
+			continue
+		}
+		add(srv.name, srv.bi.ServerCertPath, srv.bi.ServerKeyPath)
+		add(srv.name+" client CA", srv.bi.ClientCAPath, "")
+	}
+	if cfg.EmbeddedConfigGenerator != nil {
+		add("embedded config generator", cfg.EmbeddedConfigGenerator.CertPath, cfg.EmbeddedConfigGenerator.KeyPath)
+	}
+	if cfg.InstallerSettings != nil {
+		add("server CA", cfg.InstallerSettings.ServerCAPath, "")
+		add("server CA bundle", cfg.InstallerSettings.ServerCABundlePath, "")
+		add("config signature CA", cfg.InstallerSettings.ConfigSignatureCAPath, "")
+	}
+	if cfg.RegistrySettings != nil && cfg.RegistrySettings.KeyPath != "" {
+		add("registry CA", cfg.RegistrySettings.CertPath, cfg.RegistrySettings.KeyPath)
+	}
+	return ret
+}
+
+// check ensures that the certificate and its key can be loaded, and that none of the certificates expired
+func (cf certificateFile) check(now time.Time) error {
+	var ders [][]byte
+	if cf.keyPath != "" {
+		kp, err := tls.LoadX509KeyPair(cf.certPath, cf.keyPath)
+		if err != nil {
+			return fmt.Errorf("%s: %w", cf.name, err)
+		}
+		ders = kp.Certificate
+	} else {
+		b, err := os.ReadFile(cf.certPath)
+		if err != nil {
+			return fmt.Errorf("%s: %w", cf.name, err)
+		}
+		for p, rest := pem.Decode(b); p != nil; p, rest = pem.Decode(rest) {
+			if p.Type == "CERTIFICATE" {
+				ders = append(ders, p.Bytes)
+			}
+		}
+		if len(ders) == 0 {
+			return fmt.Errorf("%s: no certificates in '%s'", cf.name, cf.certPath)
+		}
+	}
+	for _, der := range ders {
+		cert, err := x509.ParseCertificate(der)
+		if err != nil {
+			return fmt.Errorf("%s: parsing certificate from '%s': %w", cf.name, cf.certPath, err)
+		}
+		if now.After(cert.NotAfter) {
+			return fmt.Errorf("%s: certificate '%s' from '%s' expired at %s", cf.name, cert.Subject.CommonName, cf.certPath, cert.NotAfter.Format(time.RFC3339))
+		}
+	}
+	return nil
+}
+
+func (s *seeder) checkCertificates(context.Context) error {
+	now := time.Now()
+	for _, cf := range s.certificates {
+		if err := cf.check(now); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *seeder) checkArtifactsProvider(ctx context.Context) error {
+	if s.artifactsProvider == nil {
+		return nil
+	}
+	return artifacts.CheckHealth(ctx, s.artifactsProvider)
+}
+
+func (s *seeder) checkControlPlane(ctx context.Context) error {
+	if s.cpc == nil {
+		return nil
+	}
+	return s.cpc.CheckHealth(ctx)
+}
+
+// healthzHandler is the liveness probe: it only checks what a restart of the seeder can fix, which is reloading
+// rotated certificates
+func (s *seeder) healthzHandler(w http.ResponseWriter, r *http.Request) {
+	s.probe(w, r, []probeCheck{
+		{name: "certificates", check: s.checkCertificates},
+	})
+}
+
+// readyzHandler is the readiness probe: the seeder cannot serve devices without its artifacts or without the
+// control plane which holds the device registrations
+func (s *seeder) readyzHandler(w http.ResponseWriter, r *http.Request) {
+	s.probe(w, r, []probeCheck{
+		{name: "certificates", check: s.checkCertificates},
+		{name: "artifacts", check: s.checkArtifactsProvider},
+		{name: "controlplane", check: s.checkControlPlane},
+	})
+}
+
+func (s *seeder) probe(w http.ResponseWriter, r *http.Request, checks []probeCheck) {
+	ctx, cancel := context.WithTimeout(r.Context(), probeTimeout)
+	defer cancel()
+	ret := ProbeStatus{
+		Status: ProbeStatusOK,
+		Checks: make([]ProbeCheck, 0, len(checks)),
+	}
+	for _, c := range checks {
+		res := ProbeCheck{Name: c.name, OK: true}
+		if err := c.check(ctx); err != nil {
+			res.OK = false
+			res.Error = err.Error()
+			ret.Status = ProbeStatusFailed
+		}
+		ret.Checks = append(ret.Checks, res)
+	}
+	status := http.StatusOK
+	if ret.Status != ProbeStatusOK {
+		status = http.StatusServiceUnavailable
+	}
+	writeJSON(w, r, status, &ret)
+}
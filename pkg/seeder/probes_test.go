@@ -0,0 +1,177 @@
+// Copyright 2023 Hedgehog
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package seeder
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"go.githedgehog.com/dasboot/pkg/seeder/artifacts"
+)
+
+func writeTestCertificate(t *testing.T, dir, name string, lifetime time.Duration) (string, string) {
+	t.Helper()
+	key, cert, err := newEphemeralCA(name, lifetime)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certPath := filepath.Join(dir, name+"-cert.pem")
+	keyPath := filepath.Join(dir, name+"-key.pem")
+	if err := os.WriteFile(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return certPath, keyPath
+}
+
+func Test_certificateFile_check(t *testing.T) {
+	dir := t.TempDir()
+	validCert, validKey := writeTestCertificate(t, dir, "valid", time.Hour)
+	expiredCert, expiredKey := writeTestCertificate(t, dir, "expired", -time.Hour)
+	_, otherKey := writeTestCertificate(t, dir, "other", time.Hour)
+	tests := []struct {
+		name    string
+		cf      certificateFile
+		wantErr string
+	}{
+		{
+			name: "valid key pair",
+			cf:   certificateFile{name: "server", certPath: validCert, keyPath: validKey},
+		},
+		{
+			name: "valid CA",
+			cf:   certificateFile{name: "CA", certPath: validCert},
+		},
+		{
+			name:    "expired key pair",
+			cf:      certificateFile{name: "server", certPath: expiredCert, keyPath: expiredKey},
+			wantErr: "expired at",
+		},
+		{
+			name:    "expired CA",
+			cf:      certificateFile{name: "CA", certPath: expiredCert},
+			wantErr: "expired at",
+		},
+		{
+			name:    "key does not match",
+			cf:      certificateFile{name: "server", certPath: validCert, keyPath: otherKey},
+			wantErr: "server: tls: private key does not match public key",
+		},
+		{
+			name:    "missing file",
+			cf:      certificateFile{name: "CA", certPath: filepath.Join(dir, "missing.pem")},
+			wantErr: "no such file or directory",
+		},
+		{
+			name:    "no certificates",
+			cf:      certificateFile{name: "CA", certPath: validKey},
+			wantErr: "no certificates",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.cf.check(time.Now())
+			if (err != nil) != (tt.wantErr != "") || (err != nil && !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Errorf("check() error = %v, wantErr %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+type healthCheckingProvider struct {
+	err error
+}
+
+var _ artifacts.HealthChecker = &healthCheckingProvider{}
+
+func (p *healthCheckingProvider) Get(string) io.ReadCloser {
+	return nil
+}
+
+func (p *healthCheckingProvider) CheckHealth(context.Context) error {
+	return p.err
+}
+
+func TestSeeder_probes(t *testing.T) {
+	dir := t.TempDir()
+	certPath, keyPath := writeTestCertificate(t, dir, "server", time.Hour)
+	failing := &healthCheckingProvider{}
+	// the secure server signs its responses
+	ecgKey, ecgCert, err := newEphemeralCA("embedded config generator", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &seeder{
+		ecg:               &embeddedConfigGenerator{key: ecgKey, certDER: ecgCert.Raw},
+		limits:            newLimits(nil),
+		artifactsProvider: artifacts.New(&healthCheckingProvider{}, failing),
+		certificates:      []certificateFile{{name: "secure server", certPath: certPath, keyPath: keyPath}},
+	}
+
+	probe := func(path string) (int, ProbeStatus) {
+		t.Helper()
+		rec := httptest.NewRecorder()
+		s.secureHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+		var ps ProbeStatus
+		if err := json.Unmarshal(rec.Body.Bytes(), &ps); err != nil {
+			t.Fatalf("GET %s: unmarshal response %q: %v", path, rec.Body.String(), err)
+		}
+		return rec.Code, ps
+	}
+
+	if code, ps := probe(readyzPath); code != http.StatusOK || ps.Status != ProbeStatusOK || len(ps.Checks) != 3 {
+		t.Errorf("readyz = %d %+v, want all checks to pass", code, ps)
+	}
+
+	// an unreachable artifacts backend makes the seeder unready, but it is still alive
+	failing.err = errors.New("registry unreachable")
+	code, ps := probe(readyzPath)
+	if code != http.StatusServiceUnavailable || ps.Status != ProbeStatusFailed {
+		t.Errorf("readyz = %d %+v, want it to fail", code, ps)
+	}
+	for _, c := range ps.Checks {
+		if c.OK != (c.Name != "artifacts") || (c.Name == "artifacts" && c.Error != "registry unreachable") {
+			t.Errorf("unexpected check result: %+v", c)
+		}
+	}
+	if code, ps := probe(healthzPath); code != http.StatusOK || ps.Status != ProbeStatusOK {
+		t.Errorf("healthz = %d %+v, want it to pass", code, ps)
+	}
+
+	// a rotated certificate which cannot be loaded anymore makes the seeder dead
+	if err := os.Remove(keyPath); err != nil {
+		t.Fatal(err)
+	}
+	if code, ps := probe(healthzPath); code != http.StatusServiceUnavailable || ps.Status != ProbeStatusFailed {
+		t.Errorf("healthz = %d %+v, want it to fail", code, ps)
+	}
+}
@@ -0,0 +1,89 @@
+// Copyright 2023 Hedgehog
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package recovery
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/google/uuid"
+	"go.githedgehog.com/dasboot/pkg/stage"
+)
+
+var ErrInvalidReport = errors.New("recovery: invalid report")
+
+// Report is sent by stage 0 to the seeder when a device enters recovery mode because its
+// installations kept failing
+type Report struct {
+	DevID               string    `json:"devid"`
+	SerialNumber        string    `json:"serial_number,omitempty"`
+	Platform            string    `json:"platform,omitempty"`
+	EthAddr             string    `json:"eth_addr,omitempty"`
+	ConsecutiveFailures uint      `json:"consecutive_failures"`
+	FirstFailure        time.Time `json:"first_failure,omitempty"`
+	LastFailure         time.Time `json:"last_failure,omitempty"`
+	LastError           string    `json:"last_error,omitempty"`
+	Action              string    `json:"action"`
+}
+
+func (r *Report) Validate() error {
+	if _, err := uuid.Parse(r.DevID); err != nil {
+		return fmt.Errorf("%w: devid: %w", ErrInvalidReport, err)
+	}
+	if r.ConsecutiveFailures == 0 {
+		return fmt.Errorf("%w: consecutive_failures must be greater than zero", ErrInvalidReport)
+	}
+	if r.Action == "" {
+		return fmt.Errorf("%w: action must be set", ErrInvalidReport)
+	}
+	return nil
+}
+
+// DoReport sends the recovery report to the seeder
+func DoReport(ctx context.Context, hc *http.Client, report *Report, reportURL string) error {
+	if err := report.Validate(); err != nil {
+		return err
+	}
+
+	// NOTE: json encoder has a problem which is why json.Marshal is better for creating post bodies
+	postBody, err := json.Marshal(report)
+	if err != nil {
+		return err
+	}
+
+	subCtx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(subCtx, http.MethodPost, reportURL, bytes.NewBuffer(postBody))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("Content-Type", "application/json")
+
+	httpResp, err := hc.Do(req)
+	if err != nil {
+		return err
+	}
+	defer httpResp.Body.Close()
+	if httpResp.StatusCode != http.StatusOK && httpResp.StatusCode != http.StatusNoContent {
+		return stage.NewHTTPErrorFromBody(httpResp)
+	}
+	return nil
+}
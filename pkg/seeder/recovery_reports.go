@@ -0,0 +1,129 @@
+// Copyright 2023 Hedgehog
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package seeder
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
+	"go.uber.org/zap"
+
+	"go.githedgehog.com/dasboot/pkg/seeder/controlplane"
+	"go.githedgehog.com/dasboot/pkg/seeder/recovery"
+)
+
+const adminRecoveryPath = "/recovery"
+
+// ReceivedRecoveryReport is a recovery report of a device as it is listed on the admin server
+type ReceivedRecoveryReport struct {
+	recovery.Report
+	ReceivedAt time.Time `json:"received_at"`
+	RemoteAddr string    `json:"remote_addr,omitempty"`
+}
+
+// recoveryReports holds the most recent recovery report of every device which entered recovery mode,
+// so that operators can find the devices which need manual intervention
+type recoveryReports struct {
+	mu      sync.Mutex
+	reports map[string]*ReceivedRecoveryReport
+}
+
+func newRecoveryReports() *recoveryReports {
+	return &recoveryReports{reports: make(map[string]*ReceivedRecoveryReport)}
+}
+
+func (rr *recoveryReports) add(report *ReceivedRecoveryReport) {
+	rr.mu.Lock()
+	defer rr.mu.Unlock()
+	rr.reports[report.DevID] = report
+}
+
+func (rr *recoveryReports) list() []*ReceivedRecoveryReport {
+	rr.mu.Lock()
+	defer rr.mu.Unlock()
+	ret := make([]*ReceivedRecoveryReport, 0, len(rr.reports))
+	for _, report := range rr.reports {
+		ret = append(ret, report)
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i].DevID < ret[j].DevID })
+	return ret
+}
+
+func (rr *recoveryReports) get(devid string) *ReceivedRecoveryReport {
+	rr.mu.Lock()
+	defer rr.mu.Unlock()
+	return rr.reports[devid]
+}
+
+func (rr *recoveryReports) delete(devid string) bool {
+	rr.mu.Lock()
+	defer rr.mu.Unlock()
+	_, ok := rr.reports[devid]
+	delete(rr.reports, devid)
+	return ok
+}
+
+func (s *seeder) processRecoveryReport(w http.ResponseWriter, r *http.Request) {
+	var report recovery.Report
+	if !s.limits.decodeJSONRequest(w, r, &report) {
+		return
+	}
+	if err := report.Validate(); err != nil {
+		errorWithJSON(w, r, http.StatusBadRequest, "request validation: %s", err)
+		return
+	}
+
+	// this needs manual intervention, so we want this to be loud
+	l.Error("DEVICE ENTERED RECOVERY MODE: installation failed too many times in a row, manual intervention required",
+		zap.String("request", middleware.GetReqID(r.Context())),
+		zap.String("devid", report.DevID),
+		zap.String("serialNumber", report.SerialNumber),
+		zap.String("platform", report.Platform),
+		zap.String("ethAddr", report.EthAddr),
+		zap.Uint("consecutiveFailures", report.ConsecutiveFailures),
+		zap.Time("firstFailure", report.FirstFailure),
+		zap.Time("lastFailure", report.LastFailure),
+		zap.String("lastError", report.LastError),
+		zap.String("action", report.Action),
+	)
+	s.recoveryReports.add(&ReceivedRecoveryReport{
+		Report:     report,
+		ReceivedAt: time.Now(),
+		RemoteAddr: r.RemoteAddr,
+	})
+	// the device is not going to use its addresses until somebody intervenes
+	s.releaseIPAMLease(report.DevID)
+	s.recordDeviceEvent(r.Context(), report.DevID, controlplane.DeviceEventFailed, fmt.Sprintf("installation failed %d times in a row, entered recovery mode (%s): %s", report.ConsecutiveFailures, report.Action, report.LastError))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *seeder) listRecoveryReportsHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, r, http.StatusOK, s.recoveryReports.list())
+}
+
+func (s *seeder) deleteRecoveryReportHandler(w http.ResponseWriter, r *http.Request) {
+	devidParam := chi.URLParam(r, "devid")
+	if !s.recoveryReports.delete(devidParam) {
+		errorWithJSON(w, r, http.StatusNotFound, "no recovery report found for device '%s'", devidParam)
+		return
+	}
+	l.Info("Recovery report deleted", zap.String("devid", devidParam))
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,151 @@
+// Copyright 2023 Hedgehog
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package registration
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path"
+	"sort"
+	"time"
+
+	dasbootv1alpha1 "go.githedgehog.com/dasboot/pkg/k8s/api/v1alpha1"
+)
+
+var (
+	ErrNotPending             = errors.New("registration: no registration request pending approval")
+	ErrInvalidAutoApproveRule = errors.New("registration: invalid auto-approve rule")
+)
+
+const deniedReason = "registration request was denied by an operator"
+
+// ApprovalPolicy decides which registration requests get a client certificate without an operator approving them.
+// A nil policy approves all registration requests.
+type ApprovalPolicy struct {
+	// Required holds back all registration requests which do not match any of the auto-approve rules
+	// until an operator approves them
+	Required bool
+
+	// AutoApprove are the rules for registration requests which get approved even though approval is required
+	AutoApprove []AutoApproveRule
+
+	// Dir is the directory in which pending registration requests are being persisted when the seeder issues
+	// client certificates itself. If it is empty, pending registration requests are lost on restarts.
+	Dir string
+}
+
+// AutoApproveRule matches registration requests by their location and by the serial number of the device.
+// All fields which are set must match.
+type AutoApproveRule struct {
+	// LocationUUID is the location UUID which registration requests must have
+	LocationUUID string
+
+	// SerialNumber is a shell pattern as in `path.Match` which the serial number in the device inventory must match
+	SerialNumber string
+}
+
+// Validate checks that the rule matches anything at all, and that the serial number is a valid pattern
+func (r *AutoApproveRule) Validate() error {
+	if r.LocationUUID == "" && r.SerialNumber == "" {
+		return fmt.Errorf("%w: neither location UUID nor serial number set", ErrInvalidAutoApproveRule)
+	}
+	if _, err := path.Match(r.SerialNumber, ""); err != nil {
+		return fmt.Errorf("%w: serial number '%s': %w", ErrInvalidAutoApproveRule, r.SerialNumber, err)
+	}
+	return nil
+}
+
+func (r *AutoApproveRule) matches(req *Request) bool {
+	if r.LocationUUID != "" && (req.LocationInfo == nil || req.LocationInfo.UUID != r.LocationUUID) {
+		return false
+	}
+	if r.SerialNumber != "" {
+		if req.Inventory == nil || req.Inventory.Serial == "" {
+			return false
+		}
+		if ok, _ := path.Match(r.SerialNumber, req.Inventory.Serial); !ok {
+			return false
+		}
+	}
+	return true
+}
+
+func (p *ApprovalPolicy) approves(req *Request) bool {
+	if p == nil || !p.Required {
+		return true
+	}
+	for i := range p.AutoApprove {
+		if p.AutoApprove[i].matches(req) {
+			return true
+		}
+	}
+	return false
+}
+
+// PendingRegistration is a registration request which waits for the approval of an operator
+type PendingRegistration struct {
+	DeviceID     string    `json:"devid"`
+	LocationUUID string    `json:"location_uuid,omitempty"`
+	SerialNumber string    `json:"serial_number,omitempty"`
+	Vendor       string    `json:"vendor,omitempty"`
+	ProductName  string    `json:"product_name,omitempty"`
+	AssetTag     string    `json:"asset_tag,omitempty"`
+	SubmittedAt  time.Time `json:"submitted_at"`
+}
+
+func newPendingRegistration(req *Request, submittedAt time.Time) PendingRegistration {
+	ret := PendingRegistration{
+		DeviceID:    req.DeviceID,
+		SubmittedAt: submittedAt,
+	}
+	if req.LocationInfo != nil {
+		ret.LocationUUID = req.LocationInfo.UUID
+	}
+	if req.Inventory != nil {
+		ret.SerialNumber = req.Inventory.Serial
+		ret.Vendor = req.Inventory.Vendor
+		ret.ProductName = req.Inventory.ProductName
+		ret.AssetTag = req.Inventory.AssetTag
+	}
+	return ret
+}
+
+// Pending lists the registration requests which wait for the approval of an operator
+func (p *Processor) Pending(ctx context.Context) ([]PendingRegistration, error) {
+	ret, err := p.pendingFunc(ctx)
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		if ret[i].SubmittedAt.Equal(ret[j].SubmittedAt) {
+			return ret[i].DeviceID < ret[j].DeviceID
+		}
+		return ret[i].SubmittedAt.Before(ret[j].SubmittedAt)
+	})
+	return ret, nil
+}
+
+// Approve approves the pending registration request of `devID`, so that the device gets its client certificate.
+// ErrNotPending is returned if there is no pending registration request for the device.
+func (p *Processor) Approve(ctx context.Context, devID string) error {
+	return p.decideFunc(ctx, devID, dasbootv1alpha1.RegistrationApprovalApproved)
+}
+
+// Deny rejects the pending registration request of `devID`. The device is told so on its next registration
+// attempt. ErrNotPending is returned if there is no pending registration request for the device.
+func (p *Processor) Deny(ctx context.Context, devID string) error {
+	return p.decideFunc(ctx, devID, dasbootv1alpha1.RegistrationApprovalDenied)
+}
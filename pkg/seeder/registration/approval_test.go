@@ -0,0 +1,168 @@
+// Copyright 2023 Hedgehog
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package registration
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"go.githedgehog.com/dasboot/pkg/devid"
+	"go.githedgehog.com/dasboot/pkg/partitions/location"
+)
+
+func TestApprovalPolicy_approves(t *testing.T) {
+	req := &Request{
+		DeviceID:     "device1",
+		LocationInfo: &location.Info{UUID: "location1"},
+		Inventory:    &devid.Inventory{Serial: "FX1234"},
+	}
+	tests := []struct {
+		name   string
+		policy *ApprovalPolicy
+		req    *Request
+		want   bool
+	}{
+		{
+			name: "no policy approves everything",
+			req:  req,
+			want: true,
+		},
+		{
+			name:   "approval not required",
+			policy: &ApprovalPolicy{},
+			req:    req,
+			want:   true,
+		},
+		{
+			name:   "approval required without rules",
+			policy: &ApprovalPolicy{Required: true},
+			req:    req,
+			want:   false,
+		},
+		{
+			name:   "serial number pattern matches",
+			policy: &ApprovalPolicy{Required: true, AutoApprove: []AutoApproveRule{{SerialNumber: "FX*"}}},
+			req:    req,
+			want:   true,
+		},
+		{
+			name:   "location and serial number must both match",
+			policy: &ApprovalPolicy{Required: true, AutoApprove: []AutoApproveRule{{LocationUUID: "location2", SerialNumber: "FX*"}}},
+			req:    req,
+			want:   false,
+		},
+		{
+			name:   "second rule matches",
+			policy: &ApprovalPolicy{Required: true, AutoApprove: []AutoApproveRule{{SerialNumber: "AB*"}, {LocationUUID: "location1"}}},
+			req:    req,
+			want:   true,
+		},
+		{
+			name:   "request without inventory",
+			policy: &ApprovalPolicy{Required: true, AutoApprove: []AutoApproveRule{{SerialNumber: "*"}}},
+			req:    &Request{DeviceID: "device1"},
+			want:   false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.policy.approves(tt.req); got != tt.want {
+				t.Errorf("ApprovalPolicy.approves() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAutoApproveRule_Validate(t *testing.T) {
+	tests := []struct {
+		name    string
+		rule    AutoApproveRule
+		wantErr bool
+	}{
+		{name: "location", rule: AutoApproveRule{LocationUUID: "location1"}},
+		{name: "serial number pattern", rule: AutoApproveRule{SerialNumber: "FX[0-9]*"}},
+		{name: "empty", rule: AutoApproveRule{}, wantErr: true},
+		{name: "malformed pattern", rule: AutoApproveRule{SerialNumber: "FX["}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.rule.Validate()
+			if (err != nil) != tt.wantErr {
+				t.Errorf("AutoApproveRule.Validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil && !errors.Is(err, ErrInvalidAutoApproveRule) {
+				t.Errorf("AutoApproveRule.Validate() error = %v, want ErrInvalidAutoApproveRule", err)
+			}
+		})
+	}
+}
+
+func TestProcessor_approvalLocally(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	caKey, caCert := selfSignedCert()
+	dir := t.TempDir()
+	policy := &ApprovalPolicy{Required: true, Dir: dir}
+
+	// registering a device which needs to be approved
+	p := NewProcessor(ctx, nil, caKey, caCert, policy)
+	defer p.Stop()
+	csr1, _, _ := newCSRPubKeyAndCert("device1", caKey, caCert)
+	csr2, _, _ := newCSRPubKeyAndCert("device2", caKey, caCert)
+	for _, req := range []*Request{{DeviceID: "device1", CSR: csr1}, {DeviceID: "device2", CSR: csr2}} {
+		p.addRequestLocally(ctx, req)
+		p.processRequestLocally(req)
+		if resp := p.ProcessRequest(ctx, &Request{DeviceID: req.DeviceID}); resp.Status != RegistrationStatusPending {
+			t.Fatalf("ProcessRequest() status = %v, want %v", resp.Status, RegistrationStatusPending)
+		}
+	}
+
+	// the pending requests survive a restart
+	p2 := NewProcessor(ctx, nil, caKey, caCert, policy)
+	defer p2.Stop()
+	pending, err := p2.Pending(ctx)
+	if err != nil {
+		t.Fatalf("Pending() error = %v", err)
+	}
+	if len(pending) != 2 || pending[0].DeviceID != "device1" || pending[1].DeviceID != "device2" {
+		t.Fatalf("Pending() = %v, want device1 and device2", pending)
+	}
+	if resp := p2.ProcessRequest(ctx, &Request{DeviceID: "device1"}); resp.Status != RegistrationStatusPending {
+		t.Fatalf("ProcessRequest() status = %v, want %v", resp.Status, RegistrationStatusPending)
+	}
+
+	if err := p2.Approve(ctx, "device1"); err != nil {
+		t.Fatalf("Approve() error = %v", err)
+	}
+	if resp := p2.ProcessRequest(ctx, &Request{DeviceID: "device1"}); resp.Status != RegistrationStatusApproved || len(resp.ClientCertificate) == 0 {
+		t.Fatalf("ProcessRequest() status = %v, want %v with certificate", resp.Status, RegistrationStatusApproved)
+	}
+
+	if err := p2.Deny(ctx, "device2"); err != nil {
+		t.Fatalf("Deny() error = %v", err)
+	}
+	if resp := p2.ProcessRequest(ctx, &Request{DeviceID: "device2"}); resp.Status != RegistrationStatusRejected {
+		t.Fatalf("ProcessRequest() status = %v, want %v", resp.Status, RegistrationStatusRejected)
+	}
+
+	if err := p2.Approve(ctx, "device2"); !errors.Is(err, ErrNotPending) {
+		t.Fatalf("Approve() error = %v, want ErrNotPending", err)
+	}
+	pending, err = NewProcessor(ctx, nil, caKey, caCert, policy).Pending(ctx)
+	if err != nil || len(pending) != 0 {
+		t.Fatalf("Pending() after decisions = %v, %v, want none", pending, err)
+	}
+}
@@ -0,0 +1,180 @@
+// Copyright 2023 Hedgehog
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package registration
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"path"
+	"strconv"
+
+	dasbootv1alpha1 "go.githedgehog.com/dasboot/pkg/k8s/api/v1alpha1"
+	"go.githedgehog.com/dasboot/pkg/tpm"
+)
+
+var ErrAttestationFailed = errors.New("registration: attestation failed")
+
+// Evidence is the attestation evidence which stage 1 collects for a registration request. Apart from the TPM quote
+// these are claims of the device which are only as trustworthy as the installer which collected them. The serial
+// number of the ONIE EEPROM is part of the inventory of the request.
+type Evidence struct {
+	// ONIEVersion is the version of ONIE which booted the installer
+	ONIEVersion string `json:"onie_version,omitempty"`
+
+	// SecureBoot is true if the device booted with UEFI secure boot enabled
+	SecureBoot bool `json:"secure_boot,omitempty"`
+
+	// Quote is a TPM quote of the boot PCRs signed by the client key of the device. Its qualifying data is the
+	// SHA-256 digest of the CSR of the request, which ties the quote to the registration request. It is only
+	// present if the client key is held by a TPM.
+	Quote *tpm.Quote `json:"quote,omitempty"`
+}
+
+// QualifyingData returns the qualifying data of the TPM quote for a registration request with `csr`
+func QualifyingData(csr []byte) []byte {
+	digest := sha256.Sum256(csr)
+	return digest[:]
+}
+
+// AttestationResult is the evidence of a registration request after the seeder verified it
+type AttestationResult struct {
+	// QuoteVerified is true if the request had a TPM quote which is signed by the key of the CSR
+	QuoteVerified bool
+
+	// PCRs are the quoted PCR values, and are only set if QuoteVerified is true
+	PCRs map[int][]byte
+
+	// SecureBoot is the secure boot state as reported by the device
+	SecureBoot bool
+
+	// ONIEVersion is the ONIE version as reported by the device
+	ONIEVersion string
+}
+
+func (r *AttestationResult) deviceAttestation() *dasbootv1alpha1.DeviceAttestation {
+	if r == nil {
+		return nil
+	}
+	ret := &dasbootv1alpha1.DeviceAttestation{
+		QuoteVerified: r.QuoteVerified,
+		SecureBoot:    r.SecureBoot,
+		ONIEVersion:   r.ONIEVersion,
+	}
+	if len(r.PCRs) > 0 {
+		ret.PCRs = make(map[string]string, len(r.PCRs))
+		for pcr, v := range r.PCRs {
+			ret.PCRs[strconv.Itoa(pcr)] = hex.EncodeToString(v)
+		}
+	}
+	return ret
+}
+
+// AttestationVerifier enforces an attestation policy on new registration requests. Registration requests for
+// which it returns an error are being rejected.
+type AttestationVerifier interface {
+	VerifyAttestation(ctx context.Context, req *Request, res *AttestationResult) error
+}
+
+// AddAttestationVerifier adds a verifier which all new registration requests must pass. It must be called before
+// the processor processes any requests.
+func (p *Processor) AddAttestationVerifier(v AttestationVerifier) {
+	p.attestationVerifiers = append(p.attestationVerifiers, v)
+}
+
+// attest verifies the TPM quote of a new registration request, and passes the result to all attestation verifiers
+func (p *Processor) attest(ctx context.Context, req *Request) (*AttestationResult, error) {
+	ret := &AttestationResult{}
+	if ev := req.Attestation; ev != nil {
+		ret.SecureBoot = ev.SecureBoot
+		ret.ONIEVersion = ev.ONIEVersion
+		if ev.Quote != nil {
+			csr, err := x509.ParseCertificateRequest(req.CSR)
+			if err != nil {
+				return nil, invalidCSRError(err)
+			}
+			if err := tpm.VerifyQuote(csr.PublicKey, ev.Quote, QualifyingData(req.CSR)); err != nil {
+				return nil, fmt.Errorf("%w: %w", ErrAttestationFailed, err)
+			}
+			ret.QuoteVerified = true
+			ret.PCRs = ev.Quote.PCRs
+		}
+	}
+	for _, v := range p.attestationVerifiers {
+		if err := v.VerifyAttestation(ctx, req, ret); err != nil {
+			return nil, err
+		}
+	}
+	return ret, nil
+}
+
+// AttestationPolicy is an AttestationVerifier which requires registration requests to come with certain evidence.
+// The zero value accepts all requests.
+type AttestationPolicy struct {
+	// RequireQuote rejects all registration requests without a valid TPM quote
+	RequireQuote bool
+
+	// RequireSecureBoot rejects all registration requests of devices which did not boot with secure boot enabled
+	RequireSecureBoot bool
+
+	// PCRs are the hex encoded SHA-256 values which the quoted PCRs must have, keyed by their index. A policy
+	// with PCR values requires a quote.
+	PCRs map[int]string
+
+	// ONIEVersions are shell patterns as in `path.Match` of which the ONIE version must match at least one
+	ONIEVersions []string
+}
+
+// Validate checks that the expected PCR values and the ONIE version patterns are valid
+func (p *AttestationPolicy) Validate() error {
+	for pcr, v := range p.PCRs {
+		if b, err := hex.DecodeString(v); err != nil || len(b) != sha256.Size {
+			return fmt.Errorf("registration: invalid attestation policy: PCR %d: not a hex encoded SHA-256 value", pcr)
+		}
+	}
+	for _, pattern := range p.ONIEVersions {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("registration: invalid attestation policy: ONIE version '%s': %w", pattern, err)
+		}
+	}
+	return nil
+}
+
+// VerifyAttestation implements AttestationVerifier
+func (p *AttestationPolicy) VerifyAttestation(_ context.Context, _ *Request, res *AttestationResult) error {
+	if (p.RequireQuote || len(p.PCRs) > 0) && !res.QuoteVerified {
+		return fmt.Errorf("%w: no TPM quote", ErrAttestationFailed)
+	}
+	if p.RequireSecureBoot && !res.SecureBoot {
+		return fmt.Errorf("%w: secure boot is disabled", ErrAttestationFailed)
+	}
+	for pcr, want := range p.PCRs {
+		if got := hex.EncodeToString(res.PCRs[pcr]); got != want {
+			return fmt.Errorf("%w: PCR %d is '%s' instead of '%s'", ErrAttestationFailed, pcr, got, want)
+		}
+	}
+	if len(p.ONIEVersions) > 0 {
+		for _, pattern := range p.ONIEVersions {
+			if ok, _ := path.Match(pattern, res.ONIEVersion); ok {
+				return nil
+			}
+		}
+		return fmt.Errorf("%w: ONIE version '%s' is not permitted", ErrAttestationFailed, res.ONIEVersion)
+	}
+	return nil
+}
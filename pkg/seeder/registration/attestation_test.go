@@ -0,0 +1,136 @@
+// Copyright 2023 Hedgehog
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package registration
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"errors"
+	"strings"
+	"testing"
+
+	"go.githedgehog.com/dasboot/pkg/tpm"
+)
+
+func TestAttestationPolicy_VerifyAttestation(t *testing.T) {
+	pcr7 := strings.Repeat("ab", 32)
+	quoted := &AttestationResult{
+		QuoteVerified: true,
+		PCRs:          map[int][]byte{7: []byte(strings.Repeat("\xab", 32))},
+		SecureBoot:    true,
+		ONIEVersion:   "2022.08-v1.2",
+	}
+	tests := []struct {
+		name    string
+		policy  *AttestationPolicy
+		res     *AttestationResult
+		wantErr bool
+	}{
+		{
+			name:   "empty policy accepts everything",
+			policy: &AttestationPolicy{},
+			res:    &AttestationResult{},
+		},
+		{
+			name:   "all requirements met",
+			policy: &AttestationPolicy{RequireQuote: true, RequireSecureBoot: true, PCRs: map[int]string{7: pcr7}, ONIEVersions: []string{"2021.*", "2022.*"}},
+			res:    quoted,
+		},
+		{
+			name:    "quote required",
+			policy:  &AttestationPolicy{RequireQuote: true},
+			res:     &AttestationResult{SecureBoot: true},
+			wantErr: true,
+		},
+		{
+			name:    "PCR values require a quote",
+			policy:  &AttestationPolicy{PCRs: map[int]string{7: pcr7}},
+			res:     &AttestationResult{},
+			wantErr: true,
+		},
+		{
+			name:    "secure boot required",
+			policy:  &AttestationPolicy{RequireSecureBoot: true},
+			res:     &AttestationResult{},
+			wantErr: true,
+		},
+		{
+			name:    "PCR value mismatch",
+			policy:  &AttestationPolicy{PCRs: map[int]string{7: strings.Repeat("cd", 32)}},
+			res:     quoted,
+			wantErr: true,
+		},
+		{
+			name:    "ONIE version not permitted",
+			policy:  &AttestationPolicy{ONIEVersions: []string{"2023.*"}},
+			res:     quoted,
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.policy.VerifyAttestation(context.Background(), &Request{}, tt.res)
+			if (err != nil) != tt.wantErr || (err != nil && !errors.Is(err, ErrAttestationFailed)) {
+				t.Errorf("AttestationPolicy.VerifyAttestation() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestAttestationPolicy_Validate(t *testing.T) {
+	if err := (&AttestationPolicy{PCRs: map[int]string{0: "00"}}).Validate(); err == nil {
+		t.Errorf("AttestationPolicy.Validate() accepted a PCR value which is too short")
+	}
+	if err := (&AttestationPolicy{ONIEVersions: []string{"["}}).Validate(); err == nil {
+		t.Errorf("AttestationPolicy.Validate() accepted an invalid ONIE version pattern")
+	}
+	if err := (&AttestationPolicy{PCRs: map[int]string{0: strings.Repeat("00", 32)}, ONIEVersions: []string{"2022.*"}}).Validate(); err != nil {
+		t.Errorf("AttestationPolicy.Validate() error = %v", err)
+	}
+}
+
+func TestProcessor_attest(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	csr, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{}, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &Processor{}
+	p.AddAttestationVerifier(&AttestationPolicy{RequireSecureBoot: true})
+
+	// the claims of the device are being passed on to the verifiers
+	res, err := p.attest(context.Background(), &Request{CSR: csr, Attestation: &Evidence{SecureBoot: true, ONIEVersion: "2022.08"}})
+	if err != nil {
+		t.Fatalf("Processor.attest() error = %v", err)
+	}
+	if res.QuoteVerified || !res.SecureBoot || res.ONIEVersion != "2022.08" {
+		t.Errorf("Processor.attest() = %#v", res)
+	}
+	if _, err := p.attest(context.Background(), &Request{CSR: csr}); !errors.Is(err, ErrAttestationFailed) {
+		t.Errorf("Processor.attest() without evidence error = %v, want %v", err, ErrAttestationFailed)
+	}
+
+	// a quote which is not signed by the key of the CSR is never accepted
+	_, err = p.attest(context.Background(), &Request{CSR: csr, Attestation: &Evidence{SecureBoot: true, Quote: &tpm.Quote{Attest: []byte("attest"), Signature: []byte("signature")}}})
+	if !errors.Is(err, ErrAttestationFailed) {
+		t.Errorf("Processor.attest() with forged quote error = %v, want %v", err, ErrAttestationFailed)
+	}
+}
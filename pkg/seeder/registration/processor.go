@@ -22,6 +22,7 @@ import (
 	"sync"
 	"time"
 
+	dasbootv1alpha1 "go.githedgehog.com/dasboot/pkg/k8s/api/v1alpha1"
 	"go.githedgehog.com/dasboot/pkg/seeder/controlplane"
 )
 
@@ -43,14 +44,26 @@ type Processor struct {
 	certsCacheRefresh  time.Duration
 	certsCache         map[string]*cert
 	certsCacheLock     sync.RWMutex
+	policy             *ApprovalPolicy
+	pending            map[string]*pendingRequest
+	pendingLock        sync.Mutex
 	stopFunc           context.CancelFunc
 	processRequestFunc func(*Request)
 	addRequestFunc     func(context.Context, *Request)
 	getRequestFunc     func(context.Context, *Request) (*cert, bool)
 	deleteRequestFunc  func(context.Context, *Request)
+	recordEventFunc    func(context.Context, *Request, controlplane.DeviceEvent, string)
+	pendingFunc        func(context.Context) ([]PendingRegistration, error)
+	decideFunc         func(context.Context, string, dasbootv1alpha1.RegistrationApproval) error
+	renewFunc          func(context.Context, string, *x509.CertificateRequest, *x509.Certificate) *Response
+
+	attestationVerifiers []AttestationVerifier
 }
 
-func NewProcessor(ctx context.Context, cpc controlplane.Client, key *ecdsa.PrivateKey, crt *x509.Certificate) *Processor {
+// NewProcessor creates a registration processor which issues client certificates itself if `key` and `crt` are set,
+// or which leaves that to the registration controller otherwise. The `policy` decides which registration requests
+// need the approval of an operator.
+func NewProcessor(ctx context.Context, cpc controlplane.Client, key *ecdsa.PrivateKey, crt *x509.Certificate, policy *ApprovalPolicy) *Processor {
 	subctx, cancel := context.WithCancel(ctx)
 	ret := &Processor{
 		key:               key,
@@ -59,17 +72,28 @@ func NewProcessor(ctx context.Context, cpc controlplane.Client, key *ecdsa.Priva
 		certsCache:        make(map[string]*cert),
 		certsCacheRefresh: defaultCertsCacheRefresh,
 		stopFunc:          cancel,
+		policy:            policy,
+		pending:           make(map[string]*pendingRequest),
 	}
 	if key != nil && crt != nil {
 		ret.processRequestFunc = ret.processRequestLocally
 		ret.addRequestFunc = ret.addRequestLocally
 		ret.getRequestFunc = ret.getRequestLocally
 		ret.deleteRequestFunc = ret.deleteRequestLocally
+		ret.recordEventFunc = ret.recordEventLocally
+		ret.pendingFunc = ret.pendingLocally
+		ret.decideFunc = ret.decideLocally
+		ret.renewFunc = ret.renewLocally
+		ret.loadPendingLocally()
 	} else {
 		ret.processRequestFunc = ret.processRequestWithControlPlane
 		ret.addRequestFunc = ret.addRequestWithControlPlane
 		ret.getRequestFunc = ret.getRequestWithControlPlane
 		ret.deleteRequestFunc = ret.deleteRequestWithControlPlane
+		ret.recordEventFunc = ret.recordEventWithControlPlane
+		ret.pendingFunc = ret.pendingWithControlPlane
+		ret.decideFunc = ret.decideWithControlPlane
+		ret.renewFunc = ret.renewWithControlPlane
 	}
 	go ret.loop(subctx)
 	return ret
@@ -101,6 +125,17 @@ func (p *Processor) ProcessRequest(ctx context.Context, req *Request) *Response
 	if !ok {
 		// not found, but there is a CSR in this request, we treat this as a new request, and will act accordingly
 		if len(req.DeviceID) > 0 && req.CSR != nil {
+			// the request never gets added if the device fails to attest itself
+			res, err := p.attest(ctx, req)
+			if err != nil {
+				p.recordEventFunc(ctx, req, controlplane.DeviceEventFailed, fmt.Sprintf("registration request was rejected: %s", err))
+				return &Response{
+					Status:            RegistrationStatusRejected,
+					StatusDescription: fmt.Sprintf("registration request for device '%s' was rejected: %s", req.DeviceID, err),
+				}
+			}
+			req.attestation = res
+
 			// add request before we submit it for processing
 			p.addRequestFunc(ctx, req)
 
@@ -132,6 +167,7 @@ func (p *Processor) ProcessRequest(ctx context.Context, req *Request) *Response
 
 	// cert was rejected
 	if cert.rejected {
+		p.recordEventFunc(ctx, req, controlplane.DeviceEventFailed, fmt.Sprintf("registration request was rejected: %s", cert.reason))
 		p.deleteRequestFunc(ctx, req)
 		return &Response{
 			Status:            RegistrationStatusRejected,
@@ -141,6 +177,7 @@ func (p *Processor) ProcessRequest(ctx context.Context, req *Request) *Response
 
 	// device approved and cert signed
 	if len(cert.der) > 0 {
+		p.recordEventFunc(ctx, req, controlplane.DeviceEventApproved, "registration request approved, client certificate issued")
 		p.deleteRequestFunc(ctx, req)
 		return &Response{
 			Status:            RegistrationStatusApproved,
@@ -18,6 +18,7 @@ import (
 	"bytes"
 	"context"
 	"errors"
+	"fmt"
 
 	dasbootv1alpha1 "go.githedgehog.com/dasboot/pkg/k8s/api/v1alpha1"
 	"go.githedgehog.com/dasboot/pkg/log"
@@ -57,6 +58,15 @@ func (p *Processor) getRequestWithControlPlane(ctx context.Context, req *Request
 		}
 	}
 
+	// an operator denied the registration, so the device is not getting a certificate ever
+	if reg.Spec.Approval == dasbootv1alpha1.RegistrationApprovalDenied {
+		l.Info("registration processor: DeviceRegistration retrieved but it was denied", zap.String("deviceID", req.DeviceID))
+		return &cert{
+			rejected: true,
+			reason:   deniedReason,
+		}, true
+	}
+
 	// if there is no certificate yet, we simply return
 	if len(reg.Status.Certificate) == 0 {
 		l.Info("registration processor: DeviceRegistration retrieved but no certificate has been issued yet", zap.String("deviceID", req.DeviceID))
@@ -93,14 +103,77 @@ func (p *Processor) addRequestWithControlPlane(ctx context.Context, req *Request
 		Spec: dasbootv1alpha1.DeviceRegistrationSpec{
 			LocationUUID: req.LocationInfo.UUID,
 			CSR:          req.CSR,
+			Attestation:  req.attestation.deviceAttestation(),
 		},
 	}
+	// the registration controller waits for an operator to approve all other registrations if it requires approval
+	if p.policy.approves(req) {
+		regReq.Spec.Approval = dasbootv1alpha1.RegistrationApprovalApproved
+	}
+	if req.Inventory != nil {
+		regReq.Spec.SerialNumber = req.Inventory.Serial
+		regReq.Spec.Vendor = req.Inventory.Vendor
+		regReq.Spec.ProductName = req.Inventory.ProductName
+		regReq.Spec.AssetTag = req.Inventory.AssetTag
+		if serial, ok := labelValue(req.Inventory.Serial); ok {
+			regReq.Labels = map[string]string{dasbootv1alpha1.SerialNumberLabelKey: serial}
+		}
+	}
 	ret, err := p.cpc.CreateDeviceRegistration(ctx, regReq)
 	if err != nil {
 		l.Error("Creating device registration object failed", zap.Error(err))
 		return
 	}
 	l.Info("Device registration object created", zap.Reflect("deviceregistration", ret))
+	p.recordEventWithControlPlane(ctx, req, controlplane.DeviceEventRegistered, fmt.Sprintf("registration request submitted for location '%s'", req.LocationInfo.UUID))
+}
+
+func (p *Processor) recordEventWithControlPlane(ctx context.Context, req *Request, event controlplane.DeviceEvent, message string) {
+	// recording events is best-effort and must never fail the registration process
+	if err := p.cpc.RecordDeviceEvent(ctx, req.DeviceID, event, message); err != nil {
+		log.L().Warn("Recording device event failed", zap.String("deviceID", req.DeviceID), zap.String("event", string(event)), zap.Error(err))
+	}
+}
+
+func (p *Processor) pendingWithControlPlane(ctx context.Context) ([]PendingRegistration, error) {
+	regs, err := p.cpc.ListDeviceRegistrations(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("listing device registrations: %w", err)
+	}
+	ret := make([]PendingRegistration, 0, len(regs))
+	for _, reg := range regs {
+		if reg.Spec.Approval != dasbootv1alpha1.RegistrationApprovalPending || len(reg.Status.Certificate) > 0 {
+			continue
+		}
+		ret = append(ret, PendingRegistration{
+			DeviceID:     reg.Name,
+			LocationUUID: reg.Spec.LocationUUID,
+			SerialNumber: reg.Spec.SerialNumber,
+			Vendor:       reg.Spec.Vendor,
+			ProductName:  reg.Spec.ProductName,
+			AssetTag:     reg.Spec.AssetTag,
+			SubmittedAt:  reg.CreationTimestamp.Time,
+		})
+	}
+	return ret, nil
+}
+
+func (p *Processor) decideWithControlPlane(ctx context.Context, devID string, approval dasbootv1alpha1.RegistrationApproval) error {
+	reg, err := p.cpc.GetDeviceRegistration(ctx, devID)
+	if err != nil {
+		if errors.Is(err, controlplane.ErrNotFound) {
+			return ErrNotPending
+		}
+		return fmt.Errorf("device registration: %w", err)
+	}
+	if reg.Spec.Approval != dasbootv1alpha1.RegistrationApprovalPending || len(reg.Status.Certificate) > 0 {
+		return ErrNotPending
+	}
+	// the events are being recorded once the device learns about the decision
+	if err := p.cpc.SetDeviceRegistrationApproval(ctx, devID, approval); err != nil {
+		return fmt.Errorf("device registration approval: %w", err)
+	}
+	return nil
 }
 
 func (p *Processor) processRequestWithControlPlane(req *Request) {
@@ -168,6 +168,27 @@ func TestProcessor_getRequestWithControlPlane(t *testing.T) {
 			},
 			want1: true,
 		},
+		{
+			name: "if an operator denied the registration, we reject it",
+			args: args{
+				req: &Request{
+					DeviceID: "device1",
+				},
+			},
+			pre: func(t *testing.T, ctrl *gomock.Controller, c *mockcontrolplane.MockClient) {
+				c.EXPECT().GetDeviceRegistration(gomock.Any(), "device1").Times(1).Return(&dasbootv1alpha1.DeviceRegistration{
+					Spec: dasbootv1alpha1.DeviceRegistrationSpec{
+						CSR:      []byte("csr1"),
+						Approval: dasbootv1alpha1.RegistrationApprovalDenied,
+					},
+				}, nil)
+			},
+			want: &cert{
+				rejected: true,
+				reason:   deniedReason,
+			},
+			want1: true,
+		},
 		{
 			name: "if there is no certificate yet, this is considered still pending",
 			args: args{
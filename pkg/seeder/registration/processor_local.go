@@ -20,11 +20,19 @@ import (
 	"crypto/rand"
 	"crypto/sha1" //nolint: gosec
 	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"math/big"
 	mathrand "math/rand"
+	"os"
+	"path/filepath"
+	"strings"
 	"time"
 
+	dasbootv1alpha1 "go.githedgehog.com/dasboot/pkg/k8s/api/v1alpha1"
 	"go.githedgehog.com/dasboot/pkg/log"
+	"go.githedgehog.com/dasboot/pkg/seeder/controlplane"
 	"go.uber.org/zap"
 )
 
@@ -58,7 +66,115 @@ func (p *Processor) deleteRequestLocally(_ context.Context, req *Request) {
 	p.certsCacheLock.Unlock()
 }
 
+func (p *Processor) recordEventLocally(_ context.Context, _ *Request, _ controlplane.DeviceEvent, _ string) {
+	// there is no device registration object to record events for
+	// when we are processing requests locally
+}
+
+// pendingRequest is a registration request which waits for the approval of an operator,
+// as it is persisted in the directory of the approval policy
+type pendingRequest struct {
+	Request     *Request  `json:"request"`
+	SubmittedAt time.Time `json:"submitted_at"`
+}
+
 func (p *Processor) processRequestLocally(req *Request) {
+	if !p.policy.approves(req) {
+		p.addPendingLocally(req)
+		return
+	}
+	p.issueCertificateLocally(req)
+}
+
+func (p *Processor) addPendingLocally(req *Request) {
+	pr := &pendingRequest{Request: req, SubmittedAt: time.Now()}
+	p.pendingLock.Lock()
+	p.pending[req.DeviceID] = pr
+	p.pendingLock.Unlock()
+	if p.policy.Dir != "" {
+		b, err := json.Marshal(pr)
+		if err == nil {
+			err = os.WriteFile(p.pendingPath(req.DeviceID), b, 0600)
+		}
+		if err != nil {
+			log.L().Error("registration: persisting pending request failed", zap.String("devID", req.DeviceID), zap.Error(err))
+		}
+	}
+	log.L().Info("registration: request pending approval", zap.String("devID", req.DeviceID))
+}
+
+func (p *Processor) pendingPath(devID string) string {
+	return filepath.Join(p.policy.Dir, devID+".json")
+}
+
+// loadPendingLocally restores the pending registration requests of a previous run, so that
+// the devices keep waiting for their approval instead of starting over
+func (p *Processor) loadPendingLocally() {
+	if p.policy == nil || p.policy.Dir == "" {
+		return
+	}
+	l := log.L()
+	entries, err := os.ReadDir(p.policy.Dir)
+	if err != nil {
+		l.Error("registration: reading pending requests failed", zap.String("dir", p.policy.Dir), zap.Error(err))
+		return
+	}
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), ".json") {
+			continue
+		}
+		b, err := os.ReadFile(filepath.Join(p.policy.Dir, entry.Name()))
+		if err != nil {
+			l.Error("registration: reading pending request failed", zap.String("file", entry.Name()), zap.Error(err))
+			continue
+		}
+		var pr pendingRequest
+		if err := json.Unmarshal(b, &pr); err != nil || pr.Request == nil || pr.Request.DeviceID+".json" != entry.Name() {
+			l.Error("registration: pending request invalid", zap.String("file", entry.Name()), zap.Error(err))
+			continue
+		}
+		p.pending[pr.Request.DeviceID] = &pr
+		p.certsCache[pr.Request.DeviceID] = &cert{}
+	}
+}
+
+func (p *Processor) pendingLocally(_ context.Context) ([]PendingRegistration, error) {
+	p.pendingLock.Lock()
+	defer p.pendingLock.Unlock()
+	ret := make([]PendingRegistration, 0, len(p.pending))
+	for _, pr := range p.pending {
+		ret = append(ret, newPendingRegistration(pr.Request, pr.SubmittedAt))
+	}
+	return ret, nil
+}
+
+func (p *Processor) decideLocally(_ context.Context, devID string, approval dasbootv1alpha1.RegistrationApproval) error {
+	p.pendingLock.Lock()
+	pr, ok := p.pending[devID]
+	delete(p.pending, devID)
+	p.pendingLock.Unlock()
+	if !ok {
+		return ErrNotPending
+	}
+	if p.policy.Dir != "" {
+		if err := os.Remove(p.pendingPath(devID)); err != nil && !os.IsNotExist(err) {
+			log.L().Warn("registration: removing pending request failed", zap.String("devID", devID), zap.Error(err))
+		}
+	}
+
+	if approval == dasbootv1alpha1.RegistrationApprovalDenied {
+		p.certsCacheLock.Lock()
+		p.certsCache[devID] = &cert{rejected: true, reason: deniedReason}
+		p.certsCacheLock.Unlock()
+		log.L().Info("registration: request denied", zap.String("devID", devID))
+		return nil
+	}
+	log.L().Info("registration: request approved", zap.String("devID", devID))
+	p.issueCertificateLocally(pr.Request)
+	return nil
+}
+
+func (p *Processor) issueCertificateLocally(req *Request) {
 	l := log.L()
 	csr, err := x509.ParseCertificateRequest(req.CSR)
 	if err != nil {
@@ -73,15 +189,30 @@ func (p *Processor) processRequestLocally(req *Request) {
 		l.Error("registration: device ID mismatch, not issuing certificate", zap.String("devID", req.DeviceID), zap.String("csrDevID", csr.Subject.CommonName))
 		return
 	}
+	signedCert, err := p.signLocally(csr)
+	if err != nil {
+		l.Error("registration: certificate signing failed", zap.String("devID", req.DeviceID), zap.Error(err))
+		return
+	}
+
+	p.certsCacheLock.Lock()
+	p.certsCache[req.DeviceID] = &cert{
+		der:    signedCert,
+		reason: "device approved and is allowed onto the network",
+	}
+	p.certsCacheLock.Unlock()
+	l.Info("registration: successfully issued device certificate", zap.String("devID", req.DeviceID))
+}
+
+// signLocally issues a client certificate for the subject and the ECDSA key of `csr`
+func (p *Processor) signLocally(csr *x509.CertificateRequest) ([]byte, error) {
 	csrPub, ok := csr.PublicKey.(*ecdsa.PublicKey)
 	if !ok {
-		l.Error("registration: CSR must contain ECDSA key", zap.String("devID", req.DeviceID))
-		return
+		return nil, errors.New("CSR must contain ECDSA key")
 	}
 	ecdhCsrPub, err := csrPub.ECDH()
 	if err != nil {
-		l.Error("registration: cannot convert ECDSA public key to ECDH public key", zap.String("devID", req.DeviceID), zap.Error(err))
-		return
+		return nil, fmt.Errorf("cannot convert ECDSA public key to ECDH public key: %w", err)
 	}
 	csrPubBytes := ecdhCsrPub.Bytes()
 	subjectKeyId := sha1.Sum(csrPubBytes) //nolint: gosec
@@ -95,17 +226,5 @@ func (p *Processor) processRequestLocally(req *Request) {
 		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
 		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
 	}
-	signedCert, err := x509.CreateCertificate(rand.Reader, template, p.cert, csr.PublicKey, p.key)
-	if err != nil {
-		l.Error("registration: certificate signing failed", zap.String("devID", req.DeviceID), zap.Error(err))
-		return
-	}
-
-	p.certsCacheLock.Lock()
-	p.certsCache[req.DeviceID] = &cert{
-		der:    signedCert,
-		reason: "device approved and is allowed onto the network",
-	}
-	p.certsCacheLock.Unlock()
-	l.Info("registration: successfully issued device certificate", zap.String("devID", req.DeviceID))
+	return x509.CreateCertificate(rand.Reader, template, p.cert, csr.PublicKey, p.key)
 }
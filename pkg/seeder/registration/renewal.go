@@ -0,0 +1,183 @@
+// Copyright 2023 Hedgehog
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package registration
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	dasbootv1alpha1 "go.githedgehog.com/dasboot/pkg/k8s/api/v1alpha1"
+	"go.githedgehog.com/dasboot/pkg/log"
+	"go.githedgehog.com/dasboot/pkg/seeder/controlplane"
+	"go.githedgehog.com/dasboot/pkg/stage"
+	"go.uber.org/zap"
+)
+
+// RenewalRequest is a request of a registered device for a new client certificate for its existing client key.
+// The device authenticates with its current client certificate.
+type RenewalRequest struct {
+	// CSR is the DER encoded certificate request which is signed with the existing client key
+	CSR []byte `json:"csr,omitempty"`
+}
+
+// Validate checks that there is a CSR, and that it is signed with the key which it holds
+func (r *RenewalRequest) Validate() error {
+	if len(r.CSR) == 0 {
+		return invalidCSRError(errors.New("missing CSR"))
+	}
+	csr, err := x509.ParseCertificateRequest(r.CSR)
+	if err != nil {
+		return invalidCSRError(err)
+	}
+	if err := csr.CheckSignature(); err != nil {
+		return invalidCSRError(err)
+	}
+	return nil
+}
+
+// DoRenewRequest submits the renewal request to the seeder. The HTTP client must present the current client
+// certificate of the device. The response is either approved with the new client certificate, still pending,
+// or rejected.
+func DoRenewRequest(ctx context.Context, hc *http.Client, renewalReq *RenewalRequest, renewURL string) (*Response, error) {
+	if err := renewalReq.Validate(); err != nil {
+		return nil, err
+	}
+	postBody, err := json.Marshal(renewalReq)
+	if err != nil {
+		return nil, err
+	}
+
+	subCtx, cancel := context.WithTimeout(ctx, 60*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(subCtx, http.MethodPost, renewURL, bytes.NewBuffer(postBody))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("Content-Type", "application/json")
+
+	httpResp, err := hc.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer httpResp.Body.Close()
+
+	// the same status codes as for registration requests apply
+	if httpResp.StatusCode == http.StatusOK || httpResp.StatusCode == http.StatusAccepted || httpResp.StatusCode == HTTPRegistrationRequestNotFound || httpResp.StatusCode == HTTPProcessError {
+		var resp Response
+		if err := json.NewDecoder(httpResp.Body).Decode(&resp); err != nil {
+			return nil, err
+		}
+		if httpResp.StatusCode == HTTPRegistrationRequestNotFound {
+			return nil, fmt.Errorf("%w: %s: %s", ErrRegistrationRequestNotFound, resp.Status, resp.StatusDescription)
+		}
+		if httpResp.StatusCode == HTTPProcessError {
+			return nil, fmt.Errorf("certificate renewal processing error: %s: %s", resp.Status, resp.StatusDescription)
+		}
+		return &resp, nil
+	}
+	return nil, stage.NewHTTPErrorFromBody(httpResp)
+}
+
+// Renew processes the renewal request of the device which authenticated with its `current` client certificate.
+// A renewal keeps the client key of the device, devices which need a new key must register again.
+func (p *Processor) Renew(ctx context.Context, current *x509.Certificate, req *RenewalRequest) *Response {
+	devID := current.Subject.CommonName
+	csr, err := x509.ParseCertificateRequest(req.CSR)
+	if err != nil {
+		return &Response{
+			Status:            RegistrationStatusError,
+			StatusDescription: fmt.Sprintf("parsing renewal CSR of device '%s' failed: %s", devID, err),
+		}
+	}
+	if csr.Subject.CommonName != devID {
+		return &Response{
+			Status:            RegistrationStatusRejected,
+			StatusDescription: fmt.Sprintf("renewal CSR is for device '%s', but the client certificate is for device '%s'", csr.Subject.CommonName, devID),
+		}
+	}
+	currentPub, ok := current.PublicKey.(interface{ Equal(crypto.PublicKey) bool })
+	if !ok || !currentPub.Equal(csr.PublicKey) {
+		return &Response{
+			Status:            RegistrationStatusRejected,
+			StatusDescription: fmt.Sprintf("renewal CSR of device '%s' is not for its existing client key, the device needs to register again for a new key", devID),
+		}
+	}
+	return p.renewFunc(ctx, devID, csr, current)
+}
+
+func (p *Processor) renewLocally(_ context.Context, devID string, csr *x509.CertificateRequest, _ *x509.Certificate) *Response {
+	der, err := p.signLocally(csr)
+	if err != nil {
+		return &Response{
+			Status:            RegistrationStatusError,
+			StatusDescription: fmt.Sprintf("signing renewed certificate for device '%s' failed: %s", devID, err),
+		}
+	}
+	log.L().Info("registration: successfully renewed device certificate", zap.String("devID", devID))
+	return &Response{
+		Status:            RegistrationStatusApproved,
+		StatusDescription: fmt.Sprintf("certificate of device '%s' renewed", devID),
+		ClientCertificate: der,
+	}
+}
+
+func (p *Processor) renewWithControlPlane(ctx context.Context, devID string, csr *x509.CertificateRequest, current *x509.Certificate) *Response {
+	reg, err := p.cpc.GetDeviceRegistration(ctx, devID)
+	if err != nil {
+		if errors.Is(err, controlplane.ErrNotFound) {
+			return &Response{
+				Status:            RegistrationStatusNotFound,
+				StatusDescription: fmt.Sprintf("device '%s' is not registered anymore", devID),
+			}
+		}
+		return &Response{
+			Status:            RegistrationStatusError,
+			StatusDescription: fmt.Sprintf("retrieving registration of device '%s' failed: %s", devID, err),
+		}
+	}
+	if reg.Spec.Approval == dasbootv1alpha1.RegistrationApprovalDenied {
+		return &Response{
+			Status:            RegistrationStatusRejected,
+			StatusDescription: fmt.Sprintf("registration of device '%s' was denied", devID),
+		}
+	}
+
+	// the registration controller renews the certificates before they expire, so the device only
+	// needs to pick it up once it outlives the certificate which it has
+	if len(reg.Status.Certificate) > 0 {
+		issued, err := x509.ParseCertificate(reg.Status.Certificate)
+		if err == nil && issued.NotAfter.After(current.NotAfter) {
+			if pub, ok := issued.PublicKey.(interface{ Equal(crypto.PublicKey) bool }); ok && pub.Equal(csr.PublicKey) {
+				return &Response{
+					Status:            RegistrationStatusApproved,
+					StatusDescription: fmt.Sprintf("certificate of device '%s' renewed", devID),
+					ClientCertificate: reg.Status.Certificate,
+				}
+			}
+		}
+	}
+	return &Response{
+		Status:            RegistrationStatusPending,
+		StatusDescription: fmt.Sprintf("certificate renewal for device '%s' is pending, the registration controller renews certificates before they expire", devID),
+	}
+}
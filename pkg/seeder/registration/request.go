@@ -20,6 +20,8 @@ import (
 	"fmt"
 
 	"github.com/google/uuid"
+	"go.githedgehog.com/dasboot/pkg/devid"
+	"go.githedgehog.com/dasboot/pkg/net"
 	"go.githedgehog.com/dasboot/pkg/partitions/location"
 )
 
@@ -41,6 +43,20 @@ type Request struct {
 	DeviceID     string         `json:"devid,omitempty"`
 	CSR          []byte         `json:"csr,omitempty"`
 	LocationInfo *location.Info `json:"location_info,omitempty"`
+
+	// Inventory is the hardware inventory of the device as it is stored in its ONIE EEPROM. It is optional.
+	Inventory *devid.Inventory `json:"inventory,omitempty"`
+
+	// Neighbors are the LLDP neighbours of the device. The seeder infers the location from them if the
+	// request comes without location information. They are optional.
+	Neighbors []*net.LLDPNeighbor `json:"neighbors,omitempty"`
+
+	// Attestation is the attestation evidence of the device. It is optional, but attestation policies of the
+	// seeder might reject requests without it.
+	Attestation *Evidence `json:"attestation,omitempty"`
+
+	// attestation is the verified evidence which is set once the request passed all attestation verifiers
+	attestation *AttestationResult
 }
 
 func (r *Request) Validate() error {
@@ -21,6 +21,7 @@ import (
 
 	"go.githedgehog.com/dasboot/pkg/log"
 	"go.uber.org/zap"
+	"k8s.io/apimachinery/pkg/util/validation"
 )
 
 func matchesPublicKeys(csrDERBytes []byte, certDERBytes []byte) bool {
@@ -55,3 +56,11 @@ func matchesPublicKeys(csrDERBytes []byte, certDERBytes []byte) bool {
 		return false
 	}
 }
+
+// labelValue returns `val` if it can be used as a Kubernetes label value
+func labelValue(val string) (string, bool) {
+	if val == "" || len(validation.IsValidLabelValue(val)) > 0 {
+		return "", false
+	}
+	return val, true
+}
@@ -0,0 +1,67 @@
+// Copyright 2023 Hedgehog
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package seeder
+
+import (
+	"context"
+	"errors"
+	"net/http"
+
+	"github.com/go-chi/chi/v5"
+	"go.uber.org/zap"
+
+	"go.githedgehog.com/dasboot/pkg/seeder/registration"
+)
+
+const adminRegistrationsPath = "/registrations"
+
+func (s *seeder) listPendingRegistrationsHandler(w http.ResponseWriter, r *http.Request) {
+	pending, err := s.registry.Pending(r.Context())
+	if err != nil {
+		errorWithJSON(w, r, http.StatusInternalServerError, "listing pending registrations: %s", err)
+		return
+	}
+	writeJSON(w, r, http.StatusOK, pending)
+}
+
+func (s *seeder) approveRegistrationHandler(w http.ResponseWriter, r *http.Request) {
+	devidParam := chi.URLParam(r, "devid")
+	if !s.decideRegistration(w, r, devidParam, s.registry.Approve) {
+		return
+	}
+	l.Info("Registration approved", zap.String("devid", devidParam))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *seeder) denyRegistrationHandler(w http.ResponseWriter, r *http.Request) {
+	devidParam := chi.URLParam(r, "devid")
+	if !s.decideRegistration(w, r, devidParam, s.registry.Deny) {
+		return
+	}
+	l.Warn("Registration denied", zap.String("devid", devidParam))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *seeder) decideRegistration(w http.ResponseWriter, r *http.Request, devid string, decide func(context.Context, string) error) bool {
+	if err := decide(r.Context(), devid); err != nil {
+		if errors.Is(err, registration.ErrNotPending) {
+			errorWithJSON(w, r, http.StatusNotFound, "no registration pending approval for device '%s'", devid)
+			return false
+		}
+		errorWithJSON(w, r, http.StatusInternalServerError, "deciding registration of device '%s': %s", devid, err)
+		return false
+	}
+	return true
+}
@@ -18,6 +18,7 @@ import (
 	"context"
 	"crypto/ecdsa"
 	"crypto/x509"
+	"os"
 
 	"go.githedgehog.com/dasboot/pkg/seeder/config"
 	"go.githedgehog.com/dasboot/pkg/seeder/controlplane"
@@ -28,6 +29,8 @@ import (
 func (s *seeder) initializeRegistrySettings(ctx context.Context, cfg *config.RegistrySettings, cpc controlplane.Client) error {
 	var key *ecdsa.PrivateKey
 	var cert *x509.Certificate
+	var policy *registration.ApprovalPolicy
+	var attestation *registration.AttestationPolicy
 	if cfg != nil {
 		if (cfg.KeyPath != "" && cfg.CertPath == "") || (cfg.CertPath != "" && cfg.KeyPath == "") {
 			return errors.InvalidConfigError("client signing key and client signing cert must always be set together")
@@ -46,9 +49,50 @@ func (s *seeder) initializeRegistrySettings(ctx context.Context, cfg *config.Reg
 				return err
 			}
 		}
+		if cfg.RequireApproval {
+			policy = &registration.ApprovalPolicy{
+				Required: true,
+				Dir:      cfg.PendingDir,
+			}
+			for _, rule := range cfg.AutoApprove {
+				r := registration.AutoApproveRule{
+					LocationUUID: rule.LocationUUID,
+					SerialNumber: rule.SerialNumber,
+				}
+				if err := r.Validate(); err != nil {
+					return errors.InvalidConfigError(err.Error())
+				}
+				policy.AutoApprove = append(policy.AutoApprove, r)
+			}
+			if cfg.PendingDir != "" {
+				if err := os.MkdirAll(cfg.PendingDir, 0700); err != nil {
+					return errors.InvalidConfigError(err.Error())
+				}
+			}
+		}
+		if cfg.Attestation != nil {
+			attestation = &registration.AttestationPolicy{
+				RequireQuote:      cfg.Attestation.RequireQuote,
+				RequireSecureBoot: cfg.Attestation.RequireSecureBoot,
+				PCRs:              cfg.Attestation.PCRs,
+				ONIEVersions:      cfg.Attestation.ONIEVersions,
+			}
+			if err := attestation.Validate(); err != nil {
+				return errors.InvalidConfigError(err.Error())
+			}
+		}
 	}
 
-	s.registry = registration.NewProcessor(ctx, cpc, key, cert)
+	// there is no registration controller in lab mode, so the lab CA approves everything
+	if key == nil && cert == nil && s.labCA != nil {
+		l.Warn("Lab mode: approving all registration requests with the ephemeral lab CA")
+		key, cert = s.labCA.key, s.labCA.cert
+	}
+
+	s.registry = registration.NewProcessor(ctx, cpc, key, cert, policy)
+	if attestation != nil {
+		s.registry.AddAttestationVerifier(attestation)
+	}
 
 	return nil
 }
@@ -0,0 +1,218 @@
+// Copyright 2023 Hedgehog
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package seeder
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.githedgehog.com/dasboot/pkg/seeder/config"
+	"go.githedgehog.com/dasboot/pkg/seeder/errors"
+	"go.githedgehog.com/dasboot/pkg/seeder/server"
+	"go.githedgehog.com/dasboot/pkg/seeder/server/generic"
+	"go.uber.org/zap"
+)
+
+// swappableHandler serves with the handler that was stored last. Requests which are in flight when a new
+// handler gets stored finish with the handler that they started with.
+type swappableHandler struct {
+	h atomic.Pointer[http.Handler]
+}
+
+func newSwappableHandler(h http.Handler) *swappableHandler {
+	ret := &swappableHandler{}
+	ret.store(h)
+	return ret
+}
+
+func (sh *swappableHandler) store(h http.Handler) {
+	sh.h.Store(&h)
+}
+
+func (sh *swappableHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	(*sh.h.Load()).ServeHTTP(w, r)
+}
+
+// reloadState holds everything that is necessary to apply a new configuration to a running seeder
+type reloadState struct {
+	sync.Mutex
+	cfg      *config.SeederConfig
+	current  *seeder
+	insecure *swappableHandler
+	secure   *swappableHandler
+	admin    *swappableHandler
+}
+
+// Reload applies `cfg` to the running seeder. The servers are being rebound to changed addresses and
+// certificates, and the artifacts provider, embedded config generator and installer settings are being
+// replaced. Nothing is applied if any of it fails to load.
+//
+// Every reload builds a new copy of the seeder which serves all new requests. Requests which are in flight,
+// like installer downloads, finish with the copy that they started with, and servers which are no longer
+// configured are drained within the drain timeout.
+func (s *seeder) Reload(ctx context.Context, cfg *config.SeederConfig) error {
+	if s.reload == nil {
+		return errors.ReloadRequiresRestartError("reloading is not supported by this seeder")
+	}
+	s.reload.Lock()
+	defer s.reload.Unlock()
+
+	if err := validateConfig(cfg); err != nil {
+		return err
+	}
+	if err := checkReload(s.reload.cfg, cfg); err != nil {
+		return err
+	}
+
+	next, err := s.reload.current.reloaded(ctx, cfg)
+	if err != nil {
+		return err
+	}
+
+	// now rebind the servers, which were all checked to be rebindable before
+	var insecureServer *config.BindInfo
+	if cfg.InsecureServer != nil {
+		insecureServer = cfg.InsecureServer.Generic
+	}
+	servers := []struct {
+		name string
+		srv  server.ControlInterface
+		bi   *config.BindInfo
+	}{
+		{"insecure server", s.insecureServer, insecureServer},
+		{"secure server", s.secureServer, cfg.SecureServer},
+		{"admin server", s.adminServer, cfg.AdminServer},
+		{"metrics server", s.metricsServer, cfg.MetricsServer},
+	}
+	for _, srv := range servers {
+		if srv.srv == nil {
+			continue
+		}
+		r, ok := srv.srv.(rebinder)
+		if !ok {
+			return errors.ReloadRequiresRestartError(srv.name + " cannot be rebound")
+		}
+		if err := r.Rebind(srv.bi, s.drainTimeout); err != nil {
+			return fmt.Errorf("%s: %w", srv.name, err)
+		}
+	}
+
+	// and switch all new requests over to the new seeder
+	s.reload.insecure.store(next.insecureHandler())
+	s.reload.secure.store(next.secureHandler())
+	s.reload.admin.store(next.adminHandler())
+	s.reload.current = next
+	s.reload.cfg = cfg
+	l.Info("Seeder configuration reloaded", zap.Bool("onieDiscovery", next.onieDiscovery), zap.Strings("stageVersions", next.stageVersions))
+	return nil
+}
+
+// rebinder is implemented by servers which can change their bind info while they are running
+type rebinder interface {
+	Rebind(*config.BindInfo, time.Duration) error
+}
+
+// reloaded returns a copy of the seeder with everything loaded from `cfg` which can change on a reload.
+// All state which must survive a reload is shared with the copy.
+func (s *seeder) reloaded(ctx context.Context, cfg *config.SeederConfig) (*seeder, error) {
+	next := *s
+	next.artifactsProvider = cfg.ArtifactsProvider
+	next.manifest = cfg.ArtifactManifest
+	next.onieDiscovery = cfg.InsecureServer != nil && cfg.InsecureServer.ONIEDiscovery
+	next.certificates = certificateFiles(cfg)
+	next.stageVersions = nil
+
+	var err error
+	next.adminClientCAs, err = loadAdminClientCAs(cfg.AdminServer)
+	if err != nil {
+		return nil, errors.InvalidConfigError(err.Error())
+	}
+
+	if err := next.intializeEmbeddedConfigGenerator(cfg.EmbeddedConfigGenerator); err != nil {
+		return nil, errors.EmbeddedConfigGeneratorError(err.Error())
+	}
+	if err := next.initializeInstallerSettings(cfg.InstallerSettings); err != nil {
+		return nil, errors.InstallerSettingsError(err)
+	}
+	next.installerSettings.plainHTTP = cfg.LabMode && cfg.SecureServer != nil && cfg.SecureServer.ServerKeyPath == ""
+
+	if len(next.installerSettings.compatibility) > 0 {
+		next.stageVersions = stageArtifactVersions(cfg.ArtifactsProvider)
+		if err := next.installerSettings.compatibility.check(componentVersions{dasboot: next.stageVersions}); err != nil {
+			return nil, errors.InstallerSettingsError(fmt.Errorf("stage artifacts: %w", err))
+		}
+	}
+
+	// the certificates must be usable before we switch over to them
+	if err := next.checkCertificates(ctx); err != nil {
+		return nil, errors.InvalidConfigError(err.Error())
+	}
+	return &next, nil
+}
+
+// checkReload returns an error if the change from `from` to `to` cannot be applied without a restart
+func checkReload(from, to *config.SeederConfig) error {
+	requiresRestart := func(what string, changed bool) error {
+		if changed {
+			return errors.ReloadRequiresRestartError(what + " changed")
+		}
+		return nil
+	}
+	bindInfoChanged := func(what string, from, to *config.BindInfo) error {
+		if (from == nil) != (to == nil) {
+			return errors.ReloadRequiresRestartError(what + " was added or removed")
+		}
+		if from == nil {
+			return nil
+		}
+		if err := generic.CheckRebind(from, to); err != nil {
+			return fmt.Errorf("%s: %w", what, err)
+		}
+		return nil
+	}
+
+	var fromInsecure, toInsecure config.InsecureServer
+	if from.InsecureServer != nil {
+		fromInsecure = *from.InsecureServer
+	}
+	if to.InsecureServer != nil {
+		toInsecure = *to.InsecureServer
+	}
+	for _, err := range []error{
+		requiresRestart("insecure server", (from.InsecureServer == nil) != (to.InsecureServer == nil)),
+		requiresRestart("DynLL", !reflect.DeepEqual(fromInsecure.DynLL, toInsecure.DynLL)),
+		bindInfoChanged("insecure server", fromInsecure.Generic, toInsecure.Generic),
+		bindInfoChanged("secure server", from.SecureServer, to.SecureServer),
+		bindInfoChanged("admin server", from.AdminServer, to.AdminServer),
+		bindInfoChanged("metrics server", from.MetricsServer, to.MetricsServer),
+		requiresRestart("lab mode", from.LabMode != to.LabMode),
+		requiresRestart("registry settings", !reflect.DeepEqual(from.RegistrySettings, to.RegistrySettings)),
+		requiresRestart("limits", !reflect.DeepEqual(from.Limits, to.Limits)),
+		requiresRestart("log shipping", !reflect.DeepEqual(from.LogShipping, to.LogShipping)),
+		requiresRestart("diagnostics uploads", !reflect.DeepEqual(from.DiagnosticsUploads, to.DiagnosticsUploads)),
+		requiresRestart("revocation", !reflect.DeepEqual(from.Revocation, to.Revocation)),
+		requiresRestart("drain timeout", from.DrainTimeout != to.DrainTimeout),
+	} {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
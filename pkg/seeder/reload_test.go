@@ -0,0 +1,223 @@
+// Copyright 2023 Hedgehog
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package seeder
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	seederconfig "go.githedgehog.com/dasboot/pkg/seeder/config"
+	seedererrors "go.githedgehog.com/dasboot/pkg/seeder/errors"
+	"go.githedgehog.com/dasboot/pkg/seeder/server/generic"
+)
+
+func Test_checkReload(t *testing.T) {
+	bi := func(tls bool, addrs ...string) *seederconfig.BindInfo {
+		ret := &seederconfig.BindInfo{Address: addrs}
+		if tls {
+			ret.ServerKeyPath = "server.key"
+			ret.ServerCertPath = "server.pem"
+		}
+		return ret
+	}
+	from := &seederconfig.SeederConfig{
+		InsecureServer: &seederconfig.InsecureServer{Generic: bi(false, "[::]:80")},
+		SecureServer:   bi(true, "[::]:443"),
+		DrainTimeout:   time.Minute,
+	}
+	tests := []struct {
+		name        string
+		to          func(c seederconfig.SeederConfig) *seederconfig.SeederConfig
+		wantRestart bool
+	}{
+		{
+			name: "unchanged",
+			to:   func(c seederconfig.SeederConfig) *seederconfig.SeederConfig { return &c },
+		},
+		{
+			name: "addresses and ONIE discovery changed",
+			to: func(c seederconfig.SeederConfig) *seederconfig.SeederConfig {
+				c.InsecureServer = &seederconfig.InsecureServer{Generic: bi(false, "[::]:80", "[::]:8080"), ONIEDiscovery: true}
+				c.SecureServer = bi(true, "[::]:8443")
+				return &c
+			},
+		},
+		{
+			name: "admin server added",
+			to: func(c seederconfig.SeederConfig) *seederconfig.SeederConfig {
+				c.AdminServer = bi(true, "[::]:9443")
+				return &c
+			},
+			wantRestart: true,
+		},
+		{
+			name: "secure server without TLS",
+			to: func(c seederconfig.SeederConfig) *seederconfig.SeederConfig {
+				c.SecureServer = bi(false, "[::]:443")
+				return &c
+			},
+			wantRestart: true,
+		},
+		{
+			name: "DynLL added",
+			to: func(c seederconfig.SeederConfig) *seederconfig.SeederConfig {
+				c.InsecureServer = &seederconfig.InsecureServer{Generic: bi(false, "[::]:80"), DynLL: &seederconfig.DynLL{ListeningPort: 80}}
+				return &c
+			},
+			wantRestart: true,
+		},
+		{
+			name: "lab mode",
+			to: func(c seederconfig.SeederConfig) *seederconfig.SeederConfig {
+				c.LabMode = true
+				return &c
+			},
+			wantRestart: true,
+		},
+		{
+			name: "limits",
+			to: func(c seederconfig.SeederConfig) *seederconfig.SeederConfig {
+				c.Limits = &seederconfig.Limits{MaxConcurrentDownloads: 1}
+				return &c
+			},
+			wantRestart: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := checkReload(from, tt.to(*from))
+			if errors.Is(err, seedererrors.ErrReloadRequiresRestart) != tt.wantRestart {
+				t.Errorf("checkReload() error = %v, wantRestart %v", err, tt.wantRestart)
+			}
+		})
+	}
+}
+
+func freeAddress(t *testing.T) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	return ln.Addr().String()
+}
+
+func TestSeeder_Reload(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	addr1 := freeAddress(t)
+	cfg := newSelfTestConfig(t, "")
+	cfg.SecureServer.Address = []string{addr1}
+	cfg.DrainTimeout = time.Second
+
+	// this is what New does, without the control plane and registry
+	s := &seeder{
+		done:          make(chan struct{}),
+		err:           make(chan error, 10),
+		limits:        newLimits(nil),
+		metrics:       newMetrics(),
+		downloads:     newDownloadSessions(),
+		drainTimeout:  cfg.DrainTimeout,
+		cancellations: newInstallCancellations(),
+	}
+	initial, err := s.reloaded(ctx, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.reload = &reloadState{
+		cfg:      cfg,
+		current:  initial,
+		insecure: newSwappableHandler(initial.insecureHandler()),
+		secure:   newSwappableHandler(initial.secureHandler()),
+		admin:    newSwappableHandler(initial.adminHandler()),
+	}
+	s.secureServer, err = generic.NewGenericServer(cfg.SecureServer, s.reload.secure)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Start()
+	defer func() {
+		s.Stop(ctx)
+		<-s.Done()
+	}()
+
+	client := &http.Client{
+		Timeout:   5 * time.Second,
+		Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}, //nolint: gosec
+	}
+	healthz := func(addr string) error {
+		resp, err := client.Get("https://" + addr + healthzPath)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return errors.New(resp.Status)
+		}
+		return nil
+	}
+	waitFor := func(addr string, up bool) {
+		t.Helper()
+		deadline := time.Now().Add(10 * time.Second)
+		for {
+			err := healthz(addr)
+			if (err == nil) == up {
+				return
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("server on %s: up = %v, last error = %v", addr, !up, err)
+			}
+			time.Sleep(50 * time.Millisecond)
+		}
+	}
+	waitFor(addr1, true)
+
+	// a change which requires a restart must not apply anything
+	labCfg := *cfg
+	labCfg.LabMode = true
+	if err := s.Reload(ctx, &labCfg); !errors.Is(err, seedererrors.ErrReloadRequiresRestart) {
+		t.Fatalf("Reload() error = %v, want %v", err, seedererrors.ErrReloadRequiresRestart)
+	}
+	if s.reload.current != initial {
+		t.Fatalf("Reload() replaced the seeder even though it failed")
+	}
+
+	// moving the secure server and changing installer settings
+	addr2 := freeAddress(t)
+	next := *cfg
+	next.SecureServer = &seederconfig.BindInfo{
+		Address:        []string{addr2},
+		ServerKeyPath:  cfg.SecureServer.ServerKeyPath,
+		ServerCertPath: cfg.SecureServer.ServerCertPath,
+	}
+	is := *cfg.InstallerSettings
+	is.ControlVIP = "192.168.42.2"
+	next.InstallerSettings = &is
+	if err := s.Reload(ctx, &next); err != nil {
+		t.Fatalf("Reload() error = %v", err)
+	}
+	waitFor(addr2, true)
+	waitFor(addr1, false)
+	if got := s.reload.current.installerSettings.controlVIP; got != "192.168.42.2" {
+		t.Errorf("control VIP = %s, want 192.168.42.2", got)
+	}
+}
@@ -0,0 +1,310 @@
+// Copyright 2023 Hedgehog
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package revocation
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"go.githedgehog.com/dasboot/pkg/log"
+	"go.uber.org/zap"
+)
+
+var (
+	ErrRevoked      = errors.New("revocation: client certificate has been revoked")
+	ErrNoDeviceID   = errors.New("revocation: no device ID")
+	ErrNoCRLEntries = errors.New("revocation: no CRL found in file")
+)
+
+// Revocation locks a device out of the secure server. All client certificates of the device which were
+// issued before the revocation are being rejected. If `SerialNumber` is set, only the certificate with this
+// serial number is being rejected.
+type Revocation struct {
+	DeviceID     string    `json:"devid"`
+	SerialNumber string    `json:"serial_number,omitempty"`
+	Reason       string    `json:"reason,omitempty"`
+	RevokedAt    time.Time `json:"revoked_at"`
+}
+
+// revokes returns true if `cert` is revoked by `r`
+func (r *Revocation) revokes(cert *x509.Certificate) bool {
+	if cert.Subject.CommonName != r.DeviceID {
+		return false
+	}
+	if r.SerialNumber != "" {
+		return cert.SerialNumber.Text(16) == r.SerialNumber
+	}
+	return cert.NotBefore.Before(r.RevokedAt)
+}
+
+// Checker checks client certificates against the revocations which were made through the seeder, and
+// against a CRL file if one is configured. The CRL file is being reloaded whenever it changes, so that it
+// can be updated without restarting the seeder. If the checker was loaded from a state file with `Load`,
+// every change to the revocations is being written back to it.
+type Checker struct {
+	lock        sync.RWMutex
+	revocations map[string]*Revocation
+	path        string
+	now         func() time.Time
+
+	crlLock    sync.Mutex
+	crlPath    string
+	crlModTime time.Time
+	crls       []*x509.RevocationList
+}
+
+// NewChecker creates a new checker. If `crlPath` is empty, no CRL is being checked.
+func NewChecker(crlPath string) *Checker {
+	return &Checker{
+		revocations: make(map[string]*Revocation),
+		now:         time.Now,
+		crlPath:     crlPath,
+	}
+}
+
+// Load restores the revocations from the state file at `path`, and persists all further changes to it. A
+// missing state file is not an error, it is being created with the first revocation.
+func (c *Checker) Load(path string) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	b, err := os.ReadFile(path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("revocation: reading state: %w", err)
+	}
+	if len(b) > 0 {
+		var revocations []*Revocation
+		if err := json.Unmarshal(b, &revocations); err != nil {
+			return fmt.Errorf("revocation: decoding state '%s': %w", path, err)
+		}
+		for _, r := range revocations {
+			if r != nil && r.DeviceID != "" {
+				c.revocations[r.DeviceID] = r
+			}
+		}
+	}
+	c.path = path
+	return nil
+}
+
+// LoadCRL loads the CRL file now. It does not need to be called as the CRL file is being loaded on first
+// use, but it allows to fail early on an invalid CRL file.
+func (c *Checker) LoadCRL() error {
+	c.crlLock.Lock()
+	defer c.crlLock.Unlock()
+	return c.reloadCRL()
+}
+
+// reloadCRL loads the CRL file if it changed since it was loaded last, the CRL lock must be held
+func (c *Checker) reloadCRL() error {
+	if c.crlPath == "" {
+		return nil
+	}
+	st, err := os.Stat(c.crlPath)
+	if err != nil {
+		return fmt.Errorf("revocation: CRL: %w", err)
+	}
+	if st.ModTime().Equal(c.crlModTime) && c.crls != nil {
+		return nil
+	}
+	b, err := os.ReadFile(c.crlPath)
+	if err != nil {
+		return fmt.Errorf("revocation: CRL: %w", err)
+	}
+	crls, err := parseCRLs(b)
+	if err != nil {
+		return fmt.Errorf("revocation: CRL '%s': %w", c.crlPath, err)
+	}
+	c.crls = crls
+	c.crlModTime = st.ModTime()
+	log.L().Info("revocation: CRL loaded", zap.String("path", c.crlPath), zap.Int("crls", len(crls)))
+	return nil
+}
+
+// parseCRLs parses all CRLs from PEM data, or a single CRL in DER format
+func parseCRLs(b []byte) ([]*x509.RevocationList, error) {
+	if !bytes.Contains(b, []byte("-----BEGIN")) {
+		crl, err := x509.ParseRevocationList(b)
+		if err != nil {
+			return nil, err
+		}
+		return []*x509.RevocationList{crl}, nil
+	}
+	var ret []*x509.RevocationList
+	for {
+		var p *pem.Block
+		p, b = pem.Decode(b)
+		if p == nil {
+			break
+		}
+		if p.Type != "X509 CRL" {
+			continue
+		}
+		crl, err := x509.ParseRevocationList(p.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, crl)
+	}
+	if len(ret) == 0 {
+		return nil, ErrNoCRLEntries
+	}
+	return ret, nil
+}
+
+// Check returns `ErrRevoked` if `cert` was revoked through the seeder, or if it is listed in a CRL which
+// was signed by `issuer`. CRLs of other issuers are being ignored.
+func (c *Checker) Check(cert, issuer *x509.Certificate) error {
+	c.lock.RLock()
+	r, ok := c.revocations[cert.Subject.CommonName]
+	c.lock.RUnlock()
+	if ok && r.revokes(cert) {
+		return fmt.Errorf("%w: device '%s' revoked at %s", ErrRevoked, r.DeviceID, r.RevokedAt.Format(time.RFC3339))
+	}
+
+	if c.crlPath == "" || issuer == nil {
+		return nil
+	}
+	c.crlLock.Lock()
+	defer c.crlLock.Unlock()
+	if err := c.reloadCRL(); err != nil {
+		// we keep using the CRL which we have if the new one is broken
+		log.L().Error("revocation: reloading CRL failed", zap.Error(err))
+	}
+	for _, crl := range c.crls {
+		if err := crl.CheckSignatureFrom(issuer); err != nil {
+			continue
+		}
+		if !crl.NextUpdate.IsZero() && c.now().After(crl.NextUpdate) {
+			log.L().Warn("revocation: CRL is outdated", zap.String("issuer", issuer.Subject.String()), zap.Time("nextUpdate", crl.NextUpdate))
+		}
+		for _, entry := range crl.RevokedCertificateEntries {
+			if entry.SerialNumber.Cmp(cert.SerialNumber) == 0 {
+				return fmt.Errorf("%w: serial number %s listed in CRL of '%s'", ErrRevoked, cert.SerialNumber.Text(16), issuer.Subject.String())
+			}
+		}
+	}
+	return nil
+}
+
+// VerifyConnection can be used as `VerifyConnection` in a TLS config. It checks the verified client certificate
+// of the connection. Connections without a client certificate are not affected.
+func (c *Checker) VerifyConnection(cs tls.ConnectionState) error {
+	for _, chain := range cs.VerifiedChains {
+		if len(chain) == 0 {
+			continue
+		}
+		var issuer *x509.Certificate
+		if len(chain) > 1 {
+			issuer = chain[1]
+		}
+		if err := c.Check(chain[0], issuer); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// DeviceRevoked returns true if all client certificates of the device `devID` are revoked. Such devices
+// must not register again either.
+func (c *Checker) DeviceRevoked(devID string) bool {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	r, ok := c.revocations[devID]
+	return ok && r.SerialNumber == ""
+}
+
+// Revoke adds a revocation for the device `r.DeviceID`. It replaces any existing revocation of the device.
+func (c *Checker) Revoke(r *Revocation) (*Revocation, error) {
+	if r.DeviceID == "" {
+		return nil, ErrNoDeviceID
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	ret := *r
+	ret.RevokedAt = c.now()
+	c.revocations[r.DeviceID] = &ret
+	c.save()
+	return &ret, nil
+}
+
+// Unrevoke removes the revocation of a device. It returns false if there was no revocation.
+func (c *Checker) Unrevoke(devID string) bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if _, ok := c.revocations[devID]; !ok {
+		return false
+	}
+	delete(c.revocations, devID)
+	c.save()
+	return true
+}
+
+// List returns all revocations sorted by device ID
+func (c *Checker) List() []*Revocation {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.sorted()
+}
+
+// sorted returns all revocations sorted by device ID, the lock must be held
+func (c *Checker) sorted() []*Revocation {
+	ret := make([]*Revocation, 0, len(c.revocations))
+	for _, r := range c.revocations {
+		ret = append(ret, r)
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i].DeviceID < ret[j].DeviceID })
+	return ret
+}
+
+// save writes the revocations to the state file if there is one, the write lock must be held
+func (c *Checker) save() {
+	if c.path == "" {
+		return
+	}
+	b, err := json.Marshal(c.sorted())
+	if err == nil {
+		err = writeFileAtomic(c.path, b)
+	}
+	if err != nil {
+		log.L().Error("revocation: persisting state failed", zap.String("path", c.path), zap.Error(err))
+	}
+}
+
+func writeFileAtomic(path string, b []byte) error {
+	f, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write(b); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
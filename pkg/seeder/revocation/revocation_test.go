@@ -0,0 +1,227 @@
+// Copyright 2023 Hedgehog
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package revocation
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+type testCA struct {
+	key  *ecdsa.PrivateKey
+	cert *x509.Certificate
+}
+
+func newTestCA(t *testing.T) *testCA {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testCA{key: key, cert: cert}
+}
+
+func (ca *testCA) issue(t *testing.T, devID string, serial int64, notBefore time.Time) *x509.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: devID},
+		NotBefore:    notBefore,
+		NotAfter:     notBefore.Add(time.Hour * 24),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert
+}
+
+func (ca *testCA) writeCRL(t *testing.T, path string, serials ...int64) {
+	t.Helper()
+	tmpl := &x509.RevocationList{
+		Number:     big.NewInt(time.Now().UnixNano()),
+		ThisUpdate: time.Now().Add(-time.Minute),
+		NextUpdate: time.Now().Add(time.Hour),
+	}
+	for _, serial := range serials {
+		tmpl.RevokedCertificateEntries = append(tmpl.RevokedCertificateEntries, x509.RevocationListEntry{
+			SerialNumber:   big.NewInt(serial),
+			RevocationTime: time.Now(),
+		})
+	}
+	der, err := x509.CreateRevocationList(rand.Reader, tmpl, ca.cert, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "X509 CRL", Bytes: der}), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestChecker_Revoke(t *testing.T) {
+	ca := newTestCA(t)
+	now := time.Now()
+	statePath := filepath.Join(t.TempDir(), "revocations.json")
+	c := NewChecker("")
+	c.now = func() time.Time { return now }
+	if err := c.Load(statePath); err != nil {
+		t.Fatalf("Load() error = %v", err)
+	}
+
+	before := ca.issue(t, "dev1", 10, now.Add(-time.Hour))
+	after := ca.issue(t, "dev1", 11, now.Add(time.Minute))
+	other := ca.issue(t, "dev2", 12, now.Add(-time.Hour))
+
+	if _, err := c.Revoke(&Revocation{}); !errors.Is(err, ErrNoDeviceID) {
+		t.Fatalf("Revoke() error = %v, want %v", err, ErrNoDeviceID)
+	}
+	r, err := c.Revoke(&Revocation{DeviceID: "dev1", Reason: "stolen"})
+	if err != nil {
+		t.Fatalf("Revoke() error = %v", err)
+	}
+	if !r.RevokedAt.Equal(now) || !c.DeviceRevoked("dev1") || c.DeviceRevoked("dev2") {
+		t.Fatalf("Revoke() = %#v, want revocation of dev1 at %s", r, now)
+	}
+
+	// certificates which were issued before the revocation are rejected, newer ones are not
+	if err := c.Check(before, ca.cert); !errors.Is(err, ErrRevoked) {
+		t.Errorf("Check() error = %v, want %v", err, ErrRevoked)
+	}
+	if err := c.Check(after, ca.cert); err != nil {
+		t.Errorf("Check() error = %v for certificate issued after revocation", err)
+	}
+	if err := c.Check(other, ca.cert); err != nil {
+		t.Errorf("Check() error = %v for other device", err)
+	}
+	if err := c.VerifyConnection(tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{before, ca.cert}}}); !errors.Is(err, ErrRevoked) {
+		t.Errorf("VerifyConnection() error = %v, want %v", err, ErrRevoked)
+	}
+	if err := c.VerifyConnection(tls.ConnectionState{}); err != nil {
+		t.Errorf("VerifyConnection() error = %v for connection without client certificate", err)
+	}
+
+	// a revocation of a serial number only affects that certificate
+	if _, err := c.Revoke(&Revocation{DeviceID: "dev1", SerialNumber: after.SerialNumber.Text(16)}); err != nil {
+		t.Fatalf("Revoke() error = %v", err)
+	}
+	if c.DeviceRevoked("dev1") {
+		t.Errorf("DeviceRevoked() = true for revocation of a serial number")
+	}
+	if err := c.Check(before, ca.cert); err != nil {
+		t.Errorf("Check() error = %v for certificate with other serial number", err)
+	}
+	if err := c.Check(after, ca.cert); !errors.Is(err, ErrRevoked) {
+		t.Errorf("Check() error = %v, want %v", err, ErrRevoked)
+	}
+
+	// revocations survive a restart
+	c2 := NewChecker("")
+	if err := c2.Load(statePath); err != nil {
+		t.Fatalf("Load() error = %v", err)
+	}
+	if list := c2.List(); len(list) != 1 || list[0].SerialNumber != after.SerialNumber.Text(16) {
+		t.Fatalf("List() = %#v after Load(), want persisted revocation", list)
+	}
+
+	if !c.Unrevoke("dev1") || c.Unrevoke("dev1") {
+		t.Fatalf("Unrevoke() did not remove the revocation exactly once")
+	}
+	if err := c.Check(after, ca.cert); err != nil {
+		t.Errorf("Check() error = %v after Unrevoke()", err)
+	}
+}
+
+func TestChecker_CRL(t *testing.T) {
+	ca := newTestCA(t)
+	otherCA := newTestCA(t)
+	crlPath := filepath.Join(t.TempDir(), "ca.crl")
+	ca.writeCRL(t, crlPath, 20)
+
+	c := NewChecker(crlPath)
+	if err := c.LoadCRL(); err != nil {
+		t.Fatalf("LoadCRL() error = %v", err)
+	}
+	revoked := ca.issue(t, "dev1", 20, time.Now().Add(-time.Hour))
+	valid := ca.issue(t, "dev2", 21, time.Now().Add(-time.Hour))
+	otherIssuer := otherCA.issue(t, "dev3", 20, time.Now().Add(-time.Hour))
+
+	if err := c.Check(revoked, ca.cert); !errors.Is(err, ErrRevoked) {
+		t.Errorf("Check() error = %v, want %v", err, ErrRevoked)
+	}
+	if err := c.Check(valid, ca.cert); err != nil {
+		t.Errorf("Check() error = %v for certificate which is not in the CRL", err)
+	}
+	if err := c.Check(otherIssuer, otherCA.cert); err != nil {
+		t.Errorf("Check() error = %v for certificate of another issuer", err)
+	}
+
+	// an updated CRL is being picked up
+	ca.writeCRL(t, crlPath, 21)
+	future := time.Now().Add(time.Minute)
+	if err := os.Chtimes(crlPath, future, future); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Check(revoked, ca.cert); err != nil {
+		t.Errorf("Check() error = %v after CRL update", err)
+	}
+	if err := c.Check(valid, ca.cert); !errors.Is(err, ErrRevoked) {
+		t.Errorf("Check() error = %v after CRL update, want %v", err, ErrRevoked)
+	}
+
+	// a broken CRL fails early
+	if err := os.WriteFile(crlPath, []byte("not a CRL"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := NewChecker(crlPath).LoadCRL(); err == nil {
+		t.Errorf("LoadCRL() error = nil for broken CRL")
+	}
+}
@@ -0,0 +1,92 @@
+// Copyright 2023 Hedgehog
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package seeder
+
+import (
+	"net/http"
+
+	"github.com/go-chi/chi/v5"
+	"go.uber.org/zap"
+
+	"go.githedgehog.com/dasboot/pkg/seeder/config"
+	"go.githedgehog.com/dasboot/pkg/seeder/revocation"
+)
+
+const adminRevocationsPath = "/revocations"
+
+// RevocationRequest is the optional request body for revoking the client certificates of a device
+type RevocationRequest struct {
+	// SerialNumber restricts the revocation to the client certificate with this serial number in hex. If it
+	// is empty, all client certificates of the device which were issued until now are revoked, and the
+	// device cannot register again until the revocation is deleted.
+	SerialNumber string `json:"serial_number,omitempty"`
+
+	// Reason is a free form explanation for the revocation, e.g. "stolen" or "RMA"
+	Reason string `json:"reason,omitempty"`
+}
+
+func newRevocationChecker(cfg *config.Revocation) (*revocation.Checker, error) {
+	if cfg == nil {
+		return revocation.NewChecker(""), nil
+	}
+	c := revocation.NewChecker(cfg.CRLPath)
+	if err := c.LoadCRL(); err != nil {
+		return nil, err
+	}
+	if cfg.StatePath != "" {
+		if err := c.Load(cfg.StatePath); err != nil {
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+func (s *seeder) listRevocationsHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, r, http.StatusOK, s.revocations.List())
+}
+
+func (s *seeder) revokeHandler(w http.ResponseWriter, r *http.Request) {
+	devidParam := chi.URLParam(r, "devid")
+	if devidParam == "" {
+		errorWithJSON(w, r, http.StatusBadRequest, "no device ID in URL")
+		return
+	}
+
+	var req RevocationRequest
+	if r.ContentLength != 0 && !s.limits.decodeJSONRequest(w, r, &req) {
+		return
+	}
+	rev, err := s.revocations.Revoke(&revocation.Revocation{
+		DeviceID:     devidParam,
+		SerialNumber: req.SerialNumber,
+		Reason:       req.Reason,
+	})
+	if err != nil {
+		errorWithJSON(w, r, http.StatusBadRequest, "revoking device '%s': %s", devidParam, err)
+		return
+	}
+	l.Warn("Device client certificates revoked", zap.String("devid", devidParam), zap.String("serialNumber", rev.SerialNumber), zap.String("reason", rev.Reason))
+	writeJSON(w, r, http.StatusOK, rev)
+}
+
+func (s *seeder) deleteRevocationHandler(w http.ResponseWriter, r *http.Request) {
+	devidParam := chi.URLParam(r, "devid")
+	if !s.revocations.Unrevoke(devidParam) {
+		errorWithJSON(w, r, http.StatusNotFound, "no revocation found for device '%s'", devidParam)
+		return
+	}
+	l.Info("Device revocation deleted", zap.String("devid", devidParam))
+	w.WriteHeader(http.StatusNoContent)
+}
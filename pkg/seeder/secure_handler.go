@@ -17,19 +17,23 @@ package seeder
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"net/http"
 	"path"
+	"time"
 
 	confighhagentprov "go.githedgehog.com/dasboot/pkg/hhagentprov/config"
 	"go.githedgehog.com/dasboot/pkg/log"
 	"go.githedgehog.com/dasboot/pkg/seeder/controlplane"
+	"go.githedgehog.com/dasboot/pkg/seeder/firstboot"
 	"go.githedgehog.com/dasboot/pkg/seeder/registration"
 	config1 "go.githedgehog.com/dasboot/pkg/stage1/config"
 	config2 "go.githedgehog.com/dasboot/pkg/stage2/config"
+	"go.githedgehog.com/dasboot/pkg/version"
 	agentv1alpha2 "go.githedgehog.com/fabric/api/agent/v1alpha2"
 	"gopkg.in/yaml.v2"
 
@@ -45,28 +49,51 @@ const (
 	onieUpdaterPathBase        = "/onie/update/"
 	hhAgentProvisionerPathBase = "/provisioners/hedgehog-agent/"
 	registerPath               = "/register"
+	renewPath                  = "/renew"
 )
 
 func (s *seeder) secureHandler() *chi.Mux {
 	r := chi.NewRouter()
 	r.Use(middleware.RequestID)
+	r.Use(s.metrics.instrument("secure"))
 	r.Use(RequestLogger(log.L()))
 	r.Use(middleware.Recoverer)
 	r.Use(middleware.RealIP)
 	r.Use(AddResponseRequestID())
-	r.Use(middleware.Heartbeat("/healthz"))
-	r.Get(path.Join(stage1PathBase, "{arch}"), s.getStageArtifact("stage1", s.stage1Authz, s.embedStage1Config))
-	r.Get(path.Join(stage2PathBase, "{arch}"), s.getStageArtifact("stage2", s.stage2Authz, s.embedStage2Config))
-	r.Post(registerPath, s.registerHandler)
+	r.Use(SignResponses(s.ecg.key, s.ecg.certDER))
+	r.Get(healthzPath, s.healthzHandler)
+	r.Get(readyzPath, s.readyzHandler)
+	r.Get(openAPIPath, s.getOpenAPIDocument(APISecure))
+	r.Get(path.Join(stage1PathBase, "{arch}"), s.getStageArtifact("stage1", s.artifactAuthz(artifactClassStage1), s.embedStage1Config))
+	r.Get(path.Join(stage2PathBase, "{arch}"), s.getStageArtifact("stage2", s.artifactAuthz(artifactClassStage2), s.embedStage2Config))
+	r.With(s.limits.maxRequestBody(s.limits.maxRegisterRequestSize)).Post(registerPath, s.registerHandler)
 	r.Get(path.Join(registerPath, "{devid}"), s.registerPollHandler)
-	r.Get(path.Join(nosInstallerPathBase, "{platform}", "{devid}"), s.getNOSArtifact(s.stage2Authz))
-	r.Get(path.Join(onieUpdaterPathBase, "{platform}"), s.getONIEArtifact(s.stage2Authz))
+	r.With(s.limits.maxRequestBody(s.limits.maxRegisterRequestSize)).Post(renewPath, s.renewHandler)
+	r.Get(caBundlePath, s.getCABundle)
+	if s.logs != nil {
+		r.With(s.limits.maxRequestBody(s.logs.maxChunkSize)).Post(logShippingPath, s.uploadLogsHandler)
+	}
+	if s.uploads != nil {
+		r.With(s.limits.maxRequestBody(s.limits.maxAdminRequestSize)).Post(diagnosticsUploadsPath, s.createUploadHandler)
+		r.Get(path.Join(diagnosticsUploadsPath, "{id}"), s.getUploadHandler)
+		r.With(s.limits.maxRequestBody(s.uploads.maxChunkSize)).Patch(path.Join(diagnosticsUploadsPath, "{id}"), s.uploadChunkHandler)
+	}
+	r.Get(path.Join(nosInstallerPathBase, "{platform}", "{devid}"), s.getNOSArtifact(s.artifactAuthz(artifactClassNOS)))
+	r.Get(path.Join(onieUpdaterPathBase, "{platform}"), s.getONIEArtifact(s.artifactAuthz(artifactClassONIE)))
 	// to lift the confusion: this is the route for the provisioner executable
-	r.Get(path.Join(hhAgentProvisionerPathBase, "{arch}"), s.getStageArtifact("hedgehog-agent-provisioner", s.stage2Authz, s.embedStageHedgehogAgentProvisionerConfig))
+	r.Get(path.Join(hhAgentProvisionerPathBase, "{arch}"), s.getStageArtifact("hedgehog-agent-provisioner", s.artifactAuthz(artifactClassProvisioner), s.embedStageHedgehogAgentProvisionerConfig))
 	// and this is the route to the agent executable which the provisioner calls
-	r.Get(path.Join(hhAgentProvisionerPathBase, "agent", "{devid}"), s.getAgentArtifact(s.stage2Authz))
-	r.Get(path.Join(hhAgentProvisionerPathBase, "agent", "config", "{devid}"), s.getAgentConfig(s.stage2Authz))
-	r.Get(path.Join(hhAgentProvisionerPathBase, "agent", "kubeconfig", "{devid}"), s.getAgentKubeconfig(s.stage2Authz))
+	r.Get(path.Join(hhAgentProvisionerPathBase, "agent", "{devid}"), s.getAgentArtifact(s.artifactAuthz(artifactClassAgent)))
+	r.Get(path.Join(hhAgentProvisionerPathBase, "agent", "config", "{devid}"), s.getAgentConfig(s.artifactAuthz(artifactClassAgent)))
+	r.Get(path.Join(hhAgentProvisionerPathBase, "agent", "kubeconfig", "{devid}"), s.getAgentKubeconfig(s.artifactAuthz(artifactClassAgent)))
+	r.Get(path.Join(hhAgentProvisionerPathBase, "agent", "firstboot", "{devid}"), s.getAgentFirstBootPayload(s.artifactAuthz(artifactClassAgent)))
+	r.Get(path.Join(deviceMetadataPathBase, "{devid}"), s.getDeviceMetadata(s.artifactAuthz(artifactClassDeviceMetadata)))
+	r.Get(path.Join(installCancellationPath, "{devid}"), s.getInstallCancellation(s.artifactAuthz(artifactClassInstallCancellation)))
+	r.Post(path.Join(installCancellationPath, "{devid}"), s.reportInstallCancellation(s.artifactAuthz(artifactClassInstallCancellation)))
+	if s.installerSettings != nil && s.installerSettings.identityBackups {
+		r.With(s.limits.maxRequestBody(s.limits.maxRegisterRequestSize)).Post(identityBackupPath, s.uploadIdentityBackupHandler)
+		r.Get(path.Join(identityBackupPath, "{devid}"), s.getIdentityBackupHandler)
+	}
 	return r
 }
 
@@ -84,9 +111,17 @@ func (s *seeder) getStageArtifact(artifact string, authz func(*http.Request) err
 			return
 		}
 
-		// get the artifact which is architecture dependent
-		artifactArch := artifact + "-" + archParam
-		f := s.artifactsProvider.Get(artifactArch)
+		// get the artifact which is architecture dependent, platform specific builds take precedence
+		var f io.ReadCloser
+		var artifactArch string
+		if platformParam := chi.URLParam(r, "platform"); platformParam != "" {
+			artifactArch = s.resolveArtifact(r, artifact+"-"+platformParam)
+			f = s.artifactsProvider.Get(artifactArch)
+		}
+		if f == nil {
+			artifactArch = s.resolveArtifact(r, artifact+"-"+archParam)
+			f = s.artifactsProvider.Get(artifactArch)
+		}
 		if f == nil {
 			errorWithJSON(w, r, http.StatusNotFound, "artifact '%s' not found", artifactArch)
 			return
@@ -95,9 +130,9 @@ func (s *seeder) getStageArtifact(artifact string, authz func(*http.Request) err
 
 		// we need to read it completely into memory because it needs to be signed
 		// and get its config embedded
-		artifactBytes, err := io.ReadAll(f)
+		artifactBytes, err := s.limits.readArtifact(f)
 		if err != nil {
-			errorWithJSON(w, r, http.StatusInternalServerError, "failed to read artifact: %s", err)
+			errorWithJSON(w, r, artifactReadErrorStatus(err), "failed to read artifact: %s", err)
 			return
 		}
 
@@ -108,10 +143,19 @@ func (s *seeder) getStageArtifact(artifact string, authz func(*http.Request) err
 			return
 		}
 
+		// the provenance covers the artifact as it is stored, the embedded configuration
+		// which gets appended to it is covered by its own signature
+		if err := setArtifactProvenanceHeaders(w.Header(), s.ecg.key, s.ecg.certDER, s.artifactProvenance(artifactArch, artifactBytes)); err != nil {
+			errorWithJSON(w, r, http.StatusInternalServerError, "failed to generate artifact provenance: %s", err)
+			return
+		}
+
 		src := bufio.NewReader(bytes.NewBuffer(signedArtifactWithConfig))
 		w.Header().Set("Content-Type", "application/octet-stream")
 		w.WriteHeader(http.StatusOK)
-		if _, err := io.Copy(w, src); err != nil {
+		n, err := io.Copy(w, src)
+		s.metrics.addArtifactBytes(artifactArch, n)
+		if err != nil {
 			l.Error("failed to write artifact to HTTP response",
 				zap.String("request", middleware.GetReqID(r.Context())),
 				zap.String("artifact", artifactArch),
@@ -121,86 +165,79 @@ func (s *seeder) getStageArtifact(artifact string, authz func(*http.Request) err
 	}
 }
 
-func (s *seeder) stage1Authz(r *http.Request) error {
-	// stage1 just needs to ensure that the request was made with TLS
-	// In the future that might get extended to require other details
-	if r.TLS == nil {
-		return fmt.Errorf("stage 1 artifact requires a TLS connection")
-	}
-	return nil
-}
-
-func (s *seeder) embedStage1Config(_ *http.Request, arch string, artifactBytes []byte) ([]byte, error) {
+func (s *seeder) embedStage1Config(r *http.Request, arch string, artifactBytes []byte) ([]byte, error) {
 	return s.ecg.Stage1(artifactBytes, &config1.Stage1{
-		RegisterURL: s.installerSettings.registerURL(),
-		Stage2URL:   s.installerSettings.stage2URL(arch),
+		RegisterURL:              s.installerSettings.registerURL(),
+		RenewURL:                 s.installerSettings.renewURL(),
+		Stage2URL:                s.installerSettings.stage2URL(arch),
+		Stage2Mirrors:            s.installerSettings.stage2Mirrors(arch),
+		Stage2Pin:                s.artifactPin(r, "stage2-"+arch),
+		LabMode:                  s.labMode,
+		EncryptIdentityPartition: s.installerSettings.encryptIdentity,
+		IdentityBackupURL:        s.installerSettings.identityBackupURL(),
 	})
 }
 
-func (s *seeder) stage2Authz(r *http.Request) error {
-	// must be a TLS request
-	if r.TLS == nil {
-		return fmt.Errorf("stage 2 artifact requires a TLS connection")
-	}
-
-	// If there were no client certificates provided (and verified),
-	// then you don't have access to this route
-	if len(r.TLS.PeerCertificates) < 1 {
-		return fmt.Errorf("device certificate not presented")
-	}
-
-	// check if certificate is not revoked
-	// This might be covered by golang, but probably not entirely, we need to check
-	// TODO
-
-	// get the UUID of the device from the cert
-	deviceCert := r.TLS.PeerCertificates[0]
-	uuid := deviceCert.Subject.CommonName
-	if uuid == "" {
-		return fmt.Errorf("device certificate missing its CN UUID")
+func (s *seeder) embedStage2Config(r *http.Request, arch string, artifactBytes []byte) ([]byte, error) {
+	// the NOS configuration preservation policy is per device, so it only applies if the device is known
+	var preserveNOSConfig []string
+	if r.TLS != nil && len(r.TLS.PeerCertificates) > 0 {
+		preserveNOSConfig = s.installerSettings.nosConfigToPreserve(r.TLS.PeerCertificates[0].Subject.CommonName)
 	}
-
-	// check if we have this in our registry
-	// this essentially makes revoking certificates needless for basic use-cases:
-	// a device which is deleted from the control plane will not be able
-	// to gain access to images anymore. Only compromised devices/certificates
-	// still require the additional check as the device ID will never change
-	// TODO
-
-	// check the keylime CV for the status of the client first
-	// this essentially means that only devices with good hardware attestation
-	// state are allowed to get an installation image
-	// TODO
-
-	return nil
-}
-
-func (s *seeder) embedStage2Config(_ *http.Request, arch string, artifactBytes []byte) ([]byte, error) {
 	return s.ecg.Stage2(artifactBytes, &config2.Stage2{
-		Platform:        "", // this should be empty, might only be useful in the future
-		NOSInstallerURL: s.installerSettings.nosInstallerURL(),
-		ONIEUpdaterURL:  s.installerSettings.onieUpdaterURL(),
-		NOSType:         "hedgehog_sonic",
+		Platform:            "", // this should be empty, might only be useful in the future
+		NOSInstallerURL:     s.installerSettings.nosInstallerURL(),
+		NOSInstallerMirrors: s.installerSettings.nosInstallerMirrors(),
+		ONIEUpdaterURL:      s.installerSettings.onieUpdaterURL(),
+		NOSType:             "hedgehog_sonic",
+		DiagBoot:            s.installerSettings.diagBoot,
+		// the allowlisted MAC addresses are only meant for provisioning
+		RollbackMACAllowlist:    len(s.installerSettings.macAllowlists) > 0,
+		GPTAttributes:           s.installerSettings.gptAttributes,
+		PreserveNOSConfig:       preserveNOSConfig,
+		DisableDiscardPlatforms: s.installerSettings.disableDiscard,
+		DeviceMetadataURL:       s.installerSettings.deviceMetadataURL(),
+		InstallCancellationURL:  s.installerSettings.installCancellationURL(),
+		DiagnosticsUploadsURL:   s.diagnosticsUploadsURL(),
+		LogShippingURL:          s.logShippingURL(),
+		LabMode:                 s.labMode,
 		HedgehogSonicProvisioners: []config2.HedgehogSonicProvisioner{
 			{
 				Name: "hedgehog-agent-provisioner",
 				URL:  s.installerSettings.hhAgentProvisionerURL(arch),
+				Pin:  s.artifactPin(r, "hedgehog-agent-provisioner-"+arch),
 			},
 		},
 	})
 }
 
-func (s *seeder) embedStageHedgehogAgentProvisionerConfig(_ *http.Request, arch string, artifactBytes []byte) ([]byte, error) {
+func (s *seeder) embedStageHedgehogAgentProvisionerConfig(r *http.Request, arch string, artifactBytes []byte) ([]byte, error) {
+	// the agent is configured per device, so it can only be pinned if the device is known
+	var agentPin *version.ArtifactPin
+	if r.TLS != nil && len(r.TLS.PeerCertificates) > 0 {
+		if agentArtifact, err := s.agentArtifact(r.Context(), r.TLS.PeerCertificates[0].Subject.CommonName); err != nil {
+			l.Warn("Not pinning agent as its artifact could not be determined", zap.String("request", middleware.GetReqID(r.Context())), zap.Error(err))
+		} else {
+			agentPin = s.artifactPin(r, agentArtifact)
+		}
+	}
 	return s.ecg.HedgehogAgentProvisioner(artifactBytes, &confighhagentprov.HedgehogAgentProvisioner{
-		AgentURL:           s.installerSettings.agentURL(),
-		AgentConfigURL:     s.installerSettings.agentConfigURL(),
-		AgentKubeconfigURL: s.installerSettings.agentKubeconfigURL(),
+		AgentURL:              s.installerSettings.agentURL(),
+		AgentPin:              agentPin,
+		AgentConfigURL:        s.installerSettings.agentConfigURL(),
+		AgentKubeconfigURL:    s.installerSettings.agentKubeconfigURL(),
+		AgentFirstBootURL:     s.installerSettings.agentFirstBootURL(),
+		CABundleURL:           s.installerSettings.caBundleURL(),
+		DeviceMetadataURL:     s.installerSettings.deviceMetadataURL(),
+		DiagnosticsUploadsURL: s.diagnosticsUploadsURL(),
+		LabMode:               s.labMode,
+		LogShippingURL:        s.logShippingURL(),
 	})
 }
 
 func (s *seeder) registerHandler(w http.ResponseWriter, r *http.Request) {
 	// must be a TLS request
-	if r.TLS == nil {
+	if r.TLS == nil && !s.labMode {
 		errorWithJSON(w, r, http.StatusBadRequest, "route requires a TLS connection")
 		return
 	}
@@ -211,8 +248,7 @@ func (s *seeder) registerHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	var req registration.Request
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		errorWithJSON(w, r, http.StatusBadRequest, "failed to decode JSON request: %s", err)
+	if !s.limits.decodeJSONRequest(w, r, &req) {
 		return
 	}
 
@@ -229,13 +265,38 @@ func (s *seeder) registerHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	resp := s.registry.ProcessRequest(r.Context(), &req)
+	// devices without a location partition can still tell us where they are through their LLDP neighbours
+	if req.LocationInfo == nil && len(req.Neighbors) > 0 {
+		ctx, cancel := context.WithTimeout(r.Context(), time.Second*30)
+		defer cancel()
+		if sw, _ := s.neighbourSwitchByLLDP(ctx, req.Neighbors); sw != nil {
+			loc, err := switchLocation(sw)
+			if err != nil {
+				log.L().Error("failed to marshal location information of neighbouring switch", zap.Error(err))
+			} else {
+				log.L().Info("Inferred location information for registration request from LLDP neighbors", zap.String("devid", req.DeviceID), zap.Reflect("loc", loc))
+				req.LocationInfo = loc
+			}
+		}
+	}
+
+	// revoked devices must not get a new client certificate either
+	var resp *registration.Response
+	if s.revocations.DeviceRevoked(req.DeviceID) {
+		resp = &registration.Response{
+			Status:            registration.RegistrationStatusRejected,
+			StatusDescription: fmt.Sprintf("device '%s' has been revoked", req.DeviceID),
+		}
+	} else {
+		resp = s.registry.ProcessRequest(r.Context(), &req)
+	}
+	s.metrics.recordRegistration(resp)
 	writeRegistrationResponse(w, r, resp)
 }
 
 func (s *seeder) registerPollHandler(w http.ResponseWriter, r *http.Request) {
 	// must be a TLS request
-	if r.TLS == nil {
+	if r.TLS == nil && !s.labMode {
 		errorWithJSON(w, r, http.StatusBadRequest, "route requires a TLS connection")
 		return
 	}
@@ -255,6 +316,32 @@ func (s *seeder) registerPollHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	resp := s.registry.ProcessRequest(r.Context(), req)
+	s.metrics.recordRegistration(resp)
+	writeRegistrationResponse(w, r, resp)
+}
+
+func (s *seeder) renewHandler(w http.ResponseWriter, r *http.Request) {
+	// the device proves who it is with the client certificate which it wants to renew
+	if err := checkAccessLevel(r, accessRegistered); err != nil {
+		errorWithJSON(w, r, http.StatusForbidden, "certificate renewal: %s", err)
+		return
+	}
+
+	var req registration.RenewalRequest
+	if !s.limits.decodeJSONRequest(w, r, &req) {
+		return
+	}
+	if err := req.Validate(); err != nil {
+		errorWithJSON(w, r, http.StatusBadRequest, "invalid request: %s", err.Error())
+		return
+	}
+
+	resp := s.registry.Renew(r.Context(), r.TLS.PeerCertificates[0], &req)
+	l.Info("Certificate renewal processed",
+		zap.String("request", middleware.GetReqID(r.Context())),
+		zap.String("devid", r.TLS.PeerCertificates[0].Subject.CommonName),
+		zap.String("status", string(resp.Status)),
+	)
 	writeRegistrationResponse(w, r, resp)
 }
 
@@ -312,12 +399,6 @@ func (s *seeder) getNOSArtifact(authz func(*http.Request) error) func(w http.Res
 			return
 		}
 
-		// the device ID parameter and the CN of the peer cert need to match
-		if err := s.authzMatchDevice(r, devidParam); err != nil {
-			errorWithJSON(w, r, http.StatusForbidden, "unauthorized access to artifact: %s", err)
-			return
-		}
-
 		// get agent config from control plane
 		agentCfg, err := s.cpc.GetAgentConfig(r.Context(), devidParam)
 		if err != nil {
@@ -335,11 +416,17 @@ func (s *seeder) getNOSArtifact(authz func(*http.Request) error) func(w http.Res
 			return
 		}
 		sonicVersion := agent.Spec.Version.NOSVersion
+		if err := s.checkCompatibility(agent); err != nil {
+			s.recordDeviceEvent(r.Context(), devidParam, controlplane.DeviceEventFailed, err.Error())
+			errorWithJSON(w, r, http.StatusConflict, "%s", err)
+			return
+		}
 
 		artifact := fmt.Sprintf("sonic/%s", platformParam)
 		if sonicVersion != "" {
 			artifact += ":" + sonicVersion
 		}
+		s.recordDeviceEvent(r.Context(), devidParam, controlplane.DeviceEventInstalling, fmt.Sprintf("NOS installer download started: %s", artifact))
 		s.getArtifact(artifact)(w, r)
 	}
 }
@@ -377,79 +464,143 @@ func (s *seeder) getAgentArtifact(authz func(*http.Request) error) func(w http.R
 			return
 		}
 
-		// get agent config from control plane
-		agentCfg, err := s.cpc.GetAgentConfig(r.Context(), devidParam)
+		// get the agent version from the agent config from the control plane
+		artifact, err := s.agentArtifact(r.Context(), devidParam)
 		if err != nil {
 			if errors.Is(err, controlplane.ErrNotFound) {
 				errorWithJSON(w, r, http.StatusNotFound, "agent config not found: %s", err)
 				return
 			}
-			errorWithJSON(w, r, http.StatusInternalServerError, "fetching agent config: %s", err)
+			if errors.Is(err, ErrIncompatibleVersions) {
+				s.recordDeviceEvent(r.Context(), devidParam, controlplane.DeviceEventFailed, err.Error())
+				errorWithJSON(w, r, http.StatusConflict, "%s", err)
+				return
+			}
+			errorWithJSON(w, r, http.StatusInternalServerError, "%s", err)
 			return
 		}
+		s.getArtifact(artifact)(w, r)
+	}
+}
 
-		var agent *agentv1alpha2.Agent
-		if err := yaml.Unmarshal(agentCfg, &agent); err != nil {
-			errorWithJSON(w, r, http.StatusInternalServerError, "unmarshalling agent config: %s", err)
-			return
-		}
-		agentVersion := agent.Spec.Version.Default
-		if agent.Spec.Version.Override != "" {
-			agentVersion = agent.Spec.Version.Override
-		}
+// agentArtifact returns the agent artifact which is configured for the device `devid` in its agent config
+func (s *seeder) agentArtifact(ctx context.Context, devid string) (string, error) {
+	agentCfg, err := s.cpc.GetAgentConfig(ctx, devid)
+	if err != nil {
+		return "", fmt.Errorf("fetching agent config: %w", err)
+	}
 
-		artifact := "fabric/agent"
-		if agentVersion != "" {
-			artifact += ":" + agentVersion
-		}
-		s.getArtifact(artifact)(w, r)
+	var agent *agentv1alpha2.Agent
+	if err := yaml.Unmarshal(agentCfg, &agent); err != nil {
+		return "", fmt.Errorf("unmarshalling agent config: %w", err)
+	}
+	if err := s.checkCompatibility(agent); err != nil {
+		return "", err
+	}
+
+	artifact := "fabric/agent"
+	if v := agentVersion(agent); v != "" {
+		artifact += ":" + v
 	}
+	return artifact, nil
+}
+
+// agentVersion returns the version of the agent which is configured for a device
+func agentVersion(agent *agentv1alpha2.Agent) string {
+	if agent.Spec.Version.Override != "" {
+		return agent.Spec.Version.Override
+	}
+	return agent.Spec.Version.Default
+}
+
+// checkCompatibility returns ErrIncompatibleVersions if the agent and NOS which are configured for a device
+// are not compatible with each other or with the stages of the seeder
+func (s *seeder) checkCompatibility(agent *agentv1alpha2.Agent) error {
+	return s.installerSettings.compatibility.check(componentVersions{
+		dasboot: s.stageVersions,
+		agent:   agentVersion(agent),
+		nos:     agent.Spec.Version.NOSVersion,
+	})
+}
+
+// resolveArtifact returns the artifact name which should be served for the device which is making
+// the request. This is `artifact` unless an artifact override was set for the device on the admin server.
+func (s *seeder) resolveArtifact(r *http.Request, artifact string) string {
+	// the device is only known if it presented its client certificate
+	if r.TLS == nil || len(r.TLS.PeerCertificates) < 1 {
+		return artifact
+	}
+	deviceID := r.TLS.PeerCertificates[0].Subject.CommonName
+	if override, ok := s.overrides.get(deviceID, artifact); ok {
+		l.Info("Serving artifact override for device",
+			zap.String("request", middleware.GetReqID(r.Context())),
+			zap.String("devid", deviceID),
+			zap.String("artifact", artifact),
+			zap.String("override", override),
+		)
+		return override
+	}
+	return artifact
 }
 
 func (s *seeder) getArtifact(artifact string) func(w http.ResponseWriter, r *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
+		artifact := s.resolveArtifact(r, artifact)
+
+		// these are the large artifacts, so we limit how many of them we serve at the same time
+		release, ok := s.limits.acquireDownload()
+		if !ok {
+			w.Header().Set("Retry-After", downloadRetryAfter)
+			errorWithJSON(w, r, http.StatusServiceUnavailable, "too many concurrent downloads, retry later")
+			return
+		}
+		defer release()
+
 		f := s.artifactsProvider.Get(artifact)
 		if f == nil {
 			errorWithJSON(w, r, http.StatusNotFound, "artifact '%s' not found", artifact)
 			return
 		}
 		defer f.Close()
+		if err := s.limits.checkArtifactSize(f); err != nil {
+			errorWithJSON(w, r, artifactReadErrorStatus(err), "artifact '%s': %s", artifact, err)
+			return
+		}
+
+		// track the download, so that a shutdown of the seeder can wait for it to finish
+		sess, ok := s.downloads.start(r, artifact, artifactSize(f))
+		if !ok {
+			w.Header().Set("Retry-After", drainRetryAfter)
+			errorWithJSON(w, r, http.StatusServiceUnavailable, "seeder is shutting down, retry later")
+			return
+		}
+		defer s.downloads.finish(sess)
 
 		w.Header().Set("Content-Type", "application/octet-stream")
-		w.WriteHeader(http.StatusOK)
-		if _, err := io.Copy(w, f); err != nil {
+		var n int64
+		var err error
+		if ra, ok := f.(rangeableArtifact); ok {
+			// the size of these artifacts has been checked already
+			n, err = s.serveArtifactRanges(w, r, artifact, ra, sess)
+		} else {
+			w.WriteHeader(http.StatusOK)
+			n, err = io.Copy(io.MultiWriter(w, sess), s.limits.limitArtifact(f))
+		}
+		s.metrics.addArtifactBytes(artifact, n)
+		if err != nil {
 			l.Error("failed to write artifact to HTTP response",
 				zap.String("request", middleware.GetReqID(r.Context())),
 				zap.String("artifact", artifact),
 				zap.Error(err),
 			)
+			// the client must not mistake a truncated artifact for a complete one
+			if errors.Is(err, ErrArtifactTooLarge) {
+				panic(http.ErrAbortHandler)
+			}
 		}
 	}
 }
 
-func (s *seeder) authzMatchDevice(r *http.Request, deviceID string) error {
-	// TODO: this is redundant, needs better treatment somehow
-	// must be a TLS request
-	if r.TLS == nil {
-		return fmt.Errorf("stage 2 artifact requires a TLS connection")
-	}
-
-	// If there were no client certificates provided (and verified),
-	// then you don't have access to this route
-	if len(r.TLS.PeerCertificates) < 1 {
-		return fmt.Errorf("device certificate not presented")
-	}
-
-	// get the UUID of the device from the cert
-	deviceCert := r.TLS.PeerCertificates[0]
-	uuid := deviceCert.Subject.CommonName
-
-	if uuid != deviceID {
-		return fmt.Errorf("device ID mismatch")
-	}
-	return nil
-}
-
 func (s *seeder) getAgentConfig(authz func(*http.Request) error) func(w http.ResponseWriter, r *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
 		if err := authz(r); err != nil {
@@ -464,12 +615,6 @@ func (s *seeder) getAgentConfig(authz func(*http.Request) error) func(w http.Res
 			return
 		}
 
-		// the device ID parameter and the CN of the peer cert need to match
-		if err := s.authzMatchDevice(r, devidParam); err != nil {
-			errorWithJSON(w, r, http.StatusForbidden, "unauthorized access to artifact: %s", err)
-			return
-		}
-
 		// get agent config from control plane
 		agentCfg, err := s.cpc.GetAgentConfig(r.Context(), devidParam)
 		if err != nil {
@@ -503,12 +648,6 @@ func (s *seeder) getAgentKubeconfig(authz func(*http.Request) error) func(w http
 			return
 		}
 
-		// the device ID parameter and the CN of the peer cert need to match
-		if err := s.authzMatchDevice(r, devidParam); err != nil {
-			errorWithJSON(w, r, http.StatusForbidden, "unauthorized access to artifact: %s", err)
-			return
-		}
-
 		// get agent kubeconfig from control plane
 		agentKubeconfigBytes, err := s.cpc.GetAgentKubeconfig(r.Context(), devidParam)
 		if err != nil {
@@ -527,3 +666,46 @@ func (s *seeder) getAgentKubeconfig(authz func(*http.Request) error) func(w http
 		}
 	}
 }
+
+func (s *seeder) getAgentFirstBootPayload(authz func(*http.Request) error) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if err := authz(r); err != nil {
+			errorWithJSON(w, r, http.StatusForbidden, "unauthorized access to artifact: %s", err)
+			return
+		}
+
+		// get the device ID from the URL paramater
+		devidParam := chi.URLParam(r, "devid")
+		if devidParam == "" {
+			errorWithJSON(w, r, http.StatusBadRequest, "no device ID in URL")
+			return
+		}
+
+		// the authz check ensures that this is the registered certificate of the device
+		if r.TLS == nil || len(r.TLS.PeerCertificates) < 1 {
+			errorWithJSON(w, r, http.StatusForbidden, "no device certificate presented")
+			return
+		}
+
+		// get agent kubeconfig from control plane
+		agentKubeconfigBytes, err := s.cpc.GetAgentKubeconfig(r.Context(), devidParam)
+		if err != nil {
+			if errors.Is(err, controlplane.ErrNotFound) {
+				errorWithJSON(w, r, http.StatusNotFound, "agent kubeconfig not found: %s", err)
+				return
+			}
+			errorWithJSON(w, r, http.StatusInternalServerError, "fetching agent kubeconfig: %s", err)
+			return
+		}
+
+		envelope, err := firstboot.Seal(r.TLS.PeerCertificates[0].PublicKey, s.installerSettings.firstBootPayload(devidParam, agentKubeconfigBytes))
+		if err != nil {
+			errorWithJSON(w, r, http.StatusInternalServerError, "sealing first-boot payload: %s", err)
+			return
+		}
+		// the agent provisioner fetches this at the very end of an installation
+		s.metrics.installationFinished(devidParam)
+		s.releaseIPAMLease(devidParam)
+		writeJSON(w, r, http.StatusOK, envelope)
+	}
+}
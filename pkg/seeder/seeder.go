@@ -16,6 +16,8 @@ package seeder
 
 import (
 	"context"
+	"crypto/x509"
+	"fmt"
 	"sync"
 	"time"
 
@@ -24,7 +26,9 @@ import (
 	"go.githedgehog.com/dasboot/pkg/seeder/config"
 	"go.githedgehog.com/dasboot/pkg/seeder/controlplane"
 	"go.githedgehog.com/dasboot/pkg/seeder/errors"
+	"go.githedgehog.com/dasboot/pkg/seeder/ipam"
 	"go.githedgehog.com/dasboot/pkg/seeder/registration"
+	"go.githedgehog.com/dasboot/pkg/seeder/revocation"
 	"go.githedgehog.com/dasboot/pkg/seeder/server"
 	"go.githedgehog.com/dasboot/pkg/seeder/server/dynll"
 	"go.githedgehog.com/dasboot/pkg/seeder/server/generic"
@@ -55,6 +59,10 @@ type Interface interface {
 
 	// Err returns a channel which will get errors of servers during startup pushed
 	Err() <-chan error
+
+	// Reload applies a new configuration to the running seeder without dropping requests which are in flight.
+	// It returns an error and applies nothing if a change requires a restart of the seeder.
+	Reload(context.Context, *config.SeederConfig) error
 }
 
 type seeder struct {
@@ -64,26 +72,76 @@ type seeder struct {
 	secureServer        server.ControlInterface
 	insecureServer      server.ControlInterface
 	insecureServerDynLL server.ControlInterface
+	adminServer         server.ControlInterface
+	metricsServer       server.ControlInterface
+	metrics             *metrics
 	artifactsProvider   artifacts.Provider
+	manifest            *artifacts.Manifest
+	overrides           *artifactOverrides
+	cancellations       *installCancellations
+	ipamLeases          *ipam.Leases
+	revocations         *revocation.Checker
+	recoveryReports     *recoveryReports
+	logs                *logStore
+	uploads             *uploadStore
+	limits              *limits
+	downloads           *downloadSessions
+	etags               *artifactETags
+	drainTimeout        time.Duration
 	installerSettings   *loadedInstallerSettings
+	stageVersions       []string
 	registry            *registration.Processor
 	cpc                 controlplane.Client
+	onieDiscovery       bool
+	labMode             bool
+	labCA               *labCA
+	certificates        []certificateFile
+	reload              *reloadState
+
+	// adminClientCAs are the CAs which client certificates on the admin server must chain to. They must not
+	// be the CAs of device certificates, or devices would be admins.
+	adminClientCAs *x509.CertPool
 }
 
 var _ Interface = &seeder{}
 
-func New(ctx context.Context, cfg *config.SeederConfig) (Interface, error) {
+// validateConfig checks `cfg` for everything that is required by New and Reload
+func validateConfig(cfg *config.SeederConfig) error {
 	if cfg == nil {
-		return nil, errors.InvalidConfigError("empty config")
+		return errors.InvalidConfigError("empty config")
 	}
 	if cfg.InsecureServer == nil && cfg.SecureServer == nil {
-		return nil, errors.InvalidConfigError("neither InsecureServer nor SecureServer are set")
+		return errors.InvalidConfigError("neither InsecureServer nor SecureServer are set")
 	}
 	if cfg.ArtifactsProvider == nil {
-		return nil, errors.InvalidConfigError("no artifacts provider")
+		return errors.InvalidConfigError("no artifacts provider")
 	}
 	if cfg.InstallerSettings == nil {
-		return nil, errors.InvalidConfigError("no installer settings provided")
+		return errors.InvalidConfigError("no installer settings provided")
+	}
+	if cfg.SecureServer != nil && cfg.SecureServer.ServerKeyPath == "" && !cfg.LabMode {
+		return errors.InvalidConfigError("secure server without TLS is only allowed in lab mode")
+	}
+	if cfg.AdminServer != nil && cfg.AdminServer.ServerKeyPath != "" {
+		if cfg.AdminServer.ClientCAPath == "" {
+			return errors.InvalidConfigError("admin server with TLS requires a dedicated client CA")
+		}
+		if cfg.SecureServer != nil && cfg.SecureServer.ClientCAPath == cfg.AdminServer.ClientCAPath {
+			return errors.InvalidConfigError("admin server must not share its client CA with the secure server")
+		}
+	}
+	if cfg.InstallerSettings.RequireManifest && cfg.ArtifactManifest == nil {
+		return errors.InvalidConfigError("requiring the artifact manifest needs an artifact manifest")
+	}
+	return nil
+}
+
+func New(ctx context.Context, cfg *config.SeederConfig) (Interface, error) {
+	if err := validateConfig(cfg); err != nil {
+		return nil, err
+	}
+	if cfg.LabMode {
+		warnLabMode(cfg)
 	}
 
 	// initialize kubernetes client
@@ -118,9 +176,66 @@ func New(ctx context.Context, cfg *config.SeederConfig) (Interface, error) {
 	ret := &seeder{
 		done:              make(chan struct{}),
 		artifactsProvider: cfg.ArtifactsProvider,
+		manifest:          cfg.ArtifactManifest,
+		overrides:         newArtifactOverrides(),
+		cancellations:     newInstallCancellations(),
+		ipamLeases:        newIPAMLeases(cfg.IPAMLeases),
+		recoveryReports:   newRecoveryReports(),
+		limits:            newLimits(cfg.Limits),
+		downloads:         newDownloadSessions(),
+		etags:             newArtifactETags(),
+		metrics:           newMetrics(),
+		drainTimeout:      DefaultDrainTimeout,
 		cpc:               cpc,
+		onieDiscovery:     cfg.InsecureServer != nil && cfg.InsecureServer.ONIEDiscovery,
+		labMode:           cfg.LabMode,
+		certificates:      certificateFiles(cfg),
+	}
+
+	// lab mode replaces all PKI which is not configured with an ephemeral CA
+	if cfg.LabMode {
+		ret.labCA, err = newLabCA()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if cfg.DrainTimeout > 0 {
+		ret.drainTimeout = cfg.DrainTimeout
+	}
+
+	ret.adminClientCAs, err = loadAdminClientCAs(cfg.AdminServer)
+	if err != nil {
+		return nil, errors.InvalidConfigError(err.Error())
 	}
 
+	// initialize the storage for shipped device logs if enabled
+	logs, err := newLogStore(cfg.LogShipping)
+	if err != nil {
+		return nil, errors.InvalidConfigError(err.Error())
+	}
+	ret.logs = logs
+
+	// the leases of a previous run are still reserved for their devices
+	if cfg.IPAMLeases != nil && cfg.IPAMLeases.StatePath != "" {
+		if err := ret.ipamLeases.Load(cfg.IPAMLeases.StatePath); err != nil {
+			return nil, errors.InvalidConfigError(err.Error())
+		}
+	}
+
+	// revoked devices stay locked out across restarts, and a broken CRL must not go unnoticed
+	ret.revocations, err = newRevocationChecker(cfg.Revocation)
+	if err != nil {
+		return nil, errors.InvalidConfigError(err.Error())
+	}
+
+	// initialize the storage for uploaded diagnostic files if enabled
+	uploads, err := newUploadStore(cfg.DiagnosticsUploads)
+	if err != nil {
+		return nil, errors.InvalidConfigError(err.Error())
+	}
+	ret.uploads = uploads
+
 	// load the embedded configuration generator
 	if err := ret.intializeEmbeddedConfigGenerator(cfg.EmbeddedConfigGenerator); err != nil {
 		return nil, errors.EmbeddedConfigGeneratorError(err.Error())
@@ -130,18 +245,35 @@ func New(ctx context.Context, cfg *config.SeederConfig) (Interface, error) {
 	if err := ret.initializeInstallerSettings(cfg.InstallerSettings); err != nil {
 		return nil, errors.InstallerSettingsError(err)
 	}
+	ret.installerSettings.plainHTTP = cfg.LabMode && cfg.SecureServer != nil && cfg.SecureServer.ServerKeyPath == ""
+
+	// the stages which we serve must be compatible with each other before they are compatible with anything else,
+	// looking up their versions is only worth it if there is a compatibility matrix though
+	if len(ret.installerSettings.compatibility) > 0 {
+		ret.stageVersions = stageArtifactVersions(cfg.ArtifactsProvider)
+		if err := ret.installerSettings.compatibility.check(componentVersions{dasboot: ret.stageVersions}); err != nil {
+			return nil, errors.InstallerSettingsError(fmt.Errorf("stage artifacts: %w", err))
+		}
+		l.Info("Stage artifacts are compatible", zap.Strings("versions", ret.stageVersions))
+	}
 
 	// load the registry settings
 	if err := ret.initializeRegistrySettings(ctx, cfg.RegistrySettings, cpc); err != nil {
 		return nil, errors.RegistrySettingsError(err)
 	}
 
-	// this section sets up the servers
+	// this section sets up the servers, their handlers get swapped out on a reload
+	ret.reload = &reloadState{
+		cfg:      cfg,
+		insecure: newSwappableHandler(ret.insecureHandler()),
+		secure:   newSwappableHandler(ret.secureHandler()),
+		admin:    newSwappableHandler(ret.adminHandler()),
+	}
 	errChLen := 0
 	if cfg.InsecureServer != nil {
 		if cfg.InsecureServer.DynLL != nil {
 			var err error
-			ret.insecureServerDynLL, err = dynll.NewDynLLServer(ctx, k8sClient, cfg.InsecureServer.DynLL, ret.insecureHandler())
+			ret.insecureServerDynLL, err = dynll.NewDynLLServer(ctx, k8sClient, cfg.InsecureServer.DynLL, ret.reload.insecure)
 			if err != nil {
 				return nil, err
 			}
@@ -149,7 +281,7 @@ func New(ctx context.Context, cfg *config.SeederConfig) (Interface, error) {
 		}
 		if cfg.InsecureServer.Generic != nil {
 			var err error
-			ret.insecureServer, err = generic.NewGenericServer(cfg.InsecureServer.Generic, ret.insecureHandler())
+			ret.insecureServer, err = generic.NewGenericServer(cfg.InsecureServer.Generic, ret.reload.insecure)
 			if err != nil {
 				return nil, err
 			}
@@ -158,14 +290,34 @@ func New(ctx context.Context, cfg *config.SeederConfig) (Interface, error) {
 	}
 
 	if cfg.SecureServer != nil {
-		var err error
-		ret.secureServer, err = generic.NewGenericServer(cfg.SecureServer, ret.secureHandler())
+		secureServer, err := generic.NewGenericServer(cfg.SecureServer, ret.reload.secure)
 		if err != nil {
 			return nil, err
 		}
+		secureServer.SetVerifyConnection(ret.revocations.VerifyConnection)
+		ret.secureServer = secureServer
 		errChLen += len(cfg.SecureServer.Address)
 	}
+
+	if cfg.AdminServer != nil {
+		var err error
+		ret.adminServer, err = generic.NewGenericServer(cfg.AdminServer, ret.reload.admin)
+		if err != nil {
+			return nil, err
+		}
+		errChLen += len(cfg.AdminServer.Address)
+	}
+
+	if cfg.MetricsServer != nil {
+		var err error
+		ret.metricsServer, err = generic.NewGenericServer(cfg.MetricsServer, ret.metricsHandler())
+		if err != nil {
+			return nil, err
+		}
+		errChLen += len(cfg.MetricsServer.Address)
+	}
 	ret.err = make(chan error, errChLen)
+	ret.reload.current = ret
 
 	return ret, nil
 }
@@ -218,7 +370,37 @@ func (s *seeder) Start() {
 		}()
 	}
 
-	// we're all done once the secure and insecure servers are done
+	if s.adminServer != nil {
+		wg.Add(1)
+		go s.adminServer.Start()
+		go func() {
+			for {
+				err, ok := <-s.adminServer.Err()
+				if !ok {
+					wg.Done()
+					return
+				}
+				s.err <- err
+			}
+		}()
+	}
+
+	if s.metricsServer != nil {
+		wg.Add(1)
+		go s.metricsServer.Start()
+		go func() {
+			for {
+				err, ok := <-s.metricsServer.Err()
+				if !ok {
+					wg.Done()
+					return
+				}
+				s.err <- err
+			}
+		}()
+	}
+
+	// we're all done once the secure, insecure, admin and metrics servers are done
 	go func() {
 		if s.insecureServer != nil {
 			<-s.insecureServer.Done()
@@ -229,6 +411,12 @@ func (s *seeder) Start() {
 		if s.secureServer != nil {
 			<-s.secureServer.Done()
 		}
+		if s.adminServer != nil {
+			<-s.adminServer.Done()
+		}
+		if s.metricsServer != nil {
+			<-s.metricsServer.Done()
+		}
 		wg.Wait()
 		close(s.done)
 		close(s.err)
@@ -244,6 +432,9 @@ func (s *seeder) Err() <-chan error {
 }
 
 func (s *seeder) Stop(pctx context.Context) {
+	// give in-flight downloads the chance to finish first: cutting them off can leave a device in the middle of an installation
+	s.drainDownloads(pctx)
+
 	// whatever context we get passed in, we will definitely cancel after 30 seconds
 	ctx, cancel := context.WithTimeout(pctx, time.Second*30)
 	defer cancel()
@@ -278,6 +469,24 @@ func (s *seeder) Stop(pctx context.Context) {
 			wg.Done()
 		}()
 	}
+	if s.adminServer != nil {
+		wg.Add(1)
+		go func() {
+			if err := s.adminServer.Shutdown(ctx); err != nil {
+				l.Warn("admin server: graceful shutdown failed", zap.Error(err))
+			}
+			wg.Done()
+		}()
+	}
+	if s.metricsServer != nil {
+		wg.Add(1)
+		go func() {
+			if err := s.metricsServer.Shutdown(ctx); err != nil {
+				l.Warn("metrics server: graceful shutdown failed", zap.Error(err))
+			}
+			wg.Done()
+		}()
+	}
 	go func() {
 		wg.Wait()
 		close(done)
@@ -301,6 +510,16 @@ func (s *seeder) Stop(pctx context.Context) {
 				l.Debug("secure server: error on close", zap.Error(err))
 			}
 		}
+		if s.adminServer != nil {
+			if err := s.adminServer.Close(); err != nil {
+				l.Debug("admin server: error on close", zap.Error(err))
+			}
+		}
+		if s.metricsServer != nil {
+			if err := s.metricsServer.Close(); err != nil {
+				l.Debug("metrics server: error on close", zap.Error(err))
+			}
+		}
 	case <-done:
 		// graceful shutdown was successful
 	}
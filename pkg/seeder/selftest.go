@@ -0,0 +1,515 @@
+// Copyright 2023 Hedgehog
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package seeder
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"go.githedgehog.com/dasboot/pkg/config"
+	confighhagentprov "go.githedgehog.com/dasboot/pkg/hhagentprov/config"
+	dasbootv1alpha1 "go.githedgehog.com/dasboot/pkg/k8s/api/v1alpha1"
+	dasbootnet "go.githedgehog.com/dasboot/pkg/net"
+	seederconfig "go.githedgehog.com/dasboot/pkg/seeder/config"
+	"go.githedgehog.com/dasboot/pkg/seeder/controlplane"
+	seedererrors "go.githedgehog.com/dasboot/pkg/seeder/errors"
+	"go.githedgehog.com/dasboot/pkg/seeder/ipam"
+	"go.githedgehog.com/dasboot/pkg/seeder/registration"
+	"go.githedgehog.com/dasboot/pkg/seeder/revocation"
+	config0 "go.githedgehog.com/dasboot/pkg/stage0/config"
+	config1 "go.githedgehog.com/dasboot/pkg/stage1/config"
+	config2 "go.githedgehog.com/dasboot/pkg/stage2/config"
+	wiring1alpha2 "go.githedgehog.com/fabric/api/wiring/v1alpha2"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	selfTestSwitchName = "self-test-switch"
+	selfTestONIEPort   = "eth0"
+	selfTestSwitchIP   = "192.0.2.2/31"
+	selfTestServerIP   = "192.0.2.3/31"
+)
+
+var ErrSelfTestFailed = errors.New("seeder: self-test failed")
+
+// SelfTestResult is the result of a single self-test check against one endpoint
+type SelfTestResult struct {
+	Name     string
+	Endpoint string
+	Passed   bool
+	Err      error
+	Duration time.Duration
+}
+
+// SelfTestReport holds the results of all self-test checks in the order in which they were executed
+type SelfTestReport struct {
+	Results []SelfTestResult
+}
+
+// Passed returns true if all checks of the self-test passed
+func (r *SelfTestReport) Passed() bool {
+	for _, res := range r.Results {
+		if !res.Passed {
+			return false
+		}
+	}
+	return true
+}
+
+// Print writes a human readable pass/fail line per check to `w`
+func (r *SelfTestReport) Print(w io.Writer) {
+	for _, res := range r.Results {
+		status := "PASS"
+		if !res.Passed {
+			status = "FAIL"
+		}
+		fmt.Fprintf(w, "%s  %-28s %-48s %s\n", status, res.Name, res.Endpoint, res.Duration.Round(time.Millisecond))
+		if res.Err != nil {
+			fmt.Fprintf(w, "      %s\n", res.Err)
+		}
+	}
+}
+
+// SelfTest validates a full install path against the seeder configuration `cfg` without serving any real
+// device. It starts the insecure and secure handlers on ephemeral loopback ports, and then walks through the
+// same HTTP contract that stage 0 up to stage 2 are using: it downloads the stage 0 artifact, performs an IPAM
+// request, downloads stage 1, registers a throwaway device with a fresh CSR, and downloads stage 2 and the
+// hedgehog agent provisioner with the issued client certificate. Artifacts are checked against the digest of
+// the artifacts that the configured providers serve, and embedded configurations are verified.
+//
+// The self-test does not talk to the Kubernetes control plane: switch lookups are answered by a fake, and the
+// throwaway device registration is signed by an in-memory CA, so nothing is persisted.
+func SelfTest(ctx context.Context, cfg *seederconfig.SeederConfig, arch string) (*SelfTestReport, error) {
+	if cfg == nil {
+		return nil, seedererrors.InvalidConfigError("empty config")
+	}
+	if cfg.SecureServer == nil {
+		return nil, seedererrors.InvalidConfigError("self-test requires a SecureServer")
+	}
+	if cfg.SecureServer.ServerKeyPath == "" || cfg.SecureServer.ServerCertPath == "" {
+		return nil, seedererrors.InvalidConfigError("self-test requires SecureServer server key and cert")
+	}
+	if cfg.ArtifactsProvider == nil {
+		return nil, seedererrors.InvalidConfigError("no artifacts provider")
+	}
+	if cfg.InstallerSettings == nil {
+		return nil, seedererrors.InvalidConfigError("no installer settings provided")
+	}
+	if arch == "" {
+		arch = "x86_64"
+	}
+
+	subCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	cpc := &selfTestControlPlane{}
+	s := &seeder{
+		done:              make(chan struct{}),
+		artifactsProvider: cfg.ArtifactsProvider,
+		manifest:          cfg.ArtifactManifest,
+		overrides:         newArtifactOverrides(),
+		ipamLeases:        ipam.NewLeases(ipam.DefaultLeaseTTL),
+		revocations:       revocation.NewChecker(""),
+		recoveryReports:   newRecoveryReports(),
+		cancellations:     newInstallCancellations(),
+		limits:            newLimits(cfg.Limits),
+		metrics:           newMetrics(),
+		cpc:               cpc,
+		onieDiscovery:     cfg.InsecureServer != nil && cfg.InsecureServer.ONIEDiscovery,
+	}
+	if err := s.intializeEmbeddedConfigGenerator(cfg.EmbeddedConfigGenerator); err != nil {
+		return nil, seedererrors.EmbeddedConfigGeneratorError(err.Error())
+	}
+	if err := s.initializeInstallerSettings(cfg.InstallerSettings); err != nil {
+		return nil, seedererrors.InstallerSettingsError(err)
+	}
+
+	// the registration of the throwaway device is signed by an in-memory CA
+	caKey, caCert, err := newEphemeralCA("DAS BOOT Seeder Self-Test CA", time.Hour)
+	if err != nil {
+		return nil, fmt.Errorf("self-test CA: %w", err)
+	}
+	s.registry = registration.NewProcessor(subCtx, cpc, caKey, caCert, nil)
+	defer s.registry.Stop()
+
+	// now spin up the servers
+	insecureSrv := httptest.NewServer(s.insecureHandler())
+	defer insecureSrv.Close()
+
+	serverCert, err := tls.LoadX509KeyPair(cfg.SecureServer.ServerCertPath, cfg.SecureServer.ServerKeyPath)
+	if err != nil {
+		return nil, fmt.Errorf("loading secure server key pair: %w", err)
+	}
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(caCert)
+	secureSrv := httptest.NewUnstartedServer(s.secureHandler())
+	secureSrv.TLS = &tls.Config{
+		MinVersion:       tls.VersionTLS12,
+		ClientCAs:        clientCAs,
+		ClientAuth:       tls.VerifyClientCertIfGiven,
+		Certificates:     []tls.Certificate{serverCert},
+		VerifyConnection: s.revocations.VerifyConnection,
+	}
+	secureSrv.StartTLS()
+	defer secureSrv.Close()
+
+	st := &selfTest{
+		s:           s,
+		arch:        arch,
+		devID:       uuid.New().String(),
+		insecureURL: insecureSrv.URL,
+		secureURL:   secureSrv.URL,
+		report:      &SelfTestReport{},
+	}
+	if err := st.initClients(); err != nil {
+		return nil, err
+	}
+	st.run(subCtx)
+
+	return st.report, nil
+}
+
+type selfTest struct {
+	s            *seeder
+	arch         string
+	devID        string
+	insecureURL  string
+	secureURL    string
+	insecureHC   *http.Client
+	secureHC     *http.Client
+	registeredHC *http.Client
+	tlsCfg       *tls.Config
+	report       *SelfTestReport
+}
+
+func (st *selfTest) initClients() error {
+	// the client must trust the server through the CA which is being passed on to the installers,
+	// and it must use the server name which the installers are going to use
+	serverCA, err := x509.ParseCertificate(st.s.installerSettings.serverCADER)
+	if err != nil {
+		return fmt.Errorf("parsing server CA: %w", err)
+	}
+	rootCAs := x509.NewCertPool()
+	rootCAs.AddCert(serverCA)
+	serverName := st.s.installerSettings.secureServerName
+	if host, _, err := net.SplitHostPort(serverName); err == nil {
+		serverName = host
+	}
+	st.tlsCfg = &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		RootCAs:    rootCAs,
+		ServerName: serverName,
+	}
+	st.insecureHC = &http.Client{Timeout: time.Minute}
+	st.secureHC = &http.Client{
+		Timeout:   time.Minute,
+		Transport: &http.Transport{TLSClientConfig: st.tlsCfg},
+	}
+	return nil
+}
+
+func (st *selfTest) check(name, endpoint string, f func() error) bool {
+	start := time.Now()
+	err := f()
+	st.report.Results = append(st.report.Results, SelfTestResult{
+		Name:     name,
+		Endpoint: endpoint,
+		Passed:   err == nil,
+		Err:      err,
+		Duration: time.Since(start),
+	})
+	return err == nil
+}
+
+func (st *selfTest) run(ctx context.Context) {
+	stage0Path := "/stage0/" + st.arch
+	st.check("stage0 artifact", stage0Path, func() error {
+		return st.downloadStage(ctx, st.insecureHC, st.insecureURL+stage0Path, "stage0", &config0.Stage0{})
+	})
+
+	st.check("ipam", ipamPath, func() error {
+		return st.doIPAM(ctx)
+	})
+
+	stage1Path := stage1PathBase + st.arch
+	st.check("stage1 artifact", stage1Path, func() error {
+		return st.downloadStage(ctx, st.secureHC, st.secureURL+stage1Path, "stage1", &config1.Stage1{})
+	})
+
+	registered := st.check("registration", registerPath, func() error {
+		return st.register(ctx)
+	})
+	if !registered {
+		return
+	}
+
+	stage2Path := stage2PathBase + st.arch
+	st.check("stage2 artifact", stage2Path, func() error {
+		return st.downloadStage(ctx, st.registeredHC, st.secureURL+stage2Path, "stage2", &config2.Stage2{})
+	})
+
+	provisionerPath := hhAgentProvisionerPathBase + st.arch
+	st.check("hedgehog agent provisioner", provisionerPath, func() error {
+		return st.downloadStage(ctx, st.registeredHC, st.secureURL+provisionerPath, "hedgehog-agent-provisioner", &confighhagentprov.HedgehogAgentProvisioner{})
+	})
+}
+
+// downloadStage downloads a stage artifact, ensures that the executable part matches the digest of the
+// artifact from the artifacts provider, and verifies the embedded configuration
+func (st *selfTest) downloadStage(ctx context.Context, hc *http.Client, u, artifact string, cfg config.EmbeddedConfig) error {
+	b, err := httpGet(ctx, hc, u)
+	if err != nil {
+		return err
+	}
+
+	f := st.s.artifactsProvider.Get(artifact + "-" + st.arch)
+	if f == nil {
+		return fmt.Errorf("artifact '%s' not found in artifacts provider", artifact+"-"+st.arch)
+	}
+	defer f.Close()
+	orig, err := io.ReadAll(f)
+	if err != nil {
+		return fmt.Errorf("reading artifact from artifacts provider: %w", err)
+	}
+	if len(b) < len(orig) {
+		return fmt.Errorf("downloaded artifact too small: %d < %d bytes", len(b), len(orig))
+	}
+	expected := sha256.Sum256(orig)
+	actual := sha256.Sum256(b[:len(orig)])
+	if !bytes.Equal(expected[:], actual[:]) {
+		return fmt.Errorf("digest mismatch: expected sha256:%x, got sha256:%x", expected, actual)
+	}
+
+	// verify the embedded config against the config signature CA if one is configured
+	if st.s.installerSettings.configSignatureCADER == nil {
+		return config.ReadEmbeddedConfig(b, cfg, nil, config.ReadOptionIgnoreSignature)
+	}
+	ca, err := x509.ParseCertificate(st.s.installerSettings.configSignatureCADER)
+	if err != nil {
+		return fmt.Errorf("parsing config signature CA: %w", err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(ca)
+	if err := config.ReadEmbeddedConfig(b, cfg, pool); err != nil {
+		return fmt.Errorf("embedded config: %w", err)
+	}
+	return nil
+}
+
+func (st *selfTest) doIPAM(ctx context.Context) error {
+	resp, err := ipam.DoRequest(ctx, st.insecureHC, &ipam.Request{
+		Arch:       st.arch,
+		DevID:      st.devID,
+		Interfaces: []string{selfTestONIEPort},
+	}, st.insecureURL+ipamPath)
+	if err != nil {
+		return err
+	}
+	if _, ok := resp.IPAddresses[selfTestONIEPort]; !ok {
+		return fmt.Errorf("no IP address for '%s' in IPAM response", selfTestONIEPort)
+	}
+	if expected := st.s.installerSettings.stage1URL(st.arch); resp.Stage1URL != expected {
+		return fmt.Errorf("unexpected stage 1 URL in IPAM response: expected '%s', got '%s'", expected, resp.Stage1URL)
+	}
+	return nil
+}
+
+func (st *selfTest) register(ctx context.Context) error {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	csr, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject: pkix.Name{CommonName: st.devID},
+	}, key)
+	if err != nil {
+		return fmt.Errorf("creating CSR: %w", err)
+	}
+
+	regCtx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+	resp, err := registration.DoRequest(regCtx, st.secureHC, &registration.Request{
+		DeviceID: st.devID,
+		CSR:      csr,
+	}, st.secureURL+registerPath)
+	if err != nil {
+		return err
+	}
+
+	// poll for the registration result like stage 1 does
+	for resp.Status == registration.RegistrationStatusPending {
+		select {
+		case <-regCtx.Done():
+			return fmt.Errorf("waiting for registration approval: %w", regCtx.Err())
+		case <-time.After(100 * time.Millisecond):
+		}
+		resp, err = registration.DoPollRequest(regCtx, st.secureHC, st.devID, st.secureURL+registerPath)
+		if err != nil {
+			return err
+		}
+	}
+	if resp.Status != registration.RegistrationStatusApproved || len(resp.ClientCertificate) == 0 {
+		return fmt.Errorf("registration not approved: %s: %s", resp.Status, resp.StatusDescription)
+	}
+
+	tlsCfg := st.tlsCfg.Clone()
+	tlsCfg.Certificates = []tls.Certificate{{
+		Certificate: [][]byte{resp.ClientCertificate},
+		PrivateKey:  key,
+	}}
+	st.registeredHC = &http.Client{
+		Timeout:   time.Minute,
+		Transport: &http.Transport{TLSClientConfig: tlsCfg},
+	}
+	return nil
+}
+
+func httpGet(ctx context.Context, hc *http.Client, u string) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := hc.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("HTTP status %d: %s", resp.StatusCode, strings.TrimSpace(string(b)))
+	}
+	return b, nil
+}
+
+// selfTestControlPlane answers the control plane requests of the self-test with a single fake switch
+type selfTestControlPlane struct{}
+
+var _ controlplane.Client = &selfTestControlPlane{}
+
+func (*selfTestControlPlane) switchObj() *wiring1alpha2.Switch {
+	return &wiring1alpha2.Switch{
+		ObjectMeta: metav1.ObjectMeta{Name: selfTestSwitchName},
+	}
+}
+
+func (*selfTestControlPlane) DeviceHostname() string {
+	return "self-test"
+}
+
+func (*selfTestControlPlane) DeviceNamespace() string {
+	return "default"
+}
+
+func (*selfTestControlPlane) GetInterfacesForNeighbours(context.Context) (map[string]string, map[string]string, error) {
+	return map[string]string{}, map[string]string{}, nil
+}
+
+func (*selfTestControlPlane) GetSwitchConnections(_ context.Context, switchName string) ([]wiring1alpha2.Connection, error) {
+	if switchName != selfTestSwitchName {
+		return nil, controlplane.ErrNotFound
+	}
+	return []wiring1alpha2.Connection{
+		{
+			ObjectMeta: metav1.ObjectMeta{Name: selfTestSwitchName + "--mgmt"},
+			Spec: wiring1alpha2.ConnectionSpec{
+				Management: &wiring1alpha2.ConnMgmt{
+					Link: wiring1alpha2.ConnMgmtLink{
+						Server: wiring1alpha2.ConnMgmtLinkServer{IP: selfTestServerIP},
+						Switch: wiring1alpha2.ConnMgmtLinkSwitch{IP: selfTestSwitchIP, ONIEPortName: selfTestONIEPort},
+					},
+				},
+			},
+		},
+	}, nil
+}
+
+func (*selfTestControlPlane) GetSwitchByAddr(context.Context, string) (*wiring1alpha2.Switch, *wiring1alpha2.Connection, error) {
+	return nil, nil, controlplane.ErrNotFound
+}
+
+func (*selfTestControlPlane) GetNeighbourSwitchByAddr(context.Context, string) (*wiring1alpha2.Switch, *wiring1alpha2.Connection, error) {
+	return nil, nil, controlplane.ErrNotFound
+}
+
+func (*selfTestControlPlane) GetNeighbourSwitchByLLDP(context.Context, *dasbootnet.LLDPNeighbor) (*wiring1alpha2.Switch, *wiring1alpha2.Connection, error) {
+	return nil, nil, controlplane.ErrNotFound
+}
+
+func (cp *selfTestControlPlane) GetSwitchByLocationUUID(context.Context, string) (*wiring1alpha2.Switch, error) {
+	return cp.switchObj(), nil
+}
+
+func (*selfTestControlPlane) GetDeviceRegistration(context.Context, string) (*dasbootv1alpha1.DeviceRegistration, error) {
+	return nil, controlplane.ErrNotFound
+}
+
+func (*selfTestControlPlane) CreateDeviceRegistration(_ context.Context, reg *dasbootv1alpha1.DeviceRegistration) (*dasbootv1alpha1.DeviceRegistration, error) {
+	return reg, nil
+}
+
+func (*selfTestControlPlane) ListDeviceRegistrations(context.Context) ([]dasbootv1alpha1.DeviceRegistration, error) {
+	return nil, nil
+}
+
+func (*selfTestControlPlane) SetDeviceRegistrationApproval(context.Context, string, dasbootv1alpha1.RegistrationApproval) error {
+	return controlplane.ErrNotFound
+}
+
+func (cp *selfTestControlPlane) GetSwitchByDeviceID(context.Context, string) (*wiring1alpha2.Switch, error) {
+	return cp.switchObj(), nil
+}
+
+func (*selfTestControlPlane) GetAgentConfig(context.Context, string) ([]byte, error) {
+	return nil, controlplane.ErrNotFound
+}
+
+func (*selfTestControlPlane) GetAgentKubeconfig(context.Context, string) ([]byte, error) {
+	return nil, controlplane.ErrNotFound
+}
+
+func (*selfTestControlPlane) RecordDeviceEvent(context.Context, string, controlplane.DeviceEvent, string) error {
+	return nil
+}
+
+func (*selfTestControlPlane) GetIdentityBackup(context.Context, string) ([]byte, error) {
+	return nil, controlplane.ErrNotFound
+}
+
+func (*selfTestControlPlane) StoreIdentityBackup(context.Context, string, []byte) error {
+	return nil
+}
+
+func (*selfTestControlPlane) CheckHealth(context.Context) error {
+	return nil
+}
@@ -0,0 +1,188 @@
+// Copyright 2023 Hedgehog
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package seeder
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"go.githedgehog.com/dasboot/pkg/seeder/artifacts/file"
+	seederconfig "go.githedgehog.com/dasboot/pkg/seeder/config"
+)
+
+func writeSelfTestKeyPair(t *testing.T, dir, name string, tmpl *x509.Certificate, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if parent == nil {
+		parent = tmpl
+		parentKey = key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, name+".pem"), pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, name+".key"), pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return cert, key
+}
+
+func newSelfTestConfig(t *testing.T, missingArtifact string) *seederconfig.SeederConfig {
+	t.Helper()
+	dir := t.TempDir()
+	now := time.Now()
+	caCert, caKey := writeSelfTestKeyPair(t, dir, "ca", &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Test CA"},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}, nil, nil)
+	writeSelfTestKeyPair(t, dir, "server", &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "das-boot.hedgehog.svc"},
+		DNSNames:     []string{"das-boot.hedgehog.svc"},
+		NotBefore:    now.Add(-time.Hour),
+		NotAfter:     now.Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}, caCert, caKey)
+	writeSelfTestKeyPair(t, dir, "config", &x509.Certificate{
+		SerialNumber: big.NewInt(3),
+		Subject:      pkix.Name{CommonName: "Test Config Signer"},
+		NotBefore:    now.Add(-time.Hour),
+		NotAfter:     now.Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+	}, caCert, caKey)
+
+	artifactsDir := filepath.Join(dir, "artifacts")
+	if err := os.Mkdir(artifactsDir, 0o700); err != nil {
+		t.Fatal(err)
+	}
+	for _, artifact := range []string{"stage0", "stage1", "stage2", "hedgehog-agent-provisioner"} {
+		if artifact == missingArtifact {
+			continue
+		}
+		content := bytes.Repeat([]byte(artifact), 1024)
+		if err := os.WriteFile(filepath.Join(artifactsDir, artifact+"-x86_64"), content, 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return &seederconfig.SeederConfig{
+		SecureServer: &seederconfig.BindInfo{
+			ServerKeyPath:  filepath.Join(dir, "server.key"),
+			ServerCertPath: filepath.Join(dir, "server.pem"),
+		},
+		ArtifactsProvider: file.Provider(artifactsDir),
+		EmbeddedConfigGenerator: &seederconfig.EmbeddedConfigGeneratorConfig{
+			KeyPath:  filepath.Join(dir, "config.key"),
+			CertPath: filepath.Join(dir, "config.pem"),
+		},
+		InstallerSettings: &seederconfig.InstallerSettings{
+			ServerCAPath:          filepath.Join(dir, "ca.pem"),
+			ConfigSignatureCAPath: filepath.Join(dir, "ca.pem"),
+			SecureServerName:      "das-boot.hedgehog.svc",
+			ControlVIP:            "192.168.42.1",
+		},
+	}
+}
+
+func TestSelfTest(t *testing.T) {
+	tests := []struct {
+		name            string
+		missingArtifact string
+		wantPassed      bool
+		wantFailed      []string
+		wantResults     int
+	}{
+		{
+			name:        "success",
+			wantPassed:  true,
+			wantResults: 6,
+		},
+		{
+			name:            "missing stage 2",
+			missingArtifact: "stage2",
+			wantPassed:      false,
+			wantFailed:      []string{"stage2 artifact"},
+			wantResults:     6,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+			defer cancel()
+			report, err := SelfTest(ctx, newSelfTestConfig(t, tt.missingArtifact), "")
+			if err != nil {
+				t.Fatalf("SelfTest() error = %v", err)
+			}
+			var out bytes.Buffer
+			report.Print(&out)
+			if report.Passed() != tt.wantPassed {
+				t.Fatalf("Passed() = %v, want %v\n%s", report.Passed(), tt.wantPassed, out.String())
+			}
+			if len(report.Results) != tt.wantResults {
+				t.Errorf("got %d results, want %d\n%s", len(report.Results), tt.wantResults, out.String())
+			}
+			var failed []string
+			for _, res := range report.Results {
+				if !res.Passed {
+					failed = append(failed, res.Name)
+				}
+			}
+			if strings.Join(failed, ",") != strings.Join(tt.wantFailed, ",") {
+				t.Errorf("failed checks = %v, want %v\n%s", failed, tt.wantFailed, out.String())
+			}
+		})
+	}
+}
+
+func TestSelfTestInvalidConfig(t *testing.T) {
+	if _, err := SelfTest(context.Background(), nil, ""); err == nil {
+		t.Errorf("expected error for empty config")
+	}
+	if _, err := SelfTest(context.Background(), &seederconfig.SeederConfig{}, ""); err == nil {
+		t.Errorf("expected error for missing secure server")
+	}
+}
@@ -37,6 +37,9 @@ type HTTPServer struct {
 	tlsCfg         *tls.Config
 	tlsCfgLock     sync.RWMutex
 	srv            *http.Server
+
+	// verifyConnection is called on every TLS handshake after the client certificate was verified
+	verifyConnection func(tls.ConnectionState) error
 }
 
 func (s *HTTPServer) Srv() *http.Server {
@@ -75,13 +78,30 @@ func (s *HTTPServer) tlsConfig(*tls.ClientHelloInfo) (*tls.Config, error) {
 }
 
 func (s *HTTPServer) ReloadTLSConfig() error {
+	s.tlsCfgLock.RLock()
+	serverKeyPath, serverCertPath, clientCAPath := s.serverKeyPath, s.serverCertPath, s.clientCAPath
+	s.tlsCfgLock.RUnlock()
+	return s.reloadTLSConfig(serverKeyPath, serverCertPath, clientCAPath)
+}
+
+// ReloadTLSConfigFrom is like ReloadTLSConfig, but it loads the TLS configuration from new paths
+func (s *HTTPServer) ReloadTLSConfigFrom(serverKeyPath, serverCertPath, clientCAPath string) error {
+	return s.reloadTLSConfig(serverKeyPath, serverCertPath, clientCAPath)
+}
+
+// reloadTLSConfig loads the TLS configuration from the given paths. The paths and the new TLS config
+// are only being stored together under the write lock once everything was loaded successfully.
+func (s *HTTPServer) reloadTLSConfig(serverKeyPath, serverCertPath, clientCAPath string) error {
 	// nothing to do if this is not a TLS server
-	if s.serverKeyPath == "" {
+	if serverKeyPath == "" {
+		s.tlsCfgLock.Lock()
+		defer s.tlsCfgLock.Unlock()
+		s.serverKeyPath, s.serverCertPath, s.clientCAPath = serverKeyPath, serverCertPath, clientCAPath
 		return nil
 	}
 
 	// load new cert and key
-	cert, err := tls.LoadX509KeyPair(s.serverCertPath, s.serverKeyPath)
+	cert, err := tls.LoadX509KeyPair(serverCertPath, serverKeyPath)
 	if err != nil {
 		return err
 	}
@@ -89,8 +109,8 @@ func (s *HTTPServer) ReloadTLSConfig() error {
 	// and try to load a new client CA pool
 	var clientCAPool *x509.CertPool
 
-	if s.clientCAPath != "" {
-		f, err := os.Open(s.clientCAPath)
+	if clientCAPath != "" {
+		f, err := os.Open(clientCAPath)
 		if err != nil {
 			return err
 		}
@@ -109,12 +129,14 @@ func (s *HTTPServer) ReloadTLSConfig() error {
 	// this requires the write lock
 	s.tlsCfgLock.Lock()
 	defer s.tlsCfgLock.Unlock()
+	s.serverKeyPath, s.serverCertPath, s.clientCAPath = serverKeyPath, serverCertPath, clientCAPath
 	s.tlsCfg = &tls.Config{
 		MinVersion:         tls.VersionTLS12,
 		ClientCAs:          clientCAPool,
 		ClientAuth:         tls.VerifyClientCertIfGiven,
 		Certificates:       []tls.Certificate{cert},
 		GetConfigForClient: s.tlsConfig,
+		VerifyConnection:   s.verifyConnection,
 	}
 
 	return nil
@@ -16,10 +16,12 @@ package generic
 
 import (
 	"context"
+	"crypto/tls"
 	"errors"
 	"fmt"
 	"net/http"
 	"sync"
+	"time"
 
 	"go.githedgehog.com/dasboot/pkg/seeder/config"
 	seedererrors "go.githedgehog.com/dasboot/pkg/seeder/errors"
@@ -30,31 +32,74 @@ type GenericServer struct {
 	done        chan struct{}
 	err         chan error
 	HTTPServers []*HTTPServer
+
+	// these are all necessary to rebind the server
+	lock     sync.Mutex
+	wg       sync.WaitGroup
+	started  bool
+	handler  http.Handler
+	bindInfo config.BindInfo
+	retired  []*HTTPServer
+
+	verifyConnection func(tls.ConnectionState) error
 }
 
 var _ server.ControlInterface = &GenericServer{}
 
-func NewGenericServer(b *config.BindInfo, handler http.Handler) (*GenericServer, error) {
+func validateBindInfo(b *config.BindInfo) error {
 	if len(b.Address) == 0 {
-		return nil, seedererrors.InvalidConfigError("no address in server config")
+		return seedererrors.InvalidConfigError("no address in server config")
 	}
 	if (b.ServerKeyPath != "" && b.ServerCertPath == "") || (b.ServerCertPath != "" && b.ServerKeyPath == "") {
-		return nil, seedererrors.InvalidConfigError("server key and server cert must always be set together")
+		return seedererrors.InvalidConfigError("server key and server cert must always be set together")
+	}
+	for _, addr := range b.Address {
+		if addr == "" {
+			return seedererrors.InvalidConfigError("address must not be empty")
+		}
+	}
+	return nil
+}
+
+// CheckRebind checks if a server which was created with `from` can be rebound to `to` with `Rebind`
+func CheckRebind(from, to *config.BindInfo) error {
+	if err := validateBindInfo(to); err != nil {
+		return err
+	}
+	if (from.ServerKeyPath == "") != (to.ServerKeyPath == "") {
+		return seedererrors.ReloadRequiresRestartError("switching a server between HTTP and HTTPS")
+	}
+	return nil
+}
+
+func NewGenericServer(b *config.BindInfo, handler http.Handler) (*GenericServer, error) {
+	if err := validateBindInfo(b); err != nil {
+		return nil, err
 	}
 
 	ret := &GenericServer{
-		done: make(chan struct{}),
-		err:  make(chan error, len(b.Address)),
+		done:     make(chan struct{}),
+		err:      make(chan error, len(b.Address)),
+		handler:  handler,
+		bindInfo: *b,
 	}
 	for _, addr := range b.Address {
-		if addr == "" {
-			return nil, seedererrors.InvalidConfigError("address must not be empty")
-		}
 		ret.HTTPServers = append(ret.HTTPServers, NewHttpServer(addr, b.ServerKeyPath, b.ServerCertPath, b.ClientCAPath, handler))
 	}
 	return ret, nil
 }
 
+// SetVerifyConnection sets a function which is called on every TLS handshake after the client certificate
+// was verified. If it returns an error, the handshake is aborted. It must be called before `Start`.
+func (s *GenericServer) SetVerifyConnection(fn func(tls.ConnectionState) error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.verifyConnection = fn
+	for _, hs := range s.HTTPServers {
+		hs.verifyConnection = fn
+	}
+}
+
 func (s *GenericServer) Done() <-chan struct{} {
 	return s.done
 }
@@ -64,36 +109,100 @@ func (s *GenericServer) Err() <-chan error {
 }
 
 func (s *GenericServer) Start() {
-	var wg sync.WaitGroup
-	wg.Add(len(s.HTTPServers))
-
-	for i, hs := range s.HTTPServers {
-		go func(_ int, hs *HTTPServer) {
-			hs.Start()
-			<-hs.Done()
-			// we filter out all ErrServerClosed which are generated by Shutdown or Closed calls
-			if err := hs.Err(); err != nil && !errors.Is(err, http.ErrServerClosed) {
-				s.err <- fmt.Errorf("server on '%s': %w", hs.srv.Addr, err)
-			}
-			wg.Done()
-		}(i, hs)
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.started = true
+	for _, hs := range s.HTTPServers {
+		s.start(hs)
 	}
 
 	go func() {
-		wg.Wait()
+		s.wg.Wait()
 		close(s.done)
 		close(s.err)
 	}()
 }
 
+// start starts `hs`, the lock must be held
+func (s *GenericServer) start(hs *HTTPServer) {
+	s.wg.Add(1)
+	go func() {
+		hs.Start()
+		<-hs.Done()
+		// we filter out all ErrServerClosed which are generated by Shutdown or Closed calls
+		if err := hs.Err(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			s.err <- fmt.Errorf("server on '%s': %w", hs.srv.Addr, err)
+		}
+		s.wg.Done()
+	}()
+}
+
+// Rebind applies the bind info `b` to a running server: servers for new addresses are being started, and servers
+// for addresses which are gone are being shut down gracefully within `drainTimeout` so that requests which are in
+// flight can finish. Servers for addresses which remain reload their TLS configuration from the paths in `b`.
+func (s *GenericServer) Rebind(b *config.BindInfo, drainTimeout time.Duration) error {
+	if err := CheckRebind(&s.bindInfo, b); err != nil {
+		return err
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	existing := make(map[string]*HTTPServer, len(s.HTTPServers))
+	for _, hs := range s.HTTPServers {
+		existing[hs.srv.Addr] = hs
+	}
+	servers := make([]*HTTPServer, 0, len(b.Address))
+	for _, addr := range b.Address {
+		if hs, ok := existing[addr]; ok {
+			delete(existing, addr)
+			if err := hs.ReloadTLSConfigFrom(b.ServerKeyPath, b.ServerCertPath, b.ClientCAPath); err != nil {
+				return fmt.Errorf("server on '%s': reloading TLS config: %w", addr, err)
+			}
+			servers = append(servers, hs)
+			continue
+		}
+		hs := NewHttpServer(addr, b.ServerKeyPath, b.ServerCertPath, b.ClientCAPath, s.handler)
+		hs.verifyConnection = s.verifyConnection
+		if s.started {
+			s.start(hs)
+		}
+		servers = append(servers, hs)
+	}
+
+	// new servers are running at this point, so the wait group cannot drop to zero while we retire the others
+	for _, hs := range existing {
+		s.retired = append(s.retired, hs)
+		go func(hs *HTTPServer) {
+			ctx, cancel := context.WithTimeout(context.Background(), drainTimeout)
+			defer cancel()
+			if err := hs.Shutdown(ctx); err != nil {
+				hs.Close() //nolint: errcheck
+			}
+		}(hs)
+	}
+	s.HTTPServers = servers
+	s.bindInfo = *b
+	return nil
+}
+
+// servers returns all servers which are running, including the ones which were retired by `Rebind`
+func (s *GenericServer) servers() []*HTTPServer {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	ret := make([]*HTTPServer, 0, len(s.HTTPServers)+len(s.retired))
+	ret = append(ret, s.HTTPServers...)
+	return append(ret, s.retired...)
+}
+
 func (s *GenericServer) Shutdown(ctx context.Context) error {
 	var wg sync.WaitGroup
 	var errs []error
-	errch := make(chan error, len(s.HTTPServers))
-	wg.Add(len(s.HTTPServers))
+	servers := s.servers()
+	errch := make(chan error, len(servers))
+	wg.Add(len(servers))
 
 	// fan out shutdown commands to all servers
-	for _, hs := range s.HTTPServers {
+	for _, hs := range servers {
 		go func(hs *HTTPServer) {
 			if err := hs.Shutdown(ctx); err != nil {
 				errch <- fmt.Errorf("server on '%s': %w", hs.srv.Addr, err)
@@ -132,11 +241,12 @@ func (s *GenericServer) Shutdown(ctx context.Context) error {
 func (s *GenericServer) Close() error {
 	var wg sync.WaitGroup
 	var errs []error
-	errch := make(chan error, len(s.HTTPServers))
-	wg.Add(len(s.HTTPServers))
+	servers := s.servers()
+	errch := make(chan error, len(servers))
+	wg.Add(len(servers))
 
 	// fan out close commands to all servers
-	for _, hs := range s.HTTPServers {
+	for _, hs := range servers {
 		go func(hs *HTTPServer) {
 			if err := hs.Close(); err != nil {
 				errch <- fmt.Errorf("server on '%s': %w", hs.srv.Addr, err)
@@ -0,0 +1,120 @@
+// Copyright 2023 Hedgehog
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package seeder
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"encoding/base64"
+	"net/http"
+	"strconv"
+
+	"github.com/go-chi/chi/v5/middleware"
+	"go.githedgehog.com/dasboot/pkg/log"
+	"go.githedgehog.com/dasboot/pkg/stage"
+	"go.uber.org/zap"
+)
+
+// SignResponses is a middleware which signs the bodies of all responses except for artifacts with a detached
+// signature. The signature is an ASN.1 encoded ECDSA signature over `stage.ResponseSignatureDigest` which binds
+// the body to the request path and the nonce of the client, and it is being sent base64 encoded in the
+// `stage.HeaderResponseSignature` header. The DER encoded signing certificate is sent base64 encoded in the
+// `stage.HeaderResponseSignatureCert` header. Clients can verify the responses with `stage.VerifyResponseSignature`
+// even if they were passed through untrusted proxies.
+func SignResponses(key *ecdsa.PrivateKey, certDER []byte) func(next http.Handler) http.Handler {
+	encodedCert := base64.StdEncoding.EncodeToString(certDER)
+	return func(next http.Handler) http.Handler {
+		fn := func(w http.ResponseWriter, r *http.Request) {
+			sw := &signingResponseWriter{ResponseWriter: w}
+			next.ServeHTTP(sw, r)
+			if !sw.wroteHeader {
+				// an empty response must be signed as well
+				sw.WriteHeader(http.StatusOK)
+			}
+			if !sw.buffering {
+				return
+			}
+
+			// there is no body in the response to HEAD requests, whatever the handler wrote
+			body, signedBody := sw.buf.Bytes(), sw.buf.Bytes()
+			if r.Method == http.MethodHead {
+				signedBody = nil
+			}
+			digest := stage.ResponseSignatureDigest(r.URL.Path, r.Header.Get(stage.HeaderResponseSignatureNonce), signedBody)
+			sig, err := ecdsa.SignASN1(rand.Reader, key, digest)
+			if err != nil {
+				// there is nothing that we can do for the client at this point, so we
+				// will send the response unsigned, and the client must reject it
+				log.L().Error("failed to sign response",
+					zap.String("request", middleware.GetReqID(r.Context())),
+					zap.Error(err),
+				)
+			} else {
+				w.Header().Set(stage.HeaderResponseSignature, base64.StdEncoding.EncodeToString(sig))
+				w.Header().Set(stage.HeaderResponseSignatureCert, encodedCert)
+			}
+			if sw.status != http.StatusNoContent && sw.status != http.StatusNotModified {
+				w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+			}
+			w.WriteHeader(sw.status)
+			if _, err := w.Write(body); err != nil {
+				log.L().Error("failed to write signed response",
+					zap.String("request", middleware.GetReqID(r.Context())),
+					zap.Error(err),
+				)
+			}
+		}
+		return http.HandlerFunc(fn)
+	}
+}
+
+// signingResponseWriter buffers the response body if the content type is one that
+// needs to be signed. Artifacts are passed through unchanged.
+type signingResponseWriter struct {
+	http.ResponseWriter
+	wroteHeader bool
+	buffering   bool
+	status      int
+	buf         bytes.Buffer
+}
+
+func (w *signingResponseWriter) WriteHeader(status int) {
+	if w.wroteHeader {
+		return
+	}
+	w.wroteHeader = true
+	w.status = status
+	if stage.IsSignedContentType(w.Header().Get("Content-Type")) {
+		w.buffering = true
+		return
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *signingResponseWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.buffering {
+		return w.buf.Write(b)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// Unwrap is used by http.ResponseController
+func (w *signingResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
@@ -0,0 +1,192 @@
+// Copyright 2023 Hedgehog
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package seeder
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"io"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"go.githedgehog.com/dasboot/pkg/stage"
+)
+
+func newTestSigner(t *testing.T) (*ecdsa.PrivateKey, []byte, *x509.CertPool) {
+	t.Helper()
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caTmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTmpl, caTmpl, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caCert, err := x509.ParseCertificate(caDER)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "Test Signer"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+	}
+	certDER, err := x509.CreateCertificate(rand.Reader, tmpl, caCert, &key.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(caCert)
+	return key, certDER, pool
+}
+
+func TestSignResponses(t *testing.T) {
+	key, certDER, pool := newTestSigner(t)
+	_, _, otherPool := newTestSigner(t)
+
+	tests := []struct {
+		name        string
+		contentType string
+		pool        *x509.CertPool
+		tamper      bool
+		verifyPath  string
+		verifyNonce string
+		wantSigned  bool
+		wantErr     error
+	}{
+		{
+			name:        "json response is signed",
+			contentType: "application/json",
+			pool:        pool,
+			wantSigned:  true,
+		},
+		{
+			name:        "yaml response is signed",
+			contentType: "application/yaml",
+			pool:        pool,
+			wantSigned:  true,
+		},
+		{
+			name:        "plain text response is signed",
+			contentType: "text/plain",
+			pool:        pool,
+			wantSigned:  true,
+		},
+		{
+			name:        "artifacts are passed through",
+			contentType: "application/octet-stream",
+			pool:        pool,
+		},
+		{
+			name:        "tampered body fails",
+			contentType: "application/json",
+			pool:        pool,
+			wantSigned:  true,
+			tamper:      true,
+			wantErr:     stage.ErrResponseSignatureInvalid,
+		},
+		{
+			name:        "response replayed for a different path fails",
+			contentType: "application/json",
+			pool:        pool,
+			wantSigned:  true,
+			verifyPath:  "/stage0/ipam",
+			wantErr:     stage.ErrResponseSignatureInvalid,
+		},
+		{
+			name:        "response replayed for a different nonce fails",
+			contentType: "application/json",
+			pool:        pool,
+			wantSigned:  true,
+			verifyNonce: "other",
+			wantErr:     stage.ErrResponseSignatureInvalid,
+		},
+		{
+			name:        "signer from different CA fails",
+			contentType: "application/json",
+			pool:        otherPool,
+			wantSigned:  true,
+			wantErr:     stage.ErrResponseSignatureInvalid,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := SignResponses(key, certDER)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", tt.contentType)
+				w.WriteHeader(http.StatusAccepted)
+				w.Write([]byte(`{"hello":`)) //nolint: errcheck
+				w.Write([]byte(`"world"}`))  //nolint: errcheck
+			}))
+			rec := httptest.NewRecorder()
+			req := httptest.NewRequest(http.MethodGet, "/ca-bundle", nil)
+			req.Header.Set(stage.HeaderResponseSignatureNonce, "nonce")
+			h.ServeHTTP(rec, req)
+			resp := rec.Result()
+			defer resp.Body.Close()
+			body, err := io.ReadAll(resp.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if resp.StatusCode != http.StatusAccepted {
+				t.Errorf("status = %d, want %d", resp.StatusCode, http.StatusAccepted)
+			}
+			if string(body) != `{"hello":"world"}` {
+				t.Errorf("body = %s", string(body))
+			}
+			signed := resp.Header.Get(stage.HeaderResponseSignature) != ""
+			if signed != tt.wantSigned {
+				t.Fatalf("signed = %v, want %v", signed, tt.wantSigned)
+			}
+			if !signed {
+				return
+			}
+			if tt.tamper {
+				body[0] = '['
+			}
+			if tt.verifyPath != "" {
+				req.URL.Path = tt.verifyPath
+			}
+			if tt.verifyNonce != "" {
+				req.Header.Set(stage.HeaderResponseSignatureNonce, tt.verifyNonce)
+			}
+			err = stage.VerifyResponseSignature(req, resp.Header, body, tt.pool)
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("VerifyResponseSignature() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -16,13 +16,20 @@ package seeder
 
 import (
 	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
 	"crypto/x509"
+	"crypto/x509/pkix"
 	"encoding/json"
 	"encoding/pem"
 	"fmt"
 	"io"
+	"math"
+	"math/big"
 	"net/http"
 	"os"
+	"strconv"
+	"time"
 
 	"github.com/go-chi/chi/v5/middleware"
 	"go.githedgehog.com/dasboot/pkg/log"
@@ -64,6 +71,29 @@ func readCertFromPath(path string) (*x509.Certificate, []byte, error) {
 	return cert, p.Bytes, nil
 }
 
+// deferWithJSON tells the client to retry its request after `retryAfter` with a 503 response
+func deferWithJSON(w http.ResponseWriter, r *http.Request, retryAfter time.Duration, format string, a ...any) {
+	secs := int64(math.Ceil(retryAfter.Seconds()))
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Retry-After", strconv.FormatInt(secs, 10))
+	w.WriteHeader(http.StatusServiceUnavailable)
+	v := struct {
+		ReqID      string `json:"request_id,omitempty"`
+		Err        string `json:"error"`
+		Deferred   bool   `json:"deferred"`
+		RetryAfter int64  `json:"retry_after"`
+	}{
+		ReqID:      middleware.GetReqID(r.Context()),
+		Err:        fmt.Sprintf(format, a...),
+		Deferred:   true,
+		RetryAfter: secs,
+	}
+	b, err := json.Marshal(&v)
+	if err == nil {
+		w.Write(b) //nolint: errcheck
+	}
+}
+
 func errorWithJSON(w http.ResponseWriter, r *http.Request, statusCode int, format string, a ...any) {
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(statusCode)
@@ -79,3 +109,30 @@ func errorWithJSON(w http.ResponseWriter, r *http.Request, statusCode int, forma
 		w.Write(b) //nolint: errcheck
 	}
 }
+
+// newEphemeralCA generates a self-signed CA which only lives in memory for `lifetime`
+func newEphemeralCA(commonName string, lifetime time.Duration) (*ecdsa.PrivateKey, *x509.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: commonName},
+		NotBefore:             now.Add(-time.Minute),
+		NotAfter:              now.Add(lifetime),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return nil, nil, err
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, nil, err
+	}
+	return key, cert, nil
+}
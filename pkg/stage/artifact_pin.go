@@ -0,0 +1,75 @@
+// Copyright 2023 Hedgehog
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package stage
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"go.githedgehog.com/dasboot/pkg/version"
+)
+
+var (
+	ErrArtifactPinInvalid  = errors.New("artifact pin: invalid pin")
+	ErrArtifactPinMismatch = errors.New("artifact pin: digest mismatch")
+)
+
+// NewArtifactPin computes the pin for the artifact which is read from `r`
+func NewArtifactPin(r io.Reader) (*version.ArtifactPin, error) {
+	h := sha256.New()
+	n, err := io.Copy(h, r)
+	if err != nil {
+		return nil, err
+	}
+	return &version.ArtifactPin{
+		Digest: provenanceDigestPrefix + hex.EncodeToString(h.Sum(nil)),
+		Size:   n,
+	}, nil
+}
+
+// VerifyArtifactPin verifies that the file at `path` starts with the artifact which is pinned by `pin`.
+// Stage artifacts have their embedded configuration appended to them which is covered by its own
+// signature, so only the first `pin.Size` bytes are part of the digest. A nil pin is always valid.
+func VerifyArtifactPin(path string, pin *version.ArtifactPin) error {
+	if pin == nil {
+		return nil
+	}
+	if !strings.HasPrefix(pin.Digest, provenanceDigestPrefix) || pin.Size < 0 {
+		return fmt.Errorf("%w: unsupported digest '%s' or size %d", ErrArtifactPinInvalid, pin.Digest, pin.Size)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("artifact pin: open '%s': %w", path, err)
+	}
+	defer f.Close()
+	h := sha256.New()
+	n, err := io.Copy(h, io.LimitReader(f, pin.Size))
+	if err != nil {
+		return fmt.Errorf("artifact pin: reading '%s': %w", path, err)
+	}
+	if n < pin.Size {
+		return fmt.Errorf("%w: '%s' is %d bytes, but the pin requires at least %d bytes", ErrArtifactPinMismatch, path, n, pin.Size)
+	}
+	digest := provenanceDigestPrefix + hex.EncodeToString(h.Sum(nil))
+	if digest != pin.Digest {
+		return fmt.Errorf("%w: '%s' has digest %s, but the pin requires %s", ErrArtifactPinMismatch, path, digest, pin.Digest)
+	}
+	return nil
+}
@@ -0,0 +1,93 @@
+// Copyright 2023 Hedgehog
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package stage
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"go.githedgehog.com/dasboot/pkg/version"
+)
+
+func TestVerifyArtifactPin(t *testing.T) {
+	artifact := []byte("stage binary")
+	pin, err := NewArtifactPin(bytes.NewReader(artifact))
+	if err != nil {
+		t.Fatalf("NewArtifactPin() error = %v", err)
+	}
+	if pin.Size != int64(len(artifact)) || pin.Digest != ProvenanceDigest(artifact) {
+		t.Fatalf("NewArtifactPin() = %#v", pin)
+	}
+
+	dir := t.TempDir()
+	write := func(name string, data []byte) string {
+		p := filepath.Join(dir, name)
+		if err := os.WriteFile(p, data, 0644); err != nil {
+			t.Fatal(err)
+		}
+		return p
+	}
+
+	tests := []struct {
+		name    string
+		path    string
+		pin     *version.ArtifactPin
+		wantErr error
+	}{
+		{
+			name: "no pin",
+			path: filepath.Join(dir, "does-not-exist"),
+		},
+		{
+			name: "exact artifact",
+			path: write("exact", artifact),
+			pin:  pin,
+		},
+		{
+			name: "artifact with embedded config",
+			path: write("embedded", append(append([]byte{}, artifact...), []byte("embedded config")...)),
+			pin:  pin,
+		},
+		{
+			name:    "modified artifact",
+			path:    write("modified", []byte("stage binarY")),
+			pin:     pin,
+			wantErr: ErrArtifactPinMismatch,
+		},
+		{
+			name:    "truncated artifact",
+			path:    write("truncated", artifact[:4]),
+			pin:     pin,
+			wantErr: ErrArtifactPinMismatch,
+		},
+		{
+			name:    "unsupported digest",
+			path:    write("unsupported", artifact),
+			pin:     &version.ArtifactPin{Digest: "md5:abcd", Size: pin.Size},
+			wantErr: ErrArtifactPinInvalid,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := VerifyArtifactPin(tt.path, tt.pin)
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("VerifyArtifactPin() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
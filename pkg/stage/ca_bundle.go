@@ -0,0 +1,204 @@
+// Copyright 2023 Hedgehog
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package stage
+
+import (
+	"bytes"
+	"context"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// CABundle is a versioned set of server CA certificates which the seeder distributes to devices so that
+// its server CA can be rotated mid-fleet. During the transition window the bundle holds the old and the
+// new CA. Once a bundle got pinned, it replaces the server CA which a client trusts for the seeder, and a
+// client never goes back to an older version. This way a CA which was removed from the bundle stays
+// untrusted even if somebody replays an old bundle.
+type CABundle struct {
+	// Version must be increased by the seeder whenever the certificates change
+	Version uint64 `json:"version"`
+
+	// Certificates are the DER encoded CA certificates of this bundle
+	Certificates [][]byte `json:"certificates"`
+}
+
+var (
+	ErrCABundleInvalid   = errors.New("ca bundle: invalid")
+	ErrCABundleDowngrade = errors.New("ca bundle: version is older than the pinned bundle")
+)
+
+// pathCABundle is the name of the pinned CA bundle in the staging area
+const pathCABundle = "ca-bundle.json"
+
+// CABundlePath returns the path of the pinned CA bundle in the staging directory
+func CABundlePath(stagingDir string) string {
+	return filepath.Join(stagingDir, pathCABundle)
+}
+
+// Validate ensures that the bundle holds at least one CA certificate, and that all of them can be parsed
+func (b *CABundle) Validate() error {
+	if b == nil {
+		return fmt.Errorf("%w: empty", ErrCABundleInvalid)
+	}
+	if b.Version == 0 {
+		return fmt.Errorf("%w: missing version", ErrCABundleInvalid)
+	}
+	if len(b.Certificates) == 0 {
+		return fmt.Errorf("%w: no certificates", ErrCABundleInvalid)
+	}
+	for i, der := range b.Certificates {
+		cert, err := x509.ParseCertificate(der)
+		if err != nil {
+			return fmt.Errorf("%w: certificate %d: %w", ErrCABundleInvalid, i, err)
+		}
+		if !cert.IsCA {
+			return fmt.Errorf("%w: certificate %d ('%s') is not a CA", ErrCABundleInvalid, i, cert.Subject)
+		}
+	}
+	return nil
+}
+
+// DER returns the concatenated DER encoded certificates of the bundle as it is being accepted by `SeederHTTPClient`
+func (b *CABundle) DER() []byte {
+	return bytes.Join(b.Certificates, nil)
+}
+
+// CertPool returns a certificate pool with all certificates of the bundle
+func (b *CABundle) CertPool() (*x509.CertPool, error) {
+	if err := b.Validate(); err != nil {
+		return nil, err
+	}
+	ret := x509.NewCertPool()
+	for _, der := range b.Certificates {
+		cert, err := x509.ParseCertificate(der)
+		if err != nil {
+			return nil, err
+		}
+		ret.AddCert(cert)
+	}
+	return ret, nil
+}
+
+// equal returns true if both bundles hold the same certificates in the same order
+func (b *CABundle) equal(other *CABundle) bool {
+	if len(b.Certificates) != len(other.Certificates) {
+		return false
+	}
+	for i := range b.Certificates {
+		if !bytes.Equal(b.Certificates[i], other.Certificates[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// LoadCABundle reads a pinned CA bundle from `path`. The error wraps `os.ErrNotExist` if no bundle was pinned.
+func LoadCABundle(path string) (*CABundle, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading CA bundle '%s': %w", path, err)
+	}
+	var ret CABundle
+	if err := json.Unmarshal(b, &ret); err != nil {
+		return nil, fmt.Errorf("%w: decoding '%s': %w", ErrCABundleInvalid, path, err)
+	}
+	if err := ret.Validate(); err != nil {
+		return nil, fmt.Errorf("'%s': %w", path, err)
+	}
+	return &ret, nil
+}
+
+// Save pins the CA bundle at `path`. The file gets replaced atomically, so that a failure never leaves
+// a client without any trusted CA.
+func (b *CABundle) Save(path string) error {
+	data, err := json.Marshal(b)
+	if err != nil {
+		return fmt.Errorf("encoding CA bundle: %w", err)
+	}
+	tmpPath := path + ".tmp"
+	if err := os.WriteFile(tmpPath, data, 0644); err != nil {
+		return fmt.Errorf("writing CA bundle '%s': %w", tmpPath, err)
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("renaming CA bundle '%s' to '%s': %w", tmpPath, path, err)
+	}
+	return nil
+}
+
+// FetchCABundle downloads the CA bundle from the seeder. The HTTP client should verify response
+// signatures (see `WithResponseSignatureVerification`) as the bundle is signed by the seeder.
+func FetchCABundle(ctx context.Context, hc *http.Client, srcURL string) (*CABundle, error) {
+	subCtx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(subCtx, http.MethodGet, srcURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/json")
+	resp, err := hc.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, NewHTTPErrorFromBody(resp)
+	}
+	var ret CABundle
+	if err := json.NewDecoder(resp.Body).Decode(&ret); err != nil {
+		return nil, fmt.Errorf("%w: decoding response: %w", ErrCABundleInvalid, err)
+	}
+	if err := ret.Validate(); err != nil {
+		return nil, err
+	}
+	return &ret, nil
+}
+
+// RefreshCABundle downloads the CA bundle from the seeder and pins it at `path` if it is newer than the
+// bundle which is already pinned there. It returns the bundle which is pinned after the refresh, and if
+// it was updated. A bundle with an older version than the pinned one is rejected, as is a bundle which
+// changes the certificates without increasing the version.
+func RefreshCABundle(ctx context.Context, hc *http.Client, srcURL string, path string) (*CABundle, bool, error) {
+	pinned, err := LoadCABundle(path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		// a corrupt pin must not prevent us from getting a valid one
+		pinned = nil
+	}
+	bundle, err := FetchCABundle(ctx, hc, srcURL)
+	if err != nil {
+		return pinned, false, err
+	}
+	if pinned != nil {
+		if bundle.Version < pinned.Version {
+			return pinned, false, fmt.Errorf("%w: got version %d, pinned version %d", ErrCABundleDowngrade, bundle.Version, pinned.Version)
+		}
+		if bundle.Version == pinned.Version {
+			if !bundle.equal(pinned) {
+				return pinned, false, fmt.Errorf("%w: certificates changed without a new version %d", ErrCABundleInvalid, bundle.Version)
+			}
+			return pinned, false, nil
+		}
+	}
+	if err := bundle.Save(path); err != nil {
+		return pinned, false, err
+	}
+	return bundle, true, nil
+}
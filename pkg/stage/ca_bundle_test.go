@@ -0,0 +1,202 @@
+// Copyright 2023 Hedgehog
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package stage
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// newTLSServerWithOwnCA starts a TLS server with a self-signed CA certificate which is unique to it.
+// The certificates of the httptest TLS servers can't be used here as they are all the same.
+func newTLSServerWithOwnCA(t *testing.T, name string) *httptest.Server {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	srv.TLS = &tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}}}
+	srv.StartTLS()
+	return srv
+}
+
+func TestRefreshCABundle(t *testing.T) {
+	oldCA := newTLSServerWithOwnCA(t, "old CA")
+	defer oldCA.Close()
+	newCA := newTLSServerWithOwnCA(t, "new CA")
+	defer newCA.Close()
+	transition := &CABundle{Version: 2, Certificates: [][]byte{oldCA.Certificate().Raw, newCA.Certificate().Raw}}
+	rotated := &CABundle{Version: 3, Certificates: [][]byte{newCA.Certificate().Raw}}
+
+	tests := []struct {
+		name        string
+		pinned      *CABundle
+		served      *CABundle
+		wantVersion uint64
+		wantUpdated bool
+		wantErr     error
+	}{
+		{
+			name:        "nothing pinned",
+			served:      transition,
+			wantVersion: 2,
+			wantUpdated: true,
+		},
+		{
+			name:        "newer version",
+			pinned:      transition,
+			served:      rotated,
+			wantVersion: 3,
+			wantUpdated: true,
+		},
+		{
+			name:        "same version",
+			pinned:      transition,
+			served:      transition,
+			wantVersion: 2,
+		},
+		{
+			name:        "downgrade",
+			pinned:      rotated,
+			served:      transition,
+			wantVersion: 3,
+			wantErr:     ErrCABundleDowngrade,
+		},
+		{
+			name:        "changed without new version",
+			pinned:      transition,
+			served:      &CABundle{Version: 2, Certificates: [][]byte{newCA.Certificate().Raw}},
+			wantVersion: 2,
+			wantErr:     ErrCABundleInvalid,
+		},
+		{
+			name:    "invalid bundle",
+			served:  &CABundle{Version: 4, Certificates: [][]byte{[]byte("garbage")}},
+			wantErr: ErrCABundleInvalid,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "application/json")
+				json.NewEncoder(w).Encode(tt.served) //nolint:errcheck
+			}))
+			defer srv.Close()
+			path := filepath.Join(t.TempDir(), pathCABundle)
+			if tt.pinned != nil {
+				if err := tt.pinned.Save(path); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			got, updated, err := RefreshCABundle(context.Background(), srv.Client(), srv.URL, path)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("RefreshCABundle() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if updated != tt.wantUpdated {
+				t.Errorf("RefreshCABundle() updated = %v, want %v", updated, tt.wantUpdated)
+			}
+			var gotVersion uint64
+			if got != nil {
+				gotVersion = got.Version
+			}
+			if gotVersion != tt.wantVersion {
+				t.Errorf("RefreshCABundle() version = %d, want %d", gotVersion, tt.wantVersion)
+			}
+			if tt.wantVersion == 0 {
+				return
+			}
+			pinned, err := LoadCABundle(path)
+			if err != nil {
+				t.Fatalf("LoadCABundle() error = %v", err)
+			}
+			if pinned.Version != tt.wantVersion {
+				t.Errorf("pinned version = %d, want %d", pinned.Version, tt.wantVersion)
+			}
+		})
+	}
+}
+
+func TestStagingInfoSeederHTTPClientCABundle(t *testing.T) {
+	oldCA := newTLSServerWithOwnCA(t, "old CA")
+	defer oldCA.Close()
+	newCA := newTLSServerWithOwnCA(t, "new CA")
+	defer newCA.Close()
+
+	reachable := func(t *testing.T, si *StagingInfo, srv *httptest.Server) bool {
+		hc, err := si.SeederHTTPClient(nil, nil)
+		if err != nil {
+			t.Fatalf("SeederHTTPClient() error = %v", err)
+		}
+		defer hc.CloseIdleConnections()
+		resp, err := hc.Get(srv.URL)
+		if err != nil {
+			return false
+		}
+		resp.Body.Close()
+		return true
+	}
+
+	si := &StagingInfo{StagingDir: t.TempDir(), ServerCA: oldCA.Certificate().Raw}
+	if !reachable(t, si, oldCA) || reachable(t, si, newCA) {
+		t.Fatalf("without a pinned bundle only the server CA from stage 0 must be trusted")
+	}
+
+	// during the transition window both CAs are trusted
+	if err := (&CABundle{Version: 1, Certificates: [][]byte{oldCA.Certificate().Raw, newCA.Certificate().Raw}}).Save(CABundlePath(si.StagingDir)); err != nil {
+		t.Fatal(err)
+	}
+	if !reachable(t, si, oldCA) || !reachable(t, si, newCA) {
+		t.Fatalf("both CAs of the pinned bundle must be trusted")
+	}
+
+	// after the rotation the old CA is not trusted anymore, even though stage 0 got it
+	if err := (&CABundle{Version: 2, Certificates: [][]byte{newCA.Certificate().Raw}}).Save(CABundlePath(si.StagingDir)); err != nil {
+		t.Fatal(err)
+	}
+	if reachable(t, si, oldCA) || !reachable(t, si, newCA) {
+		t.Fatalf("only the CA of the pinned bundle must be trusted")
+	}
+}
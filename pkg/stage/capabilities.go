@@ -0,0 +1,41 @@
+// Copyright 2023 Hedgehog
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package stage
+
+import (
+	"go.githedgehog.com/dasboot/pkg/log"
+	"go.githedgehog.com/dasboot/pkg/partitions"
+	"go.uber.org/zap"
+)
+
+// ReportToolCapabilities logs which of the external tools that partition handling depends on are available on
+// this ONIE image, and which features are affected by the missing ones. Stages call this before partition discovery,
+// so that a missing tool is obvious from the logs instead of only showing up as a cryptic exec error later.
+func ReportToolCapabilities(l log.Interface) {
+	caps := partitions.ToolCapabilities()
+	var missing []string
+	for _, c := range caps {
+		if c.Available {
+			continue
+		}
+		missing = append(missing, string(c.Tool))
+		if c.Fallback {
+			l.Warn("Tool is not installed, using a native fallback", zap.String("tool", string(c.Tool)), zap.String("feature", c.Feature))
+		} else {
+			l.Warn("Tool is not installed, feature is unavailable", zap.String("tool", string(c.Tool)), zap.String("feature", c.Feature))
+		}
+	}
+	l.Info("Tool capability report", zap.Strings("missing", missing), zap.Reflect("tools", caps))
+}
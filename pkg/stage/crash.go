@@ -0,0 +1,136 @@
+// Copyright 2023 Hedgehog
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package stage
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime/debug"
+	"time"
+
+	"go.githedgehog.com/dasboot/pkg/log"
+	"go.githedgehog.com/dasboot/pkg/log/syslog"
+	"go.githedgehog.com/dasboot/pkg/partitions/location"
+	"go.githedgehog.com/dasboot/pkg/stage0/config"
+	"go.githedgehog.com/dasboot/pkg/version"
+	"go.uber.org/zap"
+)
+
+// ExitCodePanic is the exit code of a stage binary which crashed with a panic.
+// It corresponds to EX_SOFTWARE from sysexits.h.
+const ExitCodePanic = 70
+
+// CrashReport is written to the staging directory when a stage panics
+type CrashReport struct {
+	Stage        string               `json:"stage"`
+	Version      string               `json:"version"`
+	Time         time.Time            `json:"time"`
+	Panic        string               `json:"panic"`
+	Stack        string               `json:"stack"`
+	StagingInfo  *StagingInfoSnapshot `json:"staging_info,omitempty"`
+	LogLines     []string             `json:"log_lines,omitempty"`
+	SyslogHealth []syslog.Health      `json:"syslog_health,omitempty"`
+}
+
+// StagingInfoSnapshot is the part of the staging information which is safe and useful
+// to include in a crash report
+type StagingInfoSnapshot struct {
+	StagingDir   string              `json:"staging_dir,omitempty"`
+	DeviceID     string              `json:"device_id,omitempty"`
+	LogSettings  LogSettings         `json:"log_settings,omitempty"`
+	OnieHeaders  *config.OnieHeaders `json:"onie_headers,omitempty"`
+	LocationInfo *location.Info      `json:"location_info,omitempty"`
+	MTU          int                 `json:"mtu,omitempty"`
+}
+
+// HandlePanic must be deferred at the very beginning of the main function of a stage binary.
+// If the stage panics, it writes a crash report to the staging directory, logs it through the global
+// logger (which includes syslog if it was configured already), and exits with `ExitCodePanic`.
+func HandlePanic(stageName string) {
+	r := recover()
+	if r == nil {
+		return
+	}
+	report := newCrashReport(stageName, r, debug.Stack())
+
+	// the staging directory is the best place to store the crash report
+	// as it is also going to be inspected by subsequent manual installer runs
+	dir := os.Getenv(envNameStagingDir)
+	if report.StagingInfo != nil && report.StagingInfo.StagingDir != "" {
+		dir = report.StagingInfo.StagingDir
+	}
+	if dir == "" {
+		dir = os.TempDir()
+	}
+	path, err := writeCrashReport(dir, report)
+
+	l := log.L()
+	if err != nil {
+		l.Error("Failed to write crash report", zap.String("dir", dir), zap.Error(err))
+	}
+	l.Error("Stage crashed with a panic",
+		zap.String("stage", stageName),
+		zap.String("version", report.Version),
+		zap.String("panic", report.Panic),
+		zap.String("stack", report.Stack),
+		zap.String("crashReport", path),
+	)
+	_ = l.Sync()
+
+	fmt.Fprintf(os.Stderr, "FATAL: %s crashed: %s (crash report: %s)\n", stageName, report.Panic, path)
+	os.Exit(ExitCodePanic)
+}
+
+func newCrashReport(stageName string, r any, stack []byte) *CrashReport {
+	ret := &CrashReport{
+		Stage:    stageName,
+		Version:  version.Version,
+		Time:     time.Now(),
+		Panic:    fmt.Sprintf("%v", r),
+		Stack:    string(stack),
+		LogLines: recentLogs.Lines(),
+	}
+	if h := LoggingHealth(); len(h) > 0 {
+		ret.SyslogHealth = h
+	}
+
+	// this is best effort only: we might have crashed before
+	// the staging information was even fully established
+	if si, err := ReadStagingInfo(); err == nil {
+		ret.StagingInfo = &StagingInfoSnapshot{
+			StagingDir:   si.StagingDir,
+			DeviceID:     si.DeviceID,
+			LogSettings:  si.LogSettings,
+			OnieHeaders:  si.OnieHeaders,
+			LocationInfo: si.LocationInfo,
+			MTU:          si.MTU,
+		}
+	}
+	return ret
+}
+
+func writeCrashReport(dir string, report *CrashReport) (string, error) {
+	b, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return "", fmt.Errorf("failed to JSON encode crash report: %w", err)
+	}
+	path := filepath.Join(dir, fmt.Sprintf("crash-report-%s-%d.json", report.Stage, report.Time.Unix()))
+	if err := writeFile(path, b); err != nil {
+		return "", fmt.Errorf("failed to write crash report to disk at '%s': %w", path, err)
+	}
+	return path, nil
+}
@@ -0,0 +1,110 @@
+// Copyright 2023 Hedgehog
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package stage
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"time"
+)
+
+// DeviceMetadata is what the control plane plans for a registered device. Stages label their logs and
+// reports with it, and the provisioner writes it into the initial configuration of the installed NOS.
+type DeviceMetadata struct {
+	// DeviceID is the device ID which the metadata was requested for
+	DeviceID string `json:"devid"`
+
+	// Hostname is the planned host name of the device, which is the name of its switch in the wiring
+	Hostname string `json:"hostname"`
+
+	// Role is the role of the device in the fabric, e.g. "spine" or "server-leaf"
+	Role string `json:"role,omitempty"`
+
+	// Description is the description of the device in the wiring
+	Description string `json:"description,omitempty"`
+
+	// Profile is the switch profile of the device
+	Profile string `json:"profile,omitempty"`
+
+	// Groups are the switch groups which the device is a member of
+	Groups []string `json:"groups,omitempty"`
+
+	// Fabric is the name of the fabric which the device is part of
+	Fabric string `json:"fabric,omitempty"`
+}
+
+var ErrDeviceMetadataInvalid = errors.New("device metadata: invalid")
+
+// Validate ensures that the metadata was issued for the device `devid`, and that it has a host name
+func (m *DeviceMetadata) Validate(devid string) error {
+	if m == nil {
+		return fmt.Errorf("%w: empty", ErrDeviceMetadataInvalid)
+	}
+	if m.DeviceID != devid {
+		return fmt.Errorf("%w: issued for device '%s' instead of '%s'", ErrDeviceMetadataInvalid, m.DeviceID, devid)
+	}
+	if m.Hostname == "" {
+		return fmt.Errorf("%w: missing host name", ErrDeviceMetadataInvalid)
+	}
+	return nil
+}
+
+// WriteFile writes the metadata as JSON to `path`
+func (m *DeviceMetadata) WriteFile(path string) error {
+	b, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, append(b, '\n'), 0644) //nolint: gosec
+}
+
+// FetchDeviceMetadata downloads the metadata of the device `devid` from the seeder at `baseURL`
+func FetchDeviceMetadata(ctx context.Context, hc *http.Client, baseURL string, devid string) (*DeviceMetadata, error) {
+	u, err := url.Parse(baseURL)
+	if err != nil {
+		return nil, fmt.Errorf("parsing device metadata URL '%s': %w", baseURL, err)
+	}
+	u.Path = path.Join(u.Path, devid)
+
+	subCtx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(subCtx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/json")
+	resp, err := hc.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, NewHTTPErrorFromBody(resp)
+	}
+	var ret DeviceMetadata
+	if err := json.NewDecoder(resp.Body).Decode(&ret); err != nil {
+		return nil, fmt.Errorf("%w: decoding response: %w", ErrDeviceMetadataInvalid, err)
+	}
+	if err := ret.Validate(devid); err != nil {
+		return nil, err
+	}
+	return &ret, nil
+}
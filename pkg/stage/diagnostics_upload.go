@@ -0,0 +1,309 @@
+// Copyright 2023 Hedgehog
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package stage
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.githedgehog.com/dasboot/pkg/log"
+	"go.uber.org/zap"
+	"golang.org/x/sys/unix"
+)
+
+// HeaderUploadOffset is the offset of the chunk of a diagnostics upload in a request. In responses it is the
+// offset up to which the seeder has stored the upload, which is where the next chunk has to start.
+const HeaderUploadOffset = "Upload-Offset"
+
+// DiagnosticsUploadRequest starts an upload of a diagnostic file like a core dump or a crash report. The seeder
+// continues an unfinished upload of the device with the same name and digest instead of starting a new one.
+type DiagnosticsUploadRequest struct {
+	// Name is the file name of the diagnostic file without any directories
+	Name string `json:"name"`
+
+	// Size is the size of the file in bytes
+	Size int64 `json:"size"`
+
+	// Digest is the digest of the whole file in the form `sha256:<hex>`
+	Digest string `json:"digest"`
+
+	// Stage is the name of the stage which uploads the file
+	Stage string `json:"stage,omitempty"`
+
+	// InstallSession is the install session during which the file was created
+	InstallSession string `json:"install_session,omitempty"`
+}
+
+// DiagnosticsUpload is the state of an upload as the seeder has stored it
+type DiagnosticsUpload struct {
+	DiagnosticsUploadRequest
+
+	// ID identifies the upload on the seeder
+	ID string `json:"id"`
+
+	// Offset is the number of bytes which the seeder has stored
+	Offset int64 `json:"offset"`
+
+	// ChunkSize is the maximum size of a chunk which the seeder accepts
+	ChunkSize int64 `json:"chunk_size"`
+
+	// Complete is set once the whole file was stored and its digest was verified
+	Complete bool `json:"complete,omitempty"`
+}
+
+var ErrDiagnosticsUpload = errors.New("diagnostics upload")
+
+// these are variables so that tests do not have to wait for retries
+var (
+	diagnosticsUploadAttempts      = 8
+	diagnosticsUploadRetryDelay    = 2 * time.Second
+	diagnosticsUploadMaxRetryDelay = 30 * time.Second
+)
+
+const diagnosticsUploadRequestTimeout = 2 * time.Minute
+
+// DiagnosticsDigest returns the digest of the file at `path` in the form `sha256:<hex>` together with its size
+func DiagnosticsDigest(path string) (string, int64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", 0, err
+	}
+	defer f.Close()
+	h := sha256.New()
+	n, err := io.Copy(h, f)
+	if err != nil {
+		return "", 0, err
+	}
+	return "sha256:" + hex.EncodeToString(h.Sum(nil)), n, nil
+}
+
+// UploadDiagnostics uploads the file at `path` to the diagnostics upload endpoint of the seeder at `baseURL`. The
+// file is sent in chunks, and every chunk is retried with backoff. After a failure the upload continues from the
+// offset that the seeder has stored, so also an upload which was interrupted by a reboot is continued where it
+// stopped. The correlation `c` labels the upload with the stage and install session.
+func UploadDiagnostics(ctx context.Context, hc *http.Client, baseURL string, c log.Correlation, path string) (*DiagnosticsUpload, error) {
+	digest, size, err := DiagnosticsDigest(path)
+	if err != nil {
+		return nil, fmt.Errorf("%w: digest of '%s': %w", ErrDiagnosticsUpload, path, err)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrDiagnosticsUpload, err)
+	}
+	defer f.Close()
+
+	req := &DiagnosticsUploadRequest{
+		Name:           filepath.Base(path),
+		Size:           size,
+		Digest:         digest,
+		Stage:          c.Stage,
+		InstallSession: c.InstallSession,
+	}
+	var up *DiagnosticsUpload
+	if err := retryDiagnosticsUpload(ctx, func() error {
+		var err error
+		up, err = createDiagnosticsUpload(ctx, hc, baseURL, req)
+		return err
+	}); err != nil {
+		return nil, fmt.Errorf("%w: starting upload of '%s': %w", ErrDiagnosticsUpload, path, err)
+	}
+	uploadURL, err := url.JoinPath(baseURL, up.ID)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrDiagnosticsUpload, err)
+	}
+	if up.Offset > 0 && !up.Complete {
+		log.L().Info("Resuming diagnostics upload", zap.String("path", path), zap.String("id", up.ID), zap.Int64("offset", up.Offset), zap.Int64("size", size))
+	}
+
+	for !up.Complete {
+		if err := retryDiagnosticsUpload(ctx, func() error {
+			next, err := uploadDiagnosticsChunk(ctx, hc, uploadURL, f, up)
+			if err == nil {
+				up = next
+				return nil
+			}
+			// whatever happened, the seeder knows best where to continue
+			if status, statusErr := getDiagnosticsUpload(ctx, hc, uploadURL); statusErr == nil {
+				up = status
+			}
+			return err
+		}); err != nil {
+			return up, fmt.Errorf("%w: uploading '%s' at offset %d: %w", ErrDiagnosticsUpload, path, up.Offset, err)
+		}
+	}
+	return up, nil
+}
+
+// retryDiagnosticsUpload retries `f` with exponential backoff unless the seeder rejected the request for good
+func retryDiagnosticsUpload(ctx context.Context, f func() error) error {
+	delay := diagnosticsUploadRetryDelay
+	var err error
+	for attempt := 1; ; attempt++ {
+		err = f()
+		if err == nil || !retryableDiagnosticsUploadError(err) || attempt >= diagnosticsUploadAttempts {
+			return err
+		}
+		log.L().Debug("Diagnostics upload request failed, retrying", zap.Int("attempt", attempt), zap.Duration("delay", delay), zap.Error(err))
+		select {
+		case <-ctx.Done():
+			return errors.Join(err, ctx.Err())
+		case <-time.After(delay):
+		}
+		delay = min(2*delay, diagnosticsUploadMaxRetryDelay)
+	}
+}
+
+// retryableDiagnosticsUploadError returns false for all client errors of the seeder which do not change on a retry
+func retryableDiagnosticsUploadError(err error) bool {
+	var httpErr *HTTPError
+	if !errors.As(err, &httpErr) {
+		return true
+	}
+	switch httpErr.StatusCode {
+	case http.StatusRequestTimeout, http.StatusConflict, http.StatusTooManyRequests:
+		return true
+	}
+	return httpErr.StatusCode >= 500 && httpErr.StatusCode != http.StatusInsufficientStorage
+}
+
+func doDiagnosticsUploadRequest(ctx context.Context, hc *http.Client, method, u string, body io.Reader, header http.Header) (*DiagnosticsUpload, error) {
+	subCtx, cancel := context.WithTimeout(ctx, diagnosticsUploadRequestTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(subCtx, method, u, body)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	req.Header.Set("Accept", "application/json")
+	resp, err := hc.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusCreated {
+		return nil, NewHTTPErrorFromBody(resp)
+	}
+	var ret DiagnosticsUpload
+	if err := json.NewDecoder(resp.Body).Decode(&ret); err != nil {
+		return nil, fmt.Errorf("decoding response: %w", err)
+	}
+	return &ret, nil
+}
+
+func createDiagnosticsUpload(ctx context.Context, hc *http.Client, baseURL string, r *DiagnosticsUploadRequest) (*DiagnosticsUpload, error) {
+	b, err := json.Marshal(r)
+	if err != nil {
+		return nil, err
+	}
+	up, err := doDiagnosticsUploadRequest(ctx, hc, http.MethodPost, baseURL, bytes.NewReader(b), http.Header{"Content-Type": {"application/json"}})
+	if err != nil {
+		return nil, err
+	}
+	if up.ID == "" || strings.ContainsAny(up.ID, "/?#") || path.Clean(up.ID) != up.ID {
+		return nil, fmt.Errorf("invalid upload ID '%s'", up.ID)
+	}
+	if up.ChunkSize <= 0 {
+		return nil, fmt.Errorf("invalid chunk size %d", up.ChunkSize)
+	}
+	return up, nil
+}
+
+func getDiagnosticsUpload(ctx context.Context, hc *http.Client, uploadURL string) (*DiagnosticsUpload, error) {
+	return doDiagnosticsUploadRequest(ctx, hc, http.MethodGet, uploadURL, nil, nil)
+}
+
+func uploadDiagnosticsChunk(ctx context.Context, hc *http.Client, uploadURL string, f io.ReaderAt, up *DiagnosticsUpload) (*DiagnosticsUpload, error) {
+	chunk := make([]byte, min(up.ChunkSize, up.Size-up.Offset))
+	if _, err := f.ReadAt(chunk, up.Offset); err != nil {
+		return nil, fmt.Errorf("reading chunk at offset %d: %w", up.Offset, err)
+	}
+	header := http.Header{
+		"Content-Type":     {"application/octet-stream"},
+		HeaderUploadOffset: {strconv.FormatInt(up.Offset, 10)},
+	}
+	next, err := doDiagnosticsUploadRequest(ctx, hc, http.MethodPatch, uploadURL, bytes.NewReader(chunk), header)
+	if err != nil {
+		return nil, err
+	}
+	if next.Offset <= up.Offset && !next.Complete {
+		return nil, fmt.Errorf("upload did not progress from offset %d", up.Offset)
+	}
+	return next, nil
+}
+
+// EnableCoreDumps lifts the core dump size limit of the running stage, which all commands that it executes
+// inherit. ONIE disables core dumps by default, but they are the most valuable diagnostics of a crashed installer.
+func EnableCoreDumps() error {
+	var lim unix.Rlimit
+	if err := unix.Getrlimit(unix.RLIMIT_CORE, &lim); err != nil {
+		return err
+	}
+	if err := unix.Setrlimit(unix.RLIMIT_CORE, &unix.Rlimit{Cur: unix.RLIM_INFINITY, Max: unix.RLIM_INFINITY}); err == nil {
+		return nil
+	}
+	// without privileges we can still go up to the hard limit
+	lim.Cur = lim.Max
+	return unix.Setrlimit(unix.RLIMIT_CORE, &lim)
+}
+
+// DiagnosticFiles returns all crash reports and core dumps in `dirs`
+func DiagnosticFiles(dirs ...string) []string {
+	var ret []string
+	for _, dir := range dirs {
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			continue
+		}
+		for _, entry := range entries {
+			name := entry.Name()
+			if !entry.Type().IsRegular() {
+				continue
+			}
+			if name == "core" || strings.HasPrefix(name, "core.") || (strings.HasPrefix(name, "crash-report-") && strings.HasSuffix(name, ".json")) {
+				ret = append(ret, filepath.Join(dir, name))
+			}
+		}
+	}
+	return ret
+}
+
+// UploadAllDiagnostics uploads all `files` with `UploadDiagnostics`. It is best effort, so failures are only logged.
+func UploadAllDiagnostics(ctx context.Context, hc *http.Client, baseURL string, c log.Correlation, files []string) {
+	l := log.L()
+	for _, file := range files {
+		up, err := UploadDiagnostics(ctx, hc, baseURL, c, file)
+		if err != nil {
+			l.Warn("Uploading diagnostic file failed", zap.String("path", file), zap.Error(err))
+			continue
+		}
+		l.Info("Uploaded diagnostic file", zap.String("path", file), zap.String("id", up.ID), zap.Int64("size", up.Size))
+	}
+}
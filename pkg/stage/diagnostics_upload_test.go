@@ -0,0 +1,125 @@
+// Copyright 2023 Hedgehog
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package stage
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"go.githedgehog.com/dasboot/pkg/log"
+)
+
+// flakyUploadServer implements the diagnostics upload protocol in memory. It cuts off every third chunk
+// halfway through, just like a flaky link would.
+type flakyUploadServer struct {
+	mu      sync.Mutex
+	up      *DiagnosticsUpload
+	data    []byte
+	patches int
+}
+
+func (s *flakyUploadServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	reply := func() {
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(s.up)
+	}
+	switch {
+	case r.Method == http.MethodPost:
+		var req DiagnosticsUploadRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if s.up == nil {
+			s.up = &DiagnosticsUpload{DiagnosticsUploadRequest: req, ID: "1", ChunkSize: 1000}
+		}
+		reply()
+	case r.Method == http.MethodGet && strings.HasSuffix(r.URL.Path, "/1"):
+		reply()
+	case r.Method == http.MethodPatch && strings.HasSuffix(r.URL.Path, "/1"):
+		off, _ := strconv.ParseInt(r.Header.Get(HeaderUploadOffset), 10, 64)
+		if off != s.up.Offset {
+			w.WriteHeader(http.StatusConflict)
+			_, _ = w.Write([]byte(`{"error":"offset mismatch"}`))
+			return
+		}
+		chunk, _ := io.ReadAll(r.Body)
+		s.patches++
+		if s.patches%3 == 1 {
+			chunk = chunk[:len(chunk)/2]
+			s.data = append(s.data, chunk...)
+			s.up.Offset += int64(len(chunk))
+			w.WriteHeader(http.StatusBadGateway)
+			_, _ = w.Write([]byte(`{"error":"cut off"}`))
+			return
+		}
+		s.data = append(s.data, chunk...)
+		s.up.Offset += int64(len(chunk))
+		s.up.Complete = s.up.Offset == s.up.Size
+		reply()
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func TestUploadDiagnostics(t *testing.T) {
+	oldDelay := diagnosticsUploadRetryDelay
+	diagnosticsUploadRetryDelay = time.Millisecond
+	defer func() { diagnosticsUploadRetryDelay = oldDelay }()
+
+	dir := t.TempDir()
+	data := bytes.Repeat([]byte("core dump "), 543)
+	p := filepath.Join(dir, "core.42")
+	if err := os.WriteFile(p, data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "installer.log"), []byte("log"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if files := DiagnosticFiles(dir); len(files) != 1 || files[0] != p {
+		t.Fatalf("DiagnosticFiles() = %v, want [%s]", files, p)
+	}
+
+	s := &flakyUploadServer{}
+	ts := httptest.NewServer(s)
+	defer ts.Close()
+
+	up, err := UploadDiagnostics(context.Background(), ts.Client(), ts.URL+"/diagnostics/uploads", log.Correlation{Stage: "stage2", InstallSession: "f00d"}, p)
+	if err != nil {
+		t.Fatalf("UploadDiagnostics() error = %v", err)
+	}
+	if !up.Complete || !bytes.Equal(s.data, data) {
+		t.Errorf("upload is not complete or does not match the file: %+v", up)
+	}
+	if up.Name != "core.42" || up.Stage != "stage2" || up.InstallSession != "f00d" {
+		t.Errorf("unexpected upload request: %+v", up.DiagnosticsUploadRequest)
+	}
+	if s.patches < 7 {
+		t.Errorf("only %d chunks were uploaded, the server did not cut any off", s.patches)
+	}
+}
@@ -17,6 +17,7 @@ package stage
 import (
 	"bufio"
 	"context"
+	"crypto/x509"
 	"fmt"
 	"io"
 	"net/http"
@@ -24,41 +25,218 @@ import (
 	"os"
 	"path"
 	"time"
+
+	"go.githedgehog.com/dasboot/pkg/log"
+	"go.githedgehog.com/dasboot/pkg/partitions"
+	"go.githedgehog.com/dasboot/pkg/version"
+	"go.uber.org/zap"
 )
 
-func DownloadExecutable(ctx context.Context, hc *http.Client, srcURL string, destPath string, timeout time.Duration) error {
-	return Download(ctx, hc, srcURL, destPath, 0755, timeout)
+// DownloadOption is an option which can be passed to `Download` and `DownloadExecutable`
+type DownloadOption func(*downloadOptions)
+
+type downloadOptions struct {
+	provenanceCA     *x509.CertPool
+	requireManifest  bool
+	progress         func(written int64, total int64)
+	sparse           bool
+	discard          bool
+	chunkSize        int64
+	chunkParallelism int
+}
+
+// DownloadOptionRequireProvenance requires that the downloaded artifact comes with a signed artifact
+// provenance which was signed by a certificate which was issued by a CA in `ca`. The digest of the
+// downloaded artifact is verified against the provenance. If `ca` is nil, the option has no effect.
+func DownloadOptionRequireProvenance(ca *x509.CertPool) DownloadOption {
+	return func(o *downloadOptions) {
+		o.provenanceCA = ca
+	}
+}
+
+// DownloadOptionRequireManifest additionally requires that the artifact provenance says that the seeder verified
+// the artifact against its signed artifact manifest. It only has an effect together with
+// `DownloadOptionRequireProvenance`.
+func DownloadOptionRequireManifest() DownloadOption {
+	return func(o *downloadOptions) {
+		o.requireManifest = true
+	}
+}
+
+// DownloadOptionChunked downloads artifacts in chunks of `chunkSize` bytes over up to `parallelism` connections
+// at the same time. Every chunk resumes where it failed on transient errors, and it is verified against its
+// Content-Digest header if the server sends one. Artifacts are only being downloaded in chunks if the server supports
+// range requests and sends a validator for them, and if the destination is not a block device. If `chunkSize` or
+// `parallelism` are not positive, the defaults are being used.
+func DownloadOptionChunked(chunkSize int64, parallelism int) DownloadOption {
+	return func(o *downloadOptions) {
+		if chunkSize <= 0 {
+			chunkSize = DefaultChunkSize
+		}
+		if parallelism <= 0 {
+			parallelism = DefaultChunkParallelism
+		}
+		// chunks must start at block boundaries for sparse downloads
+		if rem := chunkSize % partitions.SparseBlockSize; rem != 0 {
+			chunkSize += partitions.SparseBlockSize - rem
+		}
+		o.chunkSize = chunkSize
+		o.chunkParallelism = parallelism
+	}
+}
+
+// DownloadOptionProgress calls `f` with the number of bytes which have been written so far every time the
+// download made progress. `total` is the size of the artifact, or -1 if it is unknown. If a download gets
+// retried from another mirror, `written` starts again from zero.
+func DownloadOptionProgress(f func(written int64, total int64)) DownloadOption {
+	return func(o *downloadOptions) {
+		o.progress = f
+	}
+}
+
+// DownloadOptionSparse writes the artifact with a sparse writer which skips all blocks which contain only zeros.
+// `discard` additionally discards the skipped blocks if the destination is a block device. It must be disabled
+// on platforms where discarded blocks do not read back as zeros.
+func DownloadOptionSparse(discard bool) DownloadOption {
+	return func(o *downloadOptions) {
+		o.sparse = true
+		o.discard = discard
+	}
+}
+
+func DownloadExecutable(ctx context.Context, hc *http.Client, srcURL string, destPath string, timeout time.Duration, opts ...DownloadOption) error {
+	return Download(ctx, hc, srcURL, destPath, 0755, timeout, opts...)
 }
 
-func Download(ctx context.Context, hc *http.Client, srcURL string, destPath string, destPerm os.FileMode, timeout time.Duration) error {
-	// build the request
+func Download(ctx context.Context, hc *http.Client, srcURL string, destPath string, destPerm os.FileMode, timeout time.Duration, opts ...DownloadOption) error {
+	o := &downloadOptions{}
+	for _, opt := range opts {
+		opt(o)
+	}
+
 	subCtx, cancel := context.WithTimeout(ctx, timeout)
 	defer cancel()
-	req, err := http.NewRequestWithContext(subCtx, http.MethodGet, srcURL, nil)
-	if err != nil {
-		return err
-	}
-	req.Header.Set("Accept", "application/octet-stream")
-	req.Header.Add("Accept", "application/json")
 
 	// open the destPath first
 	// no need to go to the network if we cannot even write it to a file
-	f, err := os.OpenFile(destPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, destPerm)
+	f, err := os.OpenFile(destPath, os.O_CREATE|os.O_TRUNC|os.O_RDWR, destPerm)
 	if err != nil {
 		return fmt.Errorf("open '%s': %w", destPath, err)
 	}
 	defer f.Close()
 
-	// execute the request
-	httpResp, err := hc.Do(req)
+	// execute the request, and ask for the first chunk only if we are downloading in chunks
+	var httpResp *http.Response
+	if o.chunkSize > 0 && !isBlockDevice(f) {
+		httpResp, err = downloadRequest(subCtx, hc, srcURL, fmt.Sprintf("bytes=0-%d", o.chunkSize-1), "")
+		if err != nil {
+			return err
+		}
+		switch httpResp.StatusCode {
+		case http.StatusPartialContent:
+			if err := checkDownloadResponse(httpResp); err != nil {
+				httpResp.Body.Close()
+				return err
+			}
+			cd, err := newChunkedDownload(hc, srcURL, f, httpResp, o)
+			if err == nil {
+				prov, err := verifyDownloadProvenance(httpResp, srcURL, o)
+				if err != nil {
+					httpResp.Body.Close()
+					return err
+				}
+				return cd.run(subCtx, prov)
+			}
+			log.L().Debug("Not downloading in chunks", zap.String("url", srcURL), zap.Error(err))
+			httpResp.Body.Close()
+			httpResp = nil
+		case http.StatusRequestedRangeNotSatisfiable:
+			// this is an empty artifact
+			httpResp.Body.Close()
+			httpResp = nil
+		}
+	}
+	if httpResp == nil {
+		httpResp, err = downloadRequest(subCtx, hc, srcURL, "", "")
+		if err != nil {
+			return err
+		}
+	}
+	defer httpResp.Body.Close()
+
+	// servers which do not support ranges simply send the whole artifact
+	if err := checkDownloadResponse(httpResp); err != nil {
+		return err
+	}
+	prov, err := verifyDownloadProvenance(httpResp, srcURL, o)
 	if err != nil {
 		return err
 	}
-	defer httpResp.Body.Close()
 
+	// the provenance was verified before we even start writing the artifact,
+	// the digest gets calculated while we are writing it
+	var w interface {
+		io.Writer
+		Flush() error
+	}
+	if o.sparse {
+		w, err = partitions.NewSparseWriter(f, o.discard)
+		if err != nil {
+			return err
+		}
+	} else {
+		w = bufio.NewWriter(f)
+	}
+	var dst io.Writer = w
+	var pw *provenanceWriter
+	if prov != nil {
+		pw = newProvenanceWriter(prov.Size)
+		dst = io.MultiWriter(w, pw)
+	}
+	if o.progress != nil {
+		dst = io.MultiWriter(dst, &progressWriter{total: httpResp.ContentLength, f: o.progress})
+	}
+
+	// now we can copy the body to the file
+	if _, err := io.Copy(dst, httpResp.Body); err != nil {
+		return fmt.Errorf("writing HTTP response body to '%s': %w", destPath, err)
+	}
+	if err := w.Flush(); err != nil {
+		return fmt.Errorf("writing HTTP response body to '%s': %w", destPath, err)
+	}
+	if pw != nil {
+		if err := pw.verify(prov); err != nil {
+			return fmt.Errorf("%s: %w", srcURL, err)
+		}
+	}
+
+	return nil
+}
+
+// downloadRequest sends the GET request for an artifact. `byteRange` and `ifRange` set the respective headers
+// if they are not empty. The request is marked as an artifact download, so that artifacts do not need a
+// response signature.
+func downloadRequest(ctx context.Context, hc *http.Client, srcURL string, byteRange string, ifRange string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(withArtifactDownload(ctx), http.MethodGet, srcURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/octet-stream")
+	req.Header.Add("Accept", "application/json")
+	if byteRange != "" {
+		req.Header.Set("Range", byteRange)
+	}
+	if ifRange != "" {
+		req.Header.Set("If-Range", ifRange)
+	}
+	return hc.Do(req)
+}
+
+// checkDownloadResponse returns the error of an unsuccessful download response
+func checkDownloadResponse(httpResp *http.Response) error {
 	// if it was an error, parse the error and return as such
 	contentType := httpResp.Header.Get("Content-Type")
-	if httpResp.StatusCode != http.StatusOK {
+	if httpResp.StatusCode != http.StatusOK && httpResp.StatusCode != http.StatusPartialContent {
 		if contentType != "application/json" {
 			return NewHTTPErrorf(httpResp, "failed to decode error as the content is not JSON, but '%s'", contentType)
 		}
@@ -69,15 +247,36 @@ func Download(ctx context.Context, hc *http.Client, srcURL string, destPath stri
 	if contentType != "application/octet-stream" && contentType != "application/yaml" {
 		return NewHTTPErrorf(httpResp, "but unexpected content type: %s", contentType)
 	}
+	return nil
+}
 
-	// now we can copy the body to the file
-	w := bufio.NewWriter(f)
-	defer w.Flush()
-	if _, err := io.Copy(w, httpResp.Body); err != nil {
-		return fmt.Errorf("writing HTTP response body to '%s': %w", destPath, err)
+// verifyDownloadProvenance verifies the artifact provenance in the headers of `httpResp` if the options require it.
+// It returns nil if they do not.
+func verifyDownloadProvenance(httpResp *http.Response, srcURL string, o *downloadOptions) (*version.ArtifactProvenance, error) {
+	if o.provenanceCA == nil {
+		return nil, nil
+	}
+	prov, err := VerifyArtifactProvenance(httpResp.Header, o.provenanceCA)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", srcURL, err)
+	}
+	if o.requireManifest && prov.ManifestVersion == "" {
+		return nil, fmt.Errorf("%s: %w: artifact '%s' was not verified against the artifact manifest", srcURL, ErrProvenanceNotInManifest, prov.Artifact)
 	}
+	return prov, nil
+}
 
-	return nil
+// progressWriter reports the number of bytes which have been written through it
+type progressWriter struct {
+	written int64
+	total   int64
+	f       func(written int64, total int64)
+}
+
+func (w *progressWriter) Write(p []byte) (int, error) {
+	w.written += int64(len(p))
+	w.f(w.written, w.total)
+	return len(p), nil
 }
 
 func BuildURL(base string, pathAddendum string) (string, error) {
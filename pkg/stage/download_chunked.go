@@ -0,0 +1,372 @@
+// Copyright 2023 Hedgehog
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package stage
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go.githedgehog.com/dasboot/pkg/log"
+	"go.githedgehog.com/dasboot/pkg/partitions"
+	"go.githedgehog.com/dasboot/pkg/version"
+	"go.uber.org/zap"
+)
+
+// DefaultChunkSize is the size of the chunks in which artifacts are being downloaded
+const DefaultChunkSize = 16 * 1024 * 1024
+
+// DefaultChunkParallelism is the number of chunks of an artifact which are being downloaded at the same time
+const DefaultChunkParallelism = 4
+
+// chunkRetries is the number of times a chunk download is being retried on transient errors
+const chunkRetries = 5
+
+// chunkRetryDelay is the delay before the first retry of a chunk, and it grows with every further retry.
+// It can be swapped out for testing.
+var chunkRetryDelay = time.Second
+
+var (
+	ErrChunkDigestMismatch    = errors.New("stage: chunk digest mismatch")
+	ErrArtifactChanged        = errors.New("stage: artifact changed during chunked download")
+	errNotChunkable           = errors.New("not chunkable")
+	errTransientChunkDownload = errors.New("transient chunk download error")
+)
+
+// zeroBlock is compared against to find blocks which contain only zeros for sparse downloads
+var zeroBlock = make([]byte, partitions.SparseBlockSize)
+
+// chunk is the inclusive byte range of a part of an artifact
+type chunk struct {
+	start int64
+	end   int64
+}
+
+// chunkedDownload downloads an artifact in chunks over several connections at the same time
+type chunkedDownload struct {
+	hc        *http.Client
+	srcURL    string
+	f         *os.File
+	o         *downloadOptions
+	total     int64
+	validator string
+	first     *http.Response
+	chunks    []chunk
+
+	progressLock sync.Mutex
+	written      int64
+}
+
+// newChunkedDownload prepares the chunked download of an artifact from the partial response `first` to the first
+// range request. It fails with errNotChunkable if the server does not let us download the artifact safely in chunks.
+func newChunkedDownload(hc *http.Client, srcURL string, f *os.File, first *http.Response, o *downloadOptions) (*chunkedDownload, error) {
+	start, end, total, err := parseContentRange(first.Header.Get("Content-Range"))
+	if err != nil {
+		return nil, err
+	}
+	if start != 0 || total < 0 {
+		return nil, fmt.Errorf("%w: unexpected content range '%s'", errNotChunkable, first.Header.Get("Content-Range"))
+	}
+
+	// the validator makes sure that all chunks are from the same artifact,
+	// weak entity tags must not be used for range requests
+	validator := first.Header.Get("ETag")
+	if validator == "" || strings.HasPrefix(validator, "W/") {
+		validator = first.Header.Get("Last-Modified")
+	}
+	if validator == "" {
+		return nil, fmt.Errorf("%w: server sent no validator", errNotChunkable)
+	}
+
+	ret := &chunkedDownload{
+		hc:        hc,
+		srcURL:    srcURL,
+		f:         f,
+		o:         o,
+		total:     total,
+		validator: validator,
+		first:     first,
+		chunks:    []chunk{{start: 0, end: end}},
+	}
+	for off := end + 1; off < total; off += o.chunkSize {
+		ret.chunks = append(ret.chunks, chunk{start: off, end: min(off+o.chunkSize, total) - 1})
+	}
+	return ret, nil
+}
+
+// run downloads all chunks, and verifies the digest of the whole artifact against `prov` afterwards if it is set
+func (d *chunkedDownload) run(ctx context.Context, prov *version.ArtifactProvenance) error {
+	defer d.first.Body.Close()
+
+	// skipped zero blocks become holes, and the file has the right size even if it ends with them
+	if err := d.f.Truncate(d.total); err != nil {
+		return fmt.Errorf("truncate '%s': %w", d.f.Name(), err)
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	chunks := make(chan int)
+	errs := make(chan error, len(d.chunks))
+	var wg sync.WaitGroup
+	for i := 0; i < min(d.o.chunkParallelism, len(d.chunks)); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range chunks {
+				var body io.ReadCloser
+				if i == 0 {
+					body = d.first.Body
+				}
+				if err := d.fetchChunk(ctx, d.chunks[i], body); err != nil {
+					errs <- err
+					cancel()
+				}
+			}
+		}()
+	}
+	func() {
+		defer close(chunks)
+		for i := range d.chunks {
+			select {
+			case chunks <- i:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	wg.Wait()
+	close(errs)
+	if err := <-errs; err != nil {
+		return fmt.Errorf("%s: %w", d.srcURL, err)
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	// the chunks arrive in no particular order, so the digest gets calculated once they are all there
+	if prov != nil {
+		pw := newProvenanceWriter(prov.Size)
+		if _, err := io.Copy(pw, io.NewSectionReader(d.f, 0, d.total)); err != nil {
+			return fmt.Errorf("reading '%s': %w", d.f.Name(), err)
+		}
+		if err := pw.verify(prov); err != nil {
+			return fmt.Errorf("%s: %w", d.srcURL, err)
+		}
+	}
+	return nil
+}
+
+// fetchChunk downloads chunk `c` and writes it to the file. `body` is the response body of the chunk if it has been
+// requested already. Transient errors resume the chunk where it failed, unless the server sent a digest for the chunk,
+// which can only be verified if the chunk is being downloaded again as a whole.
+func (d *chunkedDownload) fetchChunk(ctx context.Context, c chunk, body io.ReadCloser) error {
+	var err error
+	var digest string
+	if body != nil {
+		digest = d.first.Header.Get("Content-Digest")
+	}
+	pos := c.start
+	// blocks of a chunk which is being downloaded again might hold corrupt data from before,
+	// so zero blocks are only being skipped the first time
+	skipZeros := d.o.sparse
+	for attempt := 0; ; attempt++ {
+		if attempt > 0 {
+			log.L().Warn("Retrying chunk download",
+				zap.String("url", d.srcURL),
+				zap.Int64("start", c.start),
+				zap.Int64("end", c.end),
+				zap.Int64("position", pos),
+				zap.Int("attempt", attempt),
+				zap.Error(err),
+			)
+			select {
+			case <-time.After(time.Duration(attempt) * chunkRetryDelay):
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+		if body == nil {
+			body, digest, err = d.requestChunk(ctx, pos, c.end)
+		}
+		if err == nil {
+			var next int64
+			next, err = d.copyChunk(c, pos, body, digest, skipZeros)
+			body.Close()
+			body = nil
+			if err == nil {
+				return nil
+			}
+			if digest == "" {
+				pos = next
+			} else {
+				d.addProgress(c.start - next)
+				pos = c.start
+				skipZeros = false
+			}
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if !errors.Is(err, errTransientChunkDownload) && !errors.Is(err, ErrChunkDigestMismatch) {
+			return err
+		}
+		if attempt >= chunkRetries {
+			return fmt.Errorf("chunk %d-%d failed after %d attempts: %w", c.start, c.end, attempt+1, err)
+		}
+	}
+}
+
+// requestChunk requests the byte range from `start` to `end` of the artifact, and returns the response body and the
+// digest of the range if the server sent one
+func (d *chunkedDownload) requestChunk(ctx context.Context, start int64, end int64) (io.ReadCloser, string, error) {
+	httpResp, err := downloadRequest(ctx, d.hc, d.srcURL, fmt.Sprintf("bytes=%d-%d", start, end), d.validator)
+	if err != nil {
+		return nil, "", fmt.Errorf("%w: %w", errTransientChunkDownload, err)
+	}
+	switch {
+	case httpResp.StatusCode == http.StatusPartialContent:
+	case httpResp.StatusCode == http.StatusOK:
+		// the server ignores If-Range ranges and sends the whole artifact if it no longer matches the validator
+		httpResp.Body.Close()
+		return nil, "", ErrArtifactChanged
+	case httpResp.StatusCode == http.StatusTooManyRequests || httpResp.StatusCode >= http.StatusInternalServerError:
+		httpResp.Body.Close()
+		return nil, "", fmt.Errorf("%w: %w", errTransientChunkDownload, NewHTTPErrorf(httpResp, ""))
+	default:
+		err := checkDownloadResponse(httpResp)
+		httpResp.Body.Close()
+		return nil, "", err
+	}
+	gotStart, gotEnd, gotTotal, err := parseContentRange(httpResp.Header.Get("Content-Range"))
+	if err != nil || gotStart != start || gotEnd != end || gotTotal != d.total {
+		httpResp.Body.Close()
+		return nil, "", fmt.Errorf("%w: unexpected content range '%s'", ErrArtifactChanged, httpResp.Header.Get("Content-Range"))
+	}
+	return httpResp.Body, httpResp.Header.Get("Content-Digest"), nil
+}
+
+// copyChunk writes `body` to the file from `pos` to the end of chunk `c`, and verifies it against `digest` if it is
+// not empty. Blocks which contain only zeros are not being written if `skipZeros` is set. It returns the position up
+// to which it has written the chunk.
+func (d *chunkedDownload) copyChunk(c chunk, pos int64, body io.Reader, digest string, skipZeros bool) (int64, error) {
+	h := sha256.New()
+	buf := make([]byte, partitions.SparseBlockSize)
+	for pos <= c.end {
+		// reads stay within aligned blocks, so that blocks which contain only zeros can be skipped
+		n := min(partitions.SparseBlockSize-pos%partitions.SparseBlockSize, c.end-pos+1)
+		if _, err := io.ReadFull(body, buf[:n]); err != nil {
+			return pos, fmt.Errorf("%w: %w", errTransientChunkDownload, err)
+		}
+		b := buf[:n]
+		h.Write(b) //nolint: errcheck
+		if !skipZeros || !bytes.Equal(b, zeroBlock[:n]) {
+			if _, err := d.f.WriteAt(b, pos); err != nil {
+				return pos, fmt.Errorf("writing to '%s': %w", d.f.Name(), err)
+			}
+		}
+		pos += n
+		d.addProgress(n)
+	}
+	if digest != "" {
+		if err := verifyContentDigest(digest, h.Sum(nil)); err != nil {
+			return pos, fmt.Errorf("chunk %d-%d: %w", c.start, c.end, err)
+		}
+	}
+	return pos, nil
+}
+
+// addProgress reports the number of bytes which have been written so far. `n` is negative if a chunk
+// has to be downloaded again.
+func (d *chunkedDownload) addProgress(n int64) {
+	if d.o.progress == nil {
+		return
+	}
+	d.progressLock.Lock()
+	defer d.progressLock.Unlock()
+	d.written += n
+	d.o.progress(d.written, d.total)
+}
+
+// verifyContentDigest verifies `sum` against the sha-256 digest in the Content-Digest header value `header`.
+// Other digest algorithms are being ignored.
+func verifyContentDigest(header string, sum []byte) error {
+	for _, field := range strings.Split(header, ",") {
+		alg, value, ok := strings.Cut(strings.TrimSpace(field), "=")
+		if !ok || !strings.EqualFold(alg, "sha-256") {
+			continue
+		}
+		expected, err := base64.StdEncoding.DecodeString(strings.Trim(value, ":"))
+		if err != nil {
+			return fmt.Errorf("%w: invalid digest '%s': %w", ErrChunkDigestMismatch, value, err)
+		}
+		if !bytes.Equal(expected, sum) {
+			return fmt.Errorf("%w: expected %x, got %x", ErrChunkDigestMismatch, expected, sum)
+		}
+	}
+	return nil
+}
+
+// parseContentRange parses a Content-Range header value like "bytes 0-99/1000". `total` is -1 if the size
+// of the artifact is unknown.
+func parseContentRange(s string) (start int64, end int64, total int64, err error) {
+	rng, ok := strings.CutPrefix(s, "bytes ")
+	if !ok {
+		return 0, 0, 0, fmt.Errorf("%w: invalid content range '%s'", errNotChunkable, s)
+	}
+	rng, size, ok := strings.Cut(rng, "/")
+	if !ok {
+		return 0, 0, 0, fmt.Errorf("%w: invalid content range '%s'", errNotChunkable, s)
+	}
+	first, last, ok := strings.Cut(rng, "-")
+	if !ok {
+		return 0, 0, 0, fmt.Errorf("%w: invalid content range '%s'", errNotChunkable, s)
+	}
+	total = -1
+	if size != "*" {
+		if total, err = strconv.ParseInt(size, 10, 64); err != nil {
+			return 0, 0, 0, fmt.Errorf("%w: invalid content range '%s'", errNotChunkable, s)
+		}
+	}
+	if start, err = strconv.ParseInt(first, 10, 64); err != nil {
+		return 0, 0, 0, fmt.Errorf("%w: invalid content range '%s'", errNotChunkable, s)
+	}
+	if end, err = strconv.ParseInt(last, 10, 64); err != nil {
+		return 0, 0, 0, fmt.Errorf("%w: invalid content range '%s'", errNotChunkable, s)
+	}
+	if start < 0 || end < start || (total >= 0 && end >= total) {
+		return 0, 0, 0, fmt.Errorf("%w: invalid content range '%s'", errNotChunkable, s)
+	}
+	return start, end, total, nil
+}
+
+// isBlockDevice returns true if `f` is a block device. Block devices are never being written to in chunks, as
+// they cannot be truncated, and writing them out of order makes discards impossible.
+func isBlockDevice(f *os.File) bool {
+	fi, err := f.Stat()
+	if err != nil {
+		return false
+	}
+	return fi.Mode()&os.ModeDevice != 0 && fi.Mode()&os.ModeCharDevice == 0
+}
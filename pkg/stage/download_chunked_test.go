@@ -0,0 +1,215 @@
+// Copyright 2023 Hedgehog
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package stage
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// chunkServer serves `artifact` with range support. The first `cutBodies` range requests are aborted halfway through
+// their body, and the first `badDigests` range requests come with a wrong Content-Digest header. The entity tag
+// changes after the first request if `changeETag` is set.
+type chunkServer struct {
+	artifact   []byte
+	noRanges   bool
+	digests    bool
+	cutBodies  int32
+	badDigests int32
+	changeETag bool
+
+	requests       atomic.Int32
+	rangeRequests  atomic.Int32
+	cutRequests    atomic.Int32
+	digestRequests atomic.Int32
+}
+
+func (s *chunkServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	n := s.requests.Add(1)
+	w.Header().Set("Content-Type", "application/octet-stream")
+	if s.noRanges {
+		w.Write(s.artifact) //nolint: errcheck
+		return
+	}
+	etag := `"v1"`
+	if s.changeETag && n > 1 {
+		etag = `"v2"`
+	}
+	w.Header().Set("ETag", etag)
+	if rng := r.Header.Get("Range"); rng != "" {
+		s.rangeRequests.Add(1)
+		if s.digests {
+			start, end, _, _ := parseContentRange(strings.Replace(rng, "=", " ", 1) + "/*")
+			end = min(end, int64(len(s.artifact))-1)
+			sum := sha256.Sum256(s.artifact[start : end+1])
+			if s.digestRequests.Add(1) <= s.badDigests {
+				sum[0]++
+			}
+			w.Header().Set("Content-Digest", "sha-256=:"+base64.StdEncoding.EncodeToString(sum[:])+":")
+		}
+		if s.cutRequests.Add(1) <= s.cutBodies {
+			w = &cuttingResponseWriter{ResponseWriter: w, remaining: 1000}
+		}
+	}
+	http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(s.artifact))
+}
+
+// cuttingResponseWriter aborts the response after `remaining` bytes of the body
+type cuttingResponseWriter struct {
+	http.ResponseWriter
+	remaining int
+}
+
+func (w *cuttingResponseWriter) Write(b []byte) (int, error) {
+	if len(b) > w.remaining {
+		w.ResponseWriter.Write(b[:w.remaining]) //nolint: errcheck
+		w.ResponseWriter.(http.Flusher).Flush()
+		panic(http.ErrAbortHandler)
+	}
+	w.remaining -= len(b)
+	return w.ResponseWriter.Write(b)
+}
+
+func TestDownloadChunked(t *testing.T) {
+	old := chunkRetryDelay
+	chunkRetryDelay = time.Millisecond
+	t.Cleanup(func() { chunkRetryDelay = old })
+
+	// 5 chunks of 64KiB, and the third one only holds zeros
+	artifact := make([]byte, 300*1024)
+	if _, err := rand.Read(artifact); err != nil {
+		t.Fatal(err)
+	}
+	copy(artifact[128*1024:192*1024], make([]byte, 64*1024))
+
+	tests := []struct {
+		name              string
+		srv               *chunkServer
+		opts              []DownloadOption
+		wantErr           error
+		wantRangeRequests int32
+	}{
+		{
+			name:              "chunked",
+			srv:               &chunkServer{},
+			wantRangeRequests: 5,
+		},
+		{
+			name:              "chunked and sparse",
+			srv:               &chunkServer{digests: true},
+			opts:              []DownloadOption{DownloadOptionSparse(false)},
+			wantRangeRequests: 5,
+		},
+		{
+			name: "server without range support",
+			srv:  &chunkServer{noRanges: true},
+		},
+		{
+			name:              "resumes transient failures",
+			srv:               &chunkServer{cutBodies: 3},
+			wantRangeRequests: 8,
+		},
+		{
+			name:              "retries digest mismatches",
+			srv:               &chunkServer{digests: true, badDigests: 2},
+			wantRangeRequests: 7,
+		},
+		{
+			name:    "fails on persistent digest mismatches",
+			srv:     &chunkServer{digests: true, badDigests: 1000},
+			wantErr: ErrChunkDigestMismatch,
+		},
+		{
+			name:    "fails if the artifact changes",
+			srv:     &chunkServer{changeETag: true},
+			wantErr: ErrArtifactChanged,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.srv.artifact = artifact
+			srv := httptest.NewServer(tt.srv)
+			defer srv.Close()
+
+			var lastWritten atomic.Int64
+			opts := append([]DownloadOption{
+				DownloadOptionChunked(64*1024, 2),
+				DownloadOptionProgress(func(written int64, total int64) { lastWritten.Store(written) }),
+			}, tt.opts...)
+			dest := filepath.Join(t.TempDir(), "artifact")
+			err := Download(context.Background(), srv.Client(), srv.URL, dest, 0644, 10*time.Second, opts...)
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) {
+					t.Fatalf("Download() error = %v, want %v", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Download() error = %v", err)
+			}
+			got, err := os.ReadFile(dest)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, artifact) {
+				t.Errorf("Download() wrote %d bytes which do not match the artifact", len(got))
+			}
+			if n := tt.srv.rangeRequests.Load(); tt.wantRangeRequests != 0 && n != tt.wantRangeRequests {
+				t.Errorf("Download() sent %d range requests, want %d", n, tt.wantRangeRequests)
+			}
+			if n := lastWritten.Load(); n != int64(len(artifact)) {
+				t.Errorf("Download() reported %d bytes as written, want %d", n, len(artifact))
+			}
+		})
+	}
+}
+
+func TestParseContentRange(t *testing.T) {
+	tests := []struct {
+		in                          string
+		wantStart, wantEnd, wantTot int64
+		wantErr                     bool
+	}{
+		{in: "bytes 0-99/1000", wantStart: 0, wantEnd: 99, wantTot: 1000},
+		{in: "bytes 100-199/*", wantStart: 100, wantEnd: 199, wantTot: -1},
+		{in: "bytes 0-1000/1000", wantErr: true},
+		{in: "bytes 10-5/1000", wantErr: true},
+		{in: "bytes */1000", wantErr: true},
+		{in: "items 0-1/2", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			start, end, total, err := parseContentRange(tt.in)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseContentRange() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && (start != tt.wantStart || end != tt.wantEnd || total != tt.wantTot) {
+				t.Errorf("parseContentRange() = %d, %d, %d, want %d, %d, %d", start, end, total, tt.wantStart, tt.wantEnd, tt.wantTot)
+			}
+		})
+	}
+}
@@ -0,0 +1,282 @@
+// Copyright 2023 Hedgehog
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package stage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"go.githedgehog.com/dasboot/pkg/log"
+	"go.githedgehog.com/dasboot/pkg/version"
+	"go.uber.org/zap"
+)
+
+// DefaultDownloadParallelism is the number of artifacts which a `DownloadManager` downloads at the same time
+// if no parallelism was set
+const DefaultDownloadParallelism = 3
+
+// defaultProgressInterval is the interval in which a `DownloadManager` reports the progress of its downloads
+const defaultProgressInterval = 10 * time.Second
+
+var (
+	ErrDownloadFailed       = errors.New("stage: download failed")
+	ErrVerificationFailed   = errors.New("stage: digest verification failed")
+	ErrDuplicateDownloadJob = errors.New("stage: duplicate download job")
+)
+
+// DownloadJob is an artifact which is being downloaded by a `DownloadManager`
+type DownloadJob struct {
+	// Name identifies the artifact in results, progress reports and errors. It must be unique.
+	Name string
+
+	// URLs are the URLs of the artifact, the primary one first, followed by all of its mirrors
+	URLs []string
+
+	// DestPath is where the artifact is being downloaded to. It is always made executable.
+	DestPath string
+
+	// Timeout is the timeout of every download attempt
+	Timeout time.Duration
+
+	// Pin is verified once all downloads completed if it is set
+	Pin *version.ArtifactPin
+
+	// Options are passed to every download attempt
+	Options []DownloadOption
+}
+
+// DownloadResult is the result of a `DownloadJob`
+type DownloadResult struct {
+	Name     string
+	URL      string
+	Path     string
+	Duration time.Duration
+	Err      error
+}
+
+// ArtifactProgress is the progress of a single download
+type ArtifactProgress struct {
+	Written int64 `json:"written"`
+	Total   int64 `json:"total"`
+	Done    bool  `json:"done"`
+}
+
+// DownloadProgress is the combined progress of all downloads of a `DownloadManager`
+type DownloadProgress struct {
+	Artifacts map[string]ArtifactProgress `json:"artifacts"`
+
+	// Written is the number of bytes which have been written for all artifacts
+	Written int64 `json:"written"`
+
+	// Total is the combined size of all artifacts, or -1 as long as the size of any of them is unknown
+	Total int64 `json:"total"`
+}
+
+// DownloadManagerOption is an option which can be passed to `NewDownloadManager`
+type DownloadManagerOption func(*DownloadManager)
+
+// DownloadManagerOptionProgress calls `f` with the combined progress of all downloads every `interval`, and
+// once more when all downloads completed.
+func DownloadManagerOptionProgress(interval time.Duration, f func(DownloadProgress)) DownloadManagerOption {
+	return func(m *DownloadManager) {
+		m.progressInterval = interval
+		m.progressFunc = f
+	}
+}
+
+// DownloadManager downloads independent artifacts concurrently, and verifies all of their digests at the end
+type DownloadManager struct {
+	hc               *http.Client
+	parallelism      int
+	progressInterval time.Duration
+	progressFunc     func(DownloadProgress)
+
+	progressLock sync.Mutex
+	progress     map[string]ArtifactProgress
+}
+
+// NewDownloadManager creates a download manager which downloads at most `parallelism` artifacts at the same time.
+// If `parallelism` is not positive, `DefaultDownloadParallelism` is being used.
+func NewDownloadManager(hc *http.Client, parallelism int, opts ...DownloadManagerOption) *DownloadManager {
+	if parallelism <= 0 {
+		parallelism = DefaultDownloadParallelism
+	}
+	m := &DownloadManager{
+		hc:               hc,
+		parallelism:      parallelism,
+		progressInterval: defaultProgressInterval,
+	}
+	for _, opt := range opts {
+		opt(m)
+	}
+	return m
+}
+
+// Run downloads all `jobs` and returns their results in the same order. As soon as one download fails, all other
+// downloads are being canceled. Once all downloads succeeded, the digests of all artifacts are verified against
+// their pins, and all mismatches are returned together.
+func (m *DownloadManager) Run(ctx context.Context, jobs []DownloadJob) ([]DownloadResult, error) {
+	m.progress = make(map[string]ArtifactProgress, len(jobs))
+	for _, job := range jobs {
+		if _, ok := m.progress[job.Name]; ok {
+			return nil, fmt.Errorf("%w: %s", ErrDuplicateDownloadJob, job.Name)
+		}
+		m.progress[job.Name] = ArtifactProgress{Total: -1}
+	}
+
+	// report the progress periodically until all downloads are done
+	stopReporting := m.startReporting()
+	results := m.download(ctx, jobs)
+	stopReporting()
+
+	var errs []error
+	for _, res := range results {
+		if res.Err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", res.Name, res.Err))
+		}
+	}
+	if len(errs) > 0 {
+		return results, fmt.Errorf("%w: %w", ErrDownloadFailed, errors.Join(errs...))
+	}
+
+	// the digests are only verified once all artifacts are there, so that a single error reports all mismatches
+	for i, job := range jobs {
+		if err := VerifyArtifactPin(job.DestPath, job.Pin); err != nil {
+			results[i].Err = err
+			errs = append(errs, fmt.Errorf("%s: %w", job.Name, err))
+		}
+	}
+	if len(errs) > 0 {
+		return results, fmt.Errorf("%w: %w", ErrVerificationFailed, errors.Join(errs...))
+	}
+	return results, nil
+}
+
+func (m *DownloadManager) download(ctx context.Context, jobs []DownloadJob) []DownloadResult {
+	// the first failure cancels all other downloads
+	subctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	results := make([]DownloadResult, len(jobs))
+	sem := make(chan struct{}, m.parallelism)
+	var wg sync.WaitGroup
+	var failedLock sync.Mutex
+	failed := false
+	for i, job := range jobs {
+		wg.Add(1)
+		go func(i int, job DownloadJob) {
+			defer wg.Done()
+			results[i] = DownloadResult{Name: job.Name, Path: job.DestPath}
+			select {
+			case sem <- struct{}{}:
+			case <-subctx.Done():
+				// this is only an error if the caller canceled the downloads, and not another failure
+				results[i].Err = ctx.Err()
+				return
+			}
+			defer func() { <-sem }()
+
+			start := time.Now()
+			opts := append(append([]DownloadOption{}, job.Options...), DownloadOptionProgress(func(written int64, total int64) {
+				m.setProgress(job.Name, ArtifactProgress{Written: written, Total: total})
+			}))
+			url, err := DownloadExecutableFromMirrors(subctx, m.hc, job.URLs, job.DestPath, job.Timeout, opts...)
+			results[i].URL = url
+			results[i].Duration = time.Since(start)
+			if err != nil {
+				failedLock.Lock()
+				defer failedLock.Unlock()
+				// downloads which were only canceled because of another failure are not failures on their own
+				if failed && ctx.Err() == nil && errors.Is(err, context.Canceled) {
+					return
+				}
+				failed = true
+				results[i].Err = err
+				cancel()
+				return
+			}
+			m.setDone(job.Name)
+		}(i, job)
+	}
+	wg.Wait()
+	return results
+}
+
+func (m *DownloadManager) setProgress(name string, p ArtifactProgress) {
+	m.progressLock.Lock()
+	defer m.progressLock.Unlock()
+	m.progress[name] = p
+}
+
+func (m *DownloadManager) setDone(name string) {
+	m.progressLock.Lock()
+	defer m.progressLock.Unlock()
+	p := m.progress[name]
+	p.Done = true
+	m.progress[name] = p
+}
+
+// Progress returns the combined progress of all downloads
+func (m *DownloadManager) Progress() DownloadProgress {
+	m.progressLock.Lock()
+	defer m.progressLock.Unlock()
+	ret := DownloadProgress{
+		Artifacts: make(map[string]ArtifactProgress, len(m.progress)),
+	}
+	for name, p := range m.progress {
+		ret.Artifacts[name] = p
+		ret.Written += p.Written
+		if p.Total < 0 || ret.Total < 0 {
+			ret.Total = -1
+		} else {
+			ret.Total += p.Total
+		}
+	}
+	return ret
+}
+
+func (m *DownloadManager) startReporting() func() {
+	f := m.progressFunc
+	if f == nil {
+		l := log.L()
+		f = func(p DownloadProgress) {
+			l.Info("Download progress", zap.Int64("written", p.Written), zap.Int64("total", p.Total), zap.Reflect("artifacts", p.Artifacts))
+		}
+	}
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		ticker := time.NewTicker(m.progressInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				f(m.Progress())
+				return
+			case <-ticker.C:
+				f(m.Progress())
+			}
+		}
+	}()
+	return func() {
+		close(done)
+		<-stopped
+	}
+}
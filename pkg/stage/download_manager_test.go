@@ -0,0 +1,165 @@
+// Copyright 2023 Hedgehog
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package stage
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"go.githedgehog.com/dasboot/pkg/version"
+)
+
+func TestDownloadManager(t *testing.T) {
+	var lock sync.Mutex
+	var inFlight, maxInFlight int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/broken" {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusNotFound)
+			_, _ = w.Write([]byte(`{"reason":"not found"}`))
+			return
+		}
+		lock.Lock()
+		inFlight++
+		if inFlight > maxInFlight {
+			maxInFlight = inFlight
+		}
+		lock.Unlock()
+		time.Sleep(50 * time.Millisecond)
+		lock.Lock()
+		inFlight--
+		lock.Unlock()
+		w.Header().Set("Content-Type", "application/octet-stream")
+		_, _ = w.Write([]byte("artifact " + r.URL.Path))
+	}))
+	defer srv.Close()
+
+	pin := func(path string) *version.ArtifactPin {
+		content := "artifact " + path
+		digest := sha256.Sum256([]byte(content))
+		return &version.ArtifactPin{Digest: "sha256:" + hex.EncodeToString(digest[:]), Size: int64(len(content))}
+	}
+
+	tests := []struct {
+		name            string
+		parallelism     int
+		paths           []string
+		pins            map[string]*version.ArtifactPin
+		wantErr         error
+		wantErrContains []string
+		wantMaxInFlight int
+	}{
+		{
+			name:            "downloads respect the parallelism",
+			parallelism:     2,
+			paths:           []string{"/nos", "/agent", "/hooks", "/other"},
+			pins:            map[string]*version.ArtifactPin{"/nos": pin("/nos"), "/agent": pin("/agent")},
+			wantMaxInFlight: 2,
+		},
+		{
+			name:            "sequential downloads",
+			parallelism:     1,
+			paths:           []string{"/nos", "/agent"},
+			wantMaxInFlight: 1,
+		},
+		{
+			name:            "all digest mismatches are reported together",
+			paths:           []string{"/nos", "/agent", "/hooks"},
+			pins:            map[string]*version.ArtifactPin{"/nos": pin("/agent"), "/agent": pin("/nos"), "/hooks": pin("/hooks")},
+			wantErr:         ErrVerificationFailed,
+			wantErrContains: []string{"/nos", "/agent"},
+		},
+		{
+			name:            "a failed download fails all downloads",
+			paths:           []string{"/nos", "/broken"},
+			wantErr:         ErrDownloadFailed,
+			wantErrContains: []string{"/broken"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			maxInFlight = 0
+			dir := t.TempDir()
+			jobs := make([]DownloadJob, 0, len(tt.paths))
+			for _, p := range tt.paths {
+				jobs = append(jobs, DownloadJob{
+					Name:     p,
+					URLs:     []string{srv.URL + p},
+					DestPath: filepath.Join(dir, filepath.Base(p)),
+					Timeout:  time.Second * 10,
+					Pin:      tt.pins[p],
+				})
+			}
+
+			var final DownloadProgress
+			dm := NewDownloadManager(srv.Client(), tt.parallelism, DownloadManagerOptionProgress(time.Hour, func(p DownloadProgress) {
+				final = p
+			}))
+			results, err := dm.Run(context.Background(), jobs)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("DownloadManager.Run() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			for _, s := range tt.wantErrContains {
+				if !strings.Contains(err.Error(), s) {
+					t.Errorf("DownloadManager.Run() error = %v, want it to contain %s", err, s)
+				}
+			}
+			if len(results) != len(jobs) {
+				t.Fatalf("DownloadManager.Run() returned %d results, want %d", len(results), len(jobs))
+			}
+			if tt.wantErr != nil {
+				return
+			}
+
+			if maxInFlight != tt.wantMaxInFlight {
+				t.Errorf("DownloadManager.Run() had %d downloads in flight, want %d", maxInFlight, tt.wantMaxInFlight)
+			}
+			var wantWritten int64
+			for i, p := range tt.paths {
+				if results[i].Name != p || results[i].URL != srv.URL+p || results[i].Err != nil {
+					t.Errorf("DownloadManager.Run() result = %#v", results[i])
+				}
+				b, err := os.ReadFile(results[i].Path)
+				if err != nil || string(b) != "artifact "+p {
+					t.Errorf("downloaded artifact = %q, %v", b, err)
+				}
+				wantWritten += int64(len(b))
+				if !final.Artifacts[p].Done {
+					t.Errorf("progress of %s is not done: %#v", p, final.Artifacts[p])
+				}
+			}
+			if final.Written != wantWritten || final.Total != wantWritten {
+				t.Errorf("final progress = %d/%d, want %d", final.Written, final.Total, wantWritten)
+			}
+		})
+	}
+
+	t.Run("duplicate jobs", func(t *testing.T) {
+		jobs := []DownloadJob{{Name: "nos"}, {Name: "nos"}}
+		if _, err := NewDownloadManager(srv.Client(), 0).Run(context.Background(), jobs); !errors.Is(err, ErrDuplicateDownloadJob) {
+			t.Errorf("DownloadManager.Run() error = %v, want %v", err, ErrDuplicateDownloadJob)
+		}
+	})
+}
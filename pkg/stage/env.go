@@ -25,9 +25,15 @@ import (
 	"io"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
 
+	"github.com/google/uuid"
 	"go.githedgehog.com/dasboot/pkg/devid"
+	"go.githedgehog.com/dasboot/pkg/log"
+	"go.githedgehog.com/dasboot/pkg/net"
+	onieurl "go.githedgehog.com/dasboot/pkg/net/url"
+	"go.githedgehog.com/dasboot/pkg/partitions"
 	"go.githedgehog.com/dasboot/pkg/partitions/location"
 	"go.githedgehog.com/dasboot/pkg/stage0/config"
 )
@@ -62,6 +68,12 @@ type OnieEnv struct {
 	Machine         string
 }
 
+const defaultMachineConfPath = "/etc/machine.conf"
+
+// EnvNameMachineConf is the environment variable which overrides the path of the ONIE machine.conf. This is
+// meant for tests and local development outside of ONIE only.
+const EnvNameMachineConf = "dasboot_onie_machine_conf"
+
 // GetOnieEnv returns the set of ONIE environment variables that *should* always
 // bet in any running ONIE installer
 func GetOnieEnv() *OnieEnv {
@@ -79,7 +91,11 @@ func GetOnieEnv() *OnieEnv {
 
 	// if we fail to read the machine.conf file
 	// we'll return with this only though
-	machineConfBytes, err := readFile("/etc/machine.conf")
+	machineConfPath := defaultMachineConfPath
+	if p := os.Getenv(EnvNameMachineConf); p != "" {
+		machineConfPath = p
+	}
+	machineConfBytes, err := readFile(machineConfPath)
 	if err != nil {
 		return ret
 	}
@@ -146,6 +162,16 @@ func GetOnieEnv() *OnieEnv {
 	return ret
 }
 
+// ParseExecURL parses the URL from which ONIE downloaded and executed the installer. ONIE can
+// provide broken URLs for IPv6 link-local hosts, which is why this uses the ONIE URL parser.
+// The zone of a link-local host is the network interface which ONIE used for the download.
+func (e *OnieEnv) ParseExecURL() (*onieurl.URL, error) {
+	if e.ExecURL == "" {
+		return nil, valueNotSetError("onie_exec_url")
+	}
+	return onieurl.ParseONIE(e.ExecURL)
+}
+
 type StagingInfo struct {
 	StagingDir        string
 	ServerCA          []byte
@@ -154,6 +180,18 @@ type StagingInfo struct {
 	OnieHeaders       *config.OnieHeaders
 	LocationInfo      *location.Info
 	DeviceID          string
+	MTU               int
+	Proxy             *config.Proxy
+	RequireProvenance bool
+	RequireManifest   bool
+	MultipathPolicy   partitions.MultipathPolicy
+	DiskSelection     *partitions.DiskSelectionPolicy
+
+	// Neighbors are the LLDP neighbours which stage 0 discovered. They are optional.
+	Neighbors []*net.LLDPNeighbor
+
+	// InstallSessionID identifies a single installation across all stages. It is generated by stage 0.
+	InstallSessionID string
 }
 
 const (
@@ -164,6 +202,14 @@ const (
 	envNameOnieHeaders       = "dasboot_onie_headers"
 	envNameLocationInfo      = "dasboot_location_info"
 	envNameDeviceID          = "dasboot_hhdevid"
+	envNameMTU               = "dasboot_mtu"
+	envNameProxy             = "dasboot_proxy"
+	envNameRequireProvenance = "dasboot_require_provenance"
+	envNameRequireManifest   = "dasboot_require_manifest"
+	envNameInstallSessionID  = "dasboot_install_session"
+	envNameMultipathPolicy   = "dasboot_multipath_policy"
+	envNameDiskSelection     = "dasboot_disk_selection"
+	envNameNeighbors         = "dasboot_neighbors"
 	pathServerCA             = "server-ca.der"
 	pathConfigSignatureCA    = "config-signature-ca.der"
 	pathLogSettings          = "log-settings.json"
@@ -281,6 +327,58 @@ func (si *StagingInfo) Export() error {
 			return fmt.Errorf("failed to set '%s' environment variable: %w", envNameDeviceID, err)
 		}
 	}
+	if si.MTU > 0 {
+		if err := os.Setenv(envNameMTU, strconv.Itoa(si.MTU)); err != nil {
+			return fmt.Errorf("failed to set '%s' environment variable: %w", envNameMTU, err)
+		}
+	}
+	if si.Proxy != nil {
+		proxyBytes, err := json.Marshal(si.Proxy)
+		if err != nil {
+			return fmt.Errorf("failed to JSON encode proxy settings: %w", err)
+		}
+		if err := os.Setenv(envNameProxy, string(proxyBytes)); err != nil {
+			return fmt.Errorf("failed to set '%s' environment variable: %w", envNameProxy, err)
+		}
+	}
+	if si.RequireProvenance {
+		if err := os.Setenv(envNameRequireProvenance, strconv.FormatBool(si.RequireProvenance)); err != nil {
+			return fmt.Errorf("failed to set '%s' environment variable: %w", envNameRequireProvenance, err)
+		}
+	}
+	if si.RequireManifest {
+		if err := os.Setenv(envNameRequireManifest, strconv.FormatBool(si.RequireManifest)); err != nil {
+			return fmt.Errorf("failed to set '%s' environment variable: %w", envNameRequireManifest, err)
+		}
+	}
+	if si.MultipathPolicy != "" {
+		if err := os.Setenv(envNameMultipathPolicy, string(si.MultipathPolicy)); err != nil {
+			return fmt.Errorf("failed to set '%s' environment variable: %w", envNameMultipathPolicy, err)
+		}
+	}
+	if si.DiskSelection != nil {
+		diskSelectionBytes, err := json.Marshal(si.DiskSelection)
+		if err != nil {
+			return fmt.Errorf("failed to JSON encode disk selection policy: %w", err)
+		}
+		if err := os.Setenv(envNameDiskSelection, string(diskSelectionBytes)); err != nil {
+			return fmt.Errorf("failed to set '%s' environment variable: %w", envNameDiskSelection, err)
+		}
+	}
+	if len(si.Neighbors) > 0 {
+		neighborsBytes, err := json.Marshal(si.Neighbors)
+		if err != nil {
+			return fmt.Errorf("failed to JSON encode LLDP neighbors: %w", err)
+		}
+		if err := os.Setenv(envNameNeighbors, string(neighborsBytes)); err != nil {
+			return fmt.Errorf("failed to set '%s' environment variable: %w", envNameNeighbors, err)
+		}
+	}
+	if si.InstallSessionID != "" {
+		if err := os.Setenv(envNameInstallSessionID, si.InstallSessionID); err != nil {
+			return fmt.Errorf("failed to set '%s' environment variable: %w", envNameInstallSessionID, err)
+		}
+	}
 
 	return nil
 }
@@ -431,9 +529,94 @@ func ReadStagingInfo() (*StagingInfo, error) {
 		}
 	}
 
+	// the MTU is optional, so we only parse it if it is set
+	if mtuString, ok := os.LookupEnv(envNameMTU); ok && mtuString != "" {
+		var err error
+		ret.MTU, err = strconv.Atoi(mtuString)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse MTU from environment variable '%s' (value: '%s'): %w", envNameMTU, mtuString, err)
+		}
+	}
+
+	// the proxy settings are optional, so we only parse them if they are set
+	if proxyJSONString, ok := os.LookupEnv(envNameProxy); ok && proxyJSONString != "" {
+		var proxy config.Proxy
+		if err := json.Unmarshal([]byte(proxyJSONString), &proxy); err != nil {
+			return nil, fmt.Errorf("failed to JSON decode proxy settings from environment variable '%s' (value: '%s'): %w", envNameProxy, proxyJSONString, err)
+		}
+		ret.Proxy = &proxy
+	}
+
+	// the provenance policy is optional, so we only parse it if it is set
+	if requireProvenanceString, ok := os.LookupEnv(envNameRequireProvenance); ok && requireProvenanceString != "" {
+		var err error
+		ret.RequireProvenance, err = strconv.ParseBool(requireProvenanceString)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse provenance policy from environment variable '%s' (value: '%s'): %w", envNameRequireProvenance, requireProvenanceString, err)
+		}
+	}
+
+	// and so is the manifest policy
+	if requireManifestString, ok := os.LookupEnv(envNameRequireManifest); ok && requireManifestString != "" {
+		var err error
+		ret.RequireManifest, err = strconv.ParseBool(requireManifestString)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse manifest policy from environment variable '%s' (value: '%s'): %w", envNameRequireManifest, requireManifestString, err)
+		}
+	}
+
+	// the multipath policy is optional, and the default policy is being used if it is not set
+	if multipathPolicyString := os.Getenv(envNameMultipathPolicy); multipathPolicyString != "" {
+		var err error
+		ret.MultipathPolicy, err = partitions.ParseMultipathPolicy(multipathPolicyString)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse multipath policy from environment variable '%s': %w", envNameMultipathPolicy, err)
+		}
+	}
+
+	// the disk selection policy is optional, the disk holding the ONIE partition is being used if it is not set
+	if diskSelectionJSONString, ok := os.LookupEnv(envNameDiskSelection); ok && diskSelectionJSONString != "" {
+		var p partitions.DiskSelectionPolicy
+		if err := json.Unmarshal([]byte(diskSelectionJSONString), &p); err != nil {
+			return nil, fmt.Errorf("failed to JSON decode disk selection policy from environment variable '%s' (value: '%s'): %w", envNameDiskSelection, diskSelectionJSONString, err)
+		}
+		if err := p.Validate(); err != nil {
+			return nil, fmt.Errorf("invalid disk selection policy in environment variable '%s': %w", envNameDiskSelection, err)
+		}
+		ret.DiskSelection = &p
+	}
+
+	// the LLDP neighbors are optional, so we only parse them if they are set
+	if neighborsJSONString, ok := os.LookupEnv(envNameNeighbors); ok && neighborsJSONString != "" {
+		if err := json.Unmarshal([]byte(neighborsJSONString), &ret.Neighbors); err != nil {
+			return nil, fmt.Errorf("failed to JSON decode LLDP neighbors from environment variable '%s' (value: '%s'): %w", envNameNeighbors, neighborsJSONString, err)
+		}
+	}
+
+	// a stage which was started manually starts a new install session
+	ret.InstallSessionID = os.Getenv(envNameInstallSessionID)
+	if ret.InstallSessionID == "" {
+		ret.InstallSessionID = NewInstallSessionID()
+	}
+
 	return ret, nil
 }
 
+// NewInstallSessionID generates a new ID for an installation
+func NewInstallSessionID() string {
+	return uuid.NewString()
+}
+
+// Correlation returns the fields with which the log messages of the stage `stageName` are correlated with all
+// other stages of the same installation
+func (si *StagingInfo) Correlation(stageName string) log.Correlation {
+	return log.Correlation{
+		DeviceID:       si.DeviceID,
+		Stage:          stageName,
+		InstallSession: si.InstallSessionID,
+	}
+}
+
 func readFile(path string) ([]byte, error) {
 	f, err := os.Open(path)
 	if err != nil {
@@ -451,12 +634,14 @@ func valueNotSetError(s string) error {
 
 func (si *StagingInfo) ServerCAPool() (*x509.CertPool, error) {
 	if si != nil && len(si.ServerCA) > 0 {
-		cert, err := x509.ParseCertificate(si.ServerCA)
+		certs, err := x509.ParseCertificates(si.ServerCA)
 		if err != nil {
 			return nil, fmt.Errorf("staging info: parsing Server CA certificate: %w", err)
 		}
 		ret := x509.NewCertPool()
-		ret.AddCert(cert)
+		for _, cert := range certs {
+			ret.AddCert(cert)
+		}
 		return ret, nil
 	}
 	return nil, valueNotSetError("ServerCA")
@@ -474,3 +659,21 @@ func (si *StagingInfo) ConfigSignatureCAPool() (*x509.CertPool, error) {
 	}
 	return nil, valueNotSetError("ConfigSignatureCA")
 }
+
+// ArtifactDownloadOptions returns the download options which must be used for downloading
+// artifacts from the seeder. If the provenance policy requires it, these ensure that the
+// artifact provenance gets verified against the config signature CA.
+func (si *StagingInfo) ArtifactDownloadOptions() ([]DownloadOption, error) {
+	if si == nil || !si.RequireProvenance {
+		return nil, nil
+	}
+	pool, err := si.ConfigSignatureCAPool()
+	if err != nil {
+		return nil, fmt.Errorf("artifact provenance required: %w", err)
+	}
+	ret := []DownloadOption{DownloadOptionRequireProvenance(pool)}
+	if si.RequireManifest {
+		ret = append(ret, DownloadOptionRequireManifest())
+	}
+	return ret, nil
+}
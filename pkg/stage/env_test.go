@@ -0,0 +1,57 @@
+// Copyright 2023 Hedgehog
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package stage
+
+import (
+	"testing"
+
+	"go.githedgehog.com/dasboot/test/fakeonie"
+)
+
+func TestGetOnieEnv(t *testing.T) {
+	fake := fakeonie.Default()
+	fake.Platform = "arm64-vendor_switch-r1"
+	fake.Arch = "arm64"
+	fakeonie.Setup(t, fake)
+
+	got := GetOnieEnv()
+	want := &OnieEnv{
+		BootReason:    fake.BootReason,
+		ExecURL:       fake.ExecURL,
+		Platform:      fake.Platform,
+		VendorID:      fake.VendorID,
+		SerialNum:     fake.SerialNum,
+		EthAddr:       fake.EthAddr,
+		Version:       fake.Version,
+		Machine:       fake.Machine,
+		MachineRev:    fake.MachineRev,
+		Arch:          fake.Arch,
+		BuildDate:     fake.BuildDate,
+		PartitionType: fake.PartitionType,
+		Firmware:      fake.Firmware,
+		SwitchAsic:    fake.SwitchAsic,
+	}
+	if *got != *want {
+		t.Errorf("GetOnieEnv() = %#v, want %#v", got, want)
+	}
+
+	u, err := got.ParseExecURL()
+	if err != nil {
+		t.Fatalf("ParseExecURL() error = %v", err)
+	}
+	if u.Zone() != "eth0" {
+		t.Errorf("ParseExecURL() zone = %s, want eth0", u.Zone())
+	}
+}
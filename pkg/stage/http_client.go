@@ -18,11 +18,15 @@ import (
 	"crypto/rand"
 	"crypto/tls"
 	"crypto/x509"
+	"errors"
 	"net"
 	"net/http"
+	"os"
 	"time"
 
+	"go.githedgehog.com/dasboot/pkg/log"
 	"go.githedgehog.com/dasboot/pkg/partitions/identity"
+	"go.uber.org/zap"
 )
 
 type HTTPClientOption int
@@ -37,18 +41,17 @@ const (
 	// circumstances when we cannot trust our own system clock which is the case before
 	// we have applied time from NTP servers.
 	HTTPClientOptionServerCertificateIgnoreExpiryTime
+
+	// HTTPClientOptionLabMode allows to build a client without a server CA. This must only be used if the
+	// embedded configuration of a stage says that the seeder runs in its insecure lab mode, in which it
+	// serves everything over plain HTTP.
+	HTTPClientOptionLabMode
 )
 
-// SeederHTTPClient will create an HTTP client which can be used in interaction with the seeder
+// SeederHTTPClient will create an HTTP client which can be used in interaction with the seeder.
+// `serverCA` can hold multiple concatenated DER encoded certificates, which is needed during a
+// rotation of the server CA when the seeder presents certificates of either CA.
 func SeederHTTPClient(serverCA []byte, ip identity.IdentityPartition, options ...HTTPClientOption) (*http.Client, error) {
-	// server CA
-	serverCACert, err := x509.ParseCertificate(serverCA)
-	if err != nil {
-		return nil, err
-	}
-	serverCAPool := x509.NewCertPool()
-	serverCAPool.AddCert(serverCACert)
-
 	// build client certificates
 	clientCertificates := []tls.Certificate{}
 	if ip != nil && ip.HasClientKey() && ip.HasClientCert() {
@@ -63,14 +66,31 @@ func SeederHTTPClient(serverCA []byte, ip identity.IdentityPartition, options ..
 	rand := rand.Reader
 
 	// process options
-	var ignoreExpiry bool
+	var ignoreExpiry, labMode bool
 	for _, option := range options {
-		if option == HTTPClientOptionServerCertificateIgnoreExpiryTime {
+		switch option { //nolint:exhaustive
+		case HTTPClientOptionServerCertificateIgnoreExpiryTime:
 			ignoreExpiry = true
-			break
+		case HTTPClientOptionLabMode:
+			labMode = true
 		}
 	}
 
+	// server CAs
+	serverCACerts, err := x509.ParseCertificates(serverCA)
+	if err != nil {
+		return nil, err
+	}
+	var serverCAPool *x509.CertPool
+	if len(serverCACerts) > 0 {
+		serverCAPool = x509.NewCertPool()
+		for _, serverCACert := range serverCACerts {
+			serverCAPool.AddCert(serverCACert)
+		}
+	} else if !labMode {
+		return nil, valueNotSetError("server CA")
+	}
+
 	timeFunc := time.Now
 	if ignoreExpiry { //nolint:staticcheck
 		// TODO: we haven't seen a server certificate yet at this point
@@ -84,7 +104,7 @@ func SeederHTTPClient(serverCA []byte, ip identity.IdentityPartition, options ..
 		// Timeout: time.Second * 90,
 
 		Transport: &http.Transport{
-			// disable any proxies specifically here
+			// disable any proxies by default, they must be configured explicitly with WithProxy
 			Proxy: nil,
 
 			// There are no connection timeouts
@@ -129,3 +149,50 @@ func SeederHTTPClient(serverCA []byte, ip identity.IdentityPartition, options ..
 		},
 	}, nil
 }
+
+// SeederHTTPClient builds an HTTP client for the interaction with the seeder from the staging info.
+// This is the way how every stage after stage 0 should construct its clients, so that they all
+// behave the same:
+// - the server CA from stage 0 is used to verify the seeder, unless a CA bundle was pinned
+// - the client authenticates with the identity partition client certificate if `ip` is not nil
+// - TLS sessions get resumed across stages by using the cache in the staging directory
+// - the proxy settings from stage 0 are applied
+// - responses must be signed if `signatureCA` is not nil
+func (si *StagingInfo) SeederHTTPClient(ip identity.IdentityPartition, signatureCA *x509.CertPool, options ...HTTPClientOption) (*http.Client, error) {
+	if si == nil {
+		return nil, valueNotSetError("StagingInfo")
+	}
+	l := log.L()
+	serverCA := si.ServerCA
+	if si.StagingDir != "" {
+		bundle, err := LoadCABundle(CABundlePath(si.StagingDir))
+		if err == nil {
+			serverCA = bundle.DER()
+		} else if !errors.Is(err, os.ErrNotExist) {
+			l.Warn("Ignoring invalid pinned CA bundle, using server CA from stage 0", zap.Error(err))
+		}
+	}
+	hc, err := SeederHTTPClient(serverCA, ip, options...)
+	if err != nil {
+		return nil, err
+	}
+	if si.StagingDir != "" {
+		if _, err := WithTLSSessionCache(hc, TLSSessionCachePath(si.StagingDir)); err != nil {
+			l.Warn("Failed to enable TLS session cache, TLS sessions will not be resumed", zap.Error(err))
+		}
+	}
+	if _, err := WithProxy(hc, si.Proxy); err != nil {
+		l.Warn("Invalid HTTP proxy settings, not using any proxy", zap.Reflect("proxy", si.Proxy), zap.Error(err))
+	}
+	return WithResponseSignatureVerification(hc, signatureCA), nil
+}
+
+// LabModeOptions returns the HTTP client options for a stage whose embedded configuration has lab mode set to
+// `labMode`. As nothing which a stage does can be trusted in lab mode, it warns loudly about it.
+func LabModeOptions(labMode bool) []HTTPClientOption {
+	if !labMode {
+		return nil
+	}
+	log.L().Warn("INSECURE LAB MODE: the seeder is neither authenticated nor are the connections to it encrypted. This must never be used outside of throwaway lab environments!")
+	return []HTTPClientOption{HTTPClientOptionLabMode}
+}
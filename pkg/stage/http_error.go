@@ -16,8 +16,11 @@ package stage
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
+	"strconv"
+	"time"
 )
 
 // HTTPError is the error structure as it is always being returned for any unsuccessful HTTP requests
@@ -26,6 +29,13 @@ type HTTPError struct {
 	StatusCode int    `json:"-"`
 	ReqID      string `json:"request_id,omitempty"`
 	Err        string `json:"error"`
+
+	// Deferred is set by the seeder if the request was valid, but must be retried later,
+	// e.g. because the device is outside of its maintenance window
+	Deferred bool `json:"deferred,omitempty"`
+
+	// RetryAfter is the number of seconds after which a deferred request should be retried
+	RetryAfter int64 `json:"retry_after,omitempty"`
 }
 
 // Error implements error
@@ -58,10 +68,23 @@ func NewHTTPErrorFromBody(resp *http.Response) error {
 	if v.ReqID == "" {
 		v.ReqID = reqID
 	}
+	if v.RetryAfter == 0 {
+		v.RetryAfter, _ = strconv.ParseInt(resp.Header.Get("Retry-After"), 10, 64)
+	}
 	v.StatusCode = resp.StatusCode
 	return &v
 }
 
+// IsDeferred returns true if `err` is a deferral of the request by the seeder together with the duration
+// after which the request should be retried
+func IsDeferred(err error) (time.Duration, bool) {
+	var httpErr *HTTPError
+	if !errors.As(err, &httpErr) || !httpErr.Deferred {
+		return 0, false
+	}
+	return time.Duration(httpErr.RetryAfter) * time.Second, true
+}
+
 func NewHTTPErrorf(resp *http.Response, format string, args ...any) error {
 	reqID := "<unknown>"
 	if headerReqID := resp.Header.Get("Request-ID"); headerReqID != "" {
@@ -0,0 +1,222 @@
+// Copyright 2023 Hedgehog
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package stage
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os/exec"
+	"path"
+	"sync"
+	"time"
+
+	"go.githedgehog.com/dasboot/pkg/log"
+	"go.uber.org/zap"
+)
+
+// ExitCodeCancelled is the exit code of a stage binary which aborted an installation because the seeder cancelled
+// it. It corresponds to EX_TEMPFAIL from sysexits.h as the installation can be retried once the cancellation is lifted.
+const ExitCodeCancelled = 75
+
+// QueryInstallSession is the query parameter with which stages pass their install session to the seeder
+const QueryInstallSession = "session"
+
+var ErrInstallCancelled = errors.New("stage: installation cancelled by seeder")
+
+// InstallCancellation is the answer of the seeder to a stage which asks if its installation was cancelled
+type InstallCancellation struct {
+	Cancelled bool   `json:"cancelled"`
+	Reason    string `json:"reason,omitempty"`
+}
+
+// InstallCancellationReport is what a stage reports to the seeder once it aborted a cancelled installation
+type InstallCancellationReport struct {
+	InstallSession string `json:"install_session"`
+	Stage          string `json:"stage"`
+	Checkpoint     string `json:"checkpoint"`
+}
+
+// these can be swapped out for testing
+var (
+	cancellationPollInterval = 30 * time.Second
+	cancellationTimeout      = 10 * time.Second
+)
+
+// IsCancelledExit returns true if `err` is the exit of a stage binary which aborted a cancelled installation
+func IsCancelledExit(err error) bool {
+	var exitErr *exec.ExitError
+	return errors.As(err, &exitErr) && exitErr.ExitCode() == ExitCodeCancelled
+}
+
+// CancellationWatcher learns from the seeder if the installation got cancelled by an operator. It polls the seeder in
+// the background while it is being watched, and it checks again at every safe checkpoint. A nil watcher never
+// reports a cancellation, so stages can use it unconditionally.
+type CancellationWatcher struct {
+	hc      *http.Client
+	url     string
+	session string
+	stage   string
+
+	lock      sync.Mutex
+	cancelled *InstallCancellation
+	done      chan struct{}
+}
+
+// NewCancellationWatcher creates a watcher for the install session `session` of the device `devid` which asks the
+// seeder at `baseURL`. It returns nil if `baseURL` is empty.
+func NewCancellationWatcher(hc *http.Client, baseURL string, devid string, session string, stage string) (*CancellationWatcher, error) {
+	if baseURL == "" {
+		return nil, nil
+	}
+	u, err := url.Parse(baseURL)
+	if err != nil {
+		return nil, fmt.Errorf("parsing install cancellation URL '%s': %w", baseURL, err)
+	}
+	u.Path = path.Join(u.Path, devid)
+	u.RawQuery = url.Values{QueryInstallSession: []string{session}}.Encode()
+	return &CancellationWatcher{
+		hc:      hc,
+		url:     u.String(),
+		session: session,
+		stage:   stage,
+		done:    make(chan struct{}),
+	}, nil
+}
+
+// Watch polls the seeder until `ctx` is done or the installation got cancelled. It should run in its own goroutine.
+func (w *CancellationWatcher) Watch(ctx context.Context, l log.Interface) {
+	if w == nil {
+		return
+	}
+	ticker := time.NewTicker(cancellationPollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-w.done:
+			return
+		case <-ticker.C:
+			if _, err := w.check(ctx); err != nil {
+				l.Debug("Checking for install cancellation failed", zap.Error(err))
+			}
+		}
+	}
+}
+
+// Context returns a context which is being cancelled as soon as the installation got cancelled. Steps which can be
+// interrupted at any time without harm, like downloads, should use it.
+func (w *CancellationWatcher) Context(parent context.Context) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(parent)
+	if w == nil {
+		return ctx, cancel
+	}
+	go func() {
+		select {
+		case <-w.done:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	return ctx, cancel
+}
+
+// Checkpoint must be called at every point at which the installation can be safely aborted. It returns an error
+// which wraps `ErrInstallCancelled` if the installation got cancelled, and reports the abort at `checkpoint` to the
+// seeder. If the seeder cannot be reached, the installation continues.
+func (w *CancellationWatcher) Checkpoint(ctx context.Context, l log.Interface, checkpoint string) error {
+	if w == nil {
+		return nil
+	}
+	c, err := w.check(ctx)
+	if err != nil {
+		l.Warn("Checking for install cancellation failed, continuing installation", zap.String("checkpoint", checkpoint), zap.Error(err))
+		return nil
+	}
+	if !c.Cancelled {
+		return nil
+	}
+	l.Warn("Installation cancelled by seeder, aborting", zap.String("checkpoint", checkpoint), zap.String("reason", c.Reason))
+	if err := w.report(ctx, checkpoint); err != nil {
+		l.Warn("Reporting aborted installation to seeder failed", zap.Error(err))
+	}
+	return fmt.Errorf("%w at checkpoint '%s': %s", ErrInstallCancelled, checkpoint, c.Reason)
+}
+
+// check asks the seeder unless it reported a cancellation already
+func (w *CancellationWatcher) check(ctx context.Context) (*InstallCancellation, error) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if w.cancelled != nil {
+		return w.cancelled, nil
+	}
+
+	subCtx, cancel := context.WithTimeout(ctx, cancellationTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(subCtx, http.MethodGet, w.url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/json")
+	resp, err := w.hc.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, NewHTTPErrorFromBody(resp)
+	}
+	var ret InstallCancellation
+	if err := json.NewDecoder(resp.Body).Decode(&ret); err != nil {
+		return nil, fmt.Errorf("decoding install cancellation: %w", err)
+	}
+	if ret.Cancelled {
+		w.cancelled = &ret
+		close(w.done)
+	}
+	return &ret, nil
+}
+
+func (w *CancellationWatcher) report(ctx context.Context, checkpoint string) error {
+	b, err := json.Marshal(&InstallCancellationReport{
+		InstallSession: w.session,
+		Stage:          w.stage,
+		Checkpoint:     checkpoint,
+	})
+	if err != nil {
+		return err
+	}
+	subCtx, cancel := context.WithTimeout(ctx, cancellationTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(subCtx, http.MethodPost, w.url, bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := w.hc.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent && resp.StatusCode != http.StatusOK {
+		return NewHTTPErrorFromBody(resp)
+	}
+	return nil
+}
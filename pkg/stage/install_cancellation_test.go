@@ -0,0 +1,85 @@
+// Copyright 2023 Hedgehog
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package stage
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"go.githedgehog.com/dasboot/pkg/log"
+	"go.uber.org/zap"
+)
+
+func TestCancellationWatcher_Checkpoint(t *testing.T) {
+	var cancelled bool
+	var reports []InstallCancellationReport
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/install-cancellation/dev1" || r.URL.Query().Get(QueryInstallSession) != "session1" {
+			http.NotFound(w, r)
+			return
+		}
+		switch r.Method {
+		case http.MethodGet:
+			json.NewEncoder(w).Encode(&InstallCancellation{Cancelled: cancelled, Reason: "wrong cabling"}) //nolint: errcheck
+		case http.MethodPost:
+			var report InstallCancellationReport
+			if err := json.NewDecoder(r.Body).Decode(&report); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			reports = append(reports, report)
+			w.WriteHeader(http.StatusNoContent)
+		}
+	}))
+	defer srv.Close()
+
+	ctx := context.Background()
+	l := log.NewZapWrappedLogger(zap.NewNop())
+
+	// a nil watcher never cancels
+	var nilWatcher *CancellationWatcher
+	if err := nilWatcher.Checkpoint(ctx, l, "nil"); err != nil {
+		t.Fatalf("nil watcher Checkpoint() = %v, want nil", err)
+	}
+
+	w, err := NewCancellationWatcher(srv.Client(), srv.URL+"/install-cancellation", "dev1", "session1", "stage2")
+	if err != nil {
+		t.Fatalf("NewCancellationWatcher() = %v", err)
+	}
+	if err := w.Checkpoint(ctx, l, "first"); err != nil {
+		t.Fatalf("Checkpoint() = %v, want nil", err)
+	}
+
+	cancelled = true
+	dlCtx, cancel := w.Context(ctx)
+	defer cancel()
+	if err := w.Checkpoint(ctx, l, "second"); !errors.Is(err, ErrInstallCancelled) {
+		t.Fatalf("Checkpoint() = %v, want %v", err, ErrInstallCancelled)
+	}
+	<-dlCtx.Done()
+	if len(reports) != 1 || reports[0] != (InstallCancellationReport{InstallSession: "session1", Stage: "stage2", Checkpoint: "second"}) {
+		t.Errorf("reports = %v, want exactly one report for the second checkpoint", reports)
+	}
+
+	// the cancellation is final, even if the seeder is not reachable anymore
+	srv.Close()
+	if err := w.Checkpoint(ctx, l, "third"); !errors.Is(err, ErrInstallCancelled) {
+		t.Errorf("Checkpoint() = %v, want %v", err, ErrInstallCancelled)
+	}
+}
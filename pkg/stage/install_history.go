@@ -0,0 +1,104 @@
+// Copyright 2023 Hedgehog
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package stage
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"go.githedgehog.com/dasboot/pkg/partitions/identity"
+)
+
+// installHistoryCheckpoint is the name of the checkpoint on the identity partition which
+// tracks the outcome of previous installation attempts
+const installHistoryCheckpoint = "install-history"
+
+// InstallHistoryStore is the part of the identity partition which is needed to track the install history
+type InstallHistoryStore interface {
+	StoreCheckpoint(name string, data []byte) error
+	GetCheckpoint(name string) ([]byte, error)
+	DeleteCheckpoint(name string) error
+}
+
+var _ InstallHistoryStore = identity.IdentityPartition(nil)
+
+// InstallHistory tracks the outcome of previous installation attempts across reboots
+type InstallHistory struct {
+	// ConsecutiveFailures is the number of installation attempts which failed in a row
+	ConsecutiveFailures uint `json:"consecutive_failures"`
+
+	// FirstFailure is the time of the first failure of the current series of failures
+	FirstFailure time.Time `json:"first_failure,omitempty"`
+
+	// LastFailure is the time of the most recent failure
+	LastFailure time.Time `json:"last_failure,omitempty"`
+
+	// LastError is the error of the most recent failure
+	LastError string `json:"last_error,omitempty"`
+}
+
+// ReadInstallHistory reads the install history from the identity partition. It returns an
+// empty history if there is none yet.
+func ReadInstallHistory(store InstallHistoryStore) (*InstallHistory, error) {
+	b, err := store.GetCheckpoint(installHistoryCheckpoint)
+	if err != nil {
+		if errors.Is(err, identity.ErrNoCheckpoint) {
+			return &InstallHistory{}, nil
+		}
+		return nil, fmt.Errorf("reading install history checkpoint: %w", err)
+	}
+	var ret InstallHistory
+	if err := json.Unmarshal(b, &ret); err != nil {
+		return nil, fmt.Errorf("decoding install history: %w", err)
+	}
+	return &ret, nil
+}
+
+// RecordInstallFailure increases the number of consecutive failures in the install history
+// and returns the updated history
+func RecordInstallFailure(store InstallHistoryStore, installErr error) (*InstallHistory, error) {
+	h, err := ReadInstallHistory(store)
+	if err != nil {
+		// a corrupt history must not prevent us from tracking failures
+		h = &InstallHistory{}
+	}
+	now := timeNow()
+	if h.ConsecutiveFailures == 0 {
+		h.FirstFailure = now
+	}
+	h.ConsecutiveFailures++
+	h.LastFailure = now
+	if installErr != nil {
+		h.LastError = installErr.Error()
+	}
+	b, err := json.Marshal(h)
+	if err != nil {
+		return nil, fmt.Errorf("encoding install history: %w", err)
+	}
+	if err := store.StoreCheckpoint(installHistoryCheckpoint, b); err != nil {
+		return nil, fmt.Errorf("storing install history checkpoint: %w", err)
+	}
+	return h, nil
+}
+
+// ResetInstallHistory must be called after a successful installation
+func ResetInstallHistory(store InstallHistoryStore) error {
+	if err := store.DeleteCheckpoint(installHistoryCheckpoint); err != nil {
+		return fmt.Errorf("deleting install history checkpoint: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,101 @@
+// Copyright 2023 Hedgehog
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package stage
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"go.githedgehog.com/dasboot/pkg/partitions/identity"
+)
+
+type fakeCheckpoints map[string][]byte
+
+func (f fakeCheckpoints) StoreCheckpoint(name string, data []byte) error {
+	f[name] = data
+	return nil
+}
+
+func (f fakeCheckpoints) GetCheckpoint(name string) ([]byte, error) {
+	b, ok := f[name]
+	if !ok {
+		return nil, identity.ErrNoCheckpoint
+	}
+	return b, nil
+}
+
+func (f fakeCheckpoints) DeleteCheckpoint(name string) error {
+	delete(f, name)
+	return nil
+}
+
+func TestInstallHistory(t *testing.T) {
+	now := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	oldTimeNow := timeNow
+	defer func() { timeNow = oldTimeNow }()
+	timeNow = func() time.Time { return now }
+
+	store := fakeCheckpoints{}
+	h, err := ReadInstallHistory(store)
+	if err != nil {
+		t.Fatalf("ReadInstallHistory() error = %v", err)
+	}
+	if h.ConsecutiveFailures != 0 {
+		t.Fatalf("empty history has %d failures", h.ConsecutiveFailures)
+	}
+
+	first := now
+	for i := uint(1); i <= 3; i++ {
+		h, err := RecordInstallFailure(store, errors.New("boom"))
+		if err != nil {
+			t.Fatalf("RecordInstallFailure() error = %v", err)
+		}
+		if h.ConsecutiveFailures != i {
+			t.Errorf("ConsecutiveFailures = %d, want %d", h.ConsecutiveFailures, i)
+		}
+		if !h.FirstFailure.Equal(first) || !h.LastFailure.Equal(now) {
+			t.Errorf("FirstFailure = %v, LastFailure = %v, want %v and %v", h.FirstFailure, h.LastFailure, first, now)
+		}
+		if h.LastError != "boom" {
+			t.Errorf("LastError = %q", h.LastError)
+		}
+		now = now.Add(time.Minute)
+	}
+
+	h, err = ReadInstallHistory(store)
+	if err != nil {
+		t.Fatalf("ReadInstallHistory() error = %v", err)
+	}
+	if h.ConsecutiveFailures != 3 {
+		t.Errorf("persisted ConsecutiveFailures = %d, want 3", h.ConsecutiveFailures)
+	}
+
+	// a corrupt history must not stop failures from being tracked
+	store[installHistoryCheckpoint] = []byte("garbage")
+	if _, err := ReadInstallHistory(store); err == nil {
+		t.Errorf("ReadInstallHistory() expected error for corrupt history")
+	}
+	if h, err := RecordInstallFailure(store, nil); err != nil || h.ConsecutiveFailures != 1 {
+		t.Errorf("RecordInstallFailure() on corrupt history = %v, %v", h, err)
+	}
+
+	if err := ResetInstallHistory(store); err != nil {
+		t.Fatalf("ResetInstallHistory() error = %v", err)
+	}
+	if h, _ := ReadInstallHistory(store); h.ConsecutiveFailures != 0 {
+		t.Errorf("history after reset has %d failures", h.ConsecutiveFailures)
+	}
+}
@@ -0,0 +1,211 @@
+// Copyright 2023 Hedgehog
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package stage
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"go.githedgehog.com/dasboot/pkg/log"
+	"go.uber.org/zap"
+	"golang.org/x/sys/unix"
+)
+
+var (
+	ErrInstallLocked       = errors.New("stage: another installation is in progress")
+	ErrInstallLockLost     = errors.New("stage: install lock is held by a different installation")
+	ErrInstallLockInvalid  = errors.New("stage: install lock is corrupt")
+	ErrInstallLockNotFound = errors.New("stage: install lock not found")
+)
+
+// installLockPath is where the install lock lives. It is on a tmpfs on purpose: a reboot ends every installation.
+// This can be swapped out for testing.
+var installLockPath = "/run/das-boot/install.lock"
+
+// InstallLockInfo is the content of the install lock file. Its checksum protects it against partial writes and
+// against being edited by hand.
+type InstallLockInfo struct {
+	InstallSessionID string    `json:"install_session_id"`
+	PID              int       `json:"pid"`
+	Acquired         time.Time `json:"acquired"`
+	Checksum         string    `json:"checksum"`
+}
+
+func (i *InstallLockInfo) checksum() string {
+	h := sha256.New()
+	fmt.Fprintf(h, "%s\n%d\n%s\n", i.InstallSessionID, i.PID, i.Acquired.UTC().Format(time.RFC3339Nano))
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func parseInstallLockInfo(b []byte) (*InstallLockInfo, error) {
+	var ret InstallLockInfo
+	if err := json.Unmarshal(b, &ret); err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInstallLockInvalid, err)
+	}
+	if ret.InstallSessionID == "" || ret.Checksum != ret.checksum() {
+		return nil, fmt.Errorf("%w: checksum mismatch", ErrInstallLockInvalid)
+	}
+	return &ret, nil
+}
+
+// InstallLock prevents concurrent installers on one device. Stage 0 acquires it for its install session, and holds
+// an exclusive flock on the lock file for as long as it is running. All later stages verify with
+// `VerifyInstallLock` that the lock still belongs to their install session.
+type InstallLock struct {
+	f    *os.File
+	info InstallLockInfo
+}
+
+// AcquireInstallLock acquires the install lock for the install session `sessionID`. A lock file which is not
+// locked by any process anymore is stale, and is taken over. If the lock is held by another running installation,
+// an error of type `ErrInstallLocked` is returned, unless `force` is set: then the lock gets broken, and the
+// other installation will abort at its next lock verification.
+func AcquireInstallLock(l log.Interface, sessionID string, force bool) (*InstallLock, error) {
+	if err := os.MkdirAll(filepath.Dir(installLockPath), 0o755); err != nil {
+		return nil, fmt.Errorf("install lock: creating directory: %w", err)
+	}
+	f, err := os.OpenFile(installLockPath, os.O_RDWR|os.O_CREATE, 0o600)
+	if err != nil {
+		return nil, fmt.Errorf("install lock: open: %w", err)
+	}
+
+	locked := true
+	if err := unix.Flock(int(f.Fd()), unix.LOCK_EX|unix.LOCK_NB); err != nil {
+		if !errors.Is(err, unix.EWOULDBLOCK) {
+			f.Close()
+			return nil, fmt.Errorf("install lock: flock: %w", err)
+		}
+		locked = false
+	}
+
+	// whatever is in the lock file now belongs to a previous or to a concurrent installation
+	prev, prevErr := readInstallLockFile(f)
+	if !locked {
+		if !force {
+			f.Close()
+			if prevErr != nil {
+				return nil, fmt.Errorf("%w: lock holder unknown: %w", ErrInstallLocked, prevErr)
+			}
+			return nil, fmt.Errorf("%w: install session %s (pid %d) holds the lock since %s", ErrInstallLocked, prev.InstallSessionID, prev.PID, prev.Acquired.Format(time.RFC3339))
+		}
+		l.Warn("Breaking install lock of a running installation as requested", zap.Reflect("lock", prev), zap.NamedError("lockError", prevErr))
+	} else if prevErr == nil {
+		l.Warn("Taking over stale install lock of a previous installation", zap.Reflect("lock", prev))
+	} else if !errors.Is(prevErr, io.EOF) {
+		l.Warn("Taking over corrupt install lock", zap.Error(prevErr))
+	}
+
+	ret := &InstallLock{
+		f: f,
+		info: InstallLockInfo{
+			InstallSessionID: sessionID,
+			PID:              os.Getpid(),
+			Acquired:         time.Now().UTC(),
+		},
+	}
+	ret.info.Checksum = ret.info.checksum()
+	if err := ret.write(); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return ret, nil
+}
+
+func readInstallLockFile(f *os.File) (*InstallLockInfo, error) {
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	b, err := io.ReadAll(f)
+	if err != nil {
+		return nil, err
+	}
+	if len(b) == 0 {
+		return nil, io.EOF
+	}
+	return parseInstallLockInfo(b)
+}
+
+func (il *InstallLock) write() error {
+	b, err := json.Marshal(&il.info)
+	if err != nil {
+		return fmt.Errorf("install lock: %w", err)
+	}
+	if err := il.f.Truncate(0); err != nil {
+		return fmt.Errorf("install lock: truncate: %w", err)
+	}
+	if _, err := il.f.WriteAt(b, 0); err != nil {
+		return fmt.Errorf("install lock: write: %w", err)
+	}
+	if err := il.f.Sync(); err != nil {
+		return fmt.Errorf("install lock: sync: %w", err)
+	}
+	return nil
+}
+
+// Info returns the content of the lock file as it was written when the lock was acquired
+func (il *InstallLock) Info() InstallLockInfo {
+	return il.info
+}
+
+// Release releases the install lock. The lock file is only removed if `remove` is set, and if it still belongs to
+// the install session of this lock. Keeping the lock file around is necessary if later stages are going to verify it.
+func (il *InstallLock) Release(remove bool) error {
+	if remove {
+		if err := VerifyInstallLock(il.info.InstallSessionID); err == nil {
+			if err := os.Remove(installLockPath); err != nil && !errors.Is(err, os.ErrNotExist) {
+				il.f.Close()
+				return fmt.Errorf("install lock: remove: %w", err)
+			}
+		}
+	}
+	// closing the file releases the flock
+	return il.f.Close()
+}
+
+// ReadInstallLock reads the current content of the install lock file without acquiring the lock
+func ReadInstallLock() (*InstallLockInfo, error) {
+	b, err := os.ReadFile(installLockPath)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, ErrInstallLockNotFound
+		}
+		return nil, fmt.Errorf("install lock: read: %w", err)
+	}
+	return parseInstallLockInfo(b)
+}
+
+// VerifyInstallLock verifies that the install lock belongs to the install session `sessionID`. It returns an error
+// of type `ErrInstallLockLost` if the lock was taken over by a different installation. A missing lock is not an
+// error, as there is nothing to protect against if stage 0 did not acquire one.
+func VerifyInstallLock(sessionID string) error {
+	info, err := ReadInstallLock()
+	if err != nil {
+		if errors.Is(err, ErrInstallLockNotFound) {
+			return nil
+		}
+		return err
+	}
+	if info.InstallSessionID != sessionID {
+		return fmt.Errorf("%w: install session %s (pid %d) holds the lock since %s", ErrInstallLockLost, info.InstallSessionID, info.PID, info.Acquired.Format(time.RFC3339))
+	}
+	return nil
+}
@@ -0,0 +1,145 @@
+// Copyright 2023 Hedgehog
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package stage
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"go.githedgehog.com/dasboot/pkg/log"
+)
+
+func TestInstallLock(t *testing.T) {
+	tests := []struct {
+		name       string
+		pre        func(t *testing.T) *InstallLock
+		force      bool
+		wantErr    error
+		wantVerify map[string]error
+	}{
+		{
+			name:       "no previous lock",
+			wantVerify: map[string]error{"session-2": nil, "session-1": ErrInstallLockLost},
+		},
+		{
+			name: "stale lock is taken over",
+			pre: func(t *testing.T) *InstallLock {
+				il, err := AcquireInstallLock(log.L(), "session-1", false)
+				if err != nil {
+					t.Fatal(err)
+				}
+				// closing the file without removing it is what a crashed installer leaves behind
+				il.f.Close()
+				return nil
+			},
+			wantVerify: map[string]error{"session-2": nil, "session-1": ErrInstallLockLost},
+		},
+		{
+			name: "corrupt lock is taken over",
+			pre: func(t *testing.T) *InstallLock {
+				if err := os.MkdirAll(filepath.Dir(installLockPath), 0o755); err != nil {
+					t.Fatal(err)
+				}
+				if err := os.WriteFile(installLockPath, []byte(`{"install_session_id":"session-1","checksum":"nope"}`), 0o600); err != nil {
+					t.Fatal(err)
+				}
+				return nil
+			},
+			wantVerify: map[string]error{"session-2": nil},
+		},
+		{
+			name: "running installation holds the lock",
+			pre: func(t *testing.T) *InstallLock {
+				il, err := AcquireInstallLock(log.L(), "session-1", false)
+				if err != nil {
+					t.Fatal(err)
+				}
+				return il
+			},
+			wantErr:    ErrInstallLocked,
+			wantVerify: map[string]error{"session-1": nil, "session-2": ErrInstallLockLost},
+		},
+		{
+			name: "running installation with broken lock",
+			pre: func(t *testing.T) *InstallLock {
+				il, err := AcquireInstallLock(log.L(), "session-1", false)
+				if err != nil {
+					t.Fatal(err)
+				}
+				return il
+			},
+			force:      true,
+			wantVerify: map[string]error{"session-2": nil, "session-1": ErrInstallLockLost},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			oldPath := installLockPath
+			installLockPath = filepath.Join(t.TempDir(), "das-boot", "install.lock")
+			defer func() { installLockPath = oldPath }()
+
+			if tt.pre != nil {
+				if prev := tt.pre(t); prev != nil {
+					defer prev.Release(false) //nolint: errcheck
+				}
+			}
+
+			il, err := AcquireInstallLock(log.L(), "session-2", tt.force)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("AcquireInstallLock() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			for session, wantErr := range tt.wantVerify {
+				if err := VerifyInstallLock(session); !errors.Is(err, wantErr) {
+					t.Errorf("VerifyInstallLock(%s) error = %v, wantErr %v", session, err, wantErr)
+				}
+			}
+			if il == nil {
+				return
+			}
+
+			if err := il.Release(true); err != nil {
+				t.Fatalf("Release() error = %v", err)
+			}
+			if _, err := ReadInstallLock(); !errors.Is(err, ErrInstallLockNotFound) {
+				t.Errorf("Release() did not remove the lock file: %v", err)
+			}
+		})
+	}
+}
+
+func TestVerifyInstallLockTampered(t *testing.T) {
+	oldPath := installLockPath
+	installLockPath = filepath.Join(t.TempDir(), "install.lock")
+	defer func() { installLockPath = oldPath }()
+
+	il, err := AcquireInstallLock(log.L(), "session-1", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer il.Release(false) //nolint: errcheck
+
+	// pretend somebody edited the session ID by hand
+	info := il.Info()
+	info.InstallSessionID = "session-2"
+	b := []byte(`{"install_session_id":"session-2","pid":1,"acquired":"2023-01-01T00:00:00Z","checksum":"` + info.Checksum + `"}`)
+	if err := os.WriteFile(installLockPath, b, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := VerifyInstallLock("session-2"); !errors.Is(err, ErrInstallLockInvalid) {
+		t.Errorf("VerifyInstallLock() error = %v, want ErrInstallLockInvalid", err)
+	}
+}
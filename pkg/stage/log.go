@@ -17,6 +17,9 @@ package stage
 import (
 	"context"
 	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
 
 	"go.githedgehog.com/dasboot/pkg/log"
 	"go.githedgehog.com/dasboot/pkg/log/syslog"
@@ -30,34 +33,98 @@ type LogSettings struct {
 	Format         string          `json:"format,omitempty"`
 	SyslogServers  []string        `json:"syslog_servers,omitempty"`
 	SyslogFacility syslog.Priority `json:"syslog_facility,omitempty"`
+	SyslogFraming  syslog.Framing  `json:"syslog_framing,omitempty"`
+	Consoles       []string        `json:"consoles,omitempty"`
+
+	// SyslogTransport is the transport to all syslog servers, and SyslogTLS holds the settings for TLS
+	SyslogTransport syslog.Transport    `json:"syslog_transport,omitempty"`
+	SyslogTLS       *syslog.TLSSettings `json:"syslog_tls,omitempty"`
+
+	// SyslogSpillDir is the directory where messages which cannot be delivered to the syslog servers are being
+	// spilled to until they can be replayed. Spilling is disabled if this is empty.
+	SyslogSpillDir string `json:"syslog_spill_dir,omitempty"`
+}
+
+// syslogSpillPath returns the path of the spill file for the syslog server at index `i`. Every stage runs in its
+// own process while the previous stages are still around, so the files must not be shared across processes.
+func syslogSpillPath(dir string, i int) string {
+	return filepath.Join(dir, fmt.Sprintf("syslog-%d-%d.spill", os.Getpid(), i))
+}
+
+// recentLogs retains the most recent log lines of the global logger
+// so that they can be included in crash reports
+var recentLogs = log.NewRingBuffer(100)
+
+// syslogWriters are the syslog writers of the global logger
+// which we keep around to be able to report on their health
+var syslogWriters []*syslog.Writer
+var syslogWritersLock sync.RWMutex
+
+// LoggingHealth returns the health of all syslog destinations of the global logger
+func LoggingHealth() []syslog.Health {
+	syslogWritersLock.RLock()
+	defer syslogWritersLock.RUnlock()
+	ret := make([]syslog.Health, 0, len(syslogWriters))
+	for _, w := range syslogWriters {
+		ret = append(ret, w.Health())
+	}
+	return ret
+}
+
+// LoggingDegraded returns true if any of the syslog destinations of the global logger is not healthy
+func LoggingDegraded() bool {
+	for _, h := range LoggingHealth() {
+		if h.Degraded() {
+			return true
+		}
+	}
+	return false
 }
 
 func InitializeGlobalLogger(ctx context.Context, settings *LogSettings) error {
 	// initialize zap serial logger
 	var logger log.Interface
-	serialLogger, err := log.NewSerialConsole(settings.Level, settings.Format, settings.Development)
+	serialLogger, err := log.NewSerialConsole(settings.Level, settings.Format, settings.Development, settings.Consoles...)
 	if err != nil {
 		return fmt.Errorf("failed to initialize serial logger: %w", err)
 	}
-	serialLogger.Debug("Initialized serial logger from command-line settings", zap.Bool("logDevelopment", settings.Development), zap.String("logLevel", settings.Level.String()), zap.String("logFormat", settings.Format))
-	logger = log.NewZapWrappedLogger(serialLogger)
+	serialLogger.Debug("Initialized serial logger from command-line settings", zap.Bool("logDevelopment", settings.Development), zap.String("logLevel", settings.Level.String()), zap.String("logFormat", settings.Format), zap.Strings("logConsoles", settings.Consoles))
+	ringLogger := log.NewRingBufferLogger(settings.Level, recentLogs)
+	logger = log.NewZapWrappedLogger(serialLogger, ringLogger)
 
 	// initialize zap syslog logger
+	// NOTE: the syslog writers connect asynchronously, so an unreachable syslog server
+	// never blocks us here, and it gets disabled temporarily if it keeps failing
+	var writers []*syslog.Writer
 	if len(settings.SyslogServers) > 0 {
-		loggers := []*zap.Logger{serialLogger}
-		for _, syslogServer := range settings.SyslogServers {
-			syslogLogger, err := log.NewSyslog(ctx, settings.Level, settings.Development, settings.SyslogFacility, syslogServer, syslog.InternalLogger(serialLogger))
+		connect, err := syslog.TransportConnect(settings.SyslogTransport, settings.SyslogTLS)
+		if err != nil {
+			return fmt.Errorf("failed to initialize syslog transport '%s': %w", settings.SyslogTransport, err)
+		}
+		framing := settings.SyslogTransport.Framing(settings.SyslogFraming)
+		loggers := []*zap.Logger{serialLogger, ringLogger}
+		for i, syslogServer := range settings.SyslogServers {
+			opts := []syslog.WriterOption{syslog.InternalLogger(serialLogger), syslog.ConnectFunction(connect)}
+			if settings.SyslogSpillDir != "" {
+				opts = append(opts, syslog.Spill(syslogSpillPath(settings.SyslogSpillDir, i), syslog.DefaultSpillMaxBytes))
+			}
+			syslogLogger, w, err := log.NewSyslogWithWriter(ctx, settings.Level, settings.Development, settings.SyslogFacility, framing, syslogServer, opts...)
 			if err != nil {
 				return fmt.Errorf("failed to initialize syslog logger for '%s': %w", syslogServer, err)
 			}
-			serialLogger.Debug("Initialized syslog logger from command-line settings", zap.String("syslogServer", syslogServer), zap.String("syslogFacility", settings.SyslogFacility.String()))
+			serialLogger.Debug("Initialized syslog logger from command-line settings", zap.String("syslogServer", syslogServer), zap.String("syslogFacility", settings.SyslogFacility.String()), zap.Stringer("syslogFraming", framing), zap.Stringer("syslogTransport", settings.SyslogTransport))
 			loggers = append(loggers, syslogLogger)
+			writers = append(writers, w)
 		}
 
 		// now create a "tee" logger for both serial and syslog destinations
 		logger = log.NewZapWrappedLogger(loggers...)
 	}
 
+	syslogWritersLock.Lock()
+	syslogWriters = writers
+	syslogWritersLock.Unlock()
+
 	log.ReplaceGlobals(logger)
 	return nil
 }
@@ -0,0 +1,176 @@
+// Copyright 2023 Hedgehog
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package stage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"go.githedgehog.com/dasboot/pkg/log"
+	"go.uber.org/zap"
+)
+
+// mirrorProbeSize is the number of bytes which are read from a mirror to measure its latency
+const mirrorProbeSize = 4096
+
+// mirrorProbeTimeout is the time which a mirror has to answer all probing requests
+const mirrorProbeTimeout = 5 * time.Second
+
+var ErrNoMirrors = errors.New("stage: no mirror URLs")
+
+// MirrorRanking is the result of probing an artifact URL
+type MirrorRanking struct {
+	URL     string
+	Latency time.Duration
+	Err     error
+}
+
+// Available returns true if the mirror answered all probing requests successfully
+func (m MirrorRanking) Available() bool {
+	return m.Err == nil
+}
+
+// MirrorURLs returns the URL `primary` followed by all `mirrors` of the same artifact. Empty and
+// duplicate URLs are dropped.
+func MirrorURLs(primary string, mirrors []string) []string {
+	ret := make([]string, 0, len(mirrors)+1)
+	seen := make(map[string]struct{}, len(mirrors)+1)
+	for _, u := range append([]string{primary}, mirrors...) {
+		if u == "" {
+			continue
+		}
+		if _, ok := seen[u]; ok {
+			continue
+		}
+		seen[u] = struct{}{}
+		ret = append(ret, u)
+	}
+	return ret
+}
+
+// RankMirrors probes all `urls` concurrently with a HEAD request followed by a small range read, and returns
+// them ordered by availability and latency. Unavailable mirrors are ranked last in the order in which they
+// were passed, so that they can still serve as a last resort.
+func RankMirrors(ctx context.Context, hc *http.Client, urls []string) []MirrorRanking {
+	ret := make([]MirrorRanking, len(urls))
+	var wg sync.WaitGroup
+	for i, u := range urls {
+		wg.Add(1)
+		go func(i int, u string) {
+			defer wg.Done()
+			latency, err := probeMirror(ctx, hc, u)
+			ret[i] = MirrorRanking{URL: u, Latency: latency, Err: err}
+		}(i, u)
+	}
+	wg.Wait()
+
+	sort.SliceStable(ret, func(i, j int) bool {
+		if ret[i].Available() != ret[j].Available() {
+			return ret[i].Available()
+		}
+		if !ret[i].Available() {
+			return false
+		}
+		return ret[i].Latency < ret[j].Latency
+	})
+	return ret
+}
+
+func probeMirror(ctx context.Context, hc *http.Client, u string) (time.Duration, error) {
+	subCtx, cancel := context.WithTimeout(withArtifactDownload(ctx), mirrorProbeTimeout)
+	defer cancel()
+	start := time.Now()
+
+	// a HEAD request tells us if the artifact is there at all, servers which do not support HEAD requests
+	// get the benefit of the doubt
+	req, err := http.NewRequestWithContext(subCtx, http.MethodHead, u, nil)
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Accept", "application/octet-stream")
+	resp, err := hc.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	resp.Body.Close()
+	switch {
+	case resp.StatusCode == http.StatusMethodNotAllowed || resp.StatusCode == http.StatusNotImplemented:
+	case resp.StatusCode < 200 || resp.StatusCode > 299:
+		return 0, NewHTTPErrorf(resp, "HEAD request")
+	}
+
+	// the range read tells us how fast the mirror starts serving the artifact, servers which ignore
+	// the range header are fine as well as we stop reading early
+	req, err = http.NewRequestWithContext(subCtx, http.MethodGet, u, nil)
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Accept", "application/octet-stream")
+	req.Header.Set("Range", fmt.Sprintf("bytes=0-%d", mirrorProbeSize-1))
+	resp, err = hc.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusPartialContent {
+		return 0, NewHTTPErrorf(resp, "range request")
+	}
+	if _, err := io.Copy(io.Discard, io.LimitReader(resp.Body, mirrorProbeSize)); err != nil {
+		return 0, fmt.Errorf("range request: %w", err)
+	}
+	return time.Since(start), nil
+}
+
+// DownloadExecutableFromMirrors is like `DownloadFromMirrors` for executables
+func DownloadExecutableFromMirrors(ctx context.Context, hc *http.Client, urls []string, destPath string, timeout time.Duration, opts ...DownloadOption) (string, error) {
+	return DownloadFromMirrors(ctx, hc, urls, destPath, 0755, timeout, opts...)
+}
+
+// DownloadFromMirrors downloads the same artifact which is available at all `urls`. If there is more than one URL,
+// the mirrors get ranked with `RankMirrors` first, and the download falls back to the next ranked mirror if it
+// fails. It returns the URL which the artifact was downloaded from.
+func DownloadFromMirrors(ctx context.Context, hc *http.Client, urls []string, destPath string, destPerm os.FileMode, timeout time.Duration, opts ...DownloadOption) (string, error) {
+	switch len(urls) {
+	case 0:
+		return "", ErrNoMirrors
+	case 1:
+		return urls[0], Download(ctx, hc, urls[0], destPath, destPerm, timeout, opts...)
+	}
+
+	l := log.L()
+	ranking := RankMirrors(ctx, hc, urls)
+	l.Info("Ranked download mirrors", zap.Reflect("ranking", ranking))
+
+	var errs []error
+	for _, m := range ranking {
+		err := Download(ctx, hc, m.URL, destPath, destPerm, timeout, opts...)
+		if err == nil {
+			return m.URL, nil
+		}
+		l.Warn("Download from mirror failed, trying next mirror", zap.String("url", m.URL), zap.Error(err))
+		errs = append(errs, fmt.Errorf("%s: %w", m.URL, err))
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return "", errors.Join(errs...)
+}
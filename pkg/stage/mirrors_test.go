@@ -0,0 +1,144 @@
+// Copyright 2023 Hedgehog
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package stage
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestMirrorURLs(t *testing.T) {
+	got := MirrorURLs("https://a/stage1", []string{"", "https://b/stage1", "https://a/stage1", "https://c/stage1", "https://b/stage1"})
+	want := []string{"https://a/stage1", "https://b/stage1", "https://c/stage1"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("MirrorURLs() = %v, want %v", got, want)
+	}
+	if got := MirrorURLs("", nil); len(got) != 0 {
+		t.Errorf("MirrorURLs() = %v, want empty", got)
+	}
+}
+
+// mirrorServer serves `artifact` after `delay`, or fails with `status` if it is set
+func mirrorServer(t *testing.T, artifact []byte, delay time.Duration, status int, headAllowed bool) (*httptest.Server, *atomic.Int32) {
+	var downloads atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodHead && !headAllowed {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		time.Sleep(delay)
+		if status != 0 {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(status)
+			_, _ = w.Write([]byte(`{"reason":"mirror failure"}`))
+			return
+		}
+		w.Header().Set("Content-Type", "application/octet-stream")
+		if r.Method == http.MethodGet && r.Header.Get("Range") == "" {
+			downloads.Add(1)
+		}
+		_, _ = w.Write(artifact)
+	}))
+	t.Cleanup(srv.Close)
+	return srv, &downloads
+}
+
+func TestRankMirrors(t *testing.T) {
+	artifact := []byte("stage binary")
+	slow, _ := mirrorServer(t, artifact, 100*time.Millisecond, 0, true)
+	fast, _ := mirrorServer(t, artifact, 0, 0, false)
+	broken, _ := mirrorServer(t, artifact, 0, http.StatusNotFound, true)
+
+	got := RankMirrors(context.Background(), http.DefaultClient, []string{broken.URL, slow.URL, fast.URL})
+	gotURLs := make([]string, 0, len(got))
+	for _, m := range got {
+		gotURLs = append(gotURLs, m.URL)
+	}
+	if want := []string{fast.URL, slow.URL, broken.URL}; !reflect.DeepEqual(gotURLs, want) {
+		t.Errorf("RankMirrors() = %v, want %v", gotURLs, want)
+	}
+	if !got[0].Available() || !got[1].Available() || got[2].Available() {
+		t.Errorf("RankMirrors() availability = %v", got)
+	}
+}
+
+func TestDownloadFromMirrors(t *testing.T) {
+	artifact := []byte("stage binary")
+	good, goodDownloads := mirrorServer(t, artifact, 50*time.Millisecond, 0, true)
+	broken, _ := mirrorServer(t, artifact, 0, http.StatusInternalServerError, true)
+
+	tests := []struct {
+		name          string
+		urls          []string
+		wantURL       string
+		wantErr       bool
+		wantDownloads int32
+	}{
+		{
+			name:    "no mirrors",
+			wantErr: true,
+		},
+		{
+			name:          "single URL is not probed",
+			urls:          []string{good.URL},
+			wantURL:       good.URL,
+			wantDownloads: 1,
+		},
+		{
+			name:          "falls back to available mirror",
+			urls:          []string{broken.URL, good.URL},
+			wantURL:       good.URL,
+			wantDownloads: 1,
+		},
+		{
+			name:    "all mirrors fail",
+			urls:    []string{broken.URL},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			goodDownloads.Store(0)
+			dest := filepath.Join(t.TempDir(), "artifact")
+			got, err := DownloadFromMirrors(context.Background(), http.DefaultClient, tt.urls, dest, 0644, time.Second)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("DownloadFromMirrors() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if got != tt.wantURL {
+				t.Errorf("DownloadFromMirrors() = %s, want %s", got, tt.wantURL)
+			}
+			if n := goodDownloads.Load(); n != tt.wantDownloads {
+				t.Errorf("DownloadFromMirrors() downloaded %d times from the good mirror, want %d", n, tt.wantDownloads)
+			}
+			b, err := os.ReadFile(dest)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(b) != string(artifact) {
+				t.Errorf("downloaded artifact = %q, want %q", b, artifact)
+			}
+		})
+	}
+}
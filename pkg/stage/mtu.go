@@ -0,0 +1,58 @@
+// Copyright 2023 Hedgehog
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package stage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	gonet "net"
+	"net/url"
+
+	"go.githedgehog.com/dasboot/pkg/net"
+)
+
+var ErrPathMTUTooLow = errors.New("path MTU lower than configured MTU")
+
+// CheckPathMTU probes the path MTU towards the host of `srcURL` and compares it against the configured `mtu`.
+// It returns the probe result together with an error wrapping `ErrPathMTUTooLow` if the effective path MTU
+// is lower than configured. Callers are expected to treat this as a warning only: large downloads might still
+// work if PMTU discovery is functional on the path. If `mtu` is 0, no probe is being performed at all.
+func CheckPathMTU(ctx context.Context, srcURL string, mtu int) (*net.PathMTUInfo, error) {
+	if mtu <= 0 {
+		return nil, nil
+	}
+	u, err := url.Parse(srcURL)
+	if err != nil {
+		return nil, fmt.Errorf("parsing URL '%s': %w", srcURL, err)
+	}
+	port := u.Port()
+	if port == "" {
+		switch u.Scheme {
+		case "https":
+			port = "443"
+		default:
+			port = "80"
+		}
+	}
+	info, err := net.ProbePathMTU(ctx, gonet.JoinHostPort(u.Hostname(), port))
+	if err != nil {
+		return nil, err
+	}
+	if info.PathMTU < mtu {
+		return info, fmt.Errorf("%w: %d < %d (interface %s)", ErrPathMTUTooLow, info.PathMTU, mtu, info.Interface)
+	}
+	return info, nil
+}
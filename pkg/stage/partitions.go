@@ -18,21 +18,31 @@ import (
 	"errors"
 	"fmt"
 
+	"go.githedgehog.com/dasboot/pkg/devid"
 	"go.githedgehog.com/dasboot/pkg/log"
 	"go.githedgehog.com/dasboot/pkg/partitions"
 	"go.githedgehog.com/dasboot/pkg/partitions/identity"
 	"go.githedgehog.com/dasboot/pkg/partitions/location"
 	"go.uber.org/zap"
+	"golang.org/x/sys/unix"
 )
 
-func MountLocationPartition(l log.Interface, devices partitions.Devices) (location.LocationPartition, error) {
+// these can be swapped out for testing
+var (
+	mountIdentityDevice   = (*partitions.Device).Mount
+	openIdentityPartition = identity.Open
+)
+
+// MountLocationPartition will find and mount the location partition. `opts` can override
+// the default mount policy of the location partition.
+func MountLocationPartition(l log.Interface, devices partitions.Devices, opts ...partitions.MountOption) (location.LocationPartition, error) {
 	lpdev := devices.GetHedgehogLocationPartition()
 	if lpdev == nil {
 		return nil, fmt.Errorf("location partition not found")
 	}
 
 	l.Info("Mounting Hedgehog Location Partition...", zap.String("source", lpdev.Path), zap.String("target", partitions.MountPathHedgehogLocation))
-	if err := lpdev.Mount(); err != nil && !errors.Is(err, partitions.ErrAlreadyMounted) {
+	if err := lpdev.Mount(opts...); err != nil && !errors.Is(err, partitions.ErrAlreadyMounted) {
 		l.Error("Mounting Hedgehog Location Partition failed", zap.Error(err))
 		return nil, fmt.Errorf("mounting partition: %w", err)
 	}
@@ -46,14 +56,70 @@ func MountLocationPartition(l log.Interface, devices partitions.Devices) (locati
 	return lp, nil
 }
 
+// IdentityEncryption controls the LUKS encryption of the identity partition
+type IdentityEncryption struct {
+	// Encrypt creates a LUKS container when the identity partition is being created. Existing partitions are
+	// never converted, however, encrypted partitions are always unlocked.
+	Encrypt bool
+
+	// Keys returns the keys which unlock the LUKS container (see `identity.UnlockKeys`). It is only called
+	// if the keys are needed.
+	Keys func() ([][]byte, error)
+}
+
+func (e *IdentityEncryption) keys() ([][]byte, error) {
+	if e == nil || e.Keys == nil {
+		return nil, identity.ErrNoUnlockKeys
+	}
+	return e.Keys()
+}
+
+// IdentityUnlockKeys returns a function for `IdentityEncryption.Keys` which derives the keys from the TPM and
+// from the location partition if it exists.
+func IdentityUnlockKeys(l log.Interface, devices partitions.Devices) func() ([][]byte, error) {
+	return func() ([][]byte, error) {
+		var info *location.Info
+		if lp, err := MountLocationPartition(l, devices); err != nil {
+			l.Warn("Location partition not available for unlocking the Hedgehog Identity Partition", zap.Error(err))
+		} else if info, err = lp.GetLocation(); err != nil {
+			l.Warn("Reading location information for unlocking the Hedgehog Identity Partition failed", zap.Error(err))
+		}
+		return identity.UnlockKeys(info)
+	}
+}
+
+// unlockIdentityPartition opens the LUKS container of the identity partition if it is encrypted
+func unlockIdentityPartition(l log.Interface, ipdev *partitions.Device, enc *IdentityEncryption) error {
+	if ipdev.MapperPath != "" {
+		return nil
+	}
+	isLUKS, err := ipdev.IsLUKS()
+	if err != nil {
+		// without cryptsetup the partition can only be used if it is not encrypted, mounting it tells
+		l.Debug("Checking for an encrypted Hedgehog Identity Partition failed", zap.String("source", ipdev.Path), zap.Error(err))
+		return nil
+	}
+	if !isLUKS {
+		return nil
+	}
+	l.Info("Unlocking encrypted Hedgehog Identity Partition", zap.String("source", ipdev.Path))
+	keys, err := enc.keys()
+	if err != nil && !errors.Is(err, identity.ErrNoUnlockKeys) {
+		return err
+	}
+	// even without keys it can still be unlocked already by an earlier stage
+	return ipdev.OpenLUKS(partitions.LUKSNameHedgehogIdentity, keys)
+}
+
 // MountIdentityPartition will find and mount the identity partition. It will be created
-// if it does not exist yet.
-func MountIdentityPartition(l log.Interface, devices partitions.Devices, platform string) (identity.IdentityPartition, error) {
+// if it does not exist yet. `enc` controls its encryption, and it can be nil for unencrypted
+// partitions. `opts` can override the default mount policy of the identity partition.
+func MountIdentityPartition(l log.Interface, devices partitions.Devices, platform string, enc *IdentityEncryption, opts ...partitions.MountOption) (identity.IdentityPartition, error) {
 	// we will rediscover them a couple of times potentially
 	devs := devices
 
 	// see if the partition exists already
-	ipdev := devs.GetHedgehogIdentityPartition()
+	ipdev := findIdentityPartition(l, devs)
 	if ipdev == nil {
 		l.Info("Hedgehog Identity Parition does not exist yet, preparing disk...")
 
@@ -94,6 +160,24 @@ func MountIdentityPartition(l log.Interface, devices partitions.Devices, platfor
 			return nil, fmt.Errorf("device not found after being created")
 		}
 
+		// encrypting it before the filesystem goes on it
+		if enc != nil && enc.Encrypt {
+			l.Info("Encrypting Hedgehog Identity Partition...")
+			keys, err := enc.keys()
+			if err != nil {
+				l.Error("Deriving keys for encrypting the Hedgehog Identity Partition failed", zap.Error(err))
+				return nil, fmt.Errorf("encrypting partition: %w", err)
+			}
+			if err := ipdev.FormatLUKS(keys); err != nil {
+				l.Error("Encrypting Hedgehog Identity Partition failed", zap.Error(err))
+				return nil, fmt.Errorf("encrypting partition: %w", err)
+			}
+			if err := ipdev.OpenLUKS(partitions.LUKSNameHedgehogIdentity, keys); err != nil {
+				l.Error("Unlocking newly encrypted Hedgehog Identity Partition failed", zap.Error(err))
+				return nil, fmt.Errorf("unlocking partition: %w", err)
+			}
+		}
+
 		// creating filesystem on it
 		l.Info("Creating filesystem for Hedgehog Identity Partition...")
 		if err := ipdev.MakeFilesystemForHedgehogIdentityPartition(false); err != nil && !errors.Is(err, partitions.ErrFilesystemAlreadyCreated) {
@@ -102,9 +186,19 @@ func MountIdentityPartition(l log.Interface, devices partitions.Devices, platfor
 		}
 	}
 
+	if err := unlockIdentityPartition(l, ipdev, enc); err != nil {
+		l.Error("Unlocking encrypted Hedgehog Identity Partition failed", zap.Error(err))
+		return nil, fmt.Errorf("unlocking partition: %w", err)
+	}
+
+	// a corrupt filesystem is better detected here than by a failing mount or by reading garbage
+	if err := checkIdentityFilesystem(l, ipdev); err != nil {
+		return nil, err
+	}
+
 	// mount Hedgehog Identity partition
 	l.Info("Mounting Hedgehog Identity Partition", zap.String("source", ipdev.Path), zap.String("target", partitions.MountPathHedgehogIdentity))
-	if err := ipdev.Mount(); err != nil && !errors.Is(err, partitions.ErrAlreadyMounted) {
+	if err := mountIdentityDevice(ipdev, opts...); err != nil && !errors.Is(err, partitions.ErrAlreadyMounted) {
 		l.Error("Mounting of Hedgehog Identity Partition failed", zap.Error(err))
 		return nil, fmt.Errorf("mounting partition: %w", err)
 	}
@@ -112,7 +206,7 @@ func MountIdentityPartition(l log.Interface, devices partitions.Devices, platfor
 	// now open the partition according to our format
 	// or initialize it if that has not been done yet
 	l.Info("Opening Hedgehog Identity Partition now...")
-	ip, err := identity.Open(ipdev)
+	ip, err := openIdentityPartition(ipdev)
 	if err != nil {
 		if errors.Is(err, identity.ErrUninitializedPartition) {
 			l.Info("Hedgehog Idenity Partition still needs to be initialized...")
@@ -129,3 +223,98 @@ func MountIdentityPartition(l log.Interface, devices partitions.Devices, platfor
 
 	return ip, nil
 }
+
+// findIdentityPartition returns the identity partition, or nil if it does not exist
+func findIdentityPartition(l log.Interface, devs partitions.Devices) *partitions.Device {
+	if ipdevs := devs.GetHedgehogIdentityPartitions(); len(ipdevs) > 1 {
+		return selectIdentityPartition(l, ipdevs)
+	}
+	return devs.GetHedgehogIdentityPartition()
+}
+
+// checkIdentityFilesystem checks and repairs the filesystem of the identity partition. It only fails if the
+// filesystem is corrupt beyond a safe repair, everything else is left to mounting it.
+func checkIdentityFilesystem(l log.Interface, ipdev *partitions.Device) error {
+	l.Info("Checking filesystem of Hedgehog Identity Partition", zap.String("source", ipdev.Path))
+	err := ipdev.CheckFilesystem()
+	switch {
+	case err == nil, errors.Is(err, partitions.ErrAlreadyMounted):
+		return nil
+	case errors.Is(err, partitions.ErrFilesystemCorrupt):
+		l.Error("Filesystem of Hedgehog Identity Partition is corrupt", zap.Error(err))
+		return fmt.Errorf("checking filesystem: %w", err)
+	case errors.Is(err, partitions.ErrUnsupportedFsckForDevice):
+		l.Debug("Skipping filesystem check of Hedgehog Identity Partition", zap.Error(err))
+		return nil
+	default:
+		l.Warn("Checking filesystem of Hedgehog Identity Partition failed", zap.Error(err))
+		return nil
+	}
+}
+
+// RecreateIdentityFilesystem creates a new filesystem on the identity partition and mounts it. It is meant for
+// an identity partition which `MountIdentityPartition` found to be corrupt (`partitions.ErrFilesystemCorrupt`),
+// and everything which was stored on it is lost. An encrypted partition stays encrypted with the same keys.
+func RecreateIdentityFilesystem(l log.Interface, devices partitions.Devices, platform string, enc *IdentityEncryption, opts ...partitions.MountOption) (identity.IdentityPartition, error) {
+	ipdev := findIdentityPartition(l, devices)
+	if ipdev == nil {
+		return nil, fmt.Errorf("identity partition not found")
+	}
+	if ipdev.IsMounted() {
+		return nil, fmt.Errorf("recreating filesystem: %w", partitions.ErrAlreadyMounted)
+	}
+	if err := unlockIdentityPartition(l, ipdev, enc); err != nil {
+		l.Error("Unlocking encrypted Hedgehog Identity Partition failed", zap.Error(err))
+		return nil, fmt.Errorf("unlocking partition: %w", err)
+	}
+	l.Warn("Recreating filesystem of Hedgehog Identity Partition, all of its contents are lost", zap.String("source", ipdev.Path))
+	if err := ipdev.MakeFilesystemForHedgehogIdentityPartition(true); err != nil {
+		l.Error("Recreating filesystem for Hedgehog Identity Partition failed", zap.Error(err))
+		return nil, fmt.Errorf("recreating filesystem: %w", err)
+	}
+	return MountIdentityPartition(l, devices, platform, enc, opts...)
+}
+
+// selectIdentityPartition selects the identity partition to use if there is more than one. Every partition is
+// mounted temporarily to inspect it, and the selection follows `identity.Select` for the ID of this device.
+// If no partition is valid, the first one is returned so that it gets initialized as usual.
+func selectIdentityPartition(l log.Interface, ipdevs partitions.Devices) *partitions.Device {
+	l.Warn("Multiple Hedgehog Identity Partitions found, selecting one", zap.Int("count", len(ipdevs)))
+	candidates := make([]*identity.Candidate, 0, len(ipdevs))
+	for i, dev := range ipdevs {
+		mounted := dev.IsMounted()
+		if !mounted {
+			mountPath := fmt.Sprintf("%s-candidate%d", partitions.MountPathHedgehogIdentity, i)
+			if err := dev.Mount(partitions.MountOptionMountPath(mountPath), partitions.MountOptionFlags(unix.MS_NODEV|unix.MS_NOEXEC|unix.MS_RDONLY)); err != nil {
+				l.Warn("Mounting Hedgehog Identity Partition candidate failed", zap.String("source", dev.Path), zap.Error(err))
+				candidates = append(candidates, &identity.Candidate{Device: dev, Err: err})
+				continue
+			}
+		}
+		c := identity.Inspect(dev)
+		if !mounted {
+			if err := dev.Unmount(); err != nil {
+				l.Warn("Unmounting Hedgehog Identity Partition candidate failed", zap.String("source", dev.Path), zap.Error(err))
+			}
+		}
+		l.Warn("Hedgehog Identity Partition candidate",
+			zap.String("source", dev.Path),
+			zap.Int("version", c.Version),
+			zap.Time("modTime", c.ModTime),
+			zap.String("devid", c.DeviceID),
+			zap.Error(c.Err),
+		)
+		candidates = append(candidates, c)
+	}
+
+	selected, err := identity.Select(candidates, devid.ID())
+	if err != nil {
+		l.Warn("None of the Hedgehog Identity Partitions is valid, using the first one", zap.String("source", ipdevs[0].Path), zap.Error(err))
+		return ipdevs[0]
+	}
+	l.Warn("Selected Hedgehog Identity Partition, consider consolidating the identity data and deleting the other partitions",
+		zap.String("source", selected.Device.Path),
+		zap.String("devid", selected.DeviceID),
+	)
+	return selected.Device
+}
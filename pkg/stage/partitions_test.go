@@ -0,0 +1,256 @@
+// Copyright 2023 Hedgehog
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package stage
+
+import (
+	"errors"
+	"fmt"
+	osexec "os/exec"
+	"testing"
+
+	"go.githedgehog.com/dasboot/pkg/exec"
+	"go.githedgehog.com/dasboot/pkg/log"
+	"go.githedgehog.com/dasboot/pkg/partitions"
+	"go.githedgehog.com/dasboot/pkg/partitions/identity"
+	"go.githedgehog.com/dasboot/test/mock/mockexec"
+
+	gomock "github.com/golang/mock/gomock"
+	"go.uber.org/zap"
+)
+
+// exitError returns a real exit error of a process which exited with `code`
+func exitError(t *testing.T, code int) error {
+	t.Helper()
+	err := osexec.Command("sh", "-c", fmt.Sprintf("exit %d", code)).Run()
+	var exitErr *osexec.ExitError
+	if !errors.As(err, &exitErr) {
+		t.Fatalf("expected exit error, got %v", err)
+	}
+	return err
+}
+
+// mockRun mocks a command which is being run. An argument of "*" matches any argument, which is needed for the
+// temporary key files of cryptsetup.
+func mockRun(t *testing.T, ctrl *gomock.Controller, nameArgs []string, err error) exec.CommandFunc {
+	return func(name string, arg ...string) exec.Interface {
+		expected := append([]string{}, nameArgs...)
+		for i := range expected {
+			if expected[i] == "*" && i <= len(arg) {
+				expected[i] = arg[i-1]
+			}
+		}
+		return mockexec.MockCommand(t, ctrl, expected, func(tc *mockexec.TestCmd) {
+			tc.EXPECT().Run().Times(1).DoAndReturn(func() error {
+				if err := tc.IsExpectedCommand(); err != nil {
+					return err
+				}
+				return err
+			})
+		})(name, arg...)
+	}
+}
+
+func mockOutput(t *testing.T, ctrl *gomock.Controller, nameArgs []string, out string, err error) exec.CommandFunc {
+	return mockexec.MockCommand(t, ctrl, nameArgs, func(tc *mockexec.TestCmd) {
+		tc.EXPECT().Output().Times(1).DoAndReturn(func() ([]byte, error) {
+			if err := tc.IsExpectedCommand(); err != nil {
+				return nil, err
+			}
+			return []byte(out), err
+		})
+	})
+}
+
+func TestMountIdentityPartition_CheckFilesystem(t *testing.T) {
+	errMkfsFailed := errors.New("mkfs failed")
+	identityDevice := func() *partitions.Device {
+		return &partitions.Device{
+			Uevent:      partitions.Uevent{partitions.UeventDevtype: partitions.UeventDevtypePartition},
+			Path:        "/dev/sda4",
+			GPTPartType: partitions.GPTPartTypeHedgehogIdentity,
+			Filesystem:  partitions.FSExt4,
+			FSLabel:     partitions.FSLabelHedgehogIdentity,
+		}
+	}
+	enc := &IdentityEncryption{
+		Keys: func() ([][]byte, error) { return [][]byte{[]byte("key")}, nil },
+	}
+	notLUKS := func(t *testing.T, ctrl *gomock.Controller) exec.CommandFunc {
+		return mockRun(t, ctrl, []string{"cryptsetup", "isLuks", "/dev/sda4"}, exitError(t, 1))
+	}
+	unlockLUKS := func(t *testing.T, ctrl *gomock.Controller) []exec.CommandFunc {
+		return []exec.CommandFunc{
+			mockRun(t, ctrl, []string{"cryptsetup", "isLuks", "/dev/sda4"}, nil),
+			mockRun(t, ctrl, []string{"cryptsetup", "open", "--type", "luks", "--key-file", "*", "/dev/sda4", partitions.LUKSNameHedgehogIdentity}, nil),
+			mockOutput(t, ctrl, []string{"grub-probe", "-d", "/dev/mapper/hh-identity", "-t", "fs"}, "ext2\n", nil),
+			mockOutput(t, ctrl, []string{"grub-probe", "-d", "/dev/mapper/hh-identity", "-t", "fs_label"}, partitions.FSLabelHedgehogIdentity+"\n", nil),
+		}
+	}
+	fsck := func(t *testing.T, ctrl *gomock.Controller, path string, err error) exec.CommandFunc {
+		return mockRun(t, ctrl, []string{"e2fsck", "-p", path}, err)
+	}
+	mkfs := func(t *testing.T, ctrl *gomock.Controller, path string, err error) exec.CommandFunc {
+		return mockRun(t, ctrl, []string{"mkfs.ext4", "-L", partitions.FSLabelHedgehogIdentity, "-F", path}, err)
+	}
+
+	tests := []struct {
+		name           string
+		enc            *IdentityEncryption
+		cmds           func(t *testing.T, ctrl *gomock.Controller) []exec.CommandFunc
+		recreate       bool
+		wantMounts     int
+		wantMapperPath string
+		wantErrToBe    error
+	}{
+		{
+			name: "clean filesystem",
+			cmds: func(t *testing.T, ctrl *gomock.Controller) []exec.CommandFunc {
+				return []exec.CommandFunc{
+					notLUKS(t, ctrl),
+					fsck(t, ctrl, "/dev/sda4", nil),
+				}
+			},
+			wantMounts: 1,
+		},
+		{
+			name: "filesystem repaired by fsck",
+			cmds: func(t *testing.T, ctrl *gomock.Controller) []exec.CommandFunc {
+				return []exec.CommandFunc{
+					notLUKS(t, ctrl),
+					fsck(t, ctrl, "/dev/sda4", exitError(t, 1)),
+				}
+			},
+			wantMounts: 1,
+		},
+		{
+			name: "unrecoverable filesystem is not mounted",
+			cmds: func(t *testing.T, ctrl *gomock.Controller) []exec.CommandFunc {
+				return []exec.CommandFunc{
+					notLUKS(t, ctrl),
+					fsck(t, ctrl, "/dev/sda4", exitError(t, 4)),
+				}
+			},
+			wantErrToBe: partitions.ErrFilesystemCorrupt,
+		},
+		{
+			name: "unrecoverable filesystem gets recreated",
+			cmds: func(t *testing.T, ctrl *gomock.Controller) []exec.CommandFunc {
+				return []exec.CommandFunc{
+					notLUKS(t, ctrl),
+					fsck(t, ctrl, "/dev/sda4", exitError(t, 4)),
+					notLUKS(t, ctrl),
+					mkfs(t, ctrl, "/dev/sda4", nil),
+					notLUKS(t, ctrl),
+					fsck(t, ctrl, "/dev/sda4", nil),
+				}
+			},
+			recreate:   true,
+			wantMounts: 1,
+		},
+		{
+			name: "recreating the filesystem fails",
+			cmds: func(t *testing.T, ctrl *gomock.Controller) []exec.CommandFunc {
+				return []exec.CommandFunc{
+					notLUKS(t, ctrl),
+					fsck(t, ctrl, "/dev/sda4", exitError(t, 4)),
+					notLUKS(t, ctrl),
+					mkfs(t, ctrl, "/dev/sda4", errMkfsFailed),
+				}
+			},
+			recreate:    true,
+			wantErrToBe: errMkfsFailed,
+		},
+		{
+			name: "encrypted clean filesystem",
+			enc:  enc,
+			cmds: func(t *testing.T, ctrl *gomock.Controller) []exec.CommandFunc {
+				return append(unlockLUKS(t, ctrl),
+					fsck(t, ctrl, "/dev/mapper/hh-identity", nil),
+				)
+			},
+			wantMounts:     1,
+			wantMapperPath: "/dev/mapper/hh-identity",
+		},
+		{
+			name: "encrypted filesystem repaired by fsck",
+			enc:  enc,
+			cmds: func(t *testing.T, ctrl *gomock.Controller) []exec.CommandFunc {
+				return append(unlockLUKS(t, ctrl),
+					fsck(t, ctrl, "/dev/mapper/hh-identity", exitError(t, 3)),
+				)
+			},
+			wantMounts:     1,
+			wantMapperPath: "/dev/mapper/hh-identity",
+		},
+		{
+			name: "encrypted unrecoverable filesystem gets recreated inside the LUKS container",
+			enc:  enc,
+			cmds: func(t *testing.T, ctrl *gomock.Controller) []exec.CommandFunc {
+				// the container stays unlocked, and it is never formatted again
+				return append(unlockLUKS(t, ctrl),
+					fsck(t, ctrl, "/dev/mapper/hh-identity", exitError(t, 4)),
+					mkfs(t, ctrl, "/dev/mapper/hh-identity", nil),
+					fsck(t, ctrl, "/dev/mapper/hh-identity", nil),
+				)
+			},
+			recreate:       true,
+			wantMounts:     1,
+			wantMapperPath: "/dev/mapper/hh-identity",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			defer ctrl.Finish()
+
+			oldCommand := exec.Command
+			defer func() {
+				exec.Command = oldCommand
+			}()
+			cmds := mockexec.NewMockCommands(tt.cmds(t, ctrl))
+			defer cmds.Finish()
+			exec.Command = cmds.Command()
+
+			oldMount, oldOpen := mountIdentityDevice, openIdentityPartition
+			defer func() {
+				mountIdentityDevice, openIdentityPartition = oldMount, oldOpen
+			}()
+			var mounts int
+			mountIdentityDevice = func(d *partitions.Device, _ ...partitions.MountOption) error {
+				if d.MapperPath != tt.wantMapperPath {
+					t.Errorf("mounting device with MapperPath = %q, want %q", d.MapperPath, tt.wantMapperPath)
+				}
+				mounts++
+				return nil
+			}
+			openIdentityPartition = func(*partitions.Device) (identity.IdentityPartition, error) {
+				return nil, nil
+			}
+
+			l := log.NewZapWrappedLogger(zap.NewNop())
+			devices := partitions.Devices{identityDevice()}
+			_, err := MountIdentityPartition(l, devices, "x86_64-kvm_x86_64-r0", tt.enc)
+			if tt.recreate && errors.Is(err, partitions.ErrFilesystemCorrupt) {
+				_, err = RecreateIdentityFilesystem(l, devices, "x86_64-kvm_x86_64-r0", tt.enc)
+			}
+			if !errors.Is(err, tt.wantErrToBe) {
+				t.Errorf("MountIdentityPartition() error = %v, wantErrToBe %v", err, tt.wantErrToBe)
+			}
+			if mounts != tt.wantMounts {
+				t.Errorf("MountIdentityPartition() mounted %d times, want %d", mounts, tt.wantMounts)
+			}
+		})
+	}
+}
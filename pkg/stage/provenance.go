@@ -0,0 +1,118 @@
+// Copyright 2023 Hedgehog
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package stage
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"net/http"
+	"strings"
+
+	"go.githedgehog.com/dasboot/pkg/version"
+)
+
+const (
+	// HeaderArtifactProvenance is the HTTP response header which carries the base64 encoded JSON
+	// of the `version.ArtifactProvenance` of a served artifact
+	HeaderArtifactProvenance = "Dasboot-Artifact-Provenance"
+
+	// HeaderArtifactProvenanceSignature is the HTTP response header which carries the base64 encoded
+	// detached signature over the decoded `HeaderArtifactProvenance` header. The signing certificate
+	// is sent in the `HeaderResponseSignatureCert` header.
+	HeaderArtifactProvenanceSignature = "Dasboot-Artifact-Provenance-Signature"
+
+	provenanceDigestPrefix = "sha256:"
+)
+
+var (
+	ErrProvenanceMissing        = errors.New("artifact provenance: provenance is missing")
+	ErrProvenanceInvalid        = errors.New("artifact provenance: invalid provenance")
+	ErrProvenanceDigestMismatch = errors.New("artifact provenance: digest mismatch")
+	ErrProvenanceNotInManifest  = errors.New("artifact provenance: not verified against the manifest")
+)
+
+// ProvenanceDigest returns the digest of `data` in the format which is used in `version.ArtifactProvenance`
+func ProvenanceDigest(data []byte) string {
+	cks := sha256.Sum256(data)
+	return provenanceDigestPrefix + hex.EncodeToString(cks[:])
+}
+
+// VerifyArtifactProvenance verifies the signed artifact provenance which was sent by the seeder in the
+// HTTP response headers. The signing certificate must be issued by a CA in `ca`. It returns the decoded
+// provenance on success. It does *not* verify the artifact digest itself.
+func VerifyArtifactProvenance(header http.Header, ca *x509.CertPool) (*version.ArtifactProvenance, error) {
+	provStr := header.Get(HeaderArtifactProvenance)
+	sigStr := header.Get(HeaderArtifactProvenanceSignature)
+	certStr := header.Get(HeaderResponseSignatureCert)
+	if provStr == "" || sigStr == "" || certStr == "" {
+		return nil, ErrProvenanceMissing
+	}
+	provBytes, err := base64.StdEncoding.DecodeString(provStr)
+	if err != nil {
+		return nil, fmt.Errorf("%w: decoding provenance: %w", ErrProvenanceInvalid, err)
+	}
+	if err := verifyDetachedSignature(sigStr, certStr, provBytes, ca); err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrProvenanceInvalid, err)
+	}
+	var ret version.ArtifactProvenance
+	if err := json.Unmarshal(provBytes, &ret); err != nil {
+		return nil, fmt.Errorf("%w: decoding provenance JSON: %w", ErrProvenanceInvalid, err)
+	}
+	if !strings.HasPrefix(ret.Digest, provenanceDigestPrefix) || ret.Size < 0 {
+		return nil, fmt.Errorf("%w: unsupported digest '%s' or size %d", ErrProvenanceInvalid, ret.Digest, ret.Size)
+	}
+	return &ret, nil
+}
+
+// provenanceWriter hashes the first `size` bytes which are written to it. It is
+// used to verify the digest of a downloaded artifact while it is being streamed.
+type provenanceWriter struct {
+	size    int64
+	written int64
+	h       hash.Hash
+}
+
+func newProvenanceWriter(size int64) *provenanceWriter {
+	return &provenanceWriter{size: size, h: sha256.New()}
+}
+
+func (w *provenanceWriter) Write(b []byte) (int, error) {
+	if remaining := w.size - w.written; remaining > 0 {
+		n := int64(len(b))
+		if n > remaining {
+			n = remaining
+		}
+		w.h.Write(b[:n])
+	}
+	w.written += int64(len(b))
+	return len(b), nil
+}
+
+func (w *provenanceWriter) verify(prov *version.ArtifactProvenance) error {
+	if w.written < w.size {
+		return fmt.Errorf("%w: artifact '%s' is %d bytes, but provenance requires at least %d bytes", ErrProvenanceDigestMismatch, prov.Artifact, w.written, w.size)
+	}
+	digest := provenanceDigestPrefix + hex.EncodeToString(w.h.Sum(nil))
+	if digest != prov.Digest {
+		return fmt.Errorf("%w: artifact '%s' has digest %s, but provenance requires %s", ErrProvenanceDigestMismatch, prov.Artifact, digest, prov.Digest)
+	}
+	return nil
+}
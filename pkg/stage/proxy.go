@@ -0,0 +1,183 @@
+// Copyright 2023 Hedgehog
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package stage
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+
+	"go.githedgehog.com/dasboot/pkg/stage0/config"
+)
+
+var ErrInvalidProxy = errors.New("proxy: invalid proxy settings")
+
+// onieProxyEnvVars are the environment variables which we consult in order to auto-detect
+// proxy settings. The onie_* variables are being set by ONIE from its discovery (DHCP),
+// and take precedence over the well-known variables.
+var onieProxyEnvVars = struct {
+	http, https, no []string
+}{
+	http:  []string{"onie_http_proxy", "http_proxy", "HTTP_PROXY"},
+	https: []string{"onie_https_proxy", "https_proxy", "HTTPS_PROXY"},
+	no:    []string{"onie_no_proxy", "no_proxy", "NO_PROXY"},
+}
+
+var getenv = os.Getenv
+
+func firstEnv(names []string) string {
+	for _, name := range names {
+		if val := strings.TrimSpace(getenv(name)); val != "" {
+			return val
+		}
+	}
+	return ""
+}
+
+// ProxyFromOnieEnv auto-detects proxy settings from the ONIE environment. It returns nil if no
+// proxy settings were found.
+func ProxyFromOnieEnv() *config.Proxy {
+	ret := &config.Proxy{
+		HTTPProxy:  firstEnv(onieProxyEnvVars.http),
+		HTTPSProxy: firstEnv(onieProxyEnvVars.https),
+		NoProxy:    firstEnv(onieProxyEnvVars.no),
+	}
+	if ret.HTTPProxy == "" && ret.HTTPSProxy == "" {
+		return nil
+	}
+	return ret
+}
+
+// ValidateProxy ensures that the proxy URLs in `p` are usable
+func ValidateProxy(p *config.Proxy) error {
+	if p == nil {
+		return nil
+	}
+	for _, s := range []string{p.HTTPProxy, p.HTTPSProxy} {
+		if s == "" {
+			continue
+		}
+		if _, err := parseProxyURL(s); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func parseProxyURL(s string) (*url.URL, error) {
+	// like Go and curl we accept proxies without a scheme, and default to http
+	if !strings.Contains(s, "://") {
+		s = "http://" + s
+	}
+	u, err := url.Parse(s)
+	if err != nil || u.Host == "" {
+		return nil, fmt.Errorf("%w: '%s': not a URL", ErrInvalidProxy, s)
+	}
+	switch u.Scheme {
+	case "http", "https", "socks5":
+	default:
+		return nil, fmt.Errorf("%w: '%s': unsupported scheme '%s'", ErrInvalidProxy, s, u.Scheme)
+	}
+	return u, nil
+}
+
+// ProxyFunc returns a function which can be used as the `Proxy` field of an `http.Transport`.
+// The settings must have been validated with `ValidateProxy` before.
+func ProxyFunc(p *config.Proxy) func(*http.Request) (*url.URL, error) {
+	if p == nil {
+		return nil
+	}
+	var httpProxy, httpsProxy *url.URL
+	if p.HTTPProxy != "" {
+		httpProxy, _ = parseProxyURL(p.HTTPProxy)
+	}
+	if p.HTTPSProxy != "" {
+		httpsProxy, _ = parseProxyURL(p.HTTPSProxy)
+	}
+	noProxy := strings.Split(p.NoProxy, ",")
+	return func(req *http.Request) (*url.URL, error) {
+		if matchesNoProxy(req.URL.Hostname(), noProxy) {
+			return nil, nil
+		}
+		if req.URL.Scheme == "https" {
+			return httpsProxy, nil
+		}
+		return httpProxy, nil
+	}
+}
+
+// matchesNoProxy returns true if `host` matches an entry in `noProxy`. Entries can be a "*",
+// IP addresses, CIDRs, or domain names which also match all of their subdomains.
+// Loopback and link-local addresses are never proxied.
+func matchesNoProxy(host string, noProxy []string) bool {
+	// IPv6 link-local addresses come with a zone
+	ipStr, _, _ := strings.Cut(host, "%")
+	ip := net.ParseIP(ipStr)
+	if ip != nil && (ip.IsLoopback() || ip.IsLinkLocalUnicast()) {
+		return true
+	}
+	if host == "localhost" {
+		return true
+	}
+	for _, entry := range noProxy {
+		entry = strings.ToLower(strings.TrimSpace(entry))
+		if entry == "" {
+			continue
+		}
+		if entry == "*" {
+			return true
+		}
+		if ip != nil {
+			if _, ipnet, err := net.ParseCIDR(entry); err == nil {
+				if ipnet.Contains(ip) {
+					return true
+				}
+				continue
+			}
+			if entryIP := net.ParseIP(entry); entryIP != nil && entryIP.Equal(ip) {
+				return true
+			}
+			continue
+		}
+		entry = strings.TrimPrefix(entry, ".")
+		h := strings.ToLower(host)
+		if h == entry || strings.HasSuffix(h, "."+entry) {
+			return true
+		}
+	}
+	return false
+}
+
+// WithProxy configures the proxy settings `p` on the transport of the HTTP client. It must be called
+// before any other transport wrappers like `WithResponseSignatureVerification` are applied. It is a
+// no-op if `p` is nil. It returns the same client for convenience.
+func WithProxy(hc *http.Client, p *config.Proxy) (*http.Client, error) {
+	if p == nil {
+		return hc, nil
+	}
+	if err := ValidateProxy(p); err != nil {
+		return hc, err
+	}
+	tr, ok := hc.Transport.(*http.Transport)
+	if !ok {
+		return hc, fmt.Errorf("%w: HTTP client transport is not an *http.Transport", ErrInvalidProxy)
+	}
+	tr.Proxy = ProxyFunc(p)
+	return hc, nil
+}
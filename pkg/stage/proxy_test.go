@@ -0,0 +1,148 @@
+// Copyright 2023 Hedgehog
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package stage
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+	"reflect"
+	"testing"
+
+	"go.githedgehog.com/dasboot/pkg/stage0/config"
+)
+
+func TestProxyFromOnieEnv(t *testing.T) {
+	tests := []struct {
+		name string
+		env  map[string]string
+		want *config.Proxy
+	}{
+		{
+			name: "nothing set",
+		},
+		{
+			name: "only no_proxy set",
+			env:  map[string]string{"no_proxy": "example.com"},
+		},
+		{
+			name: "ONIE settings take precedence",
+			env: map[string]string{
+				"onie_http_proxy": "http://onie-proxy:3128",
+				"http_proxy":      "http://proxy:3128",
+				"HTTPS_PROXY":     "http://proxy:3129",
+				"no_proxy":        "10.0.0.0/8",
+			},
+			want: &config.Proxy{
+				HTTPProxy:  "http://onie-proxy:3128",
+				HTTPSProxy: "http://proxy:3129",
+				NoProxy:    "10.0.0.0/8",
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			oldGetenv := getenv
+			defer func() {
+				getenv = oldGetenv
+			}()
+			getenv = func(key string) string {
+				return tt.env[key]
+			}
+			if got := ProxyFromOnieEnv(); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ProxyFromOnieEnv() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestValidateProxy(t *testing.T) {
+	tests := []struct {
+		name    string
+		p       *config.Proxy
+		wantErr error
+	}{
+		{
+			name: "nil",
+		},
+		{
+			name: "valid",
+			p:    &config.Proxy{HTTPProxy: "http://proxy:3128", HTTPSProxy: "socks5://proxy:1080"},
+		},
+		{
+			name: "no scheme",
+			p:    &config.Proxy{HTTPProxy: "proxy:3128"},
+		},
+		{
+			name:    "unsupported scheme",
+			p:       &config.Proxy{HTTPSProxy: "ftp://proxy:21"},
+			wantErr: ErrInvalidProxy,
+		},
+		{
+			name:    "garbage",
+			p:       &config.Proxy{HTTPProxy: "http://[::1"},
+			wantErr: ErrInvalidProxy,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := ValidateProxy(tt.p); !errors.Is(err, tt.wantErr) {
+				t.Errorf("ValidateProxy() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestProxyFunc(t *testing.T) {
+	p := &config.Proxy{
+		HTTPProxy:  "http://proxy:3128",
+		HTTPSProxy: "http://sproxy:3128",
+		NoProxy:    "internal.example.com, 10.0.0.0/8,192.168.1.1",
+	}
+	tests := []struct {
+		url  string
+		want string
+	}{
+		{url: "http://example.com/stage1", want: "http://proxy:3128"},
+		{url: "https://example.com/stage1", want: "http://sproxy:3128"},
+		{url: "https://seeder.internal.example.com/stage1"},
+		{url: "https://internal.example.com/stage1"},
+		{url: "https://10.1.2.3/stage1"},
+		{url: "https://192.168.1.1/stage1"},
+		{url: "https://192.168.1.2/stage1", want: "http://sproxy:3128"},
+		{url: "http://[fe80::1%25eth0]/stage0"},
+		{url: "http://127.0.0.1/stage0"},
+	}
+	f := ProxyFunc(p)
+	for _, tt := range tests {
+		t.Run(tt.url, func(t *testing.T) {
+			u, err := url.Parse(tt.url)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := f(&http.Request{URL: u})
+			if err != nil {
+				t.Fatal(err)
+			}
+			var gotStr string
+			if got != nil {
+				gotStr = got.String()
+			}
+			if gotStr != tt.want {
+				t.Errorf("proxy = %v, want %v", gotStr, tt.want)
+			}
+		})
+	}
+}
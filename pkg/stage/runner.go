@@ -0,0 +1,111 @@
+// Copyright 2023 Hedgehog
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package stage
+
+import (
+	"context"
+
+	"go.githedgehog.com/dasboot/pkg/log"
+	"go.uber.org/zap/zapcore"
+)
+
+// RunOptions are the options for running a stage in-process. They make it possible to embed
+// the stages as a library into other installers.
+type RunOptions struct {
+	// Logger is the logger that the stage uses. If this is set, the stage will not touch the global
+	// logger at all, and log settings (including syslog servers) are ignored.
+	Logger log.Interface
+
+	// LogSettings are the log settings from which the stage initializes the global logger if no
+	// Logger is set
+	LogSettings *LogSettings
+
+	// SkipNextStage will make the stage return after it has downloaded the next stage instead of
+	// executing it. The path to the next stage is returned in the Result.
+	SkipNextStage bool
+
+	// ForceBreakInstallLock makes stage 0 break the install lock of another running installation instead of failing
+	ForceBreakInstallLock bool
+}
+
+// RunOption sets options on RunOptions
+type RunOption func(*RunOptions)
+
+// RunOptionLogger makes the stage use `l` instead of initializing and replacing the global logger
+func RunOptionLogger(l log.Interface) RunOption {
+	return func(o *RunOptions) {
+		o.Logger = l
+	}
+}
+
+// RunOptionLogSettings sets the log settings from which the stage initializes the global logger
+func RunOptionLogSettings(settings *LogSettings) RunOption {
+	return func(o *RunOptions) {
+		o.LogSettings = settings
+	}
+}
+
+// RunOptionSkipNextStage makes the stage return after the next stage was downloaded instead of executing it
+func RunOptionSkipNextStage() RunOption {
+	return func(o *RunOptions) {
+		o.SkipNextStage = true
+	}
+}
+
+// RunOptionForceBreakInstallLock makes stage 0 break the install lock of another running installation
+func RunOptionForceBreakInstallLock() RunOption {
+	return func(o *RunOptions) {
+		o.ForceBreakInstallLock = true
+	}
+}
+
+// NewRunOptions creates RunOptions from `opts` with default log settings if none were given
+func NewRunOptions(opts ...RunOption) *RunOptions {
+	ret := &RunOptions{}
+	for _, opt := range opts {
+		opt(ret)
+	}
+	if ret.LogSettings == nil {
+		ret.LogSettings = &LogSettings{
+			Level:  zapcore.InfoLevel,
+			Format: "console",
+		}
+	}
+	return ret
+}
+
+// InitializeLogger returns the logger that the stage should use. If a logger was passed in the options, it is
+// being returned unchanged. Otherwise the global logger gets initialized from `settings`, and returned.
+func (o *RunOptions) InitializeLogger(ctx context.Context, settings *LogSettings) (log.Interface, error) {
+	if o.Logger != nil {
+		return o.Logger, nil
+	}
+	if err := InitializeGlobalLogger(ctx, settings); err != nil {
+		return nil, err
+	}
+	return log.L(), nil
+}
+
+// Result is the result of a stage which was run in-process
+type Result struct {
+	// StagingInfo is the staging information as it was passed on (or would have been passed on) to the next stage
+	StagingInfo *StagingInfo
+
+	// NextStagePath is the path to the downloaded next stage if there is one
+	NextStagePath string
+
+	// Timings is the timing summary of the stage execution
+	Timings *TimingSummary
+}
@@ -0,0 +1,64 @@
+// Copyright 2023 Hedgehog
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package stage
+
+import (
+	"context"
+	"testing"
+
+	"go.githedgehog.com/dasboot/pkg/log"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+func TestRunOptions(t *testing.T) {
+	t.Run("defaults", func(t *testing.T) {
+		o := NewRunOptions()
+		if o.LogSettings == nil {
+			t.Fatalf("expected default log settings")
+		}
+		if o.LogSettings.Level != zapcore.InfoLevel || o.LogSettings.Format != "console" {
+			t.Errorf("unexpected default log settings: %#v", o.LogSettings)
+		}
+		if o.Logger != nil || o.SkipNextStage {
+			t.Errorf("unexpected defaults: %#v", o)
+		}
+	})
+	t.Run("options", func(t *testing.T) {
+		settings := &LogSettings{Level: zapcore.DebugLevel, Format: "json"}
+		o := NewRunOptions(RunOptionLogSettings(settings), RunOptionSkipNextStage())
+		if o.LogSettings != settings {
+			t.Errorf("log settings not applied")
+		}
+		if !o.SkipNextStage {
+			t.Errorf("skip next stage not applied")
+		}
+	})
+	t.Run("injected logger leaves global logger alone", func(t *testing.T) {
+		injected := log.NewZapWrappedLogger(zap.NewNop())
+		before := log.L()
+		o := NewRunOptions(RunOptionLogger(injected), RunOptionLogSettings(&LogSettings{Level: zapcore.DebugLevel, Format: "json"}))
+		got, err := o.InitializeLogger(context.Background(), o.LogSettings)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if got != injected {
+			t.Errorf("expected injected logger to be returned")
+		}
+		if log.L() != before {
+			t.Errorf("global logger was replaced")
+		}
+	})
+}
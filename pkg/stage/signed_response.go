@@ -0,0 +1,213 @@
+// Copyright 2023 Hedgehog
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package stage
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	// HeaderResponseSignature is the HTTP response header which carries the base64 encoded detached
+	// signature of the response body
+	HeaderResponseSignature = "Dasboot-Signature"
+
+	// HeaderResponseSignatureCert is the HTTP response header which carries the base64 encoded DER
+	// certificate which was used to sign the response body
+	HeaderResponseSignatureCert = "Dasboot-Signature-Cert"
+
+	// HeaderResponseSignatureNonce is the HTTP request header which carries a random nonce of the client.
+	// The seeder signs it together with the response body, so that a signed response can only be used
+	// as the response to exactly this request.
+	HeaderResponseSignatureNonce = "Dasboot-Signature-Nonce"
+
+	// responseSignatureContext separates response signatures from all other signatures of the seeder
+	responseSignatureContext = "dasboot-response-signature-v2"
+)
+
+var (
+	ErrResponseNotSigned               = errors.New("response signature: response is not signed")
+	ErrResponseSignatureInvalid        = errors.New("response signature: invalid signature")
+	ErrResponseSignatureUnsupportedKey = errors.New("response signature: unsupported key type")
+)
+
+// artifactContentTypes are the content types of artifacts. The seeder signs all responses except for
+// artifacts, as they are large, and carry their own signed embedded configuration or provenance anyways.
+var artifactContentTypes = []string{
+	"application/octet-stream",
+}
+
+// IsSignedContentType returns true if responses with this content type are signed by the seeder,
+// which are all responses except for artifacts
+func IsSignedContentType(contentType string) bool {
+	for _, ct := range artifactContentTypes {
+		if strings.HasPrefix(contentType, ct) {
+			return false
+		}
+	}
+	return true
+}
+
+// ResponseSignatureDigest returns the digest over a response body which the seeder signs. It binds the body
+// to the path of the request and the nonce of the client from the `HeaderResponseSignatureNonce` header,
+// so that a signed response cannot be replayed as the response to a different request.
+func ResponseSignatureDigest(path string, nonce string, body []byte) []byte {
+	h := sha256.New()
+	for _, b := range [][]byte{[]byte(responseSignatureContext), []byte(path), []byte(nonce), body} {
+		// every part is length prefixed, so that the parts cannot be shifted into each other
+		binary.Write(h, binary.BigEndian, uint64(len(b))) //nolint: errcheck
+		h.Write(b)
+	}
+	return h.Sum(nil)
+}
+
+// VerifyResponseSignature verifies the detached signature of the HTTP response body to `req` as it was
+// created by the seeder. The signing certificate must be issued by a CA in `ca`. As the system
+// clock is not trustworthy during installation, expired signing certificates are accepted.
+func VerifyResponseSignature(req *http.Request, header http.Header, body []byte, ca *x509.CertPool) error {
+	sigStr := header.Get(HeaderResponseSignature)
+	certStr := header.Get(HeaderResponseSignatureCert)
+	if sigStr == "" || certStr == "" {
+		return ErrResponseNotSigned
+	}
+	return verifyDetachedSignatureDigest(sigStr, certStr, ResponseSignatureDigest(req.URL.Path, req.Header.Get(HeaderResponseSignatureNonce), body), ca)
+}
+
+// verifyDetachedSignature verifies the base64 encoded detached signature `sigStr` over `data`
+// with the base64 encoded DER certificate `certStr` which must be issued by a CA in `ca`.
+func verifyDetachedSignature(sigStr, certStr string, data []byte, ca *x509.CertPool) error {
+	cks := sha256.Sum256(data)
+	return verifyDetachedSignatureDigest(sigStr, certStr, cks[:], ca)
+}
+
+// verifyDetachedSignatureDigest is like verifyDetachedSignature, but the signature is over the SHA-256 `digest`
+func verifyDetachedSignatureDigest(sigStr, certStr string, digest []byte, ca *x509.CertPool) error {
+	sig, err := base64.StdEncoding.DecodeString(sigStr)
+	if err != nil {
+		return fmt.Errorf("%w: decoding signature: %w", ErrResponseSignatureInvalid, err)
+	}
+	certDER, err := base64.StdEncoding.DecodeString(certStr)
+	if err != nil {
+		return fmt.Errorf("%w: decoding certificate: %w", ErrResponseSignatureInvalid, err)
+	}
+	cert, err := x509.ParseCertificate(certDER)
+	if err != nil {
+		return fmt.Errorf("%w: parsing certificate: %w", ErrResponseSignatureInvalid, err)
+	}
+
+	// validate signing certificate against CA pool
+	opts := x509.VerifyOptions{
+		Intermediates: ca,
+		Roots:         ca,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+	}
+	if _, err := cert.Verify(opts); err != nil {
+		var certErr x509.CertificateInvalidError
+		if !errors.As(err, &certErr) || certErr.Reason != x509.Expired {
+			return fmt.Errorf("%w: certificate verification: %w", ErrResponseSignatureInvalid, err)
+		}
+		opts.CurrentTime = cert.NotBefore.Add(time.Second)
+		if _, err := cert.Verify(opts); err != nil {
+			return fmt.Errorf("%w: certificate verification: %w", ErrResponseSignatureInvalid, err)
+		}
+	}
+
+	pubKey, ok := cert.PublicKey.(*ecdsa.PublicKey)
+	if !ok {
+		return ErrResponseSignatureUnsupportedKey
+	}
+	if !ecdsa.VerifyASN1(pubKey, digest, sig) {
+		return ErrResponseSignatureInvalid
+	}
+	return nil
+}
+
+type artifactDownloadKey struct{}
+
+// withArtifactDownload marks the requests with context `ctx` as artifact downloads. Artifacts are the only
+// responses which are not signed, and they must be verified by other means like their provenance.
+func withArtifactDownload(ctx context.Context) context.Context {
+	return context.WithValue(ctx, artifactDownloadKey{}, true)
+}
+
+func isArtifactDownload(ctx context.Context) bool {
+	v, _ := ctx.Value(artifactDownloadKey{}).(bool)
+	return v
+}
+
+// WithResponseSignatureVerification wraps the transport of the HTTP client so that all responses must carry a
+// valid seeder signature for the request which they are the response to. The only exceptions are artifacts for
+// requests which were explicitly marked as artifact downloads. Responses which fail verification are turned into
+// errors. If `ca` is nil, the client is left alone. It returns the same client for convenience.
+func WithResponseSignatureVerification(hc *http.Client, ca *x509.CertPool) *http.Client {
+	if ca == nil {
+		return hc
+	}
+	next := hc.Transport
+	if next == nil {
+		next = http.DefaultTransport
+	}
+	hc.Transport = &verifyingTransport{next: next, ca: ca}
+	return hc
+}
+
+type verifyingTransport struct {
+	next http.RoundTripper
+	ca   *x509.CertPool
+}
+
+// RoundTrip implements http.RoundTripper
+func (t *verifyingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	nonce := make([]byte, 16)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, fmt.Errorf("response signature nonce: %w", err)
+	}
+	req = req.Clone(req.Context())
+	req.Header.Set(HeaderResponseSignatureNonce, hex.EncodeToString(nonce))
+
+	resp, err := t.next.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+
+	// artifacts carry no body signature, and there is no body to check for HEAD requests for them
+	if isArtifactDownload(req.Context()) && (req.Method == http.MethodHead || !IsSignedContentType(resp.Header.Get("Content-Type"))) {
+		return resp, nil
+	}
+
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	if err := VerifyResponseSignature(req, resp.Header, body, t.ca); err != nil {
+		return nil, fmt.Errorf("%s %s: %w", req.Method, req.URL.Redacted(), err)
+	}
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+	return resp, nil
+}
@@ -0,0 +1,211 @@
+// Copyright 2023 Hedgehog
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package stage
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testResponseSigner signs responses like the seeder does
+type testResponseSigner struct {
+	key     *ecdsa.PrivateKey
+	certDER []byte
+	pool    *x509.CertPool
+}
+
+func newTestResponseSigner(t *testing.T) *testResponseSigner {
+	t.Helper()
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caTmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTmpl, caTmpl, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caCert, err := x509.ParseCertificate(caDER)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "Test Signer"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+	}
+	certDER, err := x509.CreateCertificate(rand.Reader, tmpl, caCert, &key.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(caCert)
+	return &testResponseSigner{key: key, certDER: certDER, pool: pool}
+}
+
+// sign sets the signature headers for `body` as the response to a request for `path` with `nonce`
+func (s *testResponseSigner) sign(t *testing.T, w http.ResponseWriter, path string, nonce string, body []byte) {
+	t.Helper()
+	sig, err := ecdsa.SignASN1(rand.Reader, s.key, ResponseSignatureDigest(path, nonce, body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Header().Set(HeaderResponseSignature, base64.StdEncoding.EncodeToString(sig))
+	w.Header().Set(HeaderResponseSignatureCert, base64.StdEncoding.EncodeToString(s.certDER))
+}
+
+func TestWithResponseSignatureVerification(t *testing.T) {
+	signer := newTestResponseSigner(t)
+	caSrv := newTLSServerWithOwnCA(t, "bundle CA")
+	defer caSrv.Close()
+	bundle, err := json.Marshal(&CABundle{Version: 1, Certificates: [][]byte{caSrv.Certificate().Raw}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name        string
+		contentType string
+		sign        bool
+		signPath    string
+		signNonce   string
+		wantErr     error
+	}{
+		{
+			name:        "signed CA bundle",
+			contentType: "application/json",
+			sign:        true,
+		},
+		{
+			name:        "unsigned CA bundle",
+			contentType: "application/json",
+			wantErr:     ErrResponseNotSigned,
+		},
+		{
+			name:        "unsigned CA bundle relabelled as plain text",
+			contentType: "text/plain",
+			wantErr:     ErrResponseNotSigned,
+		},
+		{
+			name:        "unsigned CA bundle relabelled as an artifact",
+			contentType: "application/octet-stream",
+			wantErr:     ErrResponseNotSigned,
+		},
+		{
+			name:        "unsigned CA bundle without a content type",
+			contentType: "",
+			wantErr:     ErrResponseNotSigned,
+		},
+		{
+			name:        "signed response of a different endpoint",
+			contentType: "application/json",
+			sign:        true,
+			signPath:    "/stage0/ipam",
+			wantErr:     ErrResponseSignatureInvalid,
+		},
+		{
+			name:        "signed response replayed from a different request",
+			contentType: "application/json",
+			sign:        true,
+			signNonce:   "replayed",
+			wantErr:     ErrResponseSignatureInvalid,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.Header.Get(HeaderResponseSignatureNonce) == "" {
+					t.Errorf("request without a response signature nonce")
+				}
+				if tt.sign {
+					path, nonce := r.URL.Path, r.Header.Get(HeaderResponseSignatureNonce)
+					if tt.signPath != "" {
+						path = tt.signPath
+					}
+					if tt.signNonce != "" {
+						nonce = tt.signNonce
+					}
+					signer.sign(t, w, path, nonce, bundle)
+				}
+				w.Header()["Content-Type"] = []string{tt.contentType}
+				w.Write(bundle) //nolint: errcheck
+			}))
+			defer srv.Close()
+
+			hc := WithResponseSignatureVerification(&http.Client{}, signer.pool)
+			_, err := FetchCABundle(context.Background(), hc, srv.URL+"/ca-bundle")
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("FetchCABundle() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestWithResponseSignatureVerification_ArtifactDownload(t *testing.T) {
+	signer := newTestResponseSigner(t)
+	artifact := []byte("artifact")
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Write(artifact) //nolint: errcheck
+	}))
+	defer srv.Close()
+	hc := WithResponseSignatureVerification(&http.Client{}, signer.pool)
+
+	// artifact downloads are the only unsigned responses which are accepted
+	dest := filepath.Join(t.TempDir(), "artifact")
+	if err := Download(context.Background(), hc, srv.URL+"/artifact", dest, 0644, time.Minute); err != nil {
+		t.Fatalf("Download() error = %v", err)
+	}
+	if b, err := os.ReadFile(dest); err != nil || string(b) != string(artifact) {
+		t.Errorf("downloaded artifact = %q, %v, want %q", b, err, artifact)
+	}
+
+	// the same response for any other request is not
+	resp, err := hc.Get(srv.URL + "/artifact")
+	if err == nil {
+		resp.Body.Close()
+	}
+	if !errors.Is(err, ErrResponseNotSigned) {
+		t.Errorf("Get() error = %v, wantErr %v", err, ErrResponseNotSigned)
+	}
+}
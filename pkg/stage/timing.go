@@ -0,0 +1,252 @@
+// Copyright 2023 Hedgehog
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package stage
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"go.githedgehog.com/dasboot/pkg/log"
+	"go.githedgehog.com/dasboot/pkg/version"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// pathInstallReport is the file name of the install report in the staging directory
+const pathInstallReport = "install-report.json"
+
+// StepTiming is the timing of a single step of a stage like NTP synchronization, or a download
+type StepTiming struct {
+	Name     string    `json:"name"`
+	Start    time.Time `json:"start"`
+	Duration Duration  `json:"duration"`
+}
+
+// MarshalLogObject implements zapcore.ObjectMarshaler
+func (s StepTiming) MarshalLogObject(enc zapcore.ObjectEncoder) error {
+	enc.AddString("name", s.Name)
+	enc.AddDuration("duration", time.Duration(s.Duration))
+	return nil
+}
+
+type stepTimings []StepTiming
+
+// MarshalLogArray implements zapcore.ArrayMarshaler
+func (s stepTimings) MarshalLogArray(enc zapcore.ArrayEncoder) error {
+	for _, step := range s {
+		if err := enc.AppendObject(step); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// TimingSummary is the execution timing summary of a stage
+type TimingSummary struct {
+	Stage   string       `json:"stage"`
+	Version string       `json:"version,omitempty"`
+	Start   time.Time    `json:"start"`
+	Total   Duration     `json:"total"`
+	Success bool         `json:"success"`
+	Error   string       `json:"error,omitempty"`
+	Steps   []StepTiming `json:"steps,omitempty"`
+
+	// LoggingDegraded is set if any syslog destination was not healthy at the end of the stage
+	LoggingDegraded bool `json:"logging_degraded,omitempty"`
+
+	// TimeSync holds the NTP measurements if the stage synchronized the system clock
+	TimeSync *TimeSync `json:"time_sync,omitempty"`
+}
+
+// TimeSync holds the measurements of an NTP clock synchronization for time-related debugging
+type TimeSync struct {
+	Server             string   `json:"server,omitempty"`
+	Offset             Duration `json:"offset"`
+	Delay              Duration `json:"delay"`
+	Stratum            uint8    `json:"stratum,omitempty"`
+	RootDistance       Duration `json:"root_distance"`
+	Confirmed          bool     `json:"confirmed,omitempty"`
+	ConfirmationServer string   `json:"confirmation_server,omitempty"`
+	ConfirmationOffset Duration `json:"confirmation_offset,omitempty"`
+	Error              string   `json:"error,omitempty"`
+}
+
+// InstallReport is being written to the staging directory, and it collects the timing summaries of all stages
+type InstallReport struct {
+	Stages []*TimingSummary `json:"stages"`
+}
+
+// Duration is a time.Duration which is being JSON encoded in its human readable string form
+type Duration time.Duration
+
+// MarshalJSON implements json.Marshaler
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+// UnmarshalJSON implements json.Unmarshaler
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+	dur, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(dur)
+	return nil
+}
+
+type timingRecorder struct {
+	sync.Mutex
+	stage    string
+	start    time.Time
+	steps    []StepTiming
+	timeSync *TimeSync
+	finished bool
+}
+
+// timings is the global timing recorder of the currently executing stage
+var timings = &timingRecorder{}
+
+// timeNow can be swapped out in tests
+var timeNow = time.Now
+
+// StartTimings (re)starts the timing recorder for the stage `stageName`. It must be called at the very beginning
+// of the execution of a stage.
+func StartTimings(stageName string) {
+	timings.Lock()
+	defer timings.Unlock()
+	timings.stage = stageName
+	timings.start = timeNow()
+	timings.steps = nil
+	timings.timeSync = nil
+	timings.finished = false
+}
+
+// RecordTimeSync records the NTP measurements of the current stage, so that they become part of the install report
+func RecordTimeSync(ts *TimeSync) {
+	timings.Lock()
+	defer timings.Unlock()
+	timings.timeSync = ts
+}
+
+// Span starts the timing of the step `name`. The returned function must be called when the step finished.
+// The typical usage is `defer stage.Span("ntp")()`. Correlated loggers add the step to their messages until then.
+func Span(name string) func() {
+	start := timeNow()
+	restoreStep := log.SetStep(name)
+	return func() {
+		end := timeNow()
+		restoreStep()
+		timings.Lock()
+		defer timings.Unlock()
+		if timings.finished {
+			return
+		}
+		timings.steps = append(timings.steps, StepTiming{
+			Name:     name,
+			Start:    start,
+			Duration: Duration(end.Sub(start)),
+		})
+	}
+}
+
+// Timed executes `f` and records its execution time as the step `name`
+func Timed(name string, f func() error) error {
+	defer Span(name)()
+	return f()
+}
+
+// FinishTimings stops the timing recorder, emits the timing summary through `l` (or the global logger if nil), and appends it
+// to the install report in `stagingDir` if it is not empty. Only the first call has an effect, so it is safe to call
+// it on success before the next stage is executed, and additionally deferred for all error cases.
+func FinishTimings(l log.Interface, stagingDir string, runErr error) *TimingSummary {
+	timings.Lock()
+	if timings.finished {
+		timings.Unlock()
+		return nil
+	}
+	timings.finished = true
+	summary := &TimingSummary{
+		Stage:    timings.stage,
+		Version:  version.Version,
+		Start:    timings.start,
+		Total:    Duration(timeNow().Sub(timings.start)),
+		Success:  runErr == nil,
+		Steps:    append([]StepTiming(nil), timings.steps...),
+		TimeSync: timings.timeSync,
+	}
+	timings.Unlock()
+	if runErr != nil {
+		summary.Error = runErr.Error()
+	}
+
+	if l == nil {
+		l = log.L()
+	}
+	l.Info("Stage timing summary",
+		zap.String("stage", summary.Stage),
+		zap.Duration("total", time.Duration(summary.Total)),
+		zap.Bool("success", summary.Success),
+		zap.Array("steps", stepTimings(summary.Steps)),
+	)
+	if LoggingDegraded() {
+		summary.LoggingDegraded = true
+		l.Warn("Logging is degraded, not all syslog servers are reachable", zap.Reflect("syslogHealth", LoggingHealth()))
+	}
+
+	if stagingDir != "" {
+		if err := appendInstallReport(stagingDir, summary); err != nil {
+			l.Warn("Writing timing summary to install report failed", zap.String("stagingDir", stagingDir), zap.Error(err))
+		}
+	}
+	return summary
+}
+
+// ReadInstallReport reads the install report from the staging directory
+func ReadInstallReport(stagingDir string) (*InstallReport, error) {
+	b, err := os.ReadFile(filepath.Join(stagingDir, pathInstallReport))
+	if err != nil {
+		return nil, err
+	}
+	var ret InstallReport
+	if err := json.Unmarshal(b, &ret); err != nil {
+		return nil, fmt.Errorf("install report: JSON decoding: %w", err)
+	}
+	return &ret, nil
+}
+
+func appendInstallReport(stagingDir string, summary *TimingSummary) error {
+	report, err := ReadInstallReport(stagingDir)
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		report = &InstallReport{}
+	}
+	report.Stages = append(report.Stages, summary)
+	b, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return fmt.Errorf("install report: JSON encoding: %w", err)
+	}
+	return os.WriteFile(filepath.Join(stagingDir, pathInstallReport), b, 0644)
+}
@@ -0,0 +1,88 @@
+// Copyright 2023 Hedgehog
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package stage
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestTimings(t *testing.T) {
+	oldTimeNow := timeNow
+	defer func() {
+		timeNow = oldTimeNow
+	}()
+	now := time.Date(2023, 6, 1, 12, 0, 0, 0, time.UTC)
+	timeNow = func() time.Time {
+		return now
+	}
+	advance := func(d time.Duration) {
+		now = now.Add(d)
+	}
+
+	dir := t.TempDir()
+	for i, stageName := range []string{"stage0", "stage1"} {
+		StartTimings(stageName)
+		advance(time.Second)
+		endNTP := Span("ntp")
+		advance(2 * time.Second)
+		if i == 0 {
+			RecordTimeSync(&TimeSync{Server: "ntp.example.com", Offset: Duration(-90 * time.Second), Delay: Duration(12 * time.Millisecond), Stratum: 2})
+		}
+		endNTP()
+		endDownload := Span("download")
+		advance(3 * time.Second)
+		endDownload()
+
+		var runErr error
+		if i == 1 {
+			runErr = errors.New("failure")
+		}
+		got := FinishTimings(nil, dir, runErr)
+		if got == nil {
+			t.Fatalf("FinishTimings() returned nil")
+		}
+		if got.Stage != stageName || time.Duration(got.Total) != 6*time.Second || got.Success != (runErr == nil) {
+			t.Errorf("FinishTimings() = %+v", got)
+		}
+		if len(got.Steps) != 2 || got.Steps[0].Name != "ntp" || time.Duration(got.Steps[0].Duration) != 2*time.Second ||
+			got.Steps[1].Name != "download" || time.Duration(got.Steps[1].Duration) != 3*time.Second {
+			t.Errorf("FinishTimings() steps = %+v", got.Steps)
+		}
+
+		// subsequent calls have no effect
+		if got := FinishTimings(nil, dir, nil); got != nil {
+			t.Errorf("second FinishTimings() = %+v, want nil", got)
+		}
+	}
+
+	report, err := ReadInstallReport(dir)
+	if err != nil {
+		t.Fatalf("ReadInstallReport() error = %v", err)
+	}
+	if len(report.Stages) != 2 || report.Stages[0].Stage != "stage0" || report.Stages[1].Stage != "stage1" {
+		t.Fatalf("ReadInstallReport() = %+v", report)
+	}
+	if report.Stages[1].Error != "failure" || time.Duration(report.Stages[1].Steps[1].Duration) != 3*time.Second {
+		t.Errorf("ReadInstallReport() stage1 = %+v", report.Stages[1])
+	}
+	if ts := report.Stages[0].TimeSync; ts == nil || ts.Server != "ntp.example.com" || time.Duration(ts.Offset) != -90*time.Second || ts.Stratum != 2 {
+		t.Errorf("ReadInstallReport() stage0 time sync = %+v", ts)
+	}
+	if ts := report.Stages[1].TimeSync; ts != nil {
+		t.Errorf("ReadInstallReport() stage1 time sync = %+v, want nil", ts)
+	}
+}
@@ -0,0 +1,184 @@
+// Copyright 2023 Hedgehog
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package stage
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"go.githedgehog.com/dasboot/pkg/log"
+	"go.uber.org/zap"
+)
+
+// pathTLSSessionCache is the file within the staging directory where all stages
+// persist the TLS session tickets which they received from the seeder
+const pathTLSSessionCache = "tls-session-cache.json"
+
+// tlsSessionCacheCapacity is the maximum number of sessions which are held per cache
+const tlsSessionCacheCapacity = 32
+
+var ErrTLSSessionCache = errors.New("tls session cache")
+
+type tlsSessionCacheEntry struct {
+	Ticket []byte `json:"ticket"`
+	State  []byte `json:"state"`
+}
+
+// FileSessionCache is a tls.ClientSessionCache which persists all session tickets
+// to a file. This allows later stages to resume the TLS sessions which were
+// established by earlier stages which saves full handshakes with the seeder.
+//
+// Sessions are scoped by the client identity: a session which was established
+// without a client certificate must never be resumed by a client which is supposed
+// to authenticate with one (and vice versa) as the server would otherwise see
+// the identity of the original handshake.
+type FileSessionCache struct {
+	path     string
+	identity string
+	lru      tls.ClientSessionCache
+
+	mu      sync.Mutex
+	entries map[string]tlsSessionCacheEntry
+}
+
+var _ tls.ClientSessionCache = &FileSessionCache{}
+
+// NewFileSessionCache creates a new session cache which is backed by the file at `path`.
+// Sessions which were previously persisted there for the same client certificates are
+// loaded immediately. A missing or corrupt file is not an error: it simply results in
+// full TLS handshakes.
+func NewFileSessionCache(path string, certificates []tls.Certificate) *FileSessionCache {
+	c := &FileSessionCache{
+		path:     path,
+		identity: clientIdentity(certificates),
+		lru:      tls.NewLRUClientSessionCache(tlsSessionCacheCapacity),
+		entries:  make(map[string]tlsSessionCacheEntry),
+	}
+	if err := c.load(); err != nil && !errors.Is(err, os.ErrNotExist) {
+		log.L().Debug("Ignoring unusable TLS session cache", zap.String("path", path), zap.Error(err))
+	}
+	return c
+}
+
+// clientIdentity derives a short and stable identifier from the client certificates
+func clientIdentity(certificates []tls.Certificate) string {
+	if len(certificates) == 0 || len(certificates[0].Certificate) == 0 {
+		return "anonymous"
+	}
+	sum := sha256.Sum256(certificates[0].Certificate[0])
+	return hex.EncodeToString(sum[:8])
+}
+
+func (c *FileSessionCache) entryKey(sessionKey string) string {
+	return c.identity + "/" + sessionKey
+}
+
+// Get implements tls.ClientSessionCache
+func (c *FileSessionCache) Get(sessionKey string) (*tls.ClientSessionState, bool) {
+	return c.lru.Get(sessionKey)
+}
+
+// Put implements tls.ClientSessionCache
+func (c *FileSessionCache) Put(sessionKey string, cs *tls.ClientSessionState) {
+	c.lru.Put(sessionKey, cs)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if cs == nil {
+		delete(c.entries, c.entryKey(sessionKey))
+	} else {
+		ticket, state, err := cs.ResumptionState()
+		if err != nil || state == nil {
+			return
+		}
+		stateBytes, err := state.Bytes()
+		if err != nil {
+			return
+		}
+		c.entries[c.entryKey(sessionKey)] = tlsSessionCacheEntry{Ticket: ticket, State: stateBytes}
+	}
+	if err := c.save(); err != nil {
+		log.L().Debug("Failed to persist TLS session cache", zap.String("path", c.path), zap.Error(err))
+	}
+}
+
+// load must only be called during construction
+func (c *FileSessionCache) load() error {
+	b, err := os.ReadFile(c.path)
+	if err != nil {
+		return err
+	}
+	var entries map[string]tlsSessionCacheEntry
+	if err := json.Unmarshal(b, &entries); err != nil {
+		return fmt.Errorf("%w: %w", ErrTLSSessionCache, err)
+	}
+	prefix := c.identity + "/"
+	for key, entry := range entries {
+		c.entries[key] = entry
+		if len(key) <= len(prefix) || key[:len(prefix)] != prefix {
+			continue
+		}
+		state, err := tls.ParseSessionState(entry.State)
+		if err != nil {
+			continue
+		}
+		cs, err := tls.NewResumptionState(entry.Ticket, state)
+		if err != nil {
+			continue
+		}
+		c.lru.Put(key[len(prefix):], cs)
+	}
+	return nil
+}
+
+// save must be called with the lock held. As stages run one after another
+// we simply rewrite the whole file. The write is atomic though, so that a
+// crash never leaves a partially written file behind.
+func (c *FileSessionCache) save() error {
+	b, err := json.Marshal(c.entries)
+	if err != nil {
+		return err
+	}
+	tmp := c.path + ".tmp"
+	if err := os.WriteFile(tmp, b, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, c.path)
+}
+
+// TLSSessionCachePath returns the path of the TLS session cache within the staging directory
+func TLSSessionCachePath(stagingDir string) string {
+	return filepath.Join(stagingDir, pathTLSSessionCache)
+}
+
+// WithTLSSessionCache enables TLS session resumption for the HTTP client. The session tickets
+// are persisted at `path` so that they can be reused by subsequent stages.
+// NOTE: this must be called before the transport gets wrapped with WithResponseSignatureVerification
+func WithTLSSessionCache(hc *http.Client, path string) (*http.Client, error) {
+	tr, ok := hc.Transport.(*http.Transport)
+	if !ok || tr.TLSClientConfig == nil {
+		return hc, fmt.Errorf("%w: HTTP client transport is not an *http.Transport with a TLS configuration", ErrTLSSessionCache)
+	}
+	tr.TLSClientConfig.ClientSessionCache = NewFileSessionCache(path, tr.TLSClientConfig.Certificates)
+	return hc, nil
+}
@@ -0,0 +1,91 @@
+// Copyright 2023 Hedgehog
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package stage
+
+import (
+	"crypto/tls"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestWithTLSSessionCache(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok")) //nolint:errcheck
+	}))
+	defer srv.Close()
+
+	path := filepath.Join(t.TempDir(), pathTLSSessionCache)
+	get := func(t *testing.T) *tls.ConnectionState {
+		hc, err := SeederHTTPClient(srv.Certificate().Raw, nil)
+		if err != nil {
+			t.Fatalf("SeederHTTPClient() error = %v", err)
+		}
+		if _, err := WithTLSSessionCache(hc, path); err != nil {
+			t.Fatalf("WithTLSSessionCache() error = %v", err)
+		}
+		defer hc.CloseIdleConnections()
+		resp, err := hc.Get(srv.URL)
+		if err != nil {
+			t.Fatalf("Get() error = %v", err)
+		}
+		defer resp.Body.Close()
+		if _, err := io.ReadAll(resp.Body); err != nil {
+			t.Fatalf("reading body: %v", err)
+		}
+		return resp.TLS
+	}
+
+	// the first client (e.g. stage 0) must do a full handshake and persist its session
+	if cs := get(t); cs == nil || cs.DidResume {
+		t.Fatalf("first connection resumed a session or was not TLS")
+	}
+	if _, err := os.Stat(path); err != nil {
+		t.Fatalf("session cache was not persisted: %v", err)
+	}
+
+	// a new client (e.g. stage 1) must resume the session from the file
+	if cs := get(t); cs == nil || !cs.DidResume {
+		t.Fatalf("second connection did not resume the persisted session")
+	}
+
+	// a client with a different identity must not see the sessions
+	u, err := url.Parse(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := NewFileSessionCache(path, nil).Get(u.Hostname()); !ok {
+		t.Fatalf("session of anonymous client is not in the cache")
+	}
+	cache := NewFileSessionCache(path, []tls.Certificate{{Certificate: [][]byte{[]byte("other")}}})
+	if _, ok := cache.Get(u.Hostname()); ok {
+		t.Fatalf("session of anonymous client is visible to a different client identity")
+	}
+}
+
+func TestNewFileSessionCache_Corrupt(t *testing.T) {
+	path := filepath.Join(t.TempDir(), pathTLSSessionCache)
+	if err := os.WriteFile(path, []byte("garbage"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	cache := NewFileSessionCache(path, nil)
+	if _, ok := cache.Get("anything"); ok {
+		t.Fatalf("corrupt cache returned a session")
+	}
+}
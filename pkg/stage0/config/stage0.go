@@ -15,8 +15,19 @@
 package config
 
 import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.githedgehog.com/dasboot/pkg/banner"
 	"go.githedgehog.com/dasboot/pkg/config"
+	"go.githedgehog.com/dasboot/pkg/log/syslog"
+	"go.githedgehog.com/dasboot/pkg/partitions"
 	"go.githedgehog.com/dasboot/pkg/partitions/location"
+	"go.githedgehog.com/dasboot/pkg/version"
 )
 
 var _ config.EmbeddedConfig = &Stage0{}
@@ -43,51 +54,326 @@ type Stage0 struct {
 	// CA is a DER encoded root certificate with which server connections to the control plane must be validated.
 	// This can be empty if it is being dictated to be derived from attached USB sticks.
 	// Either must be present though.
-	CA []byte `json:"ca,omitempty" yaml:"ca,omitempty"`
+	CA []byte `json:"ca,omitempty" yaml:"ca,omitempty" merge:"replace"`
 
 	// OnieHeaders are the ONIE request headers as they were made by ONIE when downloading the stage 0 installer
-	OnieHeaders *OnieHeaders `json:"onie_headers,omitempty" yaml:"onie_headers,omitempty"`
+	OnieHeaders *OnieHeaders `json:"onie_headers,omitempty" yaml:"onie_headers,omitempty" merge:"-"`
 
 	// IPAMURL is the URL where the installer is going to get its IP and VLAN configuration from.
-	IPAMURL string `json:"ipam_url,omitempty" yaml:"ipam_url,omitempty"`
+	IPAMURL string `json:"ipam_url,omitempty" yaml:"ipam_url,omitempty" merge:"set"`
 
 	// Stage1URL is the URL where the installer is going to continue if stage 0 execution was successful with stage 1.
-	Stage1URL string `json:"stage1_url,omitempty" yaml:"ipam_url,omitempty"`
+	Stage1URL string `json:"stage1_url,omitempty" yaml:"ipam_url,omitempty" merge:"set,reset=Stage1Pin,reset=Stage1Mirrors"`
+
+	// Stage1Pin pins the digest of the stage 1 installer. If it is set, stage 0 will refuse to execute a
+	// stage 1 installer which does not match it.
+	Stage1Pin *version.ArtifactPin `json:"stage1_pin,omitempty" yaml:"stage1_pin,omitempty" merge:"set"`
+
+	// Stage1Mirrors are additional URLs which serve the same stage 1 installer as `Stage1URL`. Stage 0 ranks
+	// all of them by latency and falls back to the next one if a download fails.
+	Stage1Mirrors []string `json:"stage1_mirrors,omitempty" yaml:"stage1_mirrors,omitempty" merge:"replace"`
+
+	// CABundleURL is the URL of the server CA bundle on the seeder. Stage 0 pins the bundle in the staging area,
+	// and all later stages trust the CAs of the bundle instead of `CA` for the seeder. This is how a rotation of
+	// the server CA reaches installations which are in progress.
+	CABundleURL string `json:"ca_bundle_url,omitempty" yaml:"ca_bundle_url,omitempty" merge:"set"`
 
 	// Services holds a collection of services settings which the stage 0 installer makes use of to configure the
 	// executing system
-	Services Services `json:"services,omitempty" yaml:"services,omitempty"`
+	Services Services `json:"services,omitempty" yaml:"services,omitempty" merge:"deep"`
 
 	// Location will be served if stage0 was served over a link-local request and the seeder can determine
 	// the location information by configuration
-	Location *location.Info `json:"location,omitempty" yaml:"location,omitempty"`
+	Location *location.Info `json:"location,omitempty" yaml:"location,omitempty" merge:"set"`
+
+	// Banner holds operator information which stage 0 prints on the console and to syslog
+	Banner *banner.Banner `json:"banner,omitempty" yaml:"banner,omitempty" merge:"set"`
+
+	// Proxy holds HTTP proxy settings which all stages use for their HTTP clients. If this is not set,
+	// stage 0 tries to auto-detect the proxy settings from the ONIE environment.
+	Proxy *Proxy `json:"proxy,omitempty" yaml:"proxy,omitempty" merge:"set"`
+
+	// RequireProvenance requires that all stage artifacts which are downloaded from the seeder come with a
+	// signed artifact provenance which matches the downloaded artifact
+	RequireProvenance bool `json:"require_provenance,omitempty" yaml:"require_provenance,omitempty" merge:"set"`
+
+	// RequireManifest requires that the artifact provenance of all stage artifacts says that the seeder verified
+	// them against its signed artifact manifest. It only has an effect together with RequireProvenance.
+	RequireManifest bool `json:"require_manifest,omitempty" yaml:"require_manifest,omitempty" merge:"set"`
+
+	// MACAllowlist maps VLAN IDs to the MAC address which the port security of the fabric allows on that VLAN
+	// during provisioning. Stage 0 configures the network interface for that VLAN with this MAC address, and
+	// stage 2 rolls it back after the installation. The VLAN ID 0 stands for the untagged network interface.
+	MACAllowlist map[uint16]string `json:"mac_allowlist,omitempty" yaml:"mac_allowlist,omitempty" merge:"replace"`
+
+	// Recovery holds the policy which stops the installer from retrying forever if installations keep failing
+	Recovery *Recovery `json:"recovery,omitempty" yaml:"recovery,omitempty" merge:"set"`
+
+	// Staging holds the settings for the staging area in which all stages store their downloads
+	Staging *Staging `json:"staging,omitempty" yaml:"staging,omitempty" merge:"deep"`
+
+	// MultipathPolicy decides how all stages treat dm-multipath devices when they discover disks. See
+	// `partitions.MultipathPolicy` for the possible values. An empty value selects the default policy.
+	MultipathPolicy string `json:"multipath_policy,omitempty" yaml:"multipath_policy,omitempty" merge:"set"`
+
+	// DiskSelection selects the disk on which all stages create the NOS and the identity partition. The disk
+	// which holds the ONIE partition is being used if it is not set.
+	DiskSelection *partitions.DiskSelectionPolicy `json:"disk_selection,omitempty" yaml:"disk_selection,omitempty" merge:"set"`
+
+	// DHCPFallback makes stage 0 request a DHCP lease on its network interfaces if the IPAM request fails, or if
+	// none of the addresses of the IPAM response work. It then continues with stage 1 as usual.
+	DHCPFallback bool `json:"dhcp_fallback,omitempty" yaml:"dhcp_fallback,omitempty" merge:"set"`
+
+	// PlatformSupport references a bundle with kernel modules and firmware which stage 0 loads before it
+	// configures the network. It is only set for platforms which need it.
+	PlatformSupport *PlatformSupport `json:"platform_support,omitempty" yaml:"platform_support,omitempty" merge:"set"`
+
+	// LabMode is the insecure mode of the seeder for throwaway lab environments. The seeder serves the later stages
+	// over plain HTTP, and approves all registrations with a stub CA. Stages only accept plain HTTP URLs for the
+	// seeder if it is set, and it can only be set in the embedded configuration and never by an override.
+	LabMode bool `json:"lab_mode,omitempty" yaml:"lab_mode,omitempty" merge:"-"`
 
 	// SignatureCA holds the optional DER encoded CA certificate which signed 'signature_cert'. This should better
 	// be derived from a different place.
-	SignatureCA []byte `json:"signature_ca,omitempty" yaml:"signature_ca,omitempty"`
+	SignatureCA []byte `json:"signature_ca,omitempty" yaml:"signature_ca,omitempty" merge:"replace"`
 
 	// SignatureCert holds the DER encoded X509 certificate with which the signature of the embedded config
 	// can be validated
-	SignatureCert []byte `json:"signature_cert,omitempty" yaml:"signature_cert,omitempty"`
+	SignatureCert []byte `json:"signature_cert,omitempty" yaml:"signature_cert,omitempty" merge:"-"`
 
 	// Version is tracking the format of this structure itself
-	Version config.ConfigVersion `json:"version,omitempty" yaml:"version,omitempty"`
+	Version config.ConfigVersion `json:"version,omitempty" yaml:"version,omitempty" merge:"-"`
 }
 
 // Services holds a collection of services settings which the stage 0 installer makes use of to configure the
 // executing system
 type Services struct {
 	// ControlVIP is the IP address of the control plane virtual IP address
-	ControlVIP string `json:"control_vip,omitempty" yaml:"control_vip,omitempty"`
+	ControlVIP string `json:"control_vip,omitempty" yaml:"control_vip,omitempty" merge:"set"`
 
 	// SyslogServers is a list of syslog servers which the stage 0 installer should configure
-	SyslogServers []string `json:"syslog_servers,omitempty" yaml:"syslog_servers,omitempty"`
+	SyslogServers []string `json:"syslog_servers,omitempty" yaml:"syslog_servers,omitempty" merge:"replace"`
+
+	// SyslogFraming is the framing of syslog messages which the syslog servers expect: "non-transparent" (LF
+	// delimited) or "octet-counting" as of RFC 6587. It defaults to "non-transparent".
+	SyslogFraming string `json:"syslog_framing,omitempty" yaml:"syslog_framing,omitempty" merge:"set"`
+
+	// SyslogTransport is the transport to the syslog servers: "udp", "tcp" or "tcp+tls". It defaults to "udp".
+	SyslogTransport string `json:"syslog_transport,omitempty" yaml:"syslog_transport,omitempty" merge:"set"`
+
+	// SyslogCA is a PEM encoded CA bundle with which the syslog servers are validated over TLS. If it is empty,
+	// the system CAs are being used.
+	SyslogCA []byte `json:"syslog_ca,omitempty" yaml:"syslog_ca,omitempty" merge:"replace"`
 
 	// NTPServers is a list of NTP servers which the stage 0 installer should configure
-	NTPServers []string `json:"ntp_servers,omitempty" yaml:"ntp_servers,omitempty"`
+	NTPServers []string `json:"ntp_servers,omitempty" yaml:"ntp_servers,omitempty" merge:"replace"`
+
+	// NTPMaxOffset is the maximum clock offset as a duration like "24h" which stage 0 accepts from a single NTP
+	// query round. A larger offset is treated as suspicious, and must be confirmed by a second round before the
+	// system clock is set. It is disabled if empty or zero.
+	NTPMaxOffset string `json:"ntp_max_offset,omitempty" yaml:"ntp_max_offset,omitempty" merge:"set"`
+
+	// LLDPWait is the time as a duration like "35s" which stage 0 listens for LLDP neighbours on all network
+	// interfaces before it issues the IPAM request. LLDP agents typically announce themselves every 30 seconds.
+	// The neighbours let the seeder find the location of the device. It is disabled if empty or zero.
+	LLDPWait string `json:"lldp_wait,omitempty" yaml:"lldp_wait,omitempty" merge:"set"`
+
+	// DNSServers is a list of DNS servers which the stage 0 installer should configure in resolv.conf
+	DNSServers []string `json:"dns_servers,omitempty" yaml:"dns_servers,omitempty" merge:"replace"`
+
+	// DNSSearch is a list of DNS search domains which the stage 0 installer should configure in resolv.conf
+	DNSSearch []string `json:"dns_search,omitempty" yaml:"dns_search,omitempty" merge:"replace"`
+}
+
+// Proxy holds HTTP proxy settings with the same semantics as the well-known `http_proxy`, `https_proxy`
+// and `no_proxy` environment variables
+type Proxy struct {
+	// HTTPProxy is the proxy URL for HTTP requests
+	HTTPProxy string `json:"http_proxy,omitempty" yaml:"http_proxy,omitempty"`
+
+	// HTTPSProxy is the proxy URL for HTTPS requests
+	HTTPSProxy string `json:"https_proxy,omitempty" yaml:"https_proxy,omitempty"`
+
+	// NoProxy is a comma-separated list of hosts, domains, IP addresses or CIDRs which must not be proxied
+	NoProxy string `json:"no_proxy,omitempty" yaml:"no_proxy,omitempty"`
 }
 
 // OnieHeaders is being included by the control plane (seeder) when generating the
+// RecoveryAction is the action which stage 0 takes once it enters recovery mode
+type RecoveryAction string
+
+const (
+	// RecoveryActionStop stops the ONIE discovery, so that ONIE does not run the installer again
+	RecoveryActionStop RecoveryAction = "stop"
+
+	// RecoveryActionRescue stops the ONIE discovery, and additionally boots ONIE into rescue mode from now on
+	RecoveryActionRescue RecoveryAction = "rescue"
+)
+
+type Recovery struct {
+	// MaxConsecutiveFailures is the number of consecutive failed installations after which stage 0 enters recovery mode
+	// instead of trying again. Zero disables recovery mode.
+	MaxConsecutiveFailures uint `json:"max_consecutive_failures,omitempty" yaml:"max_consecutive_failures,omitempty"`
+
+	// Action is the action to take once recovery mode is entered. It defaults to "stop".
+	Action RecoveryAction `json:"action,omitempty" yaml:"action,omitempty"`
+
+	// ReportURL is the URL where stage 0 reports to the seeder that it entered recovery mode
+	ReportURL string `json:"report_url,omitempty" yaml:"report_url,omitempty"`
+}
+
+// Enabled returns true if recovery mode can be triggered at all
+func (r *Recovery) Enabled() bool {
+	return r != nil && r.MaxConsecutiveFailures > 0
+}
+
+// Validate validates the recovery policy
+func (r *Recovery) Validate() error {
+	if r == nil {
+		return nil
+	}
+	switch r.Action {
+	case "", RecoveryActionStop, RecoveryActionRescue:
+		return nil
+	default:
+		return fmt.Errorf("%w: '%s'", ErrInvalidRecoveryAction, r.Action)
+	}
+}
+
+var ErrInvalidRecoveryAction = errors.New("stage0 config: invalid recovery action")
+
+// Staging holds the settings for the staging area. Stage 0 creates the staging area as a new directory within
+// `BaseDir`, and mounts a dedicated tmpfs onto it.
+type Staging struct {
+	// BaseDir is the directory in which the staging area directory gets created. It defaults to the system
+	// temporary directory, which is too small on some platforms.
+	BaseDir string `json:"base_dir,omitempty" yaml:"base_dir,omitempty" merge:"set"`
+
+	// TmpfsSize limits the size of the tmpfs which gets mounted onto the staging area. It is either a size in bytes
+	// with an optional "k", "m" or "g" suffix, or a percentage of the system memory like "75%". It defaults to the
+	// kernel default which is half of the system memory. "0" disables the tmpfs, and the staging area is backed by
+	// whatever backs `BaseDir`.
+	TmpfsSize string `json:"tmpfs_size,omitempty" yaml:"tmpfs_size,omitempty" merge:"set"`
+}
+
+var ErrInvalidTmpfsSize = errors.New("stage0 config: invalid tmpfs size")
+
+// ParseTmpfsSize parses a tmpfs size as it is accepted by `Staging.TmpfsSize`. It returns either the size
+// in bytes, or a percentage of the system memory.
+func ParseTmpfsSize(s string) (bytes uint64, percent uint64, err error) {
+	if s == "" {
+		return 0, 0, fmt.Errorf("%w: empty", ErrInvalidTmpfsSize)
+	}
+	if num, ok := strings.CutSuffix(s, "%"); ok {
+		percent, err := strconv.ParseUint(num, 10, 64)
+		if err != nil || percent == 0 || percent > 100 {
+			return 0, 0, fmt.Errorf("%w: '%s': percentage must be between 1 and 100", ErrInvalidTmpfsSize, s)
+		}
+		return 0, percent, nil
+	}
+	var shift uint
+	switch strings.ToLower(s[len(s)-1:]) {
+	case "k":
+		shift = 10
+	case "m":
+		shift = 20
+	case "g":
+		shift = 30
+	}
+	num := s
+	if shift > 0 {
+		num = s[:len(s)-1]
+	}
+	bytes, err = strconv.ParseUint(num, 10, 64)
+	if err != nil {
+		return 0, 0, fmt.Errorf("%w: '%s': %w", ErrInvalidTmpfsSize, s, err)
+	}
+	if bytes > (1<<64-1)>>shift {
+		return 0, 0, fmt.Errorf("%w: '%s': out of range", ErrInvalidTmpfsSize, s)
+	}
+	return bytes << shift, 0, nil
+}
+
+// Validate validates the staging area settings
+func (s *Staging) Validate() error {
+	if s == nil {
+		return nil
+	}
+	if s.BaseDir != "" && !filepath.IsAbs(s.BaseDir) {
+		return fmt.Errorf("stage0 config: staging base directory '%s' must be an absolute path", s.BaseDir)
+	}
+	if s.TmpfsSize != "" {
+		if _, _, err := ParseTmpfsSize(s.TmpfsSize); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+var ErrInvalidNTPMaxOffset = errors.New("stage0 config: invalid NTP maximum offset")
+
+// ParseNTPMaxOffset parses the maximum NTP clock offset as it is accepted by `Services.NTPMaxOffset`
+func ParseNTPMaxOffset(s string) (time.Duration, error) {
+	if s == "" {
+		return 0, nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return 0, fmt.Errorf("%w: '%s': %w", ErrInvalidNTPMaxOffset, s, err)
+	}
+	if d < 0 {
+		return 0, fmt.Errorf("%w: '%s': must not be negative", ErrInvalidNTPMaxOffset, s)
+	}
+	return d, nil
+}
+
+var ErrInvalidLLDPWait = errors.New("stage0 config: invalid LLDP wait time")
+
+// ParseLLDPWait parses the time to listen for LLDP neighbours as it is accepted by `Services.LLDPWait`
+func ParseLLDPWait(s string) (time.Duration, error) {
+	if s == "" {
+		return 0, nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return 0, fmt.Errorf("%w: '%s': %w", ErrInvalidLLDPWait, s, err)
+	}
+	if d < 0 {
+		return 0, fmt.Errorf("%w: '%s': must not be negative", ErrInvalidLLDPWait, s)
+	}
+	return d, nil
+}
+
+// PlatformSupport references a platform support bundle. The bundle is a gzipped tar archive which holds kernel
+// modules in a "modules" directory, and firmware files in a "firmware" directory. An optional "modules/order"
+// file lists the modules in the order in which they must be loaded, optionally followed by module parameters.
+type PlatformSupport struct {
+	// Platform is the ONIE platform string of the platform that the bundle is for
+	Platform string `json:"platform,omitempty" yaml:"platform,omitempty"`
+
+	// URL is where to download the bundle from
+	URL string `json:"url" yaml:"url"`
+
+	// Pin is the digest of the bundle. It is mandatory as the bundle is served over plain HTTP.
+	Pin *version.ArtifactPin `json:"pin" yaml:"pin"`
+}
+
+var ErrInvalidPlatformSupport = errors.New("stage0 config: invalid platform support bundle")
+
+// Validate validates the platform support bundle settings
+func (ps *PlatformSupport) Validate() error {
+	if ps == nil {
+		return nil
+	}
+	if ps.URL == "" {
+		return fmt.Errorf("%w: missing URL", ErrInvalidPlatformSupport)
+	}
+	if ps.Pin == nil {
+		return fmt.Errorf("%w: missing pin", ErrInvalidPlatformSupport)
+	}
+	return nil
+}
+
 type OnieHeaders struct {
 	// SerialNumber is the serial number as stored in the EEPROM
 	SerialNumber string `json:"ONIE-SERIAL-NUMBER,omitempty" yaml:"ONIE-SERIAL-NUMBER,omitempty"`
@@ -121,8 +407,35 @@ func (c *Stage0) Cert() []byte {
 
 // Validate implements config.EmbeddedConfig
 func (c *Stage0) Validate() error {
-	// TODO: implement
-	return nil
+	// TODO: implement the rest
+	if err := c.Staging.Validate(); err != nil {
+		return err
+	}
+	if err := c.PlatformSupport.Validate(); err != nil {
+		return err
+	}
+	if _, err := ParseNTPMaxOffset(c.Services.NTPMaxOffset); err != nil {
+		return err
+	}
+	if _, err := ParseLLDPWait(c.Services.LLDPWait); err != nil {
+		return err
+	}
+	if _, err := partitions.ParseMultipathPolicy(c.MultipathPolicy); err != nil {
+		return fmt.Errorf("stage0 config: %w", err)
+	}
+	if err := c.DiskSelection.Validate(); err != nil {
+		return fmt.Errorf("stage0 config: %w", err)
+	}
+	if _, err := syslog.ParseFraming(c.Services.SyslogFraming); err != nil {
+		return fmt.Errorf("stage0 config: %w", err)
+	}
+	if _, err := syslog.ParseTransport(c.Services.SyslogTransport); err != nil {
+		return fmt.Errorf("stage0 config: %w", err)
+	}
+	if err := config.ValidateSecureURLs(c.LabMode, append([]string{c.Stage1URL, c.CABundleURL}, c.Stage1Mirrors...)...); err != nil {
+		return fmt.Errorf("stage0 config: %w", err)
+	}
+	return c.Recovery.Validate()
 }
 
 // ConfigVersion implements config.EmbeddedConfig
@@ -0,0 +1,93 @@
+// Copyright 2023 Hedgehog
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+
+	"go.githedgehog.com/dasboot/pkg/config"
+)
+
+func TestParseTmpfsSize(t *testing.T) {
+	tests := []struct {
+		name        string
+		s           string
+		wantBytes   uint64
+		wantPercent uint64
+		wantErr     bool
+	}{
+		{name: "bytes", s: "1048576", wantBytes: 1 << 20},
+		{name: "kilobytes", s: "512k", wantBytes: 512 << 10},
+		{name: "megabytes", s: "768M", wantBytes: 768 << 20},
+		{name: "gigabytes", s: "2g", wantBytes: 2 << 30},
+		{name: "zero disables", s: "0", wantBytes: 0},
+		{name: "percentage", s: "75%", wantPercent: 75},
+		{name: "empty", s: "", wantErr: true},
+		{name: "percentage out of range", s: "101%", wantErr: true},
+		{name: "zero percent", s: "0%", wantErr: true},
+		{name: "unknown suffix", s: "2t", wantErr: true},
+		{name: "suffix only", s: "g", wantErr: true},
+		{name: "overflow", s: "18446744073709551615g", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			gotBytes, gotPercent, err := ParseTmpfsSize(tt.s)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseTmpfsSize() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil && !errors.Is(err, ErrInvalidTmpfsSize) {
+				t.Errorf("ParseTmpfsSize() error = %v, want ErrInvalidTmpfsSize", err)
+			}
+			if gotBytes != tt.wantBytes || gotPercent != tt.wantPercent {
+				t.Errorf("ParseTmpfsSize() = %d, %d%%, want %d, %d%%", gotBytes, gotPercent, tt.wantBytes, tt.wantPercent)
+			}
+		})
+	}
+}
+
+func TestMergeConfigsStaging(t *testing.T) {
+	embedded := &Stage0{Staging: &Staging{BaseDir: "/tmp", TmpfsSize: "50%"}}
+	got := MergeConfigs(embedded, &Stage0{Staging: &Staging{TmpfsSize: "1g"}})
+	if got.Staging.BaseDir != "/tmp" || got.Staging.TmpfsSize != "1g" {
+		t.Errorf("MergeConfigs() staging = %#v", got.Staging)
+	}
+	if embedded.Staging.TmpfsSize != "50%" {
+		t.Errorf("MergeConfigs() modified the embedded config: %#v", embedded.Staging)
+	}
+}
+
+func TestMergeConfigsServices(t *testing.T) {
+	embedded := &Stage0{Services: Services{ControlVIP: "192.168.42.1", DNSServers: []string{"192.168.42.1"}}}
+	got := MergeConfigs(embedded, &Stage0{Services: Services{DNSServers: []string{"10.0.0.53"}, DNSSearch: []string{"fabric.local"}}})
+	want := Services{ControlVIP: "192.168.42.1", DNSServers: []string{"10.0.0.53"}, DNSSearch: []string{"fabric.local"}}
+	if !reflect.DeepEqual(got.Services, want) {
+		t.Errorf("MergeConfigs() services = %#v, want %#v", got.Services, want)
+	}
+}
+
+func TestMergeConfigsLabMode(t *testing.T) {
+	got := MergeConfigs(&Stage0{}, &Stage0{LabMode: true})
+	if got.LabMode {
+		t.Errorf("MergeConfigs() enabled lab mode from an override")
+	}
+}
+
+func TestMergeTags(t *testing.T) {
+	if err := config.ValidateMergeTags[Stage0](); err != nil {
+		t.Errorf("every field of the configuration must have a merge tag: %v", err)
+	}
+}
@@ -21,7 +21,7 @@ import (
 	"os"
 	"strings"
 
-	"go.githedgehog.com/dasboot/pkg/partitions/location"
+	"go.githedgehog.com/dasboot/pkg/config"
 	"gopkg.in/yaml.v3"
 )
 
@@ -72,62 +72,8 @@ func ReadFrom(r io.Reader, typ FileType) (*Stage0, error) {
 	return &cfg, nil
 }
 
+// MergeConfigs merges the `override` into a copy of the `embedded` configuration. How every field gets merged is
+// decided by its merge tag, see `config.Merge`.
 func MergeConfigs(embedded *Stage0, override *Stage0) *Stage0 {
-	// clone the values from the embedded config
-	// so that we don't override the arguments for the caller
-	// also short-circuit things to avoid pointer shenanigans
-	if embedded == nil {
-		return nil
-	}
-	ret := *embedded
-	if override == nil {
-		return &ret
-	}
-
-	// CA can be overridden
-	if len(override.CA) > 0 {
-		ret.CA = make([]byte, len(override.CA))
-		copy(ret.CA, override.CA)
-	}
-
-	// SignatureCA can be overridden
-	if len(override.SignatureCA) > 0 {
-		ret.SignatureCA = make([]byte, len(override.SignatureCA))
-		copy(ret.SignatureCA, override.SignatureCA)
-	}
-
-	// IPAMURL can be overridden
-	if override.IPAMURL != "" {
-		ret.IPAMURL = override.IPAMURL
-	}
-
-	// Stage1URL can be overridden
-	if override.Stage1URL != "" {
-		ret.Stage1URL = override.Stage1URL
-	}
-
-	// Services can be overridden
-	if override.Services.ControlVIP != "" {
-		ret.Services.ControlVIP = override.Services.ControlVIP
-	}
-	if len(override.Services.NTPServers) > 0 {
-		ret.Services.NTPServers = make([]string, len(override.Services.NTPServers))
-		copy(ret.Services.NTPServers, override.Services.NTPServers)
-	}
-	if len(override.Services.SyslogServers) > 0 {
-		ret.Services.SyslogServers = make([]string, len(override.Services.SyslogServers))
-		copy(ret.Services.SyslogServers, override.Services.SyslogServers)
-	}
-
-	// location information can be overridden
-	if override.Location != nil {
-		ret.Location = &location.Info{
-			UUID:        override.Location.UUID,
-			UUIDSig:     override.Location.UUIDSig,
-			Metadata:    override.Location.Metadata,
-			MetadataSig: override.Location.MetadataSig,
-		}
-	}
-
-	return &ret
+	return config.Merge(embedded, override)
 }
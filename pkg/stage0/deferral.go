@@ -0,0 +1,75 @@
+// Copyright 2023 Hedgehog
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package stage0
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"go.githedgehog.com/dasboot/pkg/seeder/ipam"
+	"go.githedgehog.com/dasboot/pkg/stage"
+	"go.uber.org/zap"
+)
+
+var ErrDeferred = errors.New("stage0: installation deferred by seeder")
+
+const (
+	// maxDeferredWait is the longest time that stage 0 waits for a deferred installation. If the seeder
+	// asks us to wait longer, we exit without having made any changes, and leave it to ONIE to retry.
+	maxDeferredWait = 15 * time.Minute
+
+	// minDeferredWait protects the seeder from devices which retry too fast
+	minDeferredWait = 10 * time.Second
+)
+
+// these can be swapped out for testing
+var (
+	doLinkLocalIPAMRequest = ipam.DoLinkLocalRequest
+	deferredWait           = func(ctx context.Context, d time.Duration) error {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(d):
+			return nil
+		}
+	}
+)
+
+// doIPAMRequest performs the IPAM request. If the seeder defers the installation (e.g. because the device is
+// outside of its maintenance window), it waits and retries for as long as the seeder does not ask us to wait
+// for too long. Otherwise it returns an error which wraps `ErrDeferred`.
+func doIPAMRequest(ctx context.Context, hc *http.Client, ipamURL string, req *ipam.Request, onieEnv *stage.OnieEnv) (*ipam.Response, error) {
+	for {
+		resp, _, err := doLinkLocalIPAMRequest(ctx, l, hc, ipamURL, req, onieEnv)
+		retryAfter, deferred := stage.IsDeferred(err)
+		if !deferred {
+			return resp, err
+		}
+		if retryAfter > maxDeferredWait {
+			l.Info("Installation deferred by seeder for too long, leaving it to ONIE to retry", zap.Duration("retryAfter", retryAfter), zap.Error(err))
+			return nil, fmt.Errorf("%w: %w", ErrDeferred, err)
+		}
+		if retryAfter < minDeferredWait {
+			retryAfter = minDeferredWait
+		}
+		l.Info("Installation deferred by seeder, waiting before retrying", zap.Duration("retryAfter", retryAfter), zap.Error(err))
+		if err := deferredWait(ctx, retryAfter); err != nil {
+			return nil, fmt.Errorf("%w: %w", ErrDeferred, err)
+		}
+	}
+}
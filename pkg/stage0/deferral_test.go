@@ -0,0 +1,99 @@
+// Copyright 2023 Hedgehog
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package stage0
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"go.githedgehog.com/dasboot/pkg/log"
+	"go.githedgehog.com/dasboot/pkg/seeder/ipam"
+	"go.githedgehog.com/dasboot/pkg/stage"
+)
+
+func TestDoIPAMRequest(t *testing.T) {
+	deferredErr := func(retryAfter int64) error {
+		return &stage.HTTPError{StatusCode: http.StatusServiceUnavailable, Err: "outside of maintenance window", Deferred: true, RetryAfter: retryAfter}
+	}
+	tests := []struct {
+		name      string
+		responses []error
+		wantWaits []time.Duration
+		wantErr   error
+	}{
+		{
+			name:      "not deferred",
+			responses: []error{nil},
+		},
+		{
+			name:      "deferred shortly",
+			responses: []error{deferredErr(60), deferredErr(1), nil},
+			wantWaits: []time.Duration{time.Minute, minDeferredWait},
+		},
+		{
+			name:      "deferred for too long",
+			responses: []error{deferredErr(3600)},
+			wantErr:   ErrDeferred,
+		},
+		{
+			name:      "other errors are not retried",
+			responses: []error{&stage.HTTPError{StatusCode: http.StatusBadRequest, Err: "bad request"}},
+			wantErr:   &stage.HTTPError{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var calls int
+			var waits []time.Duration
+			oldRequest, oldWait := doLinkLocalIPAMRequest, deferredWait
+			defer func() { doLinkLocalIPAMRequest, deferredWait = oldRequest, oldWait }()
+			doLinkLocalIPAMRequest = func(context.Context, log.Interface, *http.Client, string, *ipam.Request, *stage.OnieEnv) (*ipam.Response, string, error) {
+				err := tt.responses[calls]
+				calls++
+				if err != nil {
+					return nil, "", err
+				}
+				return &ipam.Response{}, "", nil
+			}
+			deferredWait = func(_ context.Context, d time.Duration) error {
+				waits = append(waits, d)
+				return nil
+			}
+
+			resp, err := doIPAMRequest(context.Background(), http.DefaultClient, "http://seeder/ipam", &ipam.Request{}, &stage.OnieEnv{})
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) {
+					t.Fatalf("doIPAMRequest() error = %v, want %v", err, tt.wantErr)
+				}
+			} else if err != nil || resp == nil {
+				t.Fatalf("doIPAMRequest() = %v, %v", resp, err)
+			}
+			if calls != len(tt.responses) {
+				t.Errorf("expected %d requests, got %d", len(tt.responses), calls)
+			}
+			if len(waits) != len(tt.wantWaits) {
+				t.Fatalf("waits = %v, want %v", waits, tt.wantWaits)
+			}
+			for i := range waits {
+				if waits[i] != tt.wantWaits[i] {
+					t.Errorf("waits = %v, want %v", waits, tt.wantWaits)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,101 @@
+// Copyright 2023 Hedgehog
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package stage0
+
+import (
+	"context"
+	"fmt"
+	gonet "net"
+	"net/http"
+	"time"
+
+	"go.githedgehog.com/dasboot/pkg/net"
+	"go.githedgehog.com/dasboot/pkg/seeder/ipam"
+	"go.githedgehog.com/dasboot/pkg/stage"
+	configstage "go.githedgehog.com/dasboot/pkg/stage0/config"
+	"go.uber.org/zap"
+)
+
+// dhcpLeaseTimeout is the time we wait for a DHCP lease on a single network device
+const dhcpLeaseTimeout = 30 * time.Second
+
+// requestDHCPLease can be swapped out for testing
+var requestDHCPLease = net.RequestDHCPv4Lease
+
+// runWithDHCP is the fallback if we did not get anywhere with IPAM: it tries to get a DHCP lease on every network device,
+// and runs the rest of stage 0 with the first one for which it gets one which works.
+func runWithDHCP(ctx context.Context, stagingInfo *stage.StagingInfo, o *stage.RunOptions, httpClient *http.Client, cfg *configstage.Stage0, netdevs []string, macAllowlist net.MACAllowlist, ntpMaxOffset time.Duration) (string, func(), error) {
+	for _, netdev := range netdevs {
+		leaseCtx, cancel := context.WithTimeout(ctx, dhcpLeaseTimeout)
+		lease, err := requestDHCPLease(leaseCtx, netdev)
+		cancel()
+		if err != nil {
+			l.Warn("Requesting DHCP lease failed for netdev", zap.String("netdev", netdev), zap.Error(err))
+			continue
+		}
+		l.Info("DHCP lease received", zap.String("netdev", netdev), zap.Reflect("lease", lease))
+
+		ipamResp, ipa := dhcpIPAMResponse(lease, cfg)
+		stage1Path, resetNetwork, err := runWith(ctx, stagingInfo, o, httpClient, ipamResp, netdev, ipa, macAllowlist, ntpMaxOffset)
+		if err != nil {
+			l.Error("System network configuration with DHCP lease failed for netdev", zap.String("netdev", netdev), zap.Reflect("ipa", ipa), zap.Error(err))
+			continue
+		}
+		l.Info("System network configured with DHCP lease", zap.String("netdev", netdev), zap.Reflect("ipa", ipa))
+		return stage1Path, resetNetwork, nil
+	}
+	return "", nil, fmt.Errorf("%w on any network device", net.ErrDHCPNoLease)
+}
+
+// dhcpIPAMResponse turns a DHCP lease into the IPAM response and address which the seeder would have sent us.
+// Services which the DHCP server did not send are taken from the configuration.
+func dhcpIPAMResponse(lease *net.DHCPv4Lease, cfg *configstage.Stage0) (*ipam.Response, ipam.IPAddress) {
+	ipa := ipam.IPAddress{
+		IPAddresses: []string{lease.Address.String()},
+		MTU:         lease.MTU,
+	}
+	if lease.Router != nil {
+		ipa.Routes = []*ipam.Route{
+			{
+				Destinations: []string{"0.0.0.0/0"},
+				Gateway:      lease.Router.String(),
+			},
+		}
+	}
+	resp := &ipam.Response{
+		NTPServers:    ipStringsOr(lease.NTPServers, cfg.Services.NTPServers),
+		SyslogServers: ipStringsOr(lease.LogServers, cfg.Services.SyslogServers),
+		DNSServers:    ipStringsOr(lease.DNSServers, cfg.Services.DNSServers),
+		DNSSearch:     cfg.Services.DNSSearch,
+		Stage1URL:     cfg.Stage1URL,
+		Stage1Mirrors: cfg.Stage1Mirrors,
+		Banner:        cfg.Banner,
+	}
+	if lease.DomainName != "" {
+		resp.DNSSearch = []string{lease.DomainName}
+	}
+	return resp, ipa
+}
+
+func ipStringsOr(ips []gonet.IP, fallback []string) []string {
+	if len(ips) == 0 {
+		return fallback
+	}
+	ret := make([]string, 0, len(ips))
+	for _, ip := range ips {
+		ret = append(ret, ip.String())
+	}
+	return ret
+}
@@ -0,0 +1,100 @@
+// Copyright 2023 Hedgehog
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package stage0
+
+import (
+	gonet "net"
+	"reflect"
+	"testing"
+	"time"
+
+	"go.githedgehog.com/dasboot/pkg/net"
+	"go.githedgehog.com/dasboot/pkg/seeder/ipam"
+	configstage "go.githedgehog.com/dasboot/pkg/stage0/config"
+)
+
+func TestDHCPIPAMResponse(t *testing.T) {
+	cfg := &configstage.Stage0{
+		Stage1URL:     "https://192.168.42.1/stage1/x86_64",
+		Stage1Mirrors: []string{"https://mirror.example.com/stage1/x86_64"},
+		Services: configstage.Services{
+			NTPServers:    []string{"192.168.42.1"},
+			SyslogServers: []string{"192.168.42.1:514"},
+			DNSServers:    []string{"192.168.42.2"},
+			DNSSearch:     []string{"example.com"},
+		},
+	}
+	tests := []struct {
+		name     string
+		lease    *net.DHCPv4Lease
+		wantResp *ipam.Response
+		wantIPA  ipam.IPAddress
+	}{
+		{
+			name: "services from the lease",
+			lease: &net.DHCPv4Lease{
+				Address:    &gonet.IPNet{IP: gonet.IPv4(10, 0, 0, 10).To4(), Mask: gonet.CIDRMask(24, 32)},
+				Router:     gonet.IPv4(10, 0, 0, 1).To4(),
+				LeaseTime:  time.Hour,
+				MTU:        9000,
+				DNSServers: []gonet.IP{gonet.IPv4(10, 0, 0, 2).To4(), gonet.IPv4(10, 0, 0, 3).To4()},
+				NTPServers: []gonet.IP{gonet.IPv4(10, 0, 0, 4).To4()},
+				LogServers: []gonet.IP{gonet.IPv4(10, 0, 0, 5).To4()},
+				DomainName: "lab.example.com",
+			},
+			wantResp: &ipam.Response{
+				NTPServers:    []string{"10.0.0.4"},
+				SyslogServers: []string{"10.0.0.5"},
+				DNSServers:    []string{"10.0.0.2", "10.0.0.3"},
+				DNSSearch:     []string{"lab.example.com"},
+				Stage1URL:     "https://192.168.42.1/stage1/x86_64",
+				Stage1Mirrors: []string{"https://mirror.example.com/stage1/x86_64"},
+			},
+			wantIPA: ipam.IPAddress{
+				IPAddresses: []string{"10.0.0.10/24"},
+				MTU:         9000,
+				Routes:      []*ipam.Route{{Destinations: []string{"0.0.0.0/0"}, Gateway: "10.0.0.1"}},
+			},
+		},
+		{
+			name: "services from the config",
+			lease: &net.DHCPv4Lease{
+				Address: &gonet.IPNet{IP: gonet.IPv4(10, 0, 0, 10).To4(), Mask: gonet.CIDRMask(24, 32)},
+			},
+			wantResp: &ipam.Response{
+				NTPServers:    []string{"192.168.42.1"},
+				SyslogServers: []string{"192.168.42.1:514"},
+				DNSServers:    []string{"192.168.42.2"},
+				DNSSearch:     []string{"example.com"},
+				Stage1URL:     "https://192.168.42.1/stage1/x86_64",
+				Stage1Mirrors: []string{"https://mirror.example.com/stage1/x86_64"},
+			},
+			wantIPA: ipam.IPAddress{
+				IPAddresses: []string{"10.0.0.10/24"},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			gotResp, gotIPA := dhcpIPAMResponse(tt.lease, cfg)
+			if !reflect.DeepEqual(gotResp, tt.wantResp) {
+				t.Errorf("dhcpIPAMResponse() resp = %+v, want %+v", gotResp, tt.wantResp)
+			}
+			if !reflect.DeepEqual(gotIPA, tt.wantIPA) {
+				t.Errorf("dhcpIPAMResponse() ipa = %+v, want %+v", gotIPA, tt.wantIPA)
+			}
+		})
+	}
+}
@@ -0,0 +1,44 @@
+// Copyright 2023 Hedgehog
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package stage0
+
+import "net/netip"
+
+// withZone returns `servers` with the zone of the network device `dev` added to all IPv6 link-local addresses which
+// have none, as they are only reachable through the device which we configured. Servers can be addresses with or
+// without a port. Host names and all other addresses are returned unchanged.
+func withZone(servers []string, dev string) []string {
+	if len(servers) == 0 {
+		return servers
+	}
+	ret := make([]string, 0, len(servers))
+	for _, server := range servers {
+		if ap, err := netip.ParseAddrPort(server); err == nil {
+			if needsZone(ap.Addr()) {
+				server = netip.AddrPortFrom(ap.Addr().WithZone(dev), ap.Port()).String()
+			}
+		} else if addr, err := netip.ParseAddr(server); err == nil {
+			if needsZone(addr) {
+				server = addr.WithZone(dev).String()
+			}
+		}
+		ret = append(ret, server)
+	}
+	return ret
+}
+
+func needsZone(addr netip.Addr) bool {
+	return addr.Is6() && addr.Zone() == "" && (addr.IsLinkLocalUnicast() || addr.IsLinkLocalMulticast())
+}
@@ -0,0 +1,59 @@
+// Copyright 2023 Hedgehog
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package stage0
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestWithZone(t *testing.T) {
+	tests := []struct {
+		name    string
+		servers []string
+		want    []string
+	}{
+		{
+			name: "no servers",
+		},
+		{
+			name:    "IPv4 addresses and host names are unchanged",
+			servers: []string{"172.30.1.1", "172.30.1.1:30514", "ntp.example.com", "ntp.example.com:123"},
+			want:    []string{"172.30.1.1", "172.30.1.1:30514", "ntp.example.com", "ntp.example.com:123"},
+		},
+		{
+			name:    "global IPv6 addresses are unchanged",
+			servers: []string{"fd00:42::1", "[fd00:42::1]:514"},
+			want:    []string{"fd00:42::1", "[fd00:42::1]:514"},
+		},
+		{
+			name:    "link-local IPv6 addresses get the zone",
+			servers: []string{"fe80::1", "[fe80::1]:30514"},
+			want:    []string{"fe80::1%control", "[fe80::1%control]:30514"},
+		},
+		{
+			name:    "existing zones are kept",
+			servers: []string{"fe80::1%eth0", "[fe80::1%eth0]:514"},
+			want:    []string{"fe80::1%eth0", "[fe80::1%eth0]:514"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := withZone(tt.servers, "control"); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("withZone() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,61 @@
+// Copyright 2023 Hedgehog
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package stage0
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"go.githedgehog.com/dasboot/pkg/net"
+	"go.uber.org/zap"
+)
+
+// discoverLLDPNeighbor can be swapped out for testing
+var discoverLLDPNeighbor = net.DiscoverLLDPNeighbor
+
+// discoverNeighbors listens for LLDP neighbours on all network devices at the same time for the duration of `wait`.
+// It returns the neighbours in the order of the network devices, and skips network devices without one.
+func discoverNeighbors(ctx context.Context, netdevs []string, wait time.Duration) []*net.LLDPNeighbor {
+	ctx, cancel := context.WithTimeout(ctx, wait)
+	defer cancel()
+
+	found := make([]*net.LLDPNeighbor, len(netdevs))
+	var wg sync.WaitGroup
+	for i, netdev := range netdevs {
+		wg.Add(1)
+		go func(i int, netdev string) {
+			defer wg.Done()
+			neighbor, err := discoverLLDPNeighbor(ctx, netdev)
+			if err != nil {
+				if !errors.Is(err, context.DeadlineExceeded) {
+					l.Warn("Listening for LLDP neighbor failed", zap.String("netdev", netdev), zap.Error(err))
+				}
+				return
+			}
+			found[i] = neighbor
+		}(i, netdev)
+	}
+	wg.Wait()
+
+	ret := make([]*net.LLDPNeighbor, 0, len(found))
+	for _, neighbor := range found {
+		if neighbor != nil {
+			ret = append(ret, neighbor)
+		}
+	}
+	return ret
+}
@@ -0,0 +1,55 @@
+// Copyright 2023 Hedgehog
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package stage0
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"go.githedgehog.com/dasboot/pkg/net"
+)
+
+func TestDiscoverNeighbors(t *testing.T) {
+	old := discoverLLDPNeighbor
+	t.Cleanup(func() { discoverLLDPNeighbor = old })
+	discoverLLDPNeighbor = func(ctx context.Context, device string) (*net.LLDPNeighbor, error) {
+		switch device {
+		case "eth0", "eth2":
+			return &net.LLDPNeighbor{Interface: device, ChassisID: "0c:20:12:fe:01:00", PortID: "enp2s1", TTL: 120}, nil
+		case "eth1":
+			// nobody is talking LLDP on this one
+			<-ctx.Done()
+			return nil, ctx.Err()
+		default:
+			return nil, errors.New("no such device")
+		}
+	}
+
+	start := time.Now()
+	got := discoverNeighbors(context.Background(), []string{"eth0", "eth1", "eth2", "eth3"}, 50*time.Millisecond)
+	if time.Since(start) > 5*time.Second {
+		t.Errorf("discoverNeighbors() did not stop after the wait time")
+	}
+	want := []*net.LLDPNeighbor{
+		{Interface: "eth0", ChassisID: "0c:20:12:fe:01:00", PortID: "enp2s1", TTL: 120},
+		{Interface: "eth2", ChassisID: "0c:20:12:fe:01:00", PortID: "enp2s1", TTL: 120},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("discoverNeighbors() = %+v, want %+v", got, want)
+	}
+}
@@ -0,0 +1,277 @@
+// Copyright 2023 Hedgehog
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package stage0
+
+import (
+	"archive/tar"
+	"bufio"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	onieurl "go.githedgehog.com/dasboot/pkg/net/url"
+	"go.githedgehog.com/dasboot/pkg/stage"
+	configstage "go.githedgehog.com/dasboot/pkg/stage0/config"
+	"go.uber.org/zap"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	platformSupportModulesDir  = "modules"
+	platformSupportFirmwareDir = "firmware"
+	platformSupportOrderFile   = "order"
+)
+
+var (
+	ErrPlatformSupportBundle = errors.New("stage0: platform support bundle")
+)
+
+func platformSupportBundleError(format string, a ...any) error {
+	return fmt.Errorf("%w: %s", ErrPlatformSupportBundle, fmt.Sprintf(format, a...))
+}
+
+// these can be swapped out for testing
+var (
+	firmwareDir      = "/lib/firmware"
+	loadKernelModule = func(path string, params string) error {
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		if err := unix.FinitModule(int(f.Fd()), params, 0); err != nil && !errors.Is(err, unix.EEXIST) {
+			return err
+		}
+		return nil
+	}
+)
+
+// platformSupportModule is a kernel module of a platform support bundle
+type platformSupportModule struct {
+	Name   string `json:"name"`
+	Params string `json:"params,omitempty"`
+}
+
+// loadPlatformSupport downloads the platform support bundle `ps`, verifies it against its pin, and installs it:
+// all firmware files are copied to the firmware directory first, so that the kernel modules find them when they
+// get loaded afterwards.
+func loadPlatformSupport(ctx context.Context, hc *http.Client, stagingDir string, ps *configstage.PlatformSupport, onieEnv *stage.OnieEnv) error {
+	bundleURL, err := platformSupportURL(ps.URL, onieEnv)
+	if err != nil {
+		return err
+	}
+	bundlePath := filepath.Join(stagingDir, "platform-support.tar.gz")
+	if err := stage.Download(ctx, hc, bundleURL, bundlePath, 0644, 60*time.Second); err != nil {
+		return fmt.Errorf("downloading: %w", err)
+	}
+	defer os.Remove(bundlePath)
+	if err := stage.VerifyArtifactPin(bundlePath, ps.Pin); err != nil {
+		return fmt.Errorf("verifying: %w", err)
+	}
+
+	dir := filepath.Join(stagingDir, "platform-support")
+	if err := extractPlatformSupportBundle(bundlePath, dir); err != nil {
+		return err
+	}
+	firmware, err := installPlatformSupportFirmware(dir)
+	if err != nil {
+		return err
+	}
+	l.Info("Platform support firmware installed", zap.String("platform", ps.Platform), zap.String("firmwareDir", firmwareDir), zap.Strings("firmware", firmware))
+
+	modules, err := platformSupportModules(dir)
+	if err != nil {
+		return err
+	}
+	for _, m := range modules {
+		if err := loadKernelModule(filepath.Join(dir, platformSupportModulesDir, m.Name), m.Params); err != nil {
+			return fmt.Errorf("loading kernel module '%s': %w", m.Name, err)
+		}
+		l.Info("Platform support kernel module loaded", zap.String("platform", ps.Platform), zap.String("module", m.Name), zap.String("params", m.Params))
+	}
+	return nil
+}
+
+// platformSupportURL adds the network interface which was used to download stage 0 to a link-local bundle URL.
+// The bundle is loaded before we configure any network, so this is the only interface which we know works.
+func platformSupportURL(bundleURL string, onieEnv *stage.OnieEnv) (string, error) {
+	u, err := url.Parse(bundleURL)
+	if err != nil {
+		return "", platformSupportBundleError("URL: %s", err)
+	}
+	if !strings.HasPrefix(u.Host, "[fe80:") || onieEnv == nil || !strings.Contains(onieEnv.ExecURL, "fe80:") {
+		return bundleURL, nil
+	}
+	execURL, err := onieEnv.ParseExecURL()
+	if err != nil || execURL.Zone() == "" {
+		return bundleURL, nil
+	}
+	u.Host = onieurl.HostWithZone(u.Host, execURL.Zone())
+	return u.String(), nil
+}
+
+// extractPlatformSupportBundle extracts the bundle at `bundlePath` into `dir`. Only regular files and directories
+// within `dir` are allowed in the bundle.
+func extractPlatformSupportBundle(bundlePath string, dir string) error {
+	f, err := os.Open(bundlePath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	gzr, err := gzip.NewReader(f)
+	if err != nil {
+		return platformSupportBundleError("gzip: %s", err)
+	}
+	defer gzr.Close()
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	tr := tar.NewReader(gzr)
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return platformSupportBundleError("tar: %s", err)
+		}
+		name := filepath.Clean(filepath.FromSlash(hdr.Name))
+		if !filepath.IsLocal(name) {
+			return platformSupportBundleError("'%s' is outside of the bundle", hdr.Name)
+		}
+		dest := filepath.Join(dir, name)
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(dest, 0755); err != nil {
+				return err
+			}
+		case tar.TypeReg:
+			if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+				return err
+			}
+			if err := writeBundleFile(dest, tr); err != nil {
+				return err
+			}
+		default:
+			return platformSupportBundleError("'%s' is not a regular file or directory", hdr.Name)
+		}
+	}
+}
+
+func writeBundleFile(dest string, r io.Reader) error {
+	f, err := os.OpenFile(dest, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, r); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// installPlatformSupportFirmware copies all files of the firmware directory of the extracted bundle in `dir`
+// into the firmware directory of the system
+func installPlatformSupportFirmware(dir string) ([]string, error) {
+	src := filepath.Join(dir, platformSupportFirmwareDir)
+	var ret []string
+	err := filepath.WalkDir(src, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) && path == src {
+				return filepath.SkipDir
+			}
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		dest := filepath.Join(firmwareDir, rel)
+		if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+			return err
+		}
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		if err := writeBundleFile(dest, f); err != nil {
+			return fmt.Errorf("installing firmware '%s': %w", rel, err)
+		}
+		ret = append(ret, rel)
+		return nil
+	})
+	return ret, err
+}
+
+// platformSupportModules returns the kernel modules of the extracted bundle in `dir` in the order in which they
+// must be loaded. This is the order of the order file if the bundle has one, and the lexical order otherwise.
+func platformSupportModules(dir string) ([]platformSupportModule, error) {
+	modulesDir := filepath.Join(dir, platformSupportModulesDir)
+	f, err := os.Open(filepath.Join(modulesDir, platformSupportOrderFile))
+	if err == nil {
+		defer f.Close()
+		var ret []platformSupportModule
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			line := strings.TrimSpace(scanner.Text())
+			if line == "" || strings.HasPrefix(line, "#") {
+				continue
+			}
+			name, params, _ := strings.Cut(line, " ")
+			if !filepath.IsLocal(name) {
+				return nil, platformSupportBundleError("module '%s' is outside of the bundle", name)
+			}
+			if _, err := os.Stat(filepath.Join(modulesDir, name)); err != nil {
+				return nil, platformSupportBundleError("module '%s' of the order file: %s", name, err)
+			}
+			ret = append(ret, platformSupportModule{Name: name, Params: strings.TrimSpace(params)})
+		}
+		return ret, scanner.Err()
+	}
+	if !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+
+	entries, err := os.ReadDir(modulesDir)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var ret []platformSupportModule
+	for _, entry := range entries {
+		if entry.Type().IsRegular() && strings.HasSuffix(entry.Name(), ".ko") {
+			ret = append(ret, platformSupportModule{Name: entry.Name()})
+		}
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i].Name < ret[j].Name })
+	return ret, nil
+}
@@ -0,0 +1,170 @@
+// Copyright 2023 Hedgehog
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package stage0
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+type bundleEntry struct {
+	name     string
+	content  string
+	typeflag byte
+}
+
+func writeTestBundle(t *testing.T, path string, entries []bundleEntry) {
+	t.Helper()
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	gzw := gzip.NewWriter(f)
+	tw := tar.NewWriter(gzw)
+	for _, e := range entries {
+		hdr := &tar.Header{Name: e.name, Mode: 0644, Size: int64(len(e.content)), Typeflag: e.typeflag}
+		switch e.typeflag {
+		case tar.TypeDir:
+			hdr.Mode, hdr.Size = 0755, 0
+		case tar.TypeSymlink:
+			hdr.Linkname, hdr.Size = e.content, 0
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		if hdr.Size > 0 {
+			if _, err := tw.Write([]byte(e.content)); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := gzw.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPlatformSupportBundle(t *testing.T) {
+	tests := []struct {
+		name         string
+		entries      []bundleEntry
+		wantErr      bool
+		wantFirmware []string
+		wantModules  []platformSupportModule
+	}{
+		{
+			name: "modules in order of the order file",
+			entries: []bundleEntry{
+				{name: "modules/", typeflag: tar.TypeDir},
+				{name: "modules/a.ko", content: "a", typeflag: tar.TypeReg},
+				{name: "modules/b.ko", content: "b", typeflag: tar.TypeReg},
+				{name: "modules/order", content: "# b depends on nothing\nb.ko debug=1 mode=2\n\na.ko\n", typeflag: tar.TypeReg},
+				{name: "firmware/vendor/nic.bin", content: "fw", typeflag: tar.TypeReg},
+			},
+			wantFirmware: []string{filepath.Join("vendor", "nic.bin")},
+			wantModules: []platformSupportModule{
+				{Name: "b.ko", Params: "debug=1 mode=2"},
+				{Name: "a.ko"},
+			},
+		},
+		{
+			name: "modules in lexical order",
+			entries: []bundleEntry{
+				{name: "modules/z.ko", content: "z", typeflag: tar.TypeReg},
+				{name: "modules/m.ko", content: "m", typeflag: tar.TypeReg},
+				{name: "modules/README", content: "not a module", typeflag: tar.TypeReg},
+			},
+			wantModules: []platformSupportModule{{Name: "m.ko"}, {Name: "z.ko"}},
+		},
+		{
+			name: "firmware only",
+			entries: []bundleEntry{
+				{name: "firmware/nic.bin", content: "fw", typeflag: tar.TypeReg},
+			},
+			wantFirmware: []string{"nic.bin"},
+		},
+		{
+			name: "order file references missing module",
+			entries: []bundleEntry{
+				{name: "modules/order", content: "missing.ko\n", typeflag: tar.TypeReg},
+			},
+			wantErr: true,
+		},
+		{
+			name: "path traversal",
+			entries: []bundleEntry{
+				{name: "../../etc/passwd", content: "root", typeflag: tar.TypeReg},
+			},
+			wantErr: true,
+		},
+		{
+			name: "symlink",
+			entries: []bundleEntry{
+				{name: "firmware/nic.bin", content: "/etc/shadow", typeflag: tar.TypeSymlink},
+			},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tmp := t.TempDir()
+			oldFirmwareDir := firmwareDir
+			defer func() { firmwareDir = oldFirmwareDir }()
+			firmwareDir = filepath.Join(tmp, "lib", "firmware")
+
+			bundle := filepath.Join(tmp, "bundle.tar.gz")
+			writeTestBundle(t, bundle, tt.entries)
+			dir := filepath.Join(tmp, "extracted")
+
+			err := extractPlatformSupportBundle(bundle, dir)
+			var firmware []string
+			var modules []platformSupportModule
+			if err == nil {
+				firmware, err = installPlatformSupportFirmware(dir)
+			}
+			if err == nil {
+				modules, err = platformSupportModules(dir)
+			}
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				if !errors.Is(err, ErrPlatformSupportBundle) {
+					t.Errorf("error = %v, want ErrPlatformSupportBundle", err)
+				}
+				return
+			}
+			if !reflect.DeepEqual(firmware, tt.wantFirmware) {
+				t.Errorf("firmware = %v, want %v", firmware, tt.wantFirmware)
+			}
+			for _, fw := range firmware {
+				if _, err := os.Stat(filepath.Join(firmwareDir, fw)); err != nil {
+					t.Errorf("firmware '%s' not installed: %v", fw, err)
+				}
+			}
+			if !reflect.DeepEqual(modules, tt.wantModules) {
+				t.Errorf("modules = %v, want %v", modules, tt.wantModules)
+			}
+		})
+	}
+}
@@ -0,0 +1,165 @@
+// Copyright 2023 Hedgehog
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package stage0
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os/exec"
+
+	"go.githedgehog.com/dasboot/pkg/log"
+	"go.githedgehog.com/dasboot/pkg/partitions"
+	"go.githedgehog.com/dasboot/pkg/partitions/identity"
+	"go.githedgehog.com/dasboot/pkg/seeder/recovery"
+	"go.githedgehog.com/dasboot/pkg/stage"
+	configstage "go.githedgehog.com/dasboot/pkg/stage0/config"
+	"go.uber.org/zap"
+)
+
+var ErrRecoveryMode = errors.New("stage0: recovery mode: installation failed too many times in a row")
+
+// these can be swapped out for testing
+var (
+	makeONIEDefaultBootEntry = partitions.MakeONIEDefaultBootEntryAndCleanup
+	runONIECommand           = func(ctx context.Context, name string, args ...string) error {
+		return exec.CommandContext(ctx, name, args...).Run()
+	}
+)
+
+// withInstallHistory opens the identity partition and passes it to `f` for accessing the install history.
+// Contrary to stage 1 this never creates the identity partition: if a device has never made it that far
+// in any previous installation attempt, then there is no install history. The partition is unmounted
+// again afterwards if it was not mounted before, so that stage 1 finds it as it expects it.
+func withInstallHistory(f func(stage.InstallHistoryStore) error) error {
+	ipdevs := partitions.Discover().GetHedgehogIdentityPartitions()
+	if len(ipdevs) != 1 {
+		// stage 1 is responsible for dealing with multiple identity partitions
+		return fmt.Errorf("expected exactly one identity partition, found %d", len(ipdevs))
+	}
+	ipdev := ipdevs[0]
+	if !ipdev.IsMounted() {
+		if err := ipdev.Mount(); err != nil {
+			return fmt.Errorf("mounting identity partition: %w", err)
+		}
+		defer ipdev.Unmount() //nolint:errcheck
+	}
+	ip, err := identity.Open(ipdev)
+	if err != nil {
+		return fmt.Errorf("opening identity partition: %w", err)
+	}
+	return f(ip)
+}
+
+// readInstallHistory returns the install history of previous installation attempts, or nil if there is none
+func readInstallHistory() *stage.InstallHistory {
+	var ret *stage.InstallHistory
+	if err := withInstallHistory(func(store stage.InstallHistoryStore) error {
+		var err error
+		ret, err = stage.ReadInstallHistory(store)
+		return err
+	}); err != nil {
+		l.Debug("No install history available", zap.Error(err))
+		return nil
+	}
+	return ret
+}
+
+// trackInstallOutcome records the outcome of this installation attempt in the install history
+func trackInstallOutcome(runErr error) {
+	// entering recovery mode, a deferred or a cancelled installation are not failed installation attempts
+	if errors.Is(runErr, ErrRecoveryMode) || errors.Is(runErr, ErrDeferred) || errors.Is(runErr, stage.ErrInstallCancelled) {
+		return
+	}
+	if err := withInstallHistory(func(store stage.InstallHistoryStore) error {
+		if runErr == nil {
+			return stage.ResetInstallHistory(store)
+		}
+		h, err := stage.RecordInstallFailure(store, runErr)
+		if err != nil {
+			return err
+		}
+		l.Warn("Installation attempt failed", zap.Uint("consecutiveFailures", h.ConsecutiveFailures))
+		return nil
+	}); err != nil {
+		l.Debug("Failed to track installation outcome in install history", zap.Error(err))
+	}
+}
+
+// shouldEnterRecoveryMode returns true if the install history exceeds the recovery policy
+func shouldEnterRecoveryMode(policy *configstage.Recovery, h *stage.InstallHistory) bool {
+	return policy.Enabled() && h != nil && h.ConsecutiveFailures >= policy.MaxConsecutiveFailures
+}
+
+// enterRecoveryMode stops this device from retrying installations forever: it makes ONIE the default
+// boot entry again, reports to the seeder, and executes the configured recovery action. It always
+// returns an error which wraps `ErrRecoveryMode`.
+func enterRecoveryMode(ctx context.Context, l log.Interface, hc *http.Client, policy *configstage.Recovery, h *stage.InstallHistory, onieEnv *stage.OnieEnv, hhdevid string) error {
+	action := policy.Action
+	if action == "" {
+		action = configstage.RecoveryActionStop
+	}
+	l.Error("ENTERING RECOVERY MODE: installation failed too many times in a row, manual intervention required",
+		zap.Uint("consecutiveFailures", h.ConsecutiveFailures),
+		zap.Uint("maxConsecutiveFailures", policy.MaxConsecutiveFailures),
+		zap.Time("firstFailure", h.FirstFailure),
+		zap.Time("lastFailure", h.LastFailure),
+		zap.String("lastError", h.LastError),
+		zap.String("action", string(action)),
+	)
+
+	// a previous attempt could have left a half-installed NOS as the default boot entry
+	if err := makeONIEDefaultBootEntry(); err != nil {
+		l.Warn("Restoring ONIE as the default boot entry failed", zap.Error(err))
+	} else {
+		l.Info("Restored ONIE as the default boot entry")
+	}
+
+	// let the seeder know: this is best effort as the network could be the reason for the failures
+	if policy.ReportURL != "" {
+		report := &recovery.Report{
+			DevID:               hhdevid,
+			SerialNumber:        onieEnv.SerialNum,
+			Platform:            onieEnv.Platform,
+			EthAddr:             onieEnv.EthAddr,
+			ConsecutiveFailures: h.ConsecutiveFailures,
+			FirstFailure:        h.FirstFailure,
+			LastFailure:         h.LastFailure,
+			LastError:           h.LastError,
+			Action:              string(action),
+		}
+		if err := recovery.DoReport(ctx, hc, report, policy.ReportURL); err != nil {
+			l.Warn("Sending recovery report to seeder failed", zap.String("url", policy.ReportURL), zap.Error(err))
+		} else {
+			l.Info("Sent recovery report to seeder", zap.String("url", policy.ReportURL))
+		}
+	}
+
+	if action == configstage.RecoveryActionRescue {
+		if err := runONIECommand(ctx, "onie-boot-mode", "-o", "rescue"); err != nil {
+			l.Warn("Setting ONIE boot mode to rescue failed", zap.Error(err))
+		} else {
+			l.Info("ONIE will boot into rescue mode from now on")
+		}
+	}
+	if err := runONIECommand(ctx, "onie-discovery-stop"); err != nil {
+		l.Warn("Stopping ONIE discovery failed, ONIE is going to run the installer again", zap.Error(err))
+	} else {
+		l.Info("Stopped ONIE discovery")
+	}
+
+	return fmt.Errorf("%w: %d consecutive failures, last error: %s", ErrRecoveryMode, h.ConsecutiveFailures, h.LastError)
+}
@@ -0,0 +1,105 @@
+// Copyright 2023 Hedgehog
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package stage0
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"go.githedgehog.com/dasboot/pkg/log"
+	"go.githedgehog.com/dasboot/pkg/seeder/recovery"
+	"go.githedgehog.com/dasboot/pkg/stage"
+	configstage "go.githedgehog.com/dasboot/pkg/stage0/config"
+	"go.githedgehog.com/dasboot/test/fakeonie"
+)
+
+func TestEnterRecoveryMode(t *testing.T) {
+	h := &stage.InstallHistory{
+		ConsecutiveFailures: 3,
+		FirstFailure:        time.Now().Add(-time.Hour),
+		LastFailure:         time.Now(),
+		LastError:           "NOS installer execution failed",
+	}
+	tests := []struct {
+		name      string
+		action    configstage.RecoveryAction
+		wantCalls []string
+	}{
+		{
+			name:      "stop by default",
+			wantCalls: []string{"onie-discovery-stop"},
+		},
+		{
+			name:      "rescue",
+			action:    configstage.RecoveryActionRescue,
+			wantCalls: []string{"onie-boot-mode -o rescue", "onie-discovery-stop"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := fakeonie.Setup(t, nil)
+
+			oldMakeONIEDefaultBootEntry := makeONIEDefaultBootEntry
+			defer func() { makeONIEDefaultBootEntry = oldMakeONIEDefaultBootEntry }()
+			var madeDefault bool
+			makeONIEDefaultBootEntry = func() error {
+				madeDefault = true
+				return nil
+			}
+
+			var report recovery.Report
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if err := json.NewDecoder(r.Body).Decode(&report); err != nil {
+					t.Errorf("decoding recovery report: %v", err)
+				}
+				w.WriteHeader(http.StatusNoContent)
+			}))
+			defer srv.Close()
+
+			policy := &configstage.Recovery{
+				MaxConsecutiveFailures: 3,
+				Action:                 tt.action,
+				ReportURL:              srv.URL,
+			}
+			devid := uuid.NewString()
+			err := enterRecoveryMode(context.Background(), log.L(), srv.Client(), policy, h, stage.GetOnieEnv(), devid)
+			if !errors.Is(err, ErrRecoveryMode) {
+				t.Fatalf("enterRecoveryMode() error = %v, want %v", err, ErrRecoveryMode)
+			}
+			if !madeDefault {
+				t.Errorf("enterRecoveryMode() did not make ONIE the default boot entry")
+			}
+
+			calls, err := fake.Calls()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(calls, tt.wantCalls) {
+				t.Errorf("ONIE calls = %v, want %v", calls, tt.wantCalls)
+			}
+
+			if report.DevID != devid || report.SerialNumber != fake.Env.SerialNum || report.Platform != fake.Env.Platform || report.EthAddr != fake.Env.EthAddr {
+				t.Errorf("recovery report = %#v does not match the ONIE environment", report)
+			}
+		})
+	}
+}
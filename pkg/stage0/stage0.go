@@ -22,7 +22,6 @@ import (
 	"io"
 	gonet "net"
 	"net/http"
-	"net/url"
 	"os"
 	"os/exec"
 	"path/filepath"
@@ -30,11 +29,12 @@ import (
 	"strings"
 	"time"
 
+	"go.githedgehog.com/dasboot/pkg/banner"
 	"go.githedgehog.com/dasboot/pkg/config"
 	"go.githedgehog.com/dasboot/pkg/devid"
 	"go.githedgehog.com/dasboot/pkg/log"
+	"go.githedgehog.com/dasboot/pkg/log/syslog"
 	"go.githedgehog.com/dasboot/pkg/net"
-	onieurl "go.githedgehog.com/dasboot/pkg/net/url"
 	"go.githedgehog.com/dasboot/pkg/ntp"
 	"go.githedgehog.com/dasboot/pkg/partitions"
 	"go.githedgehog.com/dasboot/pkg/partitions/location"
@@ -48,6 +48,14 @@ import (
 
 var l = log.L()
 
+// correlation holds the fields which are bound to every log message of this stage
+var correlation log.Correlation
+
+// setLogger makes `newL` the logger of this stage with all correlation fields bound to it
+func setLogger(newL log.Interface) {
+	l = log.WithCorrelation(newL, correlation)
+}
+
 var ErrExecution = errors.New("unrecoverable execution error encountered")
 
 func executionError(err error) error {
@@ -58,6 +66,63 @@ const (
 	vlanName = "control"
 )
 
+// resolvConf manages the DNS settings that we apply, and allows to restore them again on network resets
+var resolvConf = net.NewResolvConfManager(net.DefaultResolvConfPath)
+
+func configureDNS(servers []string, search []string) {
+	if len(servers) == 0 {
+		l.Info("No DNS servers to configure, leaving resolv.conf untouched")
+		return
+	}
+	if err := resolvConf.Apply(&net.ResolvConf{Nameservers: servers, Search: search}); err != nil {
+		// this is not fatal: as long as all URLs are using IP addresses, we do not need DNS
+		l.Warn("Configuring DNS servers in resolv.conf failed", zap.Strings("dnsServers", servers), zap.Strings("dnsSearch", search), zap.Error(err))
+		return
+	}
+	l.Info("Configured DNS servers in resolv.conf", zap.Strings("dnsServers", servers), zap.Strings("dnsSearch", search))
+}
+
+// prepareMACAllowlist applies the allowlisted MAC address for VLAN `vid` if there is one. The untagged interface
+// `netdev` gets the MAC address set directly, while for VLAN interfaces it returns the options to create them
+// with it. The original MAC addresses are backed up in the staging directory so that stage 2 can roll them back.
+func prepareMACAllowlist(stagingDir string, allowlist net.MACAllowlist, netdev string, vid uint16) ([]net.DeviceOption, error) {
+	hw, ok := allowlist.HardwareAddr(vid)
+	if !ok {
+		return nil, nil
+	}
+	m := net.NewMACAllowlistManager(stagingDir)
+	if vid == 0 {
+		if err := m.Apply(netdev, hw); err != nil {
+			return nil, err
+		}
+		l.Info("Applied allowlisted MAC address to network interface", zap.String("netdev", netdev), zap.Stringer("mac", hw))
+		return nil, nil
+	}
+
+	// a VLAN interface inherits the MAC address of its parent
+	original, err := net.GetHardwareAddr(netdev)
+	if err != nil {
+		return nil, err
+	}
+	if err := m.Record(vlanName, original); err != nil {
+		return nil, err
+	}
+	l.Info("Creating VLAN interface with allowlisted MAC address", zap.String("vlanInterface", vlanName), zap.Uint16("vlan", vid), zap.Stringer("mac", hw))
+	return []net.DeviceOption{net.DeviceOptionHardwareAddr(hw)}, nil
+}
+
+func restoreMACAllowlist(stagingDir string) {
+	if err := net.NewMACAllowlistManager(stagingDir).Rollback(); err != nil {
+		l.Warn("Restoring original MAC addresses failed", zap.Error(err))
+	}
+}
+
+func restoreDNS() {
+	if err := resolvConf.Restore(); err != nil {
+		l.Warn("Restoring resolv.conf failed", zap.Error(err))
+	}
+}
+
 func ReadConfig() (*configstage.Stage0, error) {
 	// open and read executable into memory
 	exePath, err := os.Executable()
@@ -111,31 +176,50 @@ func ReadConfig() (*configstage.Stage0, error) {
 	return &cfg, nil
 }
 
-func Run(ctx context.Context, override *configstage.Stage0, logSettings *stage.LogSettings) (runErr error) {
+// Run runs stage 0 with `logSettings` which initialize the global logger. This is what the stage 0 binary executes.
+func Run(ctx context.Context, override *configstage.Stage0, logSettings *stage.LogSettings, opts ...stage.RunOption) error {
+	_, err := Execute(ctx, override, append([]stage.RunOption{stage.RunOptionLogSettings(logSettings)}, opts...)...)
+	return err
+}
+
+// Execute runs stage 0 in-process. It can be used to embed stage 0 into other installers. The returned result is
+// never nil, and holds as much information as was gathered until the execution finished or failed.
+func Execute(ctx context.Context, override *configstage.Stage0, opts ...stage.RunOption) (result *stage.Result, runErr error) {
+	o := stage.NewRunOptions(opts...)
+	logSettings := o.LogSettings
+	result = &stage.Result{}
+
 	// we'll set things into this variable and export them before we execute the next stage
-	stagingInfo := &stage.StagingInfo{}
+	// every installation starts with stage 0, so this is where the install session begins
+	stagingInfo := &stage.StagingInfo{
+		InstallSessionID: stage.NewInstallSessionID(),
+	}
+	correlation = stagingInfo.Correlation("stage0")
 
 	var resetNetwork func()
 	resetNetworkLogSettings := *logSettings
 	// In case of installation success which means that we were successful at setting up the network
 	// we want to revert it again after we are done here.
 	// NOTE: we leave it in the error case because it might help when we need to debug things, and the
-	// installer is able to deal with previously existing network configuration
+	// installer is able to deal with previously existing network configuration. A cancelled installation
+	// is no error though, and must leave the device as it found it.
 	defer func() {
-		if runErr == nil && resetNetwork != nil {
+		if (runErr == nil || errors.Is(runErr, stage.ErrInstallCancelled)) && resetNetwork != nil {
 			// reset the logger to one without syslog servers, otherwise this can hang
-			stage.InitializeGlobalLogger(ctx, &resetNetworkLogSettings) //nolint: errcheck
-			l = log.L()
+			if newL, err := o.InitializeLogger(ctx, &resetNetworkLogSettings); err == nil {
+				setLogger(newL)
+			}
 			resetNetwork()
 		}
 	}()
 
 	// setup logging first
 	// TODO: this essentially should never fail, so should be implemented differently I guess
-	if err := stage.InitializeGlobalLogger(ctx, logSettings); err != nil {
-		return fmt.Errorf("stage0: failed to initialize logger: %w", err)
+	newL, err := o.InitializeLogger(ctx, logSettings)
+	if err != nil {
+		return result, fmt.Errorf("stage0: failed to initialize logger: %w", err)
 	}
-	l = log.L()
+	setLogger(newL)
 	defer func() {
 		if err := l.Sync(); err != nil {
 			l.Debug("Flushing logger failed", zap.Error(err))
@@ -145,6 +229,14 @@ func Run(ctx context.Context, override *configstage.Stage0, logSettings *stage.L
 	if err := stagingInfo.Export(); err != nil {
 		l.Warn("Failed to export staging area information", zap.Error(err))
 	}
+	// record execution timings of all major steps
+	stage.StartTimings("stage0")
+	defer func() {
+		if summary := stage.FinishTimings(l, stagingInfo.StagingDir, runErr); summary != nil {
+			result.Timings = summary
+		}
+	}()
+
 	l.Info("Stage 0 execution starting", zap.String("version", version.Version))
 	l.Info("System environment", zap.Strings("env", os.Environ()))
 
@@ -156,7 +248,7 @@ func Run(ctx context.Context, override *configstage.Stage0, logSettings *stage.L
 	embedded, err := ReadConfig()
 	if err != nil {
 		l.Error("Reading embedded config failed", zap.Error(err))
-		return executionError(err)
+		return result, executionError(err)
 	}
 	l.Info("Read embedded configuration", zap.Reflect("config", embedded))
 
@@ -164,12 +256,42 @@ func Run(ctx context.Context, override *configstage.Stage0, logSettings *stage.L
 	cfg := configstage.MergeConfigs(embedded, override)
 	if err := cfg.Validate(); err != nil {
 		l.Error("Merged config validation error", zap.Error(err))
-		return executionError(fmt.Errorf("merged config validation: %w", err))
+		return result, executionError(fmt.Errorf("merged config validation: %w", err))
 	}
 	if override != nil {
 		l.Info("Merged override configuration", zap.Reflect("config", cfg))
 	}
+
+	// the syslog servers which we get later must be spoken to with the framing and over the transport they expect
+	if cfg.Services.SyslogFraming != "" {
+		if framing, err := syslog.ParseFraming(cfg.Services.SyslogFraming); err == nil {
+			logSettings.SyslogFraming = framing
+		}
+	}
+	if cfg.Services.SyslogTransport != "" {
+		if transport, err := syslog.ParseTransport(cfg.Services.SyslogTransport); err == nil {
+			logSettings.SyslogTransport = transport
+		}
+	}
+	if len(cfg.Services.SyslogCA) > 0 {
+		// client certificates for mutual TLS can only come from the command-line
+		tlsSettings := syslog.TLSSettings{}
+		if logSettings.SyslogTLS != nil {
+			tlsSettings = *logSettings.SyslogTLS
+		}
+		tlsSettings.CA = cfg.Services.SyslogCA
+		logSettings.SyslogTLS = &tlsSettings
+	}
 	stagingInfo.OnieHeaders = cfg.OnieHeaders
+	stagingInfo.RequireProvenance = cfg.RequireProvenance
+	stagingInfo.RequireManifest = cfg.RequireManifest
+	if policy, err := partitions.ParseMultipathPolicy(cfg.MultipathPolicy); err == nil {
+		// discovery in this and all subsequent stages must agree on the devices to work with
+		partitions.SetMultipathPolicy(policy)
+		stagingInfo.MultipathPolicy = policy
+	}
+	partitions.SetDiskSelectionPolicy(cfg.DiskSelection)
+	stagingInfo.DiskSelection = cfg.DiskSelection
 	stagingInfo.ServerCA = make([]byte, len(cfg.CA))
 	stagingInfo.ConfigSignatureCA = make([]byte, len(cfg.SignatureCA))
 	copy(stagingInfo.ServerCA, cfg.CA)
@@ -178,6 +300,21 @@ func Run(ctx context.Context, override *configstage.Stage0, logSettings *stage.L
 		l.Warn("Failed to export staging area information", zap.Error(err))
 	}
 
+	// another installer running at the same time would fight with us over the partitions, and the
+	// cleanup below would remove its staging area
+	installLock, err := stage.AcquireInstallLock(l, stagingInfo.InstallSessionID, o.ForceBreakInstallLock)
+	if err != nil {
+		l.Error("Acquiring install lock failed", zap.Error(err))
+		return result, executionError(err)
+	}
+	defer func() {
+		// later stages verify the lock file, so it must stay if they are not run by us
+		if err := installLock.Release(!o.SkipNextStage); err != nil {
+			l.Warn("Releasing install lock failed", zap.Error(err))
+		}
+	}()
+	l.Info("Acquired install lock", zap.Reflect("lock", installLock.Info()))
+
 	// cleanup potentially previous staging areas and SONiC installers
 	// we want to do this on start of a new installation, and not on a failing installation
 	// so that the previously failing installer leaves their things around for debugging
@@ -192,22 +329,8 @@ func Run(ctx context.Context, override *configstage.Stage0, logSettings *stage.L
 				continue
 			}
 			// check for a DAS BOOT staging directory
-			if strings.HasPrefix(name, "das-boot-") {
-				dir := filepath.Join(tmpDir, name)
-				// unmount it first, if it is mounted
-				if ok, _ := stage.IsMountPoint(dir); ok {
-					if err := unix.Unmount(dir, 0); err != nil {
-						l.Warn("Failed to unmount previously used DAS BOOT staging directory", zap.String("stagingDir", dir), zap.Error(err))
-					} else {
-						l.Info("Unmounted previously existing DAS BOOT staging directory", zap.String("stagingDir", dir))
-					}
-				}
-				// remove it and everything in there
-				if err := os.RemoveAll(dir); err != nil {
-					l.Warn("Failed to remove previously used DAS BOOT staging directory", zap.String("stagingDir", dir), zap.Error(err))
-				} else {
-					l.Info("Removed previously existing DAS BOOT staging directory", zap.String("stagingDir", dir))
-				}
+			if strings.HasPrefix(name, stagingDirPrefix) {
+				removePreviousStagingArea(filepath.Join(tmpDir, name))
 				continue
 			}
 
@@ -235,49 +358,67 @@ func Run(ctx context.Context, override *configstage.Stage0, logSettings *stage.L
 		}
 	}
 
+	if baseDir := stagingBaseDir(cfg.Staging); baseDir != tmpDir {
+		removePreviousStagingAreas(baseDir)
+	}
+
 	// prepare staging area
-	stagingDir, err := os.MkdirTemp("", "das-boot-")
+	stagingDir, tmpfs, err := prepareStagingArea(cfg.Staging)
 	if err != nil {
 		// we can only reuse /tmp at this point
-		stagingDir = os.TempDir()
-		l.Warn("Failed to create temporary directory, reusing system temporary directory, and not mounting a tmpfs either", zap.String("stagingDir", stagingDir))
-	} else {
-		// otherwise we mount a dedicated tmpfs
-		// and we will try to unmount it if this function returns successfully
+		l.Warn("Failed to create temporary directory, reusing system temporary directory, and not mounting a tmpfs either", zap.String("stagingDir", stagingDir), zap.Error(err))
+	} else if tmpfs {
+		// unmount staging dir and remove it if this function returns successfully
 		// otherwise we will keep things around for troubleshooting purposes
-		if err := unix.Mount("das-boot", stagingDir, "tmpfs", 0, ""); err != nil {
-			l.Warn("failed to mount tmpfs onto dedicated temporary staging directory", zap.String("stagingDir", stagingDir), zap.Error(err))
-			// we will try to clean up on error all files in here
-			defer func() {
-				if runErr == nil {
-					os.RemoveAll(stagingDir)
+		defer func() {
+			if runErr == nil {
+				if err := unix.Unmount(stagingDir, 0); err != nil {
+					return
 				}
-			}()
-		} else {
-			// unmount staging dir and remove it
-			defer func() {
-				if runErr == nil {
-					if err := unix.Unmount(stagingDir, 0); err != nil {
-						return
-					}
-					os.Remove(stagingDir)
-				}
-			}()
-		}
+				os.Remove(stagingDir)
+			}
+		}()
+	} else {
+		// we will try to clean up on success all files in here
+		defer func() {
+			if runErr == nil {
+				os.RemoveAll(stagingDir)
+			}
+		}()
 	}
 	if err := os.Chdir(stagingDir); err != nil {
 		// very silly that this could fail, but we cannot recover from this
 		l.Error("Changing directory to staging area directory failed", zap.String("stagingDir", stagingDir), zap.Error(err))
-		return executionError(err)
+		return result, executionError(err)
 	}
 	stagingInfo.StagingDir = stagingDir
+	// the network comes up late and flaps while we are reconfiguring it, so
+	// early syslog messages are kept in the staging area until they can be delivered
+	logSettings.SyslogSpillDir = stagingDir
 	if err := stagingInfo.Export(); err != nil {
 		l.Warn("Failed to export staging area information", zap.Error(err))
 	}
 	l.Info("Staging area directory prepared", zap.String("stagingDir", stagingDir))
 
+	// ONIE images differ in the tools they ship, so we report what is missing before anything fails because of it
+	stage.ReportToolCapabilities(l)
+
 	// we need to do partition discovery for finding our location UUID
+	endDiscovery := stage.Span("discovery")
 	devices := partitions.Discover()
+	endDiscovery()
+	for _, dev := range devices {
+		if dev.IsDisk() {
+			l.Info("Discovered disk", zap.String("devname", dev.GetDeviceName()), zap.String("stableID", dev.StableID()), zap.Reflect("topology", dev.Topology()))
+		}
+	}
+
+	// track the outcome of the whole installation (which includes all subsequent stages) for the recovery policy
+	var installHistory *stage.InstallHistory
+	if cfg.Recovery.Enabled() {
+		installHistory = readInstallHistory()
+		defer func() { trackInstallOutcome(runErr) }()
+	}
 
 	// retrieve location info
 	// - location info from partition has priority
@@ -296,7 +437,7 @@ func Run(ctx context.Context, override *configstage.Stage0, logSettings *stage.L
 		locationInfo, err = locationPartition.GetLocation()
 		if err != nil {
 			l.Error("Retrieving location information from location partition failed", zap.Error(err))
-			return ErrExecution
+			return result, ErrExecution
 		}
 		l.Info("Location information found on location partition", zap.Reflect("locationInfo", locationInfo))
 		if cfg.Location != nil {
@@ -304,7 +445,7 @@ func Run(ctx context.Context, override *configstage.Stage0, logSettings *stage.L
 			if !reflect.DeepEqual(locationInfo, cfg.Location) {
 				err := fmt.Errorf("location information form partition does not match location information from configuration (fix this setup)")
 				l.Error("Location information mismatch", zap.Error(err), zap.Reflect("locationInfoPartition", locationInfo), zap.Reflect("locationInfoConfig", cfg.Location))
-				return executionError(err)
+				return result, executionError(err)
 			}
 		}
 	} else if cfg.Location != nil {
@@ -325,33 +466,109 @@ func Run(ctx context.Context, override *configstage.Stage0, logSettings *stage.L
 	hhdevid := devid.ID()
 	if hhdevid == "" {
 		l.Error("Determining device ID failed (hhdevid)")
-		return ErrExecution
+		return result, ErrExecution
 	}
 	stagingInfo.DeviceID = hhdevid
+	correlation = stagingInfo.Correlation("stage0")
+	setLogger(l)
 	if err := stagingInfo.Export(); err != nil {
 		l.Warn("Failed to export staging area information", zap.Error(err))
 	}
 	l.Info("Device ID determined successfully (hhdevid)", zap.String("hhdevid", hhdevid))
 
+	// build HTTP client
+	httpClientOpts := append([]stage.HTTPClientOption{stage.HTTPClientOptionServerCertificateIgnoreExpiryTime}, stage.LabModeOptions(cfg.LabMode)...)
+	httpClient, err := stage.SeederHTTPClient(cfg.CA, nil, httpClientOpts...)
+	if err != nil {
+		l.Error("Building HTTP client failed", zap.Error(err))
+		return result, executionError(err)
+	}
+
+	// persist TLS session tickets in the staging area so that the later stages can resume our sessions
+	if _, err := stage.WithTLSSessionCache(httpClient, stage.TLSSessionCachePath(stagingInfo.StagingDir)); err != nil {
+		l.Warn("Failed to enable TLS session cache, TLS sessions will not be resumed", zap.Error(err))
+	}
+
+	// configure an HTTP proxy: the embedded config wins over auto-detection from the ONIE environment
+	// NOTE: this must happen before we wrap the transport for response signature verification
+	proxy, proxySource := cfg.Proxy, "embedded config"
+	if proxy == nil {
+		proxy, proxySource = stage.ProxyFromOnieEnv(), "ONIE environment"
+	}
+	if proxy != nil {
+		if _, err := stage.WithProxy(httpClient, proxy); err != nil {
+			l.Warn("Invalid HTTP proxy settings, not using any proxy", zap.String("source", proxySource), zap.Reflect("proxy", proxy), zap.Error(err))
+		} else {
+			l.Info("Using HTTP proxy", zap.String("source", proxySource), zap.Reflect("proxy", proxy))
+			stagingInfo.Proxy = proxy
+		}
+	}
+
+	// all seeder responses (like IPAM) must be signed if we have a config signature CA
+	if len(cfg.SignatureCA) > 0 {
+		signatureCACert, err := x509.ParseCertificate(cfg.SignatureCA)
+		if err != nil {
+			l.Error("Parsing config signature CA failed", zap.Error(err))
+			return result, executionError(err)
+		}
+		signatureCAPool := x509.NewCertPool()
+		signatureCAPool.AddCert(signatureCACert)
+		stage.WithResponseSignatureVerification(httpClient, signatureCAPool)
+	} else {
+		l.Warn("No config signature CA available, seeder response signatures will not be verified")
+	}
+
+	// stop retrying forever if the previous installation attempts kept failing
+	if shouldEnterRecoveryMode(cfg.Recovery, installHistory) {
+		return result, enterRecoveryMode(ctx, l, httpClient, cfg.Recovery, installHistory, onieEnv, hhdevid)
+	}
+
+	// some platforms need extra kernel modules or firmware before their network interfaces come up,
+	// so this must happen before we look for network interfaces
+	if cfg.PlatformSupport != nil {
+		if err := stage.Timed("platform-support", func() error {
+			return loadPlatformSupport(ctx, httpClient, stagingInfo.StagingDir, cfg.PlatformSupport, onieEnv)
+		}); err != nil {
+			l.Error("Loading platform support bundle failed", zap.String("platform", cfg.PlatformSupport.Platform), zap.String("url", cfg.PlatformSupport.URL), zap.Error(err))
+			return result, executionError(fmt.Errorf("platform support bundle: %w", err))
+		}
+		l.Info("Platform support bundle loaded", zap.String("platform", cfg.PlatformSupport.Platform), zap.String("url", cfg.PlatformSupport.URL))
+	}
+
 	// retrieve network interface list
 	netdevs, err := net.GetInterfaces()
 	if err != nil {
 		l.Error("Retrieving network interface list failed", zap.Error(err))
-		return executionError(err)
+		return result, executionError(err)
 	}
 	l.Info("Capable network interface list retrieved", zap.Strings("netdevs", netdevs))
 
-	// build HTTP client
-	httpClient, err := stage.SeederHTTPClient(cfg.CA, nil, stage.HTTPClientOptionServerCertificateIgnoreExpiryTime)
+	// the LLDP neighbours let the seeder find out where we are without a location partition
+	lldpWait, err := configstage.ParseLLDPWait(cfg.Services.LLDPWait)
 	if err != nil {
-		l.Error("Building HTTP client failed", zap.Error(err))
-		return executionError(err)
+		l.Warn("Ignoring invalid LLDP wait time", zap.String("lldpWait", cfg.Services.LLDPWait), zap.Error(err))
+	}
+	if lldpWait > 0 {
+		endLLDP := stage.Span("lldp")
+		stagingInfo.Neighbors = discoverNeighbors(ctx, netdevs, lldpWait)
+		endLLDP()
+		l.Info("LLDP neighbors discovered", zap.Reflect("neighbors", stagingInfo.Neighbors))
 	}
 
 	// now issue the IPAM request if we need to
 	// NOTE: the seeder will decide if we need to do IPAM or not
 	var stage1Path string
 	if cfg.IPAMURL != "" {
+		ntpMaxOffset, err := configstage.ParseNTPMaxOffset(cfg.Services.NTPMaxOffset)
+		if err != nil {
+			l.Warn("Ignoring invalid NTP maximum offset", zap.String("ntpMaxOffset", cfg.Services.NTPMaxOffset), zap.Error(err))
+		}
+		macAllowlist := net.MACAllowlist(cfg.MACAllowlist)
+		if err := macAllowlist.Validate(); err != nil {
+			l.Warn("Ignoring invalid MAC allowlist", zap.Reflect("macAllowlist", cfg.MACAllowlist), zap.Error(err))
+			macAllowlist = nil
+		}
+
 		locationUUID := ""
 		var locationUUIDSig []byte
 		if locationInfo != nil {
@@ -364,23 +581,49 @@ func Run(ctx context.Context, override *configstage.Stage0, logSettings *stage.L
 			LocationUUID:          locationUUID,
 			LocationUUIDSignature: locationUUIDSig,
 			Interfaces:            netdevs,
+			Neighbors:             stagingInfo.Neighbors,
 		}
-		ipamResp, err := ipamClient(ctx, httpClient, cfg.IPAMURL, ipamReq, onieEnv)
-		if err != nil {
+		endIPAM := stage.Span("ipam")
+		ipamResp, err := doIPAMRequest(ctx, httpClient, cfg.IPAMURL, ipamReq, onieEnv)
+		endIPAM()
+		if errors.Is(err, ErrDeferred) {
+			return result, err
+		}
+		switch {
+		case err != nil && cfg.DHCPFallback:
+			l.Warn("IPAM request failure, falling back to DHCP", zap.Reflect("ipamRequest", ipamReq), zap.Error(err))
+		case err != nil:
 			l.Error("IPAM request failure", zap.Reflect("ipamRequest", ipamReq), zap.Error(err))
-			return executionError(err)
+			return result, executionError(err)
+		default:
+			l.Info("IPAM response received", zap.Reflect("ipamRequest", ipamReq), zap.Reflect("ipamResp", ipamResp))
 		}
-		l.Info("IPAM response received", zap.Reflect("ipamRequest", ipamReq), zap.Reflect("ipamResp", ipamResp))
 
 		// for the rest until we finished downloading stage 1, we iterate over all IP addresses that we got back
 		// and essentially retry the rest of stage 0 until it works
-		// first we try with "preferred" entries that we got back
-		for netdev, ipa := range ipamResp.IPAddresses {
-			if !ipa.Preferred {
+		// we try with "preferred" entries that we got back first
+		ipamReceived := time.Now()
+		for _, netdev := range ipamResp.Netdevs() {
+			// the seeder only reserves the addresses for the TTL of the response, so if this has been
+			// taking too long, they might have been handed out again already and we need to request them again
+			if ipamResp.Stale(ipamReceived) {
+				l.Info("IPAM response is stale, requesting it again", zap.String("nonce", ipamResp.Nonce), zap.Int64("ttl", ipamResp.TTL))
+				ipamReq.Nonce = ipamResp.Nonce
+				newIPAMResp, err := doIPAMRequest(ctx, httpClient, cfg.IPAMURL, ipamReq, onieEnv)
+				if err != nil {
+					l.Error("IPAM request failure", zap.Reflect("ipamRequest", ipamReq), zap.Error(err))
+					return result, executionError(err)
+				}
+				ipamResp, ipamReceived = newIPAMResp, time.Now()
+				l.Info("IPAM response received", zap.Reflect("ipamRequest", ipamReq), zap.Reflect("ipamResp", ipamResp))
+			}
+			ipa, ok := ipamResp.IPAddresses[netdev]
+			if !ok {
+				l.Warn("Network device is not part of the IPAM response anymore", zap.String("netdev", netdev))
 				continue
 			}
 			var err error
-			stage1Path, resetNetwork, err = runWith(ctx, stagingInfo, logSettings, httpClient, ipamResp, netdev, ipa)
+			stage1Path, resetNetwork, err = runWith(ctx, stagingInfo, o, httpClient, ipamResp, netdev, ipa, macAllowlist, ntpMaxOffset)
 			if err != nil {
 				l.Error("System network configuration failed for netdev", zap.String("netdev", netdev), zap.Reflect("ipa", ipa), zap.Error(err))
 				continue
@@ -388,38 +631,48 @@ func Run(ctx context.Context, override *configstage.Stage0, logSettings *stage.L
 			l.Info("System network configured", zap.String("netdev", netdev), zap.Reflect("ipa", ipa))
 			break
 		}
-		// if preferred responses did not work, we will try all other responses
-		if stage1Path == "" {
-			for netdev, ipa := range ipamResp.IPAddresses {
-				if ipa.Preferred {
-					continue
-				}
-				var err error
-				stage1Path, resetNetwork, err = runWith(ctx, stagingInfo, logSettings, httpClient, ipamResp, netdev, ipa)
-				if err != nil {
-					l.Error("System network configuration failed for netdev", zap.String("netdev", netdev), zap.Reflect("ipa", ipa), zap.Error(err))
-					continue
-				}
-				l.Info("System network configured", zap.String("netdev", netdev), zap.Reflect("ipa", ipa))
-				break
+		if stage1Path == "" && cfg.DHCPFallback {
+			l.Warn("System network configuration with IPAM failed for all network devices, falling back to DHCP")
+			var err error
+			stage1Path, resetNetwork, err = runWithDHCP(ctx, stagingInfo, o, httpClient, cfg, netdevs, macAllowlist, ntpMaxOffset)
+			if err != nil {
+				l.Error("System network configuration with DHCP failed for all network devices", zap.Error(err))
+				return result, executionError(err)
 			}
 		}
 		if stage1Path == "" {
 			l.Error("System network configuration failed for all network devices")
-			return ErrExecution
+			return result, ErrExecution
 		}
 	} else {
 		// if we don't need to do IPAM, then this means that we were configured with LLDP (hopefully)
 		// this means that we are going to setup NTP and Syslog servers from the configuration
 		var err error
-		stage1Path, err = runWithoutIPAM(ctx, stagingInfo, logSettings, httpClient, cfg)
+		stage1Path, err = runWithoutIPAM(ctx, stagingInfo, o, httpClient, cfg)
 		if err != nil {
 			l.Error("System configuration failed", zap.Error(err))
-			return executionError(err)
+			return result, executionError(err)
 		}
 		l.Info("System configuration successful")
 	}
 
+	// the seeder pinned the digest of stage 1 in our configuration
+	if err := stage.VerifyArtifactPin(stage1Path, cfg.Stage1Pin); err != nil {
+		l.Error("Stage 1 installer does not match its pinned digest", zap.String("path", stage1Path), zap.Reflect("pin", cfg.Stage1Pin), zap.Error(err))
+		return result, executionError(fmt.Errorf("stage 1 digest verification: %w", err))
+	}
+
+	// the seeder might be in the middle of a rotation of its server CA, so the later stages
+	// must trust the CAs of its current bundle, and not (only) the one which we were started with
+	if cfg.CABundleURL != "" {
+		bundle, updated, err := stage.RefreshCABundle(ctx, httpClient, cfg.CABundleURL, stage.CABundlePath(stagingInfo.StagingDir))
+		if err != nil {
+			l.Warn("Refreshing server CA bundle failed, later stages use the server CA from the embedded config", zap.String("url", cfg.CABundleURL), zap.Error(err))
+		} else if updated {
+			l.Info("Pinned server CA bundle", zap.String("url", cfg.CABundleURL), zap.Uint64("version", bundle.Version), zap.Int("certificates", len(bundle.Certificates)))
+		}
+	}
+
 	// set the log settings which will now also have the right syslog servers
 	stagingInfo.LogSettings = *logSettings
 	if err := stagingInfo.Export(); err != nil {
@@ -428,6 +681,14 @@ func Run(ctx context.Context, override *configstage.Stage0, logSettings *stage.L
 
 	// success
 	l.Info("Stage 0 completed successfully")
+	result.Timings = stage.FinishTimings(l, stagingInfo.StagingDir, nil)
+
+	result.StagingInfo = stagingInfo
+	result.NextStagePath = stage1Path
+	if o.SkipNextStage {
+		l.Info("Skipping execution of stage 1", zap.String("path", stage1Path))
+		return result, nil
+	}
 
 	// execute stage 1 now
 	l.Info("Executing stage 1 now...")
@@ -436,16 +697,21 @@ func Run(ctx context.Context, override *configstage.Stage0, logSettings *stage.L
 	stage1Cmd.Stderr = os.Stderr
 	stage1Cmd.Stdout = os.Stdout
 	if err := stage1Cmd.Run(); err != nil {
+		if stage.IsCancelledExit(err) {
+			l.Warn("Installation was cancelled by the seeder, reverting network configuration")
+			return result, fmt.Errorf("%w: stage 1 aborted", stage.ErrInstallCancelled)
+		}
 		l.Error("Stage 1 execution failed", zap.Error(err))
-		return executionError(err)
+		return result, executionError(err)
 	}
 
 	// as all installers are forked and execed, this is really the end of everything :)
 	l.Info("Installation complete")
-	return nil
+	return result, nil
 }
 
-func runWith(ctx context.Context, stagingInfo *stage.StagingInfo, logSettings *stage.LogSettings, httpClient *http.Client, ipamResp *ipam.Response, netdev string, ipa ipam.IPAddress) (funcRet string, funcResetNetwork func(), funcErr error) {
+func runWith(ctx context.Context, stagingInfo *stage.StagingInfo, o *stage.RunOptions, httpClient *http.Client, ipamResp *ipam.Response, netdev string, ipa ipam.IPAddress, macAllowlist net.MACAllowlist, ntpMaxOffset time.Duration) (funcRet string, funcResetNetwork func(), funcErr error) {
+	logSettings := o.LogSettings
 	// first things first: configure network interface, and we need to do some conversions first
 	// if these fail, then there is no need to proceed with anything else
 	ipaddrnets, err := net.StringsToIPNets(ipa.IPAddresses)
@@ -480,6 +746,8 @@ func runWith(ctx context.Context, stagingInfo *stage.StagingInfo, logSettings *s
 	// NOTE: We will also pass on this function **on success**, so that if anything else fails down the line, this function can be called to
 	// reset the network.
 	resetNetwork := func() {
+		restoreDNS()
+		defer restoreMACAllowlist(stagingInfo.StagingDir)
 		if ipa.VLAN > 0 {
 			if err := net.DeleteVLANDevice(vlanName, ipaddrnets, routes); err != nil {
 				l.Warn("Deleting VLAN device or reverting its configuration failed", zap.String("vlanDevice", vlanName), zap.Error(err))
@@ -500,10 +768,33 @@ func runWith(ctx context.Context, stagingInfo *stage.StagingInfo, logSettings *s
 		}
 	}()
 
+	// the port security of the fabric might only allow specific MAC addresses on the VLAN
+	devOpts, err := prepareMACAllowlist(stagingInfo.StagingDir, macAllowlist, netdev, ipa.VLAN)
+	if err != nil {
+		l.Error("Applying allowlisted MAC address failed", zap.String("netdev", netdev), zap.Uint16("vlan", ipa.VLAN), zap.Error(err))
+		return "", nil, fmt.Errorf("applying allowlisted MAC address: %w", err)
+	}
+
+	// a previous run might have left a half-configured network behind, clean it up before we configure anything
+	stale, err := net.ReconcileNetworkState(netdev, ipa.VLAN, vlanName, ipaddrnets)
+	if err != nil {
+		l.Error("Reconciling stale network state failed", zap.String("netdev", netdev), zap.String("vlanInterface", vlanName), zap.Uint16("vlan", ipa.VLAN), zap.Error(err))
+		return "", nil, fmt.Errorf("reconciling stale network state: %w", err)
+	}
+	if !stale.IsEmpty() {
+		l.Warn("Cleaned up stale network state of a previous run",
+			zap.String("netdev", netdev),
+			zap.Strings("deletedDevices", stale.DeletedDevices),
+			zap.Strings("removedAddresses", stale.RemovedAddresses),
+		)
+	}
+
 	// VLAN configuration is being considered optional when its value is `0`
 	// otherwise we configure the IP and routes directly on netdev
 	if ipa.VLAN > 0 {
-		if err := net.AddVLANDeviceWithIP(netdev, ipa.VLAN, vlanName, ipaddrnets, routes); err != nil {
+		if err := stage.Timed("network", func() error {
+			return net.AddVLANDeviceWithIP(netdev, ipa.VLAN, vlanName, ipa.MTU, ipaddrnets, routes, devOpts...)
+		}); err != nil {
 			l.Error("VLAN interface creation and configuration failed",
 				zap.String("netdev", netdev),
 				zap.String("vlanInterface", vlanName),
@@ -522,7 +813,9 @@ func runWith(ctx context.Context, stagingInfo *stage.StagingInfo, logSettings *s
 			zap.Reflect("routes", routes),
 		)
 	} else {
-		if err := net.ConfigureDeviceWithIP(netdev, ipaddrnets, routes); err != nil {
+		if err := stage.Timed("network", func() error {
+			return net.ConfigureDeviceWithIP(netdev, ipa.MTU, ipaddrnets, routes)
+		}); err != nil {
 			l.Error("Configuring network interface failed",
 				zap.String("netdev", netdev),
 				zap.Reflect("ipaddrnets", ipaddrnets),
@@ -538,38 +831,66 @@ func runWith(ctx context.Context, stagingInfo *stage.StagingInfo, logSettings *s
 		)
 	}
 
+	// configure DNS so that we can deal with hostnames in URLs
+	configureDNS(ipamResp.DNSServers, ipamResp.DNSSearch)
+
 	// configure the syslog logger so that we're not blind anymore
 	// this gets a special context so that if this function failed
 	// we will essentially stop the underlying syslog client
 	// however, we want to keep it running on success
-	logSettings.SyslogServers = ipamResp.SyslogServers
+	// IPv6 link-local servers are only reachable through the device which we just configured
+	dev := netdev
+	if ipa.VLAN > 0 {
+		dev = vlanName
+	}
+	logSettings.SyslogServers = withZone(ipamResp.SyslogServers, dev)
+	ntpServers := withZone(ipamResp.NTPServers, dev)
 	logCtx, logCtxCancel := context.WithCancel(ctx)
 	defer func() {
 		if funcErr != nil {
 			logCtxCancel()
 		}
 	}()
-	if err := stage.InitializeGlobalLogger(logCtx, logSettings); err != nil {
-		l.Warn("Reinitializing global logger with new settings including syslog servers failed", zap.String("netdev", netdev), zap.Strings("syslogServers", ipamResp.SyslogServers), zap.Error(err))
+	if newL, err := o.InitializeLogger(logCtx, logSettings); err != nil {
+		l.Warn("Reinitializing global logger with new settings including syslog servers failed", zap.String("netdev", netdev), zap.Strings("syslogServers", logSettings.SyslogServers), zap.Error(err))
 	} else {
-		l = log.L()
+		setLogger(newL)
 		l.Info("Reinitialized global logger with new settings including syslog servers",
 			zap.String("netdev", netdev),
-			zap.Strings("syslogServers", ipamResp.SyslogServers),
+			zap.Strings("syslogServers", logSettings.SyslogServers),
 		)
 	}
 
+	// let the engineer on the console (and everybody watching syslog) know who claimed this device
+	printBanner(ipamResp.Banner)
+
 	// now run NTP - we only fail if NTP fails, not if hardware clock sync fails
-	l.Info("Trying to query NTP servers now to synchronize system clock...", zap.String("netdev", netdev), zap.Strings("ntpServers", ipamResp.NTPServers))
-	if err := ntp.SyncClock(ctx, ipamResp.NTPServers); err != nil && !errors.Is(err, ntp.ErrHWClockSync) {
+	l.Info("Trying to query NTP servers now to synchronize system clock...", zap.String("netdev", netdev), zap.Strings("ntpServers", ntpServers))
+	if err := stage.Timed("ntp", func() error { return syncClock(ctx, ntpServers, ntpMaxOffset) }); err != nil && !errors.Is(err, ntp.ErrHWClockSync) {
 		l.Error("Syncing system clock with NTP failed", zap.String("netdev", netdev), zap.Error(err))
 		return "", nil, fmt.Errorf("syncing clock with NTP: %w", err)
 	}
-	l.Info("System clock successfully synchronized with NTP", zap.String("netdev", netdev), zap.Strings("ntpServers", ipamResp.NTPServers))
+	l.Info("System clock successfully synchronized with NTP", zap.String("netdev", netdev), zap.Strings("ntpServers", ntpServers))
+
+	// if an MTU was configured, we pass it on to the next stages, and verify
+	// with a path MTU probe that it is actually effective towards the seeder
+	stagingInfo.MTU = ipa.MTU
+	if info, err := stage.CheckPathMTU(ctx, ipamResp.Stage1URL, ipa.MTU); err != nil {
+		l.Warn("Path MTU check towards seeder failed", zap.String("netdev", netdev), zap.String("url", ipamResp.Stage1URL), zap.Int("mtu", ipa.MTU), zap.Reflect("pathMTU", info), zap.Error(err))
+	} else if info != nil {
+		l.Info("Path MTU check towards seeder successful", zap.String("netdev", netdev), zap.String("url", ipamResp.Stage1URL), zap.Int("mtu", ipa.MTU), zap.Reflect("pathMTU", info))
+	}
 
 	// now try to download stage 1
 	stage1Path := filepath.Join(stagingInfo.StagingDir, "stage1")
-	if err := stage.DownloadExecutable(ctx, httpClient, ipamResp.Stage1URL, stage1Path, 60*time.Second); err != nil {
+	if err := stage.Timed("download-stage1", func() error {
+		opts, err := stagingInfo.ArtifactDownloadOptions()
+		if err != nil {
+			return err
+		}
+		_, err = stage.DownloadExecutableFromMirrors(ctx, httpClient, stage.MirrorURLs(ipamResp.Stage1URL, ipamResp.Stage1Mirrors), stage1Path, 60*time.Second, opts...)
+		return err
+	}); err != nil {
 		l.Error("Downloading stage 1 installer failed", zap.String("netdev", netdev), zap.String("url", ipamResp.Stage1URL), zap.String("dest", stage1Path), zap.Error(err))
 		return "", nil, fmt.Errorf("downloading stage 1: %w", err)
 	}
@@ -580,70 +901,50 @@ func runWith(ctx context.Context, stagingInfo *stage.StagingInfo, logSettings *s
 	return stage1Path, resetNetwork, nil
 }
 
-func ipamClient(ctx context.Context, hc *http.Client, ipamURLStr string, req *ipam.Request, onieEnv *stage.OnieEnv) (*ipam.Response, error) {
-	ipamURL, err := url.Parse(ipamURLStr)
-	if err != nil {
-		return nil, fmt.Errorf("IPAM URL validation error: %w", err)
-	}
-
-	// if the IPAM URL is not a link-local address host, we can short-circuit here
-	if !strings.HasPrefix(ipamURL.Host, "[fe80:") && !strings.HasPrefix(ipamURL.Host, "fe80:") {
-		l.Debug("IPAM URL does not have a link-local host", zap.String("host", ipamURL.Host))
-		return ipam.DoRequest(ctx, hc, req, ipamURLStr)
-	}
-
-	// check if this is from within an ONIE installer
-	// because then we are going to assume that we want to use the same interface that
-	// was used to download the stage 0 installer
-	// that is of course only the case if this was downloaded from a link-local address URL
-	if strings.Contains(onieEnv.ExecURL, "fe80:") {
-		l.Warn("IPAM URL is on a link-local host, as was the stage 0 installer. We are trying to reuse the same interface for the request.", zap.String("ExecURL", onieEnv.ExecURL))
-
-		// ONIE doesn't get URL encoding right for the host
-		// Furthermore, some older ONIE versions are even not using brackets around the
-		// IPv6 address
-		// This is why we have a dedicated URL parser package which deals with broken URLs
-		// However, we need to deal with the %netdev part beforehand, as it is impossible to get this
-		// corrected generically for all use-cases.
-		// NOTE: do *NOT* use this package for anything else than parsing the ONIE Exec URL
-		execURLStr := onieEnv.ExecURL
-		if !strings.Contains(onieEnv.ExecURL, "%25") {
-			execURLStr = strings.Replace(onieEnv.ExecURL, "%", "%25", 1)
-		}
-		execURL, err := onieurl.Parse(execURLStr)
-		if err != nil {
-			return nil, fmt.Errorf("ONIE Exec URL validation error: %w", err)
+// syncClock synchronizes the system clock with NTP, and records the measurements for the install report
+func syncClock(ctx context.Context, servers []string, maxOffset time.Duration) error {
+	res, err := ntp.SyncClock(ctx, servers, ntp.SyncOptionMaxOffset(maxOffset))
+	if res != nil {
+		ts := &stage.TimeSync{
+			Server:             res.Server,
+			Offset:             stage.Duration(res.Offset),
+			Delay:              stage.Duration(res.Delay),
+			Stratum:            res.Stratum,
+			RootDistance:       stage.Duration(res.RootDistance),
+			Confirmed:          res.Confirmed,
+			ConfirmationServer: res.ConfirmationServer,
+			ConfirmationOffset: stage.Duration(res.ConfirmationOffset),
 		}
-		host := strings.SplitN(execURL.Host, "%", 2)
-		if len(host) != 2 {
-			return nil, fmt.Errorf("ONIE Exec URL Host splitting issue: [Host: '%s', Splitted Parts: %d]", execURL.Host, len(host))
+		if err != nil {
+			ts.Error = err.Error()
 		}
-
-		netdev := strings.TrimRight(host[1], "]")
-		hostTrimmed := strings.TrimLeft(strings.TrimRight(ipamURL.Host, "]"), "[")
-
-		// now adjust the URL, and use it
-		ipamURL.Host = "[" + hostTrimmed + "%" + netdev + "]"
-		return ipam.DoRequest(ctx, hc, req, ipamURL.String())
+		stage.RecordTimeSync(ts)
+		l.Info("NTP measurements", zap.Reflect("timeSync", ts))
 	}
+	return err
+}
 
-	// otherwise this is probably being executed from the ONIE rescue system
-	// we will simply try the request on all interfaces
-	l.Warn("IPAM URL is on a link-local host, and failed to detect which network interface to use. We will try all of them", zap.Strings("netdevs", req.Interfaces))
-	urlHost := ipamURL.Host
-	for _, netdev := range req.Interfaces {
-		ipamURL.Host = urlHost + "%" + netdev
-		resp, err := ipam.DoRequest(ctx, hc, req, ipamURL.String())
-		if err != nil {
-			l.Error("IPAM request failure", zap.String("netdev", netdev), zap.String("url", ipamURL.String()), zap.Reflect("ipamRequest", req), zap.Error(err))
-			continue
-		}
-		return resp, nil
+// printBanner prints the operator banner to the console, and logs it which also sends it to syslog
+func printBanner(b *banner.Banner) {
+	if b.IsEmpty() {
+		return
 	}
-	return nil, fmt.Errorf("request failed on all network interfaces [%s]", strings.Join(req.Interfaces, ","))
+	if err := b.Print(os.Stdout); err != nil {
+		l.Warn("Printing operator banner to console failed", zap.Error(err))
+	}
+	l.Info("Device claimed by seeder", zap.Object("banner", b))
 }
 
-func runWithoutIPAM(ctx context.Context, stagingInfo *stage.StagingInfo, logSettings *stage.LogSettings, httpClient *http.Client, cfg *configstage.Stage0) (funcRet string, funcErr error) {
+func runWithoutIPAM(ctx context.Context, stagingInfo *stage.StagingInfo, o *stage.RunOptions, httpClient *http.Client, cfg *configstage.Stage0) (funcRet string, funcErr error) {
+	logSettings := o.LogSettings
+	// configure DNS so that we can deal with hostnames in URLs
+	configureDNS(cfg.Services.DNSServers, cfg.Services.DNSSearch)
+	defer func() {
+		if funcErr != nil {
+			restoreDNS()
+		}
+	}()
+
 	// configure the syslog logger so that we're not blind anymore
 	// this gets a special context so that if this function failed
 	// we will essentially stop the underlying syslog client
@@ -655,18 +956,25 @@ func runWithoutIPAM(ctx context.Context, stagingInfo *stage.StagingInfo, logSett
 			logCtxCancel()
 		}
 	}()
-	if err := stage.InitializeGlobalLogger(logCtx, logSettings); err != nil {
+	if newL, err := o.InitializeLogger(logCtx, logSettings); err != nil {
 		l.Warn("Reinitializing global logger with new settings including syslog servers failed", zap.Strings("syslogServers", cfg.Services.SyslogServers), zap.Error(err))
 	} else {
-		l = log.L()
+		setLogger(newL)
 		l.Info("Reinitialized global logger with new settings including syslog servers",
 			zap.Strings("syslogServers", cfg.Services.SyslogServers),
 		)
 	}
 
+	// let the engineer on the console (and everybody watching syslog) know who claimed this device
+	printBanner(cfg.Banner)
+
 	// now run NTP - we only fail if NTP fails, not if hardware clock sync fails
 	l.Info("Trying to query NTP servers now to synchronize system clock...", zap.Strings("ntpServers", cfg.Services.NTPServers))
-	if err := ntp.SyncClock(ctx, cfg.Services.NTPServers); err != nil && !errors.Is(err, ntp.ErrHWClockSync) {
+	ntpMaxOffset, err := configstage.ParseNTPMaxOffset(cfg.Services.NTPMaxOffset)
+	if err != nil {
+		l.Warn("Ignoring invalid NTP maximum offset", zap.String("ntpMaxOffset", cfg.Services.NTPMaxOffset), zap.Error(err))
+	}
+	if err := stage.Timed("ntp", func() error { return syncClock(ctx, cfg.Services.NTPServers, ntpMaxOffset) }); err != nil && !errors.Is(err, ntp.ErrHWClockSync) {
 		l.Error("Syncing system clock with NTP failed", zap.Error(err))
 		return "", fmt.Errorf("syncing clock with NTP: %w", err)
 	}
@@ -674,7 +982,14 @@ func runWithoutIPAM(ctx context.Context, stagingInfo *stage.StagingInfo, logSett
 
 	// now try to download stage 1
 	stage1Path := filepath.Join(stagingInfo.StagingDir, "stage1")
-	if err := stage.DownloadExecutable(ctx, httpClient, cfg.Stage1URL, stage1Path, 60*time.Second); err != nil {
+	if err := stage.Timed("download-stage1", func() error {
+		opts, err := stagingInfo.ArtifactDownloadOptions()
+		if err != nil {
+			return err
+		}
+		_, err = stage.DownloadExecutableFromMirrors(ctx, httpClient, stage.MirrorURLs(cfg.Stage1URL, cfg.Stage1Mirrors), stage1Path, 60*time.Second, opts...)
+		return err
+	}); err != nil {
 		l.Error("Downloading stage 1 installer failed", zap.String("url", cfg.Stage1URL), zap.String("dest", stage1Path), zap.Error(err))
 		return "", fmt.Errorf("downloading stage 1: %w", err)
 	}
@@ -0,0 +1,219 @@
+// Copyright 2023 Hedgehog
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package stage0
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"go.githedgehog.com/dasboot/pkg/stage"
+	configstage "go.githedgehog.com/dasboot/pkg/stage0/config"
+	"go.uber.org/zap"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	stagingDirPrefix = "das-boot-"
+
+	// defaultTmpfsPercent is what the kernel uses as tmpfs size if it is not set
+	defaultTmpfsPercent = 50
+
+	// tmpfsMemoryReserve is the memory which is being left for everything else when the tmpfs gets sized
+	tmpfsMemoryReserve uint64 = 128 << 20
+
+	// minTmpfsSize is the smallest tmpfs which we are going to mount. Anything smaller would not even fit
+	// the stage 1 installer.
+	minTmpfsSize uint64 = 64 << 20
+)
+
+// these can be swapped out for testing
+var (
+	procMeminfo = "/proc/meminfo"
+	mountTmpfs  = func(dir string, size uint64) error {
+		return unix.Mount("das-boot", dir, "tmpfs", 0, fmt.Sprintf("size=%d", size))
+	}
+)
+
+// readMeminfo returns the total and the available memory in bytes
+func readMeminfo() (total uint64, available uint64, err error) {
+	b, err := os.ReadFile(procMeminfo)
+	if err != nil {
+		return 0, 0, err
+	}
+	var haveTotal, haveAvailable bool
+	scanner := bufio.NewScanner(bytes.NewReader(b))
+	for scanner.Scan() {
+		// lines are of the form "MemTotal:        2035804 kB"
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 3 || fields[2] != "kB" {
+			continue
+		}
+		val, err := strconv.ParseUint(fields[1], 10, 64)
+		if err != nil {
+			continue
+		}
+		switch fields[0] {
+		case "MemTotal:":
+			total, haveTotal = val<<10, true
+		case "MemAvailable:":
+			available, haveAvailable = val<<10, true
+		}
+	}
+	if !haveTotal || !haveAvailable {
+		return 0, 0, fmt.Errorf("%s: MemTotal or MemAvailable missing", procMeminfo)
+	}
+	return total, available, nil
+}
+
+// stagingTmpfsSize determines the size of the tmpfs for the staging area from the configured size and the
+// available memory. It returns false if no tmpfs should be mounted at all.
+func stagingTmpfsSize(cfg *configstage.Staging) (uint64, bool) {
+	sizeStr := ""
+	if cfg != nil {
+		sizeStr = cfg.TmpfsSize
+	}
+	if sizeStr == "0" {
+		l.Info("Mounting a tmpfs onto the staging area is disabled by configuration")
+		return 0, false
+	}
+	size, percent := uint64(0), uint64(defaultTmpfsPercent)
+	if sizeStr != "" {
+		var err error
+		size, percent, err = configstage.ParseTmpfsSize(sizeStr)
+		if err != nil {
+			// the config was validated already, so this is not supposed to happen
+			l.Warn("Invalid tmpfs size for staging area, using kernel default", zap.String("tmpfsSize", sizeStr), zap.Error(err))
+			size, percent = 0, defaultTmpfsPercent
+		}
+	}
+
+	total, available, err := readMeminfo()
+	if err != nil {
+		if percent > 0 {
+			l.Warn("Failed to read system memory information, mounting tmpfs for staging area with kernel default size", zap.Error(err))
+			return 0, true
+		}
+		l.Warn("Failed to read system memory information, mounting tmpfs for staging area without validating its size", zap.Uint64("size", size), zap.Error(err))
+		return size, true
+	}
+	if percent > 0 {
+		size = total * percent / 100
+	}
+
+	// the tmpfs only uses memory for what is stored in it, but we are going to fill it with large downloads
+	var limit uint64
+	if available > tmpfsMemoryReserve {
+		limit = available - tmpfsMemoryReserve
+	}
+	if size > limit {
+		if limit < minTmpfsSize {
+			l.Warn("Not enough memory available for a tmpfs for the staging area, staging area is backed by its base directory instead",
+				zap.Uint64("requestedSize", size),
+				zap.Uint64("memAvailable", available),
+				zap.Uint64("memTotal", total),
+			)
+			return 0, false
+		}
+		l.Warn("Requested tmpfs size for staging area exceeds available memory, limiting it",
+			zap.Uint64("requestedSize", size),
+			zap.Uint64("size", limit),
+			zap.Uint64("memAvailable", available),
+			zap.Uint64("memTotal", total),
+		)
+		size = limit
+	}
+	return size, true
+}
+
+// stagingBaseDir returns the configured base directory for the staging area, or the system temporary directory
+func stagingBaseDir(cfg *configstage.Staging) string {
+	if cfg != nil && cfg.BaseDir != "" {
+		return cfg.BaseDir
+	}
+	return os.TempDir()
+}
+
+// prepareStagingArea creates the staging area directory, and mounts a tmpfs onto it. It falls back to the system
+// temporary directory if the configured base directory cannot be used. If it returns an error, the staging area
+// is the system temporary directory itself. It returns true if a tmpfs was mounted.
+func prepareStagingArea(cfg *configstage.Staging) (string, bool, error) {
+	baseDir := stagingBaseDir(cfg)
+	stagingDir, err := mkdirStagingArea(baseDir)
+	if err != nil && baseDir != os.TempDir() {
+		l.Warn("Failed to create staging area in configured base directory, falling back to system temporary directory", zap.String("baseDir", baseDir), zap.Error(err))
+		stagingDir, err = mkdirStagingArea(os.TempDir())
+	}
+	if err != nil {
+		return os.TempDir(), false, err
+	}
+
+	size, ok := stagingTmpfsSize(cfg)
+	if !ok {
+		return stagingDir, false, nil
+	}
+	if err := mountTmpfs(stagingDir, size); err != nil {
+		l.Warn("failed to mount tmpfs onto dedicated temporary staging directory", zap.String("stagingDir", stagingDir), zap.Uint64("size", size), zap.Error(err))
+		return stagingDir, false, nil
+	}
+	l.Info("Mounted tmpfs onto staging area", zap.String("stagingDir", stagingDir), zap.Uint64("size", size))
+	return stagingDir, true, nil
+}
+
+func mkdirStagingArea(baseDir string) (string, error) {
+	if err := os.MkdirAll(baseDir, 0o755); err != nil {
+		return "", err
+	}
+	return os.MkdirTemp(baseDir, stagingDirPrefix)
+}
+
+// removePreviousStagingArea unmounts and removes the staging area `dir` of a previous installation attempt
+func removePreviousStagingArea(dir string) {
+	// unmount it first, if it is mounted
+	if ok, _ := stage.IsMountPoint(dir); ok {
+		if err := unix.Unmount(dir, 0); err != nil {
+			l.Warn("Failed to unmount previously used DAS BOOT staging directory", zap.String("stagingDir", dir), zap.Error(err))
+		} else {
+			l.Info("Unmounted previously existing DAS BOOT staging directory", zap.String("stagingDir", dir))
+		}
+	}
+	// remove it and everything in there
+	if err := os.RemoveAll(dir); err != nil {
+		l.Warn("Failed to remove previously used DAS BOOT staging directory", zap.String("stagingDir", dir), zap.Error(err))
+	} else {
+		l.Info("Removed previously existing DAS BOOT staging directory", zap.String("stagingDir", dir))
+	}
+}
+
+// removePreviousStagingAreas removes all staging areas of previous installation attempts in `baseDir`
+func removePreviousStagingAreas(baseDir string) {
+	entries, err := os.ReadDir(baseDir)
+	if err != nil {
+		// the base directory might simply not exist yet
+		if !os.IsNotExist(err) {
+			l.Warn("Failed to read directory entries from staging base directory. We will not be able to cleanup from previous installation attempts", zap.String("baseDir", baseDir), zap.Error(err))
+		}
+		return
+	}
+	for _, entry := range entries {
+		if entry.IsDir() && strings.HasPrefix(entry.Name(), stagingDirPrefix) {
+			removePreviousStagingArea(filepath.Join(baseDir, entry.Name()))
+		}
+	}
+}
@@ -0,0 +1,119 @@
+// Copyright 2023 Hedgehog
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package stage0
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	configstage "go.githedgehog.com/dasboot/pkg/stage0/config"
+)
+
+func TestStagingTmpfsSize(t *testing.T) {
+	tests := []struct {
+		name      string
+		cfg       *configstage.Staging
+		total     uint64
+		available uint64
+		want      uint64
+		wantMount bool
+	}{
+		{
+			name:      "kernel default",
+			total:     4 << 30,
+			available: 3 << 30,
+			want:      2 << 30,
+			wantMount: true,
+		},
+		{
+			name:      "percentage",
+			cfg:       &configstage.Staging{TmpfsSize: "25%"},
+			total:     4 << 30,
+			available: 3 << 30,
+			want:      1 << 30,
+			wantMount: true,
+		},
+		{
+			name:      "bytes",
+			cfg:       &configstage.Staging{TmpfsSize: "512m"},
+			total:     4 << 30,
+			available: 3 << 30,
+			want:      512 << 20,
+			wantMount: true,
+		},
+		{
+			name:      "disabled",
+			cfg:       &configstage.Staging{TmpfsSize: "0"},
+			total:     4 << 30,
+			available: 3 << 30,
+		},
+		{
+			name:      "limited to available memory",
+			cfg:       &configstage.Staging{TmpfsSize: "3g"},
+			total:     4 << 30,
+			available: 1 << 30,
+			want:      1<<30 - tmpfsMemoryReserve,
+			wantMount: true,
+		},
+		{
+			name:      "not enough memory",
+			total:     1 << 30,
+			available: 150 << 20,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			procMeminfo = filepath.Join(t.TempDir(), "meminfo")
+			defer func() { procMeminfo = "/proc/meminfo" }()
+			meminfo := fmt.Sprintf("MemTotal:       %d kB\nMemFree:        1024 kB\nMemAvailable:   %d kB\n", tt.total>>10, tt.available>>10)
+			if err := os.WriteFile(procMeminfo, []byte(meminfo), 0o644); err != nil {
+				t.Fatal(err)
+			}
+			got, gotMount := stagingTmpfsSize(tt.cfg)
+			if got != tt.want || gotMount != tt.wantMount {
+				t.Errorf("stagingTmpfsSize() = %d, %v, want %d, %v", got, gotMount, tt.want, tt.wantMount)
+			}
+		})
+	}
+}
+
+func TestPrepareStagingArea(t *testing.T) {
+	oldMountTmpfs := mountTmpfs
+	defer func() { mountTmpfs = oldMountTmpfs }()
+	var mounted string
+	mountTmpfs = func(dir string, _ uint64) error {
+		mounted = dir
+		return nil
+	}
+
+	baseDir := filepath.Join(t.TempDir(), "staging")
+	dir, tmpfs, err := prepareStagingArea(&configstage.Staging{BaseDir: baseDir})
+	if err != nil {
+		t.Fatalf("prepareStagingArea() error = %v", err)
+	}
+	if filepath.Dir(dir) != baseDir {
+		t.Errorf("prepareStagingArea() = %s, want it within %s", dir, baseDir)
+	}
+	if tmpfs && mounted != dir {
+		t.Errorf("prepareStagingArea() mounted tmpfs on %s, want %s", mounted, dir)
+	}
+
+	removePreviousStagingAreas(baseDir)
+	if _, err := os.Stat(dir); !os.IsNotExist(err) {
+		t.Errorf("removePreviousStagingAreas() did not remove %s: %v", dir, err)
+	}
+}
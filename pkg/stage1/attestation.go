@@ -0,0 +1,67 @@
+// Copyright 2023 Hedgehog
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package stage1
+
+import (
+	"context"
+	"errors"
+
+	"github.com/0x5a17ed/uefi/efi/efivars"
+	"go.githedgehog.com/dasboot/pkg/efivar"
+	"go.githedgehog.com/dasboot/pkg/partitions/identity"
+	"go.githedgehog.com/dasboot/pkg/seeder/registration"
+	"go.githedgehog.com/dasboot/pkg/stage"
+	"go.uber.org/zap"
+)
+
+// efiVars is where the secure boot state is being read from
+var efiVars = efivar.NewDefault()
+
+// collectAttestationEvidence collects the attestation evidence for a registration request with `csr`. This is
+// best-effort: it is up to the attestation policy of the seeder to reject requests with insufficient evidence.
+// The serial number of the ONIE EEPROM is part of the inventory of the request.
+func collectAttestationEvidence(ctx context.Context, onieEnv *stage.OnieEnv, identityPartition identity.IdentityPartition, csr []byte) *registration.Evidence {
+	ret := &registration.Evidence{
+		ONIEVersion: onieEnv.Version,
+	}
+
+	secureBoot, err := secureBootEnabled(ctx)
+	if err != nil {
+		l.Warn("Reading secure boot state failed", zap.Error(err))
+	}
+	ret.SecureBoot = secureBoot
+
+	q, err := identityPartition.Quote(registration.QualifyingData(csr))
+	switch {
+	case errors.Is(err, identity.ErrNoTPMKey):
+		l.Info("Client key is not held by a TPM, registering without TPM quote")
+	case err != nil:
+		l.Warn("Quoting PCRs with the TPM failed, registering without TPM quote", zap.Error(err))
+	default:
+		ret.Quote = q
+	}
+
+	l.Info("Collected attestation evidence", zap.String("onieVersion", ret.ONIEVersion), zap.Bool("secureBoot", ret.SecureBoot), zap.Bool("quote", ret.Quote != nil))
+	return ret
+}
+
+// secureBootEnabled reads the "SecureBoot" EFI variable which the firmware sets to 1 if it booted with secure boot
+func secureBootEnabled(ctx context.Context) (bool, error) {
+	_, v, err := efiVars.Get(ctx, "SecureBoot", efivars.GlobalVariable)
+	if err != nil {
+		return false, err
+	}
+	return len(v) == 1 && v[0] == 1, nil
+}
@@ -15,7 +15,10 @@
 package config
 
 import (
+	"fmt"
+
 	"go.githedgehog.com/dasboot/pkg/config"
+	"go.githedgehog.com/dasboot/pkg/version"
 )
 
 var _ config.EmbeddedConfig = &Stage1{}
@@ -38,41 +41,65 @@ var _ config.EmbeddedConfig = &Stage1{}
 //	}
 type Stage1 struct {
 	// Keylime is the keylime configuration
-	Keylime *KeylimeConfig `json:"keylime,omitempty" yaml:"keylime,omitempty"`
+	Keylime *KeylimeConfig `json:"keylime,omitempty" yaml:"keylime,omitempty" merge:"deep"`
 
 	// RegisterURL will be called by stage 1 to register the device (and receive its client certificate)
-	RegisterURL string `json:"register_url,omitempty" yaml:"register_url,omitempty"`
+	RegisterURL string `json:"register_url,omitempty" yaml:"register_url,omitempty" merge:"set"`
+
+	// RenewURL will be called by stage 1 to renew its client certificate before it expires. If it is empty,
+	// devices register again once their certificate expired.
+	RenewURL string `json:"renew_url,omitempty" yaml:"renew_url,omitempty" merge:"set"`
 
 	// Stage2URL is the URL to the stage 2 installer
-	Stage2URL string `json:"stage2_url,omitempty" yaml:"stage2_url,omitempty"`
+	Stage2URL string `json:"stage2_url,omitempty" yaml:"stage2_url,omitempty" merge:"set,reset=Stage2Pin,reset=Stage2Mirrors"`
+
+	// Stage2Pin pins the digest of the stage 2 installer. If it is set, stage 1 will refuse to execute a
+	// stage 2 installer which does not match it.
+	Stage2Pin *version.ArtifactPin `json:"stage2_pin,omitempty" yaml:"stage2_pin,omitempty" merge:"set"`
+
+	// Stage2Mirrors are additional URLs which serve the same stage 2 installer as `Stage2URL`. Stage 1 ranks
+	// all of them by latency and falls back to the next one if a download fails.
+	Stage2Mirrors []string `json:"stage2_mirrors,omitempty" yaml:"stage2_mirrors,omitempty" merge:"replace"`
+
+	// EncryptIdentityPartition creates the identity partition as a LUKS container which is unlocked with keys
+	// that are derived from the TPM and from the location information. Existing partitions are not converted.
+	EncryptIdentityPartition bool `json:"encrypt_identity_partition,omitempty" yaml:"encrypt_identity_partition,omitempty" merge:"set"`
+
+	// IdentityBackupURL is where stage 1 uploads the encrypted backup of the device identity, and from where it
+	// restores the identity of a registered device whose identity partition was lost. Backups are disabled if empty.
+	IdentityBackupURL string `json:"identity_backup_url,omitempty" yaml:"identity_backup_url,omitempty" merge:"set"`
+
+	// LabMode is set by a seeder which runs in its insecure lab mode. Only then plain HTTP URLs are accepted.
+	// It can only be set in the embedded configuration and never by an override.
+	LabMode bool `json:"lab_mode,omitempty" yaml:"lab_mode,omitempty" merge:"-"`
 
 	// SignatureCert holds the DER encoded X509 certificate with which the signature of the embedded config
 	// can be validated
-	SignatureCert []byte `json:"signature_cert,omitempty" yaml:"signature_cert,omitempty"`
+	SignatureCert []byte `json:"signature_cert,omitempty" yaml:"signature_cert,omitempty" merge:"-"`
 
 	// Version is tracking the format of this structure itself
-	Version config.ConfigVersion `json:"version,omitempty" yaml:"version,omitempty"`
+	Version config.ConfigVersion `json:"version,omitempty" yaml:"version,omitempty" merge:"-"`
 }
 
 // KeylimeConfig is the keylime configuration as it is embedded in the stage 1 configuration.
 type KeylimeConfig struct {
 	// CVCAURL is the URL to the CA certificate of the Keylime Verifier (CV)
-	CVCAURL string `json:"cvca_url,omitempty" yaml:"cvca_url,omitempty"`
+	CVCAURL string `json:"cvca_url,omitempty" yaml:"cvca_url,omitempty" merge:"set"`
 
 	// RegistrarIP is the IP address of the Keylime registrar service
-	RegistrarIP string `json:"registrar_ip,omitempty" yaml:"registrar_ip,omitempty"`
+	RegistrarIP string `json:"registrar_ip,omitempty" yaml:"registrar_ip,omitempty" merge:"set"`
 
 	// RegistrarPort is the port number of the Keylime registrar service
-	RegistrarPort uint16 `json:"registrar_port,omitempty" yaml:"registrar_port,omitempty"`
+	RegistrarPort uint16 `json:"registrar_port,omitempty" yaml:"registrar_port,omitempty" merge:"set"`
 
 	// RevocationNotificationIP is the IP address of the Keylime revocation notification queue system
-	RevocationNotificationIP string `json:"revocation_notification_ip,omitempty" yaml:"revocation_notification_ip,omitempty"`
+	RevocationNotificationIP string `json:"revocation_notification_ip,omitempty" yaml:"revocation_notification_ip,omitempty" merge:"set"`
 
 	// RevocationNotificationPort is the port number of the Keylime revocation notification queue system
-	RevocationNotificationPort uint16 `json:"revocation_notification_port,omitempty" yaml:"revocation_notification_port,omitempty"`
+	RevocationNotificationPort uint16 `json:"revocation_notification_port,omitempty" yaml:"revocation_notification_port,omitempty" merge:"set"`
 
 	// TenantTriggerURL is the URL which notifies the Keylime tenant controller to add the device to the Keylime Verifier (CV)
-	TenantTriggerURL string `json:"tenant_trigger_url,omitempty" yaml:"tenant_trigger_url,omitempty"`
+	TenantTriggerURL string `json:"tenant_trigger_url,omitempty" yaml:"tenant_trigger_url,omitempty" merge:"set"`
 }
 
 // Cert implements config.EmbeddedConfig
@@ -82,7 +109,10 @@ func (c *Stage1) Cert() []byte {
 
 // Validate implements config.EmbeddedConfig
 func (c *Stage1) Validate() error {
-	// TODO: implement
+	// TODO: implement the rest
+	if err := config.ValidateSecureURLs(c.LabMode, append([]string{c.RegisterURL, c.RenewURL, c.Stage2URL, c.IdentityBackupURL}, c.Stage2Mirrors...)...); err != nil {
+		return fmt.Errorf("stage1 config: %w", err)
+	}
 	return nil
 }
 
@@ -21,6 +21,7 @@ import (
 	"os"
 	"strings"
 
+	"go.githedgehog.com/dasboot/pkg/config"
 	"gopkg.in/yaml.v3"
 )
 
@@ -71,56 +72,8 @@ func ReadFrom(r io.Reader, typ FileType) (*Stage1, error) {
 	return &cfg, nil
 }
 
+// MergeConfigs merges the `override` into a copy of the `embedded` configuration. How every field gets merged is
+// decided by its merge tag, see `config.Merge`.
 func MergeConfigs(embedded *Stage1, override *Stage1) *Stage1 {
-	// clone the values from the embedded config
-	// so that we don't override the arguments for the caller
-	// also short-circuit things to avoid pointer shenanigans
-	if embedded == nil {
-		return nil
-	}
-	ret := *embedded
-	if override == nil {
-		return &ret
-	}
-
-	// Keylime settings can be overridden
-	if override.Keylime != nil {
-		if ret.Keylime == nil {
-			// if keylime isn't even set in the embedded we simply copy all over
-			keylimeOverride := *override.Keylime
-			ret.Keylime = &keylimeOverride
-		} else {
-			// otherwise we treat it as single field setting overrides
-			if override.Keylime.CVCAURL != "" {
-				ret.Keylime.CVCAURL = override.Keylime.CVCAURL
-			}
-			if override.Keylime.RegistrarIP != "" {
-				ret.Keylime.RegistrarIP = override.Keylime.RegistrarIP
-			}
-			if override.Keylime.RegistrarPort > 0 {
-				ret.Keylime.RegistrarPort = override.Keylime.RegistrarPort
-			}
-			if override.Keylime.RevocationNotificationIP != "" {
-				ret.Keylime.RevocationNotificationIP = override.Keylime.RevocationNotificationIP
-			}
-			if override.Keylime.RevocationNotificationPort > 0 {
-				ret.Keylime.RevocationNotificationPort = override.Keylime.RevocationNotificationPort
-			}
-			if override.Keylime.TenantTriggerURL != "" {
-				ret.Keylime.TenantTriggerURL = override.Keylime.TenantTriggerURL
-			}
-		}
-	}
-
-	// RegisterURL can be overridden
-	if override.RegisterURL != "" {
-		ret.RegisterURL = override.RegisterURL
-	}
-
-	// Stage2URL can be overridden
-	if override.Stage2URL != "" {
-		ret.Stage2URL = override.Stage2URL
-	}
-
-	return &ret
+	return config.Merge(embedded, override)
 }
@@ -0,0 +1,104 @@
+// Copyright 2023 Hedgehog
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package stage1
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"path"
+	"time"
+
+	"go.githedgehog.com/dasboot/pkg/partitions/identity"
+	"go.githedgehog.com/dasboot/pkg/partitions/location"
+	"go.githedgehog.com/dasboot/pkg/stage"
+	"go.uber.org/zap"
+)
+
+// restoreIdentityBackup restores the identity of the device `devid` from the backup which is held by the
+// control plane. This is for registered devices whose identity partition was lost, e.g. when their SSD was replaced.
+// The HTTP client does not need to do client certificate authentication.
+func restoreIdentityBackup(ctx context.Context, hc *http.Client, backupURL string, devid string, identityPartition identity.IdentityPartition, locationInfo *location.Info) error {
+	u, err := url.Parse(backupURL)
+	if err != nil {
+		return fmt.Errorf("parsing identity backup URL '%s': %w", backupURL, err)
+	}
+	u.Path = path.Join(u.Path, devid)
+
+	subCtx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(subCtx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	resp, err := hc.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return stage.NewHTTPErrorFromBody(resp)
+	}
+	var b identity.Backup
+	if err := json.NewDecoder(resp.Body).Decode(&b); err != nil {
+		return fmt.Errorf("%w: decoding response: %w", identity.ErrInvalidBackup, err)
+	}
+
+	keys, err := identity.UnlockKeys(locationInfo)
+	if err != nil {
+		return err
+	}
+	return identityPartition.RestoreBackup(&b, keys)
+}
+
+// uploadIdentityBackup uploads a backup of the identity of the device to the control plane. The HTTP client must
+// authenticate with the client certificate which is on the identity partition.
+func uploadIdentityBackup(ctx context.Context, hc *http.Client, backupURL string, identityPartition identity.IdentityPartition, locationInfo *location.Info) error {
+	keys, err := identity.UnlockKeys(locationInfo)
+	if err != nil {
+		return err
+	}
+	b, err := identityPartition.ExportBackup(keys)
+	if err != nil {
+		return fmt.Errorf("exporting identity backup: %w", err)
+	}
+	body, err := json.Marshal(b)
+	if err != nil {
+		return err
+	}
+
+	subCtx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(subCtx, http.MethodPost, backupURL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", "application/json")
+	resp, err := hc.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		return stage.NewHTTPErrorFromBody(resp)
+	}
+	l.Info("Uploaded identity backup to the control plane", zap.String("url", backupURL))
+	return nil
+}
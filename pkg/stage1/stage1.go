@@ -28,6 +28,7 @@ import (
 	"time"
 
 	"go.githedgehog.com/dasboot/pkg/config"
+	"go.githedgehog.com/dasboot/pkg/devid"
 	"go.githedgehog.com/dasboot/pkg/log"
 	"go.githedgehog.com/dasboot/pkg/partitions"
 	"go.githedgehog.com/dasboot/pkg/partitions/identity"
@@ -42,8 +43,19 @@ import (
 
 var l = log.L()
 
+// correlation holds the fields which are bound to every log message of this stage
+var correlation log.Correlation
+
+// setLogger makes `newL` the logger of this stage with all correlation fields bound to it
+func setLogger(newL log.Interface) {
+	l = log.WithCorrelation(newL, correlation)
+}
+
 var pollTimeout = time.Second * 5
 
+// clientCertRenewBefore is the time before the expiry of the client certificate from which on it is being renewed
+const clientCertRenewBefore = 30 * 24 * time.Hour
+
 var ErrExecution = errors.New("unrecoverable execution error encountered")
 
 func executionError(err error) error {
@@ -79,21 +91,38 @@ func ReadConfig(caPool *x509.CertPool) (*configstage.Stage1, error) {
 	return &cfg, nil
 }
 
-func Run(ctx context.Context, override *configstage.Stage1, logSettings *stage.LogSettings) (runErr error) {
+// Run runs stage 1 with `logSettings` which initialize the global logger. This is what the stage 1 binary executes.
+func Run(ctx context.Context, override *configstage.Stage1, logSettings *stage.LogSettings) error {
+	_, err := Execute(ctx, override, stage.RunOptionLogSettings(logSettings))
+	return err
+}
+
+// Execute runs stage 1 in-process. It can be used to embed stage 1 into other installers. The returned result is
+// never nil, and holds as much information as was gathered until the execution finished or failed.
+func Execute(ctx context.Context, override *configstage.Stage1, opts ...stage.RunOption) (result *stage.Result, runErr error) {
+	o := stage.NewRunOptions(opts...)
+	logSettings := o.LogSettings
+	result = &stage.Result{}
+	correlation = log.Correlation{Stage: "stage1"}
+
 	// setup some console logging first
 	// NOTE: we'll throw this away immediately after we've read the staging info
 	// so this is really just for until then
 	// TODO: this essentially should never fail, so should be implemented differently I guess
-	if err := stage.InitializeGlobalLogger(ctx, logSettings); err != nil {
-		return fmt.Errorf("stage0: failed to initialize logger: %w", err)
+	newL, err := o.InitializeLogger(ctx, logSettings)
+	if err != nil {
+		return result, fmt.Errorf("stage0: failed to initialize logger: %w", err)
 	}
-	l = log.L()
+	setLogger(newL)
 	defer func() {
 		if err := l.Sync(); err != nil {
 			l.Debug("Flushing logger failed", zap.Error(err))
 		}
 	}()
 	l.Info("Stage 1 execution starting", zap.String("version", version.Version))
+
+	// record execution timings of all major steps
+	stage.StartTimings("stage1")
 	l.Info("System environment", zap.Strings("env", os.Environ()))
 
 	// read ONIE env information
@@ -104,16 +133,34 @@ func Run(ctx context.Context, override *configstage.Stage1, logSettings *stage.L
 	si, err := stage.ReadStagingInfo()
 	if err != nil {
 		l.Error("Reading staging info", zap.Error(err))
-		return executionError(fmt.Errorf("reading staging info: %w", err))
+		stage.FinishTimings(l, "", err)
+		return result, executionError(fmt.Errorf("reading staging info: %w", err))
+	}
+
+	// from now on every message carries the device ID and install session
+	correlation = si.Correlation("stage1")
+	setLogger(l)
+	partitions.SetMultipathPolicy(si.MultipathPolicy)
+	partitions.SetDiskSelectionPolicy(si.DiskSelection)
+	defer func() {
+		if summary := stage.FinishTimings(l, si.StagingDir, runErr); summary != nil {
+			result.Timings = summary
+		}
+	}()
+
+	// stage 0 holds the install lock for our install session, if it is not ours anymore, we must stop right here
+	if err := stage.VerifyInstallLock(si.InstallSessionID); err != nil {
+		l.Error("Install lock verification failed", zap.Error(err))
+		return result, executionError(err)
 	}
 
 	// reinitialize global logger
 	// TODO: merge log settings I guess? will figure out what constitutes a change from the program flags
 	l.Debug("Reinitializing global logger again", zap.Reflect("logSettings", &si.LogSettings))
-	if err := stage.InitializeGlobalLogger(ctx, &si.LogSettings); err != nil {
+	if newL, err := o.InitializeLogger(ctx, &si.LogSettings); err != nil {
 		l.Warn("Reinitializing global logger failed", zap.Error(err))
 	} else {
-		l = log.L()
+		setLogger(newL)
 		l.Info("Reinitialized global logger from staging info", zap.Reflect("logSettings", &si.LogSettings))
 	}
 
@@ -121,14 +168,14 @@ func Run(ctx context.Context, override *configstage.Stage1, logSettings *stage.L
 	configCAPool, err := si.ConfigSignatureCAPool()
 	if err != nil {
 		l.Error("Initializing Config Signature CA Pool failed", zap.Error(err))
-		return executionError(fmt.Errorf("initializing config signature CA pool: %w", err))
+		return result, executionError(fmt.Errorf("initializing config signature CA pool: %w", err))
 	}
 
 	// read embedded config now
 	embedded, err := ReadConfig(configCAPool)
 	if err != nil {
 		l.Error("Reading embedded config failed", zap.Error(err))
-		return executionError(err)
+		return result, executionError(err)
 	}
 	l.Info("Read embedded configuration", zap.Reflect("config", embedded))
 
@@ -136,21 +183,26 @@ func Run(ctx context.Context, override *configstage.Stage1, logSettings *stage.L
 	cfg := configstage.MergeConfigs(embedded, override)
 	if err := cfg.Validate(); err != nil {
 		l.Error("Merged config validation error", zap.Error(err))
-		return executionError(fmt.Errorf("merged config validation: %w", err))
+		return result, executionError(fmt.Errorf("merged config validation: %w", err))
 	}
 	if override != nil {
 		l.Info("Merged override configuration", zap.Reflect("config", cfg))
 	}
+	labModeOpts := stage.LabModeOptions(cfg.LabMode)
 
-	// check if this device has a TPM, if yes, we will do hardware remote attestation
+	// check if this device has a TPM, if yes, its client key is held by the TPM which quotes the boot PCRs on registration
 	if tpm.HasTPM() {
-		// TODO: implement
+		l.Info("This device has a TPM 2.0 module. Using it for hardware remote attestation.")
 	} else {
 		l.Warn("This device is lacking a TPM 2.0 module. Skipping hardware remote attestation.")
 	}
 
+	stage.ReportToolCapabilities(l)
+
 	// discover partitions
+	endDiscovery := stage.Span("discovery")
 	devices := partitions.Discover()
+	endDiscovery()
 
 	// retrieve location info
 	locationPartition, err := stage.MountLocationPartition(l, devices)
@@ -165,7 +217,7 @@ func Run(ctx context.Context, override *configstage.Stage1, logSettings *stage.L
 		locationInfo, err = locationPartition.GetLocation()
 		if err != nil {
 			l.Error("Retrieving location information from location partition failed", zap.Error(err))
-			return ErrExecution
+			return result, ErrExecution
 		}
 		l.Info("Location information found on location partition", zap.Reflect("locationInfo", locationInfo))
 		if si.LocationInfo != nil {
@@ -173,7 +225,7 @@ func Run(ctx context.Context, override *configstage.Stage1, logSettings *stage.L
 			if !reflect.DeepEqual(locationInfo, si.LocationInfo) {
 				err := fmt.Errorf("location information form partition does not match location information from configuration (fix this setup)")
 				l.Error("Location information mismatch", zap.Error(err), zap.Reflect("locationInfoPartition", locationInfo), zap.Reflect("locationInfoConfig", si.LocationInfo))
-				return executionError(err)
+				return result, executionError(err)
 			}
 		}
 	} else if si.LocationInfo != nil {
@@ -185,18 +237,28 @@ func Run(ctx context.Context, override *configstage.Stage1, logSettings *stage.L
 
 	// now mount (or create and mount) the identity partition
 	// this step fully initializes and prepares the partition for our usage
-	identityPartition, err := stage.MountIdentityPartition(l, devices, onieEnv.Platform)
+	identityEncryption := &stage.IdentityEncryption{
+		Encrypt: cfg.EncryptIdentityPartition,
+		Keys:    func() ([][]byte, error) { return identity.UnlockKeys(locationInfo) },
+	}
+	identityPartition, err := stage.MountIdentityPartition(l, devices, onieEnv.Platform, identityEncryption)
+	if errors.Is(err, partitions.ErrFilesystemCorrupt) {
+		// stage 1 is the place where the identity gets established, so we can afford to start from scratch here,
+		// and the identity backup (if enabled) is going to bring the keys and certs back
+		l.Warn("Identity Partition is corrupt, recreating its filesystem", zap.Error(err))
+		identityPartition, err = stage.RecreateIdentityFilesystem(l, devices, onieEnv.Platform, identityEncryption)
+	}
 	if err != nil {
 		l.Error("Identity Partition could not be opened/mounted/created", zap.Error(err))
-		return executionError(fmt.Errorf("opening identity partition: %w", err))
+		return result, executionError(fmt.Errorf("opening identity partition: %w", err))
 	}
 	l.Info("Opened Hedgehog Identity Partition successfully")
 
 	// build an HTTP client for the register requests, it does not need to do client certificate authentication
-	hc, err := stage.SeederHTTPClient(si.ServerCA, nil)
+	hc, err := si.SeederHTTPClient(nil, configCAPool, labModeOpts...)
 	if err != nil {
 		l.Error("Building HTTP client for registration failed", zap.Error(err))
-		return executionError(err)
+		return result, executionError(err)
 	}
 
 	// first let's check if there is already location information stored
@@ -215,11 +277,21 @@ func Run(ctx context.Context, override *configstage.Stage1, logSettings *stage.L
 			l.Info("Storing location information onto identity partition", zap.Bool("reinitialize", reinitialize), zap.Bool("identityPartiionHasLocationInformation", err == nil))
 			if err := identityPartition.StoreLocation(locationInfo); err != nil {
 				l.Error("Storing location information onto identity partition failed", zap.Error(err))
-				return executionError(fmt.Errorf("storing location information: %w", err))
+				return result, executionError(fmt.Errorf("storing location information: %w", err))
 			}
 		}
 	}
 
+	// a registered device whose identity partition was lost (e.g. a replaced SSD) gets its identity back
+	// from the backup in the control plane instead of registering again, this is best-effort
+	if cfg.IdentityBackupURL != "" && !identityPartition.HasClientKey() {
+		if err := restoreIdentityBackup(ctx, hc, cfg.IdentityBackupURL, si.DeviceID, identityPartition, locationInfo); err != nil {
+			l.Warn("Restoring identity from backup failed, continuing without it", zap.Error(err))
+		} else {
+			l.Info("Restored identity from backup")
+		}
+	}
+
 	// we need to recreate a key in the following situations:
 	// - if the location info changed
 	// - if there never was a key before (duh)
@@ -231,7 +303,7 @@ func Run(ctx context.Context, override *configstage.Stage1, logSettings *stage.L
 		l.Info("Generating client key pair now...", zap.Bool("reinitialize", reinitialize), zap.Bool("hasClientKey", hasClientKey), zap.Bool("hasClientCert", hasClientCert), zap.Bool("hasValidClientCert", hasValidClientCert))
 		if err := identityPartition.GenerateClientKeyPair(); err != nil {
 			l.Error("Generating client key pair failed", zap.Error(err))
-			return executionError(fmt.Errorf("generating client key pair: %w", err))
+			return result, executionError(fmt.Errorf("generating client key pair: %w", err))
 		}
 	}
 
@@ -245,7 +317,7 @@ func Run(ctx context.Context, override *configstage.Stage1, logSettings *stage.L
 	if hasValidClientCert {
 		if err := checkValidRegistration(ctx, hc, cfg, identityPartition, si); err != nil {
 			// no detailed error handling necessary here, done in checkValidRegistration
-			return err
+			return result, err
 		}
 	}
 
@@ -260,30 +332,76 @@ func Run(ctx context.Context, override *configstage.Stage1, logSettings *stage.L
 		l.Info("Reusing existing client key pair and certificate from identity partition")
 	} else {
 		// otherwise we need to register now
-		if err := registerDevice(ctx, hc, cfg, identityPartition, si, locationInfo); err != nil {
+		if err := stage.Timed("registration", func() error {
+			return registerDevice(ctx, hc, cfg, identityPartition, si, onieEnv, locationInfo)
+		}); err != nil {
 			// no detailed error handling necessary here, done in registerDevice
-			return err
+			return result, err
 		}
 	}
 
 	// reinitialize HTTP client: it now MUST do client certificate authentication
 	// so we pass in the identity partition
-	hc, err = stage.SeederHTTPClient(si.ServerCA, identityPartition)
+	hc, err = si.SeederHTTPClient(identityPartition, configCAPool, labModeOpts...)
 	if err != nil {
 		l.Error("Building HTTP client for downloading stage 2 failed", zap.Error(err))
-		return executionError(err)
+		return result, executionError(err)
+	}
+
+	// a certificate which expires soon is being renewed while it still authenticates us,
+	// a failed renewal is not fatal as the current certificate is still valid
+	if hasValidClientCert && cfg.RenewURL != "" {
+		renewed, err := renewClientCert(ctx, hc, cfg, identityPartition)
+		if err != nil {
+			l.Warn("Renewing client certificate failed, continuing with the current one", zap.Error(err))
+		}
+		if renewed {
+			hc, err = si.SeederHTTPClient(identityPartition, configCAPool, labModeOpts...)
+			if err != nil {
+				l.Error("Building HTTP client with renewed client certificate failed", zap.Error(err))
+				return result, executionError(err)
+			}
+		}
+	}
+
+	// keep the backup of our identity in the control plane up to date, a failed upload is not fatal
+	if cfg.IdentityBackupURL != "" {
+		if err := uploadIdentityBackup(ctx, hc, cfg.IdentityBackupURL, identityPartition, locationInfo); err != nil {
+			l.Warn("Uploading identity backup failed", zap.Error(err))
+		}
 	}
 
 	// now try to download stage 2
 	stage2Path := filepath.Join(si.StagingDir, "stage2")
-	if err := stage.DownloadExecutable(ctx, hc, cfg.Stage2URL, stage2Path, 60*time.Second); err != nil {
+	if err := stage.Timed("download-stage2", func() error {
+		opts, err := si.ArtifactDownloadOptions()
+		if err != nil {
+			return err
+		}
+		_, err = stage.DownloadExecutableFromMirrors(ctx, hc, stage.MirrorURLs(cfg.Stage2URL, cfg.Stage2Mirrors), stage2Path, 60*time.Second, opts...)
+		return err
+	}); err != nil {
 		l.Error("Downloading stage 2 installer failed", zap.String("url", cfg.Stage2URL), zap.String("dest", stage2Path), zap.Error(err))
-		return executionError(fmt.Errorf("downloading stage 2: %w", err))
+		return result, executionError(fmt.Errorf("downloading stage 2: %w", err))
 	}
 	l.Info("Downloading stage 2 installer completed", zap.String("url", cfg.Stage2URL), zap.String("dest", stage2Path))
 
+	// the seeder pinned the digest of stage 2 in our configuration
+	if err := stage.VerifyArtifactPin(stage2Path, cfg.Stage2Pin); err != nil {
+		l.Error("Stage 2 installer does not match its pinned digest", zap.String("dest", stage2Path), zap.Reflect("pin", cfg.Stage2Pin), zap.Error(err))
+		return result, executionError(fmt.Errorf("stage 2 digest verification: %w", err))
+	}
+
 	// success
 	l.Info("Stage 1 completed successfully")
+	result.Timings = stage.FinishTimings(l, si.StagingDir, nil)
+
+	result.StagingInfo = si
+	result.NextStagePath = stage2Path
+	if o.SkipNextStage {
+		l.Info("Skipping execution of stage 2", zap.String("path", stage2Path))
+		return result, nil
+	}
 
 	// execute stage 2 now
 	l.Info("Executing stage 2 now...")
@@ -292,16 +410,20 @@ func Run(ctx context.Context, override *configstage.Stage1, logSettings *stage.L
 	stage2Cmd.Stderr = os.Stderr
 	stage2Cmd.Stdout = os.Stdout
 	if err := stage2Cmd.Run(); err != nil {
+		if stage.IsCancelledExit(err) {
+			l.Warn("Installation was cancelled by the seeder")
+			return result, fmt.Errorf("%w: stage 2 aborted", stage.ErrInstallCancelled)
+		}
 		l.Error("Stage 2 execution failed", zap.Error(err))
-		return executionError(err)
+		return result, executionError(err)
 	}
 
 	// we are truly done
-	return nil
+	return result, nil
 }
 
 // registers the device with the control plane
-func registerDevice(ctx context.Context, hc *http.Client, cfg *configstage.Stage1, identityPartition identity.IdentityPartition, si *stage.StagingInfo, locationInfo *location.Info) error {
+func registerDevice(ctx context.Context, hc *http.Client, cfg *configstage.Stage1, identityPartition identity.IdentityPartition, si *stage.StagingInfo, onieEnv *stage.OnieEnv, locationInfo *location.Info) error {
 	var clientCSRBytes []byte
 	hasClientCSR := identityPartition.HasClientCSR()
 	if !hasClientCSR {
@@ -323,12 +445,22 @@ func registerDevice(ctx context.Context, hc *http.Client, cfg *configstage.Stage
 		}
 	}
 
+	// the inventory allows operators to find the device by its serial number, but it is not required for the registration
+	inventory, err := devid.CollectInventory()
+	if err != nil {
+		l.Warn("Collecting device inventory from ONIE EEPROM failed", zap.Error(err))
+	} else {
+		l.Info("Collected device inventory from ONIE EEPROM", zap.Reflect("inventory", inventory))
+	}
+
 	l.Info("Performing device registration now...", zap.String("deviceID", si.DeviceID))
-	// TODO: needs all the details - this is truly the bare minimum
 	req := &registration.Request{
 		DeviceID:     si.DeviceID,
 		CSR:          clientCSRBytes,
 		LocationInfo: locationInfo,
+		Inventory:    inventory,
+		Neighbors:    si.Neighbors,
+		Attestation:  collectAttestationEvidence(ctx, onieEnv, identityPartition, clientCSRBytes),
 	}
 	resp, err := registration.DoRequest(ctx, hc, req, cfg.RegisterURL)
 	i := 0
@@ -379,6 +511,41 @@ func registerDevice(ctx context.Context, hc *http.Client, cfg *configstage.Stage
 	return nil
 }
 
+// renewClientCert renews the client certificate on the identity partition if it expires within `clientCertRenewBefore`.
+// The HTTP client must authenticate with the current client certificate. It returns true if the certificate was renewed.
+func renewClientCert(ctx context.Context, hc *http.Client, cfg *configstage.Stage1, identityPartition identity.IdentityPartition) (bool, error) {
+	kp, err := identityPartition.LoadX509KeyPair()
+	if err != nil {
+		return false, fmt.Errorf("loading client key pair: %w", err)
+	}
+	if len(kp.Certificate) == 0 {
+		return false, identity.ErrNoClientCert
+	}
+	cert, err := x509.ParseCertificate(kp.Certificate[0])
+	if err != nil {
+		return false, fmt.Errorf("parsing client certificate: %w", err)
+	}
+	if time.Until(cert.NotAfter) > clientCertRenewBefore {
+		return false, nil
+	}
+
+	l.Info("Client certificate expires soon, renewing it now...", zap.Time("notAfter", cert.NotAfter))
+	if err := identityPartition.RenewClientCert(func(csr []byte) ([]byte, error) {
+		resp, err := registration.DoRenewRequest(ctx, hc, &registration.RenewalRequest{CSR: csr}, cfg.RenewURL)
+		if err != nil {
+			return nil, err
+		}
+		if resp.Status != registration.RegistrationStatusApproved {
+			return nil, fmt.Errorf("certificate renewal not approved: %s: %s", resp.Status, resp.StatusDescription)
+		}
+		return resp.ClientCertificate, nil
+	}); err != nil {
+		return false, err
+	}
+	l.Info("Client certificate renewed and stored to identity partition")
+	return true, nil
+}
+
 func checkValidRegistration(ctx context.Context, hc *http.Client, cfg *configstage.Stage1, identityPartition identity.IdentityPartition, si *stage.StagingInfo) error {
 	l.Info("Valid client certificate found on identity partition. Checking if a registration entry exists within the controller and that it matches our certificate...", zap.String("deviceID", si.DeviceID))
 
@@ -14,7 +14,15 @@
 
 package config
 
-import "go.githedgehog.com/dasboot/pkg/config"
+import (
+	"errors"
+	"fmt"
+	"path"
+	"strings"
+
+	"go.githedgehog.com/dasboot/pkg/config"
+	"go.githedgehog.com/dasboot/pkg/version"
+)
 
 var _ config.EmbeddedConfig = &Stage2{}
 
@@ -41,26 +49,92 @@ var _ config.EmbeddedConfig = &Stage2{}
 type Stage2 struct {
 	// Platform is an override for the "onie_platform" environment variable. This field should usually be empty
 	// as the platform value should be derived from the environment.
-	Platform string `json:"platform,omitempty" yaml:"platform,omitempty"`
+	Platform string `json:"platform,omitempty" yaml:"platform,omitempty" merge:"set"`
 
 	// NOSInstallerURL is the URL where the NOS image is located
-	NOSInstallerURL string `json:"nos_installer_url,omitempty" yaml:"nos_installer_url,omitempty"`
+	NOSInstallerURL string `json:"nos_installer_url,omitempty" yaml:"nos_installer_url,omitempty" merge:"set,reset=NOSInstallerMirrors"`
+
+	// NOSInstallerMirrors are additional base URLs which serve the same NOS images as `NOSInstallerURL`.
+	// Stage 2 ranks all of them by latency and falls back to the next one if a download fails.
+	NOSInstallerMirrors []string `json:"nos_installer_mirrors,omitempty" yaml:"nos_installer_mirrors,omitempty" merge:"replace"`
 
 	// ONIEUpdaterURL is the URL where the ONIE updater image is located
-	ONIEUpdaterURL string `json:"onie_updater_url,omitempty" yaml:"onie_updater_url,omitempty"`
+	ONIEUpdaterURL string `json:"onie_updater_url,omitempty" yaml:"onie_updater_url,omitempty" merge:"set"`
 
 	// NOSType represents the NOS that will be installed from the image in `NOSInstallerURL`.
-	NOSType string `json:"nos_type,omitempty" yaml:"nos_type,omitempty"`
+	NOSType string `json:"nos_type,omitempty" yaml:"nos_type,omitempty" merge:"set"`
 
 	// HedgehogSonicProvisioners is a list of provisioners that will be executed if the `NOSType` is `hedgehog_sonic`.
-	HedgehogSonicProvisioners []HedgehogSonicProvisioner `json:"hedgehog_sonic_provisioners,omitempty" yaml:"hedgehog_sonic_provisioners,omitempty"`
+	HedgehogSonicProvisioners []HedgehogSonicProvisioner `json:"hedgehog_sonic_provisioners,omitempty" yaml:"hedgehog_sonic_provisioners,omitempty" merge:"key=Name"`
+
+	// DiagBoot instructs stage 2 to boot the vendor diagnostics OS exactly once before installing the NOS.
+	// Stage 2 checkpoints this on the identity partition and resumes the installation on the next ONIE boot.
+	DiagBoot bool `json:"diag_boot,omitempty" yaml:"diag_boot,omitempty" merge:"set"`
+
+	// Prestage instructs stage 2 to only download and verify the NOS installer and provisioners into `PrestageDir`
+	// without installing anything. A later NOS installation uses these local copies if they are still intact.
+	Prestage bool `json:"prestage,omitempty" yaml:"prestage,omitempty" merge:"set"`
+
+	// PrestageDir is the directory where pre-staged artifacts are stored. It must be on persistent storage.
+	// If it is empty, a directory on the Hedgehog Identity Partition is being used.
+	PrestageDir string `json:"prestage_dir,omitempty" yaml:"prestage_dir,omitempty" merge:"set"`
+
+	// RollbackMACAllowlist instructs stage 2 to restore the original MAC addresses of all network interfaces
+	// to which stage 0 applied an allowlisted MAC address, once the NOS was installed successfully.
+	RollbackMACAllowlist bool `json:"rollback_mac_allowlist,omitempty" yaml:"rollback_mac_allowlist,omitempty" merge:"set"`
+
+	// GPTAttributes are GPT partition attributes which stage 2 sets after the NOS installation for NOS installers
+	// which expect them. They are keyed by the ONIE platform (or "*" for all platforms) and then by the GPT partition
+	// name. The attributes are either "required", "no_block_io", "legacy_bios_bootable" or a bit number.
+	GPTAttributes map[string]map[string][]string `json:"gpt_attributes,omitempty" yaml:"gpt_attributes,omitempty" merge:"replace"`
+
+	// PreserveNOSConfig lists the files of the configuration of an existing SONiC installation which stage 2 backs
+	// up to the identity partition before it reinstalls the NOS, and restores for the new installation to migrate
+	// on its first boot. The paths are relative to /etc/sonic, and directories are preserved with all their files.
+	PreserveNOSConfig []string `json:"preserve_nos_config,omitempty" yaml:"preserve_nos_config,omitempty" merge:"replace"`
+
+	// DisableDiscardPlatforms lists the ONIE platforms (or "*" for all platforms) on which stage 2 must not discard the
+	// blocks which it skips when it writes artifacts to flash media, because discarded blocks do not read back as zeros.
+	DisableDiscardPlatforms []string `json:"disable_discard_platforms,omitempty" yaml:"disable_discard_platforms,omitempty" merge:"replace"`
+
+	// DownloadParallelism is the number of artifacts which stage 2 downloads at the same time. If it is not set,
+	// a default is being used.
+	DownloadParallelism int `json:"download_parallelism,omitempty" yaml:"download_parallelism,omitempty" merge:"set"`
+
+	// DownloadChunkSize is the size in bytes of the chunks in which stage 2 downloads the NOS installer if the server
+	// supports range requests. If it is not set, a default is being used.
+	DownloadChunkSize int64 `json:"download_chunk_size,omitempty" yaml:"download_chunk_size,omitempty" merge:"set"`
+
+	// DownloadChunkParallelism is the number of chunks of the NOS installer which stage 2 downloads at the same time.
+	// If it is not set, a default is being used.
+	DownloadChunkParallelism int `json:"download_chunk_parallelism,omitempty" yaml:"download_chunk_parallelism,omitempty" merge:"set"`
+
+	// DeviceMetadataURL is the base URL where stage 2 gets the metadata which the control plane plans for
+	// this device, like its host name and role. It is only used to label logs, and it is optional.
+	DeviceMetadataURL string `json:"device_metadata_url,omitempty" yaml:"device_metadata_url,omitempty" merge:"set"`
+
+	// InstallCancellationURL is the base URL where stage 2 learns if an operator cancelled the installation. Stage 2
+	// checks it at every safe checkpoint, and aborts the installation if it was cancelled. It is optional.
+	InstallCancellationURL string `json:"install_cancellation_url,omitempty" yaml:"install_cancellation_url,omitempty" merge:"set"`
+
+	// DiagnosticsUploadsURL is the URL where stage 2 uploads crash reports and core dumps to if the NOS installation
+	// fails. If it is empty, diagnostic files are not being uploaded.
+	DiagnosticsUploadsURL string `json:"diagnostics_uploads_url,omitempty" yaml:"diagnostics_uploads_url,omitempty" merge:"set"`
+
+	// LogShippingURL is the URL where stage 2 uploads its logs to for post-mortem analysis. If it is empty,
+	// logs are not being shipped.
+	LogShippingURL string `json:"log_shipping_url,omitempty" yaml:"log_shipping_url,omitempty" merge:"set"`
+
+	// LabMode is set by a seeder which runs in its insecure lab mode. Only then plain HTTP URLs are accepted.
+	// It can only be set in the embedded configuration and never by an override.
+	LabMode bool `json:"lab_mode,omitempty" yaml:"lab_mode,omitempty" merge:"-"`
 
 	// SignatureCert holds the DER encoded X509 certificate with which the signature of the embedded config
 	// can be validated
-	SignatureCert []byte `json:"signature_cert,omitempty" yaml:"signature_cert,omitempty"`
+	SignatureCert []byte `json:"signature_cert,omitempty" yaml:"signature_cert,omitempty" merge:"-"`
 
 	// Version is tracking the format of this structure itself
-	Version config.ConfigVersion `json:"version,omitempty" yaml:"version,omitempty"`
+	Version config.ConfigVersion `json:"version,omitempty" yaml:"version,omitempty" merge:"-"`
 }
 
 // NOSTypeHedgehogSonic is the value for the Hedgehog SONiC distribution that can be sent through the stage 2 configuration.
@@ -71,6 +145,10 @@ const NOSTypeHedgehogSonic = "hedgehog_sonic"
 type HedgehogSonicProvisioner struct {
 	Name string `json:"name" yaml:"name"`
 	URL  string `json:"URL" yaml:"URL"`
+
+	// Pin pins the digest of the provisioner. If it is set, stage 2 will refuse to execute
+	// a provisioner which does not match it.
+	Pin *version.ArtifactPin `json:"pin,omitempty" yaml:"pin,omitempty"`
 }
 
 // Cert implements config.EmbeddedConfig
@@ -80,7 +158,38 @@ func (c *Stage2) Cert() []byte {
 
 // Validate implements config.EmbeddedConfig
 func (c *Stage2) Validate() error {
-	// TODO: implement
+	if c.DownloadParallelism < 0 {
+		return fmt.Errorf("%w: %d", ErrInvalidDownloadParallelism, c.DownloadParallelism)
+	}
+	if c.DownloadChunkSize < 0 || c.DownloadChunkParallelism < 0 {
+		return fmt.Errorf("%w: chunk size %d, parallelism %d", ErrInvalidDownloadChunks, c.DownloadChunkSize, c.DownloadChunkParallelism)
+	}
+	for _, p := range c.PreserveNOSConfig {
+		if err := ValidateNOSConfigPath(p); err != nil {
+			return err
+		}
+	}
+	urls := append([]string{c.NOSInstallerURL, c.ONIEUpdaterURL, c.DeviceMetadataURL, c.InstallCancellationURL, c.DiagnosticsUploadsURL, c.LogShippingURL}, c.NOSInstallerMirrors...)
+	for _, p := range c.HedgehogSonicProvisioners {
+		urls = append(urls, p.URL)
+	}
+	if err := config.ValidateSecureURLs(c.LabMode, urls...); err != nil {
+		return fmt.Errorf("stage2 config: %w", err)
+	}
+	return nil
+}
+
+var ErrInvalidDownloadParallelism = errors.New("stage2 config: invalid download parallelism")
+
+var ErrInvalidDownloadChunks = errors.New("stage2 config: invalid download chunks")
+
+var ErrInvalidNOSConfigPath = errors.New("stage2 config: invalid NOS configuration path")
+
+// ValidateNOSConfigPath ensures that `p` is a path which stays within the NOS configuration directory
+func ValidateNOSConfigPath(p string) error {
+	if p == "" || path.IsAbs(p) || path.Clean(p) != p || p == ".." || strings.HasPrefix(p, "../") {
+		return fmt.Errorf("%w: '%s'", ErrInvalidNOSConfigPath, p)
+	}
 	return nil
 }
 
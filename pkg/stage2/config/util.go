@@ -21,6 +21,7 @@ import (
 	"os"
 	"strings"
 
+	"go.githedgehog.com/dasboot/pkg/config"
 	"gopkg.in/yaml.v3"
 )
 
@@ -71,57 +72,8 @@ func ReadFrom(r io.Reader, typ FileType) (*Stage2, error) {
 	return &cfg, nil
 }
 
+// MergeConfigs merges the `override` into a copy of the `embedded` configuration. How every field gets merged is
+// decided by its merge tag, see `config.Merge`.
 func MergeConfigs(embedded *Stage2, override *Stage2) *Stage2 {
-	// clone the values from the embedded config
-	// so that we don't override the arguments for the caller
-	// also short-circuit things to avoid pointer shenanigans
-	if embedded == nil {
-		return nil
-	}
-	ret := *embedded
-	if override == nil {
-		return &ret
-	}
-
-	if override.Platform != "" {
-		ret.Platform = override.Platform
-	}
-
-	if override.NOSInstallerURL != "" {
-		ret.NOSInstallerURL = override.NOSInstallerURL
-	}
-
-	if override.ONIEUpdaterURL != "" {
-		ret.ONIEUpdaterURL = override.ONIEUpdaterURL
-	}
-
-	if override.NOSType != "" {
-		ret.NOSType = override.NOSType
-	}
-
-	if len(override.HedgehogSonicProvisioners) > 0 {
-		provs := make([]HedgehogSonicProvisioner, len(ret.HedgehogSonicProvisioners))
-		copy(provs, ret.HedgehogSonicProvisioners)
-
-		for i := range override.HedgehogSonicProvisioners {
-			if j := hasProvisioner(ret.HedgehogSonicProvisioners, override.HedgehogSonicProvisioners[i].Name); j >= 0 {
-				provs[j] = override.HedgehogSonicProvisioners[i]
-			} else {
-				provs = append(provs, override.HedgehogSonicProvisioners[i]) //nolint: makezero
-			}
-		}
-
-		ret.HedgehogSonicProvisioners = provs
-	}
-
-	return &ret
-}
-
-func hasProvisioner(provs []HedgehogSonicProvisioner, name string) int {
-	for i, prov := range provs {
-		if prov.Name == name {
-			return i
-		}
-	}
-	return -1
+	return config.Merge(embedded, override)
 }
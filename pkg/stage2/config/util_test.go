@@ -0,0 +1,60 @@
+// Copyright 2023 Hedgehog
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"reflect"
+	"testing"
+
+	"go.githedgehog.com/dasboot/pkg/config"
+)
+
+func TestMergeTags(t *testing.T) {
+	if err := config.ValidateMergeTags[Stage2](); err != nil {
+		t.Errorf("every field of the configuration must have a merge tag: %v", err)
+	}
+}
+
+func TestMergeConfigsProvisioners(t *testing.T) {
+	embedded := &Stage2{
+		NOSInstallerURL:     "https://a/onie",
+		NOSInstallerMirrors: []string{"https://mirror/onie"},
+		HedgehogSonicProvisioners: []HedgehogSonicProvisioner{
+			{Name: "agent", URL: "https://a/agent"},
+			{Name: "frr", URL: "https://a/frr"},
+		},
+	}
+	got := MergeConfigs(embedded, &Stage2{
+		NOSInstallerURL: "https://b/onie",
+		HedgehogSonicProvisioners: []HedgehogSonicProvisioner{
+			{Name: "frr", URL: "https://b/frr"},
+			{Name: "debug", URL: "https://b/debug"},
+		},
+	})
+	want := &Stage2{
+		NOSInstallerURL: "https://b/onie",
+		HedgehogSonicProvisioners: []HedgehogSonicProvisioner{
+			{Name: "agent", URL: "https://a/agent"},
+			{Name: "frr", URL: "https://b/frr"},
+			{Name: "debug", URL: "https://b/debug"},
+		},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("MergeConfigs() = %#v, want %#v", got, want)
+	}
+	if embedded.HedgehogSonicProvisioners[1].URL != "https://a/frr" {
+		t.Errorf("MergeConfigs() modified the embedded config")
+	}
+}
@@ -0,0 +1,76 @@
+// Copyright 2023 Hedgehog
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package stage2
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os/exec"
+
+	"go.githedgehog.com/dasboot/pkg/partitions"
+	"go.githedgehog.com/dasboot/pkg/partitions/identity"
+	"go.uber.org/zap"
+)
+
+// diagBootCheckpoint is the name of the checkpoint on the identity partition which
+// tracks that we have already booted into the diagnostics OS
+const diagBootCheckpoint = "diag-boot"
+
+var ErrRebootPending = errors.New("stage2: reboot into diagnostics OS pending")
+
+// rebootCmd is a variable so that it can be swapped out in tests
+var rebootCmd = func(ctx context.Context) error {
+	return exec.CommandContext(ctx, "reboot").Run()
+}
+
+// runDiagBoot boots the diagnostics OS exactly once before the NOS installation. It returns
+// ErrRebootPending if the system is going to reboot into the diagnostics OS now. In this case
+// the NOS installation must not proceed, and it will be resumed on the next ONIE boot.
+func runDiagBoot(ctx context.Context, ip identity.IdentityPartition) error {
+	if _, err := ip.GetCheckpoint(diagBootCheckpoint); err == nil {
+		// we have been here before, so the diagnostics run is done: resume the installation
+		l.Info("Diagnostics OS boot has already been performed, resuming NOS installation")
+		if err := ip.DeleteCheckpoint(diagBootCheckpoint); err != nil {
+			l.Warn("Failed to delete diagnostics boot checkpoint", zap.Error(err))
+		}
+		return nil
+	} else if !errors.Is(err, identity.ErrNoCheckpoint) {
+		return fmt.Errorf("reading diagnostics boot checkpoint: %w", err)
+	}
+
+	// we store the checkpoint *before* we touch the boot entries, so that we never end up in a reboot loop
+	if err := ip.StoreCheckpoint(diagBootCheckpoint, []byte("pending")); err != nil {
+		return fmt.Errorf("storing diagnostics boot checkpoint: %w", err)
+	}
+
+	num, err := partitions.MakeDiagOneShotBootEntry()
+	if err != nil {
+		if errors.Is(err, partitions.ErrBootEntryNotFound) {
+			l.Warn("No diagnostics OS boot entry found, skipping diagnostics boot")
+			if err := ip.DeleteCheckpoint(diagBootCheckpoint); err != nil {
+				l.Warn("Failed to delete diagnostics boot checkpoint", zap.Error(err))
+			}
+			return nil
+		}
+		return fmt.Errorf("setting diagnostics OS as one-shot boot entry: %w", err)
+	}
+
+	l.Info("Rebooting into diagnostics OS now, NOS installation will resume afterwards", zap.String("bootEntry", fmt.Sprintf("%04X", num)))
+	if err := rebootCmd(ctx); err != nil {
+		return fmt.Errorf("reboot: %w", err)
+	}
+	return ErrRebootPending
+}
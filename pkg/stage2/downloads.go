@@ -0,0 +1,102 @@
+// Copyright 2023 Hedgehog
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package stage2
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"time"
+
+	"go.githedgehog.com/dasboot/pkg/stage"
+	configstage "go.githedgehog.com/dasboot/pkg/stage2/config"
+	"go.githedgehog.com/dasboot/pkg/version"
+	"go.uber.org/zap"
+)
+
+// downloadProgressInterval is the interval in which the progress of all downloads is being logged
+const downloadProgressInterval = 10 * time.Second
+
+// stagedArtifact is an artifact which is required for the installation
+type stagedArtifact struct {
+	name    string
+	url     string
+	mirrors []string
+	timeout time.Duration
+	pin     *version.ArtifactPin
+	opts    []stage.DownloadOption
+}
+
+// fetchArtifacts returns the paths of all `artifacts` keyed by their name. Pre-staged artifacts are used if they
+// are still intact, and all others are downloaded concurrently into `stagingDir` with at most `parallelism`
+// downloads at the same time. The pins of all artifacts are verified, and this covers pre-staged artifacts as well.
+func fetchArtifacts(ctx context.Context, hc *http.Client, m PrestageManifest, stagingDir string, parallelism int, artifacts []stagedArtifact) (map[string]string, error) {
+	paths := make(map[string]string, len(artifacts))
+	jobs := make([]stage.DownloadJob, 0, len(artifacts))
+	names := make([]string, 0, len(artifacts))
+	for _, a := range artifacts {
+		if p, ok := prestagedArtifact(m, a.name, a.url); ok {
+			l.Info("Using pre-staged artifact", zap.String("artifact", a.name), zap.String("path", p), zap.String("url", a.url))
+			if err := stage.VerifyArtifactPin(p, a.pin); err != nil {
+				l.Error("Pre-staged artifact does not match its pinned digest", zap.String("artifact", a.name), zap.String("path", p), zap.Reflect("pin", a.pin), zap.Error(err))
+				return nil, fmt.Errorf("%w: %s: %w", stage.ErrVerificationFailed, a.name, err)
+			}
+			paths[a.name] = p
+			continue
+		}
+		destPath := filepath.Join(stagingDir, a.name)
+		jobs = append(jobs, stage.DownloadJob{
+			Name:     a.name,
+			URLs:     stage.MirrorURLs(a.url, a.mirrors),
+			DestPath: destPath,
+			Timeout:  a.timeout,
+			Pin:      a.pin,
+			Options:  a.opts,
+		})
+		names = append(names, a.name)
+		paths[a.name] = destPath
+	}
+	if len(jobs) == 0 {
+		return paths, nil
+	}
+
+	l.Info("Downloading artifacts now...", zap.Strings("artifacts", names), zap.Int("parallelism", parallelism))
+	dm := stage.NewDownloadManager(hc, parallelism, stage.DownloadManagerOptionProgress(downloadProgressInterval, func(p stage.DownloadProgress) {
+		l.Info("Download progress", zap.Int64("written", p.Written), zap.Int64("total", p.Total), zap.Reflect("artifacts", p.Artifacts))
+	}))
+	results, err := dm.Run(ctx, jobs)
+	for _, res := range results {
+		if res.Err != nil {
+			l.Error("Downloading artifact failed", zap.String("artifact", res.Name), zap.String("dest", res.Path), zap.Error(res.Err))
+		} else if res.URL != "" {
+			l.Info("Downloading artifact completed", zap.String("artifact", res.Name), zap.String("url", res.URL), zap.String("dest", res.Path), zap.Duration("duration", res.Duration))
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return paths, nil
+}
+
+// discardEnabled returns false if discards are disabled for `platform` or for all platforms
+func discardEnabled(cfg *configstage.Stage2, platform string) bool {
+	for _, p := range cfg.DisableDiscardPlatforms {
+		if p == "*" || p == platform {
+			return false
+		}
+	}
+	return true
+}
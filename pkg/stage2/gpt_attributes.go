@@ -0,0 +1,60 @@
+// Copyright 2023 Hedgehog
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package stage2
+
+import (
+	"fmt"
+
+	"go.githedgehog.com/dasboot/pkg/partitions"
+	configstage "go.githedgehog.com/dasboot/pkg/stage2/config"
+	"go.uber.org/zap"
+)
+
+// platformGPTAttributes returns the GPT attributes by partition name which must be set on `platform`.
+// The attributes for all platforms ("*") and the ones for the specific platform are combined.
+func platformGPTAttributes(cfg *configstage.Stage2, platform string) (map[string]partitions.GPTAttributes, error) {
+	ret := map[string]partitions.GPTAttributes{}
+	for _, key := range []string{"*", platform} {
+		for name, attrNames := range cfg.GPTAttributes[key] {
+			attrs, err := partitions.ParseGPTAttributes(attrNames)
+			if err != nil {
+				return nil, fmt.Errorf("GPT attributes for partition '%s' on platform '%s': %w", name, key, err)
+			}
+			ret[name] |= attrs
+		}
+	}
+	return ret, nil
+}
+
+// applyGPTAttributes sets the GPT attributes on the partitions which the NOS installer created
+func applyGPTAttributes(cfg *configstage.Stage2, platform string) error {
+	attrs, err := platformGPTAttributes(cfg, platform)
+	if err != nil {
+		return err
+	}
+	if len(attrs) == 0 {
+		return nil
+	}
+
+	// the NOS installer created new partitions, so we need to rediscover them
+	devices := partitions.Discover()
+	if err := devices.ApplyGPTAttributes(attrs); err != nil {
+		return err
+	}
+	for name, a := range attrs {
+		l.Info("Set GPT partition attributes", zap.String("partition", name), zap.Stringer("attributes", a))
+	}
+	return nil
+}
@@ -0,0 +1,238 @@
+// Copyright 2023 Hedgehog
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package stage2
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"go.githedgehog.com/dasboot/pkg/partitions"
+	"go.githedgehog.com/dasboot/pkg/partitions/identity"
+	"go.uber.org/zap"
+)
+
+const (
+	// nosConfigBackupCheckpoint is the checkpoint on the identity partition which holds the NOS configuration backup
+	nosConfigBackupCheckpoint = "nos-config-backup"
+
+	// sonicImagePrefix is the prefix of the directories of installed SONiC images on the SONiC partition
+	sonicImagePrefix = "image-"
+
+	// sonicConfigDir is where /etc/sonic of a SONiC image lives on the SONiC partition relative to the image directory
+	sonicConfigDir = "rw/etc/sonic"
+
+	// sonicOldConfigDir is where SONiC picks up the configuration of a previous installation on the SONiC partition
+	// to migrate it on its first boot
+	sonicOldConfigDir = "old_config"
+)
+
+var errNoSONiCInstallation = errors.New("no SONiC installation found")
+
+// nosConfigBackup holds the preserved files of an existing NOS configuration
+type nosConfigBackup struct {
+	// Image is the SONiC image directory which the configuration was backed up from
+	Image string `json:"image"`
+
+	// Files maps the paths relative to /etc/sonic to their contents
+	Files map[string][]byte `json:"files"`
+
+	// CreatedAt is the time when the backup was taken
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// this can be swapped out for testing
+var withSONiCPartition = func(f func(root string) error) error {
+	sonicPart := partitions.Discover().GetSONiCPartition()
+	if sonicPart == nil {
+		return errNoSONiCInstallation
+	}
+	if !sonicPart.IsMounted() {
+		if err := sonicPart.Mount(); err != nil {
+			return fmt.Errorf("mounting SONiC partition: %w", err)
+		}
+		defer func() {
+			if err := sonicPart.Unmount(); err != nil {
+				l.Warn("Unmounting SONiC partition failed", zap.String("device", sonicPart.Path), zap.Error(err))
+			}
+		}()
+	}
+	return f(sonicPart.MountPath)
+}
+
+// latestSONiCImage returns the directory of the SONiC image on the SONiC partition mounted at `root` whose
+// configuration was changed most recently
+func latestSONiCImage(root string) (string, error) {
+	entries, err := os.ReadDir(root)
+	if err != nil {
+		return "", err
+	}
+	var ret string
+	var latest time.Time
+	for _, entry := range entries {
+		if !entry.IsDir() || !strings.HasPrefix(entry.Name(), sonicImagePrefix) {
+			continue
+		}
+		st, err := os.Stat(filepath.Join(root, entry.Name(), sonicConfigDir))
+		if err != nil || !st.IsDir() {
+			continue
+		}
+		if ret == "" || st.ModTime().After(latest) {
+			ret = filepath.Join(root, entry.Name())
+			latest = st.ModTime()
+		}
+	}
+	if ret == "" {
+		return "", errNoSONiCInstallation
+	}
+	return ret, nil
+}
+
+// readNOSConfig reads all files at `paths` from the configuration directory of the SONiC image at `imageDir`.
+// Paths which do not exist are skipped, and directories are read with all their files.
+func readNOSConfig(imageDir string, paths []string) (map[string][]byte, error) {
+	configDir := filepath.Join(imageDir, sonicConfigDir)
+	ret := map[string][]byte{}
+	for _, p := range paths {
+		err := filepath.WalkDir(filepath.Join(configDir, filepath.FromSlash(p)), func(fp string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			if !d.Type().IsRegular() {
+				return nil
+			}
+			rel, err := filepath.Rel(configDir, fp)
+			if err != nil {
+				return err
+			}
+			b, err := os.ReadFile(fp)
+			if err != nil {
+				return err
+			}
+			ret[filepath.ToSlash(rel)] = b
+			return nil
+		})
+		if errors.Is(err, fs.ErrNotExist) {
+			l.Info("NOS configuration to preserve does not exist, skipping", zap.String("path", p))
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("reading '%s': %w", p, err)
+		}
+	}
+	return ret, nil
+}
+
+// writeNOSConfig writes `files` for migration by a new SONiC installation on the SONiC partition mounted at `root`
+func writeNOSConfig(root string, files map[string][]byte) error {
+	oldConfigDir := filepath.Join(root, sonicOldConfigDir)
+	for rel, b := range files {
+		if strings.HasPrefix(path.Clean("/"+rel), "/..") {
+			return fmt.Errorf("invalid path '%s' in backup", rel)
+		}
+		dest := filepath.Join(oldConfigDir, filepath.FromSlash(rel))
+		if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+			return err
+		}
+		if err := os.WriteFile(dest, b, 0644); err != nil { //nolint: gosec
+			return err
+		}
+	}
+	return nil
+}
+
+// backupNOSConfig backs up the NOS configuration files at `paths` of an existing SONiC installation to the identity
+// partition. A backup which was left behind by a previous failed installation attempt is kept, as the SONiC partition
+// might have been overwritten by that attempt already.
+func backupNOSConfig(ip identity.IdentityPartition, paths []string) error {
+	if len(paths) == 0 {
+		return nil
+	}
+	if _, err := ip.GetCheckpoint(nosConfigBackupCheckpoint); err == nil {
+		l.Info("Keeping NOS configuration backup of a previous installation attempt")
+		return nil
+	} else if !errors.Is(err, identity.ErrNoCheckpoint) {
+		return fmt.Errorf("reading NOS configuration backup: %w", err)
+	}
+
+	backup := &nosConfigBackup{CreatedAt: time.Now()}
+	if err := withSONiCPartition(func(root string) error {
+		image, err := latestSONiCImage(root)
+		if err != nil {
+			return err
+		}
+		backup.Image = filepath.Base(image)
+		backup.Files, err = readNOSConfig(image, paths)
+		return err
+	}); err != nil {
+		if errors.Is(err, errNoSONiCInstallation) {
+			l.Info("No existing SONiC installation found, there is no NOS configuration to preserve")
+			return nil
+		}
+		return err
+	}
+	if len(backup.Files) == 0 {
+		l.Info("Existing SONiC installation has none of the NOS configuration to preserve", zap.String("image", backup.Image), zap.Strings("paths", paths))
+		return nil
+	}
+
+	b, err := json.Marshal(backup)
+	if err != nil {
+		return err
+	}
+	if err := ip.StoreCheckpoint(nosConfigBackupCheckpoint, b); err != nil {
+		return fmt.Errorf("storing NOS configuration backup: %w", err)
+	}
+	files := make([]string, 0, len(backup.Files))
+	for rel := range backup.Files {
+		files = append(files, rel)
+	}
+	l.Info("Backed up NOS configuration", zap.String("image", backup.Image), zap.Strings("files", files))
+	return nil
+}
+
+// restoreNOSConfig restores the NOS configuration backup from the identity partition for the new SONiC installation
+// to migrate on its first boot. The backup is deleted once it was restored.
+func restoreNOSConfig(ip identity.IdentityPartition) error {
+	b, err := ip.GetCheckpoint(nosConfigBackupCheckpoint)
+	if err != nil {
+		if errors.Is(err, identity.ErrNoCheckpoint) {
+			return nil
+		}
+		return fmt.Errorf("reading NOS configuration backup: %w", err)
+	}
+	var backup nosConfigBackup
+	if err := json.Unmarshal(b, &backup); err != nil {
+		return fmt.Errorf("decoding NOS configuration backup: %w", err)
+	}
+
+	if err := withSONiCPartition(func(root string) error {
+		return writeNOSConfig(root, backup.Files)
+	}); err != nil {
+		return err
+	}
+	l.Info("Restored NOS configuration for migration on first boot", zap.String("fromImage", backup.Image), zap.Int("files", len(backup.Files)))
+
+	if err := ip.DeleteCheckpoint(nosConfigBackupCheckpoint); err != nil {
+		l.Warn("Deleting NOS configuration backup failed", zap.Error(err))
+	}
+	return nil
+}
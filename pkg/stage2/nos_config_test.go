@@ -0,0 +1,143 @@
+// Copyright 2023 Hedgehog
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package stage2
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestPreserveNOSConfig(t *testing.T) {
+	writeFile := func(t *testing.T, p string, contents string, mtime time.Time) {
+		t.Helper()
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, []byte(contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(filepath.Dir(p), mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name        string
+		existing    map[string][]byte
+		setup       func(t *testing.T, root string)
+		paths       []string
+		wantRestore map[string]string
+	}{
+		{
+			name: "latest image is preserved",
+			setup: func(t *testing.T, root string) {
+				old := time.Now().Add(-time.Hour)
+				writeFile(t, filepath.Join(root, "image-old", sonicConfigDir, "config_db.json"), "old config", old)
+				writeFile(t, filepath.Join(root, "image-new", sonicConfigDir, "frr", "bgpd.conf"), "router bgp", time.Now())
+				writeFile(t, filepath.Join(root, "image-new", sonicConfigDir, "config_db.json"), "new config", time.Now())
+				writeFile(t, filepath.Join(root, "image-new", sonicConfigDir, "other.json"), "not preserved", time.Now())
+			},
+			paths: []string{"config_db.json", "frr", "missing.json"},
+			wantRestore: map[string]string{
+				"config_db.json": "new config",
+				"frr/bgpd.conf":  "router bgp",
+			},
+		},
+		{
+			name:  "no SONiC installation",
+			setup: func(t *testing.T, root string) {},
+			paths: []string{"config_db.json"},
+		},
+		{
+			name: "backup of previous attempt is kept",
+			existing: map[string][]byte{
+				nosConfigBackupCheckpoint: []byte(`{"image":"image-previous","files":{"config_db.json":"cHJldmlvdXMgY29uZmln"}}`),
+			},
+			setup: func(t *testing.T, root string) {
+				writeFile(t, filepath.Join(root, "image-half-installed", sonicConfigDir, "config_db.json"), "factory default", time.Now())
+			},
+			paths: []string{"config_db.json"},
+			wantRestore: map[string]string{
+				"config_db.json": "previous config",
+			},
+		},
+		{
+			name: "nothing to preserve",
+			setup: func(t *testing.T, root string) {
+				writeFile(t, filepath.Join(root, "image-new", sonicConfigDir, "config_db.json"), "new config", time.Now())
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			oldWithSONiCPartition := withSONiCPartition
+			defer func() { withSONiCPartition = oldWithSONiCPartition }()
+			root := t.TempDir()
+			withSONiCPartition = func(f func(root string) error) error {
+				return f(root)
+			}
+			tt.setup(t, root)
+
+			ip := &fakeCheckpoints{checkpoints: map[string][]byte{}}
+			for k, v := range tt.existing {
+				ip.checkpoints[k] = v
+			}
+
+			if err := backupNOSConfig(ip, tt.paths); err != nil {
+				t.Fatalf("backupNOSConfig() error = %v", err)
+			}
+
+			// the NOS installer wipes the partition
+			if err := os.RemoveAll(root); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.Mkdir(root, 0755); err != nil {
+				t.Fatal(err)
+			}
+
+			if err := restoreNOSConfig(ip); err != nil {
+				t.Fatalf("restoreNOSConfig() error = %v", err)
+			}
+			if _, ok := ip.checkpoints[nosConfigBackupCheckpoint]; ok {
+				t.Errorf("restoreNOSConfig() did not delete the backup")
+			}
+
+			got := map[string]string{}
+			oldConfigDir := filepath.Join(root, sonicOldConfigDir)
+			_ = filepath.Walk(oldConfigDir, func(p string, info os.FileInfo, err error) error {
+				if err != nil || info.IsDir() {
+					return err
+				}
+				b, err := os.ReadFile(p)
+				if err != nil {
+					return err
+				}
+				rel, _ := filepath.Rel(oldConfigDir, p)
+				got[filepath.ToSlash(rel)] = string(b)
+				return nil
+			})
+			want := tt.wantRestore
+			if want == nil {
+				want = map[string]string{}
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("restored NOS configuration = %v, want %v", got, want)
+			}
+		})
+	}
+}
@@ -0,0 +1,220 @@
+// Copyright 2023 Hedgehog
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package stage2
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	"go.githedgehog.com/dasboot/pkg/partitions"
+	"go.githedgehog.com/dasboot/pkg/partitions/identity"
+	"go.githedgehog.com/dasboot/pkg/stage"
+	configstage "go.githedgehog.com/dasboot/pkg/stage2/config"
+	"go.uber.org/zap"
+)
+
+// prestageCheckpoint is the name of the checkpoint on the identity partition which
+// holds the manifest of all pre-staged artifacts
+const prestageCheckpoint = "prestage"
+
+// nosInstallerName is the name of the NOS installer in the staging directory and in the pre-stage manifest
+const nosInstallerName = "nos-install"
+
+// PrestagedArtifact is the record of an artifact which has been pre-staged onto the device
+type PrestagedArtifact struct {
+	// URL is the URL where the artifact was downloaded from
+	URL string `json:"url"`
+
+	// Path is the local path where the artifact is stored
+	Path string `json:"path"`
+
+	// Digest is the digest of the artifact in the form `sha256:<hex>`
+	Digest string `json:"digest"`
+
+	// Size is the size of the artifact in bytes
+	Size int64 `json:"size"`
+
+	// StagedAt is the time when the artifact was pre-staged
+	StagedAt time.Time `json:"staged_at"`
+}
+
+// PrestageManifest holds all pre-staged artifacts by their name
+type PrestageManifest map[string]*PrestagedArtifact
+
+func prestageDir(cfg *configstage.Stage2) string {
+	if cfg.PrestageDir != "" {
+		return cfg.PrestageDir
+	}
+	return filepath.Join(partitions.MountPathHedgehogIdentity, "prestage")
+}
+
+// readPrestageManifest reads the pre-stage manifest from the identity partition. It returns
+// an empty manifest if nothing has been pre-staged.
+func readPrestageManifest(ip identity.IdentityPartition) (PrestageManifest, error) {
+	b, err := ip.GetCheckpoint(prestageCheckpoint)
+	if err != nil {
+		if errors.Is(err, identity.ErrNoCheckpoint) {
+			return PrestageManifest{}, nil
+		}
+		return nil, fmt.Errorf("reading pre-stage checkpoint: %w", err)
+	}
+	ret := PrestageManifest{}
+	if err := json.Unmarshal(b, &ret); err != nil {
+		return nil, fmt.Errorf("decoding pre-stage manifest: %w", err)
+	}
+	return ret, nil
+}
+
+func storePrestageManifest(ip identity.IdentityPartition, m PrestageManifest) error {
+	b, err := json.Marshal(m)
+	if err != nil {
+		return fmt.Errorf("encoding pre-stage manifest: %w", err)
+	}
+	if err := ip.StoreCheckpoint(prestageCheckpoint, b); err != nil {
+		return fmt.Errorf("storing pre-stage checkpoint: %w", err)
+	}
+	return nil
+}
+
+// fileDigest returns the digest in the form `sha256:<hex>` and the size of the file at `path`
+func fileDigest(path string) (string, int64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", 0, err
+	}
+	defer f.Close()
+	h := sha256.New()
+	n, err := io.Copy(h, f)
+	if err != nil {
+		return "", 0, err
+	}
+	return "sha256:" + hex.EncodeToString(h.Sum(nil)), n, nil
+}
+
+// prestageArtifact downloads the artifact `name` from `url` into `dir` and records it in the manifest
+func prestageArtifact(ctx context.Context, hc *http.Client, m PrestageManifest, dir string, name string, url string, timeout time.Duration, opts ...stage.DownloadOption) error {
+	destPath := filepath.Join(dir, name)
+	if err := stage.DownloadExecutable(ctx, hc, url, destPath, timeout, opts...); err != nil {
+		return err
+	}
+	digest, size, err := fileDigest(destPath)
+	if err != nil {
+		return fmt.Errorf("digest of '%s': %w", destPath, err)
+	}
+	m[name] = &PrestagedArtifact{
+		URL:      url,
+		Path:     destPath,
+		Digest:   digest,
+		Size:     size,
+		StagedAt: time.Now(),
+	}
+	return nil
+}
+
+// prestagedArtifact returns the path of the pre-staged artifact `name` if it was pre-staged from
+// the same `url`, and if it still matches its recorded digest.
+func prestagedArtifact(m PrestageManifest, name string, url string) (string, bool) {
+	pa, ok := m[name]
+	if !ok || pa == nil {
+		return "", false
+	}
+	if pa.URL != url {
+		l.Info("Pre-staged artifact was downloaded from a different URL, ignoring it", zap.String("artifact", name), zap.String("url", url), zap.String("prestagedURL", pa.URL))
+		return "", false
+	}
+	digest, size, err := fileDigest(pa.Path)
+	if err != nil {
+		l.Warn("Reading pre-staged artifact failed, ignoring it", zap.String("artifact", name), zap.String("path", pa.Path), zap.Error(err))
+		return "", false
+	}
+	if digest != pa.Digest || size != pa.Size {
+		l.Warn("Pre-staged artifact does not match its recorded digest anymore, ignoring it", zap.String("artifact", name), zap.String("path", pa.Path), zap.String("digest", digest), zap.String("wantDigest", pa.Digest))
+		return "", false
+	}
+	return pa.Path, true
+}
+
+// cleanupPrestaged removes all pre-staged artifacts and the manifest after an installation has used them
+func cleanupPrestaged(ip identity.IdentityPartition, m PrestageManifest) {
+	if len(m) == 0 {
+		return
+	}
+	for name, pa := range m {
+		if err := os.Remove(pa.Path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			l.Warn("Removing pre-staged artifact failed", zap.String("artifact", name), zap.String("path", pa.Path), zap.Error(err))
+		}
+	}
+	if err := ip.DeleteCheckpoint(prestageCheckpoint); err != nil {
+		l.Warn("Deleting pre-stage checkpoint failed", zap.Error(err))
+	}
+}
+
+// runPrestage downloads and verifies the NOS installer and all provisioners into the pre-stage directory, and records
+// them in the pre-stage manifest on the identity partition. It does not install anything.
+func runPrestage(ctx context.Context, hc *http.Client, cfg *configstage.Stage2, si *stage.StagingInfo, onie *stage.OnieEnv, ip identity.IdentityPartition) error {
+	dir := prestageDir(cfg)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("creating pre-stage directory '%s': %w", dir, err)
+	}
+	m, err := readPrestageManifest(ip)
+	if err != nil {
+		l.Warn("Reading pre-stage manifest failed, starting with an empty one", zap.Error(err))
+		m = PrestageManifest{}
+	}
+
+	url, err := nosInstallerURL(cfg, si, onie)
+	if err != nil {
+		return err
+	}
+	checkPathMTU(ctx, url, si.MTU)
+	l.Info("Pre-staging NOS installer now...", zap.String("url", url), zap.String("dir", dir))
+	if err := stage.Timed("prestage-nos", func() error {
+		return prestageArtifact(ctx, hc, m, dir, nosInstallerName, url, time.Second*120)
+	}); err != nil {
+		l.Error("Pre-staging NOS installer failed", zap.String("url", url), zap.String("dir", dir), zap.Error(err))
+		return fmt.Errorf("NOS pre-stage: %w", err)
+	}
+
+	if cfg.NOSType == configstage.NOSTypeHedgehogSonic {
+		opts, err := si.ArtifactDownloadOptions()
+		if err != nil {
+			return err
+		}
+		for _, p := range cfg.HedgehogSonicProvisioners {
+			l.Info("Pre-staging provisioner now...", zap.String("provisioner", p.Name), zap.String("url", p.URL), zap.String("dir", dir))
+			if err := stage.Timed("prestage-provisioner-"+p.Name, func() error {
+				return prestageArtifact(ctx, hc, m, dir, p.Name, p.URL, time.Second*60, opts...)
+			}); err != nil {
+				l.Error("Pre-staging provisioner failed", zap.String("provisioner", p.Name), zap.String("url", p.URL), zap.Error(err))
+				return fmt.Errorf("provisioner '%s' pre-stage: %w", p.Name, err)
+			}
+		}
+	}
+
+	if err := storePrestageManifest(ip, m); err != nil {
+		return err
+	}
+	l.Info("Pre-staged artifacts", zap.Reflect("manifest", m))
+	return nil
+}
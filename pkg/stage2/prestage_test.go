@@ -0,0 +1,137 @@
+// Copyright 2023 Hedgehog
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package stage2
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"go.githedgehog.com/dasboot/pkg/partitions/identity"
+)
+
+// fakeCheckpoints implements the checkpoint functions of an identity partition in memory
+type fakeCheckpoints struct {
+	identity.IdentityPartition
+	checkpoints map[string][]byte
+}
+
+func (f *fakeCheckpoints) StoreCheckpoint(name string, data []byte) error {
+	f.checkpoints[name] = data
+	return nil
+}
+
+func (f *fakeCheckpoints) GetCheckpoint(name string) ([]byte, error) {
+	data, ok := f.checkpoints[name]
+	if !ok {
+		return nil, identity.ErrNoCheckpoint
+	}
+	return data, nil
+}
+
+func (f *fakeCheckpoints) DeleteCheckpoint(name string) error {
+	delete(f.checkpoints, name)
+	return nil
+}
+
+func TestPrestage(t *testing.T) {
+	ctx := context.Background()
+	requests := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Write([]byte("nos installer " + r.URL.Path)) //nolint:errcheck
+	}))
+	defer srv.Close()
+	nosURL := srv.URL + "/nos"
+
+	tests := []struct {
+		name         string
+		url          string
+		tamper       bool
+		wantPrestage bool
+	}{
+		{
+			name:         "pre-staged artifact is used",
+			url:          nosURL,
+			wantPrestage: true,
+		},
+		{
+			name: "pre-staged artifact from different URL is ignored",
+			url:  srv.URL + "/other",
+		},
+		{
+			name:   "tampered pre-staged artifact is ignored",
+			url:    nosURL,
+			tamper: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ip := &fakeCheckpoints{checkpoints: map[string][]byte{}}
+			prestageDir := t.TempDir()
+			stagingDir := t.TempDir()
+
+			// pre-stage the artifact and persist the manifest
+			m := PrestageManifest{}
+			if err := prestageArtifact(ctx, srv.Client(), m, prestageDir, nosInstallerName, nosURL, time.Second*10); err != nil {
+				t.Fatalf("prestageArtifact() error = %v", err)
+			}
+			if err := storePrestageManifest(ip, m); err != nil {
+				t.Fatalf("storePrestageManifest() error = %v", err)
+			}
+			if tt.tamper {
+				if err := os.WriteFile(m[nosInstallerName].Path, []byte("tampered"), 0755); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			// a later installation reads the manifest again
+			m, err := readPrestageManifest(ip)
+			if err != nil {
+				t.Fatalf("readPrestageManifest() error = %v", err)
+			}
+			requests = 0
+			destPath := filepath.Join(stagingDir, nosInstallerName)
+			paths, err := fetchArtifacts(ctx, srv.Client(), m, stagingDir, 0, []stagedArtifact{{name: nosInstallerName, url: tt.url, timeout: time.Second * 10}})
+			if err != nil {
+				t.Fatalf("fetchArtifacts() error = %v", err)
+			}
+			got := paths[nosInstallerName]
+			if tt.wantPrestage {
+				if got != filepath.Join(prestageDir, nosInstallerName) || requests != 0 {
+					t.Errorf("fetchArtifacts() = %s with %d requests, want pre-staged artifact", got, requests)
+				}
+			} else {
+				if got != destPath || requests != 1 {
+					t.Errorf("fetchArtifacts() = %s with %d requests, want download", got, requests)
+				}
+			}
+
+			// cleanup removes the artifacts and the manifest
+			cleanupPrestaged(ip, m)
+			if _, err := os.Stat(filepath.Join(prestageDir, nosInstallerName)); !os.IsNotExist(err) {
+				t.Errorf("cleanupPrestaged() did not remove artifact: %v", err)
+			}
+			if m, err := readPrestageManifest(ip); err != nil || len(m) != 0 {
+				t.Errorf("cleanupPrestaged() did not remove manifest: %v %v", m, err)
+			}
+		})
+	}
+}
@@ -28,7 +28,10 @@ import (
 
 	"go.githedgehog.com/dasboot/pkg/config"
 	"go.githedgehog.com/dasboot/pkg/log"
+	"go.githedgehog.com/dasboot/pkg/net"
 	"go.githedgehog.com/dasboot/pkg/partitions"
+	"go.githedgehog.com/dasboot/pkg/partitions/identity"
+	"go.githedgehog.com/dasboot/pkg/seeder/logship"
 	"go.githedgehog.com/dasboot/pkg/stage"
 	configstage "go.githedgehog.com/dasboot/pkg/stage2/config"
 	"go.githedgehog.com/dasboot/pkg/version"
@@ -38,6 +41,14 @@ import (
 
 var l = log.L()
 
+// correlation holds the fields which are bound to every log message of this stage
+var correlation log.Correlation
+
+// setLogger makes `newL` the logger of this stage with all correlation fields bound to it
+func setLogger(newL log.Interface) {
+	l = log.WithCorrelation(newL, correlation)
+}
+
 var ErrExecution = errors.New("unrecoverable execution error encountered")
 
 func executionError(err error) error {
@@ -73,21 +84,38 @@ func ReadConfig(caPool *x509.CertPool) (*configstage.Stage2, error) {
 	return &cfg, nil
 }
 
-func Run(ctx context.Context, override *configstage.Stage2, logSettings *stage.LogSettings) (runErr error) {
+// Run runs stage 2 with `logSettings` which initialize the global logger. This is what the stage 2 binary executes.
+func Run(ctx context.Context, override *configstage.Stage2, logSettings *stage.LogSettings) error {
+	_, err := Execute(ctx, override, stage.RunOptionLogSettings(logSettings))
+	return err
+}
+
+// Execute runs stage 2 in-process. It can be used to embed stage 2 into other installers. The returned result is
+// never nil, and holds as much information as was gathered until the execution finished or failed.
+func Execute(ctx context.Context, override *configstage.Stage2, opts ...stage.RunOption) (result *stage.Result, runErr error) {
+	o := stage.NewRunOptions(opts...)
+	logSettings := o.LogSettings
+	result = &stage.Result{}
+	correlation = log.Correlation{Stage: "stage2"}
+
 	// setup some console logging first
 	// NOTE: we'll throw this away immediately after we've read the staging info
 	// so this is really just for until then
 	// TODO: this essentially should never fail, so should be implemented differently I guess
-	if err := stage.InitializeGlobalLogger(ctx, logSettings); err != nil {
-		return fmt.Errorf("stage0: failed to initialize logger: %w", err)
+	newL, err := o.InitializeLogger(ctx, logSettings)
+	if err != nil {
+		return result, fmt.Errorf("stage0: failed to initialize logger: %w", err)
 	}
-	l = log.L()
+	setLogger(newL)
 	defer func() {
 		if err := l.Sync(); err != nil {
 			l.Debug("Flushing logger failed", zap.Error(err))
 		}
 	}()
 	l.Info("Stage 2 execution starting", zap.String("version", version.Version))
+
+	// record execution timings of all major steps
+	stage.StartTimings("stage2")
 	l.Info("System environment", zap.Strings("env", os.Environ()))
 
 	// read ONIE env information
@@ -98,16 +126,35 @@ func Run(ctx context.Context, override *configstage.Stage2, logSettings *stage.L
 	si, err := stage.ReadStagingInfo()
 	if err != nil {
 		l.Error("Reading staging info", zap.Error(err))
-		return executionError(fmt.Errorf("reading staging info: %w", err))
+		stage.FinishTimings(l, "", err)
+		return result, executionError(fmt.Errorf("reading staging info: %w", err))
+	}
+
+	// from now on every message carries the device ID and install session
+	correlation = si.Correlation("stage2")
+	setLogger(l)
+	partitions.SetMultipathPolicy(si.MultipathPolicy)
+	partitions.SetDiskSelectionPolicy(si.DiskSelection)
+	result.StagingInfo = si
+	defer func() {
+		if summary := stage.FinishTimings(l, si.StagingDir, runErr); summary != nil {
+			result.Timings = summary
+		}
+	}()
+
+	// stage 0 holds the install lock for our install session, if it is not ours anymore, we must stop right here
+	if err := stage.VerifyInstallLock(si.InstallSessionID); err != nil {
+		l.Error("Install lock verification failed", zap.Error(err))
+		return result, executionError(err)
 	}
 
 	// reinitialize global logger
 	// TODO: merge log settings I guess? will figure out what constitutes a change from the program flags
 	l.Debug("Reinitializing global logger again", zap.Reflect("logSettings", &si.LogSettings))
-	if err := stage.InitializeGlobalLogger(ctx, &si.LogSettings); err != nil {
+	if newL, err := o.InitializeLogger(ctx, &si.LogSettings); err != nil {
 		l.Warn("Reinitializing global logger failed", zap.Error(err))
 	} else {
-		l = log.L()
+		setLogger(newL)
 		l.Info("Reinitialized global logger from staging info", zap.Reflect("logSettings", &si.LogSettings))
 	}
 
@@ -115,14 +162,14 @@ func Run(ctx context.Context, override *configstage.Stage2, logSettings *stage.L
 	configCAPool, err := si.ConfigSignatureCAPool()
 	if err != nil {
 		l.Error("Initializing Config Signature CA Pool failed", zap.Error(err))
-		return executionError(fmt.Errorf("initializing config signature CA pool: %w", err))
+		return result, executionError(fmt.Errorf("initializing config signature CA pool: %w", err))
 	}
 
 	// read embedded config now
 	embedded, err := ReadConfig(configCAPool)
 	if err != nil {
 		l.Error("Reading embedded config failed", zap.Error(err))
-		return executionError(err)
+		return result, executionError(err)
 	}
 	l.Info("Read embedded configuration", zap.Reflect("config", embedded))
 
@@ -130,75 +177,224 @@ func Run(ctx context.Context, override *configstage.Stage2, logSettings *stage.L
 	cfg := configstage.MergeConfigs(embedded, override)
 	if err := cfg.Validate(); err != nil {
 		l.Error("Merged config validation error", zap.Error(err))
-		return executionError(fmt.Errorf("merged config validation: %w", err))
+		return result, executionError(fmt.Errorf("merged config validation: %w", err))
 	}
 	if override != nil {
 		l.Info("Merged override configuration", zap.Reflect("config", cfg))
 	}
 
+	stage.ReportToolCapabilities(l)
+
 	// discover partitions
+	endDiscovery := stage.Span("discovery")
 	devices := partitions.Discover()
+	endDiscovery()
 
 	// now mount (or create and mount) the identity partition
 	// this step fully initializes and prepares the partition for our usage
-	identityPartition, err := stage.MountIdentityPartition(l, devices, onieEnv.Platform)
+	identityPartition, err := stage.MountIdentityPartition(l, devices, onieEnv.Platform, &stage.IdentityEncryption{Keys: stage.IdentityUnlockKeys(l, devices)})
 	if err != nil {
 		l.Error("Identity Partition could not be opened/mounted/created", zap.Error(err))
-		return executionError(fmt.Errorf("opening identity partition: %w", err))
+		return result, executionError(fmt.Errorf("opening identity partition: %w", err))
 	}
 	l.Info("Opened Hedgehog Identity Partition successfully")
 
-	hc, err := stage.SeederHTTPClient(si.ServerCA, identityPartition)
+	hc, err := si.SeederHTTPClient(identityPartition, configCAPool, stage.LabModeOptions(cfg.LabMode)...)
 	if err != nil {
 		l.Error("Building HTTP client for downloading stage 2 failed", zap.Error(err))
-		return executionError(err)
+		return result, executionError(err)
+	}
+
+	// ship all further logs to the seeder as well, so that they are available for post-mortem analysis
+	if cfg.LogShippingURL != "" {
+		if shipL, err := logship.StageLogger(hc, cfg.LogShippingURL, identityPartition, si, "stage2"); err != nil {
+			l.Warn("Log shipping disabled", zap.String("url", cfg.LogShippingURL), zap.Error(err))
+		} else {
+			setLogger(log.Tee(l, shipL))
+			l.Info("Shipping logs to seeder", zap.String("url", cfg.LogShippingURL))
+		}
+	}
+
+	// the metadata is only informational, so that logs and reports tell which device in the fabric they are from
+	if cfg.DeviceMetadataURL != "" {
+		md, err := stage.FetchDeviceMetadata(ctx, hc, cfg.DeviceMetadataURL, si.DeviceID)
+		if err != nil {
+			l.Warn("Fetching device metadata failed", zap.String("url", cfg.DeviceMetadataURL), zap.Error(err))
+		} else {
+			correlation.Hostname = md.Hostname
+			setLogger(l)
+			l.Info("Received device metadata", zap.Reflect("metadata", md))
+		}
+	}
+
+	// operators can cancel the installation on the seeder, and we abort at the next safe checkpoint then
+	watcher, err := stage.NewCancellationWatcher(hc, cfg.InstallCancellationURL, si.DeviceID, si.InstallSessionID, "stage2")
+	if err != nil {
+		l.Warn("Install cancellation disabled", zap.String("url", cfg.InstallCancellationURL), zap.Error(err))
+	}
+	go watcher.Watch(ctx, l)
+
+	// in pre-stage mode we only download the artifacts for a later installation
+	if cfg.Prestage {
+		if err := runPrestage(ctx, hc, cfg, si, onieEnv, identityPartition); err != nil {
+			l.Error("Pre-staging artifacts failed", zap.Error(err))
+			return result, executionError(fmt.Errorf("pre-staging artifacts: %w", err))
+		}
+		l.Info("Stage 2 pre-staging completed successfully, the NOS installation is left for a later run")
+		return result, nil
 	}
 
 	switch onieEnv.BootReason {
 	case "install":
-		if err := runNosInstall(ctx, hc, cfg, si, onieEnv); err != nil {
+		if err := runNosInstall(ctx, hc, watcher, cfg, si, onieEnv, identityPartition); err != nil {
+			if errors.Is(err, ErrRebootPending) {
+				l.Info("Stage 2 interrupted for diagnostics OS boot")
+				return result, nil
+			}
+			if errors.Is(err, stage.ErrInstallCancelled) {
+				l.Warn("NOS installation cancelled", zap.Error(err))
+				rollbackMACAllowlist(cfg, si)
+				return result, executionError(fmt.Errorf("NOS installation: %w", err))
+			}
 			l.Error("NOS installation failure", zap.Error(err))
-			return executionError(fmt.Errorf("NOS installation: %w", err))
+			return result, executionError(fmt.Errorf("NOS installation: %w", err))
 		}
 	case "update":
 		if err := runOnieUpdate(ctx, hc, cfg, si, onieEnv); err != nil {
 			l.Error("ONIE update failure", zap.Error(err))
-			return executionError(fmt.Errorf("NOS installation: %w", err))
+			return result, executionError(fmt.Errorf("NOS installation: %w", err))
 		}
 	default:
 		l.Warn("Unrecognized ONIE boot reason, assuming NOS installation", zap.String("boot_reason", onieEnv.BootReason))
-		if err := runNosInstall(ctx, hc, cfg, si, onieEnv); err != nil {
+		if err := runNosInstall(ctx, hc, watcher, cfg, si, onieEnv, identityPartition); err != nil {
+			if errors.Is(err, ErrRebootPending) {
+				l.Info("Stage 2 interrupted for diagnostics OS boot")
+				return result, nil
+			}
+			if errors.Is(err, stage.ErrInstallCancelled) {
+				l.Warn("NOS installation cancelled", zap.Error(err))
+				rollbackMACAllowlist(cfg, si)
+				return result, executionError(fmt.Errorf("NOS installation: %w", err))
+			}
 			l.Error("NOS installation failure", zap.Error(err))
-			return executionError(fmt.Errorf("NOS installation: %w", err))
+			return result, executionError(fmt.Errorf("NOS installation: %w", err))
 		}
 	}
 
 	// we are done here
 	l.Info("Stage 2 completed successfully")
-	return nil
+	return result, nil
 }
 
-func runNosInstall(ctx context.Context, hc *http.Client, cfg *configstage.Stage2, si *stage.StagingInfo, onie *stage.OnieEnv) (funcErr error) {
-	// Build donwload URL: cfg URL + ONIE platform
-	url, err := stage.BuildURL(cfg.NOSInstallerURL, onie.Platform)
+// checkPathMTU runs a path MTU probe before big downloads if an MTU was configured,
+// and warns if the effective path MTU is lower than configured
+func checkPathMTU(ctx context.Context, url string, mtu int) {
+	info, err := stage.CheckPathMTU(ctx, url, mtu)
 	if err != nil {
-		l.Error("Building NOS installer URL failed", zap.String("url", cfg.NOSInstallerURL), zap.String("platform", onie.Platform), zap.Error(err))
-		return fmt.Errorf("building NOS installer URL: %w", err)
+		l.Warn("Path MTU check failed, large downloads might stall", zap.String("url", url), zap.Int("mtu", mtu), zap.Reflect("pathMTU", info), zap.Error(err))
+		return
+	}
+	if info != nil {
+		l.Info("Path MTU check successful", zap.String("url", url), zap.Int("mtu", mtu), zap.Reflect("pathMTU", info))
+	}
+}
+
+func runNosInstall(ctx context.Context, hc *http.Client, watcher *stage.CancellationWatcher, cfg *configstage.Stage2, si *stage.StagingInfo, onie *stage.OnieEnv, ip identity.IdentityPartition) (funcErr error) {
+	// boot into the diagnostics OS once before we install the NOS if we were asked to
+	if cfg.DiagBoot {
+		if err := runDiagBoot(ctx, ip); err != nil {
+			return err
+		}
+	}
+
+	url, err := nosInstallerURL(cfg, si, onie)
+	if err != nil {
+		return err
+	}
+
+	// artifacts which have been pre-staged are used instead of downloading them again
+	prestaged, err := readPrestageManifest(ip)
+	if err != nil {
+		l.Warn("Reading pre-stage manifest failed, downloading all artifacts", zap.Error(err))
+		prestaged = PrestageManifest{}
+	}
+
+	if err := watcher.Checkpoint(ctx, l, "before-download"); err != nil {
+		return err
+	}
+
+	// the NOS installer and all provisioners are independent of each other, so we download them all concurrently
+	if _, ok := prestaged[nosInstallerName]; !ok {
+		checkPathMTU(ctx, url, si.MTU)
+	}
+	artifacts := []stagedArtifact{
+		{
+			name:    nosInstallerName,
+			url:     url,
+			mirrors: nosInstallerMirrorURLs(cfg, si, onie),
+			timeout: time.Second * 120,
+			// the NOS installer is large and mostly written to flash media, so we skip its zero blocks,
+			// and it is downloaded in chunks which survive flaky management links
+			opts: []stage.DownloadOption{
+				stage.DownloadOptionSparse(discardEnabled(cfg, onie.Platform)),
+				stage.DownloadOptionChunked(cfg.DownloadChunkSize, cfg.DownloadChunkParallelism),
+			},
+		},
+	}
+	if cfg.NOSType == configstage.NOSTypeHedgehogSonic {
+		opts, err := si.ArtifactDownloadOptions()
+		if err != nil {
+			return err
+		}
+		for _, p := range cfg.HedgehogSonicProvisioners {
+			artifacts = append(artifacts, stagedArtifact{
+				name:    p.Name,
+				url:     p.URL,
+				timeout: time.Second * 60,
+				pin:     p.Pin,
+				opts:    opts,
+			})
+		}
 	}
-	url += "/" + si.DeviceID
+	var paths map[string]string
+	if err := stage.Timed("download-artifacts", func() error {
+		dlCtx, cancel := watcher.Context(ctx)
+		defer cancel()
+		var err error
+		paths, err = fetchArtifacts(dlCtx, hc, prestaged, si.StagingDir, cfg.DownloadParallelism, artifacts)
+		return err
+	}); err != nil {
+		// the downloads get interrupted if the installation was cancelled in the meantime
+		if cerr := watcher.Checkpoint(ctx, l, "download"); cerr != nil {
+			return cerr
+		}
+		l.Error("Downloading artifacts failed", zap.Error(err))
+		return fmt.Errorf("artifact download: %w", err)
+	}
+	nosPath := paths[nosInstallerName]
 
-	// NOS download
-	nosPath := filepath.Join(si.StagingDir, "nos-install")
-	l.Info("Downloading NOS installer now...", zap.String("url", url), zap.String("dest", nosPath))
-	if err := stage.DownloadExecutable(ctx, hc, url, nosPath, time.Second*120); err != nil {
-		l.Error("Downloading NOS installer failed", zap.String("url", url), zap.String("dest", nosPath), zap.Error(err))
-		return fmt.Errorf("NOS download: %w", err)
+	// a crashing NOS installer or provisioner should leave a core dump behind in our working directory,
+	// and together with crash reports of our own provisioners it is the best we can get for a post-mortem
+	if cfg.DiagnosticsUploadsURL != "" {
+		if err := stage.EnableCoreDumps(); err != nil {
+			l.Warn("Enabling core dumps failed", zap.Error(err))
+		}
+		defer func() {
+			if funcErr == nil {
+				return
+			}
+			dirs := []string{si.StagingDir}
+			if wd, err := os.Getwd(); err == nil {
+				dirs = append(dirs, wd)
+			}
+			stage.UploadAllDiagnostics(ctx, hc, cfg.DiagnosticsUploadsURL, correlation, stage.DiagnosticFiles(dirs...))
+		}()
 	}
-	l.Info("Downloading NOS installer completed", zap.String("url", url), zap.String("dest", nosPath))
 
 	// for every following error we need to ensure that we make ONIE the default boot option again, because:
 	// - the NOS installation might have worked, but not the agent installation which is still a fatal error
 	// - the NOS installation half-assed, and we don't know what that means
+	// - the installation was cancelled, and the device must come back to ONIE to wait for the next one
 	defer func() {
 		if funcErr != nil {
 			l.Info("Trying to ensure that ONIE stays the default boot option...")
@@ -209,6 +405,21 @@ func runNosInstall(ctx context.Context, hc *http.Client, cfg *configstage.Stage2
 		}
 	}()
 
+	// the NOS installer wipes the existing installation, so we need to back up what we were asked to preserve now
+	if err := stage.Timed("backup-nos-config", func() error { return backupNOSConfig(ip, cfg.PreserveNOSConfig) }); err != nil {
+		l.Error("Backing up NOS configuration failed", zap.Strings("paths", cfg.PreserveNOSConfig), zap.Error(err))
+		return fmt.Errorf("NOS configuration backup: %w", err)
+	}
+
+	// the download can take a while, and the NOS installer is the point of no return
+	if err := stage.VerifyInstallLock(si.InstallSessionID); err != nil {
+		l.Error("Install lock verification failed", zap.Error(err))
+		return err
+	}
+	if err := watcher.Checkpoint(ctx, l, "before-nos-install"); err != nil {
+		return err
+	}
+
 	// NOS install
 	l.Info("Executing NOS installer now...")
 	subctx, cancel := context.WithCancel(ctx)
@@ -217,7 +428,7 @@ func runNosInstall(ctx context.Context, hc *http.Client, cfg *configstage.Stage2
 	nosCmd.Stdin = os.Stdin
 	nosCmd.Stderr = log.NewSinkWithLogger(subctx, l, zapcore.InfoLevel, zap.String("app", "nos-install"), zap.String("stream", "stderr"))
 	nosCmd.Stdout = log.NewSinkWithLogger(subctx, l, zapcore.InfoLevel, zap.String("app", "nos-install"), zap.String("stream", "stdout"))
-	if err := nosCmd.Run(); err != nil {
+	if err := stage.Timed("nos-install", nosCmd.Run); err != nil {
 		l.Error("NOS installer execution failed", zap.String("bin", nosPath), zap.Error(err))
 		cancel()
 		return fmt.Errorf("NOS installer execution: %w", err)
@@ -225,6 +436,18 @@ func runNosInstall(ctx context.Context, hc *http.Client, cfg *configstage.Stage2
 	l.Info("NOS installation completed")
 	cancel()
 
+	// some NOS installers expect their partitions to carry specific GPT attributes
+	if err := applyGPTAttributes(cfg, onie.Platform); err != nil {
+		l.Error("Setting GPT partition attributes failed", zap.Error(err))
+		return fmt.Errorf("GPT partition attributes: %w", err)
+	}
+
+	// the new NOS migrates the preserved configuration on its first boot
+	if err := stage.Timed("restore-nos-config", func() error { return restoreNOSConfig(ip) }); err != nil {
+		l.Error("Restoring NOS configuration failed", zap.Error(err))
+		return fmt.Errorf("NOS configuration restore: %w", err)
+	}
+
 	// if this is Hedgehog SONiC, we are going to run our additional provisioners as well
 	if cfg.NOSType == "hedgehog_sonic" && len(cfg.HedgehogSonicProvisioners) > 0 {
 		// building a list of names for logging
@@ -235,20 +458,14 @@ func runNosInstall(ctx context.Context, hc *http.Client, cfg *configstage.Stage2
 
 		l.Info("Hedgehog SONiC NOS installation detected. Running all additional Hedgehog SONiC Provisioners...", zap.String("nos_type", cfg.NOSType), zap.Strings("provisioners", names))
 		for _, p := range cfg.HedgehogSonicProvisioners {
-			// provisioner download
-			provisionerPath := filepath.Join(si.StagingDir, p.Name)
-			if err := stage.DownloadExecutable(ctx, hc, p.URL, provisionerPath, time.Second*60); err != nil {
-				l.Error("Downloading provisioner failed", zap.String("provisioner", p.Name), zap.String("url", p.URL), zap.String("dest", provisionerPath), zap.Error(err))
-				return fmt.Errorf("provisioner '%s' download: %w", p.Name, err)
-			}
-
-			// provisioner execution
+			// provisioner execution, it was downloaded and verified together with the NOS installer
+			provisionerPath := paths[p.Name]
 			l.Info("Executing provisioner now...", zap.String("provisioner", p.Name))
 			provisionerCmd := exec.CommandContext(ctx, provisionerPath)
 			provisionerCmd.Stdin = os.Stdin
 			provisionerCmd.Stderr = os.Stderr
 			provisionerCmd.Stdout = os.Stdout
-			if err := provisionerCmd.Run(); err != nil {
+			if err := stage.Timed("provisioner-"+p.Name, provisionerCmd.Run); err != nil {
 				l.Error("Provisioner execution failed", zap.String("bin", provisionerPath), zap.Error(err))
 				return fmt.Errorf("provisioner '%s' execution: %w", p.Name, err)
 			}
@@ -256,9 +473,52 @@ func runNosInstall(ctx context.Context, hc *http.Client, cfg *configstage.Stage2
 		}
 		l.Info("Completed execution of all additional Hedgehog SONiC Provisioners", zap.Strings("provisioners", names))
 	}
+
+	// the pre-staged artifacts have served their purpose
+	cleanupPrestaged(ip, prestaged)
+
+	rollbackMACAllowlist(cfg, si)
 	return nil
 }
 
+// rollbackMACAllowlist rolls back the allowlisted MAC addresses if we were asked to,
+// as they are only meant for provisioning
+func rollbackMACAllowlist(cfg *configstage.Stage2, si *stage.StagingInfo) {
+	if !cfg.RollbackMACAllowlist {
+		return
+	}
+	if err := net.NewMACAllowlistManager(si.StagingDir).Rollback(); err != nil {
+		l.Warn("Rolling back allowlisted MAC addresses failed", zap.Error(err))
+	} else {
+		l.Info("Rolled back allowlisted MAC addresses to their original MAC addresses")
+	}
+}
+
+// nosInstallerURL builds the download URL of the NOS installer: cfg URL + ONIE platform + device ID
+func nosInstallerURL(cfg *configstage.Stage2, si *stage.StagingInfo, onie *stage.OnieEnv) (string, error) {
+	url, err := stage.BuildURL(cfg.NOSInstallerURL, onie.Platform)
+	if err != nil {
+		l.Error("Building NOS installer URL failed", zap.String("url", cfg.NOSInstallerURL), zap.String("platform", onie.Platform), zap.Error(err))
+		return "", fmt.Errorf("building NOS installer URL: %w", err)
+	}
+	return url + "/" + si.DeviceID, nil
+}
+
+// nosInstallerMirrorURLs builds the download URLs of the NOS installer for all configured mirrors the same way as
+// `nosInstallerURL`. Mirrors with invalid URLs are skipped.
+func nosInstallerMirrorURLs(cfg *configstage.Stage2, si *stage.StagingInfo, onie *stage.OnieEnv) []string {
+	ret := make([]string, 0, len(cfg.NOSInstallerMirrors))
+	for _, mirror := range cfg.NOSInstallerMirrors {
+		url, err := stage.BuildURL(mirror, onie.Platform)
+		if err != nil {
+			l.Warn("Building NOS installer mirror URL failed, skipping mirror", zap.String("url", mirror), zap.String("platform", onie.Platform), zap.Error(err))
+			continue
+		}
+		ret = append(ret, url+"/"+si.DeviceID)
+	}
+	return ret
+}
+
 func runOnieUpdate(ctx context.Context, hc *http.Client, cfg *configstage.Stage2, si *stage.StagingInfo, onie *stage.OnieEnv) (funcErr error) {
 	// Build donwload URL: cfg URL + ONIE platform
 	url, err := stage.BuildURL(cfg.ONIEUpdaterURL, onie.Platform)
@@ -268,9 +528,12 @@ func runOnieUpdate(ctx context.Context, hc *http.Client, cfg *configstage.Stage2
 	}
 
 	// ONIE download
+	checkPathMTU(ctx, url, si.MTU)
 	onieUpdaterPath := filepath.Join(si.StagingDir, "onie-update")
 	l.Info("Downloading ONIE updater now...", zap.String("url", url), zap.String("dest", onieUpdaterPath))
-	if err := stage.DownloadExecutable(ctx, hc, url, onieUpdaterPath, time.Second*120); err != nil {
+	if err := stage.Timed("download-onie-updater", func() error {
+		return stage.DownloadExecutable(ctx, hc, url, onieUpdaterPath, time.Second*120)
+	}); err != nil {
 		l.Error("Downloading ONIE updater failed", zap.String("url", url), zap.String("dest", onieUpdaterPath), zap.Error(err))
 		return fmt.Errorf("ONIE updater download: %w", err)
 	}
@@ -298,7 +561,7 @@ func runOnieUpdate(ctx context.Context, hc *http.Client, cfg *configstage.Stage2
 	onieCmd.Stdin = os.Stdin
 	onieCmd.Stderr = log.NewSinkWithLogger(subctx, l, zapcore.InfoLevel, zap.String("app", "onie-update"), zap.String("stream", "stderr"))
 	onieCmd.Stdout = log.NewSinkWithLogger(subctx, l, zapcore.InfoLevel, zap.String("app", "onie-update"), zap.String("stream", "stdout"))
-	if err := onieCmd.Run(); err != nil {
+	if err := stage.Timed("onie-update", onieCmd.Run); err != nil {
 		l.Error("ONIE updater execution failed", zap.String("bin", onieUpdaterPath), zap.Error(err))
 		return fmt.Errorf("ONIE updater execution: %w", err)
 	}
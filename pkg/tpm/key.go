@@ -0,0 +1,254 @@
+// Copyright 2023 Hedgehog
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tpm
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"encoding/asn1"
+	"fmt"
+	"io"
+	"math/big"
+
+	"github.com/google/go-tpm/tpm2"
+	"github.com/google/go-tpm/tpm2/transport"
+)
+
+// KeyBlob is an ECDSA P-256 signing key which was created in the TPM. `Private` is wrapped by the storage
+// root key of the TPM and can only be loaded into the TPM which created it. Both fields are the marshalled
+// TPM2B_PUBLIC and TPM2B_PRIVATE structures, which is the same format as the one of tpm2-tools.
+type KeyBlob struct {
+	Public  []byte
+	Private []byte
+}
+
+// srkTemplate is the template of the storage root key under which our keys are being created. It is the ECC SRK
+// template of the TCG provisioning guidance, so the TPM derives the same key from it every time, and it does not
+// need to be persisted in the TPM.
+var srkTemplate = tpm2.ECCSRKTemplate
+
+// ecdsaScheme is the signature scheme of our keys
+var ecdsaScheme = tpm2.TPMTSigScheme{
+	Scheme:  tpm2.TPMAlgECDSA,
+	Details: tpm2.NewTPMUSigScheme(tpm2.TPMAlgECDSA, &tpm2.TPMSSchemeHash{HashAlg: tpm2.TPMAlgSHA256}),
+}
+
+// signingKeyTemplate is the template of our ECDSA P-256 keys, they can never leave the TPM
+var signingKeyTemplate = tpm2.TPMTPublic{
+	Type:    tpm2.TPMAlgECC,
+	NameAlg: tpm2.TPMAlgSHA256,
+	ObjectAttributes: tpm2.TPMAObject{
+		FixedTPM:            true,
+		FixedParent:         true,
+		SensitiveDataOrigin: true,
+		UserWithAuth:        true,
+		NoDA:                true,
+		SignEncrypt:         true,
+	},
+	Parameters: tpm2.NewTPMUPublicParms(tpm2.TPMAlgECC, &tpm2.TPMSECCParms{
+		Scheme: tpm2.TPMTECCScheme{
+			Scheme:  tpm2.TPMAlgECDSA,
+			Details: tpm2.NewTPMUAsymScheme(tpm2.TPMAlgECDSA, &tpm2.TPMSSigSchemeECDSA{HashAlg: tpm2.TPMAlgSHA256}),
+		},
+		CurveID: tpm2.TPMECCNistP256,
+	}),
+	Unique: tpm2.NewTPMUPublicID(tpm2.TPMAlgECC, &tpm2.TPMSECCPoint{}),
+}
+
+// CreateKey creates a new ECDSA P-256 signing key in the TPM, and returns it wrapped by the storage root key
+func CreateKey() (*KeyBlob, error) {
+	var ret *KeyBlob
+	if err := withPrimary(srkTemplate, func(t transport.TPM, primary tpm2.NamedHandle) error {
+		rsp, err := tpm2.Create{
+			ParentHandle: passwordAuth(primary),
+			InPublic:     tpm2.New2B(signingKeyTemplate),
+		}.Execute(t)
+		if err != nil {
+			return fmt.Errorf("tpm: create: %w", err)
+		}
+		ret = &KeyBlob{
+			Public:  tpm2.Marshal(rsp.OutPublic),
+			Private: tpm2.Marshal(rsp.OutPrivate),
+		}
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
+
+// unmarshalBlob unmarshals `b` which must not have any trailing data
+func unmarshalBlob[T tpm2.Marshallable, P interface {
+	*T
+	tpm2.Unmarshallable
+}](b []byte, errInvalid error) (*T, error) {
+	ret, err := tpm2.Unmarshal[T, P](b)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", errInvalid, err)
+	}
+	// go-tpm does not tell how much it consumed, and it is lenient with buffers which are too short
+	switch n := len(tpm2.Marshal(*ret)); {
+	case n > len(b):
+		return nil, errInvalid
+	case n < len(b):
+		return nil, ErrTrailingBlobContent
+	}
+	return ret, nil
+}
+
+// ParsePublic returns the public key of a marshalled TPM2B_PUBLIC structure
+func ParsePublic(b []byte) (*ecdsa.PublicKey, error) {
+	public, err := unmarshalBlob[tpm2.TPM2BPublic](b, ErrInvalidPublicBlob)
+	if err != nil {
+		return nil, err
+	}
+	contents, err := public.Contents()
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidPublicBlob, err)
+	}
+	if contents.Type != tpm2.TPMAlgECC {
+		return nil, ErrUnsupportedKey
+	}
+	params, err := contents.Parameters.ECCDetail()
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidPublicBlob, err)
+	}
+	point, err := contents.Unique.ECC()
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidPublicBlob, err)
+	}
+	if params.CurveID != tpm2.TPMECCNistP256 {
+		return nil, ErrUnsupportedKey
+	}
+	pub, err := tpm2.ECDSAPub(params, point)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrUnsupportedKey, err)
+	}
+	// the point must be on the curve, the conversion to ECDH is the only one left which validates that
+	if _, err := pub.ECDH(); err != nil {
+		return nil, fmt.Errorf("tpm: invalid public key: %w", err)
+	}
+	return pub, nil
+}
+
+// Key is a signing key in the TPM which implements `crypto.Signer`. The key is being loaded into the TPM for
+// every signature, so that no transient objects are being held in the TPM between signatures.
+type Key struct {
+	public  tpm2.TPM2BPublic
+	private tpm2.TPM2BPrivate
+	pub     *ecdsa.PublicKey
+}
+
+var _ crypto.Signer = &Key{}
+
+// LoadKey loads the key `blob` into the TPM once to validate that it belongs to this TPM, and returns a signer
+// for it
+func LoadKey(blob *KeyBlob) (*Key, error) {
+	pub, err := ParsePublic(blob.Public)
+	if err != nil {
+		return nil, err
+	}
+	public, err := unmarshalBlob[tpm2.TPM2BPublic](blob.Public, ErrInvalidPublicBlob)
+	if err != nil {
+		return nil, err
+	}
+	private, err := unmarshalBlob[tpm2.TPM2BPrivate](blob.Private, ErrInvalidPrivateBlob)
+	if err != nil {
+		return nil, err
+	}
+	if len(private.Buffer) == 0 {
+		return nil, ErrInvalidPrivateBlob
+	}
+	k := &Key{
+		public:  *public,
+		private: tpm2.TPM2BPrivate{Buffer: bytes.Clone(private.Buffer)},
+		pub:     pub,
+	}
+	if err := k.withLoadedKey(func(transport.TPM, tpm2.NamedHandle) error { return nil }); err != nil {
+		return nil, err
+	}
+	return k, nil
+}
+
+// withLoadedKey loads the key into the TPM, and calls `f` with its handle
+func (k *Key) withLoadedKey(f func(t transport.TPM, key tpm2.NamedHandle) error) error {
+	return withPrimary(srkTemplate, func(t transport.TPM, primary tpm2.NamedHandle) error {
+		rsp, err := tpm2.Load{
+			ParentHandle: passwordAuth(primary),
+			InPrivate:    k.private,
+			InPublic:     k.public,
+		}.Execute(t)
+		if err != nil {
+			return fmt.Errorf("tpm: load: %w", err)
+		}
+		key := tpm2.NamedHandle{Handle: rsp.ObjectHandle, Name: rsp.Name}
+		defer flush(t, key) //nolint: errcheck
+		return f(t, key)
+	})
+}
+
+// Public implements crypto.Signer
+func (k *Key) Public() crypto.PublicKey {
+	return k.pub
+}
+
+// Sign implements crypto.Signer. It only signs SHA-256 digests, and returns an ASN.1 encoded ECDSA signature
+// like `ecdsa.PrivateKey` does.
+func (k *Key) Sign(_ io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	if opts.HashFunc() != crypto.SHA256 || len(digest) != crypto.SHA256.Size() {
+		return nil, ErrUnsupportedHash
+	}
+	var sig []byte
+	if err := k.withLoadedKey(func(t transport.TPM, key tpm2.NamedHandle) error {
+		rsp, err := tpm2.Sign{
+			KeyHandle: passwordAuth(key),
+			Digest:    tpm2.TPM2BDigest{Buffer: digest},
+			InScheme:  ecdsaScheme,
+			// a NULL ticket, the digest was not computed by the TPM
+			Validation: tpm2.TPMTTKHashCheck{Tag: tpm2.TPMSTHashCheck, Hierarchy: tpm2.TPMRHNull},
+		}.Execute(t)
+		if err != nil {
+			return fmt.Errorf("tpm: sign: %w", err)
+		}
+		sig = encodeSignature(&rsp.Signature)
+		if sig == nil {
+			return fmt.Errorf("%w: sign", ErrUnexpectedResponse)
+		}
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	return sig, nil
+}
+
+// encodeSignature returns an ECDSA TPMT_SIGNATURE ASN.1 encoded. It returns nil if it is not an ECDSA signature.
+func encodeSignature(s *tpm2.TPMTSignature) []byte {
+	if s.SigAlg != tpm2.TPMAlgECDSA {
+		return nil
+	}
+	ecc, err := s.Signature.ECDSA()
+	if err != nil {
+		return nil
+	}
+	sig, err := asn1.Marshal(struct{ R, S *big.Int }{
+		R: new(big.Int).SetBytes(ecc.SignatureR.Buffer),
+		S: new(big.Int).SetBytes(ecc.SignatureS.Buffer),
+	})
+	if err != nil {
+		return nil
+	}
+	return sig
+}
@@ -0,0 +1,207 @@
+// Copyright 2023 Hedgehog
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tpm
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"sort"
+
+	"github.com/google/go-tpm/tpm2"
+	"github.com/google/go-tpm/tpm2/transport"
+)
+
+// DefaultPCRs are the PCRs which are being quoted by default, they hold the measurements of the firmware
+// and of the boot loader up until ONIE
+var DefaultPCRs = []int{0, 1, 2, 3, 4, 5, 6, 7}
+
+const (
+	numPCRs          = 24
+	pcrSelectionSize = numPCRs / 8
+)
+
+var (
+	ErrInvalidPCR          = errors.New("tpm: invalid PCR index")
+	ErrQuoteSignature      = errors.New("tpm: quote signature does not verify")
+	ErrQuoteNotGenerated   = errors.New("tpm: quote was not generated by a TPM")
+	ErrQuoteQualifyingData = errors.New("tpm: quote is for other qualifying data")
+	ErrQuotePCRMismatch    = errors.New("tpm: PCR values do not match the quote")
+)
+
+// Quote is a signed statement of the TPM about the SHA-256 values of a set of PCRs
+type Quote struct {
+	// Attest is the TPMS_ATTEST structure which was signed by the TPM
+	Attest []byte `json:"attest"`
+
+	// Signature is the ASN.1 encoded ECDSA signature over the SHA-256 digest of `Attest`
+	Signature []byte `json:"signature"`
+
+	// PCRs are the SHA-256 values of the quoted PCRs by their index
+	PCRs map[int][]byte `json:"pcrs"`
+}
+
+// pcrSelection returns the selection of `pcrs` of the SHA-256 bank
+func pcrSelection(pcrs []int) (tpm2.TPMLPCRSelection, error) {
+	sel := make([]byte, pcrSelectionSize)
+	for _, pcr := range pcrs {
+		if pcr < 0 || pcr >= numPCRs {
+			return tpm2.TPMLPCRSelection{}, fmt.Errorf("%w: %d", ErrInvalidPCR, pcr)
+		}
+		sel[pcr/8] |= 1 << (pcr % 8)
+	}
+	return tpm2.TPMLPCRSelection{
+		PCRSelections: []tpm2.TPMSPCRSelection{{Hash: tpm2.TPMAlgSHA256, PCRSelect: sel}},
+	}, nil
+}
+
+// selectedPCRs returns the selected PCRs of the SHA-256 bank in ascending order
+func selectedPCRs(s tpm2.TPMLPCRSelection) []int {
+	var ret []int
+	for _, bank := range s.PCRSelections {
+		if bank.Hash != tpm2.TPMAlgSHA256 {
+			continue
+		}
+		for idx, b := range bank.PCRSelect {
+			for bit := 0; bit < 8; bit++ {
+				if b&(1<<bit) != 0 {
+					ret = append(ret, idx*8+bit)
+				}
+			}
+		}
+	}
+	sort.Ints(ret)
+	return ret
+}
+
+// readPCRs reads the SHA-256 values of `pcrs`. The TPM returns only a limited number of values per command,
+// so this keeps reading until it has all of them.
+func readPCRs(t transport.TPM, pcrs []int) (map[int][]byte, error) {
+	ret := make(map[int][]byte, len(pcrs))
+	missing := append([]int(nil), pcrs...)
+	for len(missing) > 0 {
+		sel, err := pcrSelection(missing)
+		if err != nil {
+			return nil, err
+		}
+		rsp, err := tpm2.PCRRead{PCRSelectionIn: sel}.Execute(t)
+		if err != nil {
+			return nil, fmt.Errorf("tpm: PCR read: %w", err)
+		}
+		read := selectedPCRs(rsp.PCRSelectionOut)
+		if len(read) == 0 || len(rsp.PCRValues.Digests) != len(read) {
+			return nil, fmt.Errorf("%w: PCR read", ErrUnexpectedResponse)
+		}
+		for i, pcr := range read {
+			ret[pcr] = bytes.Clone(rsp.PCRValues.Digests[i].Buffer)
+		}
+		var next []int
+		for _, pcr := range missing {
+			if _, ok := ret[pcr]; !ok {
+				next = append(next, pcr)
+			}
+		}
+		missing = next
+	}
+	return ret, nil
+}
+
+// Quote signs the SHA-256 values of `pcrs` together with `qualifyingData` with the key. The key is an ordinary
+// signing key, so the quote proves that the key holder vouches for the PCR values, and that the values were read
+// from the TPM which holds the key.
+func (k *Key) Quote(qualifyingData []byte, pcrs []int) (*Quote, error) {
+	sel, err := pcrSelection(pcrs)
+	if err != nil {
+		return nil, err
+	}
+	var ret *Quote
+	if err := k.withLoadedKey(func(t transport.TPM, key tpm2.NamedHandle) error {
+		rsp, err := tpm2.Quote{
+			SignHandle:     passwordAuth(key),
+			QualifyingData: tpm2.TPM2BData{Buffer: qualifyingData},
+			InScheme:       ecdsaScheme,
+			PCRSelect:      sel,
+		}.Execute(t)
+		if err != nil {
+			return fmt.Errorf("tpm: quote: %w", err)
+		}
+		sig := encodeSignature(&rsp.Signature)
+		if sig == nil {
+			return fmt.Errorf("%w: quote", ErrUnexpectedResponse)
+		}
+		values, err := readPCRs(t, pcrs)
+		if err != nil {
+			return err
+		}
+		ret = &Quote{
+			Attest:    bytes.Clone(rsp.Quoted.Bytes()),
+			Signature: sig,
+			PCRs:      values,
+		}
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
+
+// VerifyQuote verifies that `q` was signed by `pub` for `qualifyingData`, and that its PCR values are the
+// ones which were quoted
+func VerifyQuote(pub crypto.PublicKey, q *Quote, qualifyingData []byte) error {
+	ecPub, ok := pub.(*ecdsa.PublicKey)
+	if !ok {
+		return ErrUnsupportedKey
+	}
+	digest := sha256.Sum256(q.Attest)
+	if !ecdsa.VerifyASN1(ecPub, digest[:], q.Signature) {
+		return ErrQuoteSignature
+	}
+
+	// unmarshalling fails already if the magic value is not the one of the TPM
+	attest, err := tpm2.Unmarshal[tpm2.TPMSAttest](q.Attest)
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrQuoteNotGenerated, err)
+	}
+	if attest.Type != tpm2.TPMSTAttestQuote {
+		return ErrQuoteNotGenerated
+	}
+	info, err := attest.Attested.Quote()
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrQuoteNotGenerated, err)
+	}
+	if !bytes.Equal(attest.ExtraData.Buffer, qualifyingData) {
+		return ErrQuoteQualifyingData
+	}
+
+	pcrs := selectedPCRs(info.PCRSelect)
+	if len(pcrs) != len(q.PCRs) {
+		return ErrQuotePCRMismatch
+	}
+	h := sha256.New()
+	for _, pcr := range pcrs {
+		value, ok := q.PCRs[pcr]
+		if !ok {
+			return ErrQuotePCRMismatch
+		}
+		h.Write(value)
+	}
+	if !bytes.Equal(h.Sum(nil), info.PCRDigest.Buffer) {
+		return ErrQuotePCRMismatch
+	}
+	return nil
+}
@@ -0,0 +1,80 @@
+// Copyright 2023 Hedgehog
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tpm
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+
+	"github.com/google/go-tpm/tpm2"
+	"github.com/google/go-tpm/tpm2/transport"
+)
+
+var ErrLabelTooLong = errors.New("tpm: label too long")
+
+// maxHMACBuffer is the maximum size of the data of a single TPM2_HMAC command, TPM2B_MAX_BUFFER has to hold at
+// least 1024 bytes on every TPM
+const maxHMACBuffer = 1024
+
+// hmacKeyTemplate is the template of a HMAC-SHA256 primary key. Like the storage root key, the TPM derives
+// the same key from it every time from the seed of the owner hierarchy, so it never has to be stored anywhere.
+var hmacKeyTemplate = tpm2.TPMTPublic{
+	Type:    tpm2.TPMAlgKeyedHash,
+	NameAlg: tpm2.TPMAlgSHA256,
+	ObjectAttributes: tpm2.TPMAObject{
+		FixedTPM:            true,
+		FixedParent:         true,
+		SensitiveDataOrigin: true,
+		UserWithAuth:        true,
+		NoDA:                true,
+		SignEncrypt:         true,
+	},
+	Parameters: tpm2.NewTPMUPublicParms(tpm2.TPMAlgKeyedHash, &tpm2.TPMSKeyedHashParms{
+		Scheme: tpm2.TPMTKeyedHashScheme{
+			Scheme:  tpm2.TPMAlgHMAC,
+			Details: tpm2.NewTPMUSchemeKeyedHash(tpm2.TPMAlgHMAC, &tpm2.TPMSSchemeHMAC{HashAlg: tpm2.TPMAlgSHA256}),
+		},
+	}),
+	Unique: tpm2.NewTPMUPublicID(tpm2.TPMAlgKeyedHash, &tpm2.TPM2BDigest{}),
+}
+
+// DeriveSecret derives a 32 byte secret for `label` from the TPM. It is the HMAC-SHA256 of the label with a
+// key which is derived from the seed of the owner hierarchy, so the secret is the same on every call for the
+// same label, but it cannot be computed without this TPM. The secret changes if the TPM is being cleared.
+func DeriveSecret(label []byte) ([]byte, error) {
+	if len(label) > maxHMACBuffer {
+		return nil, fmt.Errorf("%w: %d bytes, at most %d are supported", ErrLabelTooLong, len(label), maxHMACBuffer)
+	}
+	var secret []byte
+	if err := withPrimary(hmacKeyTemplate, func(t transport.TPM, primary tpm2.NamedHandle) error {
+		rsp, err := tpm2.Hmac{
+			Handle:  passwordAuth(primary),
+			Buffer:  tpm2.TPM2BMaxBuffer{Buffer: label},
+			HashAlg: tpm2.TPMAlgSHA256,
+		}.Execute(t)
+		if err != nil {
+			return fmt.Errorf("tpm: hmac: %w", err)
+		}
+		if len(rsp.OutHMAC.Buffer) != 32 {
+			return fmt.Errorf("%w: hmac", ErrUnexpectedResponse)
+		}
+		secret = bytes.Clone(rsp.OutHMAC.Buffer)
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	return secret, nil
+}
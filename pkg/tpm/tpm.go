@@ -14,7 +14,84 @@
 
 package tpm
 
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/google/go-tpm/tpm2"
+	"github.com/google/go-tpm/tpm2/transport"
+	"github.com/google/go-tpm/tpm2/transport/linuxtpm"
+)
+
+// DevicePath is the TPM 2.0 device with the in-kernel resource manager. It flushes all transient objects of
+// a connection when it is closed, so that nothing leaks into the TPM if a command sequence is interrupted.
+const DevicePath = "/dev/tpmrm0"
+
+var (
+	ErrNoTPM               = errors.New("tpm: no TPM 2.0 device")
+	ErrUnexpectedResponse  = errors.New("tpm: unexpected response")
+	ErrUnsupportedKey      = errors.New("tpm: unsupported key, only ECC NIST P-256 keys are supported")
+	ErrUnsupportedHash     = errors.New("tpm: unsupported hash, only SHA-256 digests can be signed")
+	ErrInvalidPublicBlob   = errors.New("tpm: invalid public key blob")
+	ErrInvalidPrivateBlob  = errors.New("tpm: invalid private key blob")
+	ErrTrailingBlobContent = errors.New("tpm: trailing data after key blob")
+)
+
+// openDevice opens the TPM device, it is a variable so that tests can replace the device
+var openDevice = func() (transport.TPMCloser, error) {
+	t, err := linuxtpm.Open(DevicePath)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, ErrNoTPM
+		}
+		return nil, fmt.Errorf("tpm: opening device: %w", err)
+	}
+	return t, nil
+}
+
 // HasTPM answers if the device has a TPM 2.0 device or not
 func HasTPM() bool {
-	return false
+	_, err := os.Stat(DevicePath)
+	return err == nil
+}
+
+// passwordAuth authorizes the use of `h` with an empty password
+func passwordAuth(h tpm2.NamedHandle) tpm2.AuthHandle {
+	return tpm2.AuthHandle{Handle: h.Handle, Name: h.Name, Auth: tpm2.PasswordAuth(nil)}
+}
+
+// createPrimary loads the primary key of `template` of the owner hierarchy into the TPM
+func createPrimary(t transport.TPM, template tpm2.TPMTPublic) (tpm2.NamedHandle, error) {
+	rsp, err := tpm2.CreatePrimary{
+		PrimaryHandle: tpm2.AuthHandle{Handle: tpm2.TPMRHOwner, Auth: tpm2.PasswordAuth(nil)},
+		InPublic:      tpm2.New2B(template),
+	}.Execute(t)
+	if err != nil {
+		return tpm2.NamedHandle{}, fmt.Errorf("tpm: create primary: %w", err)
+	}
+	return tpm2.NamedHandle{Handle: rsp.ObjectHandle, Name: rsp.Name}, nil
+}
+
+// flush removes the transient object `h` from the TPM
+func flush(t transport.TPM, h tpm2.NamedHandle) error {
+	if _, err := (tpm2.FlushContext{FlushHandle: h.Handle}).Execute(t); err != nil {
+		return fmt.Errorf("tpm: flush context: %w", err)
+	}
+	return nil
+}
+
+// withPrimary opens the TPM, loads the primary key of `template` into it, and calls `f` with it
+func withPrimary(template tpm2.TPMTPublic, f func(t transport.TPM, primary tpm2.NamedHandle) error) error {
+	t, err := openDevice()
+	if err != nil {
+		return err
+	}
+	defer t.Close()
+	primary, err := createPrimary(t, template)
+	if err != nil {
+		return err
+	}
+	defer flush(t, primary) //nolint: errcheck
+	return f(t, primary)
 }
@@ -0,0 +1,511 @@
+// Copyright 2023 Hedgehog
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tpm
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"math/big"
+	"testing"
+
+	"github.com/google/go-tpm/tpm2"
+	"github.com/google/go-tpm/tpm2/transport"
+)
+
+// fakeTPM is a TPM device which implements the commands of this package in software. The private key blobs
+// are the plain private keys, which is good enough to test the marshalling of commands and responses.
+type fakeTPM struct {
+	t       *testing.T
+	next    uint32
+	objects map[uint32]*ecdsa.PrivateKey
+	hmac    map[uint32]bool
+	seed    []byte
+	failCC  tpm2.TPMCC
+	closed  bool
+}
+
+func newFakeTPM(t *testing.T) *fakeTPM {
+	return &fakeTPM{t: t, next: 0x80000000, objects: map[uint32]*ecdsa.PrivateKey{}, hmac: map[uint32]bool{}, seed: []byte("owner seed")}
+}
+
+func (f *fakeTPM) Close() error {
+	f.closed = true
+	return nil
+}
+
+// cmdReader decodes the handles and parameters of a command
+type cmdReader struct {
+	t *testing.T
+	b []byte
+}
+
+func (r *cmdReader) bytes(n int) []byte {
+	if n > len(r.b) {
+		r.t.Fatalf("fakeTPM: command too short")
+	}
+	ret := r.b[:n]
+	r.b = r.b[n:]
+	return ret
+}
+
+func (r *cmdReader) uint16() uint16 {
+	return binary.BigEndian.Uint16(r.bytes(2))
+}
+
+func (r *cmdReader) uint32() uint32 {
+	return binary.BigEndian.Uint32(r.bytes(4))
+}
+
+// tpm2b reads a sized buffer
+func (r *cmdReader) tpm2b() []byte {
+	return r.bytes(int(r.uint16()))
+}
+
+// readNext unmarshals the next structure of the command
+func readNext[T tpm2.Marshallable, P interface {
+	*T
+	tpm2.Unmarshallable
+}](r *cmdReader) *T {
+	ret, err := tpm2.Unmarshal[T, P](r.b)
+	if err != nil {
+		r.t.Fatalf("fakeTPM: unmarshalling %T: %v", ret, err)
+	}
+	r.bytes(len(tpm2.Marshal(*ret)))
+	return ret
+}
+
+// emptyCreationData is an empty TPM2B_CREATION_DATA, the empty hash and the ticket of it
+var emptyCreationData = append([]byte{0, 0}, append(
+	tpm2.Marshal(tpm2.TPM2BDigest{}),
+	tpm2.Marshal(tpm2.TPMTTKCreation{Tag: tpm2.TPMSTCreation, Hierarchy: tpm2.TPMRHOwner})...,
+)...)
+
+func (f *fakeTPM) Send(cmd []byte) ([]byte, error) {
+	r := &cmdReader{t: f.t, b: cmd}
+	tag := tpm2.TPMST(r.uint16())
+	size := r.uint32()
+	cc := tpm2.TPMCC(r.uint32())
+	if int(size) != len(cmd) {
+		f.t.Fatalf("fakeTPM: malformed command header %x", cmd)
+	}
+	if cc == f.failCC {
+		return f.respond(false, 0x101, nil), nil
+	}
+
+	var handle uint32
+	if cc != tpm2.TPMCCPCRRead {
+		handle = r.uint32()
+	}
+	if tag == tpm2.TPMSTSessions {
+		r.bytes(int(r.uint32()))
+	}
+	switch cc {
+	case tpm2.TPMCCCreatePrimary:
+		if tpm2.TPMHandle(handle) != tpm2.TPMRHOwner {
+			f.t.Fatalf("fakeTPM: CreatePrimary for hierarchy 0x%x", handle)
+		}
+		r.tpm2b() // inSensitive
+		template := readNext[tpm2.TPM2BPublic](r)
+		h := f.add(nil)
+		if contents, err := template.Contents(); err == nil && contents.Type == tpm2.TPMAlgKeyedHash {
+			f.hmac[h] = true
+		}
+		return f.respond(true, 0, []uint32{h}, tpm2.Marshal(template), emptyCreationData, name(h)), nil
+	case tpm2.TPMCCCreate:
+		f.parent(handle)
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			f.t.Fatal(err)
+		}
+		return f.respond(true, 0, nil,
+			tpm2.Marshal(tpm2.TPM2BPrivate{Buffer: key.D.FillBytes(make([]byte, 32))}),
+			tpm2.Marshal(tpm2.New2B(publicArea(key))),
+			emptyCreationData,
+		), nil
+	case tpm2.TPMCCLoad:
+		f.parent(handle)
+		d := r.tpm2b()
+		key := &ecdsa.PrivateKey{D: new(big.Int).SetBytes(d)}
+		key.Curve = elliptic.P256()
+		key.X, key.Y = elliptic.P256().ScalarBaseMult(d) //nolint: staticcheck
+		h := f.add(key)
+		return f.respond(true, 0, []uint32{h}, name(h)), nil
+	case tpm2.TPMCCSign:
+		key := f.objects[handle]
+		if key == nil {
+			f.t.Fatalf("fakeTPM: Sign with unknown key 0x%x", handle)
+		}
+		return f.respond(true, 0, nil, signature(f.t, key, r.tpm2b())), nil
+	case tpm2.TPMCCQuote:
+		key := f.objects[handle]
+		if key == nil {
+			f.t.Fatalf("fakeTPM: Quote with unknown key 0x%x", handle)
+		}
+		qualifyingData := r.tpm2b()
+		readNext[tpm2.TPMTSigScheme](r)
+		sel := readNext[tpm2.TPMLPCRSelection](r)
+		h := sha256.New()
+		for _, pcr := range selectedPCRs(*sel) {
+			h.Write(fakePCR(pcr))
+		}
+		attest := tpm2.Marshal(tpm2.TPMSAttest{
+			Magic:           tpm2.TPMGeneratedValue,
+			Type:            tpm2.TPMSTAttestQuote,
+			QualifiedSigner: tpm2.TPM2BName{Buffer: []byte("signer")},
+			ExtraData:       tpm2.TPM2BData{Buffer: qualifyingData},
+			Attested: tpm2.NewTPMUAttest(tpm2.TPMSTAttestQuote, &tpm2.TPMSQuoteInfo{
+				PCRSelect: *sel,
+				PCRDigest: tpm2.TPM2BDigest{Buffer: h.Sum(nil)},
+			}),
+		})
+		digest := sha256.Sum256(attest)
+		return f.respond(true, 0, nil, tpm2.Marshal(tpm2.TPM2BData{Buffer: attest}), signature(f.t, key, digest[:])), nil
+	case tpm2.TPMCCPCRRead:
+		// real TPMs return at most 8 values, this one returns even less to test reading them in batches
+		pcrs := selectedPCRs(*readNext[tpm2.TPMLPCRSelection](r))
+		if len(pcrs) > 3 {
+			pcrs = pcrs[:3]
+		}
+		sel, err := pcrSelection(pcrs)
+		if err != nil {
+			f.t.Fatal(err)
+		}
+		values := tpm2.TPMLDigest{}
+		for _, pcr := range pcrs {
+			values.Digests = append(values.Digests, tpm2.TPM2BDigest{Buffer: fakePCR(pcr)})
+		}
+		return f.respond(false, 0, nil, binary.BigEndian.AppendUint32(nil, 42), tpm2.Marshal(sel), tpm2.Marshal(values)), nil
+	case tpm2.TPMCCHMAC:
+		if !f.hmac[handle] {
+			f.t.Fatalf("fakeTPM: HMAC with unknown key 0x%x", handle)
+		}
+		mac := hmac.New(sha256.New, f.seed)
+		mac.Write(r.tpm2b())
+		return f.respond(true, 0, nil, tpm2.Marshal(tpm2.TPM2BDigest{Buffer: mac.Sum(nil)})), nil
+	case tpm2.TPMCCFlushContext:
+		if _, ok := f.objects[handle]; !ok {
+			f.t.Fatalf("fakeTPM: flushing unknown handle 0x%x", handle)
+		}
+		delete(f.objects, handle)
+		delete(f.hmac, handle)
+		return f.respond(false, 0, nil), nil
+	default:
+		f.t.Fatalf("fakeTPM: unexpected command 0x%x", cc)
+	}
+	return nil, nil
+}
+
+func fakePCR(pcr int) []byte {
+	v := sha256.Sum256([]byte{byte(pcr)})
+	return v[:]
+}
+
+// name is the marshalled name of an object, the fake only needs it to be unique
+func name(h uint32) []byte {
+	n := sha256.Sum256(binary.BigEndian.AppendUint32(nil, h))
+	return tpm2.Marshal(tpm2.TPM2BName{Buffer: append([]byte{0x00, 0x0b}, n[:]...)})
+}
+
+// signature returns the marshalled TPMT_SIGNATURE of `digest`
+func signature(t *testing.T, key *ecdsa.PrivateKey, digest []byte) []byte {
+	sigR, sigS, err := ecdsa.Sign(rand.Reader, key, digest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tpm2.Marshal(tpm2.TPMTSignature{
+		SigAlg: tpm2.TPMAlgECDSA,
+		Signature: tpm2.NewTPMUSignature(tpm2.TPMAlgECDSA, &tpm2.TPMSSignatureECC{
+			Hash:       tpm2.TPMAlgSHA256,
+			SignatureR: tpm2.TPM2BECCParameter{Buffer: sigR.Bytes()},
+			SignatureS: tpm2.TPM2BECCParameter{Buffer: sigS.Bytes()},
+		}),
+	})
+}
+
+func (f *fakeTPM) add(key *ecdsa.PrivateKey) uint32 {
+	f.next++
+	f.objects[f.next] = key
+	return f.next
+}
+
+func (f *fakeTPM) parent(h uint32) {
+	if key, ok := f.objects[h]; !ok || key != nil {
+		f.t.Fatalf("fakeTPM: 0x%x is not a primary key", h)
+	}
+}
+
+func (f *fakeTPM) respond(sessions bool, code uint32, handles []uint32, params ...[]byte) []byte {
+	var body bytes.Buffer
+	for _, h := range handles {
+		body.Write(binary.BigEndian.AppendUint32(nil, h))
+	}
+	tag := tpm2.TPMSTNoSessions
+	if sessions && code == 0 {
+		tag = tpm2.TPMSTSessions
+		body.Write(binary.BigEndian.AppendUint32(nil, uint32(len(bytes.Join(params, nil)))))
+	}
+	for _, p := range params {
+		body.Write(p)
+	}
+	if tag == tpm2.TPMSTSessions {
+		// the response of the password session: nonce, attributes, hmac
+		body.Write([]byte{0x00, 0x00, 0x01, 0x00, 0x00})
+	}
+	ret := binary.BigEndian.AppendUint16(nil, uint16(tag))
+	ret = binary.BigEndian.AppendUint32(ret, uint32(10+body.Len()))
+	ret = binary.BigEndian.AppendUint32(ret, code)
+	return append(ret, body.Bytes()...)
+}
+
+func publicArea(key *ecdsa.PrivateKey) tpm2.TPMTPublic {
+	ret := signingKeyTemplate
+	ret.Unique = tpm2.NewTPMUPublicID(tpm2.TPMAlgECC, &tpm2.TPMSECCPoint{
+		X: tpm2.TPM2BECCParameter{Buffer: key.X.Bytes()},
+		Y: tpm2.TPM2BECCParameter{Buffer: key.Y.Bytes()},
+	})
+	return ret
+}
+
+func useFakeTPM(t *testing.T) *fakeTPM {
+	f := newFakeTPM(t)
+	old := openDevice
+	openDevice = func() (transport.TPMCloser, error) { return f, nil }
+	t.Cleanup(func() { openDevice = old })
+	return f
+}
+
+func TestKey(t *testing.T) {
+	f := useFakeTPM(t)
+
+	blob, err := CreateKey()
+	if err != nil {
+		t.Fatalf("CreateKey() error = %v", err)
+	}
+	if len(f.objects) != 0 || !f.closed {
+		t.Fatalf("CreateKey() left %d objects in the TPM", len(f.objects))
+	}
+	key, err := LoadKey(blob)
+	if err != nil {
+		t.Fatalf("LoadKey() error = %v", err)
+	}
+
+	digest := sha256.Sum256([]byte("hello"))
+	sig, err := key.Sign(rand.Reader, digest[:], crypto.SHA256)
+	if err != nil {
+		t.Fatalf("Sign() error = %v", err)
+	}
+	if !ecdsa.VerifyASN1(key.Public().(*ecdsa.PublicKey), digest[:], sig) {
+		t.Errorf("Sign() signature does not verify with the public key")
+	}
+	if len(f.objects) != 0 {
+		t.Errorf("Sign() left %d objects in the TPM", len(f.objects))
+	}
+
+	if _, err := key.Sign(rand.Reader, digest[:], crypto.SHA384); !errors.Is(err, ErrUnsupportedHash) {
+		t.Errorf("Sign() error = %v, want %v", err, ErrUnsupportedHash)
+	}
+
+	// errors of the TPM are being passed on
+	f.failCC = tpm2.TPMCCLoad
+	if _, err := LoadKey(blob); !errors.Is(err, tpm2.TPMRCFailure) {
+		t.Errorf("LoadKey() error = %v, want %v", err, tpm2.TPMRCFailure)
+	}
+	if len(f.objects) != 0 {
+		t.Errorf("LoadKey() left %d objects in the TPM after an error", len(f.objects))
+	}
+}
+
+func TestQuote(t *testing.T) {
+	f := useFakeTPM(t)
+	blob, err := CreateKey()
+	if err != nil {
+		t.Fatalf("CreateKey() error = %v", err)
+	}
+	key, err := LoadKey(blob)
+	if err != nil {
+		t.Fatalf("LoadKey() error = %v", err)
+	}
+	nonce := []byte("nonce")
+	q, err := key.Quote(nonce, DefaultPCRs)
+	if err != nil {
+		t.Fatalf("Quote() error = %v", err)
+	}
+	if len(q.PCRs) != len(DefaultPCRs) || len(f.objects) != 0 {
+		t.Fatalf("Quote() = %d PCRs with %d objects left in the TPM, want %d PCRs", len(q.PCRs), len(f.objects), len(DefaultPCRs))
+	}
+	if _, err := key.Quote(nonce, []int{24}); !errors.Is(err, ErrInvalidPCR) {
+		t.Errorf("Quote() error = %v, want %v", err, ErrInvalidPCR)
+	}
+
+	other, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tampered := &Quote{Attest: q.Attest, Signature: q.Signature, PCRs: map[int][]byte{}}
+	for pcr, v := range q.PCRs {
+		tampered.PCRs[pcr] = v
+	}
+	tampered.PCRs[7] = fakePCR(8)
+
+	tests := []struct {
+		name           string
+		pub            crypto.PublicKey
+		quote          *Quote
+		qualifyingData []byte
+		wantErrToBe    error
+	}{
+		{
+			name:           "valid",
+			pub:            key.Public(),
+			quote:          q,
+			qualifyingData: nonce,
+		},
+		{
+			name:           "other key",
+			pub:            &other.PublicKey,
+			quote:          q,
+			qualifyingData: nonce,
+			wantErrToBe:    ErrQuoteSignature,
+		},
+		{
+			name:           "other qualifying data",
+			pub:            key.Public(),
+			quote:          q,
+			qualifyingData: []byte("replayed"),
+			wantErrToBe:    ErrQuoteQualifyingData,
+		},
+		{
+			name:           "tampered PCR value",
+			pub:            key.Public(),
+			quote:          tampered,
+			qualifyingData: nonce,
+			wantErrToBe:    ErrQuotePCRMismatch,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := VerifyQuote(tt.pub, tt.quote, tt.qualifyingData); !errors.Is(err, tt.wantErrToBe) {
+				t.Errorf("VerifyQuote() error = %v, wantErrToBe %v", err, tt.wantErrToBe)
+			}
+		})
+	}
+}
+
+func TestLoadKey_invalid(t *testing.T) {
+	useFakeTPM(t)
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	public := tpm2.Marshal(tpm2.New2B(publicArea(key)))
+	offCurve := bytes.Clone(public)
+	offCurve[len(offCurve)-1] ^= 0xff
+
+	tests := []struct {
+		name        string
+		blob        *KeyBlob
+		wantErrToBe error
+	}{
+		{
+			name:        "empty public",
+			blob:        &KeyBlob{Private: []byte{0, 1, 1}},
+			wantErrToBe: ErrInvalidPublicBlob,
+		},
+		{
+			name:        "trailing data",
+			blob:        &KeyBlob{Public: append(bytes.Clone(public), 0), Private: []byte{0, 1, 1}},
+			wantErrToBe: ErrTrailingBlobContent,
+		},
+		{
+			name: "not on curve",
+			blob: &KeyBlob{Public: offCurve, Private: []byte{0, 1, 1}},
+		},
+		{
+			name:        "empty private",
+			blob:        &KeyBlob{Public: public, Private: []byte{0, 0}},
+			wantErrToBe: ErrInvalidPrivateBlob,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := LoadKey(tt.blob)
+			if err == nil {
+				t.Fatalf("LoadKey() error = nil")
+			}
+			if tt.wantErrToBe != nil && !errors.Is(err, tt.wantErrToBe) {
+				t.Errorf("LoadKey() error = %v, wantErrToBe %v", err, tt.wantErrToBe)
+			}
+		})
+	}
+}
+
+func TestCreateKey_noTPM(t *testing.T) {
+	old := openDevice
+	openDevice = func() (transport.TPMCloser, error) { return nil, ErrNoTPM }
+	defer func() { openDevice = old }()
+	if _, err := CreateKey(); !errors.Is(err, ErrNoTPM) {
+		t.Errorf("CreateKey() error = %v, want %v", err, ErrNoTPM)
+	}
+}
+
+func TestDeriveSecret(t *testing.T) {
+	f := useFakeTPM(t)
+
+	secret, err := DeriveSecret([]byte("label"))
+	if err != nil {
+		t.Fatalf("DeriveSecret() error = %v", err)
+	}
+	mac := hmac.New(sha256.New, f.seed)
+	mac.Write([]byte("label"))
+	if want := mac.Sum(nil); !bytes.Equal(secret, want) {
+		t.Errorf("DeriveSecret() = %x, want %x", secret, want)
+	}
+	again, err := DeriveSecret([]byte("label"))
+	if err != nil {
+		t.Fatalf("DeriveSecret() error = %v", err)
+	}
+	if !bytes.Equal(secret, again) {
+		t.Errorf("DeriveSecret() is not deterministic: %x != %x", secret, again)
+	}
+	other, err := DeriveSecret([]byte("other label"))
+	if err != nil {
+		t.Fatalf("DeriveSecret() error = %v", err)
+	}
+	if bytes.Equal(secret, other) {
+		t.Errorf("DeriveSecret() returned the same secret for different labels")
+	}
+	if len(f.objects) != 0 {
+		t.Errorf("DeriveSecret() leaked %d objects in the TPM", len(f.objects))
+	}
+	if !f.closed {
+		t.Errorf("DeriveSecret() did not close the TPM")
+	}
+
+	if _, err := DeriveSecret(make([]byte, maxHMACBuffer+1)); !errors.Is(err, ErrLabelTooLong) {
+		t.Errorf("DeriveSecret() error = %v, want %v", err, ErrLabelTooLong)
+	}
+
+	f.failCC = tpm2.TPMCCHMAC
+	if _, err := DeriveSecret([]byte("label")); !errors.Is(err, tpm2.TPMRCFailure) {
+		t.Errorf("DeriveSecret() error = %v, want %v", err, tpm2.TPMRCFailure)
+	}
+}
@@ -0,0 +1,113 @@
+// Copyright 2023 Hedgehog
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package version
+
+import (
+	"runtime"
+	"runtime/debug"
+)
+
+// The following variables carry the build provenance of a binary. Just like `Version` they should
+// be overwritten at compile time with go linker flags. If `Commit` is not set, it is taken from the
+// VCS information which the go toolchain embeds into the binary if it is available.
+var (
+	// Commit is the source commit which the binary was built from
+	Commit string
+
+	// Builder identifies the system or CI job which built the binary
+	Builder string
+
+	// BuildFlags are the relevant flags which were used to build the binary
+	BuildFlags string
+
+	// SBOM is a reference (usually a URL or OCI reference) to the SBOM of the binary
+	SBOM string
+)
+
+// Provenance is the build provenance of a DAS BOOT binary
+type Provenance struct {
+	Version    string `json:"version"`
+	Commit     string `json:"commit,omitempty"`
+	Modified   bool   `json:"modified,omitempty"`
+	Builder    string `json:"builder,omitempty"`
+	BuildFlags string `json:"build_flags,omitempty"`
+	SBOM       string `json:"sbom,omitempty"`
+	GoVersion  string `json:"go_version"`
+	Platform   string `json:"platform"`
+}
+
+// ArtifactProvenance is the provenance of an artifact as it is being served by the seeder
+type ArtifactProvenance struct {
+	// Artifact is the name of the artifact
+	Artifact string `json:"artifact"`
+
+	// Digest is the digest of the artifact as it is stored in the artifacts provider
+	// in the form `sha256:<hex>`. Stages get served this artifact with an embedded
+	// configuration appended to it, so this is the digest of the first `Size` bytes.
+	Digest string `json:"digest"`
+
+	// Size is the size of the artifact as it is stored in the artifacts provider
+	Size int64 `json:"size"`
+
+	// Build is the build provenance of the artifact if it is known
+	Build *Provenance `json:"build,omitempty"`
+
+	// ManifestVersion is the version of the signed digest manifest which the seeder verified the artifact
+	// against. It is empty if the artifact was not verified against a manifest.
+	ManifestVersion string `json:"manifest_version,omitempty"`
+}
+
+// ArtifactPin pins the content of an artifact which a stage is going to download and execute.
+// Pins are computed by the seeder and embedded in the signed configuration of the previous stage,
+// which makes the whole chain of stages content addressed.
+type ArtifactPin struct {
+	// Digest is the digest of the artifact as it is stored in the artifacts provider in the form
+	// `sha256:<hex>`. Just like for `ArtifactProvenance` this is the digest of the first `Size` bytes.
+	Digest string `json:"digest" yaml:"digest"`
+
+	// Size is the size of the artifact as it is stored in the artifacts provider
+	Size int64 `json:"size" yaml:"size"`
+}
+
+var readBuildInfo = debug.ReadBuildInfo
+
+// GetProvenance returns the build provenance of the running binary
+func GetProvenance() *Provenance {
+	ret := &Provenance{
+		Version:    Version,
+		Commit:     Commit,
+		Builder:    Builder,
+		BuildFlags: BuildFlags,
+		SBOM:       SBOM,
+		GoVersion:  runtime.Version(),
+		Platform:   runtime.GOOS + "/" + runtime.GOARCH,
+	}
+	if ret.Commit != "" {
+		return ret
+	}
+	bi, ok := readBuildInfo()
+	if !ok {
+		return ret
+	}
+	for _, setting := range bi.Settings {
+		switch setting.Key {
+		case "vcs.revision":
+			ret.Commit = setting.Value
+		case "vcs.modified":
+			ret.Modified = setting.Value == "true"
+		}
+	}
+	return ret
+}
@@ -0,0 +1,69 @@
+// Copyright 2023 Hedgehog
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package version
+
+import (
+	"reflect"
+	"runtime"
+	"runtime/debug"
+	"testing"
+)
+
+func TestGetProvenance(t *testing.T) {
+	platform := runtime.GOOS + "/" + runtime.GOARCH
+	tests := []struct {
+		name      string
+		commit    string
+		buildInfo *debug.BuildInfo
+		want      *Provenance
+	}{
+		{
+			name:   "commit from linker flags",
+			commit: "abc",
+			buildInfo: &debug.BuildInfo{Settings: []debug.BuildSetting{
+				{Key: "vcs.revision", Value: "def"},
+				{Key: "vcs.modified", Value: "true"},
+			}},
+			want: &Provenance{Version: "dev", Commit: "abc", GoVersion: runtime.Version(), Platform: platform},
+		},
+		{
+			name: "commit from build info",
+			buildInfo: &debug.BuildInfo{Settings: []debug.BuildSetting{
+				{Key: "vcs.revision", Value: "def"},
+				{Key: "vcs.modified", Value: "true"},
+			}},
+			want: &Provenance{Version: "dev", Commit: "def", Modified: true, GoVersion: runtime.Version(), Platform: platform},
+		},
+		{
+			name: "no build info",
+			want: &Provenance{Version: "dev", GoVersion: runtime.Version(), Platform: platform},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			oldCommit, oldReadBuildInfo := Commit, readBuildInfo
+			defer func() {
+				Commit, readBuildInfo = oldCommit, oldReadBuildInfo
+			}()
+			Commit = tt.commit
+			readBuildInfo = func() (*debug.BuildInfo, bool) {
+				return tt.buildInfo, tt.buildInfo != nil
+			}
+			if got := GetProvenance(); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("GetProvenance() = %#v, want %#v", got, tt.want)
+			}
+		})
+	}
+}
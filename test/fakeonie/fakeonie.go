@@ -0,0 +1,233 @@
+// Copyright 2023 Hedgehog
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package fakeonie fabricates a consistent ONIE environment for unit tests and local development. It provides
+// the `onie_*` environment variables, a machine.conf, and fake `onie-*` executables on the PATH, so that all
+// code paths which branch on the ONIE environment can be covered deterministically outside of ONIE.
+package fakeonie
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// MachineConfEnv is the environment variable which overrides the path of the ONIE machine.conf. It matches
+// `stage.EnvNameMachineConf`, and is repeated here so that the packages which `stage` depends on can use this
+// package in their unit tests as well.
+const MachineConfEnv = "dasboot_onie_machine_conf"
+
+const (
+	machineConfName = "machine.conf"
+	binDirName      = "bin"
+	callsName       = "calls"
+)
+
+// Env describes the ONIE environment which gets fabricated
+type Env struct {
+	BootReason    string
+	ExecURL       string
+	Platform      string
+	VendorID      string
+	SerialNum     string
+	EthAddr       string
+	Version       string
+	Machine       string
+	MachineRev    string
+	Arch          string
+	BuildDate     string
+	PartitionType string
+	Firmware      string
+	SwitchAsic    string
+}
+
+// Default returns the ONIE environment of a virtual x86_64 switch which was booted into the ONIE installer
+func Default() *Env {
+	return &Env{
+		BootReason:    "install",
+		ExecURL:       "http://[fe80::4638:39ff:fe00:1%25eth0]/onie-installer-x86_64",
+		Platform:      "x86_64-kvm_x86_64-r0",
+		VendorID:      "42623",
+		SerialNum:     "XYZ123004",
+		EthAddr:       "0c:20:12:fe:00:00",
+		Version:       "2023.05.0",
+		Machine:       "kvm_x86_64",
+		MachineRev:    "0",
+		Arch:          "x86_64",
+		BuildDate:     "2023-05-11T16:40+00:00",
+		PartitionType: "gpt",
+		Firmware:      "uefi",
+		SwitchAsic:    "qemu",
+	}
+}
+
+// Environ returns the environment variables which ONIE sets for installers
+func (e *Env) Environ() map[string]string {
+	return map[string]string{
+		"onie_boot_reason": e.BootReason,
+		"onie_exec_url":    e.ExecURL,
+		"onie_platform":    e.Platform,
+		"onie_vendor_id":   e.VendorID,
+		"onie_serial_num":  e.SerialNum,
+		"onie_eth_addr":    e.EthAddr,
+	}
+}
+
+// MachineConf returns the contents of the machine.conf as ONIE writes it
+func (e *Env) MachineConf() []byte {
+	var sb strings.Builder
+	for _, kv := range [][2]string{
+		{"onie_version", e.Version},
+		{"onie_vendor_id", e.VendorID},
+		{"onie_platform", e.Platform},
+		{"onie_machine", e.Machine},
+		{"onie_machine_rev", e.MachineRev},
+		{"onie_arch", e.Arch},
+		{"onie_build_date", e.BuildDate},
+		{"onie_partition_type", e.PartitionType},
+		{"onie_firmware", e.Firmware},
+		{"onie_switch_asic", e.SwitchAsic},
+	} {
+		fmt.Fprintf(&sb, "%s=%s\n", kv[0], kv[1])
+	}
+	return []byte(sb.String())
+}
+
+// sysinfoScript mimics the options of onie-sysinfo
+func (e *Env) sysinfoScript() string {
+	return fmt.Sprintf(`case "$1" in
+-s) echo %q ;;
+-e) echo %q ;;
+-p) echo %q ;;
+-v) echo %q ;;
+-i) echo %q ;;
+-m) echo %q ;;
+-r) echo %q ;;
+-c) echo %q ;;
+-t) echo %q ;;
+-P) echo %q ;;
+-f) echo %q ;;
+-S) echo %q ;;
+*) echo "onie-sysinfo: unsupported option '$1'" 1>&2; exit 1 ;;
+esac
+`, e.SerialNum, e.EthAddr, e.Platform, e.Version, e.VendorID, e.Machine, e.MachineRev, e.Arch, e.BuildDate, e.PartitionType, e.Firmware, e.SwitchAsic)
+}
+
+// syseepromScript mimics reading TLVs with onie-syseeprom
+func (e *Env) syseepromScript() string {
+	return fmt.Sprintf(`if [ "$1" != "-g" ]; then
+  echo "onie-syseeprom: unsupported option '$1'" 1>&2; exit 1
+fi
+case "$2" in
+0x21) echo %q ;;
+0x23) echo %q ;;
+0x24) echo %q ;;
+*) echo "onie-syseeprom: TLV $2 not found" 1>&2; exit 1 ;;
+esac
+`, e.Machine, e.SerialNum, e.EthAddr)
+}
+
+// Installation is a fabricated ONIE environment on disk
+type Installation struct {
+	Env             *Env
+	Dir             string
+	BinDir          string
+	MachineConfPath string
+}
+
+// Install writes the machine.conf and the fake `onie-*` executables of `e` into `dir`. Executables which
+// only change the state of ONIE record their invocations, see `Calls`.
+func (e *Env) Install(dir string) (*Installation, error) {
+	ret := &Installation{
+		Env:             e,
+		Dir:             dir,
+		BinDir:          filepath.Join(dir, binDirName),
+		MachineConfPath: filepath.Join(dir, machineConfName),
+	}
+	if err := os.MkdirAll(ret.BinDir, 0755); err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(ret.MachineConfPath, e.MachineConf(), 0644); err != nil {
+		return nil, err
+	}
+
+	record := fmt.Sprintf("echo \"$(basename \"$0\") $*\" >> %q\n", filepath.Join(dir, callsName))
+	scripts := map[string]string{
+		"onie-sysinfo":        e.sysinfoScript(),
+		"onie-syseeprom":      e.syseepromScript(),
+		"onie-discovery-stop": record,
+		"onie-boot-mode":      record,
+		"onie-stop":           record,
+	}
+	for name, script := range scripts {
+		if err := os.WriteFile(filepath.Join(ret.BinDir, name), []byte("#!/bin/sh\n"+script), 0755); err != nil { //nolint: gosec
+			return nil, err
+		}
+	}
+	return ret, nil
+}
+
+// Environ returns all environment variables which need to be set for the fabricated ONIE environment to be
+// effective: the ONIE variables, the machine.conf override, and the PATH with the fake executables first
+func (i *Installation) Environ() []string {
+	env := i.Env.Environ()
+	env[MachineConfEnv] = i.MachineConfPath
+	env["PATH"] = i.BinDir + string(os.PathListSeparator) + os.Getenv("PATH")
+	ret := make([]string, 0, len(env))
+	for k, v := range env {
+		ret = append(ret, k+"="+v)
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+// Calls returns the invocations of the fake executables which change the state of ONIE in the order in which
+// they happened, e.g. "onie-boot-mode -o rescue"
+func (i *Installation) Calls() ([]string, error) {
+	f, err := os.Open(filepath.Join(i.Dir, callsName))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	defer f.Close()
+	var ret []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		ret = append(ret, strings.TrimSpace(scanner.Text()))
+	}
+	return ret, scanner.Err()
+}
+
+// Setup fabricates the ONIE environment `e` for the duration of the test `t`. Passing a nil `e` uses `Default()`.
+func Setup(t testing.TB, e *Env) *Installation {
+	t.Helper()
+	if e == nil {
+		e = Default()
+	}
+	i, err := e.Install(t.TempDir())
+	if err != nil {
+		t.Fatalf("fakeonie: installing ONIE environment: %v", err)
+	}
+	for _, kv := range i.Environ() {
+		k, v, _ := strings.Cut(kv, "=")
+		t.Setenv(k, v)
+	}
+	return i
+}
@@ -24,6 +24,7 @@ import (
 	"go.githedgehog.com/dasboot/pkg/log"
 	"go.githedgehog.com/dasboot/pkg/partitions"
 	"go.githedgehog.com/dasboot/pkg/version"
+	"go.githedgehog.com/dasboot/test/integration/result"
 	"go.uber.org/zap"
 	"go.uber.org/zap/zapcore"
 
@@ -41,14 +42,19 @@ func main() {
 		Description:          "Should be running in ONIE, and will find the ONIE partition and remove any unknown partitions and create a Hedgehog Identity partition and format it",
 		Version:              version.Version,
 		EnableBashCompletion: true,
-		Flags: []cli.Flag{
+		Flags: append(result.Flags(),
 			&cli.BoolFlag{
 				Name:        "acknowledge-danger",
 				Destination: &acknowledgeDanger,
 				Usage:       "acknowledge that this is a dangerous operation",
 				Required:    true,
 			},
-		},
+			&cli.StringFlag{
+				Name:  "multipath-policy",
+				Usage: "how to treat dm-multipath devices during discovery: prefer, exclude or ignore",
+				Value: string(partitions.DefaultMultipathPolicy),
+			},
+		),
 		Action: func(ctx *cli.Context) error {
 			// prevent a hooman from doing something stupid
 			if !acknowledgeDanger {
@@ -56,7 +62,9 @@ func main() {
 			}
 
 			// run the test
-			return integDisk(ctx)
+			return result.Run(ctx, func(r *result.Result) error {
+				return integDisk(ctx, r)
+			})
 		},
 	}
 
@@ -64,42 +72,78 @@ func main() {
 	log.ReplaceGlobals(l)
 
 	if err := app.Run(os.Args); err != nil {
-		l.Fatal("integ-disk failed", zap.Error(err))
+		l.Error("integ-disk failed", zap.Error(err))
+		os.Exit(result.ExitCode(err))
 	}
 }
 
-func integDisk(_ *cli.Context) error {
+func integDisk(ctx *cli.Context, r *result.Result) error {
+	var devs partitions.Devices
+	var hhip *partitions.Device
+
+	policy, err := partitions.ParseMultipathPolicy(ctx.String("multipath-policy"))
+	if err != nil {
+		return err
+	}
+	partitions.SetMultipathPolicy(policy)
+
 	// discover disks/partitions first
 	l.Info("1. Initial disks/partitions discovery...")
-	devs := partitions.Discover()
-	if len(devs) == 0 {
-		return fmt.Errorf("initial partition discovery failed: no devices discovered")
+	if err := r.Step("discover", func(s *result.Step) error {
+		devs = partitions.Discover()
+		s.Measure("devices", len(devs))
+		if len(devs) == 0 {
+			return fmt.Errorf("initial partition discovery failed: no devices discovered")
+		}
+		return nil
+	}); err != nil {
+		return err
 	}
 
 	// cleanup any partitions which should not be there
 	l.Info("2. Deleting any partitions which should not be present...")
-	if err := devs.DeletePartitions(os.Getenv("onie_platform")); err != nil {
-		return fmt.Errorf("failed to delete partitions: %w", err)
+	if err := r.Step("delete-partitions", func(_ *result.Step) error {
+		if err := devs.DeletePartitions(os.Getenv("onie_platform")); err != nil {
+			return fmt.Errorf("failed to delete partitions: %w", err)
+		}
+		return nil
+	}); err != nil {
+		return err
 	}
 
 	// rediscover disks/partitions after deletions
 	l.Info("3. Rediscovering disks/partitions after potential partition deletions...")
-	devs = partitions.Discover()
-	if len(devs) == 0 {
-		return fmt.Errorf("partition rediscovery after deleting partitions failed: no devices discovered")
+	if err := r.Step("rediscover-after-delete", func(s *result.Step) error {
+		devs = partitions.Discover()
+		s.Measure("devices", len(devs))
+		if len(devs) == 0 {
+			return fmt.Errorf("partition rediscovery after deleting partitions failed: no devices discovered")
+		}
+		return nil
+	}); err != nil {
+		return err
 	}
+
 	// check partitions are as expected
 	l.Info("4. Check partitions are as expected after initial discovery...")
-	if err := checkPartitions(devs, false); err != nil {
-		return fmt.Errorf("checking partions failed: %w", err)
+	if err := r.Step("check-partitions", func(_ *result.Step) error {
+		if err := checkPartitions(devs, false); err != nil {
+			return fmt.Errorf("checking partions failed: %w", err)
+		}
+		return nil
+	}); err != nil {
+		return err
 	}
 
 	// now create identity partition if it is not present yet
 	l.Info("5. Ensuring Hedgehog Identity Partition exists...")
-	hhip := devs.GetHedgehogIdentityPartition()
-	if hhip != nil {
-		l.Info("5.1 Hedgehog Identity Partition already exists")
-	} else {
+	if err := r.Step("ensure-identity-partition", func(s *result.Step) error {
+		hhip = devs.GetHedgehogIdentityPartition()
+		s.Measure("created", hhip == nil)
+		if hhip != nil {
+			l.Info("5.1 Hedgehog Identity Partition already exists")
+			return nil
+		}
 		l.Info("5.1 Hedgehog Identity Partition needs to be created...")
 		if err := devs.CreateHedgehogIdentityPartition(os.Getenv("onie_platform")); err != nil {
 			return fmt.Errorf("creating Hedgehog Identity Partition failed: %w", err)
@@ -118,26 +162,47 @@ func integDisk(_ *cli.Context) error {
 		if hhip == nil {
 			return fmt.Errorf("Hedgehog Identity Partition missing after rediscovery for creating partition")
 		}
+		return nil
+	}); err != nil {
+		return err
 	}
 
 	// creating filesystem on it
 	l.Info("6. Ensuring filesystem is correct on Hedgehog Identity Partition and creating it if necessary...")
-	if err := hhip.MakeFilesystemForHedgehogIdentityPartition(false); err != nil && !errors.Is(err, partitions.ErrFilesystemAlreadyCreated) {
-		return fmt.Errorf("ensuring filesystem for Hedgehog Identity Partition failed: %w", err)
+	if err := r.Step("ensure-identity-filesystem", func(s *result.Step) error {
+		err := hhip.MakeFilesystemForHedgehogIdentityPartition(false)
+		s.Measure("created", err == nil)
+		if err != nil && !errors.Is(err, partitions.ErrFilesystemAlreadyCreated) {
+			return fmt.Errorf("ensuring filesystem for Hedgehog Identity Partition failed: %w", err)
+		}
+		return nil
+	}); err != nil {
+		return err
 	}
 
 	// rediscover disks/partitions after creating filesystem
 	// NOTE: we wouldn't really need to do this step anymore, however, this is to probe the discovery mechanism again
 	l.Info("7. Rediscovering disks/partitions after making filesystem for Hedgehog Identity Partition...")
-	devs = partitions.Discover()
-	if len(devs) == 0 {
-		return fmt.Errorf("partition rediscovery after creating Hedgehog Identity Partition failed: no devices discovered")
+	if err := r.Step("rediscover-after-filesystem", func(s *result.Step) error {
+		devs = partitions.Discover()
+		s.Measure("devices", len(devs))
+		if len(devs) == 0 {
+			return fmt.Errorf("partition rediscovery after creating Hedgehog Identity Partition failed: no devices discovered")
+		}
+		return nil
+	}); err != nil {
+		return err
 	}
 
 	// check partitions are as expected again, this time identity partition must exist
 	l.Info("8. Check partitions again after deleting/creating partitions and filesystems...")
-	if err := checkPartitions(devs, true); err != nil {
-		return fmt.Errorf("checking partions failed: %w", err)
+	if err := r.Step("check-partitions-with-identity", func(_ *result.Step) error {
+		if err := checkPartitions(devs, true); err != nil {
+			return fmt.Errorf("checking partions failed: %w", err)
+		}
+		return nil
+	}); err != nil {
+		return err
 	}
 
 	// print device/disk information
@@ -146,8 +211,15 @@ func integDisk(_ *cli.Context) error {
 
 	// last but not least, mount Hedgehog Identity partition
 	l.Info("10. Mounting Hedgehog Identity Partition", zap.String("source", hhip.Path), zap.String("target", partitions.MountPathHedgehogIdentity))
-	if err := hhip.Mount(); err != nil && !errors.Is(err, partitions.ErrAlreadyMounted) {
-		return fmt.Errorf("mounting of Hedgehog Identity Partition failed: %w", err)
+	if err := r.Step("mount-identity-partition", func(s *result.Step) error {
+		s.Measure("source", hhip.Path)
+		s.Measure("target", partitions.MountPathHedgehogIdentity)
+		if err := hhip.Mount(); err != nil && !errors.Is(err, partitions.ErrAlreadyMounted) {
+			return fmt.Errorf("mounting of Hedgehog Identity Partition failed: %w", err)
+		}
+		return nil
+	}); err != nil {
+		return err
 	}
 
 	// c'est fini
@@ -168,8 +240,10 @@ func checkPartitions(devs partitions.Devices, mustHaveIdentity bool) error {
 			logDevs(devs)
 			return fmt.Errorf("EFI partition missing")
 		}
-		partn := efiPart.GetPartitionNumber()
-		if partn != 1 {
+		partn, err := efiPart.GetPartitionNumber()
+		if err != nil {
+			l.Warn("EFI partition number could not be determined", zap.Error(err))
+		} else if partn != 1 {
 			l.Warn("EFI partition number is not (1) as it usually should be", zap.Int("partn", partn))
 		}
 		numParts += 1
@@ -181,8 +255,10 @@ func checkPartitions(devs partitions.Devices, mustHaveIdentity bool) error {
 			logDevs(devs)
 			return fmt.Errorf("ONIE partition missing")
 		}
-		partn = oniePart.GetPartitionNumber()
-		if partn != 2 && partn != 3 {
+		partn, err = oniePart.GetPartitionNumber()
+		if err != nil {
+			l.Warn("ONIE partition number could not be determined", zap.Error(err))
+		} else if partn != 2 && partn != 3 {
 			l.Warn("ONIE partition number is not (2) (or (3)) as it usually should be", zap.Int("partn", partn))
 		}
 		numParts += 1
@@ -191,8 +267,10 @@ func checkPartitions(devs partitions.Devices, mustHaveIdentity bool) error {
 		if diagPart == nil {
 			l.Debug("no Diag partition found")
 		} else {
-			partn = diagPart.GetPartitionNumber()
-			if partn != 3 && partn != 2 {
+			partn, err = diagPart.GetPartitionNumber()
+			if err != nil {
+				l.Warn("Diag partition number could not be determined", zap.Error(err))
+			} else if partn != 3 && partn != 2 {
 				l.Warn("Diag partition number is not (3) (or (2)) as it usually should be", zap.Int("partn", partn))
 			}
 			numParts += 1
@@ -207,15 +285,17 @@ func checkPartitions(devs partitions.Devices, mustHaveIdentity bool) error {
 		} else if hhidPart == nil {
 			l.Debug("no Hedgehog Identity partion found")
 		} else {
-			partn = hhidPart.GetPartitionNumber()
-			if partn != 3 && partn != 4 {
+			partn, err = hhidPart.GetPartitionNumber()
+			if err != nil {
+				l.Warn("Hedgehog Identity Partition number could not be determined", zap.Error(err))
+			} else if partn != 3 && partn != 4 {
 				l.Warn("Hedgehog Identity Partion number is not (3) (or (4)) as it usually should be", zap.Int("partn", partn))
 			}
 
 			// we'll check other things now as well
 			// all except partition name which might not be updated in sysfs, and filesystem which will be ext2 instead of ext4 for the time being
 			if hhidPart.GPTPartType != partitions.GPTPartTypeHedgehogIdentity {
-				l.Error("Hedgehog Identity Partition does not have expected GPT partition type GUID", zap.String("got", hhidPart.GPTPartType), zap.String("want", partitions.GPTPartTypeHedgehogIdentity))
+				l.Error("Hedgehog Identity Partition does not have expected GPT partition type GUID", zap.Stringer("got", hhidPart.GPTPartType), zap.Stringer("want", partitions.GPTPartTypeHedgehogIdentity))
 				return fmt.Errorf("unexpected GPT partition type for Hedgehog Identity partition")
 			}
 			if hhidPart.FSLabel != partitions.FSLabelHedgehogIdentity && mustHaveIdentity {
@@ -266,14 +346,18 @@ func logDevs(devs partitions.Devices) {
 			continue
 		}
 		if dev.IsPartition() {
+			partn, err := dev.GetPartitionNumber()
+			if err != nil {
+				l.Debug("GetPartitionNumber failed", zap.String("devname", devname), zap.Error(err))
+			}
 			l.Info(
 				"partition",
 				zap.String("devname", devname),
 				zap.Uint32("major", major),
 				zap.Uint32("minor", minor),
 				zap.String("partname", dev.GetPartitionName()),
-				zap.Int("partn", dev.GetPartitionNumber()),
-				zap.String("gpt_parttype", dev.GPTPartType),
+				zap.Int("partn", partn),
+				zap.Stringer("gpt_parttype", dev.GPTPartType),
 				zap.String("filesystem", dev.Filesystem),
 				zap.String("fs_label", dev.FSLabel),
 				zap.Bool("is_efi", dev.IsEFIPartition()),
@@ -0,0 +1,225 @@
+// Copyright 2023 Hedgehog
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.githedgehog.com/dasboot/pkg/log"
+	"go.githedgehog.com/dasboot/pkg/partitions"
+	"go.githedgehog.com/dasboot/pkg/version"
+	"go.githedgehog.com/dasboot/test/integration/result"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+
+	"github.com/urfave/cli/v2"
+)
+
+var l = log.L()
+
+// the files which the writer stores with every generation, they mirror the location files of the identity partition
+var files = []string{"/location/uuid", "/location/uuid.sig", "/location/metadata", "/location/metadata.sig"}
+
+func main() {
+	app := &cli.App{
+		Name:                 "integ-identity-atomic",
+		Usage:                "integration test for crash-consistent writes to the identity partition",
+		UsageText:            "integ-identity-atomic --iterations 20",
+		Description:          "Creates an ext4 filesystem on a loop device, and repeatedly kills a process which is writing files atomically to it. After every kill the filesystem is remounted, and all files must hold a complete generation.",
+		Version:              version.Version,
+		EnableBashCompletion: true,
+		Flags: append(result.Flags(),
+			&cli.IntFlag{
+				Name:  "iterations",
+				Usage: "number of times the writer gets killed",
+				Value: 20,
+			},
+			&cli.StringFlag{
+				Name:   "writer",
+				Usage:  "internal: write generations to the filesystem mounted at this path until killed",
+				Hidden: true,
+			},
+		),
+		Action: func(ctx *cli.Context) error {
+			if mnt := ctx.String("writer"); mnt != "" {
+				return writer(mnt)
+			}
+			return result.Run(ctx, func(r *result.Result) error {
+				return integIdentityAtomic(ctx, r)
+			})
+		},
+	}
+
+	l = log.NewZapWrappedLogger(zap.Must(log.NewSerialConsole(zapcore.DebugLevel, "console", true)))
+	log.ReplaceGlobals(l)
+
+	if err := app.Run(os.Args); err != nil {
+		l.Error("integ-identity-atomic failed", zap.Error(err))
+		os.Exit(result.ExitCode(err))
+	}
+}
+
+func content(name string, gen int) []byte {
+	// large enough so that a non-atomic write would be visible as a partial file
+	return bytes.Repeat([]byte(fmt.Sprintf("%s:%d\n", name, gen)), 4096)
+}
+
+func writer(mnt string) error {
+	fsys := partitions.NewFS(mnt)
+	for gen := 1; ; gen++ {
+		fs := make([]partitions.File, 0, len(files))
+		for _, name := range files {
+			fs = append(fs, partitions.File{Name: name, Data: content(name, gen)})
+		}
+		if err := partitions.WriteFilesAtomic(fsys, 0644, fs...); err != nil {
+			return err
+		}
+	}
+}
+
+func run(name string, args ...string) (string, error) {
+	out, err := exec.Command(name, args...).CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("%s %s: %w: %s", name, strings.Join(args, " "), err, string(out))
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+// verify ensures that every file holds exactly one complete generation
+func verify(mnt string) (int, error) {
+	maxGen := 0
+	for _, name := range files {
+		b, err := os.ReadFile(filepath.Join(mnt, name))
+		if err != nil {
+			return 0, err
+		}
+		line, _, _ := bytes.Cut(b, []byte("\n"))
+		_, genStr, ok := strings.Cut(string(line), ":")
+		if !ok {
+			return 0, fmt.Errorf("file '%s' does not contain a generation", name)
+		}
+		gen, err := strconv.Atoi(genStr)
+		if err != nil {
+			return 0, fmt.Errorf("file '%s': %w", name, err)
+		}
+		if !bytes.Equal(b, content(name, gen)) {
+			return 0, fmt.Errorf("file '%s' is partially written (generation %d, %d bytes)", name, gen, len(b))
+		}
+		if gen > maxGen {
+			maxGen = gen
+		}
+	}
+	return maxGen, nil
+}
+
+func integIdentityAtomic(ctx *cli.Context, r *result.Result) error {
+	dir, err := os.MkdirTemp("", "integ-identity-atomic-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+	img := filepath.Join(dir, "identity.img")
+	mnt := filepath.Join(dir, "mnt")
+
+	var loopDev string
+	l.Info("1. Creating loop device with an ext4 filesystem...")
+	if err := r.Step("create-loop-device", func(s *result.Step) error {
+		if err := os.Mkdir(mnt, 0755); err != nil {
+			return err
+		}
+		if err := os.WriteFile(img, nil, 0644); err != nil {
+			return err
+		}
+		if err := os.Truncate(img, 32*1024*1024); err != nil {
+			return err
+		}
+		var err error
+		loopDev, err = run("losetup", "--find", "--show", img)
+		if err != nil {
+			return err
+		}
+		s.Measure("device", loopDev)
+		_, err = run("mkfs.ext4", "-q", "-L", partitions.FSLabelHedgehogIdentity, loopDev)
+		return err
+	}); err != nil {
+		return err
+	}
+	defer run("losetup", "--detach", loopDev) //nolint: errcheck
+
+	l.Info("2. Writing initial generation...")
+	if err := r.Step("initial-write", func(_ *result.Step) error {
+		if _, err := run("mount", loopDev, mnt); err != nil {
+			return err
+		}
+		defer run("umount", mnt) //nolint: errcheck
+		if err := os.Mkdir(filepath.Join(mnt, "location"), 0755); err != nil {
+			return err
+		}
+		fs := make([]partitions.File, 0, len(files))
+		for _, name := range files {
+			fs = append(fs, partitions.File{Name: name, Data: content(name, 0)})
+		}
+		return partitions.WriteFilesAtomic(partitions.NewFS(mnt), 0644, fs...)
+	}); err != nil {
+		return err
+	}
+
+	self, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	iterations := ctx.Int("iterations")
+	l.Info("3. Killing the writer and verifying the files after remounting...", zap.Int("iterations", iterations))
+	for i := 0; i < iterations; i++ {
+		if err := r.Step(fmt.Sprintf("kill-and-verify-%d", i), func(s *result.Step) error {
+			if _, err := run("mount", loopDev, mnt); err != nil {
+				return err
+			}
+			cmd := exec.Command(self, "--writer", mnt)
+			if err := cmd.Start(); err != nil {
+				run("umount", mnt) //nolint: errcheck
+				return err
+			}
+			time.Sleep(time.Duration(10+rand.Intn(200)) * time.Millisecond) //nolint: gosec
+			if err := cmd.Process.Kill(); err != nil {
+				return err
+			}
+			cmd.Wait() //nolint: errcheck
+			if _, err := run("umount", mnt); err != nil {
+				return err
+			}
+			if _, err := run("mount", loopDev, mnt); err != nil {
+				return err
+			}
+			defer run("umount", mnt) //nolint: errcheck
+			gen, err := verify(mnt)
+			s.Measure("generation", gen)
+			return err
+		}); err != nil {
+			return err
+		}
+	}
+
+	l.Info("SUCCESS")
+	return nil
+}
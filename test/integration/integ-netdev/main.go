@@ -22,6 +22,7 @@ import (
 	"go.githedgehog.com/dasboot/pkg/log"
 	dbnet "go.githedgehog.com/dasboot/pkg/net"
 	"go.githedgehog.com/dasboot/pkg/version"
+	"go.githedgehog.com/dasboot/test/integration/result"
 
 	"github.com/urfave/cli/v2"
 	"go.uber.org/zap"
@@ -38,6 +39,21 @@ func main() {
 		Description:          "Should be running in ONIE, and will try to add/delete a vlan and IP address to/from a network device",
 		Version:              version.Version,
 		EnableBashCompletion: true,
+		Flags: append(result.Flags(),
+			&cli.StringFlag{
+				Name:  "netns",
+				Usage: "run inside of the named network namespace instead of the host namespace. It gets created together with a veth pair if it does not exist yet",
+			},
+			&cli.StringFlag{
+				Name:  "netns-device",
+				Usage: "name of the veth device which stands in for the network device inside of a newly created network namespace",
+				Value: "eth0",
+			},
+			&cli.BoolFlag{
+				Name:  "netns-delete",
+				Usage: "delete the network namespace once the command has finished",
+			},
+		),
 		Commands: []*cli.Command{
 			{
 				Name:  "add",
@@ -76,6 +92,11 @@ func main() {
 						Usage: "Set flags like onlink for the route",
 						Value: 0,
 					},
+					&cli.IntFlag{
+						Name:  "mtu",
+						Usage: "MTU of the VLAN interface, 0 leaves the default",
+						Value: 0,
+					},
 					&cli.StringFlag{
 						Name:    "device",
 						Aliases: []string{"dev"},
@@ -85,7 +106,11 @@ func main() {
 				},
 				Action: func(ctx *cli.Context) error {
 					// run the test
-					return integNetdevAdd(ctx)
+					return result.Run(ctx, func(r *result.Result) error {
+						return inNetns(ctx, r, func() error {
+							return integNetdevAdd(ctx, r)
+						})
+					})
 				},
 			},
 			{
@@ -125,7 +150,66 @@ func main() {
 				},
 				Action: func(ctx *cli.Context) error {
 					// run the test
-					return integNetdevDelete(ctx)
+					return result.Run(ctx, func(r *result.Result) error {
+						return inNetns(ctx, r, func() error {
+							return integNetdevDelete(ctx, r)
+						})
+					})
+				},
+			},
+			{
+				Name:  "reconcile",
+				Usage: "leaves a configured vlan interface behind like a crashed run would, and ensures that it gets cleaned up",
+				Flags: []cli.Flag{
+					&cli.UintFlag{
+						Name:  "vid",
+						Usage: "VLAN ID / VID",
+						Value: 42,
+					},
+					&cli.StringFlag{
+						Name:  "vlan-name",
+						Usage: "VLAN interface name",
+						Value: "mgmt",
+					},
+					&cli.StringSliceFlag{
+						Name:  "ip-address",
+						Usage: "IP addresses with their netmask CIDR",
+						Value: cli.NewStringSlice("192.168.42.101/24"),
+					},
+					&cli.StringFlag{
+						Name:    "device",
+						Aliases: []string{"dev"},
+						Usage:   "parent network device to which to add the VLAN",
+						Value:   "eth0",
+					},
+				},
+				Action: func(ctx *cli.Context) error {
+					// run the test
+					return result.Run(ctx, func(r *result.Result) error {
+						return inNetns(ctx, r, func() error {
+							return integNetdevReconcile(ctx, r)
+						})
+					})
+				},
+			},
+			{
+				Name:  "probe-mtu",
+				Usage: "probes the path MTU towards a destination",
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:    "address",
+						Aliases: []string{"addr"},
+						Usage:   "destination address in host:port notation",
+						Value:   "192.168.42.1:443",
+					},
+				},
+				Action: func(ctx *cli.Context) error {
+					// run the test
+					return result.Run(ctx, func(r *result.Result) error {
+						return inNetns(ctx, r, func() error {
+							return integNetdevProbeMTU(ctx, r)
+						})
+					})
 				},
 			},
 		},
@@ -135,11 +219,56 @@ func main() {
 	log.ReplaceGlobals(l)
 
 	if err := app.Run(os.Args); err != nil {
-		l.Fatal("integ-netdev failed", zap.Error(err), zap.String("errType", fmt.Sprintf("%T", err)))
+		l.Error("integ-netdev failed", zap.Error(err), zap.String("errType", fmt.Sprintf("%T", err)))
+		os.Exit(result.ExitCode(err))
 	}
 }
 
-func integNetdevAdd(ctx *cli.Context) error {
+// inNetns runs `f` inside of the network namespace as given with the "--netns" flag, or in the
+// host namespace if it is not set. This allows to exercise the add/delete paths in CI without
+// touching any of the real interfaces of the host.
+func inNetns(ctx *cli.Context, r *result.Result, f func() error) error {
+	name := ctx.String("netns")
+	if name == "" {
+		return f()
+	}
+
+	var ns *dbnet.Namespace
+	if err := r.Step("setup-netns", func(s *result.Step) error {
+		s.Measure("netns", name)
+		var err error
+		ns, err = dbnet.OpenNamespace(name, ctx.String("netns-device"))
+		if err == nil {
+			s.Measure("created", false)
+			return nil
+		}
+		l.Info("Creating network namespace...", zap.String("netns", name), zap.String("device", ctx.String("netns-device")))
+		ns, err = dbnet.NewNamespace(name, ctx.String("netns-device"))
+		if err != nil {
+			return fmt.Errorf("creating network namespace failed: %w", err)
+		}
+		s.Measure("created", true)
+		s.Measure("device", ns.Device)
+		s.Measure("peer", ns.Peer)
+		return nil
+	}); err != nil {
+		return err
+	}
+	defer func() {
+		if ctx.Bool("netns-delete") {
+			l.Info("Deleting network namespace...", zap.String("netns", name))
+			if err := ns.Delete(); err != nil {
+				l.Error("Deleting network namespace failed", zap.String("netns", name), zap.Error(err))
+			}
+			return
+		}
+		ns.Close() //nolint: errcheck
+	}()
+
+	return ns.Do(f)
+}
+
+func integNetdevAdd(ctx *cli.Context, r *result.Result) error {
 	vid := uint16(ctx.Uint("vid"))
 	dev := ctx.String("device")
 	vlanName := ctx.String("vlan-name")
@@ -199,15 +328,26 @@ func integNetdevAdd(ctx *cli.Context) error {
 		zap.Uint16("vid", vid),
 		zap.String("vlanName", vlanName),
 		zap.Reflect("ipnets", ipnets),
+		zap.Int("mtu", ctx.Int("mtu")),
 	)
-	if err := dbnet.AddVLANDeviceWithIP(dev, vid, vlanName, ipnets, routes); err != nil {
-		return fmt.Errorf("adding VLAN and address failed: %w", err)
+	if err := r.Step("add-vlan-device", func(s *result.Step) error {
+		s.Measure("device", dev)
+		s.Measure("vid", vid)
+		s.Measure("vlan_name", vlanName)
+		s.Measure("ip_addresses", ipaddrs)
+		s.Measure("routes", len(routes))
+		if err := dbnet.AddVLANDeviceWithIP(dev, vid, vlanName, ctx.Int("mtu"), ipnets, routes); err != nil {
+			return fmt.Errorf("adding VLAN and address failed: %w", err)
+		}
+		return nil
+	}); err != nil {
+		return err
 	}
 	l.Info("Success")
 	return nil
 }
 
-func integNetdevDelete(ctx *cli.Context) error {
+func integNetdevDelete(ctx *cli.Context, r *result.Result) error {
 	dev := ctx.String("device")
 
 	l.Info("Parsing IP and netmasks from input...")
@@ -260,9 +400,103 @@ func integNetdevDelete(ctx *cli.Context) error {
 		}
 	}
 
-	if err := dbnet.DeleteVLANDevice(dev, ipnets, routes); err != nil {
-		return fmt.Errorf("deleting VLAN interface failed: %w", err)
+	if err := r.Step("delete-vlan-device", func(s *result.Step) error {
+		s.Measure("device", dev)
+		s.Measure("ip_addresses", ipaddrs)
+		s.Measure("routes", len(routes))
+		if err := dbnet.DeleteVLANDevice(dev, ipnets, routes); err != nil {
+			return fmt.Errorf("deleting VLAN interface failed: %w", err)
+		}
+		return nil
+	}); err != nil {
+		return err
 	}
 	l.Info("Success")
 	return nil
 }
+
+func integNetdevReconcile(ctx *cli.Context, r *result.Result) error {
+	vid := uint16(ctx.Uint("vid"))
+	dev := ctx.String("device")
+	vlanName := ctx.String("vlan-name")
+
+	l.Info("Parsing IP and netmasks from input...")
+	ipaddrs := ctx.StringSlice("ip-address")
+	ipnets, err := dbnet.StringsToIPNets(ipaddrs)
+	if err != nil {
+		return fmt.Errorf("failed to parse IP addresses and netmask: %w", err)
+	}
+
+	// this is what a crashed installer leaves behind: a configured VLAN interface which never got deleted
+	l.Info("Creating stale VLAN interface...", zap.String("device", dev), zap.Uint16("vid", vid), zap.String("vlanName", vlanName))
+	if err := r.Step("create-stale-state", func(s *result.Step) error {
+		s.Measure("device", dev)
+		s.Measure("vid", vid)
+		s.Measure("vlan_name", vlanName)
+		s.Measure("ip_addresses", ipaddrs)
+		if err := dbnet.AddVLANDeviceWithIP(dev, vid, vlanName, 0, ipnets, nil); err != nil {
+			return fmt.Errorf("adding VLAN and address failed: %w", err)
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	l.Info("Reconciling network state...")
+	if err := r.Step("reconcile-network-state", func(s *result.Step) error {
+		stale, err := dbnet.ReconcileNetworkState(dev, vid, vlanName, ipnets)
+		if err != nil {
+			return fmt.Errorf("reconciling network state failed: %w", err)
+		}
+		s.Measure("deleted_devices", stale.DeletedDevices)
+		s.Measure("removed_addresses", stale.RemovedAddresses)
+		for _, name := range stale.DeletedDevices {
+			if name == vlanName {
+				return nil
+			}
+		}
+		return fmt.Errorf("stale VLAN interface '%s' was not deleted", vlanName)
+	}); err != nil {
+		return err
+	}
+
+	if err := r.Step("verify-clean", func(s *result.Step) error {
+		ifaces, err := dbnet.GetInterfaces()
+		if err != nil {
+			return fmt.Errorf("listing interfaces failed: %w", err)
+		}
+		s.Measure("interfaces", ifaces)
+		for _, iface := range ifaces {
+			if iface == vlanName {
+				return fmt.Errorf("VLAN interface '%s' still exists", vlanName)
+			}
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+	l.Info("Success")
+	return nil
+}
+
+func integNetdevProbeMTU(ctx *cli.Context, r *result.Result) error {
+	addr := ctx.String("address")
+	l.Info("Probing path MTU...", zap.String("address", addr))
+	var info *dbnet.PathMTUInfo
+	if err := r.Step("probe-mtu", func(s *result.Step) error {
+		s.Measure("address", addr)
+		var err error
+		info, err = dbnet.ProbePathMTU(ctx.Context, addr)
+		if err != nil {
+			return fmt.Errorf("probing path MTU failed: %w", err)
+		}
+		s.Measure("interface", info.Interface)
+		s.Measure("interface_mtu", info.InterfaceMTU)
+		s.Measure("path_mtu", info.PathMTU)
+		return nil
+	}); err != nil {
+		return err
+	}
+	l.Info("Success", zap.String("interface", info.Interface), zap.Int("interfaceMTU", info.InterfaceMTU), zap.Int("pathMTU", info.PathMTU))
+	return nil
+}
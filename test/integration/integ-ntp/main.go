@@ -17,10 +17,12 @@ package main
 import (
 	"fmt"
 	"os"
+	"time"
 
 	"go.githedgehog.com/dasboot/pkg/log"
 	"go.githedgehog.com/dasboot/pkg/ntp"
 	"go.githedgehog.com/dasboot/pkg/version"
+	"go.githedgehog.com/dasboot/test/integration/result"
 	"go.uber.org/zap"
 
 	"github.com/urfave/cli/v2"
@@ -36,29 +38,55 @@ func main() {
 		Description:          "Should be running in ONIE, needs networking configured, and should run with an unsynchronized system clock for good comparisons after a run",
 		Version:              version.Version,
 		EnableBashCompletion: true,
-		Flags: []cli.Flag{
+		Flags: append(result.Flags(),
 			&cli.StringSliceFlag{
 				Name:  "server",
 				Usage: "NTP server IP addresses or hostnames or FQDNs",
 				Value: cli.NewStringSlice("192.168.42.1"),
 			},
-		},
+			&cli.DurationFlag{
+				Name:  "max-offset",
+				Usage: "maximum acceptable clock offset before a confirmation round is required (0 disables the check)",
+			},
+		),
 		Action: func(ctx *cli.Context) error {
 			// run the test
-			return integNTP(ctx)
+			return result.Run(ctx, func(r *result.Result) error {
+				return integNTP(ctx, r)
+			})
 		},
 	}
 
 	if err := app.Run(os.Args); err != nil {
-		l.Fatal("integ-ntp failed", zap.Error(err), zap.String("errType", fmt.Sprintf("%T", err)))
+		l.Error("integ-ntp failed", zap.Error(err), zap.String("errType", fmt.Sprintf("%T", err)))
+		os.Exit(result.ExitCode(err))
 	}
 }
 
-func integNTP(ctx *cli.Context) error {
+func integNTP(ctx *cli.Context, r *result.Result) error {
 	servers := ctx.StringSlice("server")
 
 	l.Info("Trying to query NTP servers, and updating the system clock if successful", zap.Strings("servers", servers))
-	if err := ntp.SyncClock(ctx.Context, servers); err != nil {
+	if err := r.Step("sync-clock", func(s *result.Step) error {
+		s.Measure("servers", servers)
+		before := time.Now()
+		s.Measure("max_offset", ctx.Duration("max-offset").String())
+		res, err := ntp.SyncClock(ctx.Context, servers, ntp.SyncOptionMaxOffset(ctx.Duration("max-offset")))
+		if res != nil {
+			s.Measure("server", res.Server)
+			s.Measure("offset", res.Offset.String())
+			s.Measure("delay", res.Delay.String())
+			s.Measure("stratum", res.Stratum)
+			s.Measure("root_distance", res.RootDistance.String())
+			s.Measure("confirmed", res.Confirmed)
+		}
+		if err != nil {
+			return err
+		}
+		// the system clock was just set, so this is the clock adjustment plus the query time
+		s.Measure("clock_adjustment", time.Since(before).String())
+		return nil
+	}); err != nil {
 		return err
 	}
 
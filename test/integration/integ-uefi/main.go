@@ -21,6 +21,7 @@ import (
 	"go.githedgehog.com/dasboot/pkg/log"
 	"go.githedgehog.com/dasboot/pkg/partitions"
 	"go.githedgehog.com/dasboot/pkg/version"
+	"go.githedgehog.com/dasboot/test/integration/result"
 	"go.uber.org/zap"
 	"go.uber.org/zap/zapcore"
 
@@ -32,20 +33,20 @@ var l = log.L()
 func main() {
 	var acknowledgeDanger bool
 	app := &cli.App{
-		Name:                 "integ-disk",
-		Usage:                "integration test for disk partitioning and formating",
-		UsageText:            "integ-disk --acknowledge-danger",
-		Description:          "Should be running in ONIE, and will find the ONIE partition and remove any unknown partitions and create a Hedgehog Identity partition and format it",
+		Name:                 "integ-uefi",
+		Usage:                "integration test for UEFI boot entries",
+		UsageText:            "integ-uefi --acknowledge-danger",
+		Description:          "Should be running in ONIE, and will make ONIE the default boot entry and remove any unknown boot entries",
 		Version:              version.Version,
 		EnableBashCompletion: true,
-		Flags: []cli.Flag{
+		Flags: append(result.Flags(),
 			&cli.BoolFlag{
 				Name:        "acknowledge-danger",
 				Destination: &acknowledgeDanger,
 				Usage:       "acknowledge that this is a dangerous operation",
 				Required:    true,
 			},
-		},
+		),
 		Action: func(ctx *cli.Context) error {
 			// prevent a hooman from doing something stupid
 			if !acknowledgeDanger {
@@ -53,7 +54,9 @@ func main() {
 			}
 
 			// run the test
-			return integUefi(ctx)
+			return result.Run(ctx, func(r *result.Result) error {
+				return integUefi(ctx, r)
+			})
 		},
 	}
 
@@ -61,13 +64,16 @@ func main() {
 	log.ReplaceGlobals(l)
 
 	if err := app.Run(os.Args); err != nil {
-		l.Fatal("integ-disk failed", zap.Error(err))
+		l.Error("integ-uefi failed", zap.Error(err))
+		os.Exit(result.ExitCode(err))
 	}
 }
 
-func integUefi(_ *cli.Context) error {
+func integUefi(_ *cli.Context, r *result.Result) error {
 	l.Info("Making ONIE default boot entry...")
-	if err := partitions.MakeONIEDefaultBootEntryAndCleanup(); err != nil {
+	if err := r.Step("make-onie-default-boot-entry", func(_ *result.Step) error {
+		return partitions.MakeONIEDefaultBootEntryAndCleanup()
+	}); err != nil {
 		l.Error("Making ONIE default boot entry failed", zap.Error(err))
 		return err
 	}
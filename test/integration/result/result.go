@@ -0,0 +1,170 @@
+// Copyright 2023 Hedgehog
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package result provides a uniform, machine-readable result document for the integration test commands.
+// All commands support the `--output` flag: with `text` they only log as usual, and with `json` they
+// additionally write the result document to stdout once the test finished. Logs always go to stderr.
+// The exit codes are the same for all commands, see `ExitCode`.
+package result
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"go.githedgehog.com/dasboot/pkg/version"
+
+	"github.com/urfave/cli/v2"
+)
+
+const (
+	OutputFlag = "output"
+	OutputText = "text"
+	OutputJSON = "json"
+)
+
+// exit codes of all integration test commands
+const (
+	ExitPassed = 0
+	ExitFailed = 1
+	ExitError  = 2
+)
+
+// ErrFailed is wrapped by all errors of failed tests as returned from `Run`
+var ErrFailed = errors.New("integration test failed")
+
+// Step is the result of a single test step
+type Step struct {
+	Name         string         `json:"name"`
+	Passed       bool           `json:"passed"`
+	Error        string         `json:"error,omitempty"`
+	Duration     string         `json:"duration"`
+	Measurements map[string]any `json:"measurements,omitempty"`
+}
+
+// Measure records a measurement for the step
+func (s *Step) Measure(key string, value any) {
+	if s.Measurements == nil {
+		s.Measurements = make(map[string]any)
+	}
+	s.Measurements[key] = value
+}
+
+// Result is the result document of an integration test run
+type Result struct {
+	Test     string    `json:"test"`
+	Command  string    `json:"command,omitempty"`
+	Version  string    `json:"version"`
+	Passed   bool      `json:"passed"`
+	Error    string    `json:"error,omitempty"`
+	ExitCode int       `json:"exit_code"`
+	Started  time.Time `json:"started"`
+	Duration string    `json:"duration"`
+	Steps    []*Step   `json:"steps"`
+}
+
+// New creates a new result document for the test `test`
+func New(test string) *Result {
+	return &Result{
+		Test:    test,
+		Version: version.Version,
+		Started: time.Now(),
+		Steps:   []*Step{},
+	}
+}
+
+// Step runs the test step `name` and records its result. It returns the error of `f`.
+func (r *Result) Step(name string, f func(s *Step) error) error {
+	s := &Step{Name: name}
+	start := time.Now()
+	err := f(s)
+	s.Duration = time.Since(start).String()
+	s.Passed = err == nil
+	if err != nil {
+		s.Error = err.Error()
+	}
+	r.Steps = append(r.Steps, s)
+	return err
+}
+
+// Finish records the overall result of the test
+func (r *Result) Finish(err error) {
+	r.Duration = time.Since(r.Started).String()
+	r.Passed = err == nil
+	r.ExitCode = ExitPassed
+	if err != nil {
+		r.Error = err.Error()
+		r.ExitCode = ExitFailed
+	}
+}
+
+// Write writes the result document as JSON to `w`
+func (r *Result) Write(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(r)
+}
+
+// Flags returns the flags which all integration test commands share
+func Flags() []cli.Flag {
+	return []cli.Flag{
+		&cli.StringFlag{
+			Name:  OutputFlag,
+			Usage: "output format: 'text' only logs, 'json' additionally writes a result document to stdout",
+			Value: OutputText,
+			Action: func(_ *cli.Context, v string) error {
+				if v != OutputText && v != OutputJSON {
+					return fmt.Errorf("unsupported output format '%s'", v)
+				}
+				return nil
+			},
+		},
+	}
+}
+
+// Run runs the test `f` as the command of `ctx`, and records the overall result. In JSON output mode it
+// writes the result document to stdout. Errors of failed tests are wrapped with `ErrFailed`.
+func Run(ctx *cli.Context, f func(r *Result) error) error {
+	r := New(ctx.App.Name)
+	if ctx.Command != nil && ctx.Command.Name != "" {
+		r.Command = ctx.Command.Name
+	}
+	err := f(r)
+	r.Finish(err)
+	if ctx.String(OutputFlag) == OutputJSON {
+		if werr := r.Write(os.Stdout); werr != nil {
+			return fmt.Errorf("writing result document: %w", werr)
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrFailed, err)
+	}
+	return nil
+}
+
+// ExitCode returns the exit code for the error as it was returned from running the command. Failed tests
+// exit with `ExitFailed`, and all other errors (like invalid flags) exit with `ExitError`.
+func ExitCode(err error) int {
+	switch {
+	case err == nil:
+		return ExitPassed
+	case errors.Is(err, ErrFailed):
+		return ExitFailed
+	default:
+		return ExitError
+	}
+}
@@ -0,0 +1,113 @@
+// Copyright 2023 Hedgehog
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package result
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"testing"
+)
+
+func TestResult(t *testing.T) {
+	errStep := errors.New("step failed")
+	tests := []struct {
+		name       string
+		steps      map[string]error
+		order      []string
+		wantPassed bool
+		wantExit   int
+	}{
+		{
+			name:       "all steps pass",
+			order:      []string{"one", "two"},
+			steps:      map[string]error{"one": nil, "two": nil},
+			wantPassed: true,
+			wantExit:   ExitPassed,
+		},
+		{
+			name:       "failing step",
+			order:      []string{"one", "two"},
+			steps:      map[string]error{"one": nil, "two": errStep},
+			wantPassed: false,
+			wantExit:   ExitFailed,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := New("integ-test")
+			var err error
+			for _, name := range tt.order {
+				if err = r.Step(name, func(s *Step) error {
+					s.Measure("name", name)
+					return tt.steps[name]
+				}); err != nil {
+					break
+				}
+			}
+			r.Finish(err)
+
+			var buf bytes.Buffer
+			if err := r.Write(&buf); err != nil {
+				t.Fatalf("Write() error = %v", err)
+			}
+			var got Result
+			if err := json.Unmarshal(buf.Bytes(), &got); err != nil {
+				t.Fatalf("unmarshal error = %v", err)
+			}
+			if got.Passed != tt.wantPassed {
+				t.Errorf("Passed = %v, want %v", got.Passed, tt.wantPassed)
+			}
+			if got.ExitCode != tt.wantExit {
+				t.Errorf("ExitCode = %v, want %v", got.ExitCode, tt.wantExit)
+			}
+			if len(got.Steps) != len(tt.order) {
+				t.Fatalf("len(Steps) = %d, want %d", len(got.Steps), len(tt.order))
+			}
+			for i, s := range got.Steps {
+				wantErr := tt.steps[tt.order[i]]
+				if s.Passed != (wantErr == nil) {
+					t.Errorf("step %s Passed = %v", s.Name, s.Passed)
+				}
+				if wantErr != nil && s.Error != wantErr.Error() {
+					t.Errorf("step %s Error = %q, want %q", s.Name, s.Error, wantErr.Error())
+				}
+				if s.Measurements["name"] != tt.order[i] {
+					t.Errorf("step %s measurements = %v", s.Name, s.Measurements)
+				}
+			}
+		})
+	}
+}
+
+func TestExitCode(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want int
+	}{
+		{name: "success", err: nil, want: ExitPassed},
+		{name: "failed test", err: fmt.Errorf("%w: boom", ErrFailed), want: ExitFailed},
+		{name: "usage error", err: errors.New("flag provided but not defined"), want: ExitError},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := ExitCode(tt.err); got != tt.want {
+				t.Errorf("ExitCode() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}